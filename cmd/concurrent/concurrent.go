@@ -64,7 +64,7 @@ var tests = []setenv.NFTablesTest{
 						L4: &nftableslib.L4Rule{
 							L4Proto: unix.IPPROTO_TCP,
 							Dst: &nftableslib.Port{
-								List:  nftableslib.SetPortList([]int{8888}),
+								List:  []uint16{8888},
 								RelOp: nftableslib.NEQ,
 							},
 						},
@@ -75,7 +75,7 @@ var tests = []setenv.NFTablesTest{
 						L4: &nftableslib.L4Rule{
 							L4Proto: unix.IPPROTO_TCP,
 							Dst: &nftableslib.Port{
-								List: nftableslib.SetPortList([]int{8888}),
+								List: []uint16{8888},
 							},
 						},
 						Action: setActionRedirect(9999, false),
@@ -113,7 +113,7 @@ var tests = []setenv.NFTablesTest{
 						L4: &nftableslib.L4Rule{
 							L4Proto: unix.IPPROTO_TCP,
 							Dst: &nftableslib.Port{
-								List:  nftableslib.SetPortList([]int{8888}),
+								List:  []uint16{8888},
 								RelOp: nftableslib.NEQ,
 							},
 						},
@@ -124,7 +124,7 @@ var tests = []setenv.NFTablesTest{
 						L4: &nftableslib.L4Rule{
 							L4Proto: unix.IPPROTO_TCP,
 							Dst: &nftableslib.Port{
-								List: nftableslib.SetPortList([]int{8888}),
+								List: []uint16{8888},
 							},
 						},
 						Action: setActionRedirect(9999, false),
@@ -64,7 +64,7 @@ func main() {
 							L4: &nftableslib.L4Rule{
 								L4Proto: unix.IPPROTO_TCP,
 								Dst: &nftableslib.Port{
-									List:  nftableslib.SetPortList([]int{8888}),
+									List:  []uint16{8888},
 									RelOp: nftableslib.NEQ,
 								},
 							},
@@ -75,7 +75,7 @@ func main() {
 							L4: &nftableslib.L4Rule{
 								L4Proto: unix.IPPROTO_TCP,
 								Dst: &nftableslib.Port{
-									List: nftableslib.SetPortList([]int{8888}),
+									List: []uint16{8888},
 								},
 							},
 							Action: setActionRedirect(9999, false),
@@ -116,7 +116,7 @@ func main() {
 							L4: &nftableslib.L4Rule{
 								L4Proto: unix.IPPROTO_TCP,
 								Dst: &nftableslib.Port{
-									List:  nftableslib.SetPortList([]int{8888}),
+									List:  []uint16{8888},
 									RelOp: nftableslib.NEQ,
 								},
 							},
@@ -127,7 +127,7 @@ func main() {
 							L4: &nftableslib.L4Rule{
 								L4Proto: unix.IPPROTO_TCP,
 								Dst: &nftableslib.Port{
-									List: nftableslib.SetPortList([]int{8888}),
+									List: []uint16{8888},
 								},
 							},
 							Action: setActionRedirect(9999, false),
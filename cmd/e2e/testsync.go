@@ -30,7 +30,7 @@ func testSync() error {
 						L4: &nftableslib.L4Rule{
 							L4Proto: unix.IPPROTO_TCP,
 							Dst: &nftableslib.Port{
-								List:  nftableslib.SetPortList([]int{8888}),
+								List:  []uint16{8888},
 								RelOp: nftableslib.NEQ,
 							},
 						},
@@ -41,7 +41,7 @@ func testSync() error {
 						L4: &nftableslib.L4Rule{
 							L4Proto: unix.IPPROTO_TCP,
 							Dst: &nftableslib.Port{
-								List: nftableslib.SetPortList([]int{8888}),
+								List: []uint16{8888},
 							},
 						},
 						Action: setActionRedirect(9999, false),
@@ -127,7 +127,7 @@ func testSync() error {
 	newTI := setenv.MakeTablesInterface(ns)
 
 	// Attempting to Sync with already existing tables/chains/rules
-	if err := newTI.Tables().Sync(test.Version); err != nil {
+	if _, err := newTI.Tables().Sync(test.Version); err != nil {
 		return fmt.Errorf("fail to Sync with error: %+v", err)
 	}
 
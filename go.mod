@@ -7,7 +7,7 @@ require (
 	github.com/google/gopacket v1.1.17
 	github.com/google/nftables v0.0.0-20200316075819-7127d9d22474
 	github.com/google/uuid v1.1.1
-	github.com/mdlayher/netlink v1.1.0 // indirect
+	github.com/mdlayher/netlink v1.1.0
 	github.com/sbezverk/nftableslib/e2e/setenv v0.0.0-20191010164456-029e0d78cdb1 // indirect
 	github.com/vishvananda/netlink v1.0.0
 	github.com/vishvananda/netns v0.0.0-20190625233234-7109fa855b0f
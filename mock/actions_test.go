@@ -0,0 +1,143 @@
+package mock
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"github.com/sbezverk/nftableslib"
+	"golang.org/x/sys/unix"
+)
+
+func TestRuleActions(t *testing.T) {
+	table := &nftables.Table{Name: "filter", Family: nftables.TableFamilyIPv4}
+	m := InitMockConn()
+	if err := m.ti.Tables().CreateImm(table.Name, table.Family); err != nil {
+		t.Fatalf("failed to create table with error: %+v", err)
+	}
+	ci, _ := m.ti.Tables().TableChains(table.Name, table.Family)
+	if err := ci.Chains().CreateImm("input", nil); err != nil {
+		t.Fatalf("failed to create chain with error: %+v", err)
+	}
+	ri, _ := ci.Chains().Chain("input")
+	ssh := func(actions ...*nftableslib.RuleAction) *nftableslib.Rule {
+		return &nftableslib.Rule{
+			L4: &nftableslib.L4Rule{
+				L4Proto: unix.IPPROTO_TCP,
+				Dst:     &nftableslib.Port{List: []uint16{22}},
+			},
+			Actions: actions,
+		}
+	}
+	log, err := nftableslib.SetLog(unix.NFTA_LOG_PREFIX, []byte("ssh"))
+	if err != nil {
+		t.Fatalf("failed to build log with error: %+v", err)
+	}
+	logAction, err := nftableslib.SetLogAction(log)
+	if err != nil {
+		t.Fatalf("failed to build log action with error: %+v", err)
+	}
+	queue, err := nftableslib.SetQueue(2, 4, true, false)
+	if err != nil {
+		t.Fatalf("failed to build queue action with error: %+v", err)
+	}
+	accept := setActionVerdict(t, nftableslib.NFT_ACCEPT)
+	drop := setActionVerdict(t, nftableslib.NFT_DROP)
+	trace := []expr.Any{
+		&expr.Immediate{Register: 1, Data: []byte{1}},
+		&expr.Meta{Key: expr.MetaKeyNFTRACE, Register: 1, SourceRegister: true},
+	}
+	mark := []expr.Any{
+		&expr.Immediate{Register: 1, Data: binaryutil.NativeEndian.PutUint32(0x10)},
+		&expr.Meta{Key: expr.MetaKey(unix.NFT_META_MARK), Register: 1, SourceRegister: true},
+	}
+	ctMark := []expr.Any{
+		&expr.Immediate{Register: 1, Data: binaryutil.NativeEndian.PutUint32(0x20)},
+		&expr.Ct{Key: expr.CtKeyMARK, Register: 1, SourceRegister: true},
+	}
+	concat := func(lists ...[]expr.Any) []expr.Any {
+		re := []expr.Any{}
+		for _, l := range lists {
+			re = append(re, l...)
+		}
+		return re
+	}
+
+	tests := []struct {
+		name string
+		rule *nftableslib.Rule
+		// tail carries expressions expected after matches of the rule
+		tail []expr.Any
+	}{
+		{
+			name: "counter, log, mark set then accept",
+			rule: ssh(nftableslib.SetCounterAction(), logAction, nftableslib.SetMarkAction(0x10, 0), accept),
+			tail: concat(
+				[]expr.Any{&expr.Counter{}, &expr.Log{Key: unix.NFTA_LOG_PREFIX, Data: []byte("ssh")}},
+				mark,
+				[]expr.Any{&expr.Verdict{Kind: expr.VerdictAccept}},
+			),
+		},
+		{
+			name: "nftrace and ct mark set in declared order then queue",
+			rule: ssh(nftableslib.SetCtMarkAction(0x20), nftableslib.SetNFTraceAction(), queue),
+			tail: concat(ctMark, trace, []expr.Any{&expr.Queue{Num: 2, Total: 4, Flag: expr.QueueFlagBypass}}),
+		},
+		{
+			name: "non-terminal actions only",
+			rule: ssh(nftableslib.SetNFTraceAction(), nftableslib.SetCounterAction()),
+			tail: concat(trace, []expr.Any{&expr.Counter{}}),
+		},
+		{
+			name: "single non-terminal Action",
+			rule: &nftableslib.Rule{
+				L4:     &nftableslib.L4Rule{L4Proto: unix.IPPROTO_TCP, Dst: &nftableslib.Port{List: []uint16{22}}},
+				Action: nftableslib.SetMarkAction(0x10, 0),
+			},
+			tail: mark,
+		},
+	}
+	for _, tt := range tests {
+		if _, err := ri.Rules().CreateImm(tt.rule); err != nil {
+			t.Fatalf("Test \"%s\" failed with error: %+v but supposed to succeed", tt.name, err)
+		}
+		rules, err := m.GetRule(table, &nftables.Chain{Name: "input", Table: table})
+		if err != nil {
+			t.Fatalf("Test \"%s\" failed to get rules with error: %+v", tt.name, err)
+		}
+		got := rules[len(rules)-1].Exprs
+		if len(got) < len(tt.tail) || !reflect.DeepEqual(got[len(got)-len(tt.tail):], tt.tail) {
+			t.Fatalf("Test \"%s\" failed, expected rule to end with %+v, got %+v", tt.name, tt.tail, got)
+		}
+	}
+
+	// Terminal actions can appear only once and last
+	for _, tt := range []struct {
+		name string
+		rule *nftableslib.Rule
+	}{
+		{"terminal action followed by non-terminal", ssh(accept, nftableslib.SetCounterAction())},
+		{"two terminal actions", ssh(nftableslib.SetCounterAction(), queue, drop)},
+		{"duplicate terminal action", ssh(accept, accept)},
+		{"nil action", ssh(nftableslib.SetCounterAction(), nil, accept)},
+		{"Action and Actions", &nftableslib.Rule{Action: accept, Actions: []*nftableslib.RuleAction{nftableslib.SetCounterAction()}}},
+	} {
+		if err := tt.rule.Validate(); err == nil {
+			t.Fatalf("Test \"%s\" is supposed to fail validation", tt.name)
+		}
+		if _, err := ri.Rules().CreateImm(tt.rule); err == nil {
+			t.Fatalf("Test \"%s\" is supposed to fail", tt.name)
+		}
+	}
+	if rules, _ := m.GetRule(table, &nftables.Chain{Name: "input", Table: table}); len(rules) != len(tests) {
+		t.Fatalf("failed rules are not expected to be programmed, got %d rules", len(rules))
+	}
+	if _, err := nftableslib.SetQueue(65535, 2, false, false); err == nil {
+		t.Fatalf("queue range exceeding maximum queue number is supposed to fail")
+	}
+	if _, err := nftableslib.SetLogAction(&nftableslib.Log{Key: 100}); err == nil {
+		t.Fatalf("log action with unsupported key is supposed to fail")
+	}
+}
@@ -0,0 +1,101 @@
+package mock
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/google/nftables"
+	"github.com/sbezverk/nftableslib"
+)
+
+func TestAddrListNormalization(t *testing.T) {
+	tests := []struct {
+		name       string
+		family     nftables.TableFamily
+		list       []string
+		strict     bool
+		duplicates int
+		covered    int
+	}{
+		{
+			name:   "ipv4 list without overlaps",
+			family: nftables.TableFamilyIPv4,
+			list:   []string{"10.0.0.1", "10.0.0.2", "192.168.0.0/16"},
+		},
+		{
+			name:       "ipv4 list with duplicates and nesting",
+			family:     nftables.TableFamilyIPv4,
+			list:       []string{"10.0.0.1", "10.0.0.0/8", "192.168.1.1", "192.168.1.1", "10.1.0.0/16"},
+			duplicates: 1,
+			covered:    2,
+		},
+		{
+			name:       "ipv6 list with duplicates and nesting",
+			family:     nftables.TableFamilyIPv6,
+			list:       []string{"2001:db8::/32", "2001:db8::1", "fd00::1", "fd00::1"},
+			duplicates: 1,
+			covered:    1,
+		},
+		{
+			name:       "strict ipv6 list with duplicates",
+			family:     nftables.TableFamilyIPv6,
+			list:       []string{"fd00::1", "fd00::2", "fd00::1"},
+			strict:     true,
+			duplicates: 1,
+		},
+	}
+	for _, tt := range tests {
+		warnings := make([]error, 0)
+		opts := []nftableslib.TableOption{nftableslib.WithWarningHandler(func(w error) {
+			warnings = append(warnings, w)
+		})}
+		if tt.strict {
+			opts = append(opts, nftableslib.WithStrictAddrLists())
+		}
+		m := InitMockConn()
+		if err := m.ti.Tables().CreateImm("filter", tt.family, opts...); err != nil {
+			t.Fatalf("Test \"%s\" failed to create table with error: %+v", tt.name, err)
+		}
+		ci, _ := m.ti.Tables().TableChains("filter", tt.family)
+		if err := ci.Chains().CreateImm("input", nil); err != nil {
+			t.Fatalf("Test \"%s\" failed to create chain with error: %+v", tt.name, err)
+		}
+		ri, _ := ci.Chains().Chain("input")
+		list := make([]*nftableslib.IPAddr, 0, len(tt.list))
+		for _, a := range tt.list {
+			addr, err := nftableslib.NewIPAddr(a)
+			if err != nil {
+				t.Fatalf("Test \"%s\" failed to parse address %s with error: %+v", tt.name, a, err)
+			}
+			list = append(list, addr)
+		}
+		_, err := ri.Rules().CreateImm(&nftableslib.Rule{
+			L3:     &nftableslib.L3Rule{Src: &nftableslib.IPAddrSpec{List: list}},
+			Action: setActionVerdict(t, nftableslib.NFT_DROP),
+		})
+		normalized := tt.duplicates != 0 || tt.covered != 0
+		var w *nftableslib.AddrListNormalized
+		switch {
+		case tt.strict:
+			if !errors.As(err, &w) {
+				t.Fatalf("Test \"%s\" failed, expected AddrListNormalized error, got %+v", tt.name, err)
+			}
+			if n, _ := ci.Chains().RuleCount("input"); n != 0 {
+				t.Fatalf("Test \"%s\" failed, rule is not supposed to be created", tt.name)
+			}
+		case err != nil:
+			t.Fatalf("Test \"%s\" failed with error: %+v but supposed to succeed", tt.name, err)
+		case !normalized:
+			if len(warnings) != 0 {
+				t.Fatalf("Test \"%s\" failed, unexpected warnings %+v", tt.name, warnings)
+			}
+			continue
+		case len(warnings) != 1 || !errors.As(warnings[0], &w):
+			t.Fatalf("Test \"%s\" failed, expected AddrListNormalized warning, got %+v", tt.name, warnings)
+		}
+		if w.Table != "filter" || w.Chain != "input" || len(w.Duplicates) != tt.duplicates || len(w.Covered) != tt.covered {
+			t.Fatalf("Test \"%s\" failed, expected %d duplicates and %d covered addresses in chain input of table filter, got %+v",
+				tt.name, tt.duplicates, tt.covered, w)
+		}
+	}
+}
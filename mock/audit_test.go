@@ -0,0 +1,138 @@
+package mock
+
+import (
+	"testing"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"github.com/sbezverk/nftableslib"
+	"golang.org/x/sys/unix"
+)
+
+func TestAuditRuleset(t *testing.T) {
+	table := &nftables.Table{Name: "filter", Family: nftables.TableFamilyIPv4}
+	rules := []struct {
+		name   string
+		rule   *nftableslib.Rule
+		status nftableslib.AuditStatus
+	}{
+		{
+			name: "tcp dport { 80, 443 } counter accept",
+			rule: &nftableslib.Rule{
+				L4: &nftableslib.L4Rule{
+					L4Proto: unix.IPPROTO_TCP,
+					Dst:     &nftableslib.Port{List: []uint16{80, 443}},
+					Counter: &nftableslib.Counter{},
+				},
+				Action: setActionVerdict(t, nftableslib.NFT_ACCEPT),
+			},
+			status: nftableslib.AuditMapped,
+		},
+		{
+			name: "ip saddr { 10.0.0.0/8, 192.168.1.1 } drop",
+			rule: &nftableslib.Rule{
+				L3: &nftableslib.L3Rule{
+					Src: &nftableslib.IPAddrSpec{
+						List: []*nftableslib.IPAddr{setIPAddr(t, "10.0.0.0/8"), setIPAddr(t, "192.168.1.1")},
+					},
+				},
+				Action: setActionVerdict(t, nftableslib.NFT_DROP),
+			},
+			status: nftableslib.AuditMapped,
+		},
+		{
+			name: "tcp dport 1000-2000 meta mark set 0x10 accept",
+			rule: &nftableslib.Rule{
+				L4: &nftableslib.L4Rule{
+					L4Proto: unix.IPPROTO_TCP,
+					Dst:     &nftableslib.Port{Range: [2]uint16{1000, 2000}},
+				},
+				Meta: &nftableslib.MetaRule{
+					Mark: &nftableslib.MetaMark{Set: true, Value: 0x10},
+				},
+				Action: setActionVerdict(t, nftableslib.NFT_ACCEPT),
+			},
+			status: nftableslib.AuditMapped,
+		},
+		{
+			name: "notrack",
+			rule: &nftableslib.Rule{
+				RawExprs: []expr.Any{&expr.Notrack{}},
+			},
+			status: nftableslib.AuditPartial,
+		},
+	}
+	m := InitMockConn()
+	if err := m.ti.Tables().CreateImm(table.Name, table.Family); err != nil {
+		t.Fatalf("failed to create table with error: %+v", err)
+	}
+	ci, err := m.ti.Tables().TableChains(table.Name, table.Family)
+	if err != nil {
+		t.Fatalf("failed to get chains with error: %+v", err)
+	}
+	if err := ci.Chains().CreateImm("input", nil); err != nil {
+		t.Fatalf("failed to create chain with error: %+v", err)
+	}
+	ri, err := ci.Chains().Chain("input")
+	if err != nil {
+		t.Fatalf("failed to get rules with error: %+v", err)
+	}
+	for _, tt := range rules {
+		if _, err := ri.Rules().CreateImm(tt.rule); err != nil {
+			t.Fatalf("Test \"%s\" failed with error: %+v but supposed to succeed", tt.name, err)
+		}
+	}
+	// tcp dport vmap { 22 : accept } programmed by the nft CLI
+	vmap := &nftables.Set{
+		Table:     table,
+		Name:      "__map%d",
+		Anonymous: true,
+		Constant:  true,
+		IsMap:     true,
+		KeyType:   nftables.TypeInetService,
+		DataType:  nftables.TypeVerdict,
+	}
+	if err := m.AddSet(vmap, []nftables.SetElement{
+		{Key: binaryutil.BigEndian.PutUint16(22), VerdictData: &expr.Verdict{Kind: expr.VerdictAccept}},
+	}); err != nil {
+		t.Fatalf("failed to add verdict map with error: %+v", err)
+	}
+	m.AddRule(&nftables.Rule{
+		Table: table,
+		Chain: &nftables.Chain{Name: "input", Table: table},
+		Exprs: []expr.Any{
+			&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{unix.IPPROTO_TCP}},
+			&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 2, Len: 2},
+			&expr.Lookup{SourceRegister: 1, SetName: vmap.Name, IsDestRegSet: true},
+		},
+	})
+	if err := m.Flush(); err != nil {
+		t.Fatalf("failed to flush with error: %+v", err)
+	}
+
+	report, err := m.ti.Tables().AuditRuleset()
+	if err != nil {
+		t.Fatalf("failed to audit ruleset with error: %+v", err)
+	}
+	if len(report.Rules) != len(rules)+1 {
+		t.Fatalf("expected %d audited rules, got %d", len(rules)+1, len(report.Rules))
+	}
+	for i, tt := range rules {
+		ra := report.Rules[i]
+		if ra.Status != tt.status {
+			t.Fatalf("Test \"%s\" failed, expected status %s, got %s with reasons: %v", tt.name, tt.status, ra.Status, ra.Reasons)
+		}
+		if ra.Table.Name != table.Name || ra.Chain != "input" || ra.Handle == 0 {
+			t.Fatalf("Test \"%s\" failed, audited rule is not located: %s %s %d", tt.name, ra.Table.Name, ra.Chain, ra.Handle)
+		}
+	}
+	if ra := report.Rules[len(rules)]; ra.Status != nftableslib.AuditOpaque || len(ra.Reasons) == 0 {
+		t.Fatalf("Test \"vmap\" failed, expected opaque rule with reasons, got %s with reasons: %v", ra.Status, ra.Reasons)
+	}
+	if report.Count(nftableslib.AuditMapped) != 3 || report.Count(nftableslib.AuditPartial) != 1 || report.Count(nftableslib.AuditOpaque) != 1 {
+		t.Fatalf("unexpected report counts %d mapped, %d partial, %d opaque", report.Count(nftableslib.AuditMapped),
+			report.Count(nftableslib.AuditPartial), report.Count(nftableslib.AuditOpaque))
+	}
+}
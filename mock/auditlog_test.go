@@ -0,0 +1,267 @@
+package mock
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"github.com/sbezverk/nftableslib"
+	"golang.org/x/sys/unix"
+)
+
+// rulesetState describes the ruleset of the mock, expressions of rules are described by their encoding
+func rulesetState(t *testing.T, m *Mock) string {
+	m.Lock()
+	defer m.Unlock()
+	var b strings.Builder
+	for _, table := range m.ruleset.tables {
+		fmt.Fprintf(&b, "table %d %s %d\n", table.Family, table.Name, table.Flags)
+		sets := m.ruleset.sets[tableKey(table)]
+		sort.Slice(sets, func(i, j int) bool { return sets[i].set.Name < sets[j].set.Name })
+		for _, ms := range sets {
+			s := ms.set
+			fmt.Fprintf(&b, " set %s %t %t %t %t %d %d\n", s.Name, s.Anonymous, s.IsMap, s.Interval, s.Constant,
+				s.KeyType.GetNFTMagic(), s.DataType.GetNFTMagic())
+			for _, e := range ms.elements {
+				fmt.Fprintf(&b, "  %x %x %t %+v\n", e.Key, e.Val, e.IntervalEnd, e.VerdictData)
+			}
+		}
+	}
+	for _, c := range m.ruleset.chains {
+		fmt.Fprintf(&b, "chain %d %s %s %s %d %d %v\n", c.Table.Family, c.Table.Name, c.Name, c.Type, c.Hooknum, c.Priority, c.Policy != nil && *c.Policy == nftables.ChainPolicyAccept)
+		for _, r := range m.ruleset.rules[chainKey(c.Table, c.Name)] {
+			fmt.Fprintf(&b, " rule %d", r.Handle)
+			for _, e := range r.Exprs {
+				data, err := expr.Marshal(e)
+				if err != nil {
+					t.Fatalf("failed to encode expression with error: %+v", err)
+				}
+				fmt.Fprintf(&b, " %x", data)
+			}
+			b.WriteString("\n")
+		}
+	}
+
+	return b.String()
+}
+
+// recordSession programs tables, chains, sets and rules through the connection wrapped by the audit sink
+func recordSession(t *testing.T, nft nftableslib.TablesInterface) {
+	for _, name := range []string{"filter", "scratch"} {
+		if err := nft.Tables().CreateImm(name, nftables.TableFamilyIPv4); err != nil {
+			t.Fatalf("failed to create table %s with error: %+v", name, err)
+		}
+	}
+	ci, err := nft.Tables().Table("filter", nftables.TableFamilyIPv4)
+	if err != nil {
+		t.Fatalf("failed to get chains with error: %+v", err)
+	}
+	drop := nftableslib.ChainPolicyDrop
+	if err := ci.Chains().CreateImm("input", &nftableslib.ChainAttributes{
+		Type:     nftables.ChainTypeFilter,
+		Hook:     nftables.ChainHookInput,
+		Priority: nftables.ChainPriorityFilter,
+		Policy:   &drop,
+	}); err != nil {
+		t.Fatalf("failed to create chain input with error: %+v", err)
+	}
+	for _, name := range []string{"app", "temporary"} {
+		if err := ci.Chains().CreateImm(name, nil); err != nil {
+			t.Fatalf("failed to create chain %s with error: %+v", name, err)
+		}
+	}
+	si, err := nft.Tables().TableSets("filter", nftables.TableFamilyIPv4)
+	if err != nil {
+		t.Fatalf("failed to get sets with error: %+v", err)
+	}
+	blocked, err := si.Sets().CreateSet(&nftableslib.SetAttributes{Name: "blocked", Interval: true, KeyType: nftables.TypeIPAddr},
+		[]nftables.SetElement{
+			{Key: net.ParseIP("198.51.100.0").To4()},
+			{Key: net.ParseIP("198.51.101.0").To4(), IntervalEnd: true},
+		})
+	if err != nil {
+		t.Fatalf("failed to create set with error: %+v", err)
+	}
+	if err := si.Sets().SetAddElements(blocked.Name, []nftables.SetElement{
+		{Key: net.ParseIP("203.0.113.0").To4()},
+		{Key: net.ParseIP("203.0.114.0").To4(), IntervalEnd: true},
+	}); err != nil {
+		t.Fatalf("failed to add elements with error: %+v", err)
+	}
+	input, err := ci.Chains().Chain("input")
+	if err != nil {
+		t.Fatalf("failed to get rules with error: %+v", err)
+	}
+	rules := []*nftableslib.Rule{
+		{
+			L3:     &nftableslib.L3Rule{Src: &nftableslib.IPAddrSpec{SetRef: &nftableslib.SetRef{Name: blocked.Name, ID: blocked.ID}}},
+			Action: setActionVerdict(t, nftableslib.NFT_DROP),
+		},
+		{
+			L4:     &nftableslib.L4Rule{L4Proto: unix.IPPROTO_TCP, Dst: &nftableslib.Port{List: []uint16{80, 443}}},
+			Action: setActionVerdict(t, unix.NFT_JUMP, "app"),
+		},
+		{
+			L4:     &nftableslib.L4Rule{L4Proto: unix.IPPROTO_UDP, Dst: &nftableslib.Port{Range: [2]uint16{5000, 5100}}},
+			Action: setActionVerdict(t, nftableslib.NFT_ACCEPT),
+		},
+	}
+	handles := make([]uint64, 0, len(rules))
+	for _, r := range rules {
+		h, err := input.Rules().CreateImm(r)
+		if err != nil {
+			t.Fatalf("failed to create rule with error: %+v", err)
+		}
+		handles = append(handles, h)
+	}
+	if err := input.Rules().DeleteImm(handles[2]); err != nil {
+		t.Fatalf("failed to delete rule with error: %+v", err)
+	}
+	if err := input.Rules().Update(&nftableslib.Rule{
+		L4:     &nftableslib.L4Rule{L4Proto: unix.IPPROTO_TCP, Dst: &nftableslib.Port{List: []uint16{8080}}},
+		Action: setActionVerdict(t, unix.NFT_JUMP, "app"),
+	}, handles[1]); err != nil {
+		t.Fatalf("failed to update rule with error: %+v", err)
+	}
+	app, err := ci.Chains().Chain("app")
+	if err != nil {
+		t.Fatalf("failed to get rules with error: %+v", err)
+	}
+	if _, err := app.Rules().CreateImm(&nftableslib.Rule{
+		Conntracks: []*nftableslib.Conntrack{{Key: unix.NFT_CT_STATE, Value: binaryutil.BigEndian.PutUint32(nftableslib.CTStateEstablished)}},
+		Action:     setActionVerdict(t, nftableslib.NFT_ACCEPT),
+	}); err != nil {
+		t.Fatalf("failed to create rule with error: %+v", err)
+	}
+	if err := si.Sets().SetDelElements(blocked.Name, []nftables.SetElement{
+		{Key: net.ParseIP("203.0.113.0").To4()},
+		{Key: net.ParseIP("203.0.114.0").To4(), IntervalEnd: true},
+	}); err != nil {
+		t.Fatalf("failed to delete elements with error: %+v", err)
+	}
+	if err := ci.Chains().DeleteImm("temporary"); err != nil {
+		t.Fatalf("failed to delete chain with error: %+v", err)
+	}
+	if err := nft.Tables().DeleteImm("scratch", nftables.TableFamilyIPv4); err != nil {
+		t.Fatalf("failed to delete table with error: %+v", err)
+	}
+}
+
+func decodeRecords(t *testing.T, log []byte) []*nftableslib.AuditRecord {
+	records := make([]*nftableslib.AuditRecord, 0)
+	scanner := bufio.NewScanner(bytes.NewReader(log))
+	for scanner.Scan() {
+		r := &nftableslib.AuditRecord{}
+		if err := json.Unmarshal(scanner.Bytes(), r); err != nil {
+			t.Fatalf("failed to decode record with error: %+v", err)
+		}
+		records = append(records, r)
+	}
+
+	return records
+}
+
+func TestAuditLogReplay(t *testing.T) {
+	m := InitMockConn()
+	var log, tableLog bytes.Buffer
+	sink := nftableslib.NewJSONAuditSink(&log)
+	tableSink := nftableslib.NewJSONAuditSink(&tableLog)
+	nft := nftableslib.InitNFTables(m, nftableslib.WithAuditSink(teeSink{sink, nftableslib.TableAuditSink(nftables.TableFamilyIPv4, "filter", tableSink)}))
+	recordSession(t, nft)
+	if err := sink.Err(); err != nil {
+		t.Fatalf("failed to write records with error: %+v", err)
+	}
+
+	ops := make(map[nftableslib.AuditOp]int)
+	for _, r := range decodeRecords(t, log.Bytes()) {
+		ops[r.Op]++
+		if r.Time.IsZero() || r.Outcome == "" {
+			t.Fatalf("record %+v misses time or outcome", *r)
+		}
+		switch r.Op {
+		case nftableslib.AuditFlush:
+			if r.Outcome != nftableslib.AuditOK {
+				t.Fatalf("unexpected outcome of flush %+v", *r)
+			}
+		case nftableslib.AuditReplaceRule, nftableslib.AuditDelRule:
+			if r.Before == "" {
+				t.Fatalf("record %+v misses the rule before the operation", *r)
+			}
+		default:
+			if r.Outcome != nftableslib.AuditQueued {
+				t.Fatalf("unexpected outcome of queued operation %+v", *r)
+			}
+		}
+	}
+	for _, op := range []nftableslib.AuditOp{
+		nftableslib.AuditAddTable, nftableslib.AuditDelTable, nftableslib.AuditAddChain, nftableslib.AuditDelChain,
+		nftableslib.AuditAddRule, nftableslib.AuditReplaceRule, nftableslib.AuditDelRule, nftableslib.AuditAddSet,
+		nftableslib.AuditAddElements, nftableslib.AuditDelElements, nftableslib.AuditFlush,
+	} {
+		if ops[op] == 0 {
+			t.Fatalf("operation %s is not recorded", op)
+		}
+	}
+	for _, r := range decodeRecords(t, tableLog.Bytes()) {
+		if r.Table == "scratch" {
+			t.Fatalf("record %+v of table scratch passed to the sink of table filter", *r)
+		}
+	}
+
+	tests := []struct {
+		name string
+		log  []byte
+	}{
+		{name: "Global log", log: log.Bytes()},
+		{name: "Table log", log: tableLog.Bytes()},
+	}
+	want := rulesetState(t, m)
+	for _, tt := range tests {
+		replayed := InitMockConn()
+		if err := nftableslib.Replay(bytes.NewReader(tt.log), replayed); err != nil {
+			t.Fatalf("Test \"%s\" failed with error: %+v but supposed to succeed", tt.name, err)
+		}
+		if got := rulesetState(t, replayed); got != want {
+			t.Fatalf("Test \"%s\" replayed ruleset differs:\n%s\nexpected:\n%s", tt.name, got, want)
+		}
+	}
+}
+
+func TestAuditLogFailure(t *testing.T) {
+	m := InitMockConn()
+	var log bytes.Buffer
+	nft := nftableslib.InitNFTables(m, nftableslib.WithAuditSink(nftableslib.NewJSONAuditSink(&log)))
+	m.FailAt(0, unix.EINVAL)
+	if err := nft.Tables().CreateImm("filter", nftables.TableFamilyIPv4); err == nil {
+		t.Fatalf("creation of table supposed to fail")
+	}
+	records := decodeRecords(t, log.Bytes())
+	last := records[len(records)-1]
+	if last.Op != nftableslib.AuditFlush || last.Outcome != nftableslib.AuditFailed || last.Error == "" {
+		t.Fatalf("expected failed flush, got %+v", *last)
+	}
+	if len(last.Tables) != 1 || last.Tables[0].Name != "filter" {
+		t.Fatalf("expected flush of table filter, got %+v", last.Tables)
+	}
+	// The failure was injected, so the replayed flush succeeds
+	if err := nftableslib.Replay(bytes.NewReader(log.Bytes()), InitMockConn()); err == nil {
+		t.Fatalf("replay of the failed flush supposed to fail")
+	}
+}
+
+// teeSink passes records to all sinks
+type teeSink []nftableslib.AuditSink
+
+func (s teeSink) Record(r *nftableslib.AuditRecord) {
+	for _, sink := range s {
+		sink.Record(r)
+	}
+}
@@ -0,0 +1,83 @@
+package mock
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/google/nftables"
+	"github.com/sbezverk/nftableslib"
+	"golang.org/x/sys/unix"
+)
+
+func TestBatchErrorAttribution(t *testing.T) {
+	m := InitMockConn()
+	if err := m.ti.Tables().CreateImm("filter", nftables.TableFamilyIPv4); err != nil {
+		t.Fatalf("failed to create table filter with error: %+v", err)
+	}
+	ci, err := m.ti.Tables().TableChains("filter", nftables.TableFamilyIPv4)
+	if err != nil {
+		t.Fatalf("failed to get chains interface for table filter")
+	}
+	if err := ci.Chains().CreateImm("input", nil); err != nil {
+		t.Fatalf("failed to create chain input with error: %+v", err)
+	}
+	ri, err := ci.Chains().Chain("input")
+	if err != nil {
+		t.Fatalf("failed to get rules interface for chain input")
+	}
+	ids := make([]uint32, 0, 3)
+	for _, port := range []int{22, 80, 443} {
+		id, err := ri.Rules().Create(&nftableslib.Rule{
+			L4: &nftableslib.L4Rule{
+				L4Proto: unix.IPPROTO_TCP,
+				Dst:     &nftableslib.Port{List: []uint16{uint16(port)}},
+			},
+			Action: setActionVerdict(t, nftableslib.NFT_ACCEPT),
+		})
+		if err != nil {
+			t.Fatalf("failed to create rule for port %d with error: %+v", port, err)
+		}
+		ids = append(ids, id)
+	}
+	m.FailAt(1, unix.EINVAL)
+	err = m.Flush()
+	be, ok := err.(*nftableslib.BatchError)
+	if !ok {
+		t.Fatalf("expected BatchError, got %T: %+v", err, err)
+	}
+	want := nftableslib.BatchError{Index: 1, Operation: "add rule", Table: "filter", Chain: "input", RuleID: ids[1], Err: unix.EINVAL}
+	if *be != want {
+		t.Fatalf("expected error %+v, got %+v", want, *be)
+	}
+	if !errors.Is(err, unix.EINVAL) {
+		t.Fatalf("expected error to wrap %+v", unix.EINVAL)
+	}
+	rules, err := m.GetRule(&nftables.Table{Name: "filter", Family: nftables.TableFamilyIPv4}, &nftables.Chain{Name: "input"})
+	if err != nil {
+		t.Fatalf("failed to get rules with error: %+v", err)
+	}
+	if len(rules) != 0 {
+		t.Fatalf("expected failed batch not to program rules, got %d rules", len(rules))
+	}
+
+	// Immediate operations return BatchError without wrapping it
+	m.FailAt(0, unix.EOPNOTSUPP)
+	_, err = ri.Rules().CreateImm(&nftableslib.Rule{Action: setActionVerdict(t, nftableslib.NFT_DROP)})
+	be, ok = err.(*nftableslib.BatchError)
+	if !ok {
+		t.Fatalf("expected BatchError, got %T: %+v", err, err)
+	}
+	if be.Operation != "add rule" || be.Chain != "input" || be.RuleID == 0 || be.Err != unix.EOPNOTSUPP {
+		t.Fatalf("unexpected attribution of the failed rule: %+v", *be)
+	}
+	m.FailAt(0, unix.ENOMEM)
+	err = ci.Chains().CreateImm("forward", nil)
+	be, ok = err.(*nftableslib.BatchError)
+	if !ok {
+		t.Fatalf("expected BatchError, got %T: %+v", err, err)
+	}
+	want = nftableslib.BatchError{Operation: "add chain", Table: "filter", Chain: "forward", Err: unix.ENOMEM}
+	if *be != want {
+		t.Fatalf("expected error %+v, got %+v", want, *be)
+	}
+}
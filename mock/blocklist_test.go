@@ -0,0 +1,180 @@
+package mock
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/sbezverk/nftableslib"
+)
+
+// checkBlocklistSet validates the number of elements in the blocklist set and that every element
+// opening an interval carries the timeout of its entry.
+func checkBlocklistSet(t *testing.T, m *Mock, name string, timeouts map[string]time.Duration, n int) {
+	t.Helper()
+	m.Lock()
+	defer m.Unlock()
+	m.ruleset.expire(m.now())
+	table := &nftables.Table{Name: "blocklist", Family: nftables.TableFamilyINet}
+	s := m.ruleset.getSet(table, name)
+	if s == nil {
+		t.Fatalf("set %s does not exist", name)
+	}
+	if !s.set.Interval || !s.set.HasTimeout {
+		t.Fatalf("set %s is expected to have interval and timeout flags", name)
+	}
+	if len(s.elements) != n {
+		t.Fatalf("set %s is expected to have %d elements, got %d: %+v", name, n, len(s.elements), s.elements)
+	}
+	for i := 0; i < len(s.elements); i += 2 {
+		start, end := s.elements[i], s.elements[i+1]
+		if start.IntervalEnd || !end.IntervalEnd {
+			t.Fatalf("set %s elements are not pairs of interval start and end: %+v", name, s.elements)
+		}
+		ttl, ok := timeouts[string(start.Key)]
+		if !ok {
+			t.Fatalf("set %s carries unexpected element %v", name, start.Key)
+		}
+		if start.Timeout != ttl || end.Timeout != 0 {
+			t.Fatalf("set %s element %v has timeouts %s/%s, expected %s/0s", name, start.Key, start.Timeout, end.Timeout, ttl)
+		}
+	}
+}
+
+func TestBlocklist(t *testing.T) {
+	m := InitMockConn()
+	clock := time.Unix(1000, 0)
+	now := func() time.Time { return clock }
+	m.now = now
+	bl, err := nftableslib.NewBlocklist(m.ti, "blocklist", now)
+	if err != nil {
+		t.Fatalf("failed to create blocklist with error: %+v", err)
+	}
+	table := &nftables.Table{Name: "blocklist", Family: nftables.TableFamilyINet}
+	rules := m.ruleset.rules[chainKey(table, nftableslib.BlocklistChainName)]
+	if len(rules) != 2 {
+		t.Fatalf("expected 2 drop rules, got %d", len(rules))
+	}
+	for i, set := range []string{nftableslib.BlocklistIPv4SetName, nftableslib.BlocklistIPv6SetName} {
+		var lookup *expr.Lookup
+		var verdict *expr.Verdict
+		for _, e := range rules[i].Exprs {
+			switch e := e.(type) {
+			case *expr.Lookup:
+				lookup = e
+			case *expr.Verdict:
+				verdict = e
+			}
+		}
+		if lookup == nil || lookup.SetName != set || verdict == nil || verdict.Kind != expr.VerdictDrop {
+			t.Fatalf("rule %d is expected to drop packets with source in set %s", i, set)
+		}
+	}
+
+	if err := bl.Add("192.0.2.1", time.Minute); err != nil {
+		t.Fatalf("failed to add address with error: %+v", err)
+	}
+	if err := bl.Add("198.51.100.0/24", 0); err != nil {
+		t.Fatalf("failed to add prefix with error: %+v", err)
+	}
+	if err := bl.Add("2001:db8::/64", 2*time.Minute); err != nil {
+		t.Fatalf("failed to add ipv6 prefix with error: %+v", err)
+	}
+	for _, addr := range []string{"198.51.100.7", "198.51.0.0/16", "10.0.0.256", "255.255.255.255"} {
+		if err := bl.Add(addr, time.Minute); err == nil {
+			t.Fatalf("adding %s supposed to fail", addr)
+		}
+	}
+	checkBlocklistSet(t, m, nftableslib.BlocklistIPv4SetName, map[string]time.Duration{
+		string([]byte{192, 0, 2, 1}):    time.Minute,
+		string([]byte{198, 51, 100, 0}): 0,
+	}, 4)
+	checkBlocklistSet(t, m, nftableslib.BlocklistIPv6SetName, map[string]time.Duration{
+		string([]byte{0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}): 2 * time.Minute,
+	}, 2)
+	want := []nftableslib.BlocklistEntry{
+		{Addr: "192.0.2.1/32", TTL: time.Minute},
+		{Addr: "198.51.100.0/24"},
+		{Addr: "2001:db8::/64", TTL: 2 * time.Minute},
+	}
+	if got := bl.List(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected blocklist %+v, got %+v", want, got)
+	}
+
+	// Re-adding the address restarts its ttl without duplicating elements
+	clock = clock.Add(30 * time.Second)
+	if got := bl.List()[0].TTL; got != 30*time.Second {
+		t.Fatalf("expected 30s left for 192.0.2.1, got %s", got)
+	}
+	if err := bl.Add("192.0.2.1", time.Minute); err != nil {
+		t.Fatalf("failed to re-add address with error: %+v", err)
+	}
+	if got := bl.List()[0].TTL; got != time.Minute {
+		t.Fatalf("expected 1m left for 192.0.2.1 after re-adding, got %s", got)
+	}
+	checkBlocklistSet(t, m, nftableslib.BlocklistIPv4SetName, map[string]time.Duration{
+		string([]byte{192, 0, 2, 1}):    time.Minute,
+		string([]byte{198, 51, 100, 0}): 0,
+	}, 4)
+
+	// Entries expire in both families
+	clock = clock.Add(90 * time.Second)
+	want = []nftableslib.BlocklistEntry{{Addr: "198.51.100.0/24"}}
+	if got := bl.List(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected blocklist %+v after expiration, got %+v", want, got)
+	}
+	checkBlocklistSet(t, m, nftableslib.BlocklistIPv4SetName, map[string]time.Duration{
+		string([]byte{198, 51, 100, 0}): 0,
+	}, 2)
+	checkBlocklistSet(t, m, nftableslib.BlocklistIPv6SetName, nil, 0)
+	if err := bl.Add("192.0.2.1", time.Minute); err != nil {
+		t.Fatalf("failed to add expired address with error: %+v", err)
+	}
+
+	if err := bl.Remove("198.51.100.0/24"); err != nil {
+		t.Fatalf("failed to remove prefix with error: %+v", err)
+	}
+	if err := bl.Remove("198.51.100.0/24"); err == nil {
+		t.Fatalf("removing not blocked prefix supposed to fail")
+	}
+
+	if err := bl.ReplaceAll([]nftableslib.BlocklistEntry{
+		{Addr: "10.0.0.0/8", TTL: time.Hour},
+		{Addr: "10.1.0.0/16"},
+	}); err == nil {
+		t.Fatalf("replacing with overlapping entries supposed to fail")
+	}
+	if err := bl.ReplaceAll([]nftableslib.BlocklistEntry{
+		{Addr: "2001:db8:1::1", TTL: 10 * time.Second},
+		{Addr: "10.0.0.0/8", TTL: time.Hour},
+	}); err != nil {
+		t.Fatalf("failed to replace blocklist with error: %+v", err)
+	}
+	want = []nftableslib.BlocklistEntry{
+		{Addr: "10.0.0.0/8", TTL: time.Hour},
+		{Addr: "2001:db8:1::1/128", TTL: 10 * time.Second},
+	}
+	if got := bl.List(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected blocklist %+v after replacement, got %+v", want, got)
+	}
+	checkBlocklistSet(t, m, nftableslib.BlocklistIPv4SetName, map[string]time.Duration{
+		string([]byte{10, 0, 0, 0}): time.Hour,
+	}, 2)
+	checkBlocklistSet(t, m, nftableslib.BlocklistIPv6SetName, map[string]time.Duration{
+		string([]byte{0x20, 0x01, 0x0d, 0xb8, 0, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1}): 10 * time.Second,
+	}, 2)
+
+	// A new instance adopts the programmed entries without adding rules
+	adopted, err := nftableslib.NewBlocklist(m.ti, "blocklist", now)
+	if err != nil {
+		t.Fatalf("failed to create blocklist over existing table with error: %+v", err)
+	}
+	if got := adopted.List(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected adopted blocklist %+v, got %+v", want, got)
+	}
+	if n := len(m.ruleset.rules[chainKey(table, nftableslib.BlocklistChainName)]); n != 2 {
+		t.Fatalf("expected 2 drop rules after adoption, got %d", n)
+	}
+}
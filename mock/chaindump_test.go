@@ -0,0 +1,103 @@
+package mock
+
+import (
+	"testing"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"github.com/sbezverk/nftableslib"
+	"golang.org/x/sys/unix"
+)
+
+func TestChainsDumpSummaries(t *testing.T) {
+	table := &nftables.Table{Name: "filter", Family: nftables.TableFamilyIPv4}
+	m := InitMockConn()
+	if err := m.ti.Tables().CreateImm(table.Name, table.Family); err != nil {
+		t.Fatalf("failed to create table with error: %+v", err)
+	}
+	ci, _ := m.ti.Tables().TableChains(table.Name, table.Family)
+	if err := ci.Chains().CreateImm("input", &nftableslib.ChainAttributes{
+		Type:     nftables.ChainTypeFilter,
+		Hook:     nftables.ChainHookInput,
+		Priority: nftables.ChainPriorityFilter,
+	}); err != nil {
+		t.Fatalf("failed to create chain with error: %+v", err)
+	}
+	ri, _ := ci.Chains().Chain("input")
+	iifname := "eth0"
+	for _, r := range []*nftableslib.Rule{
+		{
+			L3: &nftableslib.L3Rule{Src: &nftableslib.IPAddrSpec{
+				List: []*nftableslib.IPAddr{setIPAddr(t, "10.0.0.0/8"), setIPAddr(t, "192.0.2.1")},
+			}},
+			L4: &nftableslib.L4Rule{
+				L4Proto: unix.IPPROTO_TCP,
+				Dst:     &nftableslib.Port{List: []uint16{22, 443}},
+				Counter: &nftableslib.Counter{},
+			},
+			Action:   setActionVerdict(t, nftableslib.NFT_ACCEPT),
+			UserData: nftableslib.MakeRuleComment("ssh and https"),
+		},
+		{
+			Meta: &nftableslib.MetaRule{IIFName: &iifname},
+			Conntracks: []*nftableslib.Conntrack{
+				{Key: unix.NFT_CT_STATE, Value: binaryutil.BigEndian.PutUint32(nftableslib.CTStateEstablished | nftableslib.CTStateRelated)},
+				{Key: unix.NFT_CT_STATUS, Value: binaryutil.BigEndian.PutUint32(nftableslib.CTStatusDNAT)},
+			},
+			Action: setActionVerdict(t, nftableslib.NFT_DROP),
+		},
+	} {
+		if _, err := ri.Rules().CreateImm(r); err != nil {
+			t.Fatalf("failed to create rule with error: %+v", err)
+		}
+	}
+	// tcp dport vmap { 22 : accept } programmed by the nft CLI cannot be decoded
+	vmap := &nftables.Set{
+		Table:     table,
+		Name:      "__map%d",
+		Anonymous: true,
+		Constant:  true,
+		IsMap:     true,
+		KeyType:   nftables.TypeInetService,
+		DataType:  nftables.TypeVerdict,
+	}
+	if err := m.AddSet(vmap, []nftables.SetElement{
+		{Key: binaryutil.BigEndian.PutUint16(22), VerdictData: &expr.Verdict{Kind: expr.VerdictAccept}},
+	}); err != nil {
+		t.Fatalf("failed to add verdict map with error: %+v", err)
+	}
+	m.AddRule(&nftables.Rule{
+		Table: table,
+		Chain: &nftables.Chain{Name: "input", Table: table},
+		Exprs: []expr.Any{
+			&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{unix.IPPROTO_TCP}},
+			&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 2, Len: 2},
+			&expr.Lookup{SourceRegister: 1, SetName: vmap.Name, IsDestRegSet: true},
+		},
+	})
+	if err := m.Flush(); err != nil {
+		t.Fatalf("failed to flush with error: %+v", err)
+	}
+	// Agent restarted on the host dumps rules it programmed along with rules it cannot decode
+	synced := nftableslib.InitNFTables(m)
+	if _, err := synced.Tables().Sync(table.Family); err != nil {
+		t.Fatalf("failed to sync tables with error: %+v", err)
+	}
+	sci, _ := synced.Tables().TableChains(table.Name, table.Family)
+	b, err := sci.Chains().Dump()
+	if err != nil {
+		t.Fatalf("failed to dump chains with error: %+v", err)
+	}
+	want := `{"Name":"input","Table":{"Name":"filter","Use":0,"Flags":0,"Family":2},"Hooknum":1,"Priority":0,"Type":"filter","Policy":1,"Use":0,"Rules":[` +
+		`{"handle":1,"comment":"ssh and https","summary":"ip saddr { 10.0.0.0/8, 192.0.2.1 } tcp dport { 22, 443 } counter accept"},` +
+		`{"handle":2,"summary":"iifname \"eth0\" ct state established,related ct status dnat drop"},` +
+		`{"handle":3,"exprs":[{"Key":"expr.MetaKeyL4PROTO","Register":1},{"Op":"expr.CmpOpEq","Register":1,"Data":["0x6"]},` +
+		`{"DestRegister":1,"Base":"expr.PayloadBaseTransportHeader","Len":2,"Offset":2},{"SourceRegister":1,"DestRegister":0,"SetID":0,"SetName":"__map1","Invert":"false"},` +
+		`{"Table":{"Name":"filter","Use":0,"Flags":0,"Family":2},"ID":0,"Name":"__map1","Anonymous":true,"Constant":true,"Interval":false,"IsMap":true,"HasTimeout":false,"Timeout":0,` +
+		`"KeyType":{"Name":"invalid","Bytes":0},"DataType":{"Name":"verdict","Bytes":0}},[{"Key":"22","IntervalEnd":false,"Val":[]}]]}]}`
+	if string(b) != want {
+		t.Fatalf("expected dump:\n%s\ngot:\n%s", want, string(b))
+	}
+}
@@ -0,0 +1,126 @@
+package mock
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/sbezverk/nftableslib"
+	"golang.org/x/sys/unix"
+)
+
+func TestChainGraph(t *testing.T) {
+	table := &nftables.Table{Name: "filter", Family: nftables.TableFamilyIPv4}
+	m := InitMockConn()
+	if err := m.ti.Tables().CreateImm(table.Name, table.Family); err != nil {
+		t.Fatalf("failed to create table with error: %+v", err)
+	}
+	ci, _ := m.ti.Tables().TableChains(table.Name, table.Family)
+	for _, name := range []string{"input", "a", "b", "c"} {
+		if err := ci.Chains().CreateImm(name, nil); err != nil {
+			t.Fatalf("failed to create chain %s with error: %+v", name, err)
+		}
+	}
+	// input jumps to a, a jumps to b and goes to c, b jumps to c
+	for _, j := range []struct {
+		chain   string
+		verdict int
+		target  string
+	}{
+		{"input", unix.NFT_JUMP, "a"},
+		{"a", unix.NFT_JUMP, "b"},
+		{"a", unix.NFT_GOTO, "c"},
+		{"b", unix.NFT_JUMP, "c"},
+	} {
+		ri, _ := ci.Chains().Chain(j.chain)
+		if _, err := ri.Rules().CreateImm(&nftableslib.Rule{
+			L4: &nftableslib.L4Rule{
+				L4Proto: unix.IPPROTO_TCP,
+				Dst:     &nftableslib.Port{List: []uint16{22}},
+			},
+			Action: setActionVerdict(t, j.verdict, j.target),
+		}); err != nil {
+			t.Fatalf("failed to create rule of chain %s with error: %+v", j.chain, err)
+		}
+	}
+	// synced returns chains of the table loaded by Sync into a new store
+	synced := func() nftableslib.ChainsInterface {
+		ti := nftableslib.InitNFTables(m)
+		if _, err := ti.Tables().Sync(table.Family); err != nil {
+			t.Fatalf("failed to sync with error: %+v", err)
+		}
+		ci, err := ti.Tables().TableChains(table.Name, table.Family)
+		if err != nil {
+			t.Fatalf("failed to get chains with error: %+v", err)
+		}
+		return ci
+	}
+
+	edges := map[string][]string{
+		"input": {"a"},
+		"a":     {"b", "c"},
+		"b":     {"c"},
+		"c":     {},
+	}
+	for _, c := range []nftableslib.ChainsInterface{ci, synced()} {
+		if g := c.Chains().Graph(); !reflect.DeepEqual(g.Edges, edges) {
+			t.Fatalf("expected graph %v, got %v", edges, g.Edges)
+		}
+		if cycles := c.Chains().DetectCycles(); len(cycles) != 0 {
+			t.Fatalf("graph without cycles reports cycles %v", cycles)
+		}
+		order, err := c.Chains().TopologicalDeleteOrder()
+		if err != nil {
+			t.Fatalf("failed to order chains with error: %+v", err)
+		}
+		if want := []string{"input", "a", "b", "c"}; !reflect.DeepEqual(order, want) {
+			t.Fatalf("expected delete order %v, got %v", want, order)
+		}
+	}
+
+	// c jumps back to a by a rule of another application
+	m.AddRule(&nftables.Rule{
+		Table: table,
+		Chain: &nftables.Chain{Name: "c", Table: table},
+		Exprs: []expr.Any{&expr.Verdict{Kind: expr.VerdictJump, Chain: "a"}},
+	})
+	if err := m.Flush(); err != nil {
+		t.Fatalf("failed to flush with error: %+v", err)
+	}
+	cyclic := synced()
+	if got, want := cyclic.Chains().Graph().Edges["c"], []string{"a"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected chain c to jump to %v, got %v", want, got)
+	}
+	if got, want := cyclic.Chains().DetectCycles(), [][]string{{"a", "b", "c"}}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected cycles %v, got %v", want, got)
+	}
+	_, err := cyclic.Chains().TopologicalDeleteOrder()
+	var cerr *nftableslib.ErrChainCycle
+	if !errors.As(err, &cerr) || !reflect.DeepEqual(cerr.Cycle, []string{"a", "b", "c"}) {
+		t.Fatalf("expected ErrChainCycle of chains a, b and c, got %+v", err)
+	}
+	if err := cyclic.Chains().DeleteAll(); !errors.As(err, &cerr) {
+		t.Fatalf("deleting chains forming a cycle is supposed to fail with ErrChainCycle, got %+v", err)
+	}
+
+	// Without the cycle chains are deleted in a single transaction, referencing chains first
+	rules, _ := m.GetRule(table, &nftables.Chain{Name: "c", Table: table})
+	if err := m.DelRule(rules[0]); err != nil {
+		t.Fatalf("failed to delete rule with error: %+v", err)
+	}
+	if err := m.Flush(); err != nil {
+		t.Fatalf("failed to flush with error: %+v", err)
+	}
+	if err := ci.Chains().DeleteAll(); err != nil {
+		t.Fatalf("failed to delete chains with error: %+v", err)
+	}
+	chains, _ := m.ListChains()
+	if len(chains) != 0 {
+		t.Fatalf("expected all chains to be deleted, got %d chains", len(chains))
+	}
+	if len(ci.Chains().Graph().Edges) != 0 {
+		t.Fatalf("expected empty graph after chains are deleted")
+	}
+}
@@ -0,0 +1,258 @@
+package mock
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"github.com/sbezverk/nftableslib"
+	"golang.org/x/sys/unix"
+)
+
+func TestChainDeleteSafe(t *testing.T) {
+	m := InitMockConn()
+	if err := m.ti.Tables().CreateImm("filter-v4", nftables.TableFamilyIPv4); err != nil {
+		t.Fatalf("failed to create table filter-v4 with error: %+v", err)
+	}
+	tbl, err := m.ti.Tables().Table("filter-v4", nftables.TableFamilyIPv4)
+	if err != nil {
+		t.Fatalf("failed to get chain interface for table filter-v4")
+	}
+	if err := tbl.Chains().CreateImm("chain-from", nil); err != nil {
+		t.Fatalf("failed to create chain chain-from with error: %+v", err)
+	}
+	if err := tbl.Chains().CreateImm("chain-to", nil); err != nil {
+		t.Fatalf("failed to create chain chain-to with error: %+v", err)
+	}
+	ri, err := tbl.Chains().Chain("chain-from")
+	if err != nil {
+		t.Fatalf("failed to get rules interface for chain chain-from")
+	}
+	handle, err := ri.Rules().CreateImm(&nftableslib.Rule{
+		L3: &nftableslib.L3Rule{
+			Protocol: nftableslib.L3Protocol(unix.IPPROTO_TCP),
+		},
+		Action: setActionVerdict(t, unix.NFT_JUMP, "chain-to"),
+	})
+	if err != nil {
+		t.Fatalf("failed to create jump rule with error: %+v", err)
+	}
+	if _, err := ri.Rules().CreateImm(&nftableslib.Rule{
+		Action: setActionVerdict(t, unix.NFT_RETURN),
+	}); err != nil {
+		t.Fatalf("failed to create return rule with error: %+v", err)
+	}
+	if n, err := tbl.Chains().RuleCount("chain-from"); err != nil || n != 2 {
+		t.Fatalf("expected 2 rules in chain-from, got %d, error: %+v", n, err)
+	}
+
+	err = tbl.Chains().DeleteSafe("chain-to")
+	if err == nil {
+		t.Fatalf("deletion of referenced chain chain-to succeeded but supposed to fail")
+	}
+	var inUse *nftableslib.ErrChainInUse
+	if !errors.As(err, &inUse) {
+		t.Fatalf("expected error of type ErrChainInUse but got: %+v", err)
+	}
+	if len(inUse.References) != 1 || inUse.References[0].Chain != "chain-from" || inUse.References[0].Handle != handle {
+		t.Fatalf("unexpected references %+v", inUse.References)
+	}
+	if !tbl.Chains().Exist("chain-to") {
+		t.Fatalf("chain chain-to was removed after refused deletion")
+	}
+
+	if err := tbl.Chains().DeleteSafe("chain-to", true); err != nil {
+		t.Fatalf("forced deletion of chain chain-to failed with error: %+v", err)
+	}
+	if _, err := tbl.Chains().Chain("chain-to"); err == nil {
+		t.Fatalf("chain chain-to still exists after forced deletion")
+	}
+	if n, err := tbl.Chains().RuleCount("chain-from"); err != nil || n != 1 {
+		t.Fatalf("expected 1 rule in chain-from after forced deletion, got %d, error: %+v", n, err)
+	}
+
+	// Referencing rule which is queued cannot be withdrawn, forced deletion fails until it is flushed
+	if err := tbl.Chains().CreateImm("chain-to", nil); err != nil {
+		t.Fatalf("failed to create chain chain-to with error: %+v", err)
+	}
+	if _, err := ri.Rules().Create(&nftableslib.Rule{
+		Action: setActionVerdict(t, unix.NFT_JUMP, "chain-to"),
+	}); err != nil {
+		t.Fatalf("failed to queue jump rule with error: %+v", err)
+	}
+	if err := tbl.Chains().DeleteSafe("chain-to", true); err == nil {
+		t.Fatalf("forced deletion of chain referenced by a queued rule supposed to fail")
+	}
+	if n, err := tbl.Chains().RuleCount("chain-from"); err != nil || n != 2 {
+		t.Fatalf("expected 2 rules in chain-from after refused deletion, got %d, error: %+v", n, err)
+	}
+	if err := m.Flush(); err != nil {
+		t.Fatalf("failed to flush queued jump rule with error: %+v", err)
+	}
+	if err := tbl.Chains().DeleteSafe("chain-to", true); err != nil {
+		t.Fatalf("forced deletion of chain chain-to failed with error: %+v", err)
+	}
+	rules, err := m.GetRule(&nftables.Table{Name: "filter-v4", Family: nftables.TableFamilyIPv4}, &nftables.Chain{Name: "chain-from"})
+	if err != nil {
+		t.Fatalf("failed to get rules of chain-from with error: %+v", err)
+	}
+	if len(rules) != 1 {
+		t.Fatalf("expected 1 rule in chain-from on the host after forced deletion, got %d", len(rules))
+	}
+}
+
+func TestRouteChainMarkReroute(t *testing.T) {
+	m := InitMockConn()
+	if err := m.ti.Tables().CreateImm("mangle", nftables.TableFamilyIPv4); err != nil {
+		t.Fatalf("failed to create table mangle with error: %+v", err)
+	}
+	tbl, err := m.ti.Tables().Table("mangle", nftables.TableFamilyIPv4)
+	if err != nil {
+		t.Fatalf("failed to get chain interface for table mangle")
+	}
+	if err := tbl.Chains().CreateImm("reroute", &nftableslib.ChainAttributes{
+		Type:     nftables.ChainTypeRoute,
+		Hook:     nftables.ChainHookPrerouting,
+		Priority: nftables.ChainPriorityMangle,
+	}); err == nil {
+		t.Fatalf("route chain on prerouting hook supposed to fail")
+	}
+	if tbl.Chains().Exist("reroute") {
+		t.Fatalf("rejected route chain must not be created")
+	}
+	if err := tbl.Chains().CreateImm("output", &nftableslib.ChainAttributes{
+		Type:     nftables.ChainTypeRoute,
+		Hook:     nftables.ChainHookOutput,
+		Priority: nftables.ChainPriorityMangle,
+	}); err != nil {
+		t.Fatalf("failed to create route chain with error: %+v", err)
+	}
+	ri, err := tbl.Chains().Chain("output")
+	if err != nil {
+		t.Fatalf("failed to get rules interface for chain output")
+	}
+	// meta mark set 0x1 for tcp traffic to port 443
+	if _, err := ri.Rules().CreateImm(&nftableslib.Rule{
+		L4: &nftableslib.L4Rule{
+			L4Proto: unix.IPPROTO_TCP,
+			Dst:     &nftableslib.Port{List: []uint16{443}},
+		},
+		Meta: &nftableslib.MetaRule{
+			Mark: &nftableslib.MetaMark{Set: true, Value: 0x1},
+		},
+	}); err != nil {
+		t.Fatalf("failed to create mark rule with error: %+v", err)
+	}
+
+	table := &nftables.Table{Name: "mangle", Family: nftables.TableFamilyIPv4}
+	i := m.ruleset.getChain(table, "output")
+	if i == -1 {
+		t.Fatalf("route chain output is not programmed")
+	}
+	if c := m.ruleset.chains[i]; c.Type != nftables.ChainTypeRoute || c.Hooknum != nftables.ChainHookOutput {
+		t.Fatalf("chain output is programmed with type %s and hook %d", c.Type, c.Hooknum)
+	}
+	rules := m.ruleset.rules[chainKey(table, "output")]
+	if len(rules) != 1 {
+		t.Fatalf("expected 1 rule in chain output, got %d", len(rules))
+	}
+	e := rules[0].Exprs
+	set, ok := e[len(e)-1].(*expr.Meta)
+	if !ok || !set.SourceRegister || set.Key != expr.MetaKeyMARK {
+		t.Fatalf("expected meta mark set as the last expression, got %+v", e[len(e)-1])
+	}
+	imm, ok := e[len(e)-2].(*expr.Immediate)
+	if !ok || binaryutil.NativeEndian.Uint32(imm.Data) != 0x1 {
+		t.Fatalf("expected mark value 0x1, got %+v", e[len(e)-2])
+	}
+
+	for _, family := range []nftables.TableFamily{nftables.TableFamilyBridge, nftables.TableFamilyNetdev} {
+		if err := m.ti.Tables().CreateImm("route", family); err != nil {
+			t.Fatalf("failed to create table route of family %d with error: %+v", family, err)
+		}
+		tbl, err := m.ti.Tables().Table("route", family)
+		if err != nil {
+			t.Fatalf("failed to get chain interface for table route of family %d", family)
+		}
+		if err := tbl.Chains().CreateImm("output", &nftableslib.ChainAttributes{
+			Type:     nftables.ChainTypeRoute,
+			Hook:     nftables.ChainHookOutput,
+			Priority: nftables.ChainPriorityMangle,
+		}); err == nil {
+			t.Fatalf("route chain in family %d supposed to fail", family)
+		}
+	}
+}
+
+func TestNetdevChainDevices(t *testing.T) {
+	m := InitMockConn()
+	m.AddLink("eth0", "eth1", "bond0")
+	if err := m.ti.Tables().CreateImm("edge", nftables.TableFamilyNetdev); err != nil {
+		t.Fatalf("failed to create table edge with error: %+v", err)
+	}
+	ci, _ := m.ti.Tables().Table("edge", nftables.TableFamilyNetdev)
+	attrs := &nftableslib.ChainAttributes{
+		Type:     nftables.ChainTypeFilter,
+		Hook:     nftables.ChainHookIngress,
+		Priority: nftables.ChainPriorityFilter,
+		Devices:  []string{"eth0", "eth1"},
+	}
+	if err := ci.Chains().Create("ingress", attrs); err != nil {
+		t.Fatalf("failed to create chain ingress bound to two devices with error: %+v", err)
+	}
+	chain := &nftables.Chain{Name: "ingress", Table: &nftables.Table{Name: "edge", Family: nftables.TableFamilyNetdev}}
+	checkDevices := func(want []string) {
+		t.Helper()
+		got, err := m.ChainDevices(chain)
+		if err != nil {
+			t.Fatalf("failed to get devices of chain ingress with error: %+v", err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("expected chain ingress bound to %v, got %v", want, got)
+		}
+	}
+	checkDevices([]string{"eth0", "eth1"})
+	ri, _ := ci.Chains().Chain("ingress")
+	ra, _ := nftableslib.SetVerdict(nftableslib.NFT_ACCEPT)
+	handle, err := ri.Rules().CreateImm(&nftableslib.Rule{Action: ra})
+	if err != nil {
+		t.Fatalf("failed to create rule in chain ingress with error: %+v", err)
+	}
+
+	if err := ci.Chains().CreateImm("missing", &nftableslib.ChainAttributes{
+		Type:    nftables.ChainTypeFilter,
+		Hook:    nftables.ChainHookIngress,
+		Devices: []string{"eth2"},
+	}); err == nil {
+		t.Fatalf("binding chain to not existing device supposed to fail")
+	}
+	if err := ci.Chains().CreateImm("pending", &nftableslib.ChainAttributes{
+		Type:                nftables.ChainTypeFilter,
+		Hook:                nftables.ChainHookIngress,
+		Devices:             []string{"eth2"},
+		AllowMissingDevices: true,
+	}); err != nil {
+		t.Fatalf("failed to bind chain to not existing device with error: %+v", err)
+	}
+
+	// Rebinding keeps the chain and its rules
+	if err := ci.Chains().UpdateDevices("ingress", []string{"eth1", "bond0"}); err != nil {
+		t.Fatalf("failed to rebind chain ingress with error: %+v", err)
+	}
+	checkDevices([]string{"bond0", "eth1"})
+	if err := ci.Chains().UpdateDevices("ingress", []string{"eth1", "eth3"}); err == nil {
+		t.Fatalf("rebinding chain to not existing device supposed to fail")
+	}
+	checkDevices([]string{"bond0", "eth1"})
+	rules, _ := m.GetRule(chain.Table, chain)
+	if len(rules) != 1 || rules[0].Handle != handle {
+		t.Fatalf("rule of chain ingress was not preserved by rebinding")
+	}
+	if err := ci.Chains().UpdateDevices("ingress", nil); err != nil {
+		t.Fatalf("failed to release all devices of chain ingress with error: %+v", err)
+	}
+	checkDevices([]string{})
+}
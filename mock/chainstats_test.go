@@ -0,0 +1,165 @@
+package mock
+
+import (
+	"testing"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/sbezverk/nftableslib"
+	"golang.org/x/sys/unix"
+)
+
+// firstRule returns the handle of the first rule of the chain programmed in the mock
+func firstRule(t *testing.T, m *Mock, table *nftables.Table, chain string) uint64 {
+	t.Helper()
+	rules, err := m.GetRule(table, &nftables.Chain{Name: chain, Table: table})
+	if err != nil {
+		t.Fatalf("failed to get rules of chain %s with error: %+v", chain, err)
+	}
+	if len(rules) == 0 {
+		return 0
+	}
+	return rules[0].Handle
+}
+
+func TestChainStats(t *testing.T) {
+	table := &nftables.Table{Name: "filter", Family: nftables.TableFamilyIPv4}
+	accept := func(port int) *nftableslib.Rule {
+		return &nftableslib.Rule{
+			L4: &nftableslib.L4Rule{
+				L4Proto: unix.IPPROTO_TCP,
+				Dst:     &nftableslib.Port{List: []uint16{uint16(port)}},
+			},
+			Action: setActionVerdict(t, nftableslib.NFT_ACCEPT),
+		}
+	}
+	m := InitMockConn()
+	if err := m.ti.Tables().CreateImm(table.Name, table.Family); err != nil {
+		t.Fatalf("failed to create table with error: %+v", err)
+	}
+	ci, err := m.ti.Tables().TableChains(table.Name, table.Family)
+	if err != nil {
+		t.Fatalf("failed to get chains with error: %+v", err)
+	}
+	if err := ci.Chains().CreateImm("input", nil); err != nil {
+		t.Fatalf("failed to create chain with error: %+v", err)
+	}
+	ri, err := ci.Chains().Chain("input")
+	if err != nil {
+		t.Fatalf("failed to get rules with error: %+v", err)
+	}
+	if _, err := ci.Chains().GetStats("input"); err == nil {
+		t.Fatalf("getting stats of a chain without stats is supposed to fail")
+	}
+	if _, err := ri.Rules().CreateImm(accept(22)); err != nil {
+		t.Fatalf("failed to create rule with error: %+v", err)
+	}
+	if err := ci.Chains().EnableStats("input"); err != nil {
+		t.Fatalf("failed to enable stats with error: %+v", err)
+	}
+	stats := firstRule(t, m, table, "input")
+	rs, _ := m.GetRule(table, &nftables.Chain{Name: "input", Table: table})
+	if len(rs[0].Exprs) != 1 {
+		t.Fatalf("stats rule is expected to carry only a counter, got expressions %+v", rs[0].Exprs)
+	}
+	if _, ok := rs[0].Exprs[0].(*expr.Counter); !ok {
+		t.Fatalf("stats rule is expected to carry only a counter, got expressions %+v", rs[0].Exprs)
+	}
+	tests := []struct {
+		name string
+		op   func() error
+	}{
+		{
+			name: "enable again",
+			op: func() error {
+				return ci.Chains().EnableStats("input")
+			},
+		},
+		{
+			name: "create",
+			op: func() error {
+				_, err := ri.Rules().CreateImm(accept(80))
+				return err
+			},
+		},
+		{
+			name: "insert",
+			op: func() error {
+				_, err := ri.Rules().InsertImm(accept(443))
+				return err
+			},
+		},
+		{
+			name: "queued insert",
+			op: func() error {
+				if _, err := ri.Rules().Insert(accept(8080)); err != nil {
+					return err
+				}
+				return m.Flush()
+			},
+		},
+		{
+			name: "set tail",
+			op: func() error {
+				_, err := ri.Rules().SetTail(&nftableslib.Rule{Action: setActionVerdict(t, nftableslib.NFT_DROP)})
+				return err
+			},
+		},
+		{
+			name: "insert with tail",
+			op: func() error {
+				_, err := ri.Rules().InsertImm(accept(8443))
+				return err
+			},
+		},
+	}
+	rules := 2
+	for _, tt := range tests {
+		if err := tt.op(); err != nil {
+			t.Fatalf("Test \"%s\" failed with error: %+v but supposed to succeed", tt.name, err)
+		}
+		if tt.name != "enable again" {
+			rules++
+		}
+		if _, n := lastRule(t, m, table, "input"); n != rules {
+			t.Fatalf("Test \"%s\" failed, expected %d rules, got %d", tt.name, rules, n)
+		}
+		if first := firstRule(t, m, table, "input"); first != stats {
+			t.Fatalf("Test \"%s\" failed, expected stats rule %d to be first, got %d", tt.name, stats, first)
+		}
+	}
+	if s, err := ci.Chains().GetStats("input"); err != nil || *s != (nftableslib.CounterState{}) {
+		t.Fatalf("expected empty stats, got %+v with error: %+v", s, err)
+	}
+
+	// A store loaded from the host identifies the stats rule and keeps it first
+	ti := nftableslib.InitNFTables(m)
+	if _, err := ti.Tables().Sync(table.Family); err != nil {
+		t.Fatalf("failed to sync with error: %+v", err)
+	}
+	sci, _ := ti.Tables().TableChains(table.Name, table.Family)
+	if _, err := sci.Chains().GetStats("input"); err != nil {
+		t.Fatalf("failed to get stats of synced chain with error: %+v", err)
+	}
+	sri, _ := sci.Chains().Chain("input")
+	if _, err := sri.Rules().InsertImm(accept(9090)); err != nil {
+		t.Fatalf("failed to insert rule with error: %+v", err)
+	}
+	if first := firstRule(t, m, table, "input"); first != stats {
+		t.Fatalf("expected stats rule %d to stay first after sync, got %d", stats, first)
+	}
+
+	if err := ci.Chains().DisableStats("input"); err != nil {
+		t.Fatalf("failed to disable stats with error: %+v", err)
+	}
+	if err := ci.Chains().DisableStats("input"); err == nil {
+		t.Fatalf("disabling stats of a chain without stats is supposed to fail")
+	}
+	h, err := ri.Rules().InsertImm(accept(9443))
+	if err != nil {
+		t.Fatalf("failed to insert rule with error: %+v", err)
+	}
+	if first := firstRule(t, m, table, "input"); first != h {
+		t.Fatalf("rule inserted after stats are disabled is expected to be first")
+	}
+}
@@ -0,0 +1,133 @@
+package mock
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/sbezverk/nftableslib"
+	"golang.org/x/sys/unix"
+)
+
+func TestCopyRules(t *testing.T) {
+	m := InitMockConn()
+	chains := func(family nftables.TableFamily, names ...string) nftableslib.ChainsInterface {
+		if err := m.ti.Tables().CreateImm("filter", family); err != nil {
+			t.Fatalf("failed to create table with error: %+v", err)
+		}
+		ci, err := m.ti.Tables().TableChains("filter", family)
+		if err != nil {
+			t.Fatalf("failed to get chains with error: %+v", err)
+		}
+		for _, name := range names {
+			if err := ci.Chains().CreateImm(name, nil); err != nil {
+				t.Fatalf("failed to create chain %s with error: %+v", name, err)
+			}
+		}
+		return ci
+	}
+	v4 := chains(nftables.TableFamilyIPv4, "input", "v4-services")
+	v6 := chains(nftables.TableFamilyIPv6, "input", "v6-services")
+	src, _ := v4.Chains().Chain("input")
+	dst, _ := v6.Chains().Chain("input")
+	ssh, _ := nftableslib.NewIPAddr("192.0.2.0/24")
+	rules := []*nftableslib.Rule{
+		{
+			L3: &nftableslib.L3Rule{Src: &nftableslib.IPAddrSpec{List: []*nftableslib.IPAddr{ssh}}},
+			L4: &nftableslib.L4Rule{
+				L4Proto: unix.IPPROTO_TCP,
+				Dst:     &nftableslib.Port{List: []uint16{22}},
+			},
+			Action: setActionVerdict(t, nftableslib.NFT_ACCEPT),
+		},
+		{
+			L4: &nftableslib.L4Rule{
+				L4Proto: unix.IPPROTO_ICMP,
+				ICMP:    &nftableslib.ICMP{Types: []byte{nftableslib.ICMPEchoRequest}},
+			},
+			Action: setActionVerdict(t, nftableslib.NFT_ACCEPT),
+		},
+		{Action: setActionVerdict(t, unix.NFT_JUMP, "v4-services")},
+	}
+	for _, r := range rules {
+		if _, err := src.Rules().CreateImm(r); err != nil {
+			t.Fatalf("failed to create rule with error: %+v", err)
+		}
+	}
+
+	// Addresses of the IPv4 table are mapped to the IPv6 prefix of the same network
+	prefix, _ := nftableslib.NewIPAddr("2001:db8:0:2::/64")
+	toV6 := func(r *nftableslib.Rule) (*nftableslib.Rule, error) {
+		return nftableslib.CloneRule(r, nftableslib.CloneOptions{
+			Address: func(a *nftableslib.IPAddr) (*nftableslib.IPAddr, error) {
+				return prefix, nil
+			},
+			Family:  nftables.TableFamilyIPv6,
+			Targets: map[string]string{"v4-services": "v6-services"},
+		})
+	}
+	if err := v4.Chains().CopyRules("input", dst, toV6); err != nil {
+		t.Fatalf("failed to copy rules with error: %+v", err)
+	}
+	table := &nftables.Table{Name: "filter", Family: nftables.TableFamilyIPv6}
+	copied, err := m.GetRule(table, &nftables.Chain{Name: "input", Table: table})
+	if err != nil || len(copied) != len(rules) {
+		t.Fatalf("expected %d copied rules, got %d error: %+v", len(rules), len(copied), err)
+	}
+	has := func(r *nftables.Rule, match func(expr.Any) bool) bool {
+		for _, e := range r.Exprs {
+			if match(e) {
+				return true
+			}
+		}
+		return false
+	}
+	tests := []struct {
+		name  string
+		match func(expr.Any) bool
+	}{
+		{
+			name: "source prefix",
+			match: func(e expr.Any) bool {
+				c, ok := e.(*expr.Cmp)
+				return ok && bytes.Equal(c.Data, net.ParseIP("2001:db8:0:2::").To16())
+			},
+		},
+		{
+			name: "icmpv6 echo request",
+			match: func(e expr.Any) bool {
+				c, ok := e.(*expr.Cmp)
+				return ok && bytes.Equal(c.Data, []byte{nftableslib.ICMPv6EchoRequest})
+			},
+		},
+		{
+			name: "jump to ipv6 services",
+			match: func(e expr.Any) bool {
+				v, ok := e.(*expr.Verdict)
+				return ok && v.Kind == expr.VerdictJump && v.Chain == "v6-services"
+			},
+		},
+	}
+	for i, tt := range tests {
+		if !has(copied[i], tt.match) {
+			t.Fatalf("Test \"%s\" failed, copied rule %d does not match", tt.name, i)
+		}
+	}
+	if n, _ := dst.Rules().GetRulesUserData(); len(n) != len(rules) {
+		t.Fatalf("expected %d rules with handles in the store, got %d", len(rules), len(n))
+	}
+
+	// A rule which cannot be converted fails the whole copy
+	reject, _ := nftableslib.SetReject(unix.NFT_REJECT_ICMP_UNREACH, 3)
+	if _, err := src.Rules().CreateImm(&nftableslib.Rule{Action: reject}); err != nil {
+		t.Fatalf("failed to create rule with error: %+v", err)
+	}
+	if err := v4.Chains().CopyRules("input", dst, toV6); err == nil {
+		t.Fatalf("copying rule which cannot be converted is supposed to fail")
+	}
+	if copied, _ = m.GetRule(table, &nftables.Chain{Name: "input", Table: table}); len(copied) != len(rules) {
+		t.Fatalf("failed copy is not supposed to add rules, got %d", len(copied))
+	}
+}
@@ -0,0 +1,148 @@
+package mock
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/sbezverk/nftableslib"
+	"golang.org/x/sys/unix"
+)
+
+// programTable creates the table with a chain, a set and a rule referring to the set, checks the store
+// and the host see them and deletes the table.
+func programTable(nft nftableslib.TablesInterface, name string, family nftables.TableFamily) error {
+	if err := nft.Tables().CreateImm(name, family); err != nil {
+		return err
+	}
+	ci, err := nft.Tables().Table(name, family)
+	if err != nil {
+		return err
+	}
+	if err := ci.Chains().CreateImm("input", nil); err != nil {
+		return err
+	}
+	si, err := nft.Tables().TableSets(name, family)
+	if err != nil {
+		return err
+	}
+	set, err := si.Sets().CreateSet(&nftableslib.SetAttributes{Name: "ports", KeyType: nftables.TypeInetService},
+		[]nftables.SetElement{{Key: binaryutil.BigEndian.PutUint16(22)}})
+	if err != nil {
+		return err
+	}
+	ri, err := ci.Chains().Chain("input")
+	if err != nil {
+		return err
+	}
+	drop, _ := nftableslib.SetVerdict(nftableslib.NFT_DROP)
+	if _, err := ri.Rules().CreateImm(&nftableslib.Rule{
+		L4: &nftableslib.L4Rule{
+			L4Proto: unix.IPPROTO_TCP,
+			Dst:     &nftableslib.Port{SetRef: &nftableslib.SetRef{Name: set.Name, ID: set.ID}},
+		},
+		Action: drop,
+	}); err != nil {
+		return err
+	}
+	if !nft.Tables().Exist(name, family) {
+		return fmt.Errorf("table %s does not exist", name)
+	}
+	if _, err := nft.Tables().SyncTable(name, family); err != nil {
+		return err
+	}
+	if n, err := ci.Chains().RuleCount("input"); err != nil || n != 1 {
+		return fmt.Errorf("expected 1 rule in table %s, got %d error: %+v", name, n, err)
+	}
+	if _, err := nft.Tables().Dump(); err != nil {
+		return err
+	}
+	return nft.Tables().DeleteImm(name, family)
+}
+
+func TestConcurrentTables(t *testing.T) {
+	m := InitMockConn()
+	families := []nftables.TableFamily{
+		nftables.TableFamilyIPv4,
+		nftables.TableFamilyIPv6,
+		nftables.TableFamilyINet,
+		nftables.TableFamilyBridge,
+	}
+	var wg sync.WaitGroup
+	errs := make(chan error, len(families)*2)
+	for _, f := range families {
+		// Two goroutines work on tables of the same family
+		for i := 0; i < 2; i++ {
+			wg.Add(1)
+			go func(f nftables.TableFamily, name string) {
+				defer wg.Done()
+				for j := 0; j < 20; j++ {
+					if err := programTable(m.ti, name, f); err != nil {
+						errs <- fmt.Errorf("table %s of family %v: %+v", name, f, err)
+						return
+					}
+				}
+			}(f, fmt.Sprintf("table-%d", i))
+		}
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Errorf("concurrent programming failed with error: %+v", err)
+	}
+	if tables, err := m.ListTables(); err != nil || len(tables) != 0 {
+		t.Fatalf("expected all tables to be deleted, got %d error: %+v", len(tables), err)
+	}
+}
+
+// BenchmarkConcurrentTables compares tables of two families created, looked up and deleted one after
+// another by a single goroutine with the same tables handled by two goroutines. Round trips to the kernel
+// take 1ms, tables of different families do not wait for each other, so the parallel benchmark takes
+// about half of the time of the serial one.
+func BenchmarkConcurrentTables(b *testing.B) {
+	families := []nftables.TableFamily{nftables.TableFamilyIPv4, nftables.TableFamilyIPv6}
+	cycle := func(b *testing.B, nft nftableslib.TablesInterface, f nftables.TableFamily) {
+		if err := nft.Tables().CreateImm("filter", f); err != nil {
+			b.Fatalf("failed to create table of family %v with error: %+v", f, err)
+		}
+		// Tables which are not in the store are looked up on the host
+		if nft.Tables().Exist("nat", f) {
+			b.Fatalf("table nat of family %v is not supposed to exist", f)
+		}
+		if _, err := nft.Tables().Get(f); err != nil {
+			b.Fatalf("failed to get tables of family %v with error: %+v", f, err)
+		}
+		if err := nft.Tables().DeleteImm("filter", f); err != nil {
+			b.Fatalf("failed to delete table of family %v with error: %+v", f, err)
+		}
+	}
+	b.Run("Serial", func(b *testing.B) {
+		m := InitMockConn()
+		m.SetLatency(time.Millisecond)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			for _, f := range families {
+				cycle(b, m.ti, f)
+			}
+		}
+	})
+	b.Run("Parallel", func(b *testing.B) {
+		m := InitMockConn()
+		m.SetLatency(time.Millisecond)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			var wg sync.WaitGroup
+			for _, f := range families {
+				wg.Add(1)
+				go func(f nftables.TableFamily) {
+					defer wg.Done()
+					cycle(b, m.ti, f)
+				}(f)
+			}
+			wg.Wait()
+		}
+	})
+}
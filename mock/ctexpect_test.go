@@ -0,0 +1,182 @@
+package mock
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"github.com/sbezverk/nftableslib"
+	"golang.org/x/sys/unix"
+)
+
+func TestCtStatus(t *testing.T) {
+	table := &nftables.Table{Name: "filter", Family: nftables.TableFamilyIPv4}
+	m := InitMockConn()
+	if err := m.ti.Tables().CreateImm(table.Name, table.Family); err != nil {
+		t.Fatalf("failed to create table with error: %+v", err)
+	}
+	ci, _ := m.ti.Tables().TableChains(table.Name, table.Family)
+	if err := ci.Chains().CreateImm("input", &nftableslib.ChainAttributes{
+		Type:     nftables.ChainTypeFilter,
+		Hook:     nftables.ChainHookInput,
+		Priority: nftables.ChainPriorityFilter,
+	}); err != nil {
+		t.Fatalf("failed to create chain with error: %+v", err)
+	}
+	if err := ci.Chains().CreateImm("raw", &nftableslib.ChainAttributes{
+		Type:     nftables.ChainTypeFilter,
+		Hook:     nftables.ChainHookPrerouting,
+		Priority: nftables.ChainPriorityRaw,
+	}); err != nil {
+		t.Fatalf("failed to create chain with error: %+v", err)
+	}
+	status := nftableslib.CTStatusDNAT | nftableslib.CTStatusAssured
+	rule := func() *nftableslib.Rule {
+		return &nftableslib.Rule{
+			Conntracks: []*nftableslib.Conntrack{{Key: unix.NFT_CT_STATUS, Value: binaryutil.BigEndian.PutUint32(status)}},
+			Action:     setActionVerdict(t, nftableslib.NFT_ACCEPT),
+		}
+	}
+
+	ri, _ := ci.Chains().Chain("input")
+	if _, err := ri.Rules().CreateImm(rule()); err != nil {
+		t.Fatalf("failed to create rule matching ct status with error: %+v", err)
+	}
+	rules, err := m.GetRule(table, &nftables.Chain{Name: "input", Table: table})
+	if err != nil || len(rules) != 1 {
+		t.Fatalf("expected single rule, got %d with error: %+v", len(rules), err)
+	}
+	// [ ct load status => reg 1 ]
+	// [ bitwise reg 1 = (reg=1 & 0x24000000 ) ^ 0x00000000 ]
+	// [ cmp neq reg 1 0x00000000 ]
+	want := []expr.Any{
+		&expr.Ct{Key: expr.CtKeySTATUS, Register: 1},
+		&expr.Bitwise{SourceRegister: 1, DestRegister: 1, Len: 4, Mask: []byte{0x24, 0, 0, 0}, Xor: []byte{0, 0, 0, 0}},
+		&expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: []byte{0, 0, 0, 0}},
+	}
+	if got := rules[0].Exprs[:3]; !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected ct status match %+v, got %+v", want, got)
+	}
+
+	// Conntrack is not looked up yet in prerouting chain of raw priority
+	raw, _ := ci.Chains().Chain("raw")
+	if _, err := raw.Rules().CreateImm(rule()); err == nil {
+		t.Fatalf("ct status match in chain running before conntrack is supposed to fail")
+	}
+	// Netdev tables do not see conntrack
+	if err := m.ti.Tables().CreateImm("ingress", nftables.TableFamilyNetdev); err != nil {
+		t.Fatalf("failed to create table with error: %+v", err)
+	}
+	nci, _ := m.ti.Tables().TableChains("ingress", nftables.TableFamilyNetdev)
+	if err := nci.Chains().CreateImm("filter", nil); err != nil {
+		t.Fatalf("failed to create chain with error: %+v", err)
+	}
+	nri, _ := nci.Chains().Chain("filter")
+	if _, err := nri.Rules().CreateImm(rule()); err == nil {
+		t.Fatalf("ct status match in netdev table is supposed to fail")
+	}
+}
+
+func TestCtExpectation(t *testing.T) {
+	table := &nftables.Table{Name: "filter", Family: nftables.TableFamilyINet}
+	m := InitMockConn()
+	if err := m.ti.Tables().CreateImm(table.Name, table.Family); err != nil {
+		t.Fatalf("failed to create table with error: %+v", err)
+	}
+	oi, _ := m.ti.Tables().TableObjects(table.Name, table.Family)
+	exp := &nftableslib.CtExpectationState{
+		Family:   nftables.TableFamilyIPv4,
+		Protocol: unix.IPPROTO_TCP,
+		Port:     20,
+		Timeout:  time.Minute,
+		Size:     4,
+	}
+	if err := oi.Objects().CreateCtExpectation("ftp-data", exp); err != nil {
+		t.Fatalf("failed to create ct expectation with error: %+v", err)
+	}
+	o, err := oi.Objects().Get(nftableslib.ObjectCtExpectation, "ftp-data")
+	if err != nil {
+		t.Fatalf("failed to get ct expectation with error: %+v", err)
+	}
+	if !reflect.DeepEqual(o.CtExpectation, exp) {
+		t.Fatalf("expected ct expectation %+v, got %+v", exp, o.CtExpectation)
+	}
+	if err := oi.Objects().CreateCtExpectation("any", &nftableslib.CtExpectationState{Protocol: unix.IPPROTO_TCP, Port: 20, Timeout: time.Minute, Size: 4}); err == nil {
+		t.Fatalf("ct expectation without family in inet table is supposed to fail")
+	}
+
+	ci, _ := m.ti.Tables().TableChains(table.Name, table.Family)
+	if err := ci.Chains().CreateImm("input", &nftableslib.ChainAttributes{
+		Type:     nftables.ChainTypeFilter,
+		Hook:     nftables.ChainHookInput,
+		Priority: nftables.ChainPriorityFilter,
+	}); err != nil {
+		t.Fatalf("failed to create chain with error: %+v", err)
+	}
+	action, err := nftableslib.SetCtExpectation("ftp-data")
+	if err != nil {
+		t.Fatalf("failed to build ct expectation action with error: %+v", err)
+	}
+	ri, _ := ci.Chains().Chain("input")
+	if _, err := ri.Rules().CreateImm(&nftableslib.Rule{
+		L4:      &nftableslib.L4Rule{L4Proto: unix.IPPROTO_TCP, Dst: &nftableslib.Port{List: []uint16{21}}},
+		Actions: []*nftableslib.RuleAction{action, setActionVerdict(t, nftableslib.NFT_ACCEPT)},
+	}); err != nil {
+		t.Fatalf("failed to create rule setting ct expectation with error: %+v", err)
+	}
+	rules, err := m.GetRule(table, &nftables.Chain{Name: "input", Table: table})
+	if err != nil || len(rules) != 1 {
+		t.Fatalf("expected single rule, got %d with error: %+v", len(rules), err)
+	}
+	found := false
+	for _, e := range rules[0].Exprs {
+		if ref, ok := e.(*expr.Objref); ok {
+			found = ref.Type == int(nftableslib.ObjectCtExpectation) && ref.Name == "ftp-data"
+		}
+	}
+	if !found {
+		t.Fatalf("expected reference to ct expectation ftp-data, got %+v", rules[0].Exprs)
+	}
+	if _, err := nftableslib.SetCtExpectation(""); err == nil {
+		t.Fatalf("ct expectation without name is supposed to fail")
+	}
+
+	if err := oi.Objects().Delete(nftableslib.ObjectCtExpectation, "ftp-data"); err != nil {
+		t.Fatalf("failed to delete ct expectation with error: %+v", err)
+	}
+	if oi.Objects().Exist(nftableslib.ObjectCtExpectation, "ftp-data") {
+		t.Fatalf("ct expectation ftp-data is expected to be deleted")
+	}
+}
+
+func TestCtExpectationNetlink(t *testing.T) {
+	k := InitMockNetlink()
+	ti, _ := nftableslib.InitNFTablesWithConn(k.Conn())
+	if err := ti.Tables().CreateImm("filter", nftables.TableFamilyIPv6); err != nil {
+		t.Fatalf("failed to create table with error: %+v", err)
+	}
+	oi, _ := ti.Tables().TableObjects("filter", nftables.TableFamilyIPv6)
+	exp := &nftableslib.CtExpectationState{Protocol: unix.IPPROTO_UDP, Port: 5060, Timeout: 1500 * time.Millisecond, Size: 1}
+	if err := oi.Objects().CreateCtExpectation("sip", exp); err != nil {
+		t.Fatalf("failed to create ct expectation with error: %+v", err)
+	}
+	if err := oi.Objects().CreateCtExpectation("sip", exp); err == nil {
+		t.Fatalf("creating existing ct expectation is supposed to fail")
+	}
+	// The family of the expectation defaults to the family of the table
+	want := *exp
+	want.Family = nftables.TableFamilyIPv6
+	o, err := oi.Objects().Get(nftableslib.ObjectCtExpectation, "sip")
+	if err != nil || !reflect.DeepEqual(o.CtExpectation, &want) {
+		t.Fatalf("expected ct expectation %+v, got %+v with error: %+v", want, o, err)
+	}
+	if err := oi.Objects().Delete(nftableslib.ObjectCtExpectation, "sip"); err != nil {
+		t.Fatalf("failed to delete ct expectation with error: %+v", err)
+	}
+	if objs, err := oi.Objects().List(); err != nil || len(objs) != 0 {
+		t.Fatalf("no objects are expected to remain, got %+v with error: %+v", objs, err)
+	}
+}
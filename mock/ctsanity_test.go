@@ -0,0 +1,183 @@
+package mock
+
+import (
+	"testing"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/sbezverk/nftableslib"
+	"golang.org/x/sys/unix"
+)
+
+func TestNATCtSanity(t *testing.T) {
+	table := &nftables.Table{Name: "nat", Family: nftables.TableFamilyIPv4}
+	forward := &nftables.Chain{Name: "forward", Table: table}
+	m := InitMockConn()
+	if err := m.ti.Tables().CreateImm(table.Name, table.Family); err != nil {
+		t.Fatalf("failed to create table with error: %+v", err)
+	}
+	ci, _ := m.ti.Tables().TableChains(table.Name, table.Family)
+	if err := ci.Chains().CreateImm("forward", &nftableslib.ChainAttributes{
+		Type:     nftables.ChainTypeFilter,
+		Hook:     nftables.ChainHookForward,
+		Priority: nftables.ChainPriorityFilter,
+	}); err != nil {
+		t.Fatalf("failed to create chain with error: %+v", err)
+	}
+	fi, _ := ci.Chains().Chain("forward")
+	if _, err := fi.Rules().CreateImm(&nftableslib.Rule{
+		L4:     &nftableslib.L4Rule{L4Proto: unix.IPPROTO_TCP, Dst: &nftableslib.Port{List: []uint16{22}}},
+		Action: setActionVerdict(t, nftableslib.NFT_ACCEPT),
+	}); err != nil {
+		t.Fatalf("failed to create rule with error: %+v", err)
+	}
+	nat := func(chains ...string) *nftableslib.ChainAttributes {
+		return &nftableslib.ChainAttributes{
+			Type:           nftables.ChainTypeNAT,
+			Hook:           nftables.ChainHookPostrouting,
+			Priority:       nftables.ChainPriorityNATSource,
+			EnsureCtSanity: true,
+			CtSanityChains: chains,
+		}
+	}
+
+	failing := []struct {
+		name  string
+		attrs *nftableslib.ChainAttributes
+	}{
+		{name: "no chains", attrs: nat()},
+		{name: "missing chain", attrs: nat("input")},
+		{name: "filter chain", attrs: &nftableslib.ChainAttributes{
+			Type:           nftables.ChainTypeFilter,
+			Hook:           nftables.ChainHookInput,
+			Priority:       nftables.ChainPriorityFilter,
+			EnsureCtSanity: true,
+			CtSanityChains: []string{"forward"},
+		}},
+	}
+	for _, tt := range failing {
+		if err := ci.Chains().CreateImm("postrouting", tt.attrs); err == nil {
+			t.Fatalf("Test \"%s\" succeeded but supposed to fail", tt.name)
+		}
+		if ci.Chains().Exist("postrouting") {
+			t.Fatalf("Test \"%s\" failed, chain is not supposed to be created", tt.name)
+		}
+	}
+	if err := ci.Chains().CreateImm("prerouting", &nftableslib.ChainAttributes{
+		Type:     nftables.ChainTypeNAT,
+		Hook:     nftables.ChainHookPrerouting,
+		Priority: nftables.ChainPriorityNATDest,
+	}); err != nil {
+		t.Fatalf("failed to create chain with error: %+v", err)
+	}
+	if err := ci.Chains().CreateImm("postrouting", nat("prerouting")); err == nil {
+		t.Fatalf("conntrack sanity rules in chain of nat type are supposed to fail")
+	}
+
+	// check verifies the forward chain carries sanity rules followed by the rule of the user
+	check := func(name string, ci nftableslib.ChainsInterface, sanity bool) {
+		rules, err := m.GetRule(table, forward)
+		if err != nil {
+			t.Fatalf("Test \"%s\" failed to get rules with error: %+v", name, err)
+		}
+		want := []struct {
+			comment string
+			verdict expr.VerdictKind
+		}{{verdict: expr.VerdictAccept}}
+		if sanity {
+			want = append([]struct {
+				comment string
+				verdict expr.VerdictKind
+			}{
+				{comment: "ct sanity of nat chain postrouting", verdict: expr.VerdictAccept},
+				{comment: "ct sanity of nat chain postrouting", verdict: expr.VerdictDrop},
+			}, want...)
+		}
+		if len(rules) != len(want) {
+			t.Fatalf("Test \"%s\" failed, expected %d rules in chain forward, got %d", name, len(want), len(rules))
+		}
+		for i, r := range rules {
+			comment := ""
+			if r.UserData[0] == 0 {
+				comment = string(r.UserData[2 : 2+int(r.UserData[1])-1])
+			}
+			v, ok := r.Exprs[len(r.Exprs)-1].(*expr.Verdict)
+			if comment != want[i].comment || !ok || v.Kind != want[i].verdict {
+				t.Fatalf("Test \"%s\" failed, expected rule %d with comment %q and verdict %d, got comment %q and %+v",
+					name, i, want[i].comment, want[i].verdict, comment, r.Exprs)
+			}
+		}
+		if sanity {
+			// established,related accept
+			ct, ok := rules[0].Exprs[0].(*expr.Ct)
+			bw, _ := rules[0].Exprs[1].(*expr.Bitwise)
+			if !ok || ct.Key != expr.CtKeySTATE || bw == nil || bw.Mask[0] != 0x06 {
+				t.Fatalf("Test \"%s\" failed, expected match of established and related states, got %+v", name, rules[0].Exprs)
+			}
+			// invalid drop
+			bw, _ = rules[1].Exprs[1].(*expr.Bitwise)
+			if bw == nil || bw.Mask[0] != 0x01 {
+				t.Fatalf("Test \"%s\" failed, expected match of invalid state, got %+v", name, rules[1].Exprs)
+			}
+		}
+		if n, err := ci.Chains().RuleCount("forward"); err != nil || n != len(want) {
+			t.Fatalf("Test \"%s\" failed, expected %d rules in the store, got %d with error: %+v", name, len(want), n, err)
+		}
+	}
+
+	if err := ci.Chains().CreateImm("postrouting", nat("forward")); err != nil {
+		t.Fatalf("failed to create nat chain with error: %+v", err)
+	}
+	check("created", ci, true)
+	if err := ci.Chains().DeleteImm("postrouting"); err != nil {
+		t.Fatalf("failed to delete nat chain with error: %+v", err)
+	}
+	check("deleted", ci, false)
+
+	// Sanity rules are removed along with the nat chain by the instance synchronized from the host
+	if err := ci.Chains().CreateImm("postrouting", nat("forward")); err != nil {
+		t.Fatalf("failed to create nat chain with error: %+v", err)
+	}
+	synced := nftableslib.InitNFTables(m)
+	if _, err := synced.Tables().Sync(table.Family); err != nil {
+		t.Fatalf("failed to sync tables with error: %+v", err)
+	}
+	sci, _ := synced.Tables().TableChains(table.Name, table.Family)
+	check("synced", sci, true)
+	if err := sci.Chains().DeleteSafe("postrouting"); err != nil {
+		t.Fatalf("failed to delete nat chain with error: %+v", err)
+	}
+	check("synced deleted", sci, false)
+
+	// Queued nat chain and its sanity rules are programmed together
+	if err := sci.Chains().Create("postrouting", nat("forward")); err != nil {
+		t.Fatalf("failed to queue nat chain with error: %+v", err)
+	}
+	if err := m.Flush(); err != nil {
+		t.Fatalf("failed to flush with error: %+v", err)
+	}
+	check("queued", sci, true)
+	if err := sci.Chains().Delete("postrouting"); err != nil {
+		t.Fatalf("failed to queue deletion of nat chain with error: %+v", err)
+	}
+	if err := m.Flush(); err != nil {
+		t.Fatalf("failed to flush with error: %+v", err)
+	}
+	check("queued deleted", sci, false)
+
+	// Deletion of a nat chain is refused while its sanity rules are queued, they cannot be withdrawn
+	if err := sci.Chains().Create("postrouting", nat("forward")); err != nil {
+		t.Fatalf("failed to queue nat chain with error: %+v", err)
+	}
+	if err := sci.Chains().Delete("postrouting"); err == nil {
+		t.Fatalf("deletion of nat chain with queued sanity rules is supposed to fail")
+	}
+	if err := m.Flush(); err != nil {
+		t.Fatalf("failed to flush with error: %+v", err)
+	}
+	check("queued refused deletion", sci, true)
+	if err := sci.Chains().DeleteImm("postrouting"); err != nil {
+		t.Fatalf("failed to delete nat chain with error: %+v", err)
+	}
+	check("flushed deleted", sci, false)
+}
@@ -0,0 +1,124 @@
+package mock
+
+import (
+	"testing"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/sbezverk/nftableslib"
+)
+
+// jumpsTo returns the number of rules of the chain programmed in the mock which jump to the target
+func jumpsTo(t *testing.T, m *Mock, table *nftables.Table, chain, target string) int {
+	t.Helper()
+	rules, err := m.GetRule(table, &nftables.Chain{Name: chain, Table: table})
+	if err != nil {
+		t.Fatalf("failed to get rules of chain %s with error: %+v", chain, err)
+	}
+	n := 0
+	for _, r := range rules {
+		for _, e := range r.Exprs {
+			if v, ok := e.(*expr.Verdict); ok && v.Kind == expr.VerdictJump && v.Chain == target {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+func TestEnsureDispatch(t *testing.T) {
+	table := &nftables.Table{Name: "filter", Family: nftables.TableFamilyIPv4}
+	policy := nftableslib.ChainPolicyDrop
+	attrs := &nftableslib.ChainAttributes{
+		Type:     nftables.ChainTypeFilter,
+		Hook:     nftables.ChainHookInput,
+		Priority: nftables.ChainPriorityFilter,
+		Policy:   &policy,
+	}
+	tests := []struct {
+		name string
+		// agent programs objects before the application ensures its dispatch
+		agent func(*testing.T, nftableslib.TablesInterface)
+		// others is the number of rules of the base chain which do not belong to the application
+		others int
+	}{
+		{
+			name: "empty ruleset",
+		},
+		{
+			name: "dispatch programmed by another agent",
+			agent: func(t *testing.T, ti nftableslib.TablesInterface) {
+				if _, err := nftableslib.EnsureDispatch(ti, "filter", nftables.TableFamilyIPv4, "input", attrs, "app"); err != nil {
+					t.Fatalf("agent failed to ensure dispatch with error: %+v", err)
+				}
+			},
+		},
+		{
+			name: "base chain shared with another agent",
+			agent: func(t *testing.T, ti nftableslib.TablesInterface) {
+				ri, err := nftableslib.EnsureDispatch(ti, "filter", nftables.TableFamilyIPv4, "input", attrs, "other")
+				if err != nil {
+					t.Fatalf("agent failed to ensure dispatch with error: %+v", err)
+				}
+				if _, err := ri.Rules().CreateImm(&nftableslib.Rule{Action: setActionVerdict(t, nftableslib.NFT_ACCEPT)}); err != nil {
+					t.Fatalf("agent failed to create rule with error: %+v", err)
+				}
+			},
+			others: 1,
+		},
+	}
+	for _, tt := range tests {
+		m := InitMockConn()
+		if tt.agent != nil {
+			tt.agent(t, nftableslib.InitNFTables(m))
+		}
+		for i := 0; i < 2; i++ {
+			ri, err := nftableslib.EnsureDispatch(m.ti, "filter", nftables.TableFamilyIPv4, "input", attrs, "app")
+			if err != nil {
+				t.Fatalf("Test \"%s\" failed with error: %+v but supposed to succeed", tt.name, err)
+			}
+			if _, err := ri.Rules().CreateImm(&nftableslib.Rule{Action: setActionVerdict(t, nftableslib.NFT_ACCEPT)}); err != nil {
+				t.Fatalf("Test \"%s\" failed to create rule in chain app with error: %+v", tt.name, err)
+			}
+		}
+		if n := jumpsTo(t, m, table, "input", "app"); n != 1 {
+			t.Fatalf("Test \"%s\" failed, expected 1 jump to chain app, got %d", tt.name, n)
+		}
+		rules, _ := m.GetRule(table, &nftables.Chain{Name: "input", Table: table})
+		if len(rules) != tt.others+1 {
+			t.Fatalf("Test \"%s\" failed, expected %d rules in chain input, got %d", tt.name, tt.others+1, len(rules))
+		}
+
+		if err := nftableslib.RemoveDispatch(m.ti, "filter", nftables.TableFamilyIPv4, "input", "app", true); err != nil {
+			t.Fatalf("Test \"%s\" failed to remove dispatch with error: %+v", tt.name, err)
+		}
+		ci, err := m.ti.Tables().Table("filter", nftables.TableFamilyIPv4)
+		if err != nil {
+			t.Fatalf("Test \"%s\" failed to get table filter with error: %+v", tt.name, err)
+		}
+		if ci.Chains().Exist("app") {
+			t.Fatalf("Test \"%s\" failed, chain app exists after removal", tt.name)
+		}
+		if got := ci.Chains().Exist("input"); got != (tt.others != 0) {
+			t.Fatalf("Test \"%s\" failed, expected chain input to exist %t, got %t", tt.name, tt.others != 0, got)
+		}
+		if err := nftableslib.RemoveDispatch(m.ti, "filter", nftables.TableFamilyIPv4, "input", "app", true); err != nil {
+			t.Fatalf("Test \"%s\" failed to remove removed dispatch with error: %+v", tt.name, err)
+		}
+	}
+
+	m := InitMockConn()
+	if _, err := nftableslib.EnsureDispatch(m.ti, "filter", nftables.TableFamilyIPv4, "input", attrs, "app"); err != nil {
+		t.Fatalf("failed to ensure dispatch with error: %+v", err)
+	}
+	if _, err := nftableslib.EnsureDispatch(m.ti, "filter", nftables.TableFamilyIPv4, "app", attrs, "input"); err == nil {
+		t.Fatalf("ensuring dispatch with swapped chains supposed to fail")
+	}
+	if err := nftableslib.RemoveDispatch(m.ti, "filter", nftables.TableFamilyIPv4, "input", "app", false); err != nil {
+		t.Fatalf("failed to remove dispatch with error: %+v", err)
+	}
+	// The base chain is kept when its removal is not requested
+	if n := jumpsTo(t, m, table, "input", "app"); n != 0 {
+		t.Fatalf("expected no jumps to chain app, got %d", n)
+	}
+}
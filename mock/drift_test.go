@@ -0,0 +1,183 @@
+package mock
+
+import (
+	"testing"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/sbezverk/nftableslib"
+	"golang.org/x/sys/unix"
+)
+
+func TestVerifyDrift(t *testing.T) {
+	table := &nftables.Table{Name: "filter", Family: nftables.TableFamilyIPv4}
+	m := InitMockConn()
+	for _, name := range []string{"filter", "nat"} {
+		if err := m.ti.Tables().CreateImm(name, nftables.TableFamilyIPv4); err != nil {
+			t.Fatalf("failed to create table with error: %+v", err)
+		}
+	}
+	ci, _ := m.ti.Tables().TableChains(table.Name, table.Family)
+	for _, c := range []struct {
+		name  string
+		attrs *nftableslib.ChainAttributes
+	}{
+		{name: "input", attrs: &nftableslib.ChainAttributes{Type: nftables.ChainTypeFilter, Hook: nftables.ChainHookInput, Priority: nftables.ChainPriorityFilter}},
+		{name: "forward", attrs: &nftableslib.ChainAttributes{Type: nftables.ChainTypeFilter, Hook: nftables.ChainHookForward, Priority: nftables.ChainPriorityFilter}},
+		{name: "services"},
+	} {
+		if err := ci.Chains().CreateImm(c.name, c.attrs); err != nil {
+			t.Fatalf("failed to create chain %s with error: %+v", c.name, err)
+		}
+	}
+	ri, _ := ci.Chains().Chain("input")
+	for _, port := range [][]uint16{{22, 443}, {80}} {
+		if _, err := ri.Rules().CreateImm(&nftableslib.Rule{
+			L4:     &nftableslib.L4Rule{L4Proto: unix.IPPROTO_TCP, Dst: &nftableslib.Port{List: port}},
+			Action: setActionVerdict(t, nftableslib.NFT_ACCEPT),
+		}); err != nil {
+			t.Fatalf("failed to create rule with error: %+v", err)
+		}
+	}
+	si, _ := m.ti.Tables().TableSets(table.Name, table.Family)
+	for _, name := range []string{"allowed", "denied"} {
+		if _, err := si.Sets().CreateSet(&nftableslib.SetAttributes{Name: name, KeyType: nftables.TypeIPAddr}, nil); err != nil {
+			t.Fatalf("failed to create set with error: %+v", err)
+		}
+	}
+	report, err := m.ti.Tables().Verify()
+	if err != nil {
+		t.Fatalf("failed to verify with error: %+v", err)
+	}
+	if !report.Empty() {
+		t.Fatalf("expected no drift, got:\n%s", report)
+	}
+
+	// Induce drift of every kind
+	m.DelTable(&nftables.Table{Name: "nat", Family: nftables.TableFamilyIPv4})
+	m.AddTable(&nftables.Table{Name: "external", Family: nftables.TableFamilyIPv4})
+	m.DelChain(&nftables.Chain{Name: "services", Table: table})
+	m.AddChain(&nftables.Chain{Name: "output", Table: table})
+	m.DelChain(&nftables.Chain{Name: "forward", Table: table})
+	policy := nftables.ChainPolicyAccept
+	m.AddChain(&nftables.Chain{Name: "forward", Table: table, Type: nftables.ChainTypeFilter,
+		Hooknum: nftables.ChainHookForward, Priority: nftables.ChainPriorityMangle, Policy: &policy})
+	m.DelSet(&nftables.Set{Name: "denied", Table: table})
+	m.DelSet(&nftables.Set{Name: "allowed", Table: table})
+	if err := m.AddSet(&nftables.Set{Name: "allowed", Table: table, KeyType: nftables.TypeIPAddr, Interval: true}, nil); err != nil {
+		t.Fatalf("failed to add set with error: %+v", err)
+	}
+	if err := m.AddSet(&nftables.Set{Name: "extra", Table: table, KeyType: nftables.TypeInetService}, nil); err != nil {
+		t.Fatalf("failed to add set with error: %+v", err)
+	}
+	if err := m.Flush(); err != nil {
+		t.Fatalf("failed to flush with error: %+v", err)
+	}
+	input := &nftables.Chain{Name: "input", Table: table}
+	rules, _ := m.GetRule(table, input)
+	if err := m.DelRule(rules[1]); err != nil {
+		t.Fatalf("failed to delete rule with error: %+v", err)
+	}
+	m.AddRule(&nftables.Rule{Table: table, Chain: input, Exprs: []expr.Any{&expr.Verdict{Kind: expr.VerdictDrop}}})
+	if err := m.Flush(); err != nil {
+		t.Fatalf("failed to flush with error: %+v", err)
+	}
+
+	before, _ := ci.Chains().RuleCount("input")
+	report, err = m.ti.Tables().Verify()
+	if err != nil {
+		t.Fatalf("failed to verify with error: %+v", err)
+	}
+	want := "missing in kernel: chain services of table ip filter\n" +
+		"missing in kernel: rule 2 of chain input of table ip filter\n" +
+		"missing in kernel: set denied of table ip filter\n" +
+		"missing in kernel: table ip nat\n" +
+		"missing in store: table ip external\n" +
+		"missing in store: chain output of table ip filter\n" +
+		"missing in store: rule 3 of chain input of table ip filter\n" +
+		"missing in store: set extra of table ip filter\n" +
+		"mismatched: chain forward of table ip filter (priority: 0/-150)\n" +
+		"mismatched: set allowed of table ip filter (interval: false/true)"
+	if s := report.String(); s != want {
+		t.Fatalf("expected drift:\n%s\ngot:\n%s", want, s)
+	}
+	// Verify does not change the stores
+	if after, _ := ci.Chains().RuleCount("input"); after != before || !ci.Chains().Exist("services") || !m.ti.Tables().Exist("nat", nftables.TableFamilyIPv4) {
+		t.Fatalf("verify is not supposed to change the stores")
+	}
+
+	if err := m.ti.Tables().RepairDrift(report); err != nil {
+		t.Fatalf("failed to repair drift with error: %+v", err)
+	}
+	report, err = m.ti.Tables().Verify()
+	if err != nil {
+		t.Fatalf("failed to verify with error: %+v", err)
+	}
+	if !report.Empty() {
+		t.Fatalf("expected no drift after repair, got:\n%s", report)
+	}
+	ci, _ = m.ti.Tables().TableChains(table.Name, table.Family)
+	if n, err := ci.Chains().RuleCount("input"); err != nil || n != 2 {
+		t.Fatalf("expected 2 rules in chain input after repair, got %d with error: %+v", n, err)
+	}
+	if ci.Chains().Exist("services") || !ci.Chains().Exist("output") || m.ti.Tables().Exist("nat", nftables.TableFamilyIPv4) ||
+		!m.ti.Tables().Exist("external", nftables.TableFamilyIPv4) {
+		t.Fatalf("expected stores to follow the kernel after repair")
+	}
+}
+
+func TestVerifyDriftQueuedRules(t *testing.T) {
+	m := InitMockConn()
+	if err := m.ti.Tables().CreateImm("filter", nftables.TableFamilyIPv4); err != nil {
+		t.Fatalf("failed to create table with error: %+v", err)
+	}
+	ci, _ := m.ti.Tables().TableChains("filter", nftables.TableFamilyIPv4)
+	if err := ci.Chains().CreateImm("input", nil); err != nil {
+		t.Fatalf("failed to create chain with error: %+v", err)
+	}
+	ri, _ := ci.Chains().Chain("input")
+	for _, port := range []uint16{22, 80} {
+		if _, err := ri.Rules().Create(&nftableslib.Rule{
+			L4:     &nftableslib.L4Rule{L4Proto: unix.IPPROTO_TCP, Dst: &nftableslib.Port{List: []uint16{port}}},
+			Action: setActionVerdict(t, nftableslib.NFT_ACCEPT),
+		}); err != nil {
+			t.Fatalf("failed to queue rule with error: %+v", err)
+		}
+	}
+	tests := []struct {
+		name  string
+		flush bool
+	}{
+		{name: "queued rules"},
+		{name: "flushed rules", flush: true},
+	}
+	for _, tt := range tests {
+		if tt.flush {
+			if err := m.Flush(); err != nil {
+				t.Fatalf("Test \"%s\" failed to flush with error: %+v", tt.name, err)
+			}
+		}
+		report, err := m.ti.Tables().Verify()
+		if err != nil {
+			t.Fatalf("Test \"%s\" failed with error: %+v but supposed to succeed", tt.name, err)
+		}
+		if !report.Empty() {
+			t.Fatalf("Test \"%s\" failed, expected no drift, got:\n%s", tt.name, report)
+		}
+	}
+	// Drift of rules tracked by their rule IDs is still detected
+	rules, _ := m.GetRule(&nftables.Table{Name: "filter", Family: nftables.TableFamilyIPv4}, &nftables.Chain{Name: "input"})
+	if err := m.DelRule(rules[0]); err != nil {
+		t.Fatalf("failed to delete rule with error: %+v", err)
+	}
+	if err := m.Flush(); err != nil {
+		t.Fatalf("failed to flush with error: %+v", err)
+	}
+	report, err := m.ti.Tables().Verify()
+	if err != nil {
+		t.Fatalf("failed to verify with error: %+v", err)
+	}
+	if want := "missing in kernel: rule 1 of chain input of table ip filter"; report.String() != want {
+		t.Fatalf("expected drift:\n%s\ngot:\n%s", want, report)
+	}
+}
@@ -0,0 +1,60 @@
+package mock
+
+import (
+	"testing"
+
+	"github.com/google/nftables"
+	"github.com/sbezverk/nftableslib"
+	"golang.org/x/sys/unix"
+)
+
+func TestDryRun(t *testing.T) {
+	m := InitMockConn()
+	m.SetDryRun(true)
+	table := &nftables.Table{Name: "filter", Family: nftables.TableFamilyIPv4}
+	chain := &nftables.Chain{Name: "input", Table: table}
+	m.AddTable(table)
+	m.AddChain(chain)
+	m.AddRule(&nftables.Rule{Table: table, Chain: chain, UserData: []byte{0x2, 0x2, 0x0, 10}})
+	if err := m.Flush(); err != nil {
+		t.Fatalf("failed to validate the batch with error: %+v", err)
+	}
+	tables, err := m.ListTables()
+	if err != nil {
+		t.Fatalf("failed to list tables with error: %+v", err)
+	}
+	if len(tables) != 0 {
+		t.Fatalf("expected no tables after dry-run flush, got %d", len(tables))
+	}
+
+	m.AddTable(table)
+	m.AddChain(chain)
+	m.AddRule(&nftables.Rule{Table: table, Chain: chain, UserData: []byte{0x2, 0x2, 0x0, 10}})
+	m.AddRule(&nftables.Rule{Table: table, Chain: &nftables.Chain{Name: "forward", Table: table}, UserData: []byte{0x2, 0x2, 0x0, 20}})
+	err = m.Flush()
+	if err == nil {
+		t.Fatalf("expected the batch to fail, but it succeeded")
+	}
+	be, ok := err.(*nftableslib.BatchError)
+	if !ok {
+		t.Fatalf("expected BatchError, got %T: %+v", err, err)
+	}
+	want := nftableslib.BatchError{Index: 3, Operation: "add rule", Table: "filter", Chain: "forward", RuleID: 20, Err: unix.ENOENT}
+	if *be != want {
+		t.Fatalf("expected error %+v, got %+v", want, *be)
+	}
+
+	m.SetDryRun(false)
+	m.AddTable(table)
+	m.AddChain(chain)
+	if err := m.Flush(); err != nil {
+		t.Fatalf("failed to program the batch with error: %+v", err)
+	}
+	chains, err := m.ListChains()
+	if err != nil {
+		t.Fatalf("failed to list chains with error: %+v", err)
+	}
+	if len(chains) != 1 {
+		t.Fatalf("expected 1 chain after flush, got %d", len(chains))
+	}
+}
@@ -0,0 +1,205 @@
+package mock
+
+import (
+	"testing"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/sbezverk/nftableslib"
+	"golang.org/x/sys/unix"
+)
+
+func TestDualStack(t *testing.T) {
+	addrs := func(list ...string) *nftableslib.IPAddrSpec {
+		spec := &nftableslib.IPAddrSpec{}
+		for _, a := range list {
+			addr, err := nftableslib.NewIPAddr(a)
+			if err != nil {
+				t.Fatalf("failed to parse address %s with error: %+v", a, err)
+			}
+			spec.List = append(spec.List, addr)
+		}
+		return spec
+	}
+	https := func(src *nftableslib.IPAddrSpec) *nftableslib.Rule {
+		return &nftableslib.Rule{
+			L3: &nftableslib.L3Rule{Src: src},
+			L4: &nftableslib.L4Rule{
+				L4Proto: unix.IPPROTO_TCP,
+				Dst:     &nftableslib.Port{List: []uint16{443}},
+			},
+			Action: setActionVerdict(t, nftableslib.NFT_ACCEPT),
+		}
+	}
+	// table creates the table of the family with the input chain
+	table := func(m *Mock, family nftables.TableFamily) nftableslib.ChainsInterface {
+		if err := m.ti.Tables().CreateImm("filter", family); err != nil {
+			t.Fatalf("failed to create table with error: %+v", err)
+		}
+		ci, _ := m.ti.Tables().TableChains("filter", family)
+		if err := ci.Chains().CreateImm("input", nil); err != nil {
+			t.Fatalf("failed to create chain with error: %+v", err)
+		}
+		return ci
+	}
+	rules := func(m *Mock, family nftables.TableFamily) []*nftables.Rule {
+		tbl := &nftables.Table{Name: "filter", Family: family}
+		rules, err := m.GetRule(tbl, &nftables.Chain{Name: "input", Table: tbl})
+		if err != nil {
+			t.Fatalf("failed to get rules with error: %+v", err)
+		}
+		return rules
+	}
+	// addrLen returns the length of addresses loaded from the network header by the rule
+	addrLen := func(r *nftables.Rule) uint32 {
+		for _, e := range r.Exprs {
+			if p, ok := e.(*expr.Payload); ok && p.Base == expr.PayloadBaseNetworkHeader {
+				return p.Len
+			}
+		}
+		return 0
+	}
+	// nfproto returns the family selected by "meta nfproto" of the rule, 0 if the rule is not guarded
+	nfproto := func(r *nftables.Rule) byte {
+		for i, e := range r.Exprs {
+			if m, ok := e.(*expr.Meta); ok && m.Key == expr.MetaKeyNFPROTO {
+				return r.Exprs[i+1].(*expr.Cmp).Data[0]
+			}
+		}
+		return 0
+	}
+
+	tests := []struct {
+		name string
+		rule *nftableslib.Rule
+		ipv4 bool
+		ipv6 bool
+	}{
+		{
+			name: "mixed list",
+			rule: https(addrs("10.0.0.0/8", "2001:db8::/32", "192.168.1.1")),
+			ipv4: true,
+			ipv6: true,
+		},
+		{
+			name: "ipv4 only",
+			rule: https(addrs("10.0.0.0/8", "192.168.1.1")),
+			ipv4: true,
+		},
+		{
+			name: "family neutral",
+			rule: https(nil),
+			ipv4: true,
+			ipv6: true,
+		},
+		{
+			name: "icmpv6 binds to ipv6",
+			rule: &nftableslib.Rule{
+				L3:     &nftableslib.L3Rule{Src: addrs("10.0.0.0/8", "fe80::/10")},
+				L4:     &nftableslib.L4Rule{L4Proto: unix.IPPROTO_ICMPV6},
+				Action: setActionVerdict(t, nftableslib.NFT_ACCEPT),
+			},
+			ipv6: true,
+		},
+	}
+	for _, tt := range tests {
+		// Separate ip and ip6 tables
+		m := InitMockConn()
+		ds, err := nftableslib.NewDualStack(table(m, nftables.TableFamilyIPv4), table(m, nftables.TableFamilyIPv6), "input")
+		if err != nil {
+			t.Fatalf("Test \"%s\" failed with error: %+v but supposed to succeed", tt.name, err)
+		}
+		h, err := ds.Create(tt.rule)
+		if err != nil {
+			t.Fatalf("Test \"%s\" failed with error: %+v but supposed to succeed", tt.name, err)
+		}
+		for _, f := range []struct {
+			family nftables.TableFamily
+			handle uint64
+			want   bool
+			len    uint32
+		}{
+			{nftables.TableFamilyIPv4, h.IPv4, tt.ipv4, 4},
+			{nftables.TableFamilyIPv6, h.IPv6, tt.ipv6, 16},
+		} {
+			rr := rules(m, f.family)
+			if !f.want {
+				if f.handle != 0 || len(rr) != 0 {
+					t.Fatalf("Test \"%s\" failed, family %v is not expected to get a rule, got handle %d and %d rules", tt.name, f.family, f.handle, len(rr))
+				}
+				continue
+			}
+			if len(rr) != 1 || rr[0].Handle != f.handle {
+				t.Fatalf("Test \"%s\" failed, family %v is expected to get a rule with handle %d, got %d rules", tt.name, f.family, f.handle, len(rr))
+			}
+			if l := addrLen(rr[0]); tt.rule.L3 != nil && tt.rule.L3.Src != nil && l != f.len {
+				t.Fatalf("Test \"%s\" failed, rule of family %v is expected to match addresses of %d bytes, got %d", tt.name, f.family, f.len, l)
+			}
+		}
+
+		// A single inet table
+		m = InitMockConn()
+		ds, err = nftableslib.NewINetDualStack(table(m, nftables.TableFamilyINet), "input")
+		if err != nil {
+			t.Fatalf("Test \"%s\" failed with error: %+v but supposed to succeed", tt.name, err)
+		}
+		if h, err = ds.Create(tt.rule); err != nil {
+			t.Fatalf("Test \"%s\" failed with error: %+v but supposed to succeed", tt.name, err)
+		}
+		rr := rules(m, nftables.TableFamilyINet)
+		if tt.rule.L3 == nil || tt.rule.L3.Src == nil {
+			// Family neutral rule is not split
+			if len(rr) != 1 || h.IPv4 != rr[0].Handle || h.IPv6 != rr[0].Handle || nfproto(rr[0]) != 0 {
+				t.Fatalf("Test \"%s\" failed, expected a single unguarded inet rule, got %d rules and handles %+v", tt.name, len(rr), h)
+			}
+			continue
+		}
+		handles := map[byte]uint64{}
+		for _, r := range rr {
+			handles[nfproto(r)] = r.Handle
+		}
+		if len(rr) != len(handles) || handles[unix.NFPROTO_IPV4] != h.IPv4 || handles[unix.NFPROTO_IPV6] != h.IPv6 ||
+			(h.IPv4 != 0) != tt.ipv4 || (h.IPv6 != 0) != tt.ipv6 {
+			t.Fatalf("Test \"%s\" failed, expected inet rules guarded by family, got handles %+v and rules by family %v", tt.name, h, handles)
+		}
+	}
+
+	// Rules bound to a family which cannot be split are rejected, nothing is programmed
+	version := byte(4)
+	options := true
+	nfprotoIPv4 := nftables.TableFamilyIPv4
+	icmpReject, _ := nftableslib.SetReject(unix.NFT_REJECT_ICMP_UNREACH, 3)
+	icmpxReject, _ := nftableslib.SetReject(unix.NFT_REJECT_ICMPX_UNREACH, unix.NFT_REJECT_ICMPX_PORT_UNREACH)
+	snat, _ := nftableslib.SetSNAT(&nftableslib.NATAttributes{L3Addr: [2]*nftableslib.IPAddr{addrs("10.0.0.1").List[0]}})
+	m := InitMockConn()
+	ds, err := nftableslib.NewDualStack(table(m, nftables.TableFamilyIPv4), table(m, nftables.TableFamilyIPv6), "input")
+	if err != nil {
+		t.Fatalf("failed to create dual stack with error: %+v", err)
+	}
+	for _, r := range []*nftableslib.Rule{
+		nil,
+		{L3: &nftableslib.L3Rule{Version: &version}},
+		{L3: &nftableslib.L3Rule{Options: &options}},
+		{Meta: &nftableslib.MetaRule{NFProto: &nfprotoIPv4}, Action: setActionVerdict(t, nftableslib.NFT_ACCEPT)},
+		{L4: &nftableslib.L4Rule{L4Proto: unix.IPPROTO_UDP}, Action: icmpReject},
+		{L4: &nftableslib.L4Rule{L4Proto: unix.IPPROTO_UDP}, Action: icmpxReject},
+		{L4: &nftableslib.L4Rule{L4Proto: unix.IPPROTO_TCP}, Action: snat},
+		{L3: &nftableslib.L3Rule{Src: &nftableslib.IPAddrSpec{SetRef: &nftableslib.SetRef{Name: "allowed"}}}},
+		{L3: &nftableslib.L3Rule{Src: addrs("10.0.0.1")}, L4: &nftableslib.L4Rule{L4Proto: unix.IPPROTO_ICMPV6}},
+		// Targets are checked for both families before anything is queued
+		{L3: &nftableslib.L3Rule{Src: addrs("10.0.0.1", "2001:db8::1")}, Action: setActionVerdict(t, unix.NFT_JUMP, "missing")},
+	} {
+		if _, err := ds.Create(r); err == nil {
+			t.Fatalf("creating dual stack rule %+v is supposed to fail", r)
+		}
+	}
+	if n := len(rules(m, nftables.TableFamilyIPv4)) + len(rules(m, nftables.TableFamilyIPv6)); n != 0 {
+		t.Fatalf("failed dual stack rules are not expected to be programmed, got %d rules", n)
+	}
+	if _, err := nftableslib.NewDualStack(table(m, nftables.TableFamilyINet), nil, "input"); err == nil {
+		t.Fatalf("creating dual stack with chains of inet table as ipv4 chains is supposed to fail")
+	}
+	if _, err := nftableslib.NewINetDualStack(nil, "input"); err == nil {
+		t.Fatalf("creating inet dual stack without chains is supposed to fail")
+	}
+}
@@ -0,0 +1,214 @@
+package mock
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"github.com/sbezverk/nftableslib"
+	"golang.org/x/sys/unix"
+)
+
+func TestDumpTable(t *testing.T) {
+	m := InitMockConn()
+	table := &nftables.Table{Name: "filter", Family: nftables.TableFamilyIPv4}
+	ti := m.ti.Tables()
+	if err := ti.CreateImm(table.Name, table.Family); err != nil {
+		t.Fatalf("failed to create table with error: %+v", err)
+	}
+	ci, _ := ti.TableChains(table.Name, table.Family)
+	if err := ci.Chains().CreateImm("input", &nftableslib.ChainAttributes{
+		Type:     nftables.ChainTypeFilter,
+		Hook:     nftables.ChainHookInput,
+		Priority: nftables.ChainPriorityFilter,
+	}); err != nil {
+		t.Fatalf("failed to create chain with error: %+v", err)
+	}
+	if err := ci.Chains().CreateImm("web", nil); err != nil {
+		t.Fatalf("failed to create chain with error: %+v", err)
+	}
+	ri, _ := ci.Chains().Chain("web")
+	if _, err := ri.Rules().CreateImm(&nftableslib.Rule{
+		L4: &nftableslib.L4Rule{
+			L4Proto: unix.IPPROTO_TCP,
+			Dst:     &nftableslib.Port{List: []uint16{80}},
+		},
+		Action: setActionVerdict(t, nftableslib.NFT_ACCEPT),
+	}); err != nil {
+		t.Fatalf("failed to create rule with error: %+v", err)
+	}
+	// A rule of another application with a counter which already counted packets
+	m.AddRule(&nftables.Rule{
+		Table: table,
+		Chain: &nftables.Chain{Name: "input", Table: table},
+		Exprs: []expr.Any{&expr.Counter{Packets: 5, Bytes: 300}},
+	})
+	if err := m.Flush(); err != nil {
+		t.Fatalf("failed to flush with error: %+v", err)
+	}
+	si, _ := ti.TableSets(table.Name, table.Family)
+	ports := make([]nftables.SetElement, 0)
+	for _, p := range []uint16{22, 80} {
+		ports = append(ports, nftables.SetElement{Key: binaryutil.BigEndian.PutUint16(p)})
+	}
+	if _, err := si.Sets().CreateSet(&nftableslib.SetAttributes{Name: "ports", KeyType: nftables.TypeInetService}, ports); err != nil {
+		t.Fatalf("failed to create set with error: %+v", err)
+	}
+
+	tests := []struct {
+		name     string
+		opts     *nftableslib.DumpOptions
+		sections []string
+		chains   []string
+		sets     []string
+		// rules is the number of rules of each dumped chain
+		rules    int
+		elements int
+		handles  bool
+		packets  uint64
+	}{
+		{
+			name:     "everything",
+			sections: []string{"chains", "rules", "sets", "elements", "counters", "handles"},
+			chains:   []string{"input", "web"},
+			sets:     []string{"ports"},
+			rules:    1,
+			elements: 2,
+			handles:  true,
+			packets:  5,
+		},
+		{
+			name:     "rules only",
+			opts:     &nftableslib.DumpOptions{NoSets: true},
+			sections: []string{"chains", "rules", "elements", "counters", "handles"},
+			chains:   []string{"input", "web"},
+			rules:    1,
+			handles:  true,
+			packets:  5,
+		},
+		{
+			name:     "sets only",
+			opts:     &nftableslib.DumpOptions{NoChains: true},
+			sections: []string{"sets", "elements"},
+			sets:     []string{"ports"},
+			elements: 2,
+		},
+		{
+			name:     "sets without elements",
+			opts:     &nftableslib.DumpOptions{NoChains: true, NoElements: true},
+			sections: []string{"sets"},
+			sets:     []string{"ports"},
+		},
+		{
+			name:     "chains without rules",
+			opts:     &nftableslib.DumpOptions{NoRules: true, NoSets: true},
+			sections: []string{"chains"},
+			chains:   []string{"input", "web"},
+		},
+		{
+			name:     "rules without counters and handles",
+			opts:     &nftableslib.DumpOptions{NoSets: true, NoCounters: true, NoHandles: true},
+			sections: []string{"chains", "rules", "elements"},
+			chains:   []string{"input", "web"},
+			rules:    1,
+		},
+	}
+	for _, tt := range tests {
+		b, err := ti.DumpTable(table.Name, table.Family, tt.opts)
+		if err != nil {
+			t.Fatalf("Test \"%s\" failed with error: %+v but supposed to succeed", tt.name, err)
+		}
+		var d nftableslib.TableDump
+		if err := json.Unmarshal(b, &d); err != nil {
+			t.Fatalf("Test \"%s\" failed to unmarshal dump with error: %+v", tt.name, err)
+		}
+		if d.Name != table.Name || d.Family != table.Family {
+			t.Fatalf("Test \"%s\" failed, expected table %s of family %v, got %s of family %v", tt.name, table.Name, table.Family, d.Name, d.Family)
+		}
+		if !reflect.DeepEqual(d.Sections, tt.sections) {
+			t.Fatalf("Test \"%s\" failed, expected sections %v, got %v", tt.name, tt.sections, d.Sections)
+		}
+		chains := make([]string, 0)
+		for _, c := range d.Chains {
+			chains = append(chains, c.Name)
+			if len(c.Rules) != tt.rules {
+				t.Fatalf("Test \"%s\" failed, expected %d rules in chain %s, got %d", tt.name, tt.rules, c.Name, len(c.Rules))
+			}
+			if c.Base != (c.Name == "input") {
+				t.Fatalf("Test \"%s\" failed, chain %s has unexpected base %t", tt.name, c.Name, c.Base)
+			}
+			for _, r := range c.Rules {
+				if (r.Handle != 0) != tt.handles {
+					t.Fatalf("Test \"%s\" failed, chain %s has rule with unexpected handle %d", tt.name, c.Name, r.Handle)
+				}
+				if c.Name != "input" {
+					continue
+				}
+				var exprs []struct {
+					Type string
+					Expr expr.Counter
+				}
+				if err := json.Unmarshal(r.Exprs, &exprs); err != nil {
+					t.Fatalf("Test \"%s\" failed to unmarshal expressions %s with error: %+v", tt.name, string(r.Exprs), err)
+				}
+				if len(exprs) == 0 || exprs[0].Type != "*expr.Counter" || exprs[0].Expr.Packets != tt.packets {
+					t.Fatalf("Test \"%s\" failed, expected counter of %d packets, got expressions %s", tt.name, tt.packets, string(r.Exprs))
+				}
+			}
+		}
+		if len(tt.chains) != len(chains) || (len(chains) != 0 && !reflect.DeepEqual(chains, tt.chains)) {
+			t.Fatalf("Test \"%s\" failed, expected chains %v, got %v", tt.name, tt.chains, chains)
+		}
+		sets := make([]string, 0)
+		for _, s := range d.Sets {
+			sets = append(sets, s.Name)
+			if len(s.Elements) != tt.elements {
+				t.Fatalf("Test \"%s\" failed, expected %d elements in set %s, got %d", tt.name, tt.elements, s.Name, len(s.Elements))
+			}
+		}
+		if len(tt.sets) != len(sets) || (len(sets) != 0 && !reflect.DeepEqual(sets, tt.sets)) {
+			t.Fatalf("Test \"%s\" failed, expected sets %v, got %v", tt.name, tt.sets, sets)
+		}
+		// Sections left out are not present in the dump at all
+		if strings.Contains(string(b), "\"chains\":") != (len(tt.chains) != 0) ||
+			strings.Contains(string(b), "\"sets\":") != (len(tt.sets) != 0) {
+			t.Fatalf("Test \"%s\" failed, dump %s carries sections left out", tt.name, string(b))
+		}
+	}
+
+	// A single chain
+	b, err := ci.Chains().DumpChain("input", &nftableslib.DumpOptions{NoHandles: true})
+	if err != nil {
+		t.Fatalf("failed to dump chain with error: %+v", err)
+	}
+	var cd nftableslib.ChainDump
+	if err := json.Unmarshal(b, &cd); err != nil {
+		t.Fatalf("failed to unmarshal dump of chain with error: %+v", err)
+	}
+	if cd.Name != "input" || !cd.Base || cd.Type != nftables.ChainTypeFilter || cd.Hooknum != nftables.ChainHookInput || len(cd.Rules) != 1 {
+		t.Fatalf("unexpected dump of chain %s", string(b))
+	}
+	if sections := []string{"chains", "rules", "elements", "counters"}; !reflect.DeepEqual(cd.Sections, sections) {
+		t.Fatalf("expected sections of chain's dump %v, got %v", sections, cd.Sections)
+	}
+	if cd.Rules[0].Handle != 0 {
+		t.Fatalf("dump of chain without handles is not expected to carry handle %d", cd.Rules[0].Handle)
+	}
+
+	if _, err := ti.DumpTable("nat", table.Family, nil); err == nil {
+		t.Fatalf("dumping missing table is supposed to fail")
+	}
+	if _, err := ti.DumpTable(table.Name, nftables.TableFamilyIPv6, nil); err == nil {
+		t.Fatalf("dumping table of another family is supposed to fail")
+	}
+	if _, err := ci.Chains().DumpChain("output", nil); err == nil {
+		t.Fatalf("dumping missing chain is supposed to fail")
+	}
+	if _, err := ci.Chains().DumpChain("in", nil); err == nil {
+		t.Fatalf("dumping chain by a prefix of its name is supposed to fail")
+	}
+}
@@ -0,0 +1,332 @@
+package mock
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/nftables"
+	"github.com/sbezverk/nftableslib"
+	"golang.org/x/sys/unix"
+)
+
+// fakeClock is the clock of the scheduler expiring rules, time moves only when it is advanced
+type fakeClock struct {
+	sync.Mutex
+	now     time.Time
+	waiters []*fakeWaiter
+}
+
+type fakeWaiter struct {
+	at time.Time
+	ch chan time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Unix(1000, 0)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.Lock()
+	defer c.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.Lock()
+	defer c.Unlock()
+	w := &fakeWaiter{at: c.now.Add(d), ch: make(chan time.Time, 1)}
+	c.waiters = append(c.waiters, w)
+	return w.ch
+}
+
+// advance moves the clock and fires waiters whose time came
+func (c *fakeClock) advance(d time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+	c.now = c.now.Add(d)
+	waiters := c.waiters[:0]
+	for _, w := range c.waiters {
+		if w.at.After(c.now) {
+			waiters = append(waiters, w)
+			continue
+		}
+		w.ch <- c.now
+	}
+	c.waiters = waiters
+}
+
+// waitFor waits until the scheduler waits for the time at, so advancing the clock wakes it up
+func (c *fakeClock) waitFor(t *testing.T, at time.Time) {
+	t.Helper()
+	waitUntil(t, "scheduler waits for "+at.String(), func() bool {
+		c.Lock()
+		defer c.Unlock()
+		for _, w := range c.waiters {
+			if w.at.Equal(at) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// waitUntil waits for the condition changed by the scheduler goroutine
+func waitUntil(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for i := 0; i < 500; i++ {
+		if cond() {
+			return
+		}
+		time.Sleep(2 * time.Millisecond)
+	}
+	t.Fatalf("timed out waiting until %s", what)
+}
+
+func TestRuleTTL(t *testing.T) {
+	table := &nftables.Table{Name: "filter", Family: nftables.TableFamilyIPv4}
+	allow := &nftableslib.Rule{
+		L4: &nftableslib.L4Rule{
+			L4Proto: unix.IPPROTO_TCP,
+			Dst:     &nftableslib.Port{List: []uint16{2222}},
+		},
+		Action:   setActionVerdict(t, nftableslib.NFT_ACCEPT),
+		UserData: nftableslib.MakeRuleComment("temporary ssh"),
+	}
+	// setup returns rules of the input chain of the table programmed in the mock by a store with the clock
+	setup := func(m *Mock, clock nftableslib.Clock) nftableslib.RulesInterface {
+		ti := nftableslib.InitNFTables(m, nftableslib.WithClock(clock))
+		if err := ti.Tables().CreateImm(table.Name, table.Family); err != nil {
+			t.Fatalf("failed to create table with error: %+v", err)
+		}
+		ci, _ := ti.Tables().TableChains(table.Name, table.Family)
+		if err := ci.Chains().CreateImm("input", nil); err != nil {
+			t.Fatalf("failed to create chain with error: %+v", err)
+		}
+		ri, _ := ci.Chains().Chain("input")
+		return ri
+	}
+	// programmed returns true if the rule with the handle is programmed in the mock
+	programmed := func(m *Mock, handle uint64) bool {
+		rules, err := m.GetRule(table, &nftables.Chain{Name: "input", Table: table})
+		if err != nil {
+			t.Fatalf("failed to get rules with error: %+v", err)
+		}
+		for _, r := range rules {
+			if r.Handle == handle {
+				return true
+			}
+		}
+		return false
+	}
+	start := newFakeClock().Now()
+
+	// The rule is deleted when its TTL extended by an hour elapses
+	m := InitMockConn()
+	clock := newFakeClock()
+	ri := setup(m, clock)
+	h, err := ri.Rules().CreateWithTTL(allow, 2*time.Hour)
+	if err != nil {
+		t.Fatalf("failed to create rule with ttl with error: %+v", err)
+	}
+	if ttl, err := ri.Rules().GetTTL(h); err != nil || ttl != 2*time.Hour {
+		t.Fatalf("expected ttl of 2h, got %s with error: %+v", ttl, err)
+	}
+	ud, err := ri.Rules().GetRulesUserData()
+	if err != nil || string(ud[h]) != string(allow.UserData) {
+		t.Fatalf("expected user data of the rule %v, got %v with error: %+v", allow.UserData, ud[h], err)
+	}
+	clock.waitFor(t, start.Add(2*time.Hour))
+	clock.advance(time.Hour)
+	if err := ri.Rules().ExtendTTL(h, time.Hour); err != nil {
+		t.Fatalf("failed to extend ttl with error: %+v", err)
+	}
+	if ttl, err := ri.Rules().GetTTL(h); err != nil || ttl != 2*time.Hour {
+		t.Fatalf("expected ttl of 2h after extension, got %s with error: %+v", ttl, err)
+	}
+	clock.waitFor(t, start.Add(3*time.Hour))
+	clock.advance(time.Hour)
+	if !programmed(m, h) {
+		t.Fatalf("rule is not expected to expire before extended ttl elapses")
+	}
+	clock.advance(time.Hour)
+	waitUntil(t, "rule expires", func() bool { return !programmed(m, h) })
+	if _, err := ri.Rules().GetTTL(h); err == nil {
+		t.Fatalf("expired rule is not expected to have ttl")
+	}
+
+	// Cancelled expiry keeps the rule
+	m = InitMockConn()
+	clock = newFakeClock()
+	ri = setup(m, clock)
+	if h, err = ri.Rules().CreateWithTTL(allow, time.Minute); err != nil {
+		t.Fatalf("failed to create rule with ttl with error: %+v", err)
+	}
+	if err := ri.Rules().CancelTTL(h); err != nil {
+		t.Fatalf("failed to cancel ttl with error: %+v", err)
+	}
+	clock.advance(time.Hour)
+	if !programmed(m, h) {
+		t.Fatalf("rule with cancelled ttl is not expected to be deleted")
+	}
+	if err := ri.Rules().CancelTTL(h); err == nil {
+		t.Fatalf("cancelling ttl of a rule without ttl is supposed to fail")
+	}
+	if err := ri.Rules().ExtendTTL(h, time.Hour); err == nil {
+		t.Fatalf("extending ttl of a rule without ttl is supposed to fail")
+	}
+
+	// Deleted rule is not expired
+	if h, err = ri.Rules().CreateWithTTL(allow, time.Minute); err != nil {
+		t.Fatalf("failed to create rule with ttl with error: %+v", err)
+	}
+	if err := ri.Rules().DeleteImm(h); err != nil {
+		t.Fatalf("failed to delete rule with error: %+v", err)
+	}
+	if _, err := ri.Rules().GetTTL(h); err == nil {
+		t.Fatalf("deleted rule is not expected to have ttl")
+	}
+
+	// Expiry does not program operations queued by the caller
+	if h, err = ri.Rules().CreateWithTTL(allow, time.Minute); err != nil {
+		t.Fatalf("failed to create rule with ttl with error: %+v", err)
+	}
+	if _, err := ri.Rules().Create(&nftableslib.Rule{Action: setActionVerdict(t, nftableslib.NFT_ACCEPT)}); err != nil {
+		t.Fatalf("failed to queue rule with error: %+v", err)
+	}
+	clock.waitFor(t, start.Add(time.Hour+time.Minute))
+	clock.advance(time.Minute)
+	waitUntil(t, "rule expires", func() bool { return !programmed(m, h) })
+	if rules, _ := m.GetRule(table, &nftables.Chain{Name: "input", Table: table}); len(rules) != 1 {
+		t.Fatalf("expected 1 rule on the host after expiry, got %d", len(rules))
+	}
+	if err := m.Flush(); err != nil {
+		t.Fatalf("failed to flush queued rule with error: %+v", err)
+	}
+	if rules, _ := m.GetRule(table, &nftables.Chain{Name: "input", Table: table}); len(rules) != 2 {
+		t.Fatalf("expected 2 rules on the host after flush of the queued rule, got %d", len(rules))
+	}
+
+	// Changes of expiry do not program operations queued by the caller
+	if h, err = ri.Rules().CreateWithTTL(allow, time.Hour); err != nil {
+		t.Fatalf("failed to create rule with ttl with error: %+v", err)
+	}
+	if _, err := ri.Rules().Create(&nftableslib.Rule{Action: setActionVerdict(t, nftableslib.NFT_ACCEPT)}); err != nil {
+		t.Fatalf("failed to queue rule with error: %+v", err)
+	}
+	if err := ri.Rules().ExtendTTL(h, time.Hour); err != nil {
+		t.Fatalf("failed to extend ttl with error: %+v", err)
+	}
+	if err := ri.Rules().CancelTTL(h); err != nil {
+		t.Fatalf("failed to cancel ttl with error: %+v", err)
+	}
+	if rules, _ := m.GetRule(table, &nftables.Chain{Name: "input", Table: table}); len(rules) != 3 {
+		t.Fatalf("expected 3 rules on the host after expiry changes, got %d", len(rules))
+	}
+	if err := m.Flush(); err != nil {
+		t.Fatalf("failed to flush queued rule with error: %+v", err)
+	}
+	if rules, _ := m.GetRule(table, &nftables.Chain{Name: "input", Table: table}); len(rules) != 4 {
+		t.Fatalf("expected 4 rules on the host after flush of the queued rule, got %d", len(rules))
+	}
+
+	// A restarted application resumes expiries by Sync
+	tests := []struct {
+		name string
+		// elapsed is the time passed before the store is synced
+		elapsed time.Duration
+		ttl     time.Duration
+	}{
+		{
+			name:    "expiry in the future",
+			elapsed: 30 * time.Minute,
+			ttl:     90 * time.Minute,
+		},
+		{
+			name:    "expiry in the past",
+			elapsed: 3 * time.Hour,
+		},
+	}
+	for _, tt := range tests {
+		m := InitMockConn()
+		// The clock of the first store never moves, as if the application stopped
+		ri := setup(m, newFakeClock())
+		h, err := ri.Rules().CreateWithTTL(allow, 2*time.Hour)
+		if err != nil {
+			t.Fatalf("Test \"%s\" failed with error: %+v but supposed to succeed", tt.name, err)
+		}
+		clock := newFakeClock()
+		clock.advance(tt.elapsed)
+		ti := nftableslib.InitNFTables(m, nftableslib.WithClock(clock))
+		if _, err := ti.Tables().Sync(table.Family); err != nil {
+			t.Fatalf("Test \"%s\" failed to sync with error: %+v", tt.name, err)
+		}
+		if tt.ttl == 0 {
+			waitUntil(t, tt.name+" rule expires", func() bool { return !programmed(m, h) })
+			continue
+		}
+		ci, _ := ti.Tables().TableChains(table.Name, table.Family)
+		sri, _ := ci.Chains().Chain("input")
+		if ttl, err := sri.Rules().GetTTL(h); err != nil || ttl != tt.ttl {
+			t.Fatalf("Test \"%s\" failed, expected ttl %s after sync, got %s with error: %+v", tt.name, tt.ttl, ttl, err)
+		}
+		clock.waitFor(t, start.Add(2*time.Hour))
+		clock.advance(tt.ttl)
+		waitUntil(t, tt.name+" rule expires", func() bool { return !programmed(m, h) })
+	}
+}
+
+func TestRuleTTLNetlink(t *testing.T) {
+	k := InitMockNetlink()
+	conn := k.Conn()
+	clock := newFakeClock()
+	ti, err := nftableslib.InitNFTablesWithConn(conn, nftableslib.WithClock(clock))
+	if err != nil {
+		t.Fatalf("failed to initialize library with injected connection with error: %+v", err)
+	}
+	table := &nftables.Table{Name: "filter", Family: nftables.TableFamilyIPv4}
+	chain := &nftables.Chain{Name: "input", Table: table}
+	if err := ti.Tables().CreateImm(table.Name, table.Family); err != nil {
+		t.Fatalf("failed to create table with error: %+v", err)
+	}
+	ci, _ := ti.Tables().TableChains(table.Name, table.Family)
+	if err := ci.Chains().CreateImm(chain.Name, nil); err != nil {
+		t.Fatalf("failed to create chain with error: %+v", err)
+	}
+	ri, _ := ci.Chains().Chain(chain.Name)
+	h, err := ri.Rules().CreateWithTTL(&nftableslib.Rule{
+		L4:     &nftableslib.L4Rule{L4Proto: unix.IPPROTO_TCP, Dst: &nftableslib.Port{List: []uint16{2222}}},
+		Action: setActionVerdict(t, nftableslib.NFT_ACCEPT),
+	}, time.Minute)
+	if err != nil {
+		t.Fatalf("failed to create rule with ttl with error: %+v", err)
+	}
+	// Rule queued by the caller stays queued when the expired rule is deleted
+	if _, err := ri.Rules().Create(&nftableslib.Rule{Action: setActionVerdict(t, nftableslib.NFT_ACCEPT)}); err != nil {
+		t.Fatalf("failed to queue rule with error: %+v", err)
+	}
+	host := func() []*nftables.Rule {
+		rules, err := k.Conn().GetRule(table, chain)
+		if err != nil {
+			t.Fatalf("failed to get rules with error: %+v", err)
+		}
+		return rules
+	}
+	// Rule queued by the caller stays queued when the expiry is extended
+	clock.waitFor(t, newFakeClock().Now().Add(time.Minute))
+	if err := ri.Rules().ExtendTTL(h, time.Minute); err != nil {
+		t.Fatalf("failed to extend ttl with error: %+v", err)
+	}
+	if rules := host(); len(rules) != 1 || rules[0].Handle != h {
+		t.Fatalf("expected only the rule with extended ttl on the host, got %+v", rules)
+	}
+	clock.waitFor(t, newFakeClock().Now().Add(2*time.Minute))
+	clock.advance(2 * time.Minute)
+	waitUntil(t, "rule expires", func() bool { return len(host()) == 0 })
+	if err := conn.Flush(); err != nil {
+		t.Fatalf("failed to flush queued rule with error: %+v", err)
+	}
+	if rules := host(); len(rules) != 1 || rules[0].Handle == h {
+		t.Fatalf("expected only the queued rule on the host, got %+v", rules)
+	}
+}
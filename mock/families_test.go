@@ -0,0 +1,122 @@
+package mock
+
+import (
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/google/nftables"
+	"github.com/sbezverk/nftableslib"
+	"golang.org/x/sys/unix"
+)
+
+func TestSameNamesInFamilies(t *testing.T) {
+	k := InitMockNetlink()
+	ti, _ := nftableslib.InitNFTablesWithConn(k.Conn())
+	families := []struct {
+		family nftables.TableFamily
+		rules  int
+		key    nftables.SetDatatype
+		addr   net.IP
+	}{
+		{family: nftables.TableFamilyIPv4, rules: 1, key: nftables.TypeIPAddr, addr: net.ParseIP("10.0.0.1").To4()},
+		{family: nftables.TableFamilyIPv6, rules: 2, key: nftables.TypeIP6Addr, addr: net.ParseIP("2001:db8::1").To16()},
+	}
+	for _, f := range families {
+		if err := ti.Tables().CreateImm("filter", f.family); err != nil {
+			t.Fatalf("failed to create table of family %d with error: %+v", f.family, err)
+		}
+		ci, _ := ti.Tables().TableChains("filter", f.family)
+		if err := ci.Chains().CreateImm("input", nil); err != nil {
+			t.Fatalf("failed to create chain of family %d with error: %+v", f.family, err)
+		}
+		ri, _ := ci.Chains().Chain("input")
+		for i := 0; i < f.rules; i++ {
+			rule := &nftableslib.Rule{
+				L4:     &nftableslib.L4Rule{L4Proto: unix.IPPROTO_TCP, Dst: &nftableslib.Port{List: []uint16{uint16(22 + i)}}},
+				Action: setActionVerdict(t, nftableslib.NFT_ACCEPT),
+			}
+			if _, err := ri.Rules().CreateImm(rule); err != nil {
+				t.Fatalf("failed to create rule of family %d with error: %+v", f.family, err)
+			}
+		}
+		si, _ := ti.Tables().TableSets("filter", f.family)
+		if _, err := si.Sets().CreateSet(&nftableslib.SetAttributes{Name: "allowed", KeyType: f.key},
+			[]nftables.SetElement{{Key: f.addr}}); err != nil {
+			t.Fatalf("failed to create set of family %d with error: %+v", f.family, err)
+		}
+	}
+
+	// check verifies the store of the table of the family carries only objects of the family
+	check := func(name string, tables nftableslib.TablesInterface) {
+		for _, f := range families {
+			ci, err := tables.Tables().TableChains("filter", f.family)
+			if err != nil {
+				t.Fatalf("Test \"%s\" failed, table of family %d is not found with error: %+v", name, f.family, err)
+			}
+			if n, err := ci.Chains().RuleCount("input"); err != nil || n != f.rules {
+				t.Fatalf("Test \"%s\" failed, expected %d rules in chain input of family %d, got %d with error: %+v", name, f.rules, f.family, n, err)
+			}
+			si, _ := tables.Tables().TableSets("filter", f.family)
+			elements, err := si.Sets().GetSetElements("allowed")
+			if err != nil || len(elements) != 1 || !net.IP(elements[0].Key).Equal(f.addr) {
+				t.Fatalf("Test \"%s\" failed, expected set allowed of family %d to carry %s, got %+v with error: %+v", name, f.family, f.addr, elements, err)
+			}
+			b, err := tables.Tables().DumpTable("filter", f.family, nil)
+			if err != nil {
+				t.Fatalf("Test \"%s\" failed to dump table of family %d with error: %+v", name, f.family, err)
+			}
+			d := &nftableslib.TableDump{}
+			if err := json.Unmarshal(b, d); err != nil {
+				t.Fatalf("Test \"%s\" failed to decode dump with error: %+v", name, err)
+			}
+			if d.Family != f.family || len(d.Chains) != 1 || len(d.Chains[0].Rules) != f.rules {
+				t.Fatalf("Test \"%s\" failed, dump of table of family %d carries objects of other family: %s", name, f.family, string(b))
+			}
+		}
+	}
+	check("created", ti)
+
+	// Instance synchronized family by family does not mix tables sharing the name
+	synced, _ := nftableslib.InitNFTablesWithConn(k.Conn())
+	for _, f := range families {
+		if _, err := synced.Tables().Sync(f.family); err != nil {
+			t.Fatalf("failed to sync family %d with error: %+v", f.family, err)
+		}
+	}
+	check("synced", synced)
+	if _, err := synced.Tables().Sync(nftables.TableFamily(unix.NFPROTO_UNSPEC)); err == nil {
+		t.Fatalf("sync of unspecified family is supposed to fail")
+	}
+
+	// Sync of one family does not touch the other one
+	if err := ti.Tables().DeleteImm("filter", nftables.TableFamilyIPv6); err != nil {
+		t.Fatalf("failed to delete table with error: %+v", err)
+	}
+	if _, err := synced.Tables().Sync(nftables.TableFamilyIPv6); err != nil {
+		t.Fatalf("failed to sync family with error: %+v", err)
+	}
+	if synced.Tables().Exist("filter", nftables.TableFamilyIPv6) || !synced.Tables().Exist("filter", nftables.TableFamilyIPv4) {
+		t.Fatalf("only table of deleted family is expected to be removed")
+	}
+	if _, err := synced.Tables().Sync(nftables.TableFamilyIPv4); err != nil {
+		t.Fatalf("failed to sync family with error: %+v", err)
+	}
+	ci, _ := synced.Tables().TableChains("filter", nftables.TableFamilyIPv4)
+	if n, err := ci.Chains().RuleCount("input"); err != nil || n != 1 {
+		t.Fatalf("expected single rule in chain input of family ip, got %d with error: %+v", n, err)
+	}
+
+	// Errors name the family of the table
+	if _, err := synced.Tables().TableChains("filter", nftables.TableFamilyIPv6); err == nil || !strings.Contains(err.Error(), "ip6 filter") {
+		t.Fatalf("expected error naming table ip6 filter, got: %+v", err)
+	}
+	if _, err := ci.Chains().Chain("output"); err == nil || !strings.Contains(err.Error(), "ip filter") {
+		t.Fatalf("expected error naming table ip filter, got: %+v", err)
+	}
+	si, _ := synced.Tables().TableSets("filter", nftables.TableFamilyIPv4)
+	if _, err := si.Sets().GetSetElements("denied"); err == nil || !strings.Contains(err.Error(), "ip filter") {
+		t.Fatalf("expected error naming table ip filter, got: %+v", err)
+	}
+}
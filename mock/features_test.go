@@ -0,0 +1,203 @@
+package mock
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/sbezverk/nftableslib"
+	"golang.org/x/sys/unix"
+)
+
+func TestConcatIntervalsFallback(t *testing.T) {
+	table := &nftables.Table{Name: "filter", Family: nftables.TableFamilyIPv4}
+	rule := &nftableslib.Rule{
+		Concat: &nftableslib.Concat{
+			Elements: []*nftableslib.ConcatElement{
+				{EType: nftables.TypeIPAddr, ESource: true},
+				{EType: nftables.TypeInetService},
+			},
+			Intervals: [][]*nftableslib.ConcatRange{
+				{{From: []byte{10, 0, 0, 0}, To: []byte{10, 255, 255, 255}}, {From: []byte{0, 80}, To: []byte{0, 80}}},
+				{{From: []byte{192, 168, 0, 0}, To: []byte{192, 168, 255, 255}}, {From: []byte{1, 0}, To: []byte{1, 255}}},
+				{{From: []byte{172, 16, 0, 1}, To: []byte{172, 16, 0, 1}}, {From: []byte{0, 22}, To: []byte{0, 22}}},
+			},
+		},
+	}
+	tests := []struct {
+		name     string
+		features nftableslib.KernelFeatures
+		rules    int
+		sets     int
+	}{
+		{
+			name:     "kernel with concatenated interval sets",
+			features: nftableslib.KernelFeatures{ConcatInterval: true},
+			rules:    1,
+			sets:     1,
+		},
+		{
+			name:     "kernel without concatenated interval sets",
+			features: nftableslib.KernelFeatures{},
+			rules:    3,
+			sets:     0,
+		},
+	}
+	for _, tt := range tests {
+		m := InitMockConn()
+		ti := nftableslib.InitNFTables(m, nftableslib.WithKernelFeatures(tt.features))
+		if err := ti.Tables().CreateImm(table.Name, table.Family); err != nil {
+			t.Fatalf("Test \"%s\" failed to create table with error: %+v", tt.name, err)
+		}
+		ci, err := ti.Tables().TableChains(table.Name, table.Family)
+		if err != nil {
+			t.Fatalf("Test \"%s\" failed to get chains with error: %+v", tt.name, err)
+		}
+		if err := ci.Chains().CreateImm("input", nil); err != nil {
+			t.Fatalf("Test \"%s\" failed to create chain with error: %+v", tt.name, err)
+		}
+		ri, err := ci.Chains().Chain("input")
+		if err != nil {
+			t.Fatalf("Test \"%s\" failed to get rules with error: %+v", tt.name, err)
+		}
+		handle, err := ri.Rules().CreateImm(rule)
+		if err != nil {
+			t.Fatalf("Test \"%s\" failed with error: %+v but supposed to succeed", tt.name, err)
+		}
+		rules, err := m.GetRule(table, &nftables.Chain{Name: "input", Table: table})
+		if err != nil {
+			t.Fatalf("Test \"%s\" failed to get rules with error: %+v", tt.name, err)
+		}
+		if len(rules) != tt.rules {
+			t.Fatalf("Test \"%s\" failed, expected %d rules, got %d", tt.name, tt.rules, len(rules))
+		}
+		sets, err := m.GetSets(table)
+		if err != nil {
+			t.Fatalf("Test \"%s\" failed to get sets with error: %+v", tt.name, err)
+		}
+		if len(sets) != tt.sets {
+			t.Fatalf("Test \"%s\" failed, expected %d sets, got %d", tt.name, tt.sets, len(sets))
+		}
+		// Rules generated for intervals are deleted along with the rule
+		if err := ri.Rules().DeleteImm(handle); err != nil {
+			t.Fatalf("Test \"%s\" failed to delete rule with error: %+v", tt.name, err)
+		}
+		if rules, _ := m.GetRule(table, &nftables.Chain{Name: "input", Table: table}); len(rules) != 0 {
+			t.Fatalf("Test \"%s\" failed, %d rules left after the rule was deleted", tt.name, len(rules))
+		}
+	}
+}
+
+func TestUnsupportedByKernel(t *testing.T) {
+	m := InitMockConn()
+	ti := nftableslib.InitNFTables(m, nftableslib.WithKernelFeatures(nftableslib.KernelFeatures{}))
+	if err := ti.Tables().CreateImm("filter", nftables.TableFamilyIPv4); err != nil {
+		t.Fatalf("failed to create table with error: %+v", err)
+	}
+	si, err := ti.Tables().TableSets("filter", nftables.TableFamilyIPv4)
+	if err != nil {
+		t.Fatalf("failed to get sets with error: %+v", err)
+	}
+	_, err = si.Sets().CreateSet(&nftableslib.SetAttributes{
+		Name:     "allowed",
+		Interval: true,
+		KeyType:  nftableslib.GenSetKeyType(nftables.TypeIPAddr, nftables.TypeInetService),
+	}, nil)
+	var unsupported *nftableslib.ErrUnsupportedByKernel
+	if !errors.As(err, &unsupported) || unsupported.Feature != nftableslib.FeatureConcatInterval {
+		t.Fatalf("expected concatenated interval set to be unsupported, got error: %+v", err)
+	}
+
+	if err := ti.Tables().CreateImm("edge", nftables.TableFamilyNetdev); err != nil {
+		t.Fatalf("failed to create table with error: %+v", err)
+	}
+	ci, err := ti.Tables().TableChains("edge", nftables.TableFamilyNetdev)
+	if err != nil {
+		t.Fatalf("failed to get chains with error: %+v", err)
+	}
+	err = ci.Chains().CreateImm("egress", &nftableslib.ChainAttributes{
+		Type:     nftables.ChainTypeFilter,
+		Hook:     nftableslib.ChainHookEgress,
+		Priority: nftables.ChainPriorityFilter,
+		Device:   "lo",
+	})
+	if !errors.As(err, &unsupported) || unsupported.Feature != nftableslib.FeatureEgressHook {
+		t.Fatalf("expected egress hook to be unsupported, got error: %+v", err)
+	}
+	if _, err := ti.Tables().KernelFeatures(); err != nil {
+		t.Fatalf("failed to get features of the kernel with error: %+v", err)
+	}
+}
+
+func TestEgressChain(t *testing.T) {
+	m := InitMockConn()
+	m.AddLink("eth0")
+	ti := nftableslib.InitNFTables(m, nftableslib.WithKernelFeatures(nftableslib.KernelFeatures{EgressHook: true}))
+	if err := ti.Tables().CreateImm("edge", nftables.TableFamilyNetdev); err != nil {
+		t.Fatalf("failed to create table with error: %+v", err)
+	}
+	ci, err := ti.Tables().TableChains("edge", nftables.TableFamilyNetdev)
+	if err != nil {
+		t.Fatalf("failed to get chains with error: %+v", err)
+	}
+	if err := ci.Chains().CreateImm("egress", &nftableslib.ChainAttributes{
+		Type:     nftables.ChainTypeFilter,
+		Hook:     nftableslib.ChainHookEgress,
+		Priority: nftables.ChainPriorityFilter,
+		Device:   "eth0",
+	}); err != nil {
+		t.Fatalf("failed to create egress chain with error: %+v", err)
+	}
+	// NF_NETDEV_EGRESS is hook 1 of netdev family
+	chains, err := m.ListChains()
+	if err != nil || len(chains) != 1 || chains[0].Hooknum != 1 {
+		t.Fatalf("expected chain attached to egress hook 1, got %+v error: %+v", chains, err)
+	}
+	if devices, _ := m.ChainDevices(chains[0]); len(devices) != 1 || devices[0] != "eth0" {
+		t.Fatalf("expected egress chain bound to eth0, got %v", devices)
+	}
+	ri, err := ci.Chains().Chain("egress")
+	if err != nil {
+		t.Fatalf("failed to get rules with error: %+v", err)
+	}
+	etherType := uint16(unix.ETH_P_IP)
+	dst, _ := nftableslib.NewIPAddr("198.51.100.1")
+	// ether saddr 02:00:00:00:00:01 ether type ip ip daddr 198.51.100.1 drop
+	rule := &nftableslib.Rule{
+		L2:     &nftableslib.L2Rule{Src: net.HardwareAddr{0x02, 0, 0, 0, 0, 1}, EtherType: &etherType},
+		L3:     &nftableslib.L3Rule{Dst: &nftableslib.IPAddrSpec{List: []*nftableslib.IPAddr{dst}}},
+		Action: setActionVerdict(t, nftableslib.NFT_DROP),
+	}
+	if _, err := ri.Rules().CreateImm(rule); err != nil {
+		t.Fatalf("failed to create rule with error: %+v", err)
+	}
+	table := &nftables.Table{Name: "edge", Family: nftables.TableFamilyNetdev}
+	rules, err := m.GetRule(table, &nftables.Chain{Name: "egress", Table: table})
+	if err != nil || len(rules) != 1 {
+		t.Fatalf("expected 1 rule, got %d error: %+v", len(rules), err)
+	}
+	// Link layer header is matched at the egress hook along with the network header it selects
+	want := []expr.Payload{
+		{DestRegister: 1, Base: expr.PayloadBaseLLHeader, Offset: 6, Len: 6},
+		{DestRegister: 1, Base: expr.PayloadBaseLLHeader, Offset: 12, Len: 2},
+		{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: 16, Len: 4},
+	}
+	got := []expr.Payload{}
+	for _, e := range rules[0].Exprs {
+		if p, ok := e.(*expr.Payload); ok {
+			got = append(got, *p)
+		}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected payloads %+v, got %+v", want, got)
+	}
+
+	// Network header of netdev tables is selected by the ether type
+	rule.L2 = &nftableslib.L2Rule{Src: net.HardwareAddr{0x02, 0, 0, 0, 0, 1}}
+	if _, err := ri.Rules().CreateImm(rule); err == nil {
+		t.Fatalf("l3 rule without ether type is supposed to fail in netdev table")
+	}
+}
@@ -0,0 +1,198 @@
+package mock
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/sbezverk/nftableslib"
+	"golang.org/x/sys/unix"
+)
+
+func TestForeignRules(t *testing.T) {
+	table := &nftables.Table{Name: "filter", Family: nftables.TableFamilyIPv4}
+	input := &nftables.Chain{Name: "input", Table: table}
+	rule := func(name string, port int) *nftableslib.Rule {
+		return &nftableslib.Rule{
+			L4: &nftableslib.L4Rule{
+				L4Proto: unix.IPPROTO_TCP,
+				Dst:     &nftableslib.Port{List: []uint16{uint16(port)}},
+			},
+			Action:   setActionVerdict(t, nftableslib.NFT_ACCEPT),
+			UserData: nftableslib.MakeRuleComment(name),
+		}
+	}
+	spec := func(policy nftableslib.ForeignRulePolicy, rules ...*nftableslib.Rule) *nftableslib.RulesetSpec {
+		return &nftableslib.RulesetSpec{
+			Tables: []*nftableslib.TableSpec{
+				{
+					Name:   table.Name,
+					Family: table.Family,
+					Chains: []*nftableslib.ChainSpec{
+						{Name: input.Name, Rules: rules, ForeignRules: policy},
+					},
+				},
+			},
+		}
+	}
+	// order returns comments of rules of the chain, foreign rules are named by their comments prefixed with "foreign"
+	order := func(m *Mock) []string {
+		rules, err := m.GetRule(table, input)
+		if err != nil {
+			t.Fatalf("failed to get rules with error: %+v", err)
+		}
+		names := make([]string, 0)
+		for _, r := range rules {
+			ud := r.UserData
+			prefix := ""
+			if _, ok := nftableslib.RuleIDFromUserData(ud); ok {
+				ud = ud[:len(ud)-4]
+			} else {
+				prefix = "foreign "
+			}
+			names = append(names, prefix+string(bytes.TrimRight(ud[2:], "\x00")))
+		}
+		return names
+	}
+	// setup programs rules a and b by the library, foreign rules are added by hand at the head of the chain
+	// and between rules of the library, a new store is synced with the table created with the options.
+	setup := func(opts ...nftableslib.TableOption) (*Mock, nftableslib.TablesInterface) {
+		m := InitMockConn()
+		if err := m.ti.Tables().ApplyRuleset(spec(nftableslib.ForeignRulesDefault, rule("a", 22), rule("b", 80))); err != nil {
+			t.Fatalf("failed to apply ruleset with error: %+v", err)
+		}
+		rules, _ := m.GetRule(table, input)
+		m.InsertRule(&nftables.Rule{Table: table, Chain: input, Exprs: []expr.Any{&expr.Counter{}},
+			UserData: nftableslib.MakeRuleComment("head")})
+		m.AddRule(&nftables.Rule{Table: table, Chain: input, Position: rules[0].Handle,
+			Exprs: []expr.Any{&expr.Verdict{Kind: expr.VerdictAccept}}, UserData: nftableslib.MakeRuleComment("middle")})
+		if err := m.Flush(); err != nil {
+			t.Fatalf("failed to flush with error: %+v", err)
+		}
+		ti := nftableslib.InitNFTables(m)
+		if len(opts) != 0 {
+			if err := ti.Tables().Create(table.Name, table.Family, opts...); err != nil {
+				t.Fatalf("failed to create table with error: %+v", err)
+			}
+		}
+		return m, ti
+	}
+	mixed := []string{"foreign head", "a", "foreign middle", "b"}
+
+	tests := []struct {
+		name   string
+		policy nftableslib.ForeignRulePolicy
+		rules  []*nftableslib.Rule
+		order  []string
+		reject bool
+	}{
+		{
+			name:   "preserve with more rules",
+			policy: nftableslib.ForeignRulesPreserve,
+			rules:  []*nftableslib.Rule{rule("c", 443), rule("d", 8080), rule("e", 8443)},
+			order:  []string{"foreign head", "c", "foreign middle", "d", "e"},
+		},
+		{
+			name:   "preserve by default",
+			policy: nftableslib.ForeignRulesDefault,
+			rules:  []*nftableslib.Rule{rule("c", 443)},
+			order:  []string{"foreign head", "c", "foreign middle", "b"},
+		},
+		{
+			name:   "reject",
+			policy: nftableslib.ForeignRulesReject,
+			rules:  []*nftableslib.Rule{rule("c", 443)},
+			order:  mixed,
+			reject: true,
+		},
+		{
+			name:   "remove",
+			policy: nftableslib.ForeignRulesRemove,
+			rules:  []*nftableslib.Rule{rule("c", 443), rule("d", 8080), rule("e", 8443)},
+			order:  []string{"c", "d", "e"},
+		},
+	}
+	for _, tt := range tests {
+		m, ti := setup()
+		if _, err := ti.Tables().Sync(table.Family); err != nil {
+			t.Fatalf("Test \"%s\" failed to sync with error: %+v", tt.name, err)
+		}
+		if got := order(m); !reflect.DeepEqual(got, mixed) {
+			t.Fatalf("Test \"%s\" failed, sync is not expected to change rules %v, got %v", tt.name, mixed, got)
+		}
+		head := firstRule(t, m, table, input.Name)
+		err := ti.Tables().ApplyRuleset(spec(tt.policy, tt.rules...))
+		if tt.reject {
+			var ferr *nftableslib.ErrForeignRules
+			if !errors.As(err, &ferr) || len(ferr.Handles) != 2 || ferr.Handles[0] != head {
+				t.Fatalf("Test \"%s\" failed, expected ErrForeignRules listing 2 rules, got %+v", tt.name, err)
+			}
+		} else if err != nil {
+			t.Fatalf("Test \"%s\" failed with error: %+v but supposed to succeed", tt.name, err)
+		}
+		if got := order(m); !reflect.DeepEqual(got, tt.order) {
+			t.Fatalf("Test \"%s\" failed, expected rules %v, got %v", tt.name, tt.order, got)
+		}
+		if tt.policy == nftableslib.ForeignRulesPreserve && firstRule(t, m, table, input.Name) != head {
+			t.Fatalf("Test \"%s\" failed, preserved foreign rule is expected to keep its handle %d", tt.name, head)
+		}
+		// Rules of the library are still found by their IDs
+		ci, _ := ti.Tables().TableChains(table.Name, table.Family)
+		ri, _ := ci.Chains().Chain(input.Name)
+		if err := ri.Rules().UpdateRulesHandle(); err != nil {
+			t.Fatalf("Test \"%s\" failed to update handles with error: %+v", tt.name, err)
+		}
+		if n, err := ci.Chains().RuleCount(input.Name); err != nil || n != len(tt.order) {
+			t.Fatalf("Test \"%s\" failed, expected %d rules in the store, got %d with error: %+v", tt.name, len(tt.order), n, err)
+		}
+	}
+
+	// Sync applies the table's and the chain's policy to chains it loads
+	m, ti := setup(nftableslib.WithForeignRulePolicy(nftableslib.ForeignRulesReject))
+	if _, err := ti.Tables().Sync(table.Family); err == nil {
+		t.Fatalf("sync of chain with foreign rules rejected by the table is supposed to fail")
+	}
+	if got := order(m); !reflect.DeepEqual(got, mixed) {
+		t.Fatalf("rejecting sync is not expected to change rules %v, got %v", mixed, got)
+	}
+	m, ti = setup(nftableslib.WithForeignRulePolicy(nftableslib.ForeignRulesRemove))
+	if _, err := ti.Tables().Sync(table.Family); err != nil {
+		t.Fatalf("failed to sync with error: %+v", err)
+	}
+	if got, want := order(m), []string{"a", "b"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected sync to remove foreign rules leaving %v, got %v", want, got)
+	}
+	ci, _ := ti.Tables().TableChains(table.Name, table.Family)
+	ri, _ := ci.Chains().Chain(input.Name)
+	if _, err := ri.Rules().CreateImm(rule("c", 443)); err != nil {
+		t.Fatalf("failed to create rule after sync with error: %+v", err)
+	}
+	if got, want := order(m), []string{"a", "b", "c"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected rules %v, got %v", want, got)
+	}
+	m.AddRule(&nftables.Rule{Table: table, Chain: input, Exprs: []expr.Any{&expr.Counter{}}})
+	if err := m.Flush(); err != nil {
+		t.Fatalf("failed to flush with error: %+v", err)
+	}
+	// The chain's policy overrides the table's one
+	if err := ci.Chains().SetForeignRulePolicy(input.Name, nftableslib.ForeignRulesReject); err != nil {
+		t.Fatalf("failed to set policy with error: %+v", err)
+	}
+	err := ti.Tables().ApplyRuleset(spec(nftableslib.ForeignRulesDefault, rule("d", 8080)))
+	var ferr *nftableslib.ErrForeignRules
+	if !errors.As(err, &ferr) || len(ferr.Handles) != 1 {
+		t.Fatalf("expected ErrForeignRules listing the rule added by hand, got %+v", err)
+	}
+	if err := ci.Chains().SetForeignRulePolicy("output", nftableslib.ForeignRulesReject); err == nil {
+		t.Fatalf("setting policy of missing chain is supposed to fail")
+	}
+	if err := ci.Chains().SetForeignRulePolicy(input.Name, nftableslib.ForeignRulePolicy(10)); err == nil {
+		t.Fatalf("setting invalid policy is supposed to fail")
+	}
+	if err := ti.Tables().ApplyRuleset(spec(nftableslib.ForeignRulePolicy(-1))); err == nil {
+		t.Fatalf("applying spec with invalid policy is supposed to fail")
+	}
+}
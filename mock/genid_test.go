@@ -0,0 +1,134 @@
+package mock
+
+import (
+	"testing"
+
+	"github.com/google/nftables"
+	"github.com/sbezverk/nftableslib"
+	"golang.org/x/sys/unix"
+)
+
+// genConn counts reads of set elements done while services are reconciled and lets the test
+// change the ruleset while the services map is dumped.
+type genConn struct {
+	*Mock
+	reads int
+	// onDump is called when elements of a set are iterated
+	onDump func()
+}
+
+func (g *genConn) GetSetElements(s *nftables.Set) ([]nftables.SetElement, error) {
+	g.reads++
+	return g.Mock.GetSetElements(s)
+}
+
+func (g *genConn) IterateSetElements(s *nftables.Set, fn func(nftables.SetElement) error) error {
+	if g.onDump != nil {
+		g.onDump()
+	}
+	return g.Mock.IterateSetElements(s, fn)
+}
+
+// externalChange changes the ruleset the way another application would
+func externalChange(t *testing.T, m *Mock) {
+	m.AddTable(&nftables.Table{Name: "other", Family: nftables.TableFamilyIPv4})
+	if err := m.Flush(); err != nil {
+		t.Fatalf("failed to change ruleset with error: %+v", err)
+	}
+}
+
+func TestGenID(t *testing.T) {
+	m := InitMockConn()
+	gen, err := m.ti.Tables().GetGenID()
+	if err != nil {
+		t.Fatalf("failed to get generation with error: %+v", err)
+	}
+	if changed, err := m.ti.Tables().ChangedSince(gen); err != nil || changed {
+		t.Fatalf("ruleset is not supposed to change, changed: %t error: %+v", changed, err)
+	}
+	if err := m.ti.Tables().CreateImm("filter", nftables.TableFamilyIPv4); err != nil {
+		t.Fatalf("failed to create table with error: %+v", err)
+	}
+	if changed, err := m.ti.Tables().ChangedSince(gen); err != nil || !changed {
+		t.Fatalf("ruleset is supposed to change, changed: %t error: %+v", changed, err)
+	}
+
+	tests := []struct {
+		name string
+		a, b uint32
+		want bool
+	}{
+		{name: "newer", a: 5, b: 4, want: true},
+		{name: "older", a: 4, b: 5, want: false},
+		{name: "same", a: 4, b: 4, want: false},
+		{name: "wrapped", a: 2, b: 0xfffffffe, want: true},
+		{name: "before wrap", a: 0xfffffffe, b: 2, want: false},
+	}
+	for _, tt := range tests {
+		if got := nftableslib.GenAfter(tt.a, tt.b); got != tt.want {
+			t.Fatalf("Test \"%s\" failed, expected %t, got %t", tt.name, tt.want, got)
+		}
+	}
+}
+
+func TestServiceDispatcherGenID(t *testing.T) {
+	web := service(t, "web", "10.96.0.10", 80, unix.IPPROTO_TCP, backend(t, "192.168.1.1", 8080, 1))
+	services := []*nftableslib.Service{web}
+	tests := []struct {
+		name string
+		// dumps is the number of dumps of the services map changing the ruleset after the first Apply
+		dumps int
+		// external changes the ruleset between Applies
+		external  bool
+		reconcile bool
+	}{
+		{
+			name:      "ruleset is not changed",
+			reconcile: false,
+		},
+		{
+			name:      "ruleset is changed by other application",
+			external:  true,
+			reconcile: true,
+		},
+		{
+			name:      "ruleset is changed once while it is read back",
+			dumps:     1,
+			reconcile: false,
+		},
+		{
+			name:      "ruleset keeps changing while it is read back",
+			dumps:     2,
+			reconcile: true,
+		},
+	}
+	for _, tt := range tests {
+		m := InitMockConn()
+		conn := &genConn{Mock: m}
+		dumps := tt.dumps
+		conn.onDump = func() {
+			if dumps > 0 {
+				dumps--
+				externalChange(t, m)
+			}
+		}
+		sd, err := nftableslib.NewServiceDispatcher(nftableslib.InitNFTables(conn), "kube-nat", nftables.TableFamilyIPv4)
+		if err != nil {
+			t.Fatalf("Test \"%s\" failed to create service dispatcher with error: %+v", tt.name, err)
+		}
+		if err := sd.Apply(services); err != nil {
+			t.Fatalf("Test \"%s\" failed with error: %+v but supposed to succeed", tt.name, err)
+		}
+		if tt.external {
+			externalChange(t, m)
+		}
+		reads := conn.reads
+		if err := sd.Apply(services); err != nil {
+			t.Fatalf("Test \"%s\" failed with error: %+v but supposed to succeed", tt.name, err)
+		}
+		if reconciled := conn.reads != reads; reconciled != tt.reconcile {
+			t.Fatalf("Test \"%s\" failed, expected reconciliation %t, got %t", tt.name, tt.reconcile, reconciled)
+		}
+		checkServices(t, m, services)
+	}
+}
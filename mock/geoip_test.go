@@ -0,0 +1,126 @@
+package mock
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/google/nftables"
+	"github.com/sbezverk/nftableslib"
+)
+
+// geoPrefixes returns 50000 lines of prefixes, pairs of adjacent IPv4 /24 prefixes separated by a gap,
+// duplicates and addresses of the IPv4 prefixes and IPv6 /48 prefixes separated by gaps.
+func geoPrefixes(skip map[string]bool, extra ...string) string {
+	var b strings.Builder
+	b.WriteString("network,geoname_id\n# synthetic country\n")
+	line := func(s string) {
+		if !skip[s] {
+			b.WriteString(s + "\n")
+		}
+	}
+	v4 := func(block int) string {
+		return fmt.Sprintf("10.%d.%d.0/24", block>>8, block&0xff)
+	}
+	for j := 0; j < 10000; j++ {
+		line(v4(3*j) + ",2921044")
+		line(v4(3*j + 1))
+	}
+	for j := 0; j < 5000; j++ {
+		line(v4(3 * j))
+		line(fmt.Sprintf("10.%d.%d.7", (3*j+1)>>8, (3*j+1)&0xff))
+	}
+	for k := 0; k < 20000; k++ {
+		line(fmt.Sprintf("2001:db8:%x::/48", 2*k))
+	}
+	for _, s := range extra {
+		line(s)
+	}
+
+	return b.String()
+}
+
+func TestLoadGeoSet(t *testing.T) {
+	m := InitMockConn()
+	// Every chunk is a single message
+	m.SetBatchLimit(1)
+	chunks := map[nftables.TableFamily]int{}
+	opts := &nftableslib.GeoSetOptions{
+		Progress: func(p nftableslib.GeoProgress) {
+			if p.Removed {
+				t.Fatalf("nothing supposed to be removed from new sets")
+			}
+			chunks[p.Family]++
+		},
+	}
+	stats, err := nftableslib.LoadGeoSet(m.ti, "geo", "blocked", strings.NewReader(geoPrefixes(nil)), opts)
+	if err != nil {
+		t.Fatalf("failed to load geo set with error: %+v", err)
+	}
+	if stats.Prefixes != 50000 || stats.Intervals[nftables.TableFamilyIPv4] != 10000 ||
+		stats.Intervals[nftables.TableFamilyIPv6] != 20000 || stats.Added != 30000 || stats.Removed != 0 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	// Intervals carry 2 elements, chunks of 512 elements
+	if chunks[nftables.TableFamilyIPv4] != 40 || chunks[nftables.TableFamilyIPv6] != 79 {
+		t.Fatalf("expected 40 and 79 chunks, got %v", chunks)
+	}
+	table := &nftables.Table{Name: "geo", Family: nftables.TableFamilyINet}
+	v4, v6 := nftableslib.GeoSetNames("blocked")
+	for name, n := range map[string]int{v4: 20000, v6: 40000} {
+		set, err := m.GetSetByName(table, name)
+		if err != nil {
+			t.Fatalf("failed to get set %s with error: %+v", name, err)
+		}
+		if !set.Interval {
+			t.Fatalf("set %s supposed to be an interval set", name)
+		}
+		if e, err := m.GetSetElements(set); err != nil || len(e) != n {
+			t.Fatalf("expected %d elements of set %s, got %d error: %+v", n, name, len(e), err)
+		}
+	}
+	chain := &nftables.Chain{Name: nftableslib.GeoChainPrefix + "blocked", Table: table}
+	if rules, err := m.GetRule(table, chain); err != nil || len(rules) != 2 {
+		t.Fatalf("expected 2 drop rules, got %d error: %+v", len(rules), err)
+	}
+
+	// The first pair is removed, the second pair shrinks and two IPv6 prefixes are added, a new instance
+	// of the library finds the table on the host.
+	skip := map[string]bool{
+		"10.0.0.0/24,2921044": true, "10.0.0.0/24": true, "10.0.1.0/24": true, "10.0.1.7": true,
+		"10.0.4.0/24": true, "10.0.4.7": true,
+	}
+	gen, _ := m.GetGenID()
+	for f := range chunks {
+		delete(chunks, f)
+	}
+	opts.Progress = func(p nftableslib.GeoProgress) {
+		chunks[p.Family]++
+	}
+	ti := nftableslib.InitNFTables(m)
+	stats, err = nftableslib.LoadGeoSet(ti, "geo", "blocked", strings.NewReader(geoPrefixes(skip, "2001:db9::/48", "2001:db9:2::/48")), opts)
+	if err != nil {
+		t.Fatalf("failed to update geo set with error: %+v", err)
+	}
+	if stats.Intervals[nftables.TableFamilyIPv4] != 9999 || stats.Intervals[nftables.TableFamilyIPv6] != 20002 ||
+		stats.Added != 3 || stats.Removed != 2 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	// Stale IPv4 intervals are removed by one chunk and added by another, IPv6 intervals are added by one
+	if g, _ := m.GetGenID(); g-gen != 3 || chunks[nftables.TableFamilyIPv4] != 2 || chunks[nftables.TableFamilyIPv6] != 1 {
+		t.Fatalf("expected 3 transactions, got %d, chunks %v", g-gen, chunks)
+	}
+	for name, n := range map[string]int{v4: 19998, v6: 40004} {
+		set, _ := m.GetSetByName(table, name)
+		if e, err := m.GetSetElements(set); err != nil || len(e) != n {
+			t.Fatalf("expected %d elements of set %s, got %d error: %+v", n, name, len(e), err)
+		}
+	}
+	if rules, err := m.GetRule(table, chain); err != nil || len(rules) != 2 {
+		t.Fatalf("expected 2 drop rules, got %d error: %+v", len(rules), err)
+	}
+
+	if _, err := nftableslib.LoadGeoSet(ti, "geo", "blocked", strings.NewReader("10.0.0.0/33\n"), opts); err == nil {
+		t.Fatalf("invalid prefix supposed to fail")
+	}
+}
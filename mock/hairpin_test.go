@@ -0,0 +1,139 @@
+package mock
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/sbezverk/nftableslib"
+	"golang.org/x/sys/unix"
+)
+
+func TestHairpinNAT(t *testing.T) {
+	m := InitMockConn()
+	addr := func(s string) *nftableslib.IPAddr {
+		a, err := nftableslib.NewIPAddr(s)
+		if err != nil {
+			t.Fatalf("failed to parse address %s with error: %+v", s, err)
+		}
+		return a
+	}
+	vip, internal, subnet := addr("203.0.113.10"), addr("192.168.1.10"), addr("192.168.1.0/24")
+	table := &nftables.Table{Name: "nat", Family: nftables.TableFamilyIPv4}
+	rules := func(chain string) []*nftables.Rule {
+		rules, err := m.GetRule(table, &nftables.Chain{Name: chain, Table: table})
+		if err != nil {
+			t.Fatalf("failed to get rules of chain %s with error: %+v", chain, err)
+		}
+		return rules
+	}
+	tcp := []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{unix.IPPROTO_TCP}},
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 2, Len: 2},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{0x1f, 0x90}},
+	}
+	dnat := func(to []byte) []expr.Any {
+		re := []expr.Any{
+			&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: 16, Len: 4},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{203, 0, 113, 10}},
+		}
+		re = append(re, tcp...)
+		return append(re,
+			&expr.Immediate{Register: 1, Data: to},
+			&expr.Immediate{Register: 2, Data: []byte{0x1f, 0x90}},
+			&expr.NAT{Type: expr.NATTypeDestNAT, Family: unix.NFPROTO_IPV4, RegAddrMin: 1, RegProtoMin: 2},
+		)
+	}
+	masq := func(to []byte) []expr.Any {
+		re := []expr.Any{
+			&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: 12, Len: 4},
+			&expr.Bitwise{SourceRegister: 1, DestRegister: 1, Len: 4, Mask: []byte{0xff, 0xff, 0xff, 0}, Xor: []byte{0, 0, 0, 0}},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{192, 168, 1, 0}},
+			&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: 16, Len: 4},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: to},
+		}
+		re = append(re, tcp...)
+		return append(re, &expr.Masq{})
+	}
+	check := func(name string, to []byte) (uint64, uint64) {
+		pre, post := rules(nftableslib.HairpinPrerouting), rules(nftableslib.HairpinPostrouting)
+		if len(pre) != 1 || len(post) != 1 {
+			t.Fatalf("Test \"%s\" failed, expected single rule in each chain, got %d and %d", name, len(pre), len(post))
+		}
+		if !reflect.DeepEqual(pre[0].Exprs, dnat(to)) {
+			t.Fatalf("Test \"%s\" failed, expected dnat rule %+v, got %+v", name, dnat(to), pre[0].Exprs)
+		}
+		if !reflect.DeepEqual(post[0].Exprs, masq(to)) {
+			t.Fatalf("Test \"%s\" failed, expected masquerade rule %+v, got %+v", name, masq(to), post[0].Exprs)
+		}
+		return pre[0].Handle, post[0].Handle
+	}
+
+	if err := nftableslib.EnsureHairpinNAT(m.ti, "nat", vip, internal, subnet, 8080, unix.IPPROTO_TCP); err != nil {
+		t.Fatalf("Test \"ensure\" failed with error: %+v but supposed to succeed", err)
+	}
+	pre, post := check("ensure", []byte{192, 168, 1, 10})
+
+	// Ensuring the same service again does not change the ruleset
+	if err := nftableslib.EnsureHairpinNAT(m.ti, "nat", vip, internal, subnet, 8080, unix.IPPROTO_TCP); err != nil {
+		t.Fatalf("Test \"ensure again\" failed with error: %+v but supposed to succeed", err)
+	}
+	if p, s := check("ensure again", []byte{192, 168, 1, 10}); p != pre || s != post {
+		t.Fatalf("rules are not supposed to be replaced, got handles %d and %d, expected %d and %d", p, s, pre, post)
+	}
+
+	// Other service of the same address is kept apart
+	other := append(rules(nftableslib.HairpinPrerouting), rules(nftableslib.HairpinPostrouting)...)
+	if err := nftableslib.EnsureHairpinNAT(m.ti, "nat", vip, internal, subnet, 8080, unix.IPPROTO_UDP); err != nil {
+		t.Fatalf("Test \"udp service\" failed with error: %+v but supposed to succeed", err)
+	}
+	if n := len(rules(nftableslib.HairpinPrerouting)) + len(rules(nftableslib.HairpinPostrouting)); n != len(other)+2 {
+		t.Fatalf("expected %d rules, got %d", len(other)+2, n)
+	}
+	if err := nftableslib.RemoveHairpinNAT(m.ti, "nat", vip, 8080, unix.IPPROTO_UDP); err != nil {
+		t.Fatalf("Test \"remove udp service\" failed with error: %+v but supposed to succeed", err)
+	}
+
+	// New internal address replaces both rules
+	if err := nftableslib.EnsureHairpinNAT(m.ti, "nat", vip, addr("192.168.1.20"), subnet, 8080, unix.IPPROTO_TCP); err != nil {
+		t.Fatalf("Test \"update\" failed with error: %+v but supposed to succeed", err)
+	}
+	if p, s := check("update", []byte{192, 168, 1, 20}); p == pre || s == post {
+		t.Fatalf("rules are supposed to be replaced, got handles %d and %d", p, s)
+	}
+
+	// Both rules are removed together, removal of missing rules succeeds
+	for _, name := range []string{"remove", "remove again"} {
+		if err := nftableslib.RemoveHairpinNAT(m.ti, "nat", vip, 8080, unix.IPPROTO_TCP); err != nil {
+			t.Fatalf("Test \"%s\" failed with error: %+v but supposed to succeed", name, err)
+		}
+		if n := len(rules(nftableslib.HairpinPrerouting)) + len(rules(nftableslib.HairpinPostrouting)); n != 0 {
+			t.Fatalf("Test \"%s\" failed, expected no rules, got %d", name, n)
+		}
+	}
+	ci, _ := m.ti.Tables().Table("nat", nftables.TableFamilyIPv4)
+	for _, chain := range []string{nftableslib.HairpinPrerouting, nftableslib.HairpinPostrouting} {
+		if n, err := ci.Chains().RuleCount(chain); err != nil || n != 0 {
+			t.Fatalf("expected no rules in store of chain %s, got %d with error: %+v", chain, n, err)
+		}
+	}
+
+	for _, tt := range []struct {
+		name     string
+		vip      *nftableslib.IPAddr
+		internal *nftableslib.IPAddr
+		port     uint16
+		proto    byte
+	}{
+		{"mixed families", vip, addr("2001:db8::10"), 80, unix.IPPROTO_TCP},
+		{"prefix as internal address", vip, subnet, 80, unix.IPPROTO_TCP},
+		{"zero port", vip, internal, 0, unix.IPPROTO_TCP},
+		{"icmp", vip, internal, 80, unix.IPPROTO_ICMP},
+	} {
+		if err := nftableslib.EnsureHairpinNAT(m.ti, "nat", tt.vip, tt.internal, subnet, tt.port, tt.proto); err == nil {
+			t.Fatalf("Test \"%s\" is supposed to fail", tt.name)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package mock
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/google/nftables"
+	"github.com/sbezverk/nftableslib"
+)
+
+func TestHookPriorityCollision(t *testing.T) {
+	// Chains of a third party agent the library does not know about
+	m := InitMockConn()
+	agent := &nftables.Table{Name: "agent", Family: nftables.TableFamilyIPv4}
+	m.AddTable(agent)
+	for _, c := range []*nftables.Chain{
+		{Name: "input", Table: agent, Type: nftables.ChainTypeFilter, Hooknum: nftables.ChainHookInput, Priority: 0},
+		{Name: "input_late", Table: agent, Type: nftables.ChainTypeFilter, Hooknum: nftables.ChainHookInput, Priority: 1},
+		{Name: "output", Table: agent, Type: nftables.ChainTypeFilter, Hooknum: nftables.ChainHookOutput, Priority: 0},
+		{Name: "regular", Table: agent},
+	} {
+		m.AddChain(c)
+	}
+	if err := m.Flush(); err != nil {
+		t.Fatalf("failed to program chains of the agent with error: %+v", err)
+	}
+
+	tests := []struct {
+		name      string
+		family    nftables.TableFamily
+		hook      nftables.ChainHook
+		priority  nftables.ChainPriority
+		strict    bool
+		colliding []string
+		suggested nftables.ChainPriority
+	}{
+		{
+			name:     "free priority",
+			family:   nftables.TableFamilyIPv4,
+			hook:     nftables.ChainHookInput,
+			priority: -150,
+		},
+		{
+			name:     "same priority of other family",
+			family:   nftables.TableFamilyIPv6,
+			hook:     nftables.ChainHookInput,
+			priority: 0,
+		},
+		{
+			name:      "same priority of the hook",
+			family:    nftables.TableFamilyIPv4,
+			hook:      nftables.ChainHookInput,
+			priority:  0,
+			colliding: []string{"ip agent input"},
+			suggested: -1,
+		},
+		{
+			name:      "same priority of the hook in inet table",
+			family:    nftables.TableFamilyINet,
+			hook:      nftables.ChainHookOutput,
+			priority:  0,
+			colliding: []string{"ip agent output"},
+			suggested: 1,
+		},
+		{
+			name:      "strict same priority of the hook",
+			family:    nftables.TableFamilyIPv4,
+			hook:      nftables.ChainHookInput,
+			priority:  1,
+			strict:    true,
+			colliding: []string{"ip agent input_late"},
+			suggested: 2,
+		},
+	}
+	for i, tt := range tests {
+		warnings := make([]error, 0)
+		opts := []nftableslib.TableOption{nftableslib.WithWarningHandler(func(w error) {
+			warnings = append(warnings, w)
+		})}
+		if tt.strict {
+			opts = append(opts, nftableslib.WithStrictHookPriorities())
+		}
+		table := "filter" + string(rune('a'+i))
+		if err := m.ti.Tables().CreateImm(table, tt.family, opts...); err != nil {
+			t.Fatalf("Test \"%s\" failed to create table with error: %+v", tt.name, err)
+		}
+		ci, _ := m.ti.Tables().TableChains(table, tt.family)
+		err := ci.Chains().CreateImm("base", &nftableslib.ChainAttributes{
+			Type:     nftables.ChainTypeFilter,
+			Hook:     tt.hook,
+			Priority: tt.priority,
+		})
+		var w *nftableslib.HookPriorityCollision
+		switch {
+		case tt.strict:
+			if !errors.As(err, &w) {
+				t.Fatalf("Test \"%s\" failed, expected HookPriorityCollision error, got %+v", tt.name, err)
+			}
+			if ci.Chains().Exist("base") {
+				t.Fatalf("Test \"%s\" failed, chain is not supposed to be created", tt.name)
+			}
+		case err != nil:
+			t.Fatalf("Test \"%s\" failed with error: %+v but supposed to succeed", tt.name, err)
+		case len(tt.colliding) == 0:
+			if len(warnings) != 0 {
+				t.Fatalf("Test \"%s\" failed, unexpected warnings %+v", tt.name, warnings)
+			}
+			continue
+		case len(warnings) != 1 || !errors.As(warnings[0], &w):
+			t.Fatalf("Test \"%s\" failed, expected HookPriorityCollision warning, got %+v", tt.name, warnings)
+		}
+		if w.Table != table || w.Chain != "base" || w.Priority != tt.priority || w.Suggested != tt.suggested {
+			t.Fatalf("Test \"%s\" failed, expected collision of chain base of table %s at priority %d with suggested priority %d, got %+v",
+				tt.name, table, tt.priority, tt.suggested, w)
+		}
+		if len(w.Colliding) != len(tt.colliding) {
+			t.Fatalf("Test \"%s\" failed, expected colliding chains %v, got %+v", tt.name, tt.colliding, w.Colliding)
+		}
+		for j, c := range tt.colliding {
+			if w.Colliding[j].String() != c {
+				t.Fatalf("Test \"%s\" failed, expected colliding chain %s, got %s", tt.name, c, w.Colliding[j].String())
+			}
+		}
+	}
+
+	report, err := m.ti.Tables().AuditHookPriorities()
+	if err != nil {
+		t.Fatalf("failed to audit hook priorities with error: %+v", err)
+	}
+	want := map[string]string{
+		"ip input":   "ip filtera base(-150) -> ip agent input(0) -> ip filterc base(0) -> ip agent input_late(1)",
+		"ip output":  "inet filterd base(0) -> ip agent output(0)",
+		"ip6 input":  "ip6 filterb base(0)",
+		"ip6 output": "inet filterd base(0)",
+	}
+	if len(report.Pipelines) != len(want) {
+		t.Fatalf("expected %d pipelines, got %+v", len(want), report.Pipelines)
+	}
+	for _, p := range report.Pipelines {
+		got := strings.SplitN(p.String(), ": ", 2)
+		if len(got) != 2 || want[got[0]] != got[1] {
+			t.Fatalf("expected pipeline %s to be %s, got %s", got[0], want[got[0]], p.String())
+		}
+	}
+	if report.Collisions() != 2 {
+		t.Fatalf("expected 2 collisions, got %d", report.Collisions())
+	}
+}
@@ -0,0 +1,163 @@
+package mock
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/sbezverk/nftableslib"
+	"golang.org/x/sys/unix"
+)
+
+func TestICMPSane(t *testing.T) {
+	l4proto := func(proto uint8) []expr.Any {
+		return []expr.Any{
+			&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{proto}},
+		}
+	}
+	icmpType := func(t uint8) []expr.Any {
+		return []expr.Any{
+			&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 0, Len: 1},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{t}},
+		}
+	}
+	icmpTypes := []expr.Any{
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 0, Len: 1},
+		&expr.Lookup{SourceRegister: 1},
+	}
+	verdict := func(kind expr.VerdictKind, chain ...string) expr.Any {
+		v := &expr.Verdict{Kind: kind}
+		if len(chain) != 0 {
+			v.Chain = chain[0]
+		}
+		return v
+	}
+	join := func(exprs ...interface{}) []expr.Any {
+		re := []expr.Any{}
+		for _, e := range exprs {
+			switch e := e.(type) {
+			case []expr.Any:
+				re = append(re, e...)
+			case expr.Any:
+				re = append(re, e)
+			}
+		}
+		return re
+	}
+	limit := &expr.Limit{Type: expr.LimitTypePkts, Rate: 10, Unit: expr.LimitTimeSecond}
+	chainRules := func(proto, echo uint8) [][]expr.Any {
+		return [][]expr.Any{
+			join(l4proto(proto), icmpType(echo), limit, verdict(expr.VerdictAccept)),
+			join(l4proto(proto), icmpTypes, verdict(expr.VerdictAccept)),
+			join(l4proto(proto), verdict(expr.VerdictDrop)),
+		}
+	}
+	jump := func(proto uint8) []expr.Any {
+		return join(l4proto(proto), verdict(expr.VerdictJump, nftableslib.ICMPSaneChainName))
+	}
+	v4Types := [][]byte{{nftableslib.ICMPDestUnreachable}, {nftableslib.ICMPTimeExceeded}, {nftableslib.ICMPParameterProblem}}
+	v6Types := [][]byte{
+		{nftableslib.ICMPv6DestUnreachable}, {nftableslib.ICMPv6PacketTooBig}, {nftableslib.ICMPv6TimeExceeded},
+		{nftableslib.ICMPv6ParameterProblem}, {nftableslib.ICMPv6MLDListenerQuery}, {nftableslib.ICMPv6MLDListenerReport},
+		{nftableslib.ICMPv6MLDListenerDone}, {nftableslib.ICMPv6NDRouterSolicit}, {nftableslib.ICMPv6NDRouterAdvert},
+		{nftableslib.ICMPv6NDNeighborSolicit}, {nftableslib.ICMPv6NDNeighborAdvert}, {nftableslib.ICMPv6MLDv2ListenerReport},
+	}
+	tests := []struct {
+		name   string
+		family nftables.TableFamily
+		chain  [][]expr.Any
+		sets   [][][]byte
+		base   [][]expr.Any
+	}{
+		{
+			name:   "IPv4 table",
+			family: nftables.TableFamilyIPv4,
+			chain:  chainRules(unix.IPPROTO_ICMP, nftableslib.ICMPEchoRequest),
+			sets:   [][][]byte{v4Types},
+			base:   [][]expr.Any{jump(unix.IPPROTO_ICMP)},
+		},
+		{
+			name:   "IPv6 table",
+			family: nftables.TableFamilyIPv6,
+			chain:  chainRules(unix.IPPROTO_ICMPV6, nftableslib.ICMPv6EchoRequest),
+			sets:   [][][]byte{v6Types},
+			base:   [][]expr.Any{jump(unix.IPPROTO_ICMPV6)},
+		},
+		{
+			name:   "Inet table",
+			family: nftables.TableFamilyINet,
+			chain: append(chainRules(unix.IPPROTO_ICMP, nftableslib.ICMPEchoRequest),
+				chainRules(unix.IPPROTO_ICMPV6, nftableslib.ICMPv6EchoRequest)...),
+			sets: [][][]byte{v4Types, v6Types},
+			base: [][]expr.Any{jump(unix.IPPROTO_ICMP), jump(unix.IPPROTO_ICMPV6)},
+		},
+	}
+	for _, tt := range tests {
+		m := InitMockConn()
+		if err := m.ti.Tables().CreateImm("filter", tt.family); err != nil {
+			t.Fatalf("test \"%s\" failed to create table with error: %+v", tt.name, err)
+		}
+		ci, _ := m.ti.Tables().Table("filter", tt.family)
+		if err := ci.Chains().CreateImm("input", &nftableslib.ChainAttributes{
+			Type:     nftables.ChainTypeFilter,
+			Hook:     nftables.ChainHookInput,
+			Priority: nftables.ChainPriorityFilter,
+		}); err != nil {
+			t.Fatalf("test \"%s\" failed to create chain input with error: %+v", tt.name, err)
+		}
+		if err := nftableslib.InstallICMPSane(m.ti, "filter", tt.family, "input", nftableslib.LimitPacketsPerSecond(10)); err != nil {
+			t.Fatalf("test \"%s\" failed with error: %+v but supposed to succeed", tt.name, err)
+		}
+		table := &nftables.Table{Name: "filter", Family: tt.family}
+		rules, err := m.GetRule(table, &nftables.Chain{Name: nftableslib.ICMPSaneChainName, Table: table})
+		if err != nil {
+			t.Fatalf("test \"%s\" failed to get rules with error: %+v", tt.name, err)
+		}
+		if len(rules) != len(tt.chain) {
+			t.Fatalf("test \"%s\" failed, expected %d rules in chain %s, got %d", tt.name, len(tt.chain), nftableslib.ICMPSaneChainName, len(rules))
+		}
+		sets := 0
+		for i, r := range rules {
+			for _, e := range r.Exprs {
+				l, ok := e.(*expr.Lookup)
+				if !ok {
+					continue
+				}
+				set, err := m.GetSetByName(table, l.SetName)
+				if err != nil {
+					t.Fatalf("test \"%s\" failed, rule %d refers to missing set %s", tt.name, i, l.SetName)
+				}
+				elements, _ := m.GetSetElements(set)
+				keys := make([][]byte, 0, len(elements))
+				for _, el := range elements {
+					keys = append(keys, el.Key)
+				}
+				if !reflect.DeepEqual(keys, tt.sets[sets]) {
+					t.Fatalf("test \"%s\" failed, expected types %v in set of rule %d, got %v", tt.name, tt.sets[sets], i, keys)
+				}
+				sets++
+				l.SetName, l.SetID = "", 0
+			}
+			if !reflect.DeepEqual(r.Exprs, tt.chain[i]) {
+				t.Fatalf("test \"%s\" failed, rule %d of chain %s expected %+v, got %+v", tt.name, i, nftableslib.ICMPSaneChainName, tt.chain[i], r.Exprs)
+			}
+		}
+		base, err := m.GetRule(table, &nftables.Chain{Name: "input", Table: table})
+		if err != nil {
+			t.Fatalf("test \"%s\" failed to get rules with error: %+v", tt.name, err)
+		}
+		if len(base) != len(tt.base) {
+			t.Fatalf("test \"%s\" failed, expected %d rules in chain input, got %d", tt.name, len(tt.base), len(base))
+		}
+		for i, r := range base {
+			if !reflect.DeepEqual(r.Exprs, tt.base[i]) {
+				t.Fatalf("test \"%s\" failed, rule %d of chain input expected %+v, got %+v", tt.name, i, tt.base[i], r.Exprs)
+			}
+		}
+		if err := nftableslib.InstallICMPSane(m.ti, "filter", tt.family, "input", nil); err == nil {
+			t.Fatalf("test \"%s\" installing icmp-sane chain twice supposed to fail", tt.name)
+		}
+	}
+}
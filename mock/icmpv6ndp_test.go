@@ -0,0 +1,184 @@
+package mock
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/google/nftables"
+	"github.com/sbezverk/nftableslib"
+	"golang.org/x/sys/unix"
+)
+
+func TestICMPv6DropWarning(t *testing.T) {
+	icmpv6 := uint8(unix.IPPROTO_ICMPV6)
+	dropICMPv6 := func() *nftableslib.Rule {
+		return &nftableslib.Rule{
+			Meta:   &nftableslib.MetaRule{L4Proto: &icmpv6},
+			Action: setActionVerdict(t, nftableslib.NFT_DROP),
+		}
+	}
+	acceptNDP := func() *nftableslib.Rule {
+		return &nftableslib.Rule{
+			L4: &nftableslib.L4Rule{
+				L4Proto: unix.IPPROTO_ICMPV6,
+				ICMP:    &nftableslib.ICMP{Types: nftableslib.ICMPv6NDPTypes()},
+			},
+			Action: setActionVerdict(t, nftableslib.NFT_ACCEPT),
+		}
+	}
+	acceptEcho := func() *nftableslib.Rule {
+		return &nftableslib.Rule{
+			L4: &nftableslib.L4Rule{
+				L4Proto: unix.IPPROTO_ICMPV6,
+				ICMP:    &nftableslib.ICMP{Types: []uint8{nftableslib.ICMPv6EchoRequest}},
+			},
+			Action: setActionVerdict(t, nftableslib.NFT_ACCEPT),
+		}
+	}
+	tests := []struct {
+		name   string
+		family nftables.TableFamily
+		hook   nftables.ChainHook
+		strict bool
+		rules  func(ri nftableslib.RulesInterface) error
+		warned bool
+	}{
+		{
+			name:   "drop without ndp accept in ip6 input",
+			family: nftables.TableFamilyIPv6,
+			hook:   nftables.ChainHookInput,
+			rules: func(ri nftableslib.RulesInterface) error {
+				_, err := ri.Rules().CreateImm(dropICMPv6())
+				return err
+			},
+			warned: true,
+		},
+		{
+			name:   "catch-all drop after echo accept in inet forward",
+			family: nftables.TableFamilyINet,
+			hook:   nftables.ChainHookForward,
+			rules: func(ri nftableslib.RulesInterface) error {
+				if _, err := ri.Rules().CreateImm(acceptEcho()); err != nil {
+					return err
+				}
+				_, err := ri.Rules().CreateImm(&nftableslib.Rule{Action: setActionVerdict(t, nftableslib.NFT_DROP)})
+				return err
+			},
+			warned: true,
+		},
+		{
+			name:   "drop after ndp accept",
+			family: nftables.TableFamilyIPv6,
+			hook:   nftables.ChainHookInput,
+			rules: func(ri nftableslib.RulesInterface) error {
+				if _, err := ri.Rules().CreateImm(acceptNDP()); err != nil {
+					return err
+				}
+				_, err := ri.Rules().CreateImm(dropICMPv6())
+				return err
+			},
+			warned: false,
+		},
+		{
+			name:   "drop after mandatory rule",
+			family: nftables.TableFamilyINet,
+			hook:   nftables.ChainHookInput,
+			strict: true,
+			rules: func(ri nftableslib.RulesInterface) error {
+				if _, err := ri.Rules().CreateImm(nftableslib.ICMPv6MandatoryRule()); err != nil {
+					return err
+				}
+				_, err := ri.Rules().CreateImm(dropICMPv6())
+				return err
+			},
+			warned: false,
+		},
+		{
+			name:   "drop inserted before ndp accept",
+			family: nftables.TableFamilyIPv6,
+			hook:   nftables.ChainHookInput,
+			rules: func(ri nftableslib.RulesInterface) error {
+				if _, err := ri.Rules().CreateImm(acceptNDP()); err != nil {
+					return err
+				}
+				_, err := ri.Rules().InsertImm(dropICMPv6())
+				return err
+			},
+			warned: true,
+		},
+		{
+			name:   "drop in output chain",
+			family: nftables.TableFamilyIPv6,
+			hook:   nftables.ChainHookOutput,
+			rules: func(ri nftableslib.RulesInterface) error {
+				_, err := ri.Rules().CreateImm(dropICMPv6())
+				return err
+			},
+			warned: false,
+		},
+		{
+			name:   "drop in ip table",
+			family: nftables.TableFamilyIPv4,
+			hook:   nftables.ChainHookInput,
+			rules: func(ri nftableslib.RulesInterface) error {
+				_, err := ri.Rules().CreateImm(&nftableslib.Rule{Action: setActionVerdict(t, nftableslib.NFT_DROP)})
+				return err
+			},
+			warned: false,
+		},
+		{
+			name:   "strict drop without ndp accept",
+			family: nftables.TableFamilyIPv6,
+			hook:   nftables.ChainHookInput,
+			strict: true,
+			rules: func(ri nftableslib.RulesInterface) error {
+				_, err := ri.Rules().CreateImm(dropICMPv6())
+				return err
+			},
+			warned: true,
+		},
+	}
+	for _, tt := range tests {
+		warnings := make([]error, 0)
+		opts := []nftableslib.TableOption{nftableslib.WithWarningHandler(func(w error) {
+			warnings = append(warnings, w)
+		})}
+		if tt.strict {
+			opts = append(opts, nftableslib.WithStrictICMPv6())
+		}
+		m := InitMockConn()
+		if err := m.ti.Tables().CreateImm("filter", tt.family, opts...); err != nil {
+			t.Fatalf("Test \"%s\" failed to create table with error: %+v", tt.name, err)
+		}
+		ci, err := m.ti.Tables().TableChains("filter", tt.family)
+		if err != nil {
+			t.Fatalf("Test \"%s\" failed to get chains with error: %+v", tt.name, err)
+		}
+		attrs := &nftableslib.ChainAttributes{
+			Type:     nftables.ChainTypeFilter,
+			Hook:     tt.hook,
+			Priority: nftables.ChainPriorityFilter,
+		}
+		if err := ci.Chains().CreateImm("base", attrs); err != nil {
+			t.Fatalf("Test \"%s\" failed to create chain with error: %+v", tt.name, err)
+		}
+		ri, err := ci.Chains().Chain("base")
+		if err != nil {
+			t.Fatalf("Test \"%s\" failed to get rules with error: %+v", tt.name, err)
+		}
+		err = tt.rules(ri)
+		var w *nftableslib.ICMPv6DropWarning
+		switch {
+		case tt.strict && tt.warned:
+			if !errors.As(err, &w) || w.Chain != "base" || w.Table != "filter" {
+				t.Fatalf("Test \"%s\" failed, expected ICMPv6DropWarning error, got %+v", tt.name, err)
+			}
+		case err != nil:
+			t.Fatalf("Test \"%s\" failed with error: %+v but supposed to succeed", tt.name, err)
+		case tt.warned && len(warnings) != 1:
+			t.Fatalf("Test \"%s\" failed, expected a warning, got %+v", tt.name, warnings)
+		case !tt.warned && len(warnings) != 0:
+			t.Fatalf("Test \"%s\" failed, unexpected warnings %+v", tt.name, warnings)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package mock
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/nftables"
+	"github.com/sbezverk/nftableslib"
+	"golang.org/x/sys/unix"
+)
+
+func TestReproducibleDumps(t *testing.T) {
+	// run programs rules building sets of lists and returns dumps of the table and its chains
+	run := func() ([]byte, []byte) {
+		m := InitMockConn()
+		if err := m.ti.Tables().CreateImm("filter", nftables.TableFamilyIPv4); err != nil {
+			t.Fatalf("failed to create table with error: %+v", err)
+		}
+		ci, _ := m.ti.Tables().TableChains("filter", nftables.TableFamilyIPv4)
+		if err := ci.Chains().CreateImm("input", nil); err != nil {
+			t.Fatalf("failed to create chain with error: %+v", err)
+		}
+		ri, _ := ci.Chains().Chain("input")
+		for _, r := range []*nftableslib.Rule{
+			{
+				L3: &nftableslib.L3Rule{Src: &nftableslib.IPAddrSpec{
+					List: []*nftableslib.IPAddr{setIPAddr(t, "10.0.0.0/8"), setIPAddr(t, "192.0.2.1")},
+				}},
+				L4:     &nftableslib.L4Rule{L4Proto: unix.IPPROTO_TCP, Dst: &nftableslib.Port{List: []uint16{22, 443}}},
+				Action: setActionVerdict(t, nftableslib.NFT_ACCEPT),
+			},
+			{
+				L4: &nftableslib.L4Rule{
+					L4Proto: unix.IPPROTO_UDP,
+					Dst:     &nftableslib.Port{Ranges: [][2]uint16{{1000, 2000}}, Exclude: [][2]uint16{{1500, 1500}}},
+				},
+				Action: setActionVerdict(t, nftableslib.NFT_DROP),
+			},
+		} {
+			if _, err := ri.Rules().CreateImm(r); err != nil {
+				t.Fatalf("failed to create rule with error: %+v", err)
+			}
+		}
+		b, err := m.ti.Tables().DumpTable("filter", nftables.TableFamilyIPv4, nil)
+		if err != nil {
+			t.Fatalf("failed to dump table with error: %+v", err)
+		}
+		// Sets carry the time they were dumped at
+		d := &nftableslib.TableDump{}
+		if err := json.Unmarshal(b, d); err != nil {
+			t.Fatalf("failed to decode dump with error: %+v", err)
+		}
+		for _, s := range d.Sets {
+			s.Dumped = time.Time{}
+		}
+		table, _ := json.Marshal(d)
+		chains, err := ci.Chains().Dump()
+		if err != nil {
+			t.Fatalf("failed to dump chains with error: %+v", err)
+		}
+		return table, chains
+	}
+
+	table1, chains1 := run()
+	table2, chains2 := run()
+	if !bytes.Equal(table1, table2) {
+		t.Fatalf("expected identical dumps of the table, got:\n%s\nand:\n%s", string(table1), string(table2))
+	}
+	if !bytes.Equal(chains1, chains2) {
+		t.Fatalf("expected identical dumps of the chains, got:\n%s\nand:\n%s", string(chains1), string(chains2))
+	}
+	// Sets of the lists are named in the order the rules are built
+	for _, name := range []string{"000000000001", "000000000002", "000000000003"} {
+		if !strings.Contains(string(table1), name) {
+			t.Fatalf("expected set %s in the dump of the table, got: %s", name, string(table1))
+		}
+	}
+}
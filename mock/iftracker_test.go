@@ -0,0 +1,149 @@
+package mock
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"github.com/sbezverk/nftableslib"
+)
+
+// fakeLinkSource delivers link events sent by the test
+type fakeLinkSource struct {
+	events chan *nftableslib.LinkEvent
+}
+
+func (f *fakeLinkSource) Events() <-chan *nftableslib.LinkEvent {
+	return f.events
+}
+
+func (f *fakeLinkSource) Close() error {
+	return nil
+}
+
+func TestIfTracker(t *testing.T) {
+	table := &nftables.Table{Name: "filter", Family: nftables.TableFamilyIPv4}
+	m := InitMockConn()
+	if err := m.ti.Tables().CreateImm(table.Name, table.Family); err != nil {
+		t.Fatalf("failed to create table with error: %+v", err)
+	}
+	ci, err := m.ti.Tables().TableChains(table.Name, table.Family)
+	if err != nil {
+		t.Fatalf("failed to get chains with error: %+v", err)
+	}
+	if err := ci.Chains().CreateImm("forward", nil); err != nil {
+		t.Fatalf("failed to create chain with error: %+v", err)
+	}
+	ri, err := ci.Chains().Chain("forward")
+	if err != nil {
+		t.Fatalf("failed to get rules with error: %+v", err)
+	}
+	index := func(i uint32) *uint32 {
+		return &i
+	}
+	rule := &nftableslib.Rule{
+		Meta:   &nftableslib.MetaRule{IIF: index(2), OIF: index(3)},
+		Action: setActionVerdict(t, nftableslib.NFT_ACCEPT),
+	}
+	handle, err := ri.Rules().CreateImm(rule)
+	if err != nil {
+		t.Fatalf("failed to create rule with error: %+v", err)
+	}
+	// indexes returns the input and output interface indexes the rule matches
+	indexes := func() (uint32, uint32) {
+		rules, err := m.GetRule(table, &nftables.Chain{Name: "forward", Table: table})
+		if err != nil || len(rules) != 1 || rules[0].Handle != handle {
+			t.Fatalf("expected rule with handle %d, got %d rules error: %+v", handle, len(rules), err)
+		}
+		found := map[expr.MetaKey]uint32{}
+		exprs := rules[0].Exprs
+		for i := 0; i < len(exprs)-1; i++ {
+			meta, ok := exprs[i].(*expr.Meta)
+			cmp, isCmp := exprs[i+1].(*expr.Cmp)
+			if ok && isCmp && len(cmp.Data) == 4 {
+				found[meta.Key] = binaryutil.NativeEndian.Uint32(cmp.Data)
+			}
+		}
+		return found[expr.MetaKeyIIF], found[expr.MetaKeyOIF]
+	}
+
+	source := &fakeLinkSource{events: make(chan *nftableslib.LinkEvent)}
+	tracker := nftableslib.NewIfTracker(source, 8)
+	defer tracker.Close()
+	if err := tracker.Track(ri, handle, &nftableslib.Rule{Action: rule.Action}, "eth0", ""); err == nil {
+		t.Fatalf("tracking rule not matching interfaces by index is supposed to fail")
+	}
+	if err := tracker.Track(ri, handle, rule, "eth0", "eth1"); err != nil {
+		t.Fatalf("failed to track rule with error: %+v", err)
+	}
+
+	tests := []struct {
+		name    string
+		event   *nftableslib.LinkEvent
+		rewrite *nftableslib.IfRewrite
+		iif     uint32
+		oif     uint32
+	}{
+		{
+			name:  "interface keeps its index",
+			event: &nftableslib.LinkEvent{Name: "eth0", Index: 2},
+			iif:   2,
+			oif:   3,
+		},
+		{
+			name:  "interface is deleted",
+			event: &nftableslib.LinkEvent{Name: "eth0", Index: 2, Deleted: true},
+			iif:   2,
+			oif:   3,
+		},
+		{
+			name:    "input interface is recreated",
+			event:   &nftableslib.LinkEvent{Name: "eth0", Index: 7},
+			rewrite: &nftableslib.IfRewrite{Name: "eth0", OldIndex: 2, NewIndex: 7, Handle: handle},
+			iif:     7,
+			oif:     3,
+		},
+		{
+			name:  "untracked interface is recreated",
+			event: &nftableslib.LinkEvent{Name: "eth2", Index: 9},
+			iif:   7,
+			oif:   3,
+		},
+		{
+			name:    "output interface is recreated",
+			event:   &nftableslib.LinkEvent{Name: "eth1", Index: 8},
+			rewrite: &nftableslib.IfRewrite{Name: "eth1", OldIndex: 3, NewIndex: 8, Handle: handle},
+			iif:     7,
+			oif:     8,
+		},
+	}
+	for _, tt := range tests {
+		source.events <- tt.event
+		// The next event is received only after the previous one is handled
+		source.events <- &nftableslib.LinkEvent{Name: "lo", Index: 1}
+		var rewrite *nftableslib.IfRewrite
+		select {
+		case rewrite = <-tracker.Rewrites():
+		case <-time.After(100 * time.Millisecond):
+		}
+		switch {
+		case tt.rewrite == nil && rewrite != nil:
+			t.Fatalf("Test \"%s\" failed, unexpected rewrite %+v", tt.name, rewrite)
+		case tt.rewrite != nil && (rewrite == nil || *rewrite != *tt.rewrite):
+			t.Fatalf("Test \"%s\" failed, expected rewrite %+v, got %+v", tt.name, tt.rewrite, rewrite)
+		}
+		if iif, oif := indexes(); iif != tt.iif || oif != tt.oif {
+			t.Fatalf("Test \"%s\" failed, expected iif %d oif %d, got iif %d oif %d", tt.name, tt.iif, tt.oif, iif, oif)
+		}
+	}
+
+	// Rules are not rewritten once they are untracked
+	tracker.Untrack(ri, handle)
+	source.events <- &nftableslib.LinkEvent{Name: "eth0", Index: 11}
+	source.events <- &nftableslib.LinkEvent{Name: "lo", Index: 1}
+	if iif, _ := indexes(); iif != 7 {
+		t.Fatalf("untracked rule is not supposed to be rewritten, got iif %d", iif)
+	}
+}
@@ -0,0 +1,141 @@
+package mock
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/sbezverk/nftableslib"
+	"golang.org/x/sys/unix"
+)
+
+// inlineChains returns chains of inline jumps programmed in the mock
+func inlineChains(t *testing.T, m *Mock) []*nftables.Chain {
+	t.Helper()
+	chains, err := m.ListChains()
+	if err != nil {
+		t.Fatalf("failed to list chains with error: %+v", err)
+	}
+	inline := make([]*nftables.Chain, 0)
+	for _, c := range chains {
+		if nftableslib.IsInlineChain(c.Name) {
+			inline = append(inline, c)
+		}
+	}
+	return inline
+}
+
+func TestJumpInline(t *testing.T) {
+	table := &nftables.Table{Name: "filter", Family: nftables.TableFamilyIPv4}
+	nested := func() *nftableslib.RuleAction {
+		ra, err := nftableslib.SetJumpInline([]*nftableslib.Rule{
+			{
+				L4: &nftableslib.L4Rule{
+					L4Proto: unix.IPPROTO_TCP,
+					Dst:     &nftableslib.Port{List: []uint16{22}},
+				},
+				Action: setActionVerdict(t, nftableslib.NFT_ACCEPT),
+			},
+			{
+				Action: setActionVerdict(t, nftableslib.NFT_DROP),
+			},
+		})
+		if err != nil {
+			t.Fatalf("failed to set inline jump with error: %+v", err)
+		}
+		return ra
+	}
+	iif := "eth0"
+	m := InitMockConn()
+	if err := m.ti.Tables().CreateImm(table.Name, table.Family); err != nil {
+		t.Fatalf("failed to create table with error: %+v", err)
+	}
+	ci, err := m.ti.Tables().TableChains(table.Name, table.Family)
+	if err != nil {
+		t.Fatalf("failed to get chains with error: %+v", err)
+	}
+	if err := ci.Chains().CreateImm("input", nil); err != nil {
+		t.Fatalf("failed to create chain with error: %+v", err)
+	}
+	ri, err := ci.Chains().Chain("input")
+	if err != nil {
+		t.Fatalf("failed to get rules with error: %+v", err)
+	}
+	handle, err := ri.Rules().CreateImm(&nftableslib.Rule{
+		Meta:   &nftableslib.MetaRule{IIFName: &iif},
+		Action: nested(),
+	})
+	if err != nil {
+		t.Fatalf("failed to create rule with inline jump with error: %+v", err)
+	}
+	inline := inlineChains(t, m)
+	if len(inline) != 1 {
+		t.Fatalf("expected 1 inline chain, got %d", len(inline))
+	}
+	rules, _ := m.GetRule(table, &nftables.Chain{Name: "input", Table: table})
+	v, ok := rules[0].Exprs[len(rules[0].Exprs)-1].(*expr.Verdict)
+	if !ok || v.Kind != expr.VerdictJump || v.Chain != inline[0].Name {
+		t.Fatalf("rule is expected to jump to inline chain %s, got expressions %+v", inline[0].Name, rules[0].Exprs)
+	}
+	rules, _ = m.GetRule(table, inline[0])
+	if len(rules) != 2 {
+		t.Fatalf("expected 2 rules in inline chain, got %d", len(rules))
+	}
+	if v, ok := rules[1].Exprs[len(rules[1].Exprs)-1].(*expr.Verdict); !ok || v.Kind != expr.VerdictDrop {
+		t.Fatalf("second rule of inline chain is expected to drop, got expressions %+v", rules[1].Exprs)
+	}
+	// The bound chain does not accept rules added later
+	m.AddRule(&nftables.Rule{Table: table, Chain: inline[0], Exprs: []expr.Any{&expr.Counter{}}})
+	if err := m.Flush(); !errors.Is(err, unix.EOPNOTSUPP) {
+		t.Fatalf("adding rule to bound chain is expected to fail with EOPNOTSUPP, got %+v", err)
+	}
+	// Inline chains are not loaded into the store of chains
+	if err := ci.Chains().Sync(); err != nil {
+		t.Fatalf("failed to sync chains with error: %+v", err)
+	}
+	names, err := ci.Chains().Get()
+	if err != nil {
+		t.Fatalf("failed to get chains with error: %+v", err)
+	}
+	for _, name := range names {
+		if nftableslib.IsInlineChain(name) {
+			t.Fatalf("inline chain %s is not expected to be loaded into the store", name)
+		}
+	}
+
+	// Replacing the rule releases the chain bound to it
+	if err := ri.Rules().Update(&nftableslib.Rule{Action: nested()}, handle); err != nil {
+		t.Fatalf("failed to update rule with error: %+v", err)
+	}
+	replaced := inlineChains(t, m)
+	if len(replaced) != 1 || replaced[0].Name == inline[0].Name {
+		t.Fatalf("expected inline chain of the replaced rule to be released, got chains %+v", replaced)
+	}
+	// Deleting the rule deletes the chain bound to it
+	if err := ri.Rules().DeleteImm(handle); err != nil {
+		t.Fatalf("failed to delete rule with error: %+v", err)
+	}
+	if left := inlineChains(t, m); len(left) != 0 {
+		t.Fatalf("expected inline chains to be deleted with the rule, got %+v", left)
+	}
+
+	// Kernels without chain binding reject inline jumps
+	ti := nftableslib.InitNFTables(m, nftableslib.WithKernelFeatures(nftableslib.KernelFeatures{}))
+	if _, err := ti.Tables().Sync(table.Family); err != nil {
+		t.Fatalf("failed to sync with error: %+v", err)
+	}
+	oci, err := ti.Tables().TableChains(table.Name, table.Family)
+	if err != nil {
+		t.Fatalf("failed to get chains with error: %+v", err)
+	}
+	ori, err := oci.Chains().Chain("input")
+	if err != nil {
+		t.Fatalf("failed to get rules with error: %+v", err)
+	}
+	var unsupported *nftableslib.ErrUnsupportedByKernel
+	if _, err := ori.Rules().CreateImm(&nftableslib.Rule{Action: nested()}); !errors.As(err, &unsupported) ||
+		unsupported.Feature != nftableslib.FeatureChainBinding {
+		t.Fatalf("expected chain binding to be unsupported, got error: %+v", err)
+	}
+}
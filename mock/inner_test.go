@@ -0,0 +1,145 @@
+package mock
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/sbezverk/nftableslib"
+	"golang.org/x/sys/unix"
+)
+
+func TestInnerHeader(t *testing.T) {
+	table := &nftables.Table{Name: "edge", Family: nftables.TableFamilyNetdev}
+	m := InitMockConn()
+	if err := m.ti.Tables().CreateImm(table.Name, table.Family); err != nil {
+		t.Fatalf("failed to create table with error: %+v", err)
+	}
+	ci, _ := m.ti.Tables().TableChains(table.Name, table.Family)
+	if err := ci.Chains().CreateImm("vxlan", nil); err != nil {
+		t.Fatalf("failed to create chain with error: %+v", err)
+	}
+	ri, _ := ci.Chains().Chain("vxlan")
+	// th returns expressions matching data loaded at the offset of the outer transport header
+	th := func(offset uint32, data ...byte) []expr.Any {
+		return []expr.Any{
+			&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: offset, Len: uint32(len(data))},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: data},
+		}
+	}
+	concat := func(lists ...[]expr.Any) []expr.Any {
+		re := []expr.Any{
+			&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{unix.IPPROTO_UDP}},
+		}
+		for _, l := range lists {
+			re = append(re, l...)
+		}
+		return re
+	}
+	dst, _ := nftableslib.NewIPAddr("2001:db8::1")
+
+	tests := []struct {
+		name string
+		rule *nftableslib.Rule
+		want []expr.Any
+	}{
+		{
+			name: "vxlan inner tcp dport",
+			rule: &nftableslib.Rule{
+				L4: &nftableslib.L4Rule{
+					L4Proto: unix.IPPROTO_TCP,
+					Dst:     &nftableslib.Port{List: []uint16{80}},
+					Inner:   &nftableslib.InnerHeader{Family: nftables.TableFamilyIPv4},
+				},
+				Action: setActionVerdict(t, nftableslib.NFT_DROP),
+			},
+			want: concat(
+				// udp dport 4789
+				th(2, 0x12, 0xb5),
+				// inner ether type ipv4 at 8 bytes udp + 8 bytes vxlan + 12
+				th(28, 0x08, 0x00),
+				// inner ipv4 header without options at 8 + 8 + 14
+				th(30, 0x45),
+				// inner ipv4 protocol at 30 + 9, inner tcp dport at 30 + 20 + 2
+				th(39, unix.IPPROTO_TCP),
+				th(52, 0, 80),
+			),
+		},
+		{
+			name: "geneve with options inner ipv6 dst and udp sport",
+			rule: &nftableslib.Rule{
+				L3: &nftableslib.L3Rule{
+					Dst:   &nftableslib.IPAddrSpec{List: []*nftableslib.IPAddr{dst}},
+					Inner: &nftableslib.InnerHeader{Encap: nftableslib.EncapGeneve, Family: nftables.TableFamilyIPv6, GeneveOptionsLen: 8},
+				},
+				L4: &nftableslib.L4Rule{
+					L4Proto: unix.IPPROTO_UDP,
+					Src:     &nftableslib.Port{List: []uint16{53}},
+					Inner:   &nftableslib.InnerHeader{Encap: nftableslib.EncapGeneve, Family: nftables.TableFamilyIPv6, GeneveOptionsLen: 8},
+				},
+				Action: setActionVerdict(t, nftableslib.NFT_DROP),
+			},
+			want: concat(
+				// udp dport 6081
+				th(2, 0x17, 0xc1),
+				// inner ether type ipv6 at 8 bytes udp + 8 bytes geneve + 8 bytes options + 12
+				th(36, 0x86, 0xdd),
+				// inner ipv6 dst at 38 + 24
+				th(62, dst.IP.To16()...),
+				// inner ipv6 next header at 38 + 6, inner udp sport at 38 + 40
+				th(44, unix.IPPROTO_UDP),
+				th(78, 0, 53),
+			),
+		},
+	}
+	for _, tt := range tests {
+		if _, err := ri.Rules().CreateImm(tt.rule); err != nil {
+			t.Fatalf("Test \"%s\" failed with error: %+v but supposed to succeed", tt.name, err)
+		}
+		rules, err := m.GetRule(table, &nftables.Chain{Name: "vxlan", Table: table})
+		if err != nil {
+			t.Fatalf("Test \"%s\" failed to get rules with error: %+v", tt.name, err)
+		}
+		got := rules[len(rules)-1].Exprs
+		if len(got) < len(tt.want) || !reflect.DeepEqual(got[:len(tt.want)], tt.want) {
+			t.Fatalf("Test \"%s\" failed, expected expressions %+v, got %+v", tt.name, tt.want, got)
+		}
+	}
+
+	// Inner header is supported only in netdev tables with consistent parameters
+	if err := m.ti.Tables().CreateImm("filter", nftables.TableFamilyIPv4); err != nil {
+		t.Fatalf("failed to create table with error: %+v", err)
+	}
+	fci, _ := m.ti.Tables().TableChains("filter", nftables.TableFamilyIPv4)
+	if err := fci.Chains().CreateImm("input", nil); err != nil {
+		t.Fatalf("failed to create chain with error: %+v", err)
+	}
+	fri, _ := fci.Chains().Chain("input")
+	http := func(h *nftableslib.InnerHeader) *nftableslib.Rule {
+		return &nftableslib.Rule{
+			L4: &nftableslib.L4Rule{
+				L4Proto: unix.IPPROTO_TCP,
+				Dst:     &nftableslib.Port{List: []uint16{80}},
+				Inner:   h,
+			},
+			Action: setActionVerdict(t, nftableslib.NFT_DROP),
+		}
+	}
+	if _, err := fri.Rules().CreateImm(http(&nftableslib.InnerHeader{Family: nftables.TableFamilyIPv4})); err == nil {
+		t.Fatalf("inner header match in ipv4 table is supposed to fail")
+	}
+	mismatch := http(&nftableslib.InnerHeader{Family: nftables.TableFamilyIPv4})
+	mismatch.L3 = &nftableslib.L3Rule{Protocol: nftableslib.L3Protocol(unix.IPPROTO_TCP), Inner: &nftableslib.InnerHeader{Family: nftables.TableFamilyIPv6}}
+	for _, r := range []*nftableslib.Rule{
+		mismatch,
+		http(&nftableslib.InnerHeader{Family: nftables.TableFamilyIPv4, GeneveOptionsLen: 4}),
+		http(&nftableslib.InnerHeader{Encap: nftableslib.EncapGeneve, Family: nftables.TableFamilyIPv4, GeneveOptionsLen: 6}),
+		http(&nftableslib.InnerHeader{Family: nftables.TableFamilyINet}),
+	} {
+		if _, err := ri.Rules().CreateImm(r); err == nil {
+			t.Fatalf("creating rule with inner header %+v is supposed to fail", r.L4.Inner)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package mock
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/google/nftables"
+	"github.com/sbezverk/nftableslib"
+)
+
+// addIptablesNftChains programs tables and base chains the way iptables-nft does
+func addIptablesNftChains(t *testing.T, m *Mock) {
+	base := func(table *nftables.Table, name string, hook nftables.ChainHook, priority nftables.ChainPriority, ct nftables.ChainType) {
+		m.AddChain(&nftables.Chain{Table: table, Name: name, Hooknum: hook, Priority: priority, Type: ct})
+	}
+	filter := m.AddTable(&nftables.Table{Name: "filter", Family: nftables.TableFamilyIPv4})
+	base(filter, "INPUT", nftables.ChainHookInput, nftables.ChainPriorityFilter, nftables.ChainTypeFilter)
+	base(filter, "FORWARD", nftables.ChainHookForward, nftables.ChainPriorityFilter, nftables.ChainTypeFilter)
+	base(filter, "OUTPUT", nftables.ChainHookOutput, nftables.ChainPriorityFilter, nftables.ChainTypeFilter)
+	// Chains of kube-proxy are regular chains
+	m.AddChain(&nftables.Chain{Table: filter, Name: "KUBE-SERVICES"})
+	nat := m.AddTable(&nftables.Table{Name: "nat", Family: nftables.TableFamilyIPv4})
+	base(nat, "PREROUTING", nftables.ChainHookPrerouting, nftables.ChainPriorityNATDest, nftables.ChainTypeNAT)
+	base(nat, "POSTROUTING", nftables.ChainHookPostrouting, nftables.ChainPriorityNATSource, nftables.ChainTypeNAT)
+	mangle := m.AddTable(&nftables.Table{Name: "mangle", Family: nftables.TableFamilyIPv6})
+	base(mangle, "PREROUTING", nftables.ChainHookPrerouting, nftables.ChainPriorityMangle, nftables.ChainTypeFilter)
+	// Chains which are not built-in chains of iptables-nft
+	inet := m.AddTable(&nftables.Table{Name: "filter", Family: nftables.TableFamilyINet})
+	base(inet, "INPUT", nftables.ChainHookInput, nftables.ChainPriorityFilter, nftables.ChainTypeFilter)
+	custom := m.AddTable(&nftables.Table{Name: "firewall", Family: nftables.TableFamilyIPv4})
+	base(custom, "INPUT", nftables.ChainHookInput, -5, nftables.ChainTypeFilter)
+	base(filter, "input", nftables.ChainHookInput, 10, nftables.ChainTypeFilter)
+	base(nat, "INPUT", nftables.ChainHookOutput, nftables.ChainPriorityNATDest, nftables.ChainTypeNAT)
+	if err := m.Flush(); err != nil {
+		t.Fatalf("failed to program iptables-nft chains with error: %+v", err)
+	}
+}
+
+func TestDetectIptablesNft(t *testing.T) {
+	m := InitMockConn()
+	report, err := m.ti.Tables().DetectIptablesNft()
+	if err != nil {
+		t.Fatalf("failed to detect iptables-nft with error: %+v", err)
+	}
+	if report.Present() {
+		t.Fatalf("iptables-nft detected on the host without tables: %+v", report.Chains)
+	}
+	addIptablesNftChains(t, m)
+	report, err = m.ti.Tables().DetectIptablesNft()
+	if err != nil {
+		t.Fatalf("failed to detect iptables-nft with error: %+v", err)
+	}
+	want := []*nftableslib.IptablesNftChain{
+		{Family: nftables.TableFamilyIPv4, Table: "nat", Chain: "PREROUTING", Hook: nftables.ChainHookPrerouting, Priority: nftables.ChainPriorityNATDest},
+		{Family: nftables.TableFamilyIPv4, Table: "filter", Chain: "INPUT", Hook: nftables.ChainHookInput, Priority: nftables.ChainPriorityFilter},
+		{Family: nftables.TableFamilyIPv4, Table: "filter", Chain: "FORWARD", Hook: nftables.ChainHookForward, Priority: nftables.ChainPriorityFilter},
+		{Family: nftables.TableFamilyIPv4, Table: "filter", Chain: "OUTPUT", Hook: nftables.ChainHookOutput, Priority: nftables.ChainPriorityFilter},
+		{Family: nftables.TableFamilyIPv4, Table: "nat", Chain: "POSTROUTING", Hook: nftables.ChainHookPostrouting, Priority: nftables.ChainPriorityNATSource},
+		{Family: nftables.TableFamilyIPv6, Table: "mangle", Chain: "PREROUTING", Hook: nftables.ChainHookPrerouting, Priority: nftables.ChainPriorityMangle},
+	}
+	if !reflect.DeepEqual(report.Chains, want) {
+		for _, c := range report.Chains {
+			t.Logf("detected %+v", *c)
+		}
+		t.Fatalf("unexpected iptables-nft chains")
+	}
+	if p := report.Priorities(nftables.TableFamilyINet, nftables.ChainHookPrerouting); !reflect.DeepEqual(p,
+		[]nftables.ChainPriority{nftables.ChainPriorityMangle, nftables.ChainPriorityNATDest}) {
+		t.Fatalf("unexpected priorities of prerouting hook %v", p)
+	}
+
+	// Base chain created before iptables-nft chains of the hook runs first
+	priority, err := nftableslib.PriorityRelativeTo(report, nftables.TableFamilyIPv4, nftables.ChainHookInput, nftableslib.PriorityBefore)
+	if err != nil {
+		t.Fatalf("failed to get priority with error: %+v", err)
+	}
+	if err := m.ti.Tables().CreateImm("early", nftables.TableFamilyIPv4); err != nil {
+		t.Fatalf("failed to create table early with error: %+v", err)
+	}
+	ci, _ := m.ti.Tables().Table("early", nftables.TableFamilyIPv4)
+	if err := ci.Chains().CreateImm("input", &nftableslib.ChainAttributes{
+		Type:     nftables.ChainTypeFilter,
+		Hook:     nftables.ChainHookInput,
+		Priority: priority,
+	}); err != nil {
+		t.Fatalf("failed to create chain input with error: %+v", err)
+	}
+	chains, err := m.ListChains()
+	if err != nil {
+		t.Fatalf("failed to list chains with error: %+v", err)
+	}
+	for _, c := range chains {
+		if c.Table.Name == "early" || c.Type == "" || c.Hooknum != nftables.ChainHookInput {
+			continue
+		}
+		if c.Priority <= priority {
+			t.Fatalf("chain %s of table %s with priority %d does not run after chain of priority %d", c.Name, c.Table.Name, c.Priority, priority)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package mock
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/google/nftables"
+	"github.com/sbezverk/nftableslib"
+	"golang.org/x/sys/unix"
+)
+
+func TestJumpTargets(t *testing.T) {
+	jump := func(chain string) *nftableslib.Rule {
+		return &nftableslib.Rule{
+			L4: &nftableslib.L4Rule{
+				L4Proto: unix.IPPROTO_TCP,
+				Dst:     &nftableslib.Port{List: []uint16{22}},
+			},
+			Action: setActionVerdict(t, unix.NFT_JUMP, chain),
+		}
+	}
+	setup := func(name string, opts ...nftableslib.TableOption) (*Mock, nftableslib.ChainsInterface, nftableslib.RulesInterface) {
+		m := InitMockConn()
+		if err := m.ti.Tables().CreateImm(name, nftables.TableFamilyIPv4, opts...); err != nil {
+			t.Fatalf("failed to create table with error: %+v", err)
+		}
+		ci, err := m.ti.Tables().TableChains(name, nftables.TableFamilyIPv4)
+		if err != nil {
+			t.Fatalf("failed to get chains with error: %+v", err)
+		}
+		if err := ci.Chains().CreateImm("input", nil); err != nil {
+			t.Fatalf("failed to create chain with error: %+v", err)
+		}
+		ri, err := ci.Chains().Chain("input")
+		if err != nil {
+			t.Fatalf("failed to get rules with error: %+v", err)
+		}
+		return m, ci, ri
+	}
+	rulesOf := func(m *Mock, table string) int {
+		tbl := &nftables.Table{Name: table, Family: nftables.TableFamilyIPv4}
+		rules, err := m.GetRule(tbl, &nftables.Chain{Name: "input", Table: tbl})
+		if err != nil {
+			t.Fatalf("failed to get rules with error: %+v", err)
+		}
+		return len(rules)
+	}
+
+	tests := []struct {
+		name    string
+		opts    []nftableslib.TableOption
+		op      func(m *Mock, ci nftableslib.ChainsInterface, ri nftableslib.RulesInterface) error
+		rules   int
+		success bool
+	}{
+		{
+			name: "jump to existing chain",
+			op: func(m *Mock, ci nftableslib.ChainsInterface, ri nftableslib.RulesInterface) error {
+				if err := ci.Chains().CreateImm("services", nil); err != nil {
+					return err
+				}
+				_, err := ri.Rules().CreateImm(jump("services"))
+				return err
+			},
+			rules:   1,
+			success: true,
+		},
+		{
+			name: "strict immediate jump to missing chain",
+			op: func(m *Mock, ci nftableslib.ChainsInterface, ri nftableslib.RulesInterface) error {
+				_, err := ri.Rules().CreateImm(jump("services"))
+				return err
+			},
+			success: false,
+		},
+		{
+			name: "strict queued jump to missing chain",
+			op: func(m *Mock, ci nftableslib.ChainsInterface, ri nftableslib.RulesInterface) error {
+				_, err := ri.Rules().Create(jump("services"))
+				return err
+			},
+			success: false,
+		},
+		{
+			name: "immediate jump with forward references allowed",
+			opts: []nftableslib.TableOption{nftableslib.AllowForwardReference()},
+			op: func(m *Mock, ci nftableslib.ChainsInterface, ri nftableslib.RulesInterface) error {
+				_, err := ri.Rules().CreateImm(jump("services"))
+				return err
+			},
+			success: false,
+		},
+		{
+			name: "forward reference within transaction",
+			opts: []nftableslib.TableOption{nftableslib.AllowForwardReference()},
+			op: func(m *Mock, ci nftableslib.ChainsInterface, ri nftableslib.RulesInterface) error {
+				if _, err := ri.Rules().Create(jump("services")); err != nil {
+					return err
+				}
+				if err := ci.Chains().Create("services", nil); err != nil {
+					return err
+				}
+				return m.ti.Tables().Commit()
+			},
+			rules:   1,
+			success: true,
+		},
+		{
+			name: "forward reference never created",
+			opts: []nftableslib.TableOption{nftableslib.AllowForwardReference()},
+			op: func(m *Mock, ci nftableslib.ChainsInterface, ri nftableslib.RulesInterface) error {
+				if _, err := ri.Rules().Create(jump("services")); err != nil {
+					return err
+				}
+				return m.ti.Tables().Commit()
+			},
+			success: false,
+		},
+		{
+			name: "forward reference deleted before commit",
+			opts: []nftableslib.TableOption{nftableslib.AllowForwardReference()},
+			op: func(m *Mock, ci nftableslib.ChainsInterface, ri nftableslib.RulesInterface) error {
+				id, err := ri.Rules().Create(jump("services"))
+				if err != nil {
+					return err
+				}
+				if err := ri.Rules().Delete(id); err != nil {
+					return err
+				}
+				return m.ti.Tables().Commit()
+			},
+			rules:   0,
+			success: true,
+		},
+	}
+	for _, tt := range tests {
+		m, ci, ri := setup("filter", tt.opts...)
+		err := tt.op(m, ci, ri)
+		if err != nil && tt.success {
+			t.Fatalf("Test \"%s\" failed with error: %+v but supposed to succeed", tt.name, err)
+		}
+		if err == nil && !tt.success {
+			t.Fatalf("Test \"%s\" succeeded but supposed to fail", tt.name)
+		}
+		if !tt.success {
+			var e *nftableslib.ErrChainNotFound
+			if !errors.As(err, &e) {
+				t.Fatalf("Test \"%s\" failed, expected ErrChainNotFound, got %+v", tt.name, err)
+			}
+			if e.Chain != "input" || e.Target != "services" {
+				t.Fatalf("Test \"%s\" failed, unexpected error %+v", tt.name, e)
+			}
+			continue
+		}
+		if n := rulesOf(m, "filter"); n != tt.rules {
+			t.Fatalf("Test \"%s\" failed, expected %d rules, got %d", tt.name, tt.rules, n)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package mock
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"github.com/sbezverk/nftableslib"
+)
+
+func TestMarkFromMap(t *testing.T) {
+	table := &nftables.Table{Name: "mangle", Family: nftables.TableFamilyIPv4}
+	m := InitMockConn()
+	if err := m.ti.Tables().CreateImm(table.Name, table.Family); err != nil {
+		t.Fatalf("failed to create table with error: %+v", err)
+	}
+	ci, _ := m.ti.Tables().TableChains(table.Name, table.Family)
+	if err := ci.Chains().CreateImm("prerouting", nil); err != nil {
+		t.Fatalf("failed to create chain with error: %+v", err)
+	}
+	si, _ := m.ti.Tables().TableSets(table.Name, table.Family)
+	elements, err := nftableslib.MakeMarkMapElements(table.Family, map[string]uint32{
+		"10.1.0.0/16": 0x100,
+		"10.2.0.1":    0x200,
+	})
+	if err != nil {
+		t.Fatalf("failed to build mark map elements with error: %+v", err)
+	}
+	want := []nftables.SetElement{
+		{Key: net.ParseIP("10.1.0.0").To4(), Val: binaryutil.NativeEndian.PutUint32(0x100)},
+		{Key: net.ParseIP("10.2.0.0").To4(), IntervalEnd: true},
+		{Key: net.ParseIP("10.2.0.1").To4(), Val: binaryutil.NativeEndian.PutUint32(0x200)},
+		{Key: net.ParseIP("10.2.0.2").To4(), IntervalEnd: true},
+	}
+	if !reflect.DeepEqual(elements, want) {
+		t.Fatalf("expected mark map elements %+v, got %+v", want, elements)
+	}
+	if _, err := si.Sets().CreateSet(&nftableslib.SetAttributes{
+		Name:     "prefix_marks",
+		Interval: true,
+		IsMap:    true,
+		KeyType:  nftables.TypeIPAddr,
+		DataType: nftables.TypeMark,
+	}, elements); err != nil {
+		t.Fatalf("failed to create mark map with error: %+v", err)
+	}
+	if _, err := si.Sets().CreateSet(&nftableslib.SetAttributes{Name: "port_marks", IsMap: true, KeyType: nftables.TypeInetService, DataType: nftables.TypeMark},
+		[]nftables.SetElement{{Key: binaryutil.BigEndian.PutUint16(80), Val: binaryutil.NativeEndian.PutUint32(0x300)}}); err != nil {
+		t.Fatalf("failed to create mark map with error: %+v", err)
+	}
+
+	ri, _ := ci.Chains().Chain("prerouting")
+	tests := []struct {
+		name  string
+		set   string
+		match []nftableslib.MatchType
+		load  *expr.Payload
+	}{
+		{
+			name: "destination address by default",
+			set:  "prefix_marks",
+			load: &expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: 16, Len: 4},
+		},
+		{
+			name:  "source address",
+			set:   "prefix_marks",
+			match: []nftableslib.MatchType{nftableslib.MatchTypeL3Src},
+			load:  &expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: 12, Len: 4},
+		},
+		{
+			name:  "destination port",
+			set:   "port_marks",
+			match: []nftableslib.MatchType{nftableslib.MatchTypeL4Dst},
+			load:  &expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 2, Len: 2},
+		},
+	}
+	for _, tt := range tests {
+		action, err := nftableslib.SetMarkFromMap(tt.set, tt.match...)
+		if err != nil {
+			t.Fatalf("Test \"%s\" failed with error: %+v but supposed to succeed", tt.name, err)
+		}
+		if _, err := ri.Rules().CreateImm(&nftableslib.Rule{Actions: []*nftableslib.RuleAction{action, setActionVerdict(t, nftableslib.NFT_ACCEPT)}}); err != nil {
+			t.Fatalf("Test \"%s\" failed with error: %+v but supposed to succeed", tt.name, err)
+		}
+		rules, err := m.GetRule(table, &nftables.Chain{Name: "prerouting", Table: table})
+		if err != nil {
+			t.Fatalf("Test \"%s\" failed to get rules with error: %+v", tt.name, err)
+		}
+		got := rules[len(rules)-1].Exprs
+		if len(got) != 4 {
+			t.Fatalf("Test \"%s\" failed, expected 4 expressions, got %+v", tt.name, got)
+		}
+		// The key is loaded into the register the lookup reads, the found mark is written back to it
+		// and meta set reads it
+		lookup, ok := got[1].(*expr.Lookup)
+		if !ok || !reflect.DeepEqual(got[0], tt.load) {
+			t.Fatalf("Test \"%s\" failed, expected key load %+v followed by lookup, got %+v", tt.name, tt.load, got)
+		}
+		if lookup.SetName != tt.set || lookup.SourceRegister != tt.load.DestRegister || !lookup.IsDestRegSet || lookup.DestRegister != 1 {
+			t.Fatalf("Test \"%s\" failed, lookup %+v does not read the key of register %d of set %s", tt.name, lookup, tt.load.DestRegister, tt.set)
+		}
+		if !reflect.DeepEqual(got[2], &expr.Meta{Key: expr.MetaKeyMARK, Register: lookup.DestRegister, SourceRegister: true}) {
+			t.Fatalf("Test \"%s\" failed, expected meta set mark from register %d, got %+v", tt.name, lookup.DestRegister, got[2])
+		}
+	}
+
+	// Key of the rule must match the key of the map and the map must carry marks
+	if _, err := si.Sets().CreateSet(&nftableslib.SetAttributes{Name: "ports", KeyType: nftables.TypeInetService}, nil); err != nil {
+		t.Fatalf("failed to create set with error: %+v", err)
+	}
+	for _, tt := range []struct {
+		name  string
+		set   string
+		match nftableslib.MatchType
+	}{
+		{"port key of address map", "prefix_marks", nftableslib.MatchTypeL4Src},
+		{"address key of port map", "port_marks", nftableslib.MatchTypeL3Dst},
+		{"set without data", "ports", nftableslib.MatchTypeL4Dst},
+	} {
+		action, _ := nftableslib.SetMarkFromMap(tt.set, tt.match)
+		if _, err := ri.Rules().CreateImm(&nftableslib.Rule{Actions: []*nftableslib.RuleAction{action}}); err == nil {
+			t.Fatalf("Test \"%s\" is supposed to fail", tt.name)
+		}
+	}
+	if _, err := nftableslib.SetMarkFromMap(""); err == nil {
+		t.Fatalf("mark map without name is supposed to fail")
+	}
+	if _, err := nftableslib.MakeMarkMapElements(table.Family, map[string]uint32{"10.0.0.0/8": 1, "10.1.0.0/16": 2}); err == nil {
+		t.Fatalf("overlapping prefixes are supposed to fail")
+	}
+	if _, err := nftableslib.MakeMarkMapElements(table.Family, map[string]uint32{"2001:db8::/32": 1}); err == nil {
+		t.Fatalf("ipv6 prefix in ipv4 mark map is supposed to fail")
+	}
+}
@@ -1,122 +1,1105 @@
 package mock
 
 import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
 	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
 	"github.com/sbezverk/nftableslib"
+	"golang.org/x/sys/unix"
 )
 
-// Mock defines type and methods to simulate operations with tables
+// Mock defines type and methods to simulate operations with tables. Similarly to netlink
+// connection, the operations are queued and applied to the in-memory ruleset by Flush
+// as a single transaction, if any of the queued operations fails, none of them is applied.
 type Mock struct {
 	ti nftableslib.TablesInterface
+	*kernel
+	// pending carries operations queued on the connection, they are guarded by the lock of the kernel
+	pending []*operation
+}
+
+// kernel carries the state shared by the mock and connections of its transactions
+type kernel struct {
+	sync.Mutex
+	ruleset *ruleset
+	setID   uint32
+	// now is the clock used to expire elements added with a timeout
+	now func() time.Time
+	// links carries names of devices existing in the simulated namespace
+	links map[string]bool
+	// dryRun validates operations without applying them to the ruleset
+	dryRun bool
+	// fault is the failure injected into the next flushed batch
+	fault *fault
+	// rejects carries errors of batches adding elements with the key to sets
+	rejects map[string]error
+	// gen is the generation of the ruleset bumped by every applied non-empty batch
+	gen uint32
+	// batchLimit is the number of operations a batch can carry, 0 means unlimited
+	batchLimit int
+	// latency is the duration of a round trip to the simulated kernel
+	latency time.Duration
+}
+
+// fault defines the error returned for the operation of the batch at the index
+type fault struct {
+	index int
+	err   error
+}
+
+// ruleset simulates the kernel's view of tables, chains, rules and sets
+type ruleset struct {
+	tables []*nftables.Table
+	chains []*nftables.Chain
+	rules  map[string][]*nftables.Rule
+	sets   map[string][]*mockSet
+	// objects carries named stateful objects keyed by table
+	objects map[string][]*nftableslib.Object
+	// devices carries devices base chains are bound to keyed by chain
+	devices map[string][]string
+	handle  uint64
+}
+
+type mockSet struct {
+	set      *nftables.Set
+	elements []nftables.SetElement
+	// expires carries expiration time of elements added with a timeout
+	expires map[string]time.Time
+}
+
+func elementKey(e nftables.SetElement) string {
+	return fmt.Sprintf("%d:%x", intervalEnd(e), e.Key)
+}
+
+// add appends elements to the set, elements with a timeout expire when the clock passes
+// now plus the timeout.
+func (ms *mockSet) add(elements []nftables.SetElement, now time.Time) {
+	for _, e := range elements {
+		if ms.set.HasTimeout && e.Timeout != 0 {
+			if ms.expires == nil {
+				ms.expires = make(map[string]time.Time)
+			}
+			ms.expires[elementKey(e)] = now.Add(e.Timeout)
+		}
+	}
+	ms.elements = append(ms.elements, elements...)
+}
+
+func tableKey(t *nftables.Table) string {
+	return fmt.Sprintf("%d:%s", t.Family, t.Name)
+}
+
+func chainKey(t *nftables.Table, c string) string {
+	return fmt.Sprintf("%d:%s:%s", t.Family, t.Name, c)
+}
+
+func newRuleset() *ruleset {
+	return &ruleset{
+		tables:  make([]*nftables.Table, 0),
+		chains:  make([]*nftables.Chain, 0),
+		rules:   make(map[string][]*nftables.Rule),
+		sets:    make(map[string][]*mockSet),
+		objects: make(map[string][]*nftableslib.Object),
+		devices: make(map[string][]string),
+	}
+}
+
+// clone makes a copy of the ruleset, transaction is applied to the copy which replaces
+// the original ruleset only when all operations succeed.
+func (rs *ruleset) clone() *ruleset {
+	n := newRuleset()
+	n.handle = rs.handle
+	n.tables = append(n.tables, rs.tables...)
+	n.chains = append(n.chains, rs.chains...)
+	for k, r := range rs.rules {
+		n.rules[k] = append([]*nftables.Rule{}, r...)
+	}
+	for k, d := range rs.devices {
+		n.devices[k] = append([]string{}, d...)
+	}
+	for k, o := range rs.objects {
+		n.objects[k] = append([]*nftableslib.Object{}, o...)
+	}
+	for k, s := range rs.sets {
+		n.sets[k] = make([]*mockSet, len(s))
+		for i, ms := range s {
+			n.sets[k][i] = &mockSet{set: ms.set, elements: append([]nftables.SetElement{}, ms.elements...)}
+			if ms.expires != nil {
+				n.sets[k][i].expires = make(map[string]time.Time, len(ms.expires))
+				for e, t := range ms.expires {
+					n.sets[k][i].expires[e] = t
+				}
+			}
+		}
+	}
+
+	return n
+}
+
+// expire removes elements which timeout elapsed, similarly to the kernel's garbage collection
+// the element closing the interval is removed along with the expired element opening it.
+func (rs *ruleset) expire(now time.Time) {
+	for _, sets := range rs.sets {
+		for _, ms := range sets {
+			if len(ms.expires) == 0 {
+				continue
+			}
+			elements := make([]nftables.SetElement, 0, len(ms.elements))
+			for i := 0; i < len(ms.elements); i++ {
+				e := ms.elements[i]
+				if t, ok := ms.expires[elementKey(e)]; ok && !now.Before(t) {
+					delete(ms.expires, elementKey(e))
+					if ms.set.Interval && i+1 < len(ms.elements) && ms.elements[i+1].IntervalEnd {
+						i++
+					}
+					continue
+				}
+				elements = append(elements, e)
+			}
+			ms.elements = elements
+		}
+	}
+}
+
+func (rs *ruleset) getTable(t *nftables.Table) int {
+	for i, tbl := range rs.tables {
+		if tbl.Name == t.Name && tbl.Family == t.Family {
+			return i
+		}
+	}
+	return -1
+}
+
+func (rs *ruleset) getChain(t *nftables.Table, name string) int {
+	for i, c := range rs.chains {
+		if c.Name == name && c.Table.Name == t.Name && c.Table.Family == t.Family {
+			return i
+		}
+	}
+	return -1
+}
+
+func (rs *ruleset) getSet(t *nftables.Table, name string) *mockSet {
+	for _, s := range rs.sets[tableKey(t)] {
+		if s.set.Name == name {
+			return s
+		}
+	}
+	return nil
+}
+
+func (rs *ruleset) getRule(t *nftables.Table, c string, handle uint64) int {
+	for i, r := range rs.rules[chainKey(t, c)] {
+		if r.Handle == handle {
+			return i
+		}
+	}
+	return -1
+}
+
+// isChainReferenced checks if any rule in the table jumps or goes to the chain
+func (rs *ruleset) isChainReferenced(t *nftables.Table, name string) bool {
+	for _, c := range rs.chains {
+		if c.Table.Name != t.Name || c.Table.Family != t.Family {
+			continue
+		}
+		for _, r := range rs.rules[chainKey(t, c.Name)] {
+			for _, e := range r.Exprs {
+				v, ok := e.(*expr.Verdict)
+				if !ok {
+					continue
+				}
+				if (v.Kind == expr.VerdictJump || v.Kind == expr.VerdictGoto) && v.Chain == name {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// releaseBound removes chains of inline jumps bound to the rule along with their rules, like the kernel,
+// which removes bound chains when the rule binding them is removed or replaced.
+func (rs *ruleset) releaseBound(r *nftables.Rule) {
+	for _, v := range ruleVerdicts(r.Exprs) {
+		if v.Kind != expr.VerdictJump || !nftableslib.IsInlineChain(v.Chain) {
+			continue
+		}
+		i := rs.getChain(r.Table, v.Chain)
+		if i == -1 {
+			continue
+		}
+		key := chainKey(r.Table, v.Chain)
+		for _, nested := range rs.rules[key] {
+			rs.releaseBound(nested)
+		}
+		rs.chains = append(rs.chains[:i], rs.chains[i+1:]...)
+		delete(rs.rules, key)
+	}
+}
+
+// isBound returns true if the chain of an inline jump is bound to a rule, the kernel does not
+// allow adding rules to bound chains.
+func (rs *ruleset) isBound(t *nftables.Table, name string) bool {
+	return nftableslib.IsInlineChain(name) && rs.isChainReferenced(t, name)
+}
+
+// checkTargets returns ENOENT if a verdict jumps or goes to a chain which does not exist in the table,
+// like the kernel, which resolves targets when rules and elements of verdict maps are added.
+func (rs *ruleset) checkTargets(t *nftables.Table, verdicts []*expr.Verdict) error {
+	for _, v := range verdicts {
+		if v == nil || (v.Kind != expr.VerdictJump && v.Kind != expr.VerdictGoto) {
+			continue
+		}
+		if rs.getChain(t, v.Chain) == -1 {
+			return unix.ENOENT
+		}
+	}
+	return nil
+}
+
+// ruleVerdicts returns verdicts carried by expressions of the rule
+func ruleVerdicts(exprs []expr.Any) []*expr.Verdict {
+	verdicts := []*expr.Verdict{}
+	for _, e := range exprs {
+		if v, ok := e.(*expr.Verdict); ok {
+			verdicts = append(verdicts, v)
+		}
+	}
+	return verdicts
+}
+
+// elementVerdicts returns verdicts carried by elements of verdict maps
+func elementVerdicts(elements []nftables.SetElement) []*expr.Verdict {
+	verdicts := []*expr.Verdict{}
+	for _, e := range elements {
+		verdicts = append(verdicts, e.VerdictData)
+	}
+	return verdicts
+}
+
+// operation is a queued operation along with its description reported when the operation fails
+type operation struct {
+	desc nftableslib.BatchError
+	op   func(*ruleset) error
 }
 
-// Flush returns
+func (m *Mock) queue(desc nftableslib.BatchError, op func(*ruleset) error) {
+	m.Lock()
+	defer m.Unlock()
+	m.pending = append(m.pending, &operation{desc: desc, op: op})
+}
+
+func tableOp(operation string, t *nftables.Table) nftableslib.BatchError {
+	return nftableslib.BatchError{Operation: operation, Table: t.Name}
+}
+
+func chainOp(operation string, c *nftables.Chain) nftableslib.BatchError {
+	return nftableslib.BatchError{Operation: operation, Table: c.Table.Name, Chain: c.Name}
+}
+
+func ruleOp(operation string, r *nftables.Rule) nftableslib.BatchError {
+	id, _ := nftableslib.RuleIDFromUserData(r.UserData)
+	return nftableslib.BatchError{Operation: operation, Table: r.Table.Name, Chain: r.Chain.Name, RuleID: id}
+}
+
+func setOp(operation string, s *nftables.Set) nftableslib.BatchError {
+	return nftableslib.BatchError{Operation: operation, Table: s.Table.Name, Set: s.Name}
+}
+
+// roundTrip waits for the latency of the simulated kernel, round trips of concurrent callers overlap
+func (m *Mock) roundTrip() {
+	m.Lock()
+	latency := m.latency
+	m.Unlock()
+	if latency != 0 {
+		time.Sleep(latency)
+	}
+}
+
+// Flush applies all queued operations as a single transaction
 func (m *Mock) Flush() error {
-	_, err := m.ti.Tables().Dump()
-	if err != nil {
-		return err
+	m.roundTrip()
+	m.Lock()
+	defer m.Unlock()
+	pending := m.pending
+	m.pending = nil
+	f := m.fault
+	m.fault = nil
+	if m.batchLimit != 0 && len(pending) > m.batchLimit {
+		return unix.EMSGSIZE
+	}
+	m.ruleset.expire(m.now())
+	rs := m.ruleset.clone()
+	for i, p := range pending {
+		err := p.op(rs)
+		if f != nil && f.index == i {
+			err = f.err
+		}
+		if err != nil {
+			be := p.desc
+			be.Index, be.Err = i, err
+			return &be
+		}
 	}
+	if !m.dryRun {
+		m.ruleset = rs
+		if len(pending) != 0 {
+			m.gen++
+		}
+	}
+
 	return nil
 }
 
-// FlushRuleset not use
-func (m *Mock) FlushRuleset() {
+// Transaction returns the connection queuing operations in a transaction of its own, the connection
+// shares the ruleset with the mock and its Flush applies only operations queued on it.
+func (m *Mock) Transaction() (nftableslib.NetNS, error) {
+	return &Mock{ti: m.ti, kernel: m.kernel}, nil
+}
+
+// GetGenID returns the generation of the ruleset
+func (m *Mock) GetGenID() (uint32, error) {
+	m.Lock()
+	defer m.Unlock()
+	return m.gen, nil
+}
+
+// SetDryRun switches the mock to dry-run mode, similarly to a dry-run connection, operations are
+// validated against the ruleset but never applied.
+func (m *Mock) SetDryRun(dryRun bool) {
+	m.Lock()
+	defer m.Unlock()
+	m.dryRun = dryRun
+}
+
+// SetBatchLimit limits the number of operations of a batch, similarly to the kernel refusing
+// batches exceeding the socket buffer, larger batches fail with unix.EMSGSIZE and are not applied.
+func (m *Mock) SetBatchLimit(limit int) {
+	m.Lock()
+	defer m.Unlock()
+	m.batchLimit = limit
+}
+
+// SetLatency makes flushes and dumps of tables, chains and rules take the latency, similarly to round trips
+// to the kernel, so the time callers spend holding locks during round trips can be measured.
+func (m *Mock) SetLatency(latency time.Duration) {
+	m.Lock()
+	defer m.Unlock()
+	m.latency = latency
+}
+
+// FailAt injects the failure into the next flushed batch, the operation at the index fails
+// with the error and the batch is not applied.
+func (m *Mock) FailAt(index int, err error) {
+	m.Lock()
+	defer m.Unlock()
+	m.fault = &fault{index: index, err: err}
+}
 
+// RejectElement makes batches adding an element with the key to a set fail with the error, similarly
+// to the kernel rejecting the element, the rejection is cleared by a nil error.
+func (m *Mock) RejectElement(key []byte, err error) {
+	m.Lock()
+	defer m.Unlock()
+	if err == nil {
+		delete(m.rejects, string(key))
+		return
+	}
+	if m.rejects == nil {
+		m.rejects = make(map[string]error)
+	}
+	m.rejects[string(key)] = err
 }
 
-// AddRule not use
+// FlushRuleset queues removal of all tables, chains, rules and sets
+func (m *Mock) FlushRuleset() {
+	m.queue(nftableslib.BatchError{Operation: "flush ruleset"}, func(rs *ruleset) error {
+		*rs = *newRuleset()
+		return nil
+	})
+}
+
+// AddRule queues a rule, if the rule carries a handle, the existing rule gets replaced.
 func (m *Mock) AddRule(r *nftables.Rule) *nftables.Rule {
+	rule := *r
+	desc := ruleOp("add rule", &rule)
+	if rule.Handle != 0 {
+		desc.Operation = "replace rule"
+	}
+	m.queue(desc, func(rs *ruleset) error {
+		if rs.getChain(rule.Table, rule.Chain.Name) == -1 {
+			return unix.ENOENT
+		}
+		if err := rs.checkTargets(rule.Table, ruleVerdicts(rule.Exprs)); err != nil {
+			return err
+		}
+		key := chainKey(rule.Table, rule.Chain.Name)
+		if rule.Handle != 0 {
+			i := rs.getRule(rule.Table, rule.Chain.Name, rule.Handle)
+			if i == -1 {
+				return unix.ENOENT
+			}
+			rs.releaseBound(rs.rules[key][i])
+			nr := rule
+			rs.rules[key][i] = &nr
+			return nil
+		}
+		if rs.isBound(rule.Table, rule.Chain.Name) {
+			return unix.EOPNOTSUPP
+		}
+		rs.handle++
+		nr := rule
+		nr.Handle = rs.handle
+		if rule.Position == 0 {
+			rs.rules[key] = append(rs.rules[key], &nr)
+			return nil
+		}
+		i := rs.getRule(rule.Table, rule.Chain.Name, rule.Position)
+		if i == -1 {
+			return unix.ENOENT
+		}
+		rs.rules[key] = append(rs.rules[key][:i+1], append([]*nftables.Rule{&nr}, rs.rules[key][i+1:]...)...)
+		return nil
+	})
+
 	return r
 }
 
-// DelRule not used
-func (m *Mock) DelRule(*nftables.Rule) error {
+// DelRule queues removal of a rule identified by its handle
+func (m *Mock) DelRule(r *nftables.Rule) error {
+	if r.Handle == 0 {
+		return fmt.Errorf("rule's handle cannot be 0")
+	}
+	rule := *r
+	m.queue(ruleOp("delete rule", &rule), func(rs *ruleset) error {
+		return rs.delRule(&rule)
+	})
+
 	return nil
 }
 
-// InsertRule not used
+func (rs *ruleset) delRule(rule *nftables.Rule) error {
+	i := rs.getRule(rule.Table, rule.Chain.Name, rule.Handle)
+	if i == -1 {
+		return unix.ENOENT
+	}
+	key := chainKey(rule.Table, rule.Chain.Name)
+	rs.releaseBound(rs.rules[key][i])
+	rs.rules[key] = append(rs.rules[key][:i], rs.rules[key][i+1:]...)
+	return nil
+}
+
+// DelRulesImm immediately removes rules identified by their handles as a single transaction,
+// queued operations are left for Flush.
+func (m *Mock) DelRulesImm(rules []*nftables.Rule) error {
+	m.roundTrip()
+	m.Lock()
+	defer m.Unlock()
+	rs := m.ruleset.clone()
+	for _, r := range rules {
+		if err := rs.delRule(r); err != nil {
+			return err
+		}
+	}
+	if !m.dryRun {
+		m.ruleset = rs
+		m.gen++
+	}
+
+	return nil
+}
+
+// InsertRule queues a rule to be inserted at the beginning of the chain or before
+// the rule which handle matches rule's position.
 func (m *Mock) InsertRule(r *nftables.Rule) *nftables.Rule {
+	rule := *r
+	m.queue(ruleOp("insert rule", &rule), func(rs *ruleset) error {
+		if rs.getChain(rule.Table, rule.Chain.Name) == -1 {
+			return unix.ENOENT
+		}
+		if rs.isBound(rule.Table, rule.Chain.Name) {
+			return unix.EOPNOTSUPP
+		}
+		if err := rs.checkTargets(rule.Table, ruleVerdicts(rule.Exprs)); err != nil {
+			return err
+		}
+		key := chainKey(rule.Table, rule.Chain.Name)
+		i := 0
+		if rule.Position != 0 {
+			if i = rs.getRule(rule.Table, rule.Chain.Name, rule.Position); i == -1 {
+				return unix.ENOENT
+			}
+		}
+		rs.handle++
+		nr := rule
+		nr.Handle = rs.handle
+		rs.rules[key] = append(rs.rules[key][:i], append([]*nftables.Rule{&nr}, rs.rules[key][i:]...)...)
+		return nil
+	})
+
 	return r
 }
 
-// ReplaceRule not used
+// ReplaceRule queues replacement of the rule identified by its handle
 func (m *Mock) ReplaceRule(r *nftables.Rule) *nftables.Rule {
+	rule := *r
+	m.queue(ruleOp("replace rule", &rule), func(rs *ruleset) error {
+		i := rs.getRule(rule.Table, rule.Chain.Name, rule.Handle)
+		if i == -1 {
+			return unix.ENOENT
+		}
+		if err := rs.checkTargets(rule.Table, ruleVerdicts(rule.Exprs)); err != nil {
+			return err
+		}
+		key := chainKey(rule.Table, rule.Chain.Name)
+		rs.releaseBound(rs.rules[key][i])
+		nr := rule
+		rs.rules[key][i] = &nr
+		return nil
+	})
+
 	return r
 }
 
-// DelTable not used
+// DelTable queues removal of a table along with its chains, rules and sets
 func (m *Mock) DelTable(t *nftables.Table) {
+	table := *t
+	m.queue(tableOp("delete table", &table), func(rs *ruleset) error {
+		i := rs.getTable(&table)
+		if i == -1 {
+			return unix.ENOENT
+		}
+		rs.tables = append(rs.tables[:i], rs.tables[i+1:]...)
+		chains := make([]*nftables.Chain, 0)
+		for _, c := range rs.chains {
+			if c.Table.Name == table.Name && c.Table.Family == table.Family {
+				delete(rs.rules, chainKey(&table, c.Name))
+				delete(rs.devices, chainKey(&table, c.Name))
+				continue
+			}
+			chains = append(chains, c)
+		}
+		rs.chains = chains
+		delete(rs.sets, tableKey(&table))
+		delete(rs.objects, tableKey(&table))
+		return nil
+	})
 }
 
-// AddTable not used
+// AddTable queues a table
 func (m *Mock) AddTable(t *nftables.Table) *nftables.Table {
+	table := *t
+	m.queue(tableOp("add table", &table), func(rs *ruleset) error {
+		if rs.getTable(&table) != -1 {
+			return nil
+		}
+		rs.tables = append(rs.tables, &table)
+		return nil
+	})
+
 	return t
 }
 
-// AddChain not used
+// AddChain queues a chain
 func (m *Mock) AddChain(c *nftables.Chain) *nftables.Chain {
+	chain := *c
+	m.queue(chainOp("add chain", &chain), func(rs *ruleset) error {
+		if rs.getTable(chain.Table) == -1 {
+			return unix.ENOENT
+		}
+		if i := rs.getChain(chain.Table, chain.Name); i != -1 {
+			rs.chains[i] = &chain
+			return nil
+		}
+		rs.chains = append(rs.chains, &chain)
+		return nil
+	})
+
 	return c
 }
 
-// DelChain not used
+// DelChain queues removal of a chain along with its rules, the chain cannot be
+// removed while it is referenced by other rules.
 func (m *Mock) DelChain(c *nftables.Chain) {
+	chain := *c
+	m.queue(chainOp("delete chain", &chain), func(rs *ruleset) error {
+		i := rs.getChain(chain.Table, chain.Name)
+		if i == -1 {
+			return unix.ENOENT
+		}
+		if rs.isChainReferenced(chain.Table, chain.Name) {
+			return unix.EBUSY
+		}
+		rs.chains = append(rs.chains[:i], rs.chains[i+1:]...)
+		delete(rs.rules, chainKey(chain.Table, chain.Name))
+		delete(rs.devices, chainKey(chain.Table, chain.Name))
+		return nil
+	})
 }
 
-// AddSet not used
+// AddSet queues a set with its elements
 func (m *Mock) AddSet(s *nftables.Set, se []nftables.SetElement) error {
+	if s.Anonymous && !s.Constant {
+		return fmt.Errorf("anonymous structs must be constant")
+	}
+	m.Lock()
+	if s.ID == 0 {
+		m.setID++
+		s.ID = m.setID
+		if s.Anonymous {
+			s.Name = fmt.Sprintf("__set%d", s.ID)
+			if s.IsMap {
+				s.Name = fmt.Sprintf("__map%d", s.ID)
+			}
+		}
+	}
+	m.Unlock()
+	set := *s
+	elements := append([]nftables.SetElement{}, se...)
+	now := m.now()
+	m.queue(setOp("add set", &set), func(rs *ruleset) error {
+		if rs.getTable(set.Table) == -1 {
+			return unix.ENOENT
+		}
+		if err := rs.checkTargets(set.Table, elementVerdicts(elements)); err != nil {
+			return err
+		}
+		if ms := rs.getSet(set.Table, set.Name); ms != nil {
+			ms.add(elements, now)
+			return nil
+		}
+		key := tableKey(set.Table)
+		ms := &mockSet{set: &set}
+		ms.add(elements, now)
+		rs.sets[key] = append(rs.sets[key], ms)
+		return nil
+	})
+
 	return nil
 }
 
-// GetRule not implemented yet
-func (m *Mock) GetRule(*nftables.Table, *nftables.Chain) ([]*nftables.Rule, error) {
-	return nil, nil
+// GetRule returns rules programmed in a chain
+func (m *Mock) GetRule(t *nftables.Table, c *nftables.Chain) ([]*nftables.Rule, error) {
+	m.roundTrip()
+	m.Lock()
+	defer m.Unlock()
+	if m.ruleset.getChain(t, c.Name) == -1 {
+		return nil, unix.ENOENT
+	}
+	rules := make([]*nftables.Rule, 0)
+	for _, r := range m.ruleset.rules[chainKey(t, c.Name)] {
+		nr := *r
+		rules = append(rules, &nr)
+	}
+
+	return rules, nil
 }
 
-// ListChains not implemented yet
+// ListChains returns all programmed chains
 func (m *Mock) ListChains() ([]*nftables.Chain, error) {
-	return nil, nil
+	m.roundTrip()
+	m.Lock()
+	defer m.Unlock()
+	chains := make([]*nftables.Chain, 0)
+	for _, c := range m.ruleset.chains {
+		nc := *c
+		chains = append(chains, &nc)
+	}
+
+	return chains, nil
 }
 
-// ListTables not implemented yet
+// ListTables returns all programmed tables
 func (m *Mock) ListTables() ([]*nftables.Table, error) {
-	return nil, nil
-}
+	m.roundTrip()
+	m.Lock()
+	defer m.Unlock()
+	tables := make([]*nftables.Table, 0)
+	for _, t := range m.ruleset.tables {
+		nt := *t
+		tables = append(tables, &nt)
+	}
 
-func (m *Mock) CreateSet(attrs *nftableslib.SetAttributes, elements []nftables.SetElement) (*nftables.Set, error) {
-	return nil, nil
+	return tables, nil
 }
 
-func (m *Mock) DelSet(set *nftables.Set) {
-	return
+// DelSet queues removal of a set
+func (m *Mock) DelSet(s *nftables.Set) {
+	set := *s
+	m.queue(setOp("delete set", &set), func(rs *ruleset) error {
+		key := tableKey(set.Table)
+		for i, ms := range rs.sets[key] {
+			if ms.set.Name == set.Name {
+				rs.sets[key] = append(rs.sets[key][:i], rs.sets[key][i+1:]...)
+				return nil
+			}
+		}
+		return unix.ENOENT
+	})
 }
 
+// GetSets returns all sets programmed in a table
 func (m *Mock) GetSets(t *nftables.Table) ([]*nftables.Set, error) {
-	return nil, nil
+	m.Lock()
+	defer m.Unlock()
+	sets := make([]*nftables.Set, 0)
+	for _, s := range m.ruleset.sets[tableKey(t)] {
+		sets = append(sets, hostSet(s.set))
+	}
+
+	return sets, nil
 }
 
+// GetSetByName returns a set programmed in a table
 func (m *Mock) GetSetByName(t *nftables.Table, name string) (*nftables.Set, error) {
-	return nil, nil
+	m.Lock()
+	defer m.Unlock()
+	s := m.ruleset.getSet(t, name)
+	if s == nil {
+		return nil, unix.ENOENT
+	}
+
+	return hostSet(s.set), nil
 }
 
+// hostSet returns a set as github.com/google/nftables decodes it from the kernel, only nft magic
+// of the key type is populated, IsMap reflects the anonymous flag, HasTimeout reflects anonymous,
+// constant and map flags and verdict data type replaces the key type. Set ID is not reported.
+func hostSet(s *nftables.Set) *nftables.Set {
+	ns := &nftables.Set{
+		Table:      s.Table,
+		Name:       s.Name,
+		Anonymous:  s.Anonymous,
+		Constant:   s.Constant,
+		Interval:   s.Interval,
+		IsMap:      s.Anonymous,
+		HasTimeout: s.Anonymous || s.Constant || s.IsMap || s.Timeout != 0,
+		Timeout:    s.Timeout,
+	}
+	ns.KeyType.SetNFTMagic(s.KeyType.GetNFTMagic())
+	if s.IsMap {
+		if s.DataType.GetNFTMagic() == nftables.TypeVerdict.GetNFTMagic() {
+			ns.KeyType = nftables.TypeVerdict
+		} else {
+			ns.DataType = s.DataType
+		}
+	}
+
+	return ns
+}
+
+// GetSetElements returns elements of a programmed set
 func (m *Mock) GetSetElements(set *nftables.Set) ([]nftables.SetElement, error) {
-	return nil, nil
+	m.Lock()
+	defer m.Unlock()
+	m.ruleset.expire(m.now())
+	s := m.ruleset.getSet(set.Table, set.Name)
+	if s == nil {
+		return nil, unix.ENOENT
+	}
+
+	return append([]nftables.SetElement{}, s.elements...), nil
 }
 
-func (m *Mock) SetAddElements(set *nftables.Set, elements []nftables.SetElement) error {
+// IterateSetElements calls fn for every element of a programmed set
+func (m *Mock) IterateSetElements(set *nftables.Set, fn func(nftables.SetElement) error) error {
+	elements, err := m.GetSetElements(set)
+	if err != nil {
+		return err
+	}
+	for _, e := range elements {
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
-func (m *Mock) SetDelElements(set *nftables.Set, elements []nftables.SetElement) error {
+// IterateExpiringElements calls fn for every element of a programmed set along with the time left
+// before the element expires
+func (m *Mock) IterateExpiringElements(set *nftables.Set, fn func(nftables.SetElement, time.Duration) error) error {
+	m.Lock()
+	now := m.now()
+	m.ruleset.expire(now)
+	s := m.ruleset.getSet(set.Table, set.Name)
+	if s == nil {
+		m.Unlock()
+		return unix.ENOENT
+	}
+	elements := append([]nftables.SetElement{}, s.elements...)
+	left := make([]time.Duration, len(elements))
+	for i, e := range elements {
+		if t, ok := s.expires[elementKey(e)]; ok {
+			left[i] = t.Sub(now)
+		}
+	}
+	m.Unlock()
+	for i, e := range elements {
+		if err := fn(e, left[i]); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
-func (m *Mock) SetDeleteElements(set *nftables.Set, elements []nftables.SetElement) error {
+// SetAddElements queues addition of elements to a set
+func (m *Mock) SetAddElements(s *nftables.Set, elements []nftables.SetElement) error {
+	if s.Anonymous {
+		return fmt.Errorf("anonymous sets cannot be updated")
+	}
+	set := *s
+	se := append([]nftables.SetElement{}, elements...)
+	now := m.now()
+	m.queue(setOp("add set elements", &set), func(rs *ruleset) error {
+		ms := rs.getSet(set.Table, set.Name)
+		if ms == nil {
+			return unix.ENOENT
+		}
+		if err := rs.checkTargets(set.Table, elementVerdicts(se)); err != nil {
+			return err
+		}
+		// Operations are applied by Flush holding the lock
+		for _, e := range se {
+			if err, ok := m.rejects[string(e.Key)]; ok {
+				return err
+			}
+		}
+		ms.add(se, now)
+		return nil
+	})
+
 	return nil
 }
 
-// InitMockConn initializes mock connection of the nftables family
+// SetDeleteElements queues removal of elements from a set
+func (m *Mock) SetDeleteElements(s *nftables.Set, elements []nftables.SetElement) error {
+	if s.Anonymous {
+		return fmt.Errorf("anonymous sets cannot be updated")
+	}
+	set := *s
+	se := append([]nftables.SetElement{}, elements...)
+	m.queue(setOp("delete set elements", &set), func(rs *ruleset) error {
+		ms := rs.getSet(set.Table, set.Name)
+		if ms == nil {
+			return unix.ENOENT
+		}
+		// Elements are matched by the key and the interval end flag
+		del := [2]map[string]bool{make(map[string]bool), make(map[string]bool)}
+		for _, d := range se {
+			del[intervalEnd(d)][string(d.Key)] = true
+		}
+		elements := make([]nftables.SetElement, 0, len(ms.elements))
+		for _, e := range ms.elements {
+			if del[intervalEnd(e)][string(e.Key)] {
+				delete(del[intervalEnd(e)], string(e.Key))
+				delete(ms.expires, elementKey(e))
+				continue
+			}
+			elements = append(elements, e)
+		}
+		ms.elements = elements
+		return nil
+	})
+
+	return nil
+}
+
+func intervalEnd(e nftables.SetElement) int {
+	if e.IntervalEnd {
+		return 1
+	}
+	return 0
+}
+
+// CreateSet not used
+func (m *Mock) CreateSet(attrs *nftableslib.SetAttributes, elements []nftables.SetElement) (*nftables.Set, error) {
+	return nil, nil
+}
+
+// SetDelElements queues removal of elements from a set
+func (m *Mock) SetDelElements(set *nftables.Set, elements []nftables.SetElement) error {
+	return m.SetDeleteElements(set, elements)
+}
+
+// AddObject queues a named stateful object, the library does not create objects other than
+// counters, so the mock allows tests to program objects of any kind.
+func (m *Mock) AddObject(t *nftables.Table, o *nftableslib.Object) {
+	table, obj := *t, *o
+	m.queue(nftableslib.BatchError{Operation: "add object", Table: table.Name}, func(rs *ruleset) error {
+		if rs.getTable(&table) == -1 {
+			return unix.ENOENT
+		}
+		for _, ro := range rs.objects[tableKey(&table)] {
+			if ro.Kind == obj.Kind && ro.Name == obj.Name {
+				return unix.EEXIST
+			}
+		}
+		rs.objects[tableKey(&table)] = append(rs.objects[tableKey(&table)], &obj)
+		return nil
+	})
+}
+
+// ListObjects returns copies of named stateful objects of a programmed table
+func (m *Mock) ListObjects(t *nftables.Table) ([]*nftableslib.Object, error) {
+	m.Lock()
+	defer m.Unlock()
+	if m.ruleset.getTable(t) == -1 {
+		return nil, unix.ENOENT
+	}
+	objs := make([]*nftableslib.Object, 0, len(m.ruleset.objects[tableKey(t)]))
+	for _, o := range m.ruleset.objects[tableKey(t)] {
+		obj := *o
+		objs = append(objs, &obj)
+	}
+
+	return objs, nil
+}
+
+// DelObject immediately removes a named stateful object, similarly to the kernel, objects
+// referred by rules or set elements cannot be removed.
+func (m *Mock) DelObject(t *nftables.Table, kind nftableslib.ObjectKind, name string) error {
+	m.Lock()
+	defer m.Unlock()
+	objs := m.ruleset.objects[tableKey(t)]
+	for i, o := range objs {
+		if o.Kind != kind || o.Name != name {
+			continue
+		}
+		if o.Use != 0 {
+			return unix.EBUSY
+		}
+		if m.dryRun {
+			return nil
+		}
+		m.ruleset.objects[tableKey(t)] = append(objs[:i:i], objs[i+1:]...)
+		return nil
+	}
+
+	return unix.ENOENT
+}
+
+// ResetObject immediately resets a counter or a quota and returns its state before the reset,
+// other kinds of objects are returned unchanged as the kernel does not reset them.
+func (m *Mock) ResetObject(t *nftables.Table, kind nftableslib.ObjectKind, name string) (*nftableslib.Object, error) {
+	m.Lock()
+	defer m.Unlock()
+	for _, o := range m.ruleset.objects[tableKey(t)] {
+		if o.Kind != kind || o.Name != name {
+			continue
+		}
+		obj := *o
+		if o.Counter != nil {
+			counter := *o.Counter
+			obj.Counter = &counter
+		}
+		if o.Quota != nil {
+			quota := *o.Quota
+			obj.Quota = &quota
+		}
+		if m.dryRun {
+			return &obj, nil
+		}
+		if o.Counter != nil {
+			o.Counter = &nftableslib.CounterState{}
+		}
+		if o.Quota != nil {
+			o.Quota = &nftableslib.QuotaState{Bytes: o.Quota.Bytes, Over: o.Quota.Over}
+		}
+		return &obj, nil
+	}
+
+	return nil, unix.ENOENT
+}
+
+// BindChainDevices immediately creates the base chain if it does not exist, binds it to added
+// devices and releases removed devices, all changes are applied as a single transaction.
+func (m *Mock) BindChainDevices(c *nftables.Chain, add []string, del []string) error {
+	m.Lock()
+	defer m.Unlock()
+	rs := m.ruleset.clone()
+	if rs.getTable(c.Table) == -1 {
+		return unix.ENOENT
+	}
+	if rs.getChain(c.Table, c.Name) == -1 {
+		chain := *c
+		rs.chains = append(rs.chains, &chain)
+	}
+	key := chainKey(c.Table, c.Name)
+	for _, d := range del {
+		i := indexOf(rs.devices[key], d)
+		if i == -1 {
+			return unix.ENOENT
+		}
+		rs.devices[key] = append(rs.devices[key][:i], rs.devices[key][i+1:]...)
+	}
+	for _, d := range add {
+		if indexOf(rs.devices[key], d) != -1 {
+			return unix.EEXIST
+		}
+		rs.devices[key] = append(rs.devices[key], d)
+	}
+	if !m.dryRun {
+		m.ruleset = rs
+	}
+
+	return nil
+}
+
+// ChainDevices returns devices the programmed chain is bound to sorted by name
+func (m *Mock) ChainDevices(c *nftables.Chain) ([]string, error) {
+	m.Lock()
+	defer m.Unlock()
+	if m.ruleset.getChain(c.Table, c.Name) == -1 {
+		return nil, unix.ENOENT
+	}
+	devices := append([]string{}, m.ruleset.devices[chainKey(c.Table, c.Name)]...)
+	sort.Strings(devices)
+
+	return devices, nil
+}
+
+// LinkExists checks whether the device was added to the simulated namespace
+func (m *Mock) LinkExists(name string) (bool, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	return m.links[name], nil
+}
+
+// AddLink adds devices to the simulated namespace, the namespace initially carries only lo device
+func (m *Mock) AddLink(names ...string) {
+	m.Lock()
+	defer m.Unlock()
+	for _, n := range names {
+		m.links[n] = true
+	}
+}
+
+func indexOf(list []string, s string) int {
+	for i, e := range list {
+		if e == s {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// InitMockConn initializes mock connection of the nftables family, IDs and names of sets built by
+// the library are generated in sequence, so expressions and dumps are the same on every run
 func InitMockConn() *Mock {
-	m := &Mock{}
-	m.ti = nftableslib.InitNFTables(m)
+	m := &Mock{kernel: &kernel{
+		ruleset: newRuleset(),
+		now:     time.Now,
+		links:   map[string]bool{"lo": true},
+	}}
+	m.ti = nftableslib.InitNFTables(m, nftableslib.WithIDGenerator(nftableslib.NewSequentialIDGenerator()))
 	return m
 }
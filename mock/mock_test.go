@@ -1,6 +1,8 @@
 package mock
 
 import (
+	"encoding/json"
+	"reflect"
 	"testing"
 
 	"github.com/google/nftables"
@@ -53,6 +55,24 @@ func setSNAT(t *testing.T, attrs *nftableslib.NATAttributes) *nftableslib.RuleAc
 	}
 	return ra
 }
+
+// checkRuleRoundTrip validates that the rule decoded from its JSON encoding is identical to the rule
+func checkRuleRoundTrip(t *testing.T, name string, rule *nftableslib.Rule) {
+	t.Helper()
+	b, err := json.Marshal(rule)
+	if err != nil {
+		t.Fatalf("test \"%s\" failed to encode rule with error: %+v", name, err)
+	}
+	loaded, err := nftableslib.LoadRule(b)
+	if err != nil {
+		t.Fatalf("test \"%s\" failed to load rule %s with error: %+v", name, string(b), err)
+	}
+	if !reflect.DeepEqual(rule, loaded) {
+		lb, _ := json.Marshal(loaded)
+		t.Fatalf("test \"%s\" rule does not survive round trip, encoded: %s loaded: %s", name, string(b), string(lb))
+	}
+}
+
 func TestMock(t *testing.T) {
 	port1 := 8080
 	port2 := 9090
@@ -78,10 +98,10 @@ func TestMock(t *testing.T) {
 				L4: &nftableslib.L4Rule{
 					L4Proto: unix.IPPROTO_TCP,
 					Src: &nftableslib.Port{
-						List: nftableslib.SetPortList([]int{port1, port2}),
+						List: []uint16{uint16(port1), uint16(port2)},
 					},
 					Dst: &nftableslib.Port{
-						List: nftableslib.SetPortList([]int{port3}),
+						List: []uint16{uint16(port3)},
 					},
 				},
 				Log:    setLog(unix.NFTA_LOG_PREFIX, []byte("nftableslib")),
@@ -109,10 +129,10 @@ func TestMock(t *testing.T) {
 				L4: &nftableslib.L4Rule{
 					L4Proto: unix.IPPROTO_TCP,
 					Src: &nftableslib.Port{
-						List: nftableslib.SetPortList([]int{port1, port2}),
+						List: []uint16{uint16(port1), uint16(port2)},
 					},
 					Dst: &nftableslib.Port{
-						List: nftableslib.SetPortList([]int{port3}),
+						List: []uint16{uint16(port3)},
 					},
 				},
 				Action: setActionVerdict(t, unix.NFT_JUMP, "fake-chain-1"),
@@ -344,7 +364,7 @@ func TestMock(t *testing.T) {
 				L4: &nftableslib.L4Rule{
 					L4Proto: unix.IPPROTO_TCP,
 					Src: &nftableslib.Port{
-						List: nftableslib.SetPortList([]int{port1}),
+						List: []uint16{uint16(port1)},
 					},
 				},
 				Action: setActionVerdict(t, unix.NFT_JUMP, "fake_chain_1"),
@@ -357,7 +377,7 @@ func TestMock(t *testing.T) {
 				L4: &nftableslib.L4Rule{
 					L4Proto: unix.IPPROTO_UDP,
 					Src: &nftableslib.Port{
-						List: nftableslib.SetPortList([]int{port2}),
+						List: []uint16{uint16(port2)},
 					},
 				},
 				Action: setActionVerdict(t, unix.NFT_RETURN),
@@ -370,7 +390,7 @@ func TestMock(t *testing.T) {
 				L4: &nftableslib.L4Rule{
 					L4Proto: unix.IPPROTO_TCP,
 					Dst: &nftableslib.Port{
-						List: nftableslib.SetPortList([]int{port1}),
+						List: []uint16{uint16(port1)},
 					},
 					RelOp: nftableslib.NEQ,
 				},
@@ -384,7 +404,7 @@ func TestMock(t *testing.T) {
 				L4: &nftableslib.L4Rule{
 					L4Proto: unix.IPPROTO_TCP,
 					Src: &nftableslib.Port{
-						List: nftableslib.SetPortList([]int{port1}),
+						List: []uint16{uint16(port1)},
 					},
 				},
 				Action: setActionRedirect(t, portRedirect, false),
@@ -397,7 +417,7 @@ func TestMock(t *testing.T) {
 				L4: &nftableslib.L4Rule{
 					L4Proto: unix.IPPROTO_UDP,
 					Dst: &nftableslib.Port{
-						List: nftableslib.SetPortList([]int{port1}),
+						List: []uint16{uint16(port1)},
 					},
 				},
 				Action: setActionRedirect(t, portRedirect, false),
@@ -410,7 +430,7 @@ func TestMock(t *testing.T) {
 				L4: &nftableslib.L4Rule{
 					L4Proto: unix.IPPROTO_TCP,
 					Dst: &nftableslib.Port{
-						List: nftableslib.SetPortList([]int{port1}),
+						List: []uint16{uint16(port1)},
 					},
 					RelOp: nftableslib.NEQ,
 				},
@@ -424,7 +444,7 @@ func TestMock(t *testing.T) {
 				L4: &nftableslib.L4Rule{
 					L4Proto: unix.IPPROTO_TCP,
 					Dst: &nftableslib.Port{
-						List: nftableslib.SetPortList([]int{port1, port2, port3}),
+						List: []uint16{uint16(port1), uint16(port2), uint16(port3)},
 					},
 				},
 				Action: setActionRedirect(t, portRedirect, false),
@@ -437,7 +457,7 @@ func TestMock(t *testing.T) {
 				L4: &nftableslib.L4Rule{
 					L4Proto: unix.IPPROTO_TCP,
 					Dst: &nftableslib.Port{
-						List: nftableslib.SetPortList([]int{port1, port2}),
+						List: []uint16{uint16(port1), uint16(port2)},
 					},
 				},
 				Action: setActionVerdict(t, unix.NFT_RETURN),
@@ -450,7 +470,7 @@ func TestMock(t *testing.T) {
 				L4: &nftableslib.L4Rule{
 					L4Proto: unix.IPPROTO_TCP,
 					Dst: &nftableslib.Port{
-						List: nftableslib.SetPortList([]int{port1, port2}),
+						List: []uint16{uint16(port1), uint16(port2)},
 					},
 					RelOp: nftableslib.NEQ,
 				},
@@ -464,7 +484,7 @@ func TestMock(t *testing.T) {
 				L4: &nftableslib.L4Rule{
 					L4Proto: unix.IPPROTO_TCP,
 					Dst: &nftableslib.Port{
-						List: nftableslib.SetPortList([]int{port1, port2}),
+						List: []uint16{uint16(port1), uint16(port2)},
 					},
 					RelOp: nftableslib.NEQ,
 				},
@@ -478,7 +498,7 @@ func TestMock(t *testing.T) {
 				L4: &nftableslib.L4Rule{
 					L4Proto: unix.IPPROTO_TCP,
 					Dst: &nftableslib.Port{
-						Range: nftableslib.SetPortRange([2]int{port1, port2}),
+						Range: [2]uint16{uint16(port1), uint16(port2)},
 					},
 				},
 				Action: setActionRedirect(t, portRedirect, false),
@@ -491,7 +511,7 @@ func TestMock(t *testing.T) {
 				L4: &nftableslib.L4Rule{
 					L4Proto: unix.IPPROTO_TCP,
 					Dst: &nftableslib.Port{
-						Range: nftableslib.SetPortRange([2]int{port1, port2}),
+						Range: [2]uint16{uint16(port1), uint16(port2)},
 					},
 				},
 				Action: setActionVerdict(t, unix.NFT_RETURN),
@@ -504,7 +524,7 @@ func TestMock(t *testing.T) {
 				L4: &nftableslib.L4Rule{
 					L4Proto: unix.IPPROTO_TCP,
 					Dst: &nftableslib.Port{
-						Range: nftableslib.SetPortRange([2]int{port1, port2}),
+						Range: [2]uint16{uint16(port1), uint16(port2)},
 					},
 					RelOp: nftableslib.NEQ,
 				},
@@ -518,7 +538,7 @@ func TestMock(t *testing.T) {
 				L4: &nftableslib.L4Rule{
 					L4Proto: unix.IPPROTO_TCP,
 					Dst: &nftableslib.Port{
-						Range: nftableslib.SetPortRange([2]int{port1, port2}),
+						Range: [2]uint16{uint16(port1), uint16(port2)},
 					},
 					RelOp: nftableslib.NEQ,
 				},
@@ -539,6 +559,9 @@ func TestMock(t *testing.T) {
 		Priority: nftables.ChainPriorityFilter,
 	}
 	tblV4.Chains().Create("chain-1-v4", &chainAttrs)
+	// Chains rules jump to
+	tblV4.Chains().Create("fake-chain-1", nil)
+	tblV4.Chains().Create("fake_chain_1", nil)
 
 	m.ti.Tables().Create("filter-v6", nftables.TableFamilyIPv6)
 	tblV6, err := m.ti.Tables().Table("filter-v6", nftables.TableFamilyIPv6)
@@ -546,12 +569,17 @@ func TestMock(t *testing.T) {
 		t.Fatalf("failed to get chain interface for table filter-v6")
 	}
 	tblV6.Chains().Create("chain-1-v6", &chainAttrs)
+	tblV6.Chains().Create("fake-chain-1", nil)
+	tblV6.Chains().Create("fake_chain_1", nil)
 
 	for _, tt := range ipv4Tests {
 		ri, err := tblV4.Chains().Chain("chain-1-v4")
 		if err != nil {
 			t.Fatalf("failed to get rules interface for chain chain-1-v4")
 		}
+		if tt.success {
+			checkRuleRoundTrip(t, tt.name, &tt.rule)
+		}
 		_, err = ri.Rules().Create(&tt.rule)
 		if err == nil && !tt.success {
 			t.Errorf("Test: %s should fail but succeeded", tt.name)
@@ -566,6 +594,9 @@ func TestMock(t *testing.T) {
 		if err != nil {
 			t.Fatalf("failed to get rules interface for chain chain-1-v6")
 		}
+		if tt.success {
+			checkRuleRoundTrip(t, tt.name, &tt.rule)
+		}
 		_, err = ri.Rules().Create(&tt.rule)
 		if err == nil && !tt.success {
 			t.Errorf("Test: %s should fail but succeeded", tt.name)
@@ -580,6 +611,9 @@ func TestMock(t *testing.T) {
 		if err != nil {
 			t.Fatalf("failed to get rules interface for chain chain-1-v4")
 		}
+		if tt.success {
+			checkRuleRoundTrip(t, tt.name, &tt.rule)
+		}
 		_, err = ri.Rules().Create(&tt.rule)
 		if err == nil && !tt.success {
 			t.Errorf("Test: %s should fail but succeeded", tt.name)
@@ -594,6 +628,9 @@ func TestMock(t *testing.T) {
 		if err != nil {
 			t.Fatalf("failed to get rules interface for chain chain-1-v4")
 		}
+		if tt.success {
+			checkRuleRoundTrip(t, tt.name, &tt.rule)
+		}
 		_, err = ri.Rules().Create(&tt.rule)
 		if err == nil && !tt.success {
 			t.Errorf("Test: %s should fail but succeeded", tt.name)
@@ -607,6 +644,9 @@ func TestMock(t *testing.T) {
 		if err != nil {
 			t.Fatalf("failed to get rules interface for chain chain-1-v6")
 		}
+		if tt.success {
+			checkRuleRoundTrip(t, tt.name, &tt.rule)
+		}
 		_, err = ri.Rules().Create(&tt.rule)
 		if err == nil && !tt.success {
 			t.Errorf("Test: %s should fail but succeeded", tt.name)
@@ -0,0 +1,185 @@
+package mock
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/nftables"
+	"github.com/sbezverk/nftableslib"
+	"golang.org/x/sys/unix"
+)
+
+func TestApplyToNamespaces(t *testing.T) {
+	bound := 3
+	dialer := func(nsPath string) (nftableslib.NetNS, func() error, error) {
+		if nsPath == "/var/run/netns/missing" {
+			return nil, nil, unix.ENOENT
+		}
+		return InitMockConn(), nil, nil
+	}
+	nm := nftableslib.InitNamespaceManager(bound, dialer)
+	paths := []string{"/var/run/netns/missing", "/var/run/netns/vanishing"}
+	for i := 0; i < 20; i++ {
+		paths = append(paths, fmt.Sprintf("/var/run/netns/pod-%d", i))
+	}
+
+	var active, maxActive int32
+	apply := func(ti nftableslib.TablesInterface) error {
+		n := atomic.AddInt32(&active, 1)
+		defer atomic.AddInt32(&active, -1)
+		for {
+			m := atomic.LoadInt32(&maxActive)
+			if n <= m || atomic.CompareAndSwapInt32(&maxActive, m, n) {
+				break
+			}
+		}
+		time.Sleep(time.Millisecond * 5)
+		if err := ti.Tables().CreateImm("filter", nftables.TableFamilyIPv4); err != nil {
+			return err
+		}
+		return nil
+	}
+	errs := nm.ApplyToNamespaces(paths, apply)
+	if maxActive > int32(bound) {
+		t.Fatalf("expected at most %d namespaces programmed in parallel, but found %d", bound, maxActive)
+	}
+	if len(errs) != 1 {
+		t.Fatalf("expected 1 failed namespace, got %d: %+v", len(errs), errs)
+	}
+	var gone *nftableslib.ErrNamespaceGone
+	if !errors.As(errs["/var/run/netns/missing"], &gone) {
+		t.Fatalf("expected ErrNamespaceGone for missing namespace, got: %+v", errs["/var/run/netns/missing"])
+	}
+	if n := len(nm.Namespaces()); n != 21 {
+		t.Fatalf("expected 21 cached namespaces, got %d", n)
+	}
+
+	// Namespace vanishes in the middle of the operation
+	vanishing := mustNamespace(t, nm, "/var/run/netns/vanishing")
+	errs = nm.ApplyToNamespaces(paths[1:], func(ti nftableslib.TablesInterface) error {
+		if ti == vanishing {
+			return unix.ESRCH
+		}
+		return nil
+	})
+	if len(errs) != 1 || !errors.As(errs["/var/run/netns/vanishing"], &gone) {
+		t.Fatalf("expected ErrNamespaceGone for vanishing namespace, got: %+v", errs)
+	}
+	if n := len(nm.Namespaces()); n != 20 {
+		t.Fatalf("expected 20 cached namespaces after vanished namespace was released, got %d", n)
+	}
+	// Missing object of an existing namespace does not release the namespace
+	existing := os.TempDir()
+	mustNamespace(t, nm, existing)
+	errs = nm.ApplyToNamespaces([]string{existing}, func(ti nftableslib.TablesInterface) error {
+		return unix.ENOENT
+	})
+	if err := errs[existing]; err == nil || errors.As(err, &gone) {
+		t.Fatalf("expected apply error without ErrNamespaceGone for existing namespace, got: %+v", err)
+	}
+	if n := len(nm.Namespaces()); n != 21 {
+		t.Fatalf("expected 21 cached namespaces after apply failure in existing namespace, got %d", n)
+	}
+	if err := nm.Close(); err != nil {
+		t.Fatalf("failed to close namespace manager with error: %+v", err)
+	}
+	if n := len(nm.Namespaces()); n != 0 {
+		t.Fatalf("expected no cached namespaces after close, got %d", n)
+	}
+}
+
+func mustNamespace(t *testing.T, nm *nftableslib.NamespaceManager, nsPath string) nftableslib.TablesInterface {
+	ti, err := nm.Namespace(nsPath)
+	if err != nil {
+		t.Fatalf("failed to get namespace %s with error: %+v", nsPath, err)
+	}
+	return ti
+}
+
+func TestNamespaceDialOutsideLock(t *testing.T) {
+	block, dialed := make(chan struct{}), make(chan struct{}, 4)
+	var closed int32
+	dialer := func(nsPath string) (nftableslib.NetNS, func() error, error) {
+		if nsPath == "/var/run/netns/slow" {
+			dialed <- struct{}{}
+			<-block
+		}
+		return InitMockConn(), func() error { atomic.AddInt32(&closed, 1); return nil }, nil
+	}
+	nm := nftableslib.InitNamespaceManager(0, dialer)
+	results := make(chan nftableslib.TablesInterface, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			ti, _ := nm.Namespace("/var/run/netns/slow")
+			results <- ti
+		}()
+	}
+	<-dialed
+	<-dialed
+	// Dial of the slow namespace does not block other namespaces
+	done := make(chan struct{})
+	go func() {
+		mustNamespace(t, nm, "/var/run/netns/fast")
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second * 5):
+		t.Fatalf("dial of a namespace blocked the namespace manager")
+	}
+	close(block)
+	if a, b := <-results, <-results; a == nil || a != b {
+		t.Fatalf("expected concurrent calls to return the same cached connection, got %p and %p", a, b)
+	}
+	if n := atomic.LoadInt32(&closed); n != 1 {
+		t.Fatalf("expected duplicate connection to be closed once, got %d closures", n)
+	}
+	if n := len(nm.Namespaces()); n != 2 {
+		t.Fatalf("expected 2 cached namespaces, got %d", n)
+	}
+}
+
+func TestNamespaceCleanupRecreated(t *testing.T) {
+	dir, err := ioutil.TempDir("", "netns")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory with error: %+v", err)
+	}
+	defer os.RemoveAll(dir)
+	nsPath, tmpPath := filepath.Join(dir, "pod"), filepath.Join(dir, "pod.tmp")
+	if err := ioutil.WriteFile(nsPath, nil, 0600); err != nil {
+		t.Fatalf("failed to create namespace file with error: %+v", err)
+	}
+	nm := nftableslib.InitNamespaceManager(0, func(string) (nftableslib.NetNS, func() error, error) {
+		return InitMockConn(), nil, nil
+	})
+	first := mustNamespace(t, nm, nsPath)
+	mustNamespace(t, nm, "/var/run/netns/missing")
+	nm.Cleanup()
+	if n := nm.Namespaces(); len(n) != 1 || n[0] != nsPath {
+		t.Fatalf("expected only existing namespace %s to stay cached, got %+v", nsPath, n)
+	}
+	// Namespace is recreated at the same path, the new file gets a different inode
+	if err := ioutil.WriteFile(tmpPath, nil, 0600); err != nil {
+		t.Fatalf("failed to create namespace file with error: %+v", err)
+	}
+	if err := os.Rename(tmpPath, nsPath); err != nil {
+		t.Fatalf("failed to replace namespace file with error: %+v", err)
+	}
+	nm.Cleanup()
+	if n := len(nm.Namespaces()); n != 0 {
+		t.Fatalf("expected recreated namespace to be released, got %d cached namespaces", n)
+	}
+	if mustNamespace(t, nm, nsPath) == first {
+		t.Fatalf("expected new connection to the recreated namespace")
+	}
+	nm.Cleanup()
+	if n := len(nm.Namespaces()); n != 1 {
+		t.Fatalf("expected connection to the recreated namespace to stay cached, got %d cached namespaces", n)
+	}
+}
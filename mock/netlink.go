@@ -0,0 +1,571 @@
+package mock
+
+import (
+	"sync"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// nlaTypeMask strips flags from the type of a netlink attribute
+const nlaTypeMask = ^uint16(unix.NLA_F_NESTED | unix.NLA_F_NET_BYTEORDER)
+
+// NetlinkMock simulates the kernel behind netlink connection of the nftables family, it is the test
+// dialer of *nftables.Conn, so the library is exercised over a real connection including the messages it
+// builds by itself. Tables, chains, rules, sets, elements and objects are stored as received and dumped back
+// in the kernel's format, batches are applied as a single transaction.
+type NetlinkMock struct {
+	sync.Mutex
+	state *nlState
+	gen   uint32
+}
+
+// nlObject is the table, chain, rule, set or set element as carried by netlink attributes
+type nlObject struct {
+	family byte
+	attrs  []netlink.Attribute
+	handle uint64
+}
+
+type nlState struct {
+	tables []*nlObject
+	chains []*nlObject
+	rules  []*nlObject
+	sets   []*nlObject
+	objs   []*nlObject
+	// elements are keyed by the family, the table and the name of the set
+	elements map[string][]*nlObject
+	handle   uint64
+}
+
+// InitMockNetlink initializes the simulated kernel without any tables
+func InitMockNetlink() *NetlinkMock {
+	return &NetlinkMock{state: &nlState{elements: make(map[string][]*nlObject)}}
+}
+
+// Conn returns connection sending requests to the simulated kernel
+func (k *NetlinkMock) Conn() *nftables.Conn {
+	return &nftables.Conn{TestDial: k.Dial}
+}
+
+// Dial processes requests sent to the simulated kernel and returns replies
+func (k *NetlinkMock) Dial(req []netlink.Message) ([]netlink.Message, error) {
+	if len(req) == 0 {
+		return nil, nil
+	}
+	k.Lock()
+	defer k.Unlock()
+	if req[0].Header.Type == netlink.HeaderType(unix.NFNL_MSG_BATCH_BEGIN) {
+		return k.batch(req), nil
+	}
+	replies := make([]netlink.Message, 0)
+	for _, m := range req {
+		replies = append(replies, k.query(m)...)
+	}
+
+	return replies, nil
+}
+
+// batch applies messages of the batch, nothing is applied if any of them fails or the batch
+// is not terminated by the end of the batch.
+func (k *NetlinkMock) batch(req []netlink.Message) []netlink.Message {
+	st := k.state.clone()
+	commit := false
+	for _, m := range req[1:] {
+		if m.Header.Type == netlink.HeaderType(unix.NFNL_MSG_BATCH_END) {
+			commit = true
+			break
+		}
+		if err := st.apply(m); err != nil {
+			return []netlink.Message{errorMessage(m, err)}
+		}
+	}
+	if commit {
+		k.state = st
+		k.gen++
+	}
+
+	return []netlink.Message{errorMessage(req[0], nil)}
+}
+
+func (st *nlState) clone() *nlState {
+	c := &nlState{
+		tables:   append([]*nlObject{}, st.tables...),
+		chains:   append([]*nlObject{}, st.chains...),
+		rules:    append([]*nlObject{}, st.rules...),
+		sets:     append([]*nlObject{}, st.sets...),
+		objs:     append([]*nlObject{}, st.objs...),
+		elements: make(map[string][]*nlObject, len(st.elements)),
+		handle:   st.handle,
+	}
+	for k, v := range st.elements {
+		c.elements[k] = append([]*nlObject{}, v...)
+	}
+
+	return c
+}
+
+func (st *nlState) apply(m netlink.Message) error {
+	if len(m.Data) < 4 {
+		return unix.EINVAL
+	}
+	attrs, err := netlink.UnmarshalAttributes(m.Data[4:])
+	if err != nil {
+		return unix.EINVAL
+	}
+	o := &nlObject{family: m.Data[0], attrs: attrs}
+	excl := m.Header.Flags&netlink.Excl != 0
+	switch msgType(m) {
+	case unix.NFT_MSG_NEWTABLE:
+		if i := find(st.tables, o, unix.NFTA_TABLE_NAME); i >= 0 {
+			if excl {
+				return unix.EEXIST
+			}
+			st.tables[i] = o
+			return nil
+		}
+		st.tables = append(st.tables, o)
+	case unix.NFT_MSG_DELTABLE:
+		if attr(attrs, unix.NFTA_TABLE_NAME) == nil {
+			// Flush of the ruleset of the family
+			for _, t := range append([]*nlObject{}, st.tables...) {
+				if o.family == unix.NFPROTO_UNSPEC || t.family == o.family {
+					st.delTable(t.family, str(t, unix.NFTA_TABLE_NAME))
+				}
+			}
+			return nil
+		}
+		if find(st.tables, o, unix.NFTA_TABLE_NAME) < 0 {
+			return unix.ENOENT
+		}
+		st.delTable(o.family, str(o, unix.NFTA_TABLE_NAME))
+	case unix.NFT_MSG_NEWCHAIN:
+		if !st.hasTable(o.family, str(o, unix.NFTA_CHAIN_TABLE)) {
+			return unix.ENOENT
+		}
+		if i := find(st.chains, o, unix.NFTA_CHAIN_TABLE, unix.NFTA_CHAIN_NAME); i >= 0 {
+			if excl {
+				return unix.EEXIST
+			}
+			st.chains[i] = o
+			return nil
+		}
+		st.chains = append(st.chains, o)
+	case unix.NFT_MSG_DELCHAIN:
+		i := find(st.chains, o, unix.NFTA_CHAIN_TABLE, unix.NFTA_CHAIN_NAME)
+		if i < 0 {
+			return unix.ENOENT
+		}
+		// Rules of the chain are deleted along with the chain
+		st.rules = filter(st.rules, func(r *nlObject) bool {
+			return !(r.family == o.family && str(r, unix.NFTA_RULE_TABLE) == str(o, unix.NFTA_CHAIN_TABLE) &&
+				str(r, unix.NFTA_RULE_CHAIN) == str(o, unix.NFTA_CHAIN_NAME))
+		})
+		st.chains = append(st.chains[:i], st.chains[i+1:]...)
+	case unix.NFT_MSG_NEWRULE:
+		return st.newRule(o, m.Header.Flags)
+	case unix.NFT_MSG_DELRULE:
+		i := st.findRule(o)
+		if i < 0 {
+			return unix.ENOENT
+		}
+		st.rules = append(st.rules[:i], st.rules[i+1:]...)
+	case unix.NFT_MSG_NEWSET:
+		if !st.hasTable(o.family, str(o, unix.NFTA_SET_TABLE)) {
+			return unix.ENOENT
+		}
+		if i := find(st.sets, o, unix.NFTA_SET_TABLE, unix.NFTA_SET_NAME); i >= 0 {
+			if excl {
+				return unix.EEXIST
+			}
+			st.sets[i] = o
+			return nil
+		}
+		st.sets = append(st.sets, o)
+	case unix.NFT_MSG_DELSET:
+		i := find(st.sets, o, unix.NFTA_SET_TABLE, unix.NFTA_SET_NAME)
+		if i < 0 {
+			return unix.ENOENT
+		}
+		delete(st.elements, setKey(o.family, str(o, unix.NFTA_SET_TABLE), str(o, unix.NFTA_SET_NAME)))
+		st.sets = append(st.sets[:i], st.sets[i+1:]...)
+	case unix.NFT_MSG_NEWSETELEM, unix.NFT_MSG_DELSETELEM:
+		return st.setElements(o, msgType(m) == unix.NFT_MSG_NEWSETELEM, excl)
+	case unix.NFT_MSG_NEWOBJ:
+		if !st.hasTable(o.family, str(o, unix.NFTA_OBJ_TABLE)) {
+			return unix.ENOENT
+		}
+		if i := find(st.objs, o, unix.NFTA_OBJ_TABLE, unix.NFTA_OBJ_NAME, unix.NFTA_OBJ_TYPE); i >= 0 {
+			if excl {
+				return unix.EEXIST
+			}
+			st.objs[i] = o
+			return nil
+		}
+		st.objs = append(st.objs, o)
+	case unix.NFT_MSG_DELOBJ:
+		i := find(st.objs, o, unix.NFTA_OBJ_TABLE, unix.NFTA_OBJ_NAME, unix.NFTA_OBJ_TYPE)
+		if i < 0 {
+			return unix.ENOENT
+		}
+		st.objs = append(st.objs[:i], st.objs[i+1:]...)
+	default:
+		return unix.EOPNOTSUPP
+	}
+
+	return nil
+}
+
+func (st *nlState) hasTable(family byte, name string) bool {
+	for _, t := range st.tables {
+		if t.family == family && str(t, unix.NFTA_TABLE_NAME) == name {
+			return true
+		}
+	}
+	return false
+}
+
+// delTable removes the table along with its chains, rules and sets
+func (st *nlState) delTable(family byte, name string) {
+	st.tables = filter(st.tables, func(o *nlObject) bool {
+		return !(o.family == family && str(o, unix.NFTA_TABLE_NAME) == name)
+	})
+	st.chains = filter(st.chains, func(o *nlObject) bool {
+		return !(o.family == family && str(o, unix.NFTA_CHAIN_TABLE) == name)
+	})
+	st.rules = filter(st.rules, func(o *nlObject) bool {
+		return !(o.family == family && str(o, unix.NFTA_RULE_TABLE) == name)
+	})
+	st.objs = filter(st.objs, func(o *nlObject) bool {
+		return !(o.family == family && str(o, unix.NFTA_OBJ_TABLE) == name)
+	})
+	st.sets = filter(st.sets, func(o *nlObject) bool {
+		if o.family == family && str(o, unix.NFTA_SET_TABLE) == name {
+			delete(st.elements, setKey(family, name, str(o, unix.NFTA_SET_NAME)))
+			return false
+		}
+		return true
+	})
+}
+
+// findRule returns the index of the rule identified by the handle of the message
+func (st *nlState) findRule(o *nlObject) int {
+	h := attr(o.attrs, unix.NFTA_RULE_HANDLE)
+	if h == nil {
+		return -1
+	}
+	return st.ruleByHandle(o, binaryutil.BigEndian.Uint64(h))
+}
+
+func (st *nlState) ruleByHandle(o *nlObject, handle uint64) int {
+	for i, r := range st.rules {
+		if r.family == o.family && r.handle == handle && str(r, unix.NFTA_RULE_TABLE) == str(o, unix.NFTA_RULE_TABLE) &&
+			str(r, unix.NFTA_RULE_CHAIN) == str(o, unix.NFTA_RULE_CHAIN) {
+			return i
+		}
+	}
+	return -1
+}
+
+// newRule adds, inserts or replaces the rule, rules are positioned relative to the rule
+// identified by the position attribute.
+func (st *nlState) newRule(o *nlObject, flags netlink.HeaderFlags) error {
+	chain := &nlObject{family: o.family, attrs: []netlink.Attribute{
+		{Type: unix.NFTA_CHAIN_TABLE, Data: attr(o.attrs, unix.NFTA_RULE_TABLE)},
+		{Type: unix.NFTA_CHAIN_NAME, Data: attr(o.attrs, unix.NFTA_RULE_CHAIN)},
+	}}
+	if find(st.chains, chain, unix.NFTA_CHAIN_TABLE, unix.NFTA_CHAIN_NAME) < 0 {
+		return unix.ENOENT
+	}
+	if flags&netlink.Replace != 0 {
+		i := st.findRule(o)
+		if i < 0 {
+			return unix.ENOENT
+		}
+		o.handle = st.rules[i].handle
+		st.rules[i] = o
+		return nil
+	}
+	pos := -1
+	if p := attr(o.attrs, unix.NFTA_RULE_POSITION); p != nil {
+		if pos = st.ruleByHandle(o, binaryutil.BigEndian.Uint64(p)); pos < 0 {
+			return unix.ENOENT
+		}
+	}
+	st.handle++
+	o.handle = st.handle
+	o.attrs = append(without(o.attrs, unix.NFTA_RULE_POSITION, unix.NFTA_RULE_HANDLE),
+		netlink.Attribute{Type: unix.NFTA_RULE_HANDLE, Data: binaryutil.BigEndian.PutUint64(o.handle)})
+	i := len(st.rules)
+	switch {
+	case flags&netlink.Append != 0 && pos >= 0:
+		i = pos + 1
+	case flags&netlink.Append == 0 && pos >= 0:
+		i = pos
+	case flags&netlink.Append == 0:
+		// Inserting before the first rule of the chain
+		for j, r := range st.rules {
+			if r.family == o.family && str(r, unix.NFTA_RULE_TABLE) == str(o, unix.NFTA_RULE_TABLE) &&
+				str(r, unix.NFTA_RULE_CHAIN) == str(o, unix.NFTA_RULE_CHAIN) {
+				i = j
+				break
+			}
+		}
+	}
+	st.rules = append(st.rules[:i], append([]*nlObject{o}, st.rules[i:]...)...)
+
+	return nil
+}
+
+// setElements adds or removes elements carried by the message, elements are identified by the key
+// and the interval end flag.
+func (st *nlState) setElements(o *nlObject, add, excl bool) error {
+	table, set := str(o, unix.NFTA_SET_ELEM_LIST_TABLE), str(o, unix.NFTA_SET_ELEM_LIST_SET)
+	s := &nlObject{family: o.family, attrs: []netlink.Attribute{
+		{Type: unix.NFTA_SET_TABLE, Data: attr(o.attrs, unix.NFTA_SET_ELEM_LIST_TABLE)},
+		{Type: unix.NFTA_SET_NAME, Data: attr(o.attrs, unix.NFTA_SET_ELEM_LIST_SET)},
+	}}
+	if find(st.sets, s, unix.NFTA_SET_TABLE, unix.NFTA_SET_NAME) < 0 {
+		return unix.ENOENT
+	}
+	list, err := netlink.UnmarshalAttributes(attr(o.attrs, unix.NFTA_SET_ELEM_LIST_ELEMENTS))
+	if err != nil {
+		return unix.EINVAL
+	}
+	key := setKey(o.family, table, set)
+	elements := st.elements[key]
+	for _, l := range list {
+		attrs, err := netlink.UnmarshalAttributes(l.Data)
+		if err != nil {
+			return unix.EINVAL
+		}
+		e := &nlObject{attrs: attrs}
+		i := -1
+		for j, c := range elements {
+			if elementID(c) == elementID(e) {
+				i = j
+				break
+			}
+		}
+		switch {
+		case add && i >= 0 && excl:
+			return unix.EEXIST
+		case add && i >= 0:
+			elements[i] = e
+		case add:
+			elements = append(elements, e)
+		case i < 0:
+			return unix.ENOENT
+		default:
+			elements = append(elements[:i], elements[i+1:]...)
+		}
+	}
+	st.elements[key] = elements
+
+	return nil
+}
+
+// elementID identifies the element by its key and the interval end flag
+func elementID(e *nlObject) string {
+	id := string(attr(e.attrs, unix.NFTA_SET_ELEM_KEY))
+	if f := attr(e.attrs, unix.NFTA_SET_ELEM_FLAGS); f != nil && binaryutil.BigEndian.Uint32(f)&unix.NFT_SET_ELEM_INTERVAL_END != 0 {
+		id += "/end"
+	}
+	return id
+}
+
+// query replies to the request reading the ruleset
+func (k *NetlinkMock) query(m netlink.Message) []netlink.Message {
+	if len(m.Data) < 4 {
+		return []netlink.Message{errorMessage(m, unix.EINVAL)}
+	}
+	attrs, err := netlink.UnmarshalAttributes(m.Data[4:])
+	if err != nil {
+		return []netlink.Message{errorMessage(m, unix.EINVAL)}
+	}
+	req := &nlObject{family: m.Data[0], attrs: attrs}
+	dump := m.Header.Flags&netlink.Dump == netlink.Dump
+	st := k.state
+	var objs []*nlObject
+	var reply uint16
+	switch msgType(m) {
+	case unix.NFT_MSG_GETTABLE:
+		reply = unix.NFT_MSG_NEWTABLE
+		objs = selectObjects(st.tables, req, dump, unix.NFTA_TABLE_NAME)
+	case unix.NFT_MSG_GETCHAIN:
+		reply = unix.NFT_MSG_NEWCHAIN
+		objs = selectObjects(st.chains, req, dump, unix.NFTA_CHAIN_TABLE, unix.NFTA_CHAIN_NAME)
+	case unix.NFT_MSG_GETRULE:
+		reply = unix.NFT_MSG_NEWRULE
+		objs = selectObjects(st.rules, req, true, unix.NFTA_RULE_TABLE, unix.NFTA_RULE_CHAIN)
+	case unix.NFT_MSG_GETSET:
+		reply = unix.NFT_MSG_NEWSET
+		objs = selectObjects(st.sets, req, dump, unix.NFTA_SET_TABLE, unix.NFTA_SET_NAME)
+	case unix.NFT_MSG_GETSETELEM:
+		set, ok := st.elements[setKey(req.family, str(req, unix.NFTA_SET_ELEM_LIST_TABLE), str(req, unix.NFTA_SET_ELEM_LIST_SET))]
+		s := &nlObject{family: req.family, attrs: []netlink.Attribute{
+			{Type: unix.NFTA_SET_TABLE, Data: attr(attrs, unix.NFTA_SET_ELEM_LIST_TABLE)},
+			{Type: unix.NFTA_SET_NAME, Data: attr(attrs, unix.NFTA_SET_ELEM_LIST_SET)},
+		}}
+		if !ok && find(st.sets, s, unix.NFTA_SET_TABLE, unix.NFTA_SET_NAME) < 0 {
+			return []netlink.Message{errorMessage(m, unix.ENOENT)}
+		}
+		reply = unix.NFT_MSG_NEWSETELEM
+		if len(set) != 0 {
+			list := make([]netlink.Attribute, 0, len(set))
+			for _, e := range set {
+				list = append(list, netlink.Attribute{Type: unix.NLA_F_NESTED | unix.NFTA_LIST_ELEM, Data: marshal(e.attrs)})
+			}
+			objs = []*nlObject{{family: req.family, attrs: []netlink.Attribute{
+				{Type: unix.NFTA_SET_ELEM_LIST_TABLE, Data: attr(attrs, unix.NFTA_SET_ELEM_LIST_TABLE)},
+				{Type: unix.NFTA_SET_ELEM_LIST_SET, Data: attr(attrs, unix.NFTA_SET_ELEM_LIST_SET)},
+				{Type: unix.NLA_F_NESTED | unix.NFTA_SET_ELEM_LIST_ELEMENTS, Data: marshal(list)},
+			}}}
+		}
+	case unix.NFT_MSG_GETGEN:
+		reply = unix.NFT_MSG_NEWGEN
+		objs = []*nlObject{{attrs: []netlink.Attribute{{Type: unix.NFTA_GEN_ID, Data: binaryutil.BigEndian.PutUint32(k.gen)}}}}
+	case unix.NFT_MSG_GETOBJ:
+		reply = unix.NFT_MSG_NEWOBJ
+		objs = selectObjects(st.objs, req, dump, unix.NFTA_OBJ_TABLE, unix.NFTA_OBJ_NAME, unix.NFTA_OBJ_TYPE)
+	default:
+		return []netlink.Message{errorMessage(m, unix.EOPNOTSUPP)}
+	}
+	if !dump && len(objs) == 0 {
+		return []netlink.Message{errorMessage(m, unix.ENOENT)}
+	}
+	replies := make([]netlink.Message, 0, len(objs)+1)
+	for _, o := range objs {
+		r := netlink.Message{
+			Header: netlink.Header{
+				Type:     netlink.HeaderType(unix.NFNL_SUBSYS_NFTABLES<<8 | reply),
+				Sequence: m.Header.Sequence,
+				PID:      m.Header.PID,
+			},
+			Data: append([]byte{o.family, unix.NFNETLINK_V0, 0, 0}, marshal(o.attrs)...),
+		}
+		if dump {
+			r.Header.Flags = netlink.Multi
+		}
+		replies = append(replies, r)
+	}
+	if dump {
+		replies = append(replies, netlink.Message{
+			Header: netlink.Header{Type: netlink.Done, Flags: netlink.Multi, Sequence: m.Header.Sequence, PID: m.Header.PID},
+			Data:   make([]byte, 4),
+		})
+	}
+
+	return replies
+}
+
+// selectObjects returns objects of the requested family matching attributes carried by the request,
+// dumps of all families are requested by unspecified family.
+func selectObjects(objs []*nlObject, req *nlObject, dump bool, keys ...uint16) []*nlObject {
+	selected := make([]*nlObject, 0)
+	for _, o := range objs {
+		if req.family != unix.NFPROTO_UNSPEC && o.family != req.family {
+			continue
+		}
+		match := true
+		for _, k := range keys {
+			if v := attr(req.attrs, k); (v != nil || !dump) && string(v) != string(attr(o.attrs, k)) {
+				match = false
+			}
+		}
+		if match {
+			selected = append(selected, o)
+		}
+	}
+
+	return selected
+}
+
+// find returns the index of the object of the same family carrying the same key attributes
+func find(objs []*nlObject, o *nlObject, keys ...uint16) int {
+	for i, c := range objs {
+		if c.family != o.family {
+			continue
+		}
+		match := true
+		for _, k := range keys {
+			if string(attr(c.attrs, k)) != string(attr(o.attrs, k)) {
+				match = false
+			}
+		}
+		if match {
+			return i
+		}
+	}
+	return -1
+}
+
+func filter(objs []*nlObject, keep func(*nlObject) bool) []*nlObject {
+	kept := make([]*nlObject, 0, len(objs))
+	for _, o := range objs {
+		if keep(o) {
+			kept = append(kept, o)
+		}
+	}
+	return kept
+}
+
+// attr returns data of the attribute of the type, nested and byte order flags are ignored
+func attr(attrs []netlink.Attribute, t uint16) []byte {
+	for _, a := range attrs {
+		if a.Type&nlaTypeMask == t {
+			return a.Data
+		}
+	}
+	return nil
+}
+
+// str returns the string carried by the attribute of the object without the terminating zero
+func str(o *nlObject, t uint16) string {
+	b := attr(o.attrs, t)
+	if l := len(b); l != 0 && b[l-1] == 0 {
+		b = b[:l-1]
+	}
+	return string(b)
+}
+
+func without(attrs []netlink.Attribute, types ...uint16) []netlink.Attribute {
+	kept := make([]netlink.Attribute, 0, len(attrs))
+	for _, a := range attrs {
+		drop := false
+		for _, t := range types {
+			drop = drop || a.Type&nlaTypeMask == t
+		}
+		if !drop {
+			kept = append(kept, a)
+		}
+	}
+	return kept
+}
+
+func marshal(attrs []netlink.Attribute) []byte {
+	b, _ := netlink.MarshalAttributes(attrs)
+	return b
+}
+
+func setKey(family byte, table, set string) string {
+	return string([]byte{family}) + "/" + table + "/" + set
+}
+
+func msgType(m netlink.Message) uint16 {
+	return uint16(m.Header.Type) & 0xff
+}
+
+// errorMessage returns the acknowledgement of the message, or the error the message failed with
+func errorMessage(m netlink.Message, err error) netlink.Message {
+	code := int32(0)
+	if errno, ok := err.(unix.Errno); ok {
+		code = -int32(errno)
+	}
+	return netlink.Message{
+		Header: netlink.Header{Type: netlink.Error, Sequence: m.Header.Sequence, PID: m.Header.PID},
+		Data:   binaryutil.NativeEndian.PutUint32(uint32(code)),
+	}
+}
@@ -0,0 +1,148 @@
+package mock
+
+import (
+	"net"
+	"testing"
+
+	"github.com/google/nftables"
+	"github.com/sbezverk/nftableslib"
+	"golang.org/x/sys/unix"
+)
+
+func TestInjectedConn(t *testing.T) {
+	k := InitMockNetlink()
+	ti, err := nftableslib.InitNFTablesWithConn(k.Conn())
+	if err != nil {
+		t.Fatalf("failed to initialize library with injected connection with error: %+v", err)
+	}
+	if _, err := nftableslib.InitNFTablesWithConn(nil); err == nil {
+		t.Fatalf("initializing library with nil connection is supposed to fail")
+	}
+	table := &nftables.Table{Name: "filter", Family: nftables.TableFamilyIPv4}
+	if err := ti.Tables().CreateImm(table.Name, table.Family); err != nil {
+		t.Fatalf("failed to create table with error: %+v", err)
+	}
+	tables, err := ti.Tables().List(nftables.TableFamilyIPv4)
+	if err != nil || len(tables) != 1 || tables[0].Name != table.Name {
+		t.Fatalf("failed to list tables, got %+v with error: %+v", tables, err)
+	}
+
+	// Chains
+	ci, _ := ti.Tables().TableChains(table.Name, table.Family)
+	policy := nftableslib.ChainPolicyAccept
+	if err := ci.Chains().CreateImm("input", &nftableslib.ChainAttributes{
+		Type:     nftables.ChainTypeFilter,
+		Hook:     nftables.ChainHookInput,
+		Priority: nftables.ChainPriorityFilter,
+		Policy:   &policy,
+	}); err != nil {
+		t.Fatalf("failed to create base chain with error: %+v", err)
+	}
+	if err := ci.Chains().CreateImm("services", nil); err != nil {
+		t.Fatalf("failed to create chain with error: %+v", err)
+	}
+	chains, err := ci.Chains().List()
+	if err != nil || len(chains) != 2 {
+		t.Fatalf("failed to list chains, got %+v with error: %+v", chains, err)
+	}
+	for _, c := range chains {
+		if c.Base != (c.Name == "input") {
+			t.Fatalf("chain %s is expected to be base chain: %t", c.Name, c.Name == "input")
+		}
+	}
+
+	// Rules
+	ri, _ := ci.Chains().Chain("services")
+	ssh := &nftableslib.Rule{
+		L4:     &nftableslib.L4Rule{L4Proto: unix.IPPROTO_TCP, Dst: &nftableslib.Port{List: []uint16{22}}},
+		Action: setActionVerdict(t, nftableslib.NFT_ACCEPT),
+	}
+	http := &nftableslib.Rule{
+		L4:     &nftableslib.L4Rule{L4Proto: unix.IPPROTO_TCP, Dst: &nftableslib.Port{List: []uint16{80}}},
+		Action: setActionVerdict(t, nftableslib.NFT_ACCEPT),
+	}
+	first, err := ri.Rules().CreateImm(ssh)
+	if err != nil {
+		t.Fatalf("failed to create rule with error: %+v", err)
+	}
+	second, err := ri.Rules().InsertImm(http)
+	if err != nil {
+		t.Fatalf("failed to insert rule with error: %+v", err)
+	}
+	if first == 0 || second == 0 || first == second {
+		t.Fatalf("rules are expected to get distinct handles, got %d and %d", first, second)
+	}
+	conn := k.Conn()
+	rules, err := conn.GetRule(table, &nftables.Chain{Name: "services", Table: table})
+	if err != nil || len(rules) != 2 {
+		t.Fatalf("failed to get rules, got %d rules with error: %+v", len(rules), err)
+	}
+	if rules[0].Handle != second || rules[1].Handle != first {
+		t.Fatalf("inserted rule %d is expected to precede created rule %d, got %d and %d", second, first, rules[0].Handle, rules[1].Handle)
+	}
+	if n, err := ci.Chains().RuleCount("services"); err != nil || n != 2 {
+		t.Fatalf("expected 2 rules in chain services, got %d with error: %+v", n, err)
+	}
+	if err := ri.Rules().DeleteImm(second); err != nil {
+		t.Fatalf("failed to delete rule with error: %+v", err)
+	}
+	if rules, _ := conn.GetRule(table, &nftables.Chain{Name: "services", Table: table}); len(rules) != 1 || rules[0].Handle != first {
+		t.Fatalf("only rule %d is expected to remain, got %d rules", first, len(rules))
+	}
+
+	// Sets
+	si, _ := ti.Tables().TableSets(table.Name, table.Family)
+	elements := []nftables.SetElement{{Key: net.ParseIP("10.0.0.1").To4()}, {Key: net.ParseIP("10.0.0.2").To4()}}
+	if _, err := si.Sets().CreateSet(&nftableslib.SetAttributes{Name: "blocked", KeyType: nftables.TypeIPAddr}, elements); err != nil {
+		t.Fatalf("failed to create set with error: %+v", err)
+	}
+	if err := si.Sets().SetAddElements("blocked", []nftables.SetElement{{Key: net.ParseIP("10.0.0.3").To4()}}); err != nil {
+		t.Fatalf("failed to add elements with error: %+v", err)
+	}
+	if err := si.Sets().SetDelElements("blocked", elements[:1]); err != nil {
+		t.Fatalf("failed to delete elements with error: %+v", err)
+	}
+	got, err := si.Sets().GetSetElements("blocked")
+	if err != nil || len(got) != 2 {
+		t.Fatalf("expected 2 elements in set blocked, got %+v with error: %+v", got, err)
+	}
+	iterated := 0
+	if err := si.Sets().IterateSetElements("blocked", func(nftables.SetElement) error {
+		iterated++
+		return nil
+	}); err != nil || iterated != 2 {
+		t.Fatalf("expected to iterate over 2 elements of set blocked, got %d with error: %+v", iterated, err)
+	}
+	if s, err := si.Sets().GetSetByName("blocked"); err != nil || s.Name != "blocked" {
+		t.Fatalf("failed to get set blocked with error: %+v", err)
+	}
+	if sets, err := si.Sets().GetSets(); err != nil || len(sets) != 1 {
+		t.Fatalf("expected single set, got %d with error: %+v", len(sets), err)
+	}
+
+	// Fresh instance discovers the ruleset over the injected connection
+	synced, _ := nftableslib.InitNFTablesWithConn(k.Conn())
+	if _, err := synced.Tables().Sync(nftables.TableFamilyIPv4); err != nil {
+		t.Fatalf("failed to sync tables with error: %+v", err)
+	}
+	if !synced.Tables().Exist(table.Name, table.Family) {
+		t.Fatalf("table %s is expected to be discovered", table.Name)
+	}
+
+	// Deletions
+	if err := si.Sets().DelSet("blocked"); err != nil {
+		t.Fatalf("failed to delete set with error: %+v", err)
+	}
+	if err := ri.Rules().DeleteImm(first); err != nil {
+		t.Fatalf("failed to delete rule with error: %+v", err)
+	}
+	if err := ci.Chains().DeleteImm("services"); err != nil {
+		t.Fatalf("failed to delete chain with error: %+v", err)
+	}
+	if err := ti.Tables().DeleteImm(table.Name, table.Family); err != nil {
+		t.Fatalf("failed to delete table with error: %+v", err)
+	}
+	if tables, err := conn.ListTables(); err != nil || len(tables) != 0 {
+		t.Fatalf("no tables are expected to remain, got %d with error: %+v", len(tables), err)
+	}
+}
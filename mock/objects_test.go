@@ -0,0 +1,144 @@
+package mock
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/nftables"
+	"github.com/sbezverk/nftableslib"
+	"golang.org/x/sys/unix"
+)
+
+func TestObjects(t *testing.T) {
+	m := InitMockConn()
+	if err := m.ti.Tables().CreateImm("filter", nftables.TableFamilyINet); err != nil {
+		t.Fatalf("failed to create table filter with error: %+v", err)
+	}
+	table := &nftables.Table{Name: "filter", Family: nftables.TableFamilyINet}
+	objects := []*nftableslib.Object{
+		{Kind: nftableslib.ObjectLimit, Name: "ssh", Limit: &nftableslib.LimitState{Rate: 10, Unit: time.Minute, Burst: 5}},
+		{Kind: nftableslib.ObjectQuota, Name: "guest", Use: 1, Quota: &nftableslib.QuotaState{Bytes: 1 << 30, Consumed: 1 << 20}},
+		{Kind: nftableslib.ObjectCounter, Name: "web", Counter: &nftableslib.CounterState{Packets: 10, Bytes: 1500}},
+		{Kind: nftableslib.ObjectCtHelper, Name: "ftp-standard", CtHelper: &nftableslib.CtHelperState{Helper: "ftp", Family: nftables.TableFamilyIPv4, Protocol: unix.IPPROTO_TCP}},
+		{Kind: nftableslib.ObjectCounter, Name: "dns", Counter: &nftableslib.CounterState{Packets: 2, Bytes: 120}},
+	}
+	for _, o := range objects {
+		m.AddObject(table, o)
+	}
+	if err := m.Flush(); err != nil {
+		t.Fatalf("failed to program objects with error: %+v", err)
+	}
+	oi, err := m.ti.Tables().TableObjects("filter", nftables.TableFamilyINet)
+	if err != nil {
+		t.Fatalf("failed to get objects interface with error: %+v", err)
+	}
+	objs, err := oi.Objects().List()
+	if err != nil {
+		t.Fatalf("failed to list objects with error: %+v", err)
+	}
+	// Objects are listed by kind and then by name
+	want := []*nftableslib.Object{objects[4], objects[2], objects[1], objects[3], objects[0]}
+	if !reflect.DeepEqual(objs, want) {
+		t.Fatalf("expected objects %+v, got %+v", want, objs)
+	}
+	quota, err := oi.Objects().Get(nftableslib.ObjectQuota, "guest")
+	if err != nil {
+		t.Fatalf("failed to get quota guest with error: %+v", err)
+	}
+	if got := quota.Quota.Remaining(); got != 1<<30-1<<20 {
+		t.Fatalf("expected %d bytes remaining in quota guest, got %d", 1<<30-1<<20, got)
+	}
+	if oi.Objects().Exist(nftableslib.ObjectQuota, "web") {
+		t.Fatalf("counter web must not be found as a quota")
+	}
+
+	if err := oi.Objects().Delete(nftableslib.ObjectCounter, "web"); err != nil {
+		t.Fatalf("failed to delete counter web with error: %+v", err)
+	}
+	if oi.Objects().Exist(nftableslib.ObjectCounter, "web") {
+		t.Fatalf("counter web still exists after deletion")
+	}
+	if err := oi.Objects().Delete(nftableslib.ObjectCounter, "web"); err == nil {
+		t.Fatalf("deleting not existing counter web supposed to fail")
+	}
+	if err := oi.Objects().Delete(nftableslib.ObjectQuota, "guest"); err == nil {
+		t.Fatalf("deleting referenced quota guest supposed to fail")
+	}
+
+	if err := m.ti.Tables().DeleteImm("filter", nftables.TableFamilyINet); err != nil {
+		t.Fatalf("failed to delete table filter with error: %+v", err)
+	}
+	if _, err := oi.Objects().List(); err == nil {
+		t.Fatalf("listing objects of deleted table supposed to fail")
+	}
+}
+
+func TestResetObjects(t *testing.T) {
+	m := InitMockConn()
+	if err := m.ti.Tables().CreateImm("filter", nftables.TableFamilyINet); err != nil {
+		t.Fatalf("failed to create table filter with error: %+v", err)
+	}
+	table := &nftables.Table{Name: "filter", Family: nftables.TableFamilyINet}
+	objects := []*nftableslib.Object{
+		{Kind: nftableslib.ObjectCounter, Name: "acct-web", Counter: &nftableslib.CounterState{Packets: 10, Bytes: 1500}},
+		{Kind: nftableslib.ObjectCounter, Name: "acct-dns", Counter: &nftableslib.CounterState{Packets: 2, Bytes: 120}},
+		{Kind: nftableslib.ObjectQuota, Name: "acct-guest", Quota: &nftableslib.QuotaState{Bytes: 1000, Consumed: 1200, Depleted: true}},
+		{Kind: nftableslib.ObjectCounter, Name: "ssh", Counter: &nftableslib.CounterState{Packets: 7, Bytes: 700}},
+		{Kind: nftableslib.ObjectLimit, Name: "acct-limit", Limit: &nftableslib.LimitState{Rate: 10, Unit: time.Minute}},
+	}
+	for _, o := range objects {
+		m.AddObject(table, o)
+	}
+	if err := m.Flush(); err != nil {
+		t.Fatalf("failed to program objects with error: %+v", err)
+	}
+	oi, err := m.ti.Tables().TableObjects("filter", nftables.TableFamilyINet)
+	if err != nil {
+		t.Fatalf("failed to get objects interface with error: %+v", err)
+	}
+
+	counter, err := oi.Objects().ResetCounter("ssh")
+	if err != nil {
+		t.Fatalf("failed to reset counter ssh with error: %+v", err)
+	}
+	if !reflect.DeepEqual(counter, objects[3].Counter) {
+		t.Fatalf("expected counter ssh %+v before reset, got %+v", objects[3].Counter, counter)
+	}
+	if counter, err = oi.Objects().ResetCounter("ssh"); err != nil {
+		t.Fatalf("failed to reset counter ssh with error: %+v", err)
+	}
+	if counter.Packets != 0 || counter.Bytes != 0 {
+		t.Fatalf("expected counter ssh to be reset, got %+v", counter)
+	}
+	if _, err := oi.Objects().ResetCounter("acct-guest"); err == nil {
+		t.Fatalf("resetting quota acct-guest as a counter supposed to fail")
+	}
+
+	objs, err := oi.Objects().ReadAndResetAll("acct-")
+	if err != nil {
+		t.Fatalf("failed to read and reset objects with error: %+v", err)
+	}
+	// Counters and quotas are returned by kind and then by name, the limit is not reset
+	want := []*nftableslib.Object{objects[1], objects[0], objects[2]}
+	if !reflect.DeepEqual(objs, want) {
+		t.Fatalf("expected objects %+v, got %+v", want, objs)
+	}
+	quota, err := oi.Objects().ResetQuota("acct-guest")
+	if err != nil {
+		t.Fatalf("failed to reset quota acct-guest with error: %+v", err)
+	}
+	if want := (&nftableslib.QuotaState{Bytes: 1000}); !reflect.DeepEqual(quota, want) {
+		t.Fatalf("expected quota acct-guest %+v after reset, got %+v", want, quota)
+	}
+	web, err := oi.Objects().Get(nftableslib.ObjectCounter, "acct-web")
+	if err != nil {
+		t.Fatalf("failed to get counter acct-web with error: %+v", err)
+	}
+	if web.Counter.Packets != 0 || web.Counter.Bytes != 0 {
+		t.Fatalf("expected counter acct-web to be reset, got %+v", web.Counter)
+	}
+	if _, err := oi.Objects().ResetQuota("missing"); err == nil {
+		t.Fatalf("resetting not existing quota supposed to fail")
+	}
+}
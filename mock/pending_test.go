@@ -0,0 +1,102 @@
+package mock
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/google/nftables"
+	"github.com/sbezverk/nftableslib"
+)
+
+func TestPendingObjects(t *testing.T) {
+	m := InitMockConn()
+	ti := m.ti.Tables()
+	pending := func(want *nftableslib.PendingObjects) {
+		t.Helper()
+		p, err := ti.Pending()
+		if err != nil {
+			t.Fatalf("failed to get pending objects with error: %+v", err)
+		}
+		if !reflect.DeepEqual(p, want) {
+			t.Fatalf("expected pending objects %+v, got %+v", want, p)
+		}
+	}
+
+	// Table
+	if err := ti.Create("filter", nftables.TableFamilyIPv4); err != nil {
+		t.Fatalf("failed to create table filter with error: %+v", err)
+	}
+	if !ti.Exist("filter", nftables.TableFamilyIPv4) {
+		t.Fatalf("expected queued table filter to exist before flush")
+	}
+	// Chain of the queued table
+	ci, _ := ti.Table("filter", nftables.TableFamilyIPv4)
+	if err := ci.Chains().Create("input", nil); err != nil {
+		t.Fatalf("failed to create chain input with error: %+v", err)
+	}
+	if !ci.Chains().Exist("input") {
+		t.Fatalf("expected queued chain input to exist before flush")
+	}
+	pending(&nftableslib.PendingObjects{
+		Tables: []nftableslib.PendingObject{{Family: nftables.TableFamilyIPv4, Table: "filter"}},
+		Chains: []nftableslib.PendingObject{{Family: nftables.TableFamilyIPv4, Table: "filter", Chain: "input"}},
+	})
+	// Sets are programmed immediately along with queued objects they depend on
+	si, _ := ti.TableSets("filter", nftables.TableFamilyIPv4)
+	if _, err := si.Sets().CreateSet(&nftableslib.SetAttributes{Name: "addresses", KeyType: nftables.TypeIPAddr}, nil); err != nil {
+		t.Fatalf("failed to create set addresses with error: %+v", err)
+	}
+	if _, err := si.Sets().GetSetByName("addresses"); err != nil {
+		t.Fatalf("expected set addresses to exist")
+	}
+	pending(&nftableslib.PendingObjects{})
+
+	// Queued deletions
+	if err := ci.Chains().Create("output", nil); err != nil {
+		t.Fatalf("failed to create chain output with error: %+v", err)
+	}
+	if err := ti.Create("nat", nftables.TableFamilyIPv4); err != nil {
+		t.Fatalf("failed to create table nat with error: %+v", err)
+	}
+	if err := m.Flush(); err != nil {
+		t.Fatalf("failed to flush with error: %+v", err)
+	}
+	if err := ci.Chains().Delete("output"); err != nil {
+		t.Fatalf("failed to delete chain output with error: %+v", err)
+	}
+	if ci.Chains().Exist("output") {
+		t.Fatalf("expected chain output queued for deletion not to exist before flush")
+	}
+	if chains, _ := ci.Chains().Get(); !reflect.DeepEqual(chains, []string{"input"}) {
+		t.Fatalf("expected only chain input, got %v", chains)
+	}
+	if err := ti.Delete("nat", nftables.TableFamilyIPv4); err != nil {
+		t.Fatalf("failed to delete table nat with error: %+v", err)
+	}
+	if ti.Exist("nat", nftables.TableFamilyIPv4) {
+		t.Fatalf("expected table nat queued for deletion not to exist before flush")
+	}
+	pending(&nftableslib.PendingObjects{
+		Tables: []nftableslib.PendingObject{{Family: nftables.TableFamilyIPv4, Table: "nat", Deleted: true}},
+		Chains: []nftableslib.PendingObject{{Family: nftables.TableFamilyIPv4, Table: "filter", Chain: "output", Deleted: true}},
+	})
+	if err := m.Flush(); err != nil {
+		t.Fatalf("failed to flush with error: %+v", err)
+	}
+	pending(&nftableslib.PendingObjects{})
+	if ti.Exist("nat", nftables.TableFamilyIPv4) || ci.Chains().Exist("output") {
+		t.Fatalf("expected deleted objects not to exist after flush")
+	}
+
+	// Creation and deletion queued in the same batch cancel each other
+	if err := ti.Create("raw", nftables.TableFamilyIPv4); err != nil {
+		t.Fatalf("failed to create table raw with error: %+v", err)
+	}
+	if err := ti.DeleteImm("raw", nftables.TableFamilyIPv4); err != nil {
+		t.Fatalf("failed to delete table raw with error: %+v", err)
+	}
+	if ti.Exist("raw", nftables.TableFamilyIPv4) {
+		t.Fatalf("expected table raw not to exist")
+	}
+	pending(&nftableslib.PendingObjects{})
+}
@@ -0,0 +1,117 @@
+package mock
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/sbezverk/nftableslib"
+	"golang.org/x/sys/unix"
+)
+
+func TestPolicer(t *testing.T) {
+	m := InitMockConn()
+	m.AddLink("eth0")
+	p, err := nftableslib.NewPolicer(m.ti, "edge", "eth0")
+	if err != nil {
+		t.Fatalf("failed to create policer with error: %+v", err)
+	}
+	table := &nftables.Table{Name: "edge", Family: nftables.TableFamilyNetdev}
+	chain := &nftables.Chain{Name: nftableslib.PolicerChainName("eth0"), Table: table}
+	devices, err := m.ChainDevices(chain)
+	if err != nil || !reflect.DeepEqual(devices, []string{"eth0"}) {
+		t.Fatalf("expected chain %s bound to eth0, got %v error: %+v", chain.Name, devices, err)
+	}
+	getRule := func() *nftables.Rule {
+		t.Helper()
+		rules, err := m.GetRule(table, chain)
+		if err != nil {
+			t.Fatalf("failed to get rules with error: %+v", err)
+		}
+		if len(rules) != 1 {
+			t.Fatalf("expected 1 rule, got %d", len(rules))
+		}
+		return rules[0]
+	}
+	getLimit := func(r *nftables.Rule) *expr.Limit {
+		t.Helper()
+		for i, e := range r.Exprs {
+			if l, ok := e.(*expr.Limit); ok {
+				if v, ok := r.Exprs[i+1].(*expr.Verdict); !ok || v.Kind != expr.VerdictDrop {
+					t.Fatalf("expected limit to be followed by drop, got %+v", r.Exprs[i+1])
+				}
+				return l
+			}
+		}
+		t.Fatalf("rule does not carry limit expression")
+		return nil
+	}
+	classifier := &nftableslib.Rule{
+		L4: &nftableslib.L4Rule{
+			L4Proto: unix.IPPROTO_UDP,
+			Dst:     &nftableslib.Port{List: []uint16{443}},
+		},
+	}
+	limit, err := nftableslib.ParseLimitRate("100 mbytes/second")
+	if err != nil {
+		t.Fatalf("failed to parse limit rate with error: %+v", err)
+	}
+	if err := p.Police("quic", classifier, limit); err != nil {
+		t.Fatalf("failed to police class quic with error: %+v", err)
+	}
+	rule := getRule()
+	want := &expr.Limit{Type: expr.LimitTypePktBytes, Rate: 100 * nftableslib.MBytes, Over: true, Unit: expr.LimitTimeSecond}
+	if l := getLimit(rule); !reflect.DeepEqual(l, want) {
+		t.Fatalf("expected limit %+v, got %+v", *want, *l)
+	}
+	if !bytes.HasPrefix(rule.UserData, []byte("policer:quic")) {
+		t.Fatalf("expected rule to be tagged with class quic, got %q", rule.UserData)
+	}
+
+	// Re-applying the same class must not program anything, a flushed batch would fail
+	m.FailAt(0, unix.EINVAL)
+	if err := p.Police("quic", classifier, limit); err != nil {
+		t.Fatalf("re-applying class quic failed with error: %+v", err)
+	}
+	if err := m.Flush(); err != nil {
+		t.Fatalf("failed to flush empty batch with error: %+v", err)
+	}
+	if r := getRule(); r.Handle != rule.Handle {
+		t.Fatalf("expected re-applied class to keep handle %d, got %d", rule.Handle, r.Handle)
+	}
+
+	// Changing the rate replaces the rule keeping its handle
+	if err := p.Police("quic", classifier, nftableslib.LimitBitsPerSecond(400000000)); err != nil {
+		t.Fatalf("failed to update rate of class quic with error: %+v", err)
+	}
+	updated := getRule()
+	if updated.Handle != rule.Handle {
+		t.Fatalf("expected updated class to keep handle %d, got %d", rule.Handle, updated.Handle)
+	}
+	want.Rate = 50000000
+	if l := getLimit(updated); !reflect.DeepEqual(l, want) {
+		t.Fatalf("expected limit %+v, got %+v", *want, *l)
+	}
+
+	// A new policer adopts classes programmed by the previous one
+	p, err = nftableslib.NewPolicer(nftableslib.InitNFTables(m), "edge", "eth0")
+	if err != nil {
+		t.Fatalf("failed to create policer over existing chain with error: %+v", err)
+	}
+	if classes := p.Classes(); !reflect.DeepEqual(classes, []string{"quic"}) {
+		t.Fatalf("expected policer to adopt class quic, got %v", classes)
+	}
+	if err := p.Remove("quic"); err != nil {
+		t.Fatalf("failed to remove class quic with error: %+v", err)
+	}
+	rules, err := m.GetRule(table, chain)
+	if err != nil || len(rules) != 0 {
+		t.Fatalf("expected no rules after removal, got %d error: %+v", len(rules), err)
+	}
+
+	if err := p.Police("bad", &nftableslib.Rule{Action: setActionVerdict(t, nftableslib.NFT_ACCEPT)}, limit); err == nil {
+		t.Fatalf("classifier carrying action supposed to fail")
+	}
+}
@@ -0,0 +1,159 @@
+package mock
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/nftables"
+	"github.com/sbezverk/nftableslib"
+	"golang.org/x/sys/unix"
+)
+
+func TestReadOnly(t *testing.T) {
+	m := InitMockConn()
+	m.AddLink("eth0")
+	table := &nftables.Table{Name: "filter", Family: nftables.TableFamilyIPv4}
+	if err := m.ti.Tables().CreateImm(table.Name, table.Family); err != nil {
+		t.Fatalf("failed to create table with error: %+v", err)
+	}
+	ci, _ := m.ti.Tables().TableChains(table.Name, table.Family)
+	for _, name := range []string{"input", "app"} {
+		if err := ci.Chains().CreateImm(name, nil); err != nil {
+			t.Fatalf("failed to create chain %s with error: %+v", name, err)
+		}
+	}
+	ri, _ := ci.Chains().Chain("input")
+	for _, action := range []*nftableslib.RuleAction{setActionVerdict(t, nftableslib.NFT_ACCEPT), setActionVerdict(t, unix.NFT_JUMP, "app")} {
+		if _, err := ri.Rules().CreateImm(&nftableslib.Rule{Action: action}); err != nil {
+			t.Fatalf("failed to create rule with error: %+v", err)
+		}
+	}
+	si, _ := m.ti.Tables().TableSets(table.Name, table.Family)
+	element := nftables.SetElement{Key: []byte{192, 0, 2, 1}}
+	if _, err := si.Sets().CreateSet(&nftableslib.SetAttributes{Name: "blocked", KeyType: nftables.TypeIPAddr}, []nftables.SetElement{element}); err != nil {
+		t.Fatalf("failed to create set with error: %+v", err)
+	}
+	m.AddObject(table, &nftableslib.Object{Kind: nftableslib.ObjectCounter, Name: "hits", Counter: &nftableslib.CounterState{Packets: 1}})
+	if err := m.Flush(); err != nil {
+		t.Fatalf("failed to add object with error: %+v", err)
+	}
+	gen, _ := m.GetGenID()
+
+	ro := nftableslib.InitNFTables(m, nftableslib.ReadOnly())
+	if _, err := ro.Tables().Sync(table.Family); err != nil {
+		t.Fatalf("failed to sync tables with error: %+v", err)
+	}
+	roc, err := ro.Tables().TableChains(table.Name, table.Family)
+	if err != nil {
+		t.Fatalf("failed to get chains with error: %+v", err)
+	}
+	rori, err := roc.Chains().Chain("input")
+	if err != nil {
+		t.Fatalf("failed to get rules with error: %+v", err)
+	}
+	ros, _ := ro.Tables().TableSets(table.Name, table.Family)
+	roo, _ := ro.Tables().TableObjects(table.Name, table.Family)
+	snapshot, err := ro.Tables().Snapshot()
+	if err != nil {
+		t.Fatalf("failed to take snapshot with error: %+v", err)
+	}
+	dump, err := ros.Sets().DumpSet("blocked")
+	if err != nil {
+		t.Fatalf("failed to dump set with error: %+v", err)
+	}
+	rule := &nftableslib.Rule{Action: setActionVerdict(t, nftableslib.NFT_DROP)}
+	elements := []nftables.SetElement{{Key: []byte{192, 0, 2, 2}}}
+	tests := []struct {
+		name string
+		call func() error
+	}{
+		{name: "Tables Create", call: func() error { return ro.Tables().Create("nat", table.Family) }},
+		{name: "Tables CreateImm", call: func() error { return ro.Tables().CreateImm("nat", table.Family) }},
+		{name: "Tables Delete", call: func() error { return ro.Tables().Delete(table.Name, table.Family) }},
+		{name: "Tables DeleteImm", call: func() error { return ro.Tables().DeleteImm(table.Name, table.Family) }},
+		{name: "Tables Rollback", call: func() error { return ro.Tables().Rollback(snapshot) }},
+		{name: "Tables Restore", call: func() error { return ro.Tables().Restore(snapshot, nil) }},
+		{name: "Tables ConfirmOrRollback", call: func() error {
+			return ro.Tables().ConfirmOrRollback(func() error { return nil }, time.Second, func() bool { return true })
+		}},
+		{name: "Tables Commit", call: func() error { return ro.Tables().Commit() }},
+		{name: "Tables ApplyRuleset", call: func() error { return ro.Tables().ApplyRuleset(&nftableslib.RulesetSpec{}) }},
+		{name: "Chains Create", call: func() error { return roc.Chains().Create("output", nil) }},
+		{name: "Chains CreateImm", call: func() error { return roc.Chains().CreateImm("output", nil) }},
+		{name: "Chains Delete", call: func() error { return roc.Chains().Delete("input") }},
+		{name: "Chains DeleteImm", call: func() error { return roc.Chains().DeleteImm("input") }},
+		{name: "Chains DeleteSafe", call: func() error { return roc.Chains().DeleteSafe("input", true) }},
+		{name: "Chains UpdateDevices", call: func() error { return roc.Chains().UpdateDevices("input", []string{"eth0"}) }},
+		{name: "Chains CopyRules", call: func() error { return roc.Chains().CopyRules("input", rori, nil) }},
+		{name: "Rules Create", call: func() error { _, err := rori.Rules().Create(rule); return err }},
+		{name: "Rules CreateImm", call: func() error { _, err := rori.Rules().CreateImm(rule); return err }},
+		{name: "Rules Delete", call: func() error { return rori.Rules().Delete(1) }},
+		{name: "Rules DeleteImm", call: func() error { return rori.Rules().DeleteImm(1) }},
+		{name: "Rules Insert", call: func() error { _, err := rori.Rules().Insert(rule); return err }},
+		{name: "Rules InsertImm", call: func() error { _, err := rori.Rules().InsertImm(rule); return err }},
+		{name: "Rules Update", call: func() error { return rori.Rules().Update(rule, 1) }},
+		{name: "Rules SetTail", call: func() error { _, err := rori.Rules().SetTail(rule); return err }},
+		{name: "Rules RemoveTail", call: func() error { return rori.Rules().RemoveTail() }},
+		{name: "Sets CreateSet", call: func() error {
+			_, err := ros.Sets().CreateSet(&nftableslib.SetAttributes{Name: "allowed", KeyType: nftables.TypeIPAddr}, nil)
+			return err
+		}},
+		{name: "Sets DelSet", call: func() error { return ros.Sets().DelSet("blocked") }},
+		{name: "Sets SetAddElements", call: func() error { return ros.Sets().SetAddElements("blocked", elements) }},
+		{name: "Sets SetDelElements", call: func() error {
+			return ros.Sets().SetDelElements("blocked", []nftables.SetElement{element})
+		}},
+		{name: "Sets SetReplaceElements", call: func() error { return ros.Sets().SetReplaceElements("blocked", elements) }},
+		{name: "Sets SetAddElementsBatch", call: func() error { return ros.Sets().SetAddElementsBatch("blocked", elements) }},
+		{name: "Sets SetDelElementsBatch", call: func() error {
+			return ros.Sets().SetDelElementsBatch("blocked", []nftables.SetElement{element})
+		}},
+		{name: "Sets DeleteUnbound", call: func() error { _, err := ros.Sets().DeleteUnbound(); return err }},
+		{name: "Sets RestoreSet", call: func() error { _, err := ros.Sets().RestoreSet(dump); return err }},
+		{name: "Objects Delete", call: func() error { return roo.Objects().Delete(nftableslib.ObjectCounter, "hits") }},
+		{name: "Objects ResetCounter", call: func() error { _, err := roo.Objects().ResetCounter("hits"); return err }},
+		{name: "Objects ResetQuota", call: func() error { _, err := roo.Objects().ResetQuota("quota"); return err }},
+		{name: "Objects ReadAndResetAll", call: func() error { _, err := roo.Objects().ReadAndResetAll(""); return err }},
+	}
+	for _, tt := range tests {
+		if err := tt.call(); !errors.Is(err, nftableslib.ErrReadOnly) {
+			t.Errorf("Test \"%s\" failed, expected ErrReadOnly, got error: %+v", tt.name, err)
+		}
+		if len(m.pending) != 0 {
+			t.Fatalf("Test \"%s\" failed, %d operations were queued", tt.name, len(m.pending))
+		}
+	}
+	// Rules removed by the library directly are refused by the connection
+	err = nftableslib.RemoveDispatch(ro, table.Name, table.Family, "input", "app", false)
+	if err == nil || !strings.Contains(err.Error(), nftableslib.ErrReadOnly.Error()) || len(m.pending) != 0 {
+		t.Fatalf("expected removal of dispatch rule to be refused, got error: %+v", err)
+	}
+	if g, _ := m.GetGenID(); g != gen {
+		t.Fatalf("ruleset was changed, generation %d, expected %d", g, gen)
+	}
+
+	// Reads are not affected
+	if names, err := roc.Chains().Get(); err != nil || len(names) != 2 {
+		t.Fatalf("expected 2 chains, got %v error: %+v", names, err)
+	}
+	if _, err := rori.Rules().Dump(); err != nil {
+		t.Fatalf("failed to dump rules with error: %+v", err)
+	}
+	if e, err := ros.Sets().GetSetElements("blocked"); err != nil || len(e) != 1 {
+		t.Fatalf("expected 1 element, got %d error: %+v", len(e), err)
+	}
+	if objs, err := roo.Objects().List(); err != nil || len(objs) != 1 {
+		t.Fatalf("expected 1 object, got %d error: %+v", len(objs), err)
+	}
+	if _, err := ro.Tables().AuditRuleset(); err != nil {
+		t.Fatalf("failed to audit ruleset with error: %+v", err)
+	}
+	if g, err := ro.Tables().GetGenID(); err != nil || g != gen {
+		t.Fatalf("expected generation %d, got %d error: %+v", gen, g, err)
+	}
+	if _, err := ro.Tables().Sync(nftables.TableFamilyIPv6); err != nil && !errors.Is(err, unix.ENOENT) {
+		t.Fatalf("failed to sync tables with error: %+v", err)
+	}
+}
@@ -0,0 +1,125 @@
+package mock
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/sbezverk/nftableslib"
+	"golang.org/x/sys/unix"
+)
+
+func TestFindReferences(t *testing.T) {
+	table := &nftables.Table{Name: "filter", Family: nftables.TableFamilyIPv4}
+	m := InitMockConn()
+	if err := m.ti.Tables().CreateImm(table.Name, table.Family); err != nil {
+		t.Fatalf("failed to create table with error: %+v", err)
+	}
+	ci, err := m.ti.Tables().Table(table.Name, table.Family)
+	if err != nil {
+		t.Fatalf("failed to get chains with error: %+v", err)
+	}
+	for _, name := range []string{"input", "app"} {
+		if err := ci.Chains().CreateImm(name, nil); err != nil {
+			t.Fatalf("failed to create chain %s with error: %+v", name, err)
+		}
+	}
+	si, err := m.ti.Tables().TableSets(table.Name, table.Family)
+	if err != nil {
+		t.Fatalf("failed to get sets with error: %+v", err)
+	}
+	allowed, err := si.Sets().CreateSet(&nftableslib.SetAttributes{Name: "allowed", KeyType: nftables.TypeInetService},
+		[]nftables.SetElement{{Key: binaryutil.BigEndian.PutUint16(443)}})
+	if err != nil {
+		t.Fatalf("failed to create set with error: %+v", err)
+	}
+	input, err := ci.Chains().Chain("input")
+	if err != nil {
+		t.Fatalf("failed to get rules with error: %+v", err)
+	}
+	jump, err := input.Rules().CreateImm(&nftableslib.Rule{
+		L4: &nftableslib.L4Rule{
+			L4Proto: unix.IPPROTO_TCP,
+			Dst:     &nftableslib.Port{List: []uint16{80}},
+		},
+		Action: setActionVerdict(t, unix.NFT_JUMP, "app"),
+	})
+	if err != nil {
+		t.Fatalf("failed to create rule with error: %+v", err)
+	}
+	app, err := ci.Chains().Chain("app")
+	if err != nil {
+		t.Fatalf("failed to get rules with error: %+v", err)
+	}
+	lookup, err := app.Rules().CreateImm(&nftableslib.Rule{
+		L4: &nftableslib.L4Rule{
+			L4Proto: unix.IPPROTO_TCP,
+			Dst:     &nftableslib.Port{SetRef: &nftableslib.SetRef{Name: allowed.Name, ID: allowed.ID}},
+		},
+		Action: setActionVerdict(t, nftableslib.NFT_ACCEPT),
+	})
+	if err != nil {
+		t.Fatalf("failed to create rule with error: %+v", err)
+	}
+
+	tests := []struct {
+		name        string
+		kind        nftableslib.ReferenceKind
+		object      string
+		chain       string
+		handle      uint64
+		description string
+	}{
+		{name: "Jump", kind: nftableslib.ReferenceChain, object: "app", chain: "input", handle: jump, description: "jump app"},
+		{name: "Lookup", kind: nftableslib.ReferenceSet, object: "allowed", chain: "app", handle: lookup, description: "lookup @allowed"},
+	}
+	for _, tt := range tests {
+		refs, err := ci.Chains().FindReferences(tt.kind, tt.object)
+		if err != nil {
+			t.Fatalf("Test \"%s\" failed with error: %+v but supposed to succeed", tt.name, err)
+		}
+		if len(refs) != 1 {
+			t.Fatalf("Test \"%s\" expected 1 reference, got %d", tt.name, len(refs))
+		}
+		if refs[0].Chain != tt.chain || refs[0].Handle != tt.handle || refs[0].Description != tt.description {
+			t.Fatalf("Test \"%s\" unexpected reference %+v", tt.name, *refs[0])
+		}
+	}
+	if refs, err := ci.Chains().FindReferences(nftableslib.ReferenceChain, "input"); err != nil || len(refs) != 0 {
+		t.Fatalf("expected no references to chain input, got %d error: %+v", len(refs), err)
+	}
+	if _, err := ci.Chains().FindReferences(nftableslib.ReferenceKind(7), "app"); err == nil {
+		t.Fatalf("unknown reference kind supposed to fail")
+	}
+
+	infos, err := si.Sets().List()
+	if err != nil {
+		t.Fatalf("failed to list sets with error: %+v", err)
+	}
+	for _, info := range infos {
+		if info.Name == allowed.Name && info.Use != 1 {
+			t.Fatalf("expected set %s to be used once, got %d", info.Name, info.Use)
+		}
+	}
+	tables, err := m.ti.Tables().List(nftables.TableFamilyIPv4)
+	if err != nil || len(tables) != 1 || tables[0].Name != table.Name {
+		t.Fatalf("expected table %s to be listed, got %d error: %+v", table.Name, len(tables), err)
+	}
+	chains, err := ci.Chains().List()
+	if err != nil || len(chains) != 2 || chains[0].Name != "app" || chains[1].Name != "input" {
+		t.Fatalf("expected chains app and input to be listed, got %d error: %+v", len(chains), err)
+	}
+	b, err := ci.Chains().Dump()
+	if err != nil {
+		t.Fatalf("failed to dump chains with error: %+v", err)
+	}
+	var chain map[string]interface{}
+	if err := json.NewDecoder(strings.NewReader(string(b))).Decode(&chain); err != nil {
+		t.Fatalf("failed to decode dump with error: %+v", err)
+	}
+	if _, ok := chain["Use"]; !ok {
+		t.Fatalf("dump of chain is missing Use: %s", string(b))
+	}
+}
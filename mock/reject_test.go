@@ -0,0 +1,129 @@
+package mock
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/sbezverk/nftableslib"
+	"golang.org/x/sys/unix"
+)
+
+func TestRejectChain(t *testing.T) {
+	logCounter := func(prefix string) []expr.Any {
+		return []expr.Any{
+			&expr.Log{Key: unix.NFTA_LOG_PREFIX, Data: []byte(prefix)},
+			&expr.Objref{Type: int(nftableslib.ObjectCounter), Name: "violations"},
+		}
+	}
+	tcpReset := []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{unix.IPPROTO_TCP}},
+		&expr.Reject{Type: unix.NFT_REJECT_TCP_RST},
+	}
+	tests := []struct {
+		name   string
+		family nftables.TableFamily
+		attrs  *nftableslib.RejectChainAttributes
+		exprs  [][]expr.Any
+	}{
+		{
+			name:   "inet",
+			family: nftables.TableFamilyINet,
+			attrs:  &nftableslib.RejectChainAttributes{Name: "polite-reject", Prefix: "policy", ID: "ssh-1", Counter: "violations"},
+			exprs: [][]expr.Any{
+				logCounter("policy[ssh-1] "),
+				tcpReset,
+				{&expr.Reject{Type: unix.NFT_REJECT_ICMPX_UNREACH, Code: unix.NFT_REJECT_ICMPX_PORT_UNREACH}},
+			},
+		},
+		{
+			name:   "ipv6",
+			family: nftables.TableFamilyIPv6,
+			attrs:  &nftableslib.RejectChainAttributes{Name: "polite-reject", Prefix: "policy: ", Counter: "violations"},
+			exprs: [][]expr.Any{
+				logCounter("policy: "),
+				tcpReset,
+				{&expr.Reject{Type: unix.NFT_REJECT_ICMP_UNREACH, Code: 4}},
+			},
+		},
+		{
+			name:   "ipv4 forward",
+			family: nftables.TableFamilyIPv4,
+			attrs:  &nftableslib.RejectChainAttributes{Name: "forward-reject", Prefix: "fwd", ID: "7", Counter: "violations", Forward: true},
+			exprs: [][]expr.Any{
+				logCounter("fwd[7] "),
+				{&expr.Reject{Type: unix.NFT_REJECT_ICMP_UNREACH, Code: 13}},
+			},
+		},
+	}
+	for _, tt := range tests {
+		m := InitMockConn()
+		table := &nftables.Table{Name: "filter", Family: tt.family}
+		// Applying the chain again does not change it
+		for i := 0; i < 2; i++ {
+			jump, err := nftableslib.CreateRejectChain(m.ti, table.Name, table.Family, tt.attrs)
+			if err != nil {
+				t.Fatalf("Test \"%s\" failed with error: %+v but supposed to succeed", tt.name, err)
+			}
+			rules, err := m.GetRule(table, &nftables.Chain{Name: tt.attrs.Name, Table: table})
+			if err != nil {
+				t.Fatalf("Test \"%s\" failed to get rules with error: %+v", tt.name, err)
+			}
+			if len(rules) != len(tt.exprs) {
+				t.Fatalf("Test \"%s\" failed, expected %d rules, got %d", tt.name, len(tt.exprs), len(rules))
+			}
+			for j, r := range rules {
+				if !reflect.DeepEqual(r.Exprs, tt.exprs[j]) {
+					t.Fatalf("Test \"%s\" failed, expected expressions %+v of rule %d, got %+v", tt.name, tt.exprs[j], j, r.Exprs)
+				}
+			}
+			// Policy rules jump to the chain by the returned action
+			ci, _ := m.ti.Tables().TableChains(table.Name, table.Family)
+			if !ci.Chains().Exist("input") {
+				if err := ci.Chains().CreateImm("input", nil); err != nil {
+					t.Fatalf("Test \"%s\" failed to create chain with error: %+v", tt.name, err)
+				}
+			}
+			ri, _ := ci.Chains().Chain("input")
+			h, err := ri.Rules().CreateImm(&nftableslib.Rule{
+				L4: &nftableslib.L4Rule{
+					L4Proto: unix.IPPROTO_TCP,
+					Dst:     &nftableslib.Port{List: []uint16{22}},
+				},
+				Action: jump,
+			})
+			if err != nil {
+				t.Fatalf("Test \"%s\" failed to create rule jumping to the chain with error: %+v", tt.name, err)
+			}
+			rules, _ = m.GetRule(table, &nftables.Chain{Name: "input", Table: table})
+			last := rules[len(rules)-1]
+			v, ok := last.Exprs[len(last.Exprs)-1].(*expr.Verdict)
+			if last.Handle != h || !ok || v.Kind != expr.VerdictJump || v.Chain != tt.attrs.Name {
+				t.Fatalf("Test \"%s\" failed, expected the rule to jump to chain %s, got %+v", tt.name, tt.attrs.Name, last.Exprs)
+			}
+		}
+		oi, _ := m.ti.Tables().TableObjects(table.Name, table.Family)
+		if objs, err := oi.Objects().List(); err != nil || len(objs) != 1 || objs[0].Kind != nftableslib.ObjectCounter || objs[0].Name != "violations" {
+			t.Fatalf("Test \"%s\" failed, expected a single counter object, got %+v with error: %+v", tt.name, objs, err)
+		}
+	}
+
+	m := InitMockConn()
+	for _, attrs := range []*nftableslib.RejectChainAttributes{
+		nil,
+		{Prefix: "policy", Counter: "violations"},
+		{Name: "polite-reject", Prefix: "policy"},
+		{Name: "polite-reject", Counter: "violations"},
+		{Name: "polite-reject", Prefix: string(make([]byte, 121)), ID: "long", Counter: "violations"},
+	} {
+		if _, err := nftableslib.CreateRejectChain(m.ti, "filter", nftables.TableFamilyINet, attrs); err == nil {
+			t.Fatalf("creating reject chain with attributes %+v is supposed to fail", attrs)
+		}
+	}
+	attrs := &nftableslib.RejectChainAttributes{Name: "polite-reject", Prefix: "policy", Counter: "violations"}
+	if _, err := nftableslib.CreateRejectChain(m.ti, "filter", nftables.TableFamilyARP, attrs); err == nil {
+		t.Fatalf("creating reject chain in arp table is supposed to fail")
+	}
+}
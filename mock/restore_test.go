@@ -0,0 +1,189 @@
+package mock
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/google/nftables"
+	"github.com/sbezverk/nftableslib"
+	"golang.org/x/sys/unix"
+)
+
+// largeSnapshot returns the snapshot of a ruleset with a large set, rules referring to it,
+// rules carrying constant sets and rules carrying anonymous maps.
+func largeSnapshot(t *testing.T, elements, rules int) *nftableslib.Snapshot {
+	m := InitMockConn()
+	table := &nftables.Table{Name: "filter", Family: nftables.TableFamilyIPv4}
+	if err := m.ti.Tables().CreateImm(table.Name, table.Family); err != nil {
+		t.Fatalf("failed to create table with error: %+v", err)
+	}
+	ci, _ := m.ti.Tables().TableChains(table.Name, table.Family)
+	for _, name := range []string{"input", "app", "backup"} {
+		if err := ci.Chains().CreateImm(name, nil); err != nil {
+			t.Fatalf("failed to create chain %s with error: %+v", name, err)
+		}
+	}
+	si, _ := m.ti.Tables().TableSets(table.Name, table.Family)
+	se := make([]nftables.SetElement, 0, elements)
+	for i := 0; i < elements; i++ {
+		se = append(se, nftables.SetElement{Key: []byte{10, byte(i >> 16), byte(i >> 8), byte(i)}})
+	}
+	blocked, err := si.Sets().CreateSet(&nftableslib.SetAttributes{Name: "blocked", KeyType: nftables.TypeIPAddr}, nil)
+	if err != nil {
+		t.Fatalf("failed to create set with error: %+v", err)
+	}
+	if err := si.Sets().SetAddElementsBatch("blocked", se); err != nil {
+		t.Fatalf("failed to add elements with error: %+v", err)
+	}
+	input, _ := ci.Chains().Chain("input")
+	app, _ := ci.Chains().Chain("app")
+	for i := 0; i < rules; i++ {
+		var rule *nftableslib.Rule
+		switch i % 4 {
+		case 0:
+			rule = &nftableslib.Rule{
+				L3: &nftableslib.L3Rule{Src: &nftableslib.IPAddrSpec{
+					SetRef: &nftableslib.SetRef{Name: blocked.Name, ID: blocked.ID},
+				}},
+				Action: setActionVerdict(t, nftableslib.NFT_DROP),
+			}
+		case 1:
+			// Addresses of the list are matched by a constant set
+			rule = &nftableslib.Rule{
+				L3: &nftableslib.L3Rule{Dst: &nftableslib.IPAddrSpec{List: []*nftableslib.IPAddr{
+					setIPAddr(t, fmt.Sprintf("192.0.2.%d", i%250)), setIPAddr(t, "198.51.100.1"),
+				}}},
+				Action: setActionVerdict(t, nftableslib.NFT_ACCEPT),
+			}
+		case 2:
+			rule = &nftableslib.Rule{Action: setActionVerdict(t, unix.NFT_JUMP, "app")}
+		default:
+			// Chains are selected by an anonymous map
+			action, err := nftableslib.SetLoadbalance([]string{"app", "backup"}, unix.NFT_GOTO, unix.NFT_NG_INCREMENTAL)
+			if err != nil {
+				t.Fatalf("failed to set loadbalance with error: %+v", err)
+			}
+			rule = &nftableslib.Rule{Action: action}
+		}
+		if _, err := input.Rules().Create(rule); err != nil {
+			t.Fatalf("failed to create rule with error: %+v", err)
+		}
+		if _, err := app.Rules().Create(&nftableslib.Rule{Action: setActionVerdict(t, unix.NFT_RETURN)}); err != nil {
+			t.Fatalf("failed to create rule with error: %+v", err)
+		}
+	}
+	if err := m.Flush(); err != nil {
+		t.Fatalf("failed to program rules with error: %+v", err)
+	}
+	s, err := m.ti.Tables().Snapshot()
+	if err != nil {
+		t.Fatalf("failed to take snapshot with error: %+v", err)
+	}
+
+	return s
+}
+
+// checkRestored checks that the ruleset of the mock matches the ruleset of largeSnapshot
+func checkRestored(t *testing.T, name string, m *Mock, elements, rules int) {
+	table := &nftables.Table{Name: "filter", Family: nftables.TableFamilyIPv4}
+	for _, chain := range []string{"input", "app"} {
+		r, err := m.GetRule(table, &nftables.Chain{Name: chain, Table: table})
+		if err != nil || len(r) != rules {
+			t.Fatalf("Test \"%s\" failed, expected %d rules in chain %s, got %d error: %+v", name, rules, chain, len(r), err)
+		}
+	}
+	sets, err := m.GetSets(table)
+	if err != nil {
+		t.Fatalf("Test \"%s\" failed to get sets with error: %+v", name, err)
+	}
+	// Named set, a constant set of every rule matching a list of addresses and an anonymous map
+	// of every rule balancing the load
+	if len(sets) != 1+rules/2 {
+		t.Fatalf("Test \"%s\" failed, expected %d sets, got %d", name, 1+rules/2, len(sets))
+	}
+	blocked, err := m.GetSetByName(table, "blocked")
+	if err != nil {
+		t.Fatalf("Test \"%s\" failed to get set with error: %+v", name, err)
+	}
+	if e, err := m.GetSetElements(blocked); err != nil || len(e) != elements {
+		t.Fatalf("Test \"%s\" failed, expected %d elements, got %d error: %+v", name, elements, len(e), err)
+	}
+}
+
+func TestRestore(t *testing.T) {
+	elements, rules := 5000, 300
+	s := largeSnapshot(t, elements, rules)
+	limit := 64
+
+	// A single transaction exceeds the limit of the batch
+	m := InitMockConn()
+	m.SetBatchLimit(limit)
+	if err := m.ti.Tables().Rollback(s); !errors.Is(err, unix.EMSGSIZE) {
+		t.Fatalf("expected rollback to exceed the limit of the batch, got error: %+v", err)
+	}
+
+	tests := []struct {
+		name string
+		// fail is the index of the chunk which fails, counted from the end if negative, 0 if no chunk fails
+		fail int
+		// resume is the checkpoint the restore is resumed from relative to the failed chunk
+		resume int
+	}{
+		{name: "restore"},
+		{name: "resume at failed elements chunk", fail: 10},
+		{name: "resume at failed rules chunk", fail: -2},
+		// Chunks programmed before the failure are applied again
+		{name: "resume before failed rules chunk", fail: -2, resume: -3},
+	}
+	for _, tt := range tests {
+		m := InitMockConn()
+		m.SetBatchLimit(limit)
+		opts := &nftableslib.RestoreOptions{MaxMessages: limit, ChunkSize: 10}
+		progress := make([]nftableslib.RestoreProgress, 0)
+		fail := tt.fail
+		opts.Progress = func(p nftableslib.RestoreProgress) {
+			progress = append(progress, p)
+			if fail < 0 {
+				fail += p.Chunks
+			}
+			// The batch of the next chunk fails once
+			if p.Chunk+1 == fail && !p.Skipped && len(progress) == fail {
+				m.FailAt(0, unix.ENOMEM)
+			}
+		}
+		err := m.ti.Tables().Restore(s, opts)
+		if tt.fail != 0 {
+			var ie *nftableslib.ErrRestoreIncomplete
+			if !errors.As(err, &ie) || ie.Checkpoint != fail {
+				t.Fatalf("Test \"%s\" failed, expected restore to fail at chunk %d, got error: %+v", tt.name, fail, err)
+			}
+			opts.Checkpoint = ie.Checkpoint + tt.resume
+			err = m.ti.Tables().Restore(s, opts)
+		}
+		if err != nil {
+			t.Fatalf("Test \"%s\" failed with error: %+v but supposed to succeed", tt.name, err)
+		}
+		checkRestored(t, tt.name, m, elements, rules)
+		stage, skipped := nftableslib.RestoreTables, 0
+		for _, p := range progress {
+			if p.Stage < stage {
+				t.Fatalf("Test \"%s\" failed, chunk %d of %s follows %s", tt.name, p.Chunk, p.Stage, stage)
+			}
+			stage = p.Stage
+			if p.Skipped {
+				skipped++
+			}
+		}
+		if last := progress[len(progress)-1]; last.Chunk != last.Chunks-1 || last.Stage != nftableslib.RestoreRules {
+			t.Fatalf("Test \"%s\" failed, restore ended at chunk %d of %d of %s", tt.name, last.Chunk, last.Chunks, last.Stage)
+		}
+		if skipped != -tt.resume {
+			t.Fatalf("Test \"%s\" failed, expected %d chunks skipped, got %d", tt.name, -tt.resume, skipped)
+		}
+		// The store is synchronized with the restored ruleset
+		if _, err := m.ti.Tables().TableSets("filter", nftables.TableFamilyIPv4); err != nil {
+			t.Fatalf("Test \"%s\" failed to get sets with error: %+v", tt.name, err)
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package mock
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/sbezverk/nftableslib"
+	"golang.org/x/sys/unix"
+)
+
+// ruleReadConn counts reads of rules of chains
+type ruleReadConn struct {
+	*Mock
+	reads int
+}
+
+func (r *ruleReadConn) GetRule(t *nftables.Table, c *nftables.Chain) ([]*nftables.Rule, error) {
+	r.reads++
+	return r.Mock.GetRule(t, c)
+}
+
+func TestDumpWithCounters(t *testing.T) {
+	m := InitMockConn()
+	conn := &ruleReadConn{Mock: m}
+	ti := nftableslib.InitNFTables(conn, nftableslib.WithIDGenerator(nftableslib.NewSequentialIDGenerator())).Tables()
+	table := &nftables.Table{Name: "filter", Family: nftables.TableFamilyIPv4}
+	if err := ti.CreateImm(table.Name, table.Family); err != nil {
+		t.Fatalf("failed to create table with error: %+v", err)
+	}
+	// The counter object counted packets before the dump
+	m.AddObject(table, &nftableslib.Object{Kind: nftableslib.ObjectCounter, Name: "web", Counter: &nftableslib.CounterState{Packets: 3, Bytes: 180}})
+	if err := m.Flush(); err != nil {
+		t.Fatalf("failed to create counter object with error: %+v", err)
+	}
+	ci, _ := ti.TableChains(table.Name, table.Family)
+	for _, name := range []string{"input", "output"} {
+		if err := ci.Chains().CreateImm(name, nil); err != nil {
+			t.Fatalf("failed to create chain %s with error: %+v", name, err)
+		}
+	}
+	ri, _ := ci.Chains().Chain("input")
+	accept := setActionVerdict(t, nftableslib.NFT_ACCEPT)
+	rules := []*nftableslib.Rule{
+		{
+			L4:       &nftableslib.L4Rule{L4Proto: unix.IPPROTO_TCP, Dst: &nftableslib.Port{List: []uint16{22}}},
+			Counter:  &nftableslib.Counter{},
+			Action:   accept,
+			UserData: nftableslib.MakeRuleComment("ssh"),
+		},
+		{
+			L4:       &nftableslib.L4Rule{L4Proto: unix.IPPROTO_TCP, Dst: &nftableslib.Port{List: []uint16{80}}},
+			RawExprs: []expr.Any{&expr.Objref{Type: int(nftableslib.ObjectCounter), Name: "web"}},
+			Action:   accept,
+			UserData: nftableslib.MakeRuleComment("web"),
+		},
+		{
+			L4:     &nftableslib.L4Rule{L4Proto: unix.IPPROTO_UDP, Dst: &nftableslib.Port{List: []uint16{53}}},
+			Action: accept,
+		},
+	}
+	handles := make([]uint64, 0, len(rules))
+	for _, r := range rules {
+		h, err := ri.Rules().CreateImm(r)
+		if err != nil {
+			t.Fatalf("failed to create rule with error: %+v", err)
+		}
+		handles = append(handles, h)
+	}
+	// Packets hit the inline counter of the ssh rule
+	programmed, err := m.GetRule(table, &nftables.Chain{Name: "input", Table: table})
+	if err != nil {
+		t.Fatalf("failed to get rules with error: %+v", err)
+	}
+	for _, r := range programmed {
+		for _, e := range r.Exprs {
+			if c, ok := e.(*expr.Counter); ok {
+				c.Packets, c.Bytes = 10, 1500
+			}
+		}
+	}
+	want := map[uint64][]*nftableslib.RuleCounter{
+		handles[0]: {{Packets: 10, Bytes: 1500}},
+		handles[1]: {{Name: "web", Packets: 3, Bytes: 180}},
+	}
+
+	conn.reads = 0
+	b, err := ci.Chains().DumpWithCounters()
+	if err != nil {
+		t.Fatalf("failed to dump chains with error: %+v", err)
+	}
+	// Rules are read once per chain with rules
+	if conn.reads != 1 {
+		t.Fatalf("expected rules to be read once, got %d reads", conn.reads)
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	got := make(map[uint64][]*nftableslib.RuleCounter)
+	for dec.More() {
+		var c struct {
+			Name  string
+			Rules []*nftableslib.RuleSummary
+		}
+		if err := dec.Decode(&c); err != nil {
+			t.Fatalf("failed to decode dump with error: %+v", err)
+		}
+		for _, r := range c.Rules {
+			if r.Counters != nil {
+				got[r.Handle] = r.Counters
+			}
+		}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("dump carries counters %+v, expected %+v", got, want)
+	}
+	if b, err := ci.Chains().Dump(); err != nil || strings.Contains(string(b), `"counters"`) {
+		t.Fatalf("dump without counters is not supposed to carry counters, error: %+v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := ci.Chains().StreamWithCounters(&buf); err != nil {
+		t.Fatalf("failed to stream counters with error: %+v", err)
+	}
+	lines := strings.Split(buf.String(), "\n")
+	if len(lines) != 3 || lines[2] != "" {
+		t.Fatalf("expected 2 newline terminated objects, got %q", buf.String())
+	}
+	expected := []*nftableslib.RuleCounters{
+		{Family: table.Family, Table: "filter", Chain: "input", Handle: handles[0], Comment: "ssh", Counters: want[handles[0]]},
+		{Family: table.Family, Table: "filter", Chain: "input", Handle: handles[1], Comment: "web", Counters: want[handles[1]]},
+	}
+	for i, line := range lines[:2] {
+		if !json.Valid([]byte(line)) {
+			t.Fatalf("line %d is not well-formed json: %s", i, line)
+		}
+		var rc nftableslib.RuleCounters
+		if err := json.Unmarshal([]byte(line), &rc); err != nil {
+			t.Fatalf("failed to decode line %d with error: %+v", i, err)
+		}
+		if !reflect.DeepEqual(&rc, expected[i]) {
+			t.Fatalf("line %d carries %+v, expected %+v", i, rc, *expected[i])
+		}
+	}
+
+	// Rules created by Create and flushed are joined with their counters by handles resolved from the host
+	oi, _ := ci.Chains().Chain("output")
+	if _, err := oi.Rules().Create(&nftableslib.Rule{
+		L4:       &nftableslib.L4Rule{L4Proto: unix.IPPROTO_UDP, Dst: &nftableslib.Port{List: []uint16{53}}},
+		Counter:  &nftableslib.Counter{},
+		Action:   accept,
+		UserData: nftableslib.MakeRuleComment("dns"),
+	}); err != nil {
+		t.Fatalf("failed to queue rule with error: %+v", err)
+	}
+	if err := m.Flush(); err != nil {
+		t.Fatalf("failed to flush rule with error: %+v", err)
+	}
+	programmed, err = m.GetRule(table, &nftables.Chain{Name: "output", Table: table})
+	if err != nil || len(programmed) != 1 {
+		t.Fatalf("expected 1 rule in chain output, got %d with error: %+v", len(programmed), err)
+	}
+	for _, e := range programmed[0].Exprs {
+		if c, ok := e.(*expr.Counter); ok {
+			c.Packets, c.Bytes = 4, 240
+		}
+	}
+	dns := programmed[0].Handle
+	want[dns] = []*nftableslib.RuleCounter{{Packets: 4, Bytes: 240}}
+	if b, err = ci.Chains().DumpWithCounters(); err != nil {
+		t.Fatalf("failed to dump chains with error: %+v", err)
+	}
+	dec = json.NewDecoder(bytes.NewReader(b))
+	got = make(map[uint64][]*nftableslib.RuleCounter)
+	for dec.More() {
+		var c struct {
+			Name  string
+			Rules []*nftableslib.RuleSummary
+		}
+		if err := dec.Decode(&c); err != nil {
+			t.Fatalf("failed to decode dump with error: %+v", err)
+		}
+		for _, r := range c.Rules {
+			if r.Handle == 0 {
+				t.Fatalf("rule of chain %s is dumped without handle", c.Name)
+			}
+			if r.Counters != nil {
+				got[r.Handle] = r.Counters
+			}
+		}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("dump carries counters %+v, expected %+v", got, want)
+	}
+	buf.Reset()
+	if err := ci.Chains().StreamWithCounters(&buf); err != nil {
+		t.Fatalf("failed to stream counters with error: %+v", err)
+	}
+	lines = strings.Split(buf.String(), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("expected 3 newline terminated objects, got %q", buf.String())
+	}
+	var rc nftableslib.RuleCounters
+	if err := json.Unmarshal([]byte(lines[2]), &rc); err != nil {
+		t.Fatalf("failed to decode line 2 with error: %+v", err)
+	}
+	if e := (&nftableslib.RuleCounters{Family: table.Family, Table: "filter", Chain: "output", Handle: dns, Comment: "dns", Counters: want[dns]}); !reflect.DeepEqual(&rc, e) {
+		t.Fatalf("line 2 carries %+v, expected %+v", rc, *e)
+	}
+}
@@ -0,0 +1,158 @@
+package mock
+
+import (
+	"encoding/binary"
+	"reflect"
+	"testing"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/sbezverk/nftableslib"
+	"golang.org/x/sys/unix"
+)
+
+func TestRuleGroups(t *testing.T) {
+	m := InitMockConn()
+	if err := m.ti.Tables().CreateImm("filter-v4", nftables.TableFamilyIPv4); err != nil {
+		t.Fatalf("failed to create table filter-v4 with error: %+v", err)
+	}
+	ci, _ := m.ti.Tables().Table("filter-v4", nftables.TableFamilyIPv4)
+	if err := ci.Chains().CreateImm("input", nil); err != nil {
+		t.Fatalf("failed to create chain input with error: %+v", err)
+	}
+	ri, _ := ci.Chains().Chain("input")
+	// Rules are told apart by the destination port they match
+	rule := func(port int) *nftableslib.Rule {
+		accept, _ := nftableslib.SetVerdict(nftableslib.NFT_ACCEPT)
+		return &nftableslib.Rule{
+			L4: &nftableslib.L4Rule{
+				L4Proto: unix.IPPROTO_TCP,
+				Dst:     &nftableslib.Port{List: []uint16{uint16(port)}},
+			},
+			Action: accept,
+		}
+	}
+	rules := func(ports ...int) []*nftableslib.Rule {
+		rr := make([]*nftableslib.Rule, 0, len(ports))
+		for _, p := range ports {
+			rr = append(rr, rule(p))
+		}
+		return rr
+	}
+	groups := nftableslib.NewRuleGroups(ri)
+	// Groups are declared out of order
+	defaults, err := groups.Group("defaults", 300)
+	if err != nil {
+		t.Fatalf("failed to declare group defaults with error: %+v", err)
+	}
+	tenants, _ := groups.Group("tenants", 200)
+	admin, _ := groups.Group("admin", 100)
+	if _, err := groups.Group("admin", 50); err == nil {
+		t.Fatalf("redeclaring group admin with a different priority supposed to fail")
+	}
+	if g, err := groups.Group("admin", 100); err != nil || g != admin {
+		t.Fatalf("redeclaring group admin supposed to return the declared group, got %v with error: %+v", g, err)
+	}
+
+	steps := []struct {
+		name  string
+		apply func() error
+	}{
+		{
+			name: "Defaults into empty chain",
+			apply: func() error {
+				return defaults.Replace(rules(3000, 3001))
+			},
+		},
+		{
+			name: "Tenants before defaults",
+			apply: func() error {
+				_, err := tenants.Create(rule(2000))
+				return err
+			},
+		},
+		{
+			name: "Admin before tenants",
+			apply: func() error {
+				return admin.Replace(rules(1000))
+			},
+		},
+		{
+			name: "Append to tenants",
+			apply: func() error {
+				_, err := tenants.Create(rule(2001))
+				return err
+			},
+		},
+		{
+			name: "Re-render defaults",
+			apply: func() error {
+				return defaults.Replace(rules(3002, 3003, 3004))
+			},
+		},
+		{
+			name: "Re-render admin",
+			apply: func() error {
+				return admin.Replace(rules(1001, 1002))
+			},
+		},
+		{
+			name: "Re-render tenants",
+			apply: func() error {
+				return tenants.Replace(rules(2002, 2003))
+			},
+		},
+		{
+			name: "Empty admin",
+			apply: func() error {
+				return admin.Replace(nil)
+			},
+		},
+		{
+			name: "Admin into the chain head",
+			apply: func() error {
+				_, err := admin.Create(rule(1003))
+				return err
+			},
+		},
+		{
+			name: "Delete from tenants",
+			apply: func() error {
+				return tenants.Delete(tenants.Handles()[0])
+			},
+		},
+	}
+	for _, s := range steps {
+		if err := s.apply(); err != nil {
+			t.Fatalf("step \"%s\" failed with error: %+v", s.name, err)
+		}
+	}
+
+	programmed, err := m.GetRule(&nftables.Table{Name: "filter-v4", Family: nftables.TableFamilyIPv4}, &nftables.Chain{Name: "input"})
+	if err != nil {
+		t.Fatalf("failed to get rules of chain input with error: %+v", err)
+	}
+	ports := make([]uint16, 0, len(programmed))
+	handles := make([]uint64, 0, len(programmed))
+	for _, r := range programmed {
+		for _, e := range r.Exprs {
+			if c, ok := e.(*expr.Cmp); ok && len(c.Data) == 2 {
+				ports = append(ports, binary.BigEndian.Uint16(c.Data))
+			}
+		}
+		handles = append(handles, r.Handle)
+	}
+	if want := []uint16{1003, 2003, 3002, 3003, 3004}; !reflect.DeepEqual(ports, want) {
+		t.Fatalf("expected rules matching ports %v, got %v", want, ports)
+	}
+	want := append(admin.Handles(), append(tenants.Handles(), defaults.Handles()...)...)
+	if !reflect.DeepEqual(handles, want) {
+		t.Fatalf("expected handles %v, got %v", want, handles)
+	}
+	if err := defaults.Delete(admin.Handles()[0]); err == nil {
+		t.Fatalf("deleting rule of other group supposed to fail")
+	}
+	if _, err := defaults.Create(&nftableslib.Rule{Position: int(handles[0])}); err == nil {
+		t.Fatalf("rule with position supposed to fail")
+	}
+}
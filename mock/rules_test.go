@@ -0,0 +1,746 @@
+package mock
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"github.com/sbezverk/nftableslib"
+	"golang.org/x/sys/unix"
+)
+
+func TestConcurrentRulesCreate(t *testing.T) {
+	const (
+		workers = 16
+		rules   = 500
+	)
+	m := InitMockConn()
+	if err := m.ti.Tables().CreateImm("filter-v4", nftables.TableFamilyIPv4); err != nil {
+		t.Fatalf("failed to create table filter-v4 with error: %+v", err)
+	}
+	ci, err := m.ti.Tables().TableChains("filter-v4", nftables.TableFamilyIPv4)
+	if err != nil {
+		t.Fatalf("failed to get chains interface for table filter-v4")
+	}
+	if err := ci.Chains().CreateImm("chain-1", nil); err != nil {
+		t.Fatalf("failed to create chain chain-1 with error: %+v", err)
+	}
+	ri, err := ci.Chains().Chain("chain-1")
+	if err != nil {
+		t.Fatalf("failed to get rules interface for chain chain-1")
+	}
+
+	var wg sync.WaitGroup
+	jobs := make(chan int)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				rule := &nftableslib.Rule{
+					L4: &nftableslib.L4Rule{
+						L4Proto: unix.IPPROTO_TCP,
+						Dst: &nftableslib.Port{
+							List: []uint16{uint16(i + 1000), uint16(i + 2000)},
+						},
+					},
+					Action: setActionVerdict(t, nftableslib.NFT_ACCEPT),
+				}
+				var err error
+				if i%2 == 0 {
+					_, err = ri.Rules().Create(rule)
+				} else {
+					_, err = ri.Rules().CreateImm(rule)
+				}
+				if err != nil {
+					t.Errorf("failed to create rule %d with error: %+v", i, err)
+				}
+			}
+		}()
+	}
+	for i := 0; i < rules; i++ {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	if err := m.Flush(); err != nil {
+		t.Fatalf("failed to flush with error: %+v", err)
+	}
+
+	programmed, err := m.GetRule(&nftables.Table{Name: "filter-v4", Family: nftables.TableFamilyIPv4},
+		&nftables.Chain{Name: "chain-1"})
+	if err != nil {
+		t.Fatalf("failed to get rules with error: %+v", err)
+	}
+	if len(programmed) != rules {
+		t.Fatalf("expected %d rules, got %d", rules, len(programmed))
+	}
+	ids := make(map[uint16]bool)
+	for _, r := range programmed {
+		id := binary.BigEndian.Uint16(r.UserData[len(r.UserData)-2:])
+		if ids[id] {
+			t.Fatalf("rule id %d is duplicated", id)
+		}
+		ids[id] = true
+	}
+	sets, err := m.GetSets(&nftables.Table{Name: "filter-v4", Family: nftables.TableFamilyIPv4})
+	if err != nil {
+		t.Fatalf("failed to get sets with error: %+v", err)
+	}
+	if len(sets) != rules {
+		t.Fatalf("expected %d sets, got %d", rules, len(sets))
+	}
+	names := make(map[string]bool)
+	for _, s := range sets {
+		if names[s.Name] {
+			t.Fatalf("set name %s is duplicated", s.Name)
+		}
+		names[s.Name] = true
+	}
+	setIDs := make(map[uint32]bool)
+	m.Lock()
+	for _, ms := range m.ruleset.sets[tableKey(&nftables.Table{Name: "filter-v4", Family: nftables.TableFamilyIPv4})] {
+		if setIDs[ms.set.ID] {
+			t.Errorf("set id %d is duplicated", ms.set.ID)
+		}
+		setIDs[ms.set.ID] = true
+	}
+	m.Unlock()
+	if _, err := ri.Rules().Dump(); err != nil {
+		t.Fatalf("failed to dump rules with error: %+v", err)
+	}
+}
+
+func TestRuleRawExprs(t *testing.T) {
+	m := InitMockConn()
+	if err := m.ti.Tables().CreateImm("filter-v4", nftables.TableFamilyIPv4); err != nil {
+		t.Fatalf("failed to create table filter-v4 with error: %+v", err)
+	}
+	ci, _ := m.ti.Tables().TableChains("filter-v4", nftables.TableFamilyIPv4)
+	if err := ci.Chains().CreateImm("chain-1", nil); err != nil {
+		t.Fatalf("failed to create chain chain-1 with error: %+v", err)
+	}
+	ri, _ := ci.Chains().Chain("chain-1")
+	numgen := &expr.Numgen{Register: 1, Modulus: 2, Type: unix.NFT_NG_INCREMENTAL}
+	if _, err := ri.Rules().CreateImm(&nftableslib.Rule{
+		L3: &nftableslib.L3Rule{
+			Src: &nftableslib.IPAddrSpec{
+				List: []*nftableslib.IPAddr{setIPAddr(t, "192.0.2.1")},
+			},
+		},
+		RawExprs: []expr.Any{
+			numgen,
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.NativeEndian.PutUint32(0)},
+		},
+		Action: setActionVerdict(t, nftableslib.NFT_ACCEPT),
+	}); err != nil {
+		t.Fatalf("failed to create rule with error: %+v", err)
+	}
+	rules, _ := m.GetRule(&nftables.Table{Name: "filter-v4", Family: nftables.TableFamilyIPv4},
+		&nftables.Chain{Name: "chain-1"})
+	if len(rules) != 1 {
+		t.Fatalf("expected 1 rule, got %d", len(rules))
+	}
+	exprs := rules[0].Exprs
+	// L3 match expressions come first, followed by raw numgen and cmp, followed by the verdict
+	if len(exprs) < 4 {
+		t.Fatalf("expected at least 4 expressions, got %d", len(exprs))
+	}
+	if _, ok := exprs[0].(*expr.Payload); !ok {
+		t.Errorf("expected L3 payload expression first, got %T", exprs[0])
+	}
+	if cmp, ok := exprs[len(exprs)-4].(*expr.Cmp); !ok || net.IP(cmp.Data).String() != "192.0.2.1" {
+		t.Errorf("expected L3 match before raw expressions, got %+v", exprs[len(exprs)-4])
+	}
+	if exprs[len(exprs)-3] != numgen {
+		t.Errorf("expected raw numgen expression after L3 match, got %T", exprs[len(exprs)-3])
+	}
+	if v, ok := exprs[len(exprs)-1].(*expr.Verdict); !ok || v.Kind != expr.VerdictAccept {
+		t.Errorf("expected accept verdict last, got %+v", exprs[len(exprs)-1])
+	}
+	if _, err := ri.Rules().Dump(); err != nil {
+		t.Errorf("failed to dump rule with raw expressions with error: %+v", err)
+	}
+
+	if _, err := ri.Rules().Create(&nftableslib.Rule{
+		RawExprs: []expr.Any{&expr.Verdict{Kind: expr.VerdictDrop}},
+		Action:   setActionVerdict(t, nftableslib.NFT_ACCEPT),
+	}); err == nil {
+		t.Fatalf("expected to fail creating rule with duplicated terminal verdict")
+	}
+}
+
+func TestSingleCIDRRuleWithoutSet(t *testing.T) {
+	m := InitMockConn()
+	if err := m.ti.Tables().CreateImm("filter-v6", nftables.TableFamilyIPv6); err != nil {
+		t.Fatalf("failed to create table filter-v6 with error: %+v", err)
+	}
+	ci, _ := m.ti.Tables().TableChains("filter-v6", nftables.TableFamilyIPv6)
+	if err := ci.Chains().CreateImm("chain-1", nil); err != nil {
+		t.Fatalf("failed to create chain chain-1 with error: %+v", err)
+	}
+	ri, _ := ci.Chains().Chain("chain-1")
+	if _, err := ri.Rules().CreateImm(&nftableslib.Rule{
+		L3: &nftableslib.L3Rule{
+			Src: &nftableslib.IPAddrSpec{
+				List:  []*nftableslib.IPAddr{setIPAddr(t, "2001:db8::/32")},
+				RelOp: nftableslib.NEQ,
+			},
+		},
+		Action: setActionVerdict(t, nftableslib.NFT_ACCEPT),
+	}); err != nil {
+		t.Fatalf("failed to create rule with error: %+v", err)
+	}
+	sets, err := m.GetSets(&nftables.Table{Name: "filter-v6", Family: nftables.TableFamilyIPv6})
+	if err != nil {
+		t.Fatalf("failed to get sets with error: %+v", err)
+	}
+	if len(sets) != 0 {
+		t.Fatalf("expected no sets for a single prefix match, got %d", len(sets))
+	}
+	b, err := ri.Rules().Dump()
+	if err != nil {
+		t.Fatalf("failed to dump rules with error: %+v", err)
+	}
+	if strings.Contains(string(b), "SetName") {
+		t.Fatalf("expected dump of a single prefix match without sets, got %s", string(b))
+	}
+}
+
+func TestDefaultCounters(t *testing.T) {
+	m := InitMockConn()
+	if err := m.ti.Tables().CreateImm("audit", nftables.TableFamilyIPv4, nftableslib.WithDefaultCounters()); err != nil {
+		t.Fatalf("failed to create table audit with error: %+v", err)
+	}
+	if err := m.ti.Tables().CreateImm("plain", nftables.TableFamilyIPv4); err != nil {
+		t.Fatalf("failed to create table plain with error: %+v", err)
+	}
+	ssh := func() *nftableslib.L4Rule {
+		return &nftableslib.L4Rule{
+			L4Proto: unix.IPPROTO_TCP,
+			Dst:     &nftableslib.Port{List: []uint16{22}},
+		}
+	}
+	tests := []struct {
+		name     string
+		table    string
+		rule     *nftableslib.Rule
+		counters int
+	}{
+		{
+			name:     "Table with default counters",
+			table:    "audit",
+			rule:     &nftableslib.Rule{L4: ssh(), Action: setActionVerdict(t, nftableslib.NFT_ACCEPT)},
+			counters: 1,
+		},
+		{
+			name:     "Rule disabling default counter",
+			table:    "audit",
+			rule:     &nftableslib.Rule{L4: ssh(), NoCounter: true, Action: setActionVerdict(t, nftableslib.NFT_ACCEPT)},
+			counters: 0,
+		},
+		{
+			name:     "Rule carrying its own counter",
+			table:    "audit",
+			rule:     &nftableslib.Rule{L4: ssh(), Counter: &nftableslib.Counter{}, Action: setActionVerdict(t, nftableslib.NFT_ACCEPT)},
+			counters: 1,
+		},
+		{
+			name:     "Table without default counters",
+			table:    "plain",
+			rule:     &nftableslib.Rule{L4: ssh(), Action: setActionVerdict(t, nftableslib.NFT_ACCEPT)},
+			counters: 0,
+		},
+	}
+	for i, tt := range tests {
+		ci, _ := m.ti.Tables().Table(tt.table, nftables.TableFamilyIPv4)
+		chain := fmt.Sprintf("chain-%d", i)
+		if err := ci.Chains().CreateImm(chain, nil); err != nil {
+			t.Fatalf("test \"%s\": failed to create chain with error: %+v", tt.name, err)
+		}
+		ri, _ := ci.Chains().Chain(chain)
+		if _, err := ri.Rules().CreateImm(tt.rule); err != nil {
+			t.Fatalf("test \"%s\": failed to create rule with error: %+v", tt.name, err)
+		}
+		rules, err := m.GetRule(&nftables.Table{Name: tt.table, Family: nftables.TableFamilyIPv4}, &nftables.Chain{Name: chain})
+		if err != nil || len(rules) != 1 {
+			t.Fatalf("test \"%s\": expected 1 rule, got %d error: %+v", tt.name, len(rules), err)
+		}
+		counters := 0
+		exprs := rules[0].Exprs
+		for _, e := range exprs {
+			if _, ok := e.(*expr.Counter); ok {
+				counters++
+			}
+		}
+		if counters != tt.counters {
+			t.Errorf("test \"%s\": expected %d counters, got %d", tt.name, tt.counters, counters)
+			continue
+		}
+		if tt.counters == 1 && tt.rule.Counter == nil {
+			// The default counter goes right before the action
+			if _, ok := exprs[len(exprs)-2].(*expr.Counter); !ok {
+				t.Errorf("test \"%s\": expected counter before the action, got %+v", tt.name, exprs)
+			}
+		}
+		b, err := ri.Rules().Dump()
+		if err != nil {
+			t.Fatalf("test \"%s\": failed to dump rules with error: %+v", tt.name, err)
+		}
+		if got := strings.Count(string(b), "expr.Counter"); got != tt.counters {
+			t.Errorf("test \"%s\": expected dump to carry %d counters, got %d: %s", tt.name, tt.counters, got, string(b))
+		}
+	}
+}
+
+func TestInetMixedFamilies(t *testing.T) {
+	m := InitMockConn()
+	if err := m.ti.Tables().CreateImm("filter", nftables.TableFamilyINet); err != nil {
+		t.Fatalf("failed to create table filter with error: %+v", err)
+	}
+	ci, _ := m.ti.Tables().Table("filter", nftables.TableFamilyINet)
+	if err := ci.Chains().CreateImm("input", nil); err != nil {
+		t.Fatalf("failed to create chain input with error: %+v", err)
+	}
+	ri, _ := ci.Chains().Chain("input")
+	list := make([]*nftableslib.IPAddr, 0)
+	for _, a := range []string{"10.0.0.0/8", "2001:db8::/32", "192.168.1.1", "fd00::1"} {
+		ip, err := nftableslib.NewIPAddr(a)
+		if err != nil {
+			t.Fatalf("failed to parse address %s with error: %+v", a, err)
+		}
+		list = append(list, ip)
+	}
+	handle, err := ri.Rules().CreateImm(&nftableslib.Rule{
+		L3:     &nftableslib.L3Rule{Src: &nftableslib.IPAddrSpec{List: list}},
+		Action: setActionVerdict(t, nftableslib.NFT_DROP),
+	})
+	if err != nil {
+		t.Fatalf("failed to create rule with error: %+v", err)
+	}
+	table := &nftables.Table{Name: "filter", Family: nftables.TableFamilyINet}
+	rules, err := m.GetRule(table, &nftables.Chain{Name: "input"})
+	if err != nil || len(rules) != 2 {
+		t.Fatalf("expected 2 rules, got %d error: %+v", len(rules), err)
+	}
+	sets, err := m.GetSets(table)
+	if err != nil {
+		t.Fatalf("failed to get sets with error: %+v", err)
+	}
+	keyTypes := map[string]uint32{}
+	for _, s := range sets {
+		keyTypes[s.Name] = s.KeyType.GetNFTMagic()
+	}
+	tests := []struct {
+		family  nftables.TableFamily
+		offset  uint32
+		keyType nftables.SetDatatype
+	}{
+		{family: nftables.TableFamilyIPv4, offset: 12, keyType: nftables.TypeIPAddr},
+		{family: nftables.TableFamilyIPv6, offset: 8, keyType: nftables.TypeIP6Addr},
+	}
+	for i, tt := range tests {
+		exprs := rules[i].Exprs
+		meta, ok := exprs[0].(*expr.Meta)
+		if !ok || meta.Key != expr.MetaKeyNFPROTO {
+			t.Fatalf("rule %d: expected nfproto guard, got %+v", i, exprs[0])
+		}
+		if cmp, ok := exprs[1].(*expr.Cmp); !ok || !reflect.DeepEqual(cmp.Data, []byte{byte(tt.family)}) {
+			t.Fatalf("rule %d: expected nfproto %d, got %+v", i, tt.family, exprs[1])
+		}
+		if p, ok := exprs[2].(*expr.Payload); !ok || p.Offset != tt.offset {
+			t.Fatalf("rule %d: expected source address load at offset %d, got %+v", i, tt.offset, exprs[2])
+		}
+		lookup, ok := exprs[3].(*expr.Lookup)
+		if !ok {
+			t.Fatalf("rule %d: expected lookup, got %+v", i, exprs[3])
+		}
+		if keyTypes[lookup.SetName] != tt.keyType.GetNFTMagic() {
+			t.Fatalf("rule %d: expected set %s of %s addresses", i, lookup.SetName, tt.keyType.Name)
+		}
+	}
+
+	// Both rules are deleted by the handle of the first one
+	if err := ri.Rules().DeleteImm(handle); err != nil {
+		t.Fatalf("failed to delete rule with error: %+v", err)
+	}
+	if rules, _ := m.GetRule(table, &nftables.Chain{Name: "input"}); len(rules) != 0 {
+		t.Fatalf("expected rules of both families to be deleted, got %d rules", len(rules))
+	}
+
+	// Single family tables keep rejecting addresses of the other family
+	if err := m.ti.Tables().CreateImm("filter-v4", nftables.TableFamilyIPv4); err != nil {
+		t.Fatalf("failed to create table filter-v4 with error: %+v", err)
+	}
+	ci, _ = m.ti.Tables().Table("filter-v4", nftables.TableFamilyIPv4)
+	if err := ci.Chains().CreateImm("input", nil); err != nil {
+		t.Fatalf("failed to create chain input with error: %+v", err)
+	}
+	ri, _ = ci.Chains().Chain("input")
+	if _, err := ri.Rules().CreateImm(&nftableslib.Rule{
+		L3:     &nftableslib.L3Rule{Src: &nftableslib.IPAddrSpec{List: list[1:2]}},
+		Action: setActionVerdict(t, nftableslib.NFT_DROP),
+	}); err == nil {
+		t.Fatalf("ipv6 address in ipv4 table supposed to fail")
+	}
+}
+
+func TestRuleJSONRoundTrip(t *testing.T) {
+	m := InitMockConn()
+	if err := m.ti.Tables().CreateImm("nat", nftables.TableFamilyIPv4); err != nil {
+		t.Fatalf("failed to create table nat with error: %+v", err)
+	}
+	ci, _ := m.ti.Tables().Table("nat", nftables.TableFamilyIPv4)
+	for _, c := range []string{"prerouting", "web", "api"} {
+		if err := ci.Chains().CreateImm(c, nil); err != nil {
+			t.Fatalf("failed to create chain %s with error: %+v", c, err)
+		}
+	}
+	ri, _ := ci.Chains().Chain("prerouting")
+	action := func(ra *nftableslib.RuleAction, err error) *nftableslib.RuleAction {
+		if err != nil {
+			t.Fatalf("failed to build action with error: %+v", err)
+		}
+		return ra
+	}
+	mark := uint32(0x10)
+	iif := "eth0"
+	tests := []struct {
+		name string
+		rule *nftableslib.Rule
+	}{
+		{
+			name: "Address range with port ranges and exclusions",
+			rule: &nftableslib.Rule{
+				L3: &nftableslib.L3Rule{
+					Dst: &nftableslib.IPAddrSpec{
+						Range: [2]*nftableslib.IPAddr{setIPAddr(t, "192.0.2.1"), setIPAddr(t, "192.0.2.100")},
+						RelOp: nftableslib.NEQ,
+					},
+				},
+				L4: &nftableslib.L4Rule{
+					L4Proto: unix.IPPROTO_TCP,
+					Dst: &nftableslib.Port{
+						Ranges:  [][2]uint16{{1000, 2000}, {3000, 4000}},
+						Exclude: [][2]uint16{{1500, 1500}},
+					},
+				},
+				Action: setActionVerdict(t, nftableslib.NFT_DROP),
+			},
+		},
+		{
+			name: "Port greater than with counter and limit",
+			rule: &nftableslib.Rule{
+				L4: &nftableslib.L4Rule{
+					L4Proto: unix.IPPROTO_UDP,
+					Dst:     &nftableslib.Port{List: []uint16{1024}, RelOp: nftableslib.GTE},
+				},
+				Counter: &nftableslib.Counter{},
+				Limit:   nftableslib.LimitPacketsPerSecond(100),
+				Action:  setActionVerdict(t, nftableslib.NFT_ACCEPT),
+			},
+		},
+		{
+			name: "DNAT to address and port range",
+			rule: &nftableslib.Rule{
+				L4: &nftableslib.L4Rule{
+					L4Proto: unix.IPPROTO_TCP,
+					Dst:     &nftableslib.Port{List: []uint16{80}},
+				},
+				Action: action(nftableslib.SetDNAT(&nftableslib.NATAttributes{
+					L3Addr: [2]*nftableslib.IPAddr{setIPAddr(t, "10.0.0.1")},
+					Port:   [2]uint16{8080, 8090},
+					Random: true,
+				})),
+			},
+		},
+		{
+			name: "SNAT to address range",
+			rule: &nftableslib.Rule{
+				L3: &nftableslib.L3Rule{Src: &nftableslib.IPAddrSpec{List: []*nftableslib.IPAddr{setIPAddr(t, "10.0.0.0/8")}}},
+				Action: setSNAT(t, &nftableslib.NATAttributes{
+					L3Addr: [2]*nftableslib.IPAddr{setIPAddr(t, "192.0.2.1"), setIPAddr(t, "192.0.2.10")},
+				}),
+			},
+		},
+		{
+			name: "Masquerade with flags",
+			rule: &nftableslib.Rule{
+				L3:     &nftableslib.L3Rule{Src: &nftableslib.IPAddrSpec{List: []*nftableslib.IPAddr{setIPAddr(t, "10.0.0.0/8")}}},
+				Action: action(nftableslib.SetMasq(true, false, true)),
+			},
+		},
+		{
+			name: "Masquerade to port range",
+			rule: &nftableslib.Rule{
+				L4: &nftableslib.L4Rule{
+					L4Proto: unix.IPPROTO_TCP,
+					Src:     &nftableslib.Port{List: []uint16{22}},
+				},
+				Action: action(nftableslib.SetMasqToPort(1000, 2000)),
+			},
+		},
+		{
+			name: "Redirect with tproxy",
+			rule: &nftableslib.Rule{
+				L4: &nftableslib.L4Rule{
+					L4Proto: unix.IPPROTO_TCP,
+					Dst:     &nftableslib.Port{List: []uint16{80}},
+				},
+				Action: setActionRedirect(t, 15001, true),
+			},
+		},
+		{
+			name: "Reject with icmp code",
+			rule: &nftableslib.Rule{
+				L3:     &nftableslib.L3Rule{Protocol: nftableslib.L3Protocol(unix.IPPROTO_ICMP)},
+				Action: setActionReject(t, unix.NFT_REJECT_ICMP_UNREACH, unix.NFT_REJECT_ICMPX_HOST_UNREACH),
+			},
+		},
+		{
+			name: "Loadbalance between chains",
+			rule: &nftableslib.Rule{
+				L4: &nftableslib.L4Rule{
+					L4Proto: unix.IPPROTO_TCP,
+					Dst:     &nftableslib.Port{List: []uint16{443}},
+				},
+				Action: action(nftableslib.SetLoadbalance([]string{"web", "api"}, unix.NFT_GOTO, unix.NFT_NG_INCREMENTAL)),
+			},
+		},
+		{
+			name: "Meta matches with jump",
+			rule: &nftableslib.Rule{
+				Meta: &nftableslib.MetaRule{
+					Mark:    &nftableslib.MetaMark{Value: mark},
+					IIFName: &iif,
+					Expr:    []nftableslib.MetaExpr{{Key: unix.NFT_META_SKUID, Value: []byte{0, 0, 0, 0}, RelOp: nftableslib.NEQ}},
+				},
+				Fib:      &nftableslib.Fib{ResultADDRTYPE: true, FlagDADDR: true, Data: []byte{unix.RTN_LOCAL}},
+				Log:      setLog(unix.NFTA_LOG_PREFIX, []byte("meta")),
+				Action:   setActionVerdict(t, unix.NFT_JUMP, "web"),
+				UserData: []byte("comment"),
+			},
+		},
+		{
+			name: "Conntrack state",
+			rule: &nftableslib.Rule{
+				Conntracks: []*nftableslib.Conntrack{
+					{Key: unix.NFT_CT_STATE, Value: binaryutil.BigEndian.PutUint32(nftableslib.CTStateEstablished)},
+				},
+				Action: setActionVerdict(t, nftableslib.NFT_ACCEPT),
+			},
+		},
+	}
+	for _, tt := range tests {
+		checkRuleRoundTrip(t, tt.name, tt.rule)
+		b, _ := json.Marshal(tt.rule)
+		loaded, _ := nftableslib.LoadRule(b)
+		if _, err := ri.Rules().Create(loaded); err != nil {
+			t.Fatalf("test \"%s\" failed with error: %+v but supposed to succeed", tt.name, err)
+		}
+	}
+}
+
+func TestConcatVMapRegisters(t *testing.T) {
+	m := InitMockConn()
+	if err := m.ti.Tables().CreateImm("filter-v6", nftables.TableFamilyIPv6); err != nil {
+		t.Fatalf("failed to create table filter-v6 with error: %+v", err)
+	}
+	ci, _ := m.ti.Tables().Table("filter-v6", nftables.TableFamilyIPv6)
+	si, _ := m.ti.Tables().TableSets("filter-v6", nftables.TableFamilyIPv6)
+	for _, c := range []string{"dispatch", "web"} {
+		if err := ci.Chains().CreateImm(c, nil); err != nil {
+			t.Fatalf("failed to create chain %s with error: %+v", c, err)
+		}
+	}
+	keyType := []nftables.SetDatatype{nftables.TypeIP6Addr, nftables.TypeIP6Addr, nftables.TypeInetService}
+	port := uint16(80)
+	e, err := nftableslib.MakeConcatElement(keyType, []nftableslib.ElementValue{
+		{IPAddr: []byte(net.ParseIP("2001:db8::1").To16())},
+		{IPAddr: []byte(net.ParseIP("2001:db8::2").To16())},
+		{InetService: &port},
+	}, setActionVerdict(t, unix.NFT_JUMP, "web"))
+	if err != nil {
+		t.Fatalf("failed to make element with error: %+v", err)
+	}
+	set, err := si.Sets().CreateSet(&nftableslib.SetAttributes{
+		Name:     "services",
+		IsMap:    true,
+		KeyType:  nftableslib.GenSetKeyType(keyType...),
+		DataType: nftables.TypeVerdict,
+	}, []nftables.SetElement{*e})
+	if err != nil {
+		t.Fatalf("failed to create map services with error: %+v", err)
+	}
+	ri, _ := ci.Chains().Chain("dispatch")
+	if _, err := ri.Rules().CreateImm(&nftableslib.Rule{
+		Concat: &nftableslib.Concat{
+			VMap: true,
+			Elements: []*nftableslib.ConcatElement{
+				{EType: nftables.TypeIP6Addr, ESource: true},
+				{EType: nftables.TypeIP6Addr},
+				{EType: nftables.TypeInetService, EProto: unix.IPPROTO_TCP},
+			},
+			SetRef: &nftableslib.SetRef{Name: set.Name, ID: set.ID},
+		},
+	}); err != nil {
+		t.Fatalf("failed to create dispatch rule with error: %+v", err)
+	}
+	rules, err := m.GetRule(&nftables.Table{Name: "filter-v6", Family: nftables.TableFamilyIPv6}, &nftables.Chain{Name: "dispatch"})
+	if err != nil || len(rules) != 1 {
+		t.Fatalf("expected 1 rule in chain dispatch, got %d with error: %+v", len(rules), err)
+	}
+	// Bytes of register space loaded by payloads must not overlap and the lookup must start at the first one
+	var used [64]bool
+	var first uint32
+	for _, ex := range rules[0].Exprs {
+		switch ex := ex.(type) {
+		case *expr.Payload:
+			start := (ex.DestRegister - unix.NFT_REG32_00) * 4
+			if ex.DestRegister <= unix.NFT_REG_4 {
+				start = (ex.DestRegister - unix.NFT_REG_1) * 16
+			}
+			if first == 0 {
+				first = ex.DestRegister
+			}
+			for i := start; i < start+ex.Len; i++ {
+				if used[i] {
+					t.Fatalf("payload loaded into register %d overlaps with previous payloads", ex.DestRegister)
+				}
+				used[i] = true
+			}
+		case *expr.Lookup:
+			if ex.SourceRegister != first || !ex.IsDestRegSet || ex.DestRegister != 0 {
+				t.Fatalf("unexpected lookup %+v, expected lookup of register %d into verdict", ex, first)
+			}
+		}
+	}
+}
+
+func TestSCTPDCCPPorts(t *testing.T) {
+	tests := []struct {
+		name   string
+		family nftables.TableFamily
+		l4     *nftableslib.L4Rule
+		proto  byte
+		// match are expressions following the port load
+		match []expr.Any
+	}{
+		{
+			name:   "SCTP dport list in ip table",
+			family: nftables.TableFamilyIPv4,
+			l4:     &nftableslib.L4Rule{L4Proto: unix.IPPROTO_SCTP, Dst: &nftableslib.Port{List: []uint16{2905, 3868}}},
+			proto:  unix.IPPROTO_SCTP,
+		},
+		{
+			name:   "SCTP dport list in inet table",
+			family: nftables.TableFamilyINet,
+			l4:     &nftableslib.L4Rule{L4Proto: unix.IPPROTO_SCTP, Dst: &nftableslib.Port{List: []uint16{2905, 3868}}},
+			proto:  unix.IPPROTO_SCTP,
+		},
+		{
+			name:   "DCCP port range in ip table",
+			family: nftables.TableFamilyIPv4,
+			l4:     &nftableslib.L4Rule{L4Proto: unix.IPPROTO_DCCP, Dst: &nftableslib.Port{Range: [2]uint16{5000, 5100}}},
+			proto:  unix.IPPROTO_DCCP,
+			match: []expr.Any{
+				&expr.Cmp{Op: expr.CmpOpGte, Register: 1, Data: binaryutil.BigEndian.PutUint16(5000)},
+				&expr.Cmp{Op: expr.CmpOpLte, Register: 1, Data: binaryutil.BigEndian.PutUint16(5100)},
+			},
+		},
+		{
+			name:   "DCCP port range in inet table",
+			family: nftables.TableFamilyINet,
+			l4:     &nftableslib.L4Rule{L4Proto: unix.IPPROTO_DCCP, Dst: &nftableslib.Port{Range: [2]uint16{5000, 5100}}},
+			proto:  unix.IPPROTO_DCCP,
+			match: []expr.Any{
+				&expr.Cmp{Op: expr.CmpOpGte, Register: 1, Data: binaryutil.BigEndian.PutUint16(5000)},
+				&expr.Cmp{Op: expr.CmpOpLte, Register: 1, Data: binaryutil.BigEndian.PutUint16(5100)},
+			},
+		},
+	}
+	for _, tt := range tests {
+		m := InitMockConn()
+		table := &nftables.Table{Name: "filter", Family: tt.family}
+		if err := m.ti.Tables().CreateImm(table.Name, table.Family); err != nil {
+			t.Fatalf("Test \"%s\" failed to create table with error: %+v", tt.name, err)
+		}
+		ci, _ := m.ti.Tables().Table(table.Name, table.Family)
+		if err := ci.Chains().CreateImm("input", nil); err != nil {
+			t.Fatalf("Test \"%s\" failed to create chain with error: %+v", tt.name, err)
+		}
+		ri, _ := ci.Chains().Chain("input")
+		if _, err := ri.Rules().CreateImm(&nftableslib.Rule{L4: tt.l4, Action: setActionVerdict(t, nftableslib.NFT_ACCEPT)}); err != nil {
+			t.Fatalf("Test \"%s\" failed with error: %+v but supposed to succeed", tt.name, err)
+		}
+		rules, err := m.GetRule(table, &nftables.Chain{Name: "input"})
+		if err != nil || len(rules) != 1 {
+			t.Fatalf("Test \"%s\" failed, expected 1 rule, got %d error: %+v", tt.name, len(rules), err)
+		}
+		exprs := rules[0].Exprs
+		guard := []expr.Any{
+			&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{tt.proto}},
+			&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 2, Len: 2},
+		}
+		if len(exprs) < len(guard) || !reflect.DeepEqual(exprs[:len(guard)], guard) {
+			t.Fatalf("Test \"%s\" failed, expected l4proto %d guard and destination port load, got %+v", tt.name, tt.proto, exprs)
+		}
+		exprs = exprs[len(guard):]
+		if tt.match == nil {
+			lookup, ok := exprs[0].(*expr.Lookup)
+			if !ok {
+				t.Fatalf("Test \"%s\" failed, expected lookup, got %+v", tt.name, exprs[0])
+			}
+			set, err := m.GetSetByName(table, lookup.SetName)
+			if err != nil || set.KeyType.GetNFTMagic() != nftables.TypeInetService.GetNFTMagic() {
+				t.Fatalf("Test \"%s\" failed, expected set of inet services, got %+v error: %+v", tt.name, set, err)
+			}
+			continue
+		}
+		if len(exprs) < len(tt.match) || !reflect.DeepEqual(exprs[:len(tt.match)], tt.match) {
+			t.Fatalf("Test \"%s\" failed, expected %+v, got %+v", tt.name, tt.match, exprs)
+		}
+	}
+
+	m := InitMockConn()
+	if err := m.ti.Tables().CreateImm("filter", nftables.TableFamilyINet); err != nil {
+		t.Fatalf("failed to create table with error: %+v", err)
+	}
+	ci, _ := m.ti.Tables().Table("filter", nftables.TableFamilyINet)
+	if err := ci.Chains().CreateImm("input", nil); err != nil {
+		t.Fatalf("failed to create chain with error: %+v", err)
+	}
+	ri, _ := ci.Chains().Chain("input")
+	// TCP reset does not answer SCTP and DCCP
+	for _, proto := range []uint8{unix.IPPROTO_SCTP, unix.IPPROTO_DCCP} {
+		rule := &nftableslib.Rule{
+			L4:     &nftableslib.L4Rule{L4Proto: proto, Dst: &nftableslib.Port{List: []uint16{3868}}},
+			Action: setActionReject(t, unix.NFT_REJECT_TCP_RST, 0),
+		}
+		if err := rule.Validate(); err == nil {
+			t.Fatalf("validation of tcp reset for l4 protocol %d supposed to fail", proto)
+		}
+		if _, err := ri.Rules().CreateImm(rule); err == nil {
+			t.Fatalf("tcp reset for l4 protocol %d supposed to fail", proto)
+		}
+	}
+	// ICMP does not carry ports
+	if _, err := ri.Rules().CreateImm(&nftableslib.Rule{
+		L4:     &nftableslib.L4Rule{L4Proto: unix.IPPROTO_ICMP, Dst: &nftableslib.Port{List: []uint16{80}}},
+		Action: setActionVerdict(t, nftableslib.NFT_ACCEPT),
+	}); err == nil {
+		t.Fatalf("port match of icmp supposed to fail")
+	}
+	if rules, _ := m.GetRule(&nftables.Table{Name: "filter", Family: nftables.TableFamilyINet}, &nftables.Chain{Name: "input"}); len(rules) != 0 {
+		t.Fatalf("expected refused rules not to be programmed, got %d rules", len(rules))
+	}
+}
@@ -0,0 +1,193 @@
+package mock
+
+import (
+	"testing"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"github.com/sbezverk/nftableslib"
+	"golang.org/x/sys/unix"
+)
+
+func TestApplyRuleset(t *testing.T) {
+	port := func(p int, action *nftableslib.RuleAction) *nftableslib.Rule {
+		return &nftableslib.Rule{
+			L4: &nftableslib.L4Rule{
+				L4Proto: unix.IPPROTO_TCP,
+				Dst:     &nftableslib.Port{List: []uint16{uint16(p)}},
+			},
+			Action: action,
+		}
+	}
+	jump := func(chain string) *nftableslib.RuleAction {
+		return setActionVerdict(t, unix.NFT_JUMP, chain)
+	}
+	input := &nftableslib.ChainAttributes{
+		Type:     nftables.ChainTypeFilter,
+		Hook:     nftables.ChainHookInput,
+		Priority: nftables.ChainPriorityFilter,
+	}
+	spec := func(sshPort int) *nftableslib.RulesetSpec {
+		return &nftableslib.RulesetSpec{
+			Tables: []*nftableslib.TableSpec{
+				{
+					Name:   "filter",
+					Family: nftables.TableFamilyIPv4,
+					Sets: []*nftableslib.SetSpec{
+						{
+							Attributes: nftableslib.SetAttributes{
+								Name:     "dispatch",
+								IsMap:    true,
+								KeyType:  nftables.TypeInetService,
+								DataType: nftables.TypeVerdict,
+							},
+							Elements: []nftables.SetElement{
+								{
+									Key:         binaryutil.BigEndian.PutUint16(80),
+									VerdictData: &expr.Verdict{Kind: expr.VerdictJump, Chain: "web"},
+								},
+							},
+						},
+					},
+					// Chains are declared before the chains they jump to
+					Chains: []*nftableslib.ChainSpec{
+						{
+							Name:       "input",
+							Attributes: input,
+							Rules:      []*nftableslib.Rule{{Action: jump("services")}},
+						},
+						{
+							Name: "services",
+							Rules: []*nftableslib.Rule{
+								port(80, jump("web")),
+								port(sshPort, jump("ssh")),
+							},
+						},
+						{
+							Name:  "web",
+							Rules: []*nftableslib.Rule{{Action: setActionVerdict(t, nftableslib.NFT_ACCEPT)}},
+						},
+						{
+							Name:  "ssh",
+							Rules: []*nftableslib.Rule{{Action: setActionVerdict(t, nftableslib.NFT_ACCEPT)}},
+						},
+					},
+				},
+				{
+					Name:   "filter",
+					Family: nftables.TableFamilyIPv6,
+					Chains: []*nftableslib.ChainSpec{
+						{
+							Name:       "input",
+							Attributes: input,
+							Rules:      []*nftableslib.Rule{{Action: setActionVerdict(t, unix.NFT_GOTO, "drop-all")}},
+						},
+						{
+							Name:  "drop-all",
+							Rules: []*nftableslib.Rule{{Action: setActionVerdict(t, nftableslib.NFT_DROP)}},
+						},
+					},
+				},
+			},
+		}
+	}
+	// verdicts returns chains targeted by verdicts of the chain's rules along with handles of the rules
+	verdicts := func(m *Mock, family nftables.TableFamily, chain string) ([]string, []uint64) {
+		table := &nftables.Table{Name: "filter", Family: family}
+		rules, err := m.GetRule(table, &nftables.Chain{Name: chain, Table: table})
+		if err != nil {
+			t.Fatalf("failed to get rules of chain %s with error: %+v", chain, err)
+		}
+		targets, handles := []string{}, []uint64{}
+		for _, r := range rules {
+			for _, e := range r.Exprs {
+				if v, ok := e.(*expr.Verdict); ok {
+					targets = append(targets, v.Chain)
+				}
+			}
+			handles = append(handles, r.Handle)
+		}
+		return targets, handles
+	}
+	equal := func(a, b []string) bool {
+		if len(a) != len(b) {
+			return false
+		}
+		for i := range a {
+			if a[i] != b[i] {
+				return false
+			}
+		}
+		return true
+	}
+
+	m := InitMockConn()
+	if err := m.ti.Tables().ApplyRuleset(spec(22)); err != nil {
+		t.Fatalf("failed to apply ruleset with error: %+v", err)
+	}
+	tests := []struct {
+		name    string
+		family  nftables.TableFamily
+		chain   string
+		targets []string
+	}{
+		{
+			name:    "ipv4 input",
+			family:  nftables.TableFamilyIPv4,
+			chain:   "input",
+			targets: []string{"services"},
+		},
+		{
+			name:    "ipv4 services",
+			family:  nftables.TableFamilyIPv4,
+			chain:   "services",
+			targets: []string{"web", "ssh"},
+		},
+		{
+			name:    "ipv6 input",
+			family:  nftables.TableFamilyIPv6,
+			chain:   "input",
+			targets: []string{"drop-all"},
+		},
+	}
+	for _, tt := range tests {
+		targets, _ := verdicts(m, tt.family, tt.chain)
+		if !equal(targets, tt.targets) {
+			t.Fatalf("Test \"%s\" failed, expected verdicts to %v, got %v", tt.name, tt.targets, targets)
+		}
+	}
+	si, err := m.ti.Tables().TableSets("filter", nftables.TableFamilyIPv4)
+	if err != nil {
+		t.Fatalf("failed to get sets with error: %+v", err)
+	}
+	vmap, err := si.Sets().VMapEntries("dispatch")
+	if err != nil {
+		t.Fatalf("failed to get entries of verdict map with error: %+v", err)
+	}
+	if len(vmap) != 1 {
+		t.Fatalf("expected a single entry of verdict map, got %v", vmap)
+	}
+
+	// Applying the updated spec replaces rules in place
+	_, before := verdicts(m, nftables.TableFamilyIPv4, "services")
+	if err := m.ti.Tables().ApplyRuleset(spec(2222)); err != nil {
+		t.Fatalf("failed to apply updated ruleset with error: %+v", err)
+	}
+	_, after := verdicts(m, nftables.TableFamilyIPv4, "services")
+	if len(after) != 2 || after[0] != before[0] || after[1] != before[1] {
+		t.Fatalf("rules are expected to keep handles %v, got %v", before, after)
+	}
+
+	// A rule jumping to a chain which is not declared fails the whole spec
+	m = InitMockConn()
+	broken := spec(22)
+	broken.Tables[0].Chains = broken.Tables[0].Chains[:3]
+	if err := m.ti.Tables().ApplyRuleset(broken); err == nil {
+		t.Fatalf("applying ruleset jumping to undeclared chain is supposed to fail")
+	}
+	tables, _ := m.ListTables()
+	if len(tables) != 0 {
+		t.Fatalf("failed ruleset is expected to leave no tables, got %d", len(tables))
+	}
+}
@@ -0,0 +1,172 @@
+package mock
+
+import (
+	"net"
+	"sort"
+	"testing"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/sbezverk/nftableslib"
+	"golang.org/x/sys/unix"
+)
+
+func backend(t *testing.T, addr string, port uint16, weight int) *nftableslib.ServiceBackend {
+	ip, err := nftableslib.NewIPAddr(addr)
+	if err != nil {
+		t.Fatalf("failed to parse address %s with error: %+v", addr, err)
+	}
+	return &nftableslib.ServiceBackend{Addr: ip, Port: port, Weight: weight}
+}
+
+func service(t *testing.T, name, vip string, port uint16, proto uint8, backends ...*nftableslib.ServiceBackend) *nftableslib.Service {
+	ip, err := nftableslib.NewIPAddr(vip)
+	if err != nil {
+		t.Fatalf("failed to parse address %s with error: %+v", vip, err)
+	}
+	return &nftableslib.Service{Name: name, VIP: ip, Port: port, Protocol: proto, Backends: backends}
+}
+
+// checkServices validates the programmed object graph against the list of services: base chains,
+// services map elements, services' chains with load balancing maps reflecting backends' weights and
+// backends' chains with DNAT rules.
+func checkServices(t *testing.T, m *Mock, services []*nftableslib.Service) {
+	t.Helper()
+	m.Lock()
+	defer m.Unlock()
+	table := &nftables.Table{Name: "kube-nat", Family: nftables.TableFamilyIPv4}
+	got := []string{}
+	for _, c := range m.ruleset.chains {
+		if c.Table.Name == table.Name {
+			got = append(got, c.Name)
+		}
+	}
+	want := []string{"prerouting", "output"}
+	jumps := map[string]bool{}
+	for _, s := range services {
+		want = append(want, nftableslib.ServiceChainPrefix+s.Name)
+		jumps[nftableslib.ServiceChainPrefix+s.Name] = true
+		weights := map[string]int{}
+		for _, b := range s.Backends {
+			weights[b.Addr.IP.String()] = b.Weight
+		}
+		rules := m.ruleset.rules[chainKey(table, nftableslib.ServiceChainPrefix+s.Name)]
+		if len(rules) != 1 {
+			t.Fatalf("service %s chain is expected to have 1 rule, got %d", s.Name, len(rules))
+		}
+		var lb *mockSet
+		for _, e := range rules[0].Exprs {
+			if l, ok := e.(*expr.Lookup); ok {
+				lb = m.ruleset.getSet(table, l.SetName)
+			}
+		}
+		if lb == nil {
+			t.Fatalf("service %s chain rule does not refer to load balancing map", s.Name)
+		}
+		counts := map[string]int{}
+		for _, e := range lb.elements {
+			counts[e.VerdictData.Chain]++
+		}
+		if len(counts) != len(s.Backends) {
+			t.Fatalf("service %s load balances to %d chains, expected %d", s.Name, len(counts), len(s.Backends))
+		}
+		for ep, n := range counts {
+			want = append(want, ep)
+			rules := m.ruleset.rules[chainKey(table, ep)]
+			if len(rules) != 1 {
+				t.Fatalf("backend chain %s is expected to have 1 rule, got %d", ep, len(rules))
+			}
+			var addr string
+			for _, e := range rules[0].Exprs {
+				if i, ok := e.(*expr.Immediate); ok && len(i.Data) == 4 {
+					addr = net.IP(i.Data).String()
+					break
+				}
+			}
+			if w, ok := weights[addr]; !ok || (w == 0 && n != 1) || (w != 0 && n != w) {
+				t.Fatalf("backend chain %s of service %s dnats to %s with %d map entries, unexpected", ep, s.Name, addr, n)
+			}
+		}
+	}
+	sort.Strings(got)
+	sort.Strings(want)
+	if len(got) != len(want) {
+		t.Fatalf("expected chains %v, got %v", want, got)
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Fatalf("expected chains %v, got %v", want, got)
+		}
+	}
+	sm := m.ruleset.getSet(table, nftableslib.ServicesMapName)
+	if sm == nil {
+		t.Fatalf("services map does not exist")
+	}
+	if len(sm.elements) != len(jumps) {
+		t.Fatalf("services map is expected to have %d elements, got %d", len(jumps), len(sm.elements))
+	}
+	for _, e := range sm.elements {
+		if !jumps[e.VerdictData.Chain] {
+			t.Fatalf("services map element jumps to unexpected chain %s", e.VerdictData.Chain)
+		}
+	}
+}
+
+func TestServiceDispatcher(t *testing.T) {
+	m := InitMockConn()
+	sd, err := nftableslib.NewServiceDispatcher(m.ti, "kube-nat", nftables.TableFamilyIPv4)
+	if err != nil {
+		t.Fatalf("failed to create service dispatcher with error: %+v", err)
+	}
+	web := service(t, "web", "10.96.0.10", 80, unix.IPPROTO_TCP,
+		backend(t, "192.168.1.1", 8080, 1),
+		backend(t, "192.168.1.2", 8080, 2),
+	)
+	dns := service(t, "dns", "10.96.0.53", 53, unix.IPPROTO_UDP,
+		backend(t, "192.168.2.1", 53, 0),
+	)
+	if err := sd.Apply([]*nftableslib.Service{web, dns}); err != nil {
+		t.Fatalf("failed to apply services with error: %+v", err)
+	}
+	checkServices(t, m, []*nftableslib.Service{web, dns})
+
+	// Applying the same services again does not change anything
+	handle := m.ruleset.handle
+	if err := sd.Apply([]*nftableslib.Service{web, dns}); err != nil {
+		t.Fatalf("failed to re-apply services with error: %+v", err)
+	}
+	if m.ruleset.handle != handle {
+		t.Fatalf("re-applying the same services changed the ruleset")
+	}
+
+	// Updating web backends, the service's load balancing rule is replaced in place
+	table := &nftables.Table{Name: "kube-nat", Family: nftables.TableFamilyIPv4}
+	lbHandle := m.ruleset.rules[chainKey(table, "svc-web")][0].Handle
+	web = service(t, "web", "10.96.0.10", 80, unix.IPPROTO_TCP,
+		backend(t, "192.168.1.2", 8080, 1),
+		backend(t, "192.168.1.3", 8080, 3),
+	)
+	if err := sd.Apply([]*nftableslib.Service{web, dns}); err != nil {
+		t.Fatalf("failed to apply updated services with error: %+v", err)
+	}
+	checkServices(t, m, []*nftableslib.Service{web, dns})
+	if h := m.ruleset.rules[chainKey(table, "svc-web")][0].Handle; h != lbHandle {
+		t.Fatalf("service web load balancing rule was recreated, handle %d, expected %d", h, lbHandle)
+	}
+
+	// Deleting dns service
+	if err := sd.Apply([]*nftableslib.Service{web}); err != nil {
+		t.Fatalf("failed to apply services without dns with error: %+v", err)
+	}
+	checkServices(t, m, []*nftableslib.Service{web})
+
+	// Services with the same vip, protocol and port are rejected before any change
+	handle = m.ruleset.handle
+	dup := service(t, "web-2", "10.96.0.10", 80, unix.IPPROTO_TCP, backend(t, "192.168.1.9", 80, 1))
+	if err := sd.Apply([]*nftableslib.Service{web, dup}); err == nil {
+		t.Fatalf("services with the same vip, protocol and port supposed to fail")
+	}
+	if m.ruleset.handle != handle {
+		t.Fatalf("failed apply changed the ruleset")
+	}
+}
@@ -0,0 +1,153 @@
+package mock
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/sbezverk/nftableslib"
+)
+
+func TestDumpRestoreSet(t *testing.T) {
+	sets := func(m *Mock) nftableslib.SetFuncs {
+		t.Helper()
+		if err := m.ti.Tables().CreateImm("filter", nftables.TableFamilyIPv4); err != nil {
+			t.Fatalf("failed to create table with error: %+v", err)
+		}
+		si, err := m.ti.Tables().TableSets("filter", nftables.TableFamilyIPv4)
+		if err != nil {
+			t.Fatalf("failed to get sets with error: %+v", err)
+		}
+		return si.Sets()
+	}
+	// expirations returns the time left for elements opening intervals of the set keyed by the address
+	expirations := func(si nftableslib.SetFuncs) map[string]time.Duration {
+		t.Helper()
+		b, err := si.DumpSet("blocked")
+		if err != nil {
+			t.Fatalf("failed to dump set with error: %+v", err)
+		}
+		d := &nftableslib.SetDump{}
+		if err := json.Unmarshal(b, d); err != nil {
+			t.Fatalf("failed to decode set dump with error: %+v", err)
+		}
+		left := make(map[string]time.Duration)
+		for _, e := range d.Elements {
+			if !e.IntervalEnd {
+				left[net.IP(e.Key).String()] = e.Expires
+			}
+		}
+		return left
+	}
+	attrs := &nftableslib.SetAttributes{
+		Name:       "blocked",
+		Interval:   true,
+		HasTimeout: true,
+		Timeout:    10 * time.Minute,
+		KeyType:    nftables.TypeIPAddr,
+	}
+
+	m := InitMockConn()
+	clock := time.Unix(1000, 0)
+	m.now = func() time.Time { return clock }
+	si := sets(m)
+	if _, err := si.CreateSet(attrs, []nftables.SetElement{
+		{Key: net.ParseIP("192.0.2.1").To4(), Timeout: 10 * time.Minute},
+		{Key: net.ParseIP("198.51.100.0").To4(), Timeout: 2 * time.Minute},
+		{Key: net.ParseIP("198.51.101.0").To4(), IntervalEnd: true},
+		{Key: net.ParseIP("203.0.113.5").To4()},
+	}); err != nil {
+		t.Fatalf("failed to create set with error: %+v", err)
+	}
+	clock = clock.Add(time.Minute)
+	b, err := si.DumpSet("blocked")
+	if err != nil {
+		t.Fatalf("failed to dump set with error: %+v", err)
+	}
+	// The dump is restored 90 seconds after it was taken
+	d := &nftableslib.SetDump{}
+	if err := json.Unmarshal(b, d); err != nil {
+		t.Fatalf("failed to decode set dump with error: %+v", err)
+	}
+	d.Dumped = d.Dumped.Add(-90 * time.Second)
+	if b, err = json.Marshal(d); err != nil {
+		t.Fatalf("failed to encode set dump with error: %+v", err)
+	}
+
+	tests := []struct {
+		name string
+		// timeout is the timeout of the set existing before the restore, nil if the set does not exist
+		timeout *time.Duration
+		left    map[string]time.Duration
+	}{
+		{
+			name: "set is created",
+			left: map[string]time.Duration{
+				"192.0.2.1":   9*time.Minute - 90*time.Second,
+				"203.0.113.5": 0,
+			},
+		},
+		{
+			name:    "set with shorter timeout exists",
+			timeout: func() *time.Duration { d := 5 * time.Minute; return &d }(),
+			left: map[string]time.Duration{
+				"192.0.2.1":   5 * time.Minute,
+				"203.0.113.5": 0,
+			},
+		},
+	}
+	for _, tt := range tests {
+		restored := InitMockConn()
+		si := sets(restored)
+		if tt.timeout != nil {
+			existing := *attrs
+			existing.Timeout = *tt.timeout
+			if _, err := si.CreateSet(&existing, []nftables.SetElement{
+				{Key: net.ParseIP("192.0.2.200").To4(), Timeout: *tt.timeout},
+			}); err != nil {
+				t.Fatalf("Test \"%s\" failed to create set with error: %+v", tt.name, err)
+			}
+		}
+		skipped, err := si.RestoreSet(b)
+		if err != nil {
+			t.Fatalf("Test \"%s\" failed with error: %+v but supposed to succeed", tt.name, err)
+		}
+		if skipped != 1 {
+			t.Fatalf("Test \"%s\" failed, expected 1 expired element to be skipped, got %d", tt.name, skipped)
+		}
+		left := expirations(si)
+		if len(left) != len(tt.left) {
+			t.Fatalf("Test \"%s\" failed, expected elements %v, got %v", tt.name, tt.left, left)
+		}
+		for addr, want := range tt.left {
+			got, ok := left[addr]
+			if !ok {
+				t.Fatalf("Test \"%s\" failed, element %s is not restored", tt.name, addr)
+			}
+			// Time passes between the restore and the check
+			if got > want || want-got > time.Second {
+				t.Fatalf("Test \"%s\" failed, expected %s left for %s, got %s", tt.name, want, addr, got)
+			}
+		}
+	}
+
+	// Elements of sets without timeouts are restored as they are
+	ports := &nftableslib.SetAttributes{Name: "ports", KeyType: nftables.TypeInetService}
+	if _, err := si.CreateSet(ports, []nftables.SetElement{{Key: binaryutil.BigEndian.PutUint16(22)}}); err != nil {
+		t.Fatalf("failed to create set with error: %+v", err)
+	}
+	if b, err = si.DumpSet("ports"); err != nil {
+		t.Fatalf("failed to dump set with error: %+v", err)
+	}
+	restored := InitMockConn()
+	rsi := sets(restored)
+	if skipped, err := rsi.RestoreSet(b); err != nil || skipped != 0 {
+		t.Fatalf("failed to restore set, skipped %d error: %+v", skipped, err)
+	}
+	if elements, err := rsi.GetSetElements("ports"); err != nil || len(elements) != 1 {
+		t.Fatalf("expected a single element of restored set, got %d error: %+v", len(elements), err)
+	}
+}
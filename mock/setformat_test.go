@@ -0,0 +1,188 @@
+package mock
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/google/nftables"
+	"github.com/sbezverk/nftableslib"
+)
+
+func TestSetElementsText(t *testing.T) {
+	m := InitMockConn()
+	if err := m.ti.Tables().CreateImm("filter", nftables.TableFamilyINet); err != nil {
+		t.Fatalf("failed to create table with error: %+v", err)
+	}
+	si, _ := m.ti.Tables().TableSets("filter", nftables.TableFamilyINet)
+	set := func(name, keyType string, interval bool) {
+		attrs, err := nftableslib.NewSetAttributes(name, keyType)
+		if err != nil {
+			t.Fatalf("failed to build attributes with error: %+v", err)
+		}
+		attrs.Interval = interval
+		if _, err := si.Sets().CreateSet(attrs, nil); err != nil {
+			t.Fatalf("failed to create set %s with error: %+v", name, err)
+		}
+	}
+	set("blocked", "ipv4_addr", true)
+	set("hosts6", "ipv6_addr", false)
+	set("ports", "inet_service", true)
+	set("services", "ipv4_addr . inet_proto . inet_service", false)
+
+	tests := []struct {
+		name   string
+		set    string
+		format nftableslib.SetElementsFormat
+		input  string
+		// output is the exported text, elements are sorted by their keys
+		output   string
+		elements int
+	}{
+		{
+			name:     "ipv4 prefixes, ranges and addresses in nft syntax",
+			set:      "blocked",
+			format:   nftableslib.SetElementsNFT,
+			input:    "elements = { 5.6.7.8,\n\t1.2.3.0/24,\n\t10.0.0.1-10.0.0.9 }\n",
+			output:   "{ 1.2.3.0/24, 5.6.7.8, 10.0.0.1-10.0.0.9 }\n",
+			elements: 3,
+		},
+		{
+			name:     "ipv4 prefixes in csv",
+			set:      "blocked",
+			format:   nftableslib.SetElementsCSV,
+			input:    "# blocked networks\n192.168.0.0/16\n\n10.0.0.1-10.0.0.9\n",
+			output:   "10.0.0.1-10.0.0.9\n192.168.0.0/16\n",
+			elements: 2,
+		},
+		{
+			name:     "ipv6 addresses in nft syntax",
+			set:      "hosts6",
+			format:   nftableslib.SetElementsNFT,
+			input:    "{ 2001:db8::2, 2001:db8::1 }",
+			output:   "{ 2001:db8::1, 2001:db8::2 }\n",
+			elements: 2,
+		},
+		{
+			name:     "ipv6 addresses in csv",
+			set:      "hosts6",
+			format:   nftableslib.SetElementsCSV,
+			input:    "fe80::1\n2001:db8::1/128\n",
+			output:   "2001:db8::1\nfe80::1\n",
+			elements: 2,
+		},
+		{
+			name:     "port ranges in nft syntax",
+			set:      "ports",
+			format:   nftableslib.SetElementsNFT,
+			input:    "{ 443, 22, 8000-8080 }",
+			output:   "{ 22, 443, 8000-8080 }\n",
+			elements: 3,
+		},
+		{
+			name:     "port ranges in csv",
+			set:      "ports",
+			format:   nftableslib.SetElementsCSV,
+			input:    "80\n1024-65534\n",
+			output:   "80\n1024-65534\n",
+			elements: 2,
+		},
+		{
+			name:     "concatenations in nft syntax",
+			set:      "services",
+			format:   nftableslib.SetElementsNFT,
+			input:    "{ 10.0.0.2 . tcp . 443, 10.0.0.1  .  17 . 53 }",
+			output:   "{ 10.0.0.1 . 17 . 53, 10.0.0.2 . 6 . 443 }\n",
+			elements: 2,
+		},
+		{
+			name:     "concatenations in csv",
+			set:      "services",
+			format:   nftableslib.SetElementsCSV,
+			input:    "10.0.0.1, udp, 53\n10.0.0.2,6,443\n",
+			output:   "10.0.0.1,17,53\n10.0.0.2,6,443\n",
+			elements: 2,
+		},
+	}
+	for _, tt := range tests {
+		n, err := si.Sets().ImportSetElements(tt.set, strings.NewReader(tt.input), tt.format, true)
+		if err != nil {
+			t.Fatalf("Test \"%s\" failed with error: %+v but supposed to succeed", tt.name, err)
+		}
+		if n != tt.elements {
+			t.Fatalf("Test \"%s\" failed, expected %d imported elements, got %d", tt.name, tt.elements, n)
+		}
+		b, err := si.Sets().ExportSetElements(tt.set, tt.format)
+		if err != nil {
+			t.Fatalf("Test \"%s\" failed to export with error: %+v", tt.name, err)
+		}
+		if string(b) != tt.output {
+			t.Fatalf("Test \"%s\" failed, expected export %q, got %q", tt.name, tt.output, string(b))
+		}
+		// The exported text imported again does not change the set
+		if _, err := si.Sets().ImportSetElements(tt.set, strings.NewReader(string(b)), tt.format, true); err != nil {
+			t.Fatalf("Test \"%s\" failed to import exported text with error: %+v", tt.name, err)
+		}
+		if again, _ := si.Sets().ExportSetElements(tt.set, tt.format); string(again) != tt.output {
+			t.Fatalf("Test \"%s\" failed, round trip changed the set to %q", tt.name, string(again))
+		}
+	}
+
+	// Import without replace adds to the elements of the set
+	if _, err := si.Sets().ImportSetElements("ports", strings.NewReader("{ 22 }"), nftableslib.SetElementsNFT, false); err != nil {
+		t.Fatalf("failed to import with error: %+v", err)
+	}
+	if b, _ := si.Sets().ExportSetElements("ports", nftableslib.SetElementsNFT); string(b) != "{ 22, 80, 1024-65534 }\n" {
+		t.Fatalf("expected elements to be added to the set, got %q", string(b))
+	}
+	if _, err := si.Sets().ImportSetElements("ports", strings.NewReader("{ }"), nftableslib.SetElementsNFT, true); err != nil {
+		t.Fatalf("failed to import with error: %+v", err)
+	}
+	if b, _ := si.Sets().ExportSetElements("ports", nftableslib.SetElementsNFT); string(b) != "{ }\n" {
+		t.Fatalf("expected replacing import to remove all elements, got %q", string(b))
+	}
+
+	// Parse errors carry the line of the invalid element and leave the set intact
+	for _, e := range []struct {
+		set    string
+		format nftableslib.SetElementsFormat
+		input  string
+		line   int
+	}{
+		{"blocked", nftableslib.SetElementsNFT, "{ 1.2.3.4,\n  1.2.3.300 }", 2},
+		{"blocked", nftableslib.SetElementsNFT, "{\n1.2.3.4,\n\n1.2.3.5,\n}", 5},
+		{"blocked", nftableslib.SetElementsNFT, "{ 1.2.3.4 } trailing", 1},
+		{"blocked", nftableslib.SetElementsNFT, "1.2.3.4", 1},
+		{"blocked", nftableslib.SetElementsNFT, "{ 1.2.3.4,\n 1.2.3.5", 2},
+		{"blocked", nftableslib.SetElementsCSV, "1.2.3.4\n# comment\n2001:db8::1\n", 3},
+		{"blocked", nftableslib.SetElementsCSV, "1.2.3.9-1.2.3.1\n", 1},
+		{"blocked", nftableslib.SetElementsCSV, "1.2.3.1/24\n", 1},
+		{"blocked", nftableslib.SetElementsCSV, "255.255.255.0/24\n", 1},
+		{"hosts6", nftableslib.SetElementsCSV, "2001:db8::1\n2001:db8::/64\n", 2},
+		{"ports", nftableslib.SetElementsCSV, "80\n\n65536\n", 3},
+		{"services", nftableslib.SetElementsCSV, "10.0.0.1,tcp\n", 1},
+		{"services", nftableslib.SetElementsNFT, "{ 10.0.0.1 . tcp . 80-90 }", 1},
+		{"services", nftableslib.SetElementsNFT, "{ 10.0.0.1 . bogus . 80 }", 1},
+	} {
+		before, _ := si.Sets().ExportSetElements(e.set, e.format)
+		_, err := si.Sets().ImportSetElements(e.set, strings.NewReader(e.input), e.format, true)
+		var serr *nftableslib.ErrElementSyntax
+		if !errors.As(err, &serr) || serr.Line != e.line {
+			t.Fatalf("importing %q is supposed to fail with syntax error at line %d, got %+v", e.input, e.line, err)
+		}
+		if after, _ := si.Sets().ExportSetElements(e.set, e.format); string(after) != string(before) {
+			t.Fatalf("failed import of %q changed the set from %q to %q", e.input, string(before), string(after))
+		}
+	}
+
+	attrs, _ := nftableslib.NewMapAttributes("portmap", "inet_service", "ipv4_addr")
+	if _, err := si.Sets().CreateSet(attrs, nil); err != nil {
+		t.Fatalf("failed to create map with error: %+v", err)
+	}
+	if _, err := si.Sets().ExportSetElements("portmap", nftableslib.SetElementsCSV); err == nil {
+		t.Fatalf("exporting elements of map is supposed to fail")
+	}
+	if _, err := si.Sets().ExportSetElements("missing", nftableslib.SetElementsCSV); err == nil {
+		t.Fatalf("exporting elements of missing set is supposed to fail")
+	}
+}
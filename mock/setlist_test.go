@@ -0,0 +1,144 @@
+package mock
+
+import (
+	"testing"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/sbezverk/nftableslib"
+	"golang.org/x/sys/unix"
+)
+
+func TestSetsList(t *testing.T) {
+	table := &nftables.Table{Name: "filter", Family: nftables.TableFamilyIPv4}
+	m := InitMockConn()
+	if err := m.ti.Tables().CreateImm(table.Name, table.Family); err != nil {
+		t.Fatalf("failed to create table with error: %+v", err)
+	}
+	si, err := m.ti.Tables().TableSets(table.Name, table.Family)
+	if err != nil {
+		t.Fatalf("failed to get sets with error: %+v", err)
+	}
+	ci, err := m.ti.Tables().TableChains(table.Name, table.Family)
+	if err != nil {
+		t.Fatalf("failed to get chains with error: %+v", err)
+	}
+	if err := ci.Chains().CreateImm("input", nil); err != nil {
+		t.Fatalf("failed to create chain with error: %+v", err)
+	}
+	ri, err := ci.Chains().Chain("input")
+	if err != nil {
+		t.Fatalf("failed to get rules with error: %+v", err)
+	}
+	ports := []nftables.SetElement{
+		{Key: binaryutil.BigEndian.PutUint16(22)},
+		{Key: binaryutil.BigEndian.PutUint16(443)},
+		{Key: binaryutil.BigEndian.PutUint16(8080)},
+	}
+	allowed, err := si.Sets().CreateSet(&nftableslib.SetAttributes{Name: "allowed", KeyType: nftables.TypeInetService}, ports)
+	if err != nil {
+		t.Fatalf("failed to create set allowed with error: %+v", err)
+	}
+	if _, err := si.Sets().CreateSet(&nftableslib.SetAttributes{Name: "spare", KeyType: nftables.TypeIPAddr}, nil); err != nil {
+		t.Fatalf("failed to create set spare with error: %+v", err)
+	}
+	named, err := ri.Rules().CreateImm(&nftableslib.Rule{
+		L4: &nftableslib.L4Rule{
+			L4Proto: unix.IPPROTO_TCP,
+			Dst:     &nftableslib.Port{SetRef: &nftableslib.SetRef{Name: allowed.Name, ID: allowed.ID}},
+		},
+		Action: setActionVerdict(t, nftableslib.NFT_ACCEPT),
+	})
+	if err != nil {
+		t.Fatalf("failed to create rule with error: %+v", err)
+	}
+	// The list of ports is compiled into an anonymous set
+	anonymous, err := ri.Rules().CreateImm(&nftableslib.Rule{
+		L4: &nftableslib.L4Rule{
+			L4Proto: unix.IPPROTO_UDP,
+			Dst:     &nftableslib.Port{List: []uint16{53, 123}},
+		},
+		Action: setActionVerdict(t, nftableslib.NFT_ACCEPT),
+	})
+	if err != nil {
+		t.Fatalf("failed to create rule with error: %+v", err)
+	}
+	// Sets of a rule deleted by a different application stay behind
+	leaked, err := ri.Rules().CreateImm(&nftableslib.Rule{
+		L4: &nftableslib.L4Rule{
+			L4Proto: unix.IPPROTO_TCP,
+			Dst:     &nftableslib.Port{List: []uint16{25, 587, 465}},
+		},
+		Action: setActionVerdict(t, nftableslib.NFT_DROP),
+	})
+	if err != nil {
+		t.Fatalf("failed to create rule with error: %+v", err)
+	}
+	m.DelRule(&nftables.Rule{Table: table, Chain: &nftables.Chain{Name: "input", Table: table}, Handle: leaked})
+	orphan := &nftables.Set{Table: table, Anonymous: true, Constant: true, KeyType: nftables.TypeInetService}
+	if err := m.AddSet(orphan, ports[:1]); err != nil {
+		t.Fatalf("failed to add orphaned set with error: %+v", err)
+	}
+	if err := m.Flush(); err != nil {
+		t.Fatalf("failed to flush with error: %+v", err)
+	}
+
+	infos, err := si.Sets().List()
+	if err != nil {
+		t.Fatalf("failed to list sets with error: %+v", err)
+	}
+	bound := map[uint64]bool{named: true, anonymous: true}
+	tests := []struct {
+		name      string
+		anonymous bool
+		generated bool
+		stored    bool
+		elements  int
+		bound     bool
+	}{
+		{name: "allowed", stored: true, elements: 3, bound: true},
+		{name: "spare", stored: true, elements: 0, bound: false},
+		{name: "generated", generated: true, elements: 2, bound: true},
+		{name: "leaked", generated: true, elements: 3, bound: false},
+		{name: orphan.Name, anonymous: true, elements: 1, bound: false},
+	}
+	if len(infos) != len(tests) {
+		t.Fatalf("expected %d sets, got %d", len(tests), len(infos))
+	}
+	// Generated sets are told apart by the number of elements
+	find := func(name string, generated bool, elements int) *nftableslib.SetInfo {
+		for _, i := range infos {
+			if i.Name == name || (generated && i.Generated && i.Elements == elements) {
+				return i
+			}
+		}
+		return nil
+	}
+	for _, tt := range tests {
+		info := find(tt.name, tt.generated, tt.elements)
+		if info == nil {
+			t.Fatalf("Test \"%s\" failed, set is not listed", tt.name)
+		}
+		if info.Anonymous != tt.anonymous || info.Generated != tt.generated || info.Stored != tt.stored ||
+			info.Elements != tt.elements {
+			t.Fatalf("Test \"%s\" failed, unexpected set info %+v", tt.name, info)
+		}
+		if info.Bound() != tt.bound {
+			t.Fatalf("Test \"%s\" failed, expected bound %t, got rules %v", tt.name, tt.bound, info.BoundRules)
+		}
+		if tt.bound && (len(info.BoundRules) != 1 || !bound[info.BoundRules[0]]) {
+			t.Fatalf("Test \"%s\" failed, unexpected bound rules %v", tt.name, info.BoundRules)
+		}
+	}
+
+	deleted, err := si.Sets().DeleteUnbound()
+	if err != nil {
+		t.Fatalf("failed to delete unbound sets with error: %+v", err)
+	}
+	if len(deleted) != 2 || (deleted[0] != orphan.Name && deleted[1] != orphan.Name) {
+		t.Fatalf("expected leaked and orphaned sets to be deleted, got %v", deleted)
+	}
+	if infos, _ = si.Sets().List(); len(infos) != len(tests)-2 {
+		t.Fatalf("expected %d sets after cleanup, got %d", len(tests)-2, len(infos))
+	}
+}
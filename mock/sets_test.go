@@ -0,0 +1,773 @@
+package mock
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/sbezverk/nftableslib"
+	"golang.org/x/sys/unix"
+)
+
+func TestSetsSync(t *testing.T) {
+	m := InitMockConn()
+	if err := m.ti.Tables().CreateImm("filter-v4", nftables.TableFamilyIPv4); err != nil {
+		t.Fatalf("failed to create table filter-v4 with error: %+v", err)
+	}
+	tbl, err := m.ti.Tables().TableSets("filter-v4", nftables.TableFamilyIPv4)
+	if err != nil {
+		t.Fatalf("failed to get sets interface for table filter-v4")
+	}
+	keyType := nftableslib.GenSetKeyType(nftables.TypeIPAddr, nftables.TypeInetService)
+	if _, err := tbl.Sets().CreateSet(&nftableslib.SetAttributes{
+		Name:     "addr-port",
+		Interval: true,
+		IsMap:    true,
+		KeyType:  keyType,
+		DataType: nftables.TypeMark,
+	}, nil); err != nil {
+		t.Fatalf("failed to create set addr-port with error: %+v", err)
+	}
+	if _, err := tbl.Sets().CreateSet(&nftableslib.SetAttributes{
+		Name:     "verdicts",
+		IsMap:    true,
+		KeyType:  nftables.TypeInetService,
+		DataType: nftables.TypeVerdict,
+	}, nil); err != nil {
+		t.Fatalf("failed to create set verdicts with error: %+v", err)
+	}
+
+	// Discovering sets with a fresh store
+	ti := nftableslib.InitNFTables(m)
+	if _, err := ti.Tables().Sync(nftables.TableFamilyIPv4); err != nil {
+		t.Fatalf("failed to sync tables with error: %+v", err)
+	}
+	stbl, err := ti.Tables().TableSets("filter-v4", nftables.TableFamilyIPv4)
+	if err != nil {
+		t.Fatalf("failed to get sets interface for synced table filter-v4")
+	}
+	sets, err := stbl.Sets().GetSets()
+	if err != nil {
+		t.Fatalf("failed to get sets with error: %+v", err)
+	}
+	for _, set := range sets {
+		switch set.Name {
+		case "addr-port":
+			if set.KeyType.GetNFTMagic() != keyType.GetNFTMagic() || set.KeyType.Bytes != keyType.Bytes {
+				t.Errorf("set addr-port has wrong key type: %+v", set.KeyType)
+			}
+			if !set.IsMap || !set.Interval || set.DataType.Name != nftables.TypeMark.Name {
+				t.Errorf("set addr-port has wrong attributes: %+v", set)
+			}
+		case "verdicts":
+			if !set.IsMap || set.DataType.GetNFTMagic() != nftables.TypeVerdict.GetNFTMagic() {
+				t.Errorf("set verdicts has wrong attributes: %+v", set)
+			}
+		default:
+			t.Errorf("unexpected set %s", set.Name)
+		}
+	}
+
+	key := append(net.ParseIP("10.0.0.1").To4(), binaryutil.BigEndian.PutUint16(8080)...)
+	key = append(key, 0, 0)
+	if err := stbl.Sets().SetAddElements("addr-port", []nftables.SetElement{
+		{Key: key, Val: binaryutil.NativeEndian.PutUint32(1)},
+	}); err != nil {
+		t.Fatalf("failed to add element to synced set with error: %+v", err)
+	}
+	elements, err := stbl.Sets().GetSetElements("addr-port")
+	if err != nil {
+		t.Fatalf("failed to get elements with error: %+v", err)
+	}
+	if len(elements) != 2 || !elements[1].IntervalEnd {
+		t.Fatalf("expected an element and the interval end, got: %+v", elements)
+	}
+
+	// Store attributes diverging from the host are reported
+	if _, err := stbl.Sets().CreateSet(&nftableslib.SetAttributes{
+		Name:    "addr-port",
+		KeyType: nftables.TypeIPAddr,
+	}, nil); err != nil {
+		t.Fatalf("failed to recreate set addr-port with error: %+v", err)
+	}
+	m.Lock()
+	ms := m.ruleset.getSet(&nftables.Table{Name: "filter-v4", Family: nftables.TableFamilyIPv4}, "addr-port")
+	ms.set.KeyType = keyType
+	m.Unlock()
+	err = stbl.Sets().Sync()
+	mismatch, ok := err.(*nftableslib.ErrSetMismatch)
+	if !ok {
+		t.Fatalf("expected ErrSetMismatch but got: %+v", err)
+	}
+	if len(mismatch.Mismatches["addr-port"]) == 0 {
+		t.Fatalf("expected mismatches for set addr-port, got: %+v", mismatch)
+	}
+}
+
+func TestSetAddElementsIntervals(t *testing.T) {
+	m := InitMockConn()
+	if err := m.ti.Tables().CreateImm("filter-v4", nftables.TableFamilyIPv4); err != nil {
+		t.Fatalf("failed to create table filter-v4 with error: %+v", err)
+	}
+	tbl, _ := m.ti.Tables().TableSets("filter-v4", nftables.TableFamilyIPv4)
+	for _, attrs := range []*nftableslib.SetAttributes{
+		{Name: "created", KeyType: nftables.TypeIPAddr, Interval: true},
+		{Name: "addrs", KeyType: nftables.TypeIPAddr, Interval: true},
+		{Name: "ports", KeyType: nftables.TypeInetService, Interval: true},
+	} {
+		if _, err := tbl.Sets().CreateSet(attrs, nil); err != nil {
+			t.Fatalf("failed to create set %s with error: %+v", attrs.Name, err)
+		}
+	}
+	ti := nftableslib.InitNFTables(m)
+	if _, err := ti.Tables().Sync(nftables.TableFamilyIPv4); err != nil {
+		t.Fatalf("failed to sync tables with error: %+v", err)
+	}
+	stbl, _ := ti.Tables().TableSets("filter-v4", nftables.TableFamilyIPv4)
+
+	tests := []struct {
+		name     string
+		sets     nftableslib.SetsInterface
+		set      string
+		elements []nftables.SetElement
+		expect   []nftables.SetElement
+	}{
+		{
+			name:     "set created by the store keeps elements as passed",
+			sets:     tbl,
+			set:      "created",
+			elements: []nftables.SetElement{{Key: []byte{10, 0, 0, 1}}},
+			expect:   []nftables.SetElement{{Key: []byte{10, 0, 0, 1}}},
+		},
+		{
+			name:     "discovered set closes single value interval",
+			sets:     stbl,
+			set:      "addrs",
+			elements: []nftables.SetElement{{Key: []byte{10, 0, 0, 1}}},
+			expect:   []nftables.SetElement{{Key: []byte{10, 0, 0, 1}}, {Key: []byte{10, 0, 0, 2}, IntervalEnd: true}},
+		},
+		{
+			name:     "discovered set leaves interval of maximum address open",
+			sets:     stbl,
+			set:      "addrs",
+			elements: []nftables.SetElement{{Key: []byte{255, 255, 255, 255}}},
+			expect:   []nftables.SetElement{{Key: []byte{255, 255, 255, 255}}},
+		},
+		{
+			name:     "discovered set leaves interval of maximum port open",
+			sets:     stbl,
+			set:      "ports",
+			elements: []nftables.SetElement{{Key: binaryutil.BigEndian.PutUint16(65535)}},
+			expect:   []nftables.SetElement{{Key: binaryutil.BigEndian.PutUint16(65535)}},
+		},
+	}
+	for _, tt := range tests {
+		before, _ := tt.sets.Sets().GetSetElements(tt.set)
+		if err := tt.sets.Sets().SetAddElements(tt.set, tt.elements); err != nil {
+			t.Fatalf("Test \"%s\" failed with error: %+v but supposed to succeed", tt.name, err)
+		}
+		after, err := tt.sets.Sets().GetSetElements(tt.set)
+		if err != nil {
+			t.Fatalf("Test \"%s\" failed to get elements with error: %+v", tt.name, err)
+		}
+		added := after[len(before):]
+		if len(added) != len(tt.expect) {
+			t.Fatalf("Test \"%s\" failed, expected elements %+v, got %+v", tt.name, tt.expect, added)
+		}
+		for i := range added {
+			if !reflect.DeepEqual(added[i].Key, tt.expect[i].Key) || added[i].IntervalEnd != tt.expect[i].IntervalEnd {
+				t.Fatalf("Test \"%s\" failed, expected elements %+v, got %+v", tt.name, tt.expect, added)
+			}
+		}
+	}
+}
+
+func ipv4Elements(n int) []nftables.SetElement {
+	se := make([]nftables.SetElement, 0, n)
+	for i := 0; i < n; i++ {
+		se = append(se, nftables.SetElement{Key: []byte{10, byte(i >> 16), byte(i >> 8), byte(i)}})
+	}
+	return se
+}
+
+func setupBatchSet(tb testing.TB) nftableslib.SetsInterface {
+	m := InitMockConn()
+	if err := m.ti.Tables().CreateImm("filter-v4", nftables.TableFamilyIPv4); err != nil {
+		tb.Fatalf("failed to create table filter-v4 with error: %+v", err)
+	}
+	si, err := m.ti.Tables().TableSets("filter-v4", nftables.TableFamilyIPv4)
+	if err != nil {
+		tb.Fatalf("failed to get sets interface for table filter-v4")
+	}
+	if _, err := si.Sets().CreateSet(&nftableslib.SetAttributes{
+		Name:    "addresses",
+		KeyType: nftables.TypeIPAddr,
+	}, nil); err != nil {
+		tb.Fatalf("failed to create set addresses with error: %+v", err)
+	}
+	return si
+}
+
+func TestSetElementsBatch(t *testing.T) {
+	si := setupBatchSet(t)
+	elements := ipv4Elements(2000)
+	if err := si.Sets().SetAddElementsBatch("addresses", elements, 300); err != nil {
+		t.Fatalf("failed to add elements with error: %+v", err)
+	}
+	se, err := si.Sets().GetSetElements("addresses")
+	if err != nil {
+		t.Fatalf("failed to get elements with error: %+v", err)
+	}
+	if len(se) != len(elements) {
+		t.Fatalf("expected %d elements, got %d", len(elements), len(se))
+	}
+	if err := si.Sets().SetDelElementsBatch("addresses", elements[:1500]); err != nil {
+		t.Fatalf("failed to delete elements with error: %+v", err)
+	}
+	se, _ = si.Sets().GetSetElements("addresses")
+	if len(se) != 500 {
+		t.Fatalf("expected 500 elements, got %d", len(se))
+	}
+	if err := si.Sets().SetAddElementsBatch("missing", elements); err == nil {
+		t.Fatalf("expected to fail adding elements to a missing set")
+	}
+}
+
+func TestSetElementsBatchLarge(t *testing.T) {
+	elements := ipv4Elements(100000)
+	m := InitMockConn()
+	if err := m.ti.Tables().CreateImm("filter-v4", nftables.TableFamilyIPv4); err != nil {
+		t.Fatalf("failed to create table filter-v4 with error: %+v", err)
+	}
+	si, _ := m.ti.Tables().TableSets("filter-v4", nftables.TableFamilyIPv4)
+	if _, err := si.Sets().CreateSet(&nftableslib.SetAttributes{Name: "addresses", KeyType: nftables.TypeIPAddr}, nil); err != nil {
+		t.Fatalf("failed to create set addresses with error: %+v", err)
+	}
+	// Elements exceeding a single transaction are programmed by consecutive transactions
+	gen, _ := m.GetGenID()
+	if err := si.Sets().SetAddElementsBatch("addresses", elements); err != nil {
+		t.Fatalf("failed to add elements with error: %+v", err)
+	}
+	se, _ := si.Sets().GetSetElements("addresses")
+	if len(se) != len(elements) {
+		t.Fatalf("expected %d elements, got %d", len(elements), len(se))
+	}
+	if g, _ := m.GetGenID(); g-gen < 2 {
+		t.Fatalf("expected elements to be programmed by several transactions, got %d", g-gen)
+	}
+	if err := si.Sets().SetDelElementsBatch("addresses", elements); err != nil {
+		t.Fatalf("failed to delete elements with error: %+v", err)
+	}
+	if se, _ = si.Sets().GetSetElements("addresses"); len(se) != 0 {
+		t.Fatalf("expected no elements, got %d", len(se))
+	}
+
+	// Chunks of transactions committed before the rejected one stay programmed
+	m.RejectElement(elements[len(elements)-1].Key, unix.EINVAL)
+	err := si.Sets().SetAddElementsBatch("addresses", elements)
+	e, ok := err.(*nftableslib.ErrElementsBatch)
+	if !ok || e.Chunk != -1 || !errors.Is(e, unix.EINVAL) {
+		t.Fatalf("expected rejected transaction, got: %+v", err)
+	}
+	if e.Committed == 0 || e.Committed >= e.Chunks {
+		t.Fatalf("expected some of %d chunks to be committed, got %d", e.Chunks, e.Committed)
+	}
+	se, _ = si.Sets().GetSetElements("addresses")
+	if want := e.Committed * nftableslib.DefaultElementsChunkSize; len(se) != want {
+		t.Fatalf("expected %d elements of committed chunks, got %d", want, len(se))
+	}
+}
+
+func TestSetAddElementsResilient(t *testing.T) {
+	elements := ipv4Elements(5000)
+	tests := []struct {
+		name       string
+		rejected   []int
+		commitGood bool
+	}{
+		{name: "Single rejected element, good elements committed", rejected: []int{3172}, commitGood: true},
+		{name: "Single rejected element, nothing committed", rejected: []int{3172}},
+		{name: "Rejected elements in both halves", rejected: []int{0, 2499, 4999}, commitGood: true},
+		{name: "Rejected elements in both halves, nothing committed", rejected: []int{0, 2499, 4999}},
+	}
+	for _, tt := range tests {
+		m := InitMockConn()
+		if err := m.ti.Tables().CreateImm("filter-v4", nftables.TableFamilyIPv4); err != nil {
+			t.Fatalf("failed to create table filter-v4 with error: %+v", err)
+		}
+		si, _ := m.ti.Tables().TableSets("filter-v4", nftables.TableFamilyIPv4)
+		// The element of the batch the set carries before is kept when nothing is committed
+		if _, err := si.Sets().CreateSet(&nftableslib.SetAttributes{Name: "addresses", KeyType: nftables.TypeIPAddr},
+			elements[10:11]); err != nil {
+			t.Fatalf("failed to create set addresses with error: %+v", err)
+		}
+		for _, i := range tt.rejected {
+			m.RejectElement(elements[i].Key, unix.EINVAL)
+		}
+		err := si.Sets().SetAddElementsResilient("addresses", elements, &nftableslib.ResilientBatchOptions{
+			ChunkSize:  300,
+			CommitGood: tt.commitGood,
+		})
+		re, ok := err.(*nftableslib.ErrRejectedElements)
+		if !ok {
+			t.Fatalf("Test \"%s\" expected ErrRejectedElements but got: %+v", tt.name, err)
+		}
+		if len(re.Rejected) != len(tt.rejected) {
+			t.Fatalf("Test \"%s\" expected %d rejected elements, got %d", tt.name, len(tt.rejected), len(re.Rejected))
+		}
+		for i, r := range re.Rejected {
+			want := elements[tt.rejected[i]]
+			if r.Index != tt.rejected[i] || !reflect.DeepEqual(r.Element.Key, want.Key) {
+				t.Fatalf("Test \"%s\" expected rejected element %d, got %d", tt.name, tt.rejected[i], r.Index)
+			}
+			if r.Err != unix.EINVAL || !reflect.DeepEqual(r.Decoded.Key, []string{net.IP(want.Key).String()}) {
+				t.Fatalf("Test \"%s\" unexpected rejected element %+v", tt.name, *r)
+			}
+		}
+		se, _ := si.Sets().GetSetElements("addresses")
+		want := 1
+		if tt.commitGood {
+			want = len(elements) - len(tt.rejected)
+			if re.Committed != want {
+				t.Fatalf("Test \"%s\" expected %d committed elements, got %d", tt.name, want, re.Committed)
+			}
+		}
+		// The mock keeps duplicates of elements the set carries
+		keys := make(map[string]bool, len(se))
+		for _, e := range se {
+			keys[string(e.Key)] = true
+		}
+		if len(keys) != want {
+			t.Fatalf("Test \"%s\" expected %d elements in the set, got %d", tt.name, want, len(keys))
+		}
+	}
+}
+
+func TestSetAddElementsResilientInterval(t *testing.T) {
+	m := InitMockConn()
+	if err := m.ti.Tables().CreateImm("filter-v4", nftables.TableFamilyIPv4); err != nil {
+		t.Fatalf("failed to create table filter-v4 with error: %+v", err)
+	}
+	si, _ := m.ti.Tables().TableSets("filter-v4", nftables.TableFamilyIPv4)
+	if _, err := si.Sets().CreateSet(&nftableslib.SetAttributes{Name: "ranges", KeyType: nftables.TypeIPAddr, Interval: true}, nil); err != nil {
+		t.Fatalf("failed to create set ranges with error: %+v", err)
+	}
+	elements := []nftables.SetElement{
+		{Key: net.ParseIP("192.0.2.0").To4()},
+		{Key: net.ParseIP("192.0.2.128").To4(), IntervalEnd: true},
+		{Key: net.ParseIP("198.51.100.0").To4()},
+		{Key: net.ParseIP("198.51.101.0").To4(), IntervalEnd: true},
+		{Key: net.ParseIP("203.0.113.7").To4()},
+	}
+	// Rejection of the element closing the interval is reported for the element opening it
+	m.RejectElement(elements[3].Key, unix.ERANGE)
+	// Operations queued before are programmed by their own transaction
+	if err := m.ti.Tables().Create("nat-v4", nftables.TableFamilyIPv4); err != nil {
+		t.Fatalf("failed to queue table nat-v4 with error: %+v", err)
+	}
+	err := si.Sets().SetAddElementsResilient("ranges", elements, &nftableslib.ResilientBatchOptions{CommitGood: true})
+	re, ok := err.(*nftableslib.ErrRejectedElements)
+	if !ok {
+		t.Fatalf("expected ErrRejectedElements but got: %+v", err)
+	}
+	if len(re.Rejected) != 1 || re.Rejected[0].Index != 2 || re.Rejected[0].Err != unix.ERANGE || re.Committed != 3 {
+		t.Fatalf("unexpected rejected elements %+v", *re)
+	}
+	se, _ := si.Sets().GetSetElements("ranges")
+	// Two intervals and the single address closed by the next address
+	if len(se) != 4 {
+		t.Fatalf("expected 4 elements in the set, got %+v", se)
+	}
+	tables, _ := m.ListTables()
+	if len(tables) != 2 {
+		t.Fatalf("queued table was not programmed, tables %+v", tables)
+	}
+}
+
+func BenchmarkSetAddElementsBatch(b *testing.B) {
+	elements := ipv4Elements(100000)
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		si := setupBatchSet(b)
+		b.StartTimer()
+		if err := si.Sets().SetAddElementsBatch("addresses", elements); err != nil {
+			b.Fatalf("failed to add elements with error: %+v", err)
+		}
+	}
+}
+
+func BenchmarkSetDelElementsBatch(b *testing.B) {
+	elements := ipv4Elements(100000)
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		si := setupBatchSet(b)
+		if err := si.Sets().SetAddElementsBatch("addresses", elements); err != nil {
+			b.Fatalf("failed to add elements with error: %+v", err)
+		}
+		b.StartTimer()
+		if err := si.Sets().SetDelElementsBatch("addresses", elements); err != nil {
+			b.Fatalf("failed to delete elements with error: %+v", err)
+		}
+	}
+}
+
+func TestIterateSetElements(t *testing.T) {
+	si := setupBatchSet(t)
+	if err := si.Sets().SetAddElementsBatch("addresses", ipv4Elements(100)); err != nil {
+		t.Fatalf("failed to add elements with error: %+v", err)
+	}
+	count := 0
+	if err := si.Sets().IterateSetElements("addresses", func(e nftables.SetElement) error {
+		count++
+		if count == 10 {
+			return nftableslib.ErrStopIteration
+		}
+		return nil
+	}); err != nil {
+		t.Fatalf("failed to iterate elements with error: %+v", err)
+	}
+	if count != 10 {
+		t.Fatalf("expected iteration to stop after 10 elements, got %d", count)
+	}
+	keys := make([]string, 0)
+	if err := si.Sets().IterateSetElementsDecoded("addresses", func(e *nftableslib.DecodedElement) error {
+		keys = append(keys, e.Key...)
+		return nil
+	}); err != nil {
+		t.Fatalf("failed to iterate decoded elements with error: %+v", err)
+	}
+	if len(keys) != 100 || keys[0] != "10.0.0.0" || keys[99] != "10.0.0.99" {
+		t.Fatalf("unexpected decoded keys: %v", keys)
+	}
+	if err := si.Sets().IterateSetElements("missing", func(nftables.SetElement) error { return nil }); err == nil {
+		t.Fatalf("expected to fail iterating elements of a missing set")
+	}
+}
+
+func TestVMapEntries(t *testing.T) {
+	m := InitMockConn()
+	if err := m.ti.Tables().CreateImm("filter", nftables.TableFamilyIPv4); err != nil {
+		t.Fatalf("failed to create table filter with error: %+v", err)
+	}
+	ci, _ := m.ti.Tables().Table("filter", nftables.TableFamilyIPv4)
+	si, _ := m.ti.Tables().TableSets("filter", nftables.TableFamilyIPv4)
+	for _, c := range []string{"web", "ssh"} {
+		if err := ci.Chains().CreateImm(c, nil); err != nil {
+			t.Fatalf("failed to create chain %s with error: %+v", c, err)
+		}
+	}
+	element := func(port uint16, kind int, chain ...string) nftables.SetElement {
+		e, err := nftableslib.MakeConcatElement([]nftables.SetDatatype{nftables.TypeInetService},
+			[]nftableslib.ElementValue{{InetService: &port}}, setActionVerdict(t, kind, chain...))
+		if err != nil {
+			t.Fatalf("failed to make element for port %d with error: %+v", port, err)
+		}
+		return *e
+	}
+	if _, err := si.Sets().CreateSet(&nftableslib.SetAttributes{
+		Name:     "services",
+		IsMap:    true,
+		KeyType:  nftableslib.GenSetKeyType(nftables.TypeInetService),
+		DataType: nftables.TypeVerdict,
+	}, []nftables.SetElement{
+		element(80, unix.NFT_JUMP, "web"),
+		element(22, unix.NFT_GOTO, "ssh"),
+		element(23, nftableslib.NFT_DROP),
+	}); err != nil {
+		t.Fatalf("failed to create map services with error: %+v", err)
+	}
+	entries, err := si.Sets().VMapEntries("services")
+	if err != nil {
+		t.Fatalf("failed to get entries of map services with error: %+v", err)
+	}
+	want := map[string]string{"80": "jump web", "22": "goto ssh", "23": "drop"}
+	if !reflect.DeepEqual(entries, want) {
+		t.Fatalf("expected entries %v, got %v", want, entries)
+	}
+	if err := si.Sets().IterateSetElementsDecoded("services", func(e *nftableslib.DecodedElement) error {
+		if e.Key[0] != "80" {
+			return nil
+		}
+		if e.Action == nil || e.Action.Kind != unix.NFT_JUMP || e.Action.Chain != "web" {
+			t.Errorf("expected element 80 to jump to web, got %+v", e.Action)
+		}
+		return nil
+	}); err != nil {
+		t.Fatalf("failed to iterate elements with error: %+v", err)
+	}
+
+	// Elements of plain sets do not carry verdicts
+	if _, err := si.Sets().CreateSet(&nftableslib.SetAttributes{
+		Name:    "ports",
+		KeyType: nftables.TypeInetService,
+	}, []nftables.SetElement{{Key: binaryutil.BigEndian.PutUint16(80)}}); err != nil {
+		t.Fatalf("failed to create set ports with error: %+v", err)
+	}
+	if _, err := si.Sets().VMapEntries("ports"); err == nil {
+		t.Fatalf("entries of set without verdicts supposed to fail")
+	}
+}
+
+func TestInvalidElements(t *testing.T) {
+	m := InitMockConn()
+	if err := m.ti.Tables().CreateImm("filter-v6", nftables.TableFamilyIPv6); err != nil {
+		t.Fatalf("failed to create table filter-v6 with error: %+v", err)
+	}
+	si, _ := m.ti.Tables().TableSets("filter-v6", nftables.TableFamilyIPv6)
+	v4 := nftables.SetElement{Key: net.ParseIP("10.0.0.1").To4()}
+	v6 := nftables.SetElement{Key: net.ParseIP("2001:db8::1").To16()}
+	_, err := si.Sets().CreateSet(&nftableslib.SetAttributes{Name: "addresses", KeyType: nftables.TypeIP6Addr},
+		[]nftables.SetElement{v6, v4})
+	ee, ok := err.(*nftableslib.ErrInvalidElement)
+	if !ok || ee.Set != "addresses" || ee.Index != 1 {
+		t.Fatalf("expected element 1 of set addresses to be invalid, got %T: %+v", err, err)
+	}
+	if sets, _ := m.GetSets(&nftables.Table{Name: "filter-v6", Family: nftables.TableFamilyIPv6}); len(sets) != 0 {
+		t.Fatalf("expected set with invalid elements not to be programmed")
+	}
+	if _, err := si.Sets().CreateSet(&nftableslib.SetAttributes{Name: "addresses", KeyType: nftables.TypeIP6Addr},
+		[]nftables.SetElement{v6}); err != nil {
+		t.Fatalf("failed to create set addresses with error: %+v", err)
+	}
+	if err := si.Sets().SetAddElements("addresses", []nftables.SetElement{v4}); err == nil {
+		t.Fatalf("adding ipv4 address to set of ipv6 addresses supposed to fail")
+	}
+	if _, err := si.Sets().CreateSet(&nftableslib.SetAttributes{Name: "services", IsMap: true, KeyType: nftables.TypeInetService}, nil); err == nil {
+		t.Fatalf("map without data type supposed to fail")
+	}
+}
+
+func TestWeightedLoadbalanceUpdate(t *testing.T) {
+	m := InitMockConn()
+	if err := m.ti.Tables().CreateImm("nat-v4", nftables.TableFamilyIPv4); err != nil {
+		t.Fatalf("failed to create table nat-v4 with error: %+v", err)
+	}
+	ci, _ := m.ti.Tables().Table("nat-v4", nftables.TableFamilyIPv4)
+	si, _ := m.ti.Tables().TableSets("nat-v4", nftables.TableFamilyIPv4)
+	for _, c := range []string{"backend-a", "backend-b"} {
+		if err := ci.Chains().CreateImm(c, nil); err != nil {
+			t.Fatalf("failed to create chain %s with error: %+v", c, err)
+		}
+	}
+	if err := ci.Chains().CreateImm("prerouting", &nftableslib.ChainAttributes{
+		Type:     nftables.ChainTypeNAT,
+		Hook:     nftables.ChainHookPrerouting,
+		Priority: nftables.ChainPriorityNATDest,
+	}); err != nil {
+		t.Fatalf("failed to create chain prerouting with error: %+v", err)
+	}
+	weighted := func(a, b int) []nftables.SetElement {
+		elements, err := nftableslib.MakeWeightedLoadbalanceElements([]*nftableslib.WeightedChain{
+			{Chain: "backend-a", Weight: a},
+			{Chain: "backend-b", Weight: b},
+		}, nftableslib.DefaultWeightedLoadbalanceModulus, unix.NFT_GOTO)
+		if err != nil {
+			t.Fatalf("failed to make weighted elements with error: %+v", err)
+		}
+		return elements
+	}
+	set, err := si.Sets().CreateSet(&nftableslib.SetAttributes{
+		Name:     "lb",
+		IsMap:    true,
+		Interval: true,
+		KeyType:  nftables.TypeInteger,
+		DataType: nftables.TypeVerdict,
+	}, weighted(70, 30))
+	if err != nil {
+		t.Fatalf("failed to create map lb with error: %+v", err)
+	}
+	ra, err := nftableslib.SetWeightedLoadbalance(&nftableslib.SetRef{Name: set.Name, ID: set.ID, IsMap: true},
+		nftableslib.DefaultWeightedLoadbalanceModulus, unix.NFT_NG_RANDOM)
+	if err != nil {
+		t.Fatalf("failed to build weighted loadbalancing action with error: %+v", err)
+	}
+	ri, _ := ci.Chains().Chain("prerouting")
+	handle, err := ri.Rules().CreateImm(&nftableslib.Rule{Action: ra})
+	if err != nil {
+		t.Fatalf("failed to create weighted loadbalancing rule with error: %+v", err)
+	}
+
+	// Shares of the chains are read back from the map's intervals
+	shares := func() map[string]uint32 {
+		elements, err := si.Sets().GetSetElements("lb")
+		if err != nil {
+			t.Fatalf("failed to get elements of map lb with error: %+v", err)
+		}
+		s := map[string]uint32{}
+		for i := 0; i+1 < len(elements); i += 2 {
+			start, end := elements[i], elements[i+1]
+			s[start.VerdictData.Chain] = binaryutil.NativeEndian.Uint32(end.Key) - binaryutil.NativeEndian.Uint32(start.Key)
+		}
+		return s
+	}
+	for _, tt := range []struct {
+		a, b int
+		want map[string]uint32
+	}{
+		{a: 70, b: 30, want: map[string]uint32{"backend-a": 70, "backend-b": 30}},
+		{a: 1, b: 3, want: map[string]uint32{"backend-a": 25, "backend-b": 75}},
+		{a: 0, b: 1, want: map[string]uint32{"backend-b": 100}},
+	} {
+		if err := si.Sets().SetReplaceElements("lb", weighted(tt.a, tt.b)); err != nil {
+			t.Fatalf("failed to replace elements of map lb with error: %+v", err)
+		}
+		if got := shares(); !reflect.DeepEqual(got, tt.want) {
+			t.Fatalf("weights %d:%d expected shares %v, got %v", tt.a, tt.b, tt.want, got)
+		}
+	}
+	rules, _ := m.GetRule(&nftables.Table{Name: "nat-v4", Family: nftables.TableFamilyIPv4},
+		&nftables.Chain{Name: "prerouting"})
+	if len(rules) != 1 || rules[0].Handle != handle {
+		t.Fatalf("weighted loadbalancing rule was recreated")
+	}
+}
+
+func TestDNATMapUpdate(t *testing.T) {
+	m := InitMockConn()
+	if err := m.ti.Tables().CreateImm("nat-v4", nftables.TableFamilyIPv4); err != nil {
+		t.Fatalf("failed to create table nat-v4 with error: %+v", err)
+	}
+	ci, _ := m.ti.Tables().Table("nat-v4", nftables.TableFamilyIPv4)
+	si, _ := m.ti.Tables().TableSets("nat-v4", nftables.TableFamilyIPv4)
+	if err := ci.Chains().CreateImm("prerouting", &nftableslib.ChainAttributes{
+		Type:     nftables.ChainTypeNAT,
+		Hook:     nftables.ChainHookPrerouting,
+		Priority: nftables.ChainPriorityNATDest,
+	}); err != nil {
+		t.Fatalf("failed to create chain prerouting with error: %+v", err)
+	}
+	attrs := &nftableslib.DNATMapAttributes{
+		Name:     "forwards",
+		L4Proto:  unix.IPPROTO_TCP,
+		WithPort: true,
+		Targets: map[uint16]*nftableslib.DNATTarget{
+			8080: {Addr: setIPAddr(t, "10.0.0.1"), Port: 80},
+			8443: {Addr: setIPAddr(t, "10.0.0.2"), Port: 443},
+		},
+	}
+	ra, err := nftableslib.SetDNATMap(attrs)
+	if err != nil {
+		t.Fatalf("failed to build dnat map action with error: %+v", err)
+	}
+	ri, _ := ci.Chains().Chain("prerouting")
+	handle, err := ri.Rules().CreateImm(&nftableslib.Rule{Action: ra})
+	if err != nil {
+		t.Fatalf("failed to create dnat map rule with error: %+v", err)
+	}
+	elements := func() []nftables.SetElement {
+		elements, err := si.Sets().GetSetElements("forwards")
+		if err != nil {
+			t.Fatalf("failed to get elements of map forwards with error: %+v", err)
+		}
+		return elements
+	}
+	want, _ := nftableslib.MakeDNATMapElements(nftables.TableFamilyIPv4, attrs.Targets, true)
+	if got := elements(); len(got) != 2 || !reflect.DeepEqual(got[0].Val, []byte{10, 0, 0, 1, 0, 80, 0, 0}) ||
+		!reflect.DeepEqual(got[1].Val, want[1].Val) {
+		t.Fatalf("expected elements %+v, got %+v", want, got)
+	}
+
+	// Forwarding of the port is changed and a port is added without touching the rule
+	update, err := nftableslib.MakeDNATMapElements(nftables.TableFamilyIPv4, map[uint16]*nftableslib.DNATTarget{
+		8080: {Addr: setIPAddr(t, "10.0.0.3"), Port: 8080},
+		2222: {Addr: setIPAddr(t, "10.0.0.4"), Port: 22},
+	}, true)
+	if err != nil {
+		t.Fatalf("failed to make elements with error: %+v", err)
+	}
+	if err := si.Sets().SetReplaceElements("forwards", update); err != nil {
+		t.Fatalf("failed to replace elements of map forwards with error: %+v", err)
+	}
+	if got := elements(); len(got) != 2 {
+		t.Fatalf("expected elements %+v, got %+v", update, got)
+	}
+	if err := si.Sets().SetAddElements("forwards", []nftables.SetElement{{Key: []byte{0, 80}, Val: []byte{10, 0, 0, 5}}}); err == nil {
+		t.Fatalf("element without port supposed to fail")
+	}
+	// Updating the rule refers to the existing map
+	attrs.FullyRandom = true
+	ra, _ = nftableslib.SetDNATMap(attrs)
+	if err := ri.Rules().Update(&nftableslib.Rule{Action: ra}, handle); err != nil {
+		t.Fatalf("failed to update dnat map rule with error: %+v", err)
+	}
+	if got := elements(); len(got) != 2 {
+		t.Fatalf("map forwards was recreated by the rule update, got elements %+v", got)
+	}
+	rules, _ := m.GetRule(&nftables.Table{Name: "nat-v4", Family: nftables.TableFamilyIPv4},
+		&nftables.Chain{Name: "prerouting"})
+	if len(rules) != 1 || rules[0].Handle != handle {
+		t.Fatalf("dnat map rule was recreated")
+	}
+	// Map of addresses cannot be referred to by the rule expecting addresses and ports
+	attrs.WithPort = false
+	attrs.Targets = nil
+	ra, _ = nftableslib.SetDNATMap(attrs)
+	if _, err := ri.Rules().CreateImm(&nftableslib.Rule{Action: ra}); err == nil {
+		t.Fatalf("dnat map rule of mismatching map supposed to fail")
+	}
+}
+
+func TestInterfaceSet(t *testing.T) {
+	m := InitMockConn()
+	if err := m.ti.Tables().CreateImm("filter", nftables.TableFamilyINet); err != nil {
+		t.Fatalf("failed to create table filter with error: %+v", err)
+	}
+	si, _ := m.ti.Tables().TableSets("filter", nftables.TableFamilyINet)
+	pods, err := nftableslib.NewInterfaceSet(si, "pods")
+	if err != nil {
+		t.Fatalf("failed to create interface set pods with error: %+v", err)
+	}
+	ci, _ := m.ti.Tables().Table("filter", nftables.TableFamilyINet)
+	if err := ci.Chains().CreateImm("forward", &nftableslib.ChainAttributes{
+		Type:     nftables.ChainTypeFilter,
+		Hook:     nftables.ChainHookForward,
+		Priority: nftables.ChainPriorityFilter,
+	}); err != nil {
+		t.Fatalf("failed to create chain forward with error: %+v", err)
+	}
+	ri, _ := ci.Chains().Chain("forward")
+	// iifname @pods accept, the rule does not change as interfaces come and go
+	if _, err := ri.Rules().CreateImm(&nftableslib.Rule{
+		Meta:   &nftableslib.MetaRule{IIFNameSet: &nftableslib.IfNameSet{SetRef: pods.SetRef()}},
+		Action: setActionVerdict(t, nftableslib.NFT_ACCEPT),
+	}); err != nil {
+		t.Fatalf("failed to create rule matching interface set with error: %+v", err)
+	}
+	for _, n := range []string{"veth1", "veth2", "veth3"} {
+		if err := pods.Add(n); err != nil {
+			t.Fatalf("failed to add interface %s with error: %+v", n, err)
+		}
+	}
+	if err := pods.Remove("veth2"); err != nil {
+		t.Fatalf("failed to remove interface veth2 with error: %+v", err)
+	}
+	if err := pods.Add("veth0123456789ab"); err == nil {
+		t.Fatalf("adding interface with name of 16 characters supposed to fail")
+	}
+	names, err := pods.Interfaces()
+	if err != nil {
+		t.Fatalf("failed to get interfaces with error: %+v", err)
+	}
+	if want := []string{"veth1", "veth3"}; !reflect.DeepEqual(names, want) {
+		t.Fatalf("expected interfaces %v, got %v", want, names)
+	}
+	elements, _ := si.Sets().GetSetElements("pods")
+	for _, e := range elements {
+		if len(e.Key) != int(nftableslib.TypeIFName.Bytes) || e.Key[len(e.Key)-1] != 0 {
+			t.Fatalf("element %q is not padded to %d bytes", e.Key, nftableslib.TypeIFName.Bytes)
+		}
+	}
+	// The set is adopted by a new InterfaceSet
+	if _, err := nftableslib.NewInterfaceSet(si, "pods"); err != nil {
+		t.Fatalf("failed to adopt interface set pods with error: %+v", err)
+	}
+	if _, err := si.Sets().CreateSet(&nftableslib.SetAttributes{Name: "ports", KeyType: nftables.TypeInetService}, nil); err != nil {
+		t.Fatalf("failed to create set ports with error: %+v", err)
+	}
+	if _, err := nftableslib.NewInterfaceSet(si, "ports"); err == nil {
+		t.Fatalf("adopting set of ports as interface set supposed to fail")
+	}
+}
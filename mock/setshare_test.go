@@ -0,0 +1,129 @@
+package mock
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/sbezverk/nftableslib"
+	"golang.org/x/sys/unix"
+)
+
+func TestSetSharing(t *testing.T) {
+	m := InitMockConn()
+	src := &nftables.Table{Name: "shared", Family: nftables.TableFamilyIPv4}
+	dst := &nftables.Table{Name: "filter", Family: nftables.TableFamilyIPv4}
+	for _, table := range []*nftables.Table{src, dst} {
+		if err := m.ti.Tables().CreateImm(table.Name, table.Family); err != nil {
+			t.Fatalf("failed to create table %s with error: %+v", table.Name, err)
+		}
+	}
+	ssi, err := m.ti.Tables().TableSets(src.Name, src.Family)
+	if err != nil {
+		t.Fatalf("failed to get sets with error: %+v", err)
+	}
+	blocked, err := ssi.Sets().CreateSet(&nftableslib.SetAttributes{Name: "blocked", Interval: true, KeyType: nftables.TypeIPAddr},
+		[]nftables.SetElement{
+			{Key: net.ParseIP("192.0.2.1").To4()},
+			{Key: net.ParseIP("198.51.100.0").To4()},
+			{Key: net.ParseIP("198.51.101.0").To4(), IntervalEnd: true},
+		})
+	if err != nil {
+		t.Fatalf("failed to create set blocked with error: %+v", err)
+	}
+	ports, err := ssi.Sets().CreateSet(&nftableslib.SetAttributes{Name: "ports", KeyType: nftables.TypeInetService},
+		[]nftables.SetElement{
+			{Key: binaryutil.BigEndian.PutUint16(22)},
+			{Key: binaryutil.BigEndian.PutUint16(443)},
+		})
+	if err != nil {
+		t.Fatalf("failed to create set ports with error: %+v", err)
+	}
+	ci, err := m.ti.Tables().Table(dst.Name, dst.Family)
+	if err != nil {
+		t.Fatalf("failed to get chains with error: %+v", err)
+	}
+	if err := ci.Chains().CreateImm("input", nil); err != nil {
+		t.Fatalf("failed to create chain with error: %+v", err)
+	}
+	ri, err := ci.Chains().Chain("input")
+	if err != nil {
+		t.Fatalf("failed to get rules with error: %+v", err)
+	}
+	rules := []struct {
+		name string
+		set  *nftables.Set
+		rule *nftableslib.Rule
+	}{
+		{
+			name: "address set",
+			set:  blocked,
+			rule: &nftableslib.Rule{
+				L3: &nftableslib.L3Rule{
+					Src: &nftableslib.IPAddrSpec{SetRef: &nftableslib.SetRef{Name: blocked.Name, ID: blocked.ID}},
+				},
+				Action: setActionVerdict(t, nftableslib.NFT_DROP),
+			},
+		},
+		{
+			name: "port set",
+			set:  ports,
+			rule: &nftableslib.Rule{
+				L4: &nftableslib.L4Rule{
+					L4Proto: unix.IPPROTO_TCP,
+					Dst:     &nftableslib.Port{SetRef: &nftableslib.SetRef{Name: ports.Name, ID: ports.ID}},
+				},
+				Action: setActionVerdict(t, nftableslib.NFT_ACCEPT),
+			},
+		},
+	}
+	for _, tt := range rules {
+		_, err := ri.Rules().CreateImm(tt.rule)
+		var other *nftableslib.ErrSetInOtherTable
+		if !errors.As(err, &other) {
+			t.Fatalf("Test \"%s\" expected cross table reference to fail, got error: %+v", tt.name, err)
+		}
+		if other.Set != tt.set.Name || other.Table.Name != dst.Name || other.SetTable.Name != src.Name {
+			t.Fatalf("Test \"%s\" unexpected error: %+v", tt.name, other)
+		}
+	}
+	if n, err := ci.Chains().RuleCount("input"); err != nil || n != 0 {
+		t.Fatalf("expected no rules, got %d error: %+v", n, err)
+	}
+
+	for _, tt := range rules {
+		copied, err := m.ti.Tables().CopySet(src, dst, tt.set.Name)
+		if err != nil {
+			t.Fatalf("Test \"%s\" failed with error: %+v but supposed to succeed", tt.name, err)
+		}
+		if copied.Table.Name != dst.Name || copied.Interval != tt.set.Interval || copied.KeyType.GetNFTMagic() != tt.set.KeyType.GetNFTMagic() {
+			t.Fatalf("Test \"%s\" unexpected copy %+v", tt.name, copied)
+		}
+		want, _ := m.GetSetElements(&nftables.Set{Table: src, Name: tt.set.Name})
+		got, err := m.GetSetElements(copied)
+		if err != nil || len(got) != len(want) {
+			t.Fatalf("Test \"%s\" expected %d elements, got %d error: %+v", tt.name, len(want), len(got), err)
+		}
+		for i := range want {
+			if !bytes.Equal(got[i].Key, want[i].Key) || got[i].IntervalEnd != want[i].IntervalEnd {
+				t.Fatalf("Test \"%s\" element %d differs, %+v and %+v", tt.name, i, got[i], want[i])
+			}
+		}
+		// The rule refers to the copy of the set by its name
+		if _, err := ri.Rules().CreateImm(tt.rule); err != nil {
+			t.Fatalf("Test \"%s\" failed to create rule with error: %+v", tt.name, err)
+		}
+	}
+	if _, err := m.ti.Tables().CopySet(src, dst, ports.Name); err == nil {
+		t.Fatalf("copy of existing set supposed to fail")
+	}
+	if _, err := m.ti.Tables().CopySet(src, src, ports.Name); err == nil {
+		t.Fatalf("copy to the same table supposed to fail")
+	}
+	if _, err := m.ti.Tables().CopySet(src, dst, "missing"); err == nil {
+		t.Fatalf("copy of missing set supposed to fail")
+	}
+}
@@ -0,0 +1,378 @@
+package mock
+
+import (
+	"net"
+	"testing"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"github.com/sbezverk/nftableslib"
+	"golang.org/x/sys/unix"
+)
+
+func TestSimulate(t *testing.T) {
+	table := &nftables.Table{Name: "filter", Family: nftables.TableFamilyIPv4}
+	m := InitMockConn()
+	if err := m.ti.Tables().CreateImm(table.Name, table.Family); err != nil {
+		t.Fatalf("failed to create table with error: %+v", err)
+	}
+	ci, err := m.ti.Tables().Table(table.Name, table.Family)
+	if err != nil {
+		t.Fatalf("failed to get chains with error: %+v", err)
+	}
+	drop := nftableslib.ChainPolicyDrop
+	if err := ci.Chains().CreateImm("input", &nftableslib.ChainAttributes{
+		Type:     nftables.ChainTypeFilter,
+		Hook:     nftables.ChainHookInput,
+		Priority: nftables.ChainPriorityFilter,
+		Policy:   &drop,
+	}); err != nil {
+		t.Fatalf("failed to create chain input with error: %+v", err)
+	}
+	for _, name := range []string{"web", "ntp"} {
+		if err := ci.Chains().CreateImm(name, nil); err != nil {
+			t.Fatalf("failed to create chain %s with error: %+v", name, err)
+		}
+	}
+	si, err := m.ti.Tables().TableSets(table.Name, table.Family)
+	if err != nil {
+		t.Fatalf("failed to get sets with error: %+v", err)
+	}
+	svc, err := si.Sets().CreateSet(&nftableslib.SetAttributes{Name: "svc", IsMap: true, KeyType: nftables.TypeInetService, DataType: nftables.TypeVerdict},
+		[]nftables.SetElement{
+			{Key: binaryutil.BigEndian.PutUint16(53), VerdictData: &expr.Verdict{Kind: expr.VerdictAccept}},
+			{Key: binaryutil.BigEndian.PutUint16(123), VerdictData: &expr.Verdict{Kind: expr.VerdictGoto, Chain: "ntp"}},
+		})
+	if err != nil {
+		t.Fatalf("failed to create map with error: %+v", err)
+	}
+	reject, _ := nftableslib.SetReject(unix.NFT_REJECT_TCP_RST, 0)
+	lo := "lo"
+	chains := []struct {
+		chain string
+		rules []*nftableslib.Rule
+	}{
+		{
+			chain: "input",
+			rules: []*nftableslib.Rule{
+				// 1: ct state established,related accept
+				{
+					Conntracks: []*nftableslib.Conntrack{{
+						Key:   unix.NFT_CT_STATE,
+						Value: binaryutil.BigEndian.PutUint32(nftableslib.CTStateEstablished | nftableslib.CTStateRelated),
+					}},
+					Action: setActionVerdict(t, nftableslib.NFT_ACCEPT),
+				},
+				// 2: iifname lo accept
+				{Meta: &nftableslib.MetaRule{IIFName: &lo}, Action: setActionVerdict(t, nftableslib.NFT_ACCEPT)},
+				// 3: meta mark 0x10 drop
+				{Meta: &nftableslib.MetaRule{Mark: &nftableslib.MetaMark{Value: 0x10}}, Action: setActionVerdict(t, nftableslib.NFT_DROP)},
+				// 4: ip saddr != 10.0.0.0/8 tcp dport 22 reject
+				{
+					L3:     &nftableslib.L3Rule{Src: &nftableslib.IPAddrSpec{List: []*nftableslib.IPAddr{setIPAddr(t, "10.0.0.0/8")}, RelOp: nftableslib.NEQ}},
+					L4:     &nftableslib.L4Rule{L4Proto: unix.IPPROTO_TCP, Dst: &nftableslib.Port{List: []uint16{22}}},
+					Action: reject,
+				},
+				// 5: tcp dport { 80, 443 } jump web
+				{
+					L4:     &nftableslib.L4Rule{L4Proto: unix.IPPROTO_TCP, Dst: &nftableslib.Port{List: []uint16{80, 443}}},
+					Action: setActionVerdict(t, unix.NFT_JUMP, "web"),
+				},
+				// 6: meta mark 7 accept, the mark is set by chain web
+				{Meta: &nftableslib.MetaRule{Mark: &nftableslib.MetaMark{Value: 7}}, Action: setActionVerdict(t, nftableslib.NFT_ACCEPT)},
+				// 7: tcp dport 8000-8100 except 8080 accept
+				{
+					L4: &nftableslib.L4Rule{L4Proto: unix.IPPROTO_TCP, Dst: &nftableslib.Port{
+						Range:   [2]uint16{8000, 8100},
+						Exclude: [][2]uint16{{8080, 8080}},
+					}},
+					Action: setActionVerdict(t, nftableslib.NFT_ACCEPT),
+				},
+				// 8: udp dport vmap @svc
+				{
+					L4: &nftableslib.L4Rule{L4Proto: unix.IPPROTO_UDP, Dst: &nftableslib.Port{
+						SetRef: &nftableslib.SetRef{Name: svc.Name, ID: svc.ID, IsMap: true},
+					}},
+				},
+				// 9: ip daddr 192.0.2.10-192.0.2.20 accept
+				{
+					L3: &nftableslib.L3Rule{Dst: &nftableslib.IPAddrSpec{
+						Range: [2]*nftableslib.IPAddr{setIPAddr(t, "192.0.2.10"), setIPAddr(t, "192.0.2.20")},
+					}},
+					Action: setActionVerdict(t, nftableslib.NFT_ACCEPT),
+				},
+				// 10: ip daddr 192.0.2.99 limit rate 10/second accept
+				{
+					L3:     &nftableslib.L3Rule{Dst: &nftableslib.IPAddrSpec{List: []*nftableslib.IPAddr{setIPAddr(t, "192.0.2.99")}}},
+					Limit:  nftableslib.LimitPacketsPerSecond(10),
+					Action: setActionVerdict(t, nftableslib.NFT_ACCEPT),
+				},
+			},
+		},
+		{
+			chain: "web",
+			rules: []*nftableslib.Rule{
+				// 1: ip saddr 203.0.113.0/24 drop
+				{
+					L3:     &nftableslib.L3Rule{Src: &nftableslib.IPAddrSpec{List: []*nftableslib.IPAddr{setIPAddr(t, "203.0.113.0/24")}}},
+					Action: setActionVerdict(t, nftableslib.NFT_DROP),
+				},
+				// 2: tcp dport 443 meta mark set 7
+				{
+					L4:   &nftableslib.L4Rule{L4Proto: unix.IPPROTO_TCP, Dst: &nftableslib.Port{List: []uint16{443}}},
+					Meta: &nftableslib.MetaRule{Mark: &nftableslib.MetaMark{Set: true, Value: 7}},
+				},
+			},
+		},
+		{
+			chain: "ntp",
+			rules: []*nftableslib.Rule{
+				// 1: ip saddr 198.51.100.1 accept
+				{
+					L3:     &nftableslib.L3Rule{Src: &nftableslib.IPAddrSpec{List: []*nftableslib.IPAddr{setIPAddr(t, "198.51.100.1")}}},
+					Action: setActionVerdict(t, nftableslib.NFT_ACCEPT),
+				},
+			},
+		},
+	}
+	ids := make(map[string][]uint32)
+	for _, c := range chains {
+		ri, err := ci.Chains().Chain(c.chain)
+		if err != nil {
+			t.Fatalf("failed to get rules of chain %s with error: %+v", c.chain, err)
+		}
+		for i, rule := range c.rules {
+			id, err := ri.Rules().Create(rule)
+			if err != nil {
+				t.Fatalf("failed to create rule %d of chain %s with error: %+v", i+1, c.chain, err)
+			}
+			ids[c.chain] = append(ids[c.chain], id)
+		}
+	}
+	if err := m.Flush(); err != nil {
+		t.Fatalf("failed to flush with error: %+v", err)
+	}
+
+	type step struct {
+		chain  string
+		rule   int
+		action string
+	}
+	tests := []struct {
+		name          string
+		packet        *nftableslib.Packet
+		verdict       int
+		rejected      bool
+		policy        bool
+		indeterminate bool
+		trail         []step
+	}{
+		{
+			name:    "Established",
+			packet:  &nftableslib.Packet{SAddr: net.ParseIP("203.0.113.5"), DAddr: net.ParseIP("192.0.2.1"), Proto: unix.IPPROTO_TCP, DPort: 22, CTState: nftableslib.CTStateEstablished},
+			verdict: nftableslib.NFT_ACCEPT,
+			trail:   []step{{"input", 1, "accept"}},
+		},
+		{
+			name:    "Loopback",
+			packet:  &nftableslib.Packet{SAddr: net.ParseIP("127.0.0.1"), DAddr: net.ParseIP("127.0.0.1"), Proto: unix.IPPROTO_TCP, DPort: 22, IIFName: "lo", CTState: nftableslib.CTStateNew},
+			verdict: nftableslib.NFT_ACCEPT,
+			trail:   []step{{"input", 2, "accept"}},
+		},
+		{
+			name:    "Mark",
+			packet:  &nftableslib.Packet{SAddr: net.ParseIP("10.1.1.1"), DAddr: net.ParseIP("192.0.2.10"), Proto: unix.IPPROTO_TCP, DPort: 22, IIFName: "eth0", Mark: 0x10, CTState: nftableslib.CTStateNew},
+			verdict: nftableslib.NFT_DROP,
+			trail:   []step{{"input", 3, "drop"}},
+		},
+		{
+			name:     "SSH from outside is rejected",
+			packet:   &nftableslib.Packet{SAddr: net.ParseIP("203.0.113.5"), DAddr: net.ParseIP("192.0.2.1"), Proto: unix.IPPROTO_TCP, DPort: 22, IIFName: "eth0", CTState: nftableslib.CTStateNew},
+			verdict:  nftableslib.NFT_DROP,
+			rejected: true,
+			trail:    []step{{"input", 4, "reject"}},
+		},
+		{
+			name:    "SSH from inside falls to policy",
+			packet:  &nftableslib.Packet{SAddr: net.ParseIP("10.1.1.1"), DAddr: net.ParseIP("192.0.2.1"), Proto: unix.IPPROTO_TCP, DPort: 22, IIFName: "eth0", CTState: nftableslib.CTStateNew},
+			verdict: nftableslib.NFT_DROP,
+			policy:  true,
+		},
+		{
+			name:    "Jump and drop",
+			packet:  &nftableslib.Packet{SAddr: net.ParseIP("203.0.113.5"), DAddr: net.ParseIP("192.0.2.1"), Proto: unix.IPPROTO_TCP, DPort: 443, IIFName: "eth0", CTState: nftableslib.CTStateNew},
+			verdict: nftableslib.NFT_DROP,
+			trail:   []step{{"input", 5, "jump web"}, {"web", 1, "drop"}},
+		},
+		{
+			name:    "Jump, mark and return",
+			packet:  &nftableslib.Packet{SAddr: net.ParseIP("198.51.100.7"), DAddr: net.ParseIP("192.0.2.1"), Proto: unix.IPPROTO_TCP, DPort: 443, IIFName: "eth0", CTState: nftableslib.CTStateNew},
+			verdict: nftableslib.NFT_ACCEPT,
+			trail:   []step{{"input", 5, "jump web"}, {"web", 2, ""}, {"input", 6, "accept"}},
+		},
+		{
+			name:    "Jump and return without mark",
+			packet:  &nftableslib.Packet{SAddr: net.ParseIP("198.51.100.7"), DAddr: net.ParseIP("192.0.2.1"), Proto: unix.IPPROTO_TCP, DPort: 80, IIFName: "eth0", CTState: nftableslib.CTStateNew},
+			verdict: nftableslib.NFT_DROP,
+			policy:  true,
+			trail:   []step{{"input", 5, "jump web"}},
+		},
+		{
+			name:    "Port range",
+			packet:  &nftableslib.Packet{SAddr: net.ParseIP("198.51.100.7"), DAddr: net.ParseIP("192.0.2.1"), Proto: unix.IPPROTO_TCP, DPort: 8100, IIFName: "eth0", CTState: nftableslib.CTStateNew},
+			verdict: nftableslib.NFT_ACCEPT,
+			trail:   []step{{"input", 7, "accept"}},
+		},
+		{
+			name:    "Port excluded from range",
+			packet:  &nftableslib.Packet{SAddr: net.ParseIP("198.51.100.7"), DAddr: net.ParseIP("192.0.2.1"), Proto: unix.IPPROTO_TCP, DPort: 8080, IIFName: "eth0", CTState: nftableslib.CTStateNew},
+			verdict: nftableslib.NFT_DROP,
+			policy:  true,
+		},
+		{
+			name:    "Port out of range",
+			packet:  &nftableslib.Packet{SAddr: net.ParseIP("198.51.100.7"), DAddr: net.ParseIP("192.0.2.1"), Proto: unix.IPPROTO_TCP, DPort: 8101, IIFName: "eth0", CTState: nftableslib.CTStateNew},
+			verdict: nftableslib.NFT_DROP,
+			policy:  true,
+		},
+		{
+			name:    "Vmap accept",
+			packet:  &nftableslib.Packet{SAddr: net.ParseIP("198.51.100.7"), DAddr: net.ParseIP("192.0.2.1"), Proto: unix.IPPROTO_UDP, DPort: 53, IIFName: "eth0", CTState: nftableslib.CTStateNew},
+			verdict: nftableslib.NFT_ACCEPT,
+			trail:   []step{{"input", 8, "accept"}},
+		},
+		{
+			name:    "Vmap goto",
+			packet:  &nftableslib.Packet{SAddr: net.ParseIP("198.51.100.1"), DAddr: net.ParseIP("192.0.2.1"), Proto: unix.IPPROTO_UDP, DPort: 123, IIFName: "eth0", CTState: nftableslib.CTStateNew},
+			verdict: nftableslib.NFT_ACCEPT,
+			trail:   []step{{"input", 8, "goto ntp"}, {"ntp", 1, "accept"}},
+		},
+		{
+			name:    "Vmap goto falls to policy",
+			packet:  &nftableslib.Packet{SAddr: net.ParseIP("198.51.100.2"), DAddr: net.ParseIP("192.0.2.15"), Proto: unix.IPPROTO_UDP, DPort: 123, IIFName: "eth0", CTState: nftableslib.CTStateNew},
+			verdict: nftableslib.NFT_DROP,
+			policy:  true,
+			trail:   []step{{"input", 8, "goto ntp"}},
+		},
+		{
+			name:    "Vmap miss and address range",
+			packet:  &nftableslib.Packet{SAddr: net.ParseIP("198.51.100.2"), DAddr: net.ParseIP("192.0.2.15"), Proto: unix.IPPROTO_UDP, DPort: 5353, IIFName: "eth0", CTState: nftableslib.CTStateNew},
+			verdict: nftableslib.NFT_ACCEPT,
+			trail:   []step{{"input", 9, "accept"}},
+		},
+		{
+			name:          "Limit is indeterminate",
+			packet:        &nftableslib.Packet{SAddr: net.ParseIP("198.51.100.2"), DAddr: net.ParseIP("192.0.2.99"), Proto: unix.IPPROTO_ICMP, ICMPType: 8, IIFName: "eth0", CTState: nftableslib.CTStateNew},
+			indeterminate: true,
+		},
+		{
+			name:          "Unknown ct state is indeterminate",
+			packet:        &nftableslib.Packet{SAddr: net.ParseIP("198.51.100.2"), DAddr: net.ParseIP("192.0.2.1"), Proto: unix.IPPROTO_TCP, DPort: 80},
+			indeterminate: true,
+		},
+	}
+	for _, tt := range tests {
+		result, err := ci.Chains().Simulate("input", tt.packet)
+		if err != nil {
+			t.Fatalf("Test \"%s\" failed with error: %+v but supposed to succeed", tt.name, err)
+		}
+		if result.Indeterminate != tt.indeterminate {
+			t.Fatalf("Test \"%s\" expected indeterminate %t, got %t reason: %s", tt.name, tt.indeterminate, result.Indeterminate, result.Reason)
+		}
+		if tt.indeterminate {
+			if result.Reason == "" {
+				t.Fatalf("Test \"%s\" indeterminate result has no reason", tt.name)
+			}
+			continue
+		}
+		if result.Verdict != tt.verdict || result.Rejected != tt.rejected || result.Policy != tt.policy {
+			t.Fatalf("Test \"%s\" unexpected result %+v", tt.name, *result)
+		}
+		if len(result.Trail) != len(tt.trail) {
+			t.Fatalf("Test \"%s\" expected trail of %d rules, got %d", tt.name, len(tt.trail), len(result.Trail))
+		}
+		for i, s := range tt.trail {
+			got := result.Trail[i]
+			if got.Chain != s.chain || got.RuleID != ids[s.chain][s.rule-1] || got.Action != s.action {
+				t.Fatalf("Test \"%s\" step %d expected rule %d of chain %s with action %q, got %+v", tt.name, i, s.rule, s.chain, s.action, *got)
+			}
+		}
+	}
+
+	if _, err := ci.Chains().Simulate("input", &nftableslib.Packet{SAddr: net.ParseIP("2001:db8::1")}); err == nil {
+		t.Fatalf("simulation of ipv6 packet in ip table supposed to fail")
+	}
+	if _, err := ci.Chains().Simulate("missing", &nftableslib.Packet{SAddr: net.ParseIP("192.0.2.1")}); err == nil {
+		t.Fatalf("simulation in missing chain supposed to fail")
+	}
+}
+
+func TestSimulateINet(t *testing.T) {
+	m := InitMockConn()
+	if err := m.ti.Tables().CreateImm("filter", nftables.TableFamilyINet); err != nil {
+		t.Fatalf("failed to create table with error: %+v", err)
+	}
+	ci, err := m.ti.Tables().Table("filter", nftables.TableFamilyINet)
+	if err != nil {
+		t.Fatalf("failed to get chains with error: %+v", err)
+	}
+	accept := nftableslib.ChainPolicyAccept
+	if err := ci.Chains().CreateImm("input", &nftableslib.ChainAttributes{
+		Type:     nftables.ChainTypeFilter,
+		Hook:     nftables.ChainHookInput,
+		Priority: nftables.ChainPriorityFilter,
+		Policy:   &accept,
+	}); err != nil {
+		t.Fatalf("failed to create chain input with error: %+v", err)
+	}
+	ri, err := ci.Chains().Chain("input")
+	if err != nil {
+		t.Fatalf("failed to get rules with error: %+v", err)
+	}
+	if _, err := ri.Rules().CreateImm(&nftableslib.Rule{
+		L3:     &nftableslib.L3Rule{Src: &nftableslib.IPAddrSpec{List: []*nftableslib.IPAddr{setIPAddr(t, "192.0.2.0/24"), setIPAddr(t, "2001:db8::/32")}}},
+		L4:     &nftableslib.L4Rule{L4Proto: unix.IPPROTO_TCP, Dst: &nftableslib.Port{List: []uint16{443}}},
+		Action: setActionVerdict(t, nftableslib.NFT_DROP),
+	}); err != nil {
+		t.Fatalf("failed to create rule with error: %+v", err)
+	}
+	tests := []struct {
+		name    string
+		packet  *nftableslib.Packet
+		verdict int
+		policy  bool
+	}{
+		{
+			name:    "IPv4",
+			packet:  &nftableslib.Packet{SAddr: net.ParseIP("192.0.2.1"), Proto: unix.IPPROTO_TCP, DPort: 443},
+			verdict: nftableslib.NFT_DROP,
+		},
+		{
+			name:    "IPv6",
+			packet:  &nftableslib.Packet{SAddr: net.ParseIP("2001:db8::1"), Proto: unix.IPPROTO_TCP, DPort: 443},
+			verdict: nftableslib.NFT_DROP,
+		},
+		{
+			name:    "IPv6 other address",
+			packet:  &nftableslib.Packet{SAddr: net.ParseIP("2001:db9::1"), Proto: unix.IPPROTO_TCP, DPort: 443},
+			verdict: nftableslib.NFT_ACCEPT,
+			policy:  true,
+		},
+		{
+			name:    "IPv6 other protocol",
+			packet:  &nftableslib.Packet{SAddr: net.ParseIP("2001:db8::1"), Proto: unix.IPPROTO_UDP, DPort: 443},
+			verdict: nftableslib.NFT_ACCEPT,
+			policy:  true,
+		},
+	}
+	for _, tt := range tests {
+		result, err := ci.Chains().Simulate("input", tt.packet)
+		if err != nil {
+			t.Fatalf("Test \"%s\" failed with error: %+v but supposed to succeed", tt.name, err)
+		}
+		if result.Indeterminate || result.Verdict != tt.verdict || result.Policy != tt.policy {
+			t.Fatalf("Test \"%s\" unexpected result %+v", tt.name, *result)
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package mock
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"github.com/sbezverk/nftableslib"
+	"golang.org/x/sys/unix"
+)
+
+func TestConfirmOrRollback(t *testing.T) {
+	m := InitMockConn()
+	if err := m.ti.Tables().CreateImm("filter-v4", nftables.TableFamilyIPv4); err != nil {
+		t.Fatalf("failed to create table filter-v4 with error: %+v", err)
+	}
+	tbl, err := m.ti.Tables().Table("filter-v4", nftables.TableFamilyIPv4)
+	if err != nil {
+		t.Fatalf("failed to get chain interface for table filter-v4")
+	}
+	if err := tbl.Chains().CreateImm("chain-1", nil); err != nil {
+		t.Fatalf("failed to create chain chain-1 with error: %+v", err)
+	}
+	ri, err := tbl.Chains().Chain("chain-1")
+	if err != nil {
+		t.Fatalf("failed to get rules interface for chain chain-1")
+	}
+	if _, err := ri.Rules().CreateImm(&nftableslib.Rule{
+		L3: &nftableslib.L3Rule{
+			Protocol: nftableslib.L3Protocol(unix.IPPROTO_TCP),
+		},
+		Action: setActionVerdict(t, nftableslib.NFT_ACCEPT),
+	}); err != nil {
+		t.Fatalf("failed to create rule with error: %+v", err)
+	}
+
+	apply := func() error {
+		if err := tbl.Chains().DeleteImm("chain-1"); err != nil {
+			return err
+		}
+		return m.ti.Tables().CreateImm("filter-v6", nftables.TableFamilyIPv6)
+	}
+	probes := 0
+	probe := func() bool {
+		probes++
+		return false
+	}
+	// Invalid timeout is rejected before the change is applied
+	for _, timeout := range []time.Duration{0, -time.Second} {
+		if err := m.ti.Tables().ConfirmOrRollback(apply, timeout, probe); err == nil {
+			t.Fatalf("expected timeout %v to be rejected", timeout)
+		}
+	}
+	if probes != 0 || !tbl.Chains().Exist("chain-1") {
+		t.Fatalf("change was applied with invalid timeout")
+	}
+	// Timeout shorter than the probe interval must not panic
+	if err := m.ti.Tables().ConfirmOrRollback(func() error { return nil }, time.Nanosecond, func() bool { return false }); err != nftableslib.ErrNotConfirmed {
+		t.Fatalf("expected ErrNotConfirmed but got: %+v", err)
+	}
+	err = m.ti.Tables().ConfirmOrRollback(apply, time.Millisecond*50, probe)
+	if err != nftableslib.ErrNotConfirmed {
+		t.Fatalf("expected ErrNotConfirmed but got: %+v", err)
+	}
+	if probes == 0 {
+		t.Fatalf("probe was never called")
+	}
+	tables, _ := m.ListTables()
+	if len(tables) != 1 || tables[0].Name != "filter-v4" {
+		t.Fatalf("expected only table filter-v4 after rollback, got %+v", tables)
+	}
+	chains, _ := m.ListChains()
+	if len(chains) != 1 || chains[0].Name != "chain-1" {
+		t.Fatalf("expected chain chain-1 after rollback, got %+v", chains)
+	}
+	rules, err := m.GetRule(chains[0].Table, chains[0])
+	if err != nil || len(rules) != 1 {
+		t.Fatalf("expected 1 rule in chain chain-1 after rollback, got %d, error: %+v", len(rules), err)
+	}
+	// Store must be rebuilt from the restored ruleset
+	tbl, err = m.ti.Tables().Table("filter-v4", nftables.TableFamilyIPv4)
+	if err != nil {
+		t.Fatalf("table filter-v4 is missing in the store after rollback")
+	}
+	if n, err := tbl.Chains().RuleCount("chain-1"); err != nil || n != 1 {
+		t.Fatalf("expected 1 rule in chain-1 store after rollback, got %d, error: %+v", n, err)
+	}
+	if _, err := m.ti.Tables().Table("filter-v6", nftables.TableFamilyIPv6); err == nil {
+		t.Fatalf("table filter-v6 is still in the store after rollback")
+	}
+}
+
+func TestSnapshotNetlink(t *testing.T) {
+	k := InitMockNetlink()
+	conn := k.Conn()
+	ti, err := nftableslib.InitNFTablesWithConn(conn)
+	if err != nil {
+		t.Fatalf("failed to initialize library with injected connection with error: %+v", err)
+	}
+	if err := ti.Tables().CreateImm("nat", nftables.TableFamilyIPv4); err != nil {
+		t.Fatalf("failed to create table with error: %+v", err)
+	}
+	ci, _ := ti.Tables().TableChains("nat", nftables.TableFamilyIPv4)
+	if err := ci.Chains().CreateImm("postrouting", &nftableslib.ChainAttributes{
+		Type:     nftables.ChainTypeNAT,
+		Hook:     nftables.ChainHookPostrouting,
+		Priority: nftables.ChainPriorityNATSource,
+	}); err != nil {
+		t.Fatalf("failed to create chain with error: %+v", err)
+	}
+	ri, _ := ci.Chains().Chain("postrouting")
+	masq, err := nftableslib.SetMasq(false, false, true)
+	if err != nil {
+		t.Fatalf("failed to set masquerade action with error: %+v", err)
+	}
+	rules := []*nftableslib.Rule{
+		{
+			Conntracks: []*nftableslib.Conntrack{{Key: unix.NFT_CT_STATE, Value: binaryutil.BigEndian.PutUint32(nftableslib.CTStateNew)}},
+			Action:     masq,
+		},
+		{
+			Conntracks: []*nftableslib.Conntrack{{Key: unix.NFT_CT_STATE, Value: binaryutil.BigEndian.PutUint32(nftableslib.CTStateEstablished)}},
+			Action:     setActionVerdict(t, nftableslib.NFT_ACCEPT),
+		},
+	}
+	for _, r := range rules {
+		if _, err := ri.Rules().CreateImm(r); err != nil {
+			t.Fatalf("failed to create rule with error: %+v", err)
+		}
+	}
+	// programmed returns expressions and user data of rules as carried by the simulated kernel
+	programmed := func() [][]byte {
+		k.Lock()
+		defer k.Unlock()
+		attrs := make([][]byte, 0)
+		for _, r := range k.state.rules {
+			attrs = append(attrs, attr(r.attrs, unix.NFTA_RULE_EXPRESSIONS), attr(r.attrs, unix.NFTA_RULE_USERDATA))
+		}
+		return attrs
+	}
+	before := programmed()
+	s, err := ti.Tables().Snapshot()
+	if err != nil {
+		t.Fatalf("failed to take snapshot with error: %+v", err)
+	}
+	if err := ti.Tables().DeleteImm("nat", nftables.TableFamilyIPv4); err != nil {
+		t.Fatalf("failed to delete table with error: %+v", err)
+	}
+	if err := ti.Tables().Rollback(s); err != nil {
+		t.Fatalf("failed to roll back with error: %+v", err)
+	}
+	if after := programmed(); !reflect.DeepEqual(before, after) {
+		t.Fatalf("rules rolled back differ from rules in the snapshot")
+	}
+	// Table restored by the rollback is not owned by the store, it is deleted on the host
+	table := &nftables.Table{Name: "nat", Family: nftables.TableFamilyIPv4}
+	conn.DelTable(table)
+	if err := conn.Flush(); err != nil {
+		t.Fatalf("failed to delete table with error: %+v", err)
+	}
+	if err := ti.Tables().Restore(s, nil); err != nil {
+		t.Fatalf("failed to restore with error: %+v", err)
+	}
+	if after := programmed(); !reflect.DeepEqual(before, after) {
+		t.Fatalf("rules restored differ from rules in the snapshot")
+	}
+
+	// Rules carrying expressions the library cannot decode are not captured
+	conn.AddRule(&nftables.Rule{
+		Table: table,
+		Chain: &nftables.Chain{Name: "postrouting", Table: table},
+		Exprs: []expr.Any{&expr.Numgen{Register: 1, Modulus: 2, Type: unix.NFT_NG_INCREMENTAL}},
+	})
+	if err := conn.Flush(); err != nil {
+		t.Fatalf("failed to add rule with error: %+v", err)
+	}
+	if _, err := ti.Tables().Snapshot(); err == nil {
+		t.Fatalf("expected snapshot of rule with numgen expression to fail")
+	}
+}
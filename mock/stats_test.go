@@ -0,0 +1,134 @@
+package mock
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/sbezverk/nftableslib"
+	"golang.org/x/sys/unix"
+)
+
+func TestTableStats(t *testing.T) {
+	m := InitMockConn()
+	ti := m.ti.Tables()
+	if err := ti.CreateImm("filter", nftables.TableFamilyIPv4); err != nil {
+		t.Fatalf("failed to create table with error: %+v", err)
+	}
+	if err := ti.CreateImm("nat", nftables.TableFamilyIPv6); err != nil {
+		t.Fatalf("failed to create table with error: %+v", err)
+	}
+	ci, _ := ti.TableChains("filter", nftables.TableFamilyIPv4)
+	rules := map[string]int{"input": 2, "output": 1, "empty": 0}
+	for _, chain := range []string{"input", "output", "empty"} {
+		if err := ci.Chains().CreateImm(chain, nil); err != nil {
+			t.Fatalf("failed to create chain %s with error: %+v", chain, err)
+		}
+		ri, _ := ci.Chains().Chain(chain)
+		for i := 0; i < rules[chain]; i++ {
+			if _, err := ri.Rules().CreateImm(&nftableslib.Rule{
+				L4: &nftableslib.L4Rule{
+					L4Proto: unix.IPPROTO_TCP,
+					Dst:     &nftableslib.Port{List: []uint16{uint16(80 + i)}},
+				},
+				Action: setActionVerdict(t, nftableslib.NFT_ACCEPT),
+			}); err != nil {
+				t.Fatalf("failed to create rule with error: %+v", err)
+			}
+		}
+	}
+	si, _ := ti.TableSets("filter", nftables.TableFamilyIPv4)
+	ports := make([]nftables.SetElement, 0)
+	for _, p := range []uint16{22, 80, 443} {
+		ports = append(ports, nftables.SetElement{Key: binaryutil.BigEndian.PutUint16(p)})
+	}
+	if _, err := si.Sets().CreateSet(&nftableslib.SetAttributes{Name: "ports", KeyType: nftables.TypeInetService}, ports); err != nil {
+		t.Fatalf("failed to create set with error: %+v", err)
+	}
+	if _, err := si.Sets().CreateSet(&nftableslib.SetAttributes{Name: "addresses", KeyType: nftables.TypeIPAddr}, nil); err != nil {
+		t.Fatalf("failed to create set with error: %+v", err)
+	}
+	// Tables of other applications are counted as well
+	m.AddTable(&nftables.Table{Name: "foreign", Family: nftables.TableFamilyIPv4})
+	if err := m.Flush(); err != nil {
+		t.Fatalf("failed to flush with error: %+v", err)
+	}
+	tests := []struct {
+		name   string
+		family nftables.TableFamily
+		stats  []*nftableslib.TableStats
+	}{
+		{
+			name:   "all families",
+			family: nftables.TableFamily(unix.NFPROTO_UNSPEC),
+			stats: []*nftableslib.TableStats{
+				{Name: "filter", Family: nftables.TableFamilyIPv4, Chains: 3, Rules: 3, Sets: 2, Elements: 3},
+				{Name: "foreign", Family: nftables.TableFamilyIPv4},
+				{Name: "nat", Family: nftables.TableFamilyIPv6},
+			},
+		},
+		{
+			name:   "ipv6",
+			family: nftables.TableFamilyIPv6,
+			stats: []*nftableslib.TableStats{
+				{Name: "nat", Family: nftables.TableFamilyIPv6},
+			},
+		},
+		{
+			name:   "family without tables",
+			family: nftables.TableFamilyBridge,
+			stats:  []*nftableslib.TableStats{},
+		},
+	}
+	for _, tt := range tests {
+		stats, err := ti.Stats(tt.family)
+		if err != nil {
+			t.Fatalf("Test \"%s\" failed with error: %+v but supposed to succeed", tt.name, err)
+		}
+		if !reflect.DeepEqual(stats, tt.stats) {
+			t.Fatalf("Test \"%s\" failed, expected stats %+v, got %+v", tt.name, tt.stats, stats)
+		}
+	}
+}
+
+func TestSetMemoryWarning(t *testing.T) {
+	m := InitMockConn()
+	warnings := make([]error, 0)
+	if err := m.ti.Tables().CreateImm("blocklist", nftables.TableFamilyINet,
+		nftableslib.WithWarningHandler(func(w error) {
+			warnings = append(warnings, w)
+		}),
+		nftableslib.WithSetMemoryWarning(4096)); err != nil {
+		t.Fatalf("failed to create table with error: %+v", err)
+	}
+	bl, err := nftableslib.NewBlocklist(m.ti, "blocklist")
+	if err != nil {
+		t.Fatalf("failed to create blocklist with error: %+v", err)
+	}
+	if err := bl.ReplaceAll([]nftableslib.BlocklistEntry{{Addr: "10.0.0.1"}, {Addr: "2001:db8::1"}}); err != nil {
+		t.Fatalf("failed to replace blocklist with error: %+v", err)
+	}
+	if len(warnings) != 0 {
+		t.Fatalf("loading small blocklist is not expected to raise warnings, got %+v", warnings)
+	}
+	entries := make([]nftableslib.BlocklistEntry, 0)
+	for i := 0; i < 64; i++ {
+		entries = append(entries, nftableslib.BlocklistEntry{Addr: fmt.Sprintf("10.0.%d.0/24", i)})
+	}
+	if err := bl.ReplaceAll(entries); err != nil {
+		t.Fatalf("failed to replace blocklist with error: %+v", err)
+	}
+	if len(warnings) != 1 {
+		t.Fatalf("expected a single warning, got %+v", warnings)
+	}
+	var w *nftableslib.SetMemoryWarning
+	if !errors.As(warnings[0], &w) {
+		t.Fatalf("expected SetMemoryWarning, got %+v", warnings[0])
+	}
+	if w.Table != "blocklist" || w.Set != nftableslib.BlocklistIPv4SetName || w.Elements != 128 || w.Bytes < 4096 {
+		t.Fatalf("unexpected warning %+v", *w)
+	}
+}
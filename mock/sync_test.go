@@ -0,0 +1,177 @@
+package mock
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/google/nftables"
+	"github.com/sbezverk/nftableslib"
+	"golang.org/x/sys/unix"
+)
+
+func populateTables(t *testing.T, m *Mock, n int) {
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("table-%d", i)
+		if err := m.ti.Tables().CreateImm(name, nftables.TableFamilyIPv4); err != nil {
+			t.Fatalf("failed to create table %s with error: %+v", name, err)
+		}
+		ci, _ := m.ti.Tables().TableChains(name, nftables.TableFamilyIPv4)
+		for _, chain := range []string{"chain-1", "chain-2"} {
+			if err := ci.Chains().CreateImm(chain, nil); err != nil {
+				t.Fatalf("failed to create chain %s with error: %+v", chain, err)
+			}
+		}
+		ri, _ := ci.Chains().Chain("chain-1")
+		if _, err := ri.Rules().CreateImm(&nftableslib.Rule{
+			L3: &nftableslib.L3Rule{
+				Protocol: nftableslib.L3Protocol(unix.IPPROTO_TCP),
+			},
+			Action: setActionVerdict(t, nftableslib.NFT_ACCEPT),
+		}); err != nil {
+			t.Fatalf("failed to create rule with error: %+v", err)
+		}
+		si, _ := m.ti.Tables().TableSets(name, nftables.TableFamilyIPv4)
+		if _, err := si.Sets().CreateSet(&nftableslib.SetAttributes{
+			Name:    "addresses",
+			KeyType: nftables.TypeIPAddr,
+		}, nil); err != nil {
+			t.Fatalf("failed to create set with error: %+v", err)
+		}
+	}
+}
+
+func TestTablesSync(t *testing.T) {
+	m := InitMockConn()
+	populateTables(t, m, 50)
+
+	ti := nftableslib.InitNFTables(m)
+	report, err := ti.Tables().Sync(nftables.TableFamilyIPv4)
+	if err != nil {
+		t.Fatalf("failed to sync with error: %+v", err)
+	}
+	want := nftableslib.SyncCounters{Tables: 50, Chains: 100, Sets: 50, Rules: 50}
+	if report.Added != want || report.Removed != (nftableslib.SyncCounters{}) {
+		t.Fatalf("unexpected sync report: %+v", report)
+	}
+	// Nothing changed on the host, second Sync does not change the store
+	report, err = ti.Tables().Sync(nftables.TableFamilyIPv4)
+	if err != nil {
+		t.Fatalf("failed to sync with error: %+v", err)
+	}
+	if report.Added != (nftableslib.SyncCounters{}) || report.Removed != (nftableslib.SyncCounters{}) {
+		t.Fatalf("unexpected sync report: %+v", report)
+	}
+
+	// Changing the host's ruleset
+	for i := 0; i < 5; i++ {
+		if err := m.ti.Tables().DeleteImm(fmt.Sprintf("table-%d", i), nftables.TableFamilyIPv4); err != nil {
+			t.Fatalf("failed to delete table with error: %+v", err)
+		}
+	}
+	ci, _ := m.ti.Tables().TableChains("table-10", nftables.TableFamilyIPv4)
+	if err := ci.Chains().CreateImm("chain-3", nil); err != nil {
+		t.Fatalf("failed to create chain chain-3 with error: %+v", err)
+	}
+	if err := ci.Chains().DeleteImm("chain-2"); err != nil {
+		t.Fatalf("failed to delete chain chain-2 with error: %+v", err)
+	}
+	report, err = ti.Tables().SyncTable("table-10", nftables.TableFamilyIPv4)
+	if err != nil {
+		t.Fatalf("failed to sync table with error: %+v", err)
+	}
+	if report.Added != (nftableslib.SyncCounters{Chains: 1}) || report.Removed != (nftableslib.SyncCounters{Chains: 1}) {
+		t.Fatalf("unexpected sync table report: %+v", report)
+	}
+	report, err = ti.Tables().Sync(nftables.TableFamilyIPv4)
+	if err != nil {
+		t.Fatalf("failed to sync with error: %+v", err)
+	}
+	if report.Added != (nftableslib.SyncCounters{}) || report.Removed != (nftableslib.SyncCounters{Tables: 5}) {
+		t.Fatalf("unexpected sync report: %+v", report)
+	}
+	tables, _ := ti.Tables().Get(nftables.TableFamilyIPv4)
+	if len(tables) != 45 {
+		t.Fatalf("expected 45 tables, got %d", len(tables))
+	}
+	if ti.Tables().Exist("table-0", nftables.TableFamilyIPv4) {
+		t.Fatalf("table table-0 is expected to be removed from the store")
+	}
+}
+
+func TestTablesSyncConcurrent(t *testing.T) {
+	m := InitMockConn()
+	populateTables(t, m, 50)
+
+	ti := nftableslib.InitNFTables(m)
+	var wg sync.WaitGroup
+	reports := make([]*nftableslib.SyncReport, 4)
+	for i := range reports {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			r, err := ti.Tables().Sync(nftables.TableFamilyIPv4)
+			if err != nil {
+				t.Errorf("failed to sync with error: %+v", err)
+			}
+			reports[i] = r
+		}(i)
+	}
+	wg.Wait()
+	added := nftableslib.SyncCounters{}
+	for _, r := range reports {
+		added.Tables += r.Added.Tables
+		added.Chains += r.Added.Chains
+		added.Sets += r.Added.Sets
+		added.Rules += r.Added.Rules
+	}
+	// Every object is expected to be added exactly once
+	want := nftableslib.SyncCounters{Tables: 50, Chains: 100, Sets: 50, Rules: 50}
+	if added != want {
+		t.Fatalf("expected %+v objects added, got %+v", want, added)
+	}
+}
+
+func TestSyncSkipsForeignObjects(t *testing.T) {
+	m := InitMockConn()
+	populateTables(t, m, 5)
+	// Foreign table of other family with its own chains
+	if err := m.ti.Tables().CreateImm("docker", nftables.TableFamilyIPv6); err != nil {
+		t.Fatalf("failed to create table docker with error: %+v", err)
+	}
+	ci, _ := m.ti.Tables().TableChains("docker", nftables.TableFamilyIPv6)
+	for _, chain := range []string{"DOCKER", "DOCKER-USER", "DOCKER-ISOLATION"} {
+		if err := ci.Chains().CreateImm(chain, nil); err != nil {
+			t.Fatalf("failed to create chain %s with error: %+v", chain, err)
+		}
+	}
+
+	ti := nftableslib.InitNFTables(m)
+	report, err := ti.Tables().Sync(nftables.TableFamilyIPv4)
+	if err != nil {
+		t.Fatalf("failed to sync with error: %+v", err)
+	}
+	if want := (nftableslib.SyncCounters{Tables: 1, Chains: 3}); report.Skipped != want {
+		t.Fatalf("expected skipped objects %+v, got %+v", want, report.Skipped)
+	}
+	report, err = ti.Tables().SyncTable("table-1", nftables.TableFamilyIPv4)
+	if err != nil {
+		t.Fatalf("failed to sync table table-1 with error: %+v", err)
+	}
+	// Other ipv4 tables and chains of all other tables are skipped
+	if want := (nftableslib.SyncCounters{Tables: 5, Chains: 11}); report.Skipped != want {
+		t.Fatalf("expected skipped objects %+v, got %+v", want, report.Skipped)
+	}
+
+	tables, err := ti.Tables().GetByPrefix(nftables.TableFamilyIPv4, "table-")
+	if err != nil || len(tables) != 5 {
+		t.Fatalf("expected 5 tables with prefix table-, got %v with error: %+v", tables, err)
+	}
+	if tables, _ := ti.Tables().GetByPrefix(nftables.TableFamilyIPv4, "docker"); len(tables) != 0 {
+		t.Fatalf("expected no ipv4 tables with prefix docker, got %v", tables)
+	}
+	chains, err := ci.Chains().GetByPrefix("DOCKER-")
+	if err != nil || len(chains) != 2 {
+		t.Fatalf("expected 2 chains with prefix DOCKER-, got %v with error: %+v", chains, err)
+	}
+}
@@ -0,0 +1,142 @@
+package mock
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/google/nftables"
+	"github.com/sbezverk/nftableslib"
+)
+
+func TestTableOwnership(t *testing.T) {
+	family := nftables.TableFamilyIPv4
+	// onHost returns true if the mock carries the table
+	onHost := func(m *Mock, name string) bool {
+		tables, err := m.ListTables()
+		if err != nil {
+			t.Fatalf("failed to list tables with error: %+v", err)
+		}
+		for _, table := range tables {
+			if table.Name == name && table.Family == family {
+				return true
+			}
+		}
+		return false
+	}
+	tests := []struct {
+		name    string
+		prepare func(m *Mock, ti nftableslib.TableFuncs) error
+		delete  func(m *Mock, ti nftableslib.TableFuncs) error
+		owned   bool
+	}{
+		{
+			name: "owned",
+			prepare: func(m *Mock, ti nftableslib.TableFuncs) error {
+				return ti.CreateImm("app", family)
+			},
+			delete: func(m *Mock, ti nftableslib.TableFuncs) error {
+				return ti.DeleteImm("app", family)
+			},
+			owned: true,
+		},
+		{
+			name: "owned queued deletion",
+			prepare: func(m *Mock, ti nftableslib.TableFuncs) error {
+				return ti.CreateImm("app", family)
+			},
+			delete: func(m *Mock, ti nftableslib.TableFuncs) error {
+				if err := ti.Delete("app", family); err != nil {
+					return err
+				}
+				return m.Flush()
+			},
+			owned: true,
+		},
+		{
+			name: "unflushed",
+			prepare: func(m *Mock, ti nftableslib.TableFuncs) error {
+				return ti.Create("app", family)
+			},
+			delete: func(m *Mock, ti nftableslib.TableFuncs) error {
+				return ti.DeleteImm("app", family)
+			},
+			owned: true,
+		},
+		{
+			name: "foreign",
+			prepare: func(m *Mock, ti nftableslib.TableFuncs) error {
+				m.AddTable(&nftables.Table{Name: "app", Family: family})
+				return m.Flush()
+			},
+			delete: func(m *Mock, ti nftableslib.TableFuncs) error {
+				return ti.DeleteImm("app", family)
+			},
+		},
+		{
+			name: "foreign synced",
+			prepare: func(m *Mock, ti nftableslib.TableFuncs) error {
+				m.AddTable(&nftables.Table{Name: "app", Family: family})
+				if err := m.Flush(); err != nil {
+					return err
+				}
+				_, err := ti.Sync(family)
+				return err
+			},
+			delete: func(m *Mock, ti nftableslib.TableFuncs) error {
+				return ti.Delete("app", family)
+			},
+		},
+		{
+			name: "owned after rollback",
+			prepare: func(m *Mock, ti nftableslib.TableFuncs) error {
+				if err := ti.CreateImm("app", family); err != nil {
+					return err
+				}
+				s, err := ti.Snapshot()
+				if err != nil {
+					return err
+				}
+				return ti.Rollback(s)
+			},
+			delete: func(m *Mock, ti nftableslib.TableFuncs) error {
+				return ti.DeleteImm("app", family)
+			},
+			owned: true,
+		},
+	}
+	for _, tt := range tests {
+		m := InitMockConn()
+		ti := m.ti.Tables()
+		if err := tt.prepare(m, ti); err != nil {
+			t.Fatalf("Test \"%s\" failed to prepare with error: %+v", tt.name, err)
+		}
+		err := tt.delete(m, ti)
+		if tt.owned {
+			if err != nil {
+				t.Fatalf("Test \"%s\" failed with error: %+v but supposed to succeed", tt.name, err)
+			}
+			if onHost(m, "app") || ti.Exist("app", family) {
+				t.Fatalf("Test \"%s\" failed, table is expected to be deleted", tt.name)
+			}
+			continue
+		}
+		var notOwned *nftableslib.ErrNotOwned
+		if !errors.As(err, &notOwned) {
+			t.Fatalf("Test \"%s\" failed, expected ErrNotOwned, got %+v", tt.name, err)
+		}
+		if !onHost(m, "app") {
+			t.Fatalf("Test \"%s\" failed, foreign table is not expected to be deleted", tt.name)
+		}
+		if err := ti.DeleteImm("app", family, true); err != nil {
+			t.Fatalf("Test \"%s\" failed to force deletion with error: %+v", tt.name, err)
+		}
+		if onHost(m, "app") {
+			t.Fatalf("Test \"%s\" failed, table is expected to be deleted by force", tt.name)
+		}
+	}
+	// Deleting a table which does not exist is not an error
+	m := InitMockConn()
+	if err := m.ti.Tables().DeleteImm("app", family); err != nil {
+		t.Fatalf("failed to delete missing table with error: %+v", err)
+	}
+}
@@ -0,0 +1,146 @@
+package mock
+
+import (
+	"testing"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/sbezverk/nftableslib"
+	"golang.org/x/sys/unix"
+)
+
+// lastRule returns the handle of the last rule of the chain programmed in the mock along with the number of rules
+func lastRule(t *testing.T, m *Mock, table *nftables.Table, chain string) (uint64, int) {
+	t.Helper()
+	rules, err := m.GetRule(table, &nftables.Chain{Name: chain, Table: table})
+	if err != nil {
+		t.Fatalf("failed to get rules of chain %s with error: %+v", chain, err)
+	}
+	if len(rules) == 0 {
+		return 0, 0
+	}
+	return rules[len(rules)-1].Handle, len(rules)
+}
+
+func TestTailRule(t *testing.T) {
+	table := &nftables.Table{Name: "filter", Family: nftables.TableFamilyIPv4}
+	tail := func(prefix string) *nftableslib.Rule {
+		return &nftableslib.Rule{
+			Log:    setLog(unix.NFTA_LOG_PREFIX, []byte(prefix)),
+			Action: setActionVerdict(t, nftableslib.NFT_DROP),
+		}
+	}
+	accept := func(port int) *nftableslib.Rule {
+		return &nftableslib.Rule{
+			L4: &nftableslib.L4Rule{
+				L4Proto: unix.IPPROTO_TCP,
+				Dst:     &nftableslib.Port{List: []uint16{uint16(port)}},
+			},
+			Action: setActionVerdict(t, nftableslib.NFT_ACCEPT),
+		}
+	}
+	m := InitMockConn()
+	if err := m.ti.Tables().CreateImm(table.Name, table.Family); err != nil {
+		t.Fatalf("failed to create table with error: %+v", err)
+	}
+	ci, err := m.ti.Tables().TableChains(table.Name, table.Family)
+	if err != nil {
+		t.Fatalf("failed to get chains with error: %+v", err)
+	}
+	if err := ci.Chains().CreateImm("input", nil); err != nil {
+		t.Fatalf("failed to create chain with error: %+v", err)
+	}
+	ri, err := ci.Chains().Chain("input")
+	if err != nil {
+		t.Fatalf("failed to get rules with error: %+v", err)
+	}
+	if err := ri.Rules().RemoveTail(); err == nil {
+		t.Fatalf("removing a tail of a chain without the tail is supposed to fail")
+	}
+	if _, err := ri.Rules().CreateImm(accept(22)); err != nil {
+		t.Fatalf("failed to create rule with error: %+v", err)
+	}
+	th, err := ri.Rules().SetTail(tail("input drop: "))
+	if err != nil {
+		t.Fatalf("failed to set tail with error: %+v", err)
+	}
+	tests := []struct {
+		name string
+		op   func() error
+	}{
+		{
+			name: "create",
+			op: func() error {
+				_, err := ri.Rules().CreateImm(accept(80))
+				return err
+			},
+		},
+		{
+			name: "queued create",
+			op: func() error {
+				if _, err := ri.Rules().Create(accept(443)); err != nil {
+					return err
+				}
+				return m.Flush()
+			},
+		},
+		{
+			name: "update tail",
+			op: func() error {
+				h, err := ri.Rules().SetTail(tail("input denied: "))
+				if err == nil && h != th {
+					t.Fatalf("updated tail is expected to keep handle %d, got %d", th, h)
+				}
+				return err
+			},
+		},
+		{
+			name: "insert",
+			op: func() error {
+				_, err := ri.Rules().InsertImm(accept(8080))
+				return err
+			},
+		},
+		{
+			name: "create after tail update",
+			op: func() error {
+				_, err := ri.Rules().CreateImm(accept(8443))
+				return err
+			},
+		},
+	}
+	rules := 2
+	for _, tt := range tests {
+		if err := tt.op(); err != nil {
+			t.Fatalf("Test \"%s\" failed with error: %+v but supposed to succeed", tt.name, err)
+		}
+		if tt.name != "update tail" {
+			rules++
+		}
+		last, n := lastRule(t, m, table, "input")
+		if n != rules {
+			t.Fatalf("Test \"%s\" failed, expected %d rules, got %d", tt.name, rules, n)
+		}
+		if last != th {
+			t.Fatalf("Test \"%s\" failed, expected tail rule %d to be last, got %d", tt.name, th, last)
+		}
+	}
+	// The updated tail carries the new prefix
+	rs, _ := m.GetRule(table, &nftables.Chain{Name: "input", Table: table})
+	if l, ok := rs[len(rs)-1].Exprs[0].(*expr.Log); !ok || string(l.Data) != "input denied: " {
+		t.Fatalf("tail rule is not updated, got expressions %+v", rs[len(rs)-1].Exprs)
+	}
+	if err := ri.Rules().RemoveTail(); err != nil {
+		t.Fatalf("failed to remove tail with error: %+v", err)
+	}
+	if _, n := lastRule(t, m, table, "input"); n != rules-1 {
+		t.Fatalf("expected %d rules after tail removal, got %d", rules-1, n)
+	}
+	h, err := ri.Rules().CreateImm(accept(9090))
+	if err != nil {
+		t.Fatalf("failed to create rule with error: %+v", err)
+	}
+	if last, _ := lastRule(t, m, table, "input"); last != h {
+		t.Fatalf("rule created after tail removal is expected to be appended")
+	}
+}
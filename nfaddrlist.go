@@ -0,0 +1,115 @@
+package nftableslib
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+)
+
+// AddrListNormalized is raised when an address list of a rule repeats addresses or carries addresses
+// covered by prefixes of the list, the set built from the list carries neither of them. Covered addresses
+// cannot be kept as elements of interval sets must not overlap.
+type AddrListNormalized struct {
+	Table string
+	Chain string
+	// Duplicates are addresses repeating an earlier address of the list
+	Duplicates []*IPAddr
+	// Covered are addresses within prefixes of the list
+	Covered []CoveredAddr
+}
+
+// CoveredAddr is the address of the list removed as it is within the prefix By of the list
+type CoveredAddr struct {
+	Addr *IPAddr
+	By   *IPAddr
+}
+
+func (w *AddrListNormalized) Error() string {
+	return fmt.Sprintf("address list of rule of chain %s of table %s carries %d duplicate and %d covered addresses",
+		w.Chain, w.Table, len(w.Duplicates), len(w.Covered))
+}
+
+// merge adds removed addresses of the other list, rules can carry several lists
+func (w *AddrListNormalized) merge(o *AddrListNormalized) {
+	w.Duplicates = append(w.Duplicates, o.Duplicates...)
+	w.Covered = append(w.Covered, o.Covered...)
+}
+
+// WithStrictAddrLists makes rules with address lists repeating addresses or carrying addresses covered
+// by prefixes of the list fail with AddrListNormalized instead of raising the warning.
+func WithStrictAddrLists() TableOption {
+	return func(o *tableOptions) {
+		o.strictAddrLists = true
+	}
+}
+
+// addrPrefixLen returns the mask length of the address, an address without the mask is a host address
+func addrPrefixLen(addr *IPAddr) uint8 {
+	if addr.Mask != nil {
+		return *addr.Mask
+	}
+
+	return uint8(len(getIP(addr)) * 8)
+}
+
+// normalizeAddrList returns addresses of the list ordered by address with duplicates and addresses
+// covered by prefixes of the list removed, the report is nil if nothing is removed. The list is not modified.
+func normalizeAddrList(list []*IPAddr) ([]*IPAddr, *AddrListNormalized) {
+	sorted := make([]*IPAddr, len(list))
+	copy(sorted, list)
+	// Prefixes sharing the address are ordered by the mask, so a prefix precedes addresses it covers
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if c := bytes.Compare(getIP(sorted[i]), getIP(sorted[j])); c != 0 {
+			return c < 0
+		}
+		return addrPrefixLen(sorted[i]) < addrPrefixLen(sorted[j])
+	})
+	kept := make([]*IPAddr, 0, len(sorted))
+	report := &AddrListNormalized{}
+	for i, addr := range sorted {
+		if i > 0 && addrPrefixLen(addr) == addrPrefixLen(sorted[i-1]) && bytes.Equal(getIP(addr), getIP(sorted[i-1])) {
+			report.Duplicates = append(report.Duplicates, addr)
+			continue
+		}
+		if len(kept) != 0 {
+			// Only the last kept prefix can cover the address, earlier ones end before it starts
+			last := kept[len(kept)-1]
+			if addrPrefixLen(last) <= addrPrefixLen(addr) && isSubnet(last, addr) {
+				report.Covered = append(report.Covered, CoveredAddr{Addr: addr, By: last})
+				continue
+			}
+		}
+		kept = append(kept, addr)
+	}
+	if len(report.Duplicates) == 0 && len(report.Covered) == 0 {
+		return kept, nil
+	}
+
+	return kept, report
+}
+
+// checkAddrLists raises AddrListNormalized if address lists the sets of the rule are built from were
+// normalized, the warning is returned as an error if the table is strict.
+func (nfr *nfRules) checkAddrLists(sets []*nfSet) error {
+	var w *AddrListNormalized
+	for _, s := range sets {
+		if s.normalized == nil {
+			continue
+		}
+		if w == nil {
+			w = &AddrListNormalized{Table: nfr.table.Name, Chain: nfr.chain.Name}
+		}
+		w.merge(s.normalized)
+	}
+	if w == nil {
+		return nil
+	}
+	if nfr.opts.strictAddrListsNormalization() {
+		return w
+	}
+	if h := nfr.opts.warningHandler(); h != nil {
+		h(w)
+	}
+
+	return nil
+}
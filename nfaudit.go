@@ -0,0 +1,628 @@
+package nftableslib
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// AuditStatus tells how much of a rule programmed on the host is represented by the Rule model
+type AuditStatus int
+
+const (
+	// AuditMapped rules are fully represented by structured fields of the Rule
+	AuditMapped AuditStatus = iota
+	// AuditPartial rules are represented by the Rule with some expressions carried by RawExprs
+	AuditPartial
+	// AuditOpaque rules cannot be represented by the Rule
+	AuditOpaque
+)
+
+func (s AuditStatus) String() string {
+	switch s {
+	case AuditMapped:
+		return "mapped"
+	case AuditPartial:
+		return "partial"
+	case AuditOpaque:
+		return "opaque"
+	}
+
+	return fmt.Sprintf("status %d", int(s))
+}
+
+// RuleAudit is the result of mapping a single rule programmed on the host to the Rule model
+type RuleAudit struct {
+	Table  *nftables.Table
+	Chain  string
+	Handle uint64
+	Status AuditStatus
+	// Rule is the rule equivalent to the rule on the host, it is nil for opaque rules
+	Rule *Rule
+	// Reasons explain why the rule is partially mapped or opaque
+	Reasons []string
+}
+
+// AuditReport lists results of mapping rules programmed on the host to the Rule model
+type AuditReport struct {
+	Rules []*RuleAudit
+}
+
+// Count returns the number of rules of the report with the status
+func (r *AuditReport) Count(s AuditStatus) int {
+	n := 0
+	for _, ra := range r.Rules {
+		if ra.Status == s {
+			n++
+		}
+	}
+
+	return n
+}
+
+// AuditRuleset walks all tables, chains and rules programmed on the host and maps every rule
+// to the Rule model. A rule is mapped when the Rule generates expressions matching the same packets
+// and applying the same statements in the same order as the rule on the host, it is partially mapped
+// when some of its expressions are carried verbatim by RawExprs. Rules with expressions
+// github.com/google/nftables cannot decode, or which cannot be reproduced by the Rule, are opaque.
+func (nft *nfTables) AuditRuleset() (*AuditReport, error) {
+	var tables []*nftables.Table
+	if err := nft.reads.do(func() (err error) {
+		tables, _, err = listTables(nft.conn, listFilter{})
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	var chains []*nftables.Chain
+	if err := nft.reads.do(func() (err error) {
+		chains, _, err = listChains(nft.conn, listFilter{})
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	report := &AuditReport{Rules: make([]*RuleAudit, 0)}
+	for _, t := range tables {
+		var sets auditSets
+		if err := nft.reads.do(func() (err error) {
+			sets, err = getAuditSets(nft.conn, t)
+			return err
+		}); err != nil {
+			return nil, fmt.Errorf("failed to get sets of table %s with error: %+v", t.Name, err)
+		}
+		for _, c := range chains {
+			if c.Table.Name != t.Name || c.Table.Family != t.Family {
+				continue
+			}
+			var rules []*auditedRule
+			if err := nft.reads.do(func() (err error) {
+				rules, err = getAuditedRules(nft.conn, t, c)
+				return err
+			}); err != nil {
+				return nil, fmt.Errorf("failed to get rules of chain %s of table %s with error: %+v", c.Name, t.Name, err)
+			}
+			for _, r := range rules {
+				ra := auditRule(t.Family, r.exprs, sets)
+				ra.Table, ra.Chain, ra.Handle = t, c.Name, r.handle
+				report.Rules = append(report.Rules, ra)
+			}
+		}
+	}
+
+	return report, nil
+}
+
+// auditSets carries sets of the table referenced by lookups of the audited rules
+type auditSets map[string]*nfSet
+
+func getAuditSets(conn NetNS, t *nftables.Table) (auditSets, error) {
+	sets, err := getSets(conn, t)
+	if err != nil {
+		return nil, err
+	}
+	as := make(auditSets, len(sets))
+	for _, s := range sets {
+		s.Table = t
+		decodeSet(s)
+		elements, err := getSetElements(conn, s)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get elements of set %s with error: %+v", s.Name, err)
+		}
+		as[s.Name] = &nfSet{set: s, elements: elements}
+	}
+
+	return as, nil
+}
+
+// auditExpr is an expression of the audited rule, expr is nil when the expression cannot be decoded
+type auditExpr struct {
+	name   string
+	expr   expr.Any
+	reason string
+}
+
+type auditedRule struct {
+	handle   uint64
+	exprs    []auditExpr
+	userData []byte
+}
+
+// getAuditedRules returns rules of the chain, github.com/google/nftables drops expressions it does
+// not know, so rules of its connections are dumped by the library keeping every expression.
+func getAuditedRules(conn NetNS, t *nftables.Table, c *nftables.Chain) ([]*auditedRule, error) {
+	nc, ok := readConn(conn).(*nftables.Conn)
+	if !ok {
+		rules, err := conn.GetRule(t, c)
+		if err != nil {
+			return nil, err
+		}
+		audited := make([]*auditedRule, 0, len(rules))
+		for _, r := range rules {
+			ar := &auditedRule{handle: r.Handle, exprs: make([]auditExpr, 0, len(r.Exprs)), userData: r.UserData}
+			for _, e := range r.Exprs {
+				ar.exprs = append(ar.exprs, auditExpr{name: exprName(e), expr: e})
+			}
+			audited = append(audited, ar)
+		}
+		return audited, nil
+	}
+	data, err := netlink.MarshalAttributes([]netlink.Attribute{
+		{Type: unix.NFTA_RULE_TABLE, Data: []byte(t.Name + "\x00")},
+		{Type: unix.NFTA_RULE_CHAIN, Data: []byte(c.Name + "\x00")},
+	})
+	if err != nil {
+		return nil, err
+	}
+	msg := netlink.Message{
+		Header: netlink.Header{
+			Type:  netlink.HeaderType((unix.NFNL_SUBSYS_NFTABLES << 8) | unix.NFT_MSG_GETRULE),
+			Flags: netlink.Request | netlink.Acknowledge | netlink.Dump,
+		},
+		// nfgenmsg header: family, version and resource id
+		Data: append([]byte{uint8(t.Family), unix.NFNETLINK_V0, 0, 0}, data...),
+	}
+	audited := make([]*auditedRule, 0)
+	if err := dumpMessages(nc, msg, func(b []byte) error {
+		r, err := auditedRuleFromMessage(b)
+		if err != nil {
+			return err
+		}
+		audited = append(audited, r)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	return audited, nil
+}
+
+// auditedRuleFromMessage decodes the handle and expressions of the rule carried by NFT_MSG_NEWRULE message
+func auditedRuleFromMessage(b []byte) (*auditedRule, error) {
+	if len(b) < 4 {
+		return nil, fmt.Errorf("short rule message")
+	}
+	ad, err := netlink.NewAttributeDecoder(b[4:])
+	if err != nil {
+		return nil, err
+	}
+	ad.ByteOrder = binary.BigEndian
+	r := &auditedRule{exprs: make([]auditExpr, 0)}
+	for ad.Next() {
+		switch ad.Type() {
+		case unix.NFTA_RULE_HANDLE:
+			r.handle = ad.Uint64()
+		case unix.NFTA_RULE_USERDATA:
+			r.userData = ad.Bytes()
+		case unix.NFTA_RULE_EXPRESSIONS:
+			ad.Nested(func(lad *netlink.AttributeDecoder) error {
+				for lad.Next() {
+					if lad.Type() != unix.NFTA_LIST_ELEM {
+						continue
+					}
+					e, err := decodeAuditExpr(lad.Bytes())
+					if err != nil {
+						return err
+					}
+					r.exprs = append(r.exprs, e)
+				}
+				return lad.Err()
+			})
+		}
+	}
+
+	return r, ad.Err()
+}
+
+func decodeAuditExpr(b []byte) (auditExpr, error) {
+	ae := auditExpr{}
+	ad, err := netlink.NewAttributeDecoder(b)
+	if err != nil {
+		return ae, err
+	}
+	ad.ByteOrder = binary.BigEndian
+	var data []byte
+	for ad.Next() {
+		switch ad.Type() {
+		case unix.NFTA_EXPR_NAME:
+			ae.name = ad.String()
+		case unix.NFTA_EXPR_DATA:
+			data = ad.Bytes()
+		}
+	}
+	if err := ad.Err(); err != nil {
+		return ae, err
+	}
+	ae.expr, ae.reason, err = unmarshalAuditExpr(ae.name, data)
+
+	return ae, err
+}
+
+// unmarshalAuditExpr decodes data of the expression, expressions github.com/google/nftables does not
+// know or decodes incompletely are returned as nil along with the reason.
+func unmarshalAuditExpr(name string, data []byte) (expr.Any, string, error) {
+	var e expr.Any
+	switch name {
+	case "meta":
+		return unmarshalMeta(data)
+	case "cmp":
+		e = &expr.Cmp{}
+	case "counter":
+		e = &expr.Counter{}
+	case "payload":
+		e = &expr.Payload{}
+	case "bitwise":
+		e = &expr.Bitwise{}
+	case "redir":
+		e = &expr.Redir{}
+	case "nat":
+		e = &expr.NAT{}
+	case "limit":
+		e = &expr.Limit{}
+	case "dynset":
+		e = &expr.Dynset{}
+	case "masq":
+		e = &expr.Masq{}
+	case "reject":
+		e = &expr.Reject{}
+	case "notrack":
+		e = &expr.Notrack{}
+	case "objref":
+		e = &expr.Objref{}
+	case "queue":
+		e = &expr.Queue{}
+	case "tproxy":
+		e = &expr.TProxy{}
+	case "immediate":
+		return unmarshalImmediate(data)
+	case "ct":
+		return unmarshalCt(data)
+	case "lookup":
+		return unmarshalLookup(data)
+	case "range":
+		return unmarshalRange(data)
+	case "byteorder":
+		return unmarshalByteorder(data)
+	case "log":
+		return unmarshalLog(data)
+	case "fib":
+		return unmarshalFib(data)
+	default:
+		return nil, fmt.Sprintf("expression %s is not supported by github.com/google/nftables", name), nil
+	}
+	if err := expr.Unmarshal(data, e); err != nil {
+		return nil, "", fmt.Errorf("failed to decode expression %s with error: %+v", name, err)
+	}
+
+	return e, "", nil
+}
+
+// unmarshalImmediate decodes immediate expressions, verdicts are decoded along with the chain
+func unmarshalImmediate(data []byte) (expr.Any, string, error) {
+	ad, err := netlink.NewAttributeDecoder(data)
+	if err != nil {
+		return nil, "", err
+	}
+	ad.ByteOrder = binary.BigEndian
+	imm := &expr.Immediate{}
+	var verdict *expr.Verdict
+	for ad.Next() {
+		switch ad.Type() {
+		case unix.NFTA_IMMEDIATE_DREG:
+			imm.Register = ad.Uint32()
+		case unix.NFTA_IMMEDIATE_DATA:
+			ad.Nested(func(nad *netlink.AttributeDecoder) error {
+				for nad.Next() {
+					switch nad.Type() {
+					case unix.NFTA_DATA_VALUE:
+						imm.Data = nad.Bytes()
+					case unix.NFTA_DATA_VERDICT:
+						verdict = &expr.Verdict{}
+						nad.Nested(func(vad *netlink.AttributeDecoder) error {
+							for vad.Next() {
+								switch vad.Type() {
+								case unix.NFTA_VERDICT_CODE:
+									verdict.Kind = expr.VerdictKind(int32(vad.Uint32()))
+								case unix.NFTA_VERDICT_CHAIN:
+									verdict.Chain = vad.String()
+								}
+							}
+							return nil
+						})
+					}
+				}
+				return nil
+			})
+		}
+	}
+	if verdict != nil {
+		return verdict, "", ad.Err()
+	}
+
+	return imm, "", ad.Err()
+}
+
+// unmarshalMeta decodes meta expressions, github.com/google/nftables does not decode the source register
+// of meta set statements.
+func unmarshalMeta(data []byte) (expr.Any, string, error) {
+	ad, err := netlink.NewAttributeDecoder(data)
+	if err != nil {
+		return nil, "", err
+	}
+	ad.ByteOrder = binary.BigEndian
+	m := &expr.Meta{}
+	for ad.Next() {
+		switch ad.Type() {
+		case unix.NFTA_META_KEY:
+			m.Key = expr.MetaKey(ad.Uint32())
+		case unix.NFTA_META_DREG:
+			m.Register = ad.Uint32()
+		case unix.NFTA_META_SREG:
+			m.Register = ad.Uint32()
+			m.SourceRegister = true
+		}
+	}
+
+	return m, "", ad.Err()
+}
+
+// unmarshalCt decodes ct expressions, github.com/google/nftables does not decode the source register
+// of ct set statements.
+func unmarshalCt(data []byte) (expr.Any, string, error) {
+	ad, err := netlink.NewAttributeDecoder(data)
+	if err != nil {
+		return nil, "", err
+	}
+	ad.ByteOrder = binary.BigEndian
+	ct := &expr.Ct{}
+	for ad.Next() {
+		switch ad.Type() {
+		case unix.NFTA_CT_KEY:
+			ct.Key = expr.CtKey(ad.Uint32())
+		case unix.NFTA_CT_DREG:
+			ct.Register = ad.Uint32()
+		case unix.NFTA_CT_SREG:
+			ct.Register = ad.Uint32()
+			ct.SourceRegister = true
+		case unix.NFTA_CT_DIRECTION:
+			return nil, "ct expression with a direction is not supported by github.com/google/nftables", nil
+		}
+	}
+
+	return ct, "", ad.Err()
+}
+
+// unmarshalLookup decodes lookup expressions, github.com/google/nftables does not flag lookups
+// of maps, so lookups of verdict maps cannot be told from lookups of sets.
+func unmarshalLookup(data []byte) (expr.Any, string, error) {
+	ad, err := netlink.NewAttributeDecoder(data)
+	if err != nil {
+		return nil, "", err
+	}
+	ad.ByteOrder = binary.BigEndian
+	l := &expr.Lookup{}
+	for ad.Next() {
+		switch ad.Type() {
+		case unix.NFTA_LOOKUP_SET:
+			l.SetName = ad.String()
+		case unix.NFTA_LOOKUP_SET_ID:
+			l.SetID = ad.Uint32()
+		case unix.NFTA_LOOKUP_SREG:
+			l.SourceRegister = ad.Uint32()
+		case unix.NFTA_LOOKUP_DREG:
+			l.DestRegister = ad.Uint32()
+			l.IsDestRegSet = true
+		case unix.NFTA_LOOKUP_FLAGS:
+			l.Invert = ad.Uint32()&unix.NFT_LOOKUP_F_INV != 0
+		}
+	}
+
+	return l, "", ad.Err()
+}
+
+// unmarshalByteorder decodes byteorder expressions, github.com/google/nftables does not implement it
+func unmarshalByteorder(data []byte) (expr.Any, string, error) {
+	ad, err := netlink.NewAttributeDecoder(data)
+	if err != nil {
+		return nil, "", err
+	}
+	ad.ByteOrder = binary.BigEndian
+	b := &expr.Byteorder{}
+	for ad.Next() {
+		switch ad.Type() {
+		case unix.NFTA_BYTEORDER_SREG:
+			b.SourceRegister = ad.Uint32()
+		case unix.NFTA_BYTEORDER_DREG:
+			b.DestRegister = ad.Uint32()
+		case unix.NFTA_BYTEORDER_OP:
+			b.Op = expr.ByteorderOp(ad.Uint32())
+		case unix.NFTA_BYTEORDER_LEN:
+			b.Len = ad.Uint32()
+		case unix.NFTA_BYTEORDER_SIZE:
+			b.Size = ad.Uint32()
+		}
+	}
+
+	return b, "", ad.Err()
+}
+
+// unmarshalRange decodes range expressions, github.com/google/nftables keeps the nested attributes
+// of the range's ends instead of their values.
+func unmarshalRange(data []byte) (expr.Any, string, error) {
+	ad, err := netlink.NewAttributeDecoder(data)
+	if err != nil {
+		return nil, "", err
+	}
+	ad.ByteOrder = binary.BigEndian
+	rng := &expr.Range{}
+	value := func(v *[]byte) func(*netlink.AttributeDecoder) error {
+		return func(nad *netlink.AttributeDecoder) error {
+			for nad.Next() {
+				if nad.Type() == unix.NFTA_DATA_VALUE {
+					*v = nad.Bytes()
+				}
+			}
+			return nil
+		}
+	}
+	for ad.Next() {
+		switch ad.Type() {
+		case unix.NFTA_RANGE_OP:
+			rng.Op = expr.CmpOp(ad.Uint32())
+		case unix.NFTA_RANGE_SREG:
+			rng.Register = ad.Uint32()
+		case unix.NFTA_RANGE_FROM_DATA:
+			ad.Nested(value(&rng.FromData))
+		case unix.NFTA_RANGE_TO_DATA:
+			ad.Nested(value(&rng.ToData))
+		}
+	}
+
+	return rng, "", ad.Err()
+}
+
+// unmarshalLog decodes log expressions, expr.Log carries a single attribute, so logs with
+// more attributes cannot be represented.
+func unmarshalLog(data []byte) (expr.Any, string, error) {
+	ad, err := netlink.NewAttributeDecoder(data)
+	if err != nil {
+		return nil, "", err
+	}
+	ad.ByteOrder = binary.BigEndian
+	log := &expr.Log{}
+	n := 0
+	for ad.Next() {
+		n++
+		log.Key = uint32(ad.Type())
+		log.Data = ad.Bytes()
+		switch log.Key {
+		case unix.NFTA_LOG_PREFIX, unix.NFTA_LOG_LEVEL:
+			if l := len(log.Data); l != 0 && log.Data[l-1] == 0 {
+				log.Data = log.Data[:l-1]
+			}
+		}
+	}
+	if err := ad.Err(); err != nil {
+		return nil, "", err
+	}
+	if n > 1 {
+		return nil, fmt.Sprintf("log expression with %d attributes is not supported by github.com/google/nftables", n), nil
+	}
+
+	return log, "", nil
+}
+
+// unmarshalFib decodes fib expressions, github.com/google/nftables does not decode flags and results
+func unmarshalFib(data []byte) (expr.Any, string, error) {
+	ad, err := netlink.NewAttributeDecoder(data)
+	if err != nil {
+		return nil, "", err
+	}
+	ad.ByteOrder = binary.BigEndian
+	fib := &expr.Fib{}
+	for ad.Next() {
+		switch ad.Type() {
+		case unix.NFTA_FIB_DREG:
+			fib.Register = ad.Uint32()
+		case unix.NFTA_FIB_RESULT:
+			switch ad.Uint32() {
+			case unix.NFT_FIB_RESULT_OIF:
+				fib.ResultOIF = true
+			case unix.NFT_FIB_RESULT_OIFNAME:
+				fib.ResultOIFNAME = true
+			case unix.NFT_FIB_RESULT_ADDRTYPE:
+				fib.ResultADDRTYPE = true
+			}
+		case unix.NFTA_FIB_FLAGS:
+			flags := ad.Uint32()
+			fib.FlagSADDR = flags&unix.NFTA_FIB_F_SADDR != 0
+			fib.FlagDADDR = flags&unix.NFTA_FIB_F_DADDR != 0
+			fib.FlagMARK = flags&unix.NFTA_FIB_F_MARK != 0
+			fib.FlagIIF = flags&unix.NFTA_FIB_F_IIF != 0
+			fib.FlagOIF = flags&unix.NFTA_FIB_F_OIF != 0
+			fib.FlagPRESENT = flags&unix.NFTA_FIB_F_PRESENT != 0
+		}
+	}
+
+	return fib, "", ad.Err()
+}
+
+// exprName returns the name the kernel knows the expression by
+func exprName(e expr.Any) string {
+	switch e.(type) {
+	case *expr.Meta:
+		return "meta"
+	case *expr.Cmp:
+		return "cmp"
+	case *expr.Counter:
+		return "counter"
+	case *expr.Payload:
+		return "payload"
+	case *expr.Lookup:
+		return "lookup"
+	case *expr.Bitwise:
+		return "bitwise"
+	case *expr.Redir:
+		return "redir"
+	case *expr.NAT:
+		return "nat"
+	case *expr.Limit:
+		return "limit"
+	case *expr.Dynset:
+		return "dynset"
+	case *expr.Masq:
+		return "masq"
+	case *expr.Reject:
+		return "reject"
+	case *expr.Notrack:
+		return "notrack"
+	case *expr.Objref:
+		return "objref"
+	case *expr.Queue:
+		return "queue"
+	case *expr.TProxy:
+		return "tproxy"
+	case *expr.Immediate, *expr.Verdict:
+		return "immediate"
+	case *expr.Ct:
+		return "ct"
+	case *expr.Range:
+		return "range"
+	case *expr.Byteorder:
+		return "byteorder"
+	case *expr.Log:
+		return "log"
+	case *expr.Fib:
+		return "fib"
+	case *expr.Numgen:
+		return "numgen"
+	case *expr.Hash:
+		return "hash"
+	case *expr.Dup:
+		return "dup"
+	}
+
+	return fmt.Sprintf("%T", e)
+}
@@ -0,0 +1,1100 @@
+package nftableslib
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math/big"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+// atom is a match or a statement of a rule. A match loads a value into a register, optionally
+// masks it and compares it with data, a range or a set. Atoms of the rule on the host and of the rule
+// generated from the decoded Rule are compared by their keys, which do not depend on registers,
+// names of sets generated for rules or counters' values.
+type atom struct {
+	stmt  bool
+	key   string
+	exprs []expr.Any
+	// Fields of matches
+	load    expr.Any
+	mask    []byte
+	xor     []byte
+	op      expr.CmpOp
+	data    []byte
+	to      []byte
+	isRange bool
+	// hton is set when the loaded value is converted to network byte order before the comparison
+	hton   bool
+	set    *lookupSet
+	invert bool
+	// mark is set by "meta mark set" statements
+	mark *MetaMark
+}
+
+// lookupSet is the set a match looks up, elements of anonymous sets are normalized to inclusive
+// intervals, so sets with the same elements are equal regardless of how the elements are stored.
+type lookupSet struct {
+	name      string
+	anonymous bool
+	intervals [][2][]byte
+	key       string
+}
+
+// atomize groups expressions of the rule into atoms
+func atomize(family nftables.TableFamily, exprs []expr.Any, sets auditSets) []*atom {
+	atoms := make([]*atom, 0, len(exprs))
+	for i := 0; i < len(exprs); {
+		a := matchAtom(family, exprs[i:], sets)
+		if a == nil {
+			a = statementAtom(exprs[i:], sets)
+		}
+		atoms = append(atoms, a)
+		i += len(a.exprs)
+	}
+
+	return atoms
+}
+
+func exprAt(exprs []expr.Any, i int) expr.Any {
+	if i < len(exprs) {
+		return exprs[i]
+	}
+
+	return nil
+}
+
+// loadRegister returns the register the expression loads a value into
+func loadRegister(e expr.Any) (uint32, bool) {
+	switch l := e.(type) {
+	case *expr.Payload:
+		return l.DestRegister, l.OperationType == expr.PayloadLoad && l.DestRegister != 0
+	case *expr.Meta:
+		return l.Register, !l.SourceRegister
+	case *expr.Ct:
+		return l.Register, !l.SourceRegister
+	case *expr.Fib:
+		return l.Register, true
+	}
+
+	return 0, false
+}
+
+func matchAtom(family nftables.TableFamily, exprs []expr.Any, sets auditSets) *atom {
+	reg, ok := loadRegister(exprs[0])
+	if !ok {
+		return nil
+	}
+	a := &atom{load: exprs[0]}
+	n := 1
+	if b, ok := exprAt(exprs, n).(*expr.Bitwise); ok && b.SourceRegister == reg && b.DestRegister == reg {
+		a.mask, a.xor = b.Mask, b.Xor
+		n++
+	}
+	// [ byteorder reg 1 = hton(reg 1, 8, 8) ] converts conntrack counters loaded in host byte order
+	if b, ok := exprAt(exprs, n).(*expr.Byteorder); ok && b.SourceRegister == reg && b.DestRegister == reg && b.Op == expr.ByteorderHton {
+		a.hton = true
+		n++
+	}
+	switch e := exprAt(exprs, n).(type) {
+	case *expr.Cmp:
+		if e.Register != reg {
+			return nil
+		}
+		a.op, a.data = e.Op, e.Data
+		n++
+		// nft matches a range by a pair of comparisons
+		if l, ok := exprAt(exprs, n).(*expr.Cmp); ok && e.Op == expr.CmpOpGte && l.Op == expr.CmpOpLte && l.Register == reg {
+			a.op, a.to, a.isRange = expr.CmpOpEq, l.Data, true
+			n++
+		}
+	case *expr.Range:
+		if e.Register != reg {
+			return nil
+		}
+		a.op, a.data, a.to, a.isRange = e.Op, e.FromData, e.ToData, true
+		n++
+	case *expr.Lookup:
+		// Lookups of maps are statements
+		if e.SourceRegister != reg || e.IsDestRegSet {
+			return nil
+		}
+		a.set = lookupSetOf(e.SetName, sets, loadLen(a.load))
+		a.invert = e.Invert
+		n++
+	default:
+		return nil
+	}
+	a.exprs = exprs[:n]
+	a.key = matchKey(family, a)
+
+	return a
+}
+
+func loadLen(e expr.Any) int {
+	if p, ok := e.(*expr.Payload); ok {
+		return int(p.Len)
+	}
+
+	return 0
+}
+
+func matchKey(family nftables.TableFamily, a *atom) string {
+	var k string
+	switch l := a.load.(type) {
+	case *expr.Payload:
+		k = fmt.Sprintf("payload %d+%d/%d", l.Base, l.Offset, l.Len)
+		// In ipv4 tables the protocol field and meta l4proto carry the same value
+		if family == nftables.TableFamilyIPv4 && l.Base == expr.PayloadBaseNetworkHeader && l.Offset == 9 && l.Len == 1 && a.mask == nil {
+			k = fmt.Sprintf("meta %d", expr.MetaKeyL4PROTO)
+		}
+	case *expr.Meta:
+		k = fmt.Sprintf("meta %d", l.Key)
+	case *expr.Ct:
+		k = fmt.Sprintf("ct %d", l.Key)
+	case *expr.Fib:
+		f := *l
+		f.Register = 0
+		k = fmt.Sprintf("fib %+v", f)
+	}
+	if a.mask != nil {
+		k += fmt.Sprintf(" & %x ^ %x", a.mask, a.xor)
+	}
+	if a.hton {
+		k += " hton"
+	}
+	switch {
+	case a.set != nil:
+		k += fmt.Sprintf(" lookup %s invert %t", a.set.key, a.invert)
+	case a.isRange:
+		k += fmt.Sprintf(" range %d %x-%x", a.op, a.data, a.to)
+	default:
+		k += fmt.Sprintf(" cmp %d %x", a.op, a.data)
+	}
+
+	return k
+}
+
+func statementAtom(exprs []expr.Any, sets auditSets) *atom {
+	a := &atom{stmt: true}
+	// [ immediate reg 1 0x0000dead ] [ meta set mark with reg 1 ]
+	if imm, ok := exprs[0].(*expr.Immediate); ok {
+		if m, ok := exprAt(exprs, 1).(*expr.Meta); ok && m.SourceRegister && m.Key == expr.MetaKeyMARK && m.Register == imm.Register && len(imm.Data) == 4 {
+			a.mark = &MetaMark{Set: true, Value: binaryutil.NativeEndian.Uint32(imm.Data)}
+			a.exprs = exprs[:2]
+			a.key = fmt.Sprintf("meta set mark %#x", a.mark.Value)
+			return a
+		}
+	}
+	// [ meta load mark => reg 1 ] [ bitwise reg 1 = (reg=1 & 0xffff0000 ) ^ 0x0000dead ] [ meta set mark with reg 1 ]
+	if l, ok := exprs[0].(*expr.Meta); ok && !l.SourceRegister && l.Key == expr.MetaKeyMARK {
+		b, ok := exprAt(exprs, 1).(*expr.Bitwise)
+		s, set := exprAt(exprs, 2).(*expr.Meta)
+		if ok && set && b.SourceRegister == l.Register && b.DestRegister == l.Register && len(b.Mask) == 4 && len(b.Xor) == 4 &&
+			s.SourceRegister && s.Key == expr.MetaKeyMARK && s.Register == l.Register {
+			a.mark = &MetaMark{
+				Set:   true,
+				Value: binaryutil.NativeEndian.Uint32(b.Xor),
+				Mask:  ^binaryutil.NativeEndian.Uint32(b.Mask),
+			}
+			a.exprs = exprs[:3]
+			a.key = fmt.Sprintf("meta set mark %#x mask %#x", a.mark.Value, a.mark.Mask)
+			return a
+		}
+	}
+	a.exprs = exprs[:1]
+	switch e := exprs[0].(type) {
+	case *expr.Counter:
+		a.key = "counter"
+	case *expr.Lookup:
+		a.key = fmt.Sprintf("lookup %s %+v", lookupSetOf(e.SetName, sets, 0).key, expr.Lookup{
+			SourceRegister: e.SourceRegister,
+			DestRegister:   e.DestRegister,
+			IsDestRegSet:   e.IsDestRegSet,
+			Invert:         e.Invert,
+		})
+	default:
+		a.key = fmt.Sprintf("%s %+v", exprName(e), e)
+	}
+
+	return a
+}
+
+// lookupSetOf returns the set a lookup refers to, keys of anonymous sets longer than the loaded
+// value, like IPv4 addresses stored in 16 bytes, are cut to the value's length.
+func lookupSetOf(name string, sets auditSets, keyLen int) *lookupSet {
+	s, ok := sets[name]
+	if !ok || !s.set.Anonymous {
+		return &lookupSet{name: name, key: "@" + name}
+	}
+	ls := &lookupSet{name: name, anonymous: true}
+	if s.set.IsMap {
+		entries := make([]string, 0, len(s.elements))
+		for _, e := range s.elements {
+			data := fmt.Sprintf("%x", e.Val)
+			if e.VerdictData != nil {
+				data = fmt.Sprintf("%d %s", e.VerdictData.Kind, e.VerdictData.Chain)
+			}
+			entries = append(entries, fmt.Sprintf("%x: %s", e.Key, data))
+		}
+		sort.Strings(entries)
+		ls.key = "{" + strings.Join(entries, ", ") + "}"
+		return ls
+	}
+	ls.intervals = setIntervals(s.elements, s.set.Interval, keyLen)
+	entries := make([]string, 0, len(ls.intervals))
+	for _, i := range ls.intervals {
+		entries = append(entries, fmt.Sprintf("%x-%x", i[0], i[1]))
+	}
+	ls.key = "{" + strings.Join(entries, ", ") + "}"
+
+	return ls
+}
+
+// setIntervals returns sorted inclusive intervals matched by elements of the set, adjacent
+// intervals are merged. An element of an interval set starts an interval which lasts until
+// the following element flagged as the interval's end.
+func setIntervals(elements []nftables.SetElement, interval bool, keyLen int) [][2][]byte {
+	type bound struct {
+		key []byte
+		end bool
+	}
+	bounds := make([]bound, 0, len(elements))
+	for _, e := range elements {
+		k := e.Key
+		if keyLen != 0 && len(k) > keyLen {
+			k = k[len(k)-keyLen:]
+		}
+		bounds = append(bounds, bound{key: k, end: e.IntervalEnd && interval})
+	}
+	sort.SliceStable(bounds, func(i, j int) bool {
+		if c := bytes.Compare(bounds[i].key, bounds[j].key); c != 0 {
+			return c < 0
+		}
+		// An interval ending where the next one starts does not cut the next one
+		return bounds[i].end && !bounds[j].end
+	})
+	intervals := make([][2][]byte, 0, len(bounds))
+	if !interval {
+		for _, b := range bounds {
+			intervals = append(intervals, [2][]byte{b.key, b.key})
+		}
+		return mergeIntervals(intervals)
+	}
+	var start []byte
+	for _, b := range bounds {
+		switch {
+		case !b.end && start == nil:
+			start = b.key
+		case b.end && start != nil:
+			last := new(big.Int).Sub(new(big.Int).SetBytes(b.key), big.NewInt(1))
+			intervals = append(intervals, [2][]byte{start, fixedBytes(last, len(b.key))})
+			start = nil
+		}
+	}
+	if start != nil {
+		intervals = append(intervals, [2][]byte{start, bytes.Repeat([]byte{0xff}, len(start))})
+	}
+
+	return mergeIntervals(intervals)
+}
+
+func mergeIntervals(intervals [][2][]byte) [][2][]byte {
+	merged := make([][2][]byte, 0, len(intervals))
+	for _, i := range intervals {
+		if l := len(merged) - 1; l >= 0 {
+			next := new(big.Int).Add(new(big.Int).SetBytes(merged[l][1]), big.NewInt(1))
+			if new(big.Int).SetBytes(i[0]).Cmp(next) <= 0 {
+				if bytes.Compare(i[1], merged[l][1]) > 0 {
+					merged[l][1] = i[1]
+				}
+				continue
+			}
+		}
+		merged = append(merged, i)
+	}
+
+	return merged
+}
+
+func fixedBytes(v *big.Int, l int) []byte {
+	b := v.Bytes()
+	if len(b) >= l {
+		return b[len(b)-l:]
+	}
+
+	return append(make([]byte, l-len(b)), b...)
+}
+
+// intervalPrefixes returns the shortest list of prefixes covering the inclusive interval
+func intervalPrefixes(from, to []byte) []*IPAddr {
+	bits := len(from) * 8
+	start, end := new(big.Int).SetBytes(from), new(big.Int).SetBytes(to)
+	addrs := make([]*IPAddr, 0)
+	for start.Cmp(end) <= 0 {
+		// The largest block aligned at start and not reaching past end
+		size := bits
+		for size > 0 {
+			block := new(big.Int).Lsh(big.NewInt(1), uint(bits-size+1))
+			if new(big.Int).Mod(start, block).Sign() != 0 {
+				break
+			}
+			last := new(big.Int).Sub(new(big.Int).Add(start, block), big.NewInt(1))
+			if last.Cmp(end) > 0 {
+				break
+			}
+			size--
+		}
+		addrs = append(addrs, ipAddr(fixedBytes(start, len(from)), uint8(size)))
+		start.Add(start, new(big.Int).Lsh(big.NewInt(1), uint(bits-size)))
+	}
+
+	return addrs
+}
+
+func ipAddr(ip []byte, prefix uint8) *IPAddr {
+	return &IPAddr{
+		IPAddr: &net.IPAddr{IP: net.IP(append([]byte{}, ip...))},
+		CIDR:   true,
+		Mask:   &prefix,
+	}
+}
+
+// prefixLen returns the length of the prefix of the contiguous mask
+func prefixLen(mask []byte) (uint8, bool) {
+	ones, bits := net.IPMask(mask).Size()
+	if bits == 0 {
+		return 0, false
+	}
+
+	return uint8(ones), true
+}
+
+// operatorOf returns the operator of the comparison
+func operatorOf(op expr.CmpOp) Operator {
+	switch op {
+	case expr.CmpOpNeq:
+		return NEQ
+	case expr.CmpOpGt:
+		return GT
+	case expr.CmpOpGte:
+		return GTE
+	case expr.CmpOpLt:
+		return LT
+	case expr.CmpOpLte:
+		return LTE
+	}
+
+	return EQ
+}
+
+// signature describes what the atoms do, statements are listed in the order they are applied
+// along with matches evaluated before them. Rules with the same signature match the same packets
+// and apply the same statements to them.
+func signature(atoms []*atom) string {
+	seen := make(map[string]bool)
+	keys := func() string {
+		k := make([]string, 0, len(seen))
+		for m := range seen {
+			k = append(k, m)
+		}
+		sort.Strings(k)
+		return strings.Join(k, "; ")
+	}
+	var b strings.Builder
+	for _, a := range atoms {
+		if !a.stmt {
+			seen[a.key] = true
+			continue
+		}
+		fmt.Fprintf(&b, "%s after [%s]\n", a.key, keys())
+	}
+	fmt.Fprintf(&b, "[%s]", keys())
+
+	return b.String()
+}
+
+// counterPlacement selects the field of the Rule carrying a counter which does not start the rule
+type counterPlacement int
+
+const (
+	counterL4 counterPlacement = iota
+	counterL3
+	counterRaw
+)
+
+// auditVariants are tried in order until the decoded Rule reproduces the rule, statements
+// which the Rule applies at other positions than the rule does are carried by RawExprs.
+var auditVariants = []struct {
+	counter  counterPlacement
+	rawStmts bool
+}{
+	{counter: counterL4},
+	{counter: counterL3},
+	{counter: counterRaw},
+	{counter: counterRaw, rawStmts: true},
+}
+
+// auditRule maps expressions of the rule to the Rule model
+func auditRule(family nftables.TableFamily, aexprs []auditExpr, sets auditSets) *RuleAudit {
+	ra := &RuleAudit{Status: AuditOpaque, Reasons: make([]string, 0)}
+	exprs := make([]expr.Any, 0, len(aexprs))
+	for _, e := range aexprs {
+		if e.expr == nil {
+			ra.Reasons = append(ra.Reasons, e.reason)
+			continue
+		}
+		exprs = append(exprs, e.expr)
+	}
+	if len(ra.Reasons) != 0 {
+		return ra
+	}
+	atoms := atomize(family, exprs, sets)
+	want := signature(atoms)
+	var opaque []string
+	// A variant mapping the whole rule is preferred over the first variant using RawExprs
+	var partial *ruleDecoder
+	for _, v := range auditVariants {
+		d := &ruleDecoder{family: family, sets: sets, rule: &Rule{}, counter: v.counter, rawStmts: v.rawStmts}
+		d.decode(atoms)
+		if len(d.opaque) != 0 {
+			opaque = d.opaque
+			continue
+		}
+		got, err := rebuildAtoms(family, d.rule)
+		if err != nil || signature(got) != want {
+			continue
+		}
+		if len(d.rule.RawExprs) == 0 {
+			ra.Rule = d.rule
+			ra.Status = AuditMapped
+			return ra
+		}
+		if partial == nil {
+			partial = d
+		}
+	}
+	if partial != nil {
+		ra.Rule = partial.rule
+		ra.Status = AuditPartial
+		ra.Reasons = partial.reasons
+		return ra
+	}
+	if opaque != nil {
+		ra.Reasons = opaque
+		return ra
+	}
+	ra.Reasons = append(ra.Reasons, "the rule cannot reproduce the order the expressions are evaluated in")
+
+	return ra
+}
+
+// rebuildAtoms returns atoms of expressions the library generates for the rule, the sets
+// generated for the rule are queued on a connection which is never flushed.
+func rebuildAtoms(family nftables.TableFamily, rule *Rule) ([]*atom, error) {
+	nfr := &nfRules{
+		conn:  &nftables.Conn{},
+		table: &nftables.Table{Name: "audit", Family: family},
+		chain: &nftables.Chain{Name: "audit"},
+	}
+	rr, err := nfr.buildRule(rule)
+	if err != nil {
+		return nil, err
+	}
+	sets := make(auditSets, len(rr.sets))
+	for _, s := range rr.sets {
+		set := *s.set
+		set.Anonymous = true
+		sets[set.Name] = &nfSet{set: &set, elements: s.elements}
+	}
+
+	return atomize(family, rr.rule.Exprs, sets), nil
+}
+
+// ruleDecoder decodes atoms into the Rule, atoms it cannot decode are carried by RawExprs
+type ruleDecoder struct {
+	family nftables.TableFamily
+	sets   auditSets
+	rule   *Rule
+	// nfproto is the family selected by "meta nfproto" of rules of inet tables
+	nfproto  nftables.TableFamily
+	counter  counterPlacement
+	rawStmts bool
+	raw      []*atom
+	reasons  []string
+	opaque   []string
+}
+
+func (d *ruleDecoder) decode(atoms []*atom) {
+	counters := make([]*atom, 0)
+	for i := 0; i < len(atoms); i++ {
+		a := atoms[i]
+		if a.stmt {
+			if _, ok := a.exprs[0].(*expr.Counter); ok && len(a.exprs) == 1 {
+				if i == 0 {
+					d.rule.Counter = &Counter{}
+					continue
+				}
+				counters = append(counters, a)
+				continue
+			}
+			if !d.statement(a, i == len(atoms)-1) {
+				d.keep(a)
+			}
+			continue
+		}
+		var next *atom
+		if i+1 < len(atoms) && !atoms[i+1].stmt {
+			next = atoms[i+1]
+		}
+		ok, consumed := d.match(a, next)
+		if !ok {
+			d.keep(a)
+			continue
+		}
+		if consumed {
+			i++
+		}
+	}
+	for _, c := range counters {
+		switch {
+		case d.counter == counterL4 && d.rule.L4 != nil && d.rule.L4.Counter == nil:
+			d.rule.L4.Counter = &Counter{}
+		case d.counter == counterL3 && d.rule.L3 != nil && d.rule.L3.Counter == nil:
+			d.rule.L3.Counter = &Counter{}
+		default:
+			d.keep(c)
+		}
+	}
+	// Raw expressions keep the order of the rule
+	sort.SliceStable(d.raw, func(i, j int) bool { return atomIndex(atoms, d.raw[i]) < atomIndex(atoms, d.raw[j]) })
+	for _, a := range d.raw {
+		d.rule.RawExprs = append(d.rule.RawExprs, a.exprs...)
+		names := make([]string, 0, len(a.exprs))
+		for _, e := range a.exprs {
+			names = append(names, exprName(e))
+		}
+		d.reasons = append(d.reasons, fmt.Sprintf("expressions %s are carried by RawExprs", strings.Join(names, ", ")))
+	}
+}
+
+func atomIndex(atoms []*atom, a *atom) int {
+	for i := range atoms {
+		if atoms[i] == a {
+			return i
+		}
+	}
+
+	return len(atoms)
+}
+
+// keep carries the atom by RawExprs, anonymous sets are bound to the rule on the host,
+// so expressions referring to them cannot be carried.
+func (d *ruleDecoder) keep(a *atom) {
+	for _, e := range a.exprs {
+		var name string
+		switch l := e.(type) {
+		case *expr.Lookup:
+			name = l.SetName
+		case *expr.Dynset:
+			name = l.SetName
+		default:
+			continue
+		}
+		if s, ok := d.sets[name]; ok && s.set.Anonymous {
+			d.opaque = append(d.opaque, fmt.Sprintf("expression %s refers to anonymous set %s which cannot be carried by RawExprs", exprName(e), name))
+		}
+	}
+	d.raw = append(d.raw, a)
+}
+
+func (d *ruleDecoder) statement(a *atom, last bool) bool {
+	if last {
+		if action := actionOf(a); action != nil {
+			d.rule.Action = action
+			return true
+		}
+	}
+	if d.rawStmts {
+		return false
+	}
+	if a.mark != nil {
+		if d.rule.Meta == nil {
+			d.rule.Meta = &MetaRule{}
+		}
+		if d.rule.Meta.Mark != nil {
+			return false
+		}
+		d.rule.Meta.Mark = a.mark
+		return true
+	}
+	switch e := a.exprs[0].(type) {
+	case *expr.Log:
+		if d.rule.Log != nil {
+			return false
+		}
+		d.rule.Log = &Log{Key: e.Key, Value: e.Data}
+		return true
+	case *expr.Limit:
+		if d.rule.Limit != nil {
+			return false
+		}
+		d.rule.Limit = &Limit{
+			Rate:  e.Rate,
+			Unit:  time.Duration(e.Unit) * time.Second,
+			Burst: e.Burst,
+			Bytes: e.Type == expr.LimitTypePktBytes,
+			Over:  e.Over,
+		}
+		return true
+	}
+
+	return false
+}
+
+// actionOf returns the action applied by the statement, nil is returned if the statement
+// is not an action of the Rule model.
+func actionOf(a *atom) *RuleAction {
+	if len(a.exprs) != 1 {
+		return nil
+	}
+	var ra *RuleAction
+	var err error
+	switch e := a.exprs[0].(type) {
+	case *expr.Verdict:
+		switch e.Kind {
+		case expr.VerdictJump, expr.VerdictGoto:
+			ra, err = SetVerdict(int(e.Kind), e.Chain)
+		default:
+			ra, err = SetVerdict(int(e.Kind))
+		}
+	case *expr.Reject:
+		ra, err = SetReject(int(e.Type), int(e.Code))
+	case *expr.Masq:
+		if e.ToPorts {
+			return nil
+		}
+		ra, err = SetMasq(e.Random, e.FullyRandom, e.Persistent)
+	case *expr.Queue:
+		ra, err = SetQueue(e.Num, e.Total, e.Flag&expr.QueueFlagBypass != 0, e.Flag&expr.QueueFlagFanout != 0)
+	}
+	if err != nil {
+		return nil
+	}
+
+	return ra
+}
+
+// match decodes the match, the match may consume the next atom, like a port match guarded by
+// the protocol match.
+func (d *ruleDecoder) match(a *atom, next *atom) (bool, bool) {
+	// Only conntrack counters are converted to network byte order
+	if _, ok := a.load.(*expr.Ct); a.hton && !ok {
+		return false, false
+	}
+	switch l := a.load.(type) {
+	case *expr.Meta:
+		return d.meta(l, a, next)
+	case *expr.Payload:
+		if l.Base == expr.PayloadBaseNetworkHeader {
+			return d.network(l, a, next)
+		}
+	case *expr.Ct:
+		return d.conntrack(l, a), false
+	case *expr.Fib:
+		return d.fib(l, a), false
+	}
+
+	return false, false
+}
+
+// guard decodes the protocol match guarding the following port match
+func (d *ruleDecoder) guard(proto byte, next *atom) bool {
+	if next == nil {
+		return false
+	}
+	p, ok := next.load.(*expr.Payload)
+	if !ok || p.Base != expr.PayloadBaseTransportHeader || next.mask != nil {
+		return false
+	}
+	if isICMP(proto) && p.Len == 1 && p.Offset == 0 {
+		return d.icmp(proto, next)
+	}
+	if p.Len != 2 || (p.Offset != 0 && p.Offset != 2) {
+		return false
+	}
+
+	return d.port(proto, p.Offset, next)
+}
+
+// icmp decodes the match of ICMP or ICMPv6 types following the protocol match
+func (d *ruleDecoder) icmp(proto byte, a *atom) bool {
+	if d.rule.L4 != nil {
+		return false
+	}
+	icmp := &ICMP{}
+	switch {
+	case a.set != nil:
+		// ICMP match does not refer to named sets
+		if !a.set.anonymous {
+			return false
+		}
+		if a.invert {
+			icmp.RelOp = NEQ
+		}
+		for _, i := range a.set.intervals {
+			if len(i[0]) != 1 || len(i[1]) != 1 {
+				return false
+			}
+			for t := int(i[0][0]); t <= int(i[1][0]); t++ {
+				icmp.Types = append(icmp.Types, uint8(t))
+			}
+		}
+	case len(a.data) != 1 || a.isRange:
+		return false
+	default:
+		icmp.Types = []uint8{a.data[0]}
+		icmp.RelOp = operatorOf(a.op)
+	}
+	d.rule.L4 = &L4Rule{L4Proto: proto, ICMP: icmp}
+
+	return true
+}
+
+func (d *ruleDecoder) port(proto byte, offset uint32, a *atom) bool {
+	l4 := d.rule.L4
+	if l4 != nil && l4.L4Proto != proto {
+		return false
+	}
+	if l4 == nil {
+		l4 = &L4Rule{L4Proto: proto}
+	}
+	side := &l4.Src
+	if offset == 2 {
+		side = &l4.Dst
+	}
+	if *side != nil {
+		return false
+	}
+	port := &Port{}
+	switch {
+	case a.set != nil:
+		if a.invert {
+			port.RelOp = NEQ
+		}
+		if !a.set.anonymous {
+			port.SetRef = &SetRef{Name: a.set.name}
+			break
+		}
+		single := len(a.set.intervals) > 1
+		for _, i := range a.set.intervals {
+			single = single && bytes.Equal(i[0], i[1])
+		}
+		for _, i := range a.set.intervals {
+			if len(i[0]) != 2 {
+				return false
+			}
+			from, to := binary.BigEndian.Uint16(i[0]), binary.BigEndian.Uint16(i[1])
+			if single {
+				port.List = append(port.List, from)
+				continue
+			}
+			port.Ranges = append(port.Ranges, [2]uint16{from, to})
+		}
+	case len(a.data) != 2:
+		return false
+	case a.isRange:
+		if len(a.to) != 2 || (a.op != expr.CmpOpEq && a.op != expr.CmpOpNeq) {
+			return false
+		}
+		from, to := binary.BigEndian.Uint16(a.data), binary.BigEndian.Uint16(a.to)
+		port.Range = [2]uint16{from, to}
+		port.RelOp = operatorOf(a.op)
+	default:
+		port.List = []uint16{binary.BigEndian.Uint16(a.data)}
+		port.RelOp = operatorOf(a.op)
+	}
+	*side = port
+	d.rule.L4 = l4
+
+	return true
+}
+
+// l3family returns the family of the network header, rules of inet tables select it by "meta nfproto"
+func (d *ruleDecoder) l3family() nftables.TableFamily {
+	switch d.family {
+	case nftables.TableFamilyIPv4, nftables.TableFamilyIPv6:
+		return d.family
+	case nftables.TableFamilyINet:
+		return d.nfproto
+	}
+
+	return unix.NFPROTO_UNSPEC
+}
+
+func (d *ruleDecoder) l3() *L3Rule {
+	if d.rule.L3 == nil {
+		d.rule.L3 = &L3Rule{}
+	}
+
+	return d.rule.L3
+}
+
+func (d *ruleDecoder) network(p *expr.Payload, a *atom, next *atom) (bool, bool) {
+	family := d.l3family()
+	if family == unix.NFPROTO_UNSPEC || a.set == nil && len(a.data) != int(p.Len) {
+		return false, false
+	}
+	v4 := family == nftables.TableFamilyIPv4
+	switch {
+	case p.Offset == 0 && p.Len == 1 && bytes.Equal(a.mask, []byte{0xf0}) && bytes.Equal(a.xor, []byte{0}) && !a.isRange && a.set == nil:
+		if d.rule.L3 != nil && d.rule.L3.Version != nil {
+			return false, false
+		}
+		version := a.data[0] >> 4
+		d.l3().Version = &version
+		d.l3().VersionRelOp = operatorOf(a.op)
+		return true, false
+	case v4 && p.Offset == 0 && p.Len == 1 && bytes.Equal(a.mask, []byte{0x0f}) && bytes.Equal(a.xor, []byte{0}) && !a.isRange && a.set == nil:
+		if d.rule.L3 != nil && d.rule.L3.Options != nil || a.data[0] != 5 || a.op != expr.CmpOpEq && a.op != expr.CmpOpGt {
+			return false, false
+		}
+		options := a.op == expr.CmpOpGt
+		d.l3().Options = &options
+		return true, false
+	case (v4 && p.Offset == 9 || !v4 && p.Offset == 6) && p.Len == 1 && a.mask == nil && !a.isRange && a.set == nil:
+		// In ipv4 tables the protocol match guards port matches the way meta l4proto does
+		if d.family == nftables.TableFamilyIPv4 && a.op == expr.CmpOpEq && d.guard(a.data[0], next) {
+			return true, true
+		}
+		if d.rule.L3 != nil && d.rule.L3.Protocol != nil {
+			return false, false
+		}
+		proto := uint32(a.data[0])
+		d.l3().Protocol = &proto
+		d.l3().ProtocolRelOp = operatorOf(a.op)
+		return true, false
+	}
+	var src bool
+	switch {
+	case v4 && p.Len == 4 && p.Offset == 12, !v4 && p.Len == 16 && p.Offset == 8:
+		src = true
+	case v4 && p.Len == 4 && p.Offset == 16, !v4 && p.Len == 16 && p.Offset == 24:
+	default:
+		return false, false
+	}
+	spec := &IPAddrSpec{}
+	switch {
+	case a.mask != nil && a.set == nil && !a.isRange:
+		if !bytes.Equal(a.xor, make([]byte, len(a.xor))) || a.op != expr.CmpOpEq && a.op != expr.CmpOpNeq {
+			return false, false
+		}
+		spec.RelOp = operatorOf(a.op)
+		prefix, ok := prefixLen(a.mask)
+		if !ok {
+			// Non-contiguous mask, "ip saddr & mask == value"
+			spec.Masked = &MaskedAddr{Mask: ipAddr(a.mask, uint8(p.Len*8)), Value: ipAddr(a.data, uint8(p.Len*8))}
+			break
+		}
+		spec.List = []*IPAddr{ipAddr(a.data, prefix)}
+	case a.mask != nil:
+		return false, false
+	case a.set != nil:
+		if a.invert {
+			spec.RelOp = NEQ
+		}
+		if !a.set.anonymous {
+			spec.SetRef = &SetRef{Name: a.set.name}
+			break
+		}
+		for _, i := range a.set.intervals {
+			if len(i[0]) != int(p.Len) {
+				return false, false
+			}
+			spec.List = append(spec.List, intervalPrefixes(i[0], i[1])...)
+		}
+	case a.isRange:
+		if a.op != expr.CmpOpEq && a.op != expr.CmpOpNeq || len(a.to) != int(p.Len) {
+			return false, false
+		}
+		spec.Range = [2]*IPAddr{ipAddr(a.data, uint8(p.Len*8)), ipAddr(a.to, uint8(p.Len*8))}
+		spec.RelOp = operatorOf(a.op)
+	default:
+		if a.op != expr.CmpOpEq && a.op != expr.CmpOpNeq {
+			return false, false
+		}
+		spec.List = []*IPAddr{ipAddr(a.data, uint8(p.Len*8))}
+		spec.RelOp = operatorOf(a.op)
+	}
+	l3 := d.l3()
+	if src {
+		if l3.Src != nil {
+			return false, false
+		}
+		l3.Src = spec
+		return true, false
+	}
+	if l3.Dst != nil {
+		return false, false
+	}
+	l3.Dst = spec
+
+	return true, false
+}
+
+func (d *ruleDecoder) metaRule() *MetaRule {
+	if d.rule.Meta == nil {
+		d.rule.Meta = &MetaRule{}
+	}
+
+	return d.rule.Meta
+}
+
+func (d *ruleDecoder) meta(m *expr.Meta, a *atom, next *atom) (bool, bool) {
+	if a.isRange {
+		return false, false
+	}
+	if a.set != nil {
+		if a.set.anonymous || m.Key != expr.MetaKeyIIFNAME && m.Key != expr.MetaKeyOIFNAME || a.mask != nil {
+			return false, false
+		}
+		s := &IfNameSet{SetRef: &SetRef{Name: a.set.name}}
+		if a.invert {
+			s.RelOp = NEQ
+		}
+		meta := d.metaRule()
+		side := &meta.IIFNameSet
+		if m.Key == expr.MetaKeyOIFNAME {
+			side = &meta.OIFNameSet
+		}
+		if *side != nil {
+			return false, false
+		}
+		*side = s
+		return true, false
+	}
+	if m.Key == expr.MetaKeyMARK {
+		if a.op != expr.CmpOpEq || len(a.data) != 4 || d.rule.Meta != nil && d.rule.Meta.Mark != nil {
+			return false, false
+		}
+		mark := &MetaMark{Value: binaryutil.NativeEndian.Uint32(a.data)}
+		if a.mask != nil {
+			if len(a.mask) != 4 || !bytes.Equal(a.xor, make([]byte, 4)) {
+				return false, false
+			}
+			mark.Mask = binaryutil.NativeEndian.Uint32(a.mask)
+		}
+		d.metaRule().Mark = mark
+		return true, false
+	}
+	if a.mask != nil {
+		return false, false
+	}
+	if m.Key == expr.MetaKeyL4PROTO && a.op == expr.CmpOpEq && len(a.data) == 1 && d.guard(a.data[0], next) {
+		return true, true
+	}
+	meta := d.metaRule()
+	if a.op == expr.CmpOpEq {
+		switch {
+		case m.Key == expr.MetaKeyNFPROTO && len(a.data) == 1 && meta.NFProto == nil:
+			family := nftables.TableFamily(a.data[0])
+			meta.NFProto = &family
+			d.nfproto = family
+			return true, false
+		case m.Key == expr.MetaKeyL4PROTO && len(a.data) == 1 && meta.L4Proto == nil:
+			proto := a.data[0]
+			meta.L4Proto = &proto
+			return true, false
+		case m.Key == expr.MetaKeyIIFNAME && meta.IIFName == nil, m.Key == expr.MetaKeyOIFNAME && meta.OIFName == nil:
+			name := string(bytes.SplitN(a.data, []byte{0}, 2)[0])
+			if !bytes.Equal(ifname(name), a.data) {
+				break
+			}
+			if m.Key == expr.MetaKeyIIFNAME {
+				meta.IIFName = &name
+			} else {
+				meta.OIFName = &name
+			}
+			return true, false
+		case m.Key == expr.MetaKeyIIF && len(a.data) == 4 && meta.IIF == nil:
+			index := binaryutil.NativeEndian.Uint32(a.data)
+			meta.IIF = &index
+			return true, false
+		case m.Key == expr.MetaKeyOIF && len(a.data) == 4 && meta.OIF == nil:
+			index := binaryutil.NativeEndian.Uint32(a.data)
+			meta.OIF = &index
+			return true, false
+		case m.Key == expr.MetaKeyPKTTYPE && len(a.data) == 1 && meta.PktType == nil:
+			t := a.data[0]
+			meta.PktType = &t
+			return true, false
+		case m.Key == expr.MetaKeyLEN && len(a.data) == 4 && meta.Length == nil:
+			l := binaryutil.NativeEndian.Uint32(a.data)
+			meta.Length = &l
+			return true, false
+		case m.Key == expr.MetaKeySKUID && len(a.data) == 4 && meta.SKUID == nil:
+			uid := binaryutil.NativeEndian.Uint32(a.data)
+			meta.SKUID = &uid
+			return true, false
+		case m.Key == expr.MetaKeySKGID && len(a.data) == 4 && meta.SKGID == nil:
+			gid := binaryutil.NativeEndian.Uint32(a.data)
+			meta.SKGID = &gid
+			return true, false
+		}
+	}
+	meta.Expr = append(meta.Expr, MetaExpr{Key: uint32(m.Key), Value: a.data, RelOp: operatorOf(a.op)})
+
+	return true, false
+}
+
+// conntrack decodes "ct state" and "ct status" matches, both are matched by their bits, and matches
+// of conntrack counters like "ct bytes > 1000".
+func (d *ruleDecoder) conntrack(ct *expr.Ct, a *atom) bool {
+	if isCtCounter(uint32(ct.Key)) {
+		if !a.hton || a.mask != nil || a.set != nil || a.isRange || len(a.data) != 8 {
+			return false
+		}
+		d.rule.Conntracks = append(d.rule.Conntracks, &Conntrack{Key: uint32(ct.Key), Value: a.data, RelOp: operatorOf(a.op)})
+		return true
+	}
+	if a.hton {
+		return false
+	}
+	zero := make([]byte, 4)
+	if ct.Key != unix.NFT_CT_STATE && ct.Key != unix.NFT_CT_STATUS || len(a.mask) != 4 || !bytes.Equal(a.xor, zero) || a.set != nil || a.isRange ||
+		a.op != expr.CmpOpNeq || !bytes.Equal(a.data, zero) {
+		return false
+	}
+	d.rule.Conntracks = append(d.rule.Conntracks, &Conntrack{Key: uint32(ct.Key), Value: a.mask})
+
+	return true
+}
+
+func (d *ruleDecoder) fib(f *expr.Fib, a *atom) bool {
+	if d.rule.Fib != nil || a.mask != nil || a.set != nil || a.isRange || a.op != expr.CmpOpEq && a.op != expr.CmpOpNeq {
+		return false
+	}
+	d.rule.Fib = &Fib{
+		ResultOIF:      f.ResultOIF,
+		ResultOIFNAME:  f.ResultOIFNAME,
+		ResultADDRTYPE: f.ResultADDRTYPE,
+		FlagSADDR:      f.FlagSADDR,
+		FlagDADDR:      f.FlagDADDR,
+		FlagMARK:       f.FlagMARK,
+		FlagIIF:        f.FlagIIF,
+		FlagOIF:        f.FlagOIF,
+		FlagPRESENT:    f.FlagPRESENT,
+		RelOp:          operatorOf(a.op),
+		Data:           a.data,
+	}
+
+	return true
+}
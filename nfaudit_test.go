@@ -0,0 +1,392 @@
+package nftableslib
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// ruleMessage encodes expressions the way the kernel reports them in NFT_MSG_NEWRULE
+func ruleMessage(t *testing.T, handle uint64, exprs []expr.Any) []byte {
+	elems := make([]netlink.Attribute, 0, len(exprs))
+	for _, e := range exprs {
+		b, err := expr.Marshal(e)
+		if err != nil {
+			t.Fatalf("failed to marshal expression %T with error: %+v", e, err)
+		}
+		elems = append(elems, netlink.Attribute{Type: unix.NLA_F_NESTED | unix.NFTA_LIST_ELEM, Data: b})
+	}
+	list, err := netlink.MarshalAttributes(elems)
+	if err != nil {
+		t.Fatalf("failed to marshal expressions with error: %+v", err)
+	}
+	data, err := netlink.MarshalAttributes([]netlink.Attribute{
+		{Type: unix.NFTA_RULE_TABLE, Data: []byte("filter\x00")},
+		{Type: unix.NFTA_RULE_CHAIN, Data: []byte("input\x00")},
+		{Type: unix.NFTA_RULE_HANDLE, Data: binaryutil.BigEndian.PutUint64(handle)},
+		{Type: unix.NLA_F_NESTED | unix.NFTA_RULE_EXPRESSIONS, Data: list},
+	})
+	if err != nil {
+		t.Fatalf("failed to marshal rule with error: %+v", err)
+	}
+
+	return append([]byte{unix.NFPROTO_IPV4, unix.NFNETLINK_V0, 0, 0}, data...)
+}
+
+// Fixtures are expressions "nft --debug=netlink" lists for the rules
+func TestAuditRule(t *testing.T) {
+	anonymous := auditSets{
+		"__set0": &nfSet{
+			set: &nftables.Set{Name: "__set0", Anonymous: true, Constant: true, KeyType: nftables.TypeInetService},
+			elements: []nftables.SetElement{
+				{Key: binaryutil.BigEndian.PutUint16(80)},
+				{Key: binaryutil.BigEndian.PutUint16(443)},
+			},
+		},
+		"__set1": &nfSet{
+			set: &nftables.Set{Name: "__set1", Anonymous: true, Constant: true, Interval: true, KeyType: nftables.TypeIPAddr},
+			elements: []nftables.SetElement{
+				{Key: []byte{0, 0, 0, 0}, IntervalEnd: true},
+				{Key: []byte{10, 0, 0, 0}},
+				{Key: []byte{11, 0, 0, 0}, IntervalEnd: true},
+				{Key: []byte{192, 168, 1, 1}},
+				{Key: []byte{192, 168, 1, 2}, IntervalEnd: true},
+			},
+		},
+		"__map0": &nfSet{
+			set: &nftables.Set{Name: "__map0", Anonymous: true, Constant: true, IsMap: true, KeyType: nftables.TypeInetService},
+			elements: []nftables.SetElement{
+				{Key: binaryutil.BigEndian.PutUint16(22), VerdictData: &expr.Verdict{Kind: expr.VerdictAccept}},
+			},
+		},
+		"blocked": &nfSet{
+			set: &nftables.Set{Name: "blocked", KeyType: nftables.TypeIPAddr},
+		},
+	}
+	tcp := []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{unix.IPPROTO_TCP}},
+	}
+	dport := func(e ...expr.Any) []expr.Any {
+		return append(append(append([]expr.Any{}, tcp...), &expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 2, Len: 2}), e...)
+	}
+	saddr := &expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: 12, Len: 4}
+	accept := &expr.Verdict{Kind: expr.VerdictAccept}
+	drop := &expr.Verdict{Kind: expr.VerdictDrop}
+	tests := []struct {
+		name   string
+		exprs  []expr.Any
+		status AuditStatus
+		check  func(*Rule) bool
+	}{
+		{
+			name:   "tcp dport 22 accept",
+			exprs:  append(dport(&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{0, 22}}), accept),
+			status: AuditMapped,
+			check: func(r *Rule) bool {
+				return r.L4 != nil && r.L4.L4Proto == unix.IPPROTO_TCP && r.L4.Dst != nil && len(r.L4.Dst.List) == 1 &&
+					r.L4.Dst.List[0] == 22 && r.Action != nil && r.Action.verdict.Kind == expr.VerdictAccept
+			},
+		},
+		{
+			name: "ip saddr 10.0.0.0/8 counter drop",
+			exprs: []expr.Any{
+				saddr,
+				&expr.Bitwise{SourceRegister: 1, DestRegister: 1, Len: 4, Mask: []byte{255, 0, 0, 0}, Xor: []byte{0, 0, 0, 0}},
+				&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{10, 0, 0, 0}},
+				&expr.Counter{Bytes: 1500, Packets: 1},
+				drop,
+			},
+			status: AuditMapped,
+			check: func(r *Rule) bool {
+				return r.L3 != nil && r.L3.Src != nil && len(r.L3.Src.List) == 1 && *r.L3.Src.List[0].Mask == 8 && r.L3.Counter != nil
+			},
+		},
+		{
+			name: "ip saddr & 0.0.0.255 != 0.0.0.1 drop",
+			exprs: []expr.Any{
+				saddr,
+				&expr.Bitwise{SourceRegister: 1, DestRegister: 1, Len: 4, Mask: []byte{0, 0, 0, 255}, Xor: []byte{0, 0, 0, 0}},
+				&expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: []byte{0, 0, 0, 1}},
+				drop,
+			},
+			status: AuditMapped,
+			check: func(r *Rule) bool {
+				return r.L3 != nil && r.L3.Src != nil && r.L3.Src.Masked != nil && r.L3.Src.RelOp == NEQ &&
+					r.L3.Src.Masked.Mask.IP.Equal(net.IP{0, 0, 0, 255}) && r.L3.Src.Masked.Value.IP.Equal(net.IP{0, 0, 0, 1})
+			},
+		},
+		{
+			name: "ct state established,related accept",
+			exprs: []expr.Any{
+				&expr.Ct{Key: expr.CtKeySTATE, Register: 1},
+				&expr.Bitwise{SourceRegister: 1, DestRegister: 1, Len: 4, Mask: []byte{6, 0, 0, 0}, Xor: []byte{0, 0, 0, 0}},
+				&expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: []byte{0, 0, 0, 0}},
+				accept,
+			},
+			status: AuditMapped,
+			check: func(r *Rule) bool {
+				return len(r.Conntracks) == 1 && r.Conntracks[0].Key == unix.NFT_CT_STATE
+			},
+		},
+		{
+			name: "iifname eth0 tcp dport { 80, 443 } counter accept",
+			exprs: append(append([]expr.Any{
+				&expr.Meta{Key: expr.MetaKeyIIFNAME, Register: 1},
+				&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: ifname("eth0")},
+			}, dport(&expr.Lookup{SourceRegister: 1, SetName: "__set0"})...), &expr.Counter{}, accept),
+			status: AuditMapped,
+			check: func(r *Rule) bool {
+				return r.Meta != nil && r.Meta.IIFName != nil && *r.Meta.IIFName == "eth0" && len(r.L4.Dst.List) == 2 && r.L4.Counter != nil
+			},
+		},
+		{
+			name: "ip saddr { 10.0.0.0/8, 192.168.1.1 } drop",
+			exprs: []expr.Any{
+				saddr,
+				&expr.Lookup{SourceRegister: 1, SetName: "__set1"},
+				drop,
+			},
+			status: AuditMapped,
+			check: func(r *Rule) bool {
+				return r.L3 != nil && len(r.L3.Src.List) == 2 && *r.L3.Src.List[0].Mask == 8 && *r.L3.Src.List[1].Mask == 32
+			},
+		},
+		{
+			name: "ip saddr 192.168.1.1-192.168.1.10 drop",
+			exprs: []expr.Any{
+				saddr,
+				&expr.Cmp{Op: expr.CmpOpGte, Register: 1, Data: []byte{192, 168, 1, 1}},
+				&expr.Cmp{Op: expr.CmpOpLte, Register: 1, Data: []byte{192, 168, 1, 10}},
+				drop,
+			},
+			status: AuditMapped,
+			check: func(r *Rule) bool {
+				return r.L3 != nil && r.L3.Src.Range[0] != nil && r.L3.Src.Range[1] != nil && r.L3.Src.RelOp == EQ
+			},
+		},
+		{
+			name:   "tcp dport != 1000-2000 drop",
+			exprs:  append(dport(&expr.Range{Op: expr.CmpOpNeq, Register: 1, FromData: []byte{0x03, 0xe8}, ToData: []byte{0x07, 0xd0}}), drop),
+			status: AuditMapped,
+			check: func(r *Rule) bool {
+				return r.L4.Dst.Range == [2]uint16{1000, 2000} && r.L4.Dst.RelOp == NEQ
+			},
+		},
+		{
+			name: "ip saddr @blocked drop",
+			exprs: []expr.Any{
+				saddr,
+				&expr.Lookup{SourceRegister: 1, SetName: "blocked"},
+				drop,
+			},
+			status: AuditMapped,
+			check: func(r *Rule) bool {
+				return r.L3.Src.SetRef != nil && r.L3.Src.SetRef.Name == "blocked"
+			},
+		},
+		{
+			name: "meta mark set 0x10",
+			exprs: []expr.Any{
+				&expr.Immediate{Register: 1, Data: binaryutil.NativeEndian.PutUint32(0x10)},
+				&expr.Meta{Key: expr.MetaKeyMARK, SourceRegister: true, Register: 1},
+			},
+			status: AuditMapped,
+			check: func(r *Rule) bool {
+				return r.Meta != nil && r.Meta.Mark != nil && r.Meta.Mark.Set && r.Meta.Mark.Value == 0x10
+			},
+		},
+		{
+			name: "fib daddr type local accept",
+			exprs: []expr.Any{
+				&expr.Fib{Register: 1, ResultADDRTYPE: true, FlagDADDR: true},
+				&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.NativeEndian.PutUint32(unix.RTN_LOCAL)},
+				accept,
+			},
+			status: AuditMapped,
+			check: func(r *Rule) bool {
+				return r.Fib != nil && r.Fib.ResultADDRTYPE && r.Fib.FlagDADDR
+			},
+		},
+		{
+			name: "tcp dport 22 jump ssh",
+			exprs: append(dport(&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{0, 22}}),
+				&expr.Verdict{Kind: expr.VerdictJump, Chain: "ssh"}),
+			status: AuditMapped,
+			check: func(r *Rule) bool {
+				return r.Action.verdict.Kind == expr.VerdictJump && r.Action.verdict.Chain == "ssh"
+			},
+		},
+		{
+			// The Rule applies the log before the limit, so both are carried by RawExprs
+			name: "limit rate 10/second log prefix \"ssh \" accept",
+			exprs: []expr.Any{
+				&expr.Limit{Type: expr.LimitTypePkts, Rate: 10, Unit: expr.LimitTimeSecond, Burst: 5},
+				&expr.Log{Key: unix.NFTA_LOG_PREFIX, Data: []byte("ssh ")},
+				accept,
+			},
+			status: AuditPartial,
+			check: func(r *Rule) bool {
+				return len(r.RawExprs) == 2 && r.Log == nil && r.Limit == nil && r.Action != nil
+			},
+		},
+		{
+			name:   "udp dport 53 notrack",
+			exprs:  []expr.Any{&expr.Notrack{}},
+			status: AuditPartial,
+			check: func(r *Rule) bool {
+				return len(r.RawExprs) == 1
+			},
+		},
+		{
+			name: "ct state new log accept",
+			exprs: []expr.Any{
+				&expr.Ct{Key: expr.CtKeySTATE, Register: 1},
+				&expr.Bitwise{SourceRegister: 1, DestRegister: 1, Len: 4, Mask: []byte{8, 0, 0, 0}, Xor: []byte{0, 0, 0, 0}},
+				&expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: []byte{0, 0, 0, 0}},
+				&expr.Log{},
+				accept,
+			},
+			status: AuditMapped,
+		},
+		{
+			name: "ct bytes > 10485760 accept",
+			exprs: []expr.Any{
+				&expr.Ct{Key: expr.CtKeyBYTES, Register: 1},
+				&expr.Byteorder{SourceRegister: 1, DestRegister: 1, Op: expr.ByteorderHton, Len: 8, Size: 8},
+				&expr.Cmp{Op: expr.CmpOpGt, Register: 1, Data: []byte{0, 0, 0, 0, 0, 0xa0, 0, 0}},
+				accept,
+			},
+			status: AuditMapped,
+			check: func(r *Rule) bool {
+				return len(r.Conntracks) == 1 && r.Conntracks[0].Key == unix.NFT_CT_BYTES && r.Conntracks[0].RelOp == GT &&
+					bytes.Equal(r.Conntracks[0].Value, []byte{0, 0, 0, 0, 0, 0xa0, 0, 0})
+			},
+		},
+		{
+			name: "log ct state new accept, ct match after the log",
+			exprs: []expr.Any{
+				&expr.Log{},
+				&expr.Ct{Key: expr.CtKeySTATE, Register: 1},
+				&expr.Bitwise{SourceRegister: 1, DestRegister: 1, Len: 4, Mask: []byte{8, 0, 0, 0}, Xor: []byte{0, 0, 0, 0}},
+				&expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: []byte{0, 0, 0, 0}},
+				accept,
+			},
+			status: AuditOpaque,
+		},
+		{
+			name:   "tcp dport vmap { 22 : accept }",
+			exprs:  dport(&expr.Lookup{SourceRegister: 1, SetName: "__map0", IsDestRegSet: true}),
+			status: AuditOpaque,
+		},
+		{
+			name: "counter log accept, counter applied after the log",
+			exprs: []expr.Any{
+				&expr.Log{},
+				&expr.Counter{},
+				accept,
+			},
+			status: AuditPartial,
+		},
+	}
+	for _, tt := range tests {
+		r, err := auditedRuleFromMessage(ruleMessage(t, 5, tt.exprs))
+		if err != nil {
+			t.Fatalf("Test \"%s\" failed to decode rule with error: %+v", tt.name, err)
+		}
+		if r.handle != 5 {
+			t.Fatalf("Test \"%s\" failed, expected handle 5, got %d", tt.name, r.handle)
+		}
+		ra := auditRule(nftables.TableFamilyIPv4, r.exprs, anonymous)
+		if ra.Status != tt.status {
+			t.Fatalf("Test \"%s\" failed, expected status %s, got %s with reasons: %v", tt.name, tt.status, ra.Status, ra.Reasons)
+		}
+		if ra.Status != AuditMapped && len(ra.Reasons) == 0 {
+			t.Fatalf("Test \"%s\" failed, %s rule carries no reasons", tt.name, ra.Status)
+		}
+		if ra.Status == AuditOpaque {
+			if ra.Rule != nil {
+				t.Fatalf("Test \"%s\" failed, opaque rule carries a rule", tt.name)
+			}
+			continue
+		}
+		if tt.check != nil && !tt.check(ra.Rule) {
+			t.Fatalf("Test \"%s\" failed, decoded rule %+v does not match", tt.name, ra.Rule)
+		}
+	}
+}
+
+func TestAuditUnsupportedExpressions(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{
+			name: "exthdr",
+		},
+		{
+			name: "rt",
+		},
+		{
+			name: "quota",
+		},
+	}
+	for _, tt := range tests {
+		e, reason, err := unmarshalAuditExpr(tt.name, tt.data)
+		if err != nil {
+			t.Fatalf("Test \"%s\" failed with error: %+v but supposed to succeed", tt.name, err)
+		}
+		if e != nil || reason == "" {
+			t.Fatalf("Test \"%s\" failed, expression is expected to be unsupported", tt.name)
+		}
+		ra := auditRule(nftables.TableFamilyIPv4, []auditExpr{{name: tt.name, reason: reason}, {name: "immediate", expr: &expr.Verdict{Kind: expr.VerdictAccept}}}, nil)
+		if ra.Status != AuditOpaque || len(ra.Reasons) != 1 {
+			t.Fatalf("Test \"%s\" failed, expected opaque rule with a reason, got %s with reasons: %v", tt.name, ra.Status, ra.Reasons)
+		}
+	}
+}
+
+func TestIntervalPrefixes(t *testing.T) {
+	tests := []struct {
+		name     string
+		from, to []byte
+		prefixes []string
+	}{
+		{
+			name:     "single prefix",
+			from:     []byte{10, 0, 0, 0},
+			to:       []byte{10, 255, 255, 255},
+			prefixes: []string{"10.0.0.0/8"},
+		},
+		{
+			name:     "host",
+			from:     []byte{192, 168, 1, 1},
+			to:       []byte{192, 168, 1, 1},
+			prefixes: []string{"192.168.1.1/32"},
+		},
+		{
+			name:     "unaligned range",
+			from:     []byte{192, 168, 1, 1},
+			to:       []byte{192, 168, 1, 6},
+			prefixes: []string{"192.168.1.1/32", "192.168.1.2/31", "192.168.1.4/31", "192.168.1.6/32"},
+		},
+	}
+	for _, tt := range tests {
+		addrs := intervalPrefixes(tt.from, tt.to)
+		if len(addrs) != len(tt.prefixes) {
+			t.Fatalf("Test \"%s\" failed, expected %d prefixes, got %d", tt.name, len(tt.prefixes), len(addrs))
+		}
+		for i, a := range addrs {
+			if got := fmt.Sprintf("%s/%d", a.IP.String(), *a.Mask); got != tt.prefixes[i] {
+				t.Fatalf("Test \"%s\" failed, expected prefix %s, got %s", tt.name, tt.prefixes[i], got)
+			}
+		}
+	}
+}
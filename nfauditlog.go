@@ -0,0 +1,786 @@
+package nftableslib
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+)
+
+// AuditOp identifies the operation of AuditRecord
+type AuditOp string
+
+const (
+	AuditAddTable     AuditOp = "addTable"
+	AuditDelTable     AuditOp = "delTable"
+	AuditFlushRuleset AuditOp = "flushRuleset"
+	AuditAddChain     AuditOp = "addChain"
+	AuditDelChain     AuditOp = "delChain"
+	AuditBindDevices  AuditOp = "bindDevices"
+	AuditAddRule      AuditOp = "addRule"
+	AuditInsertRule   AuditOp = "insertRule"
+	AuditReplaceRule  AuditOp = "replaceRule"
+	AuditDelRule      AuditOp = "delRule"
+	AuditAddSet       AuditOp = "addSet"
+	AuditDelSet       AuditOp = "delSet"
+	AuditAddElements  AuditOp = "addElements"
+	AuditDelElements  AuditOp = "delElements"
+	AuditAddObject    AuditOp = "addObject"
+	AuditDelObject    AuditOp = "delObject"
+	AuditResetObject  AuditOp = "resetObject"
+	// AuditFlush sends operations queued since the previous flush to the host
+	AuditFlush AuditOp = "flush"
+)
+
+// AuditOutcome is the outcome of the operation of AuditRecord
+type AuditOutcome string
+
+const (
+	// AuditQueued operations are sent to the host by the next flush, its record carries their outcome
+	AuditQueued AuditOutcome = "queued"
+	AuditOK     AuditOutcome = "ok"
+	AuditFailed AuditOutcome = "failed"
+)
+
+// AuditTable identifies a table
+type AuditTable struct {
+	Family nftables.TableFamily `json:"family"`
+	Name   string               `json:"name"`
+}
+
+// AuditRecord describes an operation changing the ruleset. Before and After summarize the object before
+// and after the operation in nft syntax. Records of flushes list tables changed by the flushed operations.
+type AuditRecord struct {
+	Time       time.Time            `json:"time"`
+	Op         AuditOp              `json:"op"`
+	Family     nftables.TableFamily `json:"family,omitempty"`
+	Table      string               `json:"table,omitempty"`
+	Chain      string               `json:"chain,omitempty"`
+	Set        string               `json:"set,omitempty"`
+	Handle     uint64               `json:"handle,omitempty"`
+	ObjectKind ObjectKind           `json:"objectKind,omitempty"`
+	Object     string               `json:"object,omitempty"`
+	Before     string               `json:"before,omitempty"`
+	After      string               `json:"after,omitempty"`
+	Outcome    AuditOutcome         `json:"outcome"`
+	Error      string               `json:"error,omitempty"`
+	Tables     []AuditTable         `json:"tables,omitempty"`
+	// Data carries what Replay needs to apply the operation again
+	Data *AuditData `json:"data,omitempty"`
+}
+
+// AuditData carries attributes of the object of the operation, expressions of rules are carried
+// in their netlink encoding.
+type AuditData struct {
+	TableFlags uint32                 `json:"tableFlags,omitempty"`
+	ChainType  nftables.ChainType     `json:"chainType,omitempty"`
+	Hooknum    nftables.ChainHook     `json:"hooknum,omitempty"`
+	Priority   nftables.ChainPriority `json:"priority,omitempty"`
+	Policy     *nftables.ChainPolicy  `json:"policy,omitempty"`
+	AddDevices []string               `json:"addDevices,omitempty"`
+	DelDevices []string               `json:"delDevices,omitempty"`
+	Position   uint64                 `json:"position,omitempty"`
+	Exprs      [][]byte               `json:"exprs,omitempty"`
+	UserData   []byte                 `json:"userData,omitempty"`
+	SetID      uint32                 `json:"setID,omitempty"`
+	Anonymous  bool                   `json:"anonymous,omitempty"`
+	Constant   bool                   `json:"constant,omitempty"`
+	IsMap      bool                   `json:"isMap,omitempty"`
+	Interval   bool                   `json:"interval,omitempty"`
+	HasTimeout bool                   `json:"hasTimeout,omitempty"`
+	Timeout    time.Duration          `json:"timeout,omitempty"`
+	KeyType    uint32                 `json:"keyType,omitempty"`
+	DataType   uint32                 `json:"dataType,omitempty"`
+	// Fields carries lengths of elements of concatenated interval sets
+	Fields   []uint32          `json:"fields,omitempty"`
+	Elements []*SetElementDump `json:"elements,omitempty"`
+}
+
+// AuditSink receives records of operations changing the ruleset, it must be safe for concurrent use
+type AuditSink interface {
+	Record(*AuditRecord)
+}
+
+// WithAuditSink wraps the connection, so every operation changing the ruleset, including operations
+// the library sends to the kernel directly, is recorded to the sink. Reads are not recorded.
+func WithAuditSink(sink AuditSink) TablesOption {
+	return func(nft *nfTables) {
+		nft.conn = &auditConn{conn: nft.conn, sink: sink, now: time.Now}
+	}
+}
+
+// TableAuditSink returns the sink passing to sink only records of the table, records of flushes are
+// passed when the table was changed by the flushed operations.
+func TableAuditSink(family nftables.TableFamily, name string, sink AuditSink) AuditSink {
+	return &tableAuditSink{table: AuditTable{Family: family, Name: name}, sink: sink}
+}
+
+type tableAuditSink struct {
+	table AuditTable
+	sink  AuditSink
+}
+
+func (s *tableAuditSink) Record(r *AuditRecord) {
+	if r.Family == s.table.Family && r.Table == s.table.Name {
+		s.sink.Record(r)
+		return
+	}
+	for _, t := range r.Tables {
+		if t == s.table {
+			s.sink.Record(r)
+			return
+		}
+	}
+}
+
+// JSONAuditSink writes records as JSON lines, the first error writing a record is kept and returned by Err
+type JSONAuditSink struct {
+	sync.Mutex
+	enc *json.Encoder
+	err error
+}
+
+// NewJSONAuditSink returns the sink writing records to w
+func NewJSONAuditSink(w io.Writer) *JSONAuditSink {
+	return &JSONAuditSink{enc: json.NewEncoder(w)}
+}
+
+// Record writes the record as a single line
+func (s *JSONAuditSink) Record(r *AuditRecord) {
+	s.Lock()
+	defer s.Unlock()
+	if err := s.enc.Encode(r); err != nil && s.err == nil {
+		s.err = err
+	}
+}
+
+// Err returns the first error writing a record
+func (s *JSONAuditSink) Err() error {
+	s.Lock()
+	defer s.Unlock()
+	return s.err
+}
+
+// auditConn records operations changing the ruleset and passes every operation to the wrapped connection.
+// Like readOnlyConn, methods are not promoted from the wrapped connection, so methods added to NetNS must
+// be classified here, optional interfaces of connections are implemented on top of the wrapped connection.
+type auditConn struct {
+	conn NetNS
+	sink AuditSink
+	now  func() time.Time
+	sync.Mutex
+	// tables are changed by operations queued since the last flush
+	tables []AuditTable
+}
+
+var _ NetNS = &auditConn{}
+var _ ChainDevicesConn = &auditConn{}
+var _ ObjectsConn = &auditConn{}
+var _ GenIDReader = &auditConn{}
+var _ FeaturesConn = &auditConn{}
+var _ SetElementsIterator = &auditConn{}
+var _ ExpiringElementsIterator = &auditConn{}
+var _ RulesConn = &auditConn{}
+var _ TransactionConn = &auditConn{}
+
+// record sends the record to the sink, err is the outcome of operations which are not queued
+func (ac *auditConn) record(r *AuditRecord, queued bool, err error) {
+	r.Time = ac.now()
+	switch {
+	case err != nil:
+		r.Outcome, r.Error = AuditFailed, err.Error()
+	case queued:
+		r.Outcome = AuditQueued
+	default:
+		r.Outcome = AuditOK
+	}
+	if queued && err == nil && r.Table != "" {
+		ac.touch(AuditTable{Family: r.Family, Name: r.Table})
+	}
+	ac.sink.Record(r)
+}
+
+func (ac *auditConn) touch(t AuditTable) {
+	ac.Lock()
+	defer ac.Unlock()
+	for _, tt := range ac.tables {
+		if tt == t {
+			return
+		}
+	}
+	ac.tables = append(ac.tables, t)
+}
+
+func (ac *auditConn) Flush() error {
+	err := ac.conn.Flush()
+	ac.Lock()
+	tables := ac.tables
+	ac.tables = nil
+	ac.Unlock()
+	ac.record(&AuditRecord{Op: AuditFlush, Tables: tables}, false, err)
+
+	return err
+}
+
+func (ac *auditConn) FlushRuleset() {
+	ac.conn.FlushRuleset()
+	ac.record(&AuditRecord{Op: AuditFlushRuleset, Before: ac.rulesetSummary()}, true, nil)
+}
+
+func (ac *auditConn) AddTable(t *nftables.Table) *nftables.Table {
+	r := ac.conn.AddTable(t)
+	ac.record(&AuditRecord{
+		Op: AuditAddTable, Family: t.Family, Table: t.Name, After: tableSummary(t),
+		Data: &AuditData{TableFlags: t.Flags},
+	}, true, nil)
+
+	return r
+}
+
+func (ac *auditConn) DelTable(t *nftables.Table) {
+	before := ""
+	if tables, err := ac.conn.ListTables(); err == nil {
+		for _, tt := range tables {
+			if tt.Name == t.Name && tt.Family == t.Family {
+				before = tableSummary(tt)
+			}
+		}
+	}
+	ac.conn.DelTable(t)
+	ac.record(&AuditRecord{Op: AuditDelTable, Family: t.Family, Table: t.Name, Before: before}, true, nil)
+}
+
+func (ac *auditConn) ListTables() ([]*nftables.Table, error) {
+	return ac.conn.ListTables()
+}
+
+func (ac *auditConn) AddChain(c *nftables.Chain) *nftables.Chain {
+	r := ac.conn.AddChain(c)
+	ac.record(&AuditRecord{
+		Op: AuditAddChain, Family: c.Table.Family, Table: c.Table.Name, Chain: c.Name, After: chainSummary(c),
+		Data: &AuditData{ChainType: c.Type, Hooknum: c.Hooknum, Priority: c.Priority, Policy: c.Policy},
+	}, true, nil)
+
+	return r
+}
+
+func (ac *auditConn) DelChain(c *nftables.Chain) {
+	before := ""
+	if chains, err := ac.conn.ListChains(); err == nil {
+		for _, cc := range chains {
+			if cc.Name == c.Name && cc.Table.Name == c.Table.Name && cc.Table.Family == c.Table.Family {
+				before = chainSummary(cc)
+			}
+		}
+	}
+	ac.conn.DelChain(c)
+	ac.record(&AuditRecord{Op: AuditDelChain, Family: c.Table.Family, Table: c.Table.Name, Chain: c.Name, Before: before}, true, nil)
+}
+
+func (ac *auditConn) ListChains() ([]*nftables.Chain, error) {
+	return ac.conn.ListChains()
+}
+
+// ruleRecord returns the record of the rule operation, the rule is encoded for replay
+func (ac *auditConn) ruleRecord(op AuditOp, r *nftables.Rule) (*AuditRecord, error) {
+	rec := &AuditRecord{Op: op, Family: r.Table.Family, Table: r.Table.Name, Chain: r.Chain.Name, Handle: r.Handle}
+	if op == AuditDelRule || op == AuditReplaceRule {
+		rec.Before = ac.ruleBefore(r)
+	}
+	if op == AuditDelRule {
+		return rec, nil
+	}
+	rec.After = ruleSummary(r.Table.Family, r.Exprs)
+	rec.Data = &AuditData{Position: r.Position, UserData: r.UserData, Exprs: make([][]byte, 0, len(r.Exprs))}
+	for _, e := range r.Exprs {
+		b, err := expr.Marshal(e)
+		if err != nil {
+			return rec, fmt.Errorf("failed to encode expression %s with error: %+v", exprName(e), err)
+		}
+		rec.Data.Exprs = append(rec.Data.Exprs, b)
+	}
+
+	return rec, nil
+}
+
+// ruleBefore summarizes the rule of the handle programmed on the host
+func (ac *auditConn) ruleBefore(r *nftables.Rule) string {
+	rules, err := ac.conn.GetRule(r.Table, r.Chain)
+	if err != nil {
+		return ""
+	}
+	for _, rr := range rules {
+		if rr.Handle == r.Handle {
+			return ruleSummary(r.Table.Family, rr.Exprs)
+		}
+	}
+
+	return ""
+}
+
+func (ac *auditConn) AddRule(r *nftables.Rule) *nftables.Rule {
+	op := AuditAddRule
+	if r.Handle != 0 {
+		// Rule carrying the handle replaces the existing rule
+		op = AuditReplaceRule
+	}
+	rec, err := ac.ruleRecord(op, r)
+	rr := ac.conn.AddRule(r)
+	ac.record(rec, true, err)
+
+	return rr
+}
+
+func (ac *auditConn) InsertRule(r *nftables.Rule) *nftables.Rule {
+	rec, err := ac.ruleRecord(AuditInsertRule, r)
+	rr := ac.conn.InsertRule(r)
+	ac.record(rec, true, err)
+
+	return rr
+}
+
+func (ac *auditConn) ReplaceRule(r *nftables.Rule) *nftables.Rule {
+	rec, err := ac.ruleRecord(AuditReplaceRule, r)
+	rr := ac.conn.ReplaceRule(r)
+	ac.record(rec, true, err)
+
+	return rr
+}
+
+func (ac *auditConn) DelRule(r *nftables.Rule) error {
+	rec, _ := ac.ruleRecord(AuditDelRule, r)
+	err := ac.conn.DelRule(r)
+	ac.record(rec, true, err)
+
+	return err
+}
+
+func (ac *auditConn) DelRulesImm(rules []*nftables.Rule) error {
+	// Records summarize the rules before they are deleted
+	recs := make([]*AuditRecord, len(rules))
+	for i, r := range rules {
+		recs[i], _ = ac.ruleRecord(AuditDelRule, r)
+	}
+	err := delRulesImm(ac.conn, rules)
+	for _, rec := range recs {
+		ac.record(rec, false, err)
+	}
+
+	return err
+}
+
+// Transaction returns the audited connection of the transaction, its flush is recorded separately
+func (ac *auditConn) Transaction() (NetNS, error) {
+	conn, err := transaction(ac.conn)
+	if err != nil {
+		return nil, err
+	}
+
+	return &auditConn{conn: conn, sink: ac.sink, now: ac.now}, nil
+}
+
+func (ac *auditConn) GetRule(t *nftables.Table, c *nftables.Chain) ([]*nftables.Rule, error) {
+	return ac.conn.GetRule(t, c)
+}
+
+// setRecord returns the record of the set operation
+func setRecord(op AuditOp, s *nftables.Set, fields []uint32, elements []nftables.SetElement) *AuditRecord {
+	rec := &AuditRecord{Op: op, Family: s.Table.Family, Table: s.Table.Name, Set: s.Name}
+	switch op {
+	case AuditAddSet:
+		rec.After = setSummary(s, len(elements))
+		rec.Data = &AuditData{
+			SetID:      s.ID,
+			Anonymous:  s.Anonymous,
+			Constant:   s.Constant,
+			IsMap:      s.IsMap,
+			Interval:   s.Interval,
+			HasTimeout: s.HasTimeout,
+			Timeout:    s.Timeout,
+			KeyType:    s.KeyType.GetNFTMagic(),
+			DataType:   s.DataType.GetNFTMagic(),
+			Fields:     fields,
+			Elements:   elementDumps(elements),
+		}
+	case AuditAddElements, AuditDelElements:
+		rec.After = fmt.Sprintf("%d elements", len(elements))
+		rec.Data = &AuditData{SetID: s.ID, Elements: elementDumps(elements)}
+	}
+
+	return rec
+}
+
+func elementDumps(elements []nftables.SetElement) []*SetElementDump {
+	dumps := make([]*SetElementDump, 0, len(elements))
+	for _, e := range elements {
+		dumps = append(dumps, &SetElementDump{
+			Key:         e.Key,
+			Val:         e.Val,
+			Verdict:     elementVerdict(e.VerdictData),
+			IntervalEnd: e.IntervalEnd,
+			Timeout:     e.Timeout,
+		})
+	}
+
+	return dumps
+}
+
+func (ac *auditConn) AddSet(s *nftables.Set, elements []nftables.SetElement) error {
+	err := ac.conn.AddSet(s, elements)
+	ac.record(setRecord(AuditAddSet, s, nil, elements), true, err)
+
+	return err
+}
+
+// addSet records concatenated interval sets the library programs on the wrapped connection directly
+func (ac *auditConn) addSet(s *nfSet) error {
+	err := addSet(ac.conn, s)
+	rec := setRecord(AuditAddSet, s.set, s.fields, s.elements)
+	if s.fields != nil {
+		// The set is programmed immediately and not queued
+		ac.record(rec, false, err)
+		return err
+	}
+	ac.record(rec, true, err)
+
+	return err
+}
+
+func (ac *auditConn) DelSet(s *nftables.Set) {
+	before := ""
+	if set, err := getSetByName(ac.conn, s.Table, s.Name); err == nil {
+		if elements, err := getSetElements(ac.conn, set); err == nil {
+			set.Table = s.Table
+			decodeSet(set)
+			before = setSummary(set, len(elements))
+		}
+	}
+	ac.conn.DelSet(s)
+	rec := setRecord(AuditDelSet, s, nil, nil)
+	rec.Before = before
+	ac.record(rec, true, nil)
+}
+
+func (ac *auditConn) GetSets(t *nftables.Table) ([]*nftables.Set, error) {
+	return getSets(ac.conn, t)
+}
+
+func (ac *auditConn) GetSetByName(t *nftables.Table, name string) (*nftables.Set, error) {
+	return getSetByName(ac.conn, t, name)
+}
+
+func (ac *auditConn) GetSetElements(s *nftables.Set) ([]nftables.SetElement, error) {
+	return getSetElements(ac.conn, s)
+}
+
+func (ac *auditConn) SetAddElements(s *nftables.Set, elements []nftables.SetElement) error {
+	err := ac.conn.SetAddElements(s, elements)
+	ac.record(setRecord(AuditAddElements, s, nil, elements), true, err)
+
+	return err
+}
+
+func (ac *auditConn) SetDeleteElements(s *nftables.Set, elements []nftables.SetElement) error {
+	err := ac.conn.SetDeleteElements(s, elements)
+	ac.record(setRecord(AuditDelElements, s, nil, elements), true, err)
+
+	return err
+}
+
+func (ac *auditConn) BindChainDevices(c *nftables.Chain, add []string, del []string) error {
+	err := bindChainDevices(ac.conn, c, add, del)
+	ac.record(&AuditRecord{
+		Op: AuditBindDevices, Family: c.Table.Family, Table: c.Table.Name, Chain: c.Name, After: chainSummary(c),
+		Data: &AuditData{ChainType: c.Type, Hooknum: c.Hooknum, Priority: c.Priority, Policy: c.Policy, AddDevices: add, DelDevices: del},
+	}, false, err)
+
+	return err
+}
+
+func (ac *auditConn) ChainDevices(c *nftables.Chain) ([]string, error) {
+	return chainDevices(ac.conn, c)
+}
+
+func (ac *auditConn) LinkExists(name string) (bool, error) {
+	return deviceExists(ac.conn, name)
+}
+
+func (ac *auditConn) ListObjects(t *nftables.Table) ([]*Object, error) {
+	return listObjects(ac.conn, t)
+}
+
+func (ac *auditConn) AddObject(t *nftables.Table, o *Object) {
+	err := addObject(ac.conn, t, o)
+	ac.record(&AuditRecord{Op: AuditAddObject, Family: t.Family, Table: t.Name, ObjectKind: o.Kind, Object: o.Name,
+		After: objectSummary(o)}, true, err)
+}
+
+func (ac *auditConn) DelObject(t *nftables.Table, kind ObjectKind, name string) error {
+	err := newObjects(ac.conn, t).Objects().Delete(kind, name)
+	ac.record(&AuditRecord{Op: AuditDelObject, Family: t.Family, Table: t.Name, ObjectKind: kind, Object: name}, false, err)
+
+	return err
+}
+
+func (ac *auditConn) ResetObject(t *nftables.Table, kind ObjectKind, name string) (*Object, error) {
+	var o *Object
+	objs, err := newObjects(ac.conn, t).(*nfObjects).reset([]*Object{{Kind: kind, Name: name}})
+	rec := &AuditRecord{Op: AuditResetObject, Family: t.Family, Table: t.Name, ObjectKind: kind, Object: name}
+	if err == nil {
+		o = objs[0]
+		rec.Before = objectSummary(o)
+	}
+	ac.record(rec, false, err)
+
+	return o, err
+}
+
+func (ac *auditConn) GetGenID() (uint32, error) {
+	return getGenID(ac.conn)
+}
+
+func (ac *auditConn) KernelFeatures() (*KernelFeatures, error) {
+	return probeFeatures(ac.conn)
+}
+
+func (ac *auditConn) IterateSetElements(s *nftables.Set, fn func(nftables.SetElement) error) error {
+	return iterateSetElements(ac.conn, s, fn)
+}
+
+func (ac *auditConn) IterateExpiringElements(s *nftables.Set, fn func(nftables.SetElement, time.Duration) error) error {
+	return iterateExpiringElements(ac.conn, s, fn)
+}
+
+// rulesetSummary summarizes tables programmed on the host
+func (ac *auditConn) rulesetSummary() string {
+	tables, err := ac.conn.ListTables()
+	if err != nil {
+		return ""
+	}
+	s := make([]string, 0, len(tables))
+	for _, t := range tables {
+		s = append(s, tableSummary(t))
+	}
+
+	return strings.Join(s, "; ")
+}
+
+func tableSummary(t *nftables.Table) string {
+	return fmt.Sprintf("table %s %s", familyName(t.Family), t.Name)
+}
+
+func chainSummary(c *nftables.Chain) string {
+	s := fmt.Sprintf("chain %s %s %s", familyName(c.Table.Family), c.Table.Name, c.Name)
+	if c.Type == "" {
+		return s
+	}
+	s += fmt.Sprintf(" { type %s hook %d priority %d", c.Type, c.Hooknum, c.Priority)
+	if c.Policy != nil {
+		policy := "accept"
+		if *c.Policy == nftables.ChainPolicyDrop {
+			policy = "drop"
+		}
+		s += " policy " + policy
+	}
+
+	return s + " }"
+}
+
+// ruleSummary summarizes the rule in nft syntax, rules which cannot be decoded are summarized by names
+// of their expressions. Sets are not read, so lookups of anonymous sets are summarized by names of the sets.
+func ruleSummary(family nftables.TableFamily, exprs []expr.Any) string {
+	if s, ok := summarizeRule(family, exprs, nil); ok {
+		return s
+	}
+
+	return exprsSummary(exprs)
+}
+
+func exprsSummary(exprs []expr.Any) string {
+	s := make([]string, 0, len(exprs))
+	for _, e := range exprs {
+		if v, ok := e.(*expr.Verdict); ok {
+			name := verdictName(int(v.Kind))
+			if v.Chain != "" {
+				name += " " + v.Chain
+			}
+			s = append(s, name)
+			continue
+		}
+		s = append(s, exprName(e))
+	}
+
+	return strings.Join(s, " ")
+}
+
+func setSummary(s *nftables.Set, elements int) string {
+	kind := "set"
+	if s.IsMap {
+		kind = "map"
+	}
+	flags := ""
+	if s.Interval {
+		flags = " interval"
+	}
+
+	return fmt.Sprintf("%s %s %s %s%s with %d elements", kind, familyName(s.Table.Family), s.Table.Name, s.Name, flags, elements)
+}
+
+func objectSummary(o *Object) string {
+	switch {
+	case o.Counter != nil:
+		return fmt.Sprintf("%s %s packets %d bytes %d", o.Kind, o.Name, o.Counter.Packets, o.Counter.Bytes)
+	case o.Quota != nil:
+		return fmt.Sprintf("%s %s %d bytes used %d", o.Kind, o.Name, o.Quota.Bytes, o.Quota.Consumed)
+	}
+
+	return fmt.Sprintf("%s %s", o.Kind, o.Name)
+}
+
+// Replay applies operations recorded as JSON lines by JSONAuditSink to the connection in the recorded order.
+// Queued operations are sent to the host by replayed flushes. The ruleset of the connection is expected to be
+// in the state it was in when the recording started, so the host allocates the same handles to rules.
+// Replay fails when the outcome of a replayed operation differs from the recorded one, operations which failed
+// when they were recorded are expected to fail again.
+func Replay(r io.Reader, conn NetNS) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+		rec := &AuditRecord{}
+		if err := json.Unmarshal(scanner.Bytes(), rec); err != nil {
+			return fmt.Errorf("failed to decode record at line %d with error: %+v", line, err)
+		}
+		err := replayRecord(conn, rec)
+		switch {
+		case err != nil && rec.Outcome != AuditFailed:
+			return fmt.Errorf("failed to replay %s at line %d with error: %+v", rec.Op, line, err)
+		case err == nil && rec.Outcome == AuditFailed:
+			return fmt.Errorf("%s at line %d succeeded but failed when recorded with error: %s", rec.Op, line, rec.Error)
+		}
+	}
+
+	return scanner.Err()
+}
+
+func replayRecord(conn NetNS, rec *AuditRecord) error {
+	d := rec.Data
+	if d == nil {
+		d = &AuditData{}
+	}
+	t := &nftables.Table{Name: rec.Table, Family: rec.Family, Flags: d.TableFlags}
+	c := &nftables.Chain{Name: rec.Chain, Table: t, Type: d.ChainType, Hooknum: d.Hooknum, Priority: d.Priority, Policy: d.Policy}
+	switch rec.Op {
+	case AuditFlush:
+		return conn.Flush()
+	case AuditFlushRuleset:
+		conn.FlushRuleset()
+	case AuditAddTable:
+		conn.AddTable(t)
+	case AuditDelTable:
+		conn.DelTable(t)
+	case AuditAddChain:
+		conn.AddChain(c)
+	case AuditDelChain:
+		conn.DelChain(c)
+	case AuditBindDevices:
+		return bindChainDevices(conn, c, d.AddDevices, d.DelDevices)
+	case AuditAddRule, AuditInsertRule, AuditReplaceRule:
+		r := &nftables.Rule{Table: t, Chain: c, Handle: rec.Handle, Position: d.Position, UserData: d.UserData}
+		for _, b := range d.Exprs {
+			ae, err := decodeAuditExpr(b)
+			if err != nil {
+				return err
+			}
+			if ae.expr == nil {
+				return fmt.Errorf("failed to decode expression %s: %s", ae.name, ae.reason)
+			}
+			r.Exprs = append(r.Exprs, ae.expr)
+		}
+		switch rec.Op {
+		case AuditAddRule:
+			conn.AddRule(r)
+		case AuditInsertRule:
+			conn.InsertRule(r)
+		default:
+			conn.ReplaceRule(r)
+		}
+	case AuditDelRule:
+		return conn.DelRule(&nftables.Rule{Table: t, Chain: c, Handle: rec.Handle})
+	case AuditAddSet:
+		s, err := replaySet(t, rec.Set, d)
+		if err != nil {
+			return err
+		}
+		return addSet(conn, &nfSet{set: s, elements: replayElements(d.Elements), fields: d.Fields})
+	case AuditDelSet:
+		conn.DelSet(&nftables.Set{Table: t, Name: rec.Set})
+	case AuditAddElements:
+		return conn.SetAddElements(&nftables.Set{Table: t, Name: rec.Set, ID: d.SetID}, replayElements(d.Elements))
+	case AuditDelElements:
+		return conn.SetDeleteElements(&nftables.Set{Table: t, Name: rec.Set, ID: d.SetID}, replayElements(d.Elements))
+	case AuditAddObject:
+		o := &Object{Kind: rec.ObjectKind, Name: rec.Object}
+		if o.Kind == ObjectCounter {
+			o.Counter = &CounterState{}
+		}
+		return addObject(conn, t, o)
+	case AuditDelObject:
+		return newObjects(conn, t).Objects().Delete(rec.ObjectKind, rec.Object)
+	case AuditResetObject:
+		_, err := newObjects(conn, t).(*nfObjects).reset([]*Object{{Kind: rec.ObjectKind, Name: rec.Object}})
+		return err
+	default:
+		return fmt.Errorf("unknown operation %q", rec.Op)
+	}
+
+	return nil
+}
+
+func replaySet(t *nftables.Table, name string, d *AuditData) (*nftables.Set, error) {
+	keyType, err := decodeSetDatatype(d.KeyType)
+	if err != nil {
+		return nil, err
+	}
+	dataType, err := decodeSetDatatype(d.DataType)
+	if err != nil {
+		return nil, err
+	}
+
+	return &nftables.Set{
+		Table:      t,
+		ID:         d.SetID,
+		Name:       name,
+		Anonymous:  d.Anonymous,
+		Constant:   d.Constant,
+		IsMap:      d.IsMap,
+		Interval:   d.Interval,
+		HasTimeout: d.HasTimeout,
+		Timeout:    d.Timeout,
+		KeyType:    keyType,
+		DataType:   dataType,
+	}, nil
+}
+
+func replayElements(dumps []*SetElementDump) []nftables.SetElement {
+	elements := make([]nftables.SetElement, 0, len(dumps))
+	for _, de := range dumps {
+		e := nftables.SetElement{Key: de.Key, Val: de.Val, IntervalEnd: de.IntervalEnd, Timeout: de.Timeout}
+		if de.Verdict != nil {
+			e.VerdictData = &expr.Verdict{Kind: expr.VerdictKind(de.Verdict.Kind), Chain: de.Verdict.Chain}
+		}
+		elements = append(elements, e)
+	}
+
+	return elements
+}
@@ -0,0 +1,467 @@
+package nftableslib
+
+import (
+	"bytes"
+	"fmt"
+	"math/big"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/nftables"
+)
+
+const (
+	// BlocklistIPv4SetName defines the name of the set carrying blocked IPv4 addresses and prefixes
+	BlocklistIPv4SetName = "blocklist-v4"
+	// BlocklistIPv6SetName defines the name of the set carrying blocked IPv6 addresses and prefixes
+	BlocklistIPv6SetName = "blocklist-v6"
+	// BlocklistChainName defines the name of the base chain dropping packets from blocked sources
+	BlocklistChainName = "prerouting"
+)
+
+// BlocklistEntry defines a blocked address or prefix, TTL is the time left before the entry expires,
+// TTL 0 means the entry never expires.
+type BlocklistEntry struct {
+	Addr string
+	TTL  time.Duration
+}
+
+// Blocklist maintains a blocklist of source addresses and prefixes in a table of inet family.
+// Blocked IPv4 and IPv6 prefixes are kept in a pair of interval sets with per element timeouts,
+// a base chain attached to prerouting drops packets with a source in either set. Expired entries
+// are removed by the kernel, Blocklist tracks the expiration of entries it programmed.
+type Blocklist struct {
+	nft   TablesInterface
+	table string
+	now   func() time.Time
+	sync.Mutex
+	si SetsInterface
+	// entries carries blocked prefixes by their canonical string
+	entries map[string]*blockedPrefix
+}
+
+type blockedPrefix struct {
+	prefix *net.IPNet
+	// expires is zero for entries which never expire
+	expires time.Time
+}
+
+// NewBlocklist returns Blocklist maintaining the blocklist in the inet table, the table, the sets
+// and the drop rules are created if they do not exist. Entries found in the sets of an existing table
+// are adopted, as the kernel does not report the time left, their configured timeout is used as TTL.
+// now is an optional clock used to track expiration of entries, time.Now is used by default.
+func NewBlocklist(nft TablesInterface, table string, now ...func() time.Time) (*Blocklist, error) {
+	b := &Blocklist{
+		nft:     nft,
+		table:   table,
+		now:     time.Now,
+		entries: make(map[string]*blockedPrefix),
+	}
+	if len(now) != 0 && now[0] != nil {
+		b.now = now[0]
+	}
+	if err := b.ensureTable(); err != nil {
+		return nil, err
+	}
+	if err := b.load(); err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+// ensureTable makes sure the table, the blocklist sets and the base chain with drop rules exist
+func (b *Blocklist) ensureTable() error {
+	family := nftables.TableFamilyINet
+	ci, err := b.nft.Tables().Table(b.table, family)
+	if err != nil {
+		// The table is not in the store, it might have been programmed by a previous instance
+		if _, err := b.nft.Tables().SyncTable(b.table, family); err != nil {
+			return err
+		}
+		if ci, err = b.nft.Tables().Table(b.table, family); err != nil {
+			if err := b.nft.Tables().CreateImm(b.table, family); err != nil {
+				return err
+			}
+			if ci, err = b.nft.Tables().Table(b.table, family); err != nil {
+				return err
+			}
+		}
+	}
+	if b.si, err = b.nft.Tables().TableSets(b.table, family); err != nil {
+		return err
+	}
+	sets := make([]*nftables.Set, 0, 2)
+	for _, f := range []nftables.TableFamily{nftables.TableFamilyIPv4, nftables.TableFamilyIPv6} {
+		name, keyType := blocklistSet(f)
+		// The timeout flag of a set found on the host cannot be decoded, the set is created even if
+		// it exists, the kernel accepts it only if the existing set has the same flags.
+		set, err := b.si.Sets().CreateSet(&SetAttributes{
+			Name:       name,
+			Interval:   true,
+			HasTimeout: true,
+			KeyType:    keyType,
+		}, nil)
+		if err != nil {
+			return fmt.Errorf("failed to ensure blocklist set %s with error: %+v", name, err)
+		}
+		sets = append(sets, set)
+	}
+	if !ci.Chains().Exist(BlocklistChainName) {
+		if err := ci.Chains().CreateImm(BlocklistChainName, &ChainAttributes{
+			Type:     nftables.ChainTypeFilter,
+			Hook:     nftables.ChainHookPrerouting,
+			Priority: nftables.ChainPriorityRaw,
+		}); err != nil {
+			return err
+		}
+	}
+	if n, err := ci.Chains().RuleCount(BlocklistChainName); err != nil || n != 0 {
+		return err
+	}
+	ri, err := ci.Chains().Chain(BlocklistChainName)
+	if err != nil {
+		return err
+	}
+	drop, _ := SetVerdict(NFT_DROP)
+	for i, f := range []nftables.TableFamily{nftables.TableFamilyIPv4, nftables.TableFamilyIPv6} {
+		f := f
+		// Source address offset in the network header
+		offset := uint32(12)
+		if f == nftables.TableFamilyIPv6 {
+			offset = 8
+		}
+		lookup, err := getExprForAddrSet(f, offset, &SetRef{Name: sets[i].Name, ID: sets[i].ID}, EQ)
+		if err != nil {
+			return err
+		}
+		// meta nfproto ipv4 ip saddr @blocklist-v4 drop
+		if _, err := ri.Rules().CreateImm(&Rule{
+			Meta:     &MetaRule{NFProto: &f},
+			RawExprs: lookup,
+			Action:   drop,
+		}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// load adopts prefixes programmed in the blocklist sets
+func (b *Blocklist) load() error {
+	now := b.now()
+	for _, f := range []nftables.TableFamily{nftables.TableFamilyIPv4, nftables.TableFamilyIPv6} {
+		name, _ := blocklistSet(f)
+		elements, err := b.si.Sets().GetSetElements(name)
+		if err != nil {
+			return err
+		}
+		sortIntervalElements(elements)
+		for i := 0; i < len(elements); i++ {
+			if elements[i].IntervalEnd {
+				continue
+			}
+			if i+1 >= len(elements) || !elements[i+1].IntervalEnd {
+				return fmt.Errorf("set %s carries interval starting at %s without end", name, net.IP(elements[i].Key))
+			}
+			prefix, err := intervalPrefix(elements[i].Key, elements[i+1].Key)
+			if err != nil {
+				return fmt.Errorf("set %s carries interval which is not a prefix: %+v", name, err)
+			}
+			bp := &blockedPrefix{prefix: prefix}
+			if elements[i].Timeout != 0 {
+				bp.expires = now.Add(elements[i].Timeout)
+			}
+			b.entries[prefix.String()] = bp
+			i++
+		}
+	}
+
+	return nil
+}
+
+// Add blocks the address or the prefix for ttl, ttl 0 blocks it until it is removed. Adding an already
+// blocked entry restarts its ttl, an entry overlapping with a different blocked entry is rejected.
+func (b *Blocklist) Add(addr string, ttl time.Duration) error {
+	prefix, err := parseIntervalPrefix(addr, "blocklist")
+	if err != nil {
+		return err
+	}
+	if err := validateBlocklistTTL(ttl); err != nil {
+		return err
+	}
+	b.Lock()
+	defer b.Unlock()
+	b.expire()
+	key := prefix.String()
+	for k, e := range b.entries {
+		if k != key && overlaps(e.prefix, prefix) {
+			return fmt.Errorf("%s overlaps with blocked %s", key, k)
+		}
+	}
+	name, _ := blocklistSet(prefixFamily(prefix))
+	if _, ok := b.entries[key]; ok {
+		// Element's timeout cannot be updated, the element is re-created
+		if err := b.si.Sets().SetDelElements(name, blockedElements(prefix, 0)); err != nil {
+			return err
+		}
+		delete(b.entries, key)
+	}
+	if err := b.si.Sets().SetAddElements(name, blockedElements(prefix, ttl)); err != nil {
+		return err
+	}
+	b.entries[key] = b.newBlockedPrefix(prefix, ttl)
+
+	return nil
+}
+
+// Remove unblocks the address or the prefix, it must match the blocked entry exactly
+func (b *Blocklist) Remove(addr string) error {
+	prefix, err := parseIntervalPrefix(addr, "blocklist")
+	if err != nil {
+		return err
+	}
+	b.Lock()
+	defer b.Unlock()
+	b.expire()
+	key := prefix.String()
+	if _, ok := b.entries[key]; !ok {
+		return fmt.Errorf("%s is not blocked", key)
+	}
+	name, _ := blocklistSet(prefixFamily(prefix))
+	if err := b.si.Sets().SetDelElements(name, blockedElements(prefix, 0)); err != nil {
+		return err
+	}
+	delete(b.entries, key)
+
+	return nil
+}
+
+// List returns blocked entries with the time left before they expire, IPv4 entries go first,
+// entries are sorted by address.
+func (b *Blocklist) List() []BlocklistEntry {
+	b.Lock()
+	defer b.Unlock()
+	b.expire()
+	now := b.now()
+	prefixes := make([]*blockedPrefix, 0, len(b.entries))
+	for _, e := range b.entries {
+		prefixes = append(prefixes, e)
+	}
+	sort.Slice(prefixes, func(i, j int) bool {
+		pi, pj := prefixes[i].prefix, prefixes[j].prefix
+		if len(pi.IP) != len(pj.IP) {
+			return len(pi.IP) < len(pj.IP)
+		}
+		return bytes.Compare(pi.IP, pj.IP) < 0
+	})
+	list := make([]BlocklistEntry, 0, len(prefixes))
+	for _, p := range prefixes {
+		entry := BlocklistEntry{Addr: p.prefix.String()}
+		if !p.expires.IsZero() {
+			entry.TTL = p.expires.Sub(now)
+		}
+		list = append(list, entry)
+	}
+
+	return list
+}
+
+// ReplaceAll makes the blocklist to carry only the entries, entries which are already blocked get
+// their TTL restarted. Elements are removed and added in batches, so while the blocklist is replaced,
+// entries blocked before and after the replacement are not enforced for a short period of time.
+func (b *Blocklist) ReplaceAll(entries []BlocklistEntry) error {
+	ttls := make(map[string]time.Duration, len(entries))
+	prefixes := make([]*net.IPNet, 0, len(entries))
+	for _, e := range entries {
+		prefix, err := parseIntervalPrefix(e.Addr, "blocklist")
+		if err != nil {
+			return err
+		}
+		if err := validateBlocklistTTL(e.TTL); err != nil {
+			return err
+		}
+		if _, ok := ttls[prefix.String()]; ok {
+			return fmt.Errorf("duplicate blocklist entry %s", prefix.String())
+		}
+		ttls[prefix.String()] = e.TTL
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Slice(prefixes, func(i, j int) bool {
+		if len(prefixes[i].IP) != len(prefixes[j].IP) {
+			return len(prefixes[i].IP) < len(prefixes[j].IP)
+		}
+		return bytes.Compare(prefixes[i].IP, prefixes[j].IP) < 0
+	})
+	for i := 1; i < len(prefixes); i++ {
+		if overlaps(prefixes[i-1], prefixes[i]) {
+			return fmt.Errorf("blocklist entries %s and %s overlap", prefixes[i-1].String(), prefixes[i].String())
+		}
+	}
+	b.Lock()
+	defer b.Unlock()
+	b.expire()
+	del := make(map[nftables.TableFamily][]nftables.SetElement)
+	add := make(map[nftables.TableFamily][]nftables.SetElement)
+	for _, e := range b.entries {
+		f := prefixFamily(e.prefix)
+		del[f] = append(del[f], blockedElements(e.prefix, 0)...)
+	}
+	for _, p := range prefixes {
+		f := prefixFamily(p)
+		add[f] = append(add[f], blockedElements(p, ttls[p.String()])...)
+	}
+	for _, f := range []nftables.TableFamily{nftables.TableFamilyIPv4, nftables.TableFamilyIPv6} {
+		name, _ := blocklistSet(f)
+		if len(del[f]) != 0 {
+			if err := b.si.Sets().SetDelElementsBatch(name, del[f]); err != nil {
+				return err
+			}
+			for k, e := range b.entries {
+				if prefixFamily(e.prefix) == f {
+					delete(b.entries, k)
+				}
+			}
+		}
+		if len(add[f]) != 0 {
+			warnSetLoad(b.si, name, len(add[f]))
+			if err := b.si.Sets().SetAddElementsBatch(name, add[f]); err != nil {
+				return err
+			}
+		}
+		for _, p := range prefixes {
+			if prefixFamily(p) == f {
+				b.entries[p.String()] = b.newBlockedPrefix(p, ttls[p.String()])
+			}
+		}
+	}
+
+	return nil
+}
+
+// expire drops entries which were removed by the kernel as their timeout elapsed
+func (b *Blocklist) expire() {
+	now := b.now()
+	for k, e := range b.entries {
+		if !e.expires.IsZero() && !now.Before(e.expires) {
+			delete(b.entries, k)
+		}
+	}
+}
+
+func (b *Blocklist) newBlockedPrefix(prefix *net.IPNet, ttl time.Duration) *blockedPrefix {
+	bp := &blockedPrefix{prefix: prefix}
+	if ttl != 0 {
+		bp.expires = b.now().Add(ttl)
+	}
+
+	return bp
+}
+
+// blocklistSet returns the name and the key type of the blocklist set of the family
+func blocklistSet(family nftables.TableFamily) (string, nftables.SetDatatype) {
+	if family == nftables.TableFamilyIPv6 {
+		return BlocklistIPv6SetName, nftables.TypeIP6Addr
+	}
+	return BlocklistIPv4SetName, nftables.TypeIPAddr
+}
+
+func validateBlocklistTTL(ttl time.Duration) error {
+	// Netlink carries timeouts in milliseconds, a shorter timeout would make the entry permanent
+	if ttl < 0 || (ttl != 0 && ttl < time.Millisecond) {
+		return fmt.Errorf("invalid blocklist ttl %s, ttl must be 0 or at least 1ms", ttl)
+	}
+
+	return nil
+}
+
+// parseIntervalPrefix parses an address or a prefix of an interval set element, an address is converted
+// to a host prefix, what names the kind of the set in errors.
+func parseIntervalPrefix(addr, what string) (*net.IPNet, error) {
+	var prefix *net.IPNet
+	if strings.Contains(addr, "/") {
+		_, ipnet, err := net.ParseCIDR(addr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s prefix %s: %+v", what, addr, err)
+		}
+		prefix = ipnet
+	} else {
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid %s address %s", what, addr)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			prefix = &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}
+		} else {
+			prefix = &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+		}
+	}
+	if ip4 := prefix.IP.To4(); ip4 != nil {
+		prefix.IP = ip4
+		if len(prefix.Mask) == net.IPv6len {
+			prefix.Mask = prefix.Mask[12:]
+		}
+	}
+	// The interval closing the prefix would be beyond the address space
+	if lastKey(prefix) == nil {
+		return nil, fmt.Errorf("%s prefix %s reaching the end of the address space is not supported", what, prefix.String())
+	}
+
+	return prefix, nil
+}
+
+// lastKey returns the first address following the prefix, nil is returned if the prefix
+// reaches the end of the address space.
+func lastKey(prefix *net.IPNet) []byte {
+	last := make([]byte, len(prefix.IP))
+	allOnes := true
+	for i := range prefix.IP {
+		last[i] = prefix.IP[i] | ^prefix.Mask[i]
+		allOnes = allOnes && last[i] == 0xff
+	}
+	if allOnes {
+		return nil
+	}
+
+	return nextKey(last)
+}
+
+// blockedElements returns interval elements of the prefix, the kernel does not accept a timeout for
+// the element closing the interval, it is removed along with the expired element opening the interval.
+func blockedElements(prefix *net.IPNet, ttl time.Duration) []nftables.SetElement {
+	return []nftables.SetElement{
+		{Key: []byte(prefix.IP), Timeout: ttl},
+		{Key: lastKey(prefix), IntervalEnd: true},
+	}
+}
+
+// intervalPrefix converts the interval [start, end) to a prefix
+func intervalPrefix(start, end []byte) (*net.IPNet, error) {
+	s, e := new(big.Int).SetBytes(start), new(big.Int).SetBytes(end)
+	size := new(big.Int).Sub(e, s)
+	if size.Sign() <= 0 || new(big.Int).And(size, new(big.Int).Sub(size, big.NewInt(1))).Sign() != 0 ||
+		new(big.Int).Mod(s, size).Sign() != 0 {
+		return nil, fmt.Errorf("%s-%s", net.IP(start), net.IP(end))
+	}
+	bits := len(start) * 8
+
+	return &net.IPNet{IP: net.IP(start), Mask: net.CIDRMask(bits-(size.BitLen()-1), bits)}, nil
+}
+
+func prefixFamily(prefix *net.IPNet) nftables.TableFamily {
+	if len(prefix.IP) == net.IPv4len {
+		return nftables.TableFamilyIPv4
+	}
+	return nftables.TableFamilyIPv6
+}
+
+func overlaps(a, b *net.IPNet) bool {
+	if len(a.IP) != len(b.IP) {
+		return false
+	}
+	return a.Contains(b.IP) || b.Contains(a.IP)
+}
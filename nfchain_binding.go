@@ -0,0 +1,137 @@
+package nftableslib
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// nftaChainFlags carries flags of the chain, golang.org/x/sys/unix does not define it
+	nftaChainFlags = 0xa
+	// nftChainBinding flags the chain bound to the rule jumping to it
+	nftChainBinding = 0x4
+)
+
+// inlineChainPrefix prefixes names of chains created for inline jumps
+const inlineChainPrefix = "__inline_"
+
+// IsInlineChain returns true if the chain was created by the library for an inline jump, such chain
+// is bound to the rule jumping to it and the kernel removes it along with the rule.
+func IsInlineChain(name string) bool {
+	return strings.HasPrefix(name, inlineChainPrefix)
+}
+
+// SetJumpInline builds RuleAction jumping to an anonymous chain carrying the rules, "jump { ... }".
+// The chain is created in the same transaction as the rule and it is bound to the rule, so the kernel
+// removes the chain along with the rule. Chain binding requires kernel 5.9 or newer, creating the rule
+// fails with ErrUnsupportedByKernel on older kernels. The binding is requested by connections created
+// by InitConn, other connections program the chain as a regular chain.
+func SetJumpInline(rules []*Rule) (*RuleAction, error) {
+	if len(rules) == 0 {
+		return nil, fmt.Errorf("inline jump requires at least one rule")
+	}
+	for i, r := range rules {
+		if r == nil {
+			return nil, fmt.Errorf("inline rule %d cannot be nil", i)
+		}
+		if r.Position != 0 {
+			return nil, fmt.Errorf("inline rule %d cannot carry position", i)
+		}
+	}
+
+	return &RuleAction{inline: rules}, nil
+}
+
+// inlineChain carries the chain bound to the rule and rules of the chain
+type inlineChain struct {
+	chain *nftables.Chain
+	rules []*nfRule
+}
+
+// buildInline builds the chain and rules of the inline jump, the verdict jumping to the chain is returned
+func (nfr *nfRules) buildInline(rules []*Rule) (*inlineChain, *expr.Verdict, error) {
+	features, err := nfr.opts.kernelFeatures()
+	if err != nil {
+		return nil, nil, err
+	}
+	if !features.ChainBinding {
+		return nil, nil, &ErrUnsupportedByKernel{Feature: FeatureChainBinding}
+	}
+	ic := &inlineChain{
+		chain: &nftables.Chain{Name: inlineChainPrefix + nfr.opts.idGenerator().Name(), Table: nfr.table},
+	}
+	inner := &nfRules{conn: nfr.conn, table: nfr.table, chain: ic.chain, opts: nfr.opts, chains: nfr.chains}
+	for _, rule := range rules {
+		split, err := inner.split(rule)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, r := range split {
+			rr, err := inner.buildRule(r)
+			if err != nil {
+				return nil, nil, err
+			}
+			if r.UserData != nil {
+				rr.rule.UserData = append([]byte{}, r.UserData...)
+			}
+			ic.rules = append(ic.rules, rr)
+		}
+	}
+
+	return ic, &expr.Verdict{Kind: expr.VerdictJump, Chain: ic.chain.Name}, nil
+}
+
+// pushInline queues the chain of the inline jump and its rules, they precede the rule jumping to
+// the chain in the batch, as the kernel binds the chain when the rule is added.
+func (nfr *nfRules) pushInline(rr *nfRule) {
+	if rr.inline == nil {
+		return
+	}
+	nfr.conn.AddChain(rr.inline.chain)
+	for _, r := range rr.inline.rules {
+		nfr.pushInline(r)
+		nfr.conn.AddRule(r.rule)
+	}
+}
+
+// bindInlineChains flags chains created for inline jumps as bound, github.com/google/nftables does not
+// support flags of chains, so the flag is added to chain messages of the batch. Messages are copied,
+// the batch passed to the function is not changed.
+func bindInlineChains(messages []netlink.Message) ([]netlink.Message, error) {
+	flags, err := netlink.MarshalAttributes([]netlink.Attribute{
+		{Type: nftaChainFlags, Data: binaryutil.BigEndian.PutUint32(nftChainBinding)},
+	})
+	if err != nil {
+		return nil, err
+	}
+	bound := make([]netlink.Message, len(messages))
+	copy(bound, messages)
+	for i, m := range bound {
+		if uint16(m.Header.Type)&0xff != unix.NFT_MSG_NEWCHAIN || len(m.Data) < 4 {
+			continue
+		}
+		ad, err := netlink.NewAttributeDecoder(m.Data[4:])
+		if err != nil {
+			return nil, err
+		}
+		inline := false
+		for ad.Next() {
+			if ad.Type() == unix.NFTA_CHAIN_NAME {
+				inline = IsInlineChain(ad.String())
+			}
+		}
+		if inline {
+			bound[i].Data = append(append([]byte{}, m.Data...), flags...)
+			// The length is computed again when the message is sent
+			bound[i].Header.Length = 0
+		}
+	}
+
+	return bound, nil
+}
@@ -0,0 +1,67 @@
+package nftableslib
+
+import (
+	"testing"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
+)
+
+func TestBindInlineChains(t *testing.T) {
+	var batch []netlink.Message
+	conn := &nftables.Conn{TestDial: func(req []netlink.Message) ([]netlink.Message, error) {
+		batch = append(batch, req...)
+		return nil, nil
+	}}
+	table := &nftables.Table{Name: "filter", Family: nftables.TableFamilyIPv4}
+	conn.AddChain(&nftables.Chain{Name: "input", Table: table})
+	conn.AddChain(&nftables.Chain{Name: inlineChainPrefix + "1", Table: table})
+	if err := conn.Flush(); err != nil {
+		t.Fatalf("failed to flush with error: %+v", err)
+	}
+	// Batch delimiters are not relayed
+	messages := batch[1 : len(batch)-1]
+	bound, err := bindInlineChains(messages)
+	if err != nil {
+		t.Fatalf("failed to bind inline chains with error: %+v", err)
+	}
+	tests := []struct {
+		name  string
+		flags []uint32
+	}{
+		{
+			name: "input",
+		},
+		{
+			name:  inlineChainPrefix + "1",
+			flags: []uint32{nftChainBinding},
+		},
+	}
+	for i, tt := range tests {
+		ad, err := netlink.NewAttributeDecoder(bound[i].Data[4:])
+		if err != nil {
+			t.Fatalf("Test \"%s\" failed to decode chain with error: %+v", tt.name, err)
+		}
+		name, flags := "", []uint32{}
+		for ad.Next() {
+			switch ad.Type() {
+			case unix.NFTA_CHAIN_NAME:
+				name = ad.String()
+			case nftaChainFlags:
+				flags = append(flags, binaryutil.BigEndian.Uint32(ad.Bytes()))
+			}
+		}
+		if name != tt.name || len(flags) != len(tt.flags) || len(flags) == 1 && flags[0] != tt.flags[0] {
+			t.Fatalf("Test \"%s\" failed, expected chain %s with flags %v, got chain %s with flags %v", tt.name, tt.name, tt.flags, name, flags)
+		}
+		if bound[i].Header.Length != 0 && int(bound[i].Header.Length) != unix.SizeofNlMsghdr+len(bound[i].Data) {
+			t.Fatalf("Test \"%s\" failed, length %d of the header does not match the message", tt.name, bound[i].Header.Length)
+		}
+	}
+	// The relayed batch is not changed
+	if len(messages[1].Data) == len(bound[1].Data) {
+		t.Fatalf("chain message of the batch is not expected to be changed")
+	}
+}
@@ -0,0 +1,294 @@
+package nftableslib
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/mdlayher/netlink"
+	vnetlink "github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// nftaHookDevs carries the list of devices a netdev chain is bound to, kernels older than 5.5
+	// support only a single device carried by NFTA_HOOK_DEV.
+	nftaHookDevs = 0x4
+	// nftaDeviceName is the attribute of a device in the list of devices
+	nftaDeviceName = 0x1
+)
+
+// ChainDevicesConn defines an optional interface of the connection, connections implementing it
+// bind base chains to devices and resolve devices instead of the library talking to the kernel directly.
+type ChainDevicesConn interface {
+	// BindChainDevices creates the base chain if it does not exist, binds it to added devices and
+	// releases removed devices in a single transaction.
+	BindChainDevices(c *nftables.Chain, add []string, del []string) error
+	ChainDevices(*nftables.Chain) ([]string, error)
+	LinkExists(name string) (bool, error)
+}
+
+// validateDevices checks names of the devices, the same device cannot be listed twice
+func validateDevices(devices []string) error {
+	seen := make(map[string]bool, len(devices))
+	for _, d := range devices {
+		if d == "" {
+			return fmt.Errorf("device name cannot be empty")
+		}
+		if len(d) >= unix.IFNAMSIZ {
+			return fmt.Errorf("device name %s is longer than %d characters", d, unix.IFNAMSIZ-1)
+		}
+		if seen[d] {
+			return fmt.Errorf("device %s is listed more than once", d)
+		}
+		seen[d] = true
+	}
+
+	return nil
+}
+
+// resolveDevices checks that all devices exist in the namespace of the connection
+func resolveDevices(conn NetNS, devices []string) error {
+	for _, d := range devices {
+		ok, err := deviceExists(conn, d)
+		if err != nil {
+			return fmt.Errorf("failed to resolve device %s with error: %+v", d, err)
+		}
+		if !ok {
+			return fmt.Errorf("device %s does not exist", d)
+		}
+	}
+
+	return nil
+}
+
+func deviceExists(conn NetNS, name string) (bool, error) {
+	switch c := conn.(type) {
+	case ChainDevicesConn:
+		return c.LinkExists(name)
+	case *nftables.Conn:
+		return linkExists(c.NetNS, name)
+	}
+
+	return false, fmt.Errorf("connection does not support binding chains to devices")
+}
+
+func bindChainDevices(conn NetNS, c *nftables.Chain, add, del []string) error {
+	switch cc := conn.(type) {
+	case ChainDevicesConn:
+		return cc.BindChainDevices(c, add, del)
+	case *nftables.Conn:
+		msgs := make([]netlink.Message, 0, 2)
+		// Chain message is sent even without added devices to create a chain not bound to devices yet
+		if len(add) != 0 || len(del) == 0 {
+			msg, err := chainDevicesMessage(unix.NFT_MSG_NEWCHAIN, netlink.Request|netlink.Acknowledge|netlink.Create, c, add)
+			if err != nil {
+				return err
+			}
+			msgs = append(msgs, msg)
+		}
+		if len(del) != 0 {
+			msg, err := chainDevicesMessage(unix.NFT_MSG_DELCHAIN, netlink.Request|netlink.Acknowledge, c, del)
+			if err != nil {
+				return err
+			}
+			msgs = append(msgs, msg)
+		}
+		return sendBatch(cc, msgs...)
+	}
+
+	return fmt.Errorf("connection does not support binding chains to devices")
+}
+
+func chainDevices(conn NetNS, c *nftables.Chain) ([]string, error) {
+	switch cc := conn.(type) {
+	case ChainDevicesConn:
+		return cc.ChainDevices(c)
+	case *nftables.Conn:
+		return dumpChainDevices(cc, c)
+	}
+
+	return nil, fmt.Errorf("connection does not support binding chains to devices")
+}
+
+// chainDevicesMessage builds the chain message carrying the list of devices, github.com/google/nftables
+// does not support devices of netdev chains, so the message is built by the library. NFT_MSG_NEWCHAIN
+// creates the chain or adds devices to the existing one, NFT_MSG_DELCHAIN with the list of devices
+// releases the devices without removing the chain.
+func chainDevicesMessage(msgType uint16, flags netlink.HeaderFlags, c *nftables.Chain, devices []string) (netlink.Message, error) {
+	devs := make([]netlink.Attribute, 0, len(devices))
+	for _, d := range devices {
+		devs = append(devs, netlink.Attribute{Type: nftaDeviceName, Data: []byte(d + "\x00")})
+	}
+	devsData, err := netlink.MarshalAttributes(devs)
+	if err != nil {
+		return netlink.Message{}, err
+	}
+	hook, err := netlink.MarshalAttributes([]netlink.Attribute{
+		{Type: unix.NFTA_HOOK_HOOKNUM, Data: binaryutil.BigEndian.PutUint32(uint32(c.Hooknum))},
+		{Type: unix.NFTA_HOOK_PRIORITY, Data: binaryutil.BigEndian.PutUint32(uint32(c.Priority))},
+		{Type: unix.NLA_F_NESTED | nftaHookDevs, Data: devsData},
+	})
+	if err != nil {
+		return netlink.Message{}, err
+	}
+	attrs := []netlink.Attribute{
+		{Type: unix.NFTA_CHAIN_TABLE, Data: []byte(c.Table.Name + "\x00")},
+		{Type: unix.NFTA_CHAIN_NAME, Data: []byte(c.Name + "\x00")},
+		{Type: unix.NLA_F_NESTED | unix.NFTA_CHAIN_HOOK, Data: hook},
+		{Type: unix.NFTA_CHAIN_TYPE, Data: []byte(c.Type + "\x00")},
+	}
+	if c.Policy != nil && msgType == unix.NFT_MSG_NEWCHAIN {
+		attrs = append(attrs, netlink.Attribute{Type: unix.NFTA_CHAIN_POLICY, Data: binaryutil.BigEndian.PutUint32(uint32(*c.Policy))})
+	}
+	data, err := netlink.MarshalAttributes(attrs)
+	if err != nil {
+		return netlink.Message{}, err
+	}
+
+	return netlink.Message{
+		Header: netlink.Header{
+			Type:  netlink.HeaderType((unix.NFNL_SUBSYS_NFTABLES << 8) | msgType),
+			Flags: flags,
+		},
+		// nfgenmsg header: family, version and resource id
+		Data: append([]byte{uint8(c.Table.Family), unix.NFNETLINK_V0, 0, 0}, data...),
+	}, nil
+}
+
+// dumpChainDevices returns devices the chain is bound to, the chain is looked up in the dump
+// of the table's chains.
+func dumpChainDevices(cc *nftables.Conn, c *nftables.Chain) ([]string, error) {
+	data, err := netlink.MarshalAttributes([]netlink.Attribute{
+		{Type: unix.NFTA_CHAIN_TABLE, Data: []byte(c.Table.Name + "\x00")},
+	})
+	if err != nil {
+		return nil, err
+	}
+	msg := netlink.Message{
+		Header: netlink.Header{
+			Type:  netlink.HeaderType((unix.NFNL_SUBSYS_NFTABLES << 8) | unix.NFT_MSG_GETCHAIN),
+			Flags: netlink.Request | netlink.Acknowledge | netlink.Dump,
+		},
+		Data: append([]byte{uint8(c.Table.Family), unix.NFNETLINK_V0, 0, 0}, data...),
+	}
+	var devices []string
+	found := false
+	if err := dumpMessages(cc, msg, func(b []byte) error {
+		name, devs, err := decodeChainDevices(b)
+		if err != nil {
+			return err
+		}
+		if name == c.Name {
+			found = true
+			devices = devs
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("chain %s does not exist in table %s", c.Name, c.Table.Name)
+	}
+
+	return devices, nil
+}
+
+// decodeChainDevices returns the name of the chain carried by NFT_MSG_NEWCHAIN message and
+// the devices the chain is bound to, sorted by name.
+func decodeChainDevices(b []byte) (string, []string, error) {
+	if len(b) < 4 {
+		return "", nil, fmt.Errorf("short chain message")
+	}
+	ad, err := netlink.NewAttributeDecoder(b[4:])
+	if err != nil {
+		return "", nil, err
+	}
+	ad.ByteOrder = binary.BigEndian
+	name := ""
+	devices := make(map[string]bool)
+	for ad.Next() {
+		switch ad.Type() {
+		case unix.NFTA_CHAIN_NAME:
+			name = ad.String()
+		case unix.NFTA_CHAIN_HOOK:
+			ad.Nested(func(had *netlink.AttributeDecoder) error {
+				for had.Next() {
+					switch had.Type() {
+					case unix.NFTA_HOOK_DEV:
+						devices[had.String()] = true
+					case nftaHookDevs:
+						had.Nested(func(dad *netlink.AttributeDecoder) error {
+							for dad.Next() {
+								if dad.Type() == nftaDeviceName {
+									devices[dad.String()] = true
+								}
+							}
+							return nil
+						})
+					}
+				}
+				return nil
+			})
+		}
+	}
+	if err := ad.Err(); err != nil {
+		return "", nil, err
+	}
+	devs := make([]string, 0, len(devices))
+	for d := range devices {
+		devs = append(devs, d)
+	}
+	sort.Strings(devs)
+
+	return name, devs, nil
+}
+
+// linkExists checks whether the device exists in the namespace, 0 stands for the current namespace
+func linkExists(ns int, name string) (bool, error) {
+	var h *vnetlink.Handle
+	var err error
+	if ns == 0 {
+		h, err = vnetlink.NewHandle()
+	} else {
+		h, err = vnetlink.NewHandleAt(netns.NsHandle(ns))
+	}
+	if err != nil {
+		return false, err
+	}
+	defer h.Delete()
+	if _, err := h.LinkByName(name); err != nil {
+		if _, ok := err.(vnetlink.LinkNotFoundError); ok {
+			return false, nil
+		}
+		return false, err
+	}
+
+	return true, nil
+}
+
+// devicesDiff returns devices present in want but not in have and devices present in have but not in want
+func devicesDiff(have, want []string) ([]string, []string) {
+	add, del := make([]string, 0), make([]string, 0)
+	h := make(map[string]bool, len(have))
+	for _, d := range have {
+		h[d] = true
+	}
+	w := make(map[string]bool, len(want))
+	for _, d := range want {
+		w[d] = true
+		if !h[d] {
+			add = append(add, d)
+		}
+	}
+	for _, d := range have {
+		if !w[d] {
+			del = append(del, d)
+		}
+	}
+
+	return add, del
+}
@@ -0,0 +1,225 @@
+package nftableslib
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+// ChainGraph is the directed graph of jumps between chains of the table, built from rules of the store
+// including rules loaded by Sync. Edges maps every chain of the store to sorted names of chains its rules
+// jump to or go to, either directly or through elements of verdict maps. Rules of inline chains count
+// as rules of the chain binding them.
+type ChainGraph struct {
+	Edges map[string][]string
+}
+
+// ErrChainCycle is returned when chains cannot be ordered because they jump to each other,
+// each chain of Cycle jumps to the next one and the last one jumps to the first one.
+type ErrChainCycle struct {
+	Cycle []string
+}
+
+func (e *ErrChainCycle) Error() string {
+	return fmt.Sprintf("chains form a cycle %s -> %s", strings.Join(e.Cycle, " -> "), e.Cycle[0])
+}
+
+// Chains returns sorted names of chains of the graph
+func (g *ChainGraph) Chains() []string {
+	chains := make([]string, 0, len(g.Edges))
+	for c := range g.Edges {
+		chains = append(chains, c)
+	}
+	sort.Strings(chains)
+
+	return chains
+}
+
+// Cycles returns cycles of the graph found by depth first search visiting chains in sorted order,
+// every chain which is a part of a cycle is reported in at least one of them.
+func (g *ChainGraph) Cycles() [][]string {
+	const (
+		visiting = 1
+		visited  = 2
+	)
+	cycles := make([][]string, 0)
+	state := make(map[string]int)
+	path := make([]string, 0)
+	var visit func(chain string)
+	visit = func(chain string) {
+		state[chain] = visiting
+		path = append(path, chain)
+		for _, t := range g.Edges[chain] {
+			if _, ok := g.Edges[t]; !ok {
+				continue
+			}
+			switch state[t] {
+			case visiting:
+				for i := len(path) - 1; i >= 0; i-- {
+					if path[i] == t {
+						cycles = append(cycles, append([]string{}, path[i:]...))
+						break
+					}
+				}
+			case 0:
+				visit(t)
+			}
+		}
+		path = path[:len(path)-1]
+		state[chain] = visited
+	}
+	for _, c := range g.Chains() {
+		if state[c] == 0 {
+			visit(c)
+		}
+	}
+
+	return cycles
+}
+
+// DeleteOrder returns chains of the graph ordered for deletion, chains come before chains they jump to,
+// so rules referring to a chain are removed before it. Chains which are not referenced are sorted by name.
+// ErrChainCycle is returned if chains jump to each other.
+func (g *ChainGraph) DeleteOrder() ([]string, error) {
+	refs := make(map[string]int)
+	for _, targets := range g.Edges {
+		for _, t := range targets {
+			if _, ok := g.Edges[t]; ok {
+				refs[t]++
+			}
+		}
+	}
+	ready := make([]string, 0)
+	for _, c := range g.Chains() {
+		if refs[c] == 0 {
+			ready = append(ready, c)
+		}
+	}
+	order := make([]string, 0, len(g.Edges))
+	for len(ready) != 0 {
+		c := ready[0]
+		ready = ready[1:]
+		order = append(order, c)
+		released := make([]string, 0)
+		for _, t := range g.Edges[c] {
+			if _, ok := g.Edges[t]; !ok {
+				continue
+			}
+			if refs[t]--; refs[t] == 0 {
+				released = append(released, t)
+			}
+		}
+		ready = append(ready, released...)
+		sort.Strings(ready)
+	}
+	if len(order) != len(g.Edges) {
+		return nil, &ErrChainCycle{Cycle: g.Cycles()[0]}
+	}
+
+	return order, nil
+}
+
+// ruleChainTargets adds names of chains the rule jumps to or goes to, verdicts decoded from rules
+// programmed on the host and elements of verdict maps the rule looks up are inspected.
+func ruleChainTargets(r *nfRule, names map[string]bool) {
+	add := func(v *expr.Verdict) {
+		if v == nil || v.Chain == "" {
+			return
+		}
+		if v.Kind != expr.VerdictKind(unix.NFT_JUMP) && v.Kind != expr.VerdictKind(unix.NFT_GOTO) {
+			return
+		}
+		if !IsInlineChain(v.Chain) {
+			names[v.Chain] = true
+		}
+	}
+	for _, e := range r.rule.Exprs {
+		if v, ok := e.(*expr.Verdict); ok {
+			add(v)
+		}
+	}
+	for _, s := range r.sets {
+		for _, el := range s.elements {
+			add(el.VerdictData)
+		}
+	}
+	if r.inline != nil {
+		for _, ir := range r.inline.rules {
+			ruleChainTargets(ir, names)
+		}
+	}
+}
+
+// graph builds the graph of jumps between chains of the store, it expects nfc to be locked
+func (nfc *nfChains) graph() *ChainGraph {
+	g := &ChainGraph{Edges: make(map[string][]string, len(nfc.chains))}
+	for name, ch := range nfc.chains {
+		names := make(map[string]bool)
+		if nfr, ok := ch.RulesInterface.(*nfRules); ok {
+			for _, r := range nfr.ordered() {
+				ruleChainTargets(r, names)
+			}
+		}
+		targets := make([]string, 0, len(names))
+		for t := range names {
+			targets = append(targets, t)
+		}
+		sort.Strings(targets)
+		g.Edges[name] = targets
+	}
+
+	return g
+}
+
+// Graph returns the graph of jumps between chains of the table known to the store,
+// the store should be synced to account for chains and rules programmed by other applications.
+func (nfc *nfChains) Graph() *ChainGraph {
+	nfc.Lock()
+	defer nfc.Unlock()
+
+	return nfc.graph()
+}
+
+// DetectCycles returns cycles of jumps between chains of the table, the kernel refuses rules
+// closing a cycle, so cycles point to rules which fail to program.
+func (nfc *nfChains) DetectCycles() [][]string {
+	return nfc.Graph().Cycles()
+}
+
+// TopologicalDeleteOrder returns chains of the table ordered for deletion, a chain comes before
+// chains it jumps to. ErrChainCycle is returned if chains jump to each other.
+func (nfc *nfChains) TopologicalDeleteOrder() ([]string, error) {
+	return nfc.Graph().DeleteOrder()
+}
+
+// DeleteAll removes all chains of the table along with their rules as a single transaction,
+// chains are deleted in TopologicalDeleteOrder, so rules jumping to a chain are removed before it.
+func (nfc *nfChains) DeleteAll() error {
+	if err := writable(nfc.conn); err != nil {
+		return err
+	}
+	nfc.Lock()
+	defer nfc.Unlock()
+	order, err := nfc.graph().DeleteOrder()
+	if err != nil {
+		return err
+	}
+	for _, name := range order {
+		nfc.conn.DelChain(nfc.chains[name].chain)
+	}
+	if err := flush(nfc.conn); err != nil {
+		if errors.Is(err, unix.EBUSY) {
+			return fmt.Errorf("failed to delete chains of table %s, chains are referenced by rules unknown to the store", nfc.table.Name)
+		}
+		return err
+	}
+	for _, name := range order {
+		delete(nfc.chains, name)
+	}
+
+	return nil
+}
@@ -4,6 +4,9 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
@@ -11,7 +14,8 @@ import (
 	"golang.org/x/sys/unix"
 )
 
-// ChainsInterface defines third level interface operating with nf chains
+// ChainsInterface defines third level interface operating with nf chains, it is safe for concurrent use.
+// Chains of a table are locked together while the host is programmed, chains of different tables are not.
 type ChainsInterface interface {
 	Chains() ChainFuncs
 }
@@ -35,20 +39,84 @@ type ChainAttributes struct {
 	Type     nftables.ChainType
 	Hook     nftables.ChainHook
 	Priority nftables.ChainPriority
-	Device   string
-	Policy   *ChainPolicy
+	// Device is kept for compatibility, it is bound to the chain along with Devices
+	Device string
+	// Devices lists devices a base chain of netdev family is bound to, kernels 5.5 and newer
+	// support more than a single device per chain.
+	Devices []string
+	// AllowMissingDevices allows binding to devices which do not exist yet, otherwise
+	// every device must exist when the chain is created.
+	AllowMissingDevices bool
+	Policy              *ChainPolicy
+	// EnsureCtSanity installs conntrack sanity rules at the head of every chain of CtSanityChains
+	// along with the chain of nat type in a single transaction. Conntrack does not translate packets
+	// it marks invalid, so such packets would pass the nat chain untouched. The chains get:
+	//
+	//	ct state established,related accept
+	//	ct state invalid drop
+	//
+	// Packets exempted from tracking by notrack have ct state untracked and match neither rule.
+	// The rules carry the comment "ct sanity of nat chain <name>" and are removed along with the nat chain.
+	EnsureCtSanity bool
+	// CtSanityChains lists base chains of filter type of the same table receiving conntrack sanity
+	// rules, usually the chain of forward hook.
+	CtSanityChains []string
+}
+
+// devices returns the list of devices the chain is bound to
+func (cha *ChainAttributes) devices() []string {
+	if cha.Device == "" {
+		return cha.Devices
+	}
+	for _, d := range cha.Devices {
+		if d == cha.Device {
+			return cha.Devices
+		}
+	}
+
+	return append([]string{cha.Device}, cha.Devices...)
 }
 
 // Validate validate attributes passed for a base chain creation
 func (cha *ChainAttributes) Validate() error {
-	if cha.Type == "" {
+	switch cha.Type {
+	case "":
 		return fmt.Errorf("base chain must have type set")
+	case nftables.ChainTypeFilter, nftables.ChainTypeNAT:
+	case nftables.ChainTypeRoute:
+		// Chains of type route re-route packets which got their mark or addresses changed,
+		// only locally generated packets are subject to re-routing.
+		if cha.Hook != nftables.ChainHookOutput {
+			return fmt.Errorf("chain of type route can only be attached to output hook, got hook %d", cha.Hook)
+		}
+	default:
+		return fmt.Errorf("unknown chain type %s", cha.Type)
+	}
+	if err := validateDevices(cha.devices()); err != nil {
+		return err
 	}
 	// TODO Add additional attributes validation
 
 	return nil
 }
 
+// validateFamily checks that the chain type is supported by the family of the table
+func (cha *ChainAttributes) validateFamily(family nftables.TableFamily) error {
+	if len(cha.devices()) != 0 && family != nftables.TableFamilyNetdev {
+		return fmt.Errorf("only chains of netdev family can be bound to devices, got family %#02x", family)
+	}
+	if cha.Type != nftables.ChainTypeRoute {
+		return nil
+	}
+	switch family {
+	case nftables.TableFamilyIPv4, nftables.TableFamilyIPv6, nftables.TableFamilyINet:
+	default:
+		return fmt.Errorf("chain of type route is not supported in family %#02x, only ip, ip6 and inet families are supported", family)
+	}
+
+	return nil
+}
+
 // ChainFuncs defines funcations to operate with chains
 type ChainFuncs interface {
 	Chain(name string) (RulesInterface, error)
@@ -56,22 +124,78 @@ type ChainFuncs interface {
 	CreateImm(name string, attributes *ChainAttributes) error
 	Delete(name string) error
 	DeleteImm(name string) error
+	DeleteSafe(name string, force ...bool) error
+	UpdateDevices(name string, devices []string, allowMissing ...bool) error
 	Exist(name string) bool
 	Sync() error
 	Dump() ([]byte, error)
+	DumpWithCounters() ([]byte, error)
+	StreamWithCounters(w io.Writer) error
+	DumpChain(name string, opts *DumpOptions) ([]byte, error)
 	Get() ([]string, error)
+	GetByPrefix(prefix string) ([]string, error)
+	List() ([]*ChainInfo, error)
+	FindReferences(kind ReferenceKind, name string) ([]*Reference, error)
+	Simulate(chain string, p *Packet) (*SimulationResult, error)
+	RuleCount(name string) (int, error)
+	CopyRules(src string, dst RulesInterface, transform func(*Rule) (*Rule, error)) error
+	EnableStats(name string) error
+	GetStats(name string) (*CounterState, error)
+	DisableStats(name string) error
+	SetForeignRulePolicy(name string, policy ForeignRulePolicy) error
+	Graph() *ChainGraph
+	DetectCycles() [][]string
+	TopologicalDeleteOrder() ([]string, error)
+	DeleteAll() error
+}
+
+// ChainReference describes a rule which refers to a chain by a jump or goto verdict
+type ChainReference struct {
+	// Chain is the name of the chain the referencing rule belongs to
+	Chain  string
+	RuleID uint32
+	Handle uint64
+}
+
+// ErrChainInUse is returned when a chain cannot be deleted because it is still
+// the target of jump or goto verdicts. References is populated with the rules
+// the library was able to resolve, it can be empty when the references are not known
+// to the library, for example when they were programmed by a different application.
+type ErrChainInUse struct {
+	Chain      string
+	References []ChainReference
+}
+
+func (e *ErrChainInUse) Error() string {
+	if len(e.References) == 0 {
+		return fmt.Sprintf("chain %s is in use", e.Chain)
+	}
+	refs := make([]string, 0, len(e.References))
+	for _, r := range e.References {
+		refs = append(refs, fmt.Sprintf("%s:%d(handle %d)", r.Chain, r.RuleID, r.Handle))
+	}
+	return fmt.Sprintf("chain %s is in use, referenced by rules: %s", e.Chain, strings.Join(refs, ", "))
 }
 
 type nfChains struct {
 	conn  NetNS
 	table *nftables.Table
+	opts  *tableOptions
 	sync.Mutex
 	chains map[string]*nfChain
+	// deleted carries chains which deletion is queued but the host still reports them
+	deleted map[string]bool
+	// sets is the store of the table's sets, sets referred by rules are validated against it
+	sets *nfSets
 }
 
 type nfChain struct {
 	baseChain bool
 	chain     *nftables.Chain
+	// pending is true while the chain's creation is queued and the host does not report it
+	pending bool
+	// foreign is the policy applied to foreign rules of the chain, overriding the table's policy
+	foreign ForeignRulePolicy
 	RulesInterface
 }
 
@@ -84,7 +208,7 @@ func (nfc *nfChains) Chain(name string) (RulesInterface, error) {
 		return c.RulesInterface, nil
 
 	}
-	return nil, fmt.Errorf("chain %s does not exist", name)
+	return nil, fmt.Errorf("chain %s does not exist in table %s", name, tableName(nfc.table))
 }
 
 // Chains return a list of methods available for Chain operations
@@ -140,23 +264,56 @@ func (nfc *nfChains) create(name string, attributes *ChainAttributes) error {
 
 	var baseChain bool
 	var c *nftables.Chain
+	var sanityRules map[*nfRules][][]*Rule
+	var sanityBuilt map[*nfRules][][]*nfRule
 	if attributes != nil {
 		if err := attributes.Validate(); err != nil {
 			return err
 		}
+		if err := attributes.validateFamily(nfc.table.Family); err != nil {
+			return err
+		}
+		if attributes.EnsureCtSanity {
+			if err := nfc.validateCtSanity(name, attributes); err != nil {
+				return err
+			}
+			var err error
+			if sanityRules, sanityBuilt, err = nfc.buildCtSanity(name, attributes.CtSanityChains); err != nil {
+				return err
+			}
+		}
+		if nfc.table.Family == nftables.TableFamilyNetdev && attributes.Hook == ChainHookEgress {
+			features, err := nfc.opts.kernelFeatures()
+			if err != nil {
+				return err
+			}
+			if !features.EgressHook {
+				return &ErrUnsupportedByKernel{Feature: FeatureEgressHook}
+			}
+		}
 		baseChain = true
 		policy := nftables.ChainPolicyAccept
 		if attributes.Policy != nil {
 			policy = nftables.ChainPolicy(*attributes.Policy)
 		}
-		c = nfc.conn.AddChain(&nftables.Chain{
+		c = &nftables.Chain{
 			Name:     name,
 			Hooknum:  attributes.Hook,
 			Priority: attributes.Priority,
 			Table:    nfc.table,
 			Type:     attributes.Type,
 			Policy:   &policy,
-		})
+		}
+		if err := nfc.checkHookPriority(c); err != nil {
+			return err
+		}
+		if devices := attributes.devices(); len(devices) != 0 {
+			if err := nfc.createWithDevices(c, devices, attributes.AllowMissingDevices); err != nil {
+				return err
+			}
+		} else {
+			c = nfc.conn.AddChain(c)
+		}
 	} else {
 		baseChain = false
 		c = nfc.conn.AddChain(&nftables.Chain{
@@ -164,16 +321,83 @@ func (nfc *nfChains) create(name string, attributes *ChainAttributes) error {
 			Table: nfc.table,
 		})
 	}
+	if sanityRules != nil {
+		if err := nfc.queueCtSanity(name, sanityRules, sanityBuilt); err != nil {
+			return err
+		}
+	}
 	nfc.chains[name] = &nfChain{
 		chain:          c,
 		baseChain:      baseChain,
-		RulesInterface: newRules(nfc.conn, nfc.table, c),
+		pending:        true,
+		RulesInterface: newRules(nfc.conn, nfc.table, c, nfc.opts, nfc),
+	}
+	delete(nfc.deleted, name)
+
+	return nil
+}
+
+// createWithDevices programs the base chain bound to devices immediately, github.com/google/nftables
+// cannot carry devices in its batch, so queued operations are flushed first for the chain's table to exist.
+func (nfc *nfChains) createWithDevices(c *nftables.Chain, devices []string, allowMissing bool) error {
+	if !allowMissing {
+		if err := resolveDevices(nfc.conn, devices); err != nil {
+			return err
+		}
+	}
+	if err := flush(nfc.conn); err != nil {
+		return err
+	}
+	if err := bindChainDevices(nfc.conn, c, devices, nil); err != nil {
+		return fmt.Errorf("failed to create chain %s bound to devices %v with error: %+v", c.Name, devices, err)
+	}
+
+	return nil
+}
+
+// UpdateDevices rebinds the base chain of netdev family to the list of devices without recreating
+// the chain and its rules, devices are added and released in a single transaction which is
+// applied immediately. If allowMissing is true, devices do not have to exist.
+func (nfc *nfChains) UpdateDevices(name string, devices []string, allowMissing ...bool) error {
+	if err := writable(nfc.conn); err != nil {
+		return err
+	}
+	nfc.Lock()
+	defer nfc.Unlock()
+	ch, ok := nfc.chains[name]
+	if !ok {
+		return fmt.Errorf("chain %s does not exist in table %s", name, tableName(nfc.table))
+	}
+	if !ch.baseChain || nfc.table.Family != nftables.TableFamilyNetdev {
+		return fmt.Errorf("chain %s is not a base chain of netdev family", name)
+	}
+	if err := validateDevices(devices); err != nil {
+		return err
+	}
+	if len(allowMissing) == 0 || !allowMissing[0] {
+		if err := resolveDevices(nfc.conn, devices); err != nil {
+			return err
+		}
+	}
+	current, err := chainDevices(nfc.conn, ch.chain)
+	if err != nil {
+		return fmt.Errorf("failed to get devices of chain %s with error: %+v", name, err)
+	}
+	add, del := devicesDiff(current, devices)
+	if len(add) == 0 && len(del) == 0 {
+		return nil
+	}
+	if err := bindChainDevices(nfc.conn, ch.chain, add, del); err != nil {
+		return fmt.Errorf("failed to update devices of chain %s with error: %+v", name, err)
 	}
 
 	return nil
 }
 
 func (nfc *nfChains) Create(name string, attributes *ChainAttributes) error {
+	if err := writable(nfc.conn); err != nil {
+		return err
+	}
 	nfc.Lock()
 	defer nfc.Unlock()
 
@@ -181,48 +405,73 @@ func (nfc *nfChains) Create(name string, attributes *ChainAttributes) error {
 }
 
 func (nfc *nfChains) CreateImm(name string, attributes *ChainAttributes) error {
+	if err := writable(nfc.conn); err != nil {
+		return err
+	}
 	nfc.Lock()
 	defer nfc.Unlock()
 	if err := nfc.create(name, attributes); err != nil {
 		return err
 	}
 	// Flush notifies netlink to proceed with prgramming of a chain
-	if err := nfc.conn.Flush(); err != nil {
+	if err := flush(nfc.conn); err != nil {
 		return err
 	}
+	nfc.chains[name].pending = false
+	if attributes != nil && attributes.EnsureCtSanity {
+		return nfc.updateCtSanityHandles(name)
+	}
 
 	return nil
 }
 
 func (nfc *nfChains) Delete(name string) error {
+	if err := writable(nfc.conn); err != nil {
+		return err
+	}
 	nfc.Lock()
 	defer nfc.Unlock()
 	if ch, ok := nfc.chains[name]; ok {
+		sanity := nfc.natCtSanityRefs(ch)
+		if err := nfc.delCtSanity(sanity); err != nil {
+			return err
+		}
 		nfc.conn.DelChain(ch.chain)
+		forgetRefs(sanity)
 		delete(nfc.chains, name)
+		nfc.deleted[name] = true
 	} else {
-		return fmt.Errorf("chain %s does not exists", name)
+		return fmt.Errorf("chain %s does not exist in table %s", name, tableName(nfc.table))
 	}
 
 	return nil
 }
 
 func (nfc *nfChains) DeleteImm(name string) error {
+	if err := writable(nfc.conn); err != nil {
+		return err
+	}
 	nfc.Lock()
 	defer nfc.Unlock()
 	ch, ok := nfc.chains[name]
 	if !ok {
-		return fmt.Errorf("chain %s does not exists", name)
+		return fmt.Errorf("chain %s does not exist in table %s", name, tableName(nfc.table))
 	}
 
 	var err error
+	sanity := nfc.natCtSanityRefs(ch)
 	timeout := time.NewTimer(ChainDeleteTimeout)
 	ticker := time.NewTicker(ChainDeleteTimeout / 10)
 	defer ticker.Stop()
 	for {
+		// Conntrack sanity rules of nat chain are removed in the same transaction
+		if err := nfc.delCtSanity(sanity); err != nil {
+			return err
+		}
 		// Flush notifies netlink to proceed with removing of a chain
 		nfc.conn.DelChain(ch.chain)
-		if err = nfc.conn.Flush(); err == nil {
+		if err = flush(nfc.conn); err == nil {
+			forgetRefs(sanity)
 			delete(nfc.chains, name)
 			return nil
 		}
@@ -239,47 +488,246 @@ func (nfc *nfChains) DeleteImm(name string) error {
 	}
 }
 
+// DeleteSafe removes a chain only when it is not referenced by jump or goto verdicts
+// of other rules in the table, otherwise ErrChainInUse is returned. If force is true,
+// the referencing rules are removed first, rules and chain deletion is programmed
+// as a single transaction, referencing rules which are queued and not flushed yet fail it.
+func (nfc *nfChains) DeleteSafe(name string, force ...bool) error {
+	if err := writable(nfc.conn); err != nil {
+		return err
+	}
+	nfc.Lock()
+	defer nfc.Unlock()
+	ch, ok := nfc.chains[name]
+	if !ok {
+		return fmt.Errorf("chain %s does not exist in table %s", name, tableName(nfc.table))
+	}
+	refs := nfc.references(name)
+	rules, err := snapshotRefs(refs)
+	if err != nil {
+		return err
+	}
+	if len(refs) != 0 && (len(force) == 0 || !force[0]) {
+		inUse := &ErrChainInUse{Chain: name}
+		for i, r := range refs {
+			inUse.References = append(inUse.References, ChainReference{
+				Chain:  r.chain,
+				RuleID: r.rule.id,
+				Handle: rules[i].Handle,
+			})
+		}
+		return inUse
+	}
+	for i, r := range refs {
+		// Additions of queued rules cannot be withdrawn from the batch, removing them from
+		// the store would leave untracked rules referring to a deleted chain.
+		if rules[i].Handle == 0 {
+			return fmt.Errorf("rule id %d of chain %s referring to chain %s is not programmed yet, flush it first", r.rule.id, r.chain, name)
+		}
+	}
+	for _, rule := range rules {
+		if err := nfc.conn.DelRule(rule); err != nil {
+			return err
+		}
+	}
+	sanity := nfc.natCtSanityRefs(ch)
+	if err := nfc.delCtSanity(sanity); err != nil {
+		return err
+	}
+	nfc.conn.DelChain(ch.chain)
+	if err := flush(nfc.conn); err != nil {
+		if errors.Is(err, unix.EBUSY) {
+			return &ErrChainInUse{Chain: name}
+		}
+		return err
+	}
+	forgetRefs(append(refs, sanity...))
+	delete(nfc.chains, name)
+
+	return nil
+}
+
+type chainRef struct {
+	chain string
+	rules *nfRules
+	rule  *nfRule
+}
+
+// references returns all rules known to the store which refer to the chain
+func (nfc *nfChains) references(name string) []chainRef {
+	refs := make([]chainRef, 0)
+	for cn, c := range nfc.chains {
+		nfr, ok := c.RulesInterface.(*nfRules)
+		if !ok {
+			continue
+		}
+		for _, r := range nfr.getReferences(name) {
+			refs = append(refs, chainRef{chain: cn, rules: nfr, rule: r})
+		}
+	}
+
+	return refs
+}
+
+// RuleCount returns a number of rules the store carries for the chain
+func (nfc *nfChains) RuleCount(name string) (int, error) {
+	nfc.Lock()
+	defer nfc.Unlock()
+	ch, ok := nfc.chains[name]
+	if !ok {
+		return 0, fmt.Errorf("chain %s does not exist in table %s", name, tableName(nfc.table))
+	}
+	nfr, ok := ch.RulesInterface.(*nfRules)
+	if !ok {
+		return 0, fmt.Errorf("chain %s does not have rules store", name)
+	}
+	nfr.Lock()
+	defer nfr.Unlock()
+
+	return nfr.countRules(), nil
+}
+
 func (nfc *nfChains) Sync() error {
-	chains, err := nfc.conn.ListChains()
+	chains, err := nfc.list("")
 	if err != nil {
 		return err
 	}
+
+	return nfc.sync(chains, &SyncReport{}, false)
+}
+
+// sync adds chains of the table found in the list of host's chains to the store along with their rules,
+// when prune is true, chains which are not found on the host are removed from the store.
+func (nfc *nfChains) sync(chains []*nftables.Chain, report *SyncReport, prune bool) error {
+	onHost := make(map[string]bool)
+	added := make([]*nfChain, 0)
+	nfc.Lock()
 	for _, chain := range chains {
-		if chain.Table.Name == nfc.table.Name && chain.Table.Family == nfc.table.Family {
-			if _, ok := nfc.chains[chain.Name]; !ok {
-				baseChain := false
-				if chain.Type != "" && chain.Hooknum != 0 {
-					baseChain = true
-				}
-				nfc.Lock()
-				nfc.chains[chain.Name] = &nfChain{
-					chain:          chain,
-					baseChain:      baseChain,
-					RulesInterface: newRules(nfc.conn, nfc.table, chain),
-				}
-				nfc.Unlock()
-				if err := nfc.chains[chain.Name].Rules().Sync(); err != nil {
-					return err
-				}
+		if chain.Table.Name != nfc.table.Name || chain.Table.Family != nfc.table.Family {
+			continue
+		}
+		// Chains of inline jumps belong to rules jumping to them
+		if IsInlineChain(chain.Name) {
+			continue
+		}
+		onHost[chain.Name] = true
+		if ch, ok := nfc.chains[chain.Name]; ok {
+			ch.pending = false
+			continue
+		}
+		// Chains which deletion is queued are not loaded back, unless the store is pruned,
+		// pruning expects all queued changes to be flushed.
+		if nfc.deleted[chain.Name] && !prune {
+			continue
+		}
+		baseChain := false
+		// Hook number of base chains can be 0, for example prerouting and ingress hooks
+		if chain.Type != "" {
+			baseChain = true
+		}
+		nc := &nfChain{
+			chain:          chain,
+			baseChain:      baseChain,
+			RulesInterface: newRules(nfc.conn, nfc.table, chain, nfc.opts, nfc),
+		}
+		nfc.chains[chain.Name] = nc
+		added = append(added, nc)
+		report.Added.Chains++
+	}
+	for name := range nfc.deleted {
+		if !onHost[name] || prune {
+			delete(nfc.deleted, name)
+		}
+	}
+	if prune {
+		for name := range nfc.chains {
+			if !onHost[name] {
+				delete(nfc.chains, name)
+				report.Removed.Chains++
 			}
 		}
 	}
+	nfc.Unlock()
+	// Rules are loaded only for the newly discovered chains
+	for _, nc := range added {
+		n, err := nc.RulesInterface.(*nfRules).sync()
+		if err != nil {
+			return err
+		}
+		report.Added.Rules += n
+	}
 
 	return nil
 }
 
+// Dump outputs json representation of chains of the store sorted by name, every chain carries
+// its rules, RuleSummary, in the order of the chain.
 func (nfc *nfChains) Dump() ([]byte, error) {
+	return nfc.dump(false)
+}
+
+// dump outputs json representation of chains of the store, rules carry current values of their
+// counters read from the host when counters is true.
+func (nfc *nfChains) dump(counters bool) ([]byte, error) {
 	nfc.Lock()
 	defer nfc.Unlock()
 	var data []byte
-
-	for _, c := range nfc.chains {
-		b, err := json.Marshal(&c.chain)
-		if err != nil {
-			return nil, err
+	// Use of chains is reported by the host, the store does not track it
+	var chains []*nftables.Chain
+	var counts []uint32
+	if err := nfc.opts.readPolicy().do(func() (err error) {
+		chains, counts, err = listChainsUse(nfc.conn, nfc.listFilter(""))
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	uses := make(map[string]uint32, len(chains))
+	for i, c := range chains {
+		uses[c.Name] = counts[i]
+	}
+	// Sets of the table are read from the host once, only if rules look up sets the store does not carry
+	var host auditSets
+	hostSets := func() (auditSets, error) {
+		if host != nil {
+			return host, nil
 		}
-		data = append(data, b...)
-		b, err = c.Rules().Dump()
+		err := nfc.opts.readPolicy().do(func() (err error) {
+			host, err = getAuditSets(nfc.conn, nfc.table)
+			return err
+		})
+		return host, err
+	}
+	objects := nfc.counterObjects()
+	names := make([]string, 0, len(nfc.chains))
+	for name := range nfc.chains {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		c := nfc.chains[name]
+		var rules []*RuleSummary
+		if nfr, ok := c.RulesInterface.(*nfRules); ok {
+			// Counters are joined by handles, rules created by Create and flushed since get them first
+			if counters {
+				if err := nfr.resolvePending(); err != nil {
+					return nil, err
+				}
+			}
+			var err error
+			if rules, err = nfr.summaries(hostSets); err != nil {
+				return nil, err
+			}
+			if counters {
+				if err := nfc.addCounters(c.chain, rules, objects); err != nil {
+					return nil, err
+				}
+			}
+		}
+		b, err := json.Marshal(&struct {
+			*nftables.Chain
+			Use   uint32
+			Rules []*RuleSummary `json:"Rules,omitempty"`
+		}{c.chain, uses[name], rules})
 		if err != nil {
 			return nil, err
 		}
@@ -289,52 +737,79 @@ func (nfc *nfChains) Dump() ([]byte, error) {
 	return data, nil
 }
 
-// Exist checks is the chain already defined
+// Exist checks is the chain already defined, chains queued for creation exist and chains
+// queued for deletion do not exist, even before the batch is flushed.
 func (nfc *nfChains) Exist(name string) bool {
 	// Check if Chain exists in the store
-	if _, ok := nfc.chains[name]; ok {
+	nfc.Lock()
+	_, ok := nfc.chains[name]
+	nfc.Unlock()
+	if ok {
 		return true
 	}
 	// It is not in the store, let's double check if it exists on the host
-	chains, err := nfc.conn.ListChains()
+	chains, err := nfc.list(name)
 	if err != nil {
 		return false
 	}
 	for _, chain := range chains {
 		if chain.Name == name {
-			if nfc.table.Name == chain.Table.Name && nfc.table.Family == chain.Table.Family {
-				// Found a chain is missing from the store, adding it
-				// Sync will load all missing chain,
-				// TODO Consider creating SyncChain(name) function.
-				if err := nfc.Sync(); err == nil {
-					return true
-				}
-				break
+			// The host reports the chain until queued deletion is flushed
+			if nfc.isDeleted(name) {
+				return false
+			}
+			// Found a chain is missing from the store, adding it
+			// Sync will load all missing chain,
+			// TODO Consider creating SyncChain(name) function.
+			if err := nfc.Sync(); err == nil {
+				return true
 			}
+			return false
 		}
 	}
+	nfc.Lock()
+	delete(nfc.deleted, name)
+	nfc.Unlock()
 
 	return false
 }
 
-// Get returns all tables defined for a specific TableFamily
+// isDeleted returns true if the chain's deletion is queued
+func (nfc *nfChains) isDeleted(name string) bool {
+	nfc.Lock()
+	defer nfc.Unlock()
+
+	return nfc.deleted[name]
+}
+
+// Get returns all chains of the table
 func (nfc *nfChains) Get() ([]string, error) {
-	chains, err := nfc.conn.ListChains()
+	return nfc.GetByPrefix("")
+}
+
+// GetByPrefix returns chains of the table which names start with the prefix, chains of other
+// tables are skipped while the dump is decoded.
+func (nfc *nfChains) GetByPrefix(prefix string) ([]string, error) {
+	chains, err := nfc.list(prefix)
 	if err != nil {
 		return nil, err
 	}
 	var chainNames []string
 	for _, chain := range chains {
-		if nfc.table.Name == chain.Table.Name && nfc.table.Family == chain.Table.Family {
-			if _, ok := nfc.chains[chain.Name]; !ok {
-				// Found chain which is not in the store
-				// triggering Sync() to add it
-				if err := nfc.Sync(); err != nil {
-					return nil, fmt.Errorf("Found chain in table %s which was missing in the store, failed to add it with error: %+v", chain.Table.Name, err)
-				}
+		if nfc.isDeleted(chain.Name) {
+			continue
+		}
+		nfc.Lock()
+		_, ok := nfc.chains[chain.Name]
+		nfc.Unlock()
+		if !ok {
+			// Found chain which is not in the store
+			// triggering Sync() to add it
+			if err := nfc.Sync(); err != nil {
+				return nil, fmt.Errorf("Found chain in table %s which was missing in the store, failed to add it with error: %+v", chain.Table.Name, err)
 			}
-			chainNames = append(chainNames, chain.Name)
 		}
+		chainNames = append(chainNames, chain.Name)
 	}
 
 	return chainNames, nil
@@ -342,25 +817,51 @@ func (nfc *nfChains) Get() ([]string, error) {
 
 // Ready returns true if the chain is found in the list of programmed chains
 func (nfc *nfChains) Ready(name string) (bool, error) {
-	chains, err := nfc.conn.ListChains()
+	chains, err := nfc.list(name)
 	if err != nil {
 		return false, err
 	}
 	for _, chain := range chains {
-		if nfc.table.Name == chain.Table.Name && nfc.table.Family == chain.Table.Family {
-			if name == chain.Name {
-				return true, nil
-			}
+		if name == chain.Name {
+			return true, nil
 		}
 	}
 
 	return false, nil
 }
 
-func newChains(conn NetNS, t *nftables.Table) ChainsInterface {
+// listFilter returns the filter selecting chains of the table which names start with the prefix
+func (nfc *nfChains) listFilter(prefix string) listFilter {
+	return listFilter{family: nfc.table.Family, table: nfc.table.Name, prefix: prefix}
+}
+
+// list returns chains of the table found on the host which names start with the prefix, chains of
+// inline jumps are not listed. Interrupted dumps are read again according to the table's read policy.
+func (nfc *nfChains) list(prefix string) ([]*nftables.Chain, error) {
+	var chains []*nftables.Chain
+	if err := nfc.opts.readPolicy().do(func() (err error) {
+		chains, _, err = listChains(nfc.conn, nfc.listFilter(prefix))
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	listed := chains[:0]
+	for _, c := range chains {
+		if !IsInlineChain(c.Name) {
+			listed = append(listed, c)
+		}
+	}
+
+	return listed, nil
+}
+
+func newChains(conn NetNS, t *nftables.Table, opts *tableOptions, sets *nfSets) ChainsInterface {
 	return &nfChains{
-		conn:   conn,
-		table:  t,
-		chains: make(map[string]*nfChain),
+		conn:    conn,
+		table:   t,
+		opts:    opts,
+		chains:  make(map[string]*nfChain),
+		deleted: make(map[string]bool),
+		sets:    sets,
 	}
 }
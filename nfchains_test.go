@@ -39,6 +39,59 @@ func TestChains(t *testing.T) {
 			attributes: nil,
 			success:    true,
 		},
+		{
+			name:  "Route chain, output hook",
+			chain: "chain-4",
+			attributes: &ChainAttributes{
+				Hook:     nftables.ChainHookOutput,
+				Priority: nftables.ChainPriorityMangle,
+				Type:     nftables.ChainTypeRoute,
+			},
+			success: true,
+		},
+		{
+			name:  "Route chain, prerouting hook",
+			chain: "chain-5",
+			attributes: &ChainAttributes{
+				Hook:     nftables.ChainHookPrerouting,
+				Priority: nftables.ChainPriorityMangle,
+				Type:     nftables.ChainTypeRoute,
+			},
+			success: false,
+		},
+		{
+			name:  "Base chain, unknown type",
+			chain: "chain-6",
+			attributes: &ChainAttributes{
+				Hook:     nftables.ChainHookInput,
+				Priority: nftables.ChainPriorityFilter,
+				Type:     "mangle",
+			},
+			success: false,
+		},
+		{
+			name:  "Base chain bound to devices outside of netdev family",
+			chain: "chain-7",
+			attributes: &ChainAttributes{
+				Hook:     nftables.ChainHookInput,
+				Priority: nftables.ChainPriorityFilter,
+				Type:     nftables.ChainTypeFilter,
+				Devices:  []string{"lo"},
+			},
+			success: false,
+		},
+		{
+			name:  "Base chain bound to the same device twice",
+			chain: "chain-8",
+			attributes: &ChainAttributes{
+				Hook:     nftables.ChainHookInput,
+				Priority: nftables.ChainPriorityFilter,
+				Type:     nftables.ChainTypeFilter,
+				Device:   "lo",
+				Devices:  []string{"eth0", "eth0"},
+			},
+			success: false,
+		},
 	}
 	conn := InitConn()
 	if conn == nil {
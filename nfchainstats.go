@@ -0,0 +1,124 @@
+package nftableslib
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+)
+
+// statsComment is the comment carried by the stats rule, it identifies the rule when rules are loaded from the host
+const statsComment = "nftableslib:chain-stats"
+
+// isStatsRule returns true if the user data of the rule identifies the stats rule of a chain
+func isStatsRule(ud []byte) bool {
+	return bytes.HasPrefix(ud, MakeRuleComment(statsComment))
+}
+
+// chainRules returns the rules store of the chain
+func (nfc *nfChains) chainRules(name string) (*nfRules, error) {
+	nfc.Lock()
+	defer nfc.Unlock()
+	ch, ok := nfc.chains[name]
+	if !ok {
+		return nil, fmt.Errorf("chain %s does not exists", name)
+	}
+	nfr, ok := ch.RulesInterface.(*nfRules)
+	if !ok {
+		return nil, fmt.Errorf("chain %s does not have rules store", name)
+	}
+
+	return nfr, nil
+}
+
+// EnableStats programs the stats rule of the chain, a counter-only rule kept first in the chain, it counts
+// every packet entering the chain. Rules inserted at position 0 afterwards are inserted after the stats rule.
+// Enabling stats of a chain which already has them is a no-op.
+func (nfc *nfChains) EnableStats(name string) error {
+	if err := writable(nfc.conn); err != nil {
+		return err
+	}
+	nfr, err := nfc.chainRules(name)
+	if err != nil {
+		return err
+	}
+	nfr.Lock()
+	defer nfr.Unlock()
+	if nfr.stats != nil {
+		return nil
+	}
+	rule := &Rule{
+		Counter:  &Counter{},
+		UserData: MakeRuleComment(statsComment),
+	}
+	id, err := nfr.create(rule, operationInsert, nil)
+	if err != nil {
+		return err
+	}
+	if err := flush(nfr.conn); err != nil {
+		nfr.removeRule(id)
+		return err
+	}
+	if _, err := nfr.updateHandle(id); err != nil {
+		return err
+	}
+	nfr.stats, err = getRuleByID(nfr.rules, id)
+
+	return err
+}
+
+// GetStats returns numbers of packets and bytes counted by the stats rule of the chain
+func (nfc *nfChains) GetStats(name string) (*CounterState, error) {
+	nfr, err := nfc.chainRules(name)
+	if err != nil {
+		return nil, err
+	}
+	nfr.Lock()
+	stats := nfr.stats
+	nfr.Unlock()
+	if stats == nil {
+		return nil, fmt.Errorf("chain %s does not have stats enabled", name)
+	}
+	var rules []*nftables.Rule
+	if err := nfc.opts.readPolicy().do(func() (err error) {
+		rules, err = nfc.conn.GetRule(nfr.table, nfr.chain)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	for _, r := range rules {
+		if r.Handle != stats.rule.Handle {
+			continue
+		}
+		for _, e := range r.Exprs {
+			if c, ok := e.(*expr.Counter); ok {
+				return &CounterState{Packets: c.Packets, Bytes: c.Bytes}, nil
+			}
+		}
+		return nil, fmt.Errorf("stats rule of chain %s does not carry a counter", name)
+	}
+
+	return nil, fmt.Errorf("stats rule with handle %d is not found in chain %s", stats.rule.Handle, name)
+}
+
+// DisableStats deletes the stats rule of the chain
+func (nfc *nfChains) DisableStats(name string) error {
+	if err := writable(nfc.conn); err != nil {
+		return err
+	}
+	nfr, err := nfc.chainRules(name)
+	if err != nil {
+		return err
+	}
+	nfr.Lock()
+	defer nfr.Unlock()
+	if nfr.stats == nil {
+		return fmt.Errorf("chain %s does not have stats enabled", name)
+	}
+	if err := nfr.delete(nfr.stats.id); err != nil {
+		return err
+	}
+
+	return flush(nfr.conn)
+}
@@ -0,0 +1,250 @@
+package nftableslib
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// Attributes and the flag of concatenated interval sets describing their fields and ends of their
+// elements, kernels 5.7 and newer support them, github.com/google/nftables does not encode them.
+const (
+	nftSetConcat      = 0x80
+	nftaSetDescConcat = 0x2
+	nftaSetFieldLen   = 0x1
+	nftaSetElemKeyEnd = 0xa
+)
+
+// getExprForConcatIntervals returns expressions matching the concatenation against its intervals,
+// a single interval is matched by a range per element, multiple intervals are looked up in
+// a concatenated interval set.
+func getExprForConcatIntervals(l3proto nftables.TableFamily, concat *Concat, ids IDGenerator) ([]expr.Any, *nfSet, error) {
+	if concat.SetRef != nil || concat.VMap {
+		return nil, nil, fmt.Errorf("intervals of concatenation cannot be used along with a set reference or a verdict map")
+	}
+	payloads, err := concatPayloads(l3proto, concat)
+	if err != nil {
+		return nil, nil, err
+	}
+	for i, interval := range concat.Intervals {
+		if err := validateConcatInterval(payloads, interval); err != nil {
+			return nil, nil, fmt.Errorf("interval %d of concatenation is invalid: %+v", i, err)
+		}
+	}
+	re := []expr.Any{}
+	if len(concat.Intervals) == 1 {
+		for i, p := range payloads {
+			p.DestRegister = unix.NFT_REG_1
+			re = append(re, p)
+			rng := concat.Intervals[0][i]
+			if bytes.Equal(rng.From, rng.To) {
+				re = append(re, &expr.Cmp{Op: expr.CmpOpEq, Register: unix.NFT_REG_1, Data: rng.From})
+				continue
+			}
+			re = append(re, &expr.Range{Op: expr.CmpOpEq, Register: unix.NFT_REG_1, FromData: rng.From, ToData: rng.To})
+		}
+		return re, nil, nil
+	}
+	lengths := make([]uint32, 0, len(payloads))
+	types := make([]nftables.SetDatatype, 0, len(payloads))
+	for i, p := range payloads {
+		lengths = append(lengths, p.Len)
+		types = append(types, concat.Elements[i].EType)
+	}
+	regs, err := newRegAllocator().allocConcat(lengths...)
+	if err != nil {
+		return nil, nil, err
+	}
+	for i, p := range payloads {
+		p.DestRegister = regs[i]
+		re = append(re, p)
+	}
+	set := &nftables.Set{
+		Constant: true,
+		Interval: true,
+		Name:     ids.Name(),
+		ID:       ids.SetID(),
+		KeyType:  GenSetKeyType(types...),
+	}
+	// Every interval is carried by a pair of elements, the element closing it carries ends of the ranges
+	elements := make([]nftables.SetElement, 0, 2*len(concat.Intervals))
+	for _, interval := range concat.Intervals {
+		var from, to []byte
+		for _, rng := range interval {
+			from = append(from, padConcatValue(rng.From)...)
+			to = append(to, padConcatValue(rng.To)...)
+		}
+		elements = append(elements, nftables.SetElement{Key: from}, nftables.SetElement{Key: to, IntervalEnd: true})
+	}
+	re = append(re, &expr.Lookup{
+		SourceRegister: regs[0],
+		SetID:          set.ID,
+		SetName:        set.Name,
+	})
+
+	return re, &nfSet{set: set, elements: elements, fields: lengths}, nil
+}
+
+func validateConcatInterval(payloads []*expr.Payload, interval []*ConcatRange) error {
+	if len(interval) != len(payloads) {
+		return fmt.Errorf("interval carries %d ranges, the concatenation has %d elements", len(interval), len(payloads))
+	}
+	for i, rng := range interval {
+		if rng == nil {
+			return fmt.Errorf("range of element %d is nil", i)
+		}
+		if uint32(len(rng.From)) != payloads[i].Len || uint32(len(rng.To)) != payloads[i].Len {
+			return fmt.Errorf("range of element %d must carry values of %d bytes", i, payloads[i].Len)
+		}
+		if bytes.Compare(rng.From, rng.To) > 0 {
+			return fmt.Errorf("range of element %d starts at %x after its end %x", i, rng.From, rng.To)
+		}
+	}
+
+	return nil
+}
+
+// padConcatValue pads the value of an element of a concatenation to a multiple of 4 bytes
+func padConcatValue(v []byte) []byte {
+	if len(v)%regUnitLen == 0 {
+		return v
+	}
+
+	return append(append([]byte{}, v...), make([]byte, regUnitLen-len(v)%regUnitLen)...)
+}
+
+// splitConcatIntervals replaces rules matching multiple intervals of a concatenation with a rule
+// per interval if the kernel does not support concatenated interval sets.
+func (nfr *nfRules) splitConcatIntervals(rules []*Rule) ([]*Rule, error) {
+	split := false
+	for _, r := range rules {
+		split = split || r.Concat != nil && len(r.Concat.Intervals) > 1
+	}
+	if !split {
+		return rules, nil
+	}
+	features, err := nfr.opts.kernelFeatures()
+	if err != nil {
+		return nil, err
+	}
+	if features.ConcatInterval {
+		return rules, nil
+	}
+	expanded := make([]*Rule, 0, len(rules))
+	for _, r := range rules {
+		if r.Concat == nil || len(r.Concat.Intervals) < 2 {
+			expanded = append(expanded, r)
+			continue
+		}
+		for _, interval := range r.Concat.Intervals {
+			concat := *r.Concat
+			concat.Intervals = [][]*ConcatRange{interval}
+			rr := *r
+			rr.Concat = &concat
+			expanded = append(expanded, &rr)
+		}
+	}
+
+	return expanded, nil
+}
+
+// addSet queues the set of the rule, concatenated interval sets of github.com/google/nftables
+// connections are programmed immediately as the connection cannot describe their fields.
+func addSet(conn NetNS, s *nfSet) error {
+	if ac, ok := conn.(*auditConn); ok {
+		return ac.addSet(s)
+	}
+	c, ok := conn.(*nftables.Conn)
+	if !ok || s.fields == nil {
+		return conn.AddSet(s.set, s.elements)
+	}
+	msgs, err := concatIntervalSetMessages(s)
+	if err != nil {
+		return err
+	}
+	if err := sendBatch(c, msgs...); err != nil {
+		return fmt.Errorf("failed to program set %s with error: %+v", s.set.Name, err)
+	}
+
+	return nil
+}
+
+// concatIntervalSetMessages returns messages creating the concatenated interval set and its elements,
+// the kernel expects the start and the end of an interval in a single element.
+func concatIntervalSetMessages(s *nfSet) ([]netlink.Message, error) {
+	keyLen := uint32(0)
+	fields := make([]netlink.Attribute, 0, len(s.fields))
+	for _, l := range s.fields {
+		keyLen += uint32(len(padConcatValue(make([]byte, l))))
+		field, err := netlink.MarshalAttributes([]netlink.Attribute{
+			{Type: nftaSetFieldLen, Data: binaryutil.BigEndian.PutUint32(l)},
+		})
+		if err != nil {
+			return nil, err
+		}
+		fields = append(fields, netlink.Attribute{Type: unix.NLA_F_NESTED | unix.NFTA_LIST_ELEM, Data: field})
+	}
+	concat, err := netlink.MarshalAttributes(fields)
+	if err != nil {
+		return nil, err
+	}
+	desc, err := netlink.MarshalAttributes([]netlink.Attribute{
+		{Type: unix.NLA_F_NESTED | nftaSetDescConcat, Data: concat},
+	})
+	if err != nil {
+		return nil, err
+	}
+	set, err := objectMessage(unix.NFT_MSG_NEWSET, netlink.Request|netlink.Acknowledge|netlink.Create, s.set.Table, []netlink.Attribute{
+		{Type: unix.NFTA_SET_NAME, Data: []byte(s.set.Name + "\x00")},
+		{Type: unix.NFTA_SET_FLAGS, Data: binaryutil.BigEndian.PutUint32(unix.NFT_SET_CONSTANT | unix.NFT_SET_INTERVAL | nftSetConcat)},
+		{Type: unix.NFTA_SET_KEY_TYPE, Data: binaryutil.BigEndian.PutUint32(s.set.KeyType.GetNFTMagic())},
+		{Type: unix.NFTA_SET_KEY_LEN, Data: binaryutil.BigEndian.PutUint32(keyLen)},
+		{Type: unix.NFTA_SET_ID, Data: binaryutil.BigEndian.PutUint32(s.set.ID)},
+		{Type: unix.NLA_F_NESTED | unix.NFTA_SET_DESC, Data: desc},
+	})
+	if err != nil {
+		return nil, err
+	}
+	elements := make([]netlink.Attribute, 0, len(s.elements)/2)
+	for i := 0; i+1 < len(s.elements); i += 2 {
+		key, err := dataValue(s.elements[i].Key)
+		if err != nil {
+			return nil, err
+		}
+		keyEnd, err := dataValue(s.elements[i+1].Key)
+		if err != nil {
+			return nil, err
+		}
+		e, err := netlink.MarshalAttributes([]netlink.Attribute{
+			{Type: unix.NLA_F_NESTED | unix.NFTA_SET_ELEM_KEY, Data: key},
+			{Type: unix.NLA_F_NESTED | nftaSetElemKeyEnd, Data: keyEnd},
+		})
+		if err != nil {
+			return nil, err
+		}
+		elements = append(elements, netlink.Attribute{Type: unix.NLA_F_NESTED | unix.NFTA_LIST_ELEM, Data: e})
+	}
+	list, err := netlink.MarshalAttributes(elements)
+	if err != nil {
+		return nil, err
+	}
+	elems, err := objectMessage(unix.NFT_MSG_NEWSETELEM, netlink.Request|netlink.Acknowledge|netlink.Create, s.set.Table, []netlink.Attribute{
+		{Type: unix.NFTA_SET_ELEM_LIST_SET, Data: []byte(s.set.Name + "\x00")},
+		{Type: unix.NLA_F_NESTED | unix.NFTA_SET_ELEM_LIST_ELEMENTS, Data: list},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return []netlink.Message{set, elems}, nil
+}
+
+// dataValue encodes the value as NFTA_DATA_VALUE
+func dataValue(v []byte) ([]byte, error) {
+	return netlink.MarshalAttributes([]netlink.Attribute{{Type: unix.NFTA_DATA_VALUE, Data: v}})
+}
@@ -11,31 +11,80 @@ import (
 type ConcatElement struct {
 	// Etype defines an element type as defined in github.com/google/nftables
 	// example nftables.InetService or nftables.IPAddr
-	EType nftables.SetDatatype
+	EType nftables.SetDatatype `json:"eType,omitempty"`
 	// EProto defines a protocol as defined in golang.org/x/sys/unix
-	EProto byte
+	EProto byte `json:"eProto,omitempty"`
 	// ESource defines a direction, if true then element is saddr or sport,
 	// if false then daddr or dport
-	ESource bool
+	ESource bool `json:"eSource,omitempty"`
 	// EMask defines mask of the element, mostly used along with IPAddr
-	EMask []byte
+	EMask []byte `json:"eMask,omitempty"`
 }
 
 // Concat defines parameters of Concatination rule
 type Concat struct {
-	Elements []*ConcatElement
+	Elements []*ConcatElement `json:"elements,omitempty"`
 	// VMap defines if concatination is used with verdict map, if set to true
 	// Rule's Action will be ignored as the action is stored in the verdict of the map.
-	VMap bool
+	VMap bool `json:"vMap,omitempty"`
 	// SetRef defines name and id of map for
-	SetRef *SetRef
+	SetRef *SetRef `json:"setRef,omitempty"`
+	// Intervals lists ranges the concatenation is matched against, an entry carries a range for every
+	// element in the order of Elements, packets falling into ranges of any entry match the rule.
+	// Kernels without concatenated interval sets get a rule per entry. Intervals cannot be used
+	// along with SetRef or VMap.
+	Intervals [][]*ConcatRange `json:"intervals,omitempty"`
+}
+
+// ConcatRange defines a range of values of an element of the concatenation, both ends are included.
+// Values are in network byte order and as long as the element's value, 4 or 16 bytes for addresses,
+// 6 bytes for ethernet addresses, 1 byte for protocols and 2 bytes for ports.
+type ConcatRange struct {
+	From []byte `json:"from,omitempty"`
+	To   []byte `json:"to,omitempty"`
 }
 
 func getExprForConcat(l3proto nftables.TableFamily, concat *Concat) ([]expr.Any, error) {
+	payloads, err := concatPayloads(l3proto, concat)
+	if err != nil {
+		return nil, err
+	}
+	lengths := make([]uint32, 0, len(payloads))
+	for _, p := range payloads {
+		lengths = append(lengths, p.Len)
+	}
+	regs, err := newRegAllocator().allocConcat(lengths...)
+	if err != nil {
+		return nil, err
+	}
+	re := []expr.Any{}
+	for i, p := range payloads {
+		p.DestRegister = regs[i]
+		re = append(re, p)
+	}
+	// If Concat refers to map, add lookup expression
+	if concat.SetRef != nil {
+		re = append(re, &expr.Lookup{
+			SourceRegister: regs[0],
+			DestRegister:   0,
+			IsDestRegSet:   true,
+			SetID:          concat.SetRef.ID,
+			SetName:        concat.SetRef.Name,
+		})
+	}
+
+	return re, nil
+}
+
+// concatPayloads returns payload loads of elements of the concatenation, registers are allocated
+// by the caller once lengths of all elements are known.
+func concatPayloads(l3proto nftables.TableFamily, concat *Concat) ([]*expr.Payload, error) {
 	var l3OffsetSrc, l3OffsetDst, l3AddrLen, l4ProtoOffset uint32
 	l4OffsetSrc := uint32(0)
 	l4OffsetDst := uint32(2)
-	re := []expr.Any{}
+	if len(concat.Elements) == 0 {
+		return nil, fmt.Errorf("concatenation requires at least one element")
+	}
 	switch l3proto {
 	case nftables.TableFamilyIPv4:
 		l3OffsetSrc = 12
@@ -50,81 +99,36 @@ func getExprForConcat(l3proto nftables.TableFamily, concat *Concat) ([]expr.Any,
 	default:
 		return nil, fmt.Errorf("unsupported table family %d", l3proto)
 	}
-	register := uint32(1)
+	payloads := make([]*expr.Payload, 0, len(concat.Elements))
 	for _, e := range concat.Elements {
+		p := &expr.Payload{}
 		switch e.EType {
-		case nftables.TypeIPAddr:
-			// [ payload load length of address in bytes @ network header + l3OffsetSrc or l3OffsetDst => reg 1 ]
-			var offset uint32
+		case nftables.TypeIPAddr, nftables.TypeIP6Addr:
+			// [ payload load length of address in bytes @ network header + l3OffsetSrc or l3OffsetDst => reg X ]
+			p.Base, p.Offset, p.Len = expr.PayloadBaseNetworkHeader, l3OffsetDst, l3AddrLen
 			if e.ESource {
-				offset = l3OffsetSrc
-			} else {
-				offset = l3OffsetDst
+				p.Offset = l3OffsetSrc
 			}
-			re = append(re, &expr.Payload{
-				DestRegister: register,
-				Base:         expr.PayloadBaseNetworkHeader,
-				Offset:       offset,
-				Len:          l3AddrLen,
-			})
-		case nftables.TypeIP6Addr:
-			// [ payload load length of address in bytes @ network header + l3OffsetSrc or l3OffsetDst => reg 1 ]
-			var offset uint32
+		case nftables.TypeEtherAddr:
+			// [ payload load 6b @ link header + 6 or 0 => reg X ]
+			p.Base, p.Offset, p.Len = expr.PayloadBaseLLHeader, 0, 6
 			if e.ESource {
-				offset = l3OffsetSrc
-			} else {
-				offset = l3OffsetDst
+				p.Offset = 6
 			}
-			re = append(re, &expr.Payload{
-				DestRegister: register,
-				Base:         expr.PayloadBaseNetworkHeader,
-				Offset:       offset,
-				Len:          l3AddrLen,
-			})
-			// Since IPv6 takes 16 bytes, need to increment register counter by 3.
-			register += 3
-		case nftables.TypeEtherAddr:
 		case nftables.TypeInetProto:
-			// [ payload load 1b @ network header + 9 => reg 1 ]
-			re = append(re, &expr.Payload{
-				DestRegister: register,
-				Base:         expr.PayloadBaseNetworkHeader,
-				Offset:       l4ProtoOffset,
-				Len:          1,
-			})
+			// [ payload load 1b @ network header + 9 => reg X ]
+			p.Base, p.Offset, p.Len = expr.PayloadBaseNetworkHeader, l4ProtoOffset, 1
 		case nftables.TypeInetService:
 			// [ payload load 2b @ transport header + l4OffsetSrc or l4OffsetDst => reg X ]
-			var offset uint32
+			p.Base, p.Offset, p.Len = expr.PayloadBaseTransportHeader, l4OffsetDst, 2
 			if e.ESource {
-				offset = l4OffsetSrc
-			} else {
-				offset = l4OffsetDst
+				p.Offset = l4OffsetSrc
 			}
-			re = append(re, &expr.Payload{
-				DestRegister: register,
-				Base:         expr.PayloadBaseTransportHeader,
-				Offset:       offset,
-				Len:          2,
-			})
 		default:
 			return nil, fmt.Errorf("unsupported element type %+v", e.EType)
 		}
-		if register == 1 {
-			register = 9
-		} else {
-			register++
-		}
-	}
-	// If Concat refers to map, add lookup expression
-	if concat.SetRef != nil {
-		re = append(re, &expr.Lookup{
-			SourceRegister: 1,
-			DestRegister:   0,
-			IsDestRegSet:   true,
-			SetID:          concat.SetRef.ID,
-			SetName:        concat.SetRef.Name,
-		})
+		payloads = append(payloads, p)
 	}
 
-	return re, nil
+	return payloads, nil
 }
@@ -1,23 +1,506 @@
 package nftableslib
 
-import "github.com/google/nftables"
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"sync"
+	"syscall"
 
-// InitConn initializes netlink connection of the nftables family
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/mdlayher/netlink"
+	"github.com/mdlayher/netlink/nltest"
+	"golang.org/x/sys/unix"
+)
+
+// InitConn initializes netlink connection of the nftables family, batches flushed by the connection
+// wait for the kernel to acknowledge every operation, failed batches return BatchError describing
+// the rejected operation.
 func InitConn(netns ...int) *nftables.Conn {
 	// if netns is not specified, global namespace is used
+	r := newRelay(true, netns...)
+
+	return &nftables.Conn{NetNS: r.netns, TestDial: r.exchange}
+}
+
+// relay relays messages of the connection to the kernel, github.com/google/nftables reads only
+// the first reply to a batch, so errors of operations other than the first one are lost. Batches
+// are sent by the relay which maps every error to the operation by its sequence number. Batches
+// of dry-run connections are relayed without the end of the batch, so the kernel aborts them
+// after the validation. Exchanges of the relay reuse one socket, it is closed and dialed again
+// when an exchange fails in a way which can leave replies pending on the socket.
+type relay struct {
+	netns  int
+	commit bool
+	dial   func() (*netlink.Conn, error)
+	sync.Mutex
+	conn *netlink.Conn
+}
+
+// newRelay returns the relay to the namespace, the socket of the relay is closed when the relay
+// is not used by any connection any longer.
+func newRelay(commit bool, netns ...int) *relay {
+	r := &relay{commit: commit}
 	if len(netns) != 0 {
-		return &nftables.Conn{NetNS: netns[0]}
+		r.netns = netns[0]
+	}
+	r.dial = func() (*netlink.Conn, error) {
+		return netlink.Dial(unix.NETLINK_NETFILTER, &netlink.Config{NetNS: r.netns, DisableNSLockThread: r.netns == 0})
+	}
+	runtime.SetFinalizer(r, (*relay).close)
+
+	return r
+}
+
+func (r *relay) close() {
+	r.Lock()
+	defer r.Unlock()
+	if r.conn != nil {
+		r.conn.Close()
+		r.conn = nil
 	}
-	return &nftables.Conn{}
+}
+
+func (r *relay) exchange(req []netlink.Message) ([]netlink.Message, error) {
+	// Receive of the connection without pending replies asks for more messages
+	if len(req) == 0 {
+		return nil, nil
+	}
+	r.Lock()
+	defer r.Unlock()
+	if r.conn == nil {
+		conn, err := r.dial()
+		if err != nil {
+			return nil, err
+		}
+		r.conn = conn
+	}
+	replies, err := r.relay(r.conn, req)
+	// Replies to every operation of rejected batches are received, the socket stays usable
+	var be *BatchError
+	if err != nil && !errors.As(err, &be) {
+		r.conn.Close()
+		r.conn = nil
+	}
+
+	return replies, err
+}
+
+func (r *relay) relay(conn *netlink.Conn, req []netlink.Message) ([]netlink.Message, error) {
+	if req[0].Header.Type != netlink.HeaderType(unix.NFNL_MSG_BATCH_BEGIN) {
+		return r.query(conn, req)
+	}
+	var err error
+	messages := req[1:]
+	if l := len(messages); l != 0 && messages[l-1].Header.Type == netlink.HeaderType(unix.NFNL_MSG_BATCH_END) {
+		messages = messages[:l-1]
+	}
+	if messages, err = bindInlineChains(messages); err != nil {
+		return nil, err
+	}
+	if err := exchangeBatch(conn, batchMessages(messages, r.commit)); err != nil {
+		return nil, err
+	}
+
+	return []netlink.Message{{
+		Header: netlink.Header{Type: netlink.Error, Sequence: req[0].Header.Sequence, PID: req[0].Header.PID},
+		Data:   make([]byte, 4),
+	}}, nil
+}
+
+// query relays a request which does not change the ruleset, replies are addressed to the request
+// of the connection. Multi-part replies are terminated by done message the connection expects.
+func (r *relay) query(conn *netlink.Conn, req []netlink.Message) ([]netlink.Message, error) {
+	replies := make([]netlink.Message, 0)
+	for _, m := range req {
+		// Sequence number and port id are assigned by the connection to the kernel
+		relayed := m
+		relayed.Header.Sequence, relayed.Header.PID = 0, 0
+		msgs, err := conn.Execute(relayed)
+		if err != nil {
+			return nil, err
+		}
+		multi := false
+		for _, rm := range msgs {
+			rm.Header.Sequence, rm.Header.PID = m.Header.Sequence, m.Header.PID
+			multi = multi || rm.Header.Flags&netlink.Multi != 0
+			replies = append(replies, rm)
+		}
+		if multi || m.Header.Flags&netlink.Dump != 0 {
+			replies = append(replies, netlink.Message{
+				Header: netlink.Header{Type: netlink.Done, Flags: netlink.Multi, Sequence: m.Header.Sequence, PID: m.Header.PID},
+				Data:   make([]byte, 4),
+			})
+		}
+	}
+
+	return replies, nil
+}
+
+// flush programs queued operations, BatchError describing the rejected operation is returned
+// as is, so callers can inspect it without unwrapping.
+func flush(conn NetNS) error {
+	err := conn.Flush()
+	if err == nil {
+		return nil
+	}
+	var be *BatchError
+	if errors.As(err, &be) {
+		return be
+	}
+
+	return err
 }
 
 // InitNFTables initializes netlink connection of the nftables family
-func InitNFTables(conn NetNS) TablesInterface {
+func InitNFTables(conn NetNS, opts ...TablesOption) TablesInterface {
 	// if netns is not specified, global namespace is used
 	ts := nfTables{
-		tables: make(map[nftables.TableFamily]map[string]*nfTable),
+		tables:   make(map[nftables.TableFamily]map[string]*nfTable),
+		deleted:  make(map[nftables.TableFamily]map[string]bool),
+		owned:    make(map[nftables.TableFamily]map[string]bool),
+		families: newFamilyLocks(),
 	}
 	ts.conn = conn
+	ts.features = &featureProbe{conn: conn}
+	ts.expiry = newExpiryScheduler()
+	ts.ids = defaultIDs
+	for _, opt := range opts {
+		opt(&ts)
+	}
 
 	return &ts
 }
+
+// dumpMessages sends the dump request and calls fn with the payload of every received message,
+// each message is processed before the next one is read, so the dump is never stored in memory
+// all together. If the kernel flags the dump as interrupted by changes of the ruleset, unix.EINTR
+// is returned once the dump is done, messages passed to fn may be inconsistent.
+func dumpMessages(c *nftables.Conn, msg netlink.Message, fn func([]byte) error) error {
+	if injected(c) {
+		return dumpInjected(c, msg, fn)
+	}
+	conn, err := netlink.Dial(unix.NETLINK_NETFILTER, &netlink.Config{NetNS: c.NetNS, DisableNSLockThread: c.NetNS == 0})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.Send(msg); err != nil {
+		return fmt.Errorf("failed to send dump request with error: %+v", err)
+	}
+	r, err := newReceiver(conn)
+	if err != nil {
+		return err
+	}
+	interrupted := false
+	for {
+		msgs, err := r.receive()
+		if err != nil {
+			return err
+		}
+		for _, m := range msgs {
+			interrupted = interrupted || m.Header.Flags&unix.NLM_F_DUMP_INTR != 0
+			switch m.Header.Type {
+			case unix.NLMSG_DONE:
+				if interrupted {
+					return unix.EINTR
+				}
+				return nil
+			case unix.NLMSG_ERROR:
+				if code := errorCode(m); code != nil {
+					return code
+				}
+				continue
+			}
+			if err := fn(m.Data); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// receiver reads netlink messages from the socket, the buffer grows to fit the pending datagram,
+// so large dump messages are never truncated.
+type receiver struct {
+	rc  syscall.RawConn
+	buf []byte
+}
+
+func newReceiver(conn *netlink.Conn) (*receiver, error) {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	return &receiver{rc: rc, buf: make([]byte, 32*1024)}, nil
+}
+
+func (r *receiver) receive() ([]syscall.NetlinkMessage, error) {
+	var n int
+	var rerr error
+	if err := r.rc.Read(func(fd uintptr) bool {
+		// Checking the size of the pending datagram first
+		n, _, rerr = unix.Recvfrom(int(fd), r.buf[:1], unix.MSG_PEEK|unix.MSG_TRUNC)
+		if rerr == unix.EAGAIN {
+			return false
+		}
+		if rerr != nil {
+			return true
+		}
+		if n > len(r.buf) {
+			r.buf = make([]byte, n)
+		}
+		n, _, rerr = unix.Recvfrom(int(fd), r.buf, 0)
+		return rerr != unix.EAGAIN
+	}); err != nil {
+		return nil, err
+	}
+	if rerr != nil {
+		return nil, rerr
+	}
+
+	return syscall.ParseNetlinkMessage(r.buf[:n])
+}
+
+// errorCode returns the error carried by NLMSG_ERROR message, nil is returned for acknowledgements
+func errorCode(m syscall.NetlinkMessage) error {
+	if len(m.Data) < 4 {
+		return fmt.Errorf("short netlink error message")
+	}
+	if code := int32(binaryutil.NativeEndian.Uint32(m.Data[:4])); code != 0 {
+		return syscall.Errno(-code)
+	}
+
+	return nil
+}
+
+// errorSequence returns the sequence number of the request NLMSG_ERROR message refers to,
+// the error carries the header of the request right after the error code.
+func errorSequence(m syscall.NetlinkMessage) (uint32, bool) {
+	if len(m.Data) < 4+unix.SizeofNlMsghdr {
+		return 0, false
+	}
+
+	return binaryutil.NativeEndian.Uint32(m.Data[4+8 : 4+12]), true
+}
+
+// sendBatch sends messages wrapped into a nftables batch and waits for their acknowledgements,
+// messages are applied by the kernel immediately as a single transaction. Connections with
+// a test dialer, including dry-run connections, receive the batch instead of the kernel.
+func sendBatch(c *nftables.Conn, messages ...netlink.Message) error {
+	if c.TestDial != nil {
+		conn := nltest.Dial(c.TestDial)
+		defer conn.Close()
+		if _, err := conn.SendMessages(batchMessages(messages, true)); err != nil {
+			return err
+		}
+		_, err := conn.Receive()
+		return err
+	}
+	conn, err := netlink.Dial(unix.NETLINK_NETFILTER, &netlink.Config{NetNS: c.NetNS, DisableNSLockThread: c.NetNS == 0})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	return exchangeBatch(conn, batchMessages(messages, true))
+}
+
+// batchMessages wraps messages into nftables batch delimiters, without the end of the batch
+// the kernel validates the messages but does not commit them.
+func batchMessages(messages []netlink.Message, commit bool) []netlink.Message {
+	// nfgenmsg header of batch delimiters carries nftables subsystem as the resource id
+	delimiter := func(t int) netlink.Message {
+		return netlink.Message{
+			Header: netlink.Header{Type: netlink.HeaderType(t), Flags: netlink.Request},
+			Data:   []byte{unix.AF_UNSPEC, unix.NFNETLINK_V0, 0, unix.NFNL_SUBSYS_NFTABLES},
+		}
+	}
+	batch := append([]netlink.Message{delimiter(unix.NFNL_MSG_BATCH_BEGIN)}, messages...)
+	if commit {
+		batch = append(batch, delimiter(unix.NFNL_MSG_BATCH_END))
+	}
+
+	return batch
+}
+
+// exchangeBatch sends the batch and waits for a reply to every message requesting an acknowledgement,
+// the first rejected message is reported as BatchError.
+func exchangeBatch(conn *netlink.Conn, batch []netlink.Message) error {
+	// Kernels which do not support extended acknowledgements reply with bare errors
+	conn.SetOption(netlink.ExtendedAcknowledge, true)
+	sent, err := conn.SendMessages(batch)
+	if err != nil {
+		return err
+	}
+	// Operations are indexed by their sequence number, batch delimiters are not operations
+	ops := make(map[uint32]int)
+	pending := 0
+	for i, m := range sent {
+		if m.Header.Flags&netlink.Acknowledge == 0 {
+			continue
+		}
+		ops[m.Header.Sequence] = i
+		pending++
+	}
+	r, err := newReceiver(conn)
+	if err != nil {
+		return err
+	}
+	var batchErr *BatchError
+	for pending > 0 {
+		msgs, err := r.receive()
+		if err != nil {
+			return err
+		}
+		for _, m := range msgs {
+			if m.Header.Type != unix.NLMSG_ERROR {
+				continue
+			}
+			code := errorCode(m)
+			seq, _ := errorSequence(m)
+			i, ok := ops[seq]
+			if !ok {
+				// Errors not related to operations, fail the batch as a whole
+				if code != nil {
+					return code
+				}
+				continue
+			}
+			pending--
+			if code != nil && batchErr == nil {
+				batchErr = batchError(sent[i], m, code)
+				batchErr.Index = i - 1
+			}
+		}
+	}
+	if batchErr != nil {
+		return batchErr
+	}
+
+	return nil
+}
+
+// BatchError describes the operation of a batch rejected by the kernel, Err carries
+// the error returned by the kernel for the operation.
+type BatchError struct {
+	// Index is the position of the operation in the batch
+	Index     int
+	Operation string
+	Table     string
+	Chain     string
+	Set       string
+	// RuleID is the id the library assigned to the rejected rule, it is 0 for other operations
+	RuleID uint32
+	Err    error
+	// Message is the message of the extended acknowledgement, kernels report it for some errors only
+	Message string
+	// Offset is the offset of the rejected attribute in the message of the operation, 0 if not reported
+	Offset uint32
+	// ExprName is the name the kernel knows the rejected expression of the rule by, ExprIndex is
+	// the position of the expression in the rule, both are set only if the rejected attribute is an expression.
+	ExprIndex int
+	ExprName  string
+}
+
+func (e *BatchError) Error() string {
+	target := "table " + e.Table
+	switch {
+	case e.RuleID != 0:
+		target += fmt.Sprintf(" chain %s rule id %d", e.Chain, e.RuleID)
+	case e.Chain != "":
+		target += " chain " + e.Chain
+	case e.Set != "":
+		target += " set " + e.Set
+	}
+
+	s := fmt.Sprintf("operation %d of the batch, %s in %s, failed with error: %+v", e.Index, e.Operation, target, e.Err)
+	if e.Message != "" {
+		s += ": " + e.Message
+	}
+	if e.ExprName != "" {
+		s += fmt.Sprintf(", rejected expression %d (%s)", e.ExprIndex, e.ExprName)
+	}
+
+	return s
+}
+
+// Unwrap returns the error returned by the kernel
+func (e *BatchError) Unwrap() error {
+	return e.Err
+}
+
+// describeMessage returns BatchError describing the operation carried by nftables message
+func describeMessage(m netlink.Message) *BatchError {
+	be := &BatchError{}
+	msgType := uint16(m.Header.Type) & 0xff
+	switch msgType {
+	case unix.NFT_MSG_NEWTABLE:
+		be.Operation = "add table"
+	case unix.NFT_MSG_DELTABLE:
+		be.Operation = "delete table"
+	case unix.NFT_MSG_NEWCHAIN:
+		be.Operation = "add chain"
+	case unix.NFT_MSG_DELCHAIN:
+		be.Operation = "delete chain"
+	case unix.NFT_MSG_NEWRULE:
+		switch {
+		case m.Header.Flags&netlink.Replace != 0:
+			be.Operation = "replace rule"
+		case m.Header.Flags&netlink.Append != 0:
+			be.Operation = "add rule"
+		default:
+			be.Operation = "insert rule"
+		}
+	case unix.NFT_MSG_DELRULE:
+		be.Operation = "delete rule"
+	case unix.NFT_MSG_NEWSET:
+		be.Operation = "add set"
+	case unix.NFT_MSG_DELSET:
+		be.Operation = "delete set"
+	case unix.NFT_MSG_NEWSETELEM:
+		be.Operation = "add set elements"
+	case unix.NFT_MSG_DELSETELEM:
+		be.Operation = "delete set elements"
+	case unix.NFT_MSG_NEWOBJ:
+		be.Operation = "add object"
+	case unix.NFT_MSG_DELOBJ:
+		be.Operation = "delete object"
+	default:
+		be.Operation = fmt.Sprintf("operation %d", msgType)
+	}
+	if len(m.Data) < 4 {
+		return be
+	}
+	ad, err := netlink.NewAttributeDecoder(m.Data[4:])
+	if err != nil {
+		return be
+	}
+	// Table is the first attribute of all nftables messages, other attributes depend on the message
+	for ad.Next() {
+		switch {
+		case ad.Type() == unix.NFTA_TABLE_NAME:
+			be.Table = ad.String()
+		case msgType == unix.NFT_MSG_NEWCHAIN || msgType == unix.NFT_MSG_DELCHAIN:
+			if ad.Type() == unix.NFTA_CHAIN_NAME {
+				be.Chain = ad.String()
+			}
+		case msgType == unix.NFT_MSG_NEWRULE || msgType == unix.NFT_MSG_DELRULE:
+			switch ad.Type() {
+			case unix.NFTA_RULE_CHAIN:
+				be.Chain = ad.String()
+			case unix.NFTA_RULE_USERDATA:
+				be.RuleID, _ = RuleIDFromUserData(ad.Bytes())
+			}
+		case msgType == unix.NFT_MSG_NEWSET || msgType == unix.NFT_MSG_DELSET ||
+			msgType == unix.NFT_MSG_NEWSETELEM || msgType == unix.NFT_MSG_DELSETELEM:
+			if ad.Type() == unix.NFTA_SET_NAME {
+				be.Set = ad.String()
+			}
+		}
+	}
+
+	return be
+}
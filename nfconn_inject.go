@@ -0,0 +1,85 @@
+package nftableslib
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/google/nftables"
+	"github.com/mdlayher/netlink"
+	"github.com/mdlayher/netlink/nltest"
+	"golang.org/x/sys/unix"
+)
+
+// relayExchange identifies test dialers of connections built by InitConn and InitDryRunConn
+var relayExchange = reflect.ValueOf((&relay{}).exchange).Pointer()
+
+// InitNFTablesWithConn initializes the library over the connection configured by the application, every
+// request including dumps the library otherwise reads from its own sockets is sent over the connection,
+// so requests reach the connection's network namespace or its test dialer. The connection stays owned
+// by the application, the library never closes it and sockets of the test dialer must be closed by
+// the application once the library is not used any longer.
+func InitNFTablesWithConn(conn *nftables.Conn, opts ...TablesOption) (TablesInterface, error) {
+	if conn == nil {
+		return nil, fmt.Errorf("connection cannot be nil")
+	}
+
+	return InitNFTables(conn, opts...), nil
+}
+
+// ConnNamespaceDialer returns NamespaceDialer using connections built by the application for
+// namespaces, NamespaceManager does not close such connections when namespaces are released.
+func ConnNamespaceDialer(dial func(nsPath string) (*nftables.Conn, error)) NamespaceDialer {
+	return func(nsPath string) (NetNS, func() error, error) {
+		conn, err := dial(nsPath)
+		if err != nil {
+			return nil, nil, err
+		}
+		if conn == nil {
+			return nil, nil, fmt.Errorf("connection to namespace %s cannot be nil", nsPath)
+		}
+		return conn, nil, nil
+	}
+}
+
+// injected returns true if the connection carries the test dialer of the application, requests
+// of such connection cannot be sent over sockets opened by the library.
+func injected(c *nftables.Conn) bool {
+	return c.TestDial != nil && reflect.ValueOf(c.TestDial).Pointer() != relayExchange
+}
+
+// dialNetfilter opens netlink connection of the nftables family reaching the same destination
+// as the connection.
+func dialNetfilter(c *nftables.Conn) (*netlink.Conn, error) {
+	if injected(c) {
+		return nltest.Dial(c.TestDial), nil
+	}
+
+	return netlink.Dial(unix.NETLINK_NETFILTER, &netlink.Config{NetNS: c.NetNS, DisableNSLockThread: c.NetNS == 0})
+}
+
+// dumpInjected sends the dump request over the test dialer of the connection, replies are received
+// all together as the test dialer returns them.
+func dumpInjected(c *nftables.Conn, msg netlink.Message, fn func([]byte) error) error {
+	conn := nltest.Dial(c.TestDial)
+	defer conn.Close()
+
+	msgs, err := conn.Execute(msg)
+	if err != nil {
+		return err
+	}
+	interrupted := false
+	for _, m := range msgs {
+		interrupted = interrupted || m.Header.Flags&netlink.DumpInterrupted != 0
+		if m.Header.Type == netlink.Done || m.Header.Type == netlink.Error {
+			continue
+		}
+		if err := fn(m.Data); err != nil {
+			return err
+		}
+	}
+	if interrupted {
+		return unix.EINTR
+	}
+
+	return nil
+}
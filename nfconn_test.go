@@ -0,0 +1,113 @@
+package nftableslib
+
+import (
+	"testing"
+
+	"github.com/google/nftables"
+	"github.com/mdlayher/netlink"
+	"github.com/mdlayher/netlink/nltest"
+	"golang.org/x/sys/unix"
+)
+
+func TestDescribeMessage(t *testing.T) {
+	var batch []netlink.Message
+	conn := &nftables.Conn{TestDial: func(req []netlink.Message) ([]netlink.Message, error) {
+		batch = append(batch, req...)
+		return nil, nil
+	}}
+	table := conn.AddTable(&nftables.Table{Name: "filter", Family: nftables.TableFamilyIPv4})
+	chain := conn.AddChain(&nftables.Chain{Name: "input", Table: table})
+	conn.AddRule(&nftables.Rule{Table: table, Chain: chain, UserData: []byte{0x1, 0x2, 0x2, 0x0, 0x7}})
+	conn.InsertRule(&nftables.Rule{Table: table, Chain: chain})
+	set := &nftables.Set{Name: "ports", Table: table, KeyType: nftables.TypeInetService}
+	if err := conn.AddSet(set, nil); err != nil {
+		t.Fatalf("failed to add set with error: %+v", err)
+	}
+	conn.DelChain(chain)
+	if err := conn.Flush(); err != nil {
+		t.Fatalf("failed to flush with error: %+v", err)
+	}
+	tests := []BatchError{
+		{Operation: "add table", Table: "filter"},
+		{Operation: "add chain", Table: "filter", Chain: "input"},
+		{Operation: "add rule", Table: "filter", Chain: "input", RuleID: 7},
+		{Operation: "insert rule", Table: "filter", Chain: "input"},
+		{Operation: "add set", Table: "filter", Set: "ports"},
+		{Operation: "delete chain", Table: "filter", Chain: "input"},
+	}
+	ops := make([]netlink.Message, 0, len(tests))
+	for _, m := range batch {
+		if m.Header.Type == netlink.HeaderType(unix.NFNL_MSG_BATCH_BEGIN) || m.Header.Type == netlink.HeaderType(unix.NFNL_MSG_BATCH_END) {
+			continue
+		}
+		ops = append(ops, m)
+	}
+	if len(ops) != len(tests) {
+		t.Fatalf("expected %d operations in the batch, got %d", len(tests), len(ops))
+	}
+	for i, tt := range tests {
+		if got := describeMessage(ops[i]); *got != tt {
+			t.Errorf("operation %d: expected %+v, got %+v", i, tt, *got)
+		}
+	}
+}
+
+func TestInjectedConnDetection(t *testing.T) {
+	dial := func(req []netlink.Message) ([]netlink.Message, error) { return nil, nil }
+	tests := []struct {
+		name     string
+		conn     *nftables.Conn
+		injected bool
+	}{
+		{name: "connection of InitConn", conn: InitConn()},
+		{name: "connection of InitDryRunConn", conn: InitDryRunConn()},
+		{name: "connection without test dialer", conn: &nftables.Conn{}},
+		{name: "connection with test dialer of application", conn: &nftables.Conn{TestDial: dial}, injected: true},
+	}
+	for _, tt := range tests {
+		if injected(tt.conn) != tt.injected {
+			t.Fatalf("Test \"%s\" failed, expected injected %t", tt.name, tt.injected)
+		}
+	}
+}
+
+func TestRelayReusesSocket(t *testing.T) {
+	fail := false
+	kernel := func(req []netlink.Message) ([]netlink.Message, error) {
+		if fail {
+			return nil, unix.ENOBUFS
+		}
+		h := netlink.Header{Type: netlink.Done, Flags: netlink.Multi, Sequence: req[0].Header.Sequence, PID: req[0].Header.PID}
+		return []netlink.Message{{Header: h, Data: make([]byte, 4)}}, nil
+	}
+	dials := 0
+	r := newRelay(true)
+	r.dial = func() (*netlink.Conn, error) {
+		dials++
+		return nltest.Dial(kernel), nil
+	}
+	defer r.close()
+	conn := &nftables.Conn{TestDial: r.exchange}
+	table := &nftables.Table{Name: "filter", Family: nftables.TableFamilyIPv4}
+	chain := &nftables.Chain{Name: "input", Table: table}
+	for i := 0; i < 3; i++ {
+		if _, err := conn.GetRule(table, chain); err != nil {
+			t.Fatalf("failed to get rules with error: %+v", err)
+		}
+	}
+	if dials != 1 {
+		t.Fatalf("expected exchanges to reuse a single socket, got %d dials", dials)
+	}
+	// Failed exchange drops the socket, the next exchange dials again
+	fail = true
+	if _, err := conn.GetRule(table, chain); err == nil {
+		t.Fatalf("expected get rules to fail")
+	}
+	fail = false
+	if _, err := conn.GetRule(table, chain); err != nil {
+		t.Fatalf("failed to get rules with error: %+v", err)
+	}
+	if dials != 2 {
+		t.Fatalf("expected socket to be dialed again after the failure, got %d dials", dials)
+	}
+}
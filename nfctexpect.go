@@ -0,0 +1,237 @@
+package nftableslib
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// Define bits of Connection tracking Status key, like CTState values they are the bytes of the kernel's
+// status bits in the order they are stored in registers
+var (
+	CTStatusExpected  uint32 = 0x01000000
+	CTStatusSeenReply uint32 = 0x02000000
+	CTStatusAssured   uint32 = 0x04000000
+	CTStatusConfirmed uint32 = 0x08000000
+	CTStatusSNAT      uint32 = 0x10000000
+	CTStatusDNAT      uint32 = 0x20000000
+)
+
+// ObjectCtExpectation defines named conntrack expectation object, kernels 5.3 and newer support it
+const ObjectCtExpectation ObjectKind = 9
+
+// Attributes of conntrack expectation object, golang.org/x/sys in use does not define them
+const (
+	nftaCtExpectL3Proto = 1
+	nftaCtExpectL4Proto = 2
+	nftaCtExpectDPort   = 3
+	nftaCtExpectTimeout = 4
+	nftaCtExpectSize    = 5
+)
+
+// CtExpectationState defines conntrack expectation object, a rule referring to the object creates
+// an expectation of a connection related to the packet's connection to Port of Protocol between the same
+// addresses in the reverse direction, like the data connection of active FTP. Family is the layer 3 protocol
+// of the expectation, it must be set in inet tables and match the family of ip and ip6 tables. Timeout
+// is the time the expectation lives, it is passed to the kernel in milliseconds as nft passes it, Size
+// is the maximum number of expectations of a connection.
+type CtExpectationState struct {
+	Family   nftables.TableFamily
+	Protocol uint8
+	Port     uint16
+	Timeout  time.Duration
+	Size     uint8
+}
+
+// validate checks the expectation can be created in the table of the family
+func (e *CtExpectationState) validate(family nftables.TableFamily) error {
+	switch family {
+	case nftables.TableFamilyIPv4, nftables.TableFamilyIPv6:
+		if e.Family != 0 && e.Family != family {
+			return fmt.Errorf("ct expectation of family %s cannot be created in table of family %s", familyName(e.Family), familyName(family))
+		}
+	case nftables.TableFamilyINet:
+		if e.Family != nftables.TableFamilyIPv4 && e.Family != nftables.TableFamilyIPv6 {
+			return fmt.Errorf("ct expectation in table of family inet requires family ip or ip6")
+		}
+	default:
+		return fmt.Errorf("ct expectation is not supported in table of family %s", familyName(family))
+	}
+	switch e.Protocol {
+	case unix.IPPROTO_TCP, unix.IPPROTO_UDP, unix.IPPROTO_UDPLITE, unix.IPPROTO_DCCP, unix.IPPROTO_SCTP:
+	default:
+		return fmt.Errorf("unsupported protocol %d of ct expectation", e.Protocol)
+	}
+	if e.Port == 0 {
+		return fmt.Errorf("port of ct expectation cannot be 0")
+	}
+	if e.Timeout < time.Millisecond || e.Timeout/time.Millisecond > 0xffffffff {
+		return fmt.Errorf("timeout %s of ct expectation is out of range", e.Timeout)
+	}
+	if e.Size == 0 {
+		return fmt.Errorf("size of ct expectation cannot be 0")
+	}
+
+	return nil
+}
+
+// ctExpectationAttrs returns attributes of NFTA_OBJ_DATA of the expectation, the timeout is carried
+// in host byte order
+func ctExpectationAttrs(family nftables.TableFamily, e *CtExpectationState) []netlink.Attribute {
+	l3proto := e.Family
+	if l3proto == 0 {
+		l3proto = family
+	}
+
+	return []netlink.Attribute{
+		{Type: nftaCtExpectL3Proto, Data: binaryutil.BigEndian.PutUint16(uint16(l3proto))},
+		{Type: nftaCtExpectL4Proto, Data: []byte{e.Protocol}},
+		{Type: nftaCtExpectDPort, Data: binaryutil.BigEndian.PutUint16(e.Port)},
+		{Type: nftaCtExpectTimeout, Data: binaryutil.NativeEndian.PutUint32(uint32(e.Timeout / time.Millisecond))},
+		{Type: nftaCtExpectSize, Data: []byte{e.Size}},
+	}
+}
+
+// decodeCtExpectation decodes NFTA_OBJ_DATA of the expectation object
+func decodeCtExpectation(ad *netlink.AttributeDecoder) *CtExpectationState {
+	e := &CtExpectationState{}
+	for ad.Next() {
+		switch ad.Type() {
+		case nftaCtExpectL3Proto:
+			e.Family = nftables.TableFamily(ad.Uint16())
+		case nftaCtExpectL4Proto:
+			e.Protocol = ad.Uint8()
+		case nftaCtExpectDPort:
+			e.Port = ad.Uint16()
+		case nftaCtExpectTimeout:
+			if b := ad.Bytes(); len(b) == 4 {
+				e.Timeout = time.Duration(binaryutil.NativeEndian.Uint32(b)) * time.Millisecond
+			}
+		case nftaCtExpectSize:
+			e.Size = ad.Uint8()
+		}
+	}
+
+	return e
+}
+
+// CreateCtExpectation creates the named conntrack expectation object, rules attach it by the action
+// built by SetCtExpectation. The kernel refuses to create the object if it already exists.
+func (nfo *nfObjects) CreateCtExpectation(name string, e *CtExpectationState) error {
+	if err := writable(nfo.conn); err != nil {
+		return err
+	}
+	if name == "" {
+		return fmt.Errorf("name of ct expectation cannot be empty")
+	}
+	if e == nil {
+		return fmt.Errorf("ct expectation cannot be nil")
+	}
+	if err := e.validate(nfo.table.Family); err != nil {
+		return err
+	}
+	exp := *e
+	var err error
+	switch c := nfo.conn.(type) {
+	case ObjectsConn:
+		c.AddObject(nfo.table, &Object{Kind: ObjectCtExpectation, Name: name, CtExpectation: &exp})
+		err = flush(nfo.conn)
+	case *nftables.Conn:
+		// github.com/google/nftables cannot carry the object, operations queued before are programmed first
+		if err = flush(nfo.conn); err != nil {
+			break
+		}
+		var msg netlink.Message
+		if msg, err = ctExpectationMessage(nfo.table, name, &exp); err != nil {
+			break
+		}
+		err = sendBatch(c, msg)
+	default:
+		return fmt.Errorf("connection does not support named objects")
+	}
+	if err != nil {
+		return fmt.Errorf("failed to create ct expectation %s in table %s with error: %+v", name, nfo.table.Name, err)
+	}
+
+	return nil
+}
+
+// ctExpectationMessage builds NFT_MSG_NEWOBJ message creating the expectation object
+func ctExpectationMessage(t *nftables.Table, name string, e *CtExpectationState) (netlink.Message, error) {
+	data, err := netlink.MarshalAttributes(ctExpectationAttrs(t.Family, e))
+	if err != nil {
+		return netlink.Message{}, err
+	}
+
+	return objectMessage(unix.NFT_MSG_NEWOBJ, netlink.Request|netlink.Acknowledge|netlink.Create|netlink.Excl, t, []netlink.Attribute{
+		{Type: unix.NFTA_OBJ_NAME, Data: []byte(name + "\x00")},
+		{Type: unix.NFTA_OBJ_TYPE, Data: binaryutil.BigEndian.PutUint32(uint32(ObjectCtExpectation))},
+		{Type: unix.NLA_F_NESTED | unix.NFTA_OBJ_DATA, Data: data},
+	})
+}
+
+// SetCtExpectation builds non-terminal RuleAction attaching the named conntrack expectation object
+// to the packet's connection, like nft "ct expectation set <name>". The expectation is created only
+// for connections which are not confirmed yet, so the rule is expected to match the first packet
+// of the connection.
+func SetCtExpectation(name string) (*RuleAction, error) {
+	if name == "" {
+		return nil, fmt.Errorf("ct expectation requires a name")
+	}
+
+	return &RuleAction{ctExpectation: name}, nil
+}
+
+// getExprForCtExpectation returns the reference to the expectation object
+func getExprForCtExpectation(name string) []expr.Any {
+	// [ objref type 9 name ftp-data ]
+	return []expr.Any{&expr.Objref{Type: int(ObjectCtExpectation), Name: name}}
+}
+
+// conntrackUse returns what of the rule requires conntrack, empty string if nothing does
+func conntrackUse(rule *Rule) string {
+	for _, ct := range rule.Conntracks {
+		if ct != nil && ct.Key == unix.NFT_CT_STATUS {
+			return "ct status match"
+		}
+		if ct != nil && isCtCounter(ct.Key) {
+			return "ct " + ctCounterName(ct.Key) + " match"
+		}
+	}
+	for _, a := range rule.actions() {
+		if a != nil && a.ctExpectation != "" {
+			return "ct expectation " + a.ctExpectation
+		}
+	}
+
+	return ""
+}
+
+// checkConntrack fails rules requiring conntrack in chains packets reach without conntrack, tables of
+// netdev and arp families do not see conntrack and base chains of prerouting and output hooks with
+// priority not greater than conntrack's priority run before conntrack is looked up. Regular chains can
+// be reached from any base chain, they are not checked.
+func (nfr *nfRules) checkConntrack(rule *Rule) error {
+	what := conntrackUse(rule)
+	if what == "" {
+		return nil
+	}
+	switch nfr.table.Family {
+	case nftables.TableFamilyNetdev, nftables.TableFamilyARP:
+		return fmt.Errorf("%s requires conntrack which is not available in table family %s", what, familyName(nfr.table.Family))
+	}
+	if nfr.chain == nil || nfr.chain.Type == "" {
+		return nil
+	}
+	if (nfr.chain.Hooknum == nftables.ChainHookPrerouting || nfr.chain.Hooknum == nftables.ChainHookOutput) &&
+		nfr.chain.Priority <= nftables.ChainPriorityConntrack {
+		return fmt.Errorf("%s requires conntrack, but base chain %s of priority %d runs before conntrack", what, nfr.chain.Name, nfr.chain.Priority)
+	}
+
+	return nil
+}
@@ -0,0 +1,209 @@
+package nftableslib
+
+import (
+	"fmt"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"golang.org/x/sys/unix"
+)
+
+// ctSanityComment returns the comment tagging conntrack sanity rules of the nat chain
+func ctSanityComment(natChain string) string {
+	return "ct sanity of nat chain " + natChain
+}
+
+// ctSanityRules returns conntrack sanity rules in the order they are inserted at the head of a filter chain,
+// the chain ends up with:
+//
+//	ct state established,related accept
+//	ct state invalid drop
+//
+// Packets exempted from tracking by notrack have ct state untracked and match neither rule.
+func ctSanityRules(natChain string) ([]*Rule, error) {
+	accept, err := SetVerdict(NFT_ACCEPT)
+	if err != nil {
+		return nil, err
+	}
+	drop, err := SetVerdict(NFT_DROP)
+	if err != nil {
+		return nil, err
+	}
+	comment := MakeRuleComment(ctSanityComment(natChain))
+	state := func(bits uint32) []*Conntrack {
+		return []*Conntrack{{Key: unix.NFT_CT_STATE, Value: binaryutil.BigEndian.PutUint32(bits)}}
+	}
+
+	return []*Rule{
+		{Conntracks: state(CTStateInvalid), Action: drop, UserData: comment},
+		{Conntracks: state(CTStateEstablished | CTStateRelated), Action: accept, UserData: comment},
+	}, nil
+}
+
+// validateCtSanity checks that the chain is of nat type and conntrack sanity chains are base chains
+// of filter type of the table, the lock of the store must be held.
+func (nfc *nfChains) validateCtSanity(name string, attributes *ChainAttributes) error {
+	if attributes.Type != nftables.ChainTypeNAT {
+		return fmt.Errorf("conntrack sanity rules are installed only along with chain of nat type, chain %s is of type %s", name, attributes.Type)
+	}
+	if len(attributes.CtSanityChains) == 0 {
+		return fmt.Errorf("chains receiving conntrack sanity rules of nat chain %s are not specified", name)
+	}
+	for _, c := range attributes.CtSanityChains {
+		ch, ok := nfc.chains[c]
+		if !ok {
+			return fmt.Errorf("chain %s receiving conntrack sanity rules does not exist in table %s", c, tableName(nfc.table))
+		}
+		if !ch.baseChain || ch.chain.Type != nftables.ChainTypeFilter {
+			return fmt.Errorf("chain %s receiving conntrack sanity rules is not a base chain of filter type", c)
+		}
+		if _, ok := ch.RulesInterface.(*nfRules); !ok {
+			return fmt.Errorf("rules interface of chain %s does not support conntrack sanity rules", c)
+		}
+	}
+
+	return nil
+}
+
+// buildCtSanity builds conntrack sanity rules of the nat chain for every chain of the list, the lock
+// of the store must be held.
+func (nfc *nfChains) buildCtSanity(name string, chains []string) (map[*nfRules][][]*Rule, map[*nfRules][][]*nfRule, error) {
+	rules := make(map[*nfRules][][]*Rule)
+	built := make(map[*nfRules][][]*nfRule)
+	for _, c := range chains {
+		nfr := nfc.chains[c].RulesInterface.(*nfRules)
+		sanity, err := ctSanityRules(name)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, rule := range sanity {
+			r, b, err := nfr.build(rule, operationInsert)
+			if err != nil {
+				return nil, nil, fmt.Errorf("failed to build conntrack sanity rule of chain %s with error: %+v", c, err)
+			}
+			rules[nfr] = append(rules[nfr], r)
+			built[nfr] = append(built[nfr], b)
+		}
+	}
+
+	return rules, built, nil
+}
+
+// queueCtSanity queues built conntrack sanity rules of the nat chain replacing rules left by the previous
+// chain of the same name, the lock of the store must be held.
+func (nfc *nfChains) queueCtSanity(name string, rules map[*nfRules][][]*Rule, built map[*nfRules][][]*nfRule) error {
+	stale := nfc.ctSanityRefs(name)
+	if err := nfc.delCtSanity(stale); err != nil {
+		return err
+	}
+	forgetRefs(stale)
+	for nfr := range rules {
+		nfr.Lock()
+		for i := range rules[nfr] {
+			nfr.queue(rules[nfr][i], built[nfr][i], operationInsert, nil)
+		}
+		nfr.Unlock()
+	}
+
+	return nil
+}
+
+// ctSanityRefs returns conntrack sanity rules of the nat chain known to stores of the table's chains,
+// the lock of the store must be held.
+func (nfc *nfChains) ctSanityRefs(name string) []chainRef {
+	comment := ctSanityComment(name)
+	refs := make([]chainRef, 0)
+	for c, ch := range nfc.chains {
+		nfr, ok := ch.RulesInterface.(*nfRules)
+		if !ok || c == name {
+			continue
+		}
+		nfr.Lock()
+		for _, r := range nfr.dumpRules() {
+			if cm, ok := userDataComment(r.rule.UserData); ok && cm == comment {
+				refs = append(refs, chainRef{chain: c, rules: nfr, rule: r})
+			}
+		}
+		nfr.Unlock()
+	}
+
+	return refs
+}
+
+// natCtSanityRefs returns conntrack sanity rules of the chain if it is of nat type, the lock of the store must be held
+func (nfc *nfChains) natCtSanityRefs(ch *nfChain) []chainRef {
+	if ch.chain == nil || ch.chain.Type != nftables.ChainTypeNAT {
+		return nil
+	}
+
+	return nfc.ctSanityRefs(ch.chain.Name)
+}
+
+// delCtSanity queues deletion of programmed conntrack sanity rules, rules queued by Create get
+// their handles from the host first. Additions of rules which are still queued cannot be withdrawn
+// from the batch, so they fail the deletion until they are flushed.
+func (nfc *nfChains) delCtSanity(refs []chainRef) error {
+	rules, err := snapshotRefs(refs)
+	if err != nil {
+		return err
+	}
+	for i, r := range refs {
+		if rules[i].Handle == 0 {
+			return fmt.Errorf("conntrack sanity rule id %d of chain %s is not programmed yet, flush it first", r.rule.id, r.chain)
+		}
+	}
+	for _, rule := range rules {
+		if err := nfc.conn.DelRule(rule); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// snapshotRefs resolves handles of queued referencing rules and returns copies of the rules
+// taken under the locks of their stores, in the order of refs.
+func snapshotRefs(refs []chainRef) ([]*nftables.Rule, error) {
+	resolved := make(map[*nfRules]bool)
+	for _, r := range refs {
+		if resolved[r.rules] || r.rules.snapshotRule(r.rule).Handle != 0 {
+			continue
+		}
+		if err := r.rules.resolvePending(); err != nil {
+			return nil, err
+		}
+		resolved[r.rules] = true
+	}
+	rules := make([]*nftables.Rule, 0, len(refs))
+	for _, r := range refs {
+		rules = append(rules, r.rules.snapshotRule(r.rule))
+	}
+
+	return rules, nil
+}
+
+// updateCtSanityHandles sets handles allocated by the kernel to programmed conntrack sanity rules of the nat chain
+func (nfc *nfChains) updateCtSanityHandles(name string) error {
+	for _, r := range nfc.ctSanityRefs(name) {
+		if r.rule.rule.Handle != 0 {
+			continue
+		}
+		r.rules.Lock()
+		_, err := r.rules.updateHandle(r.rule.id)
+		r.rules.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// forgetRefs removes referred rules from stores of their chains
+func forgetRefs(refs []chainRef) {
+	for _, r := range refs {
+		r.rules.Lock()
+		r.rules.removeRule(r.rule.id)
+		r.rules.Unlock()
+	}
+}
@@ -0,0 +1,188 @@
+package nftableslib
+
+import (
+	"fmt"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+// EnsureDispatch makes sure the table carries the base chain with a rule jumping to the regular chain
+// owned by the application, so the application can flush and refill its chain without touching
+// the hook. The table, both chains and the jump are created only if they are missing, objects
+// programmed by other agents are adopted as they are, including a base chain with other rules.
+// Calling EnsureDispatch again does not change the ruleset. The interface of the application's
+// chain is returned.
+func EnsureDispatch(nft TablesInterface, table string, family nftables.TableFamily, base string, attrs *ChainAttributes, appChain string) (RulesInterface, error) {
+	if attrs == nil {
+		return nil, fmt.Errorf("attributes of base chain %s are not specified", base)
+	}
+	if base == appChain {
+		return nil, fmt.Errorf("base chain and application chain cannot be the same chain %s", base)
+	}
+	ci, err := ensureTableChains(nft, table, family)
+	if err != nil {
+		return nil, err
+	}
+	if err := ensureChain(ci, base, attrs); err != nil {
+		return nil, err
+	}
+	if err := ensureChain(ci, appChain, nil); err != nil {
+		return nil, err
+	}
+	bi, err := ci.Chains().Chain(base)
+	if err != nil {
+		return nil, err
+	}
+	jumps, _, err := hostReferences(bi, appChain)
+	if err != nil {
+		return nil, err
+	}
+	if len(jumps) == 0 {
+		jump, _ := SetVerdict(unix.NFT_JUMP, appChain)
+		if _, err := bi.Rules().CreateImm(&Rule{Action: jump}); err != nil {
+			return nil, fmt.Errorf("failed to create jump from chain %s to chain %s with error: %+v", base, appChain, err)
+		}
+	}
+
+	return ci.Chains().Chain(appChain)
+}
+
+// RemoveDispatch removes rules of the base chain jumping to the application's chain and the application's
+// chain. If deleteBase is true, the base chain is removed as well unless it carries other rules, like jumps
+// to chains of other agents. Objects which do not exist are skipped.
+func RemoveDispatch(nft TablesInterface, table string, family nftables.TableFamily, base string, appChain string, deleteBase bool) error {
+	ci, err := nft.Tables().Table(table, family)
+	if err != nil {
+		if _, err := nft.Tables().SyncTable(table, family); err != nil {
+			return err
+		}
+		if ci, err = nft.Tables().Table(table, family); err != nil {
+			return nil
+		}
+	}
+	others := 0
+	if ci.Chains().Exist(base) {
+		bi, err := ci.Chains().Chain(base)
+		if err != nil {
+			return err
+		}
+		jumps, total, err := hostReferences(bi, appChain)
+		if err != nil {
+			return err
+		}
+		if err := removeRules(bi, jumps); err != nil {
+			return fmt.Errorf("failed to remove jump from chain %s to chain %s with error: %+v", base, appChain, err)
+		}
+		others = total - len(jumps)
+	}
+	if ci.Chains().Exist(appChain) {
+		if err := ci.Chains().DeleteSafe(appChain); err != nil {
+			return err
+		}
+	}
+	if deleteBase && others == 0 && ci.Chains().Exist(base) {
+		return ci.Chains().DeleteSafe(base)
+	}
+
+	return nil
+}
+
+// ensureTableChains returns the interface of the table's chains, the table is loaded from the host
+// or created if it is not in the store.
+func ensureTableChains(nft TablesInterface, table string, family nftables.TableFamily) (ChainsInterface, error) {
+	ci, err := nft.Tables().Table(table, family)
+	if err == nil {
+		return ci, nil
+	}
+	// The table is not in the store, it might have been programmed by a previous instance
+	if _, err := nft.Tables().SyncTable(table, family); err != nil {
+		return nil, err
+	}
+	if ci, err = nft.Tables().Table(table, family); err == nil {
+		return ci, nil
+	}
+	if err := nft.Tables().CreateImm(table, family); err != nil {
+		return nil, err
+	}
+
+	return nft.Tables().Table(table, family)
+}
+
+// ensureChain creates the chain if it does not exist, an existing chain must be of the same kind,
+// either a base or a regular chain, other attributes of an existing base chain are not checked.
+func ensureChain(ci ChainsInterface, name string, attrs *ChainAttributes) error {
+	if !ci.Chains().Exist(name) {
+		return ci.Chains().CreateImm(name, attrs)
+	}
+	nfc, ok := ci.(*nfChains)
+	if !ok {
+		return nil
+	}
+	nfc.Lock()
+	defer nfc.Unlock()
+	ch, ok := nfc.chains[name]
+	if !ok {
+		return nil
+	}
+	if ch.baseChain && attrs == nil {
+		return fmt.Errorf("chain %s of table %s is a base chain", name, nfc.table.Name)
+	}
+	if !ch.baseChain && attrs != nil {
+		return fmt.Errorf("chain %s of table %s is not a base chain", name, nfc.table.Name)
+	}
+
+	return nil
+}
+
+// hostReferences returns rules of the chain programmed on the host which jump or go to the target
+// chain and the number of all rules of the chain. Rules are read from the host, so rules added by
+// other agents after the chain was loaded into the store are accounted.
+func hostReferences(ri RulesInterface, target string) ([]*nftables.Rule, int, error) {
+	nfr, ok := ri.(*nfRules)
+	if !ok {
+		return nil, 0, fmt.Errorf("rules interface does not support reading rules from the host")
+	}
+	var rules []*nftables.Rule
+	if err := nfr.opts.readPolicy().do(func() (err error) {
+		rules, err = nfr.conn.GetRule(nfr.table, nfr.chain)
+		return err
+	}); err != nil {
+		return nil, 0, err
+	}
+	refs := make([]*nftables.Rule, 0)
+	for _, r := range rules {
+		for _, e := range r.Exprs {
+			if v, ok := e.(*expr.Verdict); ok && isVerdictReferencing(v, target) {
+				refs = append(refs, r)
+				break
+			}
+		}
+	}
+
+	return refs, len(rules), nil
+}
+
+// removeRules removes rules programmed on the host in a single transaction, the rules are removed
+// from the store as well if the store carries them.
+func removeRules(ri RulesInterface, rules []*nftables.Rule) error {
+	if len(rules) == 0 {
+		return nil
+	}
+	nfr := ri.(*nfRules)
+	handles := make(map[uint64]bool, len(rules))
+	for _, r := range rules {
+		r.Table, r.Chain = nfr.table, nfr.chain
+		if err := nfr.conn.DelRule(r); err != nil {
+			return err
+		}
+		handles[r.Handle] = true
+	}
+	if err := flush(nfr.conn); err != nil {
+		return err
+	}
+	nfr.forgetRules(handles)
+
+	return nil
+}
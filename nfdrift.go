@@ -0,0 +1,411 @@
+package nftableslib
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/google/nftables"
+)
+
+// DriftObjectKind defines the kind of the object drifted from the kernel
+type DriftObjectKind string
+
+const (
+	// DriftTable is a table
+	DriftTable DriftObjectKind = "table"
+	// DriftChain is a chain of the table
+	DriftChain DriftObjectKind = "chain"
+	// DriftSet is a named set of the table
+	DriftSet DriftObjectKind = "set"
+	// DriftRule is a rule of the chain identified by its handle
+	DriftRule DriftObjectKind = "rule"
+)
+
+// DriftObject identifies the object of the store or the kernel which does not match the other side
+type DriftObject struct {
+	Kind   DriftObjectKind
+	Family nftables.TableFamily
+	Table  string
+	// Chain is the chain of the rule
+	Chain string
+	// Name is the name of the chain or the set
+	Name string
+	// Handle is the handle of the rule
+	Handle uint64
+	// Attributes lists mismatched attributes in the form "attribute: store/kernel"
+	Attributes []string
+}
+
+func (o *DriftObject) String() string {
+	t := familyName(o.Family) + " " + o.Table
+	switch o.Kind {
+	case DriftTable:
+		return "table " + t
+	case DriftRule:
+		return fmt.Sprintf("rule %d of chain %s of table %s", o.Handle, o.Chain, t)
+	}
+
+	return fmt.Sprintf("%s %s of table %s", o.Kind, o.Name, t)
+}
+
+// DriftReport lists objects of stores which do not match the kernel, it is returned by Verify
+type DriftReport struct {
+	// MissingInKernel lists objects the store carries, but the kernel does not report
+	MissingInKernel []*DriftObject
+	// MissingInStore lists objects the kernel reports, but the store does not carry
+	MissingInStore []*DriftObject
+	// Mismatches lists objects which attributes in the store differ from attributes in the kernel
+	Mismatches []*DriftObject
+}
+
+// Empty returns true if the stores match the kernel
+func (r *DriftReport) Empty() bool {
+	return len(r.MissingInKernel) == 0 && len(r.MissingInStore) == 0 && len(r.Mismatches) == 0
+}
+
+func (r *DriftReport) String() string {
+	if r.Empty() {
+		return "no drift"
+	}
+	lines := make([]string, 0)
+	for _, d := range []struct {
+		what    string
+		objects []*DriftObject
+	}{
+		{"missing in kernel", r.MissingInKernel},
+		{"missing in store", r.MissingInStore},
+		{"mismatched", r.Mismatches},
+	} {
+		for _, o := range d.objects {
+			line := d.what + ": " + o.String()
+			if len(o.Attributes) != 0 {
+				line += " (" + strings.Join(o.Attributes, ", ") + ")"
+			}
+			lines = append(lines, line)
+		}
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// Verify cross-checks tables, chains and named sets of stores and handles of programmed rules against
+// the kernel without changing the stores or the kernel. Objects waiting to be programmed or deleted
+// are skipped, tables of families the stores do not carry belong to other software and are not reported.
+func (nft *nfTables) Verify() (*DriftReport, error) {
+	report := &DriftReport{
+		MissingInKernel: make([]*DriftObject, 0),
+		MissingInStore:  make([]*DriftObject, 0),
+		Mismatches:      make([]*DriftObject, 0),
+	}
+	var host []*nftables.Table
+	if err := nft.reads.do(func() (err error) {
+		host, _, err = listTables(nft.conn, listFilter{})
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	onHost := make(map[nftables.TableFamily]map[string]bool)
+	for _, t := range host {
+		if onHost[t.Family] == nil {
+			onHost[t.Family] = make(map[string]bool)
+		}
+		onHost[t.Family][t.Name] = true
+	}
+	nft.Lock()
+	stored := make([]*nfTable, 0)
+	for family, tables := range nft.tables {
+		for name, nt := range tables {
+			if nt.pending || nft.deleted[family][name] {
+				continue
+			}
+			if !onHost[family][name] {
+				report.MissingInKernel = append(report.MissingInKernel, &DriftObject{Kind: DriftTable, Family: family, Table: name})
+				continue
+			}
+			stored = append(stored, nt)
+		}
+	}
+	for _, t := range host {
+		tables, ok := nft.tables[t.Family]
+		if !ok {
+			continue
+		}
+		if _, ok := tables[t.Name]; !ok && !nft.deleted[t.Family][t.Name] {
+			report.MissingInStore = append(report.MissingInStore, &DriftObject{Kind: DriftTable, Family: t.Family, Table: t.Name})
+		}
+	}
+	nft.Unlock()
+	for _, nt := range stored {
+		if err := nt.verify(report); err != nil {
+			return nil, fmt.Errorf("failed to verify table %s with error: %+v", tableName(nt.table), err)
+		}
+	}
+	report.sort()
+
+	return report, nil
+}
+
+// sort orders objects of the report by family, table, kind and name
+func (r *DriftReport) sort() {
+	for _, objects := range [][]*DriftObject{r.MissingInKernel, r.MissingInStore, r.Mismatches} {
+		sort.SliceStable(objects, func(i, j int) bool {
+			a, b := objects[i], objects[j]
+			switch {
+			case a.Family != b.Family:
+				return a.Family < b.Family
+			case a.Table != b.Table:
+				return a.Table < b.Table
+			case a.Kind != b.Kind:
+				return a.Kind < b.Kind
+			case a.Chain != b.Chain:
+				return a.Chain < b.Chain
+			case a.Name != b.Name:
+				return a.Name < b.Name
+			}
+			return a.Handle < b.Handle
+		})
+	}
+}
+
+// verify adds drifted chains, sets and rules of the table to the report
+func (nt *nfTable) verify(report *DriftReport) error {
+	nfc, ok := nt.ChainsInterface.(*nfChains)
+	if !ok {
+		return nil
+	}
+	object := func(kind DriftObjectKind, name string) *DriftObject {
+		return &DriftObject{Kind: kind, Family: nt.table.Family, Table: nt.table.Name, Name: name}
+	}
+	var chains []*nftables.Chain
+	if err := nt.opts.readPolicy().do(func() (err error) {
+		chains, _, err = listChains(nfc.conn, listFilter{family: nt.table.Family, table: nt.table.Name})
+		return err
+	}); err != nil {
+		return err
+	}
+	hostChains := make(map[string]*nftables.Chain)
+	for _, c := range chains {
+		if c.Table.Name == nt.table.Name && c.Table.Family == nt.table.Family && !IsInlineChain(c.Name) {
+			hostChains[c.Name] = c
+		}
+	}
+	nfc.Lock()
+	storeChains := make(map[string]*nfChain)
+	for name, ch := range nfc.chains {
+		if !ch.pending {
+			storeChains[name] = ch
+		}
+	}
+	for name := range hostChains {
+		if _, ok := nfc.chains[name]; !ok && !nfc.deleted[name] {
+			report.MissingInStore = append(report.MissingInStore, object(DriftChain, name))
+		}
+	}
+	nfc.Unlock()
+	// Sets of rules are not kept in the store of sets, they belong to their rules
+	ruleSets := make(map[string]bool)
+	for name, ch := range storeChains {
+		host, ok := hostChains[name]
+		if !ok {
+			report.MissingInKernel = append(report.MissingInKernel, object(DriftChain, name))
+			continue
+		}
+		if m := compareChains(ch.chain, host); len(m) != 0 {
+			o := object(DriftChain, name)
+			o.Attributes = m
+			report.Mismatches = append(report.Mismatches, o)
+		}
+		nfr, ok := ch.RulesInterface.(*nfRules)
+		if !ok {
+			continue
+		}
+		if err := nfr.verify(report, ruleSets); err != nil {
+			return err
+		}
+	}
+
+	nfs, ok := nt.SetsInterface.(*nfSets)
+	if !ok {
+		return nil
+	}
+	var sets []*nftables.Set
+	if err := nt.opts.readPolicy().do(func() (err error) {
+		sets, err = getSets(nfs.conn, nt.table)
+		return err
+	}); err != nil {
+		return err
+	}
+	hostSets := make(map[string]*nftables.Set)
+	for _, s := range sets {
+		if s.Anonymous {
+			continue
+		}
+		s.Table = nt.table
+		decodeSet(s)
+		hostSets[s.Name] = s
+	}
+	nfs.Lock()
+	defer nfs.Unlock()
+	for name, s := range nfs.sets {
+		host, ok := hostSets[name]
+		if !ok {
+			report.MissingInKernel = append(report.MissingInKernel, object(DriftSet, name))
+			continue
+		}
+		if m := compareSets(s, host); len(m) != 0 {
+			o := object(DriftSet, name)
+			o.Attributes = m
+			report.Mismatches = append(report.Mismatches, o)
+		}
+	}
+	for name := range hostSets {
+		if _, ok := nfs.sets[name]; !ok && !ruleSets[name] {
+			report.MissingInStore = append(report.MissingInStore, object(DriftSet, name))
+		}
+	}
+
+	return nil
+}
+
+// verify adds rules which handles are tracked by the store but not reported by the kernel and rules
+// of the kernel unknown to the store to the report, names of sets of the rules are added to sets.
+func (nfr *nfRules) verify(report *DriftReport, sets map[string]bool) error {
+	var rules []*nftables.Rule
+	if err := nfr.opts.readPolicy().do(func() (err error) {
+		rules, err = nfr.conn.GetRule(nfr.table, nfr.chain)
+		return err
+	}); err != nil {
+		return err
+	}
+	onHost := make(map[uint64]bool, len(rules))
+	for _, r := range rules {
+		onHost[r.Handle] = true
+	}
+	object := func(handle uint64) *DriftObject {
+		return &DriftObject{Kind: DriftRule, Family: nfr.table.Family, Table: nfr.table.Name, Chain: nfr.chain.Name, Handle: handle}
+	}
+	nfr.Lock()
+	defer nfr.Unlock()
+	// Rules created by Create and flushed since are tracked by their rule IDs
+	nfr.resolveHandles(rules)
+	stored := make(map[uint64]bool)
+	for _, head := range nfr.dumpRules() {
+		for _, r := range append([]*nfRule{head}, head.siblings...) {
+			for _, s := range r.sets {
+				sets[s.set.Name] = true
+			}
+			// Rules waiting to be programmed do not have handles yet
+			if r.rule.Handle == 0 {
+				continue
+			}
+			stored[r.rule.Handle] = true
+			if !onHost[r.rule.Handle] {
+				report.MissingInKernel = append(report.MissingInKernel, object(r.rule.Handle))
+			}
+		}
+	}
+	for _, r := range rules {
+		if !stored[r.Handle] {
+			report.MissingInStore = append(report.MissingInStore, object(r.Handle))
+		}
+	}
+
+	return nil
+}
+
+// compareChains returns a list of attributes which do not match between the chain in the store
+// and the chain reported by the kernel.
+func compareChains(stored, host *nftables.Chain) []string {
+	m := make([]string, 0)
+	if stored.Type != host.Type {
+		m = append(m, fmt.Sprintf("type: %q/%q", stored.Type, host.Type))
+	}
+	// Hook and priority of regular chains are not defined
+	if stored.Type == "" || host.Type == "" {
+		return m
+	}
+	if stored.Hooknum != host.Hooknum {
+		m = append(m, fmt.Sprintf("hook: %d/%d", stored.Hooknum, host.Hooknum))
+	}
+	if stored.Priority != host.Priority {
+		m = append(m, fmt.Sprintf("priority: %d/%d", stored.Priority, host.Priority))
+	}
+	if stored.Policy != nil && host.Policy != nil && *stored.Policy != *host.Policy {
+		m = append(m, fmt.Sprintf("policy: %d/%d", *stored.Policy, *host.Policy))
+	}
+
+	return m
+}
+
+// RepairDrift brings stores of tables named by the report in line with the kernel, the kernel is
+// the source of truth. Tables are synchronized by SyncTable, objects missing in the kernel are removed
+// from the stores and objects missing in the stores are loaded from the kernel. Mismatched chains and sets
+// and chains with drifted rules are dropped from the stores first, so they are loaded back from the kernel
+// along with their rules. Objects missing in the kernel are not re-created, the stores do not carry elements
+// of sets, applications re-create them with the regular calls after the repair.
+func (nft *nfTables) RepairDrift(report *DriftReport) error {
+	if report == nil || report.Empty() {
+		return nil
+	}
+	type key struct {
+		family nftables.TableFamily
+		name   string
+	}
+	tables := make(map[key]bool)
+	reload := make([]*DriftObject, 0)
+	for _, objects := range [][]*DriftObject{report.MissingInKernel, report.MissingInStore, report.Mismatches} {
+		for _, o := range objects {
+			tables[key{o.Family, o.Table}] = true
+		}
+	}
+	reload = append(reload, report.Mismatches...)
+	for _, o := range append(report.MissingInKernel, report.MissingInStore...) {
+		if o.Kind == DriftRule {
+			reload = append(reload, o)
+		}
+	}
+	for _, o := range reload {
+		nft.Lock()
+		nt, ok := nft.tables[o.Family][o.Table]
+		nft.Unlock()
+		if !ok {
+			continue
+		}
+		switch o.Kind {
+		case DriftChain, DriftRule:
+			name := o.Name
+			if o.Kind == DriftRule {
+				name = o.Chain
+			}
+			if nfc, ok := nt.ChainsInterface.(*nfChains); ok {
+				nfc.Lock()
+				delete(nfc.chains, name)
+				nfc.Unlock()
+			}
+		case DriftSet:
+			if nfs, ok := nt.SetsInterface.(*nfSets); ok {
+				nfs.Lock()
+				nfs.forget(o.Name)
+				nfs.Unlock()
+			}
+		}
+	}
+	keys := make([]key, 0, len(tables))
+	for k := range tables {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].family != keys[j].family {
+			return keys[i].family < keys[j].family
+		}
+		return keys[i].name < keys[j].name
+	})
+	for _, k := range keys {
+		if _, err := nft.SyncTable(k.name, k.family); err != nil {
+			return fmt.Errorf("failed to repair table %s %s with error: %+v", familyName(k.family), k.name, err)
+		}
+	}
+
+	return nil
+}
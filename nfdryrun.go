@@ -0,0 +1,16 @@
+package nftableslib
+
+import (
+	"github.com/google/nftables"
+)
+
+// InitDryRunConn initializes netlink connection of the nftables family in dry-run mode, similarly
+// to "nft -c" the kernel validates expressions, set types and references of every flushed batch,
+// but never commits it. Failed batches return BatchError describing the rejected operation.
+// Queries are answered by the kernel, so they do not reflect operations validated in dry-run mode,
+// operations depending on each other, a chain of a new table for example, must be flushed in one batch.
+func InitDryRunConn(netns ...int) *nftables.Conn {
+	r := newRelay(false, netns...)
+
+	return &nftables.Conn{NetNS: r.netns, TestDial: r.exchange}
+}
@@ -0,0 +1,299 @@
+package nftableslib
+
+import (
+	"fmt"
+
+	"github.com/google/nftables"
+	"golang.org/x/sys/unix"
+)
+
+// DualStack programs family agnostic rules, like "allow dst port 443 from these prefixes", declared once
+// with addresses of both families. The rule is either split between a chain of ipv4 table and a chain
+// of ipv6 table, or programmed into a chain of inet table. Addresses of a family go to the family's rule,
+// family neutral matches, actions and RawExprs go to both rules.
+type DualStack struct {
+	ipv4 *nfRules
+	ipv6 *nfRules
+	inet *nfRules
+}
+
+// DualStackHandles carries handles of rules programmed by DualStack, a handle is 0 if the rule
+// does not match packets of the family. In inet tables rules which do not need to be split are
+// programmed as a single rule, both handles then refer to it.
+type DualStackHandles struct {
+	IPv4 uint64
+	IPv6 uint64
+}
+
+// dualStackRules returns the store of rules of the chain, the chain's table must be of the family
+func dualStackRules(ci ChainsInterface, chain string, family nftables.TableFamily) (*nfRules, error) {
+	if ci == nil {
+		return nil, fmt.Errorf("chains of %s table are not specified", familyName(family))
+	}
+	ri, err := ci.Chains().Chain(chain)
+	if err != nil {
+		return nil, err
+	}
+	nfr, ok := ri.(*nfRules)
+	if !ok {
+		return nil, fmt.Errorf("rules of chain %s are not managed by the library", chain)
+	}
+	if nfr.table.Family != family {
+		return nil, fmt.Errorf("chain %s belongs to table %s of family %s, expected family %s", chain, nfr.table.Name,
+			familyName(nfr.table.Family), familyName(family))
+	}
+
+	return nfr, nil
+}
+
+// NewDualStack returns DualStack splitting rules between the chain of ipv4 table and the chain of ipv6 table
+// with the same name, both tables must be managed by the same instance of the library.
+func NewDualStack(ipv4, ipv6 ChainsInterface, chain string) (*DualStack, error) {
+	v4, err := dualStackRules(ipv4, chain, nftables.TableFamilyIPv4)
+	if err != nil {
+		return nil, err
+	}
+	v6, err := dualStackRules(ipv6, chain, nftables.TableFamilyIPv6)
+	if err != nil {
+		return nil, err
+	}
+	if v4.conn != v6.conn {
+		return nil, fmt.Errorf("ipv4 and ipv6 tables must share the connection to program rules in a single transaction")
+	}
+
+	return &DualStack{ipv4: v4, ipv6: v6}, nil
+}
+
+// NewINetDualStack returns DualStack programming rules into the chain of inet table
+func NewINetDualStack(inet ChainsInterface, chain string) (*DualStack, error) {
+	nfr, err := dualStackRules(inet, chain, nftables.TableFamilyINet)
+	if err != nil {
+		return nil, err
+	}
+
+	return &DualStack{inet: nfr}, nil
+}
+
+// Create splits the rule by families and appends the resulting rules to the chains in a single transaction,
+// either all rules are programmed or none. Matches and actions bound to a family are handled as follows:
+// ICMP and ICMPv6 protocol matches bind the rule to ipv4 and ipv6 respectively, addresses of another family
+// are dropped from such rule. Rules selecting the family by Meta NFProto or matching ip version, ip options,
+// arp, Concat, Dynamic, MatchAct, addresses of named sets, and rules with nat to an address, dnat maps or
+// icmp rejects, which codes differ between families, are rejected. icmpx rejects are accepted only by inet tables.
+func (d *DualStack) Create(rule *Rule) (*DualStackHandles, error) {
+	if rule == nil {
+		return nil, fmt.Errorf("dual stack rule cannot be nil")
+	}
+	if err := rule.validateDualStack(d.inet != nil); err != nil {
+		return nil, err
+	}
+	v4, v6, err := splitDualStack(rule)
+	if err != nil {
+		return nil, err
+	}
+	if d.inet == nil {
+		handles, err := programDualStack([]*nfRules{d.ipv4, d.ipv6}, []*Rule{v4, v6})
+		if err != nil {
+			return nil, err
+		}
+		return &DualStackHandles{IPv4: handles[0], IPv6: handles[1]}, nil
+	}
+	// Family neutral rules match packets of both families in inet table without splitting
+	if v4 != nil && v6 != nil && (rule.L3 == nil || (rule.L3.Src == nil && rule.L3.Dst == nil)) {
+		handles, err := programDualStack([]*nfRules{d.inet}, []*Rule{rule})
+		if err != nil {
+			return nil, err
+		}
+		return &DualStackHandles{IPv4: handles[0], IPv6: handles[0]}, nil
+	}
+	// Rules of families are guarded by "meta nfproto"
+	rules := []*Rule{v4, v6}
+	for i, f := range []nftables.TableFamily{nftables.TableFamilyIPv4, nftables.TableFamilyIPv6} {
+		if rules[i] == nil {
+			continue
+		}
+		f := f
+		meta := MetaRule{}
+		if rules[i].Meta != nil {
+			meta = *rules[i].Meta
+		}
+		meta.NFProto = &f
+		rules[i].Meta = &meta
+	}
+	handles, err := programDualStack([]*nfRules{d.inet, d.inet}, rules)
+	if err != nil {
+		return nil, err
+	}
+
+	return &DualStackHandles{IPv4: handles[0], IPv6: handles[1]}, nil
+}
+
+// programDualStack appends each rule to its store in a single transaction and returns handles of programmed rules,
+// nil rules are skipped. All rules are built before any of them is queued, rules failing to program
+// are removed from the stores.
+func programDualStack(stores []*nfRules, rules []*Rule) ([]uint64, error) {
+	locked := make(map[*nfRules]bool)
+	for i, nfr := range stores {
+		if rules[i] == nil {
+			continue
+		}
+		if err := writable(nfr.conn); err != nil {
+			return nil, err
+		}
+		if _, err := nfr.checkTargets(rules[i], false); err != nil {
+			return nil, err
+		}
+		if !locked[nfr] {
+			nfr.Lock()
+			defer nfr.Unlock()
+			locked[nfr] = true
+		}
+	}
+	split := make([][]*Rule, len(stores))
+	built := make([][]*nfRule, len(stores))
+	for i, nfr := range stores {
+		if rules[i] == nil {
+			continue
+		}
+		var err error
+		if split[i], built[i], err = nfr.build(rules[i], operationAdd); err != nil {
+			return nil, err
+		}
+	}
+	ids := make([]uint32, len(stores))
+	var conn NetNS
+	for i, nfr := range stores {
+		if rules[i] == nil {
+			continue
+		}
+		ids[i] = nfr.queue(split[i], built[i], operationAdd, nil)
+		conn = nfr.conn
+	}
+	if err := flush(conn); err != nil {
+		for i, id := range ids {
+			if id != 0 {
+				stores[i].removeRule(id)
+			}
+		}
+		return nil, err
+	}
+	handles := make([]uint64, len(stores))
+	for i, id := range ids {
+		if id == 0 {
+			continue
+		}
+		var err error
+		if handles[i], err = stores[i].updateHandle(id); err != nil {
+			return nil, err
+		}
+	}
+
+	return handles, nil
+}
+
+// validateDualStack rejects matches and actions of the rule which cannot be split by families
+func (r *Rule) validateDualStack(inet bool) error {
+	switch {
+	case r.Position != 0:
+		return fmt.Errorf("dual stack rule cannot be positioned, positions refer to rules of a single chain")
+	case r.Meta != nil && r.Meta.NFProto != nil:
+		return fmt.Errorf("dual stack rule cannot select the family by meta nfproto")
+	case r.ARP != nil:
+		return fmt.Errorf("dual stack rule cannot match arp")
+	case r.Concat != nil || r.Dynamic != nil || r.MatchAct != nil:
+		return fmt.Errorf("concatenations, dynamic sets and match actions of dual stack rule cannot be split by families")
+	}
+	if r.L3 != nil {
+		switch {
+		case r.L3.Version != nil:
+			return fmt.Errorf("dual stack rule cannot match ip version")
+		case r.L3.Options != nil:
+			return fmt.Errorf("ip options match is supported only in ipv4 family, dual stack rule cannot carry it")
+		}
+	}
+	if err := r.validateActions(); err != nil {
+		return err
+	}
+	for _, a := range r.actions() {
+		if a.markMap != nil && (a.markMap.match == MatchTypeL3Src || a.markMap.match == MatchTypeL3Dst) {
+			return fmt.Errorf("mark map %s keyed by address cannot be split by families", a.markMap.set)
+		}
+	}
+	if a := r.action(); a != nil {
+		switch {
+		case a.nat != nil && a.nat.address != nil:
+			return fmt.Errorf("nat to an address cannot be split by families")
+		case a.dnatMap != nil:
+			return fmt.Errorf("dnat map cannot be split by families")
+		case a.reject != nil && a.reject.rejectType == unix.NFT_REJECT_ICMP_UNREACH:
+			return fmt.Errorf("icmp and icmpv6 codes of reject differ, use icmpx reject")
+		case a.reject != nil && a.reject.rejectType == unix.NFT_REJECT_ICMPX_UNREACH && !inet:
+			return fmt.Errorf("icmpx reject is supported only by dual stack rules of inet tables")
+		}
+	}
+
+	return nil
+}
+
+// l4Family returns the family the rule is bound to by ICMP or ICMPv6 protocol match, 0 is returned
+// for family neutral rules.
+func (r *Rule) l4Family() nftables.TableFamily {
+	protos := make([]uint8, 0, 2)
+	if r.L4 != nil {
+		protos = append(protos, r.L4.L4Proto)
+	}
+	if r.Meta != nil && r.Meta.L4Proto != nil {
+		protos = append(protos, *r.Meta.L4Proto)
+	}
+	for _, p := range protos {
+		switch p {
+		case unix.IPPROTO_ICMP:
+			return nftables.TableFamilyIPv4
+		case unix.IPPROTO_ICMPV6:
+			return nftables.TableFamilyIPv6
+		}
+	}
+
+	return 0
+}
+
+// splitDualStack returns copies of the rule matching ipv4 and ipv6 packets, nil is returned for
+// a family which packets never match the rule.
+func splitDualStack(rule *Rule) (*Rule, *Rule, error) {
+	bound := rule.l4Family()
+	rules := make([]*Rule, 0, 2)
+	for _, f := range []nftables.TableFamily{nftables.TableFamilyIPv4, nftables.TableFamilyIPv6} {
+		if bound != 0 && bound != f {
+			rules = append(rules, nil)
+			continue
+		}
+		r := *rule
+		if rule.L3 != nil {
+			src, ok, err := familyAddrSpec(rule.L3.Src, f)
+			if err != nil {
+				return nil, nil, err
+			}
+			dst, dok, err := familyAddrSpec(rule.L3.Dst, f)
+			if err != nil {
+				return nil, nil, err
+			}
+			if !ok || !dok {
+				rules = append(rules, nil)
+				continue
+			}
+			l3 := *rule.L3
+			l3.Src, l3.Dst = src, dst
+			r.L3 = &l3
+			if src == nil && dst == nil && l3.Protocol == nil && l3.Counter == nil {
+				// Negated matches were dropped, all packets of the family match
+				r.L3 = nil
+			}
+		}
+		rules = append(rules, &r)
+	}
+	if rules[0] == nil && rules[1] == nil {
+		return nil, nil, fmt.Errorf("dual stack rule does not match packets of any family")
+	}
+
+	return rules[0], rules[1], nil
+}
@@ -0,0 +1,312 @@
+package nftableslib
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+)
+
+// Sections of dumps produced by DumpTable and DumpChain, dumps list sections they carry
+const (
+	DumpSectionChains   = "chains"
+	DumpSectionRules    = "rules"
+	DumpSectionSets     = "sets"
+	DumpSectionElements = "elements"
+	DumpSectionCounters = "counters"
+	DumpSectionHandles  = "handles"
+)
+
+// DumpOptions selects sections of dumps produced by DumpTable and DumpChain, nil options dump
+// every section.
+type DumpOptions struct {
+	// NoChains leaves chains and their rules out, the table's dump carries only sets
+	NoChains bool
+	// NoRules leaves rules of chains out
+	NoRules bool
+	// NoSets leaves named sets of the table out, the table's dump carries only chains
+	NoSets bool
+	// NoElements leaves elements of sets out, including elements of anonymous sets of rules
+	NoElements bool
+	// NoCounters clears values of counters of rules, so dumps taken at different times can be compared
+	NoCounters bool
+	// NoHandles leaves handles of rules out
+	NoHandles bool
+}
+
+// sections returns sections of the table's dump selected by the options
+func (o *DumpOptions) sections() []string {
+	if o == nil {
+		o = &DumpOptions{}
+	}
+	sections := make([]string, 0)
+	if !o.NoChains {
+		sections = append(sections, DumpSectionChains)
+		if !o.NoRules {
+			sections = append(sections, DumpSectionRules)
+		}
+	}
+	if !o.NoSets {
+		sections = append(sections, DumpSectionSets)
+	}
+	rules := !o.NoChains && !o.NoRules
+	if !o.NoElements && (rules || !o.NoSets) {
+		sections = append(sections, DumpSectionElements)
+	}
+	if rules && !o.NoCounters {
+		sections = append(sections, DumpSectionCounters)
+	}
+	if rules && !o.NoHandles {
+		sections = append(sections, DumpSectionHandles)
+	}
+
+	return sections
+}
+
+// TableDump is the JSON representation of a table produced by DumpTable, Sections lists sections
+// the dump carries, sections left out by options are neither present nor empty.
+type TableDump struct {
+	Name     string               `json:"name"`
+	Family   nftables.TableFamily `json:"family"`
+	Sections []string             `json:"sections"`
+	Chains   []*ChainDump         `json:"chains,omitempty"`
+	Sets     []*SetDump           `json:"sets,omitempty"`
+}
+
+// ChainDump is the JSON representation of a chain and its rules, Sections is set only for dumps
+// of a single chain produced by DumpChain. Type, Hooknum, Priority and Policy are set only for base chains.
+type ChainDump struct {
+	Name     string                 `json:"name"`
+	Sections []string               `json:"sections,omitempty"`
+	Base     bool                   `json:"base,omitempty"`
+	Type     nftables.ChainType     `json:"type,omitempty"`
+	Hooknum  nftables.ChainHook     `json:"hooknum,omitempty"`
+	Priority nftables.ChainPriority `json:"priority,omitempty"`
+	Policy   *nftables.ChainPolicy  `json:"policy,omitempty"`
+	Rules    []*RuleDump            `json:"rules,omitempty"`
+}
+
+// RuleDump is the JSON representation of a rule, Exprs carries expressions of the rule followed
+// by anonymous sets the rule looks up along with their elements.
+type RuleDump struct {
+	Handle   uint64          `json:"handle,omitempty"`
+	Exprs    json.RawMessage `json:"exprs"`
+	UserData []byte          `json:"userData,omitempty"`
+}
+
+// RuleSummary is the JSON representation of a rule in dumps of chains produced by Dump, Summary
+// describes the rule in nft syntax, Exprs carries expressions of rules which cannot be decoded instead.
+type RuleSummary struct {
+	Handle  uint64          `json:"handle"`
+	Comment string          `json:"comment,omitempty"`
+	Summary string          `json:"summary,omitempty"`
+	Exprs   json.RawMessage `json:"exprs,omitempty"`
+	// Counters carries current values of counters of the rule, it is set only by DumpWithCounters
+	Counters []*RuleCounter `json:"counters,omitempty"`
+}
+
+// DumpTable returns JSON representation of the table programmed on the host, TableDump, with
+// sections selected by options. Chains and sets are sorted by name, rules keep their order in the chain.
+// Chains of inline jumps are not dumped, unlike Dump the host is read rather than the store.
+func (nft *nfTables) DumpTable(name string, familyType nftables.TableFamily, opts *DumpOptions) ([]byte, error) {
+	if opts == nil {
+		opts = &DumpOptions{}
+	}
+	var tables []*nftables.Table
+	if err := nft.reads.do(func() (err error) {
+		tables, _, err = listTables(nft.conn, listFilter{family: familyType})
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	var table *nftables.Table
+	for _, t := range tables {
+		if t.Name == name && t.Family == familyType {
+			table = t
+		}
+	}
+	if table == nil {
+		return nil, fmt.Errorf("table %s %s does not exist", familyName(familyType), name)
+	}
+	d := &TableDump{Name: table.Name, Family: table.Family, Sections: opts.sections()}
+	if !opts.NoChains {
+		var chains []*nftables.Chain
+		if err := nft.reads.do(func() (err error) {
+			chains, _, err = listChains(nft.conn, listFilter{family: familyType, table: name})
+			return err
+		}); err != nil {
+			return nil, err
+		}
+		sort.Slice(chains, func(i, j int) bool {
+			return chains[i].Name < chains[j].Name
+		})
+		for _, c := range chains {
+			if IsInlineChain(c.Name) {
+				continue
+			}
+			cd, err := dumpChain(nft.conn, nft.reads, table, c, opts)
+			if err != nil {
+				return nil, err
+			}
+			d.Chains = append(d.Chains, cd)
+		}
+	}
+	if !opts.NoSets {
+		var sets []*nftables.Set
+		if err := nft.reads.do(func() (err error) {
+			sets, err = getSets(nft.conn, table)
+			return err
+		}); err != nil {
+			return nil, err
+		}
+		sort.Slice(sets, func(i, j int) bool {
+			return sets[i].Name < sets[j].Name
+		})
+		for _, s := range sets {
+			if s.Anonymous {
+				continue
+			}
+			s.Table = table
+			decodeSet(s)
+			var sd *SetDump
+			if err := nft.reads.do(func() (err error) {
+				sd, err = dumpSet(nft.conn, s, !opts.NoElements)
+				return err
+			}); err != nil {
+				return nil, fmt.Errorf("failed to dump set %s with error: %+v", s.Name, err)
+			}
+			d.Sets = append(d.Sets, sd)
+		}
+	}
+
+	return json.Marshal(d)
+}
+
+// DumpChain returns JSON representation of the chain programmed on the host along with its rules,
+// ChainDump, with sections selected by options. Options selecting sets and chains do not apply.
+func (nfc *nfChains) DumpChain(name string, opts *DumpOptions) ([]byte, error) {
+	if opts == nil {
+		opts = &DumpOptions{}
+	}
+	chains, err := nfc.list(name)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range chains {
+		if c.Name != name {
+			continue
+		}
+		cd, err := dumpChain(nfc.conn, nfc.opts.readPolicy(), nfc.table, c, opts)
+		if err != nil {
+			return nil, err
+		}
+		chainOpts := *opts
+		chainOpts.NoChains, chainOpts.NoSets = false, true
+		cd.Sections = chainOpts.sections()
+
+		return json.Marshal(cd)
+	}
+
+	return nil, fmt.Errorf("chain %s does not exist", name)
+}
+
+// dumpChain returns the dump of the chain with its rules read from the host
+func dumpChain(conn NetNS, reads *readPolicy, t *nftables.Table, c *nftables.Chain, opts *DumpOptions) (*ChainDump, error) {
+	cd := &ChainDump{Name: c.Name}
+	if c.Type != "" {
+		cd.Base = true
+		cd.Type, cd.Hooknum, cd.Priority, cd.Policy = c.Type, c.Hooknum, c.Priority, c.Policy
+	}
+	if opts.NoRules {
+		return cd, nil
+	}
+	var rules []*nftables.Rule
+	if err := reads.do(func() (err error) {
+		rules, err = conn.GetRule(t, c)
+		return err
+	}); err != nil {
+		return nil, fmt.Errorf("failed to get rules of chain %s with error: %+v", c.Name, err)
+	}
+	var anonymous map[string]*nftables.Set
+	for _, r := range rules {
+		rr := &nfRule{rule: r}
+		if opts.NoCounters {
+			rr.rule = clearCounters(r)
+		}
+		for _, e := range r.Exprs {
+			l, ok := e.(*expr.Lookup)
+			if !ok {
+				continue
+			}
+			if anonymous == nil {
+				// Anonymous sets are read once, only for chains with rules looking sets up
+				var err error
+				if anonymous, err = anonymousSets(conn, reads, t); err != nil {
+					return nil, err
+				}
+			}
+			set, ok := anonymous[l.SetName]
+			if !ok {
+				continue
+			}
+			ns := &nfSet{set: set}
+			if !opts.NoElements {
+				if err := reads.do(func() (err error) {
+					ns.elements, err = getSetElements(conn, set)
+					return err
+				}); err != nil {
+					return nil, fmt.Errorf("failed to get elements of set %s with error: %+v", set.Name, err)
+				}
+			}
+			rr.sets = append(rr.sets, ns)
+		}
+		exprs, err := json.Marshal(rr)
+		if err != nil {
+			return nil, err
+		}
+		rd := &RuleDump{Exprs: exprs, UserData: r.UserData}
+		if !opts.NoHandles {
+			rd.Handle = r.Handle
+		}
+		cd.Rules = append(cd.Rules, rd)
+	}
+
+	return cd, nil
+}
+
+// anonymousSets returns anonymous sets of the table programmed on the host by their names
+func anonymousSets(conn NetNS, reads *readPolicy, t *nftables.Table) (map[string]*nftables.Set, error) {
+	var sets []*nftables.Set
+	if err := reads.do(func() (err error) {
+		sets, err = getSets(conn, t)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	anonymous := make(map[string]*nftables.Set)
+	for _, s := range sets {
+		if s.Anonymous {
+			s.Table = t
+			decodeSet(s)
+			anonymous[s.Name] = s
+		}
+	}
+
+	return anonymous, nil
+}
+
+// clearCounters returns a copy of the rule with values of its counters cleared
+func clearCounters(r *nftables.Rule) *nftables.Rule {
+	rule := *r
+	rule.Exprs = make([]expr.Any, len(r.Exprs))
+	for i, e := range r.Exprs {
+		if _, ok := e.(*expr.Counter); ok {
+			e = &expr.Counter{}
+		}
+		rule.Exprs[i] = e
+	}
+
+	return &rule
+}
@@ -0,0 +1,475 @@
+package nftableslib
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// ruleExpiryType is the type of the user data TLV carrying the expiry of the rule in unix nanoseconds,
+	// the TLV precedes the rule ID TLV, so a restarted application resumes expiries by Sync.
+	ruleExpiryType = 0x3
+	ruleExpiryLen  = 8
+	// ruleExpirySize is the size of the expiry TLV
+	ruleExpirySize = ruleExpiryLen + 2
+)
+
+// Clock provides the time to the scheduler deleting rules created by CreateWithTTL
+type Clock interface {
+	Now() time.Time
+	After(time.Duration) <-chan time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// WithClock sets the clock of the scheduler deleting rules created by CreateWithTTL, the system
+// clock is used by default.
+func WithClock(clock Clock) TablesOption {
+	return func(nft *nfTables) {
+		nft.expiry.clock = clock
+	}
+}
+
+// ErrRuleExpiry is passed to the warning handler of the table when a rule whose TTL elapsed
+// cannot be deleted, the rule is not retried.
+type ErrRuleExpiry struct {
+	Table  string
+	Chain  string
+	Handle uint64
+	Err    error
+}
+
+func (e *ErrRuleExpiry) Error() string {
+	return fmt.Sprintf("failed to delete expired rule with handle %d of chain %s of table %s with error: %+v",
+		e.Handle, e.Chain, e.Table, e.Err)
+}
+
+// expiryKey identifies a rule by its location, stores rebuilt from the host schedule the same rules
+type expiryKey struct {
+	family nftables.TableFamily
+	table  string
+	chain  string
+	handle uint64
+}
+
+type expiringRule struct {
+	nfr     *nfRules
+	handle  uint64
+	expires time.Time
+}
+
+// expiryScheduler deletes rules when their TTL elapses, a goroutine runs while rules are scheduled
+type expiryScheduler struct {
+	clock Clock
+	sync.Mutex
+	rules   map[expiryKey]*expiringRule
+	running bool
+	// wake interrupts the wait of the goroutine when the earliest expiry changes
+	wake chan struct{}
+}
+
+func newExpiryScheduler() *expiryScheduler {
+	return &expiryScheduler{
+		clock: systemClock{},
+		rules: make(map[expiryKey]*expiringRule),
+		wake:  make(chan struct{}, 1),
+	}
+}
+
+func ruleExpiryKey(nfr *nfRules, handle uint64) expiryKey {
+	return expiryKey{family: nfr.table.Family, table: nfr.table.Name, chain: nfr.chain.Name, handle: handle}
+}
+
+// schedule schedules deletion of the rule with the handle, the expiry of a scheduled rule is replaced
+func (s *expiryScheduler) schedule(nfr *nfRules, handle uint64, expires time.Time) {
+	s.Lock()
+	defer s.Unlock()
+	s.rules[ruleExpiryKey(nfr, handle)] = &expiringRule{nfr: nfr, handle: handle, expires: expires}
+	if !s.running {
+		s.running = true
+		go s.run()
+		return
+	}
+	s.kick()
+}
+
+// kick wakes the goroutine up to wait for the earliest expiry again
+func (s *expiryScheduler) kick() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// cancel drops the scheduled deletion of the rule with the handle
+func (s *expiryScheduler) cancel(nfr *nfRules, handle uint64) {
+	if s == nil {
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	key := ruleExpiryKey(nfr, handle)
+	if _, ok := s.rules[key]; ok {
+		delete(s.rules, key)
+		s.kick()
+	}
+}
+
+// get returns the expiry of the rule with the handle, false if the rule is not scheduled
+func (s *expiryScheduler) get(nfr *nfRules, handle uint64) (time.Time, bool) {
+	if s == nil {
+		return time.Time{}, false
+	}
+	s.Lock()
+	defer s.Unlock()
+	r, ok := s.rules[ruleExpiryKey(nfr, handle)]
+	if !ok {
+		return time.Time{}, false
+	}
+
+	return r.expires, true
+}
+
+// run deletes rules as they expire, it returns when no rules are scheduled
+func (s *expiryScheduler) run() {
+	for {
+		s.Lock()
+		if len(s.rules) == 0 {
+			s.running = false
+			s.Unlock()
+			return
+		}
+		keys := make([]expiryKey, 0, len(s.rules))
+		for k := range s.rules {
+			keys = append(keys, k)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			return s.rules[keys[i]].expires.Before(s.rules[keys[j]].expires)
+		})
+		key, next := keys[0], *s.rules[keys[0]]
+		now := s.clock.Now()
+		if next.expires.After(now) {
+			clock := s.clock
+			s.Unlock()
+			select {
+			case <-clock.After(next.expires.Sub(now)):
+			case <-s.wake:
+			}
+			continue
+		}
+		s.Unlock()
+		if err := next.nfr.expire(next.handle, next.expires); err != nil {
+			if h := next.nfr.opts.warningHandler(); h != nil {
+				h(&ErrRuleExpiry{Table: key.table, Chain: key.chain, Handle: key.handle, Err: err})
+			}
+		}
+		// The rule is dropped unless it was rescheduled while it was deleted
+		s.Lock()
+		if r, ok := s.rules[key]; ok && r.expires.Equal(next.expires) {
+			delete(s.rules, key)
+		}
+		s.Unlock()
+	}
+}
+
+// expire deletes the rule if its expiry was not changed, rules already deleted are ignored. The rule is
+// deleted in a transaction of its own, operations queued on the connection are left to the caller's Flush.
+func (nfr *nfRules) expire(handle uint64, expires time.Time) error {
+	nfr.Lock()
+	defer nfr.Unlock()
+	if e, ok := nfr.opts.scheduler().get(nfr, handle); !ok || !e.Equal(expires) {
+		return nil
+	}
+	r, err := getRuleByHandle(nfr.rules, handle)
+	if err != nil {
+		return nil
+	}
+	rules := make([]*nftables.Rule, 0, len(r.siblings)+1)
+	for _, rr := range append([]*nfRule{r}, r.siblings...) {
+		if rr.rule.Handle != 0 {
+			rules = append(rules, rr.rule)
+		}
+	}
+	if err := delRulesImm(nfr.conn, rules); err != nil {
+		if !errors.Is(err, unix.ENOENT) {
+			return err
+		}
+		// Some of the rules are gone already, the rest is deleted one by one
+		for _, rule := range rules {
+			if err := delRulesImm(nfr.conn, []*nftables.Rule{rule}); err != nil && !errors.Is(err, unix.ENOENT) {
+				return err
+			}
+		}
+	}
+
+	return nfr.remove(r.id, false)
+}
+
+// RulesConn defines an optional interface of the connection, connections implementing it delete rules
+// in a transaction of their own, operations queued on the connection are not programmed.
+type RulesConn interface {
+	DelRulesImm([]*nftables.Rule) error
+}
+
+// TransactionConn defines an optional interface of the connection, connections implementing it return
+// a connection queuing operations in a transaction of its own, Flush of the returned connection does not
+// program operations queued on the original connection.
+type TransactionConn interface {
+	Transaction() (NetNS, error)
+}
+
+// transaction returns the connection queuing operations in a transaction of its own
+func transaction(conn NetNS) (NetNS, error) {
+	switch c := conn.(type) {
+	case TransactionConn:
+		return c.Transaction()
+	case *nftables.Conn:
+		// Messages are queued per connection, the copy reaches the same namespace or test dialer
+		return &nftables.Conn{NetNS: c.NetNS, TestDial: c.TestDial}, nil
+	}
+
+	return nil, fmt.Errorf("connection does not support transactions of their own")
+}
+
+// delRulesImm deletes the rules in a single transaction without programming operations queued on the connection
+func delRulesImm(conn NetNS, rules []*nftables.Rule) error {
+	if len(rules) == 0 {
+		return nil
+	}
+	switch c := conn.(type) {
+	case RulesConn:
+		return c.DelRulesImm(rules)
+	case *nftables.Conn:
+		msgs := make([]netlink.Message, 0, len(rules))
+		for _, r := range rules {
+			msg, err := delRuleMessage(r)
+			if err != nil {
+				return err
+			}
+			msgs = append(msgs, msg)
+		}
+		return sendBatch(c, msgs...)
+	}
+
+	return fmt.Errorf("connection does not support deleting rules in a transaction of their own")
+}
+
+// delRuleMessage builds the message deleting the rule by its handle, github.com/google/nftables
+// queues messages on the connection only, so the message is built by the library.
+func delRuleMessage(r *nftables.Rule) (netlink.Message, error) {
+	data, err := netlink.MarshalAttributes([]netlink.Attribute{
+		{Type: unix.NFTA_RULE_TABLE, Data: []byte(r.Table.Name + "\x00")},
+		{Type: unix.NFTA_RULE_CHAIN, Data: []byte(r.Chain.Name + "\x00")},
+		{Type: unix.NFTA_RULE_HANDLE, Data: binaryutil.BigEndian.PutUint64(r.Handle)},
+	})
+	if err != nil {
+		return netlink.Message{}, err
+	}
+
+	return netlink.Message{
+		Header: netlink.Header{
+			Type:  netlink.HeaderType((unix.NFNL_SUBSYS_NFTABLES << 8) | unix.NFT_MSG_DELRULE),
+			Flags: netlink.Request | netlink.Acknowledge,
+		},
+		// nfgenmsg header: family, version and resource id
+		Data: append([]byte{uint8(r.Table.Family), unix.NFNETLINK_V0, 0, 0}, data...),
+	}, nil
+}
+
+// expiryTLV returns the user data TLV carrying the expiry
+func expiryTLV(expires time.Time) []byte {
+	return append([]byte{ruleExpiryType, ruleExpiryLen}, binaryutil.BigEndian.PutUint64(uint64(expires.UnixNano()))...)
+}
+
+// userDataExpiry returns the expiry carried by the user data of the rule programmed by the library
+func userDataExpiry(ud []byte) (time.Time, bool) {
+	if _, ok := RuleIDFromUserData(ud); !ok || len(ud) < ruleExpirySize+4 {
+		return time.Time{}, false
+	}
+	tlv := ud[len(ud)-4-ruleExpirySize : len(ud)-4]
+	if tlv[0] != ruleExpiryType || tlv[1] != ruleExpiryLen {
+		return time.Time{}, false
+	}
+
+	return time.Unix(0, int64(binaryutil.BigEndian.Uint64(tlv[2:]))), true
+}
+
+// withUserDataExpiry returns a copy of the user data of the rule programmed by the library carrying
+// the expiry, the zero expiry removes the expiry from the user data.
+func withUserDataExpiry(ud []byte, expires time.Time) []byte {
+	user := ud[:len(ud)-4]
+	if _, ok := userDataExpiry(ud); ok {
+		user = ud[:len(ud)-4-ruleExpirySize]
+	}
+	n := append([]byte{}, user...)
+	if !expires.IsZero() {
+		n = append(n, expiryTLV(expires)...)
+	}
+
+	return append(n, ud[len(ud)-4:]...)
+}
+
+// CreateWithTTL programs the rule and schedules its deletion when ttl elapses, the handle of the rule
+// is returned. The expiry is kept in the user data of the rule, so a store synced with the host resumes
+// the expiry, the rule is deleted right away if its TTL elapsed while no store tracked it.
+func (nfr *nfRules) CreateWithTTL(rule *Rule, ttl time.Duration) (uint64, error) {
+	if ttl <= 0 {
+		return 0, fmt.Errorf("ttl must be positive, got %s", ttl)
+	}
+	s := nfr.opts.scheduler()
+	if s == nil {
+		return 0, fmt.Errorf("rules store does not support expiry")
+	}
+	expires := s.clock.Now().Add(ttl)
+	r := *rule
+	r.UserData = append(append([]byte{}, rule.UserData...), expiryTLV(expires)...)
+	handle, err := nfr.CreateImm(&r)
+	if err != nil {
+		return 0, err
+	}
+	s.schedule(nfr, handle, expires)
+
+	return handle, nil
+}
+
+// ExtendTTL postpones the deletion of the rule created by CreateWithTTL by ttl
+func (nfr *nfRules) ExtendTTL(handle uint64, ttl time.Duration) error {
+	if ttl <= 0 {
+		return fmt.Errorf("ttl must be positive, got %s", ttl)
+	}
+	if err := writable(nfr.conn); err != nil {
+		return err
+	}
+	nfr.Lock()
+	defer nfr.Unlock()
+	s := nfr.opts.scheduler()
+	expires, ok := s.get(nfr, handle)
+	if !ok {
+		return fmt.Errorf("rule with handle %d does not expire", handle)
+	}
+	expires = expires.Add(ttl)
+	if err := nfr.persistExpiry(handle, expires); err != nil {
+		return err
+	}
+	s.schedule(nfr, handle, expires)
+
+	return nil
+}
+
+// CancelTTL cancels the deletion of the rule created by CreateWithTTL, the rule is kept
+func (nfr *nfRules) CancelTTL(handle uint64) error {
+	if err := writable(nfr.conn); err != nil {
+		return err
+	}
+	nfr.Lock()
+	defer nfr.Unlock()
+	s := nfr.opts.scheduler()
+	if _, ok := s.get(nfr, handle); !ok {
+		return fmt.Errorf("rule with handle %d does not expire", handle)
+	}
+	if err := nfr.persistExpiry(handle, time.Time{}); err != nil {
+		return err
+	}
+	s.cancel(nfr, handle)
+
+	return nil
+}
+
+// GetTTL returns the time left before the rule created by CreateWithTTL is deleted
+func (nfr *nfRules) GetTTL(handle uint64) (time.Duration, error) {
+	s := nfr.opts.scheduler()
+	expires, ok := s.get(nfr, handle)
+	if !ok {
+		return 0, fmt.Errorf("rule with handle %d does not expire", handle)
+	}
+
+	return expires.Sub(s.clock.Now()), nil
+}
+
+// persistExpiry replaces the rule and rules generated along with it by rules carrying the expiry in
+// their user data. Anonymous sets are bound to the replaced rule and removed along with it, so they
+// are added again for the new rule. Replacements are programmed in a transaction of their own,
+// operations queued on the connection are left for the next flush.
+func (nfr *nfRules) persistExpiry(handle uint64, expires time.Time) error {
+	r, err := getRuleByHandle(nfr.rules, handle)
+	if err != nil {
+		return err
+	}
+	tx, err := transaction(nfr.conn)
+	if err != nil {
+		return err
+	}
+	rules := append([]*nfRule{r}, r.siblings...)
+	replaced := make([]*nftables.Rule, len(rules))
+	sets := make([][]*nfSet, len(rules))
+	for i, rr := range rules {
+		if rr.inline != nil {
+			return fmt.Errorf("rule with handle %d jumps to inline chain, its expiry cannot be changed", handle)
+		}
+		if replaced[i], sets[i], err = rebindAnonymous(tx, rr); err != nil {
+			return err
+		}
+		replaced[i].UserData = withUserDataExpiry(rr.rule.UserData, expires)
+		tx.ReplaceRule(replaced[i])
+	}
+	if err := flush(tx); err != nil {
+		return err
+	}
+	for i, rr := range rules {
+		rr.rule, rr.sets = replaced[i], sets[i]
+	}
+
+	return nil
+}
+
+// rebindAnonymous returns a copy of the rule and its sets, anonymous sets of the rule are queued
+// again on the connection and lookups of the copy refer to them.
+func rebindAnonymous(conn NetNS, rr *nfRule) (*nftables.Rule, []*nfSet, error) {
+	rule := *rr.rule
+	rule.Position = 0
+	rule.Exprs = append([]expr.Any{}, rr.rule.Exprs...)
+	sets := make([]*nfSet, 0, len(rr.sets))
+	for _, s := range rr.sets {
+		if !s.set.Anonymous {
+			sets = append(sets, s)
+			continue
+		}
+		set := *s.set
+		set.ID, set.Name = 0, ""
+		if err := conn.AddSet(&set, s.elements); err != nil {
+			return nil, nil, err
+		}
+		for i, e := range rule.Exprs {
+			l, ok := e.(*expr.Lookup)
+			if !ok {
+				continue
+			}
+			// Sets queued by the library are referred by ID, sets loaded from the host by name
+			if s.set.ID != 0 && l.SetID == s.set.ID || s.set.ID == 0 && l.SetName == s.set.Name {
+				lookup := *l
+				lookup.SetName, lookup.SetID = set.Name, set.ID
+				rule.Exprs[i] = &lookup
+			}
+		}
+		sets = append(sets, &nfSet{set: &set, elements: s.elements, fields: s.fields})
+	}
+
+	return &rule, sets, nil
+}
@@ -0,0 +1,47 @@
+package nftableslib
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestUserDataExpiry(t *testing.T) {
+	id := []byte{0x2, 2, 0, 7}
+	expires := time.Unix(7200, 500)
+	tests := []struct {
+		name string
+		user []byte
+	}{
+		{
+			name: "without user data",
+		},
+		{
+			name: "with comment",
+			user: MakeRuleComment("temporary"),
+		},
+	}
+	for _, tt := range tests {
+		ud := append(append([]byte{}, tt.user...), id...)
+		if _, ok := userDataExpiry(ud); ok {
+			t.Fatalf("Test \"%s\" failed, user data without expiry is not expected to carry it", tt.name)
+		}
+		with := withUserDataExpiry(ud, expires)
+		if e, ok := userDataExpiry(with); !ok || !e.Equal(expires) {
+			t.Fatalf("Test \"%s\" failed, expected expiry %s, got %s", tt.name, expires, e)
+		}
+		if rid, ok := RuleIDFromUserData(with); !ok || rid != 7 {
+			t.Fatalf("Test \"%s\" failed, rule id is expected to stay last, got %d", tt.name, rid)
+		}
+		later := withUserDataExpiry(with, expires.Add(time.Hour))
+		if len(later) != len(with) {
+			t.Fatalf("Test \"%s\" failed, replaced expiry is expected to keep the length of user data", tt.name)
+		}
+		if e, _ := userDataExpiry(later); !e.Equal(expires.Add(time.Hour)) {
+			t.Fatalf("Test \"%s\" failed, expected replaced expiry %s, got %s", tt.name, expires.Add(time.Hour), e)
+		}
+		if without := withUserDataExpiry(later, time.Time{}); !bytes.Equal(without, ud) {
+			t.Fatalf("Test \"%s\" failed, expected user data %v after removal of expiry, got %v", tt.name, ud, without)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package nftableslib
 
 import (
+	"bytes"
 	"fmt"
 
 	"golang.org/x/sys/unix"
@@ -46,8 +47,13 @@ func getExprForCounter() []expr.Any {
 	}
 }
 
-// getExprForSingleIP returns expression to match a single IPv4 or IPv6 address
+// getExprForSingleIP returns expression to match a single IPv4 or IPv6 address or prefix without a set,
+// the prefix is matched by masking the loaded address, for example "ip6 saddr 2001:db8::/32", host
+// addresses are compared directly.
 func getExprForSingleIP(l3proto nftables.TableFamily, offset uint32, addr *IPAddr, op Operator) ([]expr.Any, error) {
+	if err := validateRelOp(op, "ip address", false); err != nil {
+		return nil, err
+	}
 	if addr == nil {
 		return nil, fmt.Errorf("ip address cannot be nil")
 	}
@@ -56,13 +62,7 @@ func getExprForSingleIP(l3proto nftables.TableFamily, offset uint32, addr *IPAdd
 	if l3proto == nftables.TableFamilyIPv6 {
 		addrLen = 16
 	}
-	re = append(re, &expr.Payload{
-		DestRegister: 1,
-		Base:         expr.PayloadBaseNetworkHeader,
-		Offset:       offset,          // Offset ipv4 address in network header
-		Len:          uint32(addrLen), // length bytes for ipv4 address
-	})
-	var baddr, xor []byte
+	var baddr []byte
 	if l3proto == nftables.TableFamilyIPv4 {
 		baddr = []byte(addr.IP.To4())
 	}
@@ -72,18 +72,37 @@ func getExprForSingleIP(l3proto nftables.TableFamily, offset uint32, addr *IPAdd
 	if len(baddr) == 0 {
 		return nil, fmt.Errorf("invalid ip %s", addr.IP.String())
 	}
-	xor = make([]byte, addrLen)
-	re = append(re, &expr.Bitwise{
-		SourceRegister: 1,
-		DestRegister:   1,
-		Len:            uint32(addrLen),
-		Mask:           buildMask(addrLen, *addr.Mask),
-		Xor:            xor,
+	// Address without a mask is a host address
+	prefix := uint8(addrLen * 8)
+	if addr.Mask != nil {
+		prefix = *addr.Mask
+	}
+	if int(prefix) > addrLen*8 {
+		return nil, fmt.Errorf("invalid prefix length %d of ip %s", prefix, addr.IP.String())
+	}
+	re = append(re, &expr.Payload{
+		DestRegister: 1,
+		Base:         expr.PayloadBaseNetworkHeader,
+		Offset:       offset,          // Offset ipv4 address in network header
+		Len:          uint32(addrLen), // length bytes for ipv4 address
 	})
-	cmpOp := expr.CmpOpEq
-	if op == NEQ {
-		cmpOp = expr.CmpOpNeq
+	if int(prefix) < addrLen*8 {
+		mask := buildMask(addrLen, prefix)
+		// Host bits of the address are cleared, otherwise the masked address would never match
+		network := make([]byte, addrLen)
+		for i := range network {
+			network[i] = baddr[i] & mask[i]
+		}
+		baddr = network
+		re = append(re, &expr.Bitwise{
+			SourceRegister: 1,
+			DestRegister:   1,
+			Len:            uint32(addrLen),
+			Mask:           mask,
+			Xor:            make([]byte, addrLen),
+		})
 	}
+	cmpOp := op.cmpOp()
 	re = append(re, &expr.Cmp{
 		Op:       cmpOp,
 		Register: 1,
@@ -93,8 +112,53 @@ func getExprForSingleIP(l3proto nftables.TableFamily, offset uint32, addr *IPAdd
 	return re, nil
 }
 
+// getExprForMaskedIP returns expression to match IPv4 or IPv6 address masked with an arbitrary mask,
+// for example "ip saddr & 0.0.0.255 == 0.0.0.1"
+func getExprForMaskedIP(l3proto nftables.TableFamily, offset uint32, addr *MaskedAddr, op Operator) ([]expr.Any, error) {
+	if err := validateRelOp(op, "masked ip address", false); err != nil {
+		return nil, err
+	}
+	if err := addr.Validate(); err != nil {
+		return nil, err
+	}
+	if addr.IsIPv6() != (l3proto == nftables.TableFamilyIPv6) {
+		return nil, fmt.Errorf("masked address %s does not belong to family %#02x", addr.Value.IP, l3proto)
+	}
+	mask, value := addr.bytes()
+	re := []expr.Any{}
+	// [ payload load 4b @ network header + offset => reg 1 ]
+	re = append(re, &expr.Payload{
+		DestRegister: 1,
+		Base:         expr.PayloadBaseNetworkHeader,
+		Offset:       offset,
+		Len:          uint32(len(value)),
+	})
+	// Mask of all ones does not change the address, the bitwise expression is not needed
+	if !allOnes(mask) {
+		// [ bitwise reg 1 = (reg=1 & mask ) ^ 0 ]
+		re = append(re, &expr.Bitwise{
+			SourceRegister: 1,
+			DestRegister:   1,
+			Len:            uint32(len(mask)),
+			Mask:           mask,
+			Xor:            make([]byte, len(mask)),
+		})
+	}
+	// [ cmp op reg 1 value ]
+	re = append(re, &expr.Cmp{
+		Op:       op.cmpOp(),
+		Register: 1,
+		Data:     value,
+	})
+
+	return re, nil
+}
+
 // getExprForListIP returns expression to match a list of IPv4 or IPv6 addresses
 func getExprForListIP(l3proto nftables.TableFamily, set *nftables.Set, offset uint32, op Operator) ([]expr.Any, error) {
+	if err := validateRelOp(op, "ip address list", false); err != nil {
+		return nil, err
+	}
 	if set == nil {
 		return nil, fmt.Errorf("set *nftables.Set cannot be nil")
 	}
@@ -126,6 +190,9 @@ func getExprForListIP(l3proto nftables.TableFamily, set *nftables.Set, offset ui
 
 // getExprForRangeIP returns expression to match a range of IPv4 or IPv6 addresses
 func getExprForRangeIP(l3proto nftables.TableFamily, offset uint32, rng [2]*IPAddr, op Operator) ([]expr.Any, error) {
+	if err := validateRelOp(op, "ip address range", false); err != nil {
+		return nil, err
+	}
 	if rng[0] == nil || rng[1] == nil {
 		return nil, fmt.Errorf("ip address in the range cannot be nil")
 	}
@@ -141,22 +208,14 @@ func getExprForRangeIP(l3proto nftables.TableFamily, offset uint32, rng [2]*IPAd
 		Offset:       offset,          // Offset ipv4 address in network header
 		Len:          uint32(addrLen), // length bytes for ipv4 address
 	})
-	var fromAddr, toAddr []byte
-	if l3proto == nftables.TableFamilyIPv4 {
-		fromAddr = []byte(rng[0].IP.To4())
-		toAddr = []byte(rng[1].IP.To4())
-	}
-	if l3proto == nftables.TableFamilyIPv6 {
-		fromAddr = []byte(rng[0].IP.To16())
-		toAddr = []byte(rng[1].IP.To16())
-	}
-	if len(fromAddr) == 0 {
-		return nil, fmt.Errorf("invalid ip %s", rng[0].IP.String())
-	}
-	if len(toAddr) == 0 {
-		return nil, fmt.Errorf("invalid ip %s", rng[1].IP.String())
+	fromAddr, toAddr, err := rangeBoundsIP(l3proto, rng)
+	if err != nil {
+		return nil, err
 	}
 	if op == NEQ {
+		// Two cmp expressions are evaluated as a conjunction, lt lower bound or gt upper bound cannot
+		// be expressed by them, the range expression breaks the rule when the address is within the bounds.
+		// [ range neq reg 1 0x0101000a 0x0901000a ]
 		re = append(re, &expr.Range{
 			Op:       expr.CmpOpNeq,
 			Register: 1,
@@ -165,6 +224,8 @@ func getExprForRangeIP(l3proto nftables.TableFamily, offset uint32, rng [2]*IPAd
 		})
 		return re, nil
 	}
+	// [ cmp gte reg 1 0x0101000a ]
+	// [ cmp lte reg 1 0x0901000a ]
 	re = append(re, &expr.Cmp{
 		Op:       expr.CmpOpGte,
 		Register: 1,
@@ -179,6 +240,37 @@ func getExprForRangeIP(l3proto nftables.TableFamily, offset uint32, rng [2]*IPAd
 	return re, nil
 }
 
+// rangeBoundsIP returns bounds of the address range in the format of the family, the upper bound
+// carrying prefix length covers the whole prefix, so 10.0.0.0/24-10.0.1.0/24 ends at 10.0.1.255.
+func rangeBoundsIP(l3proto nftables.TableFamily, rng [2]*IPAddr) ([]byte, []byte, error) {
+	bounds := [2][]byte{}
+	for i, addr := range rng {
+		switch {
+		case l3proto == nftables.TableFamilyIPv4 && addr.IP.To4() != nil:
+			bounds[i] = append([]byte{}, addr.IP.To4()...)
+		case l3proto == nftables.TableFamilyIPv6 && addr.IP.To4() == nil && addr.IP.To16() != nil:
+			bounds[i] = append([]byte{}, addr.IP.To16()...)
+		default:
+			return nil, nil, fmt.Errorf("invalid ip %s", addr.IP.String())
+		}
+	}
+	if rng[1].CIDR && rng[1].Mask != nil && int(*rng[1].Mask) < len(bounds[1])*8 {
+		ones := int(*rng[1].Mask)
+		for b := ones / 8; b < len(bounds[1]); b++ {
+			if b == ones/8 {
+				bounds[1][b] |= 0xff >> uint(ones%8)
+				continue
+			}
+			bounds[1][b] = 0xff
+		}
+	}
+	if bytes.Compare(bounds[0], bounds[1]) > 0 {
+		return nil, nil, fmt.Errorf("ip address range %s-%s has lower bound greater than upper bound", rng[0].IP.String(), rng[1].IP.String())
+	}
+
+	return bounds[0], bounds[1], nil
+}
+
 func getExprForRedirectPort(portToRedirect uint16) []expr.Any {
 	// [ immediate reg 1 {port to Redirect} ]
 	//  [ redir proto_min reg 1 ]
@@ -195,12 +287,12 @@ func getExprForRedirectPort(portToRedirect uint16) []expr.Any {
 	return re
 }
 
-func getExprForListPort(l4proto uint8, offset uint32, port []*uint16, op Operator, set *nftables.Set) ([]expr.Any, error) {
-	// Slice port may carry nil pointer element, checking all elements of the slice that it is not the case
-	for i, p := range port {
-		if p == nil {
-			return nil, fmt.Errorf("port[%d] carries nil pointer", i)
-		}
+func getExprForListPort(l4proto uint8, offset uint32, port []uint16, op Operator, set *nftables.Set) ([]expr.Any, error) {
+	if err := validateRelOp(op, "port", len(port) == 1); err != nil {
+		return nil, err
+	}
+	if len(port) == 0 {
+		return nil, fmt.Errorf("port list is empty")
 	}
 	if l4proto == 0 {
 		return nil, fmt.Errorf("l4 protocol is 0")
@@ -235,14 +327,10 @@ func getExprForListPort(l4proto uint8, offset uint32, port []*uint16, op Operato
 		})
 	} else {
 		// Case for a single port list
-		cmpOp := expr.CmpOpEq
-		if excl {
-			cmpOp = expr.CmpOpNeq
-		}
 		re = append(re, &expr.Cmp{
-			Op:       cmpOp,
+			Op:       op.cmpOp(),
 			Register: 1,
-			Data:     binaryutil.BigEndian.PutUint16(*port[0]),
+			Data:     binaryutil.BigEndian.PutUint16(port[0]),
 		})
 
 	}
@@ -274,12 +362,12 @@ func getExprForRedirect(port uint16, family nftables.TableFamily) []expr.Any {
 	return re
 }
 
-func getExprForRangePort(l4proto uint8, offset uint32, port [2]*uint16, op Operator) ([]expr.Any, error) {
-	// Slice port may carry nil pointer element, checking all elements of the slice that it is not the case
-	for i, p := range port {
-		if p == nil {
-			return nil, fmt.Errorf("port[%d] carries nil pointer", i)
-		}
+func getExprForRangePort(l4proto uint8, offset uint32, port [2]uint16, op Operator) ([]expr.Any, error) {
+	if err := validateRelOp(op, "port range", false); err != nil {
+		return nil, err
+	}
+	if err := validatePortRange(port); err != nil {
+		return nil, err
 	}
 	// [ meta load l4proto => reg 1 ]
 	// [ cmp eq reg 1 0x00000006 ]
@@ -307,26 +395,29 @@ func getExprForRangePort(l4proto uint8, offset uint32, port [2]*uint16, op Opera
 		re = append(re, &expr.Range{
 			Op:       expr.CmpOpNeq,
 			Register: 1,
-			FromData: binaryutil.NativeEndian.PutUint16(*port[0]),
-			ToData:   binaryutil.NativeEndian.PutUint16(*port[1]),
+			FromData: binaryutil.BigEndian.PutUint16(port[0]),
+			ToData:   binaryutil.BigEndian.PutUint16(port[1]),
 		})
 		return re, nil
 	}
 	re = append(re, &expr.Cmp{
 		Op:       expr.CmpOpGte,
 		Register: 1,
-		Data:     binaryutil.BigEndian.PutUint16(*port[0]),
+		Data:     binaryutil.BigEndian.PutUint16(port[0]),
 	})
 	re = append(re, &expr.Cmp{
 		Op:       expr.CmpOpLte,
 		Register: 1,
-		Data:     binaryutil.BigEndian.PutUint16(*port[1]),
+		Data:     binaryutil.BigEndian.PutUint16(port[1]),
 	})
 
 	return re, nil
 }
 
 func getExprForIPVersion(version byte, op Operator) ([]expr.Any, error) {
+	if err := validateRelOp(op, "ip version", true); err != nil {
+		return nil, err
+	}
 	re := []expr.Any{}
 	re = append(re, &expr.Payload{
 		DestRegister: 1,
@@ -334,10 +425,6 @@ func getExprForIPVersion(version byte, op Operator) ([]expr.Any, error) {
 		Offset:       0, // Offset for a version of IP
 		Len:          1, // 1 byte for IP version
 	})
-	if op != EQ {
-		// TODO sbezverk
-		return re, nil
-	}
 	re = append(re, &expr.Bitwise{
 		SourceRegister: 1,
 		DestRegister:   1,
@@ -345,9 +432,9 @@ func getExprForIPVersion(version byte, op Operator) ([]expr.Any, error) {
 		Mask:           []byte{0xf0},
 		Xor:            []byte{0x0},
 	})
-
+	cmpOp := op.cmpOp()
 	re = append(re, &expr.Cmp{
-		Op:       expr.CmpOpEq,
+		Op:       cmpOp,
 		Register: 1,
 		Data:     []byte{(version << 4)},
 	})
@@ -355,7 +442,43 @@ func getExprForIPVersion(version byte, op Operator) ([]expr.Any, error) {
 	return re, nil
 }
 
+// getExprForIPOptions returns expressions matching IPv4 packets with options present when options is true,
+// or without options when options is false, the header length in 32 bit words is the low nibble of byte 0.
+func getExprForIPOptions(options bool) []expr.Any {
+	re := []expr.Any{}
+	// [ payload load 1b @ network header + 0 => reg 1 ]
+	re = append(re, &expr.Payload{
+		DestRegister: 1,
+		Base:         expr.PayloadBaseNetworkHeader,
+		Offset:       0, // Offset for version and ihl
+		Len:          1,
+	})
+	// [ bitwise reg 1 = (reg=1 & 0x0f ) ^ 0x00 ]
+	re = append(re, &expr.Bitwise{
+		SourceRegister: 1,
+		DestRegister:   1,
+		Len:            1,
+		Mask:           []byte{0x0f},
+		Xor:            []byte{0x0},
+	})
+	// [ cmp gt reg 1 0x05 ] or [ cmp eq reg 1 0x05 ]
+	cmpOp := expr.CmpOpEq
+	if options {
+		cmpOp = expr.CmpOpGt
+	}
+	re = append(re, &expr.Cmp{
+		Op:       cmpOp,
+		Register: 1,
+		Data:     []byte{0x05},
+	})
+
+	return re
+}
+
 func getExprForProtocol(l3proto nftables.TableFamily, proto uint32, op Operator) ([]expr.Any, error) {
+	if err := validateRelOp(op, "l4 protocol", true); err != nil {
+		return nil, err
+	}
 	re := []expr.Any{}
 	if l3proto == nftables.TableFamilyIPv4 {
 		// IPv4
@@ -377,14 +500,11 @@ func getExprForProtocol(l3proto nftables.TableFamily, proto uint32, op Operator)
 		})
 	}
 
-	if op != EQ {
-		// TODO sbezverk
-		return re, nil
-	}
+	cmpOp := op.cmpOp()
 	// [ cmp eq reg 1 0x00000006 ]
 	protobyte := binaryutil.NativeEndian.PutUint32(proto)
 	re = append(re, &expr.Cmp{
-		Op:       expr.CmpOpEq,
+		Op:       cmpOp,
 		Register: 1,
 		Data:     protobyte[0:1],
 	})
@@ -449,13 +569,41 @@ func getExprForMetaMark(mark *MetaMark) []expr.Any {
 	return re
 }
 
+// getExprForMetaMatches returns expressions for all meta matches of the rule,
+// the mark match if present comes last.
+func getExprForMetaMatches(meta *MetaRule) []expr.Any {
+	re := getExprForMetaExpr(meta.matches())
+	if meta.IIFNameSet != nil {
+		re = append(re, getExprForIfNameSet(expr.MetaKeyIIFNAME, meta.IIFNameSet)...)
+	}
+	if meta.OIFNameSet != nil {
+		re = append(re, getExprForIfNameSet(expr.MetaKeyOIFNAME, meta.OIFNameSet)...)
+	}
+	if meta.Mark != nil && !meta.Mark.Set {
+		re = append(re, getExprForMetaMark(meta.Mark)...)
+	}
+
+	return re
+}
+
+func getExprForIfNameSet(key expr.MetaKey, s *IfNameSet) []expr.Any {
+	// [ meta load iifname => reg 1 ]
+	// [ lookup reg 1 set pods ]
+	return []expr.Any{
+		&expr.Meta{Key: key, Register: 1},
+		&expr.Lookup{
+			SourceRegister: 1,
+			Invert:         s.RelOp == NEQ,
+			SetID:          s.SetRef.ID,
+			SetName:        s.SetRef.Name,
+		},
+	}
+}
+
 func getExprForMetaExpr(meta []MetaExpr) []expr.Any {
 	re := []expr.Any{}
 	for _, m := range meta {
-		op := expr.CmpOpEq
-		if m.RelOp == NEQ {
-			op = expr.CmpOpNeq
-		}
+		op := m.RelOp.cmpOp()
 		re = append(re, &expr.Meta{Key: expr.MetaKey(m.Key), Register: 1})
 		re = append(re, &expr.Cmp{
 			Op:       op,
@@ -466,6 +614,42 @@ func getExprForMetaExpr(meta []MetaExpr) []expr.Any {
 	return re
 }
 
+// getExprForPayloadMatch returns expressions comparing payload at the offset of the base header with data
+func getExprForPayloadMatch(base expr.PayloadBase, offset uint32, data []byte, op Operator) []expr.Any {
+	cmpOp := op.cmpOp()
+
+	return []expr.Any{
+		&expr.Payload{
+			DestRegister: 1,
+			Base:         base,
+			Offset:       offset,
+			Len:          uint32(len(data)),
+		},
+		&expr.Cmp{
+			Op:       cmpOp,
+			Register: 1,
+			Data:     data,
+		},
+	}
+}
+
+// getExprForPayloadSet returns expressions writing data into payload at the offset of the base header,
+// no checksum is updated.
+func getExprForPayloadSet(base expr.PayloadBase, offset uint32, data []byte) []expr.Any {
+	return []expr.Any{
+		// [ immediate reg 1 data ]
+		&expr.Immediate{Register: 1, Data: data},
+		// [ payload write reg 1 => base + offset ]
+		&expr.Payload{
+			OperationType:  expr.PayloadWrite,
+			SourceRegister: 1,
+			Base:           base,
+			Offset:         offset,
+			Len:            uint32(len(data)),
+		},
+	}
+}
+
 func getExprForMasq(masq *masquerade) []expr.Any {
 	if masq == nil {
 		return []expr.Any{}
@@ -475,16 +659,18 @@ func getExprForMasq(masq *masquerade) []expr.Any {
 	// expressions
 	if masq.toPort[0] != nil {
 		m := &expr.Masq{ToPorts: true}
+		// Two ports always fit into registers, allocation errors are not possible
+		regs := newRegAllocator()
 		// Case  at least 1 toPort specified
 		//  [ immediate reg 1 0x00000004 ]
-		re = append(re, &expr.Immediate{Register: 1, Data: binaryutil.BigEndian.PutUint32(uint32(*masq.toPort[0]))})
-		m.RegProtoMin = 1
+		m.RegProtoMin, _ = regs.alloc(4)
+		re = append(re, &expr.Immediate{Register: m.RegProtoMin, Data: binaryutil.BigEndian.PutUint32(uint32(*masq.toPort[0]))})
 		m.RegProtoMax = 0
 		if masq.toPort[1] != nil {
 			// If second port is specified, then range of ports will be used.
 			// [ immediate reg 2 0x00000008 ]
-			re = append(re, &expr.Immediate{Register: 2, Data: binaryutil.BigEndian.PutUint32(uint32(*masq.toPort[1]))})
-			m.RegProtoMax = 2
+			m.RegProtoMax, _ = regs.alloc(4)
+			re = append(re, &expr.Immediate{Register: m.RegProtoMax, Data: binaryutil.BigEndian.PutUint32(uint32(*masq.toPort[1]))})
 		}
 		// [ masq proto_min reg 1 proto_max reg 2 ]
 		re = append(re, m)
@@ -546,10 +732,7 @@ func getExprForFib(f *Fib) []expr.Any {
 		FlagPRESENT:    f.FlagPRESENT,
 	})
 
-	op := expr.CmpOpEq
-	if f.RelOp == NEQ {
-		op = expr.CmpOpNeq
-	}
+	op := f.RelOp.cmpOp()
 	l := len(f.Data) / 4
 	if len(f.Data)%4 != 0 {
 		l++
@@ -565,20 +748,24 @@ func getExprForFib(f *Fib) []expr.Any {
 	return re
 }
 
-func getExprForConntracks(cts []*Conntrack) []expr.Any {
+func getExprForConntracks(cts []*Conntrack) ([]expr.Any, error) {
 	re := []expr.Any{}
 	for _, ct := range cts {
 		if ct == nil {
 			// Skipping nil pointers
 			continue
 		}
+		if err := ct.Validate(); err != nil {
+			return nil, err
+		}
 		switch ct.Key {
 		// List of supported conntrack keys
-		case unix.NFT_CT_STATE:
+		case unix.NFT_CT_STATE, unix.NFT_CT_STATUS:
+			// State and status are both bitmasks, the match succeeds if any bit of the value is set
 			//	[ ct load state => reg 1 ]
 			//	[ bitwise reg 1 = (reg=1 & 0x00000008 ) ^ 0x00000000 ]
 			//	[ cmp neq reg 1 0x00000000 ]
-			re = append(re, &expr.Ct{Key: unix.NFT_CT_STATE, Register: 1})
+			re = append(re, &expr.Ct{Key: expr.CtKey(ct.Key), Register: 1})
 			re = append(re, &expr.Bitwise{
 				SourceRegister: 1,
 				DestRegister:   1,
@@ -591,17 +778,18 @@ func getExprForConntracks(cts []*Conntrack) []expr.Any {
 				Register: 1,
 				Data:     []byte{0x0, 0x0, 0x0, 0x0},
 			})
-		case unix.NFT_CT_DIRECTION:
-		case unix.NFT_CT_STATUS:
-		case unix.NFT_CT_LABELS:
-		case unix.NFT_CT_EVENTMASK:
+		case unix.NFT_CT_BYTES, unix.NFT_CT_PKTS, unix.NFT_CT_AVGPKT:
+			re = append(re, getExprForCtCounter(ct)...)
 		}
 	}
 
-	return re
+	return re, nil
 }
 
 func getExprForPortSet(l4proto uint8, offset uint32, set *SetRef, op Operator) ([]expr.Any, error) {
+	if err := validateRelOp(op, "port set", false); err != nil {
+		return nil, err
+	}
 	if set == nil {
 		return nil, fmt.Errorf("set *SetRef cannot be nil")
 	}
@@ -643,6 +831,9 @@ func getExprForPortSet(l4proto uint8, offset uint32, set *SetRef, op Operator) (
 
 // getExprForListIP returns expression to match a list of IPv4 or IPv6 addresses
 func getExprForAddrSet(l3proto nftables.TableFamily, offset uint32, set *SetRef, op Operator) ([]expr.Any, error) {
+	if err := validateRelOp(op, "ip address set", false); err != nil {
+		return nil, err
+	}
 	if set == nil {
 		return nil, fmt.Errorf("set *SetRef cannot be nil")
 	}
@@ -689,7 +880,20 @@ func getExprForNAT(l3proto nftables.TableFamily, nat *nat) ([]expr.Any, error) {
 	}
 
 	var regAddrMin, regAddrMax, regProtoMin, regProtoMax uint32
-	register := uint32(1)
+	regs := newRegAllocator()
+	// immediate loads data into a newly allocated register and returns the register
+	immediate := func(data []byte) (uint32, error) {
+		register, err := regs.alloc(uint32(len(data)))
+		if err != nil {
+			return 0, err
+		}
+		re = append(re, &expr.Immediate{
+			Register: register,
+			Data:     data,
+		})
+		return register, nil
+	}
+	var err error
 	if nat.address != nil {
 		var addr1, addr2 []byte
 		// NAT does not support a list of addresses, it supports either a single address List[0]
@@ -701,12 +905,9 @@ func getExprForNAT(l3proto nftables.TableFamily, nat *nat) ([]expr.Any, error) {
 			} else {
 				addr1 = []byte(nat.address.List[0].IP.To16())
 			}
-			re = append(re, &expr.Immediate{
-				Register: register,
-				Data:     addr1,
-			})
-			regAddrMin = register
-			register++
+			if regAddrMin, err = immediate(addr1); err != nil {
+				return nil, err
+			}
 		case nat.address.Range[0] != nil && nat.address.Range[1] != nil:
 			if l3proto == nftables.TableFamilyIPv4 {
 				addr1 = []byte(nat.address.Range[0].IP.To4())
@@ -715,18 +916,12 @@ func getExprForNAT(l3proto nftables.TableFamily, nat *nat) ([]expr.Any, error) {
 				addr1 = []byte(nat.address.Range[0].IP.To16())
 				addr2 = []byte(nat.address.Range[1].IP.To16())
 			}
-			re = append(re, &expr.Immediate{
-				Register: register,
-				Data:     addr1,
-			})
-			regAddrMin = register
-			register++
-			re = append(re, &expr.Immediate{
-				Register: register,
-				Data:     addr2,
-			})
-			regAddrMax = register
-			register++
+			if regAddrMin, err = immediate(addr1); err != nil {
+				return nil, err
+			}
+			if regAddrMax, err = immediate(addr2); err != nil {
+				return nil, err
+			}
 		}
 	}
 	if nat.port != nil {
@@ -734,25 +929,16 @@ func getExprForNAT(l3proto nftables.TableFamily, nat *nat) ([]expr.Any, error) {
 		// or a range of ports Range[0]-Range[1]
 		switch {
 		case nat.port.List != nil:
-			re = append(re, &expr.Immediate{
-				Register: register,
-				Data:     binaryutil.BigEndian.PutUint16(*nat.port.List[0]),
-			})
-			regProtoMin = register
-			register++
-		case nat.port.Range[0] != nil && nat.port.Range[1] != nil:
-			re = append(re, &expr.Immediate{
-				Register: register,
-				Data:     binaryutil.BigEndian.PutUint16(*nat.port.Range[0]),
-			})
-			regProtoMin = register
-			register++
-			re = append(re, &expr.Immediate{
-				Register: register,
-				Data:     binaryutil.BigEndian.PutUint16(*nat.port.Range[1]),
-			})
-			regProtoMax = register
-			register++
+			if regProtoMin, err = immediate(binaryutil.BigEndian.PutUint16(nat.port.List[0])); err != nil {
+				return nil, err
+			}
+		case portRange(nat.port.Range).isSet():
+			if regProtoMin, err = immediate(binaryutil.BigEndian.PutUint16(nat.port.Range[0])); err != nil {
+				return nil, err
+			}
+			if regProtoMax, err = immediate(binaryutil.BigEndian.PutUint16(nat.port.Range[1])); err != nil {
+				return nil, err
+			}
 		}
 	}
 	e := &expr.NAT{
@@ -785,6 +971,28 @@ func getExprForLoadbalance(nfr *nfRules, l *loadbalance) ([]expr.Any, error) {
 	var set *nftables.Set
 	var elements []nftables.SetElement
 	var exprs []expr.Any
+	mode := uint32(unix.NFT_NG_RANDOM)
+	if l.mode == unix.NFT_NG_INCREMENTAL {
+		mode = uint32(unix.NFT_NG_INCREMENTAL)
+	}
+	if l.setRef != nil {
+		// Weighted loadbalancing, numgen output is looked up in the named interval verdict map
+		return []expr.Any{
+			&expr.Numgen{
+				Register: 1,
+				Modulus:  l.modulus,
+				Type:     mode,
+				Offset:   0,
+			},
+			&expr.Lookup{
+				SourceRegister: 1,
+				DestRegister:   0,
+				IsDestRegSet:   true,
+				SetID:          l.setRef.ID,
+				SetName:        l.setRef.Name,
+			},
+		}, nil
+	}
 	if len(l.chains) == 0 {
 		return nil, fmt.Errorf("number of chains for loadbalancing cannot be 0")
 	}
@@ -800,10 +1008,6 @@ func getExprForLoadbalance(nfr *nfRules, l *loadbalance) ([]expr.Any, error) {
 	if l.action == unix.NFT_GOTO {
 		action = int64(unix.NFT_GOTO)
 	}
-	mode := uint32(unix.NFT_NG_RANDOM)
-	if l.mode == unix.NFT_NG_INCREMENTAL {
-		mode = uint32(unix.NFT_NG_INCREMENTAL)
-	}
 	for ind, chain := range l.chains {
 		elements = append(elements, nftables.SetElement{
 			Key: binaryutil.NativeEndian.PutUint32(uint32(ind)),
@@ -0,0 +1,137 @@
+package nftableslib
+
+import (
+	"strings"
+	"syscall"
+
+	"github.com/mdlayher/netlink"
+	"github.com/mdlayher/netlink/nlenc"
+	"golang.org/x/sys/unix"
+)
+
+// Attributes of extended acknowledgements, golang.org/x/sys/unix does not define them
+const (
+	nlmsgerrAttrMsg  = 1
+	nlmsgerrAttrOffs = 2
+)
+
+// nlaTypeMask strips flags from the type of a netlink attribute
+const nlaTypeMask = ^uint16(unix.NLA_F_NESTED | unix.NLA_F_NET_BYTEORDER)
+
+// extAck carries the extended acknowledgement the kernel attaches to an error, offset is the offset
+// of the rejected attribute from the start of the rejected message, 0 if it is not reported.
+type extAck struct {
+	message string
+	offset  uint32
+}
+
+// parseExtAck returns the extended acknowledgement carried by NLMSG_ERROR message, nil is returned
+// when the message does not carry it.
+func parseExtAck(m syscall.NetlinkMessage) *extAck {
+	if m.Header.Flags&unix.NLM_F_ACK_TLVS == 0 || len(m.Data) < 4+unix.SizeofNlMsghdr {
+		return nil
+	}
+	// The error code is followed by the rejected message, only its header when the reply is capped
+	tlvs := 4 + unix.SizeofNlMsghdr
+	if m.Header.Flags&unix.NLM_F_CAPPED == 0 {
+		tlvs = 4 + int(nlenc.Uint32(m.Data[4:8]))
+	}
+	if tlvs > len(m.Data) {
+		return nil
+	}
+	ack := &extAck{}
+	for _, a := range parseAttributes(m.Data[tlvs:]) {
+		switch a.typ {
+		case nlmsgerrAttrMsg:
+			ack.message = strings.TrimRight(string(a.data), "\x00")
+		case nlmsgerrAttrOffs:
+			if len(a.data) == 4 {
+				ack.offset = nlenc.Uint32(a.data)
+			}
+		}
+	}
+	if ack.message == "" && ack.offset == 0 {
+		return nil
+	}
+
+	return ack
+}
+
+// rawAttribute is a netlink attribute along with its offset in the parsed buffer
+type rawAttribute struct {
+	typ    uint16
+	offset int
+	length int
+	data   []byte
+}
+
+// parseAttributes returns attributes of the buffer, offsets of attributes are kept so offsets
+// reported by the kernel can be mapped to them.
+func parseAttributes(b []byte) []rawAttribute {
+	attrs := make([]rawAttribute, 0)
+	for pos := 0; pos+unix.SizeofNlAttr <= len(b); {
+		l := int(nlenc.Uint16(b[pos : pos+2]))
+		if l < unix.SizeofNlAttr || pos+l > len(b) {
+			break
+		}
+		attrs = append(attrs, rawAttribute{
+			typ:    nlenc.Uint16(b[pos+2:pos+4]) & nlaTypeMask,
+			offset: pos,
+			length: l,
+			data:   b[pos+unix.SizeofNlAttr : pos+l],
+		})
+		pos += (l + unix.NLA_ALIGNTO - 1) &^ (unix.NLA_ALIGNTO - 1)
+	}
+
+	return attrs
+}
+
+// locateExpr returns the position and the name of the expression of the rule message the offset
+// points into, false is returned if the offset does not point into an expression.
+func locateExpr(m netlink.Message, offset uint32) (int, string, bool) {
+	if uint16(m.Header.Type)&0xff != unix.NFT_MSG_NEWRULE {
+		return 0, "", false
+	}
+	// Offsets count from the start of the message header, attributes follow nfgenmsg header
+	start := unix.SizeofNlMsghdr + 4
+	if int(offset) < start || len(m.Data) < 4 {
+		return 0, "", false
+	}
+	pos := int(offset) - start
+	for _, a := range parseAttributes(m.Data[4:]) {
+		if a.typ != unix.NFTA_RULE_EXPRESSIONS || pos < a.offset || pos >= a.offset+a.length {
+			continue
+		}
+		base := a.offset + unix.SizeofNlAttr
+		for i, e := range parseAttributes(a.data) {
+			if pos < base+e.offset || pos >= base+e.offset+e.length {
+				continue
+			}
+			for _, ea := range parseAttributes(e.data) {
+				if ea.typ == unix.NFTA_EXPR_NAME {
+					return i, strings.TrimRight(string(ea.data), "\x00"), true
+				}
+			}
+			return i, "", true
+		}
+	}
+
+	return 0, "", false
+}
+
+// batchError returns BatchError describing the operation rejected by NLMSG_ERROR message, the extended
+// acknowledgement of the kernel is added when the message carries it.
+func batchError(sent netlink.Message, m syscall.NetlinkMessage, code error) *BatchError {
+	be := describeMessage(sent)
+	be.Err = code
+	ack := parseExtAck(m)
+	if ack == nil {
+		return be
+	}
+	be.Message, be.Offset = ack.message, ack.offset
+	if i, name, ok := locateExpr(sent, ack.offset); ok {
+		be.ExprIndex, be.ExprName = i, name
+	}
+
+	return be
+}
@@ -0,0 +1,127 @@
+package nftableslib
+
+import (
+	"bytes"
+	"syscall"
+	"testing"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"github.com/mdlayher/netlink"
+	"github.com/mdlayher/netlink/nlenc"
+	"golang.org/x/sys/unix"
+)
+
+// extAckAttr returns a netlink attribute of the extended acknowledgement padded to 4 bytes
+func extAckAttr(typ uint16, data []byte) []byte {
+	b := append(nlenc.Uint16Bytes(uint16(unix.SizeofNlAttr+len(data))), nlenc.Uint16Bytes(typ)...)
+	b = append(b, data...)
+	for len(b)%unix.NLA_ALIGNTO != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+func TestBatchErrorExtAck(t *testing.T) {
+	var batch []netlink.Message
+	conn := &nftables.Conn{TestDial: func(req []netlink.Message) ([]netlink.Message, error) {
+		batch = append(batch, req...)
+		return nil, nil
+	}}
+	table := &nftables.Table{Name: "filter", Family: nftables.TableFamilyIPv4}
+	conn.AddRule(&nftables.Rule{
+		Table: table,
+		Chain: &nftables.Chain{Name: "input", Table: table},
+		Exprs: []expr.Any{
+			&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{unix.IPPROTO_TCP}},
+			&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 2, Len: 2},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{0, 22}},
+		},
+	})
+	if err := conn.Flush(); err != nil {
+		t.Fatalf("failed to flush with error: %+v", err)
+	}
+	rule := batch[1]
+	rule.Header.Length = uint32(unix.SizeofNlMsghdr + len(rule.Data))
+	raw, err := rule.MarshalBinary()
+	if err != nil {
+		t.Fatalf("failed to marshal message with error: %+v", err)
+	}
+	// The kernel reports the offset of the rejected attribute from the start of the message
+	payload := uint32(unix.SizeofNlMsghdr + bytes.Index(rule.Data, []byte("payload\x00")))
+	tableAttr := uint32(unix.SizeofNlMsghdr + 4)
+	msg := "Could not process rule: No such file or directory"
+	errno := nlenc.Int32Bytes(-int32(unix.ENOENT))
+	tlvs := func(offset uint32, message string) []byte {
+		b := []byte{}
+		if message != "" {
+			b = append(b, extAckAttr(nlmsgerrAttrMsg, append([]byte(message), 0))...)
+		}
+		if offset != 0 {
+			b = append(b, extAckAttr(nlmsgerrAttrOffs, nlenc.Uint32Bytes(offset))...)
+		}
+		return b
+	}
+	concat := func(parts ...[]byte) []byte {
+		return bytes.Join(parts, nil)
+	}
+	tests := []struct {
+		name      string
+		flags     uint16
+		data      []byte
+		message   string
+		offset    uint32
+		exprIndex int
+		exprName  string
+	}{
+		{
+			name:      "Capped reply with message and expression offset",
+			flags:     unix.NLM_F_CAPPED | unix.NLM_F_ACK_TLVS,
+			data:      concat(errno, raw[:unix.SizeofNlMsghdr], tlvs(payload, msg)),
+			message:   msg,
+			offset:    payload,
+			exprIndex: 2,
+			exprName:  "payload",
+		},
+		{
+			name:      "Reply echoing the rejected message",
+			flags:     unix.NLM_F_ACK_TLVS,
+			data:      concat(errno, raw, tlvs(payload, "")),
+			offset:    payload,
+			exprIndex: 2,
+			exprName:  "payload",
+		},
+		{
+			name:    "Offset of an attribute other than expressions",
+			flags:   unix.NLM_F_CAPPED | unix.NLM_F_ACK_TLVS,
+			data:    concat(errno, raw[:unix.SizeofNlMsghdr], tlvs(tableAttr, msg)),
+			message: msg,
+			offset:  tableAttr,
+		},
+		{
+			name:  "Reply without extended acknowledgement",
+			flags: unix.NLM_F_CAPPED,
+			data:  concat(errno, raw[:unix.SizeofNlMsghdr]),
+		},
+	}
+	for _, tt := range tests {
+		m := syscall.NetlinkMessage{
+			Header: syscall.NlMsghdr{Type: unix.NLMSG_ERROR, Flags: tt.flags},
+			Data:   tt.data,
+		}
+		be := batchError(rule, m, unix.ENOENT)
+		if be.Err != unix.ENOENT || be.Operation != "add rule" || be.Chain != "input" {
+			t.Errorf("Test \"%s\" failed, unexpected operation %+v", tt.name, *be)
+			continue
+		}
+		if be.Message != tt.message || be.Offset != tt.offset || be.ExprName != tt.exprName || be.ExprIndex != tt.exprIndex {
+			t.Errorf("Test \"%s\" failed, expected message %q offset %d expression %d (%s), got %q offset %d expression %d (%s)",
+				tt.name, tt.message, tt.offset, tt.exprIndex, tt.exprName, be.Message, be.Offset, be.ExprIndex, be.ExprName)
+			continue
+		}
+		if tt.message != "" && !bytes.Contains([]byte(be.Error()), []byte(tt.message)) {
+			t.Errorf("Test \"%s\" failed, error %q does not carry the message", tt.name, be.Error())
+		}
+	}
+}
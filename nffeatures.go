@@ -0,0 +1,158 @@
+package nftableslib
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/google/nftables"
+	"golang.org/x/sys/unix"
+)
+
+// Features of the kernel some generated expressions depend on, ErrUnsupportedByKernel names them.
+const (
+	FeatureConcatInterval = "concatenated interval sets"
+	FeatureSynproxy       = "synproxy expression"
+	FeatureEgressHook     = "egress hook"
+	FeatureChainBinding   = "chain binding"
+)
+
+// ChainHookEgress is the hook of netdev chains processing packets sent by the device
+const ChainHookEgress nftables.ChainHook = 1
+
+// KernelFeatures lists features of the kernel the library emits only when the kernel supports them,
+// generators either fall back to expressions older kernels support or fail with ErrUnsupportedByKernel.
+type KernelFeatures struct {
+	// ConcatInterval is true if sets with concatenated keys can carry intervals, kernels 5.7 and newer,
+	// otherwise rules matching concatenated intervals are split into a rule per interval.
+	ConcatInterval bool
+	// Synproxy is true if the synproxy expression is available, kernels 5.3 and newer
+	Synproxy bool
+	// EgressHook is true if netdev chains can be attached to the egress hook, kernels 5.16 and newer
+	EgressHook bool
+	// ChainBinding is true if chains can be bound to the rule jumping to them, kernels 5.9 and newer
+	ChainBinding bool
+}
+
+// featureVersions lists kernel versions introducing the features
+var featureVersions = []struct {
+	major, minor int
+	set          func(*KernelFeatures)
+}{
+	{5, 3, func(f *KernelFeatures) { f.Synproxy = true }},
+	{5, 7, func(f *KernelFeatures) { f.ConcatInterval = true }},
+	{5, 9, func(f *KernelFeatures) { f.ChainBinding = true }},
+	{5, 16, func(f *KernelFeatures) { f.EgressHook = true }},
+}
+
+// ErrUnsupportedByKernel is returned when the operation needs a feature the kernel does not support
+type ErrUnsupportedByKernel struct {
+	Feature string
+}
+
+func (e *ErrUnsupportedByKernel) Error() string {
+	return fmt.Sprintf("%s is not supported by the kernel", e.Feature)
+}
+
+// FeaturesConn defines an optional interface of the connection, connections implementing it report
+// features of the kernel instead of the library detecting them.
+type FeaturesConn interface {
+	KernelFeatures() (*KernelFeatures, error)
+}
+
+// WithKernelFeatures makes the library use the features instead of detecting them
+func WithKernelFeatures(f KernelFeatures) TablesOption {
+	return func(nft *nfTables) {
+		nft.features.features = &f
+	}
+}
+
+// featureProbe detects features of the kernel once per connection. Features of the kernel of
+// github.com/google/nftables connections are derived from the kernel version, other connections
+// which do not implement FeaturesConn do not talk to the kernel and support every feature.
+type featureProbe struct {
+	conn NetNS
+	sync.Mutex
+	features *KernelFeatures
+}
+
+func (p *featureProbe) get() (*KernelFeatures, error) {
+	if p == nil {
+		return allFeatures(), nil
+	}
+	p.Lock()
+	defer p.Unlock()
+	if p.features == nil {
+		f, err := probeFeatures(p.conn)
+		if err != nil {
+			return nil, fmt.Errorf("failed to detect features of the kernel with error: %+v", err)
+		}
+		p.features = f
+	}
+	f := *p.features
+
+	return &f, nil
+}
+
+func probeFeatures(conn NetNS) (*KernelFeatures, error) {
+	switch c := conn.(type) {
+	case FeaturesConn:
+		return c.KernelFeatures()
+	case *nftables.Conn:
+		var uts unix.Utsname
+		if err := unix.Uname(&uts); err != nil {
+			return nil, err
+		}
+		release := uts.Release[:]
+		if i := bytes.IndexByte(release, 0); i >= 0 {
+			release = release[:i]
+		}
+		return featuresOfRelease(string(release))
+	}
+
+	return allFeatures(), nil
+}
+
+// featuresOfRelease returns features of the kernel of the release, like 5.4.0-42-generic
+func featuresOfRelease(release string) (*KernelFeatures, error) {
+	parts := strings.SplitN(release, ".", 3)
+	if len(parts) < 2 {
+		return nil, fmt.Errorf("invalid kernel release %q", release)
+	}
+	major, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid kernel release %q", release)
+	}
+	minor := parts[1]
+	if i := strings.IndexFunc(minor, func(r rune) bool { return r < '0' || r > '9' }); i >= 0 {
+		minor = minor[:i]
+	}
+	m, err := strconv.Atoi(minor)
+	if err != nil {
+		return nil, fmt.Errorf("invalid kernel release %q", release)
+	}
+	f := &KernelFeatures{}
+	for _, v := range featureVersions {
+		if major > v.major || major == v.major && m >= v.minor {
+			v.set(f)
+		}
+	}
+
+	return f, nil
+}
+
+func allFeatures() *KernelFeatures {
+	f := &KernelFeatures{}
+	for _, v := range featureVersions {
+		v.set(f)
+	}
+
+	return f
+}
+
+// KernelFeatures returns features of the kernel of the connection, they are detected once
+func (nft *nfTables) KernelFeatures() (*KernelFeatures, error) {
+	return nft.features.get()
+}
@@ -0,0 +1,112 @@
+package nftableslib
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/google/nftables"
+)
+
+func TestFeaturesOfRelease(t *testing.T) {
+	tests := []struct {
+		name     string
+		release  string
+		features KernelFeatures
+		success  bool
+	}{
+		{
+			name:     "4.19 kernel",
+			release:  "4.19.0-18-amd64",
+			features: KernelFeatures{},
+			success:  true,
+		},
+		{
+			name:     "5.4 kernel",
+			release:  "5.4.0-42-generic",
+			features: KernelFeatures{Synproxy: true},
+			success:  true,
+		},
+		{
+			name:     "5.7 kernel without patch level",
+			release:  "5.7",
+			features: KernelFeatures{Synproxy: true, ConcatInterval: true},
+			success:  true,
+		},
+		{
+			name:     "5.15 kernel",
+			release:  "5.15.0-rc3",
+			features: KernelFeatures{Synproxy: true, ConcatInterval: true, ChainBinding: true},
+			success:  true,
+		},
+		{
+			name:     "6.1 kernel",
+			release:  "6.1.0-13-cloud-amd64",
+			features: KernelFeatures{Synproxy: true, ConcatInterval: true, EgressHook: true, ChainBinding: true},
+			success:  true,
+		},
+		{
+			name:    "no minor version",
+			release: "6",
+			success: false,
+		},
+		{
+			name:    "non numeric major version",
+			release: "v5.4.0",
+			success: false,
+		},
+	}
+	for _, tt := range tests {
+		f, err := featuresOfRelease(tt.release)
+		if err != nil && tt.success {
+			t.Fatalf("Test \"%s\" failed with error: %+v but supposed to succeed", tt.name, err)
+		}
+		if err == nil && !tt.success {
+			t.Fatalf("Test \"%s\" succeeded but supposed to fail", tt.name)
+		}
+		if !tt.success {
+			continue
+		}
+		if !reflect.DeepEqual(*f, tt.features) {
+			t.Fatalf("Test \"%s\" failed, expected features %+v, got %+v", tt.name, tt.features, *f)
+		}
+	}
+}
+
+func TestConcatIntervalSetMessages(t *testing.T) {
+	concat := &Concat{
+		Elements: []*ConcatElement{
+			{EType: nftables.TypeIPAddr, ESource: true},
+			{EType: nftables.TypeInetService},
+		},
+		Intervals: [][]*ConcatRange{
+			{{From: []byte{10, 0, 0, 0}, To: []byte{10, 255, 255, 255}}, {From: []byte{0, 80}, To: []byte{0, 80}}},
+			{{From: []byte{192, 168, 0, 0}, To: []byte{192, 168, 255, 255}}, {From: []byte{1, 0}, To: []byte{1, 255}}},
+		},
+	}
+	_, s, err := getExprForConcatIntervals(nftables.TableFamilyIPv4, concat, defaultIDs)
+	if err != nil {
+		t.Fatalf("failed to generate expressions with error: %+v", err)
+	}
+	if s == nil || !reflect.DeepEqual(s.fields, []uint32{4, 2}) {
+		t.Fatalf("expected concatenated interval set with fields of 4 and 2 bytes, got %+v", s)
+	}
+	// Ports are padded to 4 bytes in keys of the set
+	if e := s.elements[3]; !e.IntervalEnd || !reflect.DeepEqual(e.Key, []byte{192, 168, 255, 255, 1, 255, 0, 0}) {
+		t.Fatalf("unexpected end of the second interval %+v", e)
+	}
+	s.set.Table = &nftables.Table{Name: "filter", Family: nftables.TableFamilyIPv4}
+	msgs, err := concatIntervalSetMessages(s)
+	if err != nil {
+		t.Fatalf("failed to build messages with error: %+v", err)
+	}
+	if len(msgs) != 2 {
+		t.Fatalf("expected messages of the set and its elements, got %d messages", len(msgs))
+	}
+
+	if _, _, err := getExprForConcatIntervals(nftables.TableFamilyIPv4, &Concat{
+		Elements:  concat.Elements,
+		Intervals: [][]*ConcatRange{{{From: []byte{10, 0, 0, 0}, To: []byte{10, 0, 0, 1}}}},
+	}, defaultIDs); err == nil {
+		t.Fatalf("interval missing the range of the port is supposed to fail")
+	}
+}
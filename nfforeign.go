@@ -0,0 +1,176 @@
+package nftableslib
+
+import (
+	"fmt"
+
+	"github.com/google/nftables"
+)
+
+// ForeignRulePolicy defines how rules found in chains of the library which were not created by it,
+// for example rules added by nft CLI, are treated when rules of the chain are loaded by Sync or
+// reconciled by ApplyRuleset. Rules are foreign when their user data does not carry the rule ID TLV.
+type ForeignRulePolicy int
+
+const (
+	// ForeignRulesDefault applies the policy of the chain's table set by WithForeignRulePolicy,
+	// tables preserve foreign rules by default.
+	ForeignRulesDefault ForeignRulePolicy = iota
+	// ForeignRulesPreserve keeps foreign rules in their positions relative to rules of the library,
+	// rules of the library are replaced in place and new rules are appended after foreign ones.
+	ForeignRulesPreserve
+	// ForeignRulesReject fails Sync and ApplyRuleset with ErrForeignRules listing foreign rules
+	ForeignRulesReject
+	// ForeignRulesRemove deletes foreign rules from the chain
+	ForeignRulesRemove
+)
+
+// ErrForeignRules is returned when a chain with ForeignRulesReject policy carries foreign rules
+type ErrForeignRules struct {
+	Table string
+	Chain string
+	// Handles lists handles of foreign rules in the order of the chain
+	Handles []uint64
+}
+
+func (e *ErrForeignRules) Error() string {
+	return fmt.Sprintf("chain %s of table %s carries foreign rules with handles %v", e.Chain, e.Table, e.Handles)
+}
+
+// WithForeignRulePolicy sets the policy applied to foreign rules of chains of the table, chains
+// can override it by SetForeignRulePolicy. The policy applies to chains loaded by Sync as well, the table
+// must be created in the store before Sync to load its chains with the policy.
+func WithForeignRulePolicy(policy ForeignRulePolicy) TableOption {
+	return func(o *tableOptions) {
+		o.foreignRules = policy
+	}
+}
+
+// foreignRulePolicy returns the table's policy applied to foreign rules
+func (o *tableOptions) foreignRulePolicy() ForeignRulePolicy {
+	if o == nil {
+		return ForeignRulesPreserve
+	}
+	o.Lock()
+	defer o.Unlock()
+	if o.foreignRules == ForeignRulesDefault {
+		return ForeignRulesPreserve
+	}
+
+	return o.foreignRules
+}
+
+func (p ForeignRulePolicy) validate() error {
+	if p < ForeignRulesDefault || p > ForeignRulesRemove {
+		return fmt.Errorf("invalid foreign rule policy %d", p)
+	}
+
+	return nil
+}
+
+// SetForeignRulePolicy sets the policy applied to foreign rules of the chain, ForeignRulesDefault
+// makes the chain follow the table's policy.
+func (nfc *nfChains) SetForeignRulePolicy(name string, policy ForeignRulePolicy) error {
+	if err := policy.validate(); err != nil {
+		return err
+	}
+	nfc.Lock()
+	defer nfc.Unlock()
+	ch, ok := nfc.chains[name]
+	if !ok {
+		return fmt.Errorf("chain %s does not exist", name)
+	}
+	ch.foreign = policy
+
+	return nil
+}
+
+// foreignRulePolicy returns the policy applied to foreign rules of the chain
+func (nfc *nfChains) foreignRulePolicy(name string) ForeignRulePolicy {
+	nfc.Lock()
+	ch, ok := nfc.chains[name]
+	nfc.Unlock()
+	if ok && ch.foreign != ForeignRulesDefault {
+		return ch.foreign
+	}
+
+	return nfc.opts.foreignRulePolicy()
+}
+
+// foreignRulePolicy returns the policy applied to foreign rules of the store's chain
+func (nfr *nfRules) foreignRulePolicy() ForeignRulePolicy {
+	if nfr.chains == nil {
+		return nfr.opts.foreignRulePolicy()
+	}
+
+	return nfr.chains.foreignRulePolicy(nfr.chain.Name)
+}
+
+// isForeignRule returns true if the rule was not created by the library
+func isForeignRule(rule *nftables.Rule) bool {
+	_, ok := RuleIDFromUserData(rule.UserData)
+	return !ok
+}
+
+// applyForeignRulePolicy applies the policy to foreign rules among the rules programmed in the chain
+// and returns the rules kept in the chain. Deletion of removed rules is queued, the store drops them.
+func (nfr *nfRules) applyForeignRulePolicy(policy ForeignRulePolicy, programmed []*nftables.Rule) ([]*nftables.Rule, error) {
+	foreign := make([]uint64, 0)
+	for _, r := range programmed {
+		if isForeignRule(r) {
+			foreign = append(foreign, r.Handle)
+		}
+	}
+	if len(foreign) == 0 || policy == ForeignRulesPreserve {
+		return programmed, nil
+	}
+	if policy == ForeignRulesReject {
+		return nil, &ErrForeignRules{Table: nfr.table.Name, Chain: nfr.chain.Name, Handles: foreign}
+	}
+	if err := writable(nfr.conn); err != nil {
+		return nil, err
+	}
+	kept := make([]*nftables.Rule, 0, len(programmed)-len(foreign))
+	for _, r := range programmed {
+		if !isForeignRule(r) {
+			kept = append(kept, r)
+			continue
+		}
+		if err := nfr.conn.DelRule(&nftables.Rule{Table: nfr.table, Chain: nfr.chain, Handle: r.Handle}); err != nil {
+			return nil, err
+		}
+		nfr.Lock()
+		if rr, err := getRuleByHandle(nfr.rules, r.Handle); err == nil {
+			nfr.removeRule(rr.id)
+		}
+		nfr.Unlock()
+	}
+
+	return kept, nil
+}
+
+// adoptRuleIDs makes rules of the library loaded into the empty store keep IDs their user data carries,
+// so foreign rules preceding them do not shift their IDs. Foreign rules get IDs following the largest one.
+func (nfr *nfRules) adoptRuleIDs() {
+	max := uint32(0)
+	for r := nfr.rules; r != nil; r = r.next {
+		if id, ok := RuleIDFromUserData(r.rule.UserData); ok && id > max {
+			max = id
+		}
+	}
+	next := max + ruleIDIncrement
+	if next < initialRuleID {
+		next = initialRuleID
+	}
+	// Rules carrying the same ID, left by replaced rules generating multiple rules, get new IDs
+	adopted := make(map[uint32]bool)
+	for r := nfr.rules; r != nil; r = r.next {
+		if id, ok := RuleIDFromUserData(r.rule.UserData); ok && !adopted[id] {
+			adopted[id] = true
+			r.id = id
+			continue
+		}
+		r.id = next
+		next += ruleIDIncrement
+	}
+	nfr.currentID = next
+}
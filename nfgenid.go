@@ -0,0 +1,126 @@
+package nftableslib
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/google/nftables"
+	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// nftMsgNewGen and nftMsgGetGen are types of nftables messages carrying the ruleset generation
+	nftMsgNewGen = 0x0f
+	nftMsgGetGen = 0x10
+	// nftaGenID is the attribute of NFT_MSG_NEWGEN message carrying the generation ID
+	nftaGenID = 0x1
+)
+
+// GenIDReader defines an optional interface of the connection, connections which are not
+// *nftables.Conn implement it to report the generation of the ruleset.
+type GenIDReader interface {
+	GetGenID() (uint32, error)
+}
+
+// GenAfter returns true if generation a is newer than generation b, generation IDs wrap around,
+// so a is newer if it is less than 2^31 generations ahead of b.
+func GenAfter(a, b uint32) bool {
+	return int32(a-b) > 0
+}
+
+// GetGenID returns the generation ID of the ruleset, the kernel bumps the ID with every committed
+// transaction, so comparing IDs is a cheap way to detect changes made by other applications.
+func (nft *nfTables) GetGenID() (uint32, error) {
+	return getGenID(nft.conn)
+}
+
+// ChangedSince returns true if the ruleset was changed after generation gen was read. Generations
+// are compared for equality, so the comparison is not affected by the wraparound of IDs.
+func (nft *nfTables) ChangedSince(gen uint32) (bool, error) {
+	current, err := getGenID(nft.conn)
+	if err != nil {
+		return false, err
+	}
+
+	return current != gen, nil
+}
+
+// consistentGen calls read between two reads of the generation ID and returns the generation the
+// read state belongs to. If the ruleset changes while read is called, read is called again, up to
+// retries times, after that the error is returned.
+func consistentGen(genID func() (uint32, error), retries int, read func() error) (uint32, error) {
+	for i := 0; i <= retries; i++ {
+		before, err := genID()
+		if err != nil {
+			return 0, err
+		}
+		if err := read(); err != nil {
+			return 0, err
+		}
+		after, err := genID()
+		if err != nil {
+			return 0, err
+		}
+		if before == after {
+			return after, nil
+		}
+	}
+
+	return 0, fmt.Errorf("ruleset kept changing while it was read")
+}
+
+// getGenID requests the generation ID of the ruleset
+func getGenID(conn NetNS) (uint32, error) {
+	if r, ok := conn.(GenIDReader); ok {
+		return r.GetGenID()
+	}
+	c, ok := conn.(*nftables.Conn)
+	if !ok {
+		return 0, fmt.Errorf("connection does not report generation of the ruleset")
+	}
+	nc, err := dialNetfilter(c)
+	if err != nil {
+		return 0, err
+	}
+	defer nc.Close()
+
+	msgs, err := nc.Execute(netlink.Message{
+		Header: netlink.Header{
+			Type:  netlink.HeaderType((unix.NFNL_SUBSYS_NFTABLES << 8) | nftMsgGetGen),
+			Flags: netlink.Request | netlink.Acknowledge,
+		},
+		// nfgenmsg header: family, version and resource id
+		Data: []byte{unix.NFPROTO_UNSPEC, unix.NFNETLINK_V0, 0, 0},
+	})
+	if err != nil {
+		return 0, err
+	}
+	for _, m := range msgs {
+		if m.Header.Type != netlink.HeaderType((unix.NFNL_SUBSYS_NFTABLES<<8)|nftMsgNewGen) || len(m.Data) < 4 {
+			continue
+		}
+		return genIDFromMessage(m.Data)
+	}
+
+	return 0, fmt.Errorf("generation of the ruleset is not reported")
+}
+
+// genIDFromMessage decodes the generation ID carried by NFT_MSG_NEWGEN message
+func genIDFromMessage(b []byte) (uint32, error) {
+	ad, err := netlink.NewAttributeDecoder(b[4:])
+	if err != nil {
+		return 0, err
+	}
+	ad.ByteOrder = binary.BigEndian
+	for ad.Next() {
+		if ad.Type() == nftaGenID {
+			return ad.Uint32(), nil
+		}
+	}
+	if err := ad.Err(); err != nil {
+		return 0, err
+	}
+
+	return 0, fmt.Errorf("message does not carry generation id")
+}
@@ -0,0 +1,49 @@
+package nftableslib
+
+import (
+	"testing"
+
+	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
+)
+
+func TestGenIDFromMessage(t *testing.T) {
+	attrs, err := netlink.MarshalAttributes([]netlink.Attribute{
+		{Type: nftaGenID, Data: []byte{0x0, 0x0, 0x6, 0xd0}},
+		// NFTA_GEN_PROC_PID
+		{Type: 0x2, Data: []byte{0x0, 0x0, 0x0, 0x1}},
+	})
+	if err != nil {
+		t.Fatalf("failed to marshal attributes with error: %+v", err)
+	}
+	tests := []struct {
+		name    string
+		data    []byte
+		gen     uint32
+		success bool
+	}{
+		{
+			name:    "generation",
+			data:    append([]byte{unix.NFPROTO_UNSPEC, unix.NFNETLINK_V0, 0x6, 0xd0}, attrs...),
+			gen:     0x6d0,
+			success: true,
+		},
+		{
+			name:    "no generation",
+			data:    []byte{unix.NFPROTO_UNSPEC, unix.NFNETLINK_V0, 0x0, 0x0},
+			success: false,
+		},
+	}
+	for _, tt := range tests {
+		gen, err := genIDFromMessage(tt.data)
+		if err != nil && tt.success {
+			t.Fatalf("Test \"%s\" failed with error: %+v but supposed to succeed", tt.name, err)
+		}
+		if err == nil && !tt.success {
+			t.Fatalf("Test \"%s\" succeeded but supposed to fail", tt.name)
+		}
+		if tt.success && gen != tt.gen {
+			t.Fatalf("Test \"%s\" failed, expected generation %d, got %d", tt.name, tt.gen, gen)
+		}
+	}
+}
@@ -0,0 +1,354 @@
+package nftableslib
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/google/nftables"
+)
+
+// GeoChainPrefix defines the prefix of the chain dropping packets with a source in the geo sets
+const GeoChainPrefix = "geo-"
+
+// GeoSetOptions defines how LoadGeoSet programs the geo sets
+type GeoSetOptions struct {
+	// Chain defines attributes of the chain dropping packets with a source in the geo sets, the chain is
+	// a base chain when Hook is set, otherwise it is a regular chain the caller jumps to. nil means a regular chain.
+	Chain *ChainAttributes
+	// ChunkSize is the number of elements programmed by a single transaction, 0 means DefaultElementsChunkSize
+	ChunkSize int
+	// Progress is called after every chunk, it must not call the library
+	Progress func(GeoProgress)
+}
+
+// GeoProgress is reported by LoadGeoSet after every chunk of elements
+type GeoProgress struct {
+	Family nftables.TableFamily
+	// Removed is true for chunks removing stale intervals, they are programmed before chunks adding intervals
+	Removed bool
+	Chunk   int
+	Chunks  int
+}
+
+// GeoSetStats reports the result of LoadGeoSet, intervals are counted after prefixes are merged
+type GeoSetStats struct {
+	Prefixes  int
+	Intervals map[nftables.TableFamily]int
+	// Added and Removed count intervals changed on the host, intervals found on the host are kept
+	Added   int
+	Removed int
+}
+
+// GeoSetNames returns names of the IPv4 and the IPv6 geo sets
+func GeoSetNames(name string) (string, string) {
+	return name + "-v4", name + "-v6"
+}
+
+// geoInterval is an interval [start, end) of addresses, end of an interval found on the host
+// is nil if the interval reaches the end of the address space.
+type geoInterval struct {
+	start, end []byte
+}
+
+func (i geoInterval) key() string {
+	return string(i.start) + "-" + string(i.end)
+}
+
+func (i geoInterval) elements() []nftables.SetElement {
+	if i.end == nil {
+		return []nftables.SetElement{{Key: i.start}}
+	}
+	return []nftables.SetElement{{Key: i.start}, {Key: i.end, IntervalEnd: true}}
+}
+
+// LoadGeoSet makes a pair of interval sets of the inet table carry prefixes read from r and makes sure
+// the chain GeoChainPrefix+name drops packets with a source in either set. The table, the sets and the chain
+// are created if they do not exist. r carries a prefix or an address per line, lines starting with '#' are
+// ignored, only the first field of a line separated by a comma or a white space is used, so CSV exports
+// of MMDB databases can be read directly. Overlapping and adjacent prefixes are merged.
+// When the sets exist, only intervals which changed are removed and added, stale intervals are removed
+// first, so addresses of changed intervals are not matched while the sets are updated. Elements are
+// programmed in chunks, every chunk is a separate transaction.
+func LoadGeoSet(nft TablesInterface, table, name string, r io.Reader, opts *GeoSetOptions) (*GeoSetStats, error) {
+	if opts == nil {
+		opts = &GeoSetOptions{}
+	}
+	intervals, n, err := readGeoPrefixes(r)
+	if err != nil {
+		return nil, err
+	}
+	family := nftables.TableFamilyINet
+	ci, err := nft.Tables().Table(table, family)
+	if err != nil {
+		// The table is not in the store, it might have been programmed by a previous load
+		if _, err := nft.Tables().SyncTable(table, family); err != nil {
+			return nil, err
+		}
+		if ci, err = nft.Tables().Table(table, family); err != nil {
+			if err := nft.Tables().CreateImm(table, family); err != nil {
+				return nil, err
+			}
+			if ci, err = nft.Tables().Table(table, family); err != nil {
+				return nil, err
+			}
+		}
+	}
+	si, err := nft.Tables().TableSets(table, family)
+	if err != nil {
+		return nil, err
+	}
+	stats := &GeoSetStats{Prefixes: n, Intervals: make(map[nftables.TableFamily]int)}
+	sets := make([]*nftables.Set, 0, 2)
+	for _, f := range []nftables.TableFamily{nftables.TableFamilyIPv4, nftables.TableFamilyIPv6} {
+		set, err := loadGeoFamily(si, geoSetName(name, f), f, intervals[f], opts, stats)
+		if err != nil {
+			return nil, err
+		}
+		sets = append(sets, set)
+		stats.Intervals[f] = len(intervals[f])
+	}
+	if err := ensureGeoChain(ci, GeoChainPrefix+name, sets, opts.Chain); err != nil {
+		return nil, err
+	}
+
+	return stats, nil
+}
+
+// loadGeoFamily creates the set of the family if it does not exist and reconciles its intervals
+func loadGeoFamily(si SetsInterface, name string, f nftables.TableFamily, intervals []geoInterval,
+	opts *GeoSetOptions, stats *GeoSetStats) (*nftables.Set, error) {
+	keyType := nftables.TypeIPAddr
+	if f == nftables.TableFamilyIPv6 {
+		keyType = nftables.TypeIP6Addr
+	}
+	var current []geoInterval
+	if _, err := si.Sets().GetSetByName(name); err != nil {
+		if _, err := si.Sets().CreateSet(&SetAttributes{Name: name, Interval: true, KeyType: keyType}, nil); err != nil {
+			return nil, fmt.Errorf("failed to create geo set %s with error: %+v", name, err)
+		}
+	} else {
+		elements, err := si.Sets().GetSetElements(name)
+		if err != nil {
+			return nil, err
+		}
+		if current, err = geoIntervals(elements); err != nil {
+			return nil, fmt.Errorf("set %s %+v", name, err)
+		}
+	}
+	stale, missing := geoIntervalsDiff(current, intervals)
+	stats.Removed += len(stale)
+	stats.Added += len(missing)
+	program := func(removed bool, intervals []geoInterval, op func(string, []nftables.SetElement, ...int) error) error {
+		elements := make([]nftables.SetElement, 0, len(intervals)*2)
+		for _, i := range intervals {
+			elements = append(elements, i.elements()...)
+		}
+		chunks := chunkElements(elements, true, opts.ChunkSize)
+		for i, chunk := range chunks {
+			if err := op(name, chunk, len(chunk)); err != nil {
+				return err
+			}
+			if opts.Progress != nil {
+				opts.Progress(GeoProgress{Family: f, Removed: removed, Chunk: i, Chunks: len(chunks)})
+			}
+		}
+		return nil
+	}
+	if err := program(true, stale, si.Sets().SetDelElementsBatch); err != nil {
+		return nil, err
+	}
+	if len(missing) != 0 {
+		// Every interval takes two elements
+		warnSetLoad(si, name, len(intervals)*2)
+	}
+	if err := program(false, missing, si.Sets().SetAddElementsBatch); err != nil {
+		return nil, err
+	}
+
+	return si.Sets().GetSetByName(name)
+}
+
+// ensureGeoChain creates the chain with rules dropping packets with a source in the geo sets,
+// rules are not added if the chain carries rules.
+func ensureGeoChain(ci ChainsInterface, name string, sets []*nftables.Set, attrs *ChainAttributes) error {
+	if !ci.Chains().Exist(name) {
+		if err := ci.Chains().CreateImm(name, attrs); err != nil {
+			return err
+		}
+	}
+	if n, err := ci.Chains().RuleCount(name); err != nil || n != 0 {
+		return err
+	}
+	ri, err := ci.Chains().Chain(name)
+	if err != nil {
+		return err
+	}
+	drop, _ := SetVerdict(NFT_DROP)
+	for i, f := range []nftables.TableFamily{nftables.TableFamilyIPv4, nftables.TableFamilyIPv6} {
+		f := f
+		// Source address offset in the network header
+		offset := uint32(12)
+		if f == nftables.TableFamilyIPv6 {
+			offset = 8
+		}
+		lookup, err := getExprForAddrSet(f, offset, &SetRef{Name: sets[i].Name, ID: sets[i].ID}, EQ)
+		if err != nil {
+			return err
+		}
+		if _, err := ri.Rules().CreateImm(&Rule{
+			Meta:     &MetaRule{NFProto: &f},
+			RawExprs: lookup,
+			Action:   drop,
+		}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func geoSetName(name string, f nftables.TableFamily) string {
+	v4, v6 := GeoSetNames(name)
+	if f == nftables.TableFamilyIPv6 {
+		return v6
+	}
+	return v4
+}
+
+// readGeoPrefixes reads prefixes and returns merged intervals of both families along with
+// the number of prefixes read.
+func readGeoPrefixes(r io.Reader) (map[nftables.TableFamily][]geoInterval, int, error) {
+	intervals := make(map[nftables.TableFamily][]geoInterval)
+	n := 0
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		field := strings.FieldsFunc(text, func(r rune) bool { return r == ',' || unicode.IsSpace(r) })[0]
+		// Header of CSV exports
+		if field == "network" {
+			continue
+		}
+		prefix, err := parseGeoPrefix(field)
+		if err != nil {
+			return nil, 0, fmt.Errorf("line %d: %+v", line, err)
+		}
+		f := prefixFamily(prefix)
+		intervals[f] = append(intervals[f], geoInterval{start: []byte(prefix.IP), end: lastKey(prefix)})
+		n++
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, 0, err
+	}
+	for f := range intervals {
+		intervals[f] = mergeGeoIntervals(intervals[f])
+	}
+
+	return intervals, n, nil
+}
+
+// parseGeoPrefix parses a prefix or an address, host bits of the prefix are cleared
+func parseGeoPrefix(addr string) (*net.IPNet, error) {
+	var prefix *net.IPNet
+	if strings.Contains(addr, "/") {
+		_, ipnet, err := net.ParseCIDR(addr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid geo prefix %s: %+v", addr, err)
+		}
+		prefix = ipnet
+	} else {
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid geo address %s", addr)
+		}
+		prefix = &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+	}
+	if ip4 := prefix.IP.To4(); ip4 != nil {
+		prefix.IP = ip4
+		if len(prefix.Mask) == net.IPv6len {
+			prefix.Mask = prefix.Mask[12:]
+		}
+	}
+	// The interval closing the prefix would be beyond the address space
+	if lastKey(prefix) == nil {
+		return nil, fmt.Errorf("geo prefix %s reaching the end of the address space is not supported", prefix.String())
+	}
+
+	return prefix, nil
+}
+
+// mergeGeoIntervals sorts intervals and merges overlapping and adjacent ones
+func mergeGeoIntervals(intervals []geoInterval) []geoInterval {
+	sort.Slice(intervals, func(i, j int) bool {
+		return bytes.Compare(intervals[i].start, intervals[j].start) < 0
+	})
+	merged := make([]geoInterval, 0, len(intervals))
+	for _, i := range intervals {
+		if n := len(merged); n != 0 {
+			last := &merged[n-1]
+			if bytes.Compare(i.start, last.end) <= 0 {
+				if bytes.Compare(i.end, last.end) > 0 {
+					last.end = i.end
+				}
+				continue
+			}
+		}
+		merged = append(merged, i)
+	}
+
+	return merged
+}
+
+// geoIntervals converts elements of an interval set to intervals
+func geoIntervals(elements []nftables.SetElement) ([]geoInterval, error) {
+	sortIntervalElements(elements)
+	intervals := make([]geoInterval, 0, len(elements)/2)
+	for i := 0; i < len(elements); i++ {
+		if elements[i].IntervalEnd {
+			continue
+		}
+		interval := geoInterval{start: elements[i].Key}
+		if i+1 < len(elements) {
+			if !elements[i+1].IntervalEnd {
+				return nil, fmt.Errorf("carries interval starting at %s without end", net.IP(elements[i].Key))
+			}
+			interval.end = elements[i+1].Key
+			i++
+		}
+		intervals = append(intervals, interval)
+	}
+
+	return intervals, nil
+}
+
+// geoIntervalsDiff returns intervals of current which are not wanted and wanted intervals missing in current
+func geoIntervalsDiff(current, want []geoInterval) ([]geoInterval, []geoInterval) {
+	have := make(map[string]bool, len(current))
+	for _, i := range current {
+		have[i.key()] = true
+	}
+	wanted := make(map[string]bool, len(want))
+	missing := make([]geoInterval, 0)
+	for _, i := range want {
+		wanted[i.key()] = true
+		if !have[i.key()] {
+			missing = append(missing, i)
+		}
+	}
+	stale := make([]geoInterval, 0)
+	for _, i := range current {
+		if !wanted[i.key()] {
+			stale = append(stale, i)
+		}
+	}
+
+	return stale, missing
+}
@@ -0,0 +1,325 @@
+package nftableslib
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/google/nftables"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// HairpinPrerouting is the chain of the nat table carrying DNAT rules of hairpin NAT
+	HairpinPrerouting = "prerouting"
+	// HairpinPostrouting is the chain of the nat table carrying masquerade rules of hairpin NAT
+	HairpinPostrouting = "postrouting"
+)
+
+// hairpin is the port forwarded service reachable by internal clients through the external address
+type hairpin struct {
+	family   nftables.TableFamily
+	vip      *IPAddr
+	internal *IPAddr
+	subnet   *IPAddr
+	port     uint16
+	proto    byte
+}
+
+func newHairpin(vip, internal, subnet *IPAddr, port uint16, proto byte) (*hairpin, error) {
+	if vip == nil || internal == nil || subnet == nil {
+		return nil, fmt.Errorf("external address, internal address and internal subnet must be specified")
+	}
+	family, err := hairpinFamily(vip)
+	if err != nil {
+		return nil, err
+	}
+	if vip.IsIPv6() != internal.IsIPv6() || vip.IsIPv6() != subnet.IsIPv6() {
+		return nil, fmt.Errorf("external address %s, internal address %s and internal subnet %s must be of the same family",
+			vip.IP, internal.IP, subnet.IP)
+	}
+	if _, err := hairpinFamily(internal); err != nil {
+		return nil, err
+	}
+	if proto != unix.IPPROTO_TCP && proto != unix.IPPROTO_UDP {
+		return nil, fmt.Errorf("unsupported protocol %d of hairpin nat, only tcp and udp are supported", proto)
+	}
+	if port == 0 {
+		return nil, fmt.Errorf("port of hairpin nat cannot be 0")
+	}
+
+	return &hairpin{family: family, vip: vip, internal: internal, subnet: subnet, port: port, proto: proto}, nil
+}
+
+// hairpinFamily returns the family of the address, the address must be a host address
+func hairpinFamily(addr *IPAddr) (nftables.TableFamily, error) {
+	if addr.IP == nil {
+		return 0, fmt.Errorf("address of hairpin nat cannot be empty")
+	}
+	if addrPrefixLen(addr) != uint8(len(getIP(addr))*8) {
+		return 0, fmt.Errorf("address %s/%d of hairpin nat must be a host address", addr.IP, addrPrefixLen(addr))
+	}
+	if addr.IsIPv6() {
+		return nftables.TableFamilyIPv6, nil
+	}
+
+	return nftables.TableFamilyIPv4, nil
+}
+
+// hairpinKey returns the comment prefix identifying rules of the service
+func hairpinKey(vip *IPAddr, port uint16, proto byte) string {
+	name := "tcp"
+	if proto == unix.IPPROTO_UDP {
+		name = "udp"
+	}
+
+	return "hairpin " + name + " " + net.JoinHostPort(vip.IP.String(), strconv.Itoa(int(port))) + " "
+}
+
+// comment returns the comment of both rules of the service, it changes when the service changes
+func (h *hairpin) comment() string {
+	return hairpinKey(h.vip, h.port, h.proto) +
+		fmt.Sprintf("to %s from %s/%d", h.internal.IP, h.subnet.IP, addrPrefixLen(h.subnet))
+}
+
+// rules returns the DNAT rule of prerouting chain and the masquerade rule of postrouting chain,
+// packets of internal clients sent to the internal address after DNAT are masqueraded, so replies
+// of the server go back through the host instead of directly to the client.
+func (h *hairpin) rules() (*Rule, *Rule, error) {
+	dnat, err := SetDNAT(&NATAttributes{L3Addr: [2]*IPAddr{h.internal}, Port: [2]uint16{h.port}})
+	if err != nil {
+		return nil, nil, err
+	}
+	masq, err := SetMasq(false, false, false)
+	if err != nil {
+		return nil, nil, err
+	}
+	comment := MakeRuleComment(h.comment())
+	pre := &Rule{
+		L3:       &L3Rule{Dst: &IPAddrSpec{List: []*IPAddr{h.vip}}},
+		L4:       &L4Rule{L4Proto: h.proto, Dst: &Port{List: []uint16{h.port}}},
+		Action:   dnat,
+		UserData: comment,
+	}
+	post := &Rule{
+		L3: &L3Rule{
+			Src: &IPAddrSpec{List: []*IPAddr{h.subnet}},
+			Dst: &IPAddrSpec{List: []*IPAddr{h.internal}},
+		},
+		L4:       &L4Rule{L4Proto: h.proto, Dst: &Port{List: []uint16{h.port}}},
+		Action:   masq,
+		UserData: comment,
+	}
+
+	return pre, post, nil
+}
+
+// userDataComment returns the comment carried by the user data of the rule
+func userDataComment(ud []byte) (string, bool) {
+	if len(ud) < 3 || ud[0] != 0x0 || int(ud[1])+2 > len(ud) || ud[1] == 0 {
+		return "", false
+	}
+
+	return string(bytes.TrimRight(ud[2:2+int(ud[1])], "\x00")), true
+}
+
+// hairpinRules returns rules of the chain programmed on the host carrying the comment with the prefix
+func hairpinRules(ri RulesInterface, key string) ([]*nftables.Rule, error) {
+	nfr, ok := ri.(*nfRules)
+	if !ok {
+		return nil, fmt.Errorf("rules interface does not support reading rules from the host")
+	}
+	var rules []*nftables.Rule
+	if err := nfr.opts.readPolicy().do(func() (err error) {
+		rules, err = nfr.conn.GetRule(nfr.table, nfr.chain)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	found := make([]*nftables.Rule, 0)
+	for _, r := range rules {
+		if c, ok := userDataComment(r.UserData); ok && len(c) >= len(key) && c[:len(key)] == key {
+			found = append(found, r)
+		}
+	}
+
+	return found, nil
+}
+
+// hasComment returns true if the chain carries the single rule of the service with the comment
+func hasComment(rules []*nftables.Rule, comment string) bool {
+	if len(rules) != 1 {
+		return false
+	}
+	c, _ := userDataComment(rules[0].UserData)
+
+	return c == comment
+}
+
+// EnsureHairpinNAT makes sure the nat table of the family of vip forwards the port of vip to the internal
+// address and internal clients of subnet reach the service through vip. Prerouting chain of the table
+// carries the DNAT rule and postrouting chain carries the rule masquerading packets of the subnet sent
+// to the internal address after DNAT. The table and chains are created if they are missing, rules
+// of the service are identified by their comment. Calling EnsureHairpinNAT again with the same parameters
+// does not change the ruleset, rules of the service with other internal address or subnet are replaced
+// along with the new rules in a single transaction.
+func EnsureHairpinNAT(nft TablesInterface, table string, vip, internal, subnet *IPAddr, port uint16, proto byte) error {
+	h, err := newHairpin(vip, internal, subnet, port, proto)
+	if err != nil {
+		return err
+	}
+	ci, err := ensureTableChains(nft, table, h.family)
+	if err != nil {
+		return err
+	}
+	if err := ensureChain(ci, HairpinPrerouting, &ChainAttributes{
+		Type:     nftables.ChainTypeNAT,
+		Hook:     nftables.ChainHookPrerouting,
+		Priority: nftables.ChainPriorityNATDest,
+	}); err != nil {
+		return err
+	}
+	if err := ensureChain(ci, HairpinPostrouting, &ChainAttributes{
+		Type:     nftables.ChainTypeNAT,
+		Hook:     nftables.ChainHookPostrouting,
+		Priority: nftables.ChainPriorityNATSource,
+	}); err != nil {
+		return err
+	}
+	pi, err := ci.Chains().Chain(HairpinPrerouting)
+	if err != nil {
+		return err
+	}
+	si, err := ci.Chains().Chain(HairpinPostrouting)
+	if err != nil {
+		return err
+	}
+	key := hairpinKey(vip, port, proto)
+	stalePre, err := hairpinRules(pi, key)
+	if err != nil {
+		return err
+	}
+	stalePost, err := hairpinRules(si, key)
+	if err != nil {
+		return err
+	}
+	if hasComment(stalePre, h.comment()) && hasComment(stalePost, h.comment()) {
+		return nil
+	}
+	pre, post, err := h.rules()
+	if err != nil {
+		return err
+	}
+	pr, sr := pi.(*nfRules), si.(*nfRules)
+	preRules, preBuilt, err := pr.build(pre, operationAdd)
+	if err != nil {
+		return fmt.Errorf("failed to build dnat rule of hairpin nat with error: %+v", err)
+	}
+	postRules, postBuilt, err := sr.build(post, operationAdd)
+	if err != nil {
+		return fmt.Errorf("failed to build masquerade rule of hairpin nat with error: %+v", err)
+	}
+	pr.Lock()
+	preID := pr.queue(preRules, preBuilt, operationAdd, nil)
+	pr.Unlock()
+	sr.Lock()
+	postID := sr.queue(postRules, postBuilt, operationAdd, nil)
+	sr.Unlock()
+
+	if err := replaceHostRules(map[*nfRules][]*nftables.Rule{pr: stalePre, sr: stalePost}); err != nil {
+		return fmt.Errorf("failed to program hairpin nat of %s with error: %+v", key, err)
+	}
+	for nfr, id := range map[*nfRules]uint32{pr: preID, sr: postID} {
+		nfr.Lock()
+		_, err := nfr.updateHandle(id)
+		nfr.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// RemoveHairpinNAT removes both rules of the service forwarding the port of vip from the nat table
+// in a single transaction, rules and chains which do not exist are skipped.
+func RemoveHairpinNAT(nft TablesInterface, table string, vip *IPAddr, port uint16, proto byte) error {
+	if vip == nil {
+		return fmt.Errorf("external address must be specified")
+	}
+	family, err := hairpinFamily(vip)
+	if err != nil {
+		return err
+	}
+	ci, err := nft.Tables().Table(table, family)
+	if err != nil {
+		if _, err := nft.Tables().SyncTable(table, family); err != nil {
+			return err
+		}
+		if ci, err = nft.Tables().Table(table, family); err != nil {
+			return nil
+		}
+	}
+	key := hairpinKey(vip, port, proto)
+	stale := map[*nfRules][]*nftables.Rule{}
+	for _, chain := range []string{HairpinPrerouting, HairpinPostrouting} {
+		if !ci.Chains().Exist(chain) {
+			continue
+		}
+		ri, err := ci.Chains().Chain(chain)
+		if err != nil {
+			return err
+		}
+		rules, err := hairpinRules(ri, key)
+		if err != nil {
+			return err
+		}
+		stale[ri.(*nfRules)] = rules
+	}
+	if err := replaceHostRules(stale); err != nil {
+		return fmt.Errorf("failed to remove hairpin nat of %s with error: %+v", key, err)
+	}
+
+	return nil
+}
+
+// replaceHostRules removes rules programmed on the host along with operations already queued
+// in a single transaction, the rules are removed from stores of their chains as well.
+func replaceHostRules(stale map[*nfRules][]*nftables.Rule) error {
+	var conn NetNS
+	handles := make(map[*nfRules]map[uint64]bool, len(stale))
+	for nfr, rules := range stale {
+		conn = nfr.conn
+		handles[nfr] = make(map[uint64]bool, len(rules))
+		for _, r := range rules {
+			r.Table, r.Chain = nfr.table, nfr.chain
+			if err := nfr.conn.DelRule(r); err != nil {
+				return err
+			}
+			handles[nfr][r.Handle] = true
+		}
+	}
+	if conn == nil {
+		return nil
+	}
+	if err := flush(conn); err != nil {
+		return err
+	}
+	for nfr, h := range handles {
+		nfr.forgetRules(h)
+	}
+
+	return nil
+}
+
+// forgetRules removes rules with the handles from the store
+func (nfr *nfRules) forgetRules(handles map[uint64]bool) {
+	nfr.Lock()
+	defer nfr.Unlock()
+	for _, r := range nfr.dumpRules() {
+		if handles[r.rule.Handle] {
+			nfr.removeRule(r.id)
+		}
+	}
+}
@@ -0,0 +1,282 @@
+package nftableslib
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/google/nftables"
+)
+
+// HookChain is a base chain attached to a hook
+type HookChain struct {
+	Table    *nftables.Table
+	Chain    string
+	Type     nftables.ChainType
+	Priority nftables.ChainPriority
+}
+
+func (hc *HookChain) String() string {
+	return tableName(hc.Table) + " " + hc.Chain
+}
+
+// HookPipeline lists base chains processing packets of the family at the hook ordered by priority,
+// chains of inet tables are part of pipelines of both ip and ip6 families. Chains of netdev family
+// are listed regardless of the device they are bound to.
+type HookPipeline struct {
+	Family nftables.TableFamily
+	Hook   nftables.ChainHook
+	Chains []*HookChain
+}
+
+// Collisions returns groups of chains of the pipeline sharing the priority, the kernel does not
+// define the order chains of a group process packets in.
+func (p *HookPipeline) Collisions() [][]*HookChain {
+	collisions := make([][]*HookChain, 0)
+	for i := 0; i < len(p.Chains); {
+		j := i + 1
+		for j < len(p.Chains) && p.Chains[j].Priority == p.Chains[i].Priority {
+			j++
+		}
+		if j-i > 1 {
+			collisions = append(collisions, p.Chains[i:j])
+		}
+		i = j
+	}
+
+	return collisions
+}
+
+func (p *HookPipeline) String() string {
+	chains := make([]string, 0, len(p.Chains))
+	for _, c := range p.Chains {
+		chains = append(chains, fmt.Sprintf("%s(%d)", c.String(), c.Priority))
+	}
+
+	return fmt.Sprintf("%s %s: %s", familyName(p.Family), hookName(p.Family, p.Hook), strings.Join(chains, " -> "))
+}
+
+// HookPriorityReport lists pipelines of all hooks with base chains attached
+type HookPriorityReport struct {
+	Pipelines []*HookPipeline
+}
+
+// Collisions returns the number of groups of chains sharing the priority of the hook
+func (r *HookPriorityReport) Collisions() int {
+	n := 0
+	for _, p := range r.Pipelines {
+		n += len(p.Collisions())
+	}
+
+	return n
+}
+
+// HookPriorityCollision is raised when a base chain is created with the priority of another base chain
+// of the hook, the order the chains process packets in is undefined. Suggested is the free priority
+// nearest to the requested one, the higher one is suggested if both are equally near.
+type HookPriorityCollision struct {
+	Table     string
+	Chain     string
+	Family    nftables.TableFamily
+	Hook      nftables.ChainHook
+	Priority  nftables.ChainPriority
+	Colliding []*HookChain
+	Suggested nftables.ChainPriority
+}
+
+func (w *HookPriorityCollision) Error() string {
+	colliding := make([]string, 0, len(w.Colliding))
+	for _, c := range w.Colliding {
+		colliding = append(colliding, c.String())
+	}
+
+	return fmt.Sprintf("base chain %s of table %s shares priority %d of hook %s with chains %s, nearest free priority is %d",
+		w.Chain, w.Table, w.Priority, hookName(w.Family, w.Hook), strings.Join(colliding, ", "), w.Suggested)
+}
+
+// WithStrictHookPriorities makes base chains sharing the priority with another base chain of the hook
+// fail with HookPriorityCollision instead of raising the warning.
+func WithStrictHookPriorities() TableOption {
+	return func(o *tableOptions) {
+		o.strictHookPriorities = true
+	}
+}
+
+// hookName returns the name of the hook of the family
+func hookName(family nftables.TableFamily, hook nftables.ChainHook) string {
+	if family == nftables.TableFamilyNetdev {
+		switch hook {
+		case nftables.ChainHookIngress:
+			return "ingress"
+		case ChainHookEgress:
+			return "egress"
+		}
+		return fmt.Sprintf("hook %d", hook)
+	}
+	switch hook {
+	case nftables.ChainHookPrerouting:
+		return "prerouting"
+	case nftables.ChainHookInput:
+		return "input"
+	case nftables.ChainHookForward:
+		return "forward"
+	case nftables.ChainHookOutput:
+		return "output"
+	case nftables.ChainHookPostrouting:
+		return "postrouting"
+	}
+
+	return fmt.Sprintf("hook %d", hook)
+}
+
+// pipelineFamilies returns families of pipelines chains of the family are part of
+func pipelineFamilies(family nftables.TableFamily) []nftables.TableFamily {
+	if family == nftables.TableFamilyINet {
+		return []nftables.TableFamily{nftables.TableFamilyIPv4, nftables.TableFamilyIPv6}
+	}
+
+	return []nftables.TableFamily{family}
+}
+
+// sharesPipeline returns true if chains of both families process packets of the same pipeline
+func sharesPipeline(f1, f2 nftables.TableFamily) bool {
+	for _, p1 := range pipelineFamilies(f1) {
+		for _, p2 := range pipelineFamilies(f2) {
+			if p1 == p2 {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// buildPipelines groups base chains by the family and the hook and orders them by priority,
+// chains of the same priority are ordered by the table and the name.
+func buildPipelines(chains []*nftables.Chain) []*HookPipeline {
+	type key struct {
+		family nftables.TableFamily
+		hook   nftables.ChainHook
+	}
+	pipelines := map[key]*HookPipeline{}
+	for _, c := range chains {
+		if c.Type == "" || c.Table == nil {
+			continue
+		}
+		for _, f := range pipelineFamilies(c.Table.Family) {
+			k := key{family: f, hook: c.Hooknum}
+			p, ok := pipelines[k]
+			if !ok {
+				p = &HookPipeline{Family: f, Hook: c.Hooknum, Chains: make([]*HookChain, 0)}
+				pipelines[k] = p
+			}
+			p.Chains = append(p.Chains, &HookChain{Table: c.Table, Chain: c.Name, Type: c.Type, Priority: c.Priority})
+		}
+	}
+	result := make([]*HookPipeline, 0, len(pipelines))
+	for _, p := range pipelines {
+		sort.Slice(p.Chains, func(i, j int) bool {
+			ci, cj := p.Chains[i], p.Chains[j]
+			if ci.Priority != cj.Priority {
+				return ci.Priority < cj.Priority
+			}
+			if ti, tj := tableName(ci.Table), tableName(cj.Table); ti != tj {
+				return ti < tj
+			}
+			return ci.Chain < cj.Chain
+		})
+		result = append(result, p)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Family != result[j].Family {
+			return result[i].Family < result[j].Family
+		}
+		return result[i].Hook < result[j].Hook
+	})
+
+	return result
+}
+
+// AuditHookPriorities lists base chains of the host by the family and the hook they are attached to,
+// ordered as they process packets, Collisions of the report tell chains whose order is undefined.
+func (nft *nfTables) AuditHookPriorities() (*HookPriorityReport, error) {
+	var chains []*nftables.Chain
+	if err := nft.reads.do(func() (err error) {
+		chains, _, err = listChains(nft.conn, listFilter{})
+		return err
+	}); err != nil {
+		return nil, err
+	}
+
+	return &HookPriorityReport{Pipelines: buildPipelines(chains)}, nil
+}
+
+// nearestFreePriority returns the priority nearest to the priority which is not used
+func nearestFreePriority(priority nftables.ChainPriority, used map[nftables.ChainPriority]bool) nftables.ChainPriority {
+	for d := nftables.ChainPriority(1); ; d++ {
+		if !used[priority+d] {
+			return priority + d
+		}
+		if !used[priority-d] {
+			return priority - d
+		}
+	}
+}
+
+// checkHookPriority raises HookPriorityCollision if base chains of the host or chains of the table
+// waiting to be programmed share the priority of the chain's hook, the warning is returned as an error
+// if the table is strict. The host is not read if the warning would be discarded.
+func (nfc *nfChains) checkHookPriority(c *nftables.Chain) error {
+	strict := nfc.opts.strictHookPriorityCollisions()
+	handler := nfc.opts.warningHandler()
+	if !strict && handler == nil {
+		return nil
+	}
+	var chains []*nftables.Chain
+	if err := nfc.opts.readPolicy().do(func() (err error) {
+		chains, _, err = listChains(nfc.conn, listFilter{})
+		return err
+	}); err != nil {
+		return fmt.Errorf("failed to list chains to check priority of chain %s with error: %+v", c.Name, err)
+	}
+	for _, ch := range nfc.chains {
+		if ch.pending && ch.baseChain {
+			chains = append(chains, ch.chain)
+		}
+	}
+	w := &HookPriorityCollision{
+		Table:     nfc.table.Name,
+		Chain:     c.Name,
+		Family:    nfc.table.Family,
+		Hook:      c.Hooknum,
+		Priority:  c.Priority,
+		Colliding: make([]*HookChain, 0),
+	}
+	used := map[nftables.ChainPriority]bool{c.Priority: true}
+	seen := map[string]bool{}
+	for _, ch := range chains {
+		if ch.Type == "" || ch.Table == nil || ch.Hooknum != c.Hooknum || !sharesPipeline(ch.Table.Family, nfc.table.Family) {
+			continue
+		}
+		if ch.Table.Name == nfc.table.Name && ch.Table.Family == nfc.table.Family && ch.Name == c.Name {
+			continue
+		}
+		used[ch.Priority] = true
+		hc := &HookChain{Table: ch.Table, Chain: ch.Name, Type: ch.Type, Priority: ch.Priority}
+		if ch.Priority != c.Priority || seen[hc.String()] {
+			continue
+		}
+		seen[hc.String()] = true
+		w.Colliding = append(w.Colliding, hc)
+	}
+	if len(w.Colliding) == 0 {
+		return nil
+	}
+	w.Suggested = nearestFreePriority(c.Priority, used)
+	if strict {
+		return w
+	}
+	handler(w)
+
+	return nil
+}
@@ -0,0 +1,137 @@
+package nftableslib
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/google/nftables"
+	"golang.org/x/sys/unix"
+)
+
+// ICMPSaneChainName defines the name of the regular chain installed by InstallICMPSane
+const ICMPSaneChainName = "icmp-sane"
+
+// DefaultICMPEchoRate defines the rate of echo requests accepted by the icmp-sane chain
+// when the caller does not specify one, packets per second.
+const DefaultICMPEchoRate = 5
+
+// icmpEssentialTypes lists types of ICMP messages which are always accepted
+var icmpEssentialTypes = []uint8{
+	ICMPDestUnreachable,
+	ICMPTimeExceeded,
+	ICMPParameterProblem,
+}
+
+// icmpv6EssentialTypes lists types of ICMPv6 messages which are always accepted, besides errors
+// they include neighbor discovery and multicast listener discovery messages, IPv6 does not work
+// without them.
+var icmpv6EssentialTypes = []uint8{
+	ICMPv6DestUnreachable,
+	ICMPv6PacketTooBig,
+	ICMPv6TimeExceeded,
+	ICMPv6ParameterProblem,
+	ICMPv6MLDListenerQuery,
+	ICMPv6MLDListenerReport,
+	ICMPv6MLDListenerDone,
+	ICMPv6NDRouterSolicit,
+	ICMPv6NDRouterAdvert,
+	ICMPv6NDNeighborSolicit,
+	ICMPv6NDNeighborAdvert,
+	ICMPv6MLDv2ListenerReport,
+}
+
+// InstallICMPSane installs the icmp-sane regular chain into the table and a jump to it from the base
+// chain, so a host with default drop policy still answers ICMP as standards require. For each of ICMP
+// and ICMPv6 the chain carries:
+//
+//	icmp type echo-request limit rate 5/second accept
+//	icmp type { destination-unreachable, time-exceeded, parameter-problem } accept
+//	meta l4proto icmp drop
+//
+// ICMPv6 rules additionally accept packet-too-big, neighbor discovery and multicast listener discovery
+// messages. Tables of ipv4 family get ICMP rules, ipv6 tables get ICMPv6 rules and inet tables get both.
+// echoRate limits accepted echo requests, nil selects DefaultICMPEchoRate packets per second. The base
+// chain must exist, the icmp-sane chain must not.
+func InstallICMPSane(nft TablesInterface, table string, family nftables.TableFamily, baseChain string, echoRate *Limit) error {
+	if echoRate == nil {
+		echoRate = &Limit{Rate: DefaultICMPEchoRate, Unit: time.Second}
+	}
+	if err := echoRate.Validate(); err != nil {
+		return err
+	}
+	protos := []uint8{}
+	switch family {
+	case nftables.TableFamilyIPv4:
+		protos = append(protos, unix.IPPROTO_ICMP)
+	case nftables.TableFamilyIPv6:
+		protos = append(protos, unix.IPPROTO_ICMPV6)
+	case nftables.TableFamilyINet:
+		protos = append(protos, unix.IPPROTO_ICMP, unix.IPPROTO_ICMPV6)
+	default:
+		return fmt.Errorf("icmp-sane chain is not supported in tables of family %d", family)
+	}
+	ci, err := nft.Tables().Table(table, family)
+	if err != nil {
+		return err
+	}
+	if !ci.Chains().Exist(baseChain) {
+		return fmt.Errorf("chain %s does not exist in table %s", baseChain, table)
+	}
+	if ci.Chains().Exist(ICMPSaneChainName) {
+		return fmt.Errorf("chain %s already exists in table %s", ICMPSaneChainName, table)
+	}
+	if err := ci.Chains().CreateImm(ICMPSaneChainName, nil); err != nil {
+		return err
+	}
+	ri, err := ci.Chains().Chain(ICMPSaneChainName)
+	if err != nil {
+		return err
+	}
+	for _, proto := range protos {
+		for _, rule := range icmpSaneRules(proto, echoRate) {
+			if _, err := ri.Rules().CreateImm(rule); err != nil {
+				return err
+			}
+		}
+	}
+	bi, err := ci.Chains().Chain(baseChain)
+	if err != nil {
+		return err
+	}
+	for _, proto := range protos {
+		p := proto
+		jump, _ := SetVerdict(unix.NFT_JUMP, ICMPSaneChainName)
+		if _, err := bi.Rules().CreateImm(&Rule{Meta: &MetaRule{L4Proto: &p}, Action: jump}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// icmpSaneRules returns rules of the icmp-sane chain for ICMP or ICMPv6
+func icmpSaneRules(proto uint8, echoRate *Limit) []*Rule {
+	echo, essential := uint8(ICMPEchoRequest), icmpEssentialTypes
+	if proto == unix.IPPROTO_ICMPV6 {
+		echo, essential = ICMPv6EchoRequest, icmpv6EssentialTypes
+	}
+	accept, _ := SetVerdict(NFT_ACCEPT)
+	drop, _ := SetVerdict(NFT_DROP)
+	limit := *echoRate
+
+	return []*Rule{
+		{
+			L4:     &L4Rule{L4Proto: proto, ICMP: &ICMP{Types: []uint8{echo}}},
+			Limit:  &limit,
+			Action: accept,
+		},
+		{
+			L4:     &L4Rule{L4Proto: proto, ICMP: &ICMP{Types: essential}},
+			Action: accept,
+		},
+		{
+			Meta:   &MetaRule{L4Proto: &proto},
+			Action: drop,
+		},
+	}
+}
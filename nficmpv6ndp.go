@@ -0,0 +1,215 @@
+package nftableslib
+
+import (
+	"fmt"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+// ICMPv6 message types used by secure neighbor discovery and multicast router discovery
+const (
+	ICMPv6InverseNDSolicit = 141
+	ICMPv6InverseNDAdvert  = 142
+	ICMPv6CertPathSolicit  = 148
+	ICMPv6CertPathAdvert   = 149
+	ICMPv6MRDAdvert        = 151
+	ICMPv6MRDSolicit       = 152
+	ICMPv6MRDTerminate     = 153
+)
+
+// ICMPv6NDPTypes returns types of ICMPv6 neighbor discovery messages which RFC 4890 requires
+// to be accepted by hosts and routers.
+func ICMPv6NDPTypes() []uint8 {
+	return []uint8{
+		ICMPv6NDRouterSolicit,
+		ICMPv6NDRouterAdvert,
+		ICMPv6NDNeighborSolicit,
+		ICMPv6NDNeighborAdvert,
+		ICMPv6InverseNDSolicit,
+		ICMPv6InverseNDAdvert,
+		ICMPv6CertPathSolicit,
+		ICMPv6CertPathAdvert,
+	}
+}
+
+// ICMPv6MandatoryTypes returns types of ICMPv6 messages which RFC 4890 lists as not to be dropped:
+// error messages, echo, neighbor discovery, multicast listener and multicast router discovery.
+func ICMPv6MandatoryTypes() []uint8 {
+	types := []uint8{
+		ICMPv6DestUnreachable,
+		ICMPv6PacketTooBig,
+		ICMPv6TimeExceeded,
+		ICMPv6ParameterProblem,
+		ICMPv6EchoRequest,
+		ICMPv6EchoReply,
+		ICMPv6MLDListenerQuery,
+		ICMPv6MLDListenerReport,
+		ICMPv6MLDListenerDone,
+		ICMPv6MLDv2ListenerReport,
+		ICMPv6MRDAdvert,
+		ICMPv6MRDSolicit,
+		ICMPv6MRDTerminate,
+	}
+
+	return append(types, ICMPv6NDPTypes()...)
+}
+
+// ICMPv6MandatoryRule returns the rule accepting ICMPv6 messages of ICMPv6MandatoryTypes,
+// created before a rule dropping ICMPv6 it keeps IPv6 working.
+func ICMPv6MandatoryRule() *Rule {
+	accept, _ := SetVerdict(NFT_ACCEPT)
+
+	return &Rule{
+		L4:     &L4Rule{L4Proto: unix.IPPROTO_ICMPV6, ICMP: &ICMP{Types: ICMPv6MandatoryTypes()}},
+		Action: accept,
+	}
+}
+
+// ICMPv6DropWarning is raised when a rule drops all ICMPv6 messages in an input or forward base chain
+// of an ipv6 or inet table and no earlier rule of the chain accepts neighbor discovery messages.
+// Such a rule breaks IPv6, neighbor discovery and path MTU discovery stop working.
+type ICMPv6DropWarning struct {
+	Table string
+	Chain string
+}
+
+func (w *ICMPv6DropWarning) Error() string {
+	return fmt.Sprintf("rule of chain %s of table %s drops all icmpv6 messages before neighbor discovery is accepted",
+		w.Chain, w.Table)
+}
+
+// WithWarningHandler sets the function receiving warnings raised when rules are created in chains of the table,
+// the handler is called synchronously and must not operate on rules of the chain.
+func WithWarningHandler(handler func(error)) TableOption {
+	return func(o *tableOptions) {
+		o.warnings = handler
+	}
+}
+
+// WithStrictICMPv6 makes rules dropping all ICMPv6 messages before neighbor discovery is accepted
+// fail with ICMPv6DropWarning instead of raising the warning.
+func WithStrictICMPv6() TableOption {
+	return func(o *tableOptions) {
+		o.strictICMPv6 = true
+	}
+}
+
+// icmpv6Class classifies how a rule treats ICMPv6 neighbor discovery messages
+type icmpv6Class int
+
+const (
+	// icmpv6Unknown marks rules synced from the host, they may accept neighbor discovery
+	icmpv6Unknown icmpv6Class = iota
+	icmpv6Unrelated
+	// icmpv6AcceptsNDP marks rules accepting neighbor discovery or passing ICMPv6 to another chain
+	icmpv6AcceptsNDP
+	icmpv6DropsAll
+)
+
+// classifyICMPv6 returns how the rule treats ICMPv6 neighbor discovery messages
+func classifyICMPv6(rule *Rule) icmpv6Class {
+	action := rule.action()
+	if action == nil || rule.MatchAct != nil || rule.Concat != nil || rule.Dynamic != nil {
+		return icmpv6Unrelated
+	}
+	if rule.Meta != nil && rule.Meta.NFProto != nil && *rule.Meta.NFProto != nftables.TableFamilyIPv6 {
+		return icmpv6Unrelated
+	}
+	// selects is true when the rule selects ICMPv6 messages, ndp is true when all neighbor discovery
+	// messages are matched.
+	selects, ndp := false, true
+	if rule.Meta != nil && rule.Meta.L4Proto != nil {
+		if *rule.Meta.L4Proto != unix.IPPROTO_ICMPV6 {
+			return icmpv6Unrelated
+		}
+		selects = true
+	}
+	if rule.L4 != nil {
+		if rule.L4.L4Proto != unix.IPPROTO_ICMPV6 || rule.L4.Src != nil || rule.L4.Dst != nil {
+			return icmpv6Unrelated
+		}
+		selects = true
+		if icmp := rule.L4.ICMP; icmp != nil {
+			ndp = icmp.Code == nil && icmp.RelOp == EQ &&
+				hasICMPType(icmp.Types, ICMPv6NDNeighborSolicit) && hasICMPType(icmp.Types, ICMPv6NDNeighborAdvert)
+		}
+	}
+	v := action.verdict
+	switch {
+	case v != nil && (v.Kind == expr.VerdictAccept || v.Kind == expr.VerdictJump || v.Kind == expr.VerdictGoto):
+		if ndp && (selects || !hasMatches(rule)) {
+			return icmpv6AcceptsNDP
+		}
+	case v != nil && v.Kind == expr.VerdictDrop, action.reject != nil:
+		if ndp && !hasMatches(rule) {
+			return icmpv6DropsAll
+		}
+	}
+
+	return icmpv6Unrelated
+}
+
+// hasMatches returns true if the rule carries matches besides selecting ICMPv6 messages
+func hasMatches(rule *Rule) bool {
+	if rule.Fib != nil || rule.L3 != nil || rule.L2 != nil || rule.ARP != nil || len(rule.Conntracks) != 0 ||
+		rule.Limit != nil || len(rule.RawExprs) != 0 {
+		return true
+	}
+	if m := rule.Meta; m != nil {
+		return m.Mark != nil || m.IIFName != nil || m.OIFName != nil || m.IIF != nil || m.OIF != nil || m.IIFNameSet != nil || m.OIFNameSet != nil ||
+			m.PktType != nil || m.Length != nil || m.SKUID != nil || m.SKGID != nil || len(m.Expr) != 0
+	}
+
+	return false
+}
+
+func hasICMPType(types []uint8, t uint8) bool {
+	for _, v := range types {
+		if v == t {
+			return true
+		}
+	}
+
+	return false
+}
+
+// checksICMPv6 returns true if rules of the chain are checked for dropping ICMPv6
+func (nfr *nfRules) checksICMPv6() bool {
+	if nfr.table.Family != nftables.TableFamilyIPv6 && nfr.table.Family != nftables.TableFamilyINet {
+		return false
+	}
+	if nfr.chain.Type == "" {
+		// Regular chain
+		return false
+	}
+
+	return nfr.chain.Hooknum == nftables.ChainHookInput || nfr.chain.Hooknum == nftables.ChainHookForward
+}
+
+// checkICMPv6 raises ICMPv6DropWarning if the rule drops all ICMPv6 messages and no rule preceding it accepts
+// neighbor discovery. Rules inserted at the beginning of the chain are not preceded by any rule, otherwise
+// all rules created before, except the replaced one, are considered preceding. The warning is returned
+// as an error if the table is strict.
+func (nfr *nfRules) checkICMPv6(rule *Rule, first bool, replaced *nfRule) error {
+	if !nfr.checksICMPv6() || classifyICMPv6(rule) != icmpv6DropsAll {
+		return nil
+	}
+	if !first {
+		for r := nfr.rules; r != nil; r = r.next {
+			if r != replaced && (r.icmpv6 == icmpv6Unknown || r.icmpv6 == icmpv6AcceptsNDP) {
+				return nil
+			}
+		}
+	}
+	w := &ICMPv6DropWarning{Table: nfr.table.Name, Chain: nfr.chain.Name}
+	if nfr.opts.strictICMPv6Drops() {
+		return w
+	}
+	if h := nfr.opts.warningHandler(); h != nil {
+		h(w)
+	}
+
+	return nil
+}
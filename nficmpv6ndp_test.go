@@ -0,0 +1,72 @@
+package nftableslib
+
+import (
+	"testing"
+
+	"github.com/google/nftables"
+	"golang.org/x/sys/unix"
+)
+
+func TestClassifyICMPv6(t *testing.T) {
+	icmpv6, tcp := uint8(unix.IPPROTO_ICMPV6), uint8(unix.IPPROTO_TCP)
+	eth0 := "eth0"
+	ipv4 := nftables.TableFamilyIPv4
+	accept, _ := SetVerdict(NFT_ACCEPT)
+	drop, _ := SetVerdict(NFT_DROP)
+	jump, _ := SetVerdict(unix.NFT_JUMP, ICMPSaneChainName)
+	reject, _ := SetReject(unix.NFT_REJECT_ICMPX_UNREACH, unix.NFT_REJECT_ICMPX_ADMIN_PROHIBITED)
+	tests := []struct {
+		name  string
+		rule  *Rule
+		class icmpv6Class
+	}{
+		{
+			name:  "mandatory rule",
+			rule:  ICMPv6MandatoryRule(),
+			class: icmpv6AcceptsNDP,
+		},
+		{
+			name:  "jump of icmpv6",
+			rule:  &Rule{Meta: &MetaRule{L4Proto: &icmpv6}, Action: jump},
+			class: icmpv6AcceptsNDP,
+		},
+		{
+			name:  "accept of echo",
+			rule:  &Rule{L4: &L4Rule{L4Proto: icmpv6, ICMP: &ICMP{Types: []uint8{ICMPv6EchoRequest}}}, Action: accept},
+			class: icmpv6Unrelated,
+		},
+		{
+			name:  "drop of icmpv6",
+			rule:  &Rule{L4: &L4Rule{L4Proto: icmpv6}, Action: drop},
+			class: icmpv6DropsAll,
+		},
+		{
+			name:  "catch-all reject",
+			rule:  &Rule{Counter: &Counter{}, Action: reject},
+			class: icmpv6DropsAll,
+		},
+		{
+			name:  "drop of tcp",
+			rule:  &Rule{Meta: &MetaRule{L4Proto: &tcp}, Action: drop},
+			class: icmpv6Unrelated,
+		},
+		{
+			name:  "drop of ipv4",
+			rule:  &Rule{Meta: &MetaRule{NFProto: &ipv4}, Action: drop},
+			class: icmpv6Unrelated,
+		},
+		{
+			name:  "drop of icmpv6 from interface",
+			rule:  &Rule{Meta: &MetaRule{L4Proto: &icmpv6, IIFName: &eth0}, Action: drop},
+			class: icmpv6Unrelated,
+		},
+	}
+	for _, tt := range tests {
+		if err := tt.rule.Validate(); err != nil {
+			t.Fatalf("Test \"%s\" failed with error: %+v but supposed to succeed", tt.name, err)
+		}
+		if c := classifyICMPv6(tt.rule); c != tt.class {
+			t.Fatalf("Test \"%s\" failed, expected class %d, got %d", tt.name, tt.class, c)
+		}
+	}
+}
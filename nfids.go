@@ -0,0 +1,89 @@
+package nftableslib
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// IDGenerator generates IDs and names of the sets and chains built by the library, like sets of
+// address and port lists of rules or inline chains. Implementations must be safe for concurrent use.
+type IDGenerator interface {
+	// SetID returns an ID of the set unique within the transaction, IDs must be above 0xffff,
+	// the range below is used by github.com/google/nftables for anonymous sets.
+	SetID() uint32
+	// Name returns a unique name of the set or the chain
+	Name() string
+}
+
+// WithIDGenerator sets the generator of IDs and names of sets and chains built by the library,
+// by default IDs and names are unique for the process and names do not repeat across its restarts.
+func WithIDGenerator(ids IDGenerator) TablesOption {
+	return func(nft *nfTables) {
+		nft.ids = ids
+	}
+}
+
+// firstSetID is the value set IDs start after
+const firstSetID uint32 = 0xffff
+
+// defaultIDs is the generator used when the generator is not set
+var defaultIDs = newDefaultIDGenerator()
+
+// nonceSource is the source of the per process nonce of the default generator
+var nonceSource io.Reader = rand.Reader
+
+type defaultIDGenerator struct {
+	id    uint32
+	name  uint32
+	nonce uint32
+}
+
+// newDefaultIDGenerator returns the generator mixing the counter with a random per process nonce,
+// names of sets built by the library do not collide with names left on the host by previous runs.
+// When the random source is not available, the nonce is derived from the start time and the pid.
+func newDefaultIDGenerator() *defaultIDGenerator {
+	return &defaultIDGenerator{id: firstSetID, nonce: newNonce()}
+}
+
+func newNonce() uint32 {
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(nonceSource, b); err == nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	now := uint64(time.Now().UnixNano())
+
+	return uint32(now) ^ uint32(now>>32) ^ uint32(os.Getpid())<<16
+}
+
+func (g *defaultIDGenerator) SetID() uint32 {
+	return atomic.AddUint32(&g.id, 1)
+}
+
+func (g *defaultIDGenerator) Name() string {
+	return fmt.Sprintf("%08x%04x", g.nonce, atomic.AddUint32(&g.name, 1))
+}
+
+type sequentialIDGenerator struct {
+	id   uint32
+	name uint32
+}
+
+// NewSequentialIDGenerator returns the generator producing the same sequence of IDs and names
+// on every run, it is meant for tests comparing expressions and dumps. Names do not carry
+// anything unique to the process, it must not be used by applications restarted on the same host.
+func NewSequentialIDGenerator() IDGenerator {
+	return &sequentialIDGenerator{id: firstSetID}
+}
+
+func (g *sequentialIDGenerator) SetID() uint32 {
+	return atomic.AddUint32(&g.id, 1)
+}
+
+func (g *sequentialIDGenerator) Name() string {
+	return fmt.Sprintf("%012x", atomic.AddUint32(&g.name, 1))
+}
@@ -0,0 +1,82 @@
+package nftableslib
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestIDGenerators(t *testing.T) {
+	tests := []struct {
+		name string
+		ids  IDGenerator
+	}{
+		{name: "default", ids: newDefaultIDGenerator()},
+		{name: "sequential", ids: NewSequentialIDGenerator()},
+	}
+	for _, tt := range tests {
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		setIDs := make(map[uint32]bool)
+		names := make(map[string]bool)
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 1000; j++ {
+					id, name := tt.ids.SetID(), tt.ids.Name()
+					mu.Lock()
+					setIDs[id], names[name] = true, true
+					mu.Unlock()
+				}
+			}()
+		}
+		wg.Wait()
+		if len(setIDs) != 8000 || len(names) != 8000 {
+			t.Errorf("Test \"%s\" failed, expected 8000 unique IDs and names, got %d IDs and %d names", tt.name, len(setIDs), len(names))
+		}
+		for id := range setIDs {
+			if id <= 0xffff {
+				t.Errorf("Test \"%s\" failed, set ID %#x collides with IDs of anonymous sets", tt.name, id)
+				break
+			}
+		}
+	}
+
+	// Sequential generators repeat the sequence, default generators do not repeat names
+	a, b := NewSequentialIDGenerator(), NewSequentialIDGenerator()
+	for i := 0; i < 3; i++ {
+		if ida, idb, na, nb := a.SetID(), b.SetID(), a.Name(), b.Name(); ida != idb || na != nb {
+			t.Fatalf("expected sequential generators to produce the same sequence, got %#x %s and %#x %s", ida, na, idb, nb)
+		}
+	}
+	if n := NewSequentialIDGenerator().Name(); n != "000000000001" {
+		t.Fatalf("expected first sequential name 000000000001, got %s", n)
+	}
+	if na, nb := newDefaultIDGenerator().Name(), newDefaultIDGenerator().Name(); na == nb {
+		t.Fatalf("expected default generators of different runs to produce different names, got %s twice", na)
+	}
+}
+
+type failingReader struct{}
+
+func (failingReader) Read([]byte) (int, error) {
+	return 0, fmt.Errorf("entropy is not available")
+}
+
+func TestDefaultIDGeneratorWithoutRandom(t *testing.T) {
+	saved := nonceSource
+	nonceSource = failingReader{}
+	defer func() { nonceSource = saved }()
+
+	a := newDefaultIDGenerator()
+	time.Sleep(time.Millisecond)
+	b := newDefaultIDGenerator()
+	if id := a.SetID(); id <= firstSetID {
+		t.Fatalf("expected set ID above %#x, got %#x", firstSetID, id)
+	}
+	if na, nb := a.Name(), b.Name(); na == nb {
+		t.Fatalf("expected generators seeded without random source to produce different names, got %s twice", na)
+	}
+}
@@ -0,0 +1,124 @@
+package nftableslib
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+
+	"github.com/google/nftables"
+)
+
+// IfNameLength defines the length of interface names in sets, names are padded with zeros
+const IfNameLength = 16
+
+// TypeIFName defines the datatype of sets of interface names, nftables does not define it
+var TypeIFName = ifNameDatatype()
+
+func ifNameDatatype() nftables.SetDatatype {
+	t := nftables.SetDatatype{Name: "ifname", Bytes: IfNameLength}
+	t.SetNFTMagic(41)
+
+	return t
+}
+
+// MakeIfNameElements returns elements of a set of TypeIFName for interface names, every name is
+// encoded as 16 bytes padded with zeros. Names are matched exactly, wildcards like "veth*" are
+// not supported.
+func MakeIfNameElements(names ...string) ([]nftables.SetElement, error) {
+	elements := make([]nftables.SetElement, 0, len(names))
+	for _, n := range names {
+		if err := validateIfName(n); err != nil {
+			return nil, err
+		}
+		elements = append(elements, nftables.SetElement{Key: ifname(n)})
+	}
+
+	return elements, nil
+}
+
+func validateIfName(n string) error {
+	if n == "" {
+		return fmt.Errorf("interface name cannot be empty")
+	}
+	if len(n) > IfNameLength-1 {
+		return fmt.Errorf("interface name %s exceeds %d characters", n, IfNameLength-1)
+	}
+	if bytes.IndexByte([]byte(n), 0) != -1 {
+		return fmt.Errorf("interface name %q cannot carry zero bytes", n)
+	}
+
+	return nil
+}
+
+// InterfaceSet maintains a named set of interface names, rules refer to the set by IfNameSet of
+// MetaRule's IIFNameSet or OIFNameSet: "iifname @pods accept". Interfaces are added and removed
+// as they come and go without changing the rules.
+type InterfaceSet struct {
+	si   SetsInterface
+	name string
+}
+
+// NewInterfaceSet returns InterfaceSet maintaining the set in the table of si,
+// the set is created if it does not exist.
+func NewInterfaceSet(si SetsInterface, name string) (*InterfaceSet, error) {
+	if set, err := si.Sets().GetSetByName(name); err == nil {
+		if set.IsMap || set.KeyType.GetNFTMagic() != TypeIFName.GetNFTMagic() {
+			return nil, fmt.Errorf("set %s exists but it is not a set of interface names", name)
+		}
+	} else {
+		if _, err := si.Sets().CreateSet(&SetAttributes{Name: name, KeyType: TypeIFName}, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	return &InterfaceSet{si: si, name: name}, nil
+}
+
+// SetRef returns the reference to the set used by rules matching on it
+func (s *InterfaceSet) SetRef() *SetRef {
+	return &SetRef{Name: s.name}
+}
+
+// Add adds the interface to the set
+func (s *InterfaceSet) Add(name string) error {
+	elements, err := MakeIfNameElements(name)
+	if err != nil {
+		return err
+	}
+
+	return s.si.Sets().SetAddElements(s.name, elements)
+}
+
+// Remove removes the interface from the set
+func (s *InterfaceSet) Remove(name string) error {
+	elements, err := MakeIfNameElements(name)
+	if err != nil {
+		return err
+	}
+
+	return s.si.Sets().SetDelElements(s.name, elements)
+}
+
+// Interfaces returns names of interfaces in the set sorted by name
+func (s *InterfaceSet) Interfaces() ([]string, error) {
+	elements, err := s.si.Sets().GetSetElements(s.name)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(elements))
+	for _, e := range elements {
+		names = append(names, ifNameFromKey(e.Key))
+	}
+	sort.Strings(names)
+
+	return names, nil
+}
+
+// ifNameFromKey returns the interface name of the key padded with zeros
+func ifNameFromKey(key []byte) string {
+	if i := bytes.IndexByte(key, 0); i != -1 {
+		key = key[:i]
+	}
+
+	return string(key)
+}
@@ -0,0 +1,305 @@
+package nftableslib
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"syscall"
+
+	"github.com/google/nftables/binaryutil"
+	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// LinkEvent reports an interface created, changed or deleted
+type LinkEvent struct {
+	Name    string
+	Index   uint32
+	Deleted bool
+}
+
+// LinkEventSource delivers link events to IfTracker, the channel is closed when the source stops.
+type LinkEventSource interface {
+	Events() <-chan *LinkEvent
+	Close() error
+}
+
+// IfRewrite reports a rule rewritten to the new index of the interface, Err is set if the rule
+// could not be updated, the rule is retried by the next event of the interface.
+type IfRewrite struct {
+	Name     string
+	OldIndex uint32
+	NewIndex uint32
+	Handle   uint64
+	Err      error
+}
+
+// IfTracker keeps rules matching interfaces by index up to date, when a tracked interface is recreated
+// and gets a new index, rules matching the old index are updated in place to match the new one.
+type IfTracker struct {
+	source   LinkEventSource
+	rewrites chan *IfRewrite
+	done     chan struct{}
+	once     sync.Once
+	sync.Mutex
+	rules []*trackedRule
+}
+
+type trackedRule struct {
+	ri     RulesInterface
+	handle uint64
+	rule   Rule
+	// iif and oif are names of interfaces the rule's Meta IIF and OIF indexes belong to
+	iif string
+	oif string
+}
+
+// NewIfTracker starts tracking interfaces reported by the source, rewrites are delivered by the channel
+// returned by Rewrites, backlog is the size of its buffer.
+func NewIfTracker(source LinkEventSource, backlog int) *IfTracker {
+	t := &IfTracker{
+		source:   source,
+		rewrites: make(chan *IfRewrite, backlog),
+		done:     make(chan struct{}),
+	}
+	go t.run()
+
+	return t
+}
+
+// Track starts tracking the rule with the handle, iif and oif are names of interfaces whose indexes the
+// rule's Meta IIF and OIF carry, an empty name leaves the corresponding index as it is.
+func (t *IfTracker) Track(ri RulesInterface, handle uint64, rule *Rule, iif, oif string) error {
+	if iif == "" && oif == "" {
+		return fmt.Errorf("rule with handle %d does not track any interface", handle)
+	}
+	if rule.Meta == nil || iif != "" && rule.Meta.IIF == nil || oif != "" && rule.Meta.OIF == nil {
+		return fmt.Errorf("rule with handle %d does not match tracked interfaces by index", handle)
+	}
+	tr := &trackedRule{ri: ri, handle: handle, rule: *rule, iif: iif, oif: oif}
+	meta := *rule.Meta
+	tr.rule.Meta = &meta
+	t.Lock()
+	defer t.Unlock()
+	t.untrack(ri, handle)
+	t.rules = append(t.rules, tr)
+
+	return nil
+}
+
+// Untrack stops tracking the rule with the handle
+func (t *IfTracker) Untrack(ri RulesInterface, handle uint64) {
+	t.Lock()
+	defer t.Unlock()
+	t.untrack(ri, handle)
+}
+
+func (t *IfTracker) untrack(ri RulesInterface, handle uint64) {
+	for i, tr := range t.rules {
+		if tr.ri == ri && tr.handle == handle {
+			t.rules = append(t.rules[:i], t.rules[i+1:]...)
+			return
+		}
+	}
+}
+
+// Rewrites returns the channel reporting rewritten rules, rewrites not received while the buffer
+// of the channel is full are dropped, rules are rewritten regardless.
+func (t *IfTracker) Rewrites() <-chan *IfRewrite {
+	return t.rewrites
+}
+
+// Close stops the tracker and its source
+func (t *IfTracker) Close() error {
+	var err error
+	t.once.Do(func() {
+		close(t.done)
+		err = t.source.Close()
+	})
+
+	return err
+}
+
+func (t *IfTracker) run() {
+	defer close(t.rewrites)
+	events := t.source.Events()
+	for {
+		select {
+		case e, ok := <-events:
+			if !ok {
+				return
+			}
+			t.handle(e)
+		case <-t.done:
+			return
+		}
+	}
+}
+
+// handle rewrites rules matching the interface by an index other than the reported one
+func (t *IfTracker) handle(e *LinkEvent) {
+	// Rules keep the old index until the interface comes back
+	if e.Deleted || e.Index == 0 {
+		return
+	}
+	t.Lock()
+	defer t.Unlock()
+	for _, tr := range t.rules {
+		rule := tr.rule
+		meta := *rule.Meta
+		index, old, changed := e.Index, uint32(0), false
+		if tr.iif == e.Name && *meta.IIF != index {
+			old, meta.IIF, changed = *meta.IIF, &index, true
+		}
+		if tr.oif == e.Name && *meta.OIF != index {
+			old, meta.OIF, changed = *meta.OIF, &index, true
+		}
+		if !changed {
+			continue
+		}
+		rule.Meta = &meta
+		err := tr.ri.Rules().Update(&rule, tr.handle)
+		if err == nil {
+			tr.rule = rule
+		}
+		select {
+		case t.rewrites <- &IfRewrite{Name: e.Name, OldIndex: old, NewIndex: e.Index, Handle: tr.handle, Err: err}:
+		default:
+		}
+	}
+}
+
+// rtnlLinkSource reads link events from the RTNLGRP_LINK group of rtnetlink
+type rtnlLinkSource struct {
+	conn   *netlink.Conn
+	recv   *receiver
+	netns  int
+	events chan *LinkEvent
+	done   chan struct{}
+	once   sync.Once
+}
+
+// NewRTNetlinkLinkSource returns LinkEventSource reporting link events of the network namespace,
+// the source is closed when the context is cancelled.
+func NewRTNetlinkLinkSource(ctx context.Context, netns int) (LinkEventSource, error) {
+	conn, err := netlink.Dial(unix.NETLINK_ROUTE, &netlink.Config{
+		Groups:              1 << (unix.RTNLGRP_LINK - 1),
+		NetNS:               netns,
+		DisableNSLockThread: netns == 0,
+	})
+	if err != nil {
+		return nil, err
+	}
+	recv, err := newReceiver(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	s := &rtnlLinkSource{
+		conn:   conn,
+		recv:   recv,
+		netns:  netns,
+		events: make(chan *LinkEvent, 64),
+		done:   make(chan struct{}),
+	}
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.Close()
+		case <-s.done:
+		}
+	}()
+	go s.run()
+
+	return s, nil
+}
+
+func (s *rtnlLinkSource) Events() <-chan *LinkEvent {
+	return s.events
+}
+
+func (s *rtnlLinkSource) Close() error {
+	var err error
+	s.once.Do(func() {
+		close(s.done)
+		err = s.conn.Close()
+	})
+
+	return err
+}
+
+func (s *rtnlLinkSource) run() {
+	defer close(s.events)
+	for {
+		msgs, err := s.recv.receive()
+		if err == unix.ENOBUFS {
+			// Events were lost, all links are reported again, so missed index changes are caught up
+			if msgs, err = s.dump(); err != nil {
+				s.Close()
+				return
+			}
+		}
+		if err != nil {
+			s.Close()
+			return
+		}
+		for _, m := range msgs {
+			e, ok := linkEvent(m.Header.Type, m.Data)
+			if !ok {
+				continue
+			}
+			select {
+			case s.events <- e:
+			case <-s.done:
+				return
+			}
+		}
+	}
+}
+
+// dump requests all links of the namespace over a separate connection
+func (s *rtnlLinkSource) dump() ([]syscall.NetlinkMessage, error) {
+	conn, err := netlink.Dial(unix.NETLINK_ROUTE, &netlink.Config{NetNS: s.netns, DisableNSLockThread: s.netns == 0})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	replies, err := conn.Execute(netlink.Message{
+		Header: netlink.Header{
+			Type:  unix.RTM_GETLINK,
+			Flags: netlink.Request | netlink.Dump,
+		},
+		Data: make([]byte, unix.SizeofIfInfomsg),
+	})
+	if err != nil {
+		return nil, err
+	}
+	msgs := make([]syscall.NetlinkMessage, 0, len(replies))
+	for _, r := range replies {
+		msgs = append(msgs, syscall.NetlinkMessage{Header: syscall.NlMsghdr{Type: uint16(r.Header.Type)}, Data: r.Data})
+	}
+
+	return msgs, nil
+}
+
+// linkEvent decodes RTM_NEWLINK and RTM_DELLINK messages, data starts with ifinfomsg header
+func linkEvent(t uint16, data []byte) (*LinkEvent, bool) {
+	if t != unix.RTM_NEWLINK && t != unix.RTM_DELLINK || len(data) < unix.SizeofIfInfomsg {
+		return nil, false
+	}
+	e := &LinkEvent{Index: binaryutil.NativeEndian.Uint32(data[4:8]), Deleted: t == unix.RTM_DELLINK}
+	ad, err := netlink.NewAttributeDecoder(data[unix.SizeofIfInfomsg:])
+	if err != nil {
+		return nil, false
+	}
+	for ad.Next() {
+		if ad.Type() == unix.IFLA_IFNAME {
+			e.Name = ad.String()
+		}
+	}
+	if ad.Err() != nil || e.Name == "" {
+		return nil, false
+	}
+
+	return e, true
+}
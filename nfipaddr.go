@@ -0,0 +1,222 @@
+package nftableslib
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// ZonePolicy defines how NewIPAddr treats the zone of IPv6 address, like "eth0" of "fe80::1%eth0"
+type ZonePolicy uint8
+
+const (
+	// ZoneReject fails addresses carrying a zone, it is the default as addresses of packets matched
+	// by rules do not carry zones.
+	ZoneReject ZonePolicy = iota
+	// ZoneStrip drops the zone
+	ZoneStrip
+	// ZoneKeep keeps the zone in Zone of the address, zones of IPv4 addresses are still rejected
+	ZoneKeep
+)
+
+// IPAddrOption defines an option of parsing of the address by NewIPAddr
+type IPAddrOption func(*ipAddrOptions)
+
+type ipAddrOptions struct {
+	zones ZonePolicy
+}
+
+// WithZonePolicy sets how the zone of IPv6 address is treated, zones are rejected by default
+func WithZonePolicy(p ZonePolicy) IPAddrOption {
+	return func(o *ipAddrOptions) {
+		o.zones = p
+	}
+}
+
+// ErrInvalidIPAddr is returned when the string cannot be parsed as ip address, Token is the part
+// of the input which is wrong, it is empty when the input as a whole is wrong.
+type ErrInvalidIPAddr struct {
+	Input  string
+	Token  string
+	Reason string
+}
+
+func (e *ErrInvalidIPAddr) Error() string {
+	if e.Token == "" {
+		return fmt.Sprintf("invalid ip address %q: %s", e.Input, e.Reason)
+	}
+	return fmt.Sprintf("invalid ip address %q: %s %q", e.Input, e.Reason, e.Token)
+}
+
+// NewIPAddr is a helper function which converts ip address into IPAddr format
+// required by IPAddrSpec. If CIDR format is specified, Mask will be set to address'
+// subnet mask, otherwise it is set to the length of the address, CIDR is always set to true.
+// Surrounding whitespace is ignored, host bits of the prefix are cleared and IPv4 mapped
+// IPv6 addresses, like "::ffff:192.0.2.1", are converted to IPv4 addresses with the prefix length
+// reduced by 96. Octets of IPv4 addresses with leading zeros are rejected as they are read as octal
+// numbers by some tools, zones of IPv6 addresses are rejected unless WithZonePolicy allows them.
+func NewIPAddr(addr string, opts ...IPAddrOption) (*IPAddr, error) {
+	o := ipAddrOptions{}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	ip, zone, mask, err := parseIPAddr(addr, o.zones)
+	if err != nil {
+		return nil, err
+	}
+	if mask == nil {
+		m := uint8(8 * len(ip))
+		mask = &m
+	}
+
+	return &IPAddr{
+		IPAddr: &net.IPAddr{IP: ip, Zone: zone},
+		CIDR:   true,
+		Mask:   mask,
+	}, nil
+}
+
+// IsValidCIDR returns true if s is a prefix, like "192.0.2.0/24" or "2001:db8::/32", accepted
+// by NewIPAddr with default options, it is a quick check of input before rules are built.
+func IsValidCIDR(s string) bool {
+	if !strings.Contains(s, "/") {
+		return false
+	}
+	_, _, _, err := parseIPAddr(s, ZoneReject)
+
+	return err == nil
+}
+
+// String returns the canonical form of the address, "192.0.2.0/24" when CIDR is true and "192.0.2.1"
+// when it is false, IPv6 addresses are printed in the shortest form and the zone follows the address.
+func (ip IPAddr) String() string {
+	if ip.IPAddr == nil {
+		return "<nil>"
+	}
+	s := ip.IPAddr.String()
+	if ip.CIDR && ip.Mask != nil {
+		s += "/" + strconv.Itoa(int(*ip.Mask))
+	}
+
+	return s
+}
+
+// parseIPAddr parses the address with optional zone and prefix length, the address is returned
+// in 4 bytes for IPv4 and in 16 bytes for IPv6, the prefix length is nil if it is not specified.
+func parseIPAddr(input string, zones ZonePolicy) (net.IP, string, *uint8, error) {
+	invalid := func(token, reason string) error {
+		return &ErrInvalidIPAddr{Input: input, Token: token, Reason: reason}
+	}
+	s := strings.TrimSpace(input)
+	if s == "" {
+		return nil, "", nil, invalid("", "address is empty")
+	}
+	addr, length, hasLength := s, "", false
+	if i := strings.Index(s, "/"); i != -1 {
+		addr, length, hasLength = s[:i], s[i+1:], true
+	}
+	zone := ""
+	if i := strings.Index(addr, "%"); i != -1 {
+		addr, zone = addr[:i], addr[i+1:]
+		if zone == "" {
+			return nil, "", nil, invalid("%", "empty zone")
+		}
+	}
+	if token, reason := checkAddrTokens(addr); reason != "" {
+		return nil, "", nil, invalid(token, reason)
+	}
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return nil, "", nil, invalid(addr, "malformed address")
+	}
+	mapped := strings.Contains(addr, ":") && ip.To4() != nil
+	bits := 128
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, bits = ip4, 32
+	}
+	if zone != "" {
+		switch {
+		case zones == ZoneStrip:
+			zone = ""
+		case zones == ZoneReject:
+			return nil, "", nil, invalid("%"+zone, "zone is not allowed")
+		case bits == 32:
+			return nil, "", nil, invalid("%"+zone, "zone of ipv4 address")
+		}
+	}
+	if !hasLength {
+		return ip, zone, nil, nil
+	}
+	if length == "" || strings.Trim(length, "0123456789") != "" || (len(length) > 1 && length[0] == '0') {
+		return nil, "", nil, invalid(length, "invalid prefix length")
+	}
+	n, err := strconv.Atoi(length)
+	if err != nil {
+		return nil, "", nil, invalid(length, "invalid prefix length")
+	}
+	if mapped {
+		// Prefix of ipv4 mapped address covers the mapped range ::ffff:0:0/96
+		if n < 96 || n > 128 {
+			return nil, "", nil, invalid(length, "prefix length of ipv4 mapped address must be in range 96-128")
+		}
+		n -= 96
+	}
+	if n > bits {
+		return nil, "", nil, invalid(length, fmt.Sprintf("prefix length exceeds %d bits", bits))
+	}
+	mask := uint8(n)
+
+	return ip.Mask(net.CIDRMask(n, bits)), zone, &mask, nil
+}
+
+// checkAddrTokens returns the token of the address which is wrong and the reason, the reason
+// is empty if the tokens are correct. IPv4 address embedded in IPv6 address is checked as IPv4 address.
+func checkAddrTokens(addr string) (string, string) {
+	if !strings.Contains(addr, ":") {
+		if !strings.Contains(addr, ".") {
+			return addr, "not an ip address"
+		}
+		return checkOctets(addr)
+	}
+	if strings.Count(addr, "::") > 1 {
+		return addr, "more than one \"::\" in"
+	}
+	groups := strings.Split(addr, ":")
+	for i, g := range groups {
+		if i == len(groups)-1 && strings.Contains(g, ".") {
+			return checkOctets(g)
+		}
+		if len(g) > 4 {
+			return g, "group longer than 4 digits"
+		}
+		if strings.Trim(g, "0123456789abcdefABCDEF") != "" {
+			return g, "invalid group"
+		}
+	}
+
+	return "", ""
+}
+
+// checkOctets checks the dotted IPv4 address
+func checkOctets(addr string) (string, string) {
+	octets := strings.Split(addr, ".")
+	if len(octets) != 4 {
+		return addr, "ipv4 address must have 4 octets"
+	}
+	for _, o := range octets {
+		switch {
+		case o == "" || strings.Trim(o, "0123456789") != "":
+			return o, "invalid octet"
+		case len(o) > 1 && o[0] == '0':
+			return o, "leading zero in octet"
+		case len(o) > 3:
+			return o, "octet out of range"
+		}
+		if v, _ := strconv.Atoi(o); v > 255 {
+			return o, "octet out of range"
+		}
+	}
+
+	return "", ""
+}
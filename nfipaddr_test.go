@@ -0,0 +1,163 @@
+package nftableslib
+
+import (
+	"fmt"
+	"net"
+	"testing"
+)
+
+func TestNewIPAddr(t *testing.T) {
+	tests := []struct {
+		input string
+		opts  []IPAddrOption
+		// want is the canonical form of the parsed address, token is the token named by the error
+		want    string
+		token   string
+		success bool
+	}{
+		{input: "192.0.2.1", want: "192.0.2.1/32", success: true},
+		{input: "192.0.2.0/24", want: "192.0.2.0/24", success: true},
+		{input: "192.0.2.77/24", want: "192.0.2.0/24", success: true},
+		{input: "0.0.0.0/0", want: "0.0.0.0/0", success: true},
+		{input: "  10.1.2.3 \t", want: "10.1.2.3/32", success: true},
+		{input: "\n10.0.0.0/8\n", want: "10.0.0.0/8", success: true},
+		{input: "2001:db8::1", want: "2001:db8::1/128", success: true},
+		{input: "2001:0DB8:0000::0001", want: "2001:db8::1/128", success: true},
+		{input: "2001:db8::/32", want: "2001:db8::/32", success: true},
+		{input: "::/0", want: "::/0", success: true},
+		{input: "::1", want: "::1/128", success: true},
+		{input: "64:ff9b::192.0.2.1", want: "64:ff9b::c000:201/128", success: true},
+		// IPv4 mapped addresses are converted to IPv4
+		{input: "::ffff:1.2.3.4", want: "1.2.3.4/32", success: true},
+		{input: "::FFFF:1.2.3.4", want: "1.2.3.4/32", success: true},
+		{input: "::ffff:c000:201", want: "192.0.2.1/32", success: true},
+		{input: "::ffff:10.0.0.0/104", want: "10.0.0.0/8", success: true},
+		{input: "::ffff:0.0.0.0/96", want: "0.0.0.0/0", success: true},
+		{input: "::ffff:10.0.0.0/64", token: "64", success: false},
+		{input: "::ffff:10.0.0.0/129", token: "129", success: false},
+		// Zones
+		{input: "fe80::1%eth0", token: "%eth0", success: false},
+		{input: "fe80::1%eth0", opts: []IPAddrOption{WithZonePolicy(ZoneStrip)}, want: "fe80::1/128", success: true},
+		{input: "fe80::1%eth0", opts: []IPAddrOption{WithZonePolicy(ZoneKeep)}, want: "fe80::1%eth0/128", success: true},
+		{input: "fe80::%eth0/64", opts: []IPAddrOption{WithZonePolicy(ZoneKeep)}, want: "fe80::%eth0/64", success: true},
+		{input: "fe80::1%", opts: []IPAddrOption{WithZonePolicy(ZoneStrip)}, token: "%", success: false},
+		{input: "192.0.2.1%eth0", opts: []IPAddrOption{WithZonePolicy(ZoneKeep)}, token: "%eth0", success: false},
+		{input: "192.0.2.1%eth0", opts: []IPAddrOption{WithZonePolicy(ZoneStrip)}, want: "192.0.2.1/32", success: true},
+		{input: "fe80::/64%eth0", token: "64%eth0", success: false},
+		// Ambiguous and malformed IPv4 addresses
+		{input: "010.0.0.1", token: "010", success: false},
+		{input: "10.0.0.01", token: "01", success: false},
+		{input: "10.0.0.00/8", token: "00", success: false},
+		{input: "::ffff:1.02.3.4", token: "02", success: false},
+		{input: "10.0.0.256", token: "256", success: false},
+		{input: "10.0.0.1000", token: "1000", success: false},
+		{input: "10.0.0", token: "10.0.0", success: false},
+		{input: "10.0.0.1.2", token: "10.0.0.1.2", success: false},
+		{input: "10..0.1", token: "", success: false},
+		{input: "10.0.0.x", token: "x", success: false},
+		{input: "10.0. 0.1", token: " 0", success: false},
+		{input: "0x0a.0.0.1", token: "0x0a", success: false},
+		{input: "167772161", token: "167772161", success: false},
+		// Malformed IPv6 addresses
+		{input: "2001:db8::1::2", token: "2001:db8::1::2", success: false},
+		{input: "2001:db8:00001::1", token: "00001", success: false},
+		{input: "2001:db8:g::1", token: "g", success: false},
+		{input: "2001:db8:1:2:3:4:5:6:7", token: "2001:db8:1:2:3:4:5:6:7", success: false},
+		{input: "2001:db8::1 ", want: "2001:db8::1/128", success: true},
+		// Prefix lengths
+		{input: "10.0.0.0/33", token: "33", success: false},
+		{input: "2001:db8::/129", token: "129", success: false},
+		{input: "10.0.0.0/08", token: "08", success: false},
+		{input: "10.0.0.0/", token: "", success: false},
+		{input: "10.0.0.0/+8", token: "+8", success: false},
+		{input: "10.0.0.0/8/16", token: "8/16", success: false},
+		{input: "10.0.0.0/ 8", token: " 8", success: false},
+		{input: "10.0.0.0/255.0.0.0", token: "255.0.0.0", success: false},
+		{input: "10.0.0.0/99999999999999999999", token: "99999999999999999999", success: false},
+		{input: "", success: false},
+		{input: "   ", success: false},
+		{input: "localhost", token: "localhost", success: false},
+	}
+	for _, tt := range tests {
+		addr, err := NewIPAddr(tt.input, tt.opts...)
+		if err != nil && tt.success {
+			t.Errorf("Test \"%s\" failed with error: %+v but supposed to succeed", tt.input, err)
+			continue
+		}
+		if err == nil && !tt.success {
+			t.Errorf("Test \"%s\" succeeded but supposed to fail, got %s", tt.input, addr)
+			continue
+		}
+		if !tt.success {
+			e, ok := err.(*ErrInvalidIPAddr)
+			if !ok {
+				t.Errorf("Test \"%s\" failed, expected ErrInvalidIPAddr, got %T: %+v", tt.input, err, err)
+				continue
+			}
+			if e.Token != tt.token || e.Input != tt.input {
+				t.Errorf("Test \"%s\" failed, expected error naming token %q, got %+v", tt.input, tt.token, err)
+			}
+			continue
+		}
+		if s := addr.String(); s != tt.want {
+			t.Errorf("Test \"%s\" failed, expected %s, got %s", tt.input, tt.want, s)
+		}
+		if !addr.CIDR || addr.Mask == nil {
+			t.Errorf("Test \"%s\" failed, address is expected to carry a mask", tt.input)
+		}
+		// IPv4 addresses are carried in 4 bytes
+		if addr.IsIPv6() == (len(addr.IP) == net.IPv4len) {
+			t.Errorf("Test \"%s\" failed, address %s is carried in %d bytes", tt.input, addr, len(addr.IP))
+		}
+		// Canonical form is parsed back to the same address
+		again, err := NewIPAddr(addr.String(), tt.opts...)
+		if err != nil || again.String() != addr.String() {
+			t.Errorf("Test \"%s\" failed, canonical form %s is not parsed back, got %s with error: %+v", tt.input, addr, again, err)
+		}
+	}
+}
+
+func TestIPAddrString(t *testing.T) {
+	mask := uint8(24)
+	tests := []struct {
+		name string
+		addr IPAddr
+		want string
+	}{
+		{name: "host", addr: IPAddr{IPAddr: &net.IPAddr{IP: net.ParseIP("192.0.2.1")}}, want: "192.0.2.1"},
+		{name: "prefix", addr: IPAddr{IPAddr: &net.IPAddr{IP: net.ParseIP("192.0.2.0")}, CIDR: true, Mask: &mask}, want: "192.0.2.0/24"},
+		{name: "ipv6", addr: IPAddr{IPAddr: &net.IPAddr{IP: net.ParseIP("2001:0db8:0:0:0:0:0:1")}}, want: "2001:db8::1"},
+		{name: "nil", addr: IPAddr{}, want: "<nil>"},
+	}
+	for _, tt := range tests {
+		if s := tt.addr.String(); s != tt.want {
+			t.Errorf("Test \"%s\" failed, expected %s, got %s", tt.name, tt.want, s)
+		}
+		if s := fmt.Sprintf("%s", &tt.addr); s != tt.want {
+			t.Errorf("Test \"%s\" failed, expected %s to be formatted, got %s", tt.name, tt.want, s)
+		}
+	}
+}
+
+func TestIsValidCIDR(t *testing.T) {
+	tests := []struct {
+		input string
+		valid bool
+	}{
+		{input: "10.0.0.0/8", valid: true},
+		{input: "10.1.2.3/8", valid: true},
+		{input: "2001:db8::/32", valid: true},
+		{input: "::ffff:10.0.0.0/104", valid: true},
+		{input: "10.0.0.1", valid: false},
+		{input: "10.0.0.0/33", valid: false},
+		{input: "010.0.0.0/8", valid: false},
+		{input: "fe80::%eth0/64", valid: false},
+		{input: "/8", valid: false},
+		{input: "", valid: false},
+	}
+	for _, tt := range tests {
+		if valid := IsValidCIDR(tt.input); valid != tt.valid {
+			t.Errorf("Test \"%s\" failed, expected %t, got %t", tt.input, tt.valid, valid)
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package nftableslib
+
+import (
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/google/nftables"
+)
+
+// iptablesNftHooks maps names of built-in chains of iptables-nft to their hooks
+var iptablesNftHooks = map[string]nftables.ChainHook{
+	"PREROUTING":  nftables.ChainHookPrerouting,
+	"INPUT":       nftables.ChainHookInput,
+	"FORWARD":     nftables.ChainHookForward,
+	"OUTPUT":      nftables.ChainHookOutput,
+	"POSTROUTING": nftables.ChainHookPostrouting,
+}
+
+// iptablesNftChains lists built-in chains of iptables-nft tables and their priorities, the same in ip and ip6 families
+var iptablesNftChains = map[string]map[nftables.ChainHook]nftables.ChainPriority{
+	"raw": {
+		nftables.ChainHookPrerouting: nftables.ChainPriorityRaw,
+		nftables.ChainHookOutput:     nftables.ChainPriorityRaw,
+	},
+	"mangle": {
+		nftables.ChainHookPrerouting:  nftables.ChainPriorityMangle,
+		nftables.ChainHookInput:       nftables.ChainPriorityMangle,
+		nftables.ChainHookForward:     nftables.ChainPriorityMangle,
+		nftables.ChainHookOutput:      nftables.ChainPriorityMangle,
+		nftables.ChainHookPostrouting: nftables.ChainPriorityMangle,
+	},
+	"nat": {
+		nftables.ChainHookPrerouting:  nftables.ChainPriorityNATDest,
+		nftables.ChainHookInput:       nftables.ChainPriorityNATSource,
+		nftables.ChainHookOutput:      nftables.ChainPriorityNATDest,
+		nftables.ChainHookPostrouting: nftables.ChainPriorityNATSource,
+	},
+	"filter": {
+		nftables.ChainHookInput:   nftables.ChainPriorityFilter,
+		nftables.ChainHookForward: nftables.ChainPriorityFilter,
+		nftables.ChainHookOutput:  nftables.ChainPriorityFilter,
+	},
+	"security": {
+		nftables.ChainHookInput:   nftables.ChainPrioritySecurity,
+		nftables.ChainHookForward: nftables.ChainPrioritySecurity,
+		nftables.ChainHookOutput:  nftables.ChainPrioritySecurity,
+	},
+}
+
+// IptablesNftChain defines a built-in chain of iptables-nft programmed on the host
+type IptablesNftChain struct {
+	Family   nftables.TableFamily
+	Table    string
+	Chain    string
+	Hook     nftables.ChainHook
+	Priority nftables.ChainPriority
+}
+
+// IptablesNftReport lists built-in chains of iptables-nft tables found on the host, chains are ordered
+// by family, hook and priority.
+type IptablesNftReport struct {
+	Chains []*IptablesNftChain
+}
+
+// Present returns true if any iptables-nft table is programmed on the host
+func (r *IptablesNftReport) Present() bool {
+	return r != nil && len(r.Chains) != 0
+}
+
+// Priorities returns priorities occupied by iptables-nft chains at the hook in ascending order, chains of
+// inet family tables see packets of both ip and ip6 families, so chains of both are considered for inet.
+func (r *IptablesNftReport) Priorities(family nftables.TableFamily, hook nftables.ChainHook) []nftables.ChainPriority {
+	if r == nil {
+		return nil
+	}
+	seen := make(map[nftables.ChainPriority]bool)
+	priorities := make([]nftables.ChainPriority, 0)
+	for _, c := range r.Chains {
+		if c.Hook != hook || !iptablesNftFamily(family, c.Family) || seen[c.Priority] {
+			continue
+		}
+		seen[c.Priority] = true
+		priorities = append(priorities, c.Priority)
+	}
+	sort.Slice(priorities, func(i, j int) bool { return priorities[i] < priorities[j] })
+
+	return priorities
+}
+
+// iptablesNftFamily returns true if chains of iptables-nft of the family see packets of the family
+func iptablesNftFamily(family, chainFamily nftables.TableFamily) bool {
+	if family == nftables.TableFamilyINet {
+		return chainFamily == nftables.TableFamilyIPv4 || chainFamily == nftables.TableFamilyIPv6
+	}
+
+	return family == chainFamily
+}
+
+// RelativePosition defines whether a chain runs before or after other chains of the hook
+type RelativePosition int
+
+const (
+	// PriorityBefore places the chain before other chains of the hook
+	PriorityBefore RelativePosition = iota
+	// PriorityAfter places the chain after other chains of the hook
+	PriorityAfter
+)
+
+// PriorityRelativeTo returns the priority of a base chain of the family and the hook which runs before
+// or after all iptables-nft chains of the hook. Chains of equal priority run in an undefined order, so
+// the priority is one less than the lowest or one more than the highest priority. Priorities of built-in
+// chains iptables-nft creates at the hook are considered along with detected ones, so the order holds
+// when iptables-nft tables are created later.
+func PriorityRelativeTo(detected *IptablesNftReport, family nftables.TableFamily, hook nftables.ChainHook,
+	position RelativePosition) (nftables.ChainPriority, error) {
+	switch family {
+	case nftables.TableFamilyIPv4, nftables.TableFamilyIPv6, nftables.TableFamilyINet:
+	default:
+		return 0, fmt.Errorf("iptables-nft does not program chains of family %s", familyName(family))
+	}
+	priorities := detected.Priorities(family, hook)
+	for _, chains := range iptablesNftChains {
+		if p, ok := chains[hook]; ok {
+			priorities = append(priorities, p)
+		}
+	}
+	sort.Slice(priorities, func(i, j int) bool { return priorities[i] < priorities[j] })
+	if len(priorities) == 0 {
+		return 0, fmt.Errorf("iptables-nft does not program chains of hook %d", hook)
+	}
+	switch position {
+	case PriorityBefore:
+		if priorities[0] == math.MinInt32 {
+			return 0, fmt.Errorf("no priority precedes iptables-nft chains of hook %d", hook)
+		}
+		return priorities[0] - 1, nil
+	case PriorityAfter:
+		if priorities[len(priorities)-1] == math.MaxInt32 {
+			return 0, fmt.Errorf("no priority follows iptables-nft chains of hook %d", hook)
+		}
+		return priorities[len(priorities)-1] + 1, nil
+	}
+
+	return 0, fmt.Errorf("unknown relative position %d", position)
+}
+
+// DetectIptablesNft returns built-in chains of iptables-nft tables programmed on the host. A chain is
+// reported when a base chain of table filter, mangle, nat, raw or security of ip or ip6 family
+// carries the legacy name of its hook, like INPUT of the input hook.
+func (nft *nfTables) DetectIptablesNft() (*IptablesNftReport, error) {
+	var chains []*nftables.Chain
+	if err := nft.reads.do(func() (err error) {
+		chains, _, err = listChains(nft.conn, listFilter{})
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	report := &IptablesNftReport{Chains: make([]*IptablesNftChain, 0)}
+	for _, c := range chains {
+		if c.Type == "" || c.Table == nil {
+			continue
+		}
+		if c.Table.Family != nftables.TableFamilyIPv4 && c.Table.Family != nftables.TableFamilyIPv6 {
+			continue
+		}
+		builtin, ok := iptablesNftChains[c.Table.Name]
+		if !ok {
+			continue
+		}
+		hook, ok := iptablesNftHooks[c.Name]
+		if !ok || hook != c.Hooknum {
+			continue
+		}
+		if _, ok := builtin[hook]; !ok {
+			continue
+		}
+		report.Chains = append(report.Chains, &IptablesNftChain{
+			Family:   c.Table.Family,
+			Table:    c.Table.Name,
+			Chain:    c.Name,
+			Hook:     c.Hooknum,
+			Priority: c.Priority,
+		})
+	}
+	sort.SliceStable(report.Chains, func(i, j int) bool {
+		a, b := report.Chains[i], report.Chains[j]
+		if a.Family != b.Family {
+			return a.Family < b.Family
+		}
+		if a.Hook != b.Hook {
+			return a.Hook < b.Hook
+		}
+		return a.Priority < b.Priority
+	})
+
+	return report, nil
+}
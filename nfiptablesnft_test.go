@@ -0,0 +1,109 @@
+package nftableslib
+
+import (
+	"testing"
+
+	"github.com/google/nftables"
+	"golang.org/x/sys/unix"
+)
+
+func TestPriorityRelativeTo(t *testing.T) {
+	detected := &IptablesNftReport{Chains: []*IptablesNftChain{
+		{Family: nftables.TableFamilyIPv4, Table: "filter", Chain: "INPUT", Hook: nftables.ChainHookInput, Priority: nftables.ChainPriorityFilter},
+		{Family: nftables.TableFamilyIPv6, Table: "filter", Chain: "INPUT", Hook: nftables.ChainHookInput, Priority: 10},
+		{Family: nftables.TableFamilyIPv4, Table: "nat", Chain: "PREROUTING", Hook: nftables.ChainHookPrerouting, Priority: -110},
+	}}
+	tests := []struct {
+		name     string
+		detected *IptablesNftReport
+		family   nftables.TableFamily
+		hook     nftables.ChainHook
+		position RelativePosition
+		priority nftables.ChainPriority
+		success  bool
+	}{
+		{
+			name:     "Before mangle of input hook",
+			detected: detected,
+			family:   nftables.TableFamilyIPv4,
+			hook:     nftables.ChainHookInput,
+			position: PriorityBefore,
+			priority: nftables.ChainPriorityMangle - 1,
+			success:  true,
+		},
+		{
+			name:     "After nat of input hook",
+			detected: detected,
+			family:   nftables.TableFamilyIPv4,
+			hook:     nftables.ChainHookInput,
+			position: PriorityAfter,
+			priority: nftables.ChainPriorityNATSource + 1,
+			success:  true,
+		},
+		{
+			name:     "Detected chain of non standard priority",
+			detected: detected,
+			family:   nftables.TableFamilyIPv4,
+			hook:     nftables.ChainHookPrerouting,
+			position: PriorityBefore,
+			priority: nftables.ChainPriorityRaw - 1,
+			success:  true,
+		},
+		{
+			name: "Inet family considers ip6 chains",
+			detected: &IptablesNftReport{Chains: []*IptablesNftChain{
+				{Family: nftables.TableFamilyIPv6, Table: "filter", Chain: "FORWARD", Hook: nftables.ChainHookForward, Priority: 200},
+			}},
+			family:   nftables.TableFamilyINet,
+			hook:     nftables.ChainHookForward,
+			position: PriorityAfter,
+			priority: 201,
+			success:  true,
+		},
+		{
+			name: "Other family is not considered",
+			detected: &IptablesNftReport{Chains: []*IptablesNftChain{
+				{Family: nftables.TableFamilyIPv6, Table: "filter", Chain: "FORWARD", Hook: nftables.ChainHookForward, Priority: 200},
+			}},
+			family:   nftables.TableFamilyIPv4,
+			hook:     nftables.ChainHookForward,
+			position: PriorityAfter,
+			priority: nftables.ChainPrioritySecurity + 1,
+			success:  true,
+		},
+		{
+			name:     "Nothing detected",
+			family:   nftables.TableFamilyIPv6,
+			hook:     nftables.ChainHookPostrouting,
+			position: PriorityAfter,
+			priority: nftables.ChainPriorityNATSource + 1,
+			success:  true,
+		},
+		{
+			name:     "Family without iptables-nft",
+			family:   nftables.TableFamilyBridge,
+			hook:     nftables.ChainHookInput,
+			position: PriorityBefore,
+		},
+		{
+			name:     "Hook without iptables-nft",
+			family:   nftables.TableFamilyIPv4,
+			hook:     unix.NF_INET_NUMHOOKS,
+			position: PriorityBefore,
+		},
+	}
+	for _, tt := range tests {
+		priority, err := PriorityRelativeTo(tt.detected, tt.family, tt.hook, tt.position)
+		if err != nil && tt.success {
+			t.Errorf("Test \"%s\" failed with error: %+v but supposed to succeed", tt.name, err)
+			continue
+		}
+		if err == nil && !tt.success {
+			t.Errorf("Test \"%s\" succeeded but supposed to fail", tt.name)
+			continue
+		}
+		if tt.success && priority != tt.priority {
+			t.Errorf("Test \"%s\" failed, expected priority %d, got %d", tt.name, tt.priority, priority)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package nftableslib
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+// ErrChainNotFound is returned when a rule jumps to or goes to a chain which does not exist in the table,
+// neither in the store nor on the host. RuleID is 0 if the rule was rejected when it was created.
+type ErrChainNotFound struct {
+	// Chain is the name of the chain the rule belongs to
+	Chain  string
+	RuleID uint32
+	// Target is the name of the missing chain
+	Target string
+}
+
+func (e *ErrChainNotFound) Error() string {
+	if e.RuleID == 0 {
+		return fmt.Sprintf("rule of chain %s refers to chain %s which does not exist", e.Chain, e.Target)
+	}
+	return fmt.Sprintf("rule %d of chain %s refers to chain %s which does not exist", e.RuleID, e.Chain, e.Target)
+}
+
+// AllowForwardReference allows rules queued by Create and Insert to jump to chains which do not exist yet,
+// the chains are expected to be created later in the same transaction. Such rules are held by the library
+// and queued by Tables().Commit after their targets are validated again, so they follow the creation of
+// the chains in the batch. Rules programmed immediately must refer to existing chains.
+func AllowForwardReference() TableOption {
+	return func(o *tableOptions) {
+		o.forwardReferences = true
+	}
+}
+
+// forwardReference describes a rule held until Commit because its targets did not exist when it was created
+type forwardReference struct {
+	rule    *nfRule
+	op      ruleOperation
+	targets []string
+}
+
+// ruleTargets returns sorted names of chains the rule jumps to or goes to
+func ruleTargets(rule *Rule) []string {
+	verdicts := make([]*expr.Verdict, 0)
+	names := make(map[string]bool)
+	if action := rule.action(); action != nil {
+		verdicts = append(verdicts, action.verdict)
+		// Rules of the inline chain are validated along with the rule binding it
+		for _, r := range action.inline {
+			for _, t := range ruleTargets(r) {
+				names[t] = true
+			}
+		}
+		if lb := action.loadbalance; lb != nil {
+			for _, c := range lb.chains {
+				names[c] = true
+			}
+		}
+	}
+	if rule.MatchAct != nil {
+		for _, a := range rule.MatchAct.ActElement {
+			if a != nil {
+				verdicts = append(verdicts, a.verdict)
+			}
+		}
+	}
+	for _, e := range rule.RawExprs {
+		if v, ok := e.(*expr.Verdict); ok {
+			verdicts = append(verdicts, v)
+		}
+	}
+	for _, v := range verdicts {
+		if v == nil || v.Chain == "" {
+			continue
+		}
+		if v.Kind == expr.VerdictKind(unix.NFT_JUMP) || v.Kind == expr.VerdictKind(unix.NFT_GOTO) {
+			names[v.Chain] = true
+		}
+	}
+	targets := make([]string, 0, len(names))
+	for name := range names {
+		targets = append(targets, name)
+	}
+	sort.Strings(targets)
+
+	return targets
+}
+
+// checkTargets validates chains the rule refers to against the store and the host, missing chains
+// are returned if the rule is queued and the table allows forward references.
+func (nfr *nfRules) checkTargets(rule *Rule, queued bool) ([]string, error) {
+	if nfr.chains == nil {
+		return nil, nil
+	}
+	missing := make([]string, 0)
+	for _, target := range ruleTargets(rule) {
+		if !nfr.chains.Exist(target) {
+			missing = append(missing, target)
+		}
+	}
+	if len(missing) == 0 {
+		return nil, nil
+	}
+	if !queued || !nfr.opts.allowForwardReferences() {
+		return nil, &ErrChainNotFound{Chain: nfr.chain.Name, Target: missing[0]}
+	}
+
+	return missing, nil
+}
+
+// forwardReferences returns rules of the chain held until Commit
+func (nfr *nfRules) forwardReferences() []*forwardReference {
+	nfr.Lock()
+	defer nfr.Unlock()
+
+	return append([]*forwardReference{}, nfr.forward...)
+}
+
+// queueForwardReferences pushes rules held until Commit to the connection
+func (nfr *nfRules) queueForwardReferences() {
+	nfr.Lock()
+	defer nfr.Unlock()
+	for _, f := range nfr.forward {
+		nfr.pushRule(f.rule, f.op)
+	}
+	nfr.forward = nil
+}
+
+// dropForwardReference forgets the held rule when the rule is deleted before Commit
+func (nfr *nfRules) dropForwardReference(id uint32) bool {
+	for i, f := range nfr.forward {
+		if f.rule.id == id {
+			nfr.forward = append(nfr.forward[:i], nfr.forward[i+1:]...)
+			return true
+		}
+	}
+
+	return false
+}
+
+// Commit validates chains referred by rules held because of forward references, queues the rules
+// and flushes all queued operations as a single batch. If a referred chain still does not exist,
+// ErrChainNotFound is returned and nothing is flushed.
+func (nft *nfTables) Commit() error {
+	if err := writable(nft.conn); err != nil {
+		return err
+	}
+	nft.Lock()
+	chains := make([]*nfChains, 0)
+	for _, tables := range nft.tables {
+		for _, nt := range tables {
+			if nfc, ok := nt.ChainsInterface.(*nfChains); ok {
+				chains = append(chains, nfc)
+			}
+		}
+	}
+	nft.Unlock()
+	held := make([]*nfRules, 0)
+	for _, nfc := range chains {
+		for _, nfr := range nfc.rulesStores() {
+			refs := nfr.forwardReferences()
+			if len(refs) == 0 {
+				continue
+			}
+			for _, f := range refs {
+				for _, target := range f.targets {
+					if !nfc.Exist(target) {
+						return &ErrChainNotFound{Chain: nfr.chain.Name, RuleID: f.rule.id, Target: target}
+					}
+				}
+			}
+			held = append(held, nfr)
+		}
+	}
+	for _, nfr := range held {
+		nfr.queueForwardReferences()
+	}
+
+	return flush(nft.conn)
+}
+
+// rulesStores returns rules stores of the table's chains
+func (nfc *nfChains) rulesStores() []*nfRules {
+	nfc.Lock()
+	defer nfc.Unlock()
+	stores := make([]*nfRules, 0, len(nfc.chains))
+	for _, c := range nfc.chains {
+		if nfr, ok := c.RulesInterface.(*nfRules); ok {
+			stores = append(stores, nfr)
+		}
+	}
+
+	return stores
+}
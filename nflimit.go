@@ -0,0 +1,130 @@
+package nftableslib
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/nftables/expr"
+)
+
+const (
+	// KBytes defines the number of bytes in kbytes unit of byte based limits
+	KBytes = 1024
+	// MBytes defines the number of bytes in mbytes unit of byte based limits
+	MBytes = 1024 * 1024
+)
+
+// Limit defines the rate limit of the rule, the rule matches packets within the rate, or packets
+// exceeding the rate when Over is true. Rate is a number of packets per Unit, or a number of bytes
+// per Unit when Bytes is true. Unit must be a second, a minute, an hour, a day or a week, Burst 0
+// lets the kernel to use its default burst.
+type Limit struct {
+	Rate  uint64        `json:"rate,omitempty"`
+	Unit  time.Duration `json:"unit,omitempty"`
+	Burst uint32        `json:"burst,omitempty"`
+	Bytes bool          `json:"bytes,omitempty"`
+	Over  bool          `json:"over,omitempty"`
+}
+
+// LimitPacketsPerSecond returns Limit of pps packets per second
+func LimitPacketsPerSecond(pps uint64) *Limit {
+	return &Limit{Rate: pps, Unit: time.Second}
+}
+
+// LimitBitsPerSecond returns byte based Limit for the rate in bits per second,
+// the rate is rounded down to bytes.
+func LimitBitsPerSecond(bps uint64) *Limit {
+	return &Limit{Rate: bps / 8, Unit: time.Second, Bytes: true}
+}
+
+// ParseLimitRate parses the rate in nft syntax, "10/second" for packets or "100 mbytes/second"
+// for bytes, units of bytes are bytes, kbytes and mbytes. The rate can be prefixed by "over".
+func ParseLimitRate(rate string) (*Limit, error) {
+	fields := strings.Fields(strings.Replace(rate, "/", " / ", 1))
+	l := &Limit{}
+	if len(fields) != 0 && fields[0] == "over" {
+		l.Over = true
+		fields = fields[1:]
+	}
+	var unit string
+	multiplier := uint64(1)
+	switch len(fields) {
+	case 3:
+		// Packets, like "10 / second"
+		if fields[1] != "/" {
+			return nil, fmt.Errorf("invalid limit rate %q", rate)
+		}
+		unit = fields[2]
+	case 4:
+		// Bytes, like "100 mbytes / second"
+		if fields[2] != "/" {
+			return nil, fmt.Errorf("invalid limit rate %q", rate)
+		}
+		switch fields[1] {
+		case "bytes":
+		case "kbytes":
+			multiplier = KBytes
+		case "mbytes":
+			multiplier = MBytes
+		default:
+			return nil, fmt.Errorf("invalid unit %s of limit rate %q", fields[1], rate)
+		}
+		l.Bytes = true
+		unit = fields[3]
+	default:
+		return nil, fmt.Errorf("invalid limit rate %q", rate)
+	}
+	value, err := strconv.ParseUint(fields[0], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid value of limit rate %q: %+v", rate, err)
+	}
+	l.Rate = value * multiplier
+	switch unit {
+	case "second":
+		l.Unit = time.Second
+	case "minute":
+		l.Unit = time.Minute
+	case "hour":
+		l.Unit = time.Hour
+	case "day":
+		l.Unit = 24 * time.Hour
+	case "week":
+		l.Unit = 7 * 24 * time.Hour
+	default:
+		return nil, fmt.Errorf("invalid time unit %s of limit rate %q", unit, rate)
+	}
+
+	return l, l.Validate()
+}
+
+// Validate checks parameters of Limit struct
+func (l *Limit) Validate() error {
+	if l.Rate == 0 {
+		return fmt.Errorf("limit rate cannot be 0")
+	}
+	switch l.Unit {
+	case time.Second, time.Minute, time.Hour, 24 * time.Hour, 7 * 24 * time.Hour:
+	default:
+		return fmt.Errorf("invalid limit unit %s, it must be a second, a minute, an hour, a day or a week", l.Unit)
+	}
+
+	return nil
+}
+
+func getExprForLimit(l *Limit) []expr.Any {
+	// [ limit rate 12500000/second burst 0 type bytes flags 0x1 ]
+	t := expr.LimitTypePkts
+	if l.Bytes {
+		t = expr.LimitTypePktBytes
+	}
+
+	return []expr.Any{&expr.Limit{
+		Type:  t,
+		Rate:  l.Rate,
+		Over:  l.Over,
+		Unit:  expr.LimitTime(l.Unit / time.Second),
+		Burst: l.Burst,
+	}}
+}
@@ -0,0 +1,127 @@
+package nftableslib
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/nftables/expr"
+)
+
+func TestParseLimitRate(t *testing.T) {
+	tests := []struct {
+		name    string
+		rate    string
+		limit   *Limit
+		success bool
+	}{
+		{
+			name:    "Packets per second",
+			rate:    "10/second",
+			limit:   &Limit{Rate: 10, Unit: time.Second},
+			success: true,
+		},
+		{
+			name:    "Packets over per minute",
+			rate:    "over 600/minute",
+			limit:   &Limit{Rate: 600, Unit: time.Minute, Over: true},
+			success: true,
+		},
+		{
+			name:    "Bytes per day",
+			rate:    "1500 bytes/day",
+			limit:   &Limit{Rate: 1500, Unit: 24 * time.Hour, Bytes: true},
+			success: true,
+		},
+		{
+			name:    "Kbytes per second",
+			rate:    "64 kbytes/second",
+			limit:   &Limit{Rate: 64 * 1024, Unit: time.Second, Bytes: true},
+			success: true,
+		},
+		{
+			name:    "Mbytes over per second",
+			rate:    "over 100 mbytes/second",
+			limit:   &Limit{Rate: 100 * 1024 * 1024, Unit: time.Second, Bytes: true, Over: true},
+			success: true,
+		},
+		{
+			name:    "Unknown byte unit",
+			rate:    "100 gbytes/second",
+			success: false,
+		},
+		{
+			name:    "Unknown time unit",
+			rate:    "100/month",
+			success: false,
+		},
+		{
+			name:    "Zero rate",
+			rate:    "0/second",
+			success: false,
+		},
+		{
+			name:    "Missing time unit",
+			rate:    "100 mbytes",
+			success: false,
+		},
+	}
+	for _, tt := range tests {
+		limit, err := ParseLimitRate(tt.rate)
+		if err != nil && tt.success {
+			t.Errorf("test \"%s\" failed with error: %+v but supposed to succeed", tt.name, err)
+			continue
+		}
+		if err == nil && !tt.success {
+			t.Errorf("test \"%s\" succeeded but supposed to fail", tt.name)
+			continue
+		}
+		if tt.success && !reflect.DeepEqual(limit, tt.limit) {
+			t.Errorf("test \"%s\": expected limit %+v, got %+v", tt.name, *tt.limit, *limit)
+		}
+	}
+}
+
+func TestLimitExpr(t *testing.T) {
+	tests := []struct {
+		name  string
+		limit *Limit
+		expr  *expr.Limit
+	}{
+		{
+			name:  "Packets per second",
+			limit: LimitPacketsPerSecond(100),
+			expr:  &expr.Limit{Type: expr.LimitTypePkts, Rate: 100, Unit: expr.LimitTimeSecond},
+		},
+		{
+			name:  "Bits per second",
+			limit: LimitBitsPerSecond(100000000),
+			expr:  &expr.Limit{Type: expr.LimitTypePktBytes, Rate: 12500000, Unit: expr.LimitTimeSecond},
+		},
+		{
+			name:  "Mbytes over per second",
+			limit: &Limit{Rate: 100 * MBytes, Unit: time.Second, Bytes: true, Over: true},
+			expr:  &expr.Limit{Type: expr.LimitTypePktBytes, Rate: 104857600, Over: true, Unit: expr.LimitTimeSecond},
+		},
+		{
+			name:  "Kbytes per hour with burst",
+			limit: &Limit{Rate: 10 * KBytes, Unit: time.Hour, Burst: 2048, Bytes: true},
+			expr:  &expr.Limit{Type: expr.LimitTypePktBytes, Rate: 10240, Unit: expr.LimitTimeHour, Burst: 2048},
+		},
+		{
+			name:  "Packets per week",
+			limit: &Limit{Rate: 5, Unit: 7 * 24 * time.Hour},
+			expr:  &expr.Limit{Type: expr.LimitTypePkts, Rate: 5, Unit: expr.LimitTimeWeek},
+		},
+	}
+	for _, tt := range tests {
+		if err := tt.limit.Validate(); err != nil {
+			t.Errorf("test \"%s\" failed to validate limit with error: %+v", tt.name, err)
+			continue
+		}
+		re := getExprForLimit(tt.limit)
+		if len(re) != 1 || !reflect.DeepEqual(re[0], tt.expr) {
+			t.Errorf("test \"%s\": expected expression %+v, got %+v", tt.name, tt.expr, re)
+		}
+	}
+}
@@ -0,0 +1,248 @@
+package nftableslib
+
+import (
+	"encoding/binary"
+	"strings"
+
+	"github.com/google/nftables"
+	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// listFilter selects tables and chains listed from the host, zero values match everything.
+// Family is applied by the kernel, table and name prefix are applied while the dump is decoded,
+// so objects which do not match are not decoded past their names.
+type listFilter struct {
+	family nftables.TableFamily
+	table  string
+	prefix string
+}
+
+func (f listFilter) match(family nftables.TableFamily, table, name string) bool {
+	if f.family != unix.NFPROTO_UNSPEC && f.family != family {
+		return false
+	}
+	if f.table != "" && f.table != table {
+		return false
+	}
+
+	return strings.HasPrefix(name, f.prefix)
+}
+
+// listTables returns tables of the host selected by the filter and the number of skipped tables,
+// table filter of listFilter does not apply to tables.
+func listTables(conn NetNS, f listFilter) ([]*nftables.Table, int, error) {
+	f.table = ""
+	c, ok := readConn(conn).(*nftables.Conn)
+	if !ok {
+		all, err := conn.ListTables()
+		if err != nil {
+			return nil, 0, err
+		}
+		tables := make([]*nftables.Table, 0, len(all))
+		for _, t := range all {
+			if f.match(t.Family, "", t.Name) {
+				tables = append(tables, t)
+			}
+		}
+		return tables, len(all) - len(tables), nil
+	}
+	tables := make([]*nftables.Table, 0)
+	skipped := 0
+	if err := dumpMessages(c, dumpRequest(unix.NFT_MSG_GETTABLE, f.family), func(b []byte) error {
+		t, err := tableFromMessage(b, f)
+		if err != nil {
+			return err
+		}
+		if t == nil {
+			skipped++
+			return nil
+		}
+		tables = append(tables, t)
+		return nil
+	}); err != nil {
+		return nil, 0, err
+	}
+
+	return tables, skipped, nil
+}
+
+// listChains returns chains of the host selected by the filter and the number of skipped chains
+func listChains(conn NetNS, f listFilter) ([]*nftables.Chain, int, error) {
+	c, ok := readConn(conn).(*nftables.Conn)
+	if !ok {
+		all, err := conn.ListChains()
+		if err != nil {
+			return nil, 0, err
+		}
+		chains := make([]*nftables.Chain, 0, len(all))
+		for _, ch := range all {
+			if f.match(ch.Table.Family, ch.Table.Name, ch.Name) {
+				chains = append(chains, ch)
+			}
+		}
+		return chains, len(all) - len(chains), nil
+	}
+	chains := make([]*nftables.Chain, 0)
+	skipped := 0
+	if err := dumpMessages(c, dumpRequest(unix.NFT_MSG_GETCHAIN, f.family), func(b []byte) error {
+		ch, err := chainFromMessage(b, f)
+		if err != nil {
+			return err
+		}
+		if ch == nil {
+			skipped++
+			return nil
+		}
+		chains = append(chains, ch)
+		return nil
+	}); err != nil {
+		return nil, 0, err
+	}
+
+	return chains, skipped, nil
+}
+
+// listChainsUse returns chains of the host selected by the filter along with the number of references
+// to every chain reported by the kernel, other connections do not report it and their counts are 0.
+func listChainsUse(conn NetNS, f listFilter) ([]*nftables.Chain, []uint32, error) {
+	c, ok := readConn(conn).(*nftables.Conn)
+	if !ok {
+		chains, _, err := listChains(conn, f)
+		if err != nil {
+			return nil, nil, err
+		}
+		return chains, make([]uint32, len(chains)), nil
+	}
+	chains := make([]*nftables.Chain, 0)
+	uses := make([]uint32, 0)
+	if err := dumpMessages(c, dumpRequest(unix.NFT_MSG_GETCHAIN, f.family), func(b []byte) error {
+		ch, err := chainFromMessage(b, f)
+		if err != nil || ch == nil {
+			return err
+		}
+		chains = append(chains, ch)
+		uses = append(uses, chainUse(b))
+		return nil
+	}); err != nil {
+		return nil, nil, err
+	}
+
+	return chains, uses, nil
+}
+
+// chainUse returns the number of references to the chain carried by NFT_MSG_NEWCHAIN message
+func chainUse(b []byte) uint32 {
+	ad, err := netlink.NewAttributeDecoder(b[4:])
+	if err != nil {
+		return 0
+	}
+	ad.ByteOrder = binary.BigEndian
+	for ad.Next() {
+		if ad.Type() == unix.NFTA_CHAIN_USE {
+			return ad.Uint32()
+		}
+	}
+
+	return 0
+}
+
+// dumpRequest returns the request of the dump of objects of the family, the kernel dumps
+// objects of all families when the family is unspecified.
+func dumpRequest(msgType int, family nftables.TableFamily) netlink.Message {
+	return netlink.Message{
+		Header: netlink.Header{
+			Type:  netlink.HeaderType((unix.NFNL_SUBSYS_NFTABLES << 8) | msgType),
+			Flags: netlink.Request | netlink.Acknowledge | netlink.Dump,
+		},
+		// nfgenmsg header: family, version and resource id
+		Data: []byte{uint8(family), unix.NFNETLINK_V0, 0, 0},
+	}
+}
+
+// tableFromMessage decodes the table carried by NFT_MSG_NEWTABLE message the way
+// github.com/google/nftables decodes it, except use and flags are decoded in network byte order
+// the kernel sends them in. nil is returned if the table does not match the filter.
+func tableFromMessage(b []byte, f listFilter) (*nftables.Table, error) {
+	t := &nftables.Table{Family: nftables.TableFamily(b[0])}
+	ad, err := netlink.NewAttributeDecoder(b[4:])
+	if err != nil {
+		return nil, err
+	}
+	ad.ByteOrder = binary.BigEndian
+	for ad.Next() {
+		switch ad.Type() {
+		case unix.NFTA_TABLE_NAME:
+			t.Name = ad.String()
+			if !f.match(t.Family, "", t.Name) {
+				return nil, nil
+			}
+		case unix.NFTA_TABLE_USE:
+			t.Use = ad.Uint32()
+		case unix.NFTA_TABLE_FLAGS:
+			t.Flags = ad.Uint32()
+		}
+	}
+
+	return t, ad.Err()
+}
+
+// chainFromMessage decodes the chain carried by NFT_MSG_NEWCHAIN message the way
+// github.com/google/nftables decodes it, nil is returned as soon as the table or the name
+// of the chain does not match the filter. The kernel puts the table and the name of the chain
+// first, so attributes of skipped chains are not decoded.
+func chainFromMessage(b []byte, f listFilter) (*nftables.Chain, error) {
+	family := nftables.TableFamily(b[0])
+	ad, err := netlink.NewAttributeDecoder(b[4:])
+	if err != nil {
+		return nil, err
+	}
+	c := &nftables.Chain{}
+	for ad.Next() {
+		switch ad.Type() {
+		case unix.NFTA_CHAIN_TABLE:
+			c.Table = &nftables.Table{Name: ad.String(), Family: family}
+			if f.table != "" && f.table != c.Table.Name {
+				return nil, nil
+			}
+		case unix.NFTA_CHAIN_NAME:
+			c.Name = ad.String()
+			if !strings.HasPrefix(c.Name, f.prefix) {
+				return nil, nil
+			}
+		case unix.NFTA_CHAIN_TYPE:
+			c.Type = nftables.ChainType(ad.String())
+		case unix.NFTA_CHAIN_POLICY:
+			policy := nftables.ChainPolicy(ad.Uint32())
+			c.Policy = &policy
+		case unix.NFTA_CHAIN_HOOK:
+			ad.Do(func(b []byte) error {
+				hd, err := netlink.NewAttributeDecoder(b)
+				if err != nil {
+					return err
+				}
+				hd.ByteOrder = binary.BigEndian
+				for hd.Next() {
+					switch hd.Type() {
+					case unix.NFTA_HOOK_HOOKNUM:
+						c.Hooknum = nftables.ChainHook(hd.Uint32())
+					case unix.NFTA_HOOK_PRIORITY:
+						c.Priority = nftables.ChainPriority(hd.Uint32())
+					}
+				}
+				return hd.Err()
+			})
+		}
+	}
+	if err := ad.Err(); err != nil {
+		return nil, err
+	}
+	if c.Table == nil {
+		c.Table = &nftables.Table{Family: family}
+	}
+	if !f.match(family, c.Table.Name, c.Name) {
+		return nil, nil
+	}
+
+	return c, nil
+}
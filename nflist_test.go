@@ -0,0 +1,135 @@
+package nftableslib
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// chainMessage returns NFT_MSG_NEWCHAIN message data laid out the way the kernel dumps chains
+func chainMessage(t testing.TB, family nftables.TableFamily, table, name string, hook *nftables.Chain) []byte {
+	attrs := []netlink.Attribute{
+		{Type: unix.NFTA_CHAIN_TABLE, Data: []byte(table + "\x00")},
+		{Type: unix.NFTA_CHAIN_HANDLE, Data: binaryutil.BigEndian.PutUint64(1)},
+		{Type: unix.NFTA_CHAIN_NAME, Data: []byte(name + "\x00")},
+	}
+	if hook != nil {
+		h, err := netlink.MarshalAttributes([]netlink.Attribute{
+			{Type: unix.NFTA_HOOK_HOOKNUM, Data: binaryutil.BigEndian.PutUint32(uint32(hook.Hooknum))},
+			{Type: unix.NFTA_HOOK_PRIORITY, Data: binaryutil.BigEndian.PutUint32(uint32(hook.Priority))},
+		})
+		if err != nil {
+			t.Fatalf("failed to marshal hook with error: %+v", err)
+		}
+		attrs = append(attrs,
+			netlink.Attribute{Type: unix.NLA_F_NESTED | unix.NFTA_CHAIN_HOOK, Data: h},
+			netlink.Attribute{Type: unix.NFTA_CHAIN_POLICY, Data: binaryutil.NativeEndian.PutUint32(uint32(*hook.Policy))},
+			netlink.Attribute{Type: unix.NFTA_CHAIN_TYPE, Data: []byte(string(hook.Type) + "\x00")},
+		)
+	}
+	attrs = append(attrs, netlink.Attribute{Type: unix.NFTA_CHAIN_USE, Data: binaryutil.BigEndian.PutUint32(0)})
+	data, err := netlink.MarshalAttributes(attrs)
+	if err != nil {
+		t.Fatalf("failed to marshal chain with error: %+v", err)
+	}
+
+	return append([]byte{uint8(family), unix.NFNETLINK_V0, 0, 0}, data...)
+}
+
+func TestChainFromMessage(t *testing.T) {
+	policy := nftables.ChainPolicyDrop
+	base := &nftables.Chain{
+		Hooknum:  nftables.ChainHookInput,
+		Priority: nftables.ChainPriorityFilter,
+		Type:     nftables.ChainTypeFilter,
+		Policy:   &policy,
+	}
+	tests := []struct {
+		name   string
+		msg    []byte
+		filter listFilter
+		chain  *nftables.Chain
+	}{
+		{
+			name:   "Base chain",
+			msg:    chainMessage(t, nftables.TableFamilyIPv4, "filter", "input", base),
+			filter: listFilter{table: "filter"},
+			chain: &nftables.Chain{
+				Name:     "input",
+				Table:    &nftables.Table{Name: "filter", Family: nftables.TableFamilyIPv4},
+				Hooknum:  nftables.ChainHookInput,
+				Priority: nftables.ChainPriorityFilter,
+				Type:     nftables.ChainTypeFilter,
+				Policy:   &policy,
+			},
+		},
+		{
+			name:   "Regular chain matching prefix",
+			msg:    chainMessage(t, nftables.TableFamilyIPv6, "nat", "svc-web", nil),
+			filter: listFilter{family: nftables.TableFamilyIPv6, table: "nat", prefix: "svc-"},
+			chain: &nftables.Chain{
+				Name:  "svc-web",
+				Table: &nftables.Table{Name: "nat", Family: nftables.TableFamilyIPv6},
+			},
+		},
+		{
+			name:   "Chain of other table",
+			msg:    chainMessage(t, nftables.TableFamilyIPv4, "KUBE-SERVICES", "input", base),
+			filter: listFilter{table: "filter"},
+		},
+		{
+			name:   "Chain not matching prefix",
+			msg:    chainMessage(t, nftables.TableFamilyIPv4, "filter", "ep-web", nil),
+			filter: listFilter{prefix: "svc-"},
+		},
+		{
+			name:   "Chain of other family",
+			msg:    chainMessage(t, nftables.TableFamilyIPv4, "filter", "input", nil),
+			filter: listFilter{family: nftables.TableFamilyIPv6},
+		},
+	}
+	for _, tt := range tests {
+		chain, err := chainFromMessage(tt.msg, tt.filter)
+		if err != nil {
+			t.Errorf("test \"%s\" failed with error: %+v but supposed to succeed", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(chain, tt.chain) {
+			t.Errorf("test \"%s\" failed, expected chain %+v, got %+v", tt.name, tt.chain, chain)
+		}
+	}
+}
+
+// BenchmarkListChains decodes a dump of 10000 chains of 1000 tables, as a host running kube-proxy
+// and docker would return, selecting chains of a single table skips decoding of the rest.
+func BenchmarkListChains(b *testing.B) {
+	policy := nftables.ChainPolicyAccept
+	base := &nftables.Chain{Hooknum: nftables.ChainHookInput, Type: nftables.ChainTypeFilter, Policy: &policy}
+	msgs := make([][]byte, 0, 10000)
+	for i := 0; i < 10000; i++ {
+		msgs = append(msgs, chainMessage(b, nftables.TableFamilyIPv4, fmt.Sprintf("table-%d", i%1000), fmt.Sprintf("chain-%d", i), base))
+	}
+	for _, bb := range []struct {
+		name   string
+		filter listFilter
+	}{
+		{name: "All", filter: listFilter{}},
+		{name: "Table", filter: listFilter{table: "table-7"}},
+		{name: "Table and prefix", filter: listFilter{table: "table-7", prefix: "chain-7"}},
+	} {
+		b.Run(bb.name, func(b *testing.B) {
+			for n := 0; n < b.N; n++ {
+				for _, m := range msgs {
+					if _, err := chainFromMessage(m, bb.filter); err != nil {
+						b.Fatalf("failed to decode chain with error: %+v", err)
+					}
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,55 @@
+package nftableslib
+
+import (
+	"sync"
+
+	"github.com/google/nftables"
+)
+
+// tableFamilies lists families of tables, locks of all families are taken in this order
+var tableFamilies = []nftables.TableFamily{
+	nftables.TableFamilyINet,
+	nftables.TableFamilyIPv4,
+	nftables.TableFamilyARP,
+	nftables.TableFamilyNetdev,
+	nftables.TableFamilyBridge,
+	nftables.TableFamilyIPv6,
+}
+
+// familyLocks serializes operations on tables of a family which read the host and then change the store,
+// operations on tables of different families run in parallel. The map is not changed after it is built.
+type familyLocks map[nftables.TableFamily]*sync.Mutex
+
+func newFamilyLocks() familyLocks {
+	l := make(familyLocks, len(tableFamilies))
+	for _, f := range tableFamilies {
+		l[f] = &sync.Mutex{}
+	}
+
+	return l
+}
+
+// lock locks the family and returns the func unlocking it, the unspecified family and unknown
+// families lock all families.
+func (l familyLocks) lock(f nftables.TableFamily) func() {
+	m, ok := l[f]
+	if !ok {
+		return l.lockAll()
+	}
+	m.Lock()
+
+	return m.Unlock
+}
+
+// lockAll locks all families, it is used by operations on the whole ruleset
+func (l familyLocks) lockAll() func() {
+	for _, f := range tableFamilies {
+		l[f].Lock()
+	}
+
+	return func() {
+		for i := len(tableFamilies) - 1; i >= 0; i-- {
+			l[tableFamilies[i]].Unlock()
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package nftableslib
+
+import (
+	"fmt"
+
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+// maskedRegister is the register used by masked matches, the library's own expressions use
+// registers 1 and 2, so values of masked matches never overwrite them. The register is 16 bytes
+// long and fits the longest masked match.
+const maskedRegister = unix.NFT_REG_3
+
+// MaxMaskedMatchLength defines the longest data a masked match can compare
+const MaxMaskedMatchLength = 16
+
+// MatchMasked returns expressions loading length bytes of the source into a register, masking them
+// and comparing the result with the value: [ load ], [ reg & mask ], [ cmp op reg value ]. The source
+// is either expr.PayloadBase, then length bytes are loaded at the offset of the header, or expr.MetaKey,
+// then offset must be 0 and length must match the length of the meta key. Mask and value are compared
+// with the register bytewise, payload carries data in network byte order while meta keys such as mark
+// are loaded in host byte order (binaryutil.NativeEndian). Bits of the value outside of the mask are
+// not allowed as they could never match. Expressions are intended for Rule's RawExprs.
+func MatchMasked(source interface{}, offset, length uint32, mask, value []byte, op Operator) ([]expr.Any, error) {
+	if length == 0 || length > MaxMaskedMatchLength {
+		return nil, fmt.Errorf("invalid length %d of masked match, it must be in range 1-%d", length, MaxMaskedMatchLength)
+	}
+	if len(mask) != int(length) || len(value) != int(length) {
+		return nil, fmt.Errorf("mask of %d bytes and value of %d bytes do not match length %d of masked match", len(mask), len(value), length)
+	}
+	for i := range value {
+		if value[i]&^mask[i] != 0 {
+			return nil, fmt.Errorf("value %x of masked match has bits outside of mask %x", value, mask)
+		}
+	}
+	if err := validateRelOp(op, "masked", false); err != nil {
+		return nil, err
+	}
+
+	re := []expr.Any{}
+	switch s := source.(type) {
+	case expr.PayloadBase:
+		switch s {
+		case expr.PayloadBaseLLHeader, expr.PayloadBaseNetworkHeader, expr.PayloadBaseTransportHeader:
+		default:
+			return nil, fmt.Errorf("unsupported payload base %d of masked match", s)
+		}
+		// [ payload load length b @ base header + offset => reg 3 ]
+		re = append(re, &expr.Payload{DestRegister: maskedRegister, Base: s, Offset: offset, Len: length})
+	case expr.MetaKey:
+		if offset != 0 {
+			return nil, fmt.Errorf("offset of masked match of meta key %d must be 0", s)
+		}
+		// [ meta load key => reg 3 ]
+		re = append(re, &expr.Meta{Key: s, Register: maskedRegister})
+	default:
+		return nil, fmt.Errorf("unsupported source %T of masked match, it must be expr.PayloadBase or expr.MetaKey", source)
+	}
+	// Mask of all ones does not change the data, the bitwise expression is not needed
+	if !allOnes(mask) {
+		// [ bitwise reg 3 = (reg 3 & mask) ^ 0 ]
+		re = append(re, &expr.Bitwise{
+			SourceRegister: maskedRegister,
+			DestRegister:   maskedRegister,
+			Len:            length,
+			Mask:           append([]byte{}, mask...),
+			Xor:            make([]byte, length),
+		})
+	}
+	// [ cmp op reg 3 value ]
+	re = append(re, &expr.Cmp{Op: op.cmpOp(), Register: maskedRegister, Data: append([]byte{}, value...)})
+
+	return re, nil
+}
+
+func allOnes(b []byte) bool {
+	for _, v := range b {
+		if v != 0xff {
+			return false
+		}
+	}
+
+	return true
+}
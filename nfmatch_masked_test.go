@@ -0,0 +1,166 @@
+package nftableslib
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+func TestMatchMasked(t *testing.T) {
+	prefix := net.ParseIP("2001:db8:1::")
+	prefixMask := []byte(net.CIDRMask(48, 128))
+	tests := []struct {
+		name    string
+		source  interface{}
+		offset  uint32
+		length  uint32
+		mask    []byte
+		value   []byte
+		op      Operator
+		exprs   []expr.Any
+		success bool
+	}{
+		{
+			name:   "1 byte, tcp syn flag",
+			source: expr.PayloadBaseTransportHeader,
+			offset: 13,
+			length: 1,
+			mask:   []byte{0x02},
+			value:  []byte{0x02},
+			op:     EQ,
+			exprs: []expr.Any{
+				&expr.Payload{DestRegister: unix.NFT_REG_3, Base: expr.PayloadBaseTransportHeader, Offset: 13, Len: 1},
+				&expr.Bitwise{SourceRegister: unix.NFT_REG_3, DestRegister: unix.NFT_REG_3, Len: 1, Mask: []byte{0x02}, Xor: []byte{0x0}},
+				&expr.Cmp{Op: expr.CmpOpEq, Register: unix.NFT_REG_3, Data: []byte{0x02}},
+			},
+			success: true,
+		},
+		{
+			name:   "2 bytes, ipv6 traffic class",
+			source: expr.PayloadBaseNetworkHeader,
+			offset: 0,
+			length: 2,
+			mask:   []byte{0x0f, 0xc0},
+			value:  []byte{0x0b, 0x80},
+			op:     NEQ,
+			exprs: []expr.Any{
+				&expr.Payload{DestRegister: unix.NFT_REG_3, Base: expr.PayloadBaseNetworkHeader, Offset: 0, Len: 2},
+				&expr.Bitwise{SourceRegister: unix.NFT_REG_3, DestRegister: unix.NFT_REG_3, Len: 2, Mask: []byte{0x0f, 0xc0}, Xor: []byte{0x0, 0x0}},
+				&expr.Cmp{Op: expr.CmpOpNeq, Register: unix.NFT_REG_3, Data: []byte{0x0b, 0x80}},
+			},
+			success: true,
+		},
+		{
+			name:   "4 bytes, mark in host byte order",
+			source: expr.MetaKey(unix.NFT_META_MARK),
+			length: 4,
+			mask:   binaryutil.NativeEndian.PutUint32(0xff00),
+			value:  binaryutil.NativeEndian.PutUint32(0x1200),
+			op:     EQ,
+			exprs: []expr.Any{
+				&expr.Meta{Key: expr.MetaKey(unix.NFT_META_MARK), Register: unix.NFT_REG_3},
+				&expr.Bitwise{SourceRegister: unix.NFT_REG_3, DestRegister: unix.NFT_REG_3, Len: 4, Mask: binaryutil.NativeEndian.PutUint32(0xff00), Xor: []byte{0x0, 0x0, 0x0, 0x0}},
+				&expr.Cmp{Op: expr.CmpOpEq, Register: unix.NFT_REG_3, Data: binaryutil.NativeEndian.PutUint32(0x1200)},
+			},
+			success: true,
+		},
+		{
+			name:   "16 bytes, ipv6 source prefix",
+			source: expr.PayloadBaseNetworkHeader,
+			offset: 8,
+			length: 16,
+			mask:   prefixMask,
+			value:  []byte(prefix),
+			op:     EQ,
+			exprs: []expr.Any{
+				&expr.Payload{DestRegister: unix.NFT_REG_3, Base: expr.PayloadBaseNetworkHeader, Offset: 8, Len: 16},
+				&expr.Bitwise{SourceRegister: unix.NFT_REG_3, DestRegister: unix.NFT_REG_3, Len: 16, Mask: prefixMask, Xor: make([]byte, 16)},
+				&expr.Cmp{Op: expr.CmpOpEq, Register: unix.NFT_REG_3, Data: []byte(prefix)},
+			},
+			success: true,
+		},
+		{
+			name:   "Mask of all ones, no bitwise",
+			source: expr.PayloadBaseNetworkHeader,
+			offset: 9,
+			length: 1,
+			mask:   []byte{0xff},
+			value:  []byte{unix.IPPROTO_UDP},
+			op:     EQ,
+			exprs: []expr.Any{
+				&expr.Payload{DestRegister: unix.NFT_REG_3, Base: expr.PayloadBaseNetworkHeader, Offset: 9, Len: 1},
+				&expr.Cmp{Op: expr.CmpOpEq, Register: unix.NFT_REG_3, Data: []byte{unix.IPPROTO_UDP}},
+			},
+			success: true,
+		},
+		{
+			name:    "Length 0",
+			source:  expr.PayloadBaseNetworkHeader,
+			length:  0,
+			success: false,
+		},
+		{
+			name:    "Length 17",
+			source:  expr.PayloadBaseNetworkHeader,
+			length:  17,
+			mask:    make([]byte, 17),
+			value:   make([]byte, 17),
+			success: false,
+		},
+		{
+			name:    "Mask shorter than length",
+			source:  expr.PayloadBaseNetworkHeader,
+			length:  2,
+			mask:    []byte{0xff},
+			value:   []byte{0x1, 0x2},
+			success: false,
+		},
+		{
+			name:    "Value outside of mask",
+			source:  expr.PayloadBaseTransportHeader,
+			offset:  13,
+			length:  1,
+			mask:    []byte{0x02},
+			value:   []byte{0x12},
+			success: false,
+		},
+		{
+			name:    "Meta key with offset",
+			source:  expr.MetaKey(unix.NFT_META_MARK),
+			offset:  2,
+			length:  2,
+			mask:    []byte{0xff, 0xff},
+			value:   []byte{0x1, 0x2},
+			success: false,
+		},
+		{
+			name:    "Unsupported source",
+			source:  uint32(1),
+			length:  1,
+			mask:    []byte{0xff},
+			value:   []byte{0x1},
+			success: false,
+		},
+	}
+	for _, tt := range tests {
+		exprs, err := MatchMasked(tt.source, tt.offset, tt.length, tt.mask, tt.value, tt.op)
+		if err != nil && tt.success {
+			t.Errorf("test \"%s\" failed with error: %+v but supposed to succeed", tt.name, err)
+			continue
+		}
+		if err == nil && !tt.success {
+			t.Errorf("test \"%s\" succeeded but supposed to fail", tt.name)
+			continue
+		}
+		if !tt.success {
+			continue
+		}
+		if !reflect.DeepEqual(exprs, tt.exprs) {
+			t.Errorf("test \"%s\": expected expressions %+v, got %+v", tt.name, tt.exprs, exprs)
+		}
+	}
+}
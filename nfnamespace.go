@@ -0,0 +1,260 @@
+package nftableslib
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// DefaultNamespaceConcurrency defines maximum number of namespaces programmed in parallel
+	// when NamespaceManager is initialized with concurrency of 0.
+	DefaultNamespaceConcurrency = 8
+)
+
+// NamespaceDialer opens a connection to the network namespace identified by its path,
+// it returns the connection and a function to release resources associated with the connection.
+type NamespaceDialer func(nsPath string) (NetNS, func() error, error)
+
+// NamespaceManager keeps nftables connections to multiple network namespaces, the connections
+// are cached by the path of the namespace and reused between the calls.
+type NamespaceManager struct {
+	sync.Mutex
+	concurrency int
+	dial        NamespaceDialer
+	namespaces  map[string]*nsConn
+}
+
+type nsConn struct {
+	ti    TablesInterface
+	close func() error
+	// id is the identity of the namespace file when the connection was opened
+	id nsIdentity
+}
+
+// InitNamespaceManager initializes NamespaceManager, concurrency defines maximum number of namespaces
+// programmed in parallel. If dialer is not specified, a namespace is opened by its path in the file system.
+func InitNamespaceManager(concurrency int, dialer ...NamespaceDialer) *NamespaceManager {
+	if concurrency <= 0 {
+		concurrency = DefaultNamespaceConcurrency
+	}
+	dial := dialNamespace
+	if len(dialer) != 0 && dialer[0] != nil {
+		dial = dialer[0]
+	}
+
+	return &NamespaceManager{
+		concurrency: concurrency,
+		dial:        dial,
+		namespaces:  make(map[string]*nsConn),
+	}
+}
+
+func dialNamespace(nsPath string) (NetNS, func() error, error) {
+	ns, err := netns.GetFromPath(nsPath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return InitConn(int(ns)), ns.Close, nil
+}
+
+// Namespace returns TablesInterface for the namespace, connection is opened if it is not cached yet.
+// The namespace is dialed without holding the lock of the manager, when concurrent calls dial
+// the same namespace, the first cached connection is returned and the others are closed.
+func (nm *NamespaceManager) Namespace(nsPath string) (TablesInterface, error) {
+	nm.Lock()
+	c, ok := nm.namespaces[nsPath]
+	nm.Unlock()
+	if ok {
+		return c.ti, nil
+	}
+	conn, closer, err := nm.dial(nsPath)
+	if err != nil {
+		return nil, err
+	}
+	c = &nsConn{
+		ti:    InitNFTables(conn),
+		close: closer,
+	}
+	// Identity of namespaces which cannot be stat'ed is zero, Cleanup releases them once their
+	// paths exist again.
+	c.id, _ = namespaceIdentity(nsPath)
+	nm.Lock()
+	cached, ok := nm.namespaces[nsPath]
+	if !ok {
+		nm.namespaces[nsPath] = c
+	}
+	nm.Unlock()
+	if ok {
+		if c.close != nil {
+			c.close()
+		}
+		return cached.ti, nil
+	}
+
+	return c.ti, nil
+}
+
+// nsIdentity identifies the namespace file, a namespace recreated at the same path gets a new inode
+type nsIdentity struct {
+	dev uint64
+	ino uint64
+}
+
+// namespaceIdentity returns the device and the inode of the namespace file
+func namespaceIdentity(nsPath string) (nsIdentity, error) {
+	var st unix.Stat_t
+	if err := unix.Stat(nsPath, &st); err != nil {
+		return nsIdentity{}, err
+	}
+
+	return nsIdentity{dev: uint64(st.Dev), ino: uint64(st.Ino)}, nil
+}
+
+// Namespaces returns a sorted list of paths of namespaces with cached connections.
+func (nm *NamespaceManager) Namespaces() []string {
+	nm.Lock()
+	defer nm.Unlock()
+	paths := make([]string, 0, len(nm.namespaces))
+	for p := range nm.namespaces {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+
+	return paths
+}
+
+// ApplyToNamespaces calls apply for each namespace in nsPaths, at most concurrency namespaces are processed
+// in parallel. The returned map carries errors for the namespaces where apply failed, the namespaces which
+// vanished during the operation are skipped and their cached connections are released.
+func (nm *NamespaceManager) ApplyToNamespaces(nsPaths []string, apply func(TablesInterface) error) map[string]error {
+	errs := make(map[string]error)
+	if apply == nil {
+		for _, p := range nsPaths {
+			errs[p] = fmt.Errorf("apply function cannot be nil")
+		}
+		return errs
+	}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, nm.concurrency)
+	for _, p := range nsPaths {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(nsPath string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			if err := nm.apply(nsPath, apply); err != nil {
+				mu.Lock()
+				errs[nsPath] = err
+				mu.Unlock()
+			}
+		}(p)
+	}
+	wg.Wait()
+
+	return errs
+}
+
+func (nm *NamespaceManager) apply(nsPath string, apply func(TablesInterface) error) error {
+	ti, err := nm.Namespace(nsPath)
+	if err != nil {
+		if isNamespaceGone(err) {
+			return &ErrNamespaceGone{Path: nsPath, Err: err}
+		}
+		return err
+	}
+	err = apply(ti)
+	// ENOENT is returned for missing tables, chains or sets as well, the namespace is considered
+	// gone only when its path does not exist any longer.
+	if err != nil && isNamespaceGone(err) {
+		if _, serr := os.Stat(nsPath); serr != nil && os.IsNotExist(serr) {
+			nm.Release(nsPath)
+			return &ErrNamespaceGone{Path: nsPath, Err: err}
+		}
+	}
+
+	return err
+}
+
+// ErrNamespaceGone is reported when the namespace disappeared before or during the operation
+type ErrNamespaceGone struct {
+	Path string
+	Err  error
+}
+
+func (e *ErrNamespaceGone) Error() string {
+	return fmt.Sprintf("namespace %s is gone: %+v", e.Path, e.Err)
+}
+
+// Unwrap returns the original error
+func (e *ErrNamespaceGone) Unwrap() error {
+	return e.Err
+}
+
+func isNamespaceGone(err error) bool {
+	return errors.Is(err, unix.ENOENT) || errors.Is(err, unix.ESRCH) || os.IsNotExist(err)
+}
+
+// Release closes the cached connection to the namespace and removes it from the cache.
+func (nm *NamespaceManager) Release(nsPath string) error {
+	return nm.release(nsPath, nil)
+}
+
+// release closes the cached connection to the namespace, if expected is not nil, the connection
+// is released only when it is still cached, so a connection opened meanwhile is kept.
+func (nm *NamespaceManager) release(nsPath string, expected *nsConn) error {
+	nm.Lock()
+	c, ok := nm.namespaces[nsPath]
+	if ok && expected != nil && c != expected {
+		ok = false
+	}
+	if ok {
+		delete(nm.namespaces, nsPath)
+	}
+	nm.Unlock()
+	if !ok || c.close == nil {
+		return nil
+	}
+
+	return c.close()
+}
+
+// Cleanup releases cached connections of the namespaces which do not exist any longer,
+// or were recreated at the same path since their connections were opened.
+func (nm *NamespaceManager) Cleanup() {
+	nm.Lock()
+	conns := make(map[string]*nsConn, len(nm.namespaces))
+	for p, c := range nm.namespaces {
+		conns[p] = c
+	}
+	nm.Unlock()
+	for p, c := range conns {
+		id, err := namespaceIdentity(p)
+		if err != nil && !os.IsNotExist(err) {
+			continue
+		}
+		if err == nil && id == c.id {
+			continue
+		}
+		nm.release(p, c)
+	}
+}
+
+// Close releases all cached connections.
+func (nm *NamespaceManager) Close() error {
+	var err error
+	for _, p := range nm.Namespaces() {
+		if e := nm.Release(p); e != nil && err == nil {
+			err = e
+		}
+	}
+
+	return err
+}
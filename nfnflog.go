@@ -0,0 +1,392 @@
+package nftableslib
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/nftables/binaryutil"
+	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// Messages of nfnetlink_log subsystem
+	nfulnlMsgPacket = 0x0
+	nfulnlMsgConfig = 0x1
+	// Attributes of NFULNL_MSG_CONFIG
+	nfulaCfgCmd   = 0x1
+	nfulaCfgMode  = 0x2
+	nfulaCfgFlags = 0x6
+	// Commands and options of NFULA_CFG_*
+	nfulnlCfgCmdBind = 0x1
+	nfulnlCopyPacket = 0x2
+	nfulnlCfgFSeq    = 0x1
+	// Attributes of NFULNL_MSG_PACKET
+	nfulaPacketHdr         = 0x1
+	nfulaMark              = 0x2
+	nfulaTimestamp         = 0x3
+	nfulaIfindexIndev      = 0x4
+	nfulaIfindexOutdev     = 0x5
+	nfulaIfindexPhysindev  = 0x6
+	nfulaIfindexPhysoutdev = 0x7
+	nfulaHwaddr            = 0x8
+	nfulaPayload           = 0x9
+	nfulaPrefix            = 0xa
+	nfulaUID               = 0xb
+	nfulaSeq               = 0xc
+	nfulaGID               = 0xe
+)
+
+// SetLogGroup is a helper function returning Log sending packets to the nflog group, packets
+// sent to the group are consumed by NFLogReader. The log expression of the github.com/google/nftables
+// version in use carries a single attribute, so the group cannot be combined with the prefix.
+func SetLogGroup(group uint16) *Log {
+	return &Log{Key: unix.NFTA_LOG_GROUP, Value: binaryutil.BigEndian.PutUint16(group)}
+}
+
+// NFLogEntry defines a packet logged to the nflog group, interface indexes are 0 when the packet
+// does not have the corresponding interface.
+type NFLogEntry struct {
+	// Family is the family of the table logging the packet
+	Family     byte
+	Group      uint16
+	Prefix     string
+	HWProtocol uint16
+	Hook       uint8
+	Mark       uint32
+	Timestamp  time.Time
+	InIfIndex  uint32
+	OutIfIndex uint32
+	// PhysInIfIndex and PhysOutIfIndex are ports of the bridge the packet passes through
+	PhysInIfIndex  uint32
+	PhysOutIfIndex uint32
+	HWAddr         net.HardwareAddr
+	// UID and GID are the owner of the local socket of the packet, nil if the packet has no socket
+	UID *uint32
+	GID *uint32
+	// Seq is the number of the packet logged to the group
+	Seq     uint32
+	Payload []byte
+}
+
+// NFLogOption defines an option of NewNFLogReader
+type NFLogOption func(*nflogConfig)
+
+type nflogConfig struct {
+	netns      int
+	readBuffer int
+	copyRange  uint32
+	backlog    int
+}
+
+// WithNFLogNetNS binds the reader to the group of the network namespace
+func WithNFLogNetNS(netns int) NFLogOption {
+	return func(c *nflogConfig) {
+		c.netns = netns
+	}
+}
+
+// WithNFLogReadBuffer sets the size of the socket's receive buffer, packets logged while the buffer
+// is full are dropped by the kernel, a larger buffer absorbs bursts of logged packets.
+func WithNFLogReadBuffer(bytes int) NFLogOption {
+	return func(c *nflogConfig) {
+		c.readBuffer = bytes
+	}
+}
+
+// WithNFLogCopyRange limits the number of bytes of the packet copied to the entry, by default
+// the whole packet is copied.
+func WithNFLogCopyRange(bytes uint32) NFLogOption {
+	return func(c *nflogConfig) {
+		c.copyRange = bytes
+	}
+}
+
+// WithNFLogBacklog sets the number of entries buffered by the channel of the reader
+func WithNFLogBacklog(entries int) NFLogOption {
+	return func(c *nflogConfig) {
+		c.backlog = entries
+	}
+}
+
+// NFLogReader reads packets logged to the nflog group, entries are delivered by the channel
+// returned by Entries. The channel is closed when the reader is closed, the context is cancelled
+// or reading fails, Err returns the error which stopped the reader.
+type NFLogReader struct {
+	// drops is accessed atomically, it is kept first for 64-bit alignment
+	drops   uint64
+	conn    *netlink.Conn
+	recv    *receiver
+	entries chan *NFLogEntry
+	done    chan struct{}
+	once    sync.Once
+	sync.Mutex
+	err error
+	// seq is the sequence number of the next expected entry
+	seq    uint32
+	hasSeq bool
+}
+
+// NewNFLogReader binds to the nflog group and starts reading logged packets
+func NewNFLogReader(ctx context.Context, group uint16, opts ...NFLogOption) (*NFLogReader, error) {
+	c := &nflogConfig{backlog: 128}
+	for _, opt := range opts {
+		opt(c)
+	}
+	conn, err := netlink.Dial(unix.NETLINK_NETFILTER, &netlink.Config{NetNS: c.netns, DisableNSLockThread: c.netns == 0})
+	if err != nil {
+		return nil, err
+	}
+	if err := setReadBuffer(conn, c.readBuffer); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := bindNFLogGroup(conn, group, c.copyRange); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	recv, err := newReceiver(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	r := &NFLogReader{
+		conn:    conn,
+		recv:    recv,
+		entries: make(chan *NFLogEntry, c.backlog),
+		done:    make(chan struct{}),
+	}
+	go func() {
+		select {
+		case <-ctx.Done():
+			r.Close()
+		case <-r.done:
+		}
+	}()
+	go r.run()
+
+	return r, nil
+}
+
+// setReadBuffer sets the size of the receive buffer, the size is forced above the system's limit
+// if the process has CAP_NET_ADMIN.
+func setReadBuffer(conn *netlink.Conn, bytes int) error {
+	if bytes == 0 {
+		return nil
+	}
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var serr error
+	if err := rc.Control(func(fd uintptr) {
+		serr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_RCVBUFFORCE, bytes)
+	}); err != nil {
+		return err
+	}
+	if serr == nil {
+		return nil
+	}
+
+	return conn.SetReadBuffer(bytes)
+}
+
+// bindNFLogGroup binds the connection to the group, packets are copied up to the copy range
+// and carry sequence numbers of the group, so lost packets can be counted.
+func bindNFLogGroup(conn *netlink.Conn, group uint16, copyRange uint32) error {
+	mode := make([]byte, 6)
+	binary.BigEndian.PutUint32(mode, copyRange)
+	mode[4] = nfulnlCopyPacket
+	configs := [][]netlink.Attribute{
+		{{Type: nfulaCfgCmd, Data: []byte{nfulnlCfgCmdBind}}},
+		{
+			{Type: nfulaCfgMode, Data: mode},
+			{Type: nfulaCfgFlags, Data: binaryutil.BigEndian.PutUint16(nfulnlCfgFSeq)},
+		},
+	}
+	for _, attrs := range configs {
+		data, err := netlink.MarshalAttributes(attrs)
+		if err != nil {
+			return err
+		}
+		msg := netlink.Message{
+			Header: netlink.Header{
+				Type:  netlink.HeaderType(unix.NFNL_SUBSYS_ULOG<<8 | nfulnlMsgConfig),
+				Flags: netlink.Request | netlink.Acknowledge,
+			},
+			Data: append([]byte{unix.AF_UNSPEC, unix.NFNETLINK_V0, byte(group >> 8), byte(group)}, data...),
+		}
+		if _, err := conn.Execute(msg); err != nil {
+			return fmt.Errorf("failed to bind nflog group %d with error: %+v", group, err)
+		}
+	}
+
+	return nil
+}
+
+// Entries returns the channel delivering logged packets
+func (r *NFLogReader) Entries() <-chan *NFLogEntry {
+	return r.entries
+}
+
+// Drops returns the number of packets logged to the group but lost before they were read,
+// packets are lost when the receive buffer overflows, losses are detected by the sequence
+// number of the next packet read.
+func (r *NFLogReader) Drops() uint64 {
+	return atomic.LoadUint64(&r.drops)
+}
+
+// Err returns the error which stopped the reader, nil if the reader was closed
+func (r *NFLogReader) Err() error {
+	r.Lock()
+	defer r.Unlock()
+
+	return r.err
+}
+
+// Close unbinds the reader from the group and closes the channel of entries
+func (r *NFLogReader) Close() error {
+	var err error
+	r.once.Do(func() {
+		close(r.done)
+		err = r.conn.Close()
+	})
+
+	return err
+}
+
+func (r *NFLogReader) closed() bool {
+	select {
+	case <-r.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (r *NFLogReader) run() {
+	defer close(r.entries)
+	for {
+		msgs, err := r.recv.receive()
+		if err == unix.ENOBUFS {
+			// The kernel dropped packets, they are counted by the sequence number of the next packet
+			continue
+		}
+		if err != nil {
+			if !r.closed() {
+				r.stop(err)
+			}
+			return
+		}
+		for _, m := range msgs {
+			if m.Header.Type == unix.NLMSG_ERROR {
+				if err := errorCode(m); err != nil {
+					r.stop(err)
+					return
+				}
+				continue
+			}
+			if m.Header.Type != unix.NFNL_SUBSYS_ULOG<<8|nfulnlMsgPacket {
+				continue
+			}
+			e, err := decodeNFLogEntry(m.Data)
+			if err != nil {
+				r.stop(err)
+				return
+			}
+			r.count(e.Seq)
+			select {
+			case r.entries <- e:
+			case <-r.done:
+				return
+			}
+		}
+	}
+}
+
+func (r *NFLogReader) stop(err error) {
+	r.Lock()
+	r.err = err
+	r.Unlock()
+	r.Close()
+}
+
+// count adds packets missing between the expected and the read sequence numbers to drops
+func (r *NFLogReader) count(seq uint32) {
+	if r.hasSeq && seq != r.seq {
+		atomic.AddUint64(&r.drops, uint64(seq-r.seq))
+	}
+	r.seq, r.hasSeq = seq+1, true
+}
+
+// decodeNFLogEntry decodes NFULNL_MSG_PACKET message, data starts with nfgenmsg header
+func decodeNFLogEntry(data []byte) (*NFLogEntry, error) {
+	if len(data) < 4 {
+		return nil, fmt.Errorf("short nflog message")
+	}
+	e := &NFLogEntry{Family: data[0], Group: binary.BigEndian.Uint16(data[2:4])}
+	ad, err := netlink.NewAttributeDecoder(data[4:])
+	if err != nil {
+		return nil, err
+	}
+	ad.ByteOrder = binary.BigEndian
+	for ad.Next() {
+		switch ad.Type() {
+		case nfulaPacketHdr:
+			b := ad.Bytes()
+			if len(b) < 3 {
+				return nil, fmt.Errorf("short nflog packet header")
+			}
+			e.HWProtocol, e.Hook = binary.BigEndian.Uint16(b), b[2]
+		case nfulaMark:
+			e.Mark = ad.Uint32()
+		case nfulaTimestamp:
+			b := ad.Bytes()
+			if len(b) < 16 {
+				return nil, fmt.Errorf("short nflog timestamp")
+			}
+			e.Timestamp = time.Unix(int64(binary.BigEndian.Uint64(b)), int64(binary.BigEndian.Uint64(b[8:]))*int64(time.Microsecond))
+		case nfulaIfindexIndev:
+			e.InIfIndex = ad.Uint32()
+		case nfulaIfindexOutdev:
+			e.OutIfIndex = ad.Uint32()
+		case nfulaIfindexPhysindev:
+			e.PhysInIfIndex = ad.Uint32()
+		case nfulaIfindexPhysoutdev:
+			e.PhysOutIfIndex = ad.Uint32()
+		case nfulaHwaddr:
+			// struct nfulnl_msg_packet_hw carries the length of the address followed by 8 bytes of the address
+			b := ad.Bytes()
+			if len(b) < 4 {
+				return nil, fmt.Errorf("short nflog hardware address")
+			}
+			l := int(binary.BigEndian.Uint16(b))
+			if l > len(b)-4 {
+				l = len(b) - 4
+			}
+			e.HWAddr = net.HardwareAddr(append([]byte{}, b[4:4+l]...))
+		case nfulaPayload:
+			e.Payload = ad.Bytes()
+		case nfulaPrefix:
+			e.Prefix = ad.String()
+		case nfulaUID:
+			uid := ad.Uint32()
+			e.UID = &uid
+		case nfulaGID:
+			gid := ad.Uint32()
+			e.GID = &gid
+		case nfulaSeq:
+			e.Seq = ad.Uint32()
+		}
+	}
+	if err := ad.Err(); err != nil {
+		return nil, fmt.Errorf("failed to decode nflog message with error: %+v", err)
+	}
+
+	return e, nil
+}
@@ -0,0 +1,139 @@
+package nftableslib
+
+import (
+	"bytes"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// Fixtures are NFULNL_MSG_PACKET payloads captured for UDP packets 127.0.0.1:40000 -> 127.0.0.2:9999
+// of a socket with mark 0x2a, logged by `ip daddr 127.0.0.2 log prefix "zz: " group 7` of the output hook.
+var (
+	nflogHello = []byte{
+		0x2, 0x0, 0x0, 0x7, 0x8, 0x0, 0x1, 0x0, 0x8, 0x0, 0x3, 0x0, 0x9, 0x0, 0xa, 0x0,
+		0x7a, 0x7a, 0x3a, 0x20, 0x0, 0x0, 0x0, 0x0, 0x8, 0x0, 0x5, 0x0, 0x0, 0x0, 0x0, 0x1,
+		0x8, 0x0, 0x2, 0x0, 0x0, 0x0, 0x0, 0x2a, 0x8, 0x0, 0xb, 0x0, 0x0, 0x0, 0x0, 0x0,
+		0x8, 0x0, 0xe, 0x0, 0x0, 0x0, 0x0, 0x0, 0x8, 0x0, 0xc, 0x0, 0x0, 0x0, 0x0, 0x0,
+		0x25, 0x0, 0x9, 0x0, 0x45, 0x0, 0x0, 0x21, 0xeb, 0x41, 0x40, 0x0, 0x40, 0x11, 0x51, 0x87,
+		0x7f, 0x0, 0x0, 0x1, 0x7f, 0x0, 0x0, 0x2, 0x9c, 0x40, 0x27, 0xf, 0x0, 0xd, 0xfe, 0x21,
+		0x68, 0x65, 0x6c, 0x6c, 0x6f, 0x0, 0x0, 0x0,
+	}
+	nflogWorld = []byte{
+		0x2, 0x0, 0x0, 0x7, 0x8, 0x0, 0x1, 0x0, 0x8, 0x0, 0x3, 0x0, 0x9, 0x0, 0xa, 0x0,
+		0x7a, 0x7a, 0x3a, 0x20, 0x0, 0x0, 0x0, 0x0, 0x8, 0x0, 0x5, 0x0, 0x0, 0x0, 0x0, 0x1,
+		0x8, 0x0, 0x2, 0x0, 0x0, 0x0, 0x0, 0x2a, 0x8, 0x0, 0xb, 0x0, 0x0, 0x0, 0x0, 0x0,
+		0x8, 0x0, 0xe, 0x0, 0x0, 0x0, 0x0, 0x0, 0x8, 0x0, 0xc, 0x0, 0x0, 0x0, 0x0, 0x1,
+		0x26, 0x0, 0x9, 0x0, 0x45, 0x0, 0x0, 0x22, 0xeb, 0x42, 0x40, 0x0, 0x40, 0x11, 0x51, 0x85,
+		0x7f, 0x0, 0x0, 0x1, 0x7f, 0x0, 0x0, 0x2, 0x9c, 0x40, 0x27, 0xf, 0x0, 0xe, 0xfe, 0x22,
+		0x77, 0x6f, 0x72, 0x6c, 0x64, 0x21, 0x0, 0x0,
+	}
+)
+
+func TestDecodeNFLogEntry(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    []byte
+		seq     uint32
+		payload string
+		success bool
+	}{
+		{
+			name:    "first packet",
+			data:    nflogHello,
+			seq:     0,
+			payload: "hello",
+			success: true,
+		},
+		{
+			name:    "second packet",
+			data:    nflogWorld,
+			seq:     1,
+			payload: "world!",
+			success: true,
+		},
+		{
+			name:    "truncated attribute",
+			data:    nflogHello[:len(nflogHello)-10],
+			success: false,
+		},
+		{
+			name:    "short header",
+			data:    []byte{0x2, 0x0},
+			success: false,
+		},
+	}
+	for _, tt := range tests {
+		e, err := decodeNFLogEntry(tt.data)
+		if err != nil && tt.success {
+			t.Fatalf("Test \"%s\" failed with error: %+v but supposed to succeed", tt.name, err)
+		}
+		if err == nil && !tt.success {
+			t.Fatalf("Test \"%s\" succeeded but supposed to fail", tt.name)
+		}
+		if !tt.success {
+			continue
+		}
+		if e.Family != 2 || e.Group != 7 || e.Prefix != "zz: " || e.HWProtocol != 0x0800 || e.Hook != 3 {
+			t.Fatalf("Test \"%s\" failed, unexpected header of entry %+v", tt.name, e)
+		}
+		if e.Mark != 0x2a || e.InIfIndex != 0 || e.OutIfIndex != 1 || e.Seq != tt.seq {
+			t.Fatalf("Test \"%s\" failed, unexpected metadata of entry %+v", tt.name, e)
+		}
+		if e.UID == nil || *e.UID != 0 || e.GID == nil || *e.GID != 0 {
+			t.Fatalf("Test \"%s\" failed, owner of the packet is not decoded", tt.name)
+		}
+		// IPv4 header of 20 bytes and UDP header of 8 bytes precede the data
+		if len(e.Payload) != 28+len(tt.payload) || !bytes.Equal(e.Payload[28:], []byte(tt.payload)) {
+			t.Fatalf("Test \"%s\" failed, unexpected payload %v", tt.name, e.Payload)
+		}
+		if e.Payload[9] != 17 || !bytes.Equal(e.Payload[16:20], []byte{127, 0, 0, 2}) {
+			t.Fatalf("Test \"%s\" failed, payload is not the logged packet", tt.name)
+		}
+	}
+}
+
+func TestNFLogDrops(t *testing.T) {
+	tests := []struct {
+		name  string
+		seqs  []uint32
+		drops uint64
+	}{
+		{
+			name:  "sequential",
+			seqs:  []uint32{0, 1, 2, 3},
+			drops: 0,
+		},
+		{
+			name:  "first entry read after the start of the group",
+			seqs:  []uint32{5, 6},
+			drops: 0,
+		},
+		{
+			name:  "buffer overrun",
+			seqs:  []uint32{0, 1, 5, 6, 9},
+			drops: 5,
+		},
+		{
+			name:  "sequence wraps",
+			seqs:  []uint32{0xfffffffe, 0xffffffff, 1},
+			drops: 1,
+		},
+	}
+	for _, tt := range tests {
+		r := &NFLogReader{}
+		for _, s := range tt.seqs {
+			r.count(s)
+		}
+		if r.Drops() != tt.drops {
+			t.Fatalf("Test \"%s\" failed, expected %d drops, got %d", tt.name, tt.drops, r.Drops())
+		}
+	}
+}
+
+func TestSetLogGroup(t *testing.T) {
+	l := SetLogGroup(0x102)
+	if l.Key != unix.NFTA_LOG_GROUP || !bytes.Equal(l.Value, []byte{0x1, 0x2}) {
+		t.Fatalf("unexpected log %+v", l)
+	}
+}
@@ -0,0 +1,419 @@
+package nftableslib
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// ObjectKind defines the type of a named stateful object, values match kernel's NFT_OBJECT_* types
+type ObjectKind uint32
+
+const (
+	// ObjectCounter defines named counter object
+	ObjectCounter ObjectKind = 1
+	// ObjectQuota defines named quota object
+	ObjectQuota ObjectKind = 2
+	// ObjectCtHelper defines named conntrack helper object
+	ObjectCtHelper ObjectKind = 3
+	// ObjectLimit defines named limit object
+	ObjectLimit ObjectKind = 4
+)
+
+func (k ObjectKind) String() string {
+	switch k {
+	case ObjectCounter:
+		return "counter"
+	case ObjectQuota:
+		return "quota"
+	case ObjectCtHelper:
+		return "ct helper"
+	case ObjectLimit:
+		return "limit"
+	case ObjectCtExpectation:
+		return "ct expectation"
+	}
+
+	return fmt.Sprintf("object type %d", uint32(k))
+}
+
+// Object describes a named stateful object of a table, only the state matching the object's
+// kind is set, objects of kinds the library does not decode carry only kind and name.
+type Object struct {
+	Kind ObjectKind
+	Name string
+	// Use is the number of rules and set elements referring to the object
+	Use           uint32
+	Counter       *CounterState
+	Quota         *QuotaState
+	Limit         *LimitState
+	CtHelper      *CtHelperState
+	CtExpectation *CtExpectationState
+}
+
+// CounterState defines values of a counter object
+type CounterState struct {
+	Packets uint64
+	Bytes   uint64
+}
+
+// QuotaState defines state of a quota object, Over is true for "quota over" objects
+type QuotaState struct {
+	Bytes    uint64
+	Consumed uint64
+	Over     bool
+	Depleted bool
+}
+
+// Remaining returns the number of bytes left before the quota is exhausted
+func (q *QuotaState) Remaining() uint64 {
+	if q.Consumed >= q.Bytes {
+		return 0
+	}
+	return q.Bytes - q.Consumed
+}
+
+// LimitState defines the rate of a limit object, the rate is Rate packets, or bytes when Bytes is true,
+// per Unit. Over is true for "limit rate over" objects.
+type LimitState struct {
+	Rate  uint64
+	Unit  time.Duration
+	Burst uint32
+	Bytes bool
+	Over  bool
+}
+
+// CtHelperState defines conntrack helper object, Family is the layer 3 protocol the helper is bound to
+type CtHelperState struct {
+	Helper   string
+	Family   nftables.TableFamily
+	Protocol uint8
+}
+
+// ObjectsConn defines an optional interface of the connection, connections implementing it
+// list, add, delete and reset named objects of the table instead of the library talking to the kernel
+// directly. AddObject queues the object to be programmed by Flush, ResetObject returns the state
+// of the object before the reset.
+type ObjectsConn interface {
+	ListObjects(*nftables.Table) ([]*Object, error)
+	AddObject(*nftables.Table, *Object)
+	DelObject(*nftables.Table, ObjectKind, string) error
+	ResetObject(*nftables.Table, ObjectKind, string) (*Object, error)
+}
+
+// ObjectsInterface defines third level interface operating with named stateful objects, it is safe
+// for concurrent use, objects are not kept in a store, so operations never wait for each other.
+type ObjectsInterface interface {
+	Objects() ObjectFuncs
+}
+
+// ObjectFuncs defines functions to operate with named stateful objects, objects are always
+// read from the kernel and deletion is applied immediately.
+type ObjectFuncs interface {
+	List() ([]*Object, error)
+	Get(ObjectKind, string) (*Object, error)
+	Exist(ObjectKind, string) bool
+	Delete(ObjectKind, string) error
+	CreateCounter(string) error
+	CreateCtExpectation(string, *CtExpectationState) error
+	ResetCounter(string) (*CounterState, error)
+	ResetQuota(string) (*QuotaState, error)
+	ReadAndResetAll(prefix string) ([]*Object, error)
+}
+
+type nfObjects struct {
+	conn  NetNS
+	table *nftables.Table
+}
+
+// Objects returns a list of methods available for named objects operations
+func (nfo *nfObjects) Objects() ObjectFuncs {
+	return nfo
+}
+
+// List returns all named objects of the table sorted by kind and name
+func (nfo *nfObjects) List() ([]*Object, error) {
+	objs, err := listObjects(nfo.conn, nfo.table)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list objects of table %s with error: %+v", nfo.table.Name, err)
+	}
+	sort.SliceStable(objs, func(i, j int) bool {
+		if objs[i].Kind != objs[j].Kind {
+			return objs[i].Kind < objs[j].Kind
+		}
+		return objs[i].Name < objs[j].Name
+	})
+
+	return objs, nil
+}
+
+// Get returns the named object of the kind
+func (nfo *nfObjects) Get(kind ObjectKind, name string) (*Object, error) {
+	objs, err := nfo.List()
+	if err != nil {
+		return nil, err
+	}
+	for _, o := range objs {
+		if o.Kind == kind && o.Name == name {
+			return o, nil
+		}
+	}
+
+	return nil, fmt.Errorf("%s %s does not exist in table %s", kind, name, nfo.table.Name)
+}
+
+// Exist checks if the named object of the kind exists in the table
+func (nfo *nfObjects) Exist(kind ObjectKind, name string) bool {
+	_, err := nfo.Get(kind, name)
+	return err == nil
+}
+
+// Delete removes the named object of the kind, the kernel refuses to remove objects
+// still referred by rules or set elements.
+func (nfo *nfObjects) Delete(kind ObjectKind, name string) error {
+	if err := writable(nfo.conn); err != nil {
+		return err
+	}
+	var err error
+	switch c := nfo.conn.(type) {
+	case ObjectsConn:
+		err = c.DelObject(nfo.table, kind, name)
+	case *nftables.Conn:
+		err = delObject(c, nfo.table, kind, name)
+	default:
+		return fmt.Errorf("connection does not support named objects")
+	}
+	if err != nil {
+		return fmt.Errorf("failed to delete %s %s from table %s with error: %+v", kind, name, nfo.table.Name, err)
+	}
+
+	return nil
+}
+
+// CreateCounter creates the named counter object, the kernel refuses to create the object
+// if it already exists.
+func (nfo *nfObjects) CreateCounter(name string) error {
+	if err := writable(nfo.conn); err != nil {
+		return err
+	}
+	if name == "" {
+		return fmt.Errorf("name of counter cannot be empty")
+	}
+	if err := addObject(nfo.conn, nfo.table, &Object{Kind: ObjectCounter, Name: name, Counter: &CounterState{}}); err != nil {
+		return err
+	}
+	if err := flush(nfo.conn); err != nil {
+		return fmt.Errorf("failed to create counter %s in table %s with error: %+v", name, nfo.table.Name, err)
+	}
+
+	return nil
+}
+
+// addObject queues the object to be programmed by Flush, github.com/google/nftables can add
+// only counters.
+func addObject(conn NetNS, t *nftables.Table, o *Object) error {
+	switch c := conn.(type) {
+	case ObjectsConn:
+		c.AddObject(t, o)
+		return nil
+	case *nftables.Conn:
+		if o.Kind != ObjectCounter {
+			return fmt.Errorf("connection does not support adding %s objects", o.Kind)
+		}
+		counter := &nftables.CounterObj{Table: t, Name: o.Name}
+		if o.Counter != nil {
+			counter.Packets, counter.Bytes = o.Counter.Packets, o.Counter.Bytes
+		}
+		c.AddObj(counter)
+		return nil
+	}
+
+	return fmt.Errorf("connection does not support named objects")
+}
+
+func listObjects(conn NetNS, t *nftables.Table) ([]*Object, error) {
+	switch c := conn.(type) {
+	case ObjectsConn:
+		return c.ListObjects(t)
+	case *nftables.Conn:
+		return dumpObjects(c, t)
+	}
+
+	return nil, fmt.Errorf("connection does not support named objects")
+}
+
+func newObjects(conn NetNS, t *nftables.Table) ObjectsInterface {
+	return &nfObjects{
+		conn:  conn,
+		table: t,
+	}
+}
+
+// objectMessage builds the object message of the type, github.com/google/nftables
+// cannot carry objects other than counters, so the message is built by the library.
+func objectMessage(msgType uint16, flags netlink.HeaderFlags, t *nftables.Table, attrs []netlink.Attribute) (netlink.Message, error) {
+	attrs = append([]netlink.Attribute{{Type: unix.NFTA_OBJ_TABLE, Data: []byte(t.Name + "\x00")}}, attrs...)
+	data, err := netlink.MarshalAttributes(attrs)
+	if err != nil {
+		return netlink.Message{}, err
+	}
+	return netlink.Message{
+		Header: netlink.Header{
+			Type:  netlink.HeaderType((unix.NFNL_SUBSYS_NFTABLES << 8) | msgType),
+			Flags: flags,
+		},
+		// nfgenmsg header: family, version and resource id
+		Data: append([]byte{uint8(t.Family), unix.NFNETLINK_V0, 0, 0}, data...),
+	}, nil
+}
+
+// dumpObjects requests the dump of the table's objects, github.com/google/nftables fails
+// the whole dump when the table carries an object other than a counter.
+func dumpObjects(c *nftables.Conn, t *nftables.Table) ([]*Object, error) {
+	msg, err := objectMessage(unix.NFT_MSG_GETOBJ, netlink.Request|netlink.Acknowledge|netlink.Dump, t, nil)
+	if err != nil {
+		return nil, err
+	}
+	objs := make([]*Object, 0)
+	if err := dumpMessages(c, msg, func(b []byte) error {
+		o, err := decodeObject(b)
+		if err != nil {
+			return err
+		}
+		// Older kernels do not filter the dump by table, objects of other tables are skipped
+		if o.table == t.Name && o.family == t.Family {
+			objs = append(objs, &o.Object)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	return objs, nil
+}
+
+func delObject(c *nftables.Conn, t *nftables.Table, kind ObjectKind, name string) error {
+	msg, err := objectMessage(unix.NFT_MSG_DELOBJ, netlink.Request|netlink.Acknowledge, t, []netlink.Attribute{
+		{Type: unix.NFTA_OBJ_NAME, Data: []byte(name + "\x00")},
+		{Type: unix.NFTA_OBJ_TYPE, Data: binaryutil.BigEndian.PutUint32(uint32(kind))},
+	})
+	if err != nil {
+		return err
+	}
+
+	return sendBatch(c, msg)
+}
+
+// hostObject is an object decoded from NFT_MSG_NEWOBJ message along with its table
+type hostObject struct {
+	Object
+	table  string
+	family nftables.TableFamily
+}
+
+// decodeObject decodes a single NFT_MSG_NEWOBJ message, the object's state is decoded after
+// all attributes are read as the type is required to interpret the data.
+func decodeObject(b []byte) (*hostObject, error) {
+	if len(b) < 4 {
+		return nil, fmt.Errorf("short object message")
+	}
+	o := &hostObject{family: nftables.TableFamily(b[0])}
+	ad, err := netlink.NewAttributeDecoder(b[4:])
+	if err != nil {
+		return nil, err
+	}
+	ad.ByteOrder = binary.BigEndian
+	var data []byte
+	for ad.Next() {
+		switch ad.Type() {
+		case unix.NFTA_OBJ_TABLE:
+			o.table = ad.String()
+		case unix.NFTA_OBJ_NAME:
+			o.Name = ad.String()
+		case unix.NFTA_OBJ_TYPE:
+			o.Kind = ObjectKind(ad.Uint32())
+		case unix.NFTA_OBJ_USE:
+			o.Use = ad.Uint32()
+		case unix.NFTA_OBJ_DATA:
+			data = ad.Bytes()
+		}
+	}
+	if err := ad.Err(); err != nil {
+		return nil, err
+	}
+	if o.Name == "" {
+		return nil, fmt.Errorf("malformed object message")
+	}
+	if data == nil {
+		return o, nil
+	}
+	ad, err = netlink.NewAttributeDecoder(data)
+	if err != nil {
+		return nil, err
+	}
+	ad.ByteOrder = binary.BigEndian
+	switch o.Kind {
+	case ObjectCounter:
+		o.Counter = &CounterState{}
+		for ad.Next() {
+			switch ad.Type() {
+			case unix.NFTA_COUNTER_BYTES:
+				o.Counter.Bytes = ad.Uint64()
+			case unix.NFTA_COUNTER_PACKETS:
+				o.Counter.Packets = ad.Uint64()
+			}
+		}
+	case ObjectQuota:
+		o.Quota = &QuotaState{}
+		for ad.Next() {
+			switch ad.Type() {
+			case unix.NFTA_QUOTA_BYTES:
+				o.Quota.Bytes = ad.Uint64()
+			case unix.NFTA_QUOTA_CONSUMED:
+				o.Quota.Consumed = ad.Uint64()
+			case unix.NFTA_QUOTA_FLAGS:
+				flags := ad.Uint32()
+				o.Quota.Over = flags&unix.NFT_QUOTA_F_INV != 0
+				o.Quota.Depleted = flags&unix.NFT_QUOTA_F_DEPLETED != 0
+			}
+		}
+	case ObjectLimit:
+		o.Limit = &LimitState{}
+		for ad.Next() {
+			switch ad.Type() {
+			case unix.NFTA_LIMIT_RATE:
+				o.Limit.Rate = ad.Uint64()
+			case unix.NFTA_LIMIT_UNIT:
+				o.Limit.Unit = time.Duration(ad.Uint64()) * time.Second
+			case unix.NFTA_LIMIT_BURST:
+				o.Limit.Burst = ad.Uint32()
+			case unix.NFTA_LIMIT_TYPE:
+				o.Limit.Bytes = ad.Uint32() == unix.NFT_LIMIT_PKT_BYTES
+			case unix.NFTA_LIMIT_FLAGS:
+				o.Limit.Over = ad.Uint32()&unix.NFT_LIMIT_F_INV != 0
+			}
+		}
+	case ObjectCtHelper:
+		o.CtHelper = &CtHelperState{}
+		for ad.Next() {
+			switch ad.Type() {
+			case unix.NFTA_CT_HELPER_NAME:
+				o.CtHelper.Helper = ad.String()
+			case unix.NFTA_CT_HELPER_L3PROTO:
+				o.CtHelper.Family = nftables.TableFamily(ad.Uint16())
+			case unix.NFTA_CT_HELPER_L4PROTO:
+				o.CtHelper.Protocol = ad.Uint8()
+			}
+		}
+	case ObjectCtExpectation:
+		o.CtExpectation = decodeCtExpectation(ad)
+	}
+
+	return o, ad.Err()
+}
@@ -0,0 +1,137 @@
+package nftableslib
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// ResetCounter returns the state of the named counter and resets it, the kernel reads and resets
+// the counter at once, so packets are neither lost nor counted twice between two resets.
+func (nfo *nfObjects) ResetCounter(name string) (*CounterState, error) {
+	if err := writable(nfo.conn); err != nil {
+		return nil, err
+	}
+	objs, err := nfo.reset([]*Object{{Kind: ObjectCounter, Name: name}})
+	if err != nil {
+		return nil, err
+	}
+	if objs[0].Counter == nil {
+		return nil, fmt.Errorf("counter %s of table %s does not carry state", name, nfo.table.Name)
+	}
+
+	return objs[0].Counter, nil
+}
+
+// ResetQuota returns the state of the named quota and resets consumed bytes of the quota
+func (nfo *nfObjects) ResetQuota(name string) (*QuotaState, error) {
+	if err := writable(nfo.conn); err != nil {
+		return nil, err
+	}
+	objs, err := nfo.reset([]*Object{{Kind: ObjectQuota, Name: name}})
+	if err != nil {
+		return nil, err
+	}
+	if objs[0].Quota == nil {
+		return nil, fmt.Errorf("quota %s of table %s does not carry state", name, nfo.table.Name)
+	}
+
+	return objs[0].Quota, nil
+}
+
+// ReadAndResetAll returns states of counters and quotas of the table which names start with the prefix
+// and resets them, objects are sorted by kind and name. Every object is read and reset atomically,
+// objects removed after they were listed are skipped.
+func (nfo *nfObjects) ReadAndResetAll(prefix string) ([]*Object, error) {
+	if err := writable(nfo.conn); err != nil {
+		return nil, err
+	}
+	objs, err := nfo.List()
+	if err != nil {
+		return nil, err
+	}
+	selected := make([]*Object, 0, len(objs))
+	for _, o := range objs {
+		if (o.Kind == ObjectCounter || o.Kind == ObjectQuota) && strings.HasPrefix(o.Name, prefix) {
+			selected = append(selected, o)
+		}
+	}
+	if len(selected) == 0 {
+		return selected, nil
+	}
+
+	return nfo.reset(selected)
+}
+
+// reset reads and resets objects, ENOENT is returned only when a single object is requested
+func (nfo *nfObjects) reset(objs []*Object) ([]*Object, error) {
+	reset := make([]*Object, 0, len(objs))
+	var resetFn func(*Object) (*Object, error)
+	switch c := nfo.conn.(type) {
+	case ObjectsConn:
+		resetFn = func(o *Object) (*Object, error) {
+			return c.ResetObject(nfo.table, o.Kind, o.Name)
+		}
+	case *nftables.Conn:
+		conn, err := dialNetfilter(c)
+		if err != nil {
+			return nil, err
+		}
+		defer conn.Close()
+		resetFn = func(o *Object) (*Object, error) {
+			return resetObject(conn, nfo.table, o.Kind, o.Name)
+		}
+	default:
+		return nil, fmt.Errorf("connection does not support named objects")
+	}
+	for _, o := range objs {
+		r, err := resetFn(o)
+		if err != nil {
+			if len(objs) > 1 && errors.Is(err, unix.ENOENT) {
+				continue
+			}
+			return nil, fmt.Errorf("failed to reset %s %s of table %s with error: %+v", o.Kind, o.Name, nfo.table.Name, err)
+		}
+		reset = append(reset, r)
+	}
+
+	return reset, nil
+}
+
+// resetObjectMessage builds the request reading and resetting the named object, the kernel replies
+// with the state of the object before the reset.
+func resetObjectMessage(t *nftables.Table, kind ObjectKind, name string) (netlink.Message, error) {
+	return objectMessage(unix.NFT_MSG_GETOBJ_RESET, netlink.Request, t, []netlink.Attribute{
+		{Type: unix.NFTA_OBJ_NAME, Data: []byte(name + "\x00")},
+		{Type: unix.NFTA_OBJ_TYPE, Data: binaryutil.BigEndian.PutUint32(uint32(kind))},
+	})
+}
+
+func resetObject(conn *netlink.Conn, t *nftables.Table, kind ObjectKind, name string) (*Object, error) {
+	msg, err := resetObjectMessage(t, kind, name)
+	if err != nil {
+		return nil, err
+	}
+	replies, err := conn.Execute(msg)
+	if err != nil {
+		var oe *netlink.OpError
+		if errors.As(err, &oe) {
+			return nil, oe.Err
+		}
+		return nil, err
+	}
+	if len(replies) != 1 {
+		return nil, fmt.Errorf("unexpected number of replies %d", len(replies))
+	}
+	o, err := decodeObject(replies[0].Data)
+	if err != nil {
+		return nil, err
+	}
+
+	return &o.Object, nil
+}
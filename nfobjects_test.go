@@ -0,0 +1,260 @@
+package nftableslib
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// objectNewMessage builds the payload of NFT_MSG_NEWOBJ message the way the kernel dumps objects
+func objectNewMessage(t *testing.T, table *nftables.Table, kind ObjectKind, name string, data []netlink.Attribute) []byte {
+	t.Helper()
+	attrs := []netlink.Attribute{
+		{Type: unix.NFTA_OBJ_NAME, Data: []byte(name + "\x00")},
+		{Type: unix.NFTA_OBJ_TYPE, Data: binaryutil.BigEndian.PutUint32(uint32(kind))},
+		{Type: unix.NFTA_OBJ_USE, Data: binaryutil.BigEndian.PutUint32(1)},
+	}
+	if data != nil {
+		b, err := netlink.MarshalAttributes(data)
+		if err != nil {
+			t.Fatalf("failed to marshal object data with error: %+v", err)
+		}
+		attrs = append(attrs, netlink.Attribute{Type: unix.NLA_F_NESTED | unix.NFTA_OBJ_DATA, Data: b})
+	}
+	msg, err := objectMessage(unix.NFT_MSG_NEWOBJ, netlink.Request, table, attrs)
+	if err != nil {
+		t.Fatalf("failed to build object message with error: %+v", err)
+	}
+	return msg.Data
+}
+
+func TestDecodeObject(t *testing.T) {
+	table := &nftables.Table{Name: "filter", Family: nftables.TableFamilyINet}
+	u32, u64 := binaryutil.BigEndian.PutUint32, binaryutil.BigEndian.PutUint64
+	tests := []struct {
+		name string
+		kind ObjectKind
+		data []netlink.Attribute
+		want *Object
+	}{
+		{
+			name: "counter",
+			kind: ObjectCounter,
+			data: []netlink.Attribute{
+				{Type: unix.NFTA_COUNTER_BYTES, Data: u64(1500)},
+				{Type: unix.NFTA_COUNTER_PACKETS, Data: u64(3)},
+			},
+			want: &Object{Kind: ObjectCounter, Name: "counter", Use: 1, Counter: &CounterState{Packets: 3, Bytes: 1500}},
+		},
+		{
+			name: "quota",
+			kind: ObjectQuota,
+			data: []netlink.Attribute{
+				{Type: unix.NFTA_QUOTA_BYTES, Data: u64(1000)},
+				{Type: unix.NFTA_QUOTA_FLAGS, Data: u32(unix.NFT_QUOTA_F_INV)},
+				{Type: unix.NFTA_QUOTA_CONSUMED, Data: u64(400)},
+			},
+			want: &Object{Kind: ObjectQuota, Name: "quota", Use: 1, Quota: &QuotaState{Bytes: 1000, Consumed: 400, Over: true}},
+		},
+		{
+			name: "limit",
+			kind: ObjectLimit,
+			data: []netlink.Attribute{
+				{Type: unix.NFTA_LIMIT_RATE, Data: u64(1024)},
+				{Type: unix.NFTA_LIMIT_UNIT, Data: u64(60)},
+				{Type: unix.NFTA_LIMIT_BURST, Data: u32(5)},
+				{Type: unix.NFTA_LIMIT_TYPE, Data: u32(unix.NFT_LIMIT_PKT_BYTES)},
+				{Type: unix.NFTA_LIMIT_FLAGS, Data: u32(0)},
+			},
+			want: &Object{Kind: ObjectLimit, Name: "limit", Use: 1, Limit: &LimitState{Rate: 1024, Unit: time.Minute, Burst: 5, Bytes: true}},
+		},
+		{
+			name: "helper",
+			kind: ObjectCtHelper,
+			data: []netlink.Attribute{
+				{Type: unix.NFTA_CT_HELPER_NAME, Data: []byte("ftp\x00")},
+				{Type: unix.NFTA_CT_HELPER_L3PROTO, Data: binaryutil.BigEndian.PutUint16(uint16(nftables.TableFamilyIPv4))},
+				{Type: unix.NFTA_CT_HELPER_L4PROTO, Data: []byte{unix.IPPROTO_TCP}},
+			},
+			want: &Object{Kind: ObjectCtHelper, Name: "helper", Use: 1, CtHelper: &CtHelperState{Helper: "ftp", Family: nftables.TableFamilyIPv4, Protocol: unix.IPPROTO_TCP}},
+		},
+		{
+			name: "expectation",
+			kind: ObjectCtExpectation,
+			data: []netlink.Attribute{
+				{Type: nftaCtExpectL3Proto, Data: binaryutil.BigEndian.PutUint16(uint16(nftables.TableFamilyIPv6))},
+				{Type: nftaCtExpectL4Proto, Data: []byte{unix.IPPROTO_TCP}},
+				{Type: nftaCtExpectDPort, Data: binaryutil.BigEndian.PutUint16(20)},
+				{Type: nftaCtExpectTimeout, Data: binaryutil.NativeEndian.PutUint32(30000)},
+				{Type: nftaCtExpectSize, Data: []byte{4}},
+			},
+			want: &Object{Kind: ObjectCtExpectation, Name: "expectation", Use: 1, CtExpectation: &CtExpectationState{
+				Family: nftables.TableFamilyIPv6, Protocol: unix.IPPROTO_TCP, Port: 20, Timeout: 30 * time.Second, Size: 4,
+			}},
+		},
+		{
+			name: "synproxy",
+			kind: ObjectKind(10),
+			data: []netlink.Attribute{{Type: 1, Data: u32(1460)}},
+			want: &Object{Kind: ObjectKind(10), Name: "synproxy", Use: 1},
+		},
+	}
+	for _, tt := range tests {
+		o, err := decodeObject(objectNewMessage(t, table, tt.kind, tt.name, tt.data))
+		if err != nil {
+			t.Errorf("Test \"%s\" failed with error: %+v", tt.name, err)
+			continue
+		}
+		if o.table != table.Name || o.family != table.Family {
+			t.Errorf("Test \"%s\" failed, expected table %s of family %v, got %s of family %v", tt.name, table.Name, table.Family, o.table, o.family)
+		}
+		if !reflect.DeepEqual(&o.Object, tt.want) {
+			t.Errorf("Test \"%s\" failed, expected object %+v, got %+v", tt.name, tt.want, o.Object)
+		}
+	}
+	if _, err := decodeObject([]byte{uint8(nftables.TableFamilyINet), unix.NFNETLINK_V0, 0, 0}); err == nil {
+		t.Errorf("decoding object without name supposed to fail")
+	}
+}
+
+func TestCtExpectationMessage(t *testing.T) {
+	tests := []struct {
+		name  string
+		table *nftables.Table
+		exp   *CtExpectationState
+		data  []netlink.Attribute
+	}{
+		{
+			name:  "family of the table",
+			table: &nftables.Table{Name: "filter", Family: nftables.TableFamilyIPv4},
+			exp:   &CtExpectationState{Protocol: unix.IPPROTO_TCP, Port: 20, Timeout: time.Minute, Size: 8},
+			data: []netlink.Attribute{
+				{Type: nftaCtExpectL3Proto, Data: []byte{0, unix.NFPROTO_IPV4}},
+				{Type: nftaCtExpectL4Proto, Data: []byte{unix.IPPROTO_TCP}},
+				{Type: nftaCtExpectDPort, Data: []byte{0, 20}},
+				{Type: nftaCtExpectTimeout, Data: binaryutil.NativeEndian.PutUint32(60000)},
+				{Type: nftaCtExpectSize, Data: []byte{8}},
+			},
+		},
+		{
+			name:  "inet table",
+			table: &nftables.Table{Name: "filter", Family: nftables.TableFamilyINet},
+			exp:   &CtExpectationState{Family: nftables.TableFamilyIPv6, Protocol: unix.IPPROTO_UDP, Port: 5060, Timeout: 1500 * time.Millisecond, Size: 1},
+			data: []netlink.Attribute{
+				{Type: nftaCtExpectL3Proto, Data: []byte{0, unix.NFPROTO_IPV6}},
+				{Type: nftaCtExpectL4Proto, Data: []byte{unix.IPPROTO_UDP}},
+				{Type: nftaCtExpectDPort, Data: []byte{0x13, 0xc4}},
+				{Type: nftaCtExpectTimeout, Data: binaryutil.NativeEndian.PutUint32(1500)},
+				{Type: nftaCtExpectSize, Data: []byte{1}},
+			},
+		},
+	}
+	for _, tt := range tests {
+		if err := tt.exp.validate(tt.table.Family); err != nil {
+			t.Fatalf("Test \"%s\" failed with error: %+v but supposed to succeed", tt.name, err)
+		}
+		msg, err := ctExpectationMessage(tt.table, "exp", tt.exp)
+		if err != nil {
+			t.Fatalf("Test \"%s\" failed with error: %+v but supposed to succeed", tt.name, err)
+		}
+		if want := netlink.HeaderType(unix.NFNL_SUBSYS_NFTABLES<<8 | unix.NFT_MSG_NEWOBJ); msg.Header.Type != want {
+			t.Fatalf("Test \"%s\" failed, expected message type %#x, got %#x", tt.name, want, msg.Header.Type)
+		}
+		if msg.Header.Flags&netlink.Excl == 0 || msg.Data[0] != uint8(tt.table.Family) {
+			t.Fatalf("Test \"%s\" failed, expected exclusive create in family %d, got flags %v and family %d", tt.name, tt.table.Family, msg.Header.Flags, msg.Data[0])
+		}
+		attrs, err := netlink.UnmarshalAttributes(msg.Data[4:])
+		if err != nil {
+			t.Fatalf("Test \"%s\" failed to decode message with error: %+v", tt.name, err)
+		}
+		var data []netlink.Attribute
+		for _, a := range attrs {
+			switch a.Type &^ unix.NLA_F_NESTED {
+			case unix.NFTA_OBJ_TYPE:
+				if binaryutil.BigEndian.Uint32(a.Data) != uint32(ObjectCtExpectation) {
+					t.Fatalf("Test \"%s\" failed, expected object type %d, got %v", tt.name, ObjectCtExpectation, a.Data)
+				}
+			case unix.NFTA_OBJ_DATA:
+				if data, err = netlink.UnmarshalAttributes(a.Data); err != nil {
+					t.Fatalf("Test \"%s\" failed to decode object data with error: %+v", tt.name, err)
+				}
+			}
+		}
+		for i := range data {
+			data[i].Length = 0
+		}
+		if !reflect.DeepEqual(data, tt.data) {
+			t.Fatalf("Test \"%s\" failed, expected object data %+v, got %+v", tt.name, tt.data, data)
+		}
+	}
+
+	for _, tt := range []struct {
+		name   string
+		family nftables.TableFamily
+		exp    CtExpectationState
+	}{
+		{"inet table without family", nftables.TableFamilyINet, CtExpectationState{Protocol: unix.IPPROTO_TCP, Port: 20, Timeout: time.Second, Size: 1}},
+		{"family of other table", nftables.TableFamilyIPv4, CtExpectationState{Family: nftables.TableFamilyIPv6, Protocol: unix.IPPROTO_TCP, Port: 20, Timeout: time.Second, Size: 1}},
+		{"bridge table", nftables.TableFamilyBridge, CtExpectationState{Protocol: unix.IPPROTO_TCP, Port: 20, Timeout: time.Second, Size: 1}},
+		{"icmp", nftables.TableFamilyIPv4, CtExpectationState{Protocol: unix.IPPROTO_ICMP, Port: 20, Timeout: time.Second, Size: 1}},
+		{"zero port", nftables.TableFamilyIPv4, CtExpectationState{Protocol: unix.IPPROTO_TCP, Timeout: time.Second, Size: 1}},
+		{"zero timeout", nftables.TableFamilyIPv4, CtExpectationState{Protocol: unix.IPPROTO_TCP, Port: 20, Size: 1}},
+		{"zero size", nftables.TableFamilyIPv4, CtExpectationState{Protocol: unix.IPPROTO_TCP, Port: 20, Timeout: time.Second}},
+	} {
+		if err := tt.exp.validate(tt.family); err == nil {
+			t.Fatalf("Test \"%s\" is supposed to fail", tt.name)
+		}
+	}
+}
+
+func TestQuotaRemaining(t *testing.T) {
+	for _, tt := range []struct {
+		q    QuotaState
+		want uint64
+	}{
+		{q: QuotaState{Bytes: 1000, Consumed: 400}, want: 600},
+		{q: QuotaState{Bytes: 1000, Consumed: 1200, Depleted: true}, want: 0},
+	} {
+		if got := tt.q.Remaining(); got != tt.want {
+			t.Errorf("quota %+v expected %d bytes remaining, got %d", tt.q, tt.want, got)
+		}
+	}
+}
+
+func TestResetObjectMessage(t *testing.T) {
+	table := &nftables.Table{Name: "filter", Family: nftables.TableFamilyINet}
+	msg, err := resetObjectMessage(table, ObjectQuota, "guest")
+	if err != nil {
+		t.Fatalf("failed to build reset message with error: %+v", err)
+	}
+	if want := netlink.HeaderType(unix.NFNL_SUBSYS_NFTABLES<<8 | unix.NFT_MSG_GETOBJ_RESET); msg.Header.Type != want {
+		t.Errorf("expected message type %#x, got %#x", want, msg.Header.Type)
+	}
+	// A dump would reset every object of the kind in the table
+	if msg.Header.Flags != netlink.Request {
+		t.Errorf("expected request flags %v, got %v", netlink.Request, msg.Header.Flags)
+	}
+	if msg.Data[0] != uint8(table.Family) {
+		t.Errorf("expected family %v, got %v", table.Family, msg.Data[0])
+	}
+	attrs, err := netlink.UnmarshalAttributes(msg.Data[4:])
+	if err != nil {
+		t.Fatalf("failed to unmarshal attributes with error: %+v", err)
+	}
+	want := []netlink.Attribute{
+		{Type: unix.NFTA_OBJ_TABLE, Data: []byte("filter\x00")},
+		{Type: unix.NFTA_OBJ_NAME, Data: []byte("guest\x00")},
+		{Type: unix.NFTA_OBJ_TYPE, Data: binaryutil.BigEndian.PutUint32(uint32(ObjectQuota))},
+	}
+	for i := range attrs {
+		attrs[i].Length = 0
+	}
+	if !reflect.DeepEqual(attrs, want) {
+		t.Errorf("expected attributes %+v, got %+v", want, attrs)
+	}
+}
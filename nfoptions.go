@@ -0,0 +1,153 @@
+package nftableslib
+
+import "sync"
+
+// TableOption defines an option of the table passed to Create or CreateImm, options apply to rules
+// created in chains of the table after the option is set.
+type TableOption func(*tableOptions)
+
+type tableOptions struct {
+	sync.Mutex
+	defaultCounters bool
+	// forwardReferences allows queued rules to refer to chains created later in the transaction
+	forwardReferences bool
+	// strictICMPv6 fails rules dropping all ICMPv6 before neighbor discovery is accepted
+	strictICMPv6 bool
+	// strictAddrLists fails rules with address lists repeating addresses or carrying covered addresses
+	strictAddrLists bool
+	// strictHookPriorities fails base chains sharing the priority with another base chain of the hook
+	strictHookPriorities bool
+	warnings             func(error)
+	// setMemoryWarning is the estimated memory of a set raising SetMemoryWarning, 0 for the default
+	setMemoryWarning uint64
+	// reads and features are inherited from the tables the table belongs to
+	reads    *readPolicy
+	features *featureProbe
+	// expiry deletes rules created by CreateWithTTL, it is shared by tables of the connection
+	expiry *expiryScheduler
+	// foreignRules is the policy applied to rules of chains of the table not created by the library
+	foreignRules ForeignRulePolicy
+	// ids is inherited from the tables the table belongs to
+	ids IDGenerator
+}
+
+// WithDefaultCounters makes every rule created in chains of the table carry a counter, the counter
+// is placed after the rule's matches and before its action. Rules which already carry a counter
+// are not changed, Rule's NoCounter disables the counter for a single rule.
+func WithDefaultCounters() TableOption {
+	return func(o *tableOptions) {
+		o.defaultCounters = true
+	}
+}
+
+func (o *tableOptions) apply(opts []TableOption) {
+	o.Lock()
+	defer o.Unlock()
+	for _, opt := range opts {
+		opt(o)
+	}
+}
+
+// counters returns true if rules get a counter by default
+func (o *tableOptions) counters() bool {
+	if o == nil {
+		return false
+	}
+	o.Lock()
+	defer o.Unlock()
+
+	return o.defaultCounters
+}
+
+// allowForwardReferences returns true if queued rules can refer to chains which do not exist yet
+func (o *tableOptions) allowForwardReferences() bool {
+	if o == nil {
+		return false
+	}
+	o.Lock()
+	defer o.Unlock()
+
+	return o.forwardReferences
+}
+
+// strictICMPv6Drops returns true if rules dropping all ICMPv6 before neighbor discovery is accepted fail
+func (o *tableOptions) strictICMPv6Drops() bool {
+	if o == nil {
+		return false
+	}
+	o.Lock()
+	defer o.Unlock()
+
+	return o.strictICMPv6
+}
+
+// strictAddrListsNormalization returns true if rules with address lists which need to be normalized fail
+func (o *tableOptions) strictAddrListsNormalization() bool {
+	if o == nil {
+		return false
+	}
+	o.Lock()
+	defer o.Unlock()
+
+	return o.strictAddrLists
+}
+
+// strictHookPriorityCollisions returns true if base chains sharing the priority of the hook fail
+func (o *tableOptions) strictHookPriorityCollisions() bool {
+	if o == nil {
+		return false
+	}
+	o.Lock()
+	defer o.Unlock()
+
+	return o.strictHookPriorities
+}
+
+// warningHandler returns the function receiving warnings, nil if warnings are discarded
+func (o *tableOptions) warningHandler() func(error) {
+	if o == nil {
+		return nil
+	}
+	o.Lock()
+	defer o.Unlock()
+
+	return o.warnings
+}
+
+// readPolicy returns the policy of reads of the table's objects, nil is the default policy
+func (o *tableOptions) readPolicy() *readPolicy {
+	if o == nil {
+		return nil
+	}
+
+	return o.reads
+}
+
+// kernelFeatures returns features of the kernel of the table's connection
+func (o *tableOptions) kernelFeatures() (*KernelFeatures, error) {
+	if o == nil {
+		return allFeatures(), nil
+	}
+
+	return o.features.get()
+}
+
+// scheduler returns the scheduler deleting rules created by CreateWithTTL, nil if rules cannot expire
+func (o *tableOptions) scheduler() *expiryScheduler {
+	if o == nil {
+		return nil
+	}
+	o.Lock()
+	defer o.Unlock()
+
+	return o.expiry
+}
+
+// idGenerator returns the generator of IDs and names of sets and chains built for the table
+func (o *tableOptions) idGenerator() IDGenerator {
+	if o == nil || o.ids == nil {
+		return defaultIDs
+	}
+
+	return o.ids
+}
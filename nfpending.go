@@ -0,0 +1,123 @@
+package nftableslib
+
+import (
+	"sort"
+
+	"github.com/google/nftables"
+)
+
+// PendingObject identifies a table or a chain which creation or deletion is queued by a non
+// immediate operation, like Tables().Create or Chains().Delete, and is not flushed yet.
+type PendingObject struct {
+	Family nftables.TableFamily
+	Table  string
+	// Chain is empty for tables
+	Chain string
+	// Deleted is true if the object is queued for deletion, otherwise for creation
+	Deleted bool
+}
+
+// PendingObjects lists queued objects per kind. Sets and their elements are programmed
+// immediately by SetsInterface, so they are never pending.
+type PendingObjects struct {
+	Tables []PendingObject
+	Chains []PendingObject
+}
+
+// Pending returns tables and chains queued by non immediate operations which the host does not
+// reflect yet. The connection can be flushed outside of the library, so the state of queued objects
+// is checked against the host, objects reflected by the host are not pending anymore.
+func (nft *nfTables) Pending() (*PendingObjects, error) {
+	tables, _, err := listTables(nft.conn, listFilter{})
+	if err != nil {
+		return nil, err
+	}
+	chains, _, err := listChains(nft.conn, listFilter{})
+	if err != nil {
+		return nil, err
+	}
+	tablesOnHost := make(map[nftables.TableFamily]map[string]bool)
+	for _, t := range tables {
+		if tablesOnHost[t.Family] == nil {
+			tablesOnHost[t.Family] = make(map[string]bool)
+		}
+		tablesOnHost[t.Family][t.Name] = true
+	}
+	chainsOnHost := make(map[nftables.TableFamily]map[string]map[string]bool)
+	for _, c := range chains {
+		if chainsOnHost[c.Table.Family] == nil {
+			chainsOnHost[c.Table.Family] = make(map[string]map[string]bool)
+		}
+		if chainsOnHost[c.Table.Family][c.Table.Name] == nil {
+			chainsOnHost[c.Table.Family][c.Table.Name] = make(map[string]bool)
+		}
+		chainsOnHost[c.Table.Family][c.Table.Name][c.Name] = true
+	}
+
+	nft.Lock()
+	defer nft.Unlock()
+	p := &PendingObjects{}
+	for family, names := range nft.deleted {
+		for name := range names {
+			if !tablesOnHost[family][name] {
+				delete(names, name)
+				continue
+			}
+			p.Tables = append(p.Tables, PendingObject{Family: family, Table: name, Deleted: true})
+		}
+	}
+	for family, tables := range nft.tables {
+		for name, nt := range tables {
+			if nt.pending && tablesOnHost[family][name] {
+				nt.pending = false
+			}
+			if nt.pending {
+				p.Tables = append(p.Tables, PendingObject{Family: family, Table: name})
+			}
+			p.Chains = append(p.Chains, nt.ChainsInterface.(*nfChains).pendingChains(chainsOnHost[family][name])...)
+		}
+	}
+	sortPending(p.Tables)
+	sortPending(p.Chains)
+
+	return p, nil
+}
+
+// pendingChains returns queued chains of the table, onHost carries names of the table's chains
+// reported by the host.
+func (nfc *nfChains) pendingChains(onHost map[string]bool) []PendingObject {
+	nfc.Lock()
+	defer nfc.Unlock()
+	pending := make([]PendingObject, 0)
+	for name := range nfc.deleted {
+		if !onHost[name] {
+			delete(nfc.deleted, name)
+			continue
+		}
+		pending = append(pending, PendingObject{Family: nfc.table.Family, Table: nfc.table.Name, Chain: name, Deleted: true})
+	}
+	for name, ch := range nfc.chains {
+		if ch.pending && onHost[name] {
+			ch.pending = false
+		}
+		if ch.pending {
+			pending = append(pending, PendingObject{Family: nfc.table.Family, Table: nfc.table.Name, Chain: name})
+		}
+	}
+
+	return pending
+}
+
+func sortPending(objs []PendingObject) {
+	sort.Slice(objs, func(i, j int) bool {
+		a, b := objs[i], objs[j]
+		if a.Family != b.Family {
+			return a.Family < b.Family
+		}
+		if a.Table != b.Table {
+			return a.Table < b.Table
+		}
+
+		return a.Chain < b.Chain
+	})
+}
@@ -0,0 +1,200 @@
+package nftableslib
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/google/nftables"
+)
+
+// policerTag prefixes the user data of rules installed by Policer, the tag is followed by the class name
+const policerTag = "policer:"
+
+// Policer polices classes of traffic received by a device, every class is policed by a rule of the netdev
+// ingress chain, the rule drops packets of the class exceeding the class's rate: "udp dport 443 limit
+// rate over 12500 kbytes/second drop". The chain is named after the device and carries only rules
+// installed by Policer.
+type Policer struct {
+	nft    TablesInterface
+	table  string
+	device string
+	sync.Mutex
+	ri RulesInterface
+	// classes carries policed classes by name
+	classes map[string]*policedClass
+}
+
+type policedClass struct {
+	handle uint64
+	// spec is a snapshot of the class's rule, it is nil for classes adopted from the host
+	// as their classifier and rate are not known.
+	spec []byte
+}
+
+// PolicerChainName returns the name of the ingress chain policing traffic received by the device
+func PolicerChainName(device string) string {
+	return "ingress-" + device
+}
+
+// NewPolicer returns Policer policing traffic received by the device, the netdev table and the ingress
+// chain bound to the device are created if they do not exist. Classes found in the chain are adopted,
+// re-applying an adopted class replaces its rule once.
+func NewPolicer(nft TablesInterface, table, device string) (*Policer, error) {
+	if err := validateDevices([]string{device}); err != nil {
+		return nil, err
+	}
+	p := &Policer{
+		nft:     nft,
+		table:   table,
+		device:  device,
+		classes: make(map[string]*policedClass),
+	}
+	if err := p.ensureChain(); err != nil {
+		return nil, err
+	}
+	if err := p.load(); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// ensureChain makes sure the table and the ingress chain bound to the device exist
+func (p *Policer) ensureChain() error {
+	family := nftables.TableFamilyNetdev
+	ci, err := p.nft.Tables().Table(p.table, family)
+	if err != nil {
+		// The table is not in the store, it might have been programmed by a previous instance
+		if _, err := p.nft.Tables().SyncTable(p.table, family); err != nil {
+			return err
+		}
+		if ci, err = p.nft.Tables().Table(p.table, family); err != nil {
+			if err := p.nft.Tables().CreateImm(p.table, family); err != nil {
+				return err
+			}
+			if ci, err = p.nft.Tables().Table(p.table, family); err != nil {
+				return err
+			}
+		}
+	}
+	name := PolicerChainName(p.device)
+	if !ci.Chains().Exist(name) {
+		if err := ci.Chains().CreateImm(name, &ChainAttributes{
+			Type:     nftables.ChainTypeFilter,
+			Hook:     nftables.ChainHookIngress,
+			Priority: nftables.ChainPriorityFilter,
+			Devices:  []string{p.device},
+		}); err != nil {
+			return err
+		}
+	}
+	p.ri, err = ci.Chains().Chain(name)
+
+	return err
+}
+
+// load adopts classes policed by rules of the chain
+func (p *Policer) load() error {
+	ud, err := p.ri.Rules().GetRulesUserData()
+	if err != nil {
+		return err
+	}
+	for handle, data := range ud {
+		if class, ok := policedClassName(data); ok {
+			p.classes[class] = &policedClass{handle: handle}
+		}
+	}
+
+	return nil
+}
+
+// Police drops packets matched by the classifier exceeding the limit, the limit is always applied
+// as "limit rate over". Re-applying the class with the same classifier and limit does not change
+// the ruleset, a different classifier or limit replaces the class's rule in a single transaction.
+// The classifier carries only matches, it cannot carry Action, Limit or UserData.
+func (p *Policer) Police(class string, classifier *Rule, limit *Limit) error {
+	if class == "" {
+		return fmt.Errorf("class name cannot be empty")
+	}
+	if classifier == nil || limit == nil {
+		return fmt.Errorf("classifier and limit of class %s cannot be nil", class)
+	}
+	if classifier.Action != nil || len(classifier.Actions) != 0 || classifier.Limit != nil || classifier.UserData != nil {
+		return fmt.Errorf("classifier of class %s cannot carry action, limit or user data", class)
+	}
+	rule := *classifier
+	over := *limit
+	over.Over = true
+	rule.Limit = &over
+	rule.Action, _ = SetVerdict(NFT_DROP)
+	rule.UserData = []byte(policerTag + class)
+	if err := rule.Validate(); err != nil {
+		return err
+	}
+	// The snapshot does not share pointers with the classifier, so changes of the classifier are detected
+	spec, err := json.Marshal(&rule)
+	if err != nil {
+		return err
+	}
+	p.Lock()
+	defer p.Unlock()
+	pc, ok := p.classes[class]
+	switch {
+	case !ok:
+		handle, err := p.ri.Rules().CreateImm(&rule)
+		if err != nil {
+			return err
+		}
+		p.classes[class] = &policedClass{handle: handle, spec: spec}
+	case bytes.Equal(pc.spec, spec):
+		return nil
+	default:
+		if err := p.ri.Rules().Update(&rule, pc.handle); err != nil {
+			return err
+		}
+		pc.spec = spec
+	}
+
+	return nil
+}
+
+// Remove stops policing the class
+func (p *Policer) Remove(class string) error {
+	p.Lock()
+	defer p.Unlock()
+	pc, ok := p.classes[class]
+	if !ok {
+		return fmt.Errorf("class %s is not policed", class)
+	}
+	if err := p.ri.Rules().DeleteImm(pc.handle); err != nil {
+		return err
+	}
+	delete(p.classes, class)
+
+	return nil
+}
+
+// Classes returns names of policed classes sorted by name
+func (p *Policer) Classes() []string {
+	p.Lock()
+	defer p.Unlock()
+	classes := make([]string, 0, len(p.classes))
+	for c := range p.classes {
+		classes = append(classes, c)
+	}
+	sort.Strings(classes)
+
+	return classes
+}
+
+// policedClassName returns the class name carried by the user data of a rule installed by Policer
+func policedClassName(ud []byte) (string, bool) {
+	if !bytes.HasPrefix(ud, []byte(policerTag)) || len(ud) == len(policerTag) {
+		return "", false
+	}
+
+	return string(ud[len(policerTag):]), true
+}
@@ -2,100 +2,17 @@ package nftableslib
 
 import (
 	"net"
-	"sort"
 
 	"github.com/google/nftables"
 )
 
-type byIP struct {
-	byIP []*IPAddr
-}
-
-func (a *byIP) Len() int {
-	return len(a.byIP)
-}
-
-func (a *byIP) Swap(i, j int) {
-	a.byIP[i], a.byIP[j] = a.byIP[j], a.byIP[i]
-}
-
-func (a *byIP) Less(i, j int) bool {
-	a1 := a.byIP[i].IPAddr.IP
-	a2 := a.byIP[j].IPAddr.IP
-	for i := 0; i < len(a1); i++ {
-		if a1[i] < a2[i] {
-			return true
-		}
-		if a1[i] > a2[i] {
-			return false
-		}
-	}
-	return false
-}
-
-type byMask struct {
-	byMask []*IPAddr
-}
-
-func (m *byMask) Len() int {
-	return len(m.byMask)
-}
-
-func (m *byMask) Swap(i, j int) {
-	m.byMask[i], m.byMask[j] = m.byMask[j], m.byMask[i]
-}
-
-func (m *byMask) Less(i, j int) bool {
-	return *m.byMask[i].Mask < *m.byMask[j].Mask
-}
-
-// getNetworks goes through the list of IPAddr and group IP Addresses of the same network in the same slice
-// result is a 2 dimentional slice of discovered network and with addresses belonging to a particular network.
-func getNetworks(list []*IPAddr) [][]*IPAddr {
-	result := make([][]*IPAddr, 0)
-	for i := 0; i < len(list); i++ {
-		b1 := list[i].IPAddr.IP
-		networks := make([]*IPAddr, 0)
-		networks = append(networks, list[i])
-		j := i + 1
-		for ; j < len(list); j++ {
-			b2 := list[j].IPAddr.IP
-			if b1[0] == b2[0] {
-				networks = append(networks, list[j])
-				i++
-			}
-		}
-		if len(networks) != 0 {
-			result = append(result, networks)
-		}
-	}
-
-	return result
-}
-
 // buildElementRanges build a set of elements to cover ranges of IP addresses
-// defined in the list
-func buildElementRanges(list []*IPAddr) []nftables.SetElement {
-	a := byIP{
-		byIP: list,
-	}
-	sort.Sort(&a)
-	networks := getNetworks(a.byIP)
-	fl := make([]*IPAddr, 0)
-	for _, nets := range networks {
-		m := byMask{
-			byMask: nets,
-		}
-		sort.Sort(&m)
-		if len(m.byMask) > 1 {
-			fl = append(fl, tryCollapse(m.byMask)...)
-			continue
-		}
-		fl = append(fl, m.byMask...)
-	}
-	se := buildElements(fl)
+// defined in the list, duplicates and addresses covered by prefixes of the list are
+// removed and reported.
+func buildElementRanges(list []*IPAddr) ([]nftables.SetElement, *AddrListNormalized) {
+	fl, report := normalizeAddrList(list)
 
-	return se
+	return buildElements(fl), report
 }
 
 func buildElements(list []*IPAddr) []nftables.SetElement {
@@ -121,28 +38,6 @@ func computeGapRange(e1 *IPAddr) net.IP {
 	return net.IP(bip1)
 }
 
-func tryCollapse(org []*IPAddr) []*IPAddr {
-	res := make([]*IPAddr, 0)
-	collapsed := make([]int, len(org))
-	for i := 0; i < len(org); i++ {
-		if collapsed[i] == 1 {
-			continue
-		}
-		res = append(res, org[i])
-		for j := 0; j < len(org); j++ {
-			if i == j {
-				continue
-			}
-			if isSubnet(org[i], org[j]) {
-				collapsed[j] = 1
-				continue
-			}
-		}
-	}
-
-	return res
-}
-
 func isSubnet(ip1, ip2 *IPAddr) bool {
 	mask1 := getMask(*ip1.Mask, len(ip1.IP))
 	mask2 := getMask(*ip2.Mask, len(ip2.IP))
@@ -1,10 +1,8 @@
 package nftableslib
 
 import (
-	"bytes"
 	"net"
 	"reflect"
-	"sort"
 	"testing"
 )
 
@@ -147,36 +145,94 @@ func TestIsSubnet(t *testing.T) {
 	}
 }
 
-func TestTryCollapse(t *testing.T) {
-	addr1, _ := NewIPAddr("4.4.4.0/24")
-	addr2, _ := NewIPAddr("4.4.0.0/16")
-	addr3, _ := NewIPAddr("4.0.0.0/8")
-	addr4, _ := NewIPAddr("4.0.4.0/25")
-	addr5, _ := NewIPAddr("4.0.0.0/16")
+func TestNormalizeAddrList(t *testing.T) {
 	tests := []struct {
-		name string
-		list []*IPAddr
-		want []*IPAddr
+		name       string
+		list       []string
+		want       []string
+		duplicates []string
+		covered    [][2]string
 	}{
 		{
 			name: "1 entry left",
-			list: []*IPAddr{addr1, addr2, addr3, addr4},
-			want: []*IPAddr{addr3},
+			list: []string{"4.4.4.0/24", "4.4.0.0/16", "4.0.0.0/8", "4.0.4.0/25"},
+			want: []string{"4.0.0.0/8"},
+			covered: [][2]string{
+				{"4.0.4.0/25", "4.0.0.0/8"}, {"4.4.0.0/16", "4.0.0.0/8"}, {"4.4.4.0/24", "4.0.0.0/8"},
+			},
 		},
 		{
 			name: "2 entry left",
-			list: []*IPAddr{addr1, addr2, addr4, addr5},
-			want: []*IPAddr{addr2, addr5},
+			list: []string{"4.4.4.0/24", "4.4.0.0/16", "4.0.4.0/25", "4.0.0.0/16"},
+			want: []string{"4.0.0.0/16", "4.4.0.0/16"},
+			covered: [][2]string{
+				{"4.0.4.0/25", "4.0.0.0/16"}, {"4.4.4.0/24", "4.4.0.0/16"},
+			},
+		},
+		{
+			name: "ipv4 nothing to normalize",
+			list: []string{"5.5.0.0/16", "1.4.0.0/16", "2.0.0.0/8"},
+			want: []string{"1.4.0.0/16", "2.0.0.0/8", "5.5.0.0/16"},
+		},
+		{
+			name:       "ipv4 duplicates",
+			list:       []string{"10.0.0.1", "10.0.0.2", "10.0.0.1", "10.0.0.1/32"},
+			want:       []string{"10.0.0.1", "10.0.0.2"},
+			duplicates: []string{"10.0.0.1", "10.0.0.1"},
+		},
+		{
+			name:       "ipv4 duplicate within prefix",
+			list:       []string{"10.1.2.3", "10.0.0.0/8", "10.1.2.3", "0.0.0.0/1"},
+			want:       []string{"0.0.0.0/1"},
+			duplicates: []string{"10.1.2.3"},
+			covered:    [][2]string{{"10.0.0.0/8", "0.0.0.0/1"}, {"10.1.2.3", "0.0.0.0/1"}},
+		},
+		{
+			name:       "ipv6 duplicates and nesting",
+			list:       []string{"2001:db8::/32", "2001:db8:1::/48", "2001:db9::1", "2001:db8::/32", "2001:db8:ffff::1"},
+			want:       []string{"2001:db8::/32", "2001:db9::1"},
+			duplicates: []string{"2001:db8::/32"},
+			covered:    [][2]string{{"2001:db8:1::/48", "2001:db8::/32"}, {"2001:db8:ffff::1", "2001:db8::/32"}},
 		},
 	}
 	for _, tt := range tests {
-		networks := byMask{
-			byMask: tt.list,
+		list := make([]*IPAddr, 0, len(tt.list))
+		for _, a := range tt.list {
+			list = append(list, setIPAddr(t, a))
 		}
-		sort.Sort(&networks)
-		got := tryCollapse(networks.byMask)
-		if !reflect.DeepEqual(got, tt.want) {
-			t.Fatalf("Test \"%s\" failed, got: %+v want: %+v", tt.name, got, tt.want)
+		got, report := normalizeAddrList(list)
+		if len(got) != len(tt.want) {
+			t.Fatalf("Test \"%s\" failed, expected %d addresses, got %d", tt.name, len(tt.want), len(got))
+		}
+		for i, a := range tt.want {
+			if !reflect.DeepEqual(got[i], setIPAddr(t, a)) {
+				t.Fatalf("Test \"%s\" failed, expected address %s, got %+v", tt.name, a, got[i])
+			}
+		}
+		if len(tt.duplicates) == 0 && len(tt.covered) == 0 {
+			if report != nil {
+				t.Fatalf("Test \"%s\" failed, unexpected report %+v", tt.name, report)
+			}
+			continue
+		}
+		if report == nil || len(report.Duplicates) != len(tt.duplicates) || len(report.Covered) != len(tt.covered) {
+			t.Fatalf("Test \"%s\" failed, expected %d duplicates and %d covered addresses, got %+v", tt.name, len(tt.duplicates), len(tt.covered), report)
+		}
+		for i, a := range tt.duplicates {
+			if !reflect.DeepEqual(report.Duplicates[i], setIPAddr(t, a)) {
+				t.Fatalf("Test \"%s\" failed, expected duplicate %s, got %+v", tt.name, a, report.Duplicates[i])
+			}
+		}
+		for i, c := range tt.covered {
+			if !reflect.DeepEqual(report.Covered[i], CoveredAddr{Addr: setIPAddr(t, c[0]), By: setIPAddr(t, c[1])}) {
+				t.Fatalf("Test \"%s\" failed, expected %s covered by %s, got %+v", tt.name, c[0], c[1], report.Covered[i])
+			}
+		}
+		// The list itself is kept intact
+		for i, a := range tt.list {
+			if !reflect.DeepEqual(list[i], setIPAddr(t, a)) {
+				t.Fatalf("Test \"%s\" failed, list is modified", tt.name)
+			}
 		}
 	}
 }
@@ -205,53 +261,3 @@ func TestComputeGapRange(t *testing.T) {
 		}
 	}
 }
-
-func TestGetNetworks(t *testing.T) {
-	addr1, _ := NewIPAddr("4.4.4.0/24")
-	addr2, _ := NewIPAddr("1.4.0.0/16")
-	addr3, _ := NewIPAddr("2.0.0.0/8")
-	addr4, _ := NewIPAddr("2.4.4.0/25")
-	addr5, _ := NewIPAddr("5.5.0.0/16")
-	tests := []struct {
-		name string
-		list []*IPAddr
-		want [][]*IPAddr
-	}{
-		{
-			name: "Empty list",
-			list: nil,
-			want: nil,
-		},
-		{
-			name: "1 element",
-			list: []*IPAddr{addr1},
-			want: [][]*IPAddr{
-				[]*IPAddr{addr1},
-			},
-		},
-		{
-			name: "5 elements",
-			list: []*IPAddr{addr1, addr2, addr3, addr4, addr5},
-			want: [][]*IPAddr{
-				[]*IPAddr{addr2},
-				[]*IPAddr{addr3, addr4},
-				[]*IPAddr{addr1},
-				[]*IPAddr{addr5},
-			},
-		},
-	}
-	for _, tt := range tests {
-		a := byIP{
-			byIP: tt.list,
-		}
-		sort.Sort(&a)
-		got := getNetworks(a.byIP)
-		for i := 0; i < len(got); i++ {
-			for j := 0; j < len(got[i]); j++ {
-				if bytes.Compare(tt.want[i][j].IP.To4(), got[i][j].IP.To4()) != 0 {
-					t.Errorf("Test \"%s\" failed, expected %+v got %+v", tt.name, *tt.want[i][j], *got[i][j])
-				}
-			}
-		}
-	}
-}
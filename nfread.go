@@ -0,0 +1,104 @@
+package nftableslib
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// DefaultReadAttempts defines how many times an interrupted dump is read before the error
+	// is returned to the caller, unless ConsistentRead is used.
+	DefaultReadAttempts = 3
+	readBackoff         = 10 * time.Millisecond
+	maxReadBackoff      = 200 * time.Millisecond
+)
+
+// ErrDumpInterrupted is returned when the ruleset kept changing while it was dumped and no
+// uninterrupted dump was read, it unwraps to unix.EINTR.
+type ErrDumpInterrupted struct {
+	Attempts int
+}
+
+func (e *ErrDumpInterrupted) Error() string {
+	return fmt.Sprintf("dump was interrupted by changes of the ruleset %d times in a row", e.Attempts)
+}
+
+// Unwrap returns unix.EINTR
+func (e *ErrDumpInterrupted) Unwrap() error {
+	return unix.EINTR
+}
+
+// TablesOption defines an option of InitNFTables
+type TablesOption func(*nfTables)
+
+// ConsistentRead makes reads of tables, chains, rules, sets and set elements repeat interrupted
+// dumps until an uninterrupted dump is read or the deadline passes, by default an interrupted dump
+// is read up to DefaultReadAttempts times.
+func ConsistentRead(deadline time.Duration) TablesOption {
+	return func(nft *nfTables) {
+		nft.reads = &readPolicy{deadline: deadline}
+	}
+}
+
+// readPolicy repeats reads of dumps the kernel interrupted because the ruleset changed while it
+// was dumped, the kernel flags such dumps and the library reports them as unix.EINTR. Attempts are
+// separated by a backoff doubling up to maxReadBackoff. A nil policy reads DefaultReadAttempts times.
+type readPolicy struct {
+	// attempts bounds the number of reads, 0 means DefaultReadAttempts, it is ignored if deadline is set
+	attempts int
+	deadline time.Duration
+	// sleep and now are replaced by tests
+	sleep func(time.Duration)
+	now   func() time.Time
+}
+
+// do calls read until it returns an error other than unix.EINTR, read must start over on every call
+func (p *readPolicy) do(read func() error) error {
+	if p == nil {
+		p = &readPolicy{}
+	}
+	sleep, now := p.sleep, p.now
+	if sleep == nil {
+		sleep = time.Sleep
+	}
+	if now == nil {
+		now = time.Now
+	}
+	attempts := p.attempts
+	if attempts == 0 {
+		attempts = DefaultReadAttempts
+	}
+	start := now()
+	backoff := readBackoff
+	for attempt := 1; ; attempt++ {
+		err := read()
+		if !isDumpInterrupted(err) {
+			return err
+		}
+		if p.deadline != 0 {
+			if now().Sub(start)+backoff > p.deadline {
+				return &ErrDumpInterrupted{Attempts: attempt}
+			}
+		} else if attempt >= attempts {
+			return &ErrDumpInterrupted{Attempts: attempt}
+		}
+		sleep(backoff)
+		if backoff *= 2; backoff > maxReadBackoff {
+			backoff = maxReadBackoff
+		}
+	}
+}
+
+// isDumpInterrupted returns true if the dump was interrupted and can be read again, dumps which
+// were already repeated by the policy are not repeated once again.
+func isDumpInterrupted(err error) bool {
+	var de *ErrDumpInterrupted
+	if errors.As(err, &de) {
+		return false
+	}
+
+	return errors.Is(err, unix.EINTR)
+}
@@ -0,0 +1,235 @@
+package nftableslib
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/nftables"
+	"golang.org/x/sys/unix"
+)
+
+// interruptingConn returns scripted errors from reads before it returns the result,
+// methods not used by the tests are left to the embedded nil connection.
+type interruptingConn struct {
+	NetNS
+	errs     map[string][]error
+	tables   []*nftables.Table
+	chains   []*nftables.Chain
+	elements []nftables.SetElement
+}
+
+func (c *interruptingConn) next(method string) error {
+	errs := c.errs[method]
+	if len(errs) == 0 {
+		return nil
+	}
+	c.errs[method] = errs[1:]
+
+	return errs[0]
+}
+
+func (c *interruptingConn) ListTables() ([]*nftables.Table, error) {
+	if err := c.next("ListTables"); err != nil {
+		return nil, err
+	}
+	return c.tables, nil
+}
+
+func (c *interruptingConn) ListChains() ([]*nftables.Chain, error) {
+	if err := c.next("ListChains"); err != nil {
+		return nil, err
+	}
+	return c.chains, nil
+}
+
+func (c *interruptingConn) GetSets(*nftables.Table) ([]*nftables.Set, error) {
+	if err := c.next("GetSets"); err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+func (c *interruptingConn) GetSetByName(t *nftables.Table, name string) (*nftables.Set, error) {
+	return &nftables.Set{Table: t, Name: name}, nil
+}
+
+func (c *interruptingConn) GetSetElements(*nftables.Set) ([]nftables.SetElement, error) {
+	if err := c.next("GetSetElements"); err != nil {
+		return nil, err
+	}
+	return c.elements, nil
+}
+
+func (c *interruptingConn) GetRule(*nftables.Table, *nftables.Chain) ([]*nftables.Rule, error) {
+	if err := c.next("GetRule"); err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+// fakeClock records backoffs of the read policy and advances the time by them
+type fakeClock struct {
+	t      time.Time
+	sleeps []time.Duration
+}
+
+func (c *fakeClock) policy(p *readPolicy) *readPolicy {
+	c.t = time.Unix(0, 0)
+	p.sleep = func(d time.Duration) {
+		c.sleeps = append(c.sleeps, d)
+		c.t = c.t.Add(d)
+	}
+	p.now = func() time.Time { return c.t }
+
+	return p
+}
+
+func TestReadPolicy(t *testing.T) {
+	ms := time.Millisecond
+	errOther := errors.New("other")
+	tests := []struct {
+		name     string
+		policy   *readPolicy
+		errs     []error
+		calls    int
+		sleeps   []time.Duration
+		wantErr  error
+		attempts int
+	}{
+		{
+			name:   "uninterrupted",
+			policy: &readPolicy{},
+			calls:  1,
+		},
+		{
+			name:   "interrupted twice",
+			policy: &readPolicy{},
+			errs:   []error{unix.EINTR, unix.EINTR},
+			calls:  3,
+			sleeps: []time.Duration{10 * ms, 20 * ms},
+		},
+		{
+			name:     "interrupted more than default attempts",
+			policy:   &readPolicy{},
+			errs:     []error{unix.EINTR, unix.EINTR, unix.EINTR, unix.EINTR},
+			calls:    DefaultReadAttempts,
+			sleeps:   []time.Duration{10 * ms, 20 * ms},
+			wantErr:  unix.EINTR,
+			attempts: DefaultReadAttempts,
+		},
+		{
+			name:    "other error is not retried",
+			policy:  &readPolicy{},
+			errs:    []error{errOther, unix.EINTR},
+			calls:   1,
+			wantErr: errOther,
+		},
+		{
+			name:   "consistent read within deadline",
+			policy: &readPolicy{deadline: time.Second},
+			errs:   []error{unix.EINTR, unix.EINTR, unix.EINTR, unix.EINTR, unix.EINTR, unix.EINTR},
+			calls:  7,
+			sleeps: []time.Duration{10 * ms, 20 * ms, 40 * ms, 80 * ms, 160 * ms, 200 * ms},
+		},
+		{
+			name:     "consistent read past deadline",
+			policy:   &readPolicy{deadline: 500 * ms},
+			errs:     []error{unix.EINTR, unix.EINTR, unix.EINTR, unix.EINTR, unix.EINTR, unix.EINTR, unix.EINTR},
+			calls:    6,
+			sleeps:   []time.Duration{10 * ms, 20 * ms, 40 * ms, 80 * ms, 160 * ms},
+			wantErr:  unix.EINTR,
+			attempts: 6,
+		},
+	}
+	for _, tt := range tests {
+		clock := &fakeClock{}
+		p := clock.policy(tt.policy)
+		errs, calls := tt.errs, 0
+		err := p.do(func() error {
+			calls++
+			if len(errs) == 0 {
+				return nil
+			}
+			err := errs[0]
+			errs = errs[1:]
+			return err
+		})
+		if !errors.Is(err, tt.wantErr) || (err == nil) != (tt.wantErr == nil) {
+			t.Errorf("Test \"%s\" failed, expected error %v, got %v", tt.name, tt.wantErr, err)
+		}
+		if tt.attempts != 0 {
+			de, ok := err.(*ErrDumpInterrupted)
+			if !ok || de.Attempts != tt.attempts {
+				t.Errorf("Test \"%s\" failed, expected dump interrupted after %d attempts, got %v", tt.name, tt.attempts, err)
+			}
+		}
+		if calls != tt.calls {
+			t.Errorf("Test \"%s\" failed, expected %d reads, got %d", tt.name, tt.calls, calls)
+		}
+		if !reflect.DeepEqual(clock.sleeps, tt.sleeps) {
+			t.Errorf("Test \"%s\" failed, expected backoffs %v, got %v", tt.name, tt.sleeps, clock.sleeps)
+		}
+	}
+}
+
+func TestInterruptedReads(t *testing.T) {
+	table := &nftables.Table{Name: "filter", Family: nftables.TableFamilyIPv4}
+	conn := &interruptingConn{
+		errs: map[string][]error{
+			"ListTables":     {unix.EINTR},
+			"ListChains":     {unix.EINTR, unix.EINTR},
+			"GetSetElements": {unix.EINTR},
+		},
+		tables:   []*nftables.Table{table},
+		chains:   []*nftables.Chain{{Name: "input", Table: table}},
+		elements: []nftables.SetElement{{Key: []byte{10, 0, 0, 1}}},
+	}
+	clock := &fakeClock{}
+	nft := InitNFTables(conn, ConsistentRead(time.Second)).(*nfTables)
+	clock.policy(nft.reads)
+
+	if _, err := nft.Sync(nftables.TableFamilyIPv4); err != nil {
+		t.Fatalf("sync failed with error: %+v", err)
+	}
+	if want := []time.Duration{10 * time.Millisecond, 10 * time.Millisecond, 20 * time.Millisecond}; !reflect.DeepEqual(clock.sleeps, want) {
+		t.Fatalf("expected backoffs %v, got %v", want, clock.sleeps)
+	}
+	ci, err := nft.Table("filter", nftables.TableFamilyIPv4)
+	if err != nil {
+		t.Fatalf("failed to get table filter with error: %+v", err)
+	}
+	conn.errs["ListChains"] = []error{unix.EINTR}
+	chains, err := ci.Chains().Get()
+	if err != nil {
+		t.Fatalf("failed to list chains with error: %+v", err)
+	}
+	if !reflect.DeepEqual(chains, []string{"input"}) {
+		t.Fatalf("expected chains [input], got %v", chains)
+	}
+
+	si, err := nft.TableSets("filter", nftables.TableFamilyIPv4)
+	if err != nil {
+		t.Fatalf("failed to get sets of table filter with error: %+v", err)
+	}
+	nfs := si.(*nfSets)
+	nfs.sets["blocked"] = &nftables.Set{Table: table, Name: "blocked", KeyType: nftables.TypeIPAddr}
+	elements, err := si.Sets().GetSetElements("blocked")
+	if err != nil {
+		t.Fatalf("failed to get elements with error: %+v", err)
+	}
+	if !reflect.DeepEqual(elements, conn.elements) {
+		t.Fatalf("expected elements %+v, got %+v", conn.elements, elements)
+	}
+
+	// Without ConsistentRead the dump is given up after DefaultReadAttempts
+	nfs.opts.reads = nil
+	conn.errs["GetSetElements"] = []error{unix.EINTR, unix.EINTR, unix.EINTR, unix.EINTR}
+	if _, err := si.Sets().GetSetElements("blocked"); !errors.Is(err, unix.EINTR) {
+		t.Fatalf("expected interrupted dump error, got %v", err)
+	}
+	if left := len(conn.errs["GetSetElements"]); left != 4-DefaultReadAttempts {
+		t.Fatalf("expected %d reads, got %d", DefaultReadAttempts, 4-left)
+	}
+}
@@ -0,0 +1,190 @@
+package nftableslib
+
+import (
+	"errors"
+	"time"
+
+	"github.com/google/nftables"
+)
+
+// ErrReadOnly is returned by every operation changing the ruleset of a read-only connection
+var ErrReadOnly = errors.New("connection is read-only")
+
+// ReadOnly makes the library refuse to change the ruleset, reads, syncs, dumps and audits work as usual,
+// while mutating methods return ErrReadOnly without queuing anything. The connection is wrapped,
+// so operations reaching it are refused even if they are not rejected by the library first.
+func ReadOnly() TablesOption {
+	return func(nft *nfTables) {
+		if _, ok := nft.conn.(*readOnlyConn); !ok {
+			nft.conn = &readOnlyConn{conn: nft.conn}
+		}
+	}
+}
+
+// writable returns ErrReadOnly if the connection is read-only, mutating methods check it before
+// they change the store.
+func writable(conn NetNS) error {
+	if ac, ok := conn.(*auditConn); ok {
+		conn = ac.conn
+	}
+	if _, ok := conn.(*readOnlyConn); ok {
+		return ErrReadOnly
+	}
+
+	return nil
+}
+
+// readConn returns the connection reads of conn are sent to, reads dumping the kernel directly
+// bypass the read-only and audit wrappers.
+func readConn(conn NetNS) NetNS {
+	for {
+		switch c := conn.(type) {
+		case *readOnlyConn:
+			conn = c.conn
+		case *auditConn:
+			conn = c.conn
+		default:
+			return conn
+		}
+	}
+}
+
+// readOnlyConn passes reads to the wrapped connection and drops every queued change. Methods are
+// not promoted from the wrapped connection, so methods added to NetNS must be classified here.
+// Optional interfaces of connections are implemented on top of the wrapped connection.
+type readOnlyConn struct {
+	conn NetNS
+}
+
+var _ NetNS = &readOnlyConn{}
+var _ ChainDevicesConn = &readOnlyConn{}
+var _ ObjectsConn = &readOnlyConn{}
+var _ GenIDReader = &readOnlyConn{}
+var _ FeaturesConn = &readOnlyConn{}
+var _ SetElementsIterator = &readOnlyConn{}
+var _ ExpiringElementsIterator = &readOnlyConn{}
+var _ RulesConn = &readOnlyConn{}
+var _ TransactionConn = &readOnlyConn{}
+
+func (ro *readOnlyConn) Flush() error {
+	return ErrReadOnly
+}
+
+func (ro *readOnlyConn) FlushRuleset() {}
+
+func (ro *readOnlyConn) AddTable(t *nftables.Table) *nftables.Table {
+	return t
+}
+
+func (ro *readOnlyConn) DelTable(*nftables.Table) {}
+
+func (ro *readOnlyConn) ListTables() ([]*nftables.Table, error) {
+	return ro.conn.ListTables()
+}
+
+func (ro *readOnlyConn) AddChain(c *nftables.Chain) *nftables.Chain {
+	return c
+}
+
+func (ro *readOnlyConn) DelChain(*nftables.Chain) {}
+
+func (ro *readOnlyConn) ListChains() ([]*nftables.Chain, error) {
+	return ro.conn.ListChains()
+}
+
+func (ro *readOnlyConn) AddRule(r *nftables.Rule) *nftables.Rule {
+	return r
+}
+
+func (ro *readOnlyConn) InsertRule(r *nftables.Rule) *nftables.Rule {
+	return r
+}
+
+func (ro *readOnlyConn) ReplaceRule(r *nftables.Rule) *nftables.Rule {
+	return r
+}
+
+func (ro *readOnlyConn) DelRule(*nftables.Rule) error {
+	return ErrReadOnly
+}
+
+func (ro *readOnlyConn) DelRulesImm([]*nftables.Rule) error {
+	return ErrReadOnly
+}
+
+func (ro *readOnlyConn) Transaction() (NetNS, error) {
+	return nil, ErrReadOnly
+}
+
+func (ro *readOnlyConn) GetRule(t *nftables.Table, c *nftables.Chain) ([]*nftables.Rule, error) {
+	return ro.conn.GetRule(t, c)
+}
+
+func (ro *readOnlyConn) AddSet(*nftables.Set, []nftables.SetElement) error {
+	return ErrReadOnly
+}
+
+func (ro *readOnlyConn) DelSet(*nftables.Set) {}
+
+func (ro *readOnlyConn) GetSets(t *nftables.Table) ([]*nftables.Set, error) {
+	return getSets(ro.conn, t)
+}
+
+func (ro *readOnlyConn) GetSetByName(t *nftables.Table, name string) (*nftables.Set, error) {
+	return ro.conn.GetSetByName(t, name)
+}
+
+func (ro *readOnlyConn) GetSetElements(s *nftables.Set) ([]nftables.SetElement, error) {
+	return getSetElements(ro.conn, s)
+}
+
+func (ro *readOnlyConn) SetAddElements(*nftables.Set, []nftables.SetElement) error {
+	return ErrReadOnly
+}
+
+func (ro *readOnlyConn) SetDeleteElements(*nftables.Set, []nftables.SetElement) error {
+	return ErrReadOnly
+}
+
+func (ro *readOnlyConn) BindChainDevices(*nftables.Chain, []string, []string) error {
+	return ErrReadOnly
+}
+
+func (ro *readOnlyConn) ChainDevices(c *nftables.Chain) ([]string, error) {
+	return chainDevices(ro.conn, c)
+}
+
+func (ro *readOnlyConn) LinkExists(name string) (bool, error) {
+	return deviceExists(ro.conn, name)
+}
+
+func (ro *readOnlyConn) ListObjects(t *nftables.Table) ([]*Object, error) {
+	return listObjects(ro.conn, t)
+}
+
+func (ro *readOnlyConn) AddObject(*nftables.Table, *Object) {}
+
+func (ro *readOnlyConn) DelObject(*nftables.Table, ObjectKind, string) error {
+	return ErrReadOnly
+}
+
+// ResetObject is refused, resetting counters and quotas changes their state
+func (ro *readOnlyConn) ResetObject(*nftables.Table, ObjectKind, string) (*Object, error) {
+	return nil, ErrReadOnly
+}
+
+func (ro *readOnlyConn) GetGenID() (uint32, error) {
+	return getGenID(ro.conn)
+}
+
+func (ro *readOnlyConn) KernelFeatures() (*KernelFeatures, error) {
+	return probeFeatures(ro.conn)
+}
+
+func (ro *readOnlyConn) IterateSetElements(s *nftables.Set, fn func(nftables.SetElement) error) error {
+	return iterateSetElements(ro.conn, s, fn)
+}
+
+func (ro *readOnlyConn) IterateExpiringElements(s *nftables.Set, fn func(nftables.SetElement, time.Duration) error) error {
+	return iterateExpiringElements(ro.conn, s, fn)
+}
@@ -0,0 +1,208 @@
+package nftableslib
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+)
+
+// TableInfo describes a table programmed on the host, it is returned by Tables().List.
+type TableInfo struct {
+	Name   string
+	Family nftables.TableFamily
+	Flags  uint32
+	// Use is the number of objects the kernel counts as using the table, chains, sets and stateful
+	// objects of the table, the table cannot be deleted while Use is not 0.
+	Use uint32
+}
+
+// ChainInfo describes a chain of the table programmed on the host, it is returned by Chains().List.
+type ChainInfo struct {
+	Name string
+	// Base is true for chains attached to a hook, Type, Hooknum, Priority and Policy are set only for them
+	Base     bool
+	Type     nftables.ChainType
+	Hooknum  nftables.ChainHook
+	Priority nftables.ChainPriority
+	Policy   *nftables.ChainPolicy
+	// Use is the number the kernel counts of rules of the chain along with jump and goto verdicts of rules
+	// and verdict map elements referring to the chain. Only the kernel reports it, it is 0 for other connections.
+	Use uint32
+}
+
+// ReferenceKind defines a kind of object FindReferences looks for
+type ReferenceKind int
+
+const (
+	// ReferenceChain finds rules jumping or going to the chain, directly or by elements of verdict maps
+	ReferenceChain ReferenceKind = iota
+	// ReferenceSet finds rules looking up or updating the set or the map
+	ReferenceSet
+)
+
+// Reference describes a rule referring to a chain or a set
+type Reference struct {
+	// Chain is the name of the chain the referring rule belongs to
+	Chain  string
+	RuleID uint32
+	Handle uint64
+	// Description tells how the rule refers to the object, for example "jump app" or "lookup @blocked",
+	// descriptions of several references of the same rule are separated by a comma.
+	Description string
+}
+
+// List returns tables of the family programmed on the host, tables of all families are returned
+// when the family is unspecified.
+func (nft *nfTables) List(familyType nftables.TableFamily) ([]*TableInfo, error) {
+	var tables []*nftables.Table
+	if err := nft.reads.do(func() (err error) {
+		tables, _, err = listTables(nft.conn, listFilter{family: familyType})
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	infos := make([]*TableInfo, 0, len(tables))
+	for _, t := range tables {
+		infos = append(infos, &TableInfo{Name: t.Name, Family: t.Family, Flags: t.Flags, Use: t.Use})
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		if infos[i].Family != infos[j].Family {
+			return infos[i].Family < infos[j].Family
+		}
+		return infos[i].Name < infos[j].Name
+	})
+
+	return infos, nil
+}
+
+// List returns chains of the table programmed on the host sorted by name
+func (nfc *nfChains) List() ([]*ChainInfo, error) {
+	var chains []*nftables.Chain
+	var uses []uint32
+	if err := nfc.opts.readPolicy().do(func() (err error) {
+		chains, uses, err = listChainsUse(nfc.conn, nfc.listFilter(""))
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	infos := make([]*ChainInfo, 0, len(chains))
+	for i, c := range chains {
+		info := &ChainInfo{Name: c.Name, Use: uses[i]}
+		if c.Type != "" {
+			info.Base = true
+			info.Type, info.Hooknum, info.Priority, info.Policy = c.Type, c.Hooknum, c.Priority, c.Policy
+		}
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Name < infos[j].Name
+	})
+
+	return infos, nil
+}
+
+// FindReferences returns rules of the table known to the store which refer to the chain or the set,
+// references are sorted by the name of the chain and by the position of the rule in the chain.
+// Rules programmed by other applications are not known to the store unless the table was synced.
+func (nfc *nfChains) FindReferences(kind ReferenceKind, name string) ([]*Reference, error) {
+	var match func(*nfRule) []string
+	switch kind {
+	case ReferenceChain:
+		match = func(r *nfRule) []string { return chainReferences(r, name) }
+	case ReferenceSet:
+		match = func(r *nfRule) []string { return setReferences(r, name) }
+	default:
+		return nil, fmt.Errorf("unknown reference kind %d", kind)
+	}
+	nfc.Lock()
+	names := make([]string, 0, len(nfc.chains))
+	stores := make(map[string]*nfRules, len(nfc.chains))
+	for cn, c := range nfc.chains {
+		if nfr, ok := c.RulesInterface.(*nfRules); ok {
+			names = append(names, cn)
+			stores[cn] = nfr
+		}
+	}
+	nfc.Unlock()
+	sort.Strings(names)
+	refs := make([]*Reference, 0)
+	for _, cn := range names {
+		for _, r := range stores[cn].ordered() {
+			if d := match(r); len(d) != 0 {
+				refs = append(refs, &Reference{
+					Chain:       cn,
+					RuleID:      r.id,
+					Handle:      r.rule.Handle,
+					Description: strings.Join(d, ", "),
+				})
+			}
+		}
+	}
+
+	return refs, nil
+}
+
+// ordered returns rules of the store in their order in the chain
+func (nfr *nfRules) ordered() []*nfRule {
+	nfr.Lock()
+	defer nfr.Unlock()
+	rules := make([]*nfRule, 0)
+	for e := nfr.rules; e != nil; e = e.next {
+		rules = append(rules, e)
+	}
+
+	return rules
+}
+
+// chainReferences describes jump and goto verdicts of the rule and of elements of its verdict maps
+// referring to the chain.
+func chainReferences(r *nfRule, chain string) []string {
+	d := make([]string, 0)
+	for _, e := range r.rule.Exprs {
+		if v, ok := e.(*expr.Verdict); ok && isVerdictReferencing(v, chain) {
+			d = append(d, verdictName(int(v.Kind))+" "+chain)
+		}
+	}
+	for _, s := range r.sets {
+		for _, el := range s.elements {
+			if isVerdictReferencing(el.VerdictData, chain) {
+				d = append(d, fmt.Sprintf("%s %s by map %s", verdictName(int(el.VerdictData.Kind)), chain, s.set.Name))
+				break
+			}
+		}
+	}
+
+	return d
+}
+
+// setReferences describes lookups and updates of the set by the rule
+func setReferences(r *nfRule, set string) []string {
+	d := make([]string, 0)
+	for _, e := range r.rule.Exprs {
+		switch e := e.(type) {
+		case *expr.Lookup:
+			if e.SetName != set {
+				continue
+			}
+			switch {
+			case e.IsDestRegSet && e.DestRegister == 0:
+				d = append(d, "vmap @"+set)
+			case e.IsDestRegSet:
+				d = append(d, "map @"+set)
+			case e.Invert:
+				d = append(d, "lookup != @"+set)
+			default:
+				d = append(d, "lookup @"+set)
+			}
+		case *expr.Dynset:
+			if e.SetName == set {
+				d = append(d, "update @"+set)
+			}
+		}
+	}
+
+	return d
+}
@@ -0,0 +1,91 @@
+package nftableslib
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// nftables registers are addressed either as 16 bytes registers NFT_REG_1..NFT_REG_4 or as 4 bytes
+// registers NFT_REG32_00..NFT_REG32_15, both name the same 64 bytes of register space, NFT_REG_1
+// overlaps NFT_REG32_00..NFT_REG32_03 and so on.
+const (
+	regUnitLen     = 4
+	regUnitCount   = 16
+	regUnitsPerReg = 4
+)
+
+// regAllocator hands out registers to expressions whose values must stay live until a later
+// expression consumes them, like the key of a concatenation lookup or addresses and ports of nat.
+// The allocator guarantees:
+//   - registers of allocated values never overlap;
+//   - values allocated with alloc start at a 16 bytes register and are addressed as NFT_REG_1..NFT_REG_4,
+//     so expressions of a single value keep the encoding nft uses;
+//   - values allocated with allocConcat are contiguous, as the kernel expects the key of a concatenation,
+//     the first one is addressed as NFT_REG_1 when it starts the register space, the rest as NFT_REG32_xx;
+//   - running out of 64 bytes of register space is an error and not a silent overlap.
+//
+// Matches which load a value and compare it in the next expression use NFT_REG_1 as a scratch register,
+// masked matches use maskedRegister, neither keeps its value past its own expressions. An allocator
+// serves a single sequence of expressions, a generator creates one with newRegAllocator.
+type regAllocator struct {
+	next uint32
+}
+
+func newRegAllocator() *regAllocator {
+	return &regAllocator{}
+}
+
+// alloc returns the register for a value of length bytes aligned to a 16 bytes register
+func (r *regAllocator) alloc(length uint32) (uint32, error) {
+	if r.next%regUnitsPerReg != 0 {
+		r.next += regUnitsPerReg - r.next%regUnitsPerReg
+	}
+	units := (length + regUnitsPerReg*regUnitLen - 1) / (regUnitsPerReg * regUnitLen) * regUnitsPerReg
+	reg, err := r.take(length, units)
+	if err != nil {
+		return 0, err
+	}
+
+	return unix.NFT_REG_1 + reg/regUnitsPerReg, nil
+}
+
+// allocConcat returns registers for values of a concatenation, the values are placed back to back,
+// each one padded to 4 bytes.
+func (r *regAllocator) allocConcat(lengths ...uint32) ([]uint32, error) {
+	regs := make([]uint32, 0, len(lengths))
+	for _, length := range lengths {
+		reg, err := r.take(length, (length+regUnitLen-1)/regUnitLen)
+		if err != nil {
+			return nil, err
+		}
+		regs = append(regs, regNumber(reg))
+	}
+
+	return regs, nil
+}
+
+// take reserves units of register space starting at the next free unit
+func (r *regAllocator) take(length, units uint32) (uint32, error) {
+	if length == 0 {
+		return 0, fmt.Errorf("register cannot be allocated for a value of 0 bytes")
+	}
+	if r.next+units > regUnitCount {
+		return 0, fmt.Errorf("value of %d bytes does not fit into registers, %d of %d bytes are in use",
+			length, r.next*regUnitLen, regUnitCount*regUnitLen)
+	}
+	reg := r.next
+	r.next += units
+
+	return reg, nil
+}
+
+// regNumber returns the number nftables uses for the register starting at the unit, like nft
+// only the first register is addressed as NFT_REG_1.
+func regNumber(unit uint32) uint32 {
+	if unit == 0 {
+		return unix.NFT_REG_1
+	}
+
+	return unix.NFT_REG32_00 + unit
+}
@@ -0,0 +1,125 @@
+package nftableslib
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+func TestRegAllocator(t *testing.T) {
+	tests := []struct {
+		name    string
+		concat  bool
+		lengths []uint32
+		regs    []uint32
+		success bool
+	}{
+		{
+			name:    "Single values take 16 bytes registers",
+			lengths: []uint32{4, 16, 2},
+			regs:    []uint32{unix.NFT_REG_1, unix.NFT_REG_2, unix.NFT_REG_3},
+			success: true,
+		},
+		{
+			name:    "All 16 bytes registers",
+			lengths: []uint32{16, 16, 16, 16},
+			regs:    []uint32{unix.NFT_REG_1, unix.NFT_REG_2, unix.NFT_REG_3, unix.NFT_REG_4},
+			success: true,
+		},
+		{
+			name:    "Single values exceed registers",
+			lengths: []uint32{16, 16, 16, 16, 1},
+			success: false,
+		},
+		{
+			name:    "Zero length value",
+			lengths: []uint32{0},
+			success: false,
+		},
+		{
+			name:    "Concatenation of ipv4 address, protocol and port",
+			concat:  true,
+			lengths: []uint32{4, 1, 2},
+			regs:    []uint32{unix.NFT_REG_1, unix.NFT_REG32_01, unix.NFT_REG32_02},
+			success: true,
+		},
+		{
+			name:    "Concatenation of ipv6 addresses and port",
+			concat:  true,
+			lengths: []uint32{16, 16, 2},
+			regs:    []uint32{unix.NFT_REG_1, unix.NFT_REG32_04, unix.NFT_REG32_08},
+			success: true,
+		},
+		{
+			name:    "Concatenation of mac address and ipv6 address",
+			concat:  true,
+			lengths: []uint32{6, 16},
+			regs:    []uint32{unix.NFT_REG_1, unix.NFT_REG32_02},
+			success: true,
+		},
+		{
+			name:    "Concatenation exceeds registers",
+			concat:  true,
+			lengths: []uint32{16, 16, 16, 16, 2},
+			success: false,
+		},
+	}
+	for _, tt := range tests {
+		var regs []uint32
+		var err error
+		r := newRegAllocator()
+		if tt.concat {
+			regs, err = r.allocConcat(tt.lengths...)
+		} else {
+			for _, l := range tt.lengths {
+				var reg uint32
+				if reg, err = r.alloc(l); err != nil {
+					break
+				}
+				regs = append(regs, reg)
+			}
+		}
+		if err != nil && tt.success {
+			t.Errorf("test \"%s\" failed with error: %+v but supposed to succeed", tt.name, err)
+			continue
+		}
+		if err == nil && !tt.success {
+			t.Errorf("test \"%s\" succeeded but supposed to fail", tt.name)
+			continue
+		}
+		if tt.success && !reflect.DeepEqual(regs, tt.regs) {
+			t.Errorf("test \"%s\" failed, expected registers %v, got %v", tt.name, tt.regs, regs)
+		}
+	}
+}
+
+func TestConcatRegisters(t *testing.T) {
+	concat := &Concat{
+		VMap: true,
+		Elements: []*ConcatElement{
+			{EType: nftables.TypeIP6Addr, ESource: true},
+			{EType: nftables.TypeIP6Addr},
+			{EType: nftables.TypeInetService, EProto: unix.IPPROTO_TCP},
+		},
+		SetRef: &SetRef{Name: "dispatch"},
+	}
+	re, err := getExprForConcat(nftables.TableFamilyIPv6, concat)
+	if err != nil {
+		t.Fatalf("failed to generate expressions with error: %+v", err)
+	}
+	want := []expr.Any{
+		&expr.Payload{DestRegister: unix.NFT_REG_1, Base: expr.PayloadBaseNetworkHeader, Offset: 8, Len: 16},
+		&expr.Payload{DestRegister: unix.NFT_REG32_04, Base: expr.PayloadBaseNetworkHeader, Offset: 24, Len: 16},
+		&expr.Payload{DestRegister: unix.NFT_REG32_08, Base: expr.PayloadBaseTransportHeader, Offset: 2, Len: 2},
+		&expr.Lookup{SourceRegister: unix.NFT_REG_1, DestRegister: 0, IsDestRegSet: true, SetName: "dispatch"},
+	}
+	if !reflect.DeepEqual(re, want) {
+		t.Fatalf("expected expressions %+v, got %+v", want, re)
+	}
+	if _, err := getExprForConcat(nftables.TableFamilyIPv6, &Concat{}); err == nil {
+		t.Fatalf("concatenation without elements supposed to fail")
+	}
+}
@@ -0,0 +1,142 @@
+package nftableslib
+
+import (
+	"fmt"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// MaxLogPrefixLength is the maximum length of the prefix of logged packets
+	MaxLogPrefixLength = 127
+
+	// ICMP and ICMPv6 codes of destination unreachable messages sent by reject in ip and ip6 tables
+	icmpPortUnreach       = 3
+	icmpAdminProhibited   = 13
+	icmpv6PortUnreach     = 4
+	icmpv6AdminProhibited = 1
+)
+
+// RejectChainAttributes defines a regular chain created by CreateRejectChain, the chain logs packets
+// jumping to it, increments the named counter and rejects them. TCP segments are rejected with tcp reset
+// and other packets with port unreachable, packets of chains with Forward set are rejected with
+// admin prohibited regardless of their protocol.
+type RejectChainAttributes struct {
+	// Name is the name of the chain
+	Name string
+	// Prefix is the prefix of logged packets, ID identifying the policy violated by the packet is
+	// appended to the prefix in brackets.
+	Prefix string
+	ID     string
+	// Counter is the name of the counter object, it is created if it does not exist
+	Counter string
+	// Forward selects admin prohibited rejects of forwarded packets
+	Forward bool
+}
+
+// logPrefix returns the prefix of logged packets
+func (a *RejectChainAttributes) logPrefix() string {
+	if a.ID == "" {
+		return a.Prefix
+	}
+
+	return fmt.Sprintf("%s[%s] ", a.Prefix, a.ID)
+}
+
+// Validate checks parameters of RejectChainAttributes struct
+func (a *RejectChainAttributes) Validate() error {
+	if a.Name == "" {
+		return fmt.Errorf("name of reject chain cannot be empty")
+	}
+	if a.Counter == "" {
+		return fmt.Errorf("counter of reject chain %s cannot be empty", a.Name)
+	}
+	if p := a.logPrefix(); p == "" || len(p) > MaxLogPrefixLength {
+		return fmt.Errorf("log prefix %q of reject chain %s must be 1 to %d bytes long", p, a.Name, MaxLogPrefixLength)
+	}
+
+	return nil
+}
+
+// rules returns rules of the reject chain in a table of the family
+func (a *RejectChainAttributes) rules(family nftables.TableFamily) ([]*Rule, error) {
+	var rejectType, portUnreach, adminProhibited int
+	switch family {
+	case nftables.TableFamilyIPv4:
+		rejectType, portUnreach, adminProhibited = unix.NFT_REJECT_ICMP_UNREACH, icmpPortUnreach, icmpAdminProhibited
+	case nftables.TableFamilyIPv6:
+		rejectType, portUnreach, adminProhibited = unix.NFT_REJECT_ICMP_UNREACH, icmpv6PortUnreach, icmpv6AdminProhibited
+	case nftables.TableFamilyINet, nftables.TableFamilyBridge, nftables.TableFamilyNetdev:
+		// icmpx is translated by the kernel to ICMP or ICMPv6 code of the packet's family
+		rejectType = unix.NFT_REJECT_ICMPX_UNREACH
+		portUnreach, adminProhibited = unix.NFT_REJECT_ICMPX_PORT_UNREACH, unix.NFT_REJECT_ICMPX_ADMIN_PROHIBITED
+	default:
+		return nil, fmt.Errorf("reject is not supported in tables of family %s", familyName(family))
+	}
+	log, err := SetLog(unix.NFTA_LOG_PREFIX, []byte(a.logPrefix()))
+	if err != nil {
+		return nil, err
+	}
+	rules := []*Rule{
+		{
+			Log:      log,
+			RawExprs: []expr.Any{&expr.Objref{Type: int(ObjectCounter), Name: a.Counter}},
+		},
+	}
+	if a.Forward {
+		prohibited, _ := SetReject(rejectType, adminProhibited)
+		return append(rules, &Rule{Action: prohibited}), nil
+	}
+	tcp := uint8(unix.IPPROTO_TCP)
+	reset, _ := SetReject(unix.NFT_REJECT_TCP_RST, 0)
+	unreachable, _ := SetReject(rejectType, portUnreach)
+
+	return append(rules,
+		&Rule{Meta: &MetaRule{L4Proto: &tcp}, Action: reset},
+		&Rule{Action: unreachable},
+	), nil
+}
+
+// CreateRejectChain makes sure the table carries the regular chain logging, counting and rejecting packets
+// of policy violations and returns the action jumping to it, so policy rules only refer to the chain.
+// The table and the counter are created if they do not exist. Rules of an existing chain are replaced,
+// calling CreateRejectChain again does not change the ruleset.
+func CreateRejectChain(nft TablesInterface, table string, family nftables.TableFamily, attrs *RejectChainAttributes) (*RuleAction, error) {
+	if attrs == nil {
+		return nil, fmt.Errorf("attributes of reject chain are not specified")
+	}
+	if err := attrs.Validate(); err != nil {
+		return nil, err
+	}
+	rules, err := attrs.rules(family)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := ensureTableChains(nft, table, family); err != nil {
+		return nil, err
+	}
+	oi, err := nft.Tables().TableObjects(table, family)
+	if err != nil {
+		return nil, err
+	}
+	if !oi.Objects().Exist(ObjectCounter, attrs.Counter) {
+		if err := oi.Objects().CreateCounter(attrs.Counter); err != nil {
+			return nil, err
+		}
+	}
+	if err := nft.Tables().ApplyRuleset(&RulesetSpec{
+		Tables: []*TableSpec{
+			{
+				Name:   table,
+				Family: family,
+				Chains: []*ChainSpec{{Name: attrs.Name, Rules: rules}},
+			},
+		},
+	}); err != nil {
+		return nil, fmt.Errorf("failed to create reject chain %s with error: %+v", attrs.Name, err)
+	}
+
+	return SetVerdict(unix.NFT_JUMP, attrs.Name)
+}
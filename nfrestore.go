@@ -0,0 +1,359 @@
+package nftableslib
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+)
+
+// DefaultRestoreMessages defines the number of messages carried by a single transaction of Restore
+const DefaultRestoreMessages = 256
+
+// RestoreStage identifies the part of the ruleset programmed by a chunk of Restore, stages are
+// programmed in order, so tables, chains and sets exist before objects referring to them.
+type RestoreStage int
+
+const (
+	// RestoreTables chunks flush the ruleset and create tables and chains
+	RestoreTables RestoreStage = iota
+	// RestoreSets chunks create named sets
+	RestoreSets
+	// RestoreElements chunks add elements of named sets
+	RestoreElements
+	// RestoreRules chunks add rules along with anonymous sets they refer to
+	RestoreRules
+)
+
+func (s RestoreStage) String() string {
+	switch s {
+	case RestoreTables:
+		return "tables"
+	case RestoreSets:
+		return "sets"
+	case RestoreElements:
+		return "elements"
+	case RestoreRules:
+		return "rules"
+	}
+
+	return fmt.Sprintf("stage %d", int(s))
+}
+
+// RestoreProgress is reported by Restore after every chunk
+type RestoreProgress struct {
+	Stage RestoreStage
+	// Chunk is the index of the chunk, the checkpoint resuming after the chunk is Chunk+1
+	Chunk  int
+	Chunks int
+	// Skipped is true if the resumed restore found the chunk already programmed
+	Skipped bool
+}
+
+// RestoreOptions defines how Restore splits the snapshot in transactions
+type RestoreOptions struct {
+	// MaxMessages limits the number of messages of a transaction, 0 means DefaultRestoreMessages
+	MaxMessages int
+	// ChunkSize is the number of set elements carried by a message, 0 means DefaultElementsChunkSize
+	ChunkSize int
+	// Progress is called after every chunk, it must not call the library
+	Progress func(RestoreProgress)
+	// Checkpoint is the index of the chunk the restore starts from, the checkpoint of
+	// ErrRestoreIncomplete resumes the interrupted restore of the same snapshot and options.
+	Checkpoint int
+}
+
+// ErrRestoreIncomplete is returned when a chunk of Restore failed, chunks before Checkpoint were
+// programmed and chunks from Checkpoint on were not.
+type ErrRestoreIncomplete struct {
+	Stage      RestoreStage
+	Checkpoint int
+	Chunks     int
+	Err        error
+}
+
+func (e *ErrRestoreIncomplete) Error() string {
+	return fmt.Sprintf("failed to restore chunk %d of %d of %s with error: %+v", e.Checkpoint, e.Chunks, e.Stage, e.Err)
+}
+
+func (e *ErrRestoreIncomplete) Unwrap() error {
+	return e.Err
+}
+
+// restoreChunk is a transaction of Restore
+type restoreChunk struct {
+	stage    RestoreStage
+	messages int
+	bytes    int
+	ops      []func(NetNS) error
+	// rules carries ranges of rules the chunk appends to chains, they tell a resumed restore
+	// whether the chunk was programmed.
+	rules []*restoreRange
+}
+
+type restoreRange struct {
+	chain    *nftables.Chain
+	from, to int
+}
+
+// restoreKey identifies a chain or a set of the snapshot
+type restoreKey struct {
+	family      nftables.TableFamily
+	table, name string
+}
+
+func chainKeyOf(c *nftables.Chain) restoreKey {
+	return restoreKey{family: c.Table.Family, table: c.Table.Name, name: c.Name}
+}
+
+type restorePlan struct {
+	chunks      []*restoreChunk
+	maxMessages int
+}
+
+// add appends the operation to the last chunk of the stage, a new chunk is started when
+// the operation does not fit in the limits of a transaction.
+func (p *restorePlan) add(stage RestoreStage, messages, size int, op func(NetNS) error) *restoreChunk {
+	var c *restoreChunk
+	if len(p.chunks) != 0 {
+		c = p.chunks[len(p.chunks)-1]
+	}
+	if c == nil || c.stage != stage || c.messages+messages > p.maxMessages || c.bytes+size > maxBatchBytes {
+		c = &restoreChunk{stage: stage}
+		p.chunks = append(p.chunks, c)
+	}
+	c.messages += messages
+	c.bytes += size
+	c.ops = append(c.ops, op)
+
+	return c
+}
+
+// Restore replaces the ruleset programmed on the host with the ruleset captured in the snapshot,
+// unlike Rollback the ruleset is programmed by several bounded transactions, so rulesets with large
+// sets do not exceed limits of a single batch. If a transaction fails, ErrRestoreIncomplete carries
+// the checkpoint resuming the restore, chunks found programmed by the resumed restore are skipped.
+// Anonymous sets are restored along with the first rule referring to them, anonymous sets not
+// referred by rules are not restored. The store is re-synchronized with the host when Restore returns.
+func (nft *nfTables) Restore(s *Snapshot, opts *RestoreOptions) error {
+	if err := writable(nft.conn); err != nil {
+		return err
+	}
+	if s == nil {
+		return fmt.Errorf("snapshot cannot be nil")
+	}
+	if opts == nil {
+		opts = &RestoreOptions{}
+	}
+	plan := planRestore(s, opts, nft.ids)
+	if opts.Checkpoint < 0 || opts.Checkpoint > len(plan.chunks) {
+		return fmt.Errorf("checkpoint %d is out of range 0-%d", opts.Checkpoint, len(plan.chunks))
+	}
+	unlock := nft.families.lockAll()
+	err := restoreChunks(nft.conn, nft.reads, plan.chunks, opts)
+	// Store does not reflect host's ruleset any longer, rebuilding it from the host.
+	nft.Lock()
+	nft.tables = make(map[nftables.TableFamily]map[string]*nfTable)
+	nft.Unlock()
+	unlock()
+	if serr := nft.syncFamilies(s.tables); err == nil {
+		err = serr
+	}
+
+	return err
+}
+
+// planRestore splits the snapshot in chunks, the plan depends only on the snapshot and options,
+// so checkpoints of a restore refer to the same chunks when the restore is resumed.
+func planRestore(s *Snapshot, opts *RestoreOptions, ids IDGenerator) *restorePlan {
+	p := &restorePlan{maxMessages: opts.MaxMessages}
+	if p.maxMessages <= 0 {
+		p.maxMessages = DefaultRestoreMessages
+	}
+	p.add(RestoreTables, 1, 0, func(conn NetNS) error {
+		conn.FlushRuleset()
+		return nil
+	})
+	for _, t := range s.tables {
+		t := t
+		p.add(RestoreTables, 1, 0, func(conn NetNS) error {
+			conn.AddTable(t)
+			return nil
+		})
+	}
+	for _, c := range s.chains {
+		c := c
+		p.add(RestoreTables, 1, 0, func(conn NetNS) error {
+			conn.AddChain(c)
+			return nil
+		})
+	}
+	anonymous := make(map[restoreKey]*nfSet)
+	for _, set := range s.sets {
+		// Set IDs are not reported by the host, without ID anonymous sets get renamed
+		// and rules referring to them would not find them.
+		if set.set.ID == 0 {
+			set.set.ID = ids.SetID()
+		}
+		if set.set.Anonymous {
+			anonymous[restoreKey{family: set.set.Table.Family, table: set.set.Table.Name, name: set.set.Name}] = set
+			continue
+		}
+		set := set.set
+		p.add(RestoreSets, 1, 0, func(conn NetNS) error {
+			return conn.AddSet(set, nil)
+		})
+	}
+	for _, set := range s.sets {
+		if set.set.Anonymous {
+			continue
+		}
+		elements := set.elements
+		if set.set.Interval {
+			elements = sortedIntervalElements(elements)
+		}
+		for _, chunk := range chunkElements(elements, set.set.Interval, opts.ChunkSize) {
+			set, chunk := set.set, chunk
+			size := 0
+			for _, e := range chunk {
+				size += elementSize(e)
+			}
+			p.add(RestoreElements, 1, size, func(conn NetNS) error {
+				return conn.SetAddElements(set, chunk)
+			})
+		}
+	}
+	rules := make(map[restoreKey]int)
+	for _, r := range s.rules {
+		r := r
+		messages, size := 1, 0
+		deps := make([]*nfSet, 0)
+		for _, e := range r.Exprs {
+			l, ok := e.(*expr.Lookup)
+			if !ok {
+				continue
+			}
+			key := restoreKey{family: r.Table.Family, table: r.Table.Name, name: l.SetName}
+			if set, ok := anonymous[key]; ok {
+				deps = append(deps, set)
+				delete(anonymous, key)
+				messages += 2
+				for _, e := range set.elements {
+					size += elementSize(e)
+				}
+			}
+		}
+		c := p.add(RestoreRules, messages, size, func(conn NetNS) error {
+			for _, set := range deps {
+				if err := conn.AddSet(set.set, set.elements); err != nil {
+					return err
+				}
+			}
+			conn.AddRule(&nftables.Rule{
+				Table:    r.Table,
+				Chain:    r.Chain,
+				Exprs:    r.Exprs,
+				UserData: r.UserData,
+			})
+			return nil
+		})
+		key := chainKeyOf(r.Chain)
+		if n := len(c.rules); n != 0 && chainKeyOf(c.rules[n-1].chain) == key {
+			c.rules[n-1].to++
+		} else {
+			c.rules = append(c.rules, &restoreRange{chain: r.Chain, from: rules[key], to: rules[key] + 1})
+		}
+		rules[key]++
+	}
+
+	return p
+}
+
+// restoreChunks programs chunks from the checkpoint, a resumed restore checks whether chunks
+// appending rules were programmed by counting rules of their chains.
+func restoreChunks(conn NetNS, reads *readPolicy, chunks []*restoreChunk, opts *RestoreOptions) error {
+	counts := make(map[restoreKey]int)
+	for i := opts.Checkpoint; i < len(chunks); i++ {
+		c := chunks[i]
+		fail := func(err error) error {
+			return &ErrRestoreIncomplete{Stage: c.stage, Checkpoint: i, Chunks: len(chunks), Err: err}
+		}
+		skip := false
+		if opts.Checkpoint != 0 && len(c.rules) != 0 {
+			var err error
+			if skip, err = c.programmed(conn, reads, counts); err != nil {
+				return fail(err)
+			}
+		}
+		if !skip {
+			for _, op := range c.ops {
+				if err := op(conn); err != nil {
+					return fail(err)
+				}
+			}
+			if err := flush(conn); err != nil {
+				return fail(err)
+			}
+			for _, r := range c.rules {
+				counts[chainKeyOf(r.chain)] = r.to
+			}
+		}
+		if opts.Progress != nil {
+			opts.Progress(RestoreProgress{Stage: c.stage, Chunk: i, Chunks: len(chunks), Skipped: skip})
+		}
+	}
+
+	return nil
+}
+
+// programmed returns true if rules of the chunk are found on the host, chains the resumed restore
+// did not program yet are read from the host once.
+func (c *restoreChunk) programmed(conn NetNS, reads *readPolicy, counts map[restoreKey]int) (bool, error) {
+	applied, pending := 0, 0
+	for _, r := range c.rules {
+		key := chainKeyOf(r.chain)
+		n, ok := counts[key]
+		if !ok {
+			var rules []*nftables.Rule
+			if err := reads.do(func() (err error) {
+				rules, err = conn.GetRule(r.chain.Table, r.chain)
+				return err
+			}); err != nil {
+				return false, err
+			}
+			n = len(rules)
+			counts[key] = n
+		}
+		// Chunks append rules in order, rules of later chunks follow rules of the chunk
+		switch {
+		case n >= r.to:
+			applied++
+		case n == r.from:
+			pending++
+		default:
+			return false, fmt.Errorf("chain %s of table %s has %d rules, restore expected %d or %d",
+				r.chain.Name, r.chain.Table.Name, n, r.from, r.to)
+		}
+	}
+	if applied != 0 && pending != 0 {
+		return false, fmt.Errorf("rules of the chunk are programmed partially")
+	}
+
+	return applied != 0, nil
+}
+
+// sortedIntervalElements returns elements of the interval set in ascending order, the element
+// opening an interval precedes its end, so chunks do not separate them.
+func sortedIntervalElements(elements []nftables.SetElement) []nftables.SetElement {
+	sorted := append([]nftables.SetElement{}, elements...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if c := bytes.Compare(sorted[i].Key, sorted[j].Key); c != 0 {
+			return c < 0
+		}
+		return sorted[i].IntervalEnd && !sorted[j].IntervalEnd
+	})
+
+	return sorted
+}
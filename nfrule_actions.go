@@ -0,0 +1,175 @@
+package nftableslib
+
+import (
+	"fmt"
+
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+)
+
+type queue struct {
+	num    uint16
+	total  uint16
+	bypass bool
+	fanout bool
+}
+
+type markMap struct {
+	set   string
+	match MatchType
+}
+
+// SetCounterAction builds non-terminal RuleAction counting packets reaching it
+func SetCounterAction() *RuleAction {
+	return &RuleAction{counter: &Counter{}}
+}
+
+// SetLogAction builds non-terminal RuleAction logging packets reaching it, log is built by SetLog
+func SetLogAction(log *Log) (*RuleAction, error) {
+	if log == nil {
+		return nil, fmt.Errorf("log cannot be nil")
+	}
+	if _, err := SetLog(int(log.Key), log.Value); err != nil {
+		return nil, err
+	}
+	l := *log
+
+	return &RuleAction{log: &l}, nil
+}
+
+// SetMarkAction builds non-terminal RuleAction setting packet's mark, when mask is not 0
+// only bits of the mask are changed.
+func SetMarkAction(value, mask uint32) *RuleAction {
+	return &RuleAction{mark: &MetaMark{Set: true, Value: value, Mask: mask}}
+}
+
+// SetNFTraceAction builds non-terminal RuleAction enabling tracing of packets reaching it
+func SetNFTraceAction() *RuleAction {
+	return &RuleAction{nftrace: true}
+}
+
+// SetCtMarkAction builds non-terminal RuleAction setting the mark of packet's connection
+func SetCtMarkAction(value uint32) *RuleAction {
+	return &RuleAction{ctMark: &value}
+}
+
+// SetMarkFromMap builds non-terminal RuleAction setting packet's mark to the value the map carries for
+// the packet's key, like nft "meta mark set ip daddr map @prefix_marks". The key is the destination address
+// unless match specifies other key, data type of the map must be nftables.TypeMark, MakeMarkMapElements
+// builds its elements.
+func SetMarkFromMap(setName string, match ...MatchType) (*RuleAction, error) {
+	if setName == "" {
+		return nil, fmt.Errorf("mark map requires a name")
+	}
+	m := &markMap{set: setName, match: MatchTypeL3Dst}
+	if len(match) != 0 {
+		m.match = match[0]
+	}
+	switch m.match {
+	case MatchTypeL3Src, MatchTypeL3Dst, MatchTypeL4Src, MatchTypeL4Dst:
+	default:
+		return nil, fmt.Errorf("unsupported key %d of mark map %s", m.match, setName)
+	}
+
+	return &RuleAction{markMap: m}, nil
+}
+
+// SetQueue builds RuleAction passing packets to userspace queues num to num+total-1, bypass accepts packets
+// when no application listens on the queue, fanout distributes packets by the cpu instead of the flow.
+func SetQueue(num, total uint16, bypass, fanout bool) (*RuleAction, error) {
+	if total == 0 {
+		total = 1
+	}
+	if int(num)+int(total) > 1<<16 {
+		return nil, fmt.Errorf("queues %d-%d exceed maximum queue number %d", num, int(num)+int(total)-1, 1<<16-1)
+	}
+
+	return &RuleAction{queue: &queue{num: num, total: total, bypass: bypass, fanout: fanout}}, nil
+}
+
+// terminal returns true if the action ends evaluation of the rule, verdicts, nat, redirect, reject,
+// loadbalancing and queue are terminal, counter, log, mark set, mark set from map, nftrace and ct mark set are not.
+func (ra *RuleAction) terminal() bool {
+	return ra.verdict != nil || ra.redirect != nil || ra.masq != nil || ra.nat != nil || ra.reject != nil ||
+		ra.loadbalance != nil || ra.dnatMap != nil || ra.inline != nil || ra.queue != nil
+}
+
+// actions returns actions of the rule in the order they are applied, Action is a single element list
+func (r *Rule) actions() []*RuleAction {
+	if r.Action != nil {
+		return []*RuleAction{r.Action}
+	}
+	return r.Actions
+}
+
+// action returns the terminal action of the rule, nil is returned if the rule has none
+func (r *Rule) action() *RuleAction {
+	actions := r.actions()
+	if len(actions) != 0 && actions[len(actions)-1] != nil && actions[len(actions)-1].terminal() {
+		return actions[len(actions)-1]
+	}
+	return nil
+}
+
+// validateActions checks that Action and Actions are not combined and that a single terminal
+// action is the last one.
+func (r *Rule) validateActions() error {
+	if r.Action != nil && len(r.Actions) != 0 {
+		return fmt.Errorf("either Action or Actions can be specified, but not both")
+	}
+	for i, a := range r.Actions {
+		if a == nil {
+			return fmt.Errorf("action %d is nil", i)
+		}
+		if a.terminal() && i != len(r.Actions)-1 {
+			if r.Actions[len(r.Actions)-1].terminal() {
+				return fmt.Errorf("actions %d and %d are both terminal, a rule can carry only one terminal action", i, len(r.Actions)-1)
+			}
+			return fmt.Errorf("terminal action %d must be the last one, it is followed by %d actions", i, len(r.Actions)-1-i)
+		}
+	}
+
+	return nil
+}
+
+// getExprForNonTerminal returns expressions of non-terminal action, nil is returned for terminal actions
+func getExprForNonTerminal(ra *RuleAction) []expr.Any {
+	switch {
+	case ra.counter != nil:
+		return getExprForCounter()
+	case ra.log != nil:
+		return getExprForLog(ra.log)
+	case ra.mark != nil:
+		return getExprForMetaMark(ra.mark)
+	case ra.nftrace:
+		// [ immediate reg 1 0x00000001 ]
+		// [ meta set nftrace with reg 1 ]
+		return []expr.Any{
+			&expr.Immediate{Register: 1, Data: []byte{1}},
+			&expr.Meta{Key: expr.MetaKeyNFTRACE, Register: 1, SourceRegister: true},
+		}
+	case ra.ctMark != nil:
+		// [ immediate reg 1 0x0000dead ]
+		// [ ct set mark with reg 1 ]
+		return []expr.Any{
+			&expr.Immediate{Register: 1, Data: binaryutil.NativeEndian.PutUint32(*ra.ctMark)},
+			&expr.Ct{Key: expr.CtKeyMARK, Register: 1, SourceRegister: true},
+		}
+	case ra.ctExpectation != "":
+		return getExprForCtExpectation(ra.ctExpectation)
+	}
+
+	return nil
+}
+
+func getExprForQueue(q *queue) []expr.Any {
+	var flag expr.QueueFlag
+	if q.bypass {
+		flag |= expr.QueueFlagBypass
+	}
+	if q.fanout {
+		flag |= expr.QueueFlagFanout
+	}
+
+	return []expr.Any{&expr.Queue{Num: q.num, Total: q.total, Flag: flag}}
+}
@@ -0,0 +1,224 @@
+package nftableslib
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+)
+
+const (
+	// ARPOpRequest defines ARP operation request
+	ARPOpRequest uint16 = 1
+	// ARPOpReply defines ARP operation reply
+	ARPOpReply uint16 = 2
+)
+
+// Offsets of ARP header fields for IPv4 over ethernet, ARP header is loaded from the network header.
+const (
+	arpHTypeOffset  = 0
+	arpPTypeOffset  = 2
+	arpOpOffset     = 6
+	arpSHAddrOffset = 8
+	arpSAddrOffset  = 14
+	arpTHAddrOffset = 18
+	arpTAddrOffset  = 24
+	// Offsets of ethernet header fields in the link layer header
+	etherDAddrOffset = 0
+	etherSAddrOffset = 6
+)
+
+// ARPRule defines matches on ARP header fields, only IPv4 over ethernet ARP packets are supported.
+// ARPRule can only be used in tables of arp family. RelOp applies to HType, PType, Operation, SHAddr
+// and THAddr, sender and target IP addresses carry their own operator.
+type ARPRule struct {
+	HType     *uint16          `json:"hType,omitempty"`
+	PType     *uint16          `json:"pType,omitempty"`
+	Operation *uint16          `json:"operation,omitempty"`
+	SAddr     *IPAddrSpec      `json:"sAddr,omitempty"`
+	TAddr     *IPAddrSpec      `json:"tAddr,omitempty"`
+	SHAddr    net.HardwareAddr `json:"shAddr,omitempty"`
+	THAddr    net.HardwareAddr `json:"thAddr,omitempty"`
+	RelOp     Operator         `json:"relOp,omitempty"`
+	// Set defines ARP and ethernet header fields rewritten by the rule after all matches
+	Set *ARPSet `json:"set,omitempty"`
+}
+
+// ARPSet defines ARP and ethernet header fields to rewrite, it allows to turn a matched ARP request
+// into a reply without involving userspace.
+type ARPSet struct {
+	Operation  *uint16          `json:"operation,omitempty"`
+	SAddr      net.IP           `json:"sAddr,omitempty"`
+	TAddr      net.IP           `json:"tAddr,omitempty"`
+	SHAddr     net.HardwareAddr `json:"shAddr,omitempty"`
+	THAddr     net.HardwareAddr `json:"thAddr,omitempty"`
+	EtherSAddr net.HardwareAddr `json:"etherSAddr,omitempty"`
+	EtherDAddr net.HardwareAddr `json:"etherDAddr,omitempty"`
+}
+
+// Validate checks parameters of ARPRule
+func (arp *ARPRule) Validate() error {
+	if arp.HType == nil && arp.PType == nil && arp.Operation == nil && arp.SAddr == nil &&
+		arp.TAddr == nil && arp.SHAddr == nil && arp.THAddr == nil && arp.Set == nil {
+		return fmt.Errorf("arp rule does not have any match or set")
+	}
+	if err := validateRelOp(arp.RelOp, "arp", true); err != nil {
+		return err
+	}
+	for _, addr := range []*IPAddrSpec{arp.SAddr, arp.TAddr} {
+		if addr == nil {
+			continue
+		}
+		if err := addr.Validate(); err != nil {
+			return err
+		}
+		ips := append(append([]*IPAddr{}, addr.List...), addr.Range[0], addr.Range[1])
+		if addr.Masked != nil {
+			ips = append(ips, addr.Masked.Value)
+		}
+		for _, ip := range ips {
+			if ip != nil && ip.IP.To4() == nil {
+				return fmt.Errorf("arp address %s is not ipv4 address", ip.IP.String())
+			}
+		}
+	}
+	for _, mac := range []net.HardwareAddr{arp.SHAddr, arp.THAddr} {
+		if mac != nil && len(mac) != 6 {
+			return fmt.Errorf("arp hardware address %s is not ethernet address", mac.String())
+		}
+	}
+	if arp.Set != nil {
+		return arp.Set.Validate()
+	}
+
+	return nil
+}
+
+// Validate checks parameters of ARPSet
+func (s *ARPSet) Validate() error {
+	if s.Operation == nil && s.SAddr == nil && s.TAddr == nil && s.SHAddr == nil &&
+		s.THAddr == nil && s.EtherSAddr == nil && s.EtherDAddr == nil {
+		return fmt.Errorf("arp set does not have any field to set")
+	}
+	for _, ip := range []net.IP{s.SAddr, s.TAddr} {
+		if ip != nil && ip.To4() == nil {
+			return fmt.Errorf("arp address %s is not ipv4 address", ip.String())
+		}
+	}
+	for _, mac := range []net.HardwareAddr{s.SHAddr, s.THAddr, s.EtherSAddr, s.EtherDAddr} {
+		if mac != nil && len(mac) != 6 {
+			return fmt.Errorf("hardware address %s is not ethernet address", mac.String())
+		}
+	}
+
+	return nil
+}
+
+// createARP returns expressions matching ARP header fields and dynamically generated sets,
+// the expressions rewriting headers are returned separately as they follow all other matches of the rule.
+func createARP(family nftables.TableFamily, rule *Rule, ids IDGenerator) ([]expr.Any, []expr.Any, []*nfSet, error) {
+	if family != nftables.TableFamilyARP {
+		return nil, nil, nil, fmt.Errorf("arp rule can only be used in arp family table")
+	}
+	arp := rule.ARP
+	if err := arp.Validate(); err != nil {
+		return nil, nil, nil, err
+	}
+	re := []expr.Any{}
+	sets := make([]*nfSet, 0)
+	if arp.HType != nil {
+		re = append(re, getExprForPayloadMatch(expr.PayloadBaseNetworkHeader, arpHTypeOffset,
+			binaryutil.BigEndian.PutUint16(*arp.HType), arp.RelOp)...)
+	}
+	if arp.PType != nil {
+		re = append(re, getExprForPayloadMatch(expr.PayloadBaseNetworkHeader, arpPTypeOffset,
+			binaryutil.BigEndian.PutUint16(*arp.PType), arp.RelOp)...)
+	}
+	if arp.Operation != nil {
+		re = append(re, getExprForPayloadMatch(expr.PayloadBaseNetworkHeader, arpOpOffset,
+			binaryutil.BigEndian.PutUint16(*arp.Operation), arp.RelOp)...)
+	}
+	if arp.SHAddr != nil {
+		re = append(re, getExprForPayloadMatch(expr.PayloadBaseNetworkHeader, arpSHAddrOffset, arp.SHAddr, arp.RelOp)...)
+	}
+	if arp.THAddr != nil {
+		re = append(re, getExprForPayloadMatch(expr.PayloadBaseNetworkHeader, arpTHAddrOffset, arp.THAddr, arp.RelOp)...)
+	}
+	for _, a := range []struct {
+		spec   *IPAddrSpec
+		offset uint32
+	}{{arp.SAddr, arpSAddrOffset}, {arp.TAddr, arpTAddrOffset}} {
+		if a.spec == nil {
+			continue
+		}
+		e, set, err := processARPAddr(a.spec, a.offset, ids)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		sets = append(sets, set...)
+		re = append(re, e...)
+	}
+	se := []expr.Any{}
+	if arp.Set != nil {
+		se = getExprForARPSet(arp.Set)
+	}
+
+	return re, se, sets, nil
+}
+
+// processARPAddr reuses IPv4 address processing with ARP header offsets
+func processARPAddr(addrs *IPAddrSpec, offset uint32, ids IDGenerator) ([]expr.Any, []*nfSet, error) {
+	var e []expr.Any
+	var set *nfSet
+	var err error
+	switch {
+	case addrs.Masked != nil:
+		e, err = getExprForMaskedIP(nftables.TableFamilyIPv4, offset, addrs.Masked, addrs.RelOp)
+	case addrs.List != nil:
+		e, set, err = processAddrList(nftables.TableFamilyIPv4, offset, addrs.List, addrs.RelOp, ids)
+	case addrs.Range[0] != nil && addrs.Range[1] != nil:
+		e, set, err = processAddrRange(nftables.TableFamilyIPv4, offset, addrs.Range, addrs.RelOp)
+	case addrs.SetRef != nil:
+		e, err = getExprForAddrSet(nftables.TableFamilyIPv4, offset, addrs.SetRef, addrs.RelOp)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if set == nil {
+		return e, nil, nil
+	}
+	set.set.KeyType = nftables.TypeIPAddr
+
+	return e, []*nfSet{set}, nil
+}
+
+// getExprForARPSet returns expressions rewriting ARP and ethernet header fields
+func getExprForARPSet(s *ARPSet) []expr.Any {
+	re := []expr.Any{}
+	if s.Operation != nil {
+		re = append(re, getExprForPayloadSet(expr.PayloadBaseNetworkHeader, arpOpOffset,
+			binaryutil.BigEndian.PutUint16(*s.Operation))...)
+	}
+	if s.SHAddr != nil {
+		re = append(re, getExprForPayloadSet(expr.PayloadBaseNetworkHeader, arpSHAddrOffset, s.SHAddr)...)
+	}
+	if s.SAddr != nil {
+		re = append(re, getExprForPayloadSet(expr.PayloadBaseNetworkHeader, arpSAddrOffset, s.SAddr.To4())...)
+	}
+	if s.THAddr != nil {
+		re = append(re, getExprForPayloadSet(expr.PayloadBaseNetworkHeader, arpTHAddrOffset, s.THAddr)...)
+	}
+	if s.TAddr != nil {
+		re = append(re, getExprForPayloadSet(expr.PayloadBaseNetworkHeader, arpTAddrOffset, s.TAddr.To4())...)
+	}
+	if s.EtherSAddr != nil {
+		re = append(re, getExprForPayloadSet(expr.PayloadBaseLLHeader, etherSAddrOffset, s.EtherSAddr)...)
+	}
+	if s.EtherDAddr != nil {
+		re = append(re, getExprForPayloadSet(expr.PayloadBaseLLHeader, etherDAddrOffset, s.EtherDAddr)...)
+	}
+
+	return re
+}
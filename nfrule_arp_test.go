@@ -0,0 +1,154 @@
+package nftableslib
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+)
+
+func arpResponderRule(t *testing.T) *Rule {
+	htype, ptype := uint16(1), uint16(0x0800)
+	op, reply := ARPOpRequest, ARPOpReply
+	mac, _ := net.ParseMAC("02:00:5e:00:01:01")
+	return &Rule{
+		ARP: &ARPRule{
+			HType:     &htype,
+			PType:     &ptype,
+			Operation: &op,
+			TAddr:     &IPAddrSpec{List: []*IPAddr{setIPAddr(t, "192.0.2.10")}},
+			Set: &ARPSet{
+				Operation:  &reply,
+				SHAddr:     mac,
+				EtherSAddr: mac,
+			},
+		},
+		Action: setActionVerdict(t, NFT_ACCEPT),
+	}
+}
+
+func TestARPRule(t *testing.T) {
+	mac, _ := net.ParseMAC("02:00:5e:00:01:01")
+	tests := []struct {
+		name    string
+		rule    *Rule
+		success bool
+	}{
+		{
+			name:    "ARP request match with reply mangling",
+			rule:    arpResponderRule(t),
+			success: true,
+		},
+		{
+			name:    "Empty ARP rule",
+			rule:    &Rule{ARP: &ARPRule{}},
+			success: false,
+		},
+		{
+			name: "ARP rule with IPv6 target address",
+			rule: &Rule{ARP: &ARPRule{
+				TAddr: &IPAddrSpec{List: []*IPAddr{setIPAddr(t, "2001:db8::1")}},
+			}},
+			success: false,
+		},
+		{
+			name: "ARP rule with invalid hardware address",
+			rule: &Rule{ARP: &ARPRule{
+				SHAddr: mac[:4],
+			}},
+			success: false,
+		},
+		{
+			name: "ARP rule combined with L3 rule",
+			rule: &Rule{
+				ARP: &ARPRule{SHAddr: mac},
+				L3:  &L3Rule{Src: &IPAddrSpec{List: []*IPAddr{setIPAddr(t, "192.0.2.1")}}},
+			},
+			success: false,
+		},
+	}
+	for _, tt := range tests {
+		err := tt.rule.Validate()
+		if tt.success && err != nil {
+			t.Errorf("Test \"%s\" failed with error: \"%+v\" but supposed to succeed", tt.name, err)
+			continue
+		}
+		if !tt.success && err == nil {
+			t.Errorf("Test \"%s\" succeeded but supposed to fail", tt.name)
+		}
+	}
+}
+
+func TestARPRuleExpressions(t *testing.T) {
+	nfr := &nfRules{table: &nftables.Table{Name: "arpfilter", Family: nftables.TableFamilyIPv4}}
+	if _, err := nfr.buildRule(arpResponderRule(t)); err == nil {
+		t.Fatalf("arp rule supposed to fail in ipv4 family table")
+	}
+	nfr.table.Family = nftables.TableFamilyARP
+	rr, err := nfr.buildRule(arpResponderRule(t))
+	if err != nil {
+		t.Fatalf("failed to build arp rule with error: %+v", err)
+	}
+	r := rr.rule
+	lastLoad, firstWrite := -1, -1
+	writes := []*expr.Payload{}
+	for i, e := range r.Exprs {
+		p, ok := e.(*expr.Payload)
+		if !ok {
+			continue
+		}
+		if p.OperationType == expr.PayloadLoad {
+			lastLoad = i
+			continue
+		}
+		if firstWrite == -1 {
+			firstWrite = i
+		}
+		writes = append(writes, p)
+	}
+	if firstWrite < lastLoad {
+		t.Fatalf("header rewrites must follow all matches, last load at %d, first write at %d", lastLoad, firstWrite)
+	}
+	if len(writes) != 3 {
+		t.Fatalf("expected 3 payload writes, got %d", len(writes))
+	}
+	ether := writes[2]
+	if ether.Base != expr.PayloadBaseLLHeader || ether.Offset != etherSAddrOffset || ether.Len != 6 {
+		t.Fatalf("unexpected ether saddr write: %+v", *ether)
+	}
+	imm, ok := r.Exprs[len(r.Exprs)-3].(*expr.Immediate)
+	if !ok || !bytes.Equal(imm.Data, []byte{0x02, 0x00, 0x5e, 0x00, 0x01, 0x01}) {
+		t.Fatalf("unexpected ether saddr value")
+	}
+	if _, ok := r.Exprs[len(r.Exprs)-1].(*expr.Verdict); !ok {
+		t.Fatalf("expected verdict as the last expression, got %T", r.Exprs[len(r.Exprs)-1])
+	}
+}
+
+func TestARPRuleProgramming(t *testing.T) {
+	nft := InitNFTables(InitConn())
+	if err := nft.Tables().CreateImm("arpresponder", nftables.TableFamilyARP); err != nil {
+		t.Skipf("failed to create arp table with error: %+v", err)
+	}
+	defer nft.Tables().DeleteImm("arpresponder", nftables.TableFamilyARP)
+	ci, err := nft.Tables().Table("arpresponder", nftables.TableFamilyARP)
+	if err != nil {
+		t.Fatalf("failed to get chains interface with error: %+v", err)
+	}
+	if err := ci.Chains().CreateImm("input", &ChainAttributes{
+		Type:     nftables.ChainTypeFilter,
+		Hook:     nftables.ChainHookInput,
+		Priority: nftables.ChainPriorityFilter,
+	}); err != nil {
+		t.Fatalf("failed to create chain with error: %+v", err)
+	}
+	ri, err := ci.Chains().Chain("input")
+	if err != nil {
+		t.Fatalf("failed to get rules interface with error: %+v", err)
+	}
+	if _, err := ri.Rules().CreateImm(arpResponderRule(t)); err != nil {
+		t.Fatalf("failed to program arp rule with error: %+v", err)
+	}
+}
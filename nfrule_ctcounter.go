@@ -0,0 +1,90 @@
+package nftableslib
+
+import (
+	"fmt"
+
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+// CtBytes returns the match of bytes of the connection, like "ct bytes > 10485760", combined with
+// Meta.Mark Set or a mark set action it marks heavy flows. Counters are summed over both directions
+// of the connection.
+func CtBytes(op Operator, bytes uint64) (*Conntrack, error) {
+	return newCtCounter(unix.NFT_CT_BYTES, op, bytes)
+}
+
+// CtPackets returns the match of packets of the connection, like "ct packets >= 1000", see CtBytes
+func CtPackets(op Operator, packets uint64) (*Conntrack, error) {
+	return newCtCounter(unix.NFT_CT_PKTS, op, packets)
+}
+
+// CtAvgPkt returns the match of the average packet size of the connection in bytes,
+// like "ct avgpkt < 128", see CtBytes
+func CtAvgPkt(op Operator, size uint64) (*Conntrack, error) {
+	return newCtCounter(unix.NFT_CT_AVGPKT, op, size)
+}
+
+func newCtCounter(key uint32, op Operator, value uint64) (*Conntrack, error) {
+	ct := &Conntrack{Key: key, Value: binaryutil.BigEndian.PutUint64(value), RelOp: op}
+	if err := ct.Validate(); err != nil {
+		return nil, err
+	}
+
+	return ct, nil
+}
+
+// isCtCounter returns true if the key selects a 64 bit counter of the connection
+func isCtCounter(key uint32) bool {
+	return key == unix.NFT_CT_BYTES || key == unix.NFT_CT_PKTS || key == unix.NFT_CT_AVGPKT
+}
+
+func ctCounterName(key uint32) string {
+	switch key {
+	case unix.NFT_CT_BYTES:
+		return "bytes"
+	case unix.NFT_CT_PKTS:
+		return "packets"
+	case unix.NFT_CT_AVGPKT:
+		return "avgpkt"
+	}
+
+	return fmt.Sprintf("key %d", key)
+}
+
+// Validate checks Conntrack struct, only state, status and counters keys are supported, values of
+// state and status are 4 bytes bitmasks, values of counters are 8 bytes in network byte order.
+func (ct *Conntrack) Validate() error {
+	if !isCtCounter(ct.Key) {
+		if ct.Key != unix.NFT_CT_STATE && ct.Key != unix.NFT_CT_STATUS {
+			return fmt.Errorf("ct key %d is not supported", ct.Key)
+		}
+		if ct.RelOp != EQ {
+			return &ErrUnsupportedOperator{Match: fmt.Sprintf("ct key %d", ct.Key), Op: ct.RelOp}
+		}
+		if len(ct.Value) != 4 {
+			return fmt.Errorf("value of ct key %d match must be 4 bytes long, got %d bytes", ct.Key, len(ct.Value))
+		}
+		return nil
+	}
+	name := ctCounterName(ct.Key)
+	if len(ct.Value) != 8 {
+		return fmt.Errorf("value of ct %s match must be 8 bytes long, got %d bytes", name, len(ct.Value))
+	}
+
+	return validateRelOp(ct.RelOp, "ct "+name, true)
+}
+
+// getExprForCtCounter returns expressions of the counter match, the kernel loads counters in host
+// byte order, they are converted to network byte order, so GT, GTE, LT and LTE compare them as numbers.
+func getExprForCtCounter(ct *Conntrack) []expr.Any {
+	//	[ ct load bytes => reg 1 ]
+	//	[ byteorder reg 1 = hton(reg 1, 8, 8) ]
+	//	[ cmp gt reg 1 0x00000000 0x0000a000 ]
+	return []expr.Any{
+		&expr.Ct{Key: expr.CtKey(ct.Key), Register: 1},
+		&expr.Byteorder{SourceRegister: 1, DestRegister: 1, Op: expr.ByteorderHton, Len: 8, Size: 8},
+		&expr.Cmp{Op: ct.RelOp.cmpOp(), Register: 1, Data: cloneBytes(ct.Value)},
+	}
+}
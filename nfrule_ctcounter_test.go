@@ -0,0 +1,211 @@
+package nftableslib
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+func TestCtCounter(t *testing.T) {
+	tests := []struct {
+		name    string
+		ct      func() (*Conntrack, error)
+		success bool
+	}{
+		{
+			name:    "ct bytes > 10485760",
+			ct:      func() (*Conntrack, error) { return CtBytes(GT, 10485760) },
+			success: true,
+		},
+		{
+			name:    "ct packets >= 1000",
+			ct:      func() (*Conntrack, error) { return CtPackets(GTE, 1000) },
+			success: true,
+		},
+		{
+			name:    "ct avgpkt != 64",
+			ct:      func() (*Conntrack, error) { return CtAvgPkt(NEQ, 64) },
+			success: true,
+		},
+		{
+			name:    "Invalid operator",
+			ct:      func() (*Conntrack, error) { return CtBytes(Operator(7), 1) },
+			success: false,
+		},
+		{
+			name: "Value of 4 bytes",
+			ct: func() (*Conntrack, error) {
+				ct := &Conntrack{Key: unix.NFT_CT_BYTES, Value: []byte{0, 0, 0, 1}, RelOp: GT}
+				return ct, ct.Validate()
+			},
+			success: false,
+		},
+		{
+			name: "ct state with range operator",
+			ct: func() (*Conntrack, error) {
+				ct := &Conntrack{Key: unix.NFT_CT_STATE, Value: binaryutil.BigEndian.PutUint32(CTStateNew), RelOp: GT}
+				return ct, ct.Validate()
+			},
+			success: false,
+		},
+		{
+			name: "ct state new",
+			ct: func() (*Conntrack, error) {
+				ct := &Conntrack{Key: unix.NFT_CT_STATE, Value: binaryutil.BigEndian.PutUint32(CTStateNew)}
+				return ct, ct.Validate()
+			},
+			success: true,
+		},
+		{
+			name: "ct state with 1 byte value",
+			ct: func() (*Conntrack, error) {
+				ct := &Conntrack{Key: unix.NFT_CT_STATE, Value: []byte{0x8}}
+				return ct, ct.Validate()
+			},
+			success: false,
+		},
+	}
+	// Keys without expressions would turn the rule into a match of every packet
+	for _, key := range []uint32{unix.NFT_CT_DIRECTION, unix.NFT_CT_LABELS, unix.NFT_CT_EVENTMASK, unix.NFT_CT_SRC, unix.NFT_CT_MARK} {
+		key := key
+		tests = append(tests, struct {
+			name    string
+			ct      func() (*Conntrack, error)
+			success bool
+		}{
+			name: fmt.Sprintf("Unsupported ct key %d", key),
+			ct: func() (*Conntrack, error) {
+				ct := &Conntrack{Key: key, Value: []byte{0, 0, 0, 1}}
+				return ct, ct.Validate()
+			},
+		})
+	}
+	for _, tt := range tests {
+		_, err := tt.ct()
+		if tt.success && err != nil {
+			t.Errorf("Test \"%s\" failed with error: \"%+v\" but supposed to succeed", tt.name, err)
+			continue
+		}
+		if !tt.success && err == nil {
+			t.Errorf("Test \"%s\" succeeded but supposed to fail", tt.name)
+		}
+	}
+}
+
+func TestCtCounterExpressions(t *testing.T) {
+	load := func(key expr.CtKey) []expr.Any {
+		return []expr.Any{
+			&expr.Ct{Key: key, Register: 1},
+			&expr.Byteorder{SourceRegister: 1, DestRegister: 1, Op: expr.ByteorderHton, Len: 8, Size: 8},
+		}
+	}
+	tests := []struct {
+		name string
+		ct   func() (*Conntrack, error)
+		want []expr.Any
+	}{
+		{
+			// ct bytes > 10485760
+			name: "ct bytes greater than",
+			ct:   func() (*Conntrack, error) { return CtBytes(GT, 10485760) },
+			want: append(load(expr.CtKeyBYTES),
+				&expr.Cmp{Op: expr.CmpOpGt, Register: 1, Data: []byte{0x00, 0x00, 0x00, 0x00, 0x00, 0xa0, 0x00, 0x00}}),
+		},
+		{
+			// ct bytes < 10485760
+			name: "ct bytes less than",
+			ct:   func() (*Conntrack, error) { return CtBytes(LT, 10485760) },
+			want: append(load(expr.CtKeyBYTES),
+				&expr.Cmp{Op: expr.CmpOpLt, Register: 1, Data: []byte{0x00, 0x00, 0x00, 0x00, 0x00, 0xa0, 0x00, 0x00}}),
+		},
+		{
+			// ct bytes > 0x100000000 uses the upper half of the counter
+			name: "ct bytes greater than 4GiB",
+			ct:   func() (*Conntrack, error) { return CtBytes(GT, 1<<32) },
+			want: append(load(expr.CtKeyBYTES),
+				&expr.Cmp{Op: expr.CmpOpGt, Register: 1, Data: []byte{0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00}}),
+		},
+		{
+			// ct packets >= 1000
+			name: "ct packets",
+			ct:   func() (*Conntrack, error) { return CtPackets(GTE, 1000) },
+			want: append(load(expr.CtKeyPKTS),
+				&expr.Cmp{Op: expr.CmpOpGte, Register: 1, Data: []byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x03, 0xe8}}),
+		},
+		{
+			// ct avgpkt <= 128
+			name: "ct avgpkt",
+			ct:   func() (*Conntrack, error) { return CtAvgPkt(LTE, 128) },
+			want: append(load(expr.CtKeyAVGPKT),
+				&expr.Cmp{Op: expr.CmpOpLte, Register: 1, Data: []byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x80}}),
+		},
+	}
+	for _, tt := range tests {
+		ct, err := tt.ct()
+		if err != nil {
+			t.Errorf("Test \"%s\" failed with error: %+v but supposed to succeed", tt.name, err)
+			continue
+		}
+		got, err := getExprForConntracks([]*Conntrack{ct})
+		if err != nil {
+			t.Errorf("Test \"%s\" failed with error: %+v but supposed to succeed", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Test \"%s\" failed, expected expressions %+v, got %+v", tt.name, tt.want, got)
+		}
+	}
+}
+
+func TestCtCounterMarkSet(t *testing.T) {
+	// ct bytes > 10485760 meta mark set 0x2
+	ct, err := CtBytes(GT, 10485760)
+	if err != nil {
+		t.Fatalf("failed to build ct bytes match with error: %+v", err)
+	}
+	want := []expr.Any{
+		&expr.Ct{Key: expr.CtKeyBYTES, Register: 1},
+		&expr.Byteorder{SourceRegister: 1, DestRegister: 1, Op: expr.ByteorderHton, Len: 8, Size: 8},
+		&expr.Cmp{Op: expr.CmpOpGt, Register: 1, Data: []byte{0x00, 0x00, 0x00, 0x00, 0x00, 0xa0, 0x00, 0x00}},
+		&expr.Immediate{Register: 1, Data: binaryutil.NativeEndian.PutUint32(2)},
+		&expr.Meta{Key: expr.MetaKeyMARK, Register: 1, SourceRegister: true},
+	}
+	tests := []struct {
+		name string
+		rule *Rule
+	}{
+		{
+			name: "Meta mark set",
+			rule: &Rule{Conntracks: []*Conntrack{ct}, Meta: &MetaRule{Mark: &MetaMark{Set: true, Value: 2}}},
+		},
+		{
+			name: "Mark set action",
+			rule: &Rule{Conntracks: []*Conntrack{ct}, Actions: []*RuleAction{SetMarkAction(2, 0)}},
+		},
+	}
+	nfr := &nfRules{table: &nftables.Table{Name: "filter", Family: nftables.TableFamilyIPv4}}
+	for _, tt := range tests {
+		r, err := nfr.buildRule(tt.rule)
+		if err != nil {
+			t.Errorf("Test \"%s\" failed with error: %+v but supposed to succeed", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(r.rule.Exprs, want) {
+			t.Errorf("Test \"%s\" failed, expected expressions %+v, got %+v", tt.name, want, r.rule.Exprs)
+			continue
+		}
+		summary, ok := summarizeRule(nftables.TableFamilyIPv4, r.rule.Exprs, nil)
+		if !ok || summary != "ct bytes > 10485760 meta mark set 0x2" {
+			t.Errorf("Test \"%s\" failed, expected summary \"ct bytes > 10485760 meta mark set 0x2\", got \"%s\"", tt.name, summary)
+		}
+	}
+	nfr.table.Family = nftables.TableFamilyNetdev
+	if _, err := nfr.buildRule(&Rule{Conntracks: []*Conntrack{ct}}); err == nil {
+		t.Errorf("ct bytes match supposed to fail in table of netdev family")
+	}
+}
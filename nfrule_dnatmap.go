@@ -0,0 +1,238 @@
+package nftableslib
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+// DNATTarget defines the address, and optionally the port, packets sent to a port of the dnat map are
+// translated to.
+type DNATTarget struct {
+	Addr *IPAddr `json:"addr"`
+	Port uint16  `json:"port,omitempty"`
+}
+
+// DNATMapAttributes defines dnat by the destination port of the packet, like nft
+// "dnat ip to tcp dport map { 8080 : 10.0.0.1, 8443 : 10.0.0.2 }". The port is looked up in the named map
+// Name, the map's value is the address or, when WithPort is set, the concatenation of the address and the port.
+// The map is created with the rule unless the table already has it, its elements can be changed with
+// SetFuncs of the table without touching the rule, MakeDNATMapElements builds them.
+type DNATMapAttributes struct {
+	Name string `json:"name"`
+	// L4Proto is the protocol of the destination port, unix.IPPROTO_TCP, unix.IPPROTO_UDP or unix.IPPROTO_SCTP
+	L4Proto uint8 `json:"l4proto"`
+	// Family is the address family of targets, the table's family is used when it is not set,
+	// it must be set for inet tables.
+	Family      nftables.TableFamily   `json:"family,omitempty"`
+	WithPort    bool                   `json:"withPort,omitempty"`
+	Targets     map[uint16]*DNATTarget `json:"targets,omitempty"`
+	FullyRandom bool                   `json:"fullyRandom,omitempty"`
+	Random      bool                   `json:"random,omitempty"`
+	Persistent  bool                   `json:"persistent,omitempty"`
+}
+
+// SetDNATMap builds RuleAction struct for DNAT action looking up the target by the destination port
+func SetDNATMap(attrs *DNATMapAttributes) (*RuleAction, error) {
+	if attrs == nil || attrs.Name == "" {
+		return nil, fmt.Errorf("dnat map requires a name")
+	}
+	switch attrs.L4Proto {
+	case unix.IPPROTO_TCP, unix.IPPROTO_UDP, unix.IPPROTO_SCTP:
+	default:
+		return nil, fmt.Errorf("unsupported l4 protocol %d of dnat map %s", attrs.L4Proto, attrs.Name)
+	}
+	switch attrs.Family {
+	case 0, nftables.TableFamilyIPv4, nftables.TableFamilyIPv6:
+	default:
+		return nil, fmt.Errorf("unsupported address family %s of dnat map %s", familyName(attrs.Family), attrs.Name)
+	}
+	if err := validateDNATTargets(attrs.Targets, attrs.WithPort); err != nil {
+		return nil, err
+	}
+
+	return &RuleAction{dnatMap: attrs.clone()}, nil
+}
+
+// MakeDNATMapElements returns elements of the dnat map of the address family, elements are ordered by the port.
+func MakeDNATMapElements(family nftables.TableFamily, targets map[uint16]*DNATTarget, withPort bool) ([]nftables.SetElement, error) {
+	if err := validateDNATTargets(targets, withPort); err != nil {
+		return nil, err
+	}
+	ports := make([]int, 0, len(targets))
+	for p := range targets {
+		ports = append(ports, int(p))
+	}
+	sort.Ints(ports)
+	elements := make([]nftables.SetElement, 0, len(ports))
+	for _, p := range ports {
+		target := targets[uint16(p)]
+		var addr []byte
+		switch family {
+		case nftables.TableFamilyIPv4:
+			addr = target.Addr.IP.To4()
+		case nftables.TableFamilyIPv6:
+			if target.Addr.IP.To4() == nil {
+				addr = target.Addr.IP.To16()
+			}
+		default:
+			return nil, fmt.Errorf("unsupported address family %s of dnat map", familyName(family))
+		}
+		if addr == nil {
+			return nil, fmt.Errorf("address %s of port %d does not belong to address family %s", target.Addr.IP, p, familyName(family))
+		}
+		val := append([]byte{}, addr...)
+		if withPort {
+			val = append(val, padConcatValue(binaryutil.BigEndian.PutUint16(target.Port))...)
+		}
+		elements = append(elements, nftables.SetElement{
+			Key: binaryutil.BigEndian.PutUint16(uint16(p)),
+			Val: val,
+		})
+	}
+
+	return elements, nil
+}
+
+// validateDNATTargets checks targets carry an address and carry a port only when the map carries ports
+func validateDNATTargets(targets map[uint16]*DNATTarget, withPort bool) error {
+	for p, target := range targets {
+		switch {
+		case p == 0:
+			return fmt.Errorf("port 0 cannot be mapped")
+		case target == nil || target.Addr == nil || target.Addr.IPAddr == nil:
+			return fmt.Errorf("target of port %d does not carry an address", p)
+		case withPort && target.Port == 0:
+			return fmt.Errorf("target of port %d does not carry a port", p)
+		case !withPort && target.Port != 0:
+			return fmt.Errorf("target of port %d carries port %d but the map does not carry ports", p, target.Port)
+		}
+	}
+
+	return nil
+}
+
+// dnatMapDatatype returns the data type of the dnat map, the address or the address concatenated with the port
+func dnatMapDatatype(family nftables.TableFamily, withPort bool) nftables.SetDatatype {
+	addr := nftables.TypeIPAddr
+	if family == nftables.TableFamilyIPv6 {
+		addr = nftables.TypeIP6Addr
+	}
+	if !withPort {
+		return addr
+	}
+
+	return GenSetKeyType(addr, nftables.TypeInetService)
+}
+
+// getExprForDNATMap returns expressions looking up the destination port in the dnat map and feeding
+// the found address, and port, to nat. The map is returned when it has to be created with the rule.
+func getExprForDNATMap(nfr *nfRules, m *DNATMapAttributes) ([]expr.Any, *nfSet, error) {
+	family := m.Family
+	if family == 0 {
+		family = nfr.table.Family
+	}
+	if family != nftables.TableFamilyIPv4 && family != nftables.TableFamilyIPv6 {
+		return nil, nil, fmt.Errorf("address family of dnat map %s must be set for table family %s", m.Name, familyName(nfr.table.Family))
+	}
+	dt := dnatMapDatatype(family, m.WithPort)
+	var nfset *nfSet
+	var set *nftables.Set
+	if nfr.chains != nil && nfr.chains.sets != nil {
+		set, _ = nfr.chains.sets.get(m.Name)
+	}
+	if set != nil {
+		if !set.IsMap || set.KeyType.GetNFTMagic() != nftables.TypeInetService.GetNFTMagic() ||
+			set.DataType.GetNFTMagic() != dt.GetNFTMagic() {
+			return nil, nil, fmt.Errorf("set %s of the table is not a map of %s to %s", m.Name,
+				nftables.TypeInetService.Name, SetDatatypeString(dt))
+		}
+	} else {
+		elements, err := MakeDNATMapElements(family, m.Targets, m.WithPort)
+		if err != nil {
+			return nil, nil, err
+		}
+		set = &nftables.Set{
+			Name:     m.Name,
+			ID:       nfr.opts.idGenerator().SetID(),
+			IsMap:    true,
+			KeyType:  nftables.TypeInetService,
+			DataType: dt,
+		}
+		nfset = &nfSet{set: set, elements: elements}
+	}
+
+	addrLen := nftables.TypeIPAddr.Bytes
+	if family == nftables.TableFamilyIPv6 {
+		addrLen = nftables.TypeIP6Addr.Bytes
+	}
+	regs := newRegAllocator()
+	var regAddr, regProto uint32
+	if m.WithPort {
+		r, err := regs.allocConcat(addrLen, 2)
+		if err != nil {
+			return nil, nil, err
+		}
+		regAddr, regProto = r[0], r[1]
+	} else {
+		r, err := regs.alloc(addrLen)
+		if err != nil {
+			return nil, nil, err
+		}
+		regAddr = r
+	}
+
+	re := []expr.Any{}
+	if nfr.table.Family == nftables.TableFamilyINet {
+		// nat of inet tables translates only packets of the address family of the map
+		re = append(re, &expr.Meta{Key: expr.MetaKeyNFPROTO, Register: 1})
+		re = append(re, &expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{byte(family)}})
+	}
+	re = append(re, &expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1})
+	re = append(re, &expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{m.L4Proto}})
+	re = append(re, &expr.Payload{
+		DestRegister: 1,
+		Base:         expr.PayloadBaseTransportHeader,
+		Offset:       2, // Offset of the destination port
+		Len:          2,
+	})
+	re = append(re, &expr.Lookup{
+		SourceRegister: 1,
+		DestRegister:   regAddr,
+		IsDestRegSet:   true,
+		SetID:          set.ID,
+		SetName:        set.Name,
+	})
+	re = append(re, &expr.NAT{
+		Type:        expr.NATTypeDestNAT,
+		Family:      uint32(family),
+		RegAddrMin:  regAddr,
+		RegProtoMin: regProto,
+		Random:      m.Random,
+		FullyRandom: m.FullyRandom,
+		Persistent:  m.Persistent,
+	})
+
+	return re, nfset, nil
+}
+
+func (m *DNATMapAttributes) clone() *DNATMapAttributes {
+	if m == nil {
+		return nil
+	}
+	n := *m
+	if m.Targets != nil {
+		n.Targets = make(map[uint16]*DNATTarget, len(m.Targets))
+		for p, target := range m.Targets {
+			t := *target
+			t.Addr = target.Addr.clone()
+			n.Targets[p] = &t
+		}
+	}
+
+	return &n
+}
@@ -0,0 +1,191 @@
+package nftableslib
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+func TestDNATMapElements(t *testing.T) {
+	tests := []struct {
+		name     string
+		family   nftables.TableFamily
+		targets  map[uint16]*DNATTarget
+		withPort bool
+		elements []nftables.SetElement
+		success  bool
+	}{
+		{
+			name:   "IPv4 addresses ordered by port",
+			family: nftables.TableFamilyIPv4,
+			targets: map[uint16]*DNATTarget{
+				8443: {Addr: setIPAddr(t, "10.0.0.2")},
+				8080: {Addr: setIPAddr(t, "10.0.0.1")},
+			},
+			elements: []nftables.SetElement{
+				{Key: []byte{0x1f, 0x90}, Val: []byte{10, 0, 0, 1}},
+				{Key: []byte{0x20, 0xfb}, Val: []byte{10, 0, 0, 2}},
+			},
+			success: true,
+		},
+		{
+			name:     "IPv4 address concatenated with padded port",
+			family:   nftables.TableFamilyIPv4,
+			targets:  map[uint16]*DNATTarget{8080: {Addr: setIPAddr(t, "10.0.0.1"), Port: 80}},
+			withPort: true,
+			elements: []nftables.SetElement{
+				{Key: []byte{0x1f, 0x90}, Val: []byte{10, 0, 0, 1, 0, 80, 0, 0}},
+			},
+			success: true,
+		},
+		{
+			name:     "IPv6 address concatenated with padded port",
+			family:   nftables.TableFamilyIPv6,
+			targets:  map[uint16]*DNATTarget{443: {Addr: setIPAddr(t, "2001:db8::1"), Port: 8443}},
+			withPort: true,
+			elements: []nftables.SetElement{
+				{Key: []byte{0x01, 0xbb}, Val: []byte{0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0x20, 0xfb, 0, 0}},
+			},
+			success: true,
+		},
+		{
+			name:    "Address of other family",
+			family:  nftables.TableFamilyIPv6,
+			targets: map[uint16]*DNATTarget{443: {Addr: setIPAddr(t, "10.0.0.1")}},
+		},
+		{
+			name:     "Missing target port",
+			family:   nftables.TableFamilyIPv4,
+			targets:  map[uint16]*DNATTarget{443: {Addr: setIPAddr(t, "10.0.0.1")}},
+			withPort: true,
+		},
+		{
+			name:    "Target port without port in map",
+			family:  nftables.TableFamilyIPv4,
+			targets: map[uint16]*DNATTarget{443: {Addr: setIPAddr(t, "10.0.0.1"), Port: 8443}},
+		},
+		{
+			name:    "Port 0",
+			family:  nftables.TableFamilyIPv4,
+			targets: map[uint16]*DNATTarget{0: {Addr: setIPAddr(t, "10.0.0.1")}},
+		},
+	}
+	for _, tt := range tests {
+		elements, err := MakeDNATMapElements(tt.family, tt.targets, tt.withPort)
+		if err != nil && tt.success {
+			t.Errorf("Test \"%s\" failed with error: %+v but supposed to succeed", tt.name, err)
+			continue
+		}
+		if err == nil && !tt.success {
+			t.Errorf("Test \"%s\" succeeded but supposed to fail", tt.name)
+			continue
+		}
+		if !tt.success {
+			continue
+		}
+		if !reflect.DeepEqual(elements, tt.elements) {
+			t.Errorf("Test \"%s\" failed, expected elements %+v, got %+v", tt.name, tt.elements, elements)
+		}
+		if dt := dnatMapDatatype(tt.family, tt.withPort); int(dt.Bytes) != len(elements[0].Val) {
+			t.Errorf("Test \"%s\" failed, value of %d bytes does not match data type of %d bytes", tt.name, len(elements[0].Val), dt.Bytes)
+		}
+	}
+}
+
+func TestDNATMapExpressions(t *testing.T) {
+	tests := []struct {
+		name     string
+		table    nftables.TableFamily
+		attrs    *DNATMapAttributes
+		exprs    []expr.Any
+		dataType nftables.SetDatatype
+		success  bool
+	}{
+		{
+			name:  "IPv4 address",
+			table: nftables.TableFamilyIPv4,
+			attrs: &DNATMapAttributes{Name: "fwd", L4Proto: unix.IPPROTO_TCP},
+			exprs: []expr.Any{
+				&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+				&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{unix.IPPROTO_TCP}},
+				&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 2, Len: 2},
+				&expr.Lookup{SourceRegister: 1, DestRegister: unix.NFT_REG_1, IsDestRegSet: true, SetName: "fwd"},
+				&expr.NAT{Type: expr.NATTypeDestNAT, Family: unix.NFPROTO_IPV4, RegAddrMin: unix.NFT_REG_1},
+			},
+			dataType: nftables.TypeIPAddr,
+			success:  true,
+		},
+		{
+			name:  "IPv4 address and port",
+			table: nftables.TableFamilyIPv4,
+			attrs: &DNATMapAttributes{Name: "fwd", L4Proto: unix.IPPROTO_UDP, WithPort: true},
+			exprs: []expr.Any{
+				&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+				&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{unix.IPPROTO_UDP}},
+				&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 2, Len: 2},
+				&expr.Lookup{SourceRegister: 1, DestRegister: unix.NFT_REG_1, IsDestRegSet: true, SetName: "fwd"},
+				&expr.NAT{Type: expr.NATTypeDestNAT, Family: unix.NFPROTO_IPV4, RegAddrMin: unix.NFT_REG_1, RegProtoMin: unix.NFT_REG32_01},
+			},
+			dataType: GenSetKeyType(nftables.TypeIPAddr, nftables.TypeInetService),
+			success:  true,
+		},
+		{
+			name:  "IPv6 address and port in inet table",
+			table: nftables.TableFamilyINet,
+			attrs: &DNATMapAttributes{Name: "fwd", L4Proto: unix.IPPROTO_TCP, Family: nftables.TableFamilyIPv6, WithPort: true},
+			exprs: []expr.Any{
+				&expr.Meta{Key: expr.MetaKeyNFPROTO, Register: 1},
+				&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{unix.NFPROTO_IPV6}},
+				&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+				&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{unix.IPPROTO_TCP}},
+				&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 2, Len: 2},
+				&expr.Lookup{SourceRegister: 1, DestRegister: unix.NFT_REG_1, IsDestRegSet: true, SetName: "fwd"},
+				&expr.NAT{Type: expr.NATTypeDestNAT, Family: unix.NFPROTO_IPV6, RegAddrMin: unix.NFT_REG_1, RegProtoMin: unix.NFT_REG32_04},
+			},
+			dataType: GenSetKeyType(nftables.TypeIP6Addr, nftables.TypeInetService),
+			success:  true,
+		},
+		{
+			name:  "Inet table without address family",
+			table: nftables.TableFamilyINet,
+			attrs: &DNATMapAttributes{Name: "fwd", L4Proto: unix.IPPROTO_TCP},
+		},
+	}
+	for _, tt := range tests {
+		ra, err := SetDNATMap(tt.attrs)
+		if err != nil {
+			t.Fatalf("Test \"%s\" failed with error: %+v but supposed to succeed", tt.name, err)
+		}
+		nfr := &nfRules{table: &nftables.Table{Name: "nat", Family: tt.table}}
+		e, s, err := getExprForDNATMap(nfr, ra.dnatMap)
+		if err != nil && tt.success {
+			t.Errorf("Test \"%s\" failed with error: %+v but supposed to succeed", tt.name, err)
+			continue
+		}
+		if err == nil && !tt.success {
+			t.Errorf("Test \"%s\" succeeded but supposed to fail", tt.name)
+			continue
+		}
+		if !tt.success {
+			continue
+		}
+		// Set ID is allocated when the map is created
+		for _, e := range tt.exprs {
+			if l, ok := e.(*expr.Lookup); ok {
+				l.SetID = s.set.ID
+			}
+		}
+		if !reflect.DeepEqual(e, tt.exprs) {
+			t.Errorf("Test \"%s\" failed, expected expressions %+v, got %+v", tt.name, tt.exprs, e)
+		}
+		if !s.set.IsMap || s.set.KeyType != nftables.TypeInetService || !reflect.DeepEqual(s.set.DataType, tt.dataType) {
+			t.Errorf("Test \"%s\" failed, unexpected map %+v", tt.name, *s.set)
+		}
+	}
+	if _, err := SetDNATMap(&DNATMapAttributes{Name: "fwd", L4Proto: unix.IPPROTO_ICMP}); err == nil {
+		t.Fatalf("dnat map of icmp supposed to fail")
+	}
+}
@@ -35,31 +35,35 @@ func getExprForDynamic(l3proto nftables.TableFamily, dynamic *Dynamic) ([]expr.A
 		return nil, fmt.Errorf("unsupported table family %d", l3proto)
 	}
 
+	// The key and the data of the set element stay live until dynset consumes them
+	regs := newRegAllocator()
+	keyReg, _ := regs.alloc(l3AddrLen)
+	dataReg, _ := regs.alloc(4)
 	switch dynamic.Match {
 	case MatchTypeL3Src:
 		re = append(re, &expr.Payload{
-			DestRegister: 1,
+			DestRegister: keyReg,
 			Base:         expr.PayloadBaseNetworkHeader,
 			Offset:       l3OffsetSrc,       // Offset ip address in network header
 			Len:          uint32(l3AddrLen), // length bytes for ip address
 		})
 	case MatchTypeL3Dst:
 		re = append(re, &expr.Payload{
-			DestRegister: 1,
+			DestRegister: keyReg,
 			Base:         expr.PayloadBaseNetworkHeader,
 			Offset:       l3OffsetDst,       // Offset ip address in network header
 			Len:          uint32(l3AddrLen), // length bytes for ip address
 		})
 	case MatchTypeL4Src:
 		re = append(re, &expr.Payload{
-			DestRegister: 1,
+			DestRegister: keyReg,
 			Base:         expr.PayloadBaseTransportHeader,
 			Offset:       l4OffsetSrc, // Offset for a transport protocol header
 			Len:          2,           // 2 bytes for port
 		})
 	case MatchTypeL4Dst:
 		re = append(re, &expr.Payload{
-			DestRegister: 1,
+			DestRegister: keyReg,
 			Base:         expr.PayloadBaseTransportHeader,
 			Offset:       l4OffsetDst, // Offset for a transport protocol header
 			Len:          2,           // 2 bytes for port
@@ -72,13 +76,13 @@ func getExprForDynamic(l3proto nftables.TableFamily, dynamic *Dynamic) ([]expr.A
 	}
 	re = append(re, &expr.Immediate{
 		// Value of register must match to the value of SrcRegData
-		Register: 2,
+		Register: dataReg,
 		Data:     binaryutil.BigEndian.PutUint32(dynamic.Key),
 	})
 	de := &expr.Dynset{
-		SrcRegKey: 1,
+		SrcRegKey: keyReg,
 		// Value of SrcRegData must match to the value of expr.Immediate's Register
-		SrcRegData: 2,
+		SrcRegData: dataReg,
 		Operation:  dynamic.Op,
 		SetID:      dynamic.SetRef.ID,
 		SetName:    dynamic.SetRef.Name,
@@ -0,0 +1,127 @@
+package nftableslib
+
+import (
+	"fmt"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+// ICMP message types
+const (
+	ICMPEchoReply        = 0
+	ICMPDestUnreachable  = 3
+	ICMPEchoRequest      = 8
+	ICMPTimeExceeded     = 11
+	ICMPParameterProblem = 12
+)
+
+// ICMPv6 message types
+const (
+	ICMPv6DestUnreachable     = 1
+	ICMPv6PacketTooBig        = 2
+	ICMPv6TimeExceeded        = 3
+	ICMPv6ParameterProblem    = 4
+	ICMPv6EchoRequest         = 128
+	ICMPv6EchoReply           = 129
+	ICMPv6MLDListenerQuery    = 130
+	ICMPv6MLDListenerReport   = 131
+	ICMPv6MLDListenerDone     = 132
+	ICMPv6NDRouterSolicit     = 133
+	ICMPv6NDRouterAdvert      = 134
+	ICMPv6NDNeighborSolicit   = 135
+	ICMPv6NDNeighborAdvert    = 136
+	ICMPv6MLDv2ListenerReport = 143
+)
+
+// TypeICMPType and TypeICMPv6Type define datatypes of sets of ICMP and ICMPv6 message types,
+// nftables does not define them.
+var (
+	TypeICMPType   = icmpDatatype("icmp_type", 14)
+	TypeICMPv6Type = icmpDatatype("icmpv6_type", 29)
+)
+
+func icmpDatatype(name string, magic uint32) nftables.SetDatatype {
+	t := nftables.SetDatatype{Name: name, Bytes: 1}
+	t.SetNFTMagic(magic)
+
+	return t
+}
+
+// ICMP defines a match on ICMP or ICMPv6 messages, L4Proto of L4Rule selects the protocol,
+// unix.IPPROTO_ICMP or unix.IPPROTO_ICMPV6. Types matches the type of the message, RelOp applies
+// to Types, a list of types is compiled into a set. Code, when specified, matches the code of
+// the message.
+type ICMP struct {
+	Types []uint8  `json:"types,omitempty"`
+	Code  *uint8   `json:"code,omitempty"`
+	RelOp Operator `json:"relOp,omitempty"`
+}
+
+// Validate checks parameters of ICMP struct
+func (i *ICMP) Validate() error {
+	if len(i.Types) == 0 && i.Code == nil {
+		return fmt.Errorf("icmp match requires types or code")
+	}
+
+	return validateRelOp(i.RelOp, "icmp type", len(i.Types) == 1)
+}
+
+func isICMP(proto uint8) bool {
+	return proto == unix.IPPROTO_ICMP || proto == unix.IPPROTO_ICMPV6
+}
+
+// processICMP returns expressions matching ICMP messages and the set of types when the match
+// carries more than one type.
+func processICMP(proto uint8, icmp *ICMP, ids IDGenerator) ([]expr.Any, *nfSet, error) {
+	if !isICMP(proto) {
+		return nil, nil, fmt.Errorf("icmp match requires l4 protocol icmp or icmpv6, got %d", proto)
+	}
+	if err := icmp.Validate(); err != nil {
+		return nil, nil, err
+	}
+	// [ meta load l4proto => reg 1 ]
+	// [ cmp eq reg 1 0x00000001 ]
+	re := []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{proto}},
+	}
+	var set *nfSet
+	switch len(icmp.Types) {
+	case 0:
+	case 1:
+		// [ payload load 1b @ transport header + 0 => reg 1 ]
+		// [ cmp eq reg 1 0x00000008 ]
+		re = append(re, getExprForPayloadMatch(expr.PayloadBaseTransportHeader, 0, []byte{icmp.Types[0]}, icmp.RelOp)...)
+	default:
+		keyType := TypeICMPType
+		if proto == unix.IPPROTO_ICMPV6 {
+			keyType = TypeICMPv6Type
+		}
+		set = &nfSet{
+			set: &nftables.Set{
+				Constant: true,
+				Name:     ids.Name(),
+				ID:       ids.SetID(),
+				KeyType:  keyType,
+			},
+		}
+		for _, t := range icmp.Types {
+			set.elements = append(set.elements, nftables.SetElement{Key: []byte{t}})
+		}
+		// [ payload load 1b @ transport header + 0 => reg 1 ]
+		// [ lookup reg 1 set __set%d ]
+		re = append(re,
+			&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 0, Len: 1},
+			&expr.Lookup{SourceRegister: 1, Invert: icmp.RelOp == NEQ, SetID: set.set.ID, SetName: set.set.Name},
+		)
+	}
+	if icmp.Code != nil {
+		// [ payload load 1b @ transport header + 1 => reg 1 ]
+		// [ cmp eq reg 1 0x00000000 ]
+		re = append(re, getExprForPayloadMatch(expr.PayloadBaseTransportHeader, 1, []byte{*icmp.Code}, EQ)...)
+	}
+
+	return re, set, nil
+}
@@ -0,0 +1,199 @@
+package nftableslib
+
+import (
+	"fmt"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+// Encapsulation defines the tunnel protocol carrying the inner packet
+type Encapsulation uint8
+
+const (
+	// EncapVXLAN is VXLAN, 8 bytes header over UDP port 4789
+	EncapVXLAN Encapsulation = iota
+	// EncapGeneve is Geneve, 8 bytes header and options over UDP port 6081, the inner packet must be
+	// an ethernet frame
+	EncapGeneve
+)
+
+const (
+	vxlanPort      = 4789
+	genevePort     = 6081
+	udpHeaderLen   = 8
+	tunnelHeadLen  = 8
+	etherHeaderLen = 14
+	ipv4HeaderLen  = 20
+	ipv6HeaderLen  = 40
+	// maxGeneveOptionsLen is the largest length of options the 6 bits Opt Len field of the header carries
+	maxGeneveOptionsLen = 252
+)
+
+// InnerHeader selects headers of the packet encapsulated in a tunnel instead of headers of the underlay packet,
+// it is supported only in netdev tables. The kernel's inner expression cannot be encoded by github.com/google/nftables,
+// so headers are loaded at fixed offsets from the outer UDP header: the inner ipv4 header is expected without options,
+// the inner ipv6 header without extension headers and geneve options of exactly GeneveOptionsLen bytes.
+type InnerHeader struct {
+	Encap Encapsulation `json:"encap,omitempty"`
+	// Family of the inner packet, ipv4 or ipv6
+	Family nftables.TableFamily `json:"family,omitempty"`
+	// GeneveOptionsLen is the fixed length of geneve options in bytes, it must be a multiple of 4
+	GeneveOptionsLen uint8 `json:"geneveOptionsLen,omitempty"`
+	// Port overrides the UDP destination port of the encapsulation, 0 selects the default port
+	Port uint16 `json:"port,omitempty"`
+}
+
+// Validate checks parameters of InnerHeader struct
+func (h *InnerHeader) Validate() error {
+	switch h.Encap {
+	case EncapVXLAN:
+		if h.GeneveOptionsLen != 0 {
+			return fmt.Errorf("geneve options length cannot be specified for vxlan encapsulation")
+		}
+	case EncapGeneve:
+		if h.GeneveOptionsLen%4 != 0 || h.GeneveOptionsLen > maxGeneveOptionsLen {
+			return fmt.Errorf("geneve options length must be a multiple of 4 up to %d, got %d", maxGeneveOptionsLen, h.GeneveOptionsLen)
+		}
+	default:
+		return fmt.Errorf("unknown encapsulation %d", h.Encap)
+	}
+	if h.Family != nftables.TableFamilyIPv4 && h.Family != nftables.TableFamilyIPv6 {
+		return fmt.Errorf("inner packet family must be ipv4 or ipv6, got family %#02x", h.Family)
+	}
+
+	return nil
+}
+
+// port returns the UDP destination port of the encapsulation
+func (h *InnerHeader) port() uint16 {
+	switch {
+	case h.Port != 0:
+		return h.Port
+	case h.Encap == EncapGeneve:
+		return genevePort
+	}
+	return vxlanPort
+}
+
+// etherOffset returns the offset of the inner ethernet header from the outer transport header
+func (h *InnerHeader) etherOffset() uint32 {
+	return udpHeaderLen + tunnelHeadLen + uint32(h.GeneveOptionsLen)
+}
+
+// l3Offset returns the offset of the inner network header from the outer transport header
+func (h *InnerHeader) l3Offset() uint32 {
+	return h.etherOffset() + etherHeaderLen
+}
+
+// l4Offset returns the offset of the inner transport header from the outer transport header
+func (h *InnerHeader) l4Offset() uint32 {
+	if h.Family == nftables.TableFamilyIPv6 {
+		return h.l3Offset() + ipv6HeaderLen
+	}
+	return h.l3Offset() + ipv4HeaderLen
+}
+
+// protocolOffset returns the offset of the inner l4 protocol field from the outer transport header
+func (h *InnerHeader) protocolOffset() uint32 {
+	if h.Family == nftables.TableFamilyIPv6 {
+		// Next header field of ipv6 header
+		return h.l3Offset() + 6
+	}
+	return h.l3Offset() + 9
+}
+
+// innerHeader returns the inner header selected by L3 and L4 sections of the rule, nil is returned
+// if the rule matches the underlay packet only. Both sections must select the same inner header.
+func (r *Rule) innerHeader(family nftables.TableFamily) (*InnerHeader, error) {
+	var h *InnerHeader
+	if r.L3 != nil && r.L3.Inner != nil {
+		h = r.L3.Inner
+	}
+	if r.L4 != nil && r.L4.Inner != nil {
+		if h != nil && *h != *r.L4.Inner {
+			return nil, fmt.Errorf("l3 and l4 rules must select the same inner header")
+		}
+		h = r.L4.Inner
+	}
+	if h == nil {
+		return nil, nil
+	}
+	if family != nftables.TableFamilyNetdev {
+		return nil, fmt.Errorf("inner header match is supported only in netdev family table, got family %#02x", family)
+	}
+	if err := h.Validate(); err != nil {
+		return nil, err
+	}
+
+	return h, nil
+}
+
+// getExprForInnerGuard returns expressions matching packets of the encapsulation carrying an inner
+// packet of the family, ipv4 inner packets carrying options are not matched when l4 is true as
+// the inner transport header is loaded at a fixed offset.
+func getExprForInnerGuard(h *InnerHeader, l4 bool) []expr.Any {
+	// [ meta load l4proto => reg 1 ]
+	// [ cmp eq reg 1 0x00000011 ]
+	re := []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{unix.IPPROTO_UDP}},
+	}
+	// [ payload load 2b @ transport header + 2 => reg 1 ]
+	re = append(re, getExprForPayloadMatch(expr.PayloadBaseTransportHeader, 2, binaryutil.BigEndian.PutUint16(h.port()), EQ)...)
+	etherType := uint16(unix.ETH_P_IP)
+	if h.Family == nftables.TableFamilyIPv6 {
+		etherType = unix.ETH_P_IPV6
+	}
+	// 12 bytes is offset of ether type in the inner ethernet header
+	re = append(re, getExprForPayloadMatch(expr.PayloadBaseTransportHeader, h.etherOffset()+12,
+		binaryutil.BigEndian.PutUint16(etherType), EQ)...)
+	if l4 && h.Family == nftables.TableFamilyIPv4 {
+		// Version 4 and ihl 5, ipv4 header without options
+		re = append(re, getExprForPayloadMatch(expr.PayloadBaseTransportHeader, h.l3Offset(), []byte{0x45}, EQ)...)
+	}
+
+	return re
+}
+
+// shiftInner rewrites expressions of L3 or L4 section to load fields of the inner packet, network and
+// transport header loads are moved relative to the outer transport header and l4 protocol is loaded
+// from the inner network header instead of meta l4proto.
+func shiftInner(h *InnerHeader, exprs []expr.Any) ([]expr.Any, error) {
+	if h == nil {
+		return exprs, nil
+	}
+	re := make([]expr.Any, 0, len(exprs))
+	for _, e := range exprs {
+		switch e := e.(type) {
+		case *expr.Payload:
+			p := *e
+			switch p.Base {
+			case expr.PayloadBaseNetworkHeader:
+				p.Offset += h.l3Offset()
+			case expr.PayloadBaseTransportHeader:
+				p.Offset += h.l4Offset()
+			default:
+				return nil, fmt.Errorf("payload base %d cannot be moved to the inner packet", p.Base)
+			}
+			p.Base = expr.PayloadBaseTransportHeader
+			re = append(re, &p)
+		case *expr.Meta:
+			if e.Key != expr.MetaKeyL4PROTO {
+				return nil, fmt.Errorf("meta key %d cannot be moved to the inner packet", e.Key)
+			}
+			re = append(re, &expr.Payload{
+				DestRegister: e.Register,
+				Base:         expr.PayloadBaseTransportHeader,
+				Offset:       h.protocolOffset(),
+				Len:          1,
+			})
+		default:
+			re = append(re, e)
+		}
+	}
+
+	return re, nil
+}
@@ -0,0 +1,176 @@
+package nftableslib
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+// Offsets of ethernet header and VLAN tag fields in the link layer header. A VLAN tag follows
+// source address and shifts the ether type of the frame by the length of the tag, the kernel
+// reinserts tags stripped by the device when the link layer header is loaded.
+const (
+	etherTypeOffset = 12
+	// VLAN tag takes the place of the ether type, it carries TPID, the ether type announcing
+	// the tag, and TCI, the encapsulated ether type follows the tag.
+	vlanTagLen    = 4
+	vlanTCIOffset = 2
+	// MaxVLANID defines the highest VLAN id
+	MaxVLANID = 0x0fff
+	// MaxVLANPCP defines the highest VLAN priority code point
+	MaxVLANPCP = 7
+)
+
+// L2Rule defines matches on the ethernet header and 802.1Q VLAN tags, it can only be used in tables
+// of bridge and netdev families. Matches on fields of a VLAN tag are guarded by the ether type of the tag,
+// so untagged frames do not match them. A single level of QinQ is supported, ServiceVLAN matches the outer
+// 802.1ad tag and VLAN matches the inner 802.1Q tag. RelOp applies to all matches but guards.
+// Chains attached to the egress hook see the link layer header the frame is sent with, Dst is the
+// address of the next hop, including frames sent by AF_PACKET sockets bypassing the output hook.
+type L2Rule struct {
+	Src net.HardwareAddr `json:"src,omitempty"`
+	Dst net.HardwareAddr `json:"dst,omitempty"`
+	// EtherType matches the ether type of untagged frames or, when a VLAN tag is matched, the ether type
+	// encapsulated by the innermost matched tag.
+	EtherType   *uint16  `json:"etherType,omitempty"`
+	VLAN        *VLANTag `json:"vlan,omitempty"`
+	ServiceVLAN *VLANTag `json:"serviceVlan,omitempty"`
+	RelOp       Operator `json:"relOp,omitempty"`
+}
+
+// VLANTag defines matches on fields of VLAN tag, an empty VLANTag matches any tag
+type VLANTag struct {
+	ID  *uint16 `json:"id,omitempty"`
+	PCP *uint8  `json:"pcp,omitempty"`
+}
+
+// Validate checks parameters of L2Rule
+func (l2 *L2Rule) Validate() error {
+	if l2.Src == nil && l2.Dst == nil && l2.EtherType == nil && l2.VLAN == nil && l2.ServiceVLAN == nil {
+		return fmt.Errorf("l2 rule does not have any match")
+	}
+	if err := validateRelOp(l2.RelOp, "l2", false); err != nil {
+		return err
+	}
+	for _, mac := range []net.HardwareAddr{l2.Src, l2.Dst} {
+		if mac != nil && len(mac) != 6 {
+			return fmt.Errorf("l2 address %s is not ethernet address", mac.String())
+		}
+	}
+	for _, tag := range []*VLANTag{l2.ServiceVLAN, l2.VLAN} {
+		if tag == nil {
+			continue
+		}
+		if tag.ID != nil && *tag.ID > MaxVLANID {
+			return fmt.Errorf("vlan id %d is out of range 0-%d", *tag.ID, MaxVLANID)
+		}
+		if tag.PCP != nil && *tag.PCP > MaxVLANPCP {
+			return fmt.Errorf("vlan pcp %d is out of range 0-%d", *tag.PCP, MaxVLANPCP)
+		}
+	}
+
+	return nil
+}
+
+// validateL2 checks L2 section of the rule, the network header of QinQ frames starts with the inner tag,
+// so L3 and L4 headers are not at the offsets their matches use.
+func (r Rule) validateL2() error {
+	if r.L2.ServiceVLAN != nil && (r.L3 != nil || r.L4 != nil) {
+		return fmt.Errorf("l2 rule matching qinq frames cannot be combined with L3 or L4 rule")
+	}
+
+	return r.L2.Validate()
+}
+
+// l3Family returns the family of the network header L3 rule matches in bridge and netdev tables,
+// these tables do not imply the family, the ether type matched by L2 rule selects it.
+func l3Family(family nftables.TableFamily, rule *Rule) (nftables.TableFamily, error) {
+	if family != nftables.TableFamilyBridge && family != nftables.TableFamilyNetdev {
+		return family, nil
+	}
+	if rule.L2 != nil && rule.L2.EtherType != nil && rule.L2.RelOp == EQ {
+		switch *rule.L2.EtherType {
+		case unix.ETH_P_IP:
+			return nftables.TableFamilyIPv4, nil
+		case unix.ETH_P_IPV6:
+			return nftables.TableFamilyIPv6, nil
+		}
+	}
+
+	return 0, fmt.Errorf("l3 rule in family %#02x table requires l2 rule matching ipv4 or ipv6 ether type", family)
+}
+
+// createL2 returns expressions matching the ethernet header and VLAN tags, addresses precede tags and
+// are matched first, tags are matched from the outermost one, every tag is guarded by the ether type
+// which announces it.
+func createL2(family nftables.TableFamily, rule *Rule) ([]expr.Any, error) {
+	if family != nftables.TableFamilyBridge && family != nftables.TableFamilyNetdev {
+		return nil, fmt.Errorf("l2 rule can only be used in bridge or netdev family table, got family %#02x", family)
+	}
+	if err := rule.validateL2(); err != nil {
+		return nil, err
+	}
+	l2 := rule.L2
+	re := []expr.Any{}
+	for _, a := range []struct {
+		mac    net.HardwareAddr
+		offset uint32
+	}{{l2.Dst, etherDAddrOffset}, {l2.Src, etherSAddrOffset}} {
+		if a.mac != nil {
+			re = append(re, getExprForPayloadMatch(expr.PayloadBaseLLHeader, a.offset, a.mac, l2.RelOp)...)
+		}
+	}
+	offset := uint32(etherTypeOffset)
+	for _, t := range []struct {
+		tag       *VLANTag
+		etherType uint16
+	}{{l2.ServiceVLAN, unix.ETH_P_8021AD}, {l2.VLAN, unix.ETH_P_8021Q}} {
+		if t.tag == nil {
+			continue
+		}
+		// [ payload load 2b @ link header + offset => reg 1 ]
+		// [ cmp eq reg 1 tpid ]
+		re = append(re, getExprForPayloadMatch(expr.PayloadBaseLLHeader, offset,
+			binaryutil.BigEndian.PutUint16(t.etherType), EQ)...)
+		e, err := getExprForVLANTag(t.tag, offset, l2.RelOp)
+		if err != nil {
+			return nil, err
+		}
+		re = append(re, e...)
+		offset += vlanTagLen
+	}
+	if l2.EtherType != nil {
+		re = append(re, getExprForPayloadMatch(expr.PayloadBaseLLHeader, offset,
+			binaryutil.BigEndian.PutUint16(*l2.EtherType), l2.RelOp)...)
+	}
+
+	return re, nil
+}
+
+// getExprForVLANTag returns masked matches of fields of the VLAN tag starting at the offset,
+// id takes 12 low bits of TCI and pcp takes its 3 high bits.
+func getExprForVLANTag(tag *VLANTag, offset uint32, op Operator) ([]expr.Any, error) {
+	re := []expr.Any{}
+	if tag.ID != nil {
+		e, err := MatchMasked(expr.PayloadBaseLLHeader, offset+vlanTCIOffset, 2,
+			binaryutil.BigEndian.PutUint16(MaxVLANID), binaryutil.BigEndian.PutUint16(*tag.ID), op)
+		if err != nil {
+			return nil, err
+		}
+		re = append(re, e...)
+	}
+	if tag.PCP != nil {
+		e, err := MatchMasked(expr.PayloadBaseLLHeader, offset+vlanTCIOffset, 1,
+			[]byte{MaxVLANPCP << 5}, []byte{*tag.PCP << 5}, op)
+		if err != nil {
+			return nil, err
+		}
+		re = append(re, e...)
+	}
+
+	return re, nil
+}
@@ -0,0 +1,189 @@
+package nftableslib
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+func TestL2Rule(t *testing.T) {
+	id, badID := uint16(100), uint16(4096)
+	pcp, badPCP := uint8(5), uint8(8)
+	etherType := uint16(unix.ETH_P_IP)
+	tests := []struct {
+		name    string
+		rule    *Rule
+		success bool
+	}{
+		{
+			name:    "VLAN id",
+			rule:    &Rule{L2: &L2Rule{VLAN: &VLANTag{ID: &id}}},
+			success: true,
+		},
+		{
+			name:    "QinQ with inner ether type",
+			rule:    &Rule{L2: &L2Rule{ServiceVLAN: &VLANTag{ID: &id}, VLAN: &VLANTag{PCP: &pcp}, EtherType: &etherType}},
+			success: true,
+		},
+		{
+			name: "VLAN id with L3 rule",
+			rule: &Rule{
+				L2: &L2Rule{VLAN: &VLANTag{ID: &id}},
+				L3: &L3Rule{Src: &IPAddrSpec{List: []*IPAddr{setIPAddr(t, "192.0.2.1")}}},
+			},
+			success: true,
+		},
+		{
+			name:    "Source address",
+			rule:    &Rule{L2: &L2Rule{Src: net.HardwareAddr{0x02, 0, 0, 0, 0, 1}}},
+			success: true,
+		},
+		{
+			name:    "Address is not ethernet address",
+			rule:    &Rule{L2: &L2Rule{Dst: net.HardwareAddr{0x02, 0, 0, 0}}},
+			success: false,
+		},
+		{
+			name:    "Empty L2 rule",
+			rule:    &Rule{L2: &L2Rule{}},
+			success: false,
+		},
+		{
+			name:    "VLAN id out of range",
+			rule:    &Rule{L2: &L2Rule{VLAN: &VLANTag{ID: &badID}}},
+			success: false,
+		},
+		{
+			name:    "VLAN pcp out of range",
+			rule:    &Rule{L2: &L2Rule{ServiceVLAN: &VLANTag{PCP: &badPCP}}},
+			success: false,
+		},
+		{
+			name:    "VLAN id with range operator",
+			rule:    &Rule{L2: &L2Rule{VLAN: &VLANTag{ID: &id}, RelOp: GT}},
+			success: false,
+		},
+		{
+			name: "QinQ with L3 rule",
+			rule: &Rule{
+				L2: &L2Rule{ServiceVLAN: &VLANTag{ID: &id}},
+				L3: &L3Rule{Src: &IPAddrSpec{List: []*IPAddr{setIPAddr(t, "192.0.2.1")}}},
+			},
+			success: false,
+		},
+	}
+	for _, tt := range tests {
+		err := tt.rule.Validate()
+		if tt.success && err != nil {
+			t.Errorf("Test \"%s\" failed with error: \"%+v\" but supposed to succeed", tt.name, err)
+			continue
+		}
+		if !tt.success && err == nil {
+			t.Errorf("Test \"%s\" succeeded but supposed to fail", tt.name)
+		}
+	}
+}
+
+func TestL2RuleExpressions(t *testing.T) {
+	id, outer := uint16(100), uint16(10)
+	pcp := uint8(5)
+	etherType := uint16(unix.ETH_P_IPV6)
+	ll := expr.PayloadBaseLLHeader
+	guard := func(offset uint32, tpid ...byte) []expr.Any {
+		return []expr.Any{
+			&expr.Payload{DestRegister: 1, Base: ll, Offset: offset, Len: 2},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: tpid},
+		}
+	}
+	masked := func(offset, length uint32, mask, value []byte) []expr.Any {
+		return []expr.Any{
+			&expr.Payload{DestRegister: maskedRegister, Base: ll, Offset: offset, Len: length},
+			&expr.Bitwise{SourceRegister: maskedRegister, DestRegister: maskedRegister, Len: length, Mask: mask, Xor: make([]byte, length)},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: maskedRegister, Data: value},
+		}
+	}
+	join := func(exprs ...[]expr.Any) []expr.Any {
+		re := []expr.Any{}
+		for _, e := range exprs {
+			re = append(re, e...)
+		}
+		return re
+	}
+	tests := []struct {
+		name string
+		l2   *L2Rule
+		want []expr.Any
+	}{
+		{
+			// vlan id 100
+			name: "VLAN id",
+			l2:   &L2Rule{VLAN: &VLANTag{ID: &id}},
+			want: join(guard(12, 0x81, 0x00), masked(14, 2, []byte{0x0f, 0xff}, []byte{0x00, 0x64})),
+		},
+		{
+			// vlan pcp 5
+			name: "VLAN pcp",
+			l2:   &L2Rule{VLAN: &VLANTag{PCP: &pcp}},
+			want: join(guard(12, 0x81, 0x00), masked(14, 1, []byte{0xe0}, []byte{0xa0})),
+		},
+		{
+			// ether type 8021ad vlan id 10 vlan type 8021q vlan id 100 vlan type ip6
+			name: "QinQ",
+			l2:   &L2Rule{ServiceVLAN: &VLANTag{ID: &outer}, VLAN: &VLANTag{ID: &id}, EtherType: &etherType},
+			want: join(
+				guard(12, 0x88, 0xa8), masked(14, 2, []byte{0x0f, 0xff}, []byte{0x00, 0x0a}),
+				guard(16, 0x81, 0x00), masked(18, 2, []byte{0x0f, 0xff}, []byte{0x00, 0x64}),
+				[]expr.Any{
+					&expr.Payload{DestRegister: 1, Base: ll, Offset: 20, Len: 2},
+					&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{0x86, 0xdd}},
+				},
+			),
+		},
+		{
+			// ether saddr 02:00:00:00:00:01 ether daddr 02:00:00:00:00:02 vlan id 100
+			name: "Addresses with VLAN id",
+			l2: &L2Rule{
+				Src:  net.HardwareAddr{0x02, 0, 0, 0, 0, 1},
+				Dst:  net.HardwareAddr{0x02, 0, 0, 0, 0, 2},
+				VLAN: &VLANTag{ID: &id},
+			},
+			want: join(
+				[]expr.Any{
+					&expr.Payload{DestRegister: 1, Base: ll, Offset: 0, Len: 6},
+					&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{0x02, 0, 0, 0, 0, 2}},
+					&expr.Payload{DestRegister: 1, Base: ll, Offset: 6, Len: 6},
+					&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{0x02, 0, 0, 0, 0, 1}},
+				},
+				guard(12, 0x81, 0x00), masked(14, 2, []byte{0x0f, 0xff}, []byte{0x00, 0x64}),
+			),
+		},
+		{
+			// ether type != ip6
+			name: "Ether type",
+			l2:   &L2Rule{EtherType: &etherType, RelOp: NEQ},
+			want: []expr.Any{
+				&expr.Payload{DestRegister: 1, Base: ll, Offset: 12, Len: 2},
+				&expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: []byte{0x86, 0xdd}},
+			},
+		},
+	}
+	for _, tt := range tests {
+		got, err := createL2(nftables.TableFamilyBridge, &Rule{L2: tt.l2})
+		if err != nil {
+			t.Errorf("Test \"%s\" failed with error: %+v but supposed to succeed", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Test \"%s\" failed, expected expressions %+v, got %+v", tt.name, tt.want, got)
+		}
+	}
+	for _, family := range []nftables.TableFamily{nftables.TableFamilyIPv4, nftables.TableFamilyINet, nftables.TableFamilyARP} {
+		if _, err := createL2(family, &Rule{L2: &L2Rule{VLAN: &VLANTag{ID: &id}}}); err == nil {
+			t.Errorf("l2 rule supposed to fail in table of family %#02x", family)
+		}
+	}
+}
@@ -2,13 +2,12 @@ package nftableslib
 
 import (
 	"fmt"
-	"math/rand"
 
 	"github.com/google/nftables"
 	"github.com/google/nftables/expr"
 )
 
-func createL3(l3proto nftables.TableFamily, rule *Rule) ([]expr.Any, []*nfSet, error) {
+func createL3(l3proto nftables.TableFamily, rule *Rule, ids IDGenerator) ([]expr.Any, []*nfSet, error) {
 	re := []expr.Any{}
 	e := []expr.Any{}
 	sets := make([]*nfSet, 0)
@@ -17,21 +16,28 @@ func createL3(l3proto nftables.TableFamily, rule *Rule) ([]expr.Any, []*nfSet, e
 
 	// Processing non-nil keys defined in L3 portion of a rule
 	if rule.L3.Version != nil {
-		if e, _, err = processVersion(*rule.L3.Version, rule.L3.RelOp); err != nil {
+		if e, _, err = processVersion(*rule.L3.Version, rule.L3.versionRelOp()); err != nil {
 			return nil, nil, err
 		}
 		re = append(re, e...)
 	}
 
 	if rule.L3.Protocol != nil {
-		if e, _, err = processProtocol(l3proto, *rule.L3.Protocol, rule.L3.RelOp); err != nil {
+		if e, _, err = processProtocol(l3proto, *rule.L3.Protocol, rule.L3.protocolRelOp()); err != nil {
 			return nil, nil, err
 		}
 		re = append(re, e...)
 	}
 
+	if rule.L3.Options != nil {
+		if l3proto != nftables.TableFamilyIPv4 {
+			return nil, nil, fmt.Errorf("ip options match is supported only in ipv4 family, got family %#02x", l3proto)
+		}
+		re = append(re, getExprForIPOptions(*rule.L3.Options)...)
+	}
+
 	if rule.L3.Src != nil {
-		if e, set, err = processIPAddr(l3proto, rule.L3.Src, true, rule.L3.Src.RelOp); err != nil {
+		if e, set, err = processIPAddr(l3proto, rule.L3.Src, true, rule.L3.Src.RelOp, ids); err != nil {
 			return nil, nil, err
 		}
 		if set != nil {
@@ -41,7 +47,7 @@ func createL3(l3proto nftables.TableFamily, rule *Rule) ([]expr.Any, []*nfSet, e
 	}
 
 	if rule.L3.Dst != nil {
-		if e, set, err = processIPAddr(l3proto, rule.L3.Dst, false, rule.L3.Dst.RelOp); err != nil {
+		if e, set, err = processIPAddr(l3proto, rule.L3.Dst, false, rule.L3.Dst.RelOp, ids); err != nil {
 			return nil, nil, err
 		}
 		if set != nil {
@@ -56,7 +62,7 @@ func createL3(l3proto nftables.TableFamily, rule *Rule) ([]expr.Any, []*nfSet, e
 }
 
 func processAddrList(l3proto nftables.TableFamily, offset uint32, list []*IPAddr,
-	op Operator) ([]expr.Any, *nfSet, error) {
+	op Operator, ids IDGenerator) ([]expr.Any, *nfSet, error) {
 
 	if len(list) == 1 {
 		// Special case when a single IP is provided in the list
@@ -70,12 +76,10 @@ func processAddrList(l3proto nftables.TableFamily, offset uint32, list []*IPAddr
 	set := &nftables.Set{
 		Anonymous: false,
 		Constant:  true,
-		Name:      getSetName(),
-		ID:        uint32(rand.Intn(0xffff)),
+		Name:      ids.Name(),
+		ID:        ids.SetID(),
 	}
-	var se []nftables.SetElement
-
-	se = buildElementRanges(list)
+	se, normalized := buildElementRanges(list)
 	set.Interval = true
 
 	if len(se) == 0 {
@@ -83,6 +87,7 @@ func processAddrList(l3proto nftables.TableFamily, offset uint32, list []*IPAddr
 	}
 	nfset.set = set
 	nfset.elements = se
+	nfset.normalized = normalized
 	re, err := getExprForListIP(l3proto, set, offset, op)
 	if err != nil {
 		return nil, nil, err
@@ -118,7 +123,7 @@ func processProtocol(l3proto nftables.TableFamily, proto uint32, op Operator) ([
 	return re, nil, nil
 }
 
-func processIPAddr(l3proto nftables.TableFamily, addrs *IPAddrSpec, src bool, op Operator) ([]expr.Any, []*nfSet, error) {
+func processIPAddr(l3proto nftables.TableFamily, addrs *IPAddrSpec, src bool, op Operator, ids IDGenerator) ([]expr.Any, []*nfSet, error) {
 	var addrOffset uint32
 	var keyType nftables.SetDatatype
 	var set *nfSet
@@ -126,6 +131,8 @@ func processIPAddr(l3proto nftables.TableFamily, addrs *IPAddrSpec, src bool, op
 	sets := make([]*nfSet, 0)
 	e := []expr.Any{}
 	re := []expr.Any{}
+	// Addresses are at fixed offsets of the mandatory part of the header, IPv4 options follow them
+	// and do not shift the offsets.
 	switch l3proto {
 	case nftables.TableFamilyIPv4:
 		if src {
@@ -141,11 +148,17 @@ func processIPAddr(l3proto nftables.TableFamily, addrs *IPAddrSpec, src bool, op
 			addrOffset = 24
 		}
 		keyType = nftables.TypeIP6Addr
+	default:
+		return nil, nil, fmt.Errorf("ip address match is not supported in family %#02x", l3proto)
 	}
-	// There are three sources for addresses; List, Range and Set/Map/Vmap
+	// There are four sources for addresses; List, Range, Masked and Set/Map/Vmap
 	switch {
+	case addrs.Masked != nil:
+		if e, err = getExprForMaskedIP(l3proto, addrOffset, addrs.Masked, op); err != nil {
+			return nil, nil, err
+		}
 	case addrs.List != nil:
-		if e, set, err = processAddrList(l3proto, addrOffset, addrs.List, op); err != nil {
+		if e, set, err = processAddrList(l3proto, addrOffset, addrs.List, op, ids); err != nil {
 			return nil, nil, err
 		}
 	case addrs.Range[0] != nil && addrs.Range[1] != nil:
@@ -166,3 +179,97 @@ func processIPAddr(l3proto nftables.TableFamily, addrs *IPAddrSpec, src bool, op
 
 	return re, sets, nil
 }
+
+// splitFamilies splits the rule of inet table matching addresses of both families. nftables cannot
+// branch within a rule, so instead of a single rule with family guarded branches, a rule per family
+// is generated, each rule is guarded by "meta nfproto" and carries only addresses of its family.
+// A family is skipped when a source or destination match would not carry any of its addresses,
+// a negated match without addresses of the family is dropped from the family's rule. Rules already
+// guarded by Meta's NFProto are returned as they are.
+func splitFamilies(rule *Rule) ([]*Rule, error) {
+	if rule.L3 == nil || (rule.L3.Src == nil && rule.L3.Dst == nil) {
+		return []*Rule{rule}, nil
+	}
+	if rule.Meta != nil && rule.Meta.NFProto != nil {
+		return []*Rule{rule}, nil
+	}
+	rules := make([]*Rule, 0, 2)
+	for _, f := range []nftables.TableFamily{nftables.TableFamilyIPv4, nftables.TableFamilyIPv6} {
+		f := f
+		src, ok, err := familyAddrSpec(rule.L3.Src, f)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+		dst, ok, err := familyAddrSpec(rule.L3.Dst, f)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+		r := *rule
+		l3 := *rule.L3
+		l3.Src, l3.Dst = src, dst
+		r.L3 = &l3
+		if src == nil && dst == nil && l3.Version == nil && l3.Protocol == nil && l3.Options == nil && l3.Counter == nil {
+			// Negated matches were dropped, the family's packets are matched by the guard alone
+			r.L3 = nil
+		}
+		meta := MetaRule{}
+		if rule.Meta != nil {
+			meta = *rule.Meta
+		}
+		meta.NFProto = &f
+		r.Meta = &meta
+		rules = append(rules, &r)
+	}
+	if len(rules) == 0 {
+		return nil, fmt.Errorf("source and destination addresses of the rule do not share a family")
+	}
+
+	return rules, nil
+}
+
+// familyAddrSpec returns the part of the address match carrying addresses of the family, false is
+// returned if packets of the family can never match.
+func familyAddrSpec(spec *IPAddrSpec, f nftables.TableFamily) (*IPAddrSpec, bool, error) {
+	if spec == nil {
+		return nil, true, nil
+	}
+	ipv6 := f == nftables.TableFamilyIPv6
+	s := *spec
+	switch {
+	case spec.Masked != nil:
+		if spec.Masked.Value != nil && spec.Masked.Value.IPAddr != nil && spec.Masked.IsIPv6() == ipv6 {
+			return &s, true, nil
+		}
+	case len(spec.List) != 0:
+		s.List = make([]*IPAddr, 0, len(spec.List))
+		for _, addr := range spec.List {
+			if addr.IsIPv6() == ipv6 {
+				s.List = append(s.List, addr)
+			}
+		}
+		if len(s.List) != 0 {
+			return &s, true, nil
+		}
+	case spec.Range[0] != nil && spec.Range[1] != nil:
+		if spec.Range[0].IsIPv6() != spec.Range[1].IsIPv6() {
+			return nil, false, fmt.Errorf("addresses of the range belong to different families")
+		}
+		if spec.Range[0].IsIPv6() == ipv6 {
+			return &s, true, nil
+		}
+	default:
+		return nil, false, fmt.Errorf("family of the address match cannot be detected, use Meta NFProto to select it")
+	}
+	// Packets of other families never match the address, they always match the negated one
+	if spec.RelOp == NEQ {
+		return nil, true, nil
+	}
+
+	return nil, false, nil
+}
@@ -0,0 +1,636 @@
+package nftableslib
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+// inversions maps every loaded field of the expressions to whether the comparison of
+// the field is inverted, fields are identified by payload base and offset or by meta key.
+func inversions(t *testing.T, exprs []expr.Any) map[string]bool {
+	t.Helper()
+	inv := map[string]bool{}
+	field := ""
+	for _, e := range exprs {
+		switch e := e.(type) {
+		case *expr.Payload:
+			field = fmt.Sprintf("%d/%d", e.Base, e.Offset)
+		case *expr.Meta:
+			field = fmt.Sprintf("meta/%d", e.Key)
+		case *expr.Cmp:
+			inv[field] = inv[field] || e.Op == expr.CmpOpNeq
+		case *expr.Range:
+			inv[field] = inv[field] || e.Op == expr.CmpOpNeq
+		case *expr.Lookup:
+			inv[field] = inv[field] || e.Invert
+		}
+	}
+	return inv
+}
+
+func TestL3SectionRelOp(t *testing.T) {
+	version := byte(4)
+	l3Src, l3Dst := fmt.Sprintf("%d/12", expr.PayloadBaseNetworkHeader), fmt.Sprintf("%d/16", expr.PayloadBaseNetworkHeader)
+	l3Ver, l3Proto := fmt.Sprintf("%d/0", expr.PayloadBaseNetworkHeader), fmt.Sprintf("%d/9", expr.PayloadBaseNetworkHeader)
+	tests := []struct {
+		name string
+		l3   *L3Rule
+		want map[string]bool
+	}{
+		{
+			name: "Single source not equal, single destination equal",
+			l3: &L3Rule{
+				Src: &IPAddrSpec{List: []*IPAddr{setIPAddr(t, "10.0.0.1")}, RelOp: NEQ},
+				Dst: &IPAddrSpec{List: []*IPAddr{setIPAddr(t, "10.0.0.2")}},
+			},
+			want: map[string]bool{l3Src: true, l3Dst: false},
+		},
+		{
+			name: "Source list not equal, destination list equal",
+			l3: &L3Rule{
+				Src: &IPAddrSpec{List: []*IPAddr{setIPAddr(t, "10.0.0.1"), setIPAddr(t, "10.0.1.1")}, RelOp: NEQ},
+				Dst: &IPAddrSpec{List: []*IPAddr{setIPAddr(t, "10.0.0.2"), setIPAddr(t, "10.0.1.2")}},
+			},
+			want: map[string]bool{l3Src: true, l3Dst: false},
+		},
+		{
+			name: "Source range equal, destination range not equal",
+			l3: &L3Rule{
+				Src: &IPAddrSpec{Range: [2]*IPAddr{setIPAddr(t, "10.0.0.1"), setIPAddr(t, "10.0.0.9")}},
+				Dst: &IPAddrSpec{Range: [2]*IPAddr{setIPAddr(t, "10.0.1.1"), setIPAddr(t, "10.0.1.9")}, RelOp: NEQ},
+			},
+			want: map[string]bool{l3Src: false, l3Dst: true},
+		},
+		{
+			name: "Version equal, protocol not equal, source equal",
+			l3: &L3Rule{
+				Version:       &version,
+				Protocol:      L3Protocol(unix.IPPROTO_TCP),
+				ProtocolRelOp: NEQ,
+				Src:           &IPAddrSpec{List: []*IPAddr{setIPAddr(t, "10.0.0.1")}},
+			},
+			want: map[string]bool{l3Ver: false, l3Proto: true, l3Src: false},
+		},
+		{
+			name: "Deprecated RelOp applies to version and protocol only",
+			l3: &L3Rule{
+				Version:  &version,
+				Protocol: L3Protocol(unix.IPPROTO_TCP),
+				RelOp:    NEQ,
+				Dst:      &IPAddrSpec{List: []*IPAddr{setIPAddr(t, "10.0.0.2")}},
+			},
+			want: map[string]bool{l3Ver: true, l3Proto: true, l3Dst: false},
+		},
+	}
+	for _, tt := range tests {
+		e, _, err := createL3(nftables.TableFamilyIPv4, &Rule{L3: tt.l3}, defaultIDs)
+		if err != nil {
+			t.Errorf("Test \"%s\" failed with error: %+v", tt.name, err)
+			continue
+		}
+		if got := inversions(t, e); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Test \"%s\" failed, expected inversions %v, got %v", tt.name, tt.want, got)
+		}
+	}
+}
+
+func TestL4SectionRelOp(t *testing.T) {
+	l4Src, l4Dst := fmt.Sprintf("%d/0", expr.PayloadBaseTransportHeader), fmt.Sprintf("%d/2", expr.PayloadBaseTransportHeader)
+	l4Proto := fmt.Sprintf("meta/%d", expr.MetaKeyL4PROTO)
+	tests := []struct {
+		name string
+		l4   *L4Rule
+		want map[string]bool
+	}{
+		{
+			name: "Single source port not equal, destination range equal",
+			l4: &L4Rule{
+				L4Proto: unix.IPPROTO_TCP,
+				Src:     &Port{List: []uint16{1024}, RelOp: NEQ},
+				Dst:     &Port{Range: [2]uint16{80, 90}},
+			},
+			want: map[string]bool{l4Proto: false, l4Src: true, l4Dst: false},
+		},
+		{
+			name: "Source port list equal, destination range not equal",
+			l4: &L4Rule{
+				L4Proto: unix.IPPROTO_TCP,
+				Src:     &Port{List: []uint16{1024, 1025}},
+				Dst:     &Port{Range: [2]uint16{80, 90}, RelOp: NEQ},
+			},
+			want: map[string]bool{l4Proto: false, l4Src: false, l4Dst: true},
+		},
+		{
+			name: "Deprecated L4 RelOp does not invert ports",
+			l4: &L4Rule{
+				L4Proto: unix.IPPROTO_UDP,
+				Src:     &Port{List: []uint16{53}},
+				RelOp:   NEQ,
+			},
+			want: map[string]bool{l4Proto: false, l4Src: false},
+		},
+	}
+	for _, tt := range tests {
+		e, _, err := createL4(nftables.TableFamilyIPv4, &Rule{L4: tt.l4}, defaultIDs)
+		if err != nil {
+			t.Errorf("Test \"%s\" failed with error: %+v", tt.name, err)
+			continue
+		}
+		if got := inversions(t, e); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Test \"%s\" failed, expected inversions %v, got %v", tt.name, tt.want, got)
+		}
+	}
+}
+
+// payloads returns base and offset of every payload expression in the order of generation.
+func payloads(exprs []expr.Any) []string {
+	p := []string{}
+	for _, e := range exprs {
+		if e, ok := e.(*expr.Payload); ok {
+			p = append(p, fmt.Sprintf("%d/%d", e.Base, e.Offset))
+		}
+	}
+	return p
+}
+
+func TestPayloadOffsets(t *testing.T) {
+	nh, th := expr.PayloadBaseNetworkHeader, expr.PayloadBaseTransportHeader
+	version4, version6 := byte(4), byte(6)
+	options := true
+	tests := []struct {
+		name   string
+		family nftables.TableFamily
+		rule   *Rule
+		want   []string
+	}{
+		{
+			name:   "IPv4 version, protocol, ihl, addresses and ports",
+			family: nftables.TableFamilyIPv4,
+			rule: &Rule{
+				L3: &L3Rule{
+					Version:  &version4,
+					Options:  &options,
+					Protocol: L3Protocol(unix.IPPROTO_TCP),
+					Src:      &IPAddrSpec{List: []*IPAddr{setIPAddr(t, "10.0.0.1")}},
+					Dst:      &IPAddrSpec{Range: [2]*IPAddr{setIPAddr(t, "10.0.1.1"), setIPAddr(t, "10.0.1.9")}},
+				},
+				L4: &L4Rule{
+					L4Proto: unix.IPPROTO_TCP,
+					Src:     &Port{List: []uint16{1024, 1025}},
+					Dst:     &Port{Range: [2]uint16{80, 90}},
+				},
+			},
+			want: []string{
+				fmt.Sprintf("%d/0", nh), fmt.Sprintf("%d/9", nh), fmt.Sprintf("%d/0", nh),
+				fmt.Sprintf("%d/12", nh), fmt.Sprintf("%d/16", nh),
+				fmt.Sprintf("%d/0", th), fmt.Sprintf("%d/2", th),
+			},
+		},
+		{
+			name:   "IPv6 version, next header, addresses and ports",
+			family: nftables.TableFamilyIPv6,
+			rule: &Rule{
+				L3: &L3Rule{
+					Version:  &version6,
+					Protocol: L3Protocol(unix.IPPROTO_UDP),
+					Src:      &IPAddrSpec{List: []*IPAddr{setIPAddr(t, "2001:db8::1")}},
+					Dst:      &IPAddrSpec{List: []*IPAddr{setIPAddr(t, "2001:db8::2")}},
+				},
+				L4: &L4Rule{
+					L4Proto: unix.IPPROTO_UDP,
+					Src:     &Port{List: []uint16{53}},
+					Dst:     &Port{Ranges: [][2]uint16{{1000, 2000}, {3000, 4000}}},
+				},
+			},
+			want: []string{
+				fmt.Sprintf("%d/0", nh), fmt.Sprintf("%d/6", nh),
+				fmt.Sprintf("%d/8", nh), fmt.Sprintf("%d/24", nh),
+				fmt.Sprintf("%d/0", th), fmt.Sprintf("%d/2", th),
+			},
+		},
+	}
+	for _, tt := range tests {
+		l3, _, err := createL3(tt.family, tt.rule, defaultIDs)
+		if err != nil {
+			t.Errorf("Test \"%s\" failed with error: %+v", tt.name, err)
+			continue
+		}
+		l4, _, err := createL4(tt.family, tt.rule, defaultIDs)
+		if err != nil {
+			t.Errorf("Test \"%s\" failed with error: %+v", tt.name, err)
+			continue
+		}
+		if got := payloads(append(l3, l4...)); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Test \"%s\" failed, expected payloads %v, got %v", tt.name, tt.want, got)
+		}
+	}
+}
+
+func TestIPOptions(t *testing.T) {
+	present, absent := true, false
+	for _, tt := range []struct {
+		options bool
+		op      expr.CmpOp
+	}{
+		{options: present, op: expr.CmpOpGt},
+		{options: absent, op: expr.CmpOpEq},
+	} {
+		e, _, err := createL3(nftables.TableFamilyIPv4, &Rule{L3: &L3Rule{Options: &tt.options}}, defaultIDs)
+		if err != nil {
+			t.Fatalf("failed to create ip options match with error: %+v", err)
+		}
+		if len(e) != 3 {
+			t.Fatalf("expected 3 expressions, got %d", len(e))
+		}
+		b, ok := e[1].(*expr.Bitwise)
+		if !ok || !reflect.DeepEqual(b.Mask, []byte{0x0f}) {
+			t.Fatalf("expected ihl mask, got %+v", e[1])
+		}
+		c, ok := e[2].(*expr.Cmp)
+		if !ok || c.Op != tt.op || !reflect.DeepEqual(c.Data, []byte{0x05}) {
+			t.Fatalf("options %t expected cmp op %d with 5 words, got %+v", tt.options, tt.op, e[2])
+		}
+	}
+	if err := (&L3Rule{Options: &present}).Validate(); err != nil {
+		t.Fatalf("ip options only rule failed validation with error: %+v", err)
+	}
+	if _, _, err := createL3(nftables.TableFamilyIPv6, &Rule{L3: &L3Rule{Options: &present}}, defaultIDs); err == nil {
+		t.Fatalf("ip options match supposed to fail in ipv6 family")
+	}
+}
+
+func TestSingleCIDRMatch(t *testing.T) {
+	nh := expr.PayloadBaseNetworkHeader
+	prefix := uint8(32)
+	tests := []struct {
+		name   string
+		family nftables.TableFamily
+		src    *IPAddrSpec
+		exprs  []expr.Any
+		sets   int
+	}{
+		{
+			name:   "IPv6 prefix",
+			family: nftables.TableFamilyIPv6,
+			src:    &IPAddrSpec{List: []*IPAddr{setIPAddr(t, "2001:db8::/32")}},
+			exprs: []expr.Any{
+				&expr.Payload{DestRegister: 1, Base: nh, Offset: 8, Len: 16},
+				&expr.Bitwise{SourceRegister: 1, DestRegister: 1, Len: 16, Mask: []byte(net.CIDRMask(32, 128)), Xor: make([]byte, 16)},
+				&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte(net.ParseIP("2001:db8::"))},
+			},
+		},
+		{
+			name:   "IPv6 prefix with host bits not equal",
+			family: nftables.TableFamilyIPv6,
+			src:    &IPAddrSpec{List: []*IPAddr{{IPAddr: &net.IPAddr{IP: net.ParseIP("2001:db8::1")}, CIDR: true, Mask: &prefix}}, RelOp: NEQ},
+			exprs: []expr.Any{
+				&expr.Payload{DestRegister: 1, Base: nh, Offset: 8, Len: 16},
+				&expr.Bitwise{SourceRegister: 1, DestRegister: 1, Len: 16, Mask: []byte(net.CIDRMask(32, 128)), Xor: make([]byte, 16)},
+				&expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: []byte(net.ParseIP("2001:db8::"))},
+			},
+		},
+		{
+			name:   "IPv4 host address",
+			family: nftables.TableFamilyIPv4,
+			src:    &IPAddrSpec{List: []*IPAddr{setIPAddr(t, "192.0.2.1")}},
+			exprs: []expr.Any{
+				&expr.Payload{DestRegister: 1, Base: nh, Offset: 12, Len: 4},
+				&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{192, 0, 2, 1}},
+			},
+		},
+		{
+			name:   "IPv4 host address without mask",
+			family: nftables.TableFamilyIPv4,
+			src:    &IPAddrSpec{List: []*IPAddr{{IPAddr: &net.IPAddr{IP: net.ParseIP("192.0.2.1")}}}, RelOp: NEQ},
+			exprs: []expr.Any{
+				&expr.Payload{DestRegister: 1, Base: nh, Offset: 12, Len: 4},
+				&expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: []byte{192, 0, 2, 1}},
+			},
+		},
+		{
+			name:   "IPv6 list of prefixes uses set",
+			family: nftables.TableFamilyIPv6,
+			src:    &IPAddrSpec{List: []*IPAddr{setIPAddr(t, "2001:db8::/32"), setIPAddr(t, "2001:db9::/32")}},
+			sets:   1,
+		},
+	}
+	for _, tt := range tests {
+		exprs, sets, err := processIPAddr(tt.family, tt.src, true, tt.src.RelOp, defaultIDs)
+		if err != nil {
+			t.Errorf("Test \"%s\" failed with error: %+v", tt.name, err)
+			continue
+		}
+		if len(sets) != tt.sets {
+			t.Errorf("Test \"%s\" failed, expected %d sets, got %d", tt.name, tt.sets, len(sets))
+			continue
+		}
+		if tt.exprs != nil && !reflect.DeepEqual(exprs, tt.exprs) {
+			t.Errorf("Test \"%s\" failed, expected expressions %+v, got %+v", tt.name, tt.exprs, exprs)
+		}
+	}
+}
+
+func TestSplitFamilies(t *testing.T) {
+	addrs := func(list ...string) []*IPAddr {
+		r := make([]*IPAddr, 0, len(list))
+		for _, a := range list {
+			ip, err := NewIPAddr(a)
+			if err != nil {
+				t.Fatalf("failed to parse address %s with error: %+v", a, err)
+			}
+			r = append(r, ip)
+		}
+		return r
+	}
+	ipv4, ipv6 := nftables.TableFamilyIPv4, nftables.TableFamilyIPv6
+	tests := []struct {
+		name     string
+		rule     *Rule
+		families []nftables.TableFamily
+		// srcs and dsts carry the number of addresses per family, -1 if the match is dropped
+		srcs    []int
+		dsts    []int
+		success bool
+	}{
+		{
+			name:     "Mixed source list",
+			rule:     &Rule{L3: &L3Rule{Src: &IPAddrSpec{List: addrs("10.0.0.0/8", "2001:db8::/32", "192.168.1.1")}}},
+			families: []nftables.TableFamily{ipv4, ipv6},
+			srcs:     []int{2, 1},
+			dsts:     []int{-1, -1},
+			success:  true,
+		},
+		{
+			name: "Mixed source, ipv4 destination",
+			rule: &Rule{L3: &L3Rule{
+				Src: &IPAddrSpec{List: addrs("10.0.0.0/8", "2001:db8::/32")},
+				Dst: &IPAddrSpec{List: addrs("192.168.1.1")},
+			}},
+			families: []nftables.TableFamily{ipv4},
+			srcs:     []int{1},
+			dsts:     []int{1},
+			success:  true,
+		},
+		{
+			name: "Negated ipv6 destination",
+			rule: &Rule{L3: &L3Rule{
+				Src: &IPAddrSpec{List: addrs("10.0.0.0/8", "2001:db8::/32")},
+				Dst: &IPAddrSpec{List: addrs("fd00::1"), RelOp: NEQ},
+			}},
+			families: []nftables.TableFamily{ipv4, ipv6},
+			srcs:     []int{1, 1},
+			dsts:     []int{-1, 1},
+			success:  true,
+		},
+		{
+			name: "Guarded rule is not split",
+			rule: &Rule{
+				Meta: &MetaRule{NFProto: &ipv6},
+				L3:   &L3Rule{Src: &IPAddrSpec{List: addrs("10.0.0.0/8", "2001:db8::/32")}},
+			},
+			families: []nftables.TableFamily{ipv6},
+			srcs:     []int{2},
+			dsts:     []int{-1},
+			success:  true,
+		},
+		{
+			name: "No shared family",
+			rule: &Rule{L3: &L3Rule{
+				Src: &IPAddrSpec{List: addrs("10.0.0.0/8")},
+				Dst: &IPAddrSpec{List: addrs("fd00::1")},
+			}},
+			success: false,
+		},
+		{
+			name:    "Set reference",
+			rule:    &Rule{L3: &L3Rule{Src: &IPAddrSpec{SetRef: &SetRef{Name: "addresses"}}}},
+			success: false,
+		},
+	}
+	count := func(spec *IPAddrSpec) int {
+		if spec == nil {
+			return -1
+		}
+		return len(spec.List)
+	}
+	for _, tt := range tests {
+		rules, err := splitFamilies(tt.rule)
+		if err != nil && tt.success {
+			t.Errorf("test \"%s\" failed with error: %+v but supposed to succeed", tt.name, err)
+			continue
+		}
+		if err == nil && !tt.success {
+			t.Errorf("test \"%s\" succeeded but supposed to fail", tt.name)
+			continue
+		}
+		if !tt.success {
+			continue
+		}
+		if len(rules) != len(tt.families) {
+			t.Errorf("test \"%s\": expected %d rules, got %d", tt.name, len(tt.families), len(rules))
+			continue
+		}
+		for i, r := range rules {
+			if r.Meta == nil || r.Meta.NFProto == nil || *r.Meta.NFProto != tt.families[i] {
+				t.Errorf("test \"%s\": rule %d is not guarded by family %d", tt.name, i, tt.families[i])
+				continue
+			}
+			if src, dst := count(r.L3.Src), count(r.L3.Dst); src != tt.srcs[i] || dst != tt.dsts[i] {
+				t.Errorf("test \"%s\": rule %d expected %d/%d addresses, got %d/%d", tt.name, i, tt.srcs[i], tt.dsts[i], src, dst)
+			}
+		}
+	}
+	// The caller's rule is not modified
+	rule := tests[0].rule
+	if rule.Meta != nil || len(rule.L3.Src.List) != 3 {
+		t.Fatalf("splitting modified the rule")
+	}
+}
+
+func TestMaskedAddrMatch(t *testing.T) {
+	nh := expr.PayloadBaseNetworkHeader
+	masked := func(mask, value string) *MaskedAddr {
+		return &MaskedAddr{Mask: setIPAddr(t, mask), Value: setIPAddr(t, value)}
+	}
+	tests := []struct {
+		name    string
+		family  nftables.TableFamily
+		src     bool
+		spec    *IPAddrSpec
+		exprs   []expr.Any
+		wantErr bool
+	}{
+		{
+			name:   "IPv4 last octet",
+			family: nftables.TableFamilyIPv4,
+			src:    true,
+			spec:   &IPAddrSpec{Masked: masked("0.0.0.255", "0.0.0.1")},
+			exprs: []expr.Any{
+				&expr.Payload{DestRegister: 1, Base: nh, Offset: 12, Len: 4},
+				&expr.Bitwise{SourceRegister: 1, DestRegister: 1, Len: 4, Mask: []byte{0, 0, 0, 255}, Xor: make([]byte, 4)},
+				&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{0, 0, 0, 1}},
+			},
+		},
+		{
+			name:   "IPv6 interface identifier not equal",
+			family: nftables.TableFamilyIPv6,
+			spec:   &IPAddrSpec{Masked: masked("::ffff:ffff:ffff:ffff", "::1"), RelOp: NEQ},
+			exprs: []expr.Any{
+				&expr.Payload{DestRegister: 1, Base: nh, Offset: 24, Len: 16},
+				&expr.Bitwise{SourceRegister: 1, DestRegister: 1, Len: 16, Mask: []byte(net.ParseIP("::ffff:ffff:ffff:ffff")), Xor: make([]byte, 16)},
+				&expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: []byte(net.ParseIP("::1"))},
+			},
+		},
+		{
+			name:    "Mask and value of different families",
+			family:  nftables.TableFamilyIPv4,
+			spec:    &IPAddrSpec{Masked: masked("0.0.0.255", "::1")},
+			wantErr: true,
+		},
+		{
+			name:    "Masked address of other family than table",
+			family:  nftables.TableFamilyIPv6,
+			spec:    &IPAddrSpec{Masked: masked("0.0.0.255", "0.0.0.1")},
+			wantErr: true,
+		},
+		{
+			name:    "Value with bits outside of mask",
+			family:  nftables.TableFamilyIPv4,
+			spec:    &IPAddrSpec{Masked: masked("0.0.0.255", "0.0.1.1")},
+			wantErr: true,
+		},
+		{
+			name:    "Prefix as mask",
+			family:  nftables.TableFamilyIPv4,
+			spec:    &IPAddrSpec{Masked: masked("0.0.0.0/24", "0.0.0.1")},
+			wantErr: true,
+		},
+		{
+			name:    "Greater than",
+			family:  nftables.TableFamilyIPv4,
+			spec:    &IPAddrSpec{Masked: masked("0.0.0.255", "0.0.0.1"), RelOp: GT},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		exprs, _, err := processIPAddr(tt.family, tt.spec, tt.src, tt.spec.RelOp, defaultIDs)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("Test \"%s\" succeeded but supposed to fail", tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test \"%s\" failed with error: %+v but supposed to succeed", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(exprs, tt.exprs) {
+			t.Errorf("Test \"%s\" failed, expected expressions %+v, got %+v", tt.name, tt.exprs, exprs)
+		}
+	}
+	// Masked address cannot be combined with other flavours of the spec
+	spec := &IPAddrSpec{Masked: masked("0.0.0.255", "0.0.0.1"), List: []*IPAddr{setIPAddr(t, "10.0.0.1")}}
+	if err := spec.Validate(); err == nil {
+		t.Errorf("masked address combined with list is supposed to fail validation")
+	}
+}
+
+func TestAddrRangeExprs(t *testing.T) {
+	load := func(offset, l uint32) *expr.Payload {
+		return &expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: offset, Len: l}
+	}
+	v4 := func(addr string) []byte { return net.ParseIP(addr).To4() }
+	v6 := func(addr string) []byte { return net.ParseIP(addr).To16() }
+	tests := []struct {
+		name   string
+		family nftables.TableFamily
+		rng    [2]*IPAddr
+		op     Operator
+		want   []expr.Any
+	}{
+		{
+			name:   "ipv4 inclusion",
+			family: nftables.TableFamilyIPv4,
+			rng:    [2]*IPAddr{setIPAddr(t, "10.0.0.1"), setIPAddr(t, "10.0.0.9")},
+			want: []expr.Any{
+				load(12, 4),
+				&expr.Cmp{Op: expr.CmpOpGte, Register: 1, Data: v4("10.0.0.1")},
+				&expr.Cmp{Op: expr.CmpOpLte, Register: 1, Data: v4("10.0.0.9")},
+			},
+		},
+		{
+			name:   "ipv4 exclusion",
+			family: nftables.TableFamilyIPv4,
+			rng:    [2]*IPAddr{setIPAddr(t, "10.0.0.1"), setIPAddr(t, "10.0.0.9")},
+			op:     NEQ,
+			want: []expr.Any{
+				load(12, 4),
+				&expr.Range{Op: expr.CmpOpNeq, Register: 1, FromData: v4("10.0.0.1"), ToData: v4("10.0.0.9")},
+			},
+		},
+		{
+			name:   "ipv4 exclusion of prefixes",
+			family: nftables.TableFamilyIPv4,
+			rng:    [2]*IPAddr{setIPAddr(t, "192.168.0.0/24"), setIPAddr(t, "192.168.2.0/23")},
+			op:     NEQ,
+			want: []expr.Any{
+				load(12, 4),
+				&expr.Range{Op: expr.CmpOpNeq, Register: 1, FromData: v4("192.168.0.0"), ToData: v4("192.168.3.255")},
+			},
+		},
+		{
+			name:   "ipv6 inclusion of prefix",
+			family: nftables.TableFamilyIPv6,
+			rng:    [2]*IPAddr{setIPAddr(t, "2001:db8::1"), setIPAddr(t, "2001:db8::/126")},
+			want: []expr.Any{
+				load(8, 16),
+				&expr.Cmp{Op: expr.CmpOpGte, Register: 1, Data: v6("2001:db8::1")},
+				&expr.Cmp{Op: expr.CmpOpLte, Register: 1, Data: v6("2001:db8::3")},
+			},
+		},
+		{
+			name:   "ipv6 exclusion",
+			family: nftables.TableFamilyIPv6,
+			rng:    [2]*IPAddr{setIPAddr(t, "2001:db8::1"), setIPAddr(t, "2001:db8::ffff")},
+			op:     NEQ,
+			want: []expr.Any{
+				load(8, 16),
+				&expr.Range{Op: expr.CmpOpNeq, Register: 1, FromData: v6("2001:db8::1"), ToData: v6("2001:db8::ffff")},
+			},
+		},
+	}
+	for _, tt := range tests {
+		offset := uint32(12)
+		if tt.family == nftables.TableFamilyIPv6 {
+			offset = 8
+		}
+		got, _, err := processAddrRange(tt.family, offset, tt.rng, tt.op)
+		if err != nil {
+			t.Fatalf("Test \"%s\" failed with error: %+v but supposed to succeed", tt.name, err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Fatalf("Test \"%s\" failed, expected expressions %+v, got %+v", tt.name, tt.want, got)
+		}
+	}
+
+	for _, tt := range []struct {
+		name   string
+		family nftables.TableFamily
+		rng    [2]*IPAddr
+	}{
+		{"ipv4 lower bound greater than upper bound", nftables.TableFamilyIPv4, [2]*IPAddr{setIPAddr(t, "10.0.0.9"), setIPAddr(t, "10.0.0.1")}},
+		{"ipv6 lower bound greater than upper bound", nftables.TableFamilyIPv6, [2]*IPAddr{setIPAddr(t, "2001:db8::2"), setIPAddr(t, "2001:db8::1")}},
+		{"ipv4 address in ipv6 range", nftables.TableFamilyIPv6, [2]*IPAddr{setIPAddr(t, "10.0.0.1"), setIPAddr(t, "2001:db8::1")}},
+		{"ipv6 address in ipv4 range", nftables.TableFamilyIPv4, [2]*IPAddr{setIPAddr(t, "10.0.0.1"), setIPAddr(t, "2001:db8::1")}},
+	} {
+		if _, _, err := processAddrRange(tt.family, 12, tt.rng, NEQ); err == nil {
+			t.Fatalf("Test \"%s\" is supposed to fail", tt.name)
+		}
+	}
+}
@@ -1,22 +1,29 @@
 package nftableslib
 
 import (
-	"math/rand"
+	"encoding/binary"
+	"fmt"
+	"sort"
 
 	"github.com/google/nftables/binaryutil"
 	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
 
 	"github.com/google/nftables"
 )
 
-func createL4(family nftables.TableFamily, rule *Rule) ([]expr.Any, []*nfSet, error) {
+func createL4(family nftables.TableFamily, rule *Rule, ids IDGenerator) ([]expr.Any, []*nfSet, error) {
 	re := []expr.Any{}
 	sets := make([]*nfSet, 0)
 
 	l4 := rule.L4
+	if (l4.Src != nil || l4.Dst != nil) && !hasPorts(l4.L4Proto) {
+		return nil, nil, fmt.Errorf("port match is not supported for l4 protocol %d", l4.L4Proto)
+	}
 	if l4.Src != nil {
-		// 0 bytes is offset for Source ports in L4 header
-		e, set, err := processPort(l4.L4Proto, 0, l4.Src)
+		// 0 bytes is offset for Source ports in L4 header, ports are loaded relative to the transport
+		// header which the kernel locates honoring IPv4 options and IPv6 extension headers.
+		e, set, err := processPort(l4.L4Proto, 0, l4.Src, ids)
 		if err != nil {
 			return nil, nil, err
 		}
@@ -26,8 +33,18 @@ func createL4(family nftables.TableFamily, rule *Rule) ([]expr.Any, []*nfSet, er
 		re = append(re, e...)
 	}
 	if l4.Dst != nil {
-		// 2 bytes is offset for Source ports in L4 header
-		e, set, err := processPort(l4.L4Proto, 2, l4.Dst)
+		// 2 bytes is offset for Destination ports in L4 header
+		e, set, err := processPort(l4.L4Proto, 2, l4.Dst, ids)
+		if err != nil {
+			return nil, nil, err
+		}
+		if set != nil {
+			sets = append(sets, set)
+		}
+		re = append(re, e...)
+	}
+	if l4.ICMP != nil {
+		e, set, err := processICMP(l4.L4Proto, l4.ICMP, ids)
 		if err != nil {
 			return nil, nil, err
 		}
@@ -43,22 +60,39 @@ func createL4(family nftables.TableFamily, rule *Rule) ([]expr.Any, []*nfSet, er
 	return re, sets, nil
 }
 
+// hasPorts returns true if the header of the l4 protocol starts with 2 bytes of source port followed
+// by 2 bytes of destination port. Protocols are told apart by meta l4proto, so ports are matched the
+// same way in ip, ip6 and inet tables.
+func hasPorts(proto uint8) bool {
+	switch proto {
+	case unix.IPPROTO_TCP, unix.IPPROTO_UDP, unix.IPPROTO_UDPLITE, unix.IPPROTO_SCTP, unix.IPPROTO_DCCP:
+		return true
+	}
+
+	return false
+}
+
 // processPort process one of the possible port sources and returns required expressions,
 // dynamically generated set or error.
-func processPort(proto uint8, offset uint32, port *Port) ([]expr.Any, *nfSet, error) {
+func processPort(proto uint8, offset uint32, port *Port, ids IDGenerator) ([]expr.Any, *nfSet, error) {
 	re := []expr.Any{}
 	e := []expr.Any{}
 	var set *nfSet
 	var err error
 
-	// Port has three possible sources: List, Range or a reference to already existing Set/Map or VMap
+	// Port has three possible sources: List, Range or Ranges or a reference to already existing Set/Map or VMap
 	switch {
+	case len(port.Ranges) != 0 || len(port.Exclude) != 0:
+		e, set, err = processPortIntervals(proto, offset, port, ids)
+		if err != nil {
+			return nil, nil, err
+		}
 	case len(port.List) != 0:
-		e, set, err = processPortList(proto, offset, port.List, port.RelOp)
+		e, set, err = processPortList(proto, offset, port.List, port.RelOp, ids)
 		if err != nil {
 			return nil, nil, err
 		}
-	case port.Range[0] != nil && port.Range[1] != nil:
+	case portRange(port.Range).isSet():
 		e, set, err = processPortRange(proto, offset, port.Range, port.RelOp)
 		if err != nil {
 			return nil, nil, err
@@ -78,7 +112,7 @@ func processPort(proto uint8, offset uint32, port *Port) ([]expr.Any, *nfSet, er
 	return re, set, nil
 }
 
-func processPortList(l4proto uint8, offset uint32, port []*uint16, op Operator) ([]expr.Any, *nfSet, error) {
+func processPortList(l4proto uint8, offset uint32, port []uint16, op Operator, ids IDGenerator) ([]expr.Any, *nfSet, error) {
 	// Processing multiple ports case
 	re := []expr.Any{}
 	var nfset *nfSet
@@ -88,13 +122,16 @@ func processPortList(l4proto uint8, offset uint32, port []*uint16, op Operator)
 		set = &nftables.Set{}
 		set.Anonymous = false
 		set.Constant = true
-		set.Name = getSetName()
-		set.ID = uint32(rand.Intn(0xffff))
+		set.Name = ids.Name()
+		set.ID = ids.SetID()
 
 		se := make([]nftables.SetElement, len(port))
+		// Keys of all elements share a single allocation
+		keys := make([]byte, 2*len(port))
 		// Normal case, more than 1 entry in the port list need to build SetElement slice
 		for i := 0; i < len(port); i++ {
-			se[i].Key = binaryutil.BigEndian.PutUint16(*port[i])
+			se[i].Key = keys[2*i : 2*i+2 : 2*i+2]
+			binary.BigEndian.PutUint16(se[i].Key, port[i])
 		}
 		nfset.set = set
 		nfset.elements = se
@@ -107,10 +144,98 @@ func processPortList(l4proto uint8, offset uint32, port []*uint16, op Operator)
 	return re, nfset, nil
 }
 
-func processPortRange(l4proto uint8, offset uint32, port [2]*uint16, op Operator) ([]expr.Any, *nfSet, error) {
+func processPortRange(l4proto uint8, offset uint32, port [2]uint16, op Operator) ([]expr.Any, *nfSet, error) {
 	re, err := getExprForRangePort(l4proto, offset, port, op)
 	if err != nil {
 		return nil, nil, err
 	}
 	return re, nil, nil
 }
+
+// processPortIntervals compiles Range and Ranges with Exclude carved out of them into an interval set
+// and returns expressions looking up the port in the set.
+func processPortIntervals(l4proto uint8, offset uint32, port *Port, ids IDGenerator) ([]expr.Any, *nfSet, error) {
+	if err := port.Validate(); err != nil {
+		return nil, nil, err
+	}
+	ranges := port.Ranges
+	if portRange(port.Range).isSet() {
+		ranges = append([][2]uint16{port.Range}, ranges...)
+	}
+	intervals := buildPortIntervals(ranges, port.Exclude)
+	if len(intervals) == 0 {
+		return nil, nil, fmt.Errorf("no ports left after exclusion")
+	}
+	set := &nftables.Set{
+		Constant: true,
+		Interval: true,
+		Name:     ids.Name(),
+		ID:       ids.SetID(),
+		KeyType:  nftables.TypeInetService,
+	}
+	re, err := getExprForPortSet(l4proto, offset, &SetRef{Name: set.Name, ID: set.ID}, port.RelOp)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return re, &nfSet{set: set, elements: buildPortIntervalElements(intervals)}, nil
+}
+
+// buildPortIntervals merges overlapping and adjacent port ranges and carves excluded ranges
+// out of them, resulting inclusive intervals are sorted and do not overlap.
+func buildPortIntervals(ranges, exclude [][2]uint16) [][2]uint32 {
+	merged := mergePortRanges(ranges)
+	for _, ex := range mergePortRanges(exclude) {
+		carved := make([][2]uint32, 0, len(merged)+1)
+		for _, r := range merged {
+			if ex[1] < r[0] || ex[0] > r[1] {
+				carved = append(carved, r)
+				continue
+			}
+			if ex[0] > r[0] {
+				carved = append(carved, [2]uint32{r[0], ex[0] - 1})
+			}
+			if ex[1] < r[1] {
+				carved = append(carved, [2]uint32{ex[1] + 1, r[1]})
+			}
+		}
+		merged = carved
+	}
+
+	return merged
+}
+
+func mergePortRanges(ranges [][2]uint16) [][2]uint32 {
+	sorted := make([][2]uint32, 0, len(ranges))
+	for _, r := range ranges {
+		sorted = append(sorted, [2]uint32{uint32(r[0]), uint32(r[1])})
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i][0] < sorted[j][0] })
+	merged := make([][2]uint32, 0, len(sorted))
+	for _, r := range sorted {
+		if l := len(merged) - 1; l >= 0 && r[0] <= merged[l][1]+1 {
+			if r[1] > merged[l][1] {
+				merged[l][1] = r[1]
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+
+	return merged
+}
+
+// buildPortIntervalElements returns interval set elements for the intervals, each interval is
+// represented by its first port and an end marker carrying the port following the interval.
+// An interval reaching port 65535 does not have the end marker.
+func buildPortIntervalElements(intervals [][2]uint32) []nftables.SetElement {
+	se := make([]nftables.SetElement, 0, len(intervals)*2)
+	for _, i := range intervals {
+		se = append(se, nftables.SetElement{Key: binaryutil.BigEndian.PutUint16(uint16(i[0]))})
+		if i[1] < 0xffff {
+			se = append(se, nftables.SetElement{Key: binaryutil.BigEndian.PutUint16(uint16(i[1] + 1)), IntervalEnd: true})
+		}
+	}
+
+	return se
+}
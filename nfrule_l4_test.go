@@ -0,0 +1,358 @@
+package nftableslib
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+func portElement(port uint16, end bool) nftables.SetElement {
+	return nftables.SetElement{Key: binaryutil.BigEndian.PutUint16(port), IntervalEnd: end}
+}
+
+func TestPortIntervals(t *testing.T) {
+	tests := []struct {
+		name     string
+		ranges   [][2]uint16
+		exclude  [][2]uint16
+		elements []nftables.SetElement
+	}{
+		{
+			name:    "Disjoint ranges with a single port excluded",
+			ranges:  [][2]uint16{{5000, 6000}, {1000, 2000}},
+			exclude: [][2]uint16{{1500, 1500}},
+			elements: []nftables.SetElement{
+				portElement(1000, false), portElement(1500, true),
+				portElement(1501, false), portElement(2001, true),
+				portElement(5000, false), portElement(6001, true),
+			},
+		},
+		{
+			name:   "Overlapping and adjacent ranges are merged",
+			ranges: [][2]uint16{{1000, 2000}, {1500, 2500}, {2501, 3000}},
+			elements: []nftables.SetElement{
+				portElement(1000, false), portElement(3001, true),
+			},
+		},
+		{
+			name:    "Exclusion covering range boundaries",
+			ranges:  [][2]uint16{{1000, 2000}, {3000, 4000}},
+			exclude: [][2]uint16{{900, 1100}, {1900, 3100}},
+			elements: []nftables.SetElement{
+				portElement(1101, false), portElement(1900, true),
+				portElement(3101, false), portElement(4001, true),
+			},
+		},
+		{
+			name:    "Range reaching the last port does not have end marker",
+			ranges:  [][2]uint16{{60000, 65535}},
+			exclude: [][2]uint16{{65000, 65000}},
+			elements: []nftables.SetElement{
+				portElement(60000, false), portElement(65000, true),
+				portElement(65001, false),
+			},
+		},
+	}
+	for _, tt := range tests {
+		got := buildPortIntervalElements(buildPortIntervals(tt.ranges, tt.exclude))
+		if !reflect.DeepEqual(got, tt.elements) {
+			t.Errorf("Test \"%s\" failed, expected elements %v, got %v", tt.name, tt.elements, got)
+		}
+	}
+}
+
+func TestPortRangesValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		port    *Port
+		success bool
+	}{
+		{
+			name:    "Multiple ranges with exclusion",
+			port:    &Port{Ranges: [][2]uint16{{1000, 2000}, {5000, 6000}}, Exclude: [][2]uint16{{1500, 1500}}},
+			success: true,
+		},
+		{
+			name:    "Range combined with ranges",
+			port:    &Port{Range: [2]uint16{1, 10}, Ranges: [][2]uint16{{20, 30}}},
+			success: true,
+		},
+		{
+			name:    "Inverted range",
+			port:    &Port{Ranges: [][2]uint16{{2000, 1000}}},
+			success: false,
+		},
+		{
+			name:    "Inverted exclusion",
+			port:    &Port{Range: [2]uint16{1000, 2000}, Exclude: [][2]uint16{{1600, 1500}}},
+			success: false,
+		},
+		{
+			name:    "Exclusion without ranges",
+			port:    &Port{List: []uint16{80}, Exclude: [][2]uint16{{80, 80}}},
+			success: false,
+		},
+		{
+			name:    "List combined with ranges",
+			port:    &Port{List: []uint16{80}, Ranges: [][2]uint16{{1000, 2000}}},
+			success: false,
+		},
+	}
+	for _, tt := range tests {
+		err := tt.port.Validate()
+		if tt.success && err != nil {
+			t.Errorf("Test \"%s\" failed with error: \"%+v\" but supposed to succeed", tt.name, err)
+			continue
+		}
+		if !tt.success && err == nil {
+			t.Errorf("Test \"%s\" succeeded but supposed to fail", tt.name)
+		}
+	}
+}
+
+func TestPortRangesExpressions(t *testing.T) {
+	e, set, err := processPort(unix.IPPROTO_TCP, 2, &Port{
+		Ranges:  [][2]uint16{{1000, 2000}, {5000, 6000}},
+		Exclude: [][2]uint16{{1500, 1500}},
+		RelOp:   NEQ,
+	}, defaultIDs)
+	if err != nil {
+		t.Fatalf("failed to process port ranges with error: %+v", err)
+	}
+	if set == nil || !set.set.Interval || set.set.KeyType != nftables.TypeInetService {
+		t.Fatalf("expected interval set of inet_service type")
+	}
+	if len(set.elements) != 6 {
+		t.Fatalf("expected 6 interval elements, got %d", len(set.elements))
+	}
+	l, ok := e[len(e)-1].(*expr.Lookup)
+	if !ok || l.SetName != set.set.Name || !l.Invert {
+		t.Fatalf("expected inverted lookup in set %s as the last expression", set.set.Name)
+	}
+	for _, ex := range e {
+		if _, ok := ex.(*expr.Range); ok {
+			t.Fatalf("port ranges must not generate range comparison")
+		}
+	}
+}
+
+func TestICMPExpressions(t *testing.T) {
+	code := uint8(4)
+	tests := []struct {
+		name    string
+		proto   uint8
+		icmp    *ICMP
+		exprs   []expr.Any
+		set     []nftables.SetElement
+		success bool
+	}{
+		{
+			name:  "Single type",
+			proto: unix.IPPROTO_ICMP,
+			icmp:  &ICMP{Types: []uint8{ICMPEchoRequest}},
+			exprs: []expr.Any{
+				&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+				&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{unix.IPPROTO_ICMP}},
+				&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 0, Len: 1},
+				&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{ICMPEchoRequest}},
+			},
+			success: true,
+		},
+		{
+			name:  "Type and code",
+			proto: unix.IPPROTO_ICMP,
+			icmp:  &ICMP{Types: []uint8{ICMPDestUnreachable}, Code: &code},
+			exprs: []expr.Any{
+				&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+				&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{unix.IPPROTO_ICMP}},
+				&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 0, Len: 1},
+				&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{ICMPDestUnreachable}},
+				&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 1, Len: 1},
+				&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{code}},
+			},
+			success: true,
+		},
+		{
+			name:  "Excluded list of ICMPv6 types",
+			proto: unix.IPPROTO_ICMPV6,
+			icmp:  &ICMP{Types: []uint8{ICMPv6EchoRequest, ICMPv6EchoReply}, RelOp: NEQ},
+			exprs: []expr.Any{
+				&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+				&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{unix.IPPROTO_ICMPV6}},
+				&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 0, Len: 1},
+				&expr.Lookup{SourceRegister: 1, Invert: true},
+			},
+			set:     []nftables.SetElement{{Key: []byte{ICMPv6EchoRequest}}, {Key: []byte{ICMPv6EchoReply}}},
+			success: true,
+		},
+		{
+			name:    "Greater than for list of types",
+			proto:   unix.IPPROTO_ICMP,
+			icmp:    &ICMP{Types: []uint8{ICMPEchoRequest, ICMPEchoReply}, RelOp: GT},
+			success: false,
+		},
+		{
+			name:    "Not ICMP protocol",
+			proto:   unix.IPPROTO_TCP,
+			icmp:    &ICMP{Types: []uint8{ICMPEchoRequest}},
+			success: false,
+		},
+		{
+			name:    "Neither types nor code",
+			proto:   unix.IPPROTO_ICMP,
+			icmp:    &ICMP{},
+			success: false,
+		},
+	}
+	for _, tt := range tests {
+		re, set, err := processICMP(tt.proto, tt.icmp, defaultIDs)
+		if err != nil && tt.success {
+			t.Fatalf("test \"%s\" failed with error: %+v but supposed to succeed", tt.name, err)
+		}
+		if err == nil && !tt.success {
+			t.Fatalf("test \"%s\" succeeded but supposed to fail", tt.name)
+		}
+		if !tt.success {
+			continue
+		}
+		if set != nil {
+			keyType := TypeICMPType
+			if tt.proto == unix.IPPROTO_ICMPV6 {
+				keyType = TypeICMPv6Type
+			}
+			if set.set.KeyType != keyType || !reflect.DeepEqual(set.elements, tt.set) {
+				t.Fatalf("test \"%s\" failed, expected set of %s with elements %v, got set of %s with %v", tt.name, keyType.Name, tt.set, set.set.KeyType.Name, set.elements)
+			}
+			// Set name and id are generated
+			l := re[len(re)-1].(*expr.Lookup)
+			if l.SetName != set.set.Name || l.SetID != set.set.ID {
+				t.Fatalf("test \"%s\" failed, lookup does not refer to set %s", tt.name, set.set.Name)
+			}
+			l.SetName, l.SetID = "", 0
+		} else if tt.set != nil {
+			t.Fatalf("test \"%s\" failed, expected set of types", tt.name)
+		}
+		if !reflect.DeepEqual(re, tt.exprs) {
+			t.Fatalf("test \"%s\" failed, expected expressions %+v, got %+v", tt.name, tt.exprs, re)
+		}
+	}
+}
+
+func TestPortHelpers(t *testing.T) {
+	tests := []struct {
+		name    string
+		call    func() (interface{}, error)
+		result  interface{}
+		success bool
+	}{
+		{
+			name:    "List of ints",
+			call:    func() (interface{}, error) { return SetPortList([]int{0, 80, 65535}) },
+			result:  []uint16{0, 80, 65535},
+			success: true,
+		},
+		{
+			name: "Negative port in list",
+			call: func() (interface{}, error) { return SetPortList([]int{80, -1}) },
+		},
+		{
+			name: "Port above 65535 in list",
+			call: func() (interface{}, error) { return SetPortList([]int{65536}) },
+		},
+		{
+			name:    "List of ports",
+			call:    func() (interface{}, error) { return SetPortList16([]uint16{0, 80, 65535}) },
+			result:  []uint16{0, 80, 65535},
+			success: true,
+		},
+		{
+			name: "Duplicate port in list",
+			call: func() (interface{}, error) { return SetPortList16([]uint16{80, 443, 80}) },
+		},
+		{
+			name: "Empty list",
+			call: func() (interface{}, error) { return SetPortList16(nil) },
+		},
+		{
+			name: "Duplicate port in Port list",
+			call: func() (interface{}, error) { return nil, (&Port{List: []uint16{80, 443, 80}}).Validate() },
+		},
+		{
+			name:    "Range of ints",
+			call:    func() (interface{}, error) { return SetPortRange([2]int{1024, 65535}) },
+			result:  [2]uint16{1024, 65535},
+			success: true,
+		},
+		{
+			name: "Port above 65535 in range",
+			call: func() (interface{}, error) { return SetPortRange([2]int{1024, 70000}) },
+		},
+		{
+			name: "Inverted range",
+			call: func() (interface{}, error) { return SetPortRange16([2]uint16{2000, 1000}) },
+		},
+		{
+			name: "Range 0-0",
+			call: func() (interface{}, error) { return SetPortRange16([2]uint16{}) },
+		},
+		{
+			name: "Inverted Port range",
+			call: func() (interface{}, error) { return nil, (&Port{Range: [2]uint16{2000, 1000}}).Validate() },
+		},
+		{
+			name:    "Ranges of ints",
+			call:    func() (interface{}, error) { return SetPortRanges([][2]int{{1, 10}, {20, 20}}) },
+			result:  [][2]uint16{{1, 10}, {20, 20}},
+			success: true,
+		},
+		{
+			name: "Negative port in ranges",
+			call: func() (interface{}, error) { return SetPortRanges([][2]int{{1, 10}, {-20, 20}}) },
+		},
+		{
+			name:    "Ranges of ports",
+			call:    func() (interface{}, error) { return SetPortRanges16([][2]uint16{{1, 10}, {20, 20}}) },
+			result:  [][2]uint16{{1, 10}, {20, 20}},
+			success: true,
+		},
+		{
+			name: "Inverted range in ranges",
+			call: func() (interface{}, error) { return SetPortRanges16([][2]uint16{{1, 10}, {20, 2}}) },
+		},
+	}
+	for _, tt := range tests {
+		result, err := tt.call()
+		if tt.success && err != nil {
+			t.Errorf("Test \"%s\" failed with error: %+v but supposed to succeed", tt.name, err)
+			continue
+		}
+		if !tt.success && err == nil {
+			t.Errorf("Test \"%s\" succeeded but supposed to fail", tt.name)
+			continue
+		}
+		if tt.success && !reflect.DeepEqual(result, tt.result) {
+			t.Errorf("Test \"%s\" failed, expected %v, got %v", tt.name, tt.result, result)
+		}
+	}
+}
+
+func BenchmarkPortList(b *testing.B) {
+	ports := make([]uint16, 4096)
+	for i := range ports {
+		ports[i] = uint16(1024 + i)
+	}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		list, err := SetPortList16(ports)
+		if err != nil {
+			b.Fatalf("failed to build port list with error: %+v", err)
+		}
+		if _, _, err := processPort(unix.IPPROTO_TCP, 2, &Port{List: list}, defaultIDs); err != nil {
+			b.Fatalf("failed to process port list with error: %+v", err)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package nftableslib
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+// MaxWeightedLoadbalanceModulus defines the largest numgen modulus of weighted load balancing, numgen
+// produces values in host byte order while the kernel compares keys of interval maps bytewise, keys up to
+// 255, including the end of the last interval, keep the bytewise order equal to the numeric order.
+const MaxWeightedLoadbalanceModulus = 255
+
+// DefaultWeightedLoadbalanceModulus defines numgen modulus for weights expressed in percents
+const DefaultWeightedLoadbalanceModulus = 100
+
+// WeightedChain defines a chain receiving a share of the load balanced traffic proportional to its weight,
+// a chain with weight 0 does not receive any traffic.
+type WeightedChain struct {
+	Chain  string
+	Weight int
+}
+
+// WeightIntervals splits numgen output range [0, modulus) into consecutive intervals proportional
+// to the weights, the interval of weight i is [intervals[i][0], intervals[i][1]), it is empty for weight 0.
+// Weights are scaled to the modulus, slots left after scaling go to weights with the largest remainders.
+func WeightIntervals(weights []int, modulus uint32) ([][2]uint32, error) {
+	if modulus == 0 || modulus > MaxWeightedLoadbalanceModulus {
+		return nil, fmt.Errorf("invalid weighted loadbalancing modulus %d, it must be in range 1-%d", modulus, MaxWeightedLoadbalanceModulus)
+	}
+	total := uint64(0)
+	for i, w := range weights {
+		if w < 0 {
+			return nil, fmt.Errorf("weight %d of backend %d is negative", w, i)
+		}
+		total += uint64(w)
+	}
+	if total == 0 {
+		return nil, fmt.Errorf("at least one weight must be positive")
+	}
+	slots := make([]uint64, len(weights))
+	remainders := make([]uint64, len(weights))
+	left := uint64(modulus)
+	for i, w := range weights {
+		slots[i] = uint64(w) * uint64(modulus) / total
+		remainders[i] = uint64(w) * uint64(modulus) % total
+		left -= slots[i]
+	}
+	order := make([]int, len(weights))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return remainders[order[i]] > remainders[order[j]]
+	})
+	for _, i := range order {
+		if left == 0 {
+			break
+		}
+		if remainders[i] == 0 {
+			continue
+		}
+		slots[i]++
+		left--
+	}
+	intervals := make([][2]uint32, len(weights))
+	lo := uint32(0)
+	for i, w := range weights {
+		if w != 0 && slots[i] == 0 {
+			return nil, fmt.Errorf("weight %d of backend %d is too small to get a share of modulus %d", w, i, modulus)
+		}
+		intervals[i] = [2]uint32{lo, lo + uint32(slots[i])}
+		lo += uint32(slots[i])
+	}
+
+	return intervals, nil
+}
+
+// MakeWeightedLoadbalanceElements returns elements of the interval verdict map used by weighted load
+// balancing, each interval of numgen output is mapped to the verdict reaching the chain.
+// action parameter defines whether unix.NFT_JUMP (default) or unix.NFT_GOTO is used to reach the chain.
+func MakeWeightedLoadbalanceElements(chains []*WeightedChain, modulus uint32, action int) ([]nftables.SetElement, error) {
+	if len(chains) == 0 {
+		return nil, fmt.Errorf("number of chains for loadbalancing cannot be 0")
+	}
+	weights := make([]int, len(chains))
+	for i, c := range chains {
+		if c == nil || c.Chain == "" {
+			return nil, fmt.Errorf("chain %d for loadbalancing does not have a name", i)
+		}
+		weights[i] = c.Weight
+	}
+	intervals, err := WeightIntervals(weights, modulus)
+	if err != nil {
+		return nil, err
+	}
+	kind := expr.VerdictKind(unix.NFT_JUMP)
+	if action == unix.NFT_GOTO {
+		kind = expr.VerdictKind(unix.NFT_GOTO)
+	}
+	elements := make([]nftables.SetElement, 0, len(chains)*2)
+	for i, in := range intervals {
+		if in[0] == in[1] {
+			continue
+		}
+		elements = append(elements,
+			nftables.SetElement{
+				Key:         binaryutil.NativeEndian.PutUint32(in[0]),
+				VerdictData: &expr.Verdict{Kind: kind, Chain: chains[i].Chain},
+			},
+			nftables.SetElement{
+				Key:         binaryutil.NativeEndian.PutUint32(in[1]),
+				IntervalEnd: true,
+			},
+		)
+	}
+
+	return elements, nil
+}
@@ -0,0 +1,150 @@
+package nftableslib
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+func TestWeightIntervals(t *testing.T) {
+	tests := []struct {
+		name      string
+		weights   []int
+		modulus   uint32
+		intervals [][2]uint32
+		success   bool
+	}{
+		{
+			name:      "Percents",
+			weights:   []int{70, 30},
+			modulus:   100,
+			intervals: [][2]uint32{{0, 70}, {70, 100}},
+			success:   true,
+		},
+		{
+			name:      "Weights scaled to modulus",
+			weights:   []int{7, 3},
+			modulus:   100,
+			intervals: [][2]uint32{{0, 70}, {70, 100}},
+			success:   true,
+		},
+		{
+			name:      "Equal weights, left slot goes to the first weight",
+			weights:   []int{1, 1, 1},
+			modulus:   100,
+			intervals: [][2]uint32{{0, 34}, {34, 67}, {67, 100}},
+			success:   true,
+		},
+		{
+			name:      "Left slots go to the largest remainders",
+			weights:   []int{1, 2, 4},
+			modulus:   10,
+			intervals: [][2]uint32{{0, 1}, {1, 4}, {4, 10}},
+			success:   true,
+		},
+		{
+			name:      "Zero weight gets empty interval",
+			weights:   []int{5, 0, 3},
+			modulus:   8,
+			intervals: [][2]uint32{{0, 5}, {5, 5}, {5, 8}},
+			success:   true,
+		},
+		{
+			name:      "Largest modulus",
+			weights:   []int{1, 1},
+			modulus:   MaxWeightedLoadbalanceModulus,
+			intervals: [][2]uint32{{0, 128}, {128, 255}},
+			success:   true,
+		},
+		{
+			name:    "Weight too small for modulus",
+			weights: []int{1, 1000},
+			modulus: 100,
+		},
+		{
+			name:    "Negative weight",
+			weights: []int{10, -1},
+			modulus: 100,
+		},
+		{
+			name:    "All weights are zero",
+			weights: []int{0, 0},
+			modulus: 100,
+		},
+		{
+			name:    "Modulus exceeding a single byte key",
+			weights: []int{1, 1},
+			modulus: 256,
+		},
+	}
+	for _, tt := range tests {
+		intervals, err := WeightIntervals(tt.weights, tt.modulus)
+		if tt.success && err != nil {
+			t.Errorf("Test \"%s\" failed with error: \"%+v\" but supposed to succeed", tt.name, err)
+			continue
+		}
+		if !tt.success {
+			if err == nil {
+				t.Errorf("Test \"%s\" succeeded but supposed to fail", tt.name)
+			}
+			continue
+		}
+		if !reflect.DeepEqual(intervals, tt.intervals) {
+			t.Errorf("Test \"%s\" failed, expected intervals %v, got %v", tt.name, tt.intervals, intervals)
+		}
+	}
+}
+
+func TestWeightedLoadbalanceElements(t *testing.T) {
+	elements, err := MakeWeightedLoadbalanceElements([]*WeightedChain{
+		{Chain: "backend-a", Weight: 60},
+		{Chain: "backend-b", Weight: 0},
+		{Chain: "backend-c", Weight: 40},
+	}, DefaultWeightedLoadbalanceModulus, unix.NFT_GOTO)
+	if err != nil {
+		t.Fatalf("failed to make elements with error: %+v", err)
+	}
+	goTo := func(chain string) *expr.Verdict {
+		return &expr.Verdict{Kind: expr.VerdictKind(unix.NFT_GOTO), Chain: chain}
+	}
+	want := []nftables.SetElement{
+		{Key: binaryutil.NativeEndian.PutUint32(0), VerdictData: goTo("backend-a")},
+		{Key: binaryutil.NativeEndian.PutUint32(60), IntervalEnd: true},
+		{Key: binaryutil.NativeEndian.PutUint32(60), VerdictData: goTo("backend-c")},
+		{Key: binaryutil.NativeEndian.PutUint32(100), IntervalEnd: true},
+	}
+	if !reflect.DeepEqual(elements, want) {
+		t.Fatalf("expected elements %+v, got %+v", want, elements)
+	}
+	if _, err := MakeWeightedLoadbalanceElements([]*WeightedChain{{Weight: 1}}, 100, unix.NFT_JUMP); err == nil {
+		t.Fatalf("chain without name supposed to fail")
+	}
+}
+
+func TestWeightedLoadbalanceAction(t *testing.T) {
+	if _, err := SetWeightedLoadbalance(nil, 100, unix.NFT_NG_RANDOM); err == nil {
+		t.Fatalf("weighted loadbalancing without map supposed to fail")
+	}
+	if _, err := SetWeightedLoadbalance(&SetRef{Name: "lb"}, 0, unix.NFT_NG_RANDOM); err == nil {
+		t.Fatalf("weighted loadbalancing with modulus 0 supposed to fail")
+	}
+	ra, err := SetWeightedLoadbalance(&SetRef{Name: "lb", ID: 7, IsMap: true}, 100, unix.NFT_NG_INCREMENTAL)
+	if err != nil {
+		t.Fatalf("failed to build weighted loadbalancing action with error: %+v", err)
+	}
+	e, err := getExprForLoadbalance(&nfRules{}, ra.loadbalance)
+	if err != nil {
+		t.Fatalf("failed to build weighted loadbalancing expressions with error: %+v", err)
+	}
+	want := []expr.Any{
+		&expr.Numgen{Register: 1, Modulus: 100, Type: unix.NFT_NG_INCREMENTAL},
+		&expr.Lookup{SourceRegister: 1, IsDestRegSet: true, SetID: 7, SetName: "lb"},
+	}
+	if !reflect.DeepEqual(e, want) {
+		t.Fatalf("expected expressions %+v, got %+v", want, e)
+	}
+}
@@ -0,0 +1,109 @@
+package nftableslib
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sort"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+)
+
+// MakeMarkMapElements returns interval elements of the map of prefixes of the address family to marks,
+// elements are ordered by the prefix. Marks are stored in host byte order, the lookup copies them
+// to the register meta mark is set from. Overlapping prefixes are rejected as the kernel does not accept them.
+func MakeMarkMapElements(family nftables.TableFamily, marks map[string]uint32) ([]nftables.SetElement, error) {
+	if family != nftables.TableFamilyIPv4 && family != nftables.TableFamilyIPv6 {
+		return nil, fmt.Errorf("unsupported address family %s of mark map", familyName(family))
+	}
+	type entry struct {
+		prefix *net.IPNet
+		mark   uint32
+	}
+	entries := make([]entry, 0, len(marks))
+	for p, mark := range marks {
+		prefix, err := parseIntervalPrefix(p, "mark map")
+		if err != nil {
+			return nil, err
+		}
+		if (len(prefix.IP) == net.IPv4len) != (family == nftables.TableFamilyIPv4) {
+			return nil, fmt.Errorf("prefix %s does not belong to address family %s", p, familyName(family))
+		}
+		entries = append(entries, entry{prefix: prefix, mark: mark})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return bytes.Compare(entries[i].prefix.IP, entries[j].prefix.IP) < 0
+	})
+	elements := make([]nftables.SetElement, 0, 2*len(entries))
+	var end []byte
+	for i, e := range entries {
+		if i > 0 && bytes.Compare(e.prefix.IP, end) < 0 {
+			return nil, fmt.Errorf("prefix %s overlaps prefix %s", e.prefix.String(), entries[i-1].prefix.String())
+		}
+		end = lastKey(e.prefix)
+		elements = append(elements,
+			nftables.SetElement{Key: []byte(e.prefix.IP), Val: binaryutil.NativeEndian.PutUint32(e.mark)},
+			nftables.SetElement{Key: end, IntervalEnd: true},
+		)
+	}
+
+	return elements, nil
+}
+
+// getExprForMarkMap returns expressions looking up the packet's key in the map and setting the mark
+// to the found value, the key and the value share the register.
+func getExprForMarkMap(nfr *nfRules, m *markMap) ([]expr.Any, error) {
+	re := []expr.Any{}
+	var keyType nftables.SetDatatype
+	switch m.match {
+	case MatchTypeL3Src, MatchTypeL3Dst:
+		var offset, addrLen uint32
+		switch nfr.table.Family {
+		case nftables.TableFamilyIPv4:
+			offset, addrLen, keyType = 12, 4, nftables.TypeIPAddr
+		case nftables.TableFamilyIPv6:
+			offset, addrLen, keyType = 8, 16, nftables.TypeIP6Addr
+		default:
+			return nil, fmt.Errorf("mark map %s keyed by address is not supported in table family %s", m.set, familyName(nfr.table.Family))
+		}
+		if m.match == MatchTypeL3Dst {
+			offset += addrLen
+		}
+		// [ payload load 4b @ network header + 16 => reg 1 ]
+		re = append(re, &expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: offset, Len: addrLen})
+	case MatchTypeL4Src, MatchTypeL4Dst:
+		offset := uint32(0)
+		if m.match == MatchTypeL4Dst {
+			offset = 2
+		}
+		keyType = nftables.TypeInetService
+		// [ payload load 2b @ transport header + 2 => reg 1 ]
+		re = append(re, &expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: offset, Len: 2})
+	default:
+		return nil, fmt.Errorf("unsupported key %d of mark map %s", m.match, m.set)
+	}
+	var id uint32
+	if nfr.chains != nil && nfr.chains.sets != nil {
+		if set, ok := nfr.chains.sets.get(m.set); ok {
+			if !set.IsMap || set.KeyType.GetNFTMagic() != keyType.GetNFTMagic() ||
+				set.DataType.GetNFTMagic() != nftables.TypeMark.GetNFTMagic() {
+				return nil, fmt.Errorf("set %s of the table is not a map of %s to %s", m.set, keyType.Name, nftables.TypeMark.Name)
+			}
+			id = set.ID
+		}
+	}
+	// [ lookup reg 1 set prefix_marks dreg 1 ]
+	// [ meta set mark with reg 1 ]
+	re = append(re, &expr.Lookup{
+		SourceRegister: 1,
+		DestRegister:   1,
+		IsDestRegSet:   true,
+		SetID:          id,
+		SetName:        m.set,
+	})
+	re = append(re, &expr.Meta{Key: expr.MetaKeyMARK, Register: 1, SourceRegister: true})
+
+	return re, nil
+}
@@ -0,0 +1,829 @@
+package nftableslib
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+// CloneOptions defines transforms CloneRule applies to the copy of the rule
+type CloneOptions struct {
+	// DropAddresses removes source and destination address matches of the L3 section,
+	// addresses of NAT actions are kept.
+	DropAddresses bool
+	// Address is called for every address of L3 matches and NAT actions which is not dropped,
+	// the returned address replaces it. Masked addresses are not mapped, the mask defines their meaning.
+	Address func(*IPAddr) (*IPAddr, error)
+	// Family converts fields specific to IPv4 or IPv6 to the family: the IP version, meta nfproto,
+	// ICMP protocol and types and address datatypes of concatenations. 0 keeps the fields as they are.
+	Family nftables.TableFamily
+	// Targets rewrites chains targeted by jump and goto verdicts, chains not in the map are kept
+	Targets map[string]string
+}
+
+// icmpv6Types maps ICMP types to ICMPv6 types of the same meaning
+var icmpv6Types = map[uint8]uint8{
+	ICMPEchoReply:        ICMPv6EchoReply,
+	ICMPDestUnreachable:  ICMPv6DestUnreachable,
+	ICMPEchoRequest:      ICMPv6EchoRequest,
+	ICMPTimeExceeded:     ICMPv6TimeExceeded,
+	ICMPParameterProblem: ICMPv6ParameterProblem,
+}
+
+// CloneRule returns a deep copy of the rule with transforms of opts applied, the copy does not share
+// pointers, slices or maps with the rule, so either of them can be changed without affecting the other.
+func CloneRule(r *Rule, opts CloneOptions) (*Rule, error) {
+	if r == nil {
+		return nil, fmt.Errorf("rule cannot be nil")
+	}
+	c := r.clone()
+	if len(opts.Targets) != 0 {
+		c.rewriteTargets(opts.Targets)
+	}
+	if opts.DropAddresses && c.L3 != nil {
+		c.L3.Src, c.L3.Dst = nil, nil
+	}
+	if opts.Address != nil {
+		if err := c.mapAddresses(opts.Address); err != nil {
+			return nil, err
+		}
+	}
+	if opts.Family != 0 {
+		if err := c.convertFamily(opts.Family); err != nil {
+			return nil, err
+		}
+	}
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func (r *Rule) clone() *Rule {
+	c := *r
+	c.Concat = r.Concat.clone()
+	c.Dynamic = r.Dynamic.clone()
+	c.MatchAct = r.MatchAct.clone()
+	if r.Fib != nil {
+		fib := *r.Fib
+		fib.Data = cloneBytes(r.Fib.Data)
+		c.Fib = &fib
+	}
+	c.L3 = r.L3.clone()
+	c.L4 = r.L4.clone()
+	c.L2 = r.L2.clone()
+	c.ARP = r.ARP.clone()
+	if r.Conntracks != nil {
+		c.Conntracks = make([]*Conntrack, len(r.Conntracks))
+		for i, ct := range r.Conntracks {
+			if ct != nil {
+				c.Conntracks[i] = &Conntrack{Key: ct.Key, Value: cloneBytes(ct.Value), RelOp: ct.RelOp}
+			}
+		}
+	}
+	c.Meta = r.Meta.clone()
+	if r.Log != nil {
+		c.Log = &Log{Key: r.Log.Key, Value: cloneBytes(r.Log.Value)}
+	}
+	c.Counter = r.Counter.clone()
+	if r.Limit != nil {
+		limit := *r.Limit
+		c.Limit = &limit
+	}
+	if r.RawExprs != nil {
+		c.RawExprs = make([]expr.Any, len(r.RawExprs))
+		for i, e := range r.RawExprs {
+			c.RawExprs[i] = cloneExpr(e)
+		}
+	}
+	c.Action = r.Action.clone()
+	if r.Actions != nil {
+		c.Actions = make([]*RuleAction, len(r.Actions))
+		for i, a := range r.Actions {
+			c.Actions[i] = a.clone()
+		}
+	}
+	c.UserData = cloneBytes(r.UserData)
+
+	return &c
+}
+
+func (c *Concat) clone() *Concat {
+	if c == nil {
+		return nil
+	}
+	n := *c
+	if c.Elements != nil {
+		n.Elements = make([]*ConcatElement, len(c.Elements))
+		for i, e := range c.Elements {
+			if e != nil {
+				ce := *e
+				ce.EMask = cloneBytes(e.EMask)
+				n.Elements[i] = &ce
+			}
+		}
+	}
+	n.SetRef = c.SetRef.clone()
+	if c.Intervals != nil {
+		n.Intervals = make([][]*ConcatRange, len(c.Intervals))
+		for i, interval := range c.Intervals {
+			if interval == nil {
+				continue
+			}
+			n.Intervals[i] = make([]*ConcatRange, len(interval))
+			for j, cr := range interval {
+				if cr != nil {
+					n.Intervals[i][j] = &ConcatRange{From: cloneBytes(cr.From), To: cloneBytes(cr.To)}
+				}
+			}
+		}
+	}
+
+	return &n
+}
+
+func (d *Dynamic) clone() *Dynamic {
+	if d == nil {
+		return nil
+	}
+	n := *d
+	n.SetRef = d.SetRef.clone()
+
+	return &n
+}
+
+func (m *MatchAct) clone() *MatchAct {
+	if m == nil {
+		return nil
+	}
+	n := *m
+	n.MatchRef = m.MatchRef.clone()
+	if m.ActElement != nil {
+		n.ActElement = make(map[int]*RuleAction, len(m.ActElement))
+		for k, a := range m.ActElement {
+			n.ActElement[k] = a.clone()
+		}
+	}
+
+	return &n
+}
+
+func (s *SetRef) clone() *SetRef {
+	if s == nil {
+		return nil
+	}
+	n := *s
+
+	return &n
+}
+
+func (l *L3Rule) clone() *L3Rule {
+	if l == nil {
+		return nil
+	}
+	n := *l
+	n.Src = l.Src.clone()
+	n.Dst = l.Dst.clone()
+	n.Version = cloneUint8(l.Version)
+	n.Protocol = cloneUint32(l.Protocol)
+	n.Options = cloneBool(l.Options)
+	n.Counter = l.Counter.clone()
+	n.Inner = l.Inner.clone()
+
+	return &n
+}
+
+func (s *IPAddrSpec) clone() *IPAddrSpec {
+	if s == nil {
+		return nil
+	}
+	n := *s
+	if s.List != nil {
+		n.List = make([]*IPAddr, len(s.List))
+		for i, a := range s.List {
+			n.List[i] = a.clone()
+		}
+	}
+	n.Range = [2]*IPAddr{s.Range[0].clone(), s.Range[1].clone()}
+	n.SetRef = s.SetRef.clone()
+	if s.Masked != nil {
+		n.Masked = &MaskedAddr{Mask: s.Masked.Mask.clone(), Value: s.Masked.Value.clone()}
+	}
+
+	return &n
+}
+
+func (ip *IPAddr) clone() *IPAddr {
+	if ip == nil {
+		return nil
+	}
+	n := *ip
+	if ip.IPAddr != nil {
+		n.IPAddr = &net.IPAddr{IP: net.IP(cloneBytes(ip.IPAddr.IP)), Zone: ip.IPAddr.Zone}
+	}
+	n.Mask = cloneUint8(ip.Mask)
+
+	return &n
+}
+
+func (l *L4Rule) clone() *L4Rule {
+	if l == nil {
+		return nil
+	}
+	n := *l
+	n.Src = l.Src.clone()
+	n.Dst = l.Dst.clone()
+	if l.ICMP != nil {
+		icmp := *l.ICMP
+		icmp.Types = cloneBytes(l.ICMP.Types)
+		icmp.Code = cloneUint8(l.ICMP.Code)
+		n.ICMP = &icmp
+	}
+	n.Counter = l.Counter.clone()
+	n.Inner = l.Inner.clone()
+
+	return &n
+}
+
+func (p *Port) clone() *Port {
+	if p == nil {
+		return nil
+	}
+	n := *p
+	if p.List != nil {
+		n.List = append([]uint16{}, p.List...)
+	}
+	if p.Ranges != nil {
+		n.Ranges = append([][2]uint16{}, p.Ranges...)
+	}
+	if p.Exclude != nil {
+		n.Exclude = append([][2]uint16{}, p.Exclude...)
+	}
+	n.SetRef = p.SetRef.clone()
+
+	return &n
+}
+
+func clonePortRange(r [2]*uint16) [2]*uint16 {
+	return [2]*uint16{cloneUint16(r[0]), cloneUint16(r[1])}
+}
+
+func (l *L2Rule) clone() *L2Rule {
+	if l == nil {
+		return nil
+	}
+	n := *l
+	n.Src = net.HardwareAddr(cloneBytes(l.Src))
+	n.Dst = net.HardwareAddr(cloneBytes(l.Dst))
+	n.EtherType = cloneUint16(l.EtherType)
+	n.VLAN = l.VLAN.clone()
+	n.ServiceVLAN = l.ServiceVLAN.clone()
+
+	return &n
+}
+
+func (v *VLANTag) clone() *VLANTag {
+	if v == nil {
+		return nil
+	}
+
+	return &VLANTag{ID: cloneUint16(v.ID), PCP: cloneUint8(v.PCP)}
+}
+
+func (a *ARPRule) clone() *ARPRule {
+	if a == nil {
+		return nil
+	}
+	n := *a
+	n.HType = cloneUint16(a.HType)
+	n.PType = cloneUint16(a.PType)
+	n.Operation = cloneUint16(a.Operation)
+	n.SAddr = a.SAddr.clone()
+	n.TAddr = a.TAddr.clone()
+	n.SHAddr = net.HardwareAddr(cloneBytes(a.SHAddr))
+	n.THAddr = net.HardwareAddr(cloneBytes(a.THAddr))
+	if a.Set != nil {
+		n.Set = &ARPSet{
+			Operation:  cloneUint16(a.Set.Operation),
+			SAddr:      net.IP(cloneBytes(a.Set.SAddr)),
+			TAddr:      net.IP(cloneBytes(a.Set.TAddr)),
+			SHAddr:     net.HardwareAddr(cloneBytes(a.Set.SHAddr)),
+			THAddr:     net.HardwareAddr(cloneBytes(a.Set.THAddr)),
+			EtherSAddr: net.HardwareAddr(cloneBytes(a.Set.EtherSAddr)),
+			EtherDAddr: net.HardwareAddr(cloneBytes(a.Set.EtherDAddr)),
+		}
+	}
+
+	return &n
+}
+
+func (m *MetaRule) clone() *MetaRule {
+	if m == nil {
+		return nil
+	}
+	n := *m
+	if m.Mark != nil {
+		mark := *m.Mark
+		n.Mark = &mark
+	}
+	if m.NFProto != nil {
+		family := *m.NFProto
+		n.NFProto = &family
+	}
+	n.L4Proto = cloneUint8(m.L4Proto)
+	n.IIFName = cloneString(m.IIFName)
+	n.OIFName = cloneString(m.OIFName)
+	n.IIF = cloneUint32(m.IIF)
+	n.OIF = cloneUint32(m.OIF)
+	for _, s := range []**IfNameSet{&n.IIFNameSet, &n.OIFNameSet} {
+		if *s != nil {
+			set := **s
+			set.SetRef = set.SetRef.clone()
+			*s = &set
+		}
+	}
+	n.PktType = cloneUint8(m.PktType)
+	n.Length = cloneUint32(m.Length)
+	n.SKUID = cloneUint32(m.SKUID)
+	n.SKGID = cloneUint32(m.SKGID)
+	if m.Expr != nil {
+		n.Expr = make([]MetaExpr, len(m.Expr))
+		for i, e := range m.Expr {
+			n.Expr[i] = MetaExpr{Key: e.Key, Value: cloneBytes(e.Value), RelOp: e.RelOp}
+		}
+	}
+
+	return &n
+}
+
+func (h *InnerHeader) clone() *InnerHeader {
+	if h == nil {
+		return nil
+	}
+	n := *h
+
+	return &n
+}
+
+func (c *Counter) clone() *Counter {
+	if c == nil {
+		return nil
+	}
+	n := *c
+
+	return &n
+}
+
+func (ra *RuleAction) clone() *RuleAction {
+	if ra == nil {
+		return nil
+	}
+	n := &RuleAction{}
+	if ra.verdict != nil {
+		v := *ra.verdict
+		n.verdict = &v
+	}
+	if ra.redirect != nil {
+		r := *ra.redirect
+		n.redirect = &r
+	}
+	if ra.masq != nil {
+		n.masq = &masquerade{
+			random:      cloneBool(ra.masq.random),
+			fullyRandom: cloneBool(ra.masq.fullyRandom),
+			persistent:  cloneBool(ra.masq.persistent),
+			toPort:      clonePortRange(ra.masq.toPort),
+		}
+	}
+	if ra.nat != nil {
+		n.nat = &nat{
+			nattype:     ra.nat.nattype,
+			random:      cloneBool(ra.nat.random),
+			fullyRandom: cloneBool(ra.nat.fullyRandom),
+			persistent:  cloneBool(ra.nat.persistent),
+			address:     ra.nat.address.clone(),
+			port:        ra.nat.port.clone(),
+		}
+	}
+	if ra.reject != nil {
+		r := *ra.reject
+		n.reject = &r
+	}
+	if ra.loadbalance != nil {
+		lb := *ra.loadbalance
+		if ra.loadbalance.chains != nil {
+			lb.chains = append([]string{}, ra.loadbalance.chains...)
+		}
+		lb.setRef = ra.loadbalance.setRef.clone()
+		n.loadbalance = &lb
+	}
+	n.dnatMap = ra.dnatMap.clone()
+	if ra.inline != nil {
+		n.inline = make([]*Rule, len(ra.inline))
+		for i, r := range ra.inline {
+			n.inline[i] = r.clone()
+		}
+	}
+	if ra.queue != nil {
+		q := *ra.queue
+		n.queue = &q
+	}
+	n.counter = ra.counter.clone()
+	if ra.log != nil {
+		n.log = &Log{Key: ra.log.Key, Value: cloneBytes(ra.log.Value)}
+	}
+	if ra.mark != nil {
+		m := *ra.mark
+		n.mark = &m
+	}
+	n.nftrace = ra.nftrace
+	n.ctMark = cloneUint32(ra.ctMark)
+	if ra.markMap != nil {
+		m := *ra.markMap
+		n.markMap = &m
+	}
+	n.ctExpectation = ra.ctExpectation
+
+	return n
+}
+
+// cloneExpr copies the expression, slices, pointers and maps it carries are copied as well
+func cloneExpr(e expr.Any) expr.Any {
+	v := reflect.ValueOf(e)
+	if v.Kind() != reflect.Ptr || v.IsNil() {
+		return e
+	}
+	c := reflect.New(v.Elem().Type())
+	c.Elem().Set(v.Elem())
+	deepCopyValue(c.Elem())
+
+	return c.Interface().(expr.Any)
+}
+
+// deepCopyValue replaces slices, pointers and maps reachable through exported fields of the value
+// with their copies
+func deepCopyValue(v reflect.Value) {
+	switch v.Kind() {
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if f := v.Field(i); f.CanSet() {
+				deepCopyValue(f)
+			}
+		}
+	case reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			deepCopyValue(v.Index(i))
+		}
+	case reflect.Slice:
+		if v.IsNil() {
+			return
+		}
+		c := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		reflect.Copy(c, v)
+		for i := 0; i < c.Len(); i++ {
+			deepCopyValue(c.Index(i))
+		}
+		v.Set(c)
+	case reflect.Ptr:
+		if v.IsNil() {
+			return
+		}
+		c := reflect.New(v.Elem().Type())
+		c.Elem().Set(v.Elem())
+		deepCopyValue(c.Elem())
+		v.Set(c)
+	case reflect.Map:
+		if v.IsNil() {
+			return
+		}
+		c := reflect.MakeMapWithSize(v.Type(), v.Len())
+		for _, k := range v.MapKeys() {
+			e := reflect.New(v.Type().Elem()).Elem()
+			e.Set(v.MapIndex(k))
+			deepCopyValue(e)
+			c.SetMapIndex(k, e)
+		}
+		v.Set(c)
+	case reflect.Interface:
+		if v.IsNil() {
+			return
+		}
+		e := reflect.New(v.Elem().Type()).Elem()
+		e.Set(v.Elem())
+		deepCopyValue(e)
+		v.Set(e)
+	}
+}
+
+// rewriteTargets replaces chains targeted by verdicts of the rule's actions
+func (r *Rule) rewriteTargets(targets map[string]string) {
+	actions := append([]*RuleAction{}, r.actions()...)
+	if r.MatchAct != nil {
+		for _, a := range r.MatchAct.ActElement {
+			actions = append(actions, a)
+		}
+	}
+	for _, a := range actions {
+		if a == nil {
+			continue
+		}
+		if v := a.verdict; v != nil && (v.Kind == expr.VerdictJump || v.Kind == expr.VerdictGoto) {
+			if t, ok := targets[v.Chain]; ok {
+				v.Chain = t
+			}
+		}
+		if lb := a.loadbalance; lb != nil {
+			for i, c := range lb.chains {
+				if t, ok := targets[c]; ok {
+					lb.chains[i] = t
+				}
+			}
+		}
+		for _, inline := range a.inline {
+			inline.rewriteTargets(targets)
+		}
+	}
+}
+
+// addressSpecs returns address specs of L3 matches and of the NAT action
+func (r *Rule) addressSpecs() []*IPAddrSpec {
+	specs := make([]*IPAddrSpec, 0, 3)
+	if r.L3 != nil {
+		specs = append(specs, r.L3.Src, r.L3.Dst)
+	}
+	if action := r.action(); action != nil && action.nat != nil {
+		specs = append(specs, action.nat.address)
+	}
+
+	return specs
+}
+
+func (r *Rule) mapAddresses(fn func(*IPAddr) (*IPAddr, error)) error {
+	apply := func(a **IPAddr) error {
+		if *a == nil {
+			return nil
+		}
+		mapped, err := fn(*a)
+		if err != nil {
+			return err
+		}
+		if mapped == nil {
+			return fmt.Errorf("address %s is mapped to nil", (*a).IPAddr)
+		}
+		*a = mapped
+		return nil
+	}
+	for _, s := range r.addressSpecs() {
+		if s == nil {
+			continue
+		}
+		for i := range s.List {
+			if err := apply(&s.List[i]); err != nil {
+				return err
+			}
+		}
+		for i := range s.Range {
+			if err := apply(&s.Range[i]); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// convertFamily converts fields specific to IPv4 or IPv6 to the family
+func (r *Rule) convertFamily(family nftables.TableFamily) error {
+	if family != nftables.TableFamilyIPv4 && family != nftables.TableFamilyIPv6 {
+		return fmt.Errorf("rules can be converted only to ipv4 or ipv6 family")
+	}
+	v6 := family == nftables.TableFamilyIPv6
+	from, to := uint8(unix.IPPROTO_ICMP), uint8(unix.IPPROTO_ICMPV6)
+	if !v6 {
+		from, to = to, from
+	}
+	if r.L3 != nil {
+		if r.L3.Version != nil {
+			*r.L3.Version = 4
+			if v6 {
+				*r.L3.Version = 6
+			}
+		}
+		if r.L3.Protocol != nil && *r.L3.Protocol == uint32(from) {
+			*r.L3.Protocol = uint32(to)
+		}
+	}
+	if r.Meta != nil {
+		if r.Meta.NFProto != nil && (*r.Meta.NFProto == nftables.TableFamilyIPv4 || *r.Meta.NFProto == nftables.TableFamilyIPv6) {
+			*r.Meta.NFProto = family
+		}
+		if r.Meta.L4Proto != nil && *r.Meta.L4Proto == from {
+			*r.Meta.L4Proto = to
+		}
+	}
+	if r.L4 != nil && r.L4.L4Proto == from {
+		r.L4.L4Proto = to
+		if err := convertICMP(r.L4.ICMP, v6); err != nil {
+			return err
+		}
+	}
+	if r.Concat != nil {
+		for _, e := range r.Concat.Elements {
+			switch {
+			case e == nil:
+			case v6 && e.EType.GetNFTMagic() == nftables.TypeIPAddr.GetNFTMagic():
+				e.EType = nftables.TypeIP6Addr
+			case !v6 && e.EType.GetNFTMagic() == nftables.TypeIP6Addr.GetNFTMagic():
+				e.EType = nftables.TypeIPAddr
+			}
+		}
+	}
+	if r.ARP != nil && v6 {
+		return fmt.Errorf("arp rule cannot be converted to ipv6 family")
+	}
+	if action := r.action(); action != nil && action.reject != nil && action.reject.rejectType == unix.NFT_REJECT_ICMP_UNREACH {
+		return fmt.Errorf("reject with family specific icmp code cannot be converted, use icmpx reject type")
+	}
+	for _, s := range r.addressSpecs() {
+		if s == nil {
+			continue
+		}
+		addrs := append(append([]*IPAddr{}, s.List...), s.Range[0], s.Range[1])
+		if s.Masked != nil {
+			addrs = append(addrs, s.Masked.Value)
+		}
+		for _, a := range addrs {
+			if a == nil || a.IPAddr == nil {
+				continue
+			}
+			if (a.IP.To4() != nil) == v6 {
+				return fmt.Errorf("address %s does not belong to the family, drop or map addresses", a.IP)
+			}
+		}
+	}
+
+	return nil
+}
+
+// convertICMP converts ICMP types to ICMPv6 types or back, types without a counterpart are rejected
+func convertICMP(icmp *ICMP, v6 bool) error {
+	if icmp == nil {
+		return nil
+	}
+	if icmp.Code != nil {
+		return fmt.Errorf("icmp code %d cannot be converted to the other family", *icmp.Code)
+	}
+	for i, t := range icmp.Types {
+		converted, ok := t, false
+		for v4type, v6type := range icmpv6Types {
+			if v6 && t == v4type {
+				converted, ok = v6type, true
+			}
+			if !v6 && t == v6type {
+				converted, ok = v4type, true
+			}
+		}
+		if !ok {
+			return fmt.Errorf("icmp type %d cannot be converted to the other family", t)
+		}
+		icmp.Types[i] = converted
+	}
+
+	return nil
+}
+
+func cloneBytes(b []byte) []byte {
+	if b == nil {
+		return nil
+	}
+
+	return append([]byte{}, b...)
+}
+
+func cloneBool(p *bool) *bool {
+	if p == nil {
+		return nil
+	}
+	v := *p
+
+	return &v
+}
+
+func cloneUint8(p *uint8) *uint8 {
+	if p == nil {
+		return nil
+	}
+	v := *p
+
+	return &v
+}
+
+func cloneUint16(p *uint16) *uint16 {
+	if p == nil {
+		return nil
+	}
+	v := *p
+
+	return &v
+}
+
+func cloneUint32(p *uint32) *uint32 {
+	if p == nil {
+		return nil
+	}
+	v := *p
+
+	return &v
+}
+
+func cloneString(p *string) *string {
+	if p == nil {
+		return nil
+	}
+	v := *p
+
+	return &v
+}
+
+// CopyRules copies rules of the chain src to the rules of dst, dst can be a chain of a table of a different
+// family. Rules are read from the host and mapped to the Rule model, transform is called with a copy of
+// every rule and returns the rule to create, or nil to skip it. Copies are programmed in a single
+// transaction, if any of the rules cannot be mapped, transformed or programmed, none is copied.
+func (nfc *nfChains) CopyRules(src string, dst RulesInterface, transform func(*Rule) (*Rule, error)) error {
+	if err := writable(nfc.conn); err != nil {
+		return err
+	}
+	dr, ok := dst.(*nfRules)
+	if !ok {
+		return fmt.Errorf("rules of chain %s cannot be copied to unknown rules implementation", src)
+	}
+	if !nfc.Exist(src) {
+		return fmt.Errorf("chain %s does not exist", src)
+	}
+	var sets auditSets
+	var rules []*auditedRule
+	if err := nfc.opts.readPolicy().do(func() (err error) {
+		if sets, err = getAuditSets(nfc.conn, nfc.table); err != nil {
+			return err
+		}
+		rules, err = getAuditedRules(nfc.conn, nfc.table, &nftables.Chain{Name: src, Table: nfc.table})
+		return err
+	}); err != nil {
+		return err
+	}
+	copies := make([]*Rule, 0, len(rules))
+	for _, r := range rules {
+		ra := auditRule(nfc.table.Family, r.exprs, sets)
+		if ra.Status != AuditMapped {
+			return fmt.Errorf("rule with handle %d of chain %s cannot be copied: %s", r.handle, src, strings.Join(ra.Reasons, ", "))
+		}
+		rule := ra.Rule
+		if transform != nil {
+			var err error
+			if rule, err = transform(rule); err != nil {
+				return fmt.Errorf("failed to transform rule with handle %d of chain %s with error: %+v", r.handle, src, err)
+			}
+			if rule == nil {
+				continue
+			}
+		}
+		if err := rule.Validate(); err != nil {
+			return fmt.Errorf("copy of rule with handle %d of chain %s is invalid: %+v", r.handle, src, err)
+		}
+		copies = append(copies, rule)
+	}
+	ids := make([]uint32, 0, len(copies))
+	// discard removes copies queued so far from the store of dst, they have no handles yet
+	discard := func() {
+		for _, id := range ids {
+			dr.Delete(id)
+		}
+	}
+	for _, rule := range copies {
+		id, err := dr.Create(rule)
+		if err != nil {
+			discard()
+			return err
+		}
+		ids = append(ids, id)
+	}
+	if err := flush(dr.conn); err != nil {
+		discard()
+		return err
+	}
+	dr.Lock()
+	defer dr.Unlock()
+	for _, id := range ids {
+		if _, err := dr.updateHandle(id); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
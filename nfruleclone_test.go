@@ -0,0 +1,367 @@
+package nftableslib
+
+import (
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+// fullRule returns a rule with every pointer, slice and map of the Rule model populated, the rule
+// is not valid, it is used to check that copies do not share memory with the original.
+func fullRule(t *testing.T) *Rule {
+	return fullRuleOf(t, true)
+}
+
+// fullRuleOf returns the full rule, rules of inline jumps are full rules without inline jumps
+func fullRuleOf(t *testing.T, inline bool) *Rule {
+	u8 := func(v uint8) *uint8 { return &v }
+	u16 := func(v uint16) *uint16 { return &v }
+	u32 := func(v uint32) *uint32 { return &v }
+	b := func(v bool) *bool { return &v }
+	s := func(v string) *string { return &v }
+	addr := func(a string) *IPAddr {
+		ip, err := NewIPAddr(a)
+		if err != nil {
+			t.Fatalf("failed to parse address %s with error: %+v", a, err)
+		}
+		return ip
+	}
+	spec := func() *IPAddrSpec {
+		return &IPAddrSpec{
+			List:   []*IPAddr{addr("192.0.2.0/24")},
+			Range:  [2]*IPAddr{addr("192.0.2.1"), addr("192.0.2.9")},
+			SetRef: &SetRef{Name: "addrs"},
+			Masked: &MaskedAddr{Mask: addr("0.0.0.255"), Value: addr("0.0.0.1")},
+		}
+	}
+	port := func() *Port {
+		return &Port{
+			List:    []uint16{80},
+			Range:   [2]uint16{1000, 2000},
+			Ranges:  [][2]uint16{{3000, 4000}},
+			Exclude: [][2]uint16{{3500, 3600}},
+			SetRef:  &SetRef{Name: "ports"},
+		}
+	}
+	hw := net.HardwareAddr{0, 1, 2, 3, 4, 5}
+	family := nftables.TableFamilyIPv4
+	action := func() *RuleAction {
+		ra := &RuleAction{
+			verdict:  &expr.Verdict{Kind: expr.VerdictJump, Chain: "web"},
+			redirect: &redirect{port: 8080},
+			masq: &masquerade{
+				random:      b(true),
+				fullyRandom: b(false),
+				persistent:  b(true),
+				toPort:      [2]*uint16{u16(1024), u16(2048)},
+			},
+			nat: &nat{
+				random:      b(true),
+				fullyRandom: b(false),
+				persistent:  b(true),
+				address:     spec(),
+				port:        port(),
+			},
+			reject: &reject{rejectType: unix.NFT_REJECT_TCP_RST},
+			loadbalance: &loadbalance{
+				chains: []string{"web-1", "web-2"},
+				setRef: &SetRef{Name: "backends"},
+			},
+			dnatMap: &DNATMapAttributes{
+				Name:    "forwards",
+				Targets: map[uint16]*DNATTarget{8080: {Addr: setIPAddr(t, "10.0.0.1")}},
+			},
+			queue:         &queue{num: 1, total: 2},
+			counter:       &Counter{},
+			log:           &Log{Key: unix.NFTA_LOG_PREFIX, Value: []byte("prefix")},
+			mark:          &MetaMark{Set: true, Value: 1},
+			nftrace:       true,
+			ctMark:        u32(1),
+			markMap:       &markMap{set: "marks", match: MatchTypeL4Dst},
+			ctExpectation: "ftp-data",
+		}
+		if inline {
+			ra.inline = []*Rule{fullRuleOf(t, false)}
+		}
+		return ra
+	}
+
+	return &Rule{
+		Concat: &Concat{
+			Elements:  []*ConcatElement{{EType: nftables.TypeIPAddr, EMask: []byte{255, 255, 255, 0}}},
+			SetRef:    &SetRef{Name: "concat"},
+			Intervals: [][]*ConcatRange{{{From: []byte{10, 0, 0, 0}, To: []byte{10, 0, 0, 255}}}},
+		},
+		Dynamic:  &Dynamic{SetRef: &SetRef{Name: "dynamic"}, Timeout: time.Minute},
+		MatchAct: &MatchAct{MatchRef: &SetRef{Name: "match"}, ActElement: map[int]*RuleAction{1: action()}},
+		Fib:      &Fib{ResultOIF: true, Data: []byte{1, 0, 0, 0}},
+		L3: &L3Rule{
+			Src:      spec(),
+			Dst:      spec(),
+			Version:  u8(4),
+			Protocol: u32(unix.IPPROTO_TCP),
+			Options:  b(true),
+			Counter:  &Counter{},
+			Inner:    &InnerHeader{Family: nftables.TableFamilyIPv4},
+		},
+		L4: &L4Rule{
+			L4Proto: unix.IPPROTO_TCP,
+			Src:     port(),
+			Dst:     port(),
+			ICMP:    &ICMP{Types: []byte{ICMPEchoRequest}, Code: u8(0)},
+			Counter: &Counter{},
+			Inner:   &InnerHeader{Family: nftables.TableFamilyIPv4},
+		},
+		L2: &L2Rule{
+			Src:         hw,
+			Dst:         hw,
+			EtherType:   u16(0x0800),
+			VLAN:        &VLANTag{ID: u16(10), PCP: u8(1)},
+			ServiceVLAN: &VLANTag{ID: u16(20), PCP: u8(2)},
+		},
+		ARP: &ARPRule{
+			HType:     u16(1),
+			PType:     u16(0x0800),
+			Operation: u16(1),
+			SAddr:     spec(),
+			TAddr:     spec(),
+			SHAddr:    hw,
+			THAddr:    hw,
+			Set: &ARPSet{
+				Operation:  u16(2),
+				SAddr:      net.ParseIP("192.0.2.1"),
+				TAddr:      net.ParseIP("192.0.2.2"),
+				SHAddr:     hw,
+				THAddr:     hw,
+				EtherSAddr: hw,
+				EtherDAddr: hw,
+			},
+		},
+		Conntracks: []*Conntrack{{Key: unix.NFT_CT_STATE, Value: []byte{2, 0, 0, 0}}},
+		Meta: &MetaRule{
+			Mark:       &MetaMark{Value: 1},
+			NFProto:    &family,
+			L4Proto:    u8(unix.IPPROTO_TCP),
+			IIFName:    s("eth0"),
+			OIFName:    s("eth1"),
+			IIF:        u32(2),
+			OIF:        u32(3),
+			IIFNameSet: &IfNameSet{SetRef: &SetRef{Name: "in"}},
+			OIFNameSet: &IfNameSet{SetRef: &SetRef{Name: "out"}},
+			PktType:    u8(0),
+			Length:     u32(1500),
+			SKUID:      u32(1000),
+			SKGID:      u32(1000),
+			Expr:       []MetaExpr{{Key: unix.NFT_META_PRIORITY, Value: []byte{1, 0, 0, 0}}},
+		},
+		Log:     &Log{Key: unix.NFTA_LOG_PREFIX, Value: []byte("dropped")},
+		Counter: &Counter{},
+		Limit:   &Limit{Rate: 10, Unit: time.Second},
+		RawExprs: []expr.Any{
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{1}},
+			&expr.Bitwise{SourceRegister: 1, DestRegister: 1, Len: 1, Mask: []byte{1}, Xor: []byte{0}},
+		},
+		Action:   action(),
+		Actions:  []*RuleAction{action()},
+		UserData: []byte("user data"),
+	}
+}
+
+// checkNotShared fails if a pointer, a slice or a map reachable from a is shared with b or is not
+// populated, so fields added to the Rule model are covered once the fixture populates them.
+func checkNotShared(t *testing.T, path string, a, b reflect.Value) {
+	// Rules of inline jumps do not carry inline jumps themselves
+	if strings.Contains(path, ".inline[].") && strings.HasSuffix(path, ".inline") {
+		return
+	}
+	switch a.Kind() {
+	case reflect.Ptr, reflect.Slice, reflect.Map:
+		if a.IsNil() || a.Kind() != reflect.Ptr && a.Len() == 0 {
+			t.Fatalf("%s of the fixture is not populated", path)
+		}
+		// Pointers to zero sized values are allowed to be equal
+		if a.Pointer() == b.Pointer() && (a.Kind() != reflect.Ptr || a.Type().Elem().Size() != 0) {
+			t.Fatalf("%s is shared by the rule and its copy", path)
+		}
+	}
+	switch a.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if a.IsNil() {
+			t.Fatalf("%s of the fixture is not populated", path)
+		}
+		checkNotShared(t, path, a.Elem(), b.Elem())
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < a.Len(); i++ {
+			checkNotShared(t, path+"[]", a.Index(i), b.Index(i))
+		}
+	case reflect.Map:
+		for _, k := range a.MapKeys() {
+			checkNotShared(t, path+"{}", a.MapIndex(k), b.MapIndex(k))
+		}
+	case reflect.Struct:
+		for i := 0; i < a.NumField(); i++ {
+			checkNotShared(t, path+"."+a.Type().Field(i).Name, a.Field(i), b.Field(i))
+		}
+	}
+}
+
+func TestCloneRuleNoAliasing(t *testing.T) {
+	r := fullRule(t)
+	c := r.clone()
+	if !reflect.DeepEqual(r, c) {
+		t.Fatalf("copy of the rule is not equal to the rule")
+	}
+	checkNotShared(t, "Rule", reflect.ValueOf(r), reflect.ValueOf(c))
+	// Changing the copy leaves the rule intact
+	c.L3.Src.List[0].IP[0] = 10
+	c.L4.Dst.List[0] = 8080
+	c.Action.nat.address.Range[0].IP[3] = 100
+	c.MatchAct.ActElement[1].loadbalance.chains[0] = "other"
+	c.RawExprs[0].(*expr.Cmp).Data[0] = 2
+	if !reflect.DeepEqual(r, fullRule(t)) {
+		t.Fatalf("changes of the copy affected the rule")
+	}
+}
+
+func TestCloneRule(t *testing.T) {
+	accept, _ := SetVerdict(NFT_ACCEPT)
+	jump, _ := SetVerdict(unix.NFT_JUMP, "v4-web")
+	rejectICMP, _ := SetReject(unix.NFT_REJECT_ICMP_UNREACH, 3)
+	addr := func(a string) *IPAddr {
+		ip, _ := NewIPAddr(a)
+		return ip
+	}
+	v6 := func(a *IPAddr) (*IPAddr, error) {
+		if a.IP.Equal(net.ParseIP("192.0.2.0")) {
+			return addr("2001:db8::/64"), nil
+		}
+		return addr("2001:db8::1"), nil
+	}
+	icmpCode := uint8(1)
+	tests := []struct {
+		name    string
+		rule    *Rule
+		opts    CloneOptions
+		check   func(*Rule) bool
+		success bool
+	}{
+		{
+			name: "Addresses are mapped and jump target is rewritten",
+			rule: &Rule{
+				L3:     &L3Rule{Src: &IPAddrSpec{List: []*IPAddr{addr("192.0.2.0/24")}}},
+				Action: jump,
+			},
+			opts: CloneOptions{Address: v6, Family: nftables.TableFamilyIPv6, Targets: map[string]string{"v4-web": "v6-web"}},
+			check: func(r *Rule) bool {
+				return r.L3.Src.List[0].String() == "2001:db8::/64" && *r.L3.Src.List[0].Mask == 64 &&
+					r.Action.verdict.Chain == "v6-web"
+			},
+			success: true,
+		},
+		{
+			name: "Addresses are dropped",
+			rule: &Rule{
+				L3: &L3Rule{
+					Src:      &IPAddrSpec{List: []*IPAddr{addr("192.0.2.0/24")}},
+					Protocol: func() *uint32 { p := uint32(unix.IPPROTO_ICMP); return &p }(),
+				},
+				Action: accept,
+			},
+			opts: CloneOptions{DropAddresses: true, Family: nftables.TableFamilyIPv6},
+			check: func(r *Rule) bool {
+				return r.L3.Src == nil && *r.L3.Protocol == unix.IPPROTO_ICMPV6
+			},
+			success: true,
+		},
+		{
+			name: "ICMP types are converted",
+			rule: &Rule{
+				L4:     &L4Rule{L4Proto: unix.IPPROTO_ICMP, ICMP: &ICMP{Types: []byte{ICMPEchoRequest, ICMPEchoReply}}},
+				Action: accept,
+			},
+			opts: CloneOptions{Family: nftables.TableFamilyIPv6},
+			check: func(r *Rule) bool {
+				return r.L4.L4Proto == unix.IPPROTO_ICMPV6 && reflect.DeepEqual(r.L4.ICMP.Types, []byte{ICMPv6EchoRequest, ICMPv6EchoReply})
+			},
+			success: true,
+		},
+		{
+			name: "ICMPv6 types are converted back",
+			rule: &Rule{
+				L4:     &L4Rule{L4Proto: unix.IPPROTO_ICMPV6, ICMP: &ICMP{Types: []byte{ICMPv6TimeExceeded}}},
+				Action: accept,
+			},
+			opts: CloneOptions{Family: nftables.TableFamilyIPv4},
+			check: func(r *Rule) bool {
+				return r.L4.L4Proto == unix.IPPROTO_ICMP && r.L4.ICMP.Types[0] == ICMPTimeExceeded
+			},
+			success: true,
+		},
+		{
+			name: "ICMP type without counterpart",
+			rule: &Rule{
+				L4:     &L4Rule{L4Proto: unix.IPPROTO_ICMPV6, ICMP: &ICMP{Types: []byte{ICMPv6NDNeighborSolicit}}},
+				Action: accept,
+			},
+			opts:    CloneOptions{Family: nftables.TableFamilyIPv4},
+			success: false,
+		},
+		{
+			name: "ICMP code",
+			rule: &Rule{
+				L4:     &L4Rule{L4Proto: unix.IPPROTO_ICMP, ICMP: &ICMP{Types: []byte{ICMPDestUnreachable}, Code: &icmpCode}},
+				Action: accept,
+			},
+			opts:    CloneOptions{Family: nftables.TableFamilyIPv6},
+			success: false,
+		},
+		{
+			name: "Address of the other family is kept",
+			rule: &Rule{
+				L3:     &L3Rule{Dst: &IPAddrSpec{List: []*IPAddr{addr("192.0.2.1")}}},
+				Action: accept,
+			},
+			opts:    CloneOptions{Family: nftables.TableFamilyIPv6},
+			success: false,
+		},
+		{
+			name: "Reject with icmp code",
+			rule: &Rule{
+				L4:     &L4Rule{L4Proto: unix.IPPROTO_TCP, Dst: &Port{List: []uint16{22}}},
+				Action: rejectICMP,
+			},
+			opts:    CloneOptions{Family: nftables.TableFamilyIPv6},
+			success: false,
+		},
+		{
+			name:    "Unsupported family",
+			rule:    &Rule{Action: accept},
+			opts:    CloneOptions{Family: nftables.TableFamilyINet},
+			success: false,
+		},
+	}
+	for _, tt := range tests {
+		c, err := CloneRule(tt.rule, tt.opts)
+		if err != nil && tt.success {
+			t.Fatalf("Test \"%s\" failed with error: %+v but supposed to succeed", tt.name, err)
+		}
+		if err == nil && !tt.success {
+			t.Fatalf("Test \"%s\" succeeded but supposed to fail", tt.name)
+		}
+		if !tt.success {
+			continue
+		}
+		if !tt.check(c) {
+			t.Fatalf("Test \"%s\" failed, unexpected copy %+v", tt.name, c)
+		}
+		if c.Action == tt.rule.Action {
+			t.Fatalf("Test \"%s\" failed, action is shared by the rule and its copy", tt.name)
+		}
+	}
+}
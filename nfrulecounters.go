@@ -0,0 +1,188 @@
+package nftableslib
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+)
+
+// RuleCounter carries values of a counter of the rule, Name is set for counter objects the rule
+// refers to and empty for counters of the rule itself.
+type RuleCounter struct {
+	Name    string `json:"name,omitempty"`
+	Packets uint64 `json:"packets"`
+	Bytes   uint64 `json:"bytes"`
+}
+
+// RuleCounters is the JSON object StreamWithCounters writes for every rule carrying counters
+type RuleCounters struct {
+	Family   nftables.TableFamily `json:"family"`
+	Table    string               `json:"table"`
+	Chain    string               `json:"chain"`
+	Handle   uint64               `json:"handle"`
+	Comment  string               `json:"comment,omitempty"`
+	Counters []*RuleCounter       `json:"counters"`
+}
+
+// DumpWithCounters outputs the same json representation of chains as Dump, rules carrying counters
+// or referring to counter objects include current values of the counters. Rules of a chain are
+// read from the host by a single dump, counter objects of the table are listed once.
+func (nfc *nfChains) DumpWithCounters() ([]byte, error) {
+	return nfc.dump(true)
+}
+
+// StreamWithCounters writes RuleCounters of every programmed rule of the store carrying counters to w,
+// objects are separated by new lines. Chains are sorted by name, rules keep their order in the chain,
+// only rules of a single chain are kept in memory at a time.
+func (nfc *nfChains) StreamWithCounters(w io.Writer) error {
+	nfc.Lock()
+	names := make([]string, 0, len(nfc.chains))
+	for name := range nfc.chains {
+		names = append(names, name)
+	}
+	nfc.Unlock()
+	sort.Strings(names)
+	objects := nfc.counterObjects()
+	enc := json.NewEncoder(w)
+	for _, name := range names {
+		nfc.Lock()
+		ch, ok := nfc.chains[name]
+		nfc.Unlock()
+		if !ok {
+			// The chain was deleted meanwhile
+			continue
+		}
+		nfr, ok := ch.RulesInterface.(*nfRules)
+		if !ok {
+			continue
+		}
+		rules, err := nfc.chainCounters(ch.chain, nfr, objects)
+		if err != nil {
+			return err
+		}
+		for _, rc := range rules {
+			if err := enc.Encode(rc); err != nil {
+				return fmt.Errorf("failed to write counters of rule with handle %d of chain %s with error: %+v", rc.Handle, name, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// chainCounters returns RuleCounters of rules of the chain's store carrying counters, rules created
+// by Create and flushed since get their handles first.
+func (nfc *nfChains) chainCounters(c *nftables.Chain, nfr *nfRules, objects func() (map[string]*CounterState, error)) ([]*RuleCounters, error) {
+	if err := nfr.resolvePending(); err != nil {
+		return nil, err
+	}
+	host, err := nfc.hostCounters(c, objects)
+	if err != nil {
+		return nil, err
+	}
+	nfr.Lock()
+	defer nfr.Unlock()
+	rules := make([]*RuleCounters, 0)
+	for _, r := range nfr.dumpRules() {
+		for _, rr := range append([]*nfRule{r}, r.siblings...) {
+			counters, ok := host[rr.rule.Handle]
+			if !ok {
+				continue
+			}
+			rc := &RuleCounters{
+				Family:   nfc.table.Family,
+				Table:    nfc.table.Name,
+				Chain:    c.Name,
+				Handle:   rr.rule.Handle,
+				Counters: counters,
+			}
+			rc.Comment, _ = userDataComment(rr.rule.UserData)
+			rules = append(rules, rc)
+		}
+	}
+
+	return rules, nil
+}
+
+// addCounters sets counters of summaries of rules of the chain
+func (nfc *nfChains) addCounters(c *nftables.Chain, rules []*RuleSummary, objects func() (map[string]*CounterState, error)) error {
+	if len(rules) == 0 {
+		return nil
+	}
+	host, err := nfc.hostCounters(c, objects)
+	if err != nil {
+		return err
+	}
+	for _, rs := range rules {
+		if rs.Handle != 0 {
+			rs.Counters = host[rs.Handle]
+		}
+	}
+
+	return nil
+}
+
+// hostCounters returns counters of rules of the chain programmed on the host by handles of the rules,
+// rules without counters are not returned. Rules are dumped by the library, github.com/google/nftables
+// drops references to counter objects.
+func (nfc *nfChains) hostCounters(c *nftables.Chain, objects func() (map[string]*CounterState, error)) (map[uint64][]*RuleCounter, error) {
+	var rules []*auditedRule
+	if err := nfc.opts.readPolicy().do(func() (err error) {
+		rules, err = getAuditedRules(nfc.conn, nfc.table, c)
+		return err
+	}); err != nil {
+		return nil, fmt.Errorf("failed to get rules of chain %s with error: %+v", c.Name, err)
+	}
+	counters := make(map[uint64][]*RuleCounter)
+	for _, r := range rules {
+		for _, ae := range r.exprs {
+			switch e := ae.expr.(type) {
+			case *expr.Counter:
+				counters[r.handle] = append(counters[r.handle], &RuleCounter{Packets: e.Packets, Bytes: e.Bytes})
+			case *expr.Objref:
+				if ObjectKind(e.Type) != ObjectCounter {
+					continue
+				}
+				objs, err := objects()
+				if err != nil {
+					return nil, err
+				}
+				// Objects deleted after the rules were read are skipped
+				if o, ok := objs[e.Name]; ok {
+					counters[r.handle] = append(counters[r.handle], &RuleCounter{Name: e.Name, Packets: o.Packets, Bytes: o.Bytes})
+				}
+			}
+		}
+	}
+
+	return counters, nil
+}
+
+// counterObjects returns the function listing counter objects of the table by their names, objects
+// are listed once, only when a rule refers to a counter object.
+func (nfc *nfChains) counterObjects() func() (map[string]*CounterState, error) {
+	var counters map[string]*CounterState
+	return func() (map[string]*CounterState, error) {
+		if counters != nil {
+			return counters, nil
+		}
+		var objs []*Object
+		if err := nfc.opts.readPolicy().do(func() (err error) {
+			objs, err = listObjects(nfc.conn, nfc.table)
+			return err
+		}); err != nil {
+			return nil, fmt.Errorf("failed to list objects of table %s with error: %+v", nfc.table.Name, err)
+		}
+		counters = make(map[string]*CounterState)
+		for _, o := range objs {
+			if o.Kind == ObjectCounter && o.Counter != nil {
+				counters[o.Name] = o.Counter
+			}
+		}
+		return counters, nil
+	}
+}
@@ -0,0 +1,189 @@
+package nftableslib
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// RuleGroups keeps groups of rules of a chain ordered by groups' priorities, rules of a group
+// with lower priority precede rules of groups with higher priority, groups of equal priority
+// are ordered as they were declared. Rules are placed by inserting them before or after rules
+// of neighbouring groups, so a group can be updated without touching rules of other groups.
+// Rules of the chain which do not belong to any group are not tracked, they keep their
+// positions relative to each other.
+type RuleGroups struct {
+	ri RulesInterface
+	sync.Mutex
+	groups []*RuleGroup
+}
+
+// RuleGroup is a group of rules of a chain, rules of the group are kept together
+// in the order they were created.
+type RuleGroup struct {
+	name     string
+	priority int
+	groups   *RuleGroups
+	handles  []uint64
+}
+
+// NewRuleGroups returns RuleGroups maintaining groups of rules of the chain
+func NewRuleGroups(ri RulesInterface) *RuleGroups {
+	return &RuleGroups{ri: ri}
+}
+
+// Group declares the group with the priority and returns it, declaring the group once again
+// returns the existing group if the priority matches.
+func (rg *RuleGroups) Group(name string, priority int) (*RuleGroup, error) {
+	rg.Lock()
+	defer rg.Unlock()
+	if name == "" {
+		return nil, fmt.Errorf("rule group name cannot be empty")
+	}
+	for _, g := range rg.groups {
+		if g.name != name {
+			continue
+		}
+		if g.priority != priority {
+			return nil, fmt.Errorf("rule group %s is declared with priority %d", name, g.priority)
+		}
+		return g, nil
+	}
+	g := &RuleGroup{name: name, priority: priority, groups: rg}
+	rg.groups = append(rg.groups, g)
+	sort.SliceStable(rg.groups, func(i, j int) bool {
+		return rg.groups[i].priority < rg.groups[j].priority
+	})
+
+	return g, nil
+}
+
+// Name returns the name of the group
+func (g *RuleGroup) Name() string {
+	return g.name
+}
+
+// Priority returns the priority of the group
+func (g *RuleGroup) Priority() int {
+	return g.priority
+}
+
+// Handles returns handles of rules of the group in the order of the chain
+func (g *RuleGroup) Handles() []uint64 {
+	g.groups.Lock()
+	defer g.groups.Unlock()
+
+	return append([]uint64{}, g.handles...)
+}
+
+// Create programs the rule after the last rule of the group and returns the rule's handle
+func (g *RuleGroup) Create(rule *Rule) (uint64, error) {
+	g.groups.Lock()
+	defer g.groups.Unlock()
+	var after, before uint64
+	if len(g.handles) != 0 {
+		after = g.handles[len(g.handles)-1]
+	} else {
+		after, before = g.groups.neighbours(g)
+	}
+	h, err := g.groups.place(rule, after, before)
+	if err != nil {
+		return 0, err
+	}
+	g.handles = append(g.handles, h)
+
+	return h, nil
+}
+
+// Replace re-renders the group, rules of the group are replaced by the rules passed in the order
+// they are passed. New rules are programmed in place of the old ones before the old ones are
+// removed, rules of other groups are not touched.
+func (g *RuleGroup) Replace(rules []*Rule) error {
+	g.groups.Lock()
+	defer g.groups.Unlock()
+	old := g.handles
+	var after, before uint64
+	if len(old) != 0 {
+		before = old[0]
+	} else {
+		after, before = g.groups.neighbours(g)
+	}
+	created := make([]uint64, 0, len(rules))
+	for _, r := range rules {
+		h, err := g.groups.place(r, after, before)
+		if err != nil {
+			g.handles = append(created, old...)
+			return fmt.Errorf("failed to replace rules of group %s with error: %+v", g.name, err)
+		}
+		created = append(created, h)
+		if before == 0 {
+			after = h
+		}
+	}
+	for i, h := range old {
+		if err := g.groups.ri.Rules().DeleteImm(h); err != nil {
+			g.handles = append(created, old[i:]...)
+			return fmt.Errorf("failed to remove rule %d of group %s with error: %+v", h, g.name, err)
+		}
+	}
+	g.handles = created
+
+	return nil
+}
+
+// Delete removes the rule of the group
+func (g *RuleGroup) Delete(handle uint64) error {
+	g.groups.Lock()
+	defer g.groups.Unlock()
+	for i, h := range g.handles {
+		if h != handle {
+			continue
+		}
+		if err := g.groups.ri.Rules().DeleteImm(h); err != nil {
+			return err
+		}
+		g.handles = append(g.handles[:i], g.handles[i+1:]...)
+		return nil
+	}
+
+	return fmt.Errorf("rule %d does not belong to group %s", handle, g.name)
+}
+
+// neighbours returns the handle of the last rule of groups preceding the group and the handle
+// of the first rule of groups following the group, 0 if such rule does not exist.
+func (rg *RuleGroups) neighbours(g *RuleGroup) (uint64, uint64) {
+	var after, before uint64
+	i := 0
+	for ; rg.groups[i] != g; i++ {
+		if n := len(rg.groups[i].handles); n != 0 {
+			after = rg.groups[i].handles[n-1]
+		}
+	}
+	for i++; i < len(rg.groups); i++ {
+		if len(rg.groups[i].handles) != 0 {
+			before = rg.groups[i].handles[0]
+			break
+		}
+	}
+
+	return after, before
+}
+
+// place programs the rule before the rule with handle before, or if it is 0, after the rule with
+// handle after, if both are 0 the rule is added at the end of the chain.
+func (rg *RuleGroups) place(rule *Rule, after, before uint64) (uint64, error) {
+	if rule == nil {
+		return 0, fmt.Errorf("rule cannot be nil")
+	}
+	if rule.Position != 0 {
+		return 0, fmt.Errorf("position of a rule of a group is defined by the group")
+	}
+	r := *rule
+	if before != 0 {
+		r.Position = int(before)
+		return rg.ri.Rules().InsertImm(&r)
+	}
+	r.Position = int(after)
+
+	return rg.ri.Rules().CreateImm(&r)
+}
@@ -1,16 +1,18 @@
 package nftableslib
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"math"
 	"net"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/google/nftables"
 	"github.com/google/nftables/binaryutil"
 	"github.com/google/nftables/expr"
-	"github.com/google/uuid"
 	"golang.org/x/sys/unix"
 )
 
@@ -31,7 +33,8 @@ const (
 	operationReplace
 )
 
-// RulesInterface defines third level interface operating with nf Rules
+// RulesInterface defines third level interface operating with nf Rules, it is safe for concurrent use.
+// Rules of a chain are locked together while the host is programmed, rules of different chains are not.
 type RulesInterface interface {
 	Rules() RuleFuncs
 }
@@ -50,26 +53,52 @@ type RuleFuncs interface {
 	UpdateRulesHandle() error
 	GetRuleHandle(id uint32) (uint64, error)
 	GetRulesUserData() (map[uint64][]byte, error)
+	CreateWithTTL(*Rule, time.Duration) (uint64, error)
+	ExtendTTL(handle uint64, ttl time.Duration) error
+	CancelTTL(handle uint64) error
+	GetTTL(handle uint64) (time.Duration, error)
+	SetTail(*Rule) (uint64, error)
+	RemoveTail() error
 }
 
 type nfRules struct {
 	conn  NetNS
 	table *nftables.Table
 	chain *nftables.Chain
+	opts  *tableOptions
 	sync.Mutex
 	currentID uint32
 	rules     *nfRule
+	// tail is the rule kept last in the chain, rules created after it are inserted before it
+	tail *nfRule
+	// stats is the counter-only rule kept first in the chain, rules inserted at position 0 are inserted after it
+	stats *nfRule
+	// chains is the store of the table's chains, targets of jumps and gotos are validated against it
+	chains *nfChains
+	// forward carries rules referring to chains which do not exist yet, they are queued by Commit
+	forward []*forwardReference
 }
 
 type nfSet struct {
 	set      *nftables.Set
 	elements []nftables.SetElement
+	// fields carries lengths of elements of concatenated interval sets
+	fields []uint32
+	// normalized reports addresses removed from the address list the set is built from
+	normalized *AddrListNormalized
 }
 
 type nfRule struct {
 	id   uint32
 	rule *nftables.Rule
 	sets []*nfSet
+	// siblings are rules generated from the same Rule, for the other family of inet table or
+	// for other intervals of a concatenation the kernel cannot look up in a set
+	siblings []*nfRule
+	// icmpv6 classifies how the rule treats ICMPv6 neighbor discovery
+	icmpv6 icmpv6Class
+	// inline is the chain of the inline jump bound to the rule
+	inline *inlineChain
 	sync.Mutex
 	next *nfRule
 	prev *nfRule
@@ -92,6 +121,8 @@ func (nfr *nfRules) buildRule(rule *Rule) (*nfRule, error) {
 	e := []expr.Any{}
 	// Some Rule elements can request to skip processing of certain blocks
 	var skipL3, skipL4, skipAction bool
+	var dnatMap *nfSet
+	var inline *inlineChain
 	if rule.Concat != nil {
 		if rule.Concat.VMap {
 			skipL3, skipL4, skipAction = true, true, true
@@ -113,11 +144,55 @@ func (nfr *nfRules) buildRule(rule *Rule) (*nfRule, error) {
 		r.Exprs = append(r.Exprs, e...)
 	}
 	if rule.Fib != nil {
+		if err := rule.Fib.Validate(); err != nil {
+			return nil, err
+		}
 		e := getExprForFib(rule.Fib)
 		r.Exprs = append(r.Exprs, e...)
 	}
+	// Meta matches go before L3 and L4 matches, they guard payload loads in inet tables
+	if rule.Meta != nil {
+		if err := rule.Meta.Validate(); err != nil {
+			return nil, err
+		}
+		r.Exprs = append(r.Exprs, getExprForMetaMatches(rule.Meta)...)
+	}
+	if rule.L2 != nil {
+		if e, err = createL2(nfr.table.Family, rule); err != nil {
+			return nil, err
+		}
+		r.Exprs = append(r.Exprs, e...)
+	}
+	var arpSet []expr.Any
+	if rule.ARP != nil {
+		if e, arpSet, set, err = createARP(nfr.table.Family, rule, nfr.opts.idGenerator()); err != nil {
+			return nil, err
+		}
+		sets = append(sets, set...)
+		r.Exprs = append(r.Exprs, e...)
+	}
+	inner, err := rule.innerHeader(nfr.table.Family)
+	if err != nil {
+		return nil, err
+	}
+	if inner != nil && !(skipL3 && skipL4) {
+		r.Exprs = append(r.Exprs, getExprForInnerGuard(inner, rule.L4 != nil && rule.L4.Inner != nil)...)
+	}
 	if rule.L3 != nil && !skipL3 {
-		if e, set, err = createL3(nfr.table.Family, rule); err != nil {
+		var l3proto nftables.TableFamily
+		if rule.L3.Inner != nil {
+			l3proto = rule.L3.Inner.Family
+		} else if l3proto, err = l3Family(nfr.table.Family, rule); err != nil {
+			return nil, err
+		}
+		// In inet family the L3 header is selected by the nfproto guard
+		if l3proto == nftables.TableFamilyINet && rule.Meta != nil && rule.Meta.NFProto != nil {
+			l3proto = *rule.Meta.NFProto
+		}
+		if e, set, err = createL3(l3proto, rule, nfr.opts.idGenerator()); err != nil {
+			return nil, err
+		}
+		if e, err = shiftInner(rule.L3.Inner, e); err != nil {
 			return nil, err
 		}
 		sets = append(sets, set...)
@@ -125,7 +200,10 @@ func (nfr *nfRules) buildRule(rule *Rule) (*nfRule, error) {
 	}
 
 	if rule.L4 != nil && !skipL4 {
-		if e, set, err = createL4(nfr.table.Family, rule); err != nil {
+		if e, set, err = createL4(nfr.table.Family, rule, nfr.opts.idGenerator()); err != nil {
+			return nil, err
+		}
+		if e, err = shiftInner(rule.L4.Inner, e); err != nil {
 			return nil, err
 		}
 		sets = append(sets, set...)
@@ -137,56 +215,119 @@ func (nfr *nfRules) buildRule(rule *Rule) (*nfRule, error) {
 	if len(r.Exprs) == 0 {
 		r.Exprs = []expr.Any{}
 	}
-	// Check if Meta is specified appending to rule's list of expressions
-	if rule.Meta != nil {
-		switch {
-		case rule.Meta.Mark != nil:
-			r.Exprs = append(r.Exprs, getExprForMetaMark(rule.Meta.Mark)...)
-		case len(rule.Meta.Expr) != 0:
-			r.Exprs = append(r.Exprs, getExprForMetaExpr(rule.Meta.Expr)...)
+	if err := nfr.checkConntrack(rule); err != nil {
+		return nil, err
+	}
+	if len(rule.Conntracks) > 0 {
+		e, err := getExprForConntracks(rule.Conntracks)
+		if err != nil {
+			return nil, err
 		}
+		r.Exprs = append(r.Exprs, e...)
 	}
-	// Check if Meta is specified appending to rule's list of expressions
+	// Rewriting of ARP and ethernet headers is done after all matches
+	r.Exprs = append(r.Exprs, arpSet...)
+	// Setting packet's mark is done after all matches
+	if rule.Meta != nil && rule.Meta.Mark != nil && rule.Meta.Mark.Set {
+		r.Exprs = append(r.Exprs, getExprForMetaMark(rule.Meta.Mark)...)
+	}
+	// Check if Log is specified appending to rule's list of expressions
 	if rule.Log != nil {
 		r.Exprs = append(r.Exprs, getExprForLog(rule.Log)...)
 	}
 
-	if len(rule.Conntracks) > 0 {
-		r.Exprs = append(r.Exprs, getExprForConntracks(rule.Conntracks)...)
+	// Raw expressions are placed after all matches and before the action
+	if len(rule.RawExprs) != 0 {
+		if err := rule.validateRawExprs(); err != nil {
+			return nil, err
+		}
+		r.Exprs = append(r.Exprs, rule.RawExprs...)
+	}
+	if rule.Limit != nil {
+		if err := rule.Limit.Validate(); err != nil {
+			return nil, err
+		}
+		r.Exprs = append(r.Exprs, getExprForLimit(rule.Limit)...)
+	}
+	// The default counter accounts packets matched by the rule
+	if nfr.opts.counters() && !rule.NoCounter && !rule.hasCounter() {
+		r.Exprs = append(r.Exprs, getExprForCounter()...)
 	}
 
-	if rule.Action != nil && !skipAction {
+	if err := rule.validateActions(); err != nil {
+		return nil, err
+	}
+	// Non-terminal actions are applied in the order they are specified followed by the terminal action
+	if !skipAction {
+		for _, a := range rule.actions() {
+			if a.markMap != nil {
+				if e, err = getExprForMarkMap(nfr, a.markMap); err != nil {
+					return nil, err
+				}
+				r.Exprs = append(r.Exprs, e...)
+				continue
+			}
+			r.Exprs = append(r.Exprs, getExprForNonTerminal(a)...)
+		}
+	}
+	if action := rule.action(); action != nil && !skipAction {
 		switch {
-		case rule.Action.redirect != nil:
-			if rule.Action.redirect.tproxy {
-				r.Exprs = append(r.Exprs, getExprForTProxyRedirect(rule.Action.redirect.port, nfr.table.Family)...)
+		case action.redirect != nil:
+			if action.redirect.tproxy {
+				r.Exprs = append(r.Exprs, getExprForTProxyRedirect(action.redirect.port, nfr.table.Family)...)
 			} else {
-				r.Exprs = append(r.Exprs, getExprForRedirect(rule.Action.redirect.port, nfr.table.Family)...)
+				r.Exprs = append(r.Exprs, getExprForRedirect(action.redirect.port, nfr.table.Family)...)
+			}
+		case action.verdict != nil:
+			r.Exprs = append(r.Exprs, action.verdict)
+		case action.inline != nil:
+			var v *expr.Verdict
+			if inline, v, err = nfr.buildInline(action.inline); err != nil {
+				return nil, err
+			}
+			r.Exprs = append(r.Exprs, v)
+		case action.masq != nil:
+			r.Exprs = append(r.Exprs, getExprForMasq(action.masq)...)
+		case action.reject != nil:
+			if err := rule.validateReject(); err != nil {
+				return nil, err
 			}
-		case rule.Action.verdict != nil:
-			r.Exprs = append(r.Exprs, rule.Action.verdict)
-		case rule.Action.masq != nil:
-			r.Exprs = append(r.Exprs, getExprForMasq(rule.Action.masq)...)
-		case rule.Action.reject != nil:
-			r.Exprs = append(r.Exprs, getExprForReject(rule.Action.reject)...)
-		case rule.Action.loadbalance != nil:
-			e, err := getExprForLoadbalance(nfr, rule.Action.loadbalance)
+			r.Exprs = append(r.Exprs, getExprForReject(action.reject)...)
+		case action.queue != nil:
+			r.Exprs = append(r.Exprs, getExprForQueue(action.queue)...)
+		case action.loadbalance != nil:
+			e, err := getExprForLoadbalance(nfr, action.loadbalance)
 			if err != nil {
 				return nil, err
 			}
 			// Adding generated loadbalancing expressions and anonymous set
 			r.Exprs = append(r.Exprs, e...)
-		case rule.Action.nat != nil:
-			e, err = getExprForNAT(nfr.table.Family, rule.Action.nat)
+		case action.nat != nil:
+			e, err = getExprForNAT(nfr.table.Family, action.nat)
 			if err != nil {
 				return nil, err
 			}
 			r.Exprs = append(r.Exprs, e...)
+		case action.dnatMap != nil:
+			if e, dnatMap, err = getExprForDNATMap(nfr, action.dnatMap); err != nil {
+				return nil, err
+			}
+			if dnatMap != nil {
+				sets = append(sets, dnatMap)
+			}
+			r.Exprs = append(r.Exprs, e...)
 		}
 	}
 	if rule.Concat != nil {
-		e, err = getExprForConcat(nfr.table.Family, rule.Concat)
-		if err != nil {
+		if len(rule.Concat.Intervals) != 0 {
+			var s *nfSet
+			if e, s, err = getExprForConcatIntervals(nfr.table.Family, rule.Concat, nfr.opts.idGenerator()); err != nil {
+				return nil, err
+			}
+			if s != nil {
+				sets = append(sets, s)
+			}
+		} else if e, err = getExprForConcat(nfr.table.Family, rule.Concat); err != nil {
 			return nil, err
 		}
 		r.Exprs = append(r.Exprs, e...)
@@ -208,33 +349,110 @@ func (nfr *nfRules) buildRule(rule *Rule) (*nfRule, error) {
 	r.Table = nfr.table
 	r.Chain = nfr.chain
 
+	if err := nfr.checkAddrLists(sets); err != nil {
+		return nil, err
+	}
+	if err := nfr.checkSetReferences(r.Exprs, sets); err != nil {
+		return nil, err
+	}
 	rr := &nfRule{}
 	rr.rule = r
+	rr.inline = inline
 	for _, s := range sets {
 		s.set.Table = nfr.table
-		if err := nfr.conn.AddSet(s.set, s.elements); err != nil {
+		if err := addSet(nfr.conn, s); err != nil {
 			return nil, err
 		}
 		//		s.set.DataLen = len(s.elements)
 		rr.sets = append(rr.sets, s)
 	}
+	// The dnat map is kept in the table's store, so its elements can be changed without touching the rule
+	if dnatMap != nil && nfr.chains != nil && nfr.chains.sets != nil {
+		nfr.chains.sets.store(dnatMap.set)
+	}
 
 	return rr, nil
 }
 
 func (nfr *nfRules) Create(rule *Rule) (uint32, error) {
+	if err := writable(nfr.conn); err != nil {
+		return 0, err
+	}
+	missing, err := nfr.checkTargets(rule, true)
+	if err != nil {
+		return 0, err
+	}
 	nfr.Lock()
 	defer nfr.Unlock()
 
-	return nfr.create(rule, operationAdd)
+	return nfr.create(rule, operationAdd, missing)
 }
 
-func (nfr *nfRules) create(rule *Rule, ruleOp ruleOperation) (uint32, error) {
-	// Process all user specified expressions and return nfRule
-	rr, err := nfr.buildRule(rule)
+// create builds and queues rules generated from the Rule, rules referring to missing chains are held until Commit
+func (nfr *nfRules) create(rule *Rule, ruleOp ruleOperation, missing []string) (uint32, error) {
+	rules, built, err := nfr.build(rule, ruleOp)
 	if err != nil {
 		return 0, err
 	}
+
+	return nfr.queue(rules, built, ruleOp, missing), nil
+}
+
+// build builds rules generated from the Rule without queueing them
+func (nfr *nfRules) build(rule *Rule, ruleOp ruleOperation) ([]*Rule, []*nfRule, error) {
+	rules, err := nfr.split(rule)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := nfr.checkICMPv6(rule, ruleOp == operationInsert && rule.Position == 0, nil); err != nil {
+		return nil, nil, err
+	}
+	// Process all user specified expressions and return nfRule
+	built := make([]*nfRule, 0, len(rules))
+	for _, r := range rules {
+		rr, err := nfr.buildRule(r)
+		if err != nil {
+			return nil, nil, err
+		}
+		rr.icmpv6 = classifyICMPv6(rule)
+		built = append(built, rr)
+	}
+
+	return rules, built, nil
+}
+
+// queue queues built rules and returns the ID of the first one
+func (nfr *nfRules) queue(rules []*Rule, built []*nfRule, ruleOp ruleOperation, missing []string) uint32 {
+	for i, rr := range built {
+		nfr.queueRule(rules[i], rr, ruleOp, missing)
+	}
+	if len(built) > 1 {
+		for i, rr := range built {
+			rr.siblings = make([]*nfRule, 0, len(built)-1)
+			rr.siblings = append(append(rr.siblings, built[:i]...), built[i+1:]...)
+		}
+	}
+
+	return built[0].id
+}
+
+// split returns rules generated from the Rule, rules matching addresses of both families of inet
+// table are split per family, rules matching multiple intervals of a concatenation are split per
+// interval if the kernel does not support concatenated interval sets.
+func (nfr *nfRules) split(rule *Rule) ([]*Rule, error) {
+	rules := []*Rule{rule}
+	if nfr.table.Family == nftables.TableFamilyINet {
+		var err error
+		if rules, err = splitFamilies(rule); err != nil {
+			return nil, err
+		}
+	}
+
+	return nfr.splitConcatIntervals(rules)
+}
+
+// queueRule adds the built rule to the list and pushes it to the connection
+func (nfr *nfRules) queueRule(rule *Rule, rr *nfRule, ruleOp ruleOperation, missing []string) {
 	// Adding nfRule to the list
 	nfr.addRule(rr)
 	if rule.Position != 0 {
@@ -252,6 +470,26 @@ func (nfr *nfRules) create(rule *Rule, ruleOp ruleOperation) (uint32, error) {
 	rr.rule.UserData[ul] = 0x2
 	rr.rule.UserData[ul+1] = 2
 	copy(rr.rule.UserData[ul+2:], binaryutil.BigEndian.PutUint16(uint16(rr.id)))
+	if len(missing) != 0 {
+		nfr.forward = append(nfr.forward, &forwardReference{rule: rr, op: ruleOp, targets: missing})
+		return
+	}
+	nfr.pushRule(rr, ruleOp)
+}
+
+// pushRule pushes the rule to the connection
+func (nfr *nfRules) pushRule(rr *nfRule, ruleOp ruleOperation) {
+	if ruleOp == operationAdd && rr.rule.Position == 0 && nfr.tail != nil && nfr.tail.rule.Handle != 0 {
+		// Appended rules are inserted before the tail rule to keep it last
+		rr.rule.Position = nfr.tail.rule.Handle
+		ruleOp = operationInsert
+	}
+	if ruleOp == operationInsert && rr.rule.Position == 0 && nfr.stats != nil && nfr.stats.rule.Handle != 0 {
+		// Rules inserted at the head of the chain are added after the stats rule to keep it first
+		rr.rule.Position = nfr.stats.rule.Handle
+		ruleOp = operationAdd
+	}
+	nfr.pushInline(rr)
 	// Pushing rule to netlink library to be programmed by Flush()
 	switch ruleOp {
 	case operationAdd:
@@ -259,34 +497,36 @@ func (nfr *nfRules) create(rule *Rule, ruleOp ruleOperation) (uint32, error) {
 	case operationInsert:
 		nfr.conn.InsertRule(rr.rule)
 	}
-
-	return rr.id, nil
 }
 
 func (nfr *nfRules) CreateImm(rule *Rule) (uint64, error) {
-	nfr.Lock()
-	defer nfr.Unlock()
-	id, err := nfr.create(rule, operationAdd)
-	if err != nil {
+	if err := writable(nfr.conn); err != nil {
 		return 0, err
 	}
-	// Programming rule
-	if err := nfr.conn.Flush(); err != nil {
+	if _, err := nfr.checkTargets(rule, false); err != nil {
 		return 0, err
 	}
-	// Getting rule's handle allocated by the kernel
-	handle, err := nfr.GetRuleHandle(id)
+	nfr.Lock()
+	defer nfr.Unlock()
+	id, err := nfr.create(rule, operationAdd, nil)
 	if err != nil {
 		return 0, err
 	}
-	if err := nfr.UpdateRuleHandleByID(id, handle); err != nil {
+	// Programming rule
+	if err := flush(nfr.conn); err != nil {
 		return 0, err
 	}
-
-	return handle, nil
+	// Getting rule's handle allocated by the kernel
+	return nfr.updateHandle(id)
 }
 
 func (nfr *nfRules) delete(id uint32) error {
+	return nfr.remove(id, true)
+}
+
+// remove removes the rule and rules generated along with it from the store, when queue is true
+// deletion of the programmed rules is queued as well.
+func (nfr *nfRules) remove(id uint32, queue bool) error {
 	r, err := getRuleByID(nfr.rules, id)
 	if err != nil {
 		return err
@@ -294,21 +534,52 @@ func (nfr *nfRules) delete(id uint32) error {
 	// If rule's handle is 0, it means it has not been already programmed
 	// then no reason to call netfilter module
 	if r.rule.Handle != 0 {
-		if err := nfr.conn.DelRule(r.rule); err != nil {
+		if queue {
+			if err := nfr.conn.DelRule(r.rule); err != nil {
+				return err
+			}
+		}
+		nfr.opts.scheduler().cancel(nfr, r.rule.Handle)
+	}
+	nfr.dropForwardReference(r.id)
+
+	if err := nfr.removeRule(r.id); err != nil {
+		return err
+	}
+	if nfr.tail == r {
+		nfr.tail = nil
+	}
+	if nfr.stats == r {
+		nfr.stats = nil
+	}
+	// Rules generated from the same Rule are deleted together
+	siblings := r.siblings
+	for _, s := range siblings {
+		s.siblings = nil
+	}
+	r.siblings = nil
+	for _, s := range siblings {
+		if err := nfr.remove(s.id, queue); err != nil {
 			return err
 		}
 	}
 
-	return nfr.removeRule(r.id)
+	return nil
 }
 
 func (nfr *nfRules) Delete(id uint32) error {
+	if err := writable(nfr.conn); err != nil {
+		return err
+	}
 	nfr.Lock()
 	defer nfr.Unlock()
 	return nfr.delete(id)
 }
 
 func (nfr *nfRules) DeleteImm(rh uint64) error {
+	if err := writable(nfr.conn); err != nil {
+		return err
+	}
 	nfr.Lock()
 	defer nfr.Unlock()
 	r, err := getRuleByHandle(nfr.rules, rh)
@@ -319,7 +590,7 @@ func (nfr *nfRules) DeleteImm(rh uint64) error {
 		return err
 	}
 	// Programming rule's deleteion
-	if err := nfr.conn.Flush(); err != nil {
+	if err := flush(nfr.conn); err != nil {
 		return err
 	}
 
@@ -330,40 +601,88 @@ func (nfr *nfRules) DeleteImm(rh uint64) error {
 // the value of position passed in Rule.Position.
 // Example: rule1 has handle of 5, you want to insert rule2 before rule1, then position for rule2 will be 5
 func (nfr *nfRules) Insert(rule *Rule) (uint32, error) {
-	return nfr.create(rule, operationInsert)
+	if err := writable(nfr.conn); err != nil {
+		return 0, err
+	}
+	missing, err := nfr.checkTargets(rule, true)
+	if err != nil {
+		return 0, err
+	}
+	nfr.Lock()
+	defer nfr.Unlock()
+
+	return nfr.create(rule, operationInsert, missing)
 }
 
 func (nfr *nfRules) InsertImm(rule *Rule) (uint64, error) {
-	id, err := nfr.Insert(rule)
-	if err != nil {
+	if err := writable(nfr.conn); err != nil {
 		return 0, err
 	}
-	// Programming rule
-	if err := nfr.conn.Flush(); err != nil {
+	if _, err := nfr.checkTargets(rule, false); err != nil {
 		return 0, err
 	}
-	// Getting rule's handle allocated by the kernel
-	handle, err := nfr.GetRuleHandle(id)
+	nfr.Lock()
+	defer nfr.Unlock()
+	id, err := nfr.create(rule, operationInsert, nil)
 	if err != nil {
 		return 0, err
 	}
-	if err := nfr.UpdateRuleHandleByID(id, handle); err != nil {
+	// Programming rule
+	if err := flush(nfr.conn); err != nil {
 		return 0, err
 	}
-
-	return handle, nil
+	// Getting rule's handle allocated by the kernel
+	return nfr.updateHandle(id)
 }
 
 func (nfr *nfRules) Update(rule *Rule, handle uint64) error {
+	if err := writable(nfr.conn); err != nil {
+		return err
+	}
+	if _, err := nfr.checkTargets(rule, false); err != nil {
+		return err
+	}
+	nfr.Lock()
+	defer nfr.Unlock()
+
+	return nfr.update(rule, handle)
+}
+
+func (nfr *nfRules) update(rule *Rule, handle uint64) error {
+	if err := nfr.replace(rule, handle); err != nil {
+		return err
+	}
+	// Programming Update rule
+	if err := flush(nfr.conn); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// replace builds the rule and queues replacement of the rule with the handle, the replaced rule keeps its ID
+func (nfr *nfRules) replace(rule *Rule, handle uint64) error {
 	nfrule, err := getRuleByHandle(nfr.rules, handle)
 	if err != nil {
 		return err
 	}
+	rules, err := nfr.split(rule)
+	if err != nil {
+		return err
+	}
+	if len(rules) != 1 || len(nfrule.siblings) != 0 {
+		return fmt.Errorf("rule generating multiple rules cannot be updated, delete and create it instead")
+	}
+	if err := nfr.checkICMPv6(rule, false, nfrule); err != nil {
+		return err
+	}
+	rule = rules[0]
 	r, err := nfr.buildRule(rule)
 	if err != nil {
 		return err
 	}
 	r.rule.Handle = handle
+	r.id = nfrule.id
 	ul := len(rule.UserData)
 	// Extra 4 bytes to keep rule ID in userdata during the rule programming interactions.
 	r.rule.UserData = make([]byte, ul+4)
@@ -378,13 +697,13 @@ func (nfr *nfRules) Update(rule *Rule, handle uint64) error {
 	// Updating rule expressions and sets but preserving pointers to prev and next
 	nfrule.rule = r.rule
 	nfrule.sets = r.sets
+	nfrule.icmpv6 = classifyICMPv6(rule)
+	nfrule.inline = r.inline
 
-	// Pushing rule to netlink library to be programmed by Flush()
+	// Pushing rule to netlink library to be programmed by Flush(), the chain bound to the replaced
+	// rule is released by the kernel
+	nfr.pushInline(nfrule)
 	nfr.conn.AddRule(nfrule.rule)
-	// Programming Update rule
-	if err := nfr.conn.Flush(); err != nil {
-		return err
-	}
 
 	return nil
 }
@@ -406,10 +725,32 @@ func (nfr *nfRules) Dump() ([]byte, error) {
 }
 
 func (nfr *nfRules) Sync() error {
-	rules, err := nfr.conn.GetRule(nfr.table, nfr.chain)
-	if err != nil {
+	_, err := nfr.sync()
+	return err
+}
+
+// sync adds rules programmed on the host to the list of rules and returns the number of added rules
+func (nfr *nfRules) sync() (int, error) {
+	var programmed []*nftables.Rule
+	if err := nfr.opts.readPolicy().do(func() (err error) {
+		programmed, err = nfr.conn.GetRule(nfr.table, nfr.chain)
 		return err
+	}); err != nil {
+		return 0, err
+	}
+	rules, err := nfr.applyForeignRulePolicy(nfr.foreignRulePolicy(), programmed)
+	if err != nil {
+		return 0, err
+	}
+	if len(rules) != len(programmed) {
+		// Deletion of removed foreign rules is programmed before rules are loaded
+		if err := flush(nfr.conn); err != nil {
+			return 0, err
+		}
 	}
+	nfr.Lock()
+	empty := nfr.rules == nil
+	nfr.Unlock()
 	for _, rule := range rules {
 		sets := make([]*nfSet, 0)
 		for _, e := range rule.Exprs {
@@ -419,11 +760,11 @@ func (nfr *nfRules) Sync() error {
 			}
 			set, err := nfr.getSet(exp.SetName)
 			if err != nil {
-				return err
+				return 0, err
 			}
 			elements, err := nfr.getSetElements(set)
 			if err != nil {
-				return err
+				return 0, err
 			}
 			// set.DataLen = len(elements)
 			sets = append(sets, &nfSet{set: set, elements: elements})
@@ -434,20 +775,37 @@ func (nfr *nfRules) Sync() error {
 		if len(sets) != 0 {
 			rr.sets = sets
 		}
+		nfr.Lock()
 		nfr.addRule(rr)
+		if isStatsRule(rule.UserData) {
+			nfr.stats = rr
+		}
+		nfr.Unlock()
+		// Expiries of rules created by CreateWithTTL are resumed
+		if expires, ok := userDataExpiry(rule.UserData); ok {
+			if s := nfr.opts.scheduler(); s != nil {
+				s.schedule(nfr, rule.Handle, expires)
+			}
+		}
+	}
+	if empty {
+		nfr.Lock()
+		nfr.adoptRuleIDs()
+		nfr.Unlock()
 	}
 
-	return nil
+	return len(rules), nil
 }
 
 func (nfr *nfRules) getSet(name string) (*nftables.Set, error) {
-	sets, err := nfr.conn.GetSets(nfr.table)
+	sets, err := getSets(nfr.conn, nfr.table)
 	if err != nil {
 		return nil, err
 	}
 	for _, set := range sets {
 		if set.Name == name {
 			set.Table = nfr.table
+			decodeSet(set)
 			return set, nil
 		}
 	}
@@ -467,24 +825,60 @@ func (nfr *nfRules) getSetElements(set *nftables.Set) ([]nftables.SetElement, er
 // UpdateRulesHandle populates rule's handle information with handle value allocated by the kernel.
 // Handle information can be used for further rule's management.
 func (nfr *nfRules) UpdateRulesHandle() error {
+	nfr.Lock()
+	defer nfr.Unlock()
 	r := nfr.rules
 	for ; r != nil; r = r.next {
+		// Foreign rules are loaded from the host with their handles
+		if isForeignRule(r.rule) {
+			continue
+		}
 		handle, err := nfr.GetRuleHandle(r.id)
 		if err != nil {
 			return err
 		}
+		r.Lock()
 		r.rule.Handle = handle
+		r.Unlock()
 	}
 
 	return nil
 }
 
+// UpdateRuleHandleByID sets the handle of the rule specified by its id
 func (nfr *nfRules) UpdateRuleHandleByID(id uint32, handle uint64) error {
+	nfr.Lock()
+	defer nfr.Unlock()
+
+	return nfr.updateRuleHandleByID(id, handle)
+}
+
+// updateHandle sets handles allocated by the kernel to the programmed rule and its siblings,
+// the rule's handle is returned.
+func (nfr *nfRules) updateHandle(id uint32) (uint64, error) {
+	r, err := getRuleByID(nfr.rules, id)
+	if err != nil {
+		return 0, err
+	}
+	for _, rr := range append([]*nfRule{r}, r.siblings...) {
+		handle, err := nfr.GetRuleHandle(rr.id)
+		if err != nil {
+			return 0, err
+		}
+		if err := nfr.updateRuleHandleByID(rr.id, handle); err != nil {
+			return 0, err
+		}
+	}
+
+	return r.rule.Handle, nil
+}
+
+func (nfr *nfRules) updateRuleHandleByID(id uint32, handle uint64) error {
 	r := nfr.rules
 	for ; r != nil; r = r.next {
 		if r.id == id {
-			nfr.rules.Lock()
-			defer nfr.rules.Unlock()
+			r.Lock()
+			defer r.Unlock()
 			r.rule.Handle = handle
 			return nil
 		}
@@ -500,28 +894,79 @@ func (nfr *nfRules) GetRuleHandle(id uint32) (uint64, error) {
 		return 0, err
 	}
 	for _, rule := range rules {
-		if rule.UserData != nil {
-			// Rule ID TLV is stored in last 4 bytes of User data
-			n := make([]byte, 4)
-			// Rule ID TLV 4 bytes:
-			//      [0] - TLV type , must be 0x2
-			//      [1] - Value length, must be 2
-			//      [2:] - 2 bytes carrying Rule ID
-			if rule.UserData[len(rule.UserData)-4] != 0x2 || rule.UserData[len(rule.UserData)-3] != 0x2 {
-				return 0, fmt.Errorf("did not find Rule ID TLV in user data")
-			}
-			// Copy last 2 bytes of user data which carry rule id
-			copy(n[2:], rule.UserData[len(rule.UserData)-2:])
-			ruleID := binaryutil.BigEndian.Uint32(n)
-			if ruleID == id {
-				return rule.Handle, nil
-			}
+		// Foreign rules do not carry rule ID TLV
+		if ruleID, ok := RuleIDFromUserData(rule.UserData); ok && ruleID == id {
+			return rule.Handle, nil
 		}
 	}
 
 	return 0, fmt.Errorf("rule with id %d is not found", id)
 }
 
+// resolveHandles sets handles of rules queued by non immediate operations and flushed since, rules
+// of the host are matched by the rule ID TLV, handles of rules which are still queued remain 0.
+// The caller must hold the lock of the rules.
+func (nfr *nfRules) resolveHandles(programmed []*nftables.Rule) {
+	handles := make(map[uint32]uint64, len(programmed))
+	for _, rule := range programmed {
+		if id, ok := RuleIDFromUserData(rule.UserData); ok {
+			handles[id] = rule.Handle
+		}
+	}
+	for r := nfr.rules; r != nil; r = r.next {
+		if r.rule.Handle != 0 {
+			delete(handles, r.id)
+		}
+	}
+	for r := nfr.rules; r != nil; r = r.next {
+		if h, ok := handles[r.id]; ok && r.rule.Handle == 0 {
+			r.Lock()
+			r.rule.Handle = h
+			r.Unlock()
+		}
+	}
+}
+
+// resolvePending reads rules of the chain from the host and resolves handles of flushed rules
+// when the store carries rules without a handle.
+func (nfr *nfRules) resolvePending() error {
+	nfr.Lock()
+	pending := false
+	for r := nfr.rules; r != nil && !pending; r = r.next {
+		pending = r.rule.Handle == 0
+	}
+	nfr.Unlock()
+	if !pending {
+		return nil
+	}
+	var programmed []*nftables.Rule
+	if err := nfr.opts.readPolicy().do(func() (err error) {
+		programmed, err = nfr.conn.GetRule(nfr.table, nfr.chain)
+		return err
+	}); err != nil {
+		return err
+	}
+	nfr.Lock()
+	defer nfr.Unlock()
+	nfr.resolveHandles(programmed)
+
+	return nil
+}
+
+// RuleIDFromUserData returns the id of the rule programmed by the library, the rule ID TLV
+// is stored in the last 4 bytes of the rule's user data:
+//
+//	[0] - TLV type , must be 0x2
+//	[1] - Value length, must be 2
+//	[2:] - 2 bytes carrying Rule ID
+func RuleIDFromUserData(ud []byte) (uint32, bool) {
+	if len(ud) < 4 || ud[len(ud)-4] != 0x2 || ud[len(ud)-3] != 0x2 {
+		return 0, false
+	}
+
+	return uint32(ud[len(ud)-2])<<8 | uint32(ud[len(ud)-1]), true
+}
+
 func (nfr *nfRules) GetRulesUserData() (map[uint64][]byte, error) {
 	rules, err := nfr.conn.GetRule(nfr.table, nfr.chain)
 	if err != nil {
@@ -532,17 +977,22 @@ func (nfr *nfRules) GetRulesUserData() (map[uint64][]byte, error) {
 		if rule.UserData != nil {
 			// TODO, needs to be tested
 			ud[rule.Handle] = rule.UserData[:len(rule.UserData)-4]
+			if _, ok := userDataExpiry(rule.UserData); ok {
+				ud[rule.Handle] = rule.UserData[:len(rule.UserData)-4-ruleExpirySize]
+			}
 		}
 	}
 
 	return ud, nil
 }
 
-func newRules(conn NetNS, t *nftables.Table, c *nftables.Chain) RulesInterface {
+func newRules(conn NetNS, t *nftables.Table, c *nftables.Chain, opts *tableOptions, chains *nfChains) RulesInterface {
 	return &nfRules{
+		chains:    chains,
 		conn:      conn,
 		table:     t,
 		chain:     c,
+		opts:      opts,
 		currentID: 10,
 		rules:     nil,
 	}
@@ -585,56 +1035,165 @@ type Operator byte
 const (
 	EQ Operator = iota
 	NEQ
+	// GT, GTE, LT and LTE are supported only by matches comparing a single value, like a single port,
+	// lists, ranges and sets of values support only EQ and NEQ.
+	GT
+	GTE
+	LT
+	LTE
 )
 
-// IPAddrSpec lists possible flavours if specifying ip address, either List or Range can be specified
+func (op Operator) String() string {
+	switch op {
+	case EQ:
+		return "eq"
+	case NEQ:
+		return "neq"
+	case GT:
+		return "gt"
+	case GTE:
+		return "gte"
+	case LT:
+		return "lt"
+	case LTE:
+		return "lte"
+	}
+
+	return fmt.Sprintf("operator %d", byte(op))
+}
+
+// ParseRelOp converts the name of relational operator into Operator, besides names returned by String,
+// symbols "==", "=", "!=", ">", ">=", "<", "<=" and short names "ne", "ge", "le" are accepted.
+func ParseRelOp(s string) (Operator, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "eq", "==", "=":
+		return EQ, nil
+	case "neq", "ne", "!=":
+		return NEQ, nil
+	case "gt", ">":
+		return GT, nil
+	case "gte", "ge", ">=":
+		return GTE, nil
+	case "lt", "<":
+		return LT, nil
+	case "lte", "le", "<=":
+		return LTE, nil
+	}
+
+	return EQ, fmt.Errorf("unknown relational operator %q", s)
+}
+
+// ErrUnsupportedOperator is returned when the match cannot implement the relational operator
+type ErrUnsupportedOperator struct {
+	Match string
+	Op    Operator
+}
+
+func (e *ErrUnsupportedOperator) Error() string {
+	return fmt.Sprintf("%s match does not support operator %s", e.Match, e.Op)
+}
+
+// validateRelOp checks that the match supports the operator, relational operators other than
+// EQ and NEQ are supported only by matches comparing a single value.
+func validateRelOp(op Operator, match string, single bool) error {
+	switch {
+	case op == EQ || op == NEQ:
+		return nil
+	case op <= LTE && single:
+		return nil
+	}
+
+	return &ErrUnsupportedOperator{Match: match, Op: op}
+}
+
+// cmpOp returns the comparison implementing the operator, operators are validated
+// before expressions are built.
+func (op Operator) cmpOp() expr.CmpOp {
+	switch op {
+	case NEQ:
+		return expr.CmpOpNeq
+	case GT:
+		return expr.CmpOpGt
+	case GTE:
+		return expr.CmpOpGte
+	case LT:
+		return expr.CmpOpLt
+	case LTE:
+		return expr.CmpOpLte
+	}
+
+	return expr.CmpOpEq
+}
+
+// IPAddrSpec lists possible flavours if specifying ip address, either List, Range or Masked can be specified
 type IPAddrSpec struct {
-	List   []*IPAddr
-	Range  [2]*IPAddr
-	SetRef *SetRef
-	RelOp  Operator
-}
-
-// NewIPAddr is a helper function which converts ip address into IPAddr format
-// required by IPAddrSpec. If CIDR format is specified, Mask will be set to address'
-// subnet mask and CIDR will e set to true
-func NewIPAddr(addr string) (*IPAddr, error) {
-	if _, ipnet, err := net.ParseCIDR(addr); err == nil {
-		// Found a valid CIDR address
-		ones, _ := ipnet.Mask.Size()
-		mask := uint8(ones)
-		return &IPAddr{
-			&net.IPAddr{
-				IP: ipnet.IP,
-			},
-			true,
-			&mask,
-		}, nil
-	}
-	// Check if addr is just ip address in a non CIDR format
-	ip := net.ParseIP(addr)
-	if ip == nil {
-		return nil, fmt.Errorf("%s is invalid ip address", addr)
-	}
-	mask := uint8(32)
-	if ip.To4() == nil {
-		mask = uint8(128)
-	}
-	_, ipnet, err := net.ParseCIDR(addr + "/" + fmt.Sprintf("%d", mask))
-	if err != nil {
-		return nil, err
+	List   []*IPAddr   `json:"list,omitempty"`
+	Range  [2]*IPAddr  `json:"range,omitempty"`
+	SetRef *SetRef     `json:"setRef,omitempty"`
+	Masked *MaskedAddr `json:"masked,omitempty"`
+	RelOp  Operator    `json:"relOp,omitempty"`
+}
+
+// MaskedAddr matches the address masked with an arbitrary, also non-contiguous, mask against the value,
+// for example "ip saddr & 0.0.0.255 == 0.0.0.1" selects hosts with the last octet 1 in all subnets.
+// Mask and Value must be host addresses of the same family, Value cannot have bits outside of Mask.
+type MaskedAddr struct {
+	Mask  *IPAddr `json:"mask"`
+	Value *IPAddr `json:"value"`
+}
+
+// IsIPv6 returns true if the masked address matches IPv6 addresses
+func (m *MaskedAddr) IsIPv6() bool {
+	return m.Value.IsIPv6()
+}
+
+// bytes returns the mask and the value in the length of addresses of the family
+func (m *MaskedAddr) bytes() ([]byte, []byte) {
+	if m.IsIPv6() {
+		return []byte(m.Mask.IP.To16()), []byte(m.Value.IP.To16())
 	}
-	return &IPAddr{
-		&net.IPAddr{
-			IP: ipnet.IP,
-		},
-		true,
-		&mask,
-	}, nil
+
+	return []byte(m.Mask.IP.To4()), []byte(m.Value.IP.To4())
+}
+
+// Validate checks MaskedAddr struct
+func (m *MaskedAddr) Validate() error {
+	if m.Mask == nil || m.Mask.IPAddr == nil || m.Value == nil || m.Value.IPAddr == nil {
+		return fmt.Errorf("both mask and value of masked address must be specified")
+	}
+	if m.Mask.IsIPv6() != m.Value.IsIPv6() {
+		return fmt.Errorf("mask %s and value %s of masked address belong to different families", m.Mask.IP, m.Value.IP)
+	}
+	bits := uint8(32)
+	if m.IsIPv6() {
+		bits = 128
+	}
+	for _, a := range []*IPAddr{m.Mask, m.Value} {
+		if a.Mask != nil && *a.Mask != bits {
+			return fmt.Errorf("mask and value of masked address must be host addresses, got %s/%d", a.IP, *a.Mask)
+		}
+	}
+	mask, value := m.bytes()
+	for i := range value {
+		if value[i]&^mask[i] != 0 {
+			return fmt.Errorf("value %s of masked address has bits outside of mask %s", m.Value.IP, m.Mask.IP)
+		}
+	}
+
+	return nil
 }
 
 // Validate checks IPAddrSpec struct
 func (ip *IPAddrSpec) Validate() error {
+	if err := validateRelOp(ip.RelOp, "ip address", false); err != nil {
+		return err
+	}
+	if ip.Masked != nil {
+		if len(ip.List) != 0 || ip.Range[0] != nil || ip.Range[1] != nil || ip.SetRef != nil {
+			return fmt.Errorf("masked address cannot be combined with List, Range or SetRef")
+		}
+		return ip.Masked.Validate()
+	}
 	if len(ip.List) != 0 && (ip.Range[0] != nil || ip.Range[1] != nil) {
 		return fmt.Errorf("either List or Range but not both can be specified")
 	}
@@ -661,12 +1220,40 @@ func (ip *IPAddrSpec) Validate() error {
 
 // L3Rule contains parameters for L3 based rule, either Source or Destination can be specified
 type L3Rule struct {
-	Src      *IPAddrSpec
-	Dst      *IPAddrSpec
-	Version  *byte
-	Protocol *uint32
-	RelOp    Operator
-	Counter  *Counter
+	Src      *IPAddrSpec `json:"src,omitempty"`
+	Dst      *IPAddrSpec `json:"dst,omitempty"`
+	Version  *byte       `json:"version,omitempty"`
+	Protocol *uint32     `json:"protocol,omitempty"`
+	// VersionRelOp and ProtocolRelOp define relational operators of Version and Protocol matches,
+	// Src and Dst carry their own operators.
+	VersionRelOp  Operator `json:"versionRelOp,omitempty"`
+	ProtocolRelOp Operator `json:"protocolRelOp,omitempty"`
+	// RelOp is applied to Version and Protocol matches which do not set their own operator.
+	//
+	// Deprecated: use VersionRelOp and ProtocolRelOp.
+	RelOp Operator `json:"relOp,omitempty"`
+	// Options when true matches IPv4 packets carrying IP options (ihl > 5), when false matches
+	// packets without options (ihl == 5). It is supported only in ipv4 family tables.
+	Options *bool    `json:"options,omitempty"`
+	Counter *Counter `json:"counter,omitempty"`
+	// Inner when set matches headers of the packet encapsulated in a tunnel, it is supported only in netdev tables.
+	Inner *InnerHeader `json:"inner,omitempty"`
+}
+
+// versionRelOp returns the operator of the Version match honoring deprecated RelOp
+func (l3 *L3Rule) versionRelOp() Operator {
+	if l3.VersionRelOp != EQ {
+		return l3.VersionRelOp
+	}
+	return l3.RelOp
+}
+
+// protocolRelOp returns the operator of the Protocol match honoring deprecated RelOp
+func (l3 *L3Rule) protocolRelOp() Operator {
+	if l3.ProtocolRelOp != EQ {
+		return l3.ProtocolRelOp
+	}
+	return l3.RelOp
 }
 
 // L3Protocol is a helper function to convert a value of L3 protocol
@@ -678,19 +1265,28 @@ func L3Protocol(proto int) *uint32 {
 
 // Validate checks parameters of L3Rule struct
 func (l3 *L3Rule) Validate() error {
-	switch {
-	case l3.Src != nil:
+	if l3.Src == nil && l3.Dst == nil && l3.Version == nil && l3.Protocol == nil && l3.Options == nil {
+		return fmt.Errorf("invalid L3 rule as none of L3 parameters are provided")
+	}
+	if l3.Version != nil {
+		if err := validateRelOp(l3.versionRelOp(), "ip version", true); err != nil {
+			return err
+		}
+	}
+	if l3.Protocol != nil {
+		if err := validateRelOp(l3.protocolRelOp(), "l4 protocol", true); err != nil {
+			return err
+		}
+	}
+	if l3.Src != nil {
 		if err := l3.Src.Validate(); err != nil {
 			return err
 		}
-	case l3.Dst != nil:
+	}
+	if l3.Dst != nil {
 		if err := l3.Dst.Validate(); err != nil {
 			return err
 		}
-	case l3.Version != nil:
-	case l3.Protocol != nil:
-	default:
-		return fmt.Errorf("invalid L3 rule as none of L3 parameters are provided")
 	}
 
 	return nil
@@ -698,55 +1294,184 @@ func (l3 *L3Rule) Validate() error {
 
 // SetRef defines a reference to a Set/Map/Vmap
 type SetRef struct {
-	Name  string
-	ID    uint32
-	IsMap bool
+	Name  string `json:"name,omitempty"`
+	ID    uint32 `json:"id,omitempty"`
+	IsMap bool   `json:"isMap,omitempty"`
 }
 
-// Port lists possible flavours of specifying port information
+// Port lists possible flavours of specifying port information. Range is not set when both its ports
+// are 0, port 0 cannot be expressed as a range, List with a single port 0 matches it.
 type Port struct {
-	List   []*uint16
-	Range  [2]*uint16
-	RelOp  Operator
-	SetRef *SetRef
+	List  []uint16  `json:"list,omitempty"`
+	Range [2]uint16 `json:"range,omitempty"`
+	// Ranges defines multiple ranges of ports, along with Range they are compiled into a single
+	// interval set, overlapping and adjacent ranges are merged.
+	Ranges [][2]uint16 `json:"ranges,omitempty"`
+	// Exclude defines ranges of ports carved out of Range and Ranges, a single port is
+	// excluded by a range with both ports equal.
+	Exclude [][2]uint16 `json:"exclude,omitempty"`
+	RelOp   Operator    `json:"relOp,omitempty"`
+	SetRef  *SetRef     `json:"setRef,omitempty"`
+}
+
+// SetPortList16 is a helper function which validates a list of ports and returns its copy
+// in a format required by Port struct
+func SetPortList16(ports []uint16) ([]uint16, error) {
+	if len(ports) == 0 {
+		return nil, fmt.Errorf("port list cannot be empty")
+	}
+	if err := validatePortList(ports); err != nil {
+		return nil, err
+	}
+
+	return append([]uint16{}, ports...), nil
+}
+
+// SetPortRange16 is a helper function which validates a range of ports in a format required by Port struct
+func SetPortRange16(ports [2]uint16) ([2]uint16, error) {
+	if err := validatePortRange(ports); err != nil {
+		return [2]uint16{}, err
+	}
+
+	return ports, nil
+}
+
+// SetPortRanges16 is a helper function which validates ranges of ports and returns their copy
+// in a format required by Ranges and Exclude of Port struct
+func SetPortRanges16(ranges [][2]uint16) ([][2]uint16, error) {
+	for _, r := range ranges {
+		if err := validatePortRange(r); err != nil {
+			return nil, err
+		}
+	}
+
+	return append([][2]uint16{}, ranges...), nil
+}
+
+// toPort converts int to a port, values out of the range of ports fail
+func toPort(port int) (uint16, error) {
+	if port < 0 || port > math.MaxUint16 {
+		return 0, fmt.Errorf("port %d is out of range 0-%d", port, math.MaxUint16)
+	}
+
+	return uint16(port), nil
 }
 
 // SetPortList is a helper function which transforms a slice of int into
-// a format required by Port struct
-func SetPortList(ports []int) []*uint16 {
-	p := make([]*uint16, len(ports))
+// a format required by Port struct, ports out of the range 0-65535 fail
+func SetPortList(ports []int) ([]uint16, error) {
+	p := make([]uint16, len(ports))
 	for i, port := range ports {
-		pp := uint16(port)
-		p[i] = &pp
+		pp, err := toPort(port)
+		if err != nil {
+			return nil, err
+		}
+		p[i] = pp
 	}
-	return p
+
+	return SetPortList16(p)
 }
 
 // SetPortRange is a helper function which transforms an 2 element array of int into
-// a format required by Port struct
-func SetPortRange(ports [2]int) [2]*uint16 {
-	p := [2]*uint16{}
+// a format required by Port struct, ports out of the range 0-65535 fail
+func SetPortRange(ports [2]int) ([2]uint16, error) {
+	p := [2]uint16{}
 	for i, port := range ports {
-		pp := uint16(port)
-		p[i] = &pp
+		pp, err := toPort(port)
+		if err != nil {
+			return [2]uint16{}, err
+		}
+		p[i] = pp
 	}
-	return p
+
+	return SetPortRange16(p)
+}
+
+// SetPortRanges is a helper function which transforms a slice of 2 element arrays of int into
+// a format required by Ranges and Exclude of Port struct, ports out of the range 0-65535 fail
+func SetPortRanges(ranges [][2]int) ([][2]uint16, error) {
+	p := make([][2]uint16, len(ranges))
+	for i, r := range ranges {
+		pr, err := SetPortRange(r)
+		if err != nil {
+			return nil, err
+		}
+		p[i] = pr
+	}
+
+	return p, nil
+}
+
+// validatePortList fails lists with ports listed more than once
+func validatePortList(ports []uint16) error {
+	// Bitmap of all ports, it does not allocate for long lists
+	var seen [1 << 16 / 64]uint64
+	for _, port := range ports {
+		if seen[port/64]&(1<<(port%64)) != 0 {
+			return fmt.Errorf("port %d is listed more than once", port)
+		}
+		seen[port/64] |= 1 << (port % 64)
+	}
+
+	return nil
+}
+
+// portRange is a range of ports of Port struct
+type portRange [2]uint16
+
+// isSet returns true if the range of ports is set, ranges with both ports 0 are not set
+func (r portRange) isSet() bool {
+	return r[0] != 0 || r[1] != 0
+}
+
+func validatePortRange(r [2]uint16) error {
+	if !portRange(r).isSet() {
+		return fmt.Errorf("port range 0-0 is not valid")
+	}
+	if r[0] > r[1] {
+		return fmt.Errorf("port range %d-%d is inverted", r[0], r[1])
+	}
+	return nil
 }
 
 // Validate check parameters of Port struct
 func (p *Port) Validate() error {
+	if err := validateRelOp(p.RelOp, "port", len(p.List) == 1); err != nil {
+		return err
+	}
 	set := 0
-	switch {
-	case len(p.List) != 0:
+	if len(p.List) != 0 {
+		if err := validatePortList(p.List); err != nil {
+			return err
+		}
 		set++
-	case p.Range[0] != nil || p.Range[1] != nil:
-		if p.Range[0] == nil || p.Range[1] == nil {
-			return fmt.Errorf("port range requires both ports of the range to be non nil")
+	}
+	if portRange(p.Range).isSet() || len(p.Ranges) != 0 {
+		if portRange(p.Range).isSet() {
+			if err := validatePortRange(p.Range); err != nil {
+				return err
+			}
+		}
+		for _, r := range p.Ranges {
+			if err := validatePortRange(r); err != nil {
+				return err
+			}
 		}
 		set++
-	case p.SetRef != nil:
+	}
+	if p.SetRef != nil {
 		set++
 	}
+	if len(p.Exclude) != 0 {
+		if !portRange(p.Range).isSet() && len(p.Ranges) == 0 {
+			return fmt.Errorf("port exclusion requires Range or Ranges")
+		}
+		for _, r := range p.Exclude {
+			if err := validatePortRange(r); err != nil {
+				return err
+			}
+		}
+	}
 	if set > 1 {
 		return fmt.Errorf("either List or Range or SetRef but not the combination of them can be specified")
 	}
@@ -759,11 +1484,22 @@ func (p *Port) Validate() error {
 
 // L4Rule contains parameters for L4 based rule
 type L4Rule struct {
-	L4Proto uint8
-	Src     *Port
-	Dst     *Port
-	RelOp   Operator
-	Counter *Counter
+	L4Proto uint8 `json:"l4Proto,omitempty"`
+	Src     *Port `json:"src,omitempty"`
+	Dst     *Port `json:"dst,omitempty"`
+	// ICMP matches ICMP or ICMPv6 messages, it cannot be combined with Src and Dst.
+	ICMP *ICMP `json:"icmp,omitempty"`
+	// RelOp is not used, Src and Dst carry their own operators.
+	//
+	// Deprecated: use RelOp of Src and Dst ports.
+	RelOp   Operator `json:"relOp,omitempty"`
+	Counter *Counter `json:"counter,omitempty"`
+	// NoCounter disables the counter added to the rule when the rule's table is created
+	// WithDefaultCounters, counters requested by the rule's Counter fields are not affected.
+	NoCounter bool `json:"noCounter,omitempty"`
+	// Inner when set matches the transport header of the packet encapsulated in a tunnel, it is supported
+	// only in netdev tables.
+	Inner *InnerHeader `json:"inner,omitempty"`
 }
 
 // Validate checks parameters of L4Rule struct
@@ -771,6 +1507,20 @@ func (l4 *L4Rule) Validate() error {
 	if l4.L4Proto == 0 {
 		return fmt.Errorf("L4Proto cannot be 0")
 	}
+	if l4.ICMP != nil {
+		if !isICMP(l4.L4Proto) {
+			return fmt.Errorf("icmp match requires l4 protocol icmp or icmpv6, got %d", l4.L4Proto)
+		}
+		if l4.Src != nil || l4.Dst != nil {
+			return fmt.Errorf("icmp match cannot be combined with ports")
+		}
+		if err := l4.ICMP.Validate(); err != nil {
+			return err
+		}
+	}
+	if (l4.Src != nil || l4.Dst != nil) && !hasPorts(l4.L4Proto) {
+		return fmt.Errorf("port match is not supported for l4 protocol %d", l4.L4Proto)
+	}
 	if l4.Src != nil {
 		if err := l4.Src.Validate(); err != nil {
 			return err
@@ -822,6 +1572,10 @@ type loadbalance struct {
 	chains []string
 	action int
 	mode   int
+	// setRef refers to the interval verdict map of weighted load balancing, numgen output
+	// in range [0, modulus) is looked up in the map.
+	setRef  *SetRef
+	modulus uint32
 }
 
 // MetaMark defines Mark keyword of Meta key
@@ -831,23 +1585,149 @@ type loadbalance struct {
 // Mask can be used to test for or to set only particular bits in mark.
 // If mask is 0, than it is not used at all.
 type MetaMark struct {
-	Set   bool
-	Value uint32
-	Mask  uint32
+	Set   bool   `json:"set,omitempty"`
+	Value uint32 `json:"value,omitempty"`
+	Mask  uint32 `json:"mask,omitempty"`
 }
 
 // MetaExpr allows specifing Meta expressions by meta key and its value,
 // example Key: unix.NFT_META_SKGID and Value: 1024
 type MetaExpr struct {
-	Key   uint32
-	Value []byte
-	RelOp Operator
+	Key   uint32   `json:"key,omitempty"`
+	Value []byte   `json:"value,omitempty"`
+	RelOp Operator `json:"relOp,omitempty"`
+}
+
+// MetaRule defines all meta keys a rule can match on or set. Meta matches are placed before
+// the rule's L3 and L4 matches, so in inet tables the NFProto and L4Proto guards are evaluated
+// before any payload is loaded. Mark with Set true is applied after all matches of the rule.
+type MetaRule struct {
+	Mark    *MetaMark             `json:"mark,omitempty"`
+	NFProto *nftables.TableFamily `json:"nfProto,omitempty"`
+	L4Proto *uint8                `json:"l4Proto,omitempty"`
+	IIFName *string               `json:"iifName,omitempty"`
+	OIFName *string               `json:"oifName,omitempty"`
+	// IIF and OIF match the interface index, unlike names indexes change when the interface is
+	// recreated, IfTracker rewrites such rules to the new index.
+	IIF *uint32 `json:"iif,omitempty"`
+	OIF *uint32 `json:"oif,omitempty"`
+	// IIFNameSet and OIFNameSet match the interface name against a set of TypeIFName
+	IIFNameSet *IfNameSet `json:"iifNameSet,omitempty"`
+	OIFNameSet *IfNameSet `json:"oifNameSet,omitempty"`
+	PktType    *uint8     `json:"pktType,omitempty"`
+	Length     *uint32    `json:"length,omitempty"`
+	SKUID      *uint32    `json:"skuid,omitempty"`
+	SKGID      *uint32    `json:"skgid,omitempty"`
+	// Expr carries matches for meta keys not covered by the typed fields
+	Expr []MetaExpr `json:"expr,omitempty"`
+}
+
+// IfNameSet defines a match of the interface name against a named set of interface names,
+// like "iifname @pods", RelOp NEQ matches names not in the set.
+type IfNameSet struct {
+	SetRef *SetRef  `json:"setRef,omitempty"`
+	RelOp  Operator `json:"relOp,omitempty"`
+}
+
+// Validate checks parameters of IfNameSet struct
+func (s *IfNameSet) Validate() error {
+	if s.SetRef == nil {
+		return fmt.Errorf("set reference of interface name set match cannot be nil")
+	}
+	if s.SetRef.IsMap {
+		return fmt.Errorf("interface name set match cannot refer to map %s", s.SetRef.Name)
+	}
+	if s.SetRef.Name == "" && s.SetRef.ID == 0 {
+		return fmt.Errorf("interface name set match must refer to a set by name or id")
+	}
+
+	return validateRelOp(s.RelOp, "interface name set", false)
 }
 
 // Meta defines parameters used to build nft meta expression
-type Meta struct {
-	Mark *MetaMark
-	Expr []MetaExpr
+//
+// Deprecated: Meta is kept for existing callers, use MetaRule instead.
+type Meta = MetaRule
+
+// matches returns meta matches of the rule in the order they are programmed,
+// the mark match is not included as it is built separately.
+func (m *MetaRule) matches() []MetaExpr {
+	me := []MetaExpr{}
+	if m.NFProto != nil {
+		me = append(me, MetaExpr{Key: unix.NFT_META_NFPROTO, Value: []byte{byte(*m.NFProto)}})
+	}
+	if m.L4Proto != nil {
+		me = append(me, MetaExpr{Key: unix.NFT_META_L4PROTO, Value: []byte{*m.L4Proto}})
+	}
+	if m.IIFName != nil {
+		me = append(me, MetaExpr{Key: unix.NFT_META_IIFNAME, Value: ifname(*m.IIFName)})
+	}
+	if m.OIFName != nil {
+		me = append(me, MetaExpr{Key: unix.NFT_META_OIFNAME, Value: ifname(*m.OIFName)})
+	}
+	if m.IIF != nil {
+		me = append(me, MetaExpr{Key: unix.NFT_META_IIF, Value: binaryutil.NativeEndian.PutUint32(*m.IIF)})
+	}
+	if m.OIF != nil {
+		me = append(me, MetaExpr{Key: unix.NFT_META_OIF, Value: binaryutil.NativeEndian.PutUint32(*m.OIF)})
+	}
+	if m.PktType != nil {
+		me = append(me, MetaExpr{Key: unix.NFT_META_PKTTYPE, Value: []byte{*m.PktType}})
+	}
+	if m.Length != nil {
+		me = append(me, MetaExpr{Key: unix.NFT_META_LEN, Value: binaryutil.NativeEndian.PutUint32(*m.Length)})
+	}
+	if m.SKUID != nil {
+		me = append(me, MetaExpr{Key: unix.NFT_META_SKUID, Value: binaryutil.NativeEndian.PutUint32(*m.SKUID)})
+	}
+	if m.SKGID != nil {
+		me = append(me, MetaExpr{Key: unix.NFT_META_SKGID, Value: binaryutil.NativeEndian.PutUint32(*m.SKGID)})
+	}
+
+	return append(me, m.Expr...)
+}
+
+// Validate checks meta keys for duplicates and for contradictory equality constraints,
+// like mark == 1 and mark != 1, or mark == 1 and mark == 2.
+func (m *MetaRule) Validate() error {
+	if m.IIFName != nil && len(*m.IIFName) > 15 {
+		return fmt.Errorf("input interface name %s exceeds 15 characters", *m.IIFName)
+	}
+	if m.OIFName != nil && len(*m.OIFName) > 15 {
+		return fmt.Errorf("output interface name %s exceeds 15 characters", *m.OIFName)
+	}
+	for _, s := range []*IfNameSet{m.IIFNameSet, m.OIFNameSet} {
+		if s == nil {
+			continue
+		}
+		if err := s.Validate(); err != nil {
+			return err
+		}
+	}
+	all := m.matches()
+	if m.Mark != nil && !m.Mark.Set && m.Mark.Mask == 0 {
+		all = append(all, MetaExpr{Key: unix.NFT_META_MARK, Value: binaryutil.NativeEndian.PutUint32(m.Mark.Value)})
+	}
+	seen := make(map[uint32][]MetaExpr)
+	for _, e := range all {
+		if err := validateRelOp(e.RelOp, fmt.Sprintf("meta key %d", e.Key), false); err != nil {
+			return err
+		}
+		for _, p := range seen[e.Key] {
+			same := bytes.Equal(p.Value, e.Value)
+			switch {
+			case p.RelOp == e.RelOp && same:
+				return fmt.Errorf("duplicate match for meta key %d", e.Key)
+			case p.RelOp != e.RelOp && same:
+				return fmt.Errorf("meta key %d is matched as equal and not equal to the same value", e.Key)
+			case p.RelOp == EQ && e.RelOp == EQ:
+				return fmt.Errorf("meta key %d is matched as equal to different values", e.Key)
+			}
+		}
+		seen[e.Key] = append(seen[e.Key], e)
+	}
+
+	return nil
 }
 
 // RuleAction defines what action needs to be executed on the rule match
@@ -858,6 +1738,19 @@ type RuleAction struct {
 	nat         *nat
 	reject      *reject
 	loadbalance *loadbalance
+	dnatMap     *DNATMapAttributes
+	// inline carries rules of the chain bound to the rule by an inline jump
+	inline []*Rule
+	queue  *queue
+	// Non-terminal actions, they precede the terminal action in Rule's Actions
+	counter *Counter
+	log     *Log
+	mark    *MetaMark
+	nftrace bool
+	ctMark  *uint32
+	markMap *markMap
+	// ctExpectation is the name of conntrack expectation object attached to the connection
+	ctExpectation string
 }
 
 // SetLoadbalance builds RuleAction struct for Verdict based actions,
@@ -873,6 +1766,29 @@ func SetLoadbalance(chains []string, action int, mode int) (*RuleAction, error)
 		loadbalance: &loadbalance{
 			chains: chains,
 			action: action,
+			mode:   mode,
+		},
+	}
+
+	return ra, nil
+}
+
+// SetWeightedLoadbalance builds RuleAction struct for weighted load balancing, numgen output in range
+// [0, modulus) is looked up in the interval verdict map referred by set. Elements of the map are built by
+// MakeWeightedLoadbalanceElements, they can be replaced when weights change without recreating the rule.
+// mode parameters defines the mode of numgen; unix.NFT_NG_RANDOM or unix.NFT_NG_INCREMENTAL.
+func SetWeightedLoadbalance(set *SetRef, modulus uint32, mode int) (*RuleAction, error) {
+	if set == nil || set.Name == "" {
+		return nil, fmt.Errorf("weighted loadbalancing requires a named interval verdict map")
+	}
+	if modulus == 0 || modulus > MaxWeightedLoadbalanceModulus {
+		return nil, fmt.Errorf("invalid weighted loadbalancing modulus %d, it must be in range 1-%d", modulus, MaxWeightedLoadbalanceModulus)
+	}
+	ra := &RuleAction{
+		loadbalance: &loadbalance{
+			setRef:  set,
+			modulus: modulus,
+			mode:    mode,
 		},
 	}
 
@@ -936,11 +1852,11 @@ func SetMasqToPort(port ...int) (*RuleAction, error) {
 // When 2 elements of array are specified, then the range of either ip addresses
 // or ports will be specified in NAT rule.
 type NATAttributes struct {
-	L3Addr      [2]*IPAddr
-	Port        [2]uint16
-	FullyRandom bool
-	Random      bool
-	Persistent  bool
+	L3Addr      [2]*IPAddr `json:"l3Addr,omitempty"`
+	Port        [2]uint16  `json:"port,omitempty"`
+	FullyRandom bool       `json:"fullyRandom,omitempty"`
+	Random      bool       `json:"random,omitempty"`
+	Persistent  bool       `json:"persistent,omitempty"`
 }
 
 func setNat(nattype expr.NATType, natAttrs *NATAttributes) (*RuleAction, error) {
@@ -975,16 +1891,13 @@ func setNat(nattype expr.NATType, natAttrs *NATAttributes) (*RuleAction, error)
 	switch {
 	case natAttrs.Port[0] != 0 && natAttrs.Port[1] != 0:
 		// Both Ports are not 0, then pass them as Range
-		port.Range = [2]*uint16{}
-		port.Range[0] = &natAttrs.Port[0]
-		port.Range[1] = &natAttrs.Port[1]
+		port.Range = natAttrs.Port
 
 	case natAttrs.Port[0] == 0 && natAttrs.Port[1] != 0:
 		return nil, fmt.Errorf("first element of a port range cannot be 0")
 	case natAttrs.Port[0] != 0:
 		// Single Port is specified, then pass it as a single element of the list
-		port.List = make([]*uint16, 1)
-		port.List[0] = &natAttrs.Port[0]
+		port.List = []uint16{natAttrs.Port[0]}
 	}
 	ra.nat.port = &port
 	// Add NAT flags is any specified
@@ -1020,7 +1933,7 @@ func SetReject(rt int, rc int) (*RuleAction, error) {
 
 // Validate method validates RuleAction parameters and returns error if inconsistency if found
 func (ra *RuleAction) Validate() error {
-	if ra.verdict == nil && ra.redirect == nil {
+	if ra.verdict == nil && ra.redirect == nil && ra.inline == nil {
 		return fmt.Errorf("rule's action is not set")
 	}
 	if ra.verdict != nil && ra.redirect != nil {
@@ -1064,8 +1977,8 @@ func (ra *RuleAction) setVerdict(key int, chain ...string) error {
 
 // Log defines nftables logging parameters for a rule
 type Log struct {
-	Key   uint32
-	Value []byte
+	Key   uint32 `json:"key,omitempty"`
+	Value []byte `json:"value,omitempty"`
 }
 
 // Counter indicates a presence of a counter object in the rule
@@ -1088,17 +2001,22 @@ type Counter struct {
 // RTN_NAT                 = 0xa
 // RTN_XRESOLVE            = 0xb
 type Fib struct {
-	ResultOIF      bool
-	ResultOIFNAME  bool
-	ResultADDRTYPE bool
-	FlagSADDR      bool
-	FlagDADDR      bool
-	FlagMARK       bool
-	FlagIIF        bool
-	FlagOIF        bool
-	FlagPRESENT    bool
-	RelOp          Operator
-	Data           []byte
+	ResultOIF      bool     `json:"resultOIF,omitempty"`
+	ResultOIFNAME  bool     `json:"resultOIFNAME,omitempty"`
+	ResultADDRTYPE bool     `json:"resultADDRTYPE,omitempty"`
+	FlagSADDR      bool     `json:"flagSADDR,omitempty"`
+	FlagDADDR      bool     `json:"flagDADDR,omitempty"`
+	FlagMARK       bool     `json:"flagMARK,omitempty"`
+	FlagIIF        bool     `json:"flagIIF,omitempty"`
+	FlagOIF        bool     `json:"flagOIF,omitempty"`
+	FlagPRESENT    bool     `json:"flagPRESENT,omitempty"`
+	RelOp          Operator `json:"relOp,omitempty"`
+	Data           []byte   `json:"data,omitempty"`
+}
+
+// Validate checks parameters of Fib struct
+func (f *Fib) Validate() error {
+	return validateRelOp(f.RelOp, "fib", false)
 }
 
 // SetLog is a helper function returning Log struct with validated values
@@ -1125,8 +2043,11 @@ var (
 
 // Conntrack defines a key and  value for Ccnnection tracking
 type Conntrack struct {
-	Key   uint32
-	Value []byte
+	Key   uint32 `json:"key,omitempty"`
+	Value []byte `json:"value,omitempty"`
+	// RelOp is used by matches of conntrack counters (NFT_CT_BYTES, NFT_CT_PKTS and NFT_CT_AVGPKT),
+	// see CtBytes, state and status matches support only EQ.
+	RelOp Operator `json:"relOp,omitempty"`
 }
 
 // MatchType defines a matching criteria for an incoming packet. Only one of the criterias
@@ -1147,45 +2068,65 @@ const (
 // Dynamic defines a rule which dynamically add or update a Set or Map based on
 // an incoming packet.
 type Dynamic struct {
-	Match MatchType
+	Match MatchType `json:"match,omitempty"`
 	// Op defines an operation, supported operations are Add and Update.
-	Op uint32
+	Op uint32 `json:"op,omitempty"`
 	// Key defines a key to use for a new entry added to a Set or Map.
-	Key uint32
+	Key uint32 `json:"key,omitempty"`
 	// SetRef defines a reference to the Set or Map that gets updated.
-	SetRef *SetRef
+	SetRef *SetRef `json:"setRef,omitempty"`
 	// Timeout defines an aging timeout for a new entry.
-	Timeout time.Duration
-	Invert  bool
+	Timeout time.Duration `json:"timeout,omitempty"`
+	Invert  bool          `json:"invert,omitempty"`
 }
 
 // MatchAct rule defines a special type of rules (no support yet by nft cli tool), where matching
 // is done by referring to a named map { match criteria : integer } and action is defined in an anonymous vmap
 // { integer : action }. The match returns a key which is used as input for action lookup in the anonymous vmap.
 type MatchAct struct {
-	Match MatchType
+	Match MatchType `json:"match,omitempty"`
 	// MatchRef defines a reference to the named map { match criteria : integer }
-	MatchRef *SetRef
+	MatchRef *SetRef `json:"matchRef,omitempty"`
 	// ActElements defines a slice elements of type { integer : action }, these will be placed into
 	// the anonymous action map.
-	ActElement map[int]*RuleAction
+	ActElement map[int]*RuleAction `json:"actElement,omitempty"`
 }
 
 // Rule contains parameters for a rule to configure, only L3 OR L4 parameters can be specified
 type Rule struct {
-	Concat     *Concat
-	Dynamic    *Dynamic
-	MatchAct   *MatchAct
-	Fib        *Fib
-	L3         *L3Rule
-	L4         *L4Rule
-	Conntracks []*Conntrack
-	Meta       *Meta
-	Log        *Log
-	RelOp      Operator
-	Counter    *Counter
-	Action     *RuleAction
-	UserData   []byte
+	Concat     *Concat      `json:"concat,omitempty"`
+	Dynamic    *Dynamic     `json:"dynamic,omitempty"`
+	MatchAct   *MatchAct    `json:"matchAct,omitempty"`
+	Fib        *Fib         `json:"fib,omitempty"`
+	L3         *L3Rule      `json:"l3,omitempty"`
+	L4         *L4Rule      `json:"l4,omitempty"`
+	L2         *L2Rule      `json:"l2,omitempty"`
+	ARP        *ARPRule     `json:"arp,omitempty"`
+	Conntracks []*Conntrack `json:"conntracks,omitempty"`
+	Meta       *MetaRule    `json:"meta,omitempty"`
+	Log        *Log         `json:"log,omitempty"`
+	// RelOp is not used, every section of the rule carries its own operator.
+	//
+	// Deprecated: use RelOp of the rule's sections.
+	RelOp   Operator `json:"relOp,omitempty"`
+	Counter *Counter `json:"counter,omitempty"`
+	// NoCounter disables the counter added to the rule when the rule's table is created
+	// WithDefaultCounters, counters requested by the rule's Counter fields are not affected.
+	NoCounter bool `json:"noCounter,omitempty"`
+	// Limit is placed after all matches, including RawExprs, and before the action, so only
+	// packets matched by the rule are accounted against the rate.
+	Limit *Limit `json:"limit,omitempty"`
+	// RawExprs carries expressions which are not covered by the rule's structured fields,
+	// the expressions are added verbatim after all generated matches (Counter, Fib, L3, L4,
+	// Meta, Log and Conntracks) and before the expressions generated for Action, Concat,
+	// Dynamic and MatchAct. RawExprs can carry a terminal verdict only if the rule has no terminal action.
+	RawExprs []expr.Any  `json:"rawExprs,omitempty"`
+	Action   *RuleAction `json:"action,omitempty"`
+	// Actions are applied in the order of the slice after Limit, non-terminal actions (counter, log,
+	// mark set, nftrace and ct mark set) can be followed by a single terminal action, Action is
+	// a shorthand for Actions of a single element and cannot be combined with it.
+	Actions  []*RuleAction `json:"actions,omitempty"`
+	UserData []byte        `json:"userData,omitempty"`
 	// Position identifies the desired position of the rule, depending on the operation
 	// Add, Insert or Replace, the resulting position may vary.
 	// AddRule with position 0, will add a rule to the end of the chain
@@ -1193,7 +2134,7 @@ type Rule struct {
 	// InsertRule with position 0 will insert a rule at the beginning of the chain
 	// InsertRule with position != 0 will insert a rule right before the rule with specified position
 	// Replace operation with position 0 will fail.
-	Position int
+	Position int `json:"position,omitempty"`
 }
 
 // Validate checks parameters passed in struct and returns error if inconsistency is found
@@ -1208,18 +2149,117 @@ func (r Rule) Validate() error {
 			return err
 		}
 	}
-	if r.Action == nil {
+	if r.L2 != nil {
+		if err := r.validateL2(); err != nil {
+			return err
+		}
+	}
+	if r.ARP != nil {
+		if r.L3 != nil || r.L4 != nil {
+			return fmt.Errorf("arp rule cannot be combined with L3 or L4 rule")
+		}
+		if err := r.ARP.Validate(); err != nil {
+			return err
+		}
+	}
+	if r.Meta != nil {
+		if err := r.Meta.Validate(); err != nil {
+			return err
+		}
+	}
+	if r.Fib != nil {
+		if err := r.Fib.Validate(); err != nil {
+			return err
+		}
+	}
+	for _, ct := range r.Conntracks {
+		if ct == nil {
+			continue
+		}
+		if err := ct.Validate(); err != nil {
+			return err
+		}
+	}
+	if r.Limit != nil {
+		if err := r.Limit.Validate(); err != nil {
+			return err
+		}
+	}
+	if err := r.validateRawExprs(); err != nil {
+		return err
+	}
+	if err := r.validateActions(); err != nil {
+		return err
+	}
+	action := r.action()
+	if action == nil {
 		return nil
 	}
-	if r.L3 == nil && r.L4 == nil && r.Action.redirect != nil {
+	if r.L3 == nil && r.L4 == nil && action.redirect != nil {
 		return fmt.Errorf("cannot redirect wihtout specifying L3 or L4 rule")
 	}
+	if err := r.validateReject(); err != nil {
+		return err
+	}
 	return nil
 }
 
-func getSetName() string {
-	name := uuid.New().String()
-	return name[len(name)-12:]
+// validateRawExprs checks that raw expressions do not carry more than one terminal verdict
+// and that a terminal verdict is not combined with the rule's Action.
+func (r Rule) validateRawExprs() error {
+	terminal := 0
+	for _, e := range r.RawExprs {
+		v, ok := e.(*expr.Verdict)
+		if !ok {
+			continue
+		}
+		switch v.Kind {
+		case expr.VerdictContinue, expr.VerdictBreak:
+		default:
+			terminal++
+		}
+	}
+	if terminal > 1 {
+		return fmt.Errorf("raw expressions carry %d terminal verdicts", terminal)
+	}
+	if terminal == 1 && r.action() != nil {
+		return fmt.Errorf("raw expressions carry a terminal verdict and the rule has an action")
+	}
+
+	return nil
+}
+
+// validateReject refuses reject with tcp reset in rules matching l4 protocols other than tcp,
+// tcp reset can only answer tcp segments.
+func (r Rule) validateReject() error {
+	action := r.action()
+	if action == nil || action.reject == nil || action.reject.rejectType != unix.NFT_REJECT_TCP_RST {
+		return nil
+	}
+	if r.L4 != nil && r.L4.L4Proto != unix.IPPROTO_TCP {
+		return fmt.Errorf("reject with tcp reset requires l4 protocol tcp, got %d", r.L4.L4Proto)
+	}
+
+	return nil
+}
+
+// hasCounter returns true if the rule requests a counter by any of its fields
+func (r Rule) hasCounter() bool {
+	if r.Counter != nil || (r.L3 != nil && r.L3.Counter != nil) || (r.L4 != nil && r.L4.Counter != nil) {
+		return true
+	}
+	for _, e := range r.RawExprs {
+		if _, ok := e.(*expr.Counter); ok {
+			return true
+		}
+	}
+	for _, a := range r.actions() {
+		if a != nil && a.counter != nil {
+			return true
+		}
+	}
+
+	return false
 }
 
 const (
@@ -0,0 +1,552 @@
+package nftableslib
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+// LoadRule decodes the rule from JSON and validates it, fields which are not part of the Rule model
+// are rejected. Field names follow the json tags of Rule and its sections, YAML documents can be loaded
+// after conversion to JSON. Addresses are encoded as strings like "192.0.2.1" or "2001:db8::/32",
+// relational operators by their names like "neq" and actions as {"verdict": "jump web"},
+// {"redirect": {...}}, {"nat": {...}} and so on. RawExprs cannot be loaded.
+func LoadRule(data []byte) (*Rule, error) {
+	rule := &Rule{}
+	if err := unmarshalStrict(data, rule); err != nil {
+		return nil, fmt.Errorf("failed to decode rule with error: %+v", err)
+	}
+	if err := rule.Validate(); err != nil {
+		return nil, err
+	}
+
+	return rule, nil
+}
+
+// unmarshalStrict decodes JSON rejecting unknown fields
+func unmarshalStrict(data []byte, v interface{}) error {
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.DisallowUnknownFields()
+
+	return d.Decode(v)
+}
+
+// MarshalText encodes the operator by its name
+func (op Operator) MarshalText() ([]byte, error) {
+	if op > LTE {
+		return nil, fmt.Errorf("unknown relational operator %d", byte(op))
+	}
+
+	return []byte(op.String()), nil
+}
+
+// UnmarshalText decodes the operator by any name accepted by ParseRelOp
+func (op *Operator) UnmarshalText(b []byte) error {
+	o, err := ParseRelOp(string(b))
+	if err != nil {
+		return err
+	}
+	*op = o
+
+	return nil
+}
+
+// MarshalJSON encodes the address as a string, "192.0.2.1" when CIDR is false
+// and "192.0.2.0/24" when it is true.
+func (ip IPAddr) MarshalJSON() ([]byte, error) {
+	if ip.IPAddr == nil {
+		return nil, fmt.Errorf("ip address is not specified")
+	}
+	if ip.CIDR && ip.Mask == nil {
+		return nil, fmt.Errorf("mask length must be specified when CIDR is true")
+	}
+
+	return json.Marshal(ip.String())
+}
+
+// UnmarshalJSON decodes the address from a string, the address carrying a mask length
+// is decoded with CIDR set to true.
+func (ip *IPAddr) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	addr := s
+	var mask *uint8
+	if i := strings.LastIndex(s, "/"); i != -1 {
+		m, err := strconv.ParseUint(s[i+1:], 10, 8)
+		if err != nil {
+			return fmt.Errorf("invalid mask length of address %s", s)
+		}
+		l := uint8(m)
+		mask = &l
+		addr = s[:i]
+	}
+	zone := ""
+	if i := strings.Index(addr, "%"); i != -1 {
+		addr, zone = addr[:i], addr[i+1:]
+	}
+	parsed := net.ParseIP(addr)
+	if parsed == nil {
+		return fmt.Errorf("%s is invalid ip address", s)
+	}
+	bits := uint8(128)
+	if v4 := parsed.To4(); v4 != nil {
+		parsed = v4
+		bits = 32
+	}
+	if mask != nil && *mask > bits {
+		return fmt.Errorf("mask length of address %s exceeds %d bits", s, bits)
+	}
+	*ip = IPAddr{IPAddr: &net.IPAddr{IP: parsed, Zone: zone}, CIDR: mask != nil, Mask: mask}
+
+	return nil
+}
+
+// MarshalJSON encodes the spec omitting Range when it is not specified
+func (ip IPAddrSpec) MarshalJSON() ([]byte, error) {
+	type spec IPAddrSpec
+	v := struct {
+		spec
+		Range *[2]*IPAddr `json:"range,omitempty"`
+	}{spec: spec(ip)}
+	if ip.Range[0] != nil || ip.Range[1] != nil {
+		v.Range = &ip.Range
+	}
+
+	return json.Marshal(&v)
+}
+
+// UnmarshalJSON decodes the spec
+func (ip *IPAddrSpec) UnmarshalJSON(b []byte) error {
+	type spec IPAddrSpec
+	v := struct {
+		*spec
+		Range *[2]*IPAddr `json:"range,omitempty"`
+	}{spec: (*spec)(ip)}
+	if err := unmarshalStrict(b, &v); err != nil {
+		return err
+	}
+	if v.Range != nil {
+		ip.Range = *v.Range
+	}
+
+	return nil
+}
+
+// MarshalJSON encodes the port omitting Range when it is not specified
+func (p Port) MarshalJSON() ([]byte, error) {
+	type port Port
+	v := struct {
+		port
+		Range *[2]uint16 `json:"range,omitempty"`
+	}{port: port(p)}
+	if portRange(p.Range).isSet() {
+		v.Range = &p.Range
+	}
+
+	return json.Marshal(&v)
+}
+
+// UnmarshalJSON decodes the port
+func (p *Port) UnmarshalJSON(b []byte) error {
+	type port Port
+	v := struct {
+		*port
+		Range *[2]uint16 `json:"range,omitempty"`
+	}{port: (*port)(p)}
+	if err := unmarshalStrict(b, &v); err != nil {
+		return err
+	}
+	if v.Range != nil {
+		p.Range = *v.Range
+	}
+
+	return nil
+}
+
+// MarshalJSON encodes NAT attributes omitting the address and the port when they are not specified
+func (n NATAttributes) MarshalJSON() ([]byte, error) {
+	type attrs NATAttributes
+	v := struct {
+		attrs
+		L3Addr *[2]*IPAddr `json:"l3Addr,omitempty"`
+		Port   *[2]uint16  `json:"port,omitempty"`
+	}{attrs: attrs(n)}
+	if n.L3Addr[0] != nil || n.L3Addr[1] != nil {
+		v.L3Addr = &n.L3Addr
+	}
+	if n.Port[0] != 0 || n.Port[1] != 0 {
+		v.Port = &n.Port
+	}
+
+	return json.Marshal(&v)
+}
+
+// UnmarshalJSON decodes NAT attributes
+func (n *NATAttributes) UnmarshalJSON(b []byte) error {
+	type attrs NATAttributes
+	v := struct {
+		*attrs
+		L3Addr *[2]*IPAddr `json:"l3Addr,omitempty"`
+		Port   *[2]uint16  `json:"port,omitempty"`
+	}{attrs: (*attrs)(n)}
+	if err := unmarshalStrict(b, &v); err != nil {
+		return err
+	}
+	if v.L3Addr != nil {
+		n.L3Addr = *v.L3Addr
+	}
+	if v.Port != nil {
+		n.Port = *v.Port
+	}
+
+	return nil
+}
+
+// MarshalJSON encodes the element's type by its name
+func (e ConcatElement) MarshalJSON() ([]byte, error) {
+	type element ConcatElement
+	v := struct {
+		element
+		EType string `json:"eType,omitempty"`
+	}{element: element(e), EType: e.EType.Name}
+
+	return json.Marshal(&v)
+}
+
+// UnmarshalJSON decodes the element's type from its name
+func (e *ConcatElement) UnmarshalJSON(b []byte) error {
+	type element ConcatElement
+	v := struct {
+		*element
+		EType string `json:"eType,omitempty"`
+	}{element: (*element)(e)}
+	if err := unmarshalStrict(b, &v); err != nil {
+		return err
+	}
+	t, ok := lookupSetDatatype(v.EType)
+	if !ok {
+		return fmt.Errorf("unknown type %s of concatenation element", v.EType)
+	}
+	e.EType = t
+
+	return nil
+}
+
+// verdictNames maps verdicts to their names in nft syntax
+var verdictNames = map[int]string{
+	NFT_ACCEPT:        "accept",
+	NFT_DROP:          "drop",
+	unix.NFT_JUMP:     "jump",
+	unix.NFT_GOTO:     "goto",
+	unix.NFT_RETURN:   "return",
+	unix.NFT_CONTINUE: "continue",
+	unix.NFT_BREAK:    "break",
+}
+
+// verdictName returns the name of the verdict in nft syntax
+func verdictName(kind int) string {
+	if name, ok := verdictNames[kind]; ok {
+		return name
+	}
+
+	return fmt.Sprintf("verdict %d", kind)
+}
+
+// parseVerdict builds RuleAction from the verdict in nft syntax, like "accept" or "jump web"
+func parseVerdict(s string) (*RuleAction, error) {
+	fields := strings.Fields(s)
+	if len(fields) == 0 || len(fields) > 2 {
+		return nil, fmt.Errorf("invalid verdict %q", s)
+	}
+	for kind, name := range verdictNames {
+		if name != fields[0] {
+			continue
+		}
+		if len(fields) == 2 && kind != unix.NFT_JUMP && kind != unix.NFT_GOTO {
+			return nil, fmt.Errorf("verdict %s cannot refer to chain %s", name, fields[1])
+		}
+		return SetVerdict(kind, fields[1:]...)
+	}
+
+	return nil, fmt.Errorf("unknown verdict %q", s)
+}
+
+type redirectJSON struct {
+	Port   uint16 `json:"port"`
+	TProxy bool   `json:"tproxy,omitempty"`
+}
+
+type masqueradeJSON struct {
+	Random      *bool    `json:"random,omitempty"`
+	FullyRandom *bool    `json:"fullyRandom,omitempty"`
+	Persistent  *bool    `json:"persistent,omitempty"`
+	ToPort      []uint16 `json:"toPort,omitempty"`
+}
+
+type natJSON struct {
+	Type        string      `json:"type"`
+	Random      *bool       `json:"random,omitempty"`
+	FullyRandom *bool       `json:"fullyRandom,omitempty"`
+	Persistent  *bool       `json:"persistent,omitempty"`
+	Address     *IPAddrSpec `json:"address,omitempty"`
+	Port        *Port       `json:"port,omitempty"`
+}
+
+type rejectJSON struct {
+	Type uint32 `json:"type"`
+	Code uint8  `json:"code"`
+}
+
+type loadbalanceJSON struct {
+	Chains  []string `json:"chains,omitempty"`
+	Action  int      `json:"action,omitempty"`
+	Mode    int      `json:"mode,omitempty"`
+	SetRef  *SetRef  `json:"setRef,omitempty"`
+	Modulus uint32   `json:"modulus,omitempty"`
+}
+
+type queueJSON struct {
+	Num    uint16 `json:"num"`
+	Total  uint16 `json:"total,omitempty"`
+	Bypass bool   `json:"bypass,omitempty"`
+	Fanout bool   `json:"fanout,omitempty"`
+}
+
+type markJSON struct {
+	Value uint32 `json:"value"`
+	Mask  uint32 `json:"mask,omitempty"`
+}
+
+type markMapJSON struct {
+	Set   string    `json:"set"`
+	Match MatchType `json:"match"`
+}
+
+// ruleActionJSON defines JSON encoding of RuleAction, only one of the actions is set
+type ruleActionJSON struct {
+	Verdict       string             `json:"verdict,omitempty"`
+	Redirect      *redirectJSON      `json:"redirect,omitempty"`
+	Masquerade    *masqueradeJSON    `json:"masquerade,omitempty"`
+	NAT           *natJSON           `json:"nat,omitempty"`
+	Reject        *rejectJSON        `json:"reject,omitempty"`
+	Loadbalance   *loadbalanceJSON   `json:"loadbalance,omitempty"`
+	DNATMap       *DNATMapAttributes `json:"dnatMap,omitempty"`
+	Inline        []*Rule            `json:"inline,omitempty"`
+	Queue         *queueJSON         `json:"queue,omitempty"`
+	Counter       *Counter           `json:"counter,omitempty"`
+	Log           *Log               `json:"log,omitempty"`
+	Mark          *markJSON          `json:"mark,omitempty"`
+	NFTrace       bool               `json:"nftrace,omitempty"`
+	CtMark        *uint32            `json:"ctMark,omitempty"`
+	MarkMap       *markMapJSON       `json:"markMap,omitempty"`
+	CtExpectation string             `json:"ctExpectation,omitempty"`
+}
+
+var natTypeNames = map[expr.NATType]string{
+	expr.NATTypeSourceNAT: "snat",
+	expr.NATTypeDestNAT:   "dnat",
+}
+
+// MarshalJSON encodes the action
+func (ra RuleAction) MarshalJSON() ([]byte, error) {
+	v := ruleActionJSON{}
+	if ra.verdict != nil {
+		v.Verdict = verdictName(int(ra.verdict.Kind))
+		if ra.verdict.Chain != "" {
+			v.Verdict += " " + ra.verdict.Chain
+		}
+	}
+	if ra.redirect != nil {
+		v.Redirect = &redirectJSON{Port: ra.redirect.port, TProxy: ra.redirect.tproxy}
+	}
+	if ra.masq != nil {
+		v.Masquerade = &masqueradeJSON{
+			Random:      ra.masq.random,
+			FullyRandom: ra.masq.fullyRandom,
+			Persistent:  ra.masq.persistent,
+		}
+		for _, p := range ra.masq.toPort {
+			if p != nil {
+				v.Masquerade.ToPort = append(v.Masquerade.ToPort, *p)
+			}
+		}
+	}
+	if ra.nat != nil {
+		t, ok := natTypeNames[ra.nat.nattype]
+		if !ok {
+			return nil, fmt.Errorf("unknown nat type %d", ra.nat.nattype)
+		}
+		v.NAT = &natJSON{
+			Type:        t,
+			Random:      ra.nat.random,
+			FullyRandom: ra.nat.fullyRandom,
+			Persistent:  ra.nat.persistent,
+			Address:     ra.nat.address,
+			Port:        ra.nat.port,
+		}
+	}
+	if ra.reject != nil {
+		v.Reject = &rejectJSON{Type: ra.reject.rejectType, Code: ra.reject.rejectCode}
+	}
+	if ra.loadbalance != nil {
+		v.Loadbalance = &loadbalanceJSON{
+			Chains:  ra.loadbalance.chains,
+			Action:  ra.loadbalance.action,
+			Mode:    ra.loadbalance.mode,
+			SetRef:  ra.loadbalance.setRef,
+			Modulus: ra.loadbalance.modulus,
+		}
+	}
+	v.DNATMap = ra.dnatMap
+	v.Inline = ra.inline
+	if ra.queue != nil {
+		v.Queue = &queueJSON{Num: ra.queue.num, Total: ra.queue.total, Bypass: ra.queue.bypass, Fanout: ra.queue.fanout}
+	}
+	v.Counter = ra.counter
+	v.Log = ra.log
+	if ra.mark != nil {
+		v.Mark = &markJSON{Value: ra.mark.Value, Mask: ra.mark.Mask}
+	}
+	v.NFTrace = ra.nftrace
+	v.CtMark = ra.ctMark
+	if ra.markMap != nil {
+		v.MarkMap = &markMapJSON{Set: ra.markMap.set, Match: ra.markMap.match}
+	}
+	v.CtExpectation = ra.ctExpectation
+
+	return json.Marshal(&v)
+}
+
+// UnmarshalJSON decodes the action, the action is built by the same helpers as programmatic
+// actions, so it is validated the same way.
+func (ra *RuleAction) UnmarshalJSON(b []byte) error {
+	v := ruleActionJSON{}
+	if err := unmarshalStrict(b, &v); err != nil {
+		return err
+	}
+	var action *RuleAction
+	var err error
+	set := 0
+	if v.Verdict != "" {
+		set++
+		action, err = parseVerdict(v.Verdict)
+	}
+	if v.Redirect != nil {
+		set++
+		action, err = SetRedirect(int(v.Redirect.Port), v.Redirect.TProxy)
+	}
+	if v.Masquerade != nil {
+		set++
+		action, err = unmarshalMasquerade(v.Masquerade)
+	}
+	if v.NAT != nil {
+		set++
+		action, err = unmarshalNAT(v.NAT)
+	}
+	if v.Reject != nil {
+		set++
+		action, err = SetReject(int(v.Reject.Type), int(v.Reject.Code))
+	}
+	if v.Loadbalance != nil {
+		set++
+		if v.Loadbalance.SetRef != nil {
+			action, err = SetWeightedLoadbalance(v.Loadbalance.SetRef, v.Loadbalance.Modulus, v.Loadbalance.Mode)
+		} else {
+			action, err = SetLoadbalance(v.Loadbalance.Chains, v.Loadbalance.Action, v.Loadbalance.Mode)
+		}
+	}
+	if v.DNATMap != nil {
+		set++
+		action, err = SetDNATMap(v.DNATMap)
+	}
+	if v.Inline != nil {
+		set++
+		action, err = SetJumpInline(v.Inline)
+	}
+	if v.Queue != nil {
+		set++
+		action, err = SetQueue(v.Queue.Num, v.Queue.Total, v.Queue.Bypass, v.Queue.Fanout)
+	}
+	if v.Counter != nil {
+		set++
+		action = SetCounterAction()
+	}
+	if v.Log != nil {
+		set++
+		action, err = SetLogAction(v.Log)
+	}
+	if v.Mark != nil {
+		set++
+		action = SetMarkAction(v.Mark.Value, v.Mark.Mask)
+	}
+	if v.NFTrace {
+		set++
+		action = SetNFTraceAction()
+	}
+	if v.CtMark != nil {
+		set++
+		action = SetCtMarkAction(*v.CtMark)
+	}
+	if v.MarkMap != nil {
+		set++
+		action, err = SetMarkFromMap(v.MarkMap.Set, v.MarkMap.Match)
+	}
+	if v.CtExpectation != "" {
+		set++
+		action, err = SetCtExpectation(v.CtExpectation)
+	}
+	switch {
+	case set == 0:
+		return fmt.Errorf("rule's action is not set")
+	case set > 1:
+		return fmt.Errorf("rule's action carries %d actions, only one can be set", set)
+	case err != nil:
+		return err
+	}
+	*ra = *action
+
+	return nil
+}
+
+func unmarshalMasquerade(v *masqueradeJSON) (*RuleAction, error) {
+	if len(v.ToPort) > 2 {
+		return nil, fmt.Errorf("more than maximum of 2 ports provided")
+	}
+	ra := &RuleAction{masq: &masquerade{
+		random:      v.Random,
+		fullyRandom: v.FullyRandom,
+		persistent:  v.Persistent,
+	}}
+	for i := range v.ToPort {
+		p := v.ToPort[i]
+		ra.masq.toPort[i] = &p
+	}
+
+	return ra, nil
+}
+
+func unmarshalNAT(v *natJSON) (*RuleAction, error) {
+	ra := &RuleAction{nat: &nat{
+		random:      v.Random,
+		fullyRandom: v.FullyRandom,
+		persistent:  v.Persistent,
+		address:     v.Address,
+		port:        v.Port,
+	}}
+	for t, name := range natTypeNames {
+		if name == v.Type {
+			ra.nat.nattype = t
+			return ra, nil
+		}
+	}
+
+	return nil, fmt.Errorf("unknown nat type %q", v.Type)
+}
@@ -0,0 +1,141 @@
+package nftableslib
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestLoadRule(t *testing.T) {
+	tests := []struct {
+		name    string
+		rule    string
+		success bool
+	}{
+		{
+			name:    "Port list with verdict",
+			rule:    `{"l4": {"l4Proto": 6, "dst": {"list": [80, 443]}}, "action": {"verdict": "accept"}}`,
+			success: true,
+		},
+		{
+			name:    "Excluded source prefix with jump",
+			rule:    `{"l3": {"src": {"list": ["10.0.0.0/8"], "relOp": "!="}}, "action": {"verdict": "jump web"}}`,
+			success: true,
+		},
+		{
+			name:    "Unknown field",
+			rule:    `{"l4": {"l4Proto": 6, "dport": 80}}`,
+			success: false,
+		},
+		{
+			name:    "Unknown operator",
+			rule:    `{"l3": {"src": {"list": ["10.0.0.1"], "relOp": "like"}}}`,
+			success: false,
+		},
+		{
+			name:    "Invalid address",
+			rule:    `{"l3": {"src": {"list": ["10.0.0.256"]}}}`,
+			success: false,
+		},
+		{
+			name:    "Mask length exceeding address length",
+			rule:    `{"l3": {"src": {"list": ["10.0.0.0/33"]}}}`,
+			success: false,
+		},
+		{
+			name:    "Rule failing validation",
+			rule:    `{"l4": {"l4Proto": 6, "dst": {"list": [80], "range": [1, 2]}}}`,
+			success: false,
+		},
+		{
+			name:    "Jump without chain",
+			rule:    `{"l4": {"l4Proto": 6, "dst": {"list": [80]}}, "action": {"verdict": "jump"}}`,
+			success: false,
+		},
+		{
+			name:    "Accept referring to chain",
+			rule:    `{"l4": {"l4Proto": 6, "dst": {"list": [80]}}, "action": {"verdict": "accept web"}}`,
+			success: false,
+		},
+		{
+			name:    "Two actions",
+			rule:    `{"l4": {"l4Proto": 6, "dst": {"list": [80]}}, "action": {"verdict": "accept", "redirect": {"port": 8080}}}`,
+			success: false,
+		},
+		{
+			name:    "Ordered actions",
+			rule:    `{"l4": {"l4Proto": 6, "dst": {"list": [22]}}, "actions": [{"counter": {}}, {"log": {"key": 2, "value": "c3No"}}, {"mark": {"value": 1}}, {"verdict": "accept"}]}`,
+			success: true,
+		},
+		{
+			name:    "Mark from map",
+			rule:    `{"actions": [{"markMap": {"set": "prefix_marks", "match": 1}}, {"verdict": "accept"}]}`,
+			success: true,
+		},
+		{
+			name:    "Mark from map without name",
+			rule:    `{"actions": [{"markMap": {"set": ""}}]}`,
+			success: false,
+		},
+		{
+			name:    "Action followed by terminal action",
+			rule:    `{"actions": [{"queue": {"num": 1, "bypass": true}}, {"verdict": "accept"}]}`,
+			success: false,
+		},
+		{
+			name:    "Unknown nat type",
+			rule:    `{"action": {"nat": {"type": "fullnat", "address": {"list": ["10.0.0.1"]}}}}`,
+			success: false,
+		},
+	}
+	for _, tt := range tests {
+		_, err := LoadRule([]byte(tt.rule))
+		if err != nil && tt.success {
+			t.Fatalf("test \"%s\" failed with error: %+v but supposed to succeed", tt.name, err)
+		}
+		if err == nil && !tt.success {
+			t.Fatalf("test \"%s\" succeeded but supposed to fail", tt.name)
+		}
+	}
+}
+
+func TestIPAddrJSON(t *testing.T) {
+	host, _ := NewIPAddr("2001:db8::1")
+	prefix, _ := NewIPAddr("192.0.2.0/24")
+	tests := []struct {
+		name string
+		addr *IPAddr
+		want string
+	}{
+		{
+			name: "Address without CIDR",
+			addr: &IPAddr{IPAddr: prefix.IPAddr},
+			want: `"192.0.2.0"`,
+		},
+		{
+			name: "Prefix",
+			addr: prefix,
+			want: `"192.0.2.0/24"`,
+		},
+		{
+			name: "Host address created by NewIPAddr",
+			addr: host,
+			want: `"2001:db8::1/128"`,
+		},
+	}
+	for _, tt := range tests {
+		b, err := json.Marshal(tt.addr)
+		if err != nil {
+			t.Fatalf("test \"%s\" failed with error: %+v but supposed to succeed", tt.name, err)
+		}
+		if string(b) != tt.want {
+			t.Fatalf("test \"%s\" failed, expected %s, got %s", tt.name, tt.want, string(b))
+		}
+		addr := &IPAddr{}
+		if err := json.Unmarshal(b, addr); err != nil {
+			t.Fatalf("test \"%s\" failed with error: %+v but supposed to succeed", tt.name, err)
+		}
+		if !addr.IP.Equal(tt.addr.IP) || addr.CIDR != tt.addr.CIDR || (addr.CIDR && *addr.Mask != *tt.addr.Mask) {
+			t.Fatalf("test \"%s\" failed, expected %+v, got %+v", tt.name, tt.addr, addr)
+		}
+	}
+}
@@ -231,8 +231,13 @@ func marshalExpression(exp expr.Any) ([]byte, error) {
 		return b, nil
 	}
 	if e, ok := exp.(*expr.Payload); ok {
-		b = append(b, []byte("{\"DestRegister\":")...)
-		b = append(b, []byte(fmt.Sprintf("%d", e.DestRegister))...)
+		if e.OperationType == expr.PayloadWrite {
+			b = append(b, []byte("{\"OperationType\":\"expr.PayloadWrite\",\"SourceRegister\":")...)
+			b = append(b, []byte(fmt.Sprintf("%d", e.SourceRegister))...)
+		} else {
+			b = append(b, []byte("{\"DestRegister\":")...)
+			b = append(b, []byte(fmt.Sprintf("%d", e.DestRegister))...)
+		}
 		b = append(b, []byte(",\"Base\":")...)
 		switch e.Base {
 		case expr.PayloadBaseLLHeader:
@@ -453,6 +458,12 @@ func marshalExpression(exp expr.Any) ([]byte, error) {
 			expr.Queue:
 			expr.Rt:
 	*/
+	// Expressions without dedicated marshaling, for example passed in Rule's RawExprs,
+	// are marshaled with their type name and exported fields.
+	data, err := json.Marshal(exp)
+	if err != nil {
+		return nil, fmt.Errorf("unknown expression type %T", exp)
+	}
 
-	return nil, fmt.Errorf("unknown expression type %T", exp)
+	return []byte(fmt.Sprintf("{\"Type\":\"%T\",\"Expr\":%s}", exp, data)), nil
 }
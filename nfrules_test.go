@@ -1,8 +1,11 @@
 package nftableslib
 
 import (
+	"errors"
 	"testing"
 
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
 	"golang.org/x/sys/unix"
 )
 
@@ -31,6 +34,7 @@ func setIPAddr(t *testing.T, addr string) *IPAddr {
 }
 
 func TestRule(t *testing.T) {
+	pktType := uint8(0)
 	//	ipv4Mask := uint8(24)
 	ipVersion := byte(4)
 
@@ -101,6 +105,97 @@ func TestRule(t *testing.T) {
 			},
 			success: true,
 		},
+		{
+			name: "Raw expressions with Action",
+			rule: &Rule{
+				RawExprs: []expr.Any{
+					&expr.Numgen{Register: 1, Modulus: 2, Type: unix.NFT_NG_INCREMENTAL},
+					&expr.Verdict{Kind: expr.VerdictContinue},
+				},
+				Action: setActionVerdict(t, NFT_ACCEPT),
+			},
+			success: true,
+		},
+		{
+			name: "Raw terminal verdict only",
+			rule: &Rule{
+				RawExprs: []expr.Any{&expr.Verdict{Kind: expr.VerdictDrop}},
+			},
+			success: true,
+		},
+		{
+			name: "Raw terminal verdict with Action",
+			rule: &Rule{
+				RawExprs: []expr.Any{&expr.Verdict{Kind: expr.VerdictDrop}},
+				Action:   setActionVerdict(t, NFT_ACCEPT),
+			},
+			success: false,
+		},
+		{
+			name: "Duplicated raw terminal verdicts",
+			rule: &Rule{
+				RawExprs: []expr.Any{
+					&expr.Verdict{Kind: expr.VerdictAccept},
+					&expr.Verdict{Kind: expr.VerdictJump, Chain: "fake-chain-1"},
+				},
+			},
+			success: false,
+		},
+		{
+			name: "Meta mark match and meta expression",
+			rule: &Rule{
+				Meta: &MetaRule{
+					Mark: &MetaMark{Value: 1},
+					Expr: []MetaExpr{{Key: unix.NFT_META_SKUID, Value: []byte{0xe8, 0x03, 0x0, 0x0}}},
+				},
+				Action: setActionVerdict(t, NFT_ACCEPT),
+			},
+			success: true,
+		},
+		{
+			name: "Meta contradictory mark",
+			rule: &Rule{
+				Meta: &MetaRule{
+					Mark: &MetaMark{Value: 1},
+					Expr: []MetaExpr{{Key: unix.NFT_META_MARK, Value: []byte{0x1, 0x0, 0x0, 0x0}, RelOp: NEQ}},
+				},
+			},
+			success: false,
+		},
+		{
+			name: "Meta equal to different values",
+			rule: &Rule{
+				Meta: &MetaRule{
+					PktType: &pktType,
+					Expr:    []MetaExpr{{Key: unix.NFT_META_PKTTYPE, Value: []byte{0x1}}},
+				},
+			},
+			success: false,
+		},
+		{
+			name: "Meta duplicate key",
+			rule: &Rule{
+				Meta: &MetaRule{
+					Expr: []MetaExpr{
+						{Key: unix.NFT_META_SKGID, Value: []byte{0x1, 0x0, 0x0, 0x0}, RelOp: NEQ},
+						{Key: unix.NFT_META_SKGID, Value: []byte{0x1, 0x0, 0x0, 0x0}, RelOp: NEQ},
+					},
+				},
+			},
+			success: false,
+		},
+		{
+			name: "Meta not equal to different values",
+			rule: &Rule{
+				Meta: &MetaRule{
+					Expr: []MetaExpr{
+						{Key: unix.NFT_META_SKGID, Value: []byte{0x1, 0x0, 0x0, 0x0}, RelOp: NEQ},
+						{Key: unix.NFT_META_SKGID, Value: []byte{0x2, 0x0, 0x0, 0x0}, RelOp: NEQ},
+					},
+				},
+			},
+			success: true,
+		},
 	}
 
 	for _, tt := range tests {
@@ -114,3 +209,184 @@ func TestRule(t *testing.T) {
 		}
 	}
 }
+
+func TestMetaGuardsOrder(t *testing.T) {
+	nfproto := nftables.TableFamilyIPv4
+	nfr := &nfRules{table: &nftables.Table{Name: "filter", Family: nftables.TableFamilyIPv4}}
+	rr, err := nfr.buildRule(&Rule{
+		L3: &L3Rule{
+			Src: &IPAddrSpec{List: []*IPAddr{setIPAddr(t, "192.0.2.1")}},
+		},
+		Meta: &MetaRule{
+			NFProto: &nfproto,
+			Mark:    &MetaMark{Set: true, Value: 1},
+		},
+		Action: setActionVerdict(t, NFT_ACCEPT),
+	})
+	if err != nil {
+		t.Fatalf("failed to build rule with error: %+v", err)
+	}
+	r := rr.rule
+	m, ok := r.Exprs[0].(*expr.Meta)
+	if !ok || m.Key != expr.MetaKeyNFPROTO {
+		t.Fatalf("expected meta nfproto guard as the first expression, got %T", r.Exprs[0])
+	}
+	payload, mark := -1, -1
+	for i, e := range r.Exprs {
+		switch e := e.(type) {
+		case *expr.Payload:
+			if payload == -1 {
+				payload = i
+			}
+		case *expr.Meta:
+			if e.Key == expr.MetaKeyMARK && e.SourceRegister {
+				mark = i
+			}
+		}
+	}
+	if payload == -1 || mark == -1 || mark < payload {
+		t.Fatalf("expected mark to be set after payload match, payload at %d, mark at %d", payload, mark)
+	}
+}
+
+func TestParseRelOp(t *testing.T) {
+	tests := []struct {
+		input   string
+		op      Operator
+		success bool
+	}{
+		{input: "eq", op: EQ, success: true},
+		{input: "==", op: EQ, success: true},
+		{input: "=", op: EQ, success: true},
+		{input: "neq", op: NEQ, success: true},
+		{input: "NE", op: NEQ, success: true},
+		{input: "!=", op: NEQ, success: true},
+		{input: "gt", op: GT, success: true},
+		{input: ">", op: GT, success: true},
+		{input: " >= ", op: GTE, success: true},
+		{input: "ge", op: GTE, success: true},
+		{input: "lt", op: LT, success: true},
+		{input: "<", op: LT, success: true},
+		{input: "<=", op: LTE, success: true},
+		{input: "le", op: LTE, success: true},
+		{input: "", success: false},
+		{input: "=>", success: false},
+		{input: "like", success: false},
+	}
+	for _, tt := range tests {
+		op, err := ParseRelOp(tt.input)
+		if err != nil && tt.success {
+			t.Errorf("Test \"%s\" failed with error: %+v but supposed to succeed", tt.input, err)
+			continue
+		}
+		if err == nil && !tt.success {
+			t.Errorf("Test \"%s\" succeeded but supposed to fail", tt.input)
+			continue
+		}
+		if tt.success && op != tt.op {
+			t.Errorf("Test \"%s\" failed, expected operator %s, got %s", tt.input, tt.op, op)
+		}
+	}
+	// Names returned by String are parsed back to the same operator
+	for op := EQ; op <= LTE; op++ {
+		parsed, err := ParseRelOp(op.String())
+		if err != nil || parsed != op {
+			t.Errorf("operator %s is not parsed back, got %s with error: %+v", op, parsed, err)
+		}
+	}
+}
+
+func TestUnsupportedRelOp(t *testing.T) {
+	tests := []struct {
+		name    string
+		rule    *Rule
+		success bool
+	}{
+		{
+			name: "Greater than single port",
+			rule: &Rule{
+				L4: &L4Rule{L4Proto: unix.IPPROTO_TCP, Dst: &Port{List: []uint16{1024}, RelOp: GTE}},
+			},
+			success: true,
+		},
+		{
+			name: "Greater than port list",
+			rule: &Rule{
+				L4: &L4Rule{L4Proto: unix.IPPROTO_TCP, Dst: &Port{List: []uint16{80, 443}, RelOp: GT}},
+			},
+			success: false,
+		},
+		{
+			name: "Less than port range",
+			rule: &Rule{
+				L4: &L4Rule{L4Proto: unix.IPPROTO_TCP, Dst: &Port{Range: [2]uint16{80, 90}, RelOp: LT}},
+			},
+			success: false,
+		},
+		{
+			name: "Greater than address list",
+			rule: &Rule{
+				L3: &L3Rule{Src: &IPAddrSpec{List: []*IPAddr{setIPAddr(t, "192.0.2.1"), setIPAddr(t, "192.0.2.2")}, RelOp: GT}},
+			},
+			success: false,
+		},
+		{
+			name: "Less than l4 protocol",
+			rule: &Rule{
+				L3: &L3Rule{Protocol: L3Protocol(unix.IPPROTO_UDP), ProtocolRelOp: LT},
+			},
+			success: true,
+		},
+		{
+			name: "Greater than meta key",
+			rule: &Rule{
+				Meta: &MetaRule{Expr: []MetaExpr{{Key: unix.NFT_META_SKUID, Value: []byte{0x1, 0x0, 0x0, 0x0}, RelOp: GT}}},
+			},
+			success: false,
+		},
+		{
+			name:    "Greater than fib result",
+			rule:    &Rule{Fib: &Fib{ResultOIF: true, FlagDADDR: true, RelOp: GT}},
+			success: false,
+		},
+		{
+			name: "Unknown operator",
+			rule: &Rule{
+				L4: &L4Rule{L4Proto: unix.IPPROTO_TCP, Dst: &Port{List: []uint16{1024}, RelOp: LTE + 1}},
+			},
+			success: false,
+		},
+	}
+	for _, tt := range tests {
+		err := tt.rule.Validate()
+		if err != nil && tt.success {
+			t.Errorf("Test \"%s\" failed with error: %+v but supposed to succeed", tt.name, err)
+			continue
+		}
+		if err == nil && !tt.success {
+			t.Errorf("Test \"%s\" succeeded but supposed to fail", tt.name)
+			continue
+		}
+		if err != nil {
+			var unsupported *ErrUnsupportedOperator
+			if !errors.As(err, &unsupported) {
+				t.Errorf("Test \"%s\" expected ErrUnsupportedOperator, got %T: %+v", tt.name, err, err)
+			}
+		}
+	}
+
+	// Relational operators of a single port are compiled into a single comparison
+	e, _, err := processPortList(unix.IPPROTO_TCP, 2, []uint16{1024}, GTE, defaultIDs)
+	if err != nil {
+		t.Fatalf("failed to build single port match with error: %+v", err)
+	}
+	if cmp, ok := e[len(e)-1].(*expr.Cmp); !ok || cmp.Op != expr.CmpOpGte {
+		t.Fatalf("expected cmp gte as the last expression, got %+v", e[len(e)-1])
+	}
+	// Expressions are not built for unsupported operators even when validation is skipped
+	_, _, err = processPortList(unix.IPPROTO_TCP, 2, []uint16{80, 443}, GT, defaultIDs)
+	var unsupported *ErrUnsupportedOperator
+	if !errors.As(err, &unsupported) || unsupported.Op != GT {
+		t.Fatalf("expected ErrUnsupportedOperator for port list, got %+v", err)
+	}
+}
@@ -0,0 +1,284 @@
+package nftableslib
+
+import (
+	"fmt"
+
+	"github.com/google/nftables"
+)
+
+// RulesetSpec declares tables with their sets, chains and rules, ApplyRuleset builds the declared objects.
+type RulesetSpec struct {
+	Tables []*TableSpec
+}
+
+// TableSpec declares a table, Options apply when the table is created by ApplyRuleset.
+type TableSpec struct {
+	Name    string
+	Family  nftables.TableFamily
+	Options []TableOption
+	Sets    []*SetSpec
+	Chains  []*ChainSpec
+}
+
+// SetSpec declares a named set or map of the table with its elements
+type SetSpec struct {
+	Attributes SetAttributes
+	Elements   []nftables.SetElement
+}
+
+// ChainSpec declares a chain of the table, Attributes is nil for regular chains. Rules are kept
+// in the chain in the declared order. ForeignRules is the policy applied to foreign rules of the existing
+// chain, ForeignRulesDefault applies the chain's policy.
+type ChainSpec struct {
+	Name         string
+	Attributes   *ChainAttributes
+	Rules        []*Rule
+	ForeignRules ForeignRulePolicy
+}
+
+// Validate checks the spec for missing and duplicate names
+func (s *RulesetSpec) Validate() error {
+	tables := make(map[nftables.TableFamily]map[string]bool)
+	for _, ts := range s.Tables {
+		if ts == nil || ts.Name == "" {
+			return fmt.Errorf("table name cannot be empty")
+		}
+		if tables[ts.Family] == nil {
+			tables[ts.Family] = make(map[string]bool)
+		}
+		if tables[ts.Family][ts.Name] {
+			return fmt.Errorf("duplicate table %s of family %d", ts.Name, ts.Family)
+		}
+		tables[ts.Family][ts.Name] = true
+		sets := make(map[string]bool)
+		for _, ss := range ts.Sets {
+			if ss == nil {
+				return fmt.Errorf("table %s carries nil set", ts.Name)
+			}
+			if sets[ss.Attributes.Name] {
+				return fmt.Errorf("duplicate set %s in table %s", ss.Attributes.Name, ts.Name)
+			}
+			sets[ss.Attributes.Name] = true
+		}
+		chains := make(map[string]bool)
+		for _, cs := range ts.Chains {
+			if cs == nil || cs.Name == "" {
+				return fmt.Errorf("chain name in table %s cannot be empty", ts.Name)
+			}
+			if chains[cs.Name] {
+				return fmt.Errorf("duplicate chain %s in table %s", cs.Name, ts.Name)
+			}
+			chains[cs.Name] = true
+			if err := cs.ForeignRules.validate(); err != nil {
+				return fmt.Errorf("chain %s in table %s: %+v", cs.Name, ts.Name, err)
+			}
+			for i, r := range cs.Rules {
+				if r == nil {
+					return fmt.Errorf("rule %d of chain %s in table %s is nil", i, cs.Name, ts.Name)
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// specTable carries stores of a table declared by the spec
+type specTable struct {
+	spec   *TableSpec
+	chains *nfChains
+	sets   *nfSets
+	// created carries sets created by the spec, elements of other sets are replaced
+	created map[string]*nftables.Set
+	// existing carries chains which existed before the spec was applied
+	existing map[string]bool
+}
+
+// ApplyRuleset creates objects declared by the spec which do not exist and updates existing ones
+// in a single transaction. Objects are queued in the order of their dependencies: tables, sets,
+// chains, elements of sets, which can jump to chains, and finally rules. Elements of existing sets
+// are replaced by the declared ones, rules of existing chains are replaced by position and extra
+// rules are appended. Foreign rules of existing chains, not created by the library, are treated according
+// to the chain's ForeignRulePolicy, preserved foreign rules do not take positions of declared rules.
+// Objects which are not declared are left intact. If the transaction fails,
+// the ruleset is rolled back to the state before ApplyRuleset.
+func (nft *nfTables) ApplyRuleset(spec *RulesetSpec) error {
+	if err := writable(nft.conn); err != nil {
+		return err
+	}
+	if err := spec.Validate(); err != nil {
+		return err
+	}
+	snapshot, err := nft.Snapshot()
+	if err != nil {
+		return err
+	}
+	if err := nft.applyRuleset(spec); err != nil {
+		if rerr := nft.Rollback(snapshot); rerr != nil {
+			return fmt.Errorf("failed to apply ruleset with error: %+v, rollback failed with error: %+v", err, rerr)
+		}
+		return err
+	}
+
+	return nil
+}
+
+func (nft *nfTables) applyRuleset(spec *RulesetSpec) error {
+	tables := make([]*specTable, 0, len(spec.Tables))
+	for _, ts := range spec.Tables {
+		if err := nft.Create(ts.Name, ts.Family, ts.Options...); err != nil {
+			return err
+		}
+		nft.Lock()
+		nt := nft.tables[ts.Family][ts.Name]
+		nft.Unlock()
+		nfc, ok := nt.ChainsInterface.(*nfChains)
+		if !ok {
+			return fmt.Errorf("chains of table %s are not managed by the library", ts.Name)
+		}
+		nfs, ok := nt.SetsInterface.(*nfSets)
+		if !ok {
+			return fmt.Errorf("sets of table %s are not managed by the library", ts.Name)
+		}
+		tables = append(tables, &specTable{
+			spec:     ts,
+			chains:   nfc,
+			sets:     nfs,
+			created:  make(map[string]*nftables.Set),
+			existing: make(map[string]bool),
+		})
+	}
+	for _, st := range tables {
+		for _, ss := range st.spec.Sets {
+			if _, ok := st.sets.get(ss.Attributes.Name); ok && st.sets.Exist(ss.Attributes.Name) {
+				continue
+			}
+			attrs := ss.Attributes
+			s, err := st.sets.create(&attrs, nil)
+			if err != nil {
+				return err
+			}
+			st.sets.store(s)
+			st.created[s.Name] = s
+		}
+	}
+	for _, st := range tables {
+		for _, cs := range st.spec.Chains {
+			if st.chains.Exist(cs.Name) {
+				st.existing[cs.Name] = true
+				continue
+			}
+			if err := st.chains.Create(cs.Name, cs.Attributes); err != nil {
+				return err
+			}
+		}
+	}
+	for _, st := range tables {
+		for _, ss := range st.spec.Sets {
+			if s, ok := st.sets.get(ss.Attributes.Name); ok {
+				st.sets.warnSetMemory(s, len(ss.Elements))
+			}
+			if s, ok := st.created[ss.Attributes.Name]; ok {
+				if len(ss.Elements) == 0 {
+					continue
+				}
+				if err := st.sets.addElements(s, ss.Elements, true); err != nil {
+					return err
+				}
+				continue
+			}
+			s, _ := st.sets.get(ss.Attributes.Name)
+			if err := st.sets.replaceElements(s, ss.Elements); err != nil {
+				return err
+			}
+		}
+	}
+	stores := make([]*nfRules, 0)
+	for _, st := range tables {
+		for _, cs := range st.spec.Chains {
+			nfr, err := st.rules(cs.Name)
+			if err != nil {
+				return err
+			}
+			policy := cs.ForeignRules
+			if policy == ForeignRulesDefault {
+				policy = st.chains.foreignRulePolicy(cs.Name)
+			}
+			if err := nfr.applyRules(cs.Rules, st.existing[cs.Name], policy); err != nil {
+				if _, ok := err.(*ErrForeignRules); ok {
+					return err
+				}
+				return fmt.Errorf("failed to apply rules of chain %s of table %s with error: %+v", cs.Name, st.spec.Name, err)
+			}
+			stores = append(stores, nfr)
+		}
+	}
+	if err := flush(nft.conn); err != nil {
+		return err
+	}
+	for _, nfr := range stores {
+		if err := nfr.UpdateRulesHandle(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// rules returns the store of rules of the table's chain
+func (st *specTable) rules(chain string) (*nfRules, error) {
+	ri, err := st.chains.Chain(chain)
+	if err != nil {
+		return nil, err
+	}
+	nfr, ok := ri.(*nfRules)
+	if !ok {
+		return nil, fmt.Errorf("rules of chain %s are not managed by the library", chain)
+	}
+
+	return nfr, nil
+}
+
+// applyRules queues rules of the chain, if the chain exists its rules are replaced in the order
+// the host reports them and rules beyond the number of programmed rules are appended. Foreign rules
+// are treated according to the policy, preserved ones are not replaced and keep their positions.
+func (nfr *nfRules) applyRules(rules []*Rule, existing bool, policy ForeignRulePolicy) error {
+	handles := make([]uint64, 0)
+	if existing {
+		var programmed []*nftables.Rule
+		if err := nfr.opts.readPolicy().do(func() (err error) {
+			programmed, err = nfr.conn.GetRule(nfr.table, nfr.chain)
+			return err
+		}); err != nil {
+			return err
+		}
+		programmed, err := nfr.applyForeignRulePolicy(policy, programmed)
+		if err != nil {
+			return err
+		}
+		for _, r := range programmed {
+			if !isForeignRule(r) {
+				handles = append(handles, r.Handle)
+			}
+		}
+	}
+	for i, rule := range rules {
+		if i >= len(handles) {
+			if _, err := nfr.Create(rule); err != nil {
+				return err
+			}
+			continue
+		}
+		if _, err := nfr.checkTargets(rule, false); err != nil {
+			return err
+		}
+		nfr.Lock()
+		err := nfr.replace(rule, handles[i])
+		nfr.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
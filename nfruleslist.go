@@ -1,6 +1,11 @@
 package nftableslib
 
-import "fmt"
+import (
+	"fmt"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+)
 
 const (
 	initialRuleID   = 10
@@ -70,6 +75,55 @@ func (r *nfRules) countRules() int {
 	return count
 }
 
+// getReferences returns rules which refer to the chain by jump or goto verdict,
+// either directly or through elements of verdict maps.
+func (r *nfRules) getReferences(chain string) []*nfRule {
+	r.Lock()
+	defer r.Unlock()
+	refs := []*nfRule{}
+	for e := r.rules; e != nil; e = e.next {
+		if isRuleReferencing(e, chain) {
+			refs = append(refs, e)
+		}
+	}
+	return refs
+}
+
+// snapshotRule returns a copy of the rule taken under the lock of the store, handles of queued
+// rules are set by resolveHandles and resolvePending concurrently with readers of the store.
+func (r *nfRules) snapshotRule(e *nfRule) *nftables.Rule {
+	r.Lock()
+	defer r.Unlock()
+	rule := *e.rule
+	return &rule
+}
+
+func isRuleReferencing(e *nfRule, chain string) bool {
+	for _, ex := range e.rule.Exprs {
+		if v, ok := ex.(*expr.Verdict); ok && isVerdictReferencing(v, chain) {
+			return true
+		}
+	}
+	for _, s := range e.sets {
+		for _, el := range s.elements {
+			if isVerdictReferencing(el.VerdictData, chain) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func isVerdictReferencing(v *expr.Verdict, chain string) bool {
+	if v == nil {
+		return false
+	}
+	if v.Kind != expr.VerdictJump && v.Kind != expr.VerdictGoto {
+		return false
+	}
+	return v.Chain == chain
+}
+
 func (r *nfRules) dumpRules() []*nfRule {
 	rr := []*nfRule{}
 	e := r.rules
@@ -0,0 +1,528 @@
+package nftableslib
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+// summarizeRule returns the summary of the rule's expressions in nft syntax, the expressions are
+// decoded to the Rule model the way AuditRuleset decodes rules of the host. False is returned for
+// rules which cannot be decoded, expressions of partially decoded rules which are carried by RawExprs
+// are listed by their names.
+func summarizeRule(family nftables.TableFamily, exprs []expr.Any, sets auditSets) (string, bool) {
+	aexprs := make([]auditExpr, 0, len(exprs))
+	for _, e := range exprs {
+		aexprs = append(aexprs, auditExpr{name: exprName(e), expr: e})
+	}
+	ra := auditRule(family, aexprs, sets)
+	if ra.Status == AuditOpaque {
+		return "", false
+	}
+
+	return decodedSummary(family, ra.Rule), true
+}
+
+// summaries returns summaries of rules of the chain kept in the store, rules generated for the other
+// family of inet table follow their rule. Sets looked up by rules which are not carried by the store
+// are read from the host by hostSets.
+func (nfr *nfRules) summaries(hostSets func() (auditSets, error)) ([]*RuleSummary, error) {
+	nfr.Lock()
+	defer nfr.Unlock()
+	summaries := make([]*RuleSummary, 0)
+	for _, r := range nfr.dumpRules() {
+		for _, rr := range append([]*nfRule{r}, r.siblings...) {
+			rs, err := rr.summary(nfr.table.Family, hostSets)
+			if err != nil {
+				return nil, err
+			}
+			summaries = append(summaries, rs)
+		}
+	}
+
+	return summaries, nil
+}
+
+func (nfr *nfRule) summary(family nftables.TableFamily, hostSets func() (auditSets, error)) (*RuleSummary, error) {
+	sets := make(auditSets, len(nfr.sets))
+	for _, s := range nfr.sets {
+		set := *s.set
+		set.Anonymous = true
+		sets[set.Name] = &nfSet{set: &set, elements: s.elements}
+	}
+	for _, e := range nfr.rule.Exprs {
+		l, ok := e.(*expr.Lookup)
+		if !ok {
+			continue
+		}
+		if _, ok := sets[l.SetName]; ok {
+			continue
+		}
+		host, err := hostSets()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get sets of rule with handle %d with error: %+v", nfr.rule.Handle, err)
+		}
+		if s, ok := host[l.SetName]; ok {
+			sets[l.SetName] = s
+		}
+	}
+	rs := &RuleSummary{Handle: nfr.rule.Handle}
+	rs.Comment, _ = userDataComment(nfr.rule.UserData)
+	var ok bool
+	if rs.Summary, ok = summarizeRule(family, nfr.rule.Exprs, sets); !ok {
+		exprs, err := json.Marshal(nfr)
+		if err != nil {
+			return nil, err
+		}
+		rs.Exprs = exprs
+	}
+
+	return rs, nil
+}
+
+// decodedSummary returns the summary of the decoded rule, matches are listed before statements
+func decodedSummary(family nftables.TableFamily, r *Rule) string {
+	s := &summary{family: family}
+	if r.Counter != nil {
+		s.add("counter")
+	}
+	if r.Meta != nil && r.Meta.NFProto != nil {
+		s.family = *r.Meta.NFProto
+		s.add("meta nfproto " + nfprotoName(*r.Meta.NFProto))
+	}
+	if r.L3 != nil {
+		s.l3(r.L3)
+	}
+	if r.L4 != nil {
+		s.l4(r.L4)
+	}
+	if r.Meta != nil {
+		s.meta(r.Meta)
+	}
+	for _, ct := range r.Conntracks {
+		s.conntrack(ct)
+	}
+	if r.Fib != nil {
+		s.fib(r.Fib)
+	}
+	if len(r.RawExprs) != 0 {
+		names := make([]string, 0, len(r.RawExprs))
+		for _, e := range r.RawExprs {
+			names = append(names, exprName(e))
+		}
+		s.add("raw(" + strings.Join(names, ", ") + ")")
+	}
+	if r.Meta != nil && r.Meta.Mark != nil && r.Meta.Mark.Set {
+		m := r.Meta.Mark
+		if m.Mask != 0 {
+			s.add(fmt.Sprintf("meta mark set mark and %#x or %#x", ^m.Mask, m.Value))
+		} else {
+			s.add(fmt.Sprintf("meta mark set %#x", m.Value))
+		}
+	}
+	if r.Log != nil {
+		s.log(r.Log)
+	}
+	if r.Limit != nil {
+		s.limit(r.Limit)
+	}
+	if r.Action != nil {
+		s.action(r.Action)
+	}
+
+	return strings.Join(s.parts, " ")
+}
+
+type summary struct {
+	family nftables.TableFamily
+	parts  []string
+}
+
+func (s *summary) add(part string) {
+	s.parts = append(s.parts, part)
+}
+
+// relOp returns the operator in nft syntax followed by a space, equality is implicit
+func relOp(op Operator) string {
+	switch op {
+	case NEQ:
+		return "!= "
+	case GT:
+		return "> "
+	case GTE:
+		return ">= "
+	case LT:
+		return "< "
+	case LTE:
+		return "<= "
+	}
+
+	return ""
+}
+
+// list returns the single value or the anonymous set of values in nft syntax
+func list(values []string) string {
+	if len(values) == 1 {
+		return values[0]
+	}
+
+	return "{ " + strings.Join(values, ", ") + " }"
+}
+
+func nfprotoName(f nftables.TableFamily) string {
+	switch f {
+	case nftables.TableFamilyIPv4:
+		return "ipv4"
+	case nftables.TableFamilyIPv6:
+		return "ipv6"
+	}
+
+	return strconv.Itoa(int(f))
+}
+
+func protoName(p uint8) string {
+	switch p {
+	case unix.IPPROTO_TCP:
+		return "tcp"
+	case unix.IPPROTO_UDP:
+		return "udp"
+	case unix.IPPROTO_SCTP:
+		return "sctp"
+	case unix.IPPROTO_ICMP:
+		return "icmp"
+	case unix.IPPROTO_ICMPV6:
+		return "icmpv6"
+	case unix.IPPROTO_GRE:
+		return "gre"
+	case unix.IPPROTO_ESP:
+		return "esp"
+	}
+
+	return strconv.Itoa(int(p))
+}
+
+func (s *summary) l3(l3 *L3Rule) {
+	hdr := "ip"
+	if s.family == nftables.TableFamilyIPv6 {
+		hdr = "ip6"
+	}
+	if l3.Version != nil {
+		s.add(fmt.Sprintf("%s version %s%d", hdr, relOp(l3.VersionRelOp), *l3.Version))
+	}
+	if l3.Options != nil {
+		if *l3.Options {
+			s.add("ip hdrlength > 5")
+		} else {
+			s.add("ip hdrlength 5")
+		}
+	}
+	if l3.Protocol != nil {
+		field := "protocol"
+		if hdr == "ip6" {
+			field = "nexthdr"
+		}
+		s.add(fmt.Sprintf("%s %s %s%s", hdr, field, relOp(l3.ProtocolRelOp), protoName(uint8(*l3.Protocol))))
+	}
+	for _, side := range []struct {
+		name string
+		spec *IPAddrSpec
+	}{{"saddr", l3.Src}, {"daddr", l3.Dst}} {
+		if side.spec == nil {
+			continue
+		}
+		h := hdr
+		if a := firstAddr(side.spec); a != nil && a.IPAddr != nil {
+			if h = "ip"; a.IsIPv6() {
+				h = "ip6"
+			}
+		}
+		s.add(fmt.Sprintf("%s %s %s%s", h, side.name, relOp(side.spec.RelOp), addrSpec(side.spec)))
+	}
+	if l3.Counter != nil {
+		s.add("counter")
+	}
+}
+
+// firstAddr returns an address of the spec telling its family, nil if the spec refers to a set
+func firstAddr(spec *IPAddrSpec) *IPAddr {
+	switch {
+	case len(spec.List) != 0:
+		return spec.List[0]
+	case spec.Range[0] != nil:
+		return spec.Range[0]
+	case spec.Masked != nil:
+		return spec.Masked.Value
+	}
+
+	return nil
+}
+
+func addrSpec(spec *IPAddrSpec) string {
+	switch {
+	case spec.SetRef != nil:
+		return "@" + spec.SetRef.Name
+	case spec.Masked != nil:
+		return fmt.Sprintf("& %s == %s", spec.Masked.Mask.IP, spec.Masked.Value.IP)
+	case spec.Range[0] != nil && spec.Range[1] != nil:
+		return fmt.Sprintf("%s-%s", spec.Range[0].IP, spec.Range[1].IP)
+	}
+	addrs := make([]string, 0, len(spec.List))
+	for _, a := range spec.List {
+		if a.Mask != nil && int(*a.Mask) == 8*len(a.IP) {
+			addrs = append(addrs, a.IP.String())
+			continue
+		}
+		addrs = append(addrs, a.String())
+	}
+
+	return list(addrs)
+}
+
+func (s *summary) l4(l4 *L4Rule) {
+	proto := protoName(l4.L4Proto)
+	switch {
+	case l4.ICMP != nil:
+		types := make([]string, 0, len(l4.ICMP.Types))
+		for _, t := range l4.ICMP.Types {
+			types = append(types, strconv.Itoa(int(t)))
+		}
+		if len(types) != 0 {
+			s.add(fmt.Sprintf("%s type %s%s", proto, relOp(l4.ICMP.RelOp), list(types)))
+		}
+		if l4.ICMP.Code != nil {
+			s.add(fmt.Sprintf("%s code %d", proto, *l4.ICMP.Code))
+		}
+	case l4.Src == nil && l4.Dst == nil:
+		s.add("meta l4proto " + proto)
+	}
+	for _, side := range []struct {
+		name string
+		port *Port
+	}{{"sport", l4.Src}, {"dport", l4.Dst}} {
+		if side.port != nil {
+			s.add(fmt.Sprintf("%s %s %s%s", proto, side.name, relOp(side.port.RelOp), portSpec(side.port)))
+		}
+	}
+	if l4.Counter != nil {
+		s.add("counter")
+	}
+}
+
+func portSpec(p *Port) string {
+	switch {
+	case p.SetRef != nil:
+		return "@" + p.SetRef.Name
+	case len(p.Ranges) != 0:
+		ranges := make([]string, 0, len(p.Ranges))
+		for _, r := range p.Ranges {
+			ranges = append(ranges, fmt.Sprintf("%d-%d", r[0], r[1]))
+		}
+		return list(ranges)
+	case len(p.List) == 0:
+		return fmt.Sprintf("%d-%d", p.Range[0], p.Range[1])
+	}
+	ports := make([]string, 0, len(p.List))
+	for _, port := range p.List {
+		ports = append(ports, strconv.Itoa(int(port)))
+	}
+
+	return list(ports)
+}
+
+func (s *summary) meta(m *MetaRule) {
+	if m.L4Proto != nil {
+		s.add("meta l4proto " + protoName(*m.L4Proto))
+	}
+	if m.IIFName != nil {
+		s.add(fmt.Sprintf("iifname %q", *m.IIFName))
+	}
+	if m.OIFName != nil {
+		s.add(fmt.Sprintf("oifname %q", *m.OIFName))
+	}
+	if m.IIFNameSet != nil && m.IIFNameSet.SetRef != nil {
+		s.add(fmt.Sprintf("iifname %s@%s", relOp(m.IIFNameSet.RelOp), m.IIFNameSet.SetRef.Name))
+	}
+	if m.OIFNameSet != nil && m.OIFNameSet.SetRef != nil {
+		s.add(fmt.Sprintf("oifname %s@%s", relOp(m.OIFNameSet.RelOp), m.OIFNameSet.SetRef.Name))
+	}
+	if m.IIF != nil {
+		s.add(fmt.Sprintf("iif %d", *m.IIF))
+	}
+	if m.OIF != nil {
+		s.add(fmt.Sprintf("oif %d", *m.OIF))
+	}
+	if m.PktType != nil {
+		s.add(fmt.Sprintf("meta pkttype %d", *m.PktType))
+	}
+	if m.Length != nil {
+		s.add(fmt.Sprintf("meta length %d", *m.Length))
+	}
+	if m.SKUID != nil {
+		s.add(fmt.Sprintf("meta skuid %d", *m.SKUID))
+	}
+	if m.SKGID != nil {
+		s.add(fmt.Sprintf("meta skgid %d", *m.SKGID))
+	}
+	if m.Mark != nil && !m.Mark.Set {
+		if m.Mark.Mask != 0 {
+			s.add(fmt.Sprintf("meta mark and %#x == %#x", m.Mark.Mask, m.Mark.Value))
+		} else {
+			s.add(fmt.Sprintf("meta mark %#x", m.Mark.Value))
+		}
+	}
+	for _, e := range m.Expr {
+		s.add(fmt.Sprintf("meta %d %s0x%x", e.Key, relOp(e.RelOp), e.Value))
+	}
+}
+
+// ctBits lists names of bits of ct state and ct status in the order nft prints them
+var ctBits = map[uint32][]struct {
+	bit  uint32
+	name string
+}{
+	unix.NFT_CT_STATE: {
+		{CTStateInvalid, "invalid"},
+		{CTStateEstablished, "established"},
+		{CTStateRelated, "related"},
+		{CTStateNew, "new"},
+	},
+	unix.NFT_CT_STATUS: {
+		{CTStatusExpected, "expected"},
+		{CTStatusSeenReply, "seen-reply"},
+		{CTStatusAssured, "assured"},
+		{CTStatusConfirmed, "confirmed"},
+		{CTStatusSNAT, "snat"},
+		{CTStatusDNAT, "dnat"},
+	},
+}
+
+func (s *summary) conntrack(ct *Conntrack) {
+	if ct != nil && isCtCounter(ct.Key) && len(ct.Value) == 8 {
+		s.add(fmt.Sprintf("ct %s %s%d", ctCounterName(ct.Key), relOp(ct.RelOp), binaryutil.BigEndian.Uint64(ct.Value)))
+		return
+	}
+	if ct == nil || len(ct.Value) != 4 {
+		return
+	}
+	key := "state"
+	if ct.Key == unix.NFT_CT_STATUS {
+		key = "status"
+	}
+	v := binaryutil.BigEndian.Uint32(ct.Value)
+	names := make([]string, 0)
+	for _, b := range ctBits[ct.Key] {
+		if v&b.bit != 0 {
+			names = append(names, b.name)
+			v &^= b.bit
+		}
+	}
+	if v != 0 {
+		names = append(names, fmt.Sprintf("%#x", v))
+	}
+	s.add(fmt.Sprintf("ct %s %s", key, strings.Join(names, ",")))
+}
+
+func (s *summary) fib(f *Fib) {
+	flags := make([]string, 0)
+	for _, fl := range []struct {
+		set  bool
+		name string
+	}{{f.FlagSADDR, "saddr"}, {f.FlagDADDR, "daddr"}, {f.FlagMARK, "mark"}, {f.FlagIIF, "iif"}, {f.FlagOIF, "oif"}} {
+		if fl.set {
+			flags = append(flags, fl.name)
+		}
+	}
+	result := "oif"
+	switch {
+	case f.ResultOIFNAME:
+		result = "oifname"
+	case f.ResultADDRTYPE:
+		result = "type"
+	}
+	if f.FlagPRESENT {
+		result += " exists"
+	}
+	s.add(fmt.Sprintf("fib %s %s %s0x%x", strings.Join(flags, " . "), result, relOp(f.RelOp), f.Data))
+}
+
+func (s *summary) log(l *Log) {
+	if l.Key == unix.NFTA_LOG_PREFIX && len(l.Value) != 0 {
+		s.add(fmt.Sprintf("log prefix %q", strings.TrimRight(string(l.Value), "\x00")))
+		return
+	}
+	s.add("log")
+}
+
+func (s *summary) limit(l *Limit) {
+	over := ""
+	if l.Over {
+		over = "over "
+	}
+	unit := "packets"
+	if l.Bytes {
+		unit = "bytes"
+	}
+	part := fmt.Sprintf("limit rate %s%d %s/%s", over, l.Rate, unit, limitUnitName(l.Unit))
+	if l.Burst != 0 {
+		part += fmt.Sprintf(" burst %d %s", l.Burst, unit)
+	}
+	s.add(part)
+}
+
+func limitUnitName(u time.Duration) string {
+	switch u {
+	case time.Minute:
+		return "minute"
+	case time.Hour:
+		return "hour"
+	case 24 * time.Hour:
+		return "day"
+	case 7 * 24 * time.Hour:
+		return "week"
+	}
+
+	return "second"
+}
+
+func (s *summary) action(a *RuleAction) {
+	switch {
+	case a.verdict != nil:
+		if a.verdict.Chain != "" {
+			s.add(verdictName(int(a.verdict.Kind)) + " " + a.verdict.Chain)
+			return
+		}
+		s.add(verdictName(int(a.verdict.Kind)))
+	case a.reject != nil:
+		s.add(fmt.Sprintf("reject with type %d code %d", a.reject.rejectType, a.reject.rejectCode))
+	case a.masq != nil:
+		part := "masquerade"
+		for _, f := range []struct {
+			set  *bool
+			name string
+		}{{a.masq.random, "random"}, {a.masq.fullyRandom, "fully-random"}, {a.masq.persistent, "persistent"}} {
+			if f.set != nil && *f.set {
+				part += " " + f.name
+			}
+		}
+		s.add(part)
+	case a.queue != nil:
+		part := fmt.Sprintf("queue num %d", a.queue.num)
+		if a.queue.total > 1 {
+			part = fmt.Sprintf("queue num %d-%d", a.queue.num, a.queue.num+a.queue.total-1)
+		}
+		if a.queue.bypass {
+			part += " bypass"
+		}
+		if a.queue.fanout {
+			part += " fanout"
+		}
+		s.add(part)
+	}
+}
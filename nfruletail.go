@@ -0,0 +1,69 @@
+package nftableslib
+
+import (
+	"fmt"
+)
+
+// SetTail programs the rule kept last in the chain, like a "log prefix X drop" rule closing a base chain.
+// If the chain already has a tail rule, the tail rule is replaced in place. Rules created after the tail
+// is set are inserted before it, rules inserted at a position stay where they are inserted.
+// The handle of the tail rule is returned.
+func (nfr *nfRules) SetTail(rule *Rule) (uint64, error) {
+	if err := writable(nfr.conn); err != nil {
+		return 0, err
+	}
+	if _, err := nfr.checkTargets(rule, false); err != nil {
+		return 0, err
+	}
+	nfr.Lock()
+	defer nfr.Unlock()
+	rules, err := nfr.split(rule)
+	if err != nil {
+		return 0, err
+	}
+	if len(rules) != 1 {
+		return 0, fmt.Errorf("tail rule cannot generate multiple rules")
+	}
+	if rule.Position != 0 {
+		return 0, fmt.Errorf("tail rule cannot be positioned")
+	}
+	if nfr.tail != nil {
+		if err := nfr.update(rule, nfr.tail.rule.Handle); err != nil {
+			return 0, err
+		}
+		return nfr.tail.rule.Handle, nil
+	}
+	id, err := nfr.create(rule, operationAdd, nil)
+	if err != nil {
+		return 0, err
+	}
+	if err := flush(nfr.conn); err != nil {
+		return 0, err
+	}
+	handle, err := nfr.updateHandle(id)
+	if err != nil {
+		return 0, err
+	}
+	if nfr.tail, err = getRuleByID(nfr.rules, id); err != nil {
+		return 0, err
+	}
+
+	return handle, nil
+}
+
+// RemoveTail deletes the tail rule of the chain, rules created afterwards are appended to the chain.
+func (nfr *nfRules) RemoveTail() error {
+	if err := writable(nfr.conn); err != nil {
+		return err
+	}
+	nfr.Lock()
+	defer nfr.Unlock()
+	if nfr.tail == nil {
+		return fmt.Errorf("chain %s does not have a tail rule", nfr.chain.Name)
+	}
+	if err := nfr.delete(nfr.tail.id); err != nil {
+		return err
+	}
+
+	return flush(nfr.conn)
+}
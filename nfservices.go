@@ -0,0 +1,470 @@
+package nftableslib
+
+import (
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"strings"
+	"sync"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// ServicesMapName defines the name of the verdict map dispatching traffic to services' chains
+	ServicesMapName = "services"
+	// ServiceChainPrefix defines the prefix of service's chain name
+	ServiceChainPrefix = "svc-"
+	// EndpointChainPrefix defines the prefix of backend's chain name
+	EndpointChainPrefix = "ep-"
+)
+
+// ServiceBackend defines a backend of a service, traffic is distributed between backends
+// proportionally to their weights, weight 0 is treated as 1.
+type ServiceBackend struct {
+	Addr   *IPAddr
+	Port   uint16
+	Weight int
+}
+
+// Service defines a virtual service, traffic destined to VIP, Port and Protocol
+// is load balanced and DNATed to one of the service's backends.
+type Service struct {
+	Name     string
+	VIP      *IPAddr
+	Port     uint16
+	Protocol uint8
+	Backends []*ServiceBackend
+}
+
+// Validate checks parameters of a service
+func (s *Service) Validate(family nftables.TableFamily) error {
+	if s.Name == "" {
+		return fmt.Errorf("service name cannot be empty")
+	}
+	if s.VIP == nil {
+		return fmt.Errorf("service %s does not have vip", s.Name)
+	}
+	if s.Protocol != unix.IPPROTO_TCP && s.Protocol != unix.IPPROTO_UDP && s.Protocol != unix.IPPROTO_SCTP {
+		return fmt.Errorf("service %s has unsupported protocol %d", s.Name, s.Protocol)
+	}
+	if len(s.Backends) == 0 {
+		return fmt.Errorf("service %s does not have backends", s.Name)
+	}
+	addrs := []*IPAddr{s.VIP}
+	for _, b := range s.Backends {
+		if b == nil || b.Addr == nil {
+			return fmt.Errorf("service %s has backend without address", s.Name)
+		}
+		if b.Weight < 0 {
+			return fmt.Errorf("service %s has backend %s with negative weight", s.Name, b.Addr.IP.String())
+		}
+		addrs = append(addrs, b.Addr)
+	}
+	for _, a := range addrs {
+		if a.IsIPv6() != (family == nftables.TableFamilyIPv6) {
+			return fmt.Errorf("service %s address %s does not match table family", s.Name, a.IP.String())
+		}
+	}
+
+	return nil
+}
+
+// ServiceDispatcher programs and maintains the structure dispatching traffic to services:
+// nat base chains prerouting and output look up (daddr . protocol . dport) in the services verdict map,
+// the map jumps to a per-service chain which picks one of the per-backend chains with numgen,
+// a per-backend chain DNATs traffic to the backend.
+type ServiceDispatcher struct {
+	nft    TablesInterface
+	table  string
+	family nftables.TableFamily
+	sync.Mutex
+	// applied carries fingerprints of services' backends programmed by the last successful Apply
+	applied map[string]string
+	// gen is the generation of the ruleset the applied services were read back in, valid is false
+	// if the generation is not known
+	gen      uint32
+	genValid bool
+}
+
+// NewServiceDispatcher returns ServiceDispatcher maintaining services in the table,
+// the table is created by the first Apply if it does not exist.
+func NewServiceDispatcher(nft TablesInterface, table string, family nftables.TableFamily) (*ServiceDispatcher, error) {
+	if family != nftables.TableFamilyIPv4 && family != nftables.TableFamilyIPv6 {
+		return nil, fmt.Errorf("service dispatcher supports only ipv4 and ipv6 table families")
+	}
+
+	return &ServiceDispatcher{
+		nft:     nft,
+		table:   table,
+		family:  family,
+		applied: make(map[string]string),
+	}, nil
+}
+
+// Apply makes the programmed services to match the list of services, missing objects get created,
+// services which changed get updated and objects of services not in the list get removed.
+// The ruleset is snapshotted before the changes, if any change fails, the ruleset is rolled back.
+func (sd *ServiceDispatcher) Apply(services []*Service) error {
+	sd.Lock()
+	defer sd.Unlock()
+	desired := make(map[string]*Service, len(services))
+	keys := make(map[string]string, len(services))
+	for _, s := range services {
+		if err := s.Validate(sd.family); err != nil {
+			return err
+		}
+		if _, ok := desired[s.Name]; ok {
+			return fmt.Errorf("duplicate service %s", s.Name)
+		}
+		k := string(sd.serviceKey(s))
+		if n, ok := keys[k]; ok {
+			return fmt.Errorf("services %s and %s have the same vip, protocol and port", n, s.Name)
+		}
+		keys[k] = s.Name
+		desired[s.Name] = s
+	}
+	if sd.unchanged(desired) {
+		return nil
+	}
+	sd.genValid = false
+	snapshot, err := sd.nft.Tables().Snapshot()
+	if err != nil {
+		return err
+	}
+	if err := sd.apply(desired); err != nil {
+		// Handles and objects known to the dispatcher are not valid after the rollback
+		sd.applied = make(map[string]string)
+		if rerr := sd.nft.Tables().Rollback(snapshot); rerr != nil {
+			return fmt.Errorf("failed to apply services with error: %+v, rollback failed with error: %+v", err, rerr)
+		}
+		return err
+	}
+	sd.applied = make(map[string]string, len(desired))
+	for name, s := range desired {
+		sd.applied[name] = s.fingerprint()
+	}
+	sd.gen, sd.genValid = sd.settle(len(desired))
+
+	return nil
+}
+
+// unchanged returns true if services match the applied ones and the ruleset did not change
+// since they were applied, so Apply has nothing to reconcile.
+func (sd *ServiceDispatcher) unchanged(desired map[string]*Service) bool {
+	if !sd.genValid || len(desired) != len(sd.applied) {
+		return false
+	}
+	for name, s := range desired {
+		if fp, ok := sd.applied[name]; !ok || fp != s.fingerprint() {
+			return false
+		}
+	}
+	changed, err := sd.nft.Tables().ChangedSince(sd.gen)
+
+	return err == nil && !changed
+}
+
+// settle returns the generation of the ruleset the applied services belong to. The services map is
+// dumped between two reads of the generation, so a change made by other applications right after
+// Apply is not attributed to the dispatcher. If the ruleset keeps changing, the connection does not
+// report generations or the map does not carry all services, the generation is not known and the next
+// Apply reconciles services again.
+func (sd *ServiceDispatcher) settle(services int) (uint32, bool) {
+	si, err := sd.nft.Tables().TableSets(sd.table, sd.family)
+	if err != nil {
+		return 0, false
+	}
+	entries := 0
+	gen, err := consistentGen(sd.nft.Tables().GetGenID, 1, func() error {
+		vmap, err := si.Sets().VMapEntries(ServicesMapName)
+		entries = len(vmap)
+		return err
+	})
+	if err != nil || entries != services {
+		return 0, false
+	}
+
+	return gen, true
+}
+
+func (sd *ServiceDispatcher) apply(desired map[string]*Service) error {
+	ci, si, err := sd.ensureTable()
+	if err != nil {
+		return err
+	}
+	chains := make(map[string]bool)
+	elements := make([]nftables.SetElement, 0, len(desired))
+	for _, s := range desired {
+		names, err := sd.ensureService(ci, s)
+		if err != nil {
+			return err
+		}
+		for _, n := range names {
+			chains[n] = true
+		}
+		ra, _ := SetVerdict(unix.NFT_JUMP, serviceChain(s.Name))
+		elements = append(elements, nftables.SetElement{Key: sd.serviceKey(s), VerdictData: ra.verdict})
+	}
+	if err := reconcileElements(si, ServicesMapName, elements); err != nil {
+		return err
+	}
+	// Chains of removed services are deleted once nothing jumps to them, services' chains go first
+	// as they refer to backends' chains.
+	existing, err := ci.Chains().Get()
+	if err != nil {
+		return err
+	}
+	for _, prefix := range []string{ServiceChainPrefix, EndpointChainPrefix} {
+		for _, name := range existing {
+			if !strings.HasPrefix(name, prefix) || chains[name] {
+				continue
+			}
+			if err := ci.Chains().DeleteSafe(name, true); err != nil {
+				return fmt.Errorf("failed to delete chain %s with error: %+v", name, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// ensureTable makes sure the table, the services map and base chains with dispatching rules exist
+func (sd *ServiceDispatcher) ensureTable() (ChainsInterface, SetsInterface, error) {
+	ci, err := ensureTableChains(sd.nft, sd.table, sd.family)
+	if err != nil {
+		return nil, nil, err
+	}
+	si, err := sd.nft.Tables().TableSets(sd.table, sd.family)
+	if err != nil {
+		return nil, nil, err
+	}
+	addrType := nftables.TypeIPAddr
+	if sd.family == nftables.TableFamilyIPv6 {
+		addrType = nftables.TypeIP6Addr
+	}
+	set, err := si.Sets().GetSetByName(ServicesMapName)
+	if err != nil {
+		if set, err = si.Sets().CreateSet(&SetAttributes{
+			Name:     ServicesMapName,
+			IsMap:    true,
+			KeyType:  GenSetKeyType(addrType, nftables.TypeInetProto, nftables.TypeInetService),
+			DataType: nftables.TypeVerdict,
+		}, nil); err != nil {
+			return nil, nil, err
+		}
+	}
+	for _, bc := range []struct {
+		name string
+		hook nftables.ChainHook
+	}{
+		{"prerouting", nftables.ChainHookPrerouting},
+		{"output", nftables.ChainHookOutput},
+	} {
+		if !ci.Chains().Exist(bc.name) {
+			if err := ci.Chains().CreateImm(bc.name, &ChainAttributes{
+				Type:     nftables.ChainTypeNAT,
+				Hook:     bc.hook,
+				Priority: nftables.ChainPriorityNATDest,
+			}); err != nil {
+				return nil, nil, err
+			}
+		}
+		if n, err := ci.Chains().RuleCount(bc.name); err != nil || n != 0 {
+			if err != nil {
+				return nil, nil, err
+			}
+			continue
+		}
+		ri, err := ci.Chains().Chain(bc.name)
+		if err != nil {
+			return nil, nil, err
+		}
+		if _, err := ri.Rules().CreateImm(&Rule{
+			Concat: &Concat{
+				Elements: []*ConcatElement{
+					{EType: addrType},
+					{EType: nftables.TypeInetProto},
+					{EType: nftables.TypeInetService},
+				},
+				VMap:   true,
+				SetRef: &SetRef{Name: set.Name, ID: set.ID, IsMap: true},
+			},
+		}); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return ci, si, nil
+}
+
+// ensureService makes sure the service's chain and backends' chains exist and carry the service's
+// current backends, it returns names of all chains of the service.
+func (sd *ServiceDispatcher) ensureService(ci ChainsInterface, s *Service) ([]string, error) {
+	svc := serviceChain(s.Name)
+	names := []string{svc}
+	lb := make([]string, 0, len(s.Backends))
+	for _, b := range s.Backends {
+		ep := endpointChain(s, b)
+		names = append(names, ep)
+		if err := ensureChainRule(ci, ep, func() (*Rule, error) {
+			natAttrs := &NATAttributes{L3Addr: [2]*IPAddr{b.Addr}}
+			if b.Port != 0 {
+				natAttrs.Port = [2]uint16{b.Port}
+			}
+			ra, err := SetDNAT(natAttrs)
+			if err != nil {
+				return nil, err
+			}
+			proto := s.Protocol
+			return &Rule{Meta: &MetaRule{L4Proto: &proto}, Action: ra}, nil
+		}); err != nil {
+			return nil, err
+		}
+		weight := b.Weight
+		if weight == 0 {
+			weight = 1
+		}
+		for i := 0; i < weight; i++ {
+			lb = append(lb, ep)
+		}
+	}
+	ra, err := SetLoadbalance(lb, unix.NFT_GOTO, unix.NFT_NG_RANDOM)
+	if err != nil {
+		return nil, err
+	}
+	rule := &Rule{Action: ra, UserData: MakeRuleComment(svc)}
+	if !ci.Chains().Exist(svc) {
+		return names, ensureChainRule(ci, svc, func() (*Rule, error) { return rule, nil })
+	}
+	if fp, ok := sd.applied[s.Name]; ok && fp == s.fingerprint() {
+		return names, nil
+	}
+	// Service's chain exists, its load balancing rule gets replaced in place to avoid
+	// dropping traffic of the service while backends change.
+	ri, err := ci.Chains().Chain(svc)
+	if err != nil {
+		return nil, err
+	}
+	ud, err := ri.Rules().GetRulesUserData()
+	if err != nil {
+		return nil, err
+	}
+	for handle, data := range ud {
+		if bytes.Equal(data, rule.UserData) {
+			return names, ri.Rules().Update(rule, handle)
+		}
+	}
+	if _, err := ri.Rules().CreateImm(rule); err != nil {
+		return nil, err
+	}
+
+	return names, nil
+}
+
+// ensureChainRule creates a regular chain if it does not exist and adds the rule
+// returned by build if the chain does not have any rules.
+func ensureChainRule(ci ChainsInterface, name string, build func() (*Rule, error)) error {
+	if !ci.Chains().Exist(name) {
+		if err := ci.Chains().CreateImm(name, nil); err != nil {
+			return err
+		}
+	}
+	if n, err := ci.Chains().RuleCount(name); err != nil || n != 0 {
+		return err
+	}
+	rule, err := build()
+	if err != nil {
+		return err
+	}
+	ri, err := ci.Chains().Chain(name)
+	if err != nil {
+		return err
+	}
+	_, err = ri.Rules().CreateImm(rule)
+
+	return err
+}
+
+// reconcileElements removes elements of the map which are not in the list or carry a different
+// verdict and adds missing elements.
+func reconcileElements(si SetsInterface, name string, elements []nftables.SetElement) error {
+	current, err := si.Sets().GetSetElements(name)
+	if err != nil {
+		return err
+	}
+	want := make(map[string]*expr.Verdict, len(elements))
+	for _, e := range elements {
+		want[string(e.Key)] = e.VerdictData
+	}
+	have := make(map[string]bool, len(current))
+	stale := []nftables.SetElement{}
+	for _, e := range current {
+		v, ok := want[string(e.Key)]
+		if ok && e.VerdictData != nil && *e.VerdictData == *v {
+			have[string(e.Key)] = true
+			continue
+		}
+		stale = append(stale, e)
+	}
+	if len(stale) != 0 {
+		if err := si.Sets().SetDelElements(name, stale); err != nil {
+			return err
+		}
+	}
+	missing := []nftables.SetElement{}
+	for _, e := range elements {
+		if !have[string(e.Key)] {
+			missing = append(missing, e)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	warnSetLoad(si, name, len(elements))
+
+	return si.Sets().SetAddElements(name, missing)
+}
+
+// serviceKey returns the services map key of the service, (vip . protocol . port)
+func (sd *ServiceDispatcher) serviceKey(s *Service) []byte {
+	addrType, addr := nftables.TypeIPAddr, []byte(s.VIP.IP.To4())
+	if sd.family == nftables.TableFamilyIPv6 {
+		addrType, addr = nftables.TypeIP6Addr, []byte(s.VIP.IP.To16())
+	}
+	proto, port := s.Protocol, s.Port
+	e, _ := MakeConcatElement(
+		[]nftables.SetDatatype{addrType, nftables.TypeInetProto, nftables.TypeInetService},
+		[]ElementValue{{IPAddr: addr}, {InetProto: &proto}, {InetService: &port}},
+		&RuleAction{},
+	)
+
+	return e.Key
+}
+
+// fingerprint returns a string identifying service's protocol and backends,
+// services with the same fingerprint have the same load balancing rule.
+func (s *Service) fingerprint() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d", s.Protocol)
+	for _, be := range s.Backends {
+		fmt.Fprintf(&b, ",%s/%d/%d", be.Addr.IP.String(), be.Port, be.Weight)
+	}
+
+	return b.String()
+}
+
+func serviceChain(name string) string {
+	return ServiceChainPrefix + name
+}
+
+// endpointChain returns the name of backend's chain, the name carries a hash of the backend's
+// parameters, a changed backend gets a new chain.
+func endpointChain(s *Service, b *ServiceBackend) string {
+	h := fnv.New32a()
+	fmt.Fprintf(h, "%s/%d/%d", b.Addr.IP.String(), b.Port, s.Protocol)
+
+	return fmt.Sprintf("%s%s-%08x", EndpointChainPrefix, s.Name, h.Sum32())
+}
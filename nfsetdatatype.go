@@ -0,0 +1,123 @@
+package nftableslib
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/google/nftables"
+)
+
+// concatSeparator separates datatypes of a concatenation in nft syntax
+const concatSeparator = " . "
+
+// concatElementDatatypes lists datatypes MakeConcatElement can encode as a part of a concatenation
+var concatElementDatatypes = []nftables.SetDatatype{
+	nftables.TypeInteger,
+	nftables.TypeMark,
+	nftables.TypeIPAddr,
+	nftables.TypeIP6Addr,
+	nftables.TypeEtherAddr,
+	nftables.TypeInetProto,
+	nftables.TypeInetService,
+}
+
+// ParseSetDatatype returns the set datatype named in nft syntax, like "ipv4_addr" or
+// "ipv4_addr . inet_service" for concatenations. Concatenations are built by GenSetKeyType and
+// can combine only datatypes MakeConcatElement encodes, verdict cannot be a part of a concatenation.
+func ParseSetDatatype(s string) (nftables.SetDatatype, error) {
+	names := strings.Split(s, ".")
+	if len(names) > 32/nftables.SetConcatTypeBits {
+		return nftables.TypeInvalid, fmt.Errorf("set datatype %q concatenates more than %d datatypes", s, 32/nftables.SetConcatTypeBits)
+	}
+	types := make([]nftables.SetDatatype, 0, len(names))
+	for _, n := range names {
+		t, ok := lookupSetDatatype(strings.TrimSpace(n))
+		if !ok {
+			return nftables.TypeInvalid, fmt.Errorf("unknown set datatype %q", strings.TrimSpace(n))
+		}
+		types = append(types, t)
+	}
+	if len(types) == 1 {
+		return types[0], nil
+	}
+	for _, t := range types {
+		if !isConcatElementDatatype(t) {
+			return nftables.TypeInvalid, fmt.Errorf("set datatype %s cannot be a part of a concatenation", t.Name)
+		}
+	}
+
+	return GenSetKeyType(types...), nil
+}
+
+// SetDatatypeString returns the name of the set datatype in nft syntax, datatypes of
+// a concatenation are separated by " . ". The datatype's name is returned if nft magic
+// carries unknown datatypes.
+func SetDatatypeString(dt nftables.SetDatatype) string {
+	types := splitSetDatatype(dt.GetNFTMagic())
+	if len(types) == 0 {
+		return dt.Name
+	}
+	names := make([]string, 0, len(types))
+	for _, t := range types {
+		names = append(names, t.Name)
+	}
+
+	return strings.Join(names, concatSeparator)
+}
+
+// NewSetAttributes returns attributes of the set with the key type named in nft syntax
+func NewSetAttributes(name, keyType string) (*SetAttributes, error) {
+	kt, err := parseKeyType(keyType)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SetAttributes{Name: name, KeyType: kt}, nil
+}
+
+// NewMapAttributes returns attributes of the map with the key and data types named in nft syntax,
+// verdict maps use "verdict" data type.
+func NewMapAttributes(name, keyType, dataType string) (*SetAttributes, error) {
+	kt, err := parseKeyType(keyType)
+	if err != nil {
+		return nil, err
+	}
+	dt, err := ParseSetDatatype(dataType)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SetAttributes{Name: name, IsMap: true, KeyType: kt, DataType: dt}, nil
+}
+
+func parseKeyType(s string) (nftables.SetDatatype, error) {
+	kt, err := ParseSetDatatype(s)
+	if err != nil {
+		return nftables.TypeInvalid, err
+	}
+	if kt.GetNFTMagic() == nftables.TypeVerdict.GetNFTMagic() {
+		return nftables.TypeInvalid, fmt.Errorf("verdict cannot be a key type")
+	}
+
+	return kt, nil
+}
+
+func lookupSetDatatype(name string) (nftables.SetDatatype, bool) {
+	for _, t := range knownSetDatatypes {
+		if t.Name == name {
+			return t, true
+		}
+	}
+
+	return nftables.TypeInvalid, false
+}
+
+func isConcatElementDatatype(dt nftables.SetDatatype) bool {
+	for _, t := range concatElementDatatypes {
+		if t == dt {
+			return true
+		}
+	}
+
+	return false
+}
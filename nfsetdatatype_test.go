@@ -0,0 +1,131 @@
+package nftableslib
+
+import (
+	"testing"
+
+	"github.com/google/nftables"
+)
+
+func TestParseSetDatatype(t *testing.T) {
+	for _, dt := range knownSetDatatypes {
+		got, err := ParseSetDatatype(SetDatatypeString(dt))
+		if err != nil {
+			t.Errorf("Test \"%s\" failed with error: %+v but supposed to succeed", dt.Name, err)
+			continue
+		}
+		if got != dt {
+			t.Errorf("Test \"%s\" failed, expected datatype %+v, got %+v", dt.Name, dt, got)
+		}
+	}
+
+	tests := []struct {
+		name    string
+		s       string
+		want    nftables.SetDatatype
+		str     string
+		success bool
+	}{
+		{
+			name:    "ipv4 address and service",
+			s:       "ipv4_addr . inet_service",
+			want:    GenSetKeyType(nftables.TypeIPAddr, nftables.TypeInetService),
+			str:     "ipv4_addr . inet_service",
+			success: true,
+		},
+		{
+			name:    "ipv6 address, protocol and service without spaces",
+			s:       "ipv6_addr.inet_proto.inet_service",
+			want:    GenSetKeyType(nftables.TypeIP6Addr, nftables.TypeInetProto, nftables.TypeInetService),
+			str:     "ipv6_addr . inet_proto . inet_service",
+			success: true,
+		},
+		{
+			name:    "ether address and mark",
+			s:       "ether_addr . mark",
+			want:    GenSetKeyType(nftables.TypeEtherAddr, nftables.TypeMark),
+			str:     "ether_addr . mark",
+			success: true,
+		},
+		{
+			name:    "integer and ipv4 address",
+			s:       " integer . ipv4_addr ",
+			want:    GenSetKeyType(nftables.TypeInteger, nftables.TypeIPAddr),
+			str:     "integer . ipv4_addr",
+			success: true,
+		},
+		{
+			name:    "unknown datatype",
+			s:       "ipv4_addr . port",
+			success: false,
+		},
+		{
+			name:    "empty datatype",
+			s:       "",
+			success: false,
+		},
+		{
+			name:    "verdict in concatenation",
+			s:       "ipv4_addr . verdict",
+			success: false,
+		},
+		{
+			name:    "interface name in concatenation",
+			s:       "ifname . inet_service",
+			success: false,
+		},
+		{
+			name:    "too many datatypes",
+			s:       "mark . mark . mark . mark . mark . mark",
+			success: false,
+		},
+	}
+	for _, tt := range tests {
+		got, err := ParseSetDatatype(tt.s)
+		if err != nil && tt.success {
+			t.Errorf("Test \"%s\" failed with error: %+v but supposed to succeed", tt.name, err)
+			continue
+		}
+		if err == nil && !tt.success {
+			t.Errorf("Test \"%s\" failed as it was supposed to fail but succeeded", tt.name)
+			continue
+		}
+		if !tt.success {
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("Test \"%s\" failed, expected datatype %+v, got %+v", tt.name, tt.want, got)
+		}
+		if str := SetDatatypeString(got); str != tt.str {
+			t.Errorf("Test \"%s\" failed, expected name %q, got %q", tt.name, tt.str, str)
+		}
+		if again, err := ParseSetDatatype(SetDatatypeString(got)); err != nil || again != got {
+			t.Errorf("Test \"%s\" failed to round-trip datatype, got %+v with error: %+v", tt.name, again, err)
+		}
+	}
+}
+
+func TestNewSetAttributes(t *testing.T) {
+	attrs, err := NewMapAttributes("svc", "ipv4_addr . inet_proto . inet_service", "verdict")
+	if err != nil {
+		t.Fatalf("failed to build map attributes with error: %+v", err)
+	}
+	if !attrs.IsMap || attrs.DataType != nftables.TypeVerdict || attrs.KeyType != GenSetKeyType(nftables.TypeIPAddr, nftables.TypeInetProto, nftables.TypeInetService) {
+		t.Errorf("unexpected map attributes %+v", attrs)
+	}
+	if err := validateSetAttributes(attrs); err != nil {
+		t.Errorf("map attributes failed validation with error: %+v", err)
+	}
+	attrs, err = NewSetAttributes("blocked", "ipv6_addr")
+	if err != nil {
+		t.Fatalf("failed to build set attributes with error: %+v", err)
+	}
+	if attrs.IsMap || attrs.KeyType != nftables.TypeIP6Addr {
+		t.Errorf("unexpected set attributes %+v", attrs)
+	}
+	if _, err := NewSetAttributes("verdicts", "verdict"); err == nil {
+		t.Errorf("set of verdicts supposed to fail")
+	}
+	if _, err := NewMapAttributes("m", "ipv4_addr", "addr"); err == nil {
+		t.Errorf("map of unknown data type supposed to fail")
+	}
+}
@@ -0,0 +1,133 @@
+package nftableslib
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/google/nftables"
+	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// verdictDataMagic is nft magic the kernel reports for the data type of verdict maps
+const verdictDataMagic = 0xffffff00
+
+// getSets returns sets of the table programmed on the host, github.com/google/nftables fails
+// the whole dump when the table carries a set of a datatype it does not know, like TypeIFName.
+func getSets(conn NetNS, t *nftables.Table) ([]*nftables.Set, error) {
+	c, ok := conn.(*nftables.Conn)
+	if !ok {
+		return conn.GetSets(t)
+	}
+
+	return dumpSets(c, t)
+}
+
+// getSetElements returns elements of the set programmed on the host, elements are dumped by
+// the library, so interrupted dumps are reported as unix.EINTR.
+func getSetElements(conn NetNS, set *nftables.Set) ([]nftables.SetElement, error) {
+	c, ok := conn.(*nftables.Conn)
+	if !ok {
+		return conn.GetSetElements(set)
+	}
+	elements := make([]nftables.SetElement, 0)
+	if err := dumpSetElements(c, set, func(e nftables.SetElement) error {
+		elements = append(elements, e)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	return elements, nil
+}
+
+// getSetByName returns the set of the table programmed on the host
+func getSetByName(conn NetNS, t *nftables.Table, name string) (*nftables.Set, error) {
+	if _, ok := conn.(*nftables.Conn); !ok {
+		return conn.GetSetByName(t, name)
+	}
+	sets, err := getSets(conn, t)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range sets {
+		if s.Name == name {
+			return s, nil
+		}
+	}
+
+	return nil, unix.ENOENT
+}
+
+// dumpSets requests the dump of the table's sets
+func dumpSets(c *nftables.Conn, t *nftables.Table) ([]*nftables.Set, error) {
+	data, err := netlink.MarshalAttributes([]netlink.Attribute{
+		{Type: unix.NFTA_SET_TABLE, Data: []byte(t.Name + "\x00")},
+	})
+	if err != nil {
+		return nil, err
+	}
+	msg := netlink.Message{
+		Header: netlink.Header{
+			Type:  netlink.HeaderType((unix.NFNL_SUBSYS_NFTABLES << 8) | unix.NFT_MSG_GETSET),
+			Flags: netlink.Request | netlink.Acknowledge | netlink.Dump,
+		},
+		// nfgenmsg header: family, version and resource id
+		Data: append([]byte{uint8(t.Family), unix.NFNETLINK_V0, 0, 0}, data...),
+	}
+	sets := make([]*nftables.Set, 0)
+	if err := dumpMessages(c, msg, func(b []byte) error {
+		s, err := setFromMessage(b)
+		if err != nil {
+			return err
+		}
+		s.Table = &nftables.Table{Name: t.Name, Use: t.Use, Flags: t.Flags, Family: t.Family}
+		sets = append(sets, s)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	return sets, nil
+}
+
+// setFromMessage decodes the set carried by NFT_MSG_NEWSET message, attributes are decoded
+// the way github.com/google/nftables decodes them, so decodeSet recovers flags and datatypes
+// of sets of both dumps. Datatypes are kept as nft magic even if they are not known.
+func setFromMessage(b []byte) (*nftables.Set, error) {
+	ad, err := netlink.NewAttributeDecoder(b[4:])
+	if err != nil {
+		return nil, err
+	}
+	ad.ByteOrder = binary.BigEndian
+	s := &nftables.Set{}
+	for ad.Next() {
+		switch ad.Type() {
+		case unix.NFTA_SET_NAME:
+			s.Name = ad.String()
+		case unix.NFTA_SET_ID:
+			s.ID = ad.Uint32()
+		case unix.NFTA_SET_TIMEOUT:
+			s.Timeout = time.Duration(ad.Uint64()) * time.Millisecond
+			s.HasTimeout = true
+		case unix.NFTA_SET_FLAGS:
+			flags := ad.Uint32()
+			s.Constant = flags&unix.NFT_SET_CONSTANT != 0
+			s.Anonymous = flags&unix.NFT_SET_ANONYMOUS != 0
+			s.Interval = flags&unix.NFT_SET_INTERVAL != 0
+			s.IsMap = flags&unix.NFT_SET_ANONYMOUS != 0
+			s.HasTimeout = flags&(unix.NFT_SET_ANONYMOUS|unix.NFT_SET_CONSTANT|unix.NFT_SET_MAP) != 0
+		case unix.NFTA_SET_KEY_TYPE:
+			s.KeyType.SetNFTMagic(ad.Uint32())
+		case unix.NFTA_SET_DATA_TYPE:
+			magic := ad.Uint32()
+			if magic == verdictDataMagic {
+				s.KeyType = nftables.TypeVerdict
+				break
+			}
+			s.DataType.SetNFTMagic(magic)
+		}
+	}
+
+	return s, ad.Err()
+}
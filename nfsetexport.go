@@ -0,0 +1,212 @@
+package nftableslib
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+)
+
+// ExpiringElementsIterator defines an optional interface of the connection, connections which are not
+// *nftables.Conn implement it to report the time left before elements of a set expire.
+type ExpiringElementsIterator interface {
+	IterateExpiringElements(*nftables.Set, func(nftables.SetElement, time.Duration) error) error
+}
+
+// SetDump is the JSON representation of a set and its elements produced by DumpSet and consumed
+// by RestoreSet. Data types are carried by their nft magic.
+type SetDump struct {
+	Name       string        `json:"name"`
+	Constant   bool          `json:"constant,omitempty"`
+	IsMap      bool          `json:"isMap,omitempty"`
+	Interval   bool          `json:"interval,omitempty"`
+	HasTimeout bool          `json:"hasTimeout,omitempty"`
+	Timeout    time.Duration `json:"timeout,omitempty"`
+	KeyType    uint32        `json:"keyType"`
+	DataType   uint32        `json:"dataType,omitempty"`
+	// Dumped is the time the set was dumped at, expirations of elements are counted from it
+	Dumped   time.Time         `json:"dumped"`
+	Elements []*SetElementDump `json:"elements,omitempty"`
+}
+
+// SetElementDump is the JSON representation of a set element
+type SetElementDump struct {
+	Key         []byte          `json:"key"`
+	Val         []byte          `json:"val,omitempty"`
+	Verdict     *ElementVerdict `json:"verdict,omitempty"`
+	IntervalEnd bool            `json:"intervalEnd,omitempty"`
+	Timeout     time.Duration   `json:"timeout,omitempty"`
+	// Expires is the time left before the element expired when the set was dumped, 0 if it does not expire
+	Expires time.Duration `json:"expires,omitempty"`
+}
+
+// DumpSet returns JSON representation of the set with its elements, elements of sets with timeouts
+// carry the time left before they expire, so RestoreSet does not restart their timeouts.
+func (nfs *nfSets) DumpSet(name string) ([]byte, error) {
+	if !nfs.Exist(name) {
+		return nil, fmt.Errorf("set %s does not exist in table %s", name, tableName(nfs.table))
+	}
+	set, _ := nfs.get(name)
+	d, err := dumpSet(nfs.conn, set, true)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(d)
+}
+
+// dumpSet returns the dump of the set programmed on the host, elements are read only if requested
+func dumpSet(conn NetNS, set *nftables.Set, elements bool) (*SetDump, error) {
+	d := &SetDump{
+		Name:       set.Name,
+		Constant:   set.Constant,
+		IsMap:      set.IsMap,
+		Interval:   set.Interval,
+		HasTimeout: set.HasTimeout,
+		Timeout:    set.Timeout,
+		KeyType:    set.KeyType.GetNFTMagic(),
+		DataType:   set.DataType.GetNFTMagic(),
+	}
+	if !elements {
+		return d, nil
+	}
+	d.Dumped = time.Now()
+	if err := iterateExpiringElements(conn, set, func(e nftables.SetElement, left time.Duration) error {
+		d.Elements = append(d.Elements, &SetElementDump{
+			Key:         e.Key,
+			Val:         e.Val,
+			Verdict:     elementVerdict(e.VerdictData),
+			IntervalEnd: e.IntervalEnd,
+			Timeout:     e.Timeout,
+			Expires:     left,
+		})
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	if set.Interval {
+		// The host reports intervals in descending order, the element opening an interval must precede its end
+		sort.SliceStable(d.Elements, func(i, j int) bool {
+			if c := bytes.Compare(d.Elements[i].Key, d.Elements[j].Key); c != 0 {
+				return c < 0
+			}
+			return d.Elements[i].IntervalEnd && !d.Elements[j].IntervalEnd
+		})
+	}
+
+	return d, nil
+}
+
+// RestoreSet creates the set dumped by DumpSet, or replaces elements of the set if it already exists.
+// Elements get timeouts set to the time they had left when they were dumped minus the time passed
+// since, clamped to the timeout of the set, or of the element if the set has none. Elements which
+// expired in the meantime are not restored, their number is returned.
+func (nfs *nfSets) RestoreSet(data []byte) (int, error) {
+	if err := writable(nfs.conn); err != nil {
+		return 0, err
+	}
+	d := &SetDump{}
+	if err := json.Unmarshal(data, d); err != nil {
+		return 0, fmt.Errorf("failed to decode set dump with error: %+v", err)
+	}
+	keyType, err := decodeSetDatatype(d.KeyType)
+	if err != nil {
+		return 0, err
+	}
+	var dataType nftables.SetDatatype
+	if d.DataType != 0 {
+		if dataType, err = decodeSetDatatype(d.DataType); err != nil {
+			return 0, err
+		}
+	}
+	set, exists := nfs.get(d.Name)
+	exists = exists && nfs.Exist(d.Name)
+	timeout := d.Timeout
+	if exists {
+		timeout = set.Timeout
+	}
+	elements, skipped := restoredElements(d, time.Since(d.Dumped), timeout)
+	if exists {
+		if err := nfs.replaceElements(set, elements); err != nil {
+			return 0, err
+		}
+		return skipped, flush(nfs.conn)
+	}
+	isAddr := d.KeyType == nftables.TypeIPAddr.GetNFTMagic() || d.KeyType == nftables.TypeIP6Addr.GetNFTMagic()
+	if d.Interval && isAddr && len(elements) != 0 && elements[0].IntervalEnd {
+		// The end of the interval preceding the first one is added by CreateSet
+		elements = elements[1:]
+	}
+	if _, err := nfs.CreateSet(&SetAttributes{
+		Name:       d.Name,
+		Constant:   d.Constant,
+		IsMap:      d.IsMap,
+		HasTimeout: d.HasTimeout,
+		Timeout:    d.Timeout,
+		Interval:   d.Interval,
+		KeyType:    keyType,
+		DataType:   dataType,
+	}, elements); err != nil {
+		return 0, err
+	}
+
+	return skipped, nil
+}
+
+// restoredElements converts dumped elements to elements with timeouts set to the time left after elapsed,
+// expired elements are skipped along with ends of the intervals they open.
+func restoredElements(d *SetDump, elapsed, timeout time.Duration) ([]nftables.SetElement, int) {
+	elements := make([]nftables.SetElement, 0, len(d.Elements))
+	skipped := 0
+	for i := 0; i < len(d.Elements); i++ {
+		de := d.Elements[i]
+		e := nftables.SetElement{Key: de.Key, Val: de.Val, IntervalEnd: de.IntervalEnd, Timeout: de.Timeout}
+		if de.Verdict != nil {
+			e.VerdictData = &expr.Verdict{Kind: expr.VerdictKind(de.Verdict.Kind), Chain: de.Verdict.Chain}
+		}
+		if de.Expires != 0 {
+			left := de.Expires - elapsed
+			if left <= 0 {
+				skipped++
+				if d.Interval && i+1 < len(d.Elements) && d.Elements[i+1].IntervalEnd {
+					i++
+				}
+				continue
+			}
+			limit := timeout
+			if limit == 0 {
+				limit = de.Timeout
+			}
+			if limit != 0 && left > limit {
+				left = limit
+			}
+			// The kernel counts timeouts in milliseconds, shorter timeouts would not expire
+			if left < time.Millisecond {
+				left = time.Millisecond
+			}
+			e.Timeout = left
+		}
+		elements = append(elements, e)
+	}
+
+	return elements, skipped
+}
+
+// iterateExpiringElements calls fn for every element of the set along with the time left before
+// the element expires, connections unable to report expiration report 0.
+func iterateExpiringElements(conn NetNS, set *nftables.Set, fn func(nftables.SetElement, time.Duration) error) error {
+	switch c := conn.(type) {
+	case ExpiringElementsIterator:
+		return c.IterateExpiringElements(set, fn)
+	case *nftables.Conn:
+		return dumpExpiringElements(c, set, fn)
+	}
+
+	return iterateSetElements(conn, set, func(e nftables.SetElement) error {
+		return fn(e, 0)
+	})
+}
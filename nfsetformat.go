@@ -0,0 +1,542 @@
+package nftableslib
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/google/nftables"
+	"golang.org/x/sys/unix"
+)
+
+// SetElementsFormat defines the text format of set elements exchanged with other tools by
+// ExportSetElements and ImportSetElements. Keys of interval sets are written as a single value,
+// a prefix like "10.0.0.0/8" or a range like "10.0.0.1-10.0.0.9" or "8000-8080".
+type SetElementsFormat int
+
+const (
+	// SetElementsNFT is nft element syntax, like "{ 1.2.3.0/24, 5.6.7.8 }", elements can span
+	// multiple lines and can be preceded by "elements =". Fields of concatenated keys are joined by " . ".
+	SetElementsNFT SetElementsFormat = iota
+	// SetElementsCSV carries an element per line, fields of concatenated keys are separated by commas.
+	// Empty lines and lines starting with # are skipped.
+	SetElementsCSV
+)
+
+// ErrElementSyntax is returned by ImportSetElements when the text carries an element which cannot be parsed,
+// Line is the number of the line the element starts at, lines are counted from 1.
+type ErrElementSyntax struct {
+	Line    int
+	Element string
+	Reason  string
+}
+
+func (e *ErrElementSyntax) Error() string {
+	return fmt.Sprintf("line %d: invalid element %q: %s", e.Line, e.Element, e.Reason)
+}
+
+// textElement is an element read from the text along with the line it starts at
+type textElement struct {
+	line int
+	text string
+}
+
+// ExportSetElements returns elements of the set in the format, elements are sorted by their keys.
+// Only sets of ipv4_addr, ipv6_addr, inet_service and inet_proto keys and their concatenations are supported.
+func (nfs *nfSets) ExportSetElements(name string, format SetElementsFormat) ([]byte, error) {
+	set, ok := nfs.get(name)
+	if !ok {
+		return nil, fmt.Errorf("set %s does not exist", name)
+	}
+	types, err := textElementTypes(set)
+	if err != nil {
+		return nil, err
+	}
+	elements, err := nfs.GetSetElements(name)
+	if err != nil {
+		return nil, err
+	}
+	sep := concatSeparator
+	if format == SetElementsCSV {
+		sep = ","
+	}
+	texts := make([]string, 0, len(elements))
+	if set.Interval {
+		for _, interval := range elementIntervals(elements) {
+			end := interval[0].Key
+			if len(interval) == 2 {
+				end = interval[1].Key
+			}
+			texts = append(texts, formatInterval(types[0], interval[0].Key, end, len(interval) == 2))
+		}
+	} else {
+		sortIntervalElements(elements)
+		for _, e := range elements {
+			fields := make([]string, 0, len(types))
+			b := e.Key
+			for _, t := range types {
+				l := int(t.Bytes)
+				if len(types) > 1 {
+					l = (l + 3) &^ 3
+				}
+				if l > len(b) {
+					return nil, fmt.Errorf("key %x of set %s is shorter than its key type", e.Key, name)
+				}
+				fields = append(fields, renderElementData(t.GetNFTMagic(), b[:t.Bytes]))
+				b = b[l:]
+			}
+			texts = append(texts, strings.Join(fields, sep))
+		}
+	}
+	var buf bytes.Buffer
+	switch format {
+	case SetElementsNFT:
+		if len(texts) == 0 {
+			buf.WriteString("{ }\n")
+			break
+		}
+		fmt.Fprintf(&buf, "{ %s }\n", strings.Join(texts, ", "))
+	case SetElementsCSV:
+		for _, t := range texts {
+			buf.WriteString(t + "\n")
+		}
+	default:
+		return nil, fmt.Errorf("unknown set elements format %d", format)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// ImportSetElements reads elements of the set in the format and adds them in chunks as SetAddElementsBatch does,
+// the number of read elements is returned. Parsing stops at the first invalid element, ErrElementSyntax is returned
+// and no elements are added. If replace is true, elements of the set which are not read are removed and only
+// missing elements are added, elements present in both stay in the set all the time.
+func (nfs *nfSets) ImportSetElements(name string, r io.Reader, format SetElementsFormat, replace bool) (int, error) {
+	if err := writable(nfs.conn); err != nil {
+		return 0, err
+	}
+	set, ok := nfs.get(name)
+	if !ok {
+		return 0, fmt.Errorf("set %s does not exist", name)
+	}
+	types, err := textElementTypes(set)
+	if err != nil {
+		return 0, err
+	}
+	var texts []*textElement
+	switch format {
+	case SetElementsNFT:
+		texts, err = readNFTElements(r)
+	case SetElementsCSV:
+		texts, err = readCSVElements(r)
+	default:
+		return 0, fmt.Errorf("unknown set elements format %d", format)
+	}
+	if err != nil {
+		return 0, err
+	}
+	elements := make([]nftables.SetElement, 0, len(texts))
+	for _, t := range texts {
+		e, err := parseTextElement(set, types, t.text, format)
+		if err != nil {
+			return 0, &ErrElementSyntax{Line: t.line, Element: t.text, Reason: err.Error()}
+		}
+		elements = append(elements, e...)
+	}
+	if !replace {
+		return len(texts), nfs.SetAddElementsBatch(name, elements)
+	}
+	current, err := nfs.GetSetElements(name)
+	if err != nil {
+		return 0, err
+	}
+	stale, missing := elementsDiff(current, elements, set.Interval)
+	// Stale elements are removed first, so new intervals do not overlap with them
+	if len(stale) != 0 {
+		if err := nfs.SetDelElementsBatch(name, stale); err != nil {
+			return 0, err
+		}
+	}
+	if len(missing) != 0 {
+		if err := nfs.SetAddElementsBatch(name, missing); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(texts), nil
+}
+
+// textElementTypes returns datatypes of fields of the set's key, only datatypes which have a text form
+// are supported.
+func textElementTypes(set *nftables.Set) ([]nftables.SetDatatype, error) {
+	if set.IsMap {
+		return nil, fmt.Errorf("elements of map %s cannot be exchanged as text", set.Name)
+	}
+	types := splitSetDatatype(set.KeyType.GetNFTMagic())
+	if len(types) == 0 {
+		return nil, fmt.Errorf("key type of set %s is not known", set.Name)
+	}
+	for _, t := range types {
+		switch t.GetNFTMagic() {
+		case nftables.TypeIPAddr.GetNFTMagic(), nftables.TypeIP6Addr.GetNFTMagic(),
+			nftables.TypeInetService.GetNFTMagic(), nftables.TypeInetProto.GetNFTMagic():
+		default:
+			return nil, fmt.Errorf("elements of set %s with key type %s cannot be exchanged as text", set.Name, t.Name)
+		}
+	}
+	if set.Interval && len(types) > 1 {
+		return nil, fmt.Errorf("elements of set %s with concatenated intervals cannot be exchanged as text", set.Name)
+	}
+
+	return types, nil
+}
+
+// readNFTElements splits the text in nft element syntax into elements
+func readNFTElements(r io.Reader) ([]*textElement, error) {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	text := string(b)
+	line := 1
+	syntax := func(element, reason string) error {
+		return &ErrElementSyntax{Line: line, Element: element, Reason: reason}
+	}
+	// skip skips white spaces counting lines
+	skip := func() {
+		for len(text) != 0 && strings.ContainsRune(" \t\r\n", rune(text[0])) {
+			if text[0] == '\n' {
+				line++
+			}
+			text = text[1:]
+		}
+	}
+	skip()
+	if strings.HasPrefix(text, "elements") {
+		text = strings.TrimPrefix(text, "elements")
+		skip()
+		if !strings.HasPrefix(text, "=") {
+			return nil, syntax("elements", "\"=\" is expected after \"elements\"")
+		}
+		text = text[1:]
+		skip()
+	}
+	if !strings.HasPrefix(text, "{") {
+		return nil, syntax(firstLine(text), "elements must be enclosed in { }")
+	}
+	text = text[1:]
+	elements := make([]*textElement, 0)
+	for {
+		skip()
+		if strings.HasPrefix(text, "}") {
+			if len(elements) != 0 {
+				return nil, syntax("}", "element is expected after \",\"")
+			}
+			text = text[1:]
+			break
+		}
+		end := strings.IndexAny(text, ",}")
+		if end == -1 {
+			return nil, syntax(firstLine(text), "elements are not closed by }")
+		}
+		e := strings.TrimSpace(text[:end])
+		if e == "" {
+			return nil, syntax(text[:end+1], "empty element")
+		}
+		elements = append(elements, &textElement{line: line, text: e})
+		line += strings.Count(text[:end], "\n")
+		closing := text[end] == '}'
+		text = text[end+1:]
+		if closing {
+			break
+		}
+	}
+	skip()
+	if text != "" {
+		return nil, syntax(firstLine(text), "unexpected text after }")
+	}
+
+	return elements, nil
+}
+
+// readCSVElements reads an element per line
+func readCSVElements(r io.Reader) ([]*textElement, error) {
+	elements := make([]*textElement, 0)
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		elements = append(elements, &textElement{line: line, text: text})
+	}
+
+	return elements, scanner.Err()
+}
+
+// firstLine returns the first line of the text
+func firstLine(text string) string {
+	if i := strings.IndexByte(text, '\n'); i != -1 {
+		return strings.TrimSpace(text[:i])
+	}
+
+	return strings.TrimSpace(text)
+}
+
+// parseTextElement returns the element of the set, elements of interval sets are returned with
+// the element closing the interval.
+func parseTextElement(set *nftables.Set, types []nftables.SetDatatype, text string, format SetElementsFormat) ([]nftables.SetElement, error) {
+	fields := []string{text}
+	if len(types) > 1 {
+		if format == SetElementsCSV {
+			fields = strings.Split(text, ",")
+		} else {
+			fields = strings.Split(strings.Join(strings.Fields(text), " "), concatSeparator)
+		}
+	}
+	if len(fields) != len(types) {
+		return nil, fmt.Errorf("%d fields do not match %d fields of key type %s", len(fields), len(types), SetDatatypeString(set.KeyType))
+	}
+	if set.Interval {
+		start, end, err := parseTextField(types[0], text)
+		if err != nil {
+			return nil, err
+		}
+		if end == nil {
+			end = nextKey(start)
+		}
+		if bytes.Equal(end, make([]byte, len(end))) {
+			return nil, fmt.Errorf("interval reaching the end of the key space is not supported")
+		}
+		return []nftables.SetElement{{Key: start}, {Key: end, IntervalEnd: true}}, nil
+	}
+	key := make([]byte, 0, set.KeyType.Bytes)
+	for i, t := range types {
+		start, end, err := parseTextField(t, strings.TrimSpace(fields[i]))
+		if err != nil {
+			return nil, err
+		}
+		// A prefix or a range can carry a single key
+		if end != nil && !bytes.Equal(nextKey(start), end) {
+			return nil, fmt.Errorf("intervals require set %s with interval flag", set.Name)
+		}
+		if len(types) > 1 {
+			start = append(start, make([]byte, ((len(start)+3)&^3)-len(start))...)
+		}
+		key = append(key, start...)
+	}
+
+	return []nftables.SetElement{{Key: key}}, nil
+}
+
+// parseTextField parses the value of the datatype, the end of the interval is returned as the first key
+// following the interval, it is nil if the value is not an interval.
+func parseTextField(t nftables.SetDatatype, s string) ([]byte, []byte, error) {
+	switch t.GetNFTMagic() {
+	case nftables.TypeIPAddr.GetNFTMagic(), nftables.TypeIP6Addr.GetNFTMagic():
+		l := net.IPv4len
+		if t.GetNFTMagic() == nftables.TypeIP6Addr.GetNFTMagic() {
+			l = net.IPv6len
+		}
+		addr := func(s string) ([]byte, error) {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %s", s)
+			}
+			if ip4 := ip.To4(); l == net.IPv4len && ip4 != nil {
+				return ip4, nil
+			}
+			if l == net.IPv6len && ip.To4() == nil {
+				return ip.To16(), nil
+			}
+			return nil, fmt.Errorf("address %s does not match key type %s", s, t.Name)
+		}
+		if strings.Contains(s, "/") {
+			ip, prefix, err := net.ParseCIDR(s)
+			if err != nil {
+				return nil, nil, fmt.Errorf("invalid prefix %s", s)
+			}
+			start, err := addr(ip.String())
+			if err != nil {
+				return nil, nil, err
+			}
+			if !ip.Equal(prefix.IP) {
+				return nil, nil, fmt.Errorf("prefix %s has host bits set", s)
+			}
+			ones, _ := prefix.Mask.Size()
+			mask := net.CIDRMask(ones, l*8)
+			last := make([]byte, l)
+			for i := range last {
+				last[i] = start[i] | ^mask[i]
+			}
+			return start, nextKey(last), nil
+		}
+		if i := strings.Index(s, "-"); i != -1 {
+			start, err := addr(strings.TrimSpace(s[:i]))
+			if err != nil {
+				return nil, nil, err
+			}
+			last, err := addr(strings.TrimSpace(s[i+1:]))
+			if err != nil {
+				return nil, nil, err
+			}
+			if bytes.Compare(start, last) > 0 {
+				return nil, nil, fmt.Errorf("range %s is reversed", s)
+			}
+			return start, nextKey(last), nil
+		}
+		start, err := addr(s)
+		return start, nil, err
+	case nftables.TypeInetService.GetNFTMagic():
+		port := func(s string) ([]byte, error) {
+			p, err := strconv.ParseUint(s, 10, 16)
+			if err != nil {
+				return nil, fmt.Errorf("invalid port %s", s)
+			}
+			b := make([]byte, 2)
+			binary.BigEndian.PutUint16(b, uint16(p))
+			return b, nil
+		}
+		if i := strings.Index(s, "-"); i != -1 {
+			start, err := port(strings.TrimSpace(s[:i]))
+			if err != nil {
+				return nil, nil, err
+			}
+			last, err := port(strings.TrimSpace(s[i+1:]))
+			if err != nil {
+				return nil, nil, err
+			}
+			if bytes.Compare(start, last) > 0 {
+				return nil, nil, fmt.Errorf("range %s is reversed", s)
+			}
+			return start, nextKey(last), nil
+		}
+		start, err := port(s)
+		return start, nil, err
+	case nftables.TypeInetProto.GetNFTMagic():
+		protos := map[string]uint8{"tcp": unix.IPPROTO_TCP, "udp": unix.IPPROTO_UDP, "icmp": unix.IPPROTO_ICMP,
+			"icmpv6": unix.IPPROTO_ICMPV6, "sctp": unix.IPPROTO_SCTP}
+		if p, ok := protos[s]; ok {
+			return []byte{p}, nil, nil
+		}
+		p, err := strconv.ParseUint(s, 10, 8)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid protocol %s", s)
+		}
+		return []byte{byte(p)}, nil, nil
+	}
+
+	return nil, nil, fmt.Errorf("datatype %s is not supported", t.Name)
+}
+
+// formatInterval renders the interval [start, end) as a single value, a prefix or a range, intervals
+// without end reach the end of the key space.
+func formatInterval(t nftables.SetDatatype, start, end []byte, closed bool) string {
+	last := make([]byte, len(start))
+	if closed {
+		// The last key of the interval is end - 1
+		copy(last, end)
+		for i := len(last) - 1; i >= 0; i-- {
+			last[i]--
+			if last[i] != 0xff {
+				break
+			}
+		}
+	} else {
+		for i := range last {
+			last[i] = 0xff
+		}
+	}
+	render := func(b []byte) string { return renderElementData(t.GetNFTMagic(), b) }
+	if bytes.Equal(start, last) {
+		return render(start)
+	}
+	isAddr := t.GetNFTMagic() == nftables.TypeIPAddr.GetNFTMagic() || t.GetNFTMagic() == nftables.TypeIP6Addr.GetNFTMagic()
+	if isAddr && closed {
+		if prefix, err := intervalPrefix(start, end); err == nil {
+			return prefix.String()
+		}
+	}
+
+	return render(start) + "-" + render(last)
+}
+
+// elementIntervals pairs elements opening intervals with elements closing them, intervals reaching
+// the end of the key space carry only the opening element.
+func elementIntervals(elements []nftables.SetElement) [][]nftables.SetElement {
+	sorted := append([]nftables.SetElement{}, elements...)
+	sortIntervalElements(sorted)
+	intervals := make([][]nftables.SetElement, 0, len(sorted)/2)
+	for i := 0; i < len(sorted); i++ {
+		if sorted[i].IntervalEnd {
+			continue
+		}
+		if i+1 < len(sorted) && sorted[i+1].IntervalEnd {
+			intervals = append(intervals, sorted[i:i+2])
+			i++
+			continue
+		}
+		intervals = append(intervals, sorted[i:i+1])
+	}
+
+	return intervals
+}
+
+// elementsDiff returns elements of current which are not wanted and wanted elements missing in current,
+// intervals are compared by both their ends.
+func elementsDiff(current, want []nftables.SetElement, interval bool) ([]nftables.SetElement, []nftables.SetElement) {
+	groups := func(elements []nftables.SetElement) ([][]nftables.SetElement, map[string]bool) {
+		var gs [][]nftables.SetElement
+		if interval {
+			gs = elementIntervals(elements)
+		} else {
+			for i := range elements {
+				gs = append(gs, []nftables.SetElement{{Key: elements[i].Key}})
+			}
+		}
+		keys := make(map[string]bool, len(gs))
+		for _, g := range gs {
+			keys[elementsKey(g)] = true
+		}
+		return gs, keys
+	}
+	have, haveKeys := groups(current)
+	wanted, wantKeys := groups(want)
+	stale := make([]nftables.SetElement, 0)
+	for _, g := range have {
+		if wantKeys[elementsKey(g)] {
+			continue
+		}
+		// Elements are removed by the key, data reported by the host is not sent back
+		for _, e := range g {
+			stale = append(stale, nftables.SetElement{Key: e.Key, IntervalEnd: e.IntervalEnd})
+		}
+	}
+	missing := make([]nftables.SetElement, 0)
+	added := make(map[string]bool)
+	for _, g := range wanted {
+		k := elementsKey(g)
+		if !haveKeys[k] && !added[k] {
+			missing = append(missing, g...)
+			added[k] = true
+		}
+	}
+
+	return stale, missing
+}
+
+// elementsKey identifies the element or the interval by its keys
+func elementsKey(elements []nftables.SetElement) string {
+	var b strings.Builder
+	for _, e := range elements {
+		fmt.Fprintf(&b, "%x/%t;", e.Key, e.IntervalEnd)
+	}
+
+	return b.String()
+}
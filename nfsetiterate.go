@@ -0,0 +1,342 @@
+package nftableslib
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// ErrStopIteration can be returned by the function processing set elements to stop
+// the iteration, in this case the iteration function returns nil.
+var ErrStopIteration = errors.New("stop iteration")
+
+// SetElementsIterator defines an optional interface of the connection, connections implementing it
+// deliver elements of a set one by one instead of returning a slice of all elements.
+type SetElementsIterator interface {
+	IterateSetElements(*nftables.Set, func(nftables.SetElement) error) error
+}
+
+// DecodedElement defines a set element with the key and the value rendered according to
+// the set's datatypes, concatenated key or value carries an entry per datatype.
+type DecodedElement struct {
+	Key     []string
+	Val     []string
+	Verdict *expr.Verdict
+	// Action carries the verdict of verdict map's element, it is nil for elements of other sets
+	Action      *ElementVerdict
+	IntervalEnd bool
+	Timeout     time.Duration
+}
+
+// ElementVerdict defines the verdict of verdict map's element, Kind carries the same values SetVerdict
+// accepts: NFT_ACCEPT, NFT_DROP, unix.NFT_JUMP, unix.NFT_GOTO, unix.NFT_RETURN and others, Chain is set
+// only for jump and goto verdicts.
+type ElementVerdict struct {
+	Kind  int
+	Chain string
+}
+
+// String returns the verdict in nft syntax, like "accept" or "jump web"
+func (v *ElementVerdict) String() string {
+	if v.Chain == "" {
+		return verdictName(v.Kind)
+	}
+
+	return verdictName(v.Kind) + " " + v.Chain
+}
+
+// Action returns RuleAction carrying the verdict
+func (v *ElementVerdict) Action() (*RuleAction, error) {
+	if v.Chain == "" {
+		return SetVerdict(v.Kind)
+	}
+
+	return SetVerdict(v.Kind, v.Chain)
+}
+
+func elementVerdict(v *expr.Verdict) *ElementVerdict {
+	if v == nil {
+		return nil
+	}
+	ev := &ElementVerdict{Kind: int(int32(v.Kind))}
+	// Only jump and goto verdicts refer to a chain
+	if ev.Kind == unix.NFT_JUMP || ev.Kind == unix.NFT_GOTO {
+		ev.Chain = v.Chain
+	}
+
+	return ev
+}
+
+// IterateSetElements calls fn for every element of the set, elements are processed as the netlink
+// dump messages arrive, so elements of the set are never stored in memory all together.
+func (nfs *nfSets) IterateSetElements(name string, fn func(nftables.SetElement) error) error {
+	if !nfs.Exist(name) {
+		return fmt.Errorf("set %s does not exist in table %s", name, tableName(nfs.table))
+	}
+	set, _ := nfs.get(name)
+
+	err := iterateSetElements(nfs.conn, set, fn)
+	if err == ErrStopIteration {
+		return nil
+	}
+
+	return err
+}
+
+// IterateSetElementsDecoded calls fn for every element of the set with the element's key and value
+// decoded according to the set's key and data types.
+func (nfs *nfSets) IterateSetElementsDecoded(name string, fn func(*DecodedElement) error) error {
+	set, ok := nfs.get(name)
+	if !ok {
+		return fmt.Errorf("set %s does not exist in table %s", name, tableName(nfs.table))
+	}
+
+	return nfs.IterateSetElements(name, func(e nftables.SetElement) error {
+		return fn(decodeElement(set, e))
+	})
+}
+
+// VMapEntries returns elements of the verdict map as a map of decoded keys to verdicts in nft syntax,
+// like "80": "jump web". Fields of concatenated keys are joined by " . ", ends of intervals are skipped.
+func (nfs *nfSets) VMapEntries(name string) (map[string]string, error) {
+	entries := make(map[string]string)
+	if err := nfs.IterateSetElementsDecoded(name, func(e *DecodedElement) error {
+		if e.IntervalEnd {
+			return nil
+		}
+		if e.Action == nil {
+			return fmt.Errorf("element %s of set %s does not carry a verdict", strings.Join(e.Key, " . "), name)
+		}
+		entries[strings.Join(e.Key, " . ")] = e.Action.String()
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+func iterateSetElements(conn NetNS, set *nftables.Set, fn func(nftables.SetElement) error) error {
+	switch c := conn.(type) {
+	case SetElementsIterator:
+		return c.IterateSetElements(set, fn)
+	case *nftables.Conn:
+		return dumpSetElements(c, set, fn)
+	}
+	// Connection cannot stream elements, falling back to the full list
+	elements, err := conn.GetSetElements(set)
+	if err != nil {
+		return err
+	}
+	for _, e := range elements {
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// dumpSetElements requests the dump of the set's elements and decodes each received message
+// before reading the next one.
+func dumpSetElements(c *nftables.Conn, set *nftables.Set, fn func(nftables.SetElement) error) error {
+	return dumpExpiringElements(c, set, func(e nftables.SetElement, _ time.Duration) error {
+		return fn(e)
+	})
+}
+
+// dumpExpiringElements requests the dump of the set's elements, fn receives every element along with
+// the time left before the element expires, 0 for elements which do not expire.
+func dumpExpiringElements(c *nftables.Conn, set *nftables.Set, fn func(nftables.SetElement, time.Duration) error) error {
+	data, err := netlink.MarshalAttributes([]netlink.Attribute{
+		{Type: unix.NFTA_SET_TABLE, Data: []byte(set.Table.Name + "\x00")},
+		{Type: unix.NFTA_SET_NAME, Data: []byte(set.Name + "\x00")},
+	})
+	if err != nil {
+		return err
+	}
+	msg := netlink.Message{
+		Header: netlink.Header{
+			Type:  netlink.HeaderType((unix.NFNL_SUBSYS_NFTABLES << 8) | unix.NFT_MSG_GETSETELEM),
+			Flags: netlink.Request | netlink.Acknowledge | netlink.Dump,
+		},
+		// nfgenmsg header: family, version and resource id
+		Data: append([]byte{uint8(set.Table.Family), unix.NFNETLINK_V0, 0, 0}, data...),
+	}
+
+	return dumpMessages(c, msg, func(b []byte) error {
+		return expiringElementsFromMessage(b, fn)
+	})
+}
+
+// elementsFromMessage decodes elements carried by a single NFT_MSG_NEWSETELEM message
+// and calls fn for each of them.
+func elementsFromMessage(b []byte, fn func(nftables.SetElement) error) error {
+	return expiringElementsFromMessage(b, func(e nftables.SetElement, _ time.Duration) error {
+		return fn(e)
+	})
+}
+
+// expiringElementsFromMessage decodes elements carried by a single NFT_MSG_NEWSETELEM message,
+// fn receives every element along with the time left before it expires.
+func expiringElementsFromMessage(b []byte, fn func(nftables.SetElement, time.Duration) error) error {
+	if len(b) < 4 {
+		return fmt.Errorf("short set elements message")
+	}
+	ad, err := netlink.NewAttributeDecoder(b[4:])
+	if err != nil {
+		return err
+	}
+	ad.ByteOrder = binary.BigEndian
+	for ad.Next() {
+		if ad.Type() != unix.NFTA_SET_ELEM_LIST_ELEMENTS {
+			continue
+		}
+		lad, err := netlink.NewAttributeDecoder(ad.Bytes())
+		if err != nil {
+			return err
+		}
+		lad.ByteOrder = binary.BigEndian
+		for lad.Next() {
+			if lad.Type() != unix.NFTA_LIST_ELEM {
+				continue
+			}
+			e, expires, err := decodeSetElement(lad.Bytes())
+			if err != nil {
+				return err
+			}
+			if err := fn(e, expires); err != nil {
+				return err
+			}
+		}
+		if err := lad.Err(); err != nil {
+			return err
+		}
+	}
+
+	return ad.Err()
+}
+
+// decodeSetElement decodes the element and the time left before it expires
+func decodeSetElement(b []byte) (nftables.SetElement, time.Duration, error) {
+	e := nftables.SetElement{}
+	var expires time.Duration
+	ad, err := netlink.NewAttributeDecoder(b)
+	if err != nil {
+		return e, 0, err
+	}
+	ad.ByteOrder = binary.BigEndian
+	for ad.Next() {
+		switch ad.Type() {
+		case unix.NFTA_SET_ELEM_KEY:
+			ad.Nested(func(nad *netlink.AttributeDecoder) error {
+				for nad.Next() {
+					if nad.Type() == unix.NFTA_DATA_VALUE {
+						e.Key = nad.Bytes()
+					}
+				}
+				return nil
+			})
+		case unix.NFTA_SET_ELEM_DATA:
+			ad.Nested(func(nad *netlink.AttributeDecoder) error {
+				for nad.Next() {
+					switch nad.Type() {
+					case unix.NFTA_DATA_VALUE:
+						e.Val = nad.Bytes()
+					case unix.NFTA_DATA_VERDICT:
+						e.VerdictData = &expr.Verdict{}
+						nad.Nested(func(vad *netlink.AttributeDecoder) error {
+							for vad.Next() {
+								switch vad.Type() {
+								case unix.NFTA_VERDICT_CODE:
+									e.VerdictData.Kind = expr.VerdictKind(int32(vad.Uint32()))
+								case unix.NFTA_VERDICT_CHAIN:
+									e.VerdictData.Chain = vad.String()
+								}
+							}
+							return nil
+						})
+					}
+				}
+				return nil
+			})
+		case unix.NFTA_SET_ELEM_FLAGS:
+			e.IntervalEnd = ad.Uint32()&unix.NFT_SET_ELEM_INTERVAL_END != 0
+		case unix.NFTA_SET_ELEM_TIMEOUT:
+			e.Timeout = time.Millisecond * time.Duration(ad.Uint64())
+		case unix.NFTA_SET_ELEM_EXPIRATION:
+			expires = time.Millisecond * time.Duration(ad.Uint64())
+		}
+	}
+
+	return e, expires, ad.Err()
+}
+
+// decodeElement renders the element's key and value according to the set's datatypes
+func decodeElement(set *nftables.Set, e nftables.SetElement) *DecodedElement {
+	de := &DecodedElement{
+		Key:         decodeElementData(set.KeyType, e.Key),
+		IntervalEnd: e.IntervalEnd,
+		Timeout:     e.Timeout,
+		Verdict:     e.VerdictData,
+		Action:      elementVerdict(e.VerdictData),
+	}
+	if len(e.Val) != 0 {
+		de.Val = decodeElementData(set.DataType, e.Val)
+	}
+
+	return de
+}
+
+// decodeElementData splits the data according to the datatype, concatenated datatypes
+// occupy 4 bytes aligned fields.
+func decodeElementData(dt nftables.SetDatatype, b []byte) []string {
+	types := splitSetDatatype(dt.GetNFTMagic())
+	if len(types) <= 1 {
+		return []string{renderElementData(dt.GetNFTMagic(), b)}
+	}
+	values := make([]string, 0, len(types))
+	for _, t := range types {
+		l := int(t.Bytes)
+		if l > len(b) {
+			l = len(b)
+		}
+		values = append(values, renderElementData(t.GetNFTMagic(), b[:l]))
+		if l = (l + 3) &^ 3; l > len(b) {
+			l = len(b)
+		}
+		b = b[l:]
+	}
+
+	return values
+}
+
+func renderElementData(magic uint32, b []byte) string {
+	switch {
+	case magic == nftables.TypeIPAddr.GetNFTMagic() && len(b) >= 4:
+		return net.IP(b[:4]).String()
+	case magic == nftables.TypeIP6Addr.GetNFTMagic() && len(b) >= 16:
+		return net.IP(b[:16]).String()
+	case magic == nftables.TypeInetService.GetNFTMagic() && len(b) >= 2:
+		return fmt.Sprintf("%d", binary.BigEndian.Uint16(b[:2]))
+	case (magic == nftables.TypeInetProto.GetNFTMagic() || magic == TypeICMPType.GetNFTMagic() || magic == TypeICMPv6Type.GetNFTMagic()) && len(b) >= 1:
+		return fmt.Sprintf("%d", b[0])
+	case magic == nftables.TypeEtherAddr.GetNFTMagic() && len(b) >= 6:
+		return net.HardwareAddr(b[:6]).String()
+	case magic == TypeIFName.GetNFTMagic():
+		return ifNameFromKey(b)
+	case (magic == nftables.TypeMark.GetNFTMagic() || magic == nftables.TypeInteger.GetNFTMagic()) && len(b) >= 4:
+		return fmt.Sprintf("%d", binaryutil.NativeEndian.Uint32(b[:4]))
+	}
+
+	return fmt.Sprintf("%x", b)
+}
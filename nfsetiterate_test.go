@@ -0,0 +1,196 @@
+package nftableslib
+
+import (
+	"reflect"
+	"runtime"
+	"testing"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
+)
+
+func setupIterateSet(tb testing.TB, n int) (TablesInterface, SetsInterface) {
+	nft := InitNFTables(InitConn())
+	if err := nft.Tables().CreateImm("iterate", nftables.TableFamilyIPv4); err != nil {
+		tb.Skipf("failed to create table iterate with error: %+v", err)
+	}
+	si, err := nft.Tables().TableSets("iterate", nftables.TableFamilyIPv4)
+	if err != nil {
+		tb.Fatalf("failed to get sets interface for table iterate")
+	}
+	if _, err := si.Sets().CreateSet(&SetAttributes{
+		Name:    "addresses",
+		KeyType: nftables.TypeIPAddr,
+	}, nil); err != nil {
+		tb.Fatalf("failed to create set addresses with error: %+v", err)
+	}
+	for i := 0; i < n; i += 10000 {
+		se := make([]nftables.SetElement, 0, 10000)
+		for j := i; j < i+10000 && j < n; j++ {
+			se = append(se, nftables.SetElement{Key: []byte{10, byte(j >> 16), byte(j >> 8), byte(j)}})
+		}
+		if err := si.Sets().SetAddElementsBatch("addresses", se); err != nil {
+			tb.Fatalf("failed to add elements with error: %+v", err)
+		}
+	}
+	return nft, si
+}
+
+func TestIterateSetElements(t *testing.T) {
+	nft, si := setupIterateSet(t, 5000)
+	defer nft.Tables().DeleteImm("iterate", nftables.TableFamilyIPv4)
+
+	count := 0
+	if err := si.Sets().IterateSetElements("addresses", func(e nftables.SetElement) error {
+		if len(e.Key) != 4 || e.Key[0] != 10 {
+			t.Errorf("unexpected element key: %v", e.Key)
+		}
+		count++
+		return nil
+	}); err != nil {
+		t.Fatalf("failed to iterate elements with error: %+v", err)
+	}
+	if count != 5000 {
+		t.Fatalf("expected 5000 elements, got %d", count)
+	}
+	count = 0
+	if err := si.Sets().IterateSetElementsDecoded("addresses", func(e *DecodedElement) error {
+		count++
+		if count == 100 {
+			return ErrStopIteration
+		}
+		return nil
+	}); err != nil {
+		t.Fatalf("failed to iterate elements with error: %+v", err)
+	}
+	if count != 100 {
+		t.Fatalf("expected iteration to stop after 100 elements, got %d", count)
+	}
+}
+
+func TestDecodeVMapElements(t *testing.T) {
+	var batch []netlink.Message
+	conn := &nftables.Conn{TestDial: func(req []netlink.Message) ([]netlink.Message, error) {
+		batch = append(batch, req...)
+		return nil, nil
+	}}
+	table := &nftables.Table{Name: "filter", Family: nftables.TableFamilyIPv4}
+	set := &nftables.Set{Name: "services", Table: table, IsMap: true, KeyType: nftables.TypeInetService, DataType: nftables.TypeVerdict}
+	elements := []nftables.SetElement{
+		{Key: binaryutil.BigEndian.PutUint16(80), VerdictData: &expr.Verdict{Kind: expr.VerdictJump, Chain: "web"}},
+		{Key: binaryutil.BigEndian.PutUint16(22), VerdictData: &expr.Verdict{Kind: expr.VerdictGoto, Chain: "ssh"}},
+		{Key: binaryutil.BigEndian.PutUint16(23), VerdictData: &expr.Verdict{Kind: expr.VerdictDrop}},
+		{Key: binaryutil.BigEndian.PutUint16(53), VerdictData: &expr.Verdict{Kind: expr.VerdictAccept}},
+	}
+	// Requests number elements of the list while dumps carry NFTA_LIST_ELEM, an element per request
+	// makes the request look like a dump.
+	for _, e := range elements {
+		if err := conn.SetAddElements(set, []nftables.SetElement{e}); err != nil {
+			t.Fatalf("failed to add element with error: %+v", err)
+		}
+	}
+	if err := conn.Flush(); err != nil {
+		t.Fatalf("failed to flush with error: %+v", err)
+	}
+	decoded := make([]*DecodedElement, 0, len(elements))
+	for _, m := range batch {
+		if m.Header.Type != netlink.HeaderType((unix.NFNL_SUBSYS_NFTABLES<<8)|unix.NFT_MSG_NEWSETELEM) {
+			continue
+		}
+		// Elements are encoded the same way in requests and in dumps
+		if err := elementsFromMessage(m.Data, func(e nftables.SetElement) error {
+			decoded = append(decoded, decodeElement(set, e))
+			return nil
+		}); err != nil {
+			t.Fatalf("failed to decode elements with error: %+v", err)
+		}
+	}
+	tests := []struct {
+		key     string
+		verdict ElementVerdict
+		str     string
+	}{
+		{key: "80", verdict: ElementVerdict{Kind: unix.NFT_JUMP, Chain: "web"}, str: "jump web"},
+		{key: "22", verdict: ElementVerdict{Kind: unix.NFT_GOTO, Chain: "ssh"}, str: "goto ssh"},
+		{key: "23", verdict: ElementVerdict{Kind: NFT_DROP}, str: "drop"},
+		{key: "53", verdict: ElementVerdict{Kind: NFT_ACCEPT}, str: "accept"},
+	}
+	if len(decoded) != len(tests) {
+		t.Fatalf("expected %d decoded elements, got %d", len(tests), len(decoded))
+	}
+	for i, tt := range tests {
+		e := decoded[i]
+		if !reflect.DeepEqual(e.Key, []string{tt.key}) {
+			t.Errorf("element %d: expected key %s, got %v", i, tt.key, e.Key)
+			continue
+		}
+		if e.Action == nil || *e.Action != tt.verdict {
+			t.Errorf("element %s: expected verdict %+v, got %+v", tt.key, tt.verdict, e.Action)
+			continue
+		}
+		if s := e.Action.String(); s != tt.str {
+			t.Errorf("element %s: expected verdict %q, got %q", tt.key, tt.str, s)
+		}
+		ra, err := e.Action.Action()
+		if err != nil {
+			t.Errorf("element %s: failed to build rule action with error: %+v", tt.key, err)
+			continue
+		}
+		if !reflect.DeepEqual(ra.verdict, elements[i].VerdictData) {
+			t.Errorf("element %s: expected rule action verdict %+v, got %+v", tt.key, *elements[i].VerdictData, *ra.verdict)
+		}
+	}
+}
+
+func heapInUse() uint64 {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	return ms.HeapInuse
+}
+
+func BenchmarkGetSetElements1M(b *testing.B) {
+	nft, si := setupIterateSet(b, 1000000)
+	defer nft.Tables().DeleteImm("iterate", nftables.TableFamilyIPv4)
+	b.ResetTimer()
+	var peak uint64
+	for i := 0; i < b.N; i++ {
+		runtime.GC()
+		base := heapInUse()
+		elements, err := si.Sets().GetSetElements("addresses")
+		if err != nil {
+			b.Fatalf("failed to get elements with error: %+v", err)
+		}
+		if h := heapInUse() - base; h > peak {
+			peak = h
+		}
+		runtime.KeepAlive(elements)
+	}
+	b.ReportMetric(float64(peak)/(1<<20), "peak-MiB")
+}
+
+func BenchmarkIterateSetElements1M(b *testing.B) {
+	nft, si := setupIterateSet(b, 1000000)
+	defer nft.Tables().DeleteImm("iterate", nftables.TableFamilyIPv4)
+	b.ResetTimer()
+	var peak uint64
+	for i := 0; i < b.N; i++ {
+		runtime.GC()
+		base := heapInUse()
+		count := 0
+		if err := si.Sets().IterateSetElements("addresses", func(e nftables.SetElement) error {
+			count++
+			if count%100000 == 0 {
+				if h := heapInUse() - base; h > peak {
+					peak = h
+				}
+			}
+			return nil
+		}); err != nil {
+			b.Fatalf("failed to iterate elements with error: %+v", err)
+		}
+	}
+	b.ReportMetric(float64(peak)/(1<<20), "peak-MiB")
+}
@@ -0,0 +1,172 @@
+package nftableslib
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+)
+
+// SetInfo describes a set of the table programmed on the host, it is returned by Sets().List.
+type SetInfo struct {
+	Name      string
+	Anonymous bool
+	// Generated is true for constant sets the library creates for lists and ranges of rules' matches
+	Generated bool
+	Constant  bool
+	Interval  bool
+	IsMap     bool
+	KeyType   nftables.SetDatatype
+	DataType  nftables.SetDatatype
+	// Elements is the number of elements, ends of intervals are not counted
+	Elements int
+	// BoundRules carries handles of rules of the table which look up or update the set
+	BoundRules []uint64
+	// Use is the number of expressions of rules of the table binding the set, the kernel counts
+	// the same bindings but does not report them, a rule can bind the set more than once.
+	Use uint32
+	// Stored is true if the set is kept in the library's store, anonymous sets never are
+	Stored bool
+}
+
+// Bound returns true if at least one rule of the table refers to the set
+func (s *SetInfo) Bound() bool {
+	return len(s.BoundRules) != 0
+}
+
+// List returns all sets of the table programmed on the host, including anonymous sets created for
+// rules' lists and ranges, along with the number of their elements and rules referring to them.
+// Elements are counted while the dump is received, they are not kept in memory.
+func (nfs *nfSets) List() ([]*SetInfo, error) {
+	sets, err := getSets(nfs.conn, nfs.table)
+	if err != nil {
+		return nil, err
+	}
+	bindings, uses, err := nfs.bindings()
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]*SetInfo, 0, len(sets))
+	for _, set := range sets {
+		decodeSet(set)
+		_, stored := nfs.get(set.Name)
+		info := &SetInfo{
+			Name:       set.Name,
+			Anonymous:  set.Anonymous,
+			Generated:  set.Constant && isGeneratedSetName(set.Name),
+			Constant:   set.Constant,
+			Interval:   set.Interval,
+			IsMap:      set.IsMap,
+			KeyType:    set.KeyType,
+			DataType:   set.DataType,
+			BoundRules: bindings[set.Name],
+			Use:        uses[set.Name],
+			Stored:     stored,
+		}
+		if err := iterateSetElements(nfs.conn, set, func(e nftables.SetElement) error {
+			if !e.IntervalEnd {
+				info.Elements++
+			}
+			return nil
+		}); err != nil {
+			return nil, fmt.Errorf("failed to count elements of set %s with error: %+v", set.Name, err)
+		}
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Name < infos[j].Name
+	})
+
+	return infos, nil
+}
+
+// DeleteUnbound deletes anonymous and generated sets of the table which no rule refers to, such sets are
+// left behind when rules are removed without their sets. Other named sets are kept, they can be referred
+// to by rules created later. Names of deleted sets are returned.
+func (nfs *nfSets) DeleteUnbound() ([]string, error) {
+	if err := writable(nfs.conn); err != nil {
+		return nil, err
+	}
+	infos, err := nfs.List()
+	if err != nil {
+		return nil, err
+	}
+	deleted := make([]string, 0)
+	for _, info := range infos {
+		if !(info.Anonymous || info.Generated) || info.Bound() {
+			continue
+		}
+		nfs.conn.DelSet(&nftables.Set{Table: nfs.table, Name: info.Name})
+		deleted = append(deleted, info.Name)
+	}
+	if len(deleted) == 0 {
+		return deleted, nil
+	}
+	if err := flush(nfs.conn); err != nil {
+		return nil, err
+	}
+
+	return deleted, nil
+}
+
+// bindings returns handles of rules of the table referring to sets and the number of expressions
+// binding the sets, both keyed by names of the sets.
+func (nfs *nfSets) bindings() (map[string][]uint64, map[string]uint32, error) {
+	var chains []*nftables.Chain
+	if err := nfs.opts.readPolicy().do(func() (err error) {
+		chains, err = nfs.conn.ListChains()
+		return err
+	}); err != nil {
+		return nil, nil, err
+	}
+	bindings := make(map[string][]uint64)
+	uses := make(map[string]uint32)
+	for _, c := range chains {
+		if c.Table.Name != nfs.table.Name || c.Table.Family != nfs.table.Family {
+			continue
+		}
+		var rules []*nftables.Rule
+		if err := nfs.opts.readPolicy().do(func() (err error) {
+			rules, err = nfs.conn.GetRule(nfs.table, c)
+			return err
+		}); err != nil {
+			return nil, nil, err
+		}
+		for _, r := range rules {
+			for _, e := range r.Exprs {
+				name := ""
+				switch e := e.(type) {
+				case *expr.Lookup:
+					name = e.SetName
+				case *expr.Dynset:
+					name = e.SetName
+				}
+				if name == "" {
+					continue
+				}
+				uses[name]++
+				// A rule can refer to the same set more than once
+				if h := bindings[name]; len(h) == 0 || h[len(h)-1] != r.Handle {
+					bindings[name] = append(h, r.Handle)
+				}
+			}
+		}
+	}
+
+	return bindings, uses, nil
+}
+
+// isGeneratedSetName returns true if the name has the format of names generated by getSetName
+func isGeneratedSetName(name string) bool {
+	if len(name) != 12 {
+		return false
+	}
+	for _, c := range name {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,197 @@
+package nftableslib
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/google/nftables"
+)
+
+// ResilientBatchOptions defines how SetAddElementsResilient programs elements
+type ResilientBatchOptions struct {
+	// ChunkSize defines the number of elements carried by a single netlink message,
+	// DefaultElementsChunkSize is used if it is 0.
+	ChunkSize int
+	// CommitGood keeps elements accepted by the kernel when some elements are rejected, otherwise
+	// elements programmed while looking for rejected elements are removed again.
+	CommitGood bool
+}
+
+// RejectedElement describes an element rejected by the kernel, Index is the position of the element
+// in elements passed to SetAddElementsResilient and Err is the error returned by the kernel.
+type RejectedElement struct {
+	Index   int
+	Element nftables.SetElement
+	Decoded *DecodedElement
+	Err     error
+}
+
+// ErrRejectedElements is returned by SetAddElementsResilient when the kernel rejected some elements,
+// Committed is the number of elements left programmed, it is 0 unless CommitGood is set.
+type ErrRejectedElements struct {
+	Set       string
+	Rejected  []*RejectedElement
+	Committed int
+}
+
+func (e *ErrRejectedElements) Error() string {
+	r := e.Rejected[0]
+	return fmt.Sprintf("%d elements of set %s were rejected, element %d %s failed with error: %+v",
+		len(e.Rejected), e.Set, r.Index, strings.Join(r.Decoded.Key, concatSeparator), r.Err)
+}
+
+func (e *ErrRejectedElements) Unwrap() error {
+	return e.Rejected[0].Err
+}
+
+// elementUnit carries elements programmed or rejected together, an element of an interval set is
+// programmed with the element closing the interval.
+type elementUnit struct {
+	// index is the position of the first element in elements passed by the caller
+	index    int
+	count    int
+	elements []nftables.SetElement
+}
+
+func elementUnits(elements []nftables.SetElement, interval bool) []*elementUnit {
+	units := make([]*elementUnit, 0, len(elements))
+	for i := 0; i < len(elements); i++ {
+		u := &elementUnit{index: i, count: 1, elements: elements[i : i+1]}
+		if interval {
+			if !elements[i].IntervalEnd && i+1 < len(elements) && elements[i+1].IntervalEnd {
+				u.count = 2
+				i++
+			}
+			u.elements = buildIntervalElements(elements[u.index : u.index+u.count])
+		}
+		units = append(units, u)
+	}
+
+	return units
+}
+
+// bisection programs units of elements, a transaction rejected by the kernel is split in halves
+// programmed by separate transactions until the rejected elements are found.
+type bisection struct {
+	nfs       *nfSets
+	set       *nftables.Set
+	chunkSize int
+	committed []*elementUnit
+	rejected  []*RejectedElement
+}
+
+func (b *bisection) program(units []*elementUnit) error {
+	if len(units) == 0 {
+		return nil
+	}
+	elements := make([]nftables.SetElement, 0, len(units))
+	size := 0
+	for _, u := range units {
+		elements = append(elements, u.elements...)
+		for _, e := range u.elements {
+			size += elementSize(e)
+		}
+	}
+	// Units exceeding a transaction are split without trying
+	if size <= maxBatchBytes || len(units) == 1 {
+		for _, chunk := range chunkElements(elements, b.set.Interval, b.chunkSize) {
+			if err := b.nfs.conn.SetAddElements(b.set, chunk); err != nil {
+				return err
+			}
+		}
+		err := flush(b.nfs.conn)
+		if err == nil {
+			b.committed = append(b.committed, units...)
+			return nil
+		}
+		if len(units) == 1 {
+			var be *BatchError
+			if errors.As(err, &be) {
+				err = be.Err
+			}
+			u := units[0]
+			b.rejected = append(b.rejected, &RejectedElement{
+				Index:   u.index,
+				Element: u.elements[0],
+				Decoded: decodeElement(b.set, u.elements[0]),
+				Err:     err,
+			})
+			return nil
+		}
+	}
+	mid := len(units) / 2
+	if err := b.program(units[:mid]); err != nil {
+		return err
+	}
+
+	return b.program(units[mid:])
+}
+
+// SetAddElementsResilient adds elements to the set the same way SetAddElementsBatch does, but when the kernel
+// rejects a transaction, its elements are bisected to find rejected elements, ErrRejectedElements reports them.
+// Operations queued before the call are programmed first by their own transaction, so transactions of
+// elements carry nothing else. Unless CommitGood is set, elements programmed while bisecting are removed
+// when some elements are rejected, elements the set carried before the call are kept.
+func (nfs *nfSets) SetAddElementsResilient(name string, elements []nftables.SetElement, opts *ResilientBatchOptions) error {
+	if err := writable(nfs.conn); err != nil {
+		return err
+	}
+	if !nfs.Exist(name) {
+		return fmt.Errorf("set %s does not exist", name)
+	}
+	set, _ := nfs.get(name)
+	if err := validateElements(set, elements); err != nil {
+		return err
+	}
+	if opts == nil {
+		opts = &ResilientBatchOptions{}
+	}
+	if err := flush(nfs.conn); err != nil {
+		return err
+	}
+	var before map[string]bool
+	if !opts.CommitGood {
+		current, err := nfs.conn.GetSetElements(set)
+		if err != nil {
+			return fmt.Errorf("failed to get elements of set %s with error: %+v", set.Name, err)
+		}
+		before = make(map[string]bool, len(current))
+		for _, e := range current {
+			before[fmt.Sprintf("%t:%x", e.IntervalEnd, e.Key)] = true
+		}
+	}
+	b := &bisection{nfs: nfs, set: set, chunkSize: opts.ChunkSize}
+	if err := b.program(elementUnits(elements, set.Interval)); err != nil {
+		return err
+	}
+	if len(b.rejected) == 0 {
+		return nil
+	}
+	re := &ErrRejectedElements{Set: set.Name, Rejected: b.rejected}
+	if opts.CommitGood {
+		for _, u := range b.committed {
+			re.Committed += u.count
+		}
+		return re
+	}
+	del := make([]nftables.SetElement, 0)
+	for _, u := range b.committed {
+		for _, e := range u.elements {
+			if !before[fmt.Sprintf("%t:%x", e.IntervalEnd, e.Key)] {
+				del = append(del, nftables.SetElement{Key: e.Key, IntervalEnd: e.IntervalEnd})
+			}
+		}
+	}
+	if len(del) == 0 {
+		return re
+	}
+	if set.Interval {
+		sortIntervalElements(del)
+	}
+	if err := nfs.batchElements(set, chunkElements(del, set.Interval, opts.ChunkSize), nfs.conn.SetDeleteElements); err != nil {
+		return fmt.Errorf("failed to remove elements of set %s programmed while looking for rejected elements with error: %+v", set.Name, err)
+	}
+
+	return re
+}
@@ -1,9 +1,12 @@
 package nftableslib
 
 import (
+	"bytes"
 	"fmt"
-	"math/rand"
+	"io"
 	"net"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
@@ -42,7 +45,8 @@ type ElementValue struct {
 	Mark        *uint32
 }
 
-// SetsInterface defines third level interface operating with nf maps
+// SetsInterface defines third level interface operating with nf maps, it is safe for concurrent use.
+// The store of sets is locked only while it is changed, the host is read and programmed without the lock.
 type SetsInterface interface {
 	Sets() SetFuncs
 }
@@ -56,14 +60,31 @@ type SetFuncs interface {
 	GetSetElements(string) ([]nftables.SetElement, error)
 	SetAddElements(string, []nftables.SetElement) error
 	SetDelElements(string, []nftables.SetElement) error
+	SetReplaceElements(string, []nftables.SetElement) error
+	SetAddElementsBatch(string, []nftables.SetElement, ...int) error
+	SetDelElementsBatch(string, []nftables.SetElement, ...int) error
+	SetAddElementsResilient(string, []nftables.SetElement, *ResilientBatchOptions) error
+	IterateSetElements(string, func(nftables.SetElement) error) error
+	IterateSetElementsDecoded(string, func(*DecodedElement) error) error
+	VMapEntries(string) (map[string]string, error)
+	List() ([]*SetInfo, error)
+	DeleteUnbound() ([]string, error)
+	DumpSet(string) ([]byte, error)
+	RestoreSet([]byte) (int, error)
+	ExportSetElements(string, SetElementsFormat) ([]byte, error)
+	ImportSetElements(string, io.Reader, SetElementsFormat, bool) (int, error)
 	Sync() error
 }
 
 type nfSets struct {
 	conn  NetNS
 	table *nftables.Table
+	opts  *tableOptions
 	sync.Mutex
 	sets map[string]*nftables.Set
+	// discovered carries sets added to the store by Sync, SetAddElements closes intervals
+	// of their elements which are not followed by the interval end
+	discovered map[*nftables.Set]bool
 }
 
 // Sets return a list of methods available for Sets operations
@@ -72,8 +93,37 @@ func (nfs *nfSets) Sets() SetFuncs {
 }
 
 func (nfs *nfSets) CreateSet(attrs *SetAttributes, elements []nftables.SetElement) (*nftables.Set, error) {
+	if err := writable(nfs.conn); err != nil {
+		return nil, err
+	}
+	s, err := nfs.create(attrs, elements)
+	if err != nil {
+		return nil, err
+	}
+	// Requesting Netfilter to programm it.
+	if err := flush(nfs.conn); err != nil {
+		return nil, err
+	}
+	nfs.store(s)
+
+	return s, nil
+}
+
+// create validates attributes and elements of the set and queues its creation, the set is not stored
+func (nfs *nfSets) create(attrs *SetAttributes, elements []nftables.SetElement) (*nftables.Set, error) {
 	var err error
-	// TODO Add parameters validation
+	if err := validateSetAttributes(attrs); err != nil {
+		return nil, err
+	}
+	if attrs.Interval && len(splitSetDatatype(attrs.KeyType.GetNFTMagic())) > 1 {
+		features, err := nfs.opts.kernelFeatures()
+		if err != nil {
+			return nil, err
+		}
+		if !features.ConcatInterval {
+			return nil, &ErrUnsupportedByKernel{Feature: FeatureConcatInterval}
+		}
+	}
 	se := []nftables.SetElement{}
 	if attrs.Interval {
 		if attrs.KeyType == nftables.TypeIPAddr || attrs.KeyType == nftables.TypeIP6Addr {
@@ -86,7 +136,7 @@ func (nfs *nfSets) CreateSet(attrs *SetAttributes, elements []nftables.SetElemen
 	}
 	s := &nftables.Set{
 		Table:      nfs.table,
-		ID:         uint32(rand.Intn(0xffff)),
+		ID:         nfs.opts.idGenerator().SetID(),
 		Name:       attrs.Name,
 		Anonymous:  false,
 		Constant:   attrs.Constant,
@@ -100,32 +150,32 @@ func (nfs *nfSets) CreateSet(attrs *SetAttributes, elements []nftables.SetElemen
 		// Netlink expects timeout in milliseconds
 		s.Timeout = attrs.Timeout
 	}
+	if err := validateElements(s, elements); err != nil {
+		return nil, err
+	}
 	// Adding elements to new Set if any provided
 	se = append(se, elements...)
 	if err = nfs.conn.AddSet(s, elements); err != nil {
 		return nil, err
 	}
-	// Requesting Netfilter to programm it.
-	if err := nfs.conn.Flush(); err != nil {
-		return nil, err
-	}
-	nfs.Lock()
-	defer nfs.Unlock()
-	nfs.sets[attrs.Name] = s
 
 	return s, nil
 }
 
+// store adds the set to the store
+func (nfs *nfSets) store(s *nftables.Set) {
+	nfs.Lock()
+	defer nfs.Unlock()
+	nfs.sets[s.Name] = s
+}
+
 // Exist check if the set with name exists in the store and programmed on the host,
 // if both checks succeed, true is returned, otherwise false is returned.
 func (nfs *nfSets) Exist(name string) bool {
-	nfs.Lock()
-	_, ok := nfs.sets[name]
-	nfs.Unlock()
-	if !ok {
+	if _, ok := nfs.get(name); !ok {
 		return false
 	}
-	_, err := nfs.conn.GetSetByName(nfs.table, name)
+	_, err := getSetByName(nfs.conn, nfs.table, name)
 	if err != nil {
 		return false
 	}
@@ -133,97 +183,580 @@ func (nfs *nfSets) Exist(name string) bool {
 	return true
 }
 
-func (nfs *nfSets) GetSetByName(name string) (*nftables.Set, error) {
+// get returns the set from the store
+func (nfs *nfSets) get(name string) (*nftables.Set, bool) {
 	nfs.Lock()
-	_, ok := nfs.sets[name]
-	nfs.Unlock()
+	defer nfs.Unlock()
+	s, ok := nfs.sets[name]
+
+	return s, ok
+}
+
+func (nfs *nfSets) GetSetByName(name string) (*nftables.Set, error) {
+	stored, ok := nfs.get(name)
 	if !ok {
-		return nil, fmt.Errorf("set %s is not found", name)
+		return nil, fmt.Errorf("set %s is not found in table %s", name, tableName(nfs.table))
 	}
-	s, err := nfs.conn.GetSetByName(nfs.table, name)
+	s, err := getSetByName(nfs.conn, nfs.table, name)
 	if err != nil {
-		return nil, fmt.Errorf("set %s is not found", name)
+		return nil, fmt.Errorf("set %s is not found in table %s", name, tableName(nfs.table))
+	}
+	decodeSet(s)
+	// Key type of verdict maps is not reported by the host, using the stored one
+	if s.KeyType.GetNFTMagic() == 0 {
+		s.KeyType = stored.KeyType
 	}
 
 	return s, nil
 }
 
 func (nfs *nfSets) DelSet(name string) error {
+	if err := writable(nfs.conn); err != nil {
+		return err
+	}
 	if nfs.Exist(name) {
-		nfs.conn.DelSet(nfs.sets[name])
-		if err := nfs.conn.Flush(); err != nil {
+		set, _ := nfs.get(name)
+		nfs.conn.DelSet(set)
+		if err := flush(nfs.conn); err != nil {
 			return err
 		}
 		nfs.Lock()
 		defer nfs.Unlock()
-		delete(nfs.sets, name)
+		nfs.forget(name)
 	}
 
 	return nil
 }
 
+// forget removes the set from the store, the lock of the store must be held
+func (nfs *nfSets) forget(name string) {
+	delete(nfs.discovered, nfs.sets[name])
+	delete(nfs.sets, name)
+}
+
 // GetSets returns a slice programmed on the host for a specific table.
 func (nfs *nfSets) GetSets() ([]*nftables.Set, error) {
-	return nfs.conn.GetSets(nfs.table)
+	sets, err := getSets(nfs.conn, nfs.table)
+	if err != nil {
+		return nil, err
+	}
+	for _, set := range sets {
+		decodeSet(set)
+	}
+
+	return sets, nil
 }
 
+// GetSetElements returns elements of the set, interrupted dumps are read again according to
+// the table's read policy, so a partial list of elements is never returned.
 func (nfs *nfSets) GetSetElements(name string) ([]nftables.SetElement, error) {
-	if nfs.Exist(name) {
-		return nfs.conn.GetSetElements(nfs.sets[name])
+	if !nfs.Exist(name) {
+		return nil, fmt.Errorf("set %s does not exist in table %s", name, tableName(nfs.table))
 	}
-	return nil, fmt.Errorf("set %s does not exist", name)
+	set, _ := nfs.get(name)
+	var elements []nftables.SetElement
+	err := nfs.opts.readPolicy().do(func() (err error) {
+		elements, err = getSetElements(nfs.conn, set)
+		return err
+	})
+
+	return elements, err
 }
 
 func (nfs *nfSets) SetAddElements(name string, elements []nftables.SetElement) error {
+	if err := writable(nfs.conn); err != nil {
+		return err
+	}
 	if nfs.Exist(name) {
-		if err := nfs.conn.SetAddElements(nfs.sets[name], elements); err != nil {
+		set, _ := nfs.get(name)
+		nfs.Lock()
+		discovered := nfs.discovered[set]
+		nfs.Unlock()
+		if err := nfs.addElements(set, elements, discovered); err != nil {
 			return err
 		}
-		if err := nfs.conn.Flush(); err != nil {
+		if err := flush(nfs.conn); err != nil {
 			return err
 		}
 		return nil
 	}
 
-	return fmt.Errorf("set %s does not exist", name)
+	return fmt.Errorf("set %s does not exist in table %s", name, tableName(nfs.table))
 }
 
 func (nfs *nfSets) SetDelElements(name string, elements []nftables.SetElement) error {
+	if err := writable(nfs.conn); err != nil {
+		return err
+	}
 	if nfs.Exist(name) {
-		set := nfs.sets[name]
+		set, _ := nfs.get(name)
 		if err := nfs.conn.SetDeleteElements(set, elements); err != nil {
 			return err
 		}
-		if err := nfs.conn.Flush(); err != nil {
+		if err := flush(nfs.conn); err != nil {
 			return err
 		}
 		return nil
 	}
 
-	return fmt.Errorf("set %s does not exist", name)
+	return fmt.Errorf("set %s does not exist in table %s", name, tableName(nfs.table))
 }
 
-func (nfs *nfSets) Sync() error {
-	sets, err := nfs.conn.GetSets(nfs.table)
+// SetReplaceElements replaces all elements of the set with elements, current elements are removed and
+// elements are added by a single transaction, so the set is never observed partially updated. The number
+// of elements is limited by the size of a single transaction, unlike SetAddElementsBatch.
+func (nfs *nfSets) SetReplaceElements(name string, elements []nftables.SetElement) error {
+	if err := writable(nfs.conn); err != nil {
+		return err
+	}
+	if !nfs.Exist(name) {
+		return fmt.Errorf("set %s does not exist in table %s", name, tableName(nfs.table))
+	}
+	set, _ := nfs.get(name)
+	if err := nfs.replaceElements(set, elements); err != nil {
+		return err
+	}
+
+	return flush(nfs.conn)
+}
+
+// addElements validates elements and queues their addition to the set, if closeIntervals is true,
+// elements of an interval set which are not followed by the interval end are added as single value intervals.
+func (nfs *nfSets) addElements(set *nftables.Set, elements []nftables.SetElement, closeIntervals bool) error {
+	if err := validateElements(set, elements); err != nil {
+		return err
+	}
+	if set.Interval && closeIntervals {
+		elements = buildIntervalElements(elements)
+	}
+
+	return nfs.conn.SetAddElements(set, elements)
+}
+
+// replaceElements queues removal of current elements of the set and addition of elements
+func (nfs *nfSets) replaceElements(set *nftables.Set, elements []nftables.SetElement) error {
+	if err := validateElements(set, elements); err != nil {
+		return err
+	}
+	current, err := nfs.conn.GetSetElements(set)
 	if err != nil {
 		return err
 	}
+	if len(current) != 0 {
+		// Elements are removed by the key, data of verdict maps reported by the host is not decoded
+		// and cannot be sent back.
+		del := make([]nftables.SetElement, 0, len(current))
+		for _, e := range current {
+			del = append(del, nftables.SetElement{Key: e.Key, IntervalEnd: e.IntervalEnd})
+		}
+		if set.Interval {
+			// The host reports intervals in descending order, the kernel removes them only in ascending order
+			sortIntervalElements(del)
+		}
+		if err := nfs.conn.SetDeleteElements(set, del); err != nil {
+			return err
+		}
+	}
+	if set.Interval {
+		elements = buildIntervalElements(elements)
+	}
+	if len(elements) != 0 {
+		return nfs.conn.SetAddElements(set, elements)
+	}
+
+	return nil
+}
+
+// DefaultElementsChunkSize defines a number of elements carried by a single netlink message
+// when the elements are added or removed in a batch.
+const DefaultElementsChunkSize = 512
+
+// ErrElementsBatch is returned when a batch of elements failed to be programmed. Chunk is the index of
+// the chunk which failed to be queued, when the transaction carrying the chunks was rejected, Chunk is -1.
+// Committed is the number of leading chunks programmed by transactions committed before the failure,
+// the other chunks are not programmed.
+type ErrElementsBatch struct {
+	Set       string
+	Chunk     int
+	Chunks    int
+	Committed int
+	Err       error
+}
+
+func (e *ErrElementsBatch) Error() string {
+	if e.Chunk == -1 {
+		return fmt.Sprintf("failed to program chunks %d to %d of elements of set %s with error: %+v", e.Committed, e.Chunks-1, e.Set, e.Err)
+	}
+	return fmt.Sprintf("failed to queue chunk %d of %d of elements of set %s with error: %+v", e.Chunk, e.Chunks, e.Set, e.Err)
+}
+
+func (e *ErrElementsBatch) Unwrap() error {
+	return e.Err
+}
+
+// SetAddElementsBatch adds elements to the set, elements are split in chunks of chunkSize elements,
+// each chunk is sent in a separate netlink message and all chunks are programmed by a single Flush.
+// If chunkSize is not specified, DefaultElementsChunkSize is used. Batches exceeding maxBatchBytes
+// are programmed by consecutive transactions, each carrying as many chunks as fit maxBatchBytes.
+func (nfs *nfSets) SetAddElementsBatch(name string, elements []nftables.SetElement, chunkSize ...int) error {
+	if err := writable(nfs.conn); err != nil {
+		return err
+	}
+	if !nfs.Exist(name) {
+		return fmt.Errorf("set %s does not exist in table %s", name, tableName(nfs.table))
+	}
+	set, _ := nfs.get(name)
+	if err := validateElements(set, elements); err != nil {
+		return err
+	}
+	if set.Interval {
+		elements = buildIntervalElements(elements)
+	}
+
+	return nfs.batchElements(set, chunkElements(elements, set.Interval, chunkSize...), nfs.conn.SetAddElements)
+}
+
+// SetDelElementsBatch removes elements from the set, elements are split in chunks the same way
+// as by SetAddElementsBatch.
+func (nfs *nfSets) SetDelElementsBatch(name string, elements []nftables.SetElement, chunkSize ...int) error {
+	if err := writable(nfs.conn); err != nil {
+		return err
+	}
+	if !nfs.Exist(name) {
+		return fmt.Errorf("set %s does not exist in table %s", name, tableName(nfs.table))
+	}
+	set, _ := nfs.get(name)
+
+	return nfs.batchElements(set, chunkElements(elements, set.Interval, chunkSize...), nfs.conn.SetDeleteElements)
+}
+
+// maxBatchBytes defines the limit of encoded elements programmed by a single Flush, all messages
+// of a transaction are sent by one sendmsg call which cannot exceed the socket's send buffer,
+// by default 208KiB.
+const maxBatchBytes = 160 * 1024
+
+// batchElements queues chunks of elements with op and flushes them, chunks which do not fit a single
+// transaction are programmed by consecutive transactions. Operations queued on the connection before
+// are programmed by the first transaction.
+func (nfs *nfSets) batchElements(set *nftables.Set, chunks [][]nftables.SetElement,
+	op func(*nftables.Set, []nftables.SetElement) error) error {
+	committed, queued, size := 0, 0, 0
+	for i, chunk := range chunks {
+		chunkSize := 0
+		for _, e := range chunk {
+			chunkSize += elementSize(e)
+		}
+		if queued != 0 && size+chunkSize > maxBatchBytes {
+			if err := flush(nfs.conn); err != nil {
+				return &ErrElementsBatch{Set: set.Name, Chunk: -1, Chunks: len(chunks), Committed: committed, Err: err}
+			}
+			committed, queued, size = committed+queued, 0, 0
+		}
+		// Queueing fails for sets which cannot be updated, it happens on the first chunk
+		// before any messages are queued.
+		if err := op(set, chunk); err != nil {
+			return &ErrElementsBatch{Set: set.Name, Chunk: i, Chunks: len(chunks), Committed: committed, Err: err}
+		}
+		queued, size = queued+1, size+chunkSize
+	}
+	if err := flush(nfs.conn); err != nil {
+		return &ErrElementsBatch{Set: set.Name, Chunk: -1, Chunks: len(chunks), Committed: committed, Err: err}
+	}
+
+	return nil
+}
+
+// maxElementsChunkBytes defines the limit of encoded elements in a single chunk, netlink attribute
+// carrying the list of elements cannot exceed 64KiB.
+const maxElementsChunkBytes = 48 * 1024
+
+// chunkElements splits elements in chunks of chunkSize elements, a chunk is closed earlier if its
+// estimated encoded size reaches maxElementsChunkBytes. For interval sets an element and the element
+// closing the interval are kept in the same chunk.
+func chunkElements(elements []nftables.SetElement, interval bool, chunkSize ...int) [][]nftables.SetElement {
+	size := DefaultElementsChunkSize
+	if len(chunkSize) != 0 && chunkSize[0] > 0 {
+		size = chunkSize[0]
+	}
+	chunks := make([][]nftables.SetElement, 0, len(elements)/size+1)
+	start, bytes := 0, 0
+	for i := 0; i < len(elements); i++ {
+		bytes += elementSize(elements[i])
+		if i-start+1 < size && bytes < maxElementsChunkBytes {
+			continue
+		}
+		end := i + 1
+		if interval && end < len(elements) && elements[end].IntervalEnd {
+			end++
+			i++
+		}
+		chunks = append(chunks, elements[start:end])
+		start, bytes = end, 0
+	}
+	if start < len(elements) {
+		chunks = append(chunks, elements[start:])
+	}
+
+	return chunks
+}
+
+// elementSize returns the estimated size of the encoded element, every attribute carries 4 bytes header
+// and its data is aligned to 4 bytes.
+func elementSize(e nftables.SetElement) int {
+	align := func(l int) int { return (l + 3) &^ 3 }
+	// Element, flags, key and key's value attributes
+	size := 4 + 8 + 8 + 4 + align(len(e.Key))
+	if e.Timeout != 0 {
+		size += 12
+	}
+	switch {
+	case e.VerdictData != nil:
+		size += 4 + 8 + 4 + align(len(e.VerdictData.Chain)+1)
+	case len(e.Val) != 0:
+		size += 8 + align(len(e.Val))
+	}
+
+	return size
+}
+
+// ErrSetMismatch is returned by Sync when attributes of sets in the store do not match
+// attributes of the sets programmed on the host, the store keeps its own copy of such sets.
+type ErrSetMismatch struct {
+	// Mismatches carries a list of mismatched attributes per set name
+	Mismatches map[string][]string
+}
+
+func (e *ErrSetMismatch) Error() string {
+	names := make([]string, 0, len(e.Mismatches))
+	for name := range e.Mismatches {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	msg := "sets in the store do not match the host:"
+	for _, name := range names {
+		msg += fmt.Sprintf(" %s(%s)", name, strings.Join(e.Mismatches[name], ", "))
+	}
+	return msg
+}
+
+// Sync adds sets programmed on the host to the store, attributes of the discovered sets are
+// reconstructed from the host's data. For the sets already present in the store, the attributes are
+// compared and mismatches are reported by ErrSetMismatch.
+func (nfs *nfSets) Sync() error {
+	return nfs.sync(&SyncReport{}, false)
+}
+
+// sync adds discovered sets to the store and accounts them in the report, when prune is true,
+// sets which are not found on the host are removed from the store.
+func (nfs *nfSets) sync(report *SyncReport, prune bool) error {
+	var sets []*nftables.Set
+	if err := nfs.opts.readPolicy().do(func() (err error) {
+		sets, err = getSets(nfs.conn, nfs.table)
+		return err
+	}); err != nil {
+		return err
+	}
+	nfs.Lock()
+	defer nfs.Unlock()
+	onHost := make(map[string]bool)
+	mismatches := make(map[string][]string)
 	for _, set := range sets {
-		if _, ok := nfs.sets[set.Name]; !ok {
-			nfs.Lock()
-			nfs.sets[set.Name] = set
-			nfs.Lock()
+		onHost[set.Name] = true
+		set.Table = nfs.table
+		decodeSet(set)
+		if stored, ok := nfs.sets[set.Name]; ok {
+			if m := compareSets(stored, set); len(m) != 0 {
+				mismatches[set.Name] = m
+			}
+			continue
 		}
+		nfs.sets[set.Name] = set
+		nfs.discovered[set] = true
+		report.Added.Sets++
+	}
+	if prune {
+		for name := range nfs.sets {
+			if !onHost[name] {
+				nfs.forget(name)
+				report.Removed.Sets++
+			}
+		}
+	}
+	if len(mismatches) != 0 {
+		return &ErrSetMismatch{Mismatches: mismatches}
 	}
 
 	return nil
 }
 
-func newSets(conn NetNS, t *nftables.Table) SetsInterface {
+// knownSetDatatypes lists set datatypes which can be decoded from nft magic
+var knownSetDatatypes = []nftables.SetDatatype{
+	nftables.TypeVerdict,
+	nftables.TypeInteger,
+	nftables.TypeIPAddr,
+	nftables.TypeIP6Addr,
+	nftables.TypeEtherAddr,
+	nftables.TypeInetProto,
+	nftables.TypeInetService,
+	nftables.TypeMark,
+	TypeIFName,
+	TypeICMPType,
+	TypeICMPv6Type,
+}
+
+// splitSetDatatype returns datatypes encoded in nft magic, concatenated types are decomposed,
+// nil is returned if magic carries unknown datatypes.
+func splitSetDatatype(magic uint32) []nftables.SetDatatype {
+	types := make([]nftables.SetDatatype, 0)
+	for m := magic; m != 0; m >>= nftables.SetConcatTypeBits {
+		found := false
+		for _, t := range knownSetDatatypes {
+			if t.GetNFTMagic() == m&nftables.SetConcatTypeMask {
+				types = append([]nftables.SetDatatype{t}, types...)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil
+		}
+	}
+
+	return types
+}
+
+// decodeSetDatatype builds a set datatype from nft magic, concatenated types
+// are decomposed and combined by GenSetKeyType.
+func decodeSetDatatype(magic uint32) (nftables.SetDatatype, error) {
+	if magic == 0 {
+		return nftables.TypeInvalid, nil
+	}
+	types := splitSetDatatype(magic)
+	switch len(types) {
+	case 0:
+		return nftables.TypeInvalid, fmt.Errorf("unknown set datatype magic %#x", magic)
+	case 1:
+		return types[0], nil
+	}
+
+	return GenSetKeyType(types...), nil
+}
+
+// decodeSet reconstructs attributes of a set received from the host. github.com/google/nftables
+// populates only nft magic of the key type, it sets IsMap when the set is anonymous, HasTimeout when
+// the set is either anonymous, constant or a map, and it stores verdict data type as the key type.
+func decodeSet(set *nftables.Set) {
+	hasMapFlag := set.HasTimeout && !set.Anonymous && !set.Constant
+	keyMagic := set.KeyType.GetNFTMagic()
+	switch {
+	case keyMagic == nftables.TypeVerdict.GetNFTMagic() && set.DataType.GetNFTMagic() == 0:
+		// Data type is verdict, the key type is lost
+		set.DataType = nftables.TypeVerdict
+		set.KeyType = nftables.TypeInvalid
+	default:
+		if kt, err := decodeSetDatatype(keyMagic); err == nil {
+			set.KeyType = kt
+		}
+		if dt, err := decodeSetDatatype(set.DataType.GetNFTMagic()); err == nil {
+			set.DataType = dt
+		}
+	}
+	set.IsMap = set.DataType.GetNFTMagic() != 0 || hasMapFlag
+	set.HasTimeout = set.Timeout != 0
+}
+
+// compareSets returns a list of attributes which do not match between the set in the store
+// and the set decoded from the host.
+func compareSets(stored, host *nftables.Set) []string {
+	m := make([]string, 0)
+	// Key type of verdict maps cannot be decoded, skip it
+	if host.KeyType.GetNFTMagic() != 0 && stored.KeyType.GetNFTMagic() != host.KeyType.GetNFTMagic() {
+		m = append(m, fmt.Sprintf("key type: %s/%s", stored.KeyType.Name, host.KeyType.Name))
+	}
+	if stored.DataType.GetNFTMagic() != host.DataType.GetNFTMagic() {
+		m = append(m, fmt.Sprintf("data type: %s/%s", stored.DataType.Name, host.DataType.Name))
+	}
+	if stored.Interval != host.Interval {
+		m = append(m, fmt.Sprintf("interval: %t/%t", stored.Interval, host.Interval))
+	}
+	if stored.Constant != host.Constant {
+		m = append(m, fmt.Sprintf("constant: %t/%t", stored.Constant, host.Constant))
+	}
+	if stored.IsMap != host.IsMap {
+		m = append(m, fmt.Sprintf("map: %t/%t", stored.IsMap, host.IsMap))
+	}
+
+	return m
+}
+
+// buildIntervalElements makes sure that every element added to an interval set is followed by
+// the element closing the interval, elements which are not followed by the interval end
+// are treated as a single value interval. Like nft, no end is added after the maximum key,
+// the interval stays open to the end of the key space.
+func buildIntervalElements(elements []nftables.SetElement) []nftables.SetElement {
+	se := make([]nftables.SetElement, 0, len(elements)*2)
+	for i := 0; i < len(elements); i++ {
+		se = append(se, elements[i])
+		if elements[i].IntervalEnd {
+			continue
+		}
+		if i+1 < len(elements) && elements[i+1].IntervalEnd {
+			se = append(se, elements[i+1])
+			i++
+			continue
+		}
+		if isMaxKey(elements[i].Key) {
+			continue
+		}
+		se = append(se, nftables.SetElement{Key: nextKey(elements[i].Key), IntervalEnd: true})
+	}
+
+	return se
+}
+
+// sortIntervalElements sorts elements of an interval set by the key, the element closing an interval
+// goes before the element opening the next interval with the same key.
+func sortIntervalElements(elements []nftables.SetElement) {
+	sort.SliceStable(elements, func(i, j int) bool {
+		if c := bytes.Compare(elements[i].Key, elements[j].Key); c != 0 {
+			return c < 0
+		}
+		return elements[i].IntervalEnd && !elements[j].IntervalEnd
+	})
+}
+
+// isMaxKey returns true if the key is the maximum key, incrementing it wraps to zero
+func isMaxKey(key []byte) bool {
+	for _, b := range key {
+		if b != 0xff {
+			return false
+		}
+	}
+
+	return len(key) != 0
+}
+
+// nextKey returns the key incremented by 1
+func nextKey(key []byte) []byte {
+	r := make([]byte, len(key))
+	copy(r, key)
+	for i := len(r) - 1; i >= 0; i-- {
+		r[i]++
+		if r[i] != 0 {
+			break
+		}
+	}
+
+	return r
+}
+
+func newSets(conn NetNS, t *nftables.Table, opts *tableOptions) *nfSets {
 	return &nfSets{
-		conn:  conn,
-		table: t,
-		sets:  make(map[string]*nftables.Set),
+		conn:       conn,
+		table:      t,
+		opts:       opts,
+		sets:       make(map[string]*nftables.Set),
+		discovered: make(map[*nftables.Set]bool),
 	}
 }
 
@@ -237,8 +770,7 @@ func MakeElement(input *ElementValue) ([]nftables.SetElement, error) {
 		return nil, err
 	}
 
-	// TODO Figure out if overlapping and possibility of collapsing needs to be checked.
-	elements := buildElementRanges([]*IPAddr{addr})
+	elements, _ := buildElementRanges([]*IPAddr{addr})
 	p := &elements[0]
 	switch {
 	case input.AddrIP != nil:
@@ -1,9 +1,13 @@
 package nftableslib
 
 import (
+	"encoding/binary"
+	"reflect"
 	"testing"
 
 	"github.com/google/nftables"
+	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
 )
 
 func TestGenSetKeyType(t *testing.T) {
@@ -71,3 +75,157 @@ func TestGenSetKeyType(t *testing.T) {
 		}
 	}
 }
+
+func TestChunkElements(t *testing.T) {
+	elements := func(n int, interval bool) []nftables.SetElement {
+		se := make([]nftables.SetElement, 0)
+		for i := 0; i < n; i++ {
+			se = append(se, nftables.SetElement{Key: []byte{10, 0, byte(i >> 8), byte(i)}})
+			if interval {
+				se = append(se, nftables.SetElement{Key: []byte{10, 0, byte(i >> 8), byte(i + 1)}, IntervalEnd: true})
+			}
+		}
+		return se
+	}
+	tests := []struct {
+		name       string
+		elements   []nftables.SetElement
+		interval   bool
+		chunkSize  []int
+		wantChunks []int
+	}{
+		{
+			name:       "No elements",
+			elements:   nil,
+			wantChunks: []int{},
+		},
+		{
+			name:       "Default chunk size",
+			elements:   elements(DefaultElementsChunkSize+1, false),
+			wantChunks: []int{DefaultElementsChunkSize, 1},
+		},
+		{
+			name:       "Custom chunk size",
+			elements:   elements(10, false),
+			chunkSize:  []int{4},
+			wantChunks: []int{4, 4, 2},
+		},
+		{
+			name:       "Interval end is kept with its element",
+			elements:   elements(3, true),
+			interval:   true,
+			chunkSize:  []int{3},
+			wantChunks: []int{4, 2},
+		},
+		{
+			name: "Chunk is limited by size",
+			elements: []nftables.SetElement{
+				{Key: make([]byte, 4), Val: make([]byte, maxElementsChunkBytes)},
+				{Key: make([]byte, 4)},
+			},
+			wantChunks: []int{1, 1},
+		},
+	}
+	for _, tt := range tests {
+		chunks := chunkElements(tt.elements, tt.interval, tt.chunkSize...)
+		got := make([]int, 0)
+		total := 0
+		for _, c := range chunks {
+			got = append(got, len(c))
+			total += len(c)
+			if tt.interval && c[0].IntervalEnd {
+				t.Errorf("test \"%s\" failed, chunk starts with the interval end", tt.name)
+			}
+		}
+		if !reflect.DeepEqual(got, tt.wantChunks) {
+			t.Errorf("test \"%s\" failed, got chunks: %v want: %v", tt.name, got, tt.wantChunks)
+		}
+		if total != len(tt.elements) {
+			t.Errorf("test \"%s\" failed, chunks carry %d elements, expected %d", tt.name, total, len(tt.elements))
+		}
+	}
+}
+
+func TestMakeIfNameElements(t *testing.T) {
+	tests := []struct {
+		name    string
+		ifName  string
+		key     []byte
+		success bool
+	}{
+		{
+			name:    "Short name",
+			ifName:  "lo",
+			key:     []byte{'l', 'o', 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0},
+			success: true,
+		},
+		{
+			name:    "Name of 15 characters",
+			ifName:  "veth0123456789a",
+			key:     []byte{'v', 'e', 't', 'h', '0', '1', '2', '3', '4', '5', '6', '7', '8', '9', 'a', 0},
+			success: true,
+		},
+		{
+			name:    "Name of 16 characters",
+			ifName:  "veth0123456789ab",
+			success: false,
+		},
+		{
+			name:    "Empty name",
+			ifName:  "",
+			success: false,
+		},
+		{
+			name:    "Name with zero byte",
+			ifName:  "eth\x000",
+			success: false,
+		},
+	}
+	for _, tt := range tests {
+		elements, err := MakeIfNameElements(tt.ifName)
+		if err != nil && tt.success {
+			t.Fatalf("test \"%s\" failed with error: %+v but supposed to succeed", tt.name, err)
+		}
+		if err == nil && !tt.success {
+			t.Fatalf("test \"%s\" succeeded but supposed to fail", tt.name)
+		}
+		if !tt.success {
+			continue
+		}
+		if len(elements) != 1 || !reflect.DeepEqual(elements[0].Key, tt.key) {
+			t.Fatalf("test \"%s\" failed, expected key %v, got %+v", tt.name, tt.key, elements)
+		}
+		if len(elements[0].Key) != int(TypeIFName.Bytes) {
+			t.Fatalf("test \"%s\" failed, key of %d bytes does not match %d bytes of ifname", tt.name, len(elements[0].Key), TypeIFName.Bytes)
+		}
+		if n := ifNameFromKey(elements[0].Key); n != tt.ifName {
+			t.Fatalf("test \"%s\" failed, expected name %s decoded from the key, got %s", tt.name, tt.ifName, n)
+		}
+	}
+}
+
+func TestSetFromMessage(t *testing.T) {
+	u32 := func(v uint32) []byte {
+		b := make([]byte, 4)
+		binary.BigEndian.PutUint32(b, v)
+		return b
+	}
+	data, err := netlink.MarshalAttributes([]netlink.Attribute{
+		{Type: unix.NFTA_SET_TABLE, Data: []byte("filter\x00")},
+		{Type: unix.NFTA_SET_NAME, Data: []byte("pods\x00")},
+		{Type: unix.NFTA_SET_FLAGS, Data: u32(0)},
+		{Type: unix.NFTA_SET_KEY_TYPE, Data: u32(TypeIFName.GetNFTMagic())},
+		{Type: unix.NFTA_SET_KEY_LEN, Data: u32(IfNameLength)},
+	})
+	if err != nil {
+		t.Fatalf("failed to marshal attributes with error: %+v", err)
+	}
+	s, err := setFromMessage(append([]byte{uint8(nftables.TableFamilyINet), unix.NFNETLINK_V0, 0, 0}, data...))
+	if err != nil {
+		t.Fatalf("failed to decode set with error: %+v", err)
+	}
+	decodeSet(s)
+	if s.Name != "pods" || s.IsMap || s.HasTimeout || !reflect.DeepEqual(s.KeyType, TypeIFName) {
+		t.Fatalf("set of interface names is not decoded, got %+v", s)
+	}
+}
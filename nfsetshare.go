@@ -0,0 +1,171 @@
+package nftableslib
+
+import (
+	"fmt"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+)
+
+// ErrSetInOtherTable is returned when a rule refers to a set which is not defined in the table of the rule
+// but is defined in another table. Sets are scoped to their tables, CopySet copies a set to another table.
+type ErrSetInOtherTable struct {
+	Set string
+	// Table is the table of the rule
+	Table *nftables.Table
+	// SetTable is the table the set is defined in
+	SetTable *nftables.Table
+}
+
+func (e *ErrSetInOtherTable) Error() string {
+	return fmt.Sprintf("rule of %s table %s refers to set %s defined in %s table %s, sets cannot be shared between tables",
+		familyName(e.Table.Family), e.Table.Name, e.Set, familyName(e.SetTable.Family), e.SetTable.Name)
+}
+
+// familyName returns the name of the family in nft syntax
+func familyName(f nftables.TableFamily) string {
+	switch f {
+	case nftables.TableFamilyINet:
+		return "inet"
+	case nftables.TableFamilyIPv4:
+		return "ip"
+	case nftables.TableFamilyIPv6:
+		return "ip6"
+	case nftables.TableFamilyARP:
+		return "arp"
+	case nftables.TableFamilyNetdev:
+		return "netdev"
+	case nftables.TableFamilyBridge:
+		return "bridge"
+	}
+
+	return fmt.Sprintf("family %d", f)
+}
+
+// tableName returns the family and the name of the table the way nft refers to it, "ip filter"
+func tableName(t *nftables.Table) string {
+	return familyName(t.Family) + " " + t.Name
+}
+
+// checkSetReferences returns ErrSetInOtherTable if the expressions refer to a set which is neither in the store
+// nor on the host for the table of the rule, but is found on the host in another table. Sets which are not found
+// anywhere are left to the host, they can be created later in the same transaction. Sets generated
+// for the rule are not checked.
+func (nfr *nfRules) checkSetReferences(exprs []expr.Any, generated []*nfSet) error {
+	if nfr.chains == nil || nfr.chains.sets == nil {
+		return nil
+	}
+	checked := make(map[string]bool, len(generated))
+	for _, s := range generated {
+		checked[s.set.Name] = true
+	}
+	for _, e := range exprs {
+		name := ""
+		switch e := e.(type) {
+		case *expr.Lookup:
+			name = e.SetName
+		case *expr.Dynset:
+			name = e.SetName
+		}
+		if name == "" || checked[name] {
+			continue
+		}
+		checked[name] = true
+		if _, ok := nfr.chains.sets.get(name); ok {
+			continue
+		}
+		if _, err := getSetByName(nfr.conn, nfr.table, name); err == nil {
+			continue
+		}
+		if t := findSetTable(nfr.conn, nfr.table, name); t != nil {
+			return &ErrSetInOtherTable{Set: name, Table: nfr.table, SetTable: t}
+		}
+	}
+
+	return nil
+}
+
+// findSetTable returns a table of the host other than the table which defines the set, nil is returned
+// if no other table defines it.
+func findSetTable(conn NetNS, table *nftables.Table, name string) *nftables.Table {
+	tables, _, err := listTables(conn, listFilter{})
+	if err != nil {
+		return nil
+	}
+	for _, t := range tables {
+		if t.Name == table.Name && t.Family == table.Family {
+			continue
+		}
+		if _, err := getSetByName(conn, t, name); err == nil {
+			return t
+		}
+	}
+
+	return nil
+}
+
+// CopySet copies the set programmed on the host in the source table along with its elements to the destination
+// table, the destination table must be in the store. The set and its elements are programmed by a single
+// transaction, elements are split in messages of DefaultElementsChunkSize elements. The copy is stored
+// in the destination table's store and returned.
+func (nft *nfTables) CopySet(src, dst *nftables.Table, name string) (*nftables.Set, error) {
+	if err := writable(nft.conn); err != nil {
+		return nil, err
+	}
+	if src == nil || dst == nil {
+		return nil, fmt.Errorf("source and destination tables cannot be nil")
+	}
+	if src.Name == dst.Name && src.Family == dst.Family {
+		return nil, fmt.Errorf("set %s cannot be copied to the table it is defined in", name)
+	}
+	si, err := nft.TableSets(dst.Name, dst.Family)
+	if err != nil {
+		return nil, err
+	}
+	nfs, ok := si.(*nfSets)
+	if !ok {
+		return nil, fmt.Errorf("sets of table %s are not managed by the library", dst.Name)
+	}
+	var set *nftables.Set
+	var elements []nftables.SetElement
+	if err := nft.reads.do(func() (err error) {
+		if set, err = getSetByName(nft.conn, &nftables.Table{Name: src.Name, Family: src.Family}, name); err != nil {
+			return err
+		}
+		elements, err = getSetElements(nft.conn, set)
+		return err
+	}); err != nil {
+		return nil, fmt.Errorf("failed to read set %s of %s table %s with error: %+v", name, familyName(src.Family), src.Name, err)
+	}
+	if set.Anonymous {
+		return nil, fmt.Errorf("anonymous set %s cannot be copied", name)
+	}
+	if _, ok := nfs.get(name); ok {
+		return nil, fmt.Errorf("set %s already exists in %s table %s", name, familyName(dst.Family), dst.Name)
+	}
+	if _, err := getSetByName(nft.conn, nfs.table, name); err == nil {
+		return nil, fmt.Errorf("set %s already exists in %s table %s", name, familyName(dst.Family), dst.Name)
+	}
+	decodeSet(set)
+	inferKeyType(set, elements)
+	s := *set
+	s.Table = nfs.table
+	s.ID = nft.ids.SetID()
+	if s.Interval {
+		elements = sortedIntervalElements(elements)
+	}
+	if err := nft.conn.AddSet(&s, nil); err != nil {
+		return nil, err
+	}
+	for _, chunk := range chunkElements(elements, s.Interval) {
+		if err := nft.conn.SetAddElements(&s, chunk); err != nil {
+			return nil, err
+		}
+	}
+	if err := flush(nft.conn); err != nil {
+		return nil, err
+	}
+	nfs.store(&s)
+
+	return &s, nil
+}
@@ -0,0 +1,108 @@
+package nftableslib
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+// ErrInvalidElement is returned when an element does not match datatypes or flags of the set,
+// Index is the index of the element in the slice passed by the caller.
+type ErrInvalidElement struct {
+	Set    string
+	Index  int
+	Reason string
+}
+
+func (e *ErrInvalidElement) Error() string {
+	return fmt.Sprintf("element %d of set %s is invalid: %s", e.Index, e.Set, e.Reason)
+}
+
+// isVerdictMap returns true if the set is a map of verdicts
+func isVerdictMap(set *nftables.Set) bool {
+	return set.IsMap && set.DataType.GetNFTMagic() == nftables.TypeVerdict.GetNFTMagic()
+}
+
+// validateSetAttributes checks that the datatypes of the set are consistent with its flags
+func validateSetAttributes(attrs *SetAttributes) error {
+	if attrs.KeyType.GetNFTMagic() == 0 {
+		return fmt.Errorf("key type of set %s is not specified", attrs.Name)
+	}
+	if attrs.IsMap && attrs.DataType.GetNFTMagic() == 0 {
+		return fmt.Errorf("data type of map %s is not specified", attrs.Name)
+	}
+	if !attrs.IsMap && attrs.DataType.GetNFTMagic() != 0 {
+		return fmt.Errorf("set %s carries data type %s but it is not a map", attrs.Name, attrs.DataType.Name)
+	}
+
+	return nil
+}
+
+// validateElements checks encoding of elements against datatypes of the set before they are sent
+// to the kernel: the key must be of the key type's size, elements of verdict maps must carry a verdict,
+// elements of data maps must carry a value of the data type's size and elements of sets carry neither.
+// An element closing an interval cannot carry data and, when it follows the element opening
+// the interval, its key must be greater than the key of the opening element.
+func validateElements(set *nftables.Set, elements []nftables.SetElement) error {
+	invalid := func(i int, format string, a ...interface{}) error {
+		return &ErrInvalidElement{Set: set.Name, Index: i, Reason: fmt.Sprintf(format, a...)}
+	}
+	for i, e := range elements {
+		if kl := int(set.KeyType.Bytes); kl != 0 && len(e.Key) != kl {
+			return invalid(i, "key of %d bytes does not match %d bytes of key type %s", len(e.Key), kl, set.KeyType.Name)
+		}
+		if e.IntervalEnd {
+			if !set.Interval {
+				return invalid(i, "element closes an interval but the set is not an interval set")
+			}
+			if e.VerdictData != nil || len(e.Val) != 0 {
+				return invalid(i, "element closing an interval cannot carry data")
+			}
+			if i > 0 && !elements[i-1].IntervalEnd && bytes.Compare(e.Key, elements[i-1].Key) <= 0 {
+				return invalid(i, "interval end %x is not greater than interval start %x", e.Key, elements[i-1].Key)
+			}
+			continue
+		}
+		switch {
+		case isVerdictMap(set):
+			if e.VerdictData == nil {
+				return invalid(i, "element of verdict map must carry a verdict")
+			}
+			if err := validateElementVerdict(e.VerdictData); err != nil {
+				return invalid(i, "%v", err)
+			}
+		case set.IsMap:
+			if e.VerdictData != nil {
+				return invalid(i, "element of map of %s cannot carry a verdict", set.DataType.Name)
+			}
+			if dl := int(set.DataType.Bytes); dl != 0 && len(e.Val) != dl {
+				return invalid(i, "value of %d bytes does not match %d bytes of data type %s", len(e.Val), dl, set.DataType.Name)
+			}
+		default:
+			if e.VerdictData != nil || len(e.Val) != 0 {
+				return invalid(i, "element of set cannot carry data")
+			}
+		}
+	}
+
+	return nil
+}
+
+// validateElementVerdict checks that only jump and goto verdicts refer to a chain
+func validateElementVerdict(v *expr.Verdict) error {
+	switch int(v.Kind) {
+	case unix.NFT_JUMP, unix.NFT_GOTO:
+		if v.Chain == "" {
+			return fmt.Errorf("jump or goto verdict must have a chain name specified")
+		}
+	default:
+		if v.Chain != "" {
+			return fmt.Errorf("verdict %d cannot refer to chain %s", v.Kind, v.Chain)
+		}
+	}
+
+	return nil
+}
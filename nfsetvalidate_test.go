@@ -0,0 +1,213 @@
+package nftableslib
+
+import (
+	"testing"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+)
+
+func TestValidateElements(t *testing.T) {
+	accept := &expr.Verdict{Kind: expr.VerdictAccept}
+	tests := []struct {
+		name     string
+		set      *nftables.Set
+		elements []nftables.SetElement
+		index    int
+		success  bool
+	}{
+		{
+			name:     "ipv4_addr of 4 bytes",
+			set:      &nftables.Set{KeyType: nftables.TypeIPAddr},
+			elements: []nftables.SetElement{{Key: []byte{10, 0, 0, 1}}},
+			success:  true,
+		},
+		{
+			name:     "ipv4_addr of 16 bytes",
+			set:      &nftables.Set{KeyType: nftables.TypeIPAddr},
+			elements: []nftables.SetElement{{Key: []byte{10, 0, 0, 1}}, {Key: make([]byte, 16)}},
+			index:    1,
+			success:  false,
+		},
+		{
+			name:     "ipv6_addr of 16 bytes",
+			set:      &nftables.Set{KeyType: nftables.TypeIP6Addr},
+			elements: []nftables.SetElement{{Key: make([]byte, 16)}},
+			success:  true,
+		},
+		{
+			name:     "ipv6_addr of 4 bytes",
+			set:      &nftables.Set{KeyType: nftables.TypeIP6Addr},
+			elements: []nftables.SetElement{{Key: []byte{10, 0, 0, 1}}},
+			success:  false,
+		},
+		{
+			name:     "inet_service of 2 bytes",
+			set:      &nftables.Set{KeyType: nftables.TypeInetService},
+			elements: []nftables.SetElement{{Key: []byte{0, 80}}},
+			success:  true,
+		},
+		{
+			name:     "inet_service of 4 bytes",
+			set:      &nftables.Set{KeyType: nftables.TypeInetService},
+			elements: []nftables.SetElement{{Key: []byte{0, 80, 0, 0}}},
+			success:  false,
+		},
+		{
+			name:     "inet_service padded by GenSetKeyType",
+			set:      &nftables.Set{KeyType: GenSetKeyType(nftables.TypeInetService)},
+			elements: []nftables.SetElement{{Key: []byte{0, 80, 0, 0}}},
+			success:  true,
+		},
+		{
+			name:     "inet_proto of 1 byte",
+			set:      &nftables.Set{KeyType: nftables.TypeInetProto},
+			elements: []nftables.SetElement{{Key: []byte{6}}},
+			success:  true,
+		},
+		{
+			name:     "inet_proto of 2 bytes",
+			set:      &nftables.Set{KeyType: nftables.TypeInetProto},
+			elements: []nftables.SetElement{{Key: []byte{0, 6}}},
+			success:  false,
+		},
+		{
+			name:     "ether_addr of 6 bytes",
+			set:      &nftables.Set{KeyType: nftables.TypeEtherAddr},
+			elements: []nftables.SetElement{{Key: []byte{0, 1, 2, 3, 4, 5}}},
+			success:  true,
+		},
+		{
+			name:     "ether_addr of 8 bytes",
+			set:      &nftables.Set{KeyType: nftables.TypeEtherAddr},
+			elements: []nftables.SetElement{{Key: make([]byte, 8)}},
+			success:  false,
+		},
+		{
+			name:     "mark of 4 bytes",
+			set:      &nftables.Set{KeyType: nftables.TypeMark},
+			elements: []nftables.SetElement{{Key: []byte{0, 0, 0, 1}}},
+			success:  true,
+		},
+		{
+			name:     "integer of 2 bytes",
+			set:      &nftables.Set{KeyType: nftables.TypeInteger},
+			elements: []nftables.SetElement{{Key: []byte{0, 1}}},
+			success:  false,
+		},
+		{
+			name:     "concatenation of ipv4_addr and inet_service",
+			set:      &nftables.Set{KeyType: GenSetKeyType(nftables.TypeIPAddr, nftables.TypeInetService)},
+			elements: []nftables.SetElement{{Key: []byte{10, 0, 0, 1, 0, 80, 0, 0}}},
+			success:  true,
+		},
+		{
+			name:     "concatenation without padding",
+			set:      &nftables.Set{KeyType: GenSetKeyType(nftables.TypeIPAddr, nftables.TypeInetService)},
+			elements: []nftables.SetElement{{Key: []byte{10, 0, 0, 1, 0, 80}}},
+			success:  false,
+		},
+		{
+			name:     "set element with value",
+			set:      &nftables.Set{KeyType: nftables.TypeIPAddr},
+			elements: []nftables.SetElement{{Key: []byte{10, 0, 0, 1}, Val: []byte{0, 80}}},
+			success:  false,
+		},
+		{
+			name:     "verdict map",
+			set:      &nftables.Set{IsMap: true, KeyType: nftables.TypeInetService, DataType: nftables.TypeVerdict},
+			elements: []nftables.SetElement{{Key: []byte{0, 80}, VerdictData: &expr.Verdict{Kind: expr.VerdictJump, Chain: "web"}}},
+			success:  true,
+		},
+		{
+			name:     "verdict map without verdict",
+			set:      &nftables.Set{IsMap: true, KeyType: nftables.TypeInetService, DataType: nftables.TypeVerdict},
+			elements: []nftables.SetElement{{Key: []byte{0, 80}, VerdictData: accept}, {Key: []byte{0, 22}}},
+			index:    1,
+			success:  false,
+		},
+		{
+			name:     "verdict map jump without chain",
+			set:      &nftables.Set{IsMap: true, KeyType: nftables.TypeInetService, DataType: nftables.TypeVerdict},
+			elements: []nftables.SetElement{{Key: []byte{0, 80}, VerdictData: &expr.Verdict{Kind: expr.VerdictJump}}},
+			success:  false,
+		},
+		{
+			name:     "data map of ipv4_addr",
+			set:      &nftables.Set{IsMap: true, KeyType: nftables.TypeInetService, DataType: nftables.TypeIPAddr},
+			elements: []nftables.SetElement{{Key: []byte{0, 80}, Val: []byte{10, 0, 0, 1}}},
+			success:  true,
+		},
+		{
+			name:     "data map of ipv4_addr with ipv6 value",
+			set:      &nftables.Set{IsMap: true, KeyType: nftables.TypeInetService, DataType: nftables.TypeIPAddr},
+			elements: []nftables.SetElement{{Key: []byte{0, 80}, Val: make([]byte, 16)}},
+			success:  false,
+		},
+		{
+			name:     "data map with verdict",
+			set:      &nftables.Set{IsMap: true, KeyType: nftables.TypeInetService, DataType: nftables.TypeIPAddr},
+			elements: []nftables.SetElement{{Key: []byte{0, 80}, VerdictData: accept}},
+			success:  false,
+		},
+		{
+			name: "interval",
+			set:  &nftables.Set{Interval: true, KeyType: nftables.TypeIPAddr},
+			elements: []nftables.SetElement{
+				{Key: []byte{10, 0, 0, 0}},
+				{Key: []byte{10, 0, 1, 0}, IntervalEnd: true},
+				{Key: []byte{10, 0, 2, 0}},
+			},
+			success: true,
+		},
+		{
+			name: "interval ending before its start",
+			set:  &nftables.Set{Interval: true, KeyType: nftables.TypeIPAddr},
+			elements: []nftables.SetElement{
+				{Key: []byte{10, 0, 1, 0}},
+				{Key: []byte{10, 0, 1, 0}, IntervalEnd: true},
+			},
+			index:   1,
+			success: false,
+		},
+		{
+			name:     "interval end in set without interval flag",
+			set:      &nftables.Set{KeyType: nftables.TypeIPAddr},
+			elements: []nftables.SetElement{{Key: []byte{10, 0, 0, 0}, IntervalEnd: true}},
+			success:  false,
+		},
+		{
+			name: "interval end with verdict",
+			set:  &nftables.Set{Interval: true, IsMap: true, KeyType: nftables.TypeIPAddr, DataType: nftables.TypeVerdict},
+			elements: []nftables.SetElement{
+				{Key: []byte{10, 0, 0, 0}, VerdictData: accept},
+				{Key: []byte{10, 0, 1, 0}, IntervalEnd: true, VerdictData: accept},
+			},
+			index:   1,
+			success: false,
+		},
+	}
+	for _, tt := range tests {
+		tt.set.Name = "test"
+		err := validateElements(tt.set, tt.elements)
+		if err != nil && tt.success {
+			t.Errorf("test \"%s\" failed with error: %+v but supposed to succeed", tt.name, err)
+			continue
+		}
+		if err == nil && !tt.success {
+			t.Errorf("test \"%s\" succeeded but supposed to fail", tt.name)
+			continue
+		}
+		if tt.success {
+			continue
+		}
+		ee, ok := err.(*ErrInvalidElement)
+		if !ok {
+			t.Errorf("test \"%s\": expected ErrInvalidElement, got %T", tt.name, err)
+			continue
+		}
+		if ee.Index != tt.index {
+			t.Errorf("test \"%s\": expected element %d to be reported, got %d: %v", tt.name, tt.index, ee.Index, err)
+		}
+	}
+}
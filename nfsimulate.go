@@ -0,0 +1,588 @@
+package nftableslib
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sort"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// simJumpStackSize is the depth of jumps the kernel allows, NFT_JUMP_STACK_SIZE
+	simJumpStackSize = 16
+	// simMaxRules bounds the number of rules a simulation evaluates, it stops loops of gotos
+	simMaxRules = 1 << 16
+	// simRegistersLen is the length of the verdict register followed by 64 bytes of data registers
+	simRegistersLen = regUnitsPerReg*regUnitLen + regUnitCount*regUnitLen
+)
+
+// Packet describes a packet for Simulate. The family of the packet is the family of its addresses,
+// at least one address must be set. Ports are used when Proto is tcp, udp, udplite, sctp or dccp,
+// ICMPType and ICMPCode when Proto is icmp or icmpv6.
+type Packet struct {
+	SAddr    net.IP
+	DAddr    net.IP
+	Proto    uint8
+	SPort    uint16
+	DPort    uint16
+	ICMPType uint8
+	ICMPCode uint8
+	IIFName  string
+	OIFName  string
+	Mark     uint32
+	// CTState is one of CTStateNew, CTStateRelated, CTStateEstablished or CTStateInvalid,
+	// rules matching ct state are indeterminate when it is 0.
+	CTState uint32
+}
+
+// SimulationStep is a rule which matched the packet
+type SimulationStep struct {
+	Chain  string
+	RuleID uint32
+	Handle uint64
+	// Action is the verdict of the rule in nft syntax, like "accept" or "jump web", "reject" for rejecting
+	// rules and empty when the rule matched without a verdict.
+	Action string
+}
+
+// SimulationResult is the outcome of Simulate. Verdict is NFT_ACCEPT or NFT_DROP, rejected packets are
+// dropped and have Rejected set. When a rule cannot be evaluated, the simulation stops, Indeterminate is set,
+// Reason tells why and Verdict is meaningless.
+type SimulationResult struct {
+	Verdict  int
+	Rejected bool
+	// Policy is set when the verdict is the policy of the chain
+	Policy        bool
+	Indeterminate bool
+	Reason        string
+	Trail         []*SimulationStep
+}
+
+type simOutcome int
+
+const (
+	simBreak simOutcome = iota
+	simNoVerdict
+	simVerdict
+	simReject
+	simIndeterminate
+)
+
+// simHeader is a header synthesized from the packet, only bytes of known fields can be loaded
+type simHeader struct {
+	data  []byte
+	known []bool
+}
+
+func newSimHeader(l int) *simHeader {
+	return &simHeader{data: make([]byte, l), known: make([]bool, l)}
+}
+
+func (h *simHeader) set(offset int, b []byte) {
+	copy(h.data[offset:], b)
+	for i := range b {
+		h.known[offset+i] = true
+	}
+}
+
+func (h *simHeader) load(offset, l uint32) ([]byte, bool) {
+	if int(offset+l) > len(h.data) {
+		return nil, false
+	}
+	for _, k := range h.known[offset : offset+l] {
+		if !k {
+			return nil, false
+		}
+	}
+
+	return h.data[offset : offset+l], true
+}
+
+type simulation struct {
+	nfc       *nfChains
+	packet    Packet
+	family    nftables.TableFamily
+	network   *simHeader
+	transport *simHeader
+	regs      [simRegistersLen]byte
+	// sets caches named sets read from the host
+	sets   map[string]*nfSet
+	result *SimulationResult
+}
+
+// Simulate evaluates the packet against rules of the store starting with the chain, following jumps and
+// gotos and applying the policy of the chain when the packet falls through it. Chains which are not base
+// chains accept packets falling through them. Addresses, ports, protocols, icmp type and code, meta l4proto,
+// nfproto, protocol, iifname, oifname and mark, ct state and lookups in sets and maps are evaluated,
+// counters and logs are skipped and "meta mark set" changes the mark of the packet. Any other expression
+// makes the result indeterminate. Rules do not need to be programmed, elements of named sets are read
+// from the host.
+func (nfc *nfChains) Simulate(chain string, p *Packet) (*SimulationResult, error) {
+	if p == nil {
+		return nil, fmt.Errorf("packet cannot be nil")
+	}
+	s := &simulation{nfc: nfc, packet: *p, sets: make(map[string]*nfSet), result: &SimulationResult{}}
+	if err := s.buildHeaders(); err != nil {
+		return nil, err
+	}
+	if nfc.table.Family != nftables.TableFamilyINet && nfc.table.Family != s.family {
+		return nil, fmt.Errorf("%s packet cannot be simulated in %s table %s", familyName(s.family), familyName(nfc.table.Family), nfc.table.Name)
+	}
+	start, ok := nfc.simChain(chain)
+	if !ok {
+		return nil, fmt.Errorf("chain %s does not exist", chain)
+	}
+	type frame struct {
+		chain string
+		rules []*nfRule
+		next  int
+	}
+	cur := frame{chain: chain, rules: start.ordered()}
+	stack := make([]frame, 0, simJumpStackSize)
+	evaluated := 0
+	for {
+		if cur.next == len(cur.rules) {
+			if len(stack) != 0 {
+				cur, stack = stack[len(stack)-1], stack[:len(stack)-1]
+				continue
+			}
+			return s.policy(chain), nil
+		}
+		r := cur.rules[cur.next]
+		cur.next++
+		if evaluated++; evaluated > simMaxRules {
+			return nil, fmt.Errorf("simulation exceeded %d rules, chains loop", simMaxRules)
+		}
+		outcome, v, reason := s.evalRule(r)
+		step := &SimulationStep{Chain: cur.chain, RuleID: r.id, Handle: r.rule.Handle}
+		switch outcome {
+		case simBreak:
+			continue
+		case simIndeterminate:
+			s.result.Indeterminate = true
+			s.result.Reason = fmt.Sprintf("rule %d of chain %s: %s", r.id, cur.chain, reason)
+			return s.result, nil
+		case simReject:
+			step.Action = "reject"
+			s.result.Trail = append(s.result.Trail, step)
+			s.result.Verdict, s.result.Rejected = NFT_DROP, true
+			return s.result, nil
+		case simNoVerdict:
+			s.result.Trail = append(s.result.Trail, step)
+			continue
+		}
+		step.Action = verdictName(int(v.Kind))
+		if v.Chain != "" {
+			step.Action += " " + v.Chain
+		}
+		s.result.Trail = append(s.result.Trail, step)
+		switch v.Kind {
+		case expr.VerdictAccept:
+			s.result.Verdict = NFT_ACCEPT
+			return s.result, nil
+		case expr.VerdictDrop:
+			s.result.Verdict = NFT_DROP
+			return s.result, nil
+		case expr.VerdictContinue, expr.VerdictBreak:
+		case expr.VerdictReturn:
+			cur.next = len(cur.rules)
+		case expr.VerdictJump, expr.VerdictGoto:
+			target, ok := nfc.simChain(v.Chain)
+			if !ok {
+				s.result.Indeterminate = true
+				s.result.Reason = fmt.Sprintf("rule %d of chain %s: chain %s is not known", r.id, cur.chain, v.Chain)
+				return s.result, nil
+			}
+			if v.Kind == expr.VerdictJump {
+				if len(stack) == simJumpStackSize {
+					return nil, fmt.Errorf("jump to chain %s exceeds %d nested jumps", v.Chain, simJumpStackSize)
+				}
+				stack = append(stack, cur)
+			}
+			cur = frame{chain: v.Chain, rules: target.ordered()}
+		default:
+			s.result.Indeterminate = true
+			s.result.Reason = fmt.Sprintf("rule %d of chain %s: verdict %s is not simulated", r.id, cur.chain, step.Action)
+			return s.result, nil
+		}
+	}
+}
+
+// simChain returns rules of the chain from the store
+func (nfc *nfChains) simChain(name string) (*nfRules, bool) {
+	nfc.Lock()
+	defer nfc.Unlock()
+	c, ok := nfc.chains[name]
+	if !ok {
+		return nil, false
+	}
+	nfr, ok := c.RulesInterface.(*nfRules)
+
+	return nfr, ok
+}
+
+// policy sets the verdict of the packet falling through the chain
+func (s *simulation) policy(chain string) *SimulationResult {
+	s.result.Verdict, s.result.Policy = NFT_ACCEPT, true
+	s.nfc.Lock()
+	defer s.nfc.Unlock()
+	if c, ok := s.nfc.chains[chain]; ok && c.baseChain && c.chain.Policy != nil && *c.chain.Policy == nftables.ChainPolicyDrop {
+		s.result.Verdict = NFT_DROP
+	}
+
+	return s.result
+}
+
+// buildHeaders synthesizes network and transport headers of the packet
+func (s *simulation) buildHeaders() error {
+	p := &s.packet
+	var saddr, daddr net.IP
+	switch {
+	case p.SAddr == nil && p.DAddr == nil:
+		return fmt.Errorf("packet must have source or destination address")
+	case (p.SAddr == nil || p.SAddr.To4() != nil) && (p.DAddr == nil || p.DAddr.To4() != nil):
+		s.family = nftables.TableFamilyIPv4
+		s.network = newSimHeader(20)
+		s.network.set(0, []byte{0x45})
+		s.network.set(9, []byte{p.Proto})
+		if saddr = p.SAddr.To4(); saddr != nil {
+			s.network.set(12, saddr)
+		}
+		if daddr = p.DAddr.To4(); daddr != nil {
+			s.network.set(16, daddr)
+		}
+	case (p.SAddr == nil || p.SAddr.To4() == nil) && (p.DAddr == nil || p.DAddr.To4() == nil):
+		s.family = nftables.TableFamilyIPv6
+		s.network = newSimHeader(40)
+		s.network.set(6, []byte{p.Proto})
+		if p.SAddr != nil {
+			s.network.set(8, p.SAddr.To16())
+		}
+		if p.DAddr != nil {
+			s.network.set(24, p.DAddr.To16())
+		}
+	default:
+		return fmt.Errorf("source %s and destination %s addresses of the packet are of different families", p.SAddr, p.DAddr)
+	}
+	s.transport = newSimHeader(20)
+	switch p.Proto {
+	case unix.IPPROTO_TCP, unix.IPPROTO_UDP, unix.IPPROTO_UDPLITE, unix.IPPROTO_SCTP, unix.IPPROTO_DCCP:
+		s.transport.set(0, binaryutil.BigEndian.PutUint16(p.SPort))
+		s.transport.set(2, binaryutil.BigEndian.PutUint16(p.DPort))
+	case unix.IPPROTO_ICMP, unix.IPPROTO_ICMPV6:
+		s.transport.set(0, []byte{p.ICMPType, p.ICMPCode})
+	}
+
+	return nil
+}
+
+// register returns the register space of the register, 16 bytes registers are numbered 0 to 4 with
+// the verdict register 0, 4 bytes registers NFT_REG32_00 to NFT_REG32_15 are numbered 8 to 23.
+func (s *simulation) register(reg, l uint32) ([]byte, bool) {
+	var offset uint32
+	switch {
+	case reg <= unix.NFT_REG_4:
+		offset = reg * regUnitsPerReg * regUnitLen
+	case reg >= unix.NFT_REG32_00 && reg < unix.NFT_REG32_00+regUnitCount:
+		offset = regUnitsPerReg*regUnitLen + (reg-unix.NFT_REG32_00)*regUnitLen
+	default:
+		return nil, false
+	}
+	if offset+l > simRegistersLen {
+		return nil, false
+	}
+
+	return s.regs[offset : offset+l], true
+}
+
+// store copies data to the register, the last 4 bytes unit is zeroed first as the kernel does
+func (s *simulation) store(reg uint32, data []byte) bool {
+	r, ok := s.register(reg, (uint32(len(data))+regUnitLen-1)/regUnitLen*regUnitLen)
+	if !ok {
+		return false
+	}
+	for i := range r {
+		r[i] = 0
+	}
+	copy(r, data)
+
+	return true
+}
+
+// evalRule evaluates expressions of the rule
+func (s *simulation) evalRule(r *nfRule) (simOutcome, *expr.Verdict, string) {
+	for _, e := range r.rule.Exprs {
+		var reason string
+		switch e := e.(type) {
+		case *expr.Payload:
+			reason = s.payload(e)
+		case *expr.Meta:
+			reason = s.meta(e)
+		case *expr.Ct:
+			reason = s.ct(e)
+		case *expr.Immediate:
+			if !s.store(e.Register, e.Data) {
+				reason = fmt.Sprintf("invalid register %d", e.Register)
+			}
+		case *expr.Bitwise:
+			src, ok1 := s.register(e.SourceRegister, e.Len)
+			if !ok1 || len(e.Mask) < int(e.Len) || len(e.Xor) < int(e.Len) {
+				reason = "invalid bitwise expression"
+				break
+			}
+			b := make([]byte, e.Len)
+			for i := range b {
+				b[i] = src[i]&e.Mask[i] ^ e.Xor[i]
+			}
+			if !s.store(e.DestRegister, b) {
+				reason = fmt.Sprintf("invalid register %d", e.DestRegister)
+			}
+		case *expr.Cmp:
+			v, ok := s.register(e.Register, uint32(len(e.Data)))
+			if !ok {
+				return simIndeterminate, nil, fmt.Sprintf("invalid register %d", e.Register)
+			}
+			if !cmpMatches(e.Op, bytes.Compare(v, e.Data)) {
+				return simBreak, nil, ""
+			}
+		case *expr.Range:
+			v, ok := s.register(e.Register, uint32(len(e.FromData)))
+			if !ok || len(e.FromData) != len(e.ToData) {
+				return simIndeterminate, nil, "invalid range expression"
+			}
+			in := bytes.Compare(v, e.FromData) >= 0 && bytes.Compare(v, e.ToData) <= 0
+			if in != (e.Op == expr.CmpOpEq) {
+				return simBreak, nil, ""
+			}
+		case *expr.Lookup:
+			matched, v, reason := s.lookup(e, r.sets)
+			if reason != "" {
+				return simIndeterminate, nil, reason
+			}
+			if !matched {
+				return simBreak, nil, ""
+			}
+			if v != nil {
+				return simVerdict, v, ""
+			}
+		case *expr.Verdict:
+			return simVerdict, e, ""
+		case *expr.Reject:
+			return simReject, nil, ""
+		case *expr.Counter, *expr.Log, *expr.Notrack:
+		case *expr.Objref:
+			if ObjectKind(e.Type) != ObjectCounter {
+				reason = fmt.Sprintf("%s %s is not simulated", ObjectKind(e.Type), e.Name)
+			}
+		default:
+			reason = fmt.Sprintf("%s expression is not simulated", exprName(e))
+		}
+		if reason != "" {
+			return simIndeterminate, nil, reason
+		}
+	}
+
+	return simNoVerdict, nil, ""
+}
+
+func cmpMatches(op expr.CmpOp, c int) bool {
+	switch op {
+	case expr.CmpOpEq:
+		return c == 0
+	case expr.CmpOpNeq:
+		return c != 0
+	case expr.CmpOpLt:
+		return c < 0
+	case expr.CmpOpLte:
+		return c <= 0
+	case expr.CmpOpGt:
+		return c > 0
+	case expr.CmpOpGte:
+		return c >= 0
+	}
+
+	return false
+}
+
+func (s *simulation) payload(e *expr.Payload) string {
+	if e.OperationType != expr.PayloadLoad {
+		return "payload write is not simulated"
+	}
+	var h *simHeader
+	name := ""
+	switch e.Base {
+	case expr.PayloadBaseNetworkHeader:
+		h, name = s.network, "network"
+	case expr.PayloadBaseTransportHeader:
+		h, name = s.transport, "transport"
+	default:
+		return "link layer header is not simulated"
+	}
+	b, ok := h.load(e.Offset, e.Len)
+	if !ok {
+		return fmt.Sprintf("%d bytes at offset %d of %s header are not known", e.Len, e.Offset, name)
+	}
+	if !s.store(e.DestRegister, b) {
+		return fmt.Sprintf("invalid register %d", e.DestRegister)
+	}
+
+	return ""
+}
+
+func (s *simulation) meta(e *expr.Meta) string {
+	if e.SourceRegister {
+		if e.Key != expr.MetaKeyMARK {
+			return fmt.Sprintf("meta set of key %d is not simulated", e.Key)
+		}
+		b, ok := s.register(e.Register, 4)
+		if !ok {
+			return fmt.Sprintf("invalid register %d", e.Register)
+		}
+		s.packet.Mark = binaryutil.NativeEndian.Uint32(b)
+		return ""
+	}
+	var b []byte
+	switch e.Key {
+	case expr.MetaKeyL4PROTO:
+		b = []byte{s.packet.Proto}
+	case expr.MetaKeyNFPROTO:
+		b = []byte{byte(s.family)}
+	case expr.MetaKeyPROTOCOL:
+		b = binaryutil.BigEndian.PutUint16(unix.ETH_P_IP)
+		if s.family == nftables.TableFamilyIPv6 {
+			b = binaryutil.BigEndian.PutUint16(unix.ETH_P_IPV6)
+		}
+	case expr.MetaKeyIIFNAME:
+		b = ifname(s.packet.IIFName)
+	case expr.MetaKeyOIFNAME:
+		b = ifname(s.packet.OIFName)
+	case expr.MetaKeyMARK:
+		b = binaryutil.NativeEndian.PutUint32(s.packet.Mark)
+	default:
+		return fmt.Sprintf("meta key %d is not simulated", e.Key)
+	}
+	if !s.store(e.Register, b) {
+		return fmt.Sprintf("invalid register %d", e.Register)
+	}
+
+	return ""
+}
+
+func (s *simulation) ct(e *expr.Ct) string {
+	if e.SourceRegister || e.Key != unix.NFT_CT_STATE {
+		return fmt.Sprintf("ct key %d is not simulated", e.Key)
+	}
+	if s.packet.CTState == 0 {
+		return "ct state of the packet is not known"
+	}
+	// CTState constants are the bytes of the kernel's state bits in the order they are stored in registers
+	if !s.store(e.Register, binaryutil.BigEndian.PutUint32(s.packet.CTState)) {
+		return fmt.Sprintf("invalid register %d", e.Register)
+	}
+
+	return ""
+}
+
+// lookup looks up the key in the set, the verdict is returned for verdict maps
+func (s *simulation) lookup(e *expr.Lookup, generated []*nfSet) (bool, *expr.Verdict, string) {
+	set, elements, reason := s.setElements(e.SetName, generated)
+	if reason != "" {
+		return false, nil, reason
+	}
+	if len(elements) == 0 {
+		return e.Invert, nil, ""
+	}
+	key, ok := s.register(e.SourceRegister, uint32(len(elements[0].Key)))
+	if !ok {
+		return false, nil, fmt.Sprintf("invalid register %d", e.SourceRegister)
+	}
+	el := findElement(set, elements, key)
+	if e.Invert {
+		return el == nil, nil, ""
+	}
+	if el == nil {
+		return false, nil, ""
+	}
+	switch {
+	case !e.IsDestRegSet:
+	case e.DestRegister == 0:
+		if el.VerdictData == nil {
+			return false, nil, fmt.Sprintf("element of map %s has no verdict", e.SetName)
+		}
+		return true, el.VerdictData, ""
+	default:
+		if !s.store(e.DestRegister, el.Val) {
+			return false, nil, fmt.Sprintf("invalid register %d", e.DestRegister)
+		}
+	}
+
+	return true, nil, ""
+}
+
+// setElements returns elements of the set generated for the rule or of the named set read from the host
+func (s *simulation) setElements(name string, generated []*nfSet) (*nftables.Set, []nftables.SetElement, string) {
+	for _, g := range generated {
+		if g.set.Name == name {
+			if len(g.fields) != 0 {
+				return nil, nil, fmt.Sprintf("concatenated intervals of set %s are not simulated", name)
+			}
+			return g.set, g.elements, ""
+		}
+	}
+	if c, ok := s.sets[name]; ok {
+		return c.set, c.elements, ""
+	}
+	var set *nftables.Set
+	var elements []nftables.SetElement
+	if err := s.nfc.opts.readPolicy().do(func() (err error) {
+		if set, err = getSetByName(s.nfc.conn, s.nfc.table, name); err != nil {
+			return err
+		}
+		elements, err = getSetElements(s.nfc.conn, set)
+		return err
+	}); err != nil {
+		return nil, nil, fmt.Sprintf("failed to read set %s with error: %+v", name, err)
+	}
+	s.sets[name] = &nfSet{set: set, elements: elements}
+
+	return set, elements, ""
+}
+
+// findElement returns the element of the set matching the key, an interval set matches the key when
+// the greatest element not above the key starts an interval.
+func findElement(set *nftables.Set, elements []nftables.SetElement, key []byte) *nftables.SetElement {
+	if !set.Interval {
+		for i := range elements {
+			if bytes.Equal(elements[i].Key, key) {
+				return &elements[i]
+			}
+		}
+		return nil
+	}
+	sorted := make([]nftables.SetElement, len(elements))
+	copy(sorted, elements)
+	// Ends of intervals go before starts of adjacent intervals with the same key
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if c := bytes.Compare(sorted[i].Key, sorted[j].Key); c != 0 {
+			return c < 0
+		}
+		return sorted[i].IntervalEnd && !sorted[j].IntervalEnd
+	})
+	var found *nftables.SetElement
+	for i := range sorted {
+		if bytes.Compare(sorted[i].Key, key) > 0 {
+			break
+		}
+		found = &sorted[i]
+	}
+	if found == nil || found.IntervalEnd {
+		return nil
+	}
+
+	return found
+}
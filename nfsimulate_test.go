@@ -0,0 +1,41 @@
+package nftableslib
+
+import (
+	"testing"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+)
+
+func TestFindElement(t *testing.T) {
+	port := binaryutil.BigEndian.PutUint16
+	interval := &nftables.Set{Interval: true}
+	// Intervals 80-89 and 90-99 are adjacent, 1000 starts an interval open to the end
+	elements := []nftables.SetElement{
+		{Key: port(1000)},
+		{Key: port(90)},
+		{Key: port(100), IntervalEnd: true},
+		{Key: port(80)},
+		{Key: port(90), IntervalEnd: true},
+	}
+	tests := []struct {
+		name  string
+		set   *nftables.Set
+		key   uint16
+		found bool
+	}{
+		{name: "Below first interval", set: interval, key: 79, found: false},
+		{name: "Start of interval", set: interval, key: 80, found: true},
+		{name: "Start of adjacent interval", set: interval, key: 90, found: true},
+		{name: "Last of interval", set: interval, key: 99, found: true},
+		{name: "End of interval", set: interval, key: 100, found: false},
+		{name: "Open interval", set: interval, key: 65535, found: true},
+		{name: "Set element", set: &nftables.Set{}, key: 90, found: true},
+		{name: "Set missing element", set: &nftables.Set{}, key: 85, found: false},
+	}
+	for _, tt := range tests {
+		if found := findElement(tt.set, elements, port(tt.key)) != nil; found != tt.found {
+			t.Fatalf("Test \"%s\" expected found %t, got %t", tt.name, tt.found, found)
+		}
+	}
+}
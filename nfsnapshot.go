@@ -0,0 +1,234 @@
+package nftableslib
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/expr"
+)
+
+// Snapshot is an opaque copy of the ruleset programmed on the host, it is returned by Snapshot
+// and used by Rollback to restore the ruleset to the state it was in when the snapshot was taken.
+type Snapshot struct {
+	// Taken is the time when the snapshot was taken
+	Taken  time.Time
+	tables []*nftables.Table
+	chains []*nftables.Chain
+	sets   []*nfSet
+	rules  []*nftables.Rule
+}
+
+// Snapshot captures all tables, chains, sets with their elements and rules programmed on the host.
+// Rules are captured from the raw dump, rules carrying expressions the library cannot decode fail
+// the snapshot, as Rollback and Restore would program different rules.
+func (nft *nfTables) Snapshot() (*Snapshot, error) {
+	unlock := nft.families.lockAll()
+	defer unlock()
+
+	return takeSnapshot(nft.conn)
+}
+
+func takeSnapshot(conn NetNS) (*Snapshot, error) {
+	s := &Snapshot{
+		Taken: time.Now(),
+	}
+	tables, err := conn.ListTables()
+	if err != nil {
+		return nil, err
+	}
+	chains, err := conn.ListChains()
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range tables {
+		s.tables = append(s.tables, t)
+		sets, err := getSets(conn, t)
+		if err != nil {
+			return nil, err
+		}
+		maps := make(map[string]bool)
+		for _, set := range sets {
+			set.Table = t
+			decodeSet(set)
+			elements, err := getSetElements(conn, set)
+			if err != nil {
+				return nil, err
+			}
+			inferKeyType(set, elements)
+			s.sets = append(s.sets, &nfSet{set: set, elements: elements})
+			maps[set.Name] = set.IsMap
+		}
+		for _, c := range chains {
+			if c.Table.Name != t.Name || c.Table.Family != t.Family {
+				continue
+			}
+			c.Table = t
+			s.chains = append(s.chains, c)
+			rules, err := snapshotRules(conn, t, c)
+			if err != nil {
+				return nil, err
+			}
+			for _, r := range rules {
+				for _, e := range r.Exprs {
+					// Destination register of lookups is decoded without the flag, lookups of maps need it
+					if l, ok := e.(*expr.Lookup); ok && maps[l.SetName] {
+						l.IsDestRegSet = true
+					}
+				}
+				s.rules = append(s.rules, r)
+			}
+		}
+	}
+
+	return s, nil
+}
+
+// snapshotRules returns rules of the chain decoded from the raw dump, github.com/google/nftables drops
+// expressions it does not decode, restoring such rules would program different rules. Rules carrying
+// expressions which cannot be decoded completely are refused.
+func snapshotRules(conn NetNS, t *nftables.Table, c *nftables.Chain) ([]*nftables.Rule, error) {
+	audited, err := getAuditedRules(conn, t, c)
+	if err != nil {
+		return nil, err
+	}
+	rules := make([]*nftables.Rule, 0, len(audited))
+	for _, ar := range audited {
+		r := &nftables.Rule{Table: t, Chain: c, Handle: ar.handle, UserData: ar.userData}
+		for _, ae := range ar.exprs {
+			if ae.expr == nil {
+				return nil, fmt.Errorf("rule with handle %d of chain %s in table %s cannot be captured, %s",
+					ar.handle, c.Name, t.Name, ae.reason)
+			}
+			r.Exprs = append(r.Exprs, ae.expr)
+		}
+		rules = append(rules, r)
+	}
+
+	return rules, nil
+}
+
+// inferKeyType sets the key type of verdict maps decoded from the host, the key type is lost
+// and the host rejects sets without the key length, the length is taken from the elements.
+func inferKeyType(set *nftables.Set, elements []nftables.SetElement) {
+	if set.KeyType.GetNFTMagic() == 0 && len(elements) != 0 {
+		set.KeyType = nftables.TypeInteger
+		set.KeyType.Bytes = uint32(len(elements[0].Key))
+	}
+}
+
+// Rollback replaces the ruleset programmed on the host with the ruleset captured in the snapshot.
+// The ruleset is flushed and restored in a single transaction, if the transaction fails
+// the host's ruleset stays intact. On success, the store is re-synchronized with the host.
+func (nft *nfTables) Rollback(s *Snapshot) error {
+	if err := writable(nft.conn); err != nil {
+		return err
+	}
+	if s == nil {
+		return fmt.Errorf("snapshot cannot be nil")
+	}
+	unlock := nft.families.lockAll()
+	nft.conn.FlushRuleset()
+	for _, t := range s.tables {
+		nft.conn.AddTable(t)
+	}
+	for _, c := range s.chains {
+		nft.conn.AddChain(c)
+	}
+	for _, set := range s.sets {
+		// Set IDs are not reported by the host, without ID anonymous sets get renamed
+		// and rules referring to them would not find them.
+		if set.set.ID == 0 {
+			set.set.ID = nft.ids.SetID()
+		}
+		if err := nft.conn.AddSet(set.set, set.elements); err != nil {
+			unlock()
+			return err
+		}
+	}
+	for _, r := range s.rules {
+		nft.conn.AddRule(&nftables.Rule{
+			Table:    r.Table,
+			Chain:    r.Chain,
+			Exprs:    r.Exprs,
+			UserData: r.UserData,
+		})
+	}
+	if err := flush(nft.conn); err != nil {
+		unlock()
+		return err
+	}
+	// Store does not reflect host's ruleset any longer, rebuilding it from the host.
+	nft.Lock()
+	nft.tables = make(map[nftables.TableFamily]map[string]*nfTable)
+	nft.Unlock()
+	unlock()
+
+	return nft.syncFamilies(s.tables)
+}
+
+// syncFamilies synchronizes the store with tables of families of the tables
+func (nft *nfTables) syncFamilies(tables []*nftables.Table) error {
+	families := make(map[nftables.TableFamily]bool)
+	for _, t := range tables {
+		families[t.Family] = true
+	}
+	for family := range families {
+		if _, err := nft.Sync(family); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// minProbeInterval is the shortest interval between calls of the probe of ConfirmOrRollback
+const minProbeInterval = 10 * time.Millisecond
+
+// ConfirmOrRollback takes a snapshot of the ruleset and calls apply to change it. After the change
+// is applied, probe is called periodically until it returns true or timeout expires. If apply fails or
+// probe does not confirm the change within timeout, the ruleset is rolled back to the snapshot.
+// Probe is called every tenth of timeout but not more often than every 10ms.
+func (nft *nfTables) ConfirmOrRollback(apply func() error, timeout time.Duration, probe func() bool) error {
+	if err := writable(nft.conn); err != nil {
+		return err
+	}
+	if apply == nil || probe == nil {
+		return fmt.Errorf("apply and probe functions cannot be nil")
+	}
+	if timeout <= 0 {
+		return fmt.Errorf("invalid confirmation timeout %v, it must be positive", timeout)
+	}
+	s, err := nft.Snapshot()
+	if err != nil {
+		return err
+	}
+	if err := apply(); err != nil {
+		if rerr := nft.Rollback(s); rerr != nil {
+			return fmt.Errorf("failed to apply change with error: %+v, rollback failed with error: %+v", err, rerr)
+		}
+		return err
+	}
+	expire := time.NewTimer(timeout)
+	defer expire.Stop()
+	interval := timeout / 10
+	if interval < minProbeInterval {
+		interval = minProbeInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if probe() {
+			return nil
+		}
+		select {
+		case <-expire.C:
+			if err := nft.Rollback(s); err != nil {
+				return fmt.Errorf("change was not confirmed within %v, rollback failed with error: %+v", timeout, err)
+			}
+			return ErrNotConfirmed
+		case <-ticker.C:
+			continue
+		}
+	}
+}
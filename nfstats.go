@@ -0,0 +1,278 @@
+package nftableslib
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/google/nftables"
+)
+
+// TableStats carries counts of objects of a table programmed on the host, it is returned by Tables().Stats.
+type TableStats struct {
+	Name   string
+	Family nftables.TableFamily
+	Chains int
+	Rules  int
+	Sets   int
+	// Elements is the total number of elements of sets and maps of the table as the kernel stores them,
+	// an interval takes two elements, its start and its end.
+	Elements int
+}
+
+// DefaultSetMemoryWarning is the estimated memory of a set above which loading elements raises SetMemoryWarning
+const DefaultSetMemoryWarning = 64 << 20
+
+// SetMemoryWarning is raised when elements are loaded into a set and the kernel memory the set is
+// estimated to take by EstimateSetMemory reaches the threshold set by WithSetMemoryWarning.
+type SetMemoryWarning struct {
+	Table    string
+	Set      string
+	Elements int
+	Bytes    uint64
+}
+
+func (w *SetMemoryWarning) Error() string {
+	return fmt.Sprintf("set %s of table %s with %d elements is estimated to take %d bytes of kernel memory",
+		w.Set, w.Table, w.Elements, w.Bytes)
+}
+
+// WithSetMemoryWarning sets the estimated memory of a set above which helpers loading elements into sets
+// of the table, like Blocklist, ServiceDispatcher, geo sets and ApplyRuleset, raise SetMemoryWarning.
+// The warning is passed to the handler set by WithWarningHandler, DefaultSetMemoryWarning is used by default.
+func WithSetMemoryWarning(bytes uint64) TableOption {
+	return func(o *tableOptions) {
+		o.setMemoryWarning = bytes
+	}
+}
+
+// setMemoryThreshold returns the estimated memory of a set above which SetMemoryWarning is raised
+func (o *tableOptions) setMemoryThreshold() uint64 {
+	if o == nil {
+		return DefaultSetMemoryWarning
+	}
+	o.Lock()
+	defer o.Unlock()
+	if o.setMemoryWarning == 0 {
+		return DefaultSetMemoryWarning
+	}
+
+	return o.setMemoryWarning
+}
+
+// Stats returns counts of chains, rules, sets and elements of sets of tables of the family programmed
+// on the host, tables of all families are returned when the family is unspecified. Tables are sorted
+// the same way as by List. Elements of sets are counted while they are dumped, they are not kept.
+func (nft *nfTables) Stats(familyType nftables.TableFamily) ([]*TableStats, error) {
+	var tables []*nftables.Table
+	if err := nft.reads.do(func() (err error) {
+		tables, _, err = listTables(nft.conn, listFilter{family: familyType})
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	var chains []*nftables.Chain
+	if err := nft.reads.do(func() (err error) {
+		chains, _, err = listChains(nft.conn, listFilter{family: familyType})
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	stats := make([]*TableStats, 0, len(tables))
+	for _, t := range tables {
+		ts := &TableStats{Name: t.Name, Family: t.Family}
+		for _, c := range chains {
+			if c.Table.Name != t.Name || c.Table.Family != t.Family {
+				continue
+			}
+			ts.Chains++
+			var rules []*nftables.Rule
+			if err := nft.reads.do(func() (err error) {
+				rules, err = nft.conn.GetRule(t, c)
+				return err
+			}); err != nil {
+				return nil, fmt.Errorf("failed to get rules of chain %s of table %s with error: %+v", c.Name, t.Name, err)
+			}
+			ts.Rules += len(rules)
+		}
+		var sets []*nftables.Set
+		if err := nft.reads.do(func() (err error) {
+			sets, err = getSets(nft.conn, t)
+			return err
+		}); err != nil {
+			return nil, fmt.Errorf("failed to get sets of table %s with error: %+v", t.Name, err)
+		}
+		ts.Sets = len(sets)
+		for _, s := range sets {
+			s.Table = t
+			var n int
+			if err := nft.reads.do(func() (err error) {
+				n, err = countSetElements(nft.conn, s)
+				return err
+			}); err != nil {
+				return nil, fmt.Errorf("failed to get elements of set %s of table %s with error: %+v", s.Name, t.Name, err)
+			}
+			ts.Elements += n
+		}
+		stats = append(stats, ts)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Family != stats[j].Family {
+			return stats[i].Family < stats[j].Family
+		}
+		return stats[i].Name < stats[j].Name
+	})
+
+	return stats, nil
+}
+
+// countSetElements returns the number of elements of the set programmed on the host, elements
+// dumped by the library are counted without being collected.
+func countSetElements(conn NetNS, set *nftables.Set) (int, error) {
+	c, ok := readConn(conn).(*nftables.Conn)
+	if !ok {
+		elements, err := conn.GetSetElements(set)
+		return len(elements), err
+	}
+	n := 0
+	if err := dumpSetElements(c, set, func(nftables.SetElement) error {
+		n++
+		return nil
+	}); err != nil {
+		return 0, err
+	}
+
+	return n, nil
+}
+
+// Sizes of kernel structures used by EstimateSetMemory, they approximate a 64 bit kernel
+const (
+	// setBaseMemory is taken by the set and private data of its backend regardless of elements
+	setBaseMemory = 1024
+	// setExtHeader is the header of extensions of the element and the pointer to its expressions
+	setExtHeader = 16
+	// setTimeoutExt carries the timeout and the expiration of the element
+	setTimeoutExt = 16
+	// setVerdictData is the size of the verdict stored by elements of verdict maps
+	setVerdictData = 16
+	// setBucketSize is the size of a pointer of hash buckets
+	setBucketSize = 8
+	// Headers of elements of backends linking elements into their structures
+	rhashElemHeader  = 16
+	hashElemHeader   = 16
+	rbtreeElemHeader = 24
+	bitmapElemHeader = 16
+	pipapoElemHeader = 8
+)
+
+// EstimateSetMemory returns an estimate of the kernel memory in bytes a set with the attributes takes
+// when it carries nElements elements, an interval counts as two elements, its start and its end.
+// The estimate follows the backend the kernel selects with the default performance policy, sets of
+// the library are created with it: intervals of concatenations are kept by pipapo, other intervals
+// by rbtree, sets of keys up to 2 bytes without data and timeouts by bitmap, constant sets by a fixed
+// size hash and others by a resizable hash. Elements are rounded up to sizes of kernel allocations.
+// The estimate is a heuristic, it is meant for capacity planning and it never decreases as elements
+// are added.
+func EstimateSetMemory(attrs *SetAttributes, nElements int) uint64 {
+	if attrs == nil || nElements < 0 {
+		return 0
+	}
+	n := uint64(nElements)
+	keyLen := uint64(attrs.KeyType.Bytes)
+	fields := uint64(len(splitSetDatatype(attrs.KeyType.GetNFTMagic())))
+	if fields == 0 {
+		fields = 1
+	}
+	// Keys are kept in 4 bytes registers
+	ext := setExtHeader + alignSize(keyLen, 4)
+	if attrs.IsMap {
+		if attrs.DataType.GetNFTMagic() == nftables.TypeVerdict.GetNFTMagic() {
+			ext += setVerdictData
+		} else {
+			ext += alignSize(uint64(attrs.DataType.Bytes), 4)
+		}
+	}
+	if attrs.HasTimeout {
+		ext += setTimeoutExt
+	}
+	ext = alignSize(ext, 8)
+	switch {
+	case attrs.Interval && fields > 1:
+		// Lookup tables carry a bit per element for each 4 bits group of the key, the tables are cloned
+		// for transactions, mapping tables carry a start and a length per field.
+		return setBaseMemory + n*(slabSize(pipapoElemHeader+ext)+keyLen*8+fields*16)
+	case attrs.Interval:
+		return setBaseMemory + n*slabSize(rbtreeElemHeader+ext)
+	case keyLen != 0 && keyLen <= 2 && !attrs.IsMap && !attrs.HasTimeout:
+		// The bitmap carries two bits for each value of the key, generation masks of the element
+		bitmap := (uint64(1) << (keyLen * 8)) * 2 / 8
+		return setBaseMemory + bitmap + n*slabSize(bitmapElemHeader+ext)
+	case attrs.Constant:
+		return setBaseMemory + hashBuckets(n)*setBucketSize + n*slabSize(hashElemHeader+ext)
+	}
+
+	return setBaseMemory + hashBuckets(n)*setBucketSize + n*slabSize(rhashElemHeader+ext)
+}
+
+// alignSize rounds n up to the multiple of a
+func alignSize(n, a uint64) uint64 {
+	return (n + a - 1) / a * a
+}
+
+// hashBuckets returns the number of buckets of a hash keeping its load under 75%
+func hashBuckets(n uint64) uint64 {
+	b := uint64(4)
+	for b*3/4 < n {
+		b <<= 1
+	}
+
+	return b
+}
+
+// slabSize returns the size of the kernel allocation of n bytes
+func slabSize(n uint64) uint64 {
+	for _, s := range []uint64{8, 16, 32, 64, 96, 128, 192, 256, 512, 1024, 2048, 4096} {
+		if n <= s {
+			return s
+		}
+	}
+
+	return alignSize(n, 4096)
+}
+
+// setAttributes returns attributes of the set passed to EstimateSetMemory
+func setAttributes(set *nftables.Set) *SetAttributes {
+	return &SetAttributes{
+		Name:       set.Name,
+		Constant:   set.Constant,
+		IsMap:      set.IsMap,
+		HasTimeout: set.HasTimeout,
+		Timeout:    set.Timeout,
+		Interval:   set.Interval,
+		KeyType:    set.KeyType,
+		DataType:   set.DataType,
+	}
+}
+
+// warnSetMemory raises SetMemoryWarning when the set with nElements elements is estimated to take
+// at least the threshold of the table, nothing is raised when the table has no warning handler.
+func (nfs *nfSets) warnSetMemory(set *nftables.Set, nElements int) {
+	h := nfs.opts.warningHandler()
+	if h == nil {
+		return
+	}
+	if b := EstimateSetMemory(setAttributes(set), nElements); b >= nfs.opts.setMemoryThreshold() {
+		h(&SetMemoryWarning{Table: nfs.table.Name, Set: set.Name, Elements: nElements, Bytes: b})
+	}
+}
+
+// warnSetLoad raises SetMemoryWarning before nElements elements are loaded into the set by helpers
+// operating on SetsInterface, sets of stores other than the library's are not checked.
+func warnSetLoad(si SetsInterface, name string, nElements int) {
+	nfs, ok := si.(*nfSets)
+	if !ok {
+		return
+	}
+	if set, ok := nfs.get(name); ok {
+		nfs.warnSetMemory(set, nElements)
+	}
+}
@@ -0,0 +1,66 @@
+package nftableslib
+
+import (
+	"testing"
+
+	"github.com/google/nftables"
+)
+
+func TestEstimateSetMemory(t *testing.T) {
+	tests := []struct {
+		name  string
+		attrs *SetAttributes
+	}{
+		{
+			name:  "hash of ipv4 addresses",
+			attrs: &SetAttributes{KeyType: nftables.TypeIPAddr},
+		},
+		{
+			name:  "constant hash of ipv6 addresses",
+			attrs: &SetAttributes{Constant: true, KeyType: nftables.TypeIP6Addr},
+		},
+		{
+			name:  "bitmap of ports",
+			attrs: &SetAttributes{KeyType: nftables.TypeInetService},
+		},
+		{
+			name:  "verdict map of ports with timeouts",
+			attrs: &SetAttributes{IsMap: true, HasTimeout: true, KeyType: nftables.TypeInetService, DataType: nftables.TypeVerdict},
+		},
+		{
+			name:  "intervals of ipv4 addresses",
+			attrs: &SetAttributes{Interval: true, KeyType: nftables.TypeIPAddr},
+		},
+		{
+			name: "intervals of concatenations",
+			attrs: &SetAttributes{Interval: true,
+				KeyType: GenSetKeyType(nftables.TypeIPAddr, nftables.TypeInetProto, nftables.TypeInetService)},
+		},
+	}
+	for _, tt := range tests {
+		prev := EstimateSetMemory(tt.attrs, 0)
+		if prev == 0 {
+			t.Fatalf("Test \"%s\" failed, empty set is expected to take memory", tt.name)
+		}
+		for _, n := range []int{1, 2, 3, 10, 100, 1000, 50000, 500000} {
+			b := EstimateSetMemory(tt.attrs, n)
+			if b < prev {
+				t.Fatalf("Test \"%s\" failed, estimate of %d elements %d is less than estimate of fewer elements %d", tt.name, n, b, prev)
+			}
+			prev = b
+		}
+		if prev < 500000*16 {
+			t.Fatalf("Test \"%s\" failed, estimate of 500000 elements %d is below 16 bytes per element", tt.name, prev)
+		}
+	}
+	// Data and timeouts of elements take memory
+	plain := EstimateSetMemory(&SetAttributes{KeyType: nftables.TypeIPAddr}, 100000)
+	mapped := EstimateSetMemory(&SetAttributes{IsMap: true, KeyType: nftables.TypeIPAddr, DataType: nftables.TypeIP6Addr}, 100000)
+	timed := EstimateSetMemory(&SetAttributes{IsMap: true, HasTimeout: true, KeyType: nftables.TypeIPAddr, DataType: nftables.TypeIP6Addr}, 100000)
+	if plain > mapped || mapped > timed || plain >= timed {
+		t.Fatalf("expected estimates to grow with data and timeouts, got %d, %d and %d", plain, mapped, timed)
+	}
+	if EstimateSetMemory(nil, 10) != 0 || EstimateSetMemory(&SetAttributes{KeyType: nftables.TypeIPAddr}, -1) != 0 {
+		t.Fatalf("invalid input is expected to be estimated as 0")
+	}
+}
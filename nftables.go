@@ -4,44 +4,110 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/google/nftables"
 	"golang.org/x/sys/unix"
 )
 
-// TablesInterface defines a top level interface
+// TablesInterface defines a top level interface, it is safe for concurrent use by multiple goroutines.
+// Changes queued by non immediate operations are kept by the connection, they are flushed by any
+// goroutine flushing the connection, so goroutines sharing the interface should use immediate operations
+// or Commit. Operations of tables of different families run in parallel, operations changing the store of
+// tables of the same family are serialized, operations on the whole ruleset, like Snapshot, Rollback and
+// Restore, wait for operations on tables of all families.
 type TablesInterface interface {
 	Tables() TableFuncs
 }
 
-// TableFuncs defines second level interface operating with nf tables
+// TableFuncs defines second level interface operating with nf tables, the host is never read or
+// programmed while the store of all tables is locked, lookups of tables' interfaces do not wait for
+// operations reading or programming the host.
 type TableFuncs interface {
 	Table(name string, familyType nftables.TableFamily) (ChainsInterface, error)
 	TableChains(name string, familyType nftables.TableFamily) (ChainsInterface, error)
 	TableSets(name string, familyType nftables.TableFamily) (SetsInterface, error)
-	Create(name string, familyType nftables.TableFamily) error
-	Delete(name string, familyType nftables.TableFamily) error
-	CreateImm(name string, familyType nftables.TableFamily) error
-	DeleteImm(name string, familyType nftables.TableFamily) error
+	TableObjects(name string, familyType nftables.TableFamily) (ObjectsInterface, error)
+	Create(name string, familyType nftables.TableFamily, opts ...TableOption) error
+	Delete(name string, familyType nftables.TableFamily, force ...bool) error
+	CreateImm(name string, familyType nftables.TableFamily, opts ...TableOption) error
+	DeleteImm(name string, familyType nftables.TableFamily, force ...bool) error
 	Exist(name string, familyType nftables.TableFamily) bool
 	Get(familyType nftables.TableFamily) ([]string, error)
-	Sync(familyType nftables.TableFamily) error
+	GetByPrefix(familyType nftables.TableFamily, prefix string) ([]string, error)
+	List(familyType nftables.TableFamily) ([]*TableInfo, error)
+	Stats(familyType nftables.TableFamily) ([]*TableStats, error)
+	CopySet(src, dst *nftables.Table, name string) (*nftables.Set, error)
+	Sync(familyType nftables.TableFamily) (*SyncReport, error)
+	SyncTable(name string, familyType nftables.TableFamily) (*SyncReport, error)
 	Dump() ([]byte, error)
+	DumpTable(name string, familyType nftables.TableFamily, opts *DumpOptions) ([]byte, error)
+	Pending() (*PendingObjects, error)
+	Snapshot() (*Snapshot, error)
+	Rollback(*Snapshot) error
+	Restore(*Snapshot, *RestoreOptions) error
+	ConfirmOrRollback(apply func() error, timeout time.Duration, probe func() bool) error
+	KernelFeatures() (*KernelFeatures, error)
+	AuditRuleset() (*AuditReport, error)
+	AuditHookPriorities() (*HookPriorityReport, error)
+	DetectIptablesNft() (*IptablesNftReport, error)
+	Verify() (*DriftReport, error)
+	RepairDrift(*DriftReport) error
+	Commit() error
+	ApplyRuleset(*RulesetSpec) error
+	GetGenID() (uint32, error)
+	ChangedSince(gen uint32) (bool, error)
+}
+
+// ErrNotConfirmed is returned by ConfirmOrRollback when the change was not confirmed
+// by the probe and the ruleset was rolled back.
+var ErrNotConfirmed = errors.New("change was not confirmed, ruleset was rolled back")
+
+// ErrNotOwned is returned when a table which was not created by Create or CreateImm of the same
+// instance is deleted without force, tables of other software are not deleted by mistake.
+type ErrNotOwned struct {
+	Table  string
+	Family nftables.TableFamily
+}
+
+func (e *ErrNotOwned) Error() string {
+	return fmt.Sprintf("table %s of family %s is not owned by the library", e.Table, familyName(e.Family))
 }
 
 type nfTables struct {
 	conn NetNS
+	// Mutex guards tables and deleted maps, it is never held while the host is read or programmed
 	sync.Mutex
 	// Two dimensional map, 1st key is table family, 2nd key is table name
 	tables map[nftables.TableFamily]map[string]*nfTable
+	// deleted carries tables which deletion is queued but the host still reports them
+	deleted map[nftables.TableFamily]map[string]bool
+	// owned carries tables created by Create or CreateImm, it survives rebuilds of the store from the host
+	owned map[nftables.TableFamily]map[string]bool
+	// families serializes operations on tables of the same family, operations on the whole ruleset lock all families
+	families familyLocks
+	// reads defines how interrupted dumps are repeated
+	reads *readPolicy
+	// features detects features of the kernel of the connection
+	features *featureProbe
+	// expiry deletes rules created by CreateWithTTL when their TTL elapses
+	expiry *expiryScheduler
+	// ids generates IDs and names of sets and chains built by the library
+	ids IDGenerator
 }
 
 // nfTable defines a single type/name nf table with its linked chains
 type nfTable struct {
 	table *nftables.Table
+	opts  *tableOptions
+	// pending is true while the table's creation is queued and the host does not report it
+	pending bool
 	ChainsInterface
 	SetsInterface
+	ObjectsInterface
 }
 
 // Tables returns methods available for managing nf tables
@@ -59,7 +125,7 @@ func (nft *nfTables) Table(name string, familyType nftables.TableFamily) (Chains
 
 	}
 
-	return nil, fmt.Errorf("table %s of type %v does not exist", name, familyType)
+	return nil, fmt.Errorf("table %s %s does not exist", familyName(familyType), name)
 }
 
 // TableChains returns Chains Interface for a specific table
@@ -72,7 +138,7 @@ func (nft *nfTables) TableChains(name string, familyType nftables.TableFamily) (
 
 	}
 
-	return nil, fmt.Errorf("table %s of type %v does not exist", name, familyType)
+	return nil, fmt.Errorf("table %s %s does not exist", familyName(familyType), name)
 }
 
 // TableChains returns Chains Interface for a specific table
@@ -85,14 +151,34 @@ func (nft *nfTables) TableSets(name string, familyType nftables.TableFamily) (Se
 
 	}
 
-	return nil, fmt.Errorf("table %s of type %v does not exist", name, familyType)
+	return nil, fmt.Errorf("table %s %s does not exist", familyName(familyType), name)
 }
 
-// Create appends a table into NF tables list
-func (nft *nfTables) Create(name string, familyType nftables.TableFamily) error {
+// TableObjects returns Objects Interface for a specific table
+func (nft *nfTables) TableObjects(name string, familyType nftables.TableFamily) (ObjectsInterface, error) {
 	nft.Lock()
 	defer nft.Unlock()
-	nft.conn.AddTable(nft.create(name, familyType).table)
+	if t, ok := nft.tables[familyType][name]; ok {
+		return t.ObjectsInterface, nil
+	}
+
+	return nil, fmt.Errorf("table %s %s does not exist", familyName(familyType), name)
+}
+
+// Create appends a table into NF tables list
+func (nft *nfTables) Create(name string, familyType nftables.TableFamily, opts ...TableOption) error {
+	if err := writable(nft.conn); err != nil {
+		return err
+	}
+	unlock := nft.families.lock(familyType)
+	defer unlock()
+	nft.Lock()
+	nt := nft.create(name, familyType)
+	nt.pending = true
+	nft.own(name, familyType)
+	nft.Unlock()
+	nt.opts.apply(opts)
+	nft.conn.AddTable(nt.table)
 
 	return nil
 }
@@ -112,70 +198,152 @@ func (nft *nfTables) create(name string, familyType nftables.TableFamily) *nfTab
 		// First table for familyType, allocating memory
 		nft.tables[familyType] = make(map[string]*nfTable)
 	}
+	delete(nft.deleted[familyType], name)
 
 	t := &nftables.Table{
 		Family: familyType,
 		Name:   name,
 	}
+	opts := &tableOptions{reads: nft.reads, features: nft.features, expiry: nft.expiry, ids: nft.ids}
+	sets := newSets(nft.conn, t, opts)
 	nft.tables[familyType][name] = &nfTable{
-		table:           t,
-		ChainsInterface: newChains(nft.conn, t),
-		SetsInterface:   newSets(nft.conn, t),
+		table:            t,
+		opts:             opts,
+		ChainsInterface:  newChains(nft.conn, t, opts, sets),
+		SetsInterface:    sets,
+		ObjectsInterface: newObjects(nft.conn, t),
 	}
 
 	return nft.tables[familyType][name]
 }
 
 // Create appends a table into NF tables list and request to program it immediately
-func (nft *nfTables) CreateImm(name string, familyType nftables.TableFamily) error {
+func (nft *nfTables) CreateImm(name string, familyType nftables.TableFamily, opts ...TableOption) error {
+	if err := writable(nft.conn); err != nil {
+		return err
+	}
+	unlock := nft.families.lock(familyType)
+	defer unlock()
 	nft.Lock()
-	defer nft.Unlock()
-	nft.conn.AddTable(nft.create(name, familyType).table)
-	err := nft.conn.Flush()
+	nt := nft.create(name, familyType)
+	nft.own(name, familyType)
+	nft.Unlock()
+	nt.opts.apply(opts)
+	nft.conn.AddTable(nt.table)
+	err := flush(nft.conn)
 	// If the error indicates that the table already exists, then consider it as a non error
-	if errors.Is(err, unix.EEXIST) {
+	if err == nil || errors.Is(err, unix.EEXIST) {
+		nft.Lock()
+		nt.pending = false
+		nft.Unlock()
 		return nil
 	}
 
 	return err
 }
 
-// DeleteImm requests nftables module to remove a specified table from the kernel and from NF tables list
-func (nft *nfTables) DeleteImm(name string, familyType nftables.TableFamily) error {
-	if err := nft.Delete(name, familyType); err != nil {
+// own marks the table as created by the library, it expects nft to be locked
+func (nft *nfTables) own(name string, familyType nftables.TableFamily) {
+	if nft.owned[familyType] == nil {
+		nft.owned[familyType] = make(map[string]bool)
+	}
+	nft.owned[familyType][name] = true
+}
+
+// DeleteImm requests nftables module to remove a specified table from the kernel and from NF tables list.
+// Tables which were not created by Create or CreateImm are not deleted unless force is true,
+// ErrNotOwned is returned for them.
+func (nft *nfTables) DeleteImm(name string, familyType nftables.TableFamily, force ...bool) error {
+	if err := writable(nft.conn); err != nil {
+		return err
+	}
+	unlock := nft.families.lock(familyType)
+	defer unlock()
+	if err := nft.delete(name, familyType, len(force) != 0 && force[0]); err != nil {
+		return err
+	}
+	if err := flush(nft.conn); err != nil {
+		return err
+	}
+	nft.Lock()
+	delete(nft.deleted[familyType], name)
+	delete(nft.owned[familyType], name)
+	nft.Unlock()
+
+	return nil
+}
+
+// Delete removes a specified table from NF tables list, the table is queued for deletion
+// if it is in the store, its creation might be queued too, or if it exists on the host.
+// Tables which were not created by Create or CreateImm are not deleted unless force is true.
+func (nft *nfTables) Delete(name string, familyType nftables.TableFamily, force ...bool) error {
+	if err := writable(nft.conn); err != nil {
 		return err
 	}
+	unlock := nft.families.lock(familyType)
+	defer unlock()
+	if err := nft.delete(name, familyType, len(force) != 0 && force[0]); err != nil {
+		return err
+	}
+	nft.Lock()
+	delete(nft.owned[familyType], name)
+	nft.Unlock()
 
-	return nft.conn.Flush()
+	return nil
 }
 
-// Delete removes a specified table from NF tables list
-func (nft *nfTables) Delete(name string, familyType nftables.TableFamily) error {
+// delete queues deletion of the table, existence and ownership of the table are checked
+// before the table is removed from the store.
+func (nft *nfTables) delete(name string, familyType nftables.TableFamily, force bool) error {
+	exist := nft.exist(name, familyType)
 	nft.Lock()
 	defer nft.Unlock()
-	// Check if nf table with the same family type and name  already exists
-	if _, ok := nft.tables[familyType][name]; ok {
-		// Removing old table, at this point, this table should be removed from the kernel as well.
-		delete(nft.tables[familyType], name)
+	if !exist {
+		nft.removeTable(name, familyType)
+		return nil
+	}
+	if !force && !nft.owned[familyType][name] {
+		return &ErrNotOwned{Table: name, Family: familyType}
 	}
-	if nft.Tables().Exist(name, familyType) {
-		nft.conn.DelTable(&nftables.Table{
-			Name:   name,
-			Family: familyType,
-		})
+	nft.conn.DelTable(&nftables.Table{
+		Name:   name,
+		Family: familyType,
+	})
+	if nft.deleted[familyType] == nil {
+		nft.deleted[familyType] = make(map[string]bool)
 	}
+	nft.deleted[familyType][name] = true
+	// Removing old table, at this point, this table should be removed from the kernel as well.
+	nft.removeTable(name, familyType)
+
+	return nil
+}
+
+// removeTable removes the table from the store, it expects nft to be locked
+func (nft *nfTables) removeTable(name string, familyType nftables.TableFamily) {
+	delete(nft.tables[familyType], name)
 	// If no more tables exists under a specific family name, removing  family type.
 	if len(nft.tables[familyType]) == 0 {
 		delete(nft.tables, familyType)
 	}
-
-	return nil
 }
 
-// Exist checks is the table already defined
+// Exist checks is the table already defined, tables queued for creation exist
+// and tables queued for deletion do not exist, even before the batch is flushed.
 func (nft *nfTables) Exist(name string, familyType nftables.TableFamily) bool {
+	unlock := nft.families.lock(familyType)
+	defer unlock()
+
+	return nft.exist(name, familyType)
+}
+
+// exist expects the family to be locked
+func (nft *nfTables) exist(name string, familyType nftables.TableFamily) bool {
 	// Check if Table exists in the store
-	if _, ok := nft.tables[familyType][name]; ok {
+	nft.Lock()
+	_, ok := nft.tables[familyType][name]
+	nft.Unlock()
+	if ok {
 		return true
 	}
 	// It is not in the store, let's double check if it exists on the host
@@ -183,87 +351,304 @@ func (nft *nfTables) Exist(name string, familyType nftables.TableFamily) bool {
 	if err != nil {
 		return false
 	}
+	nft.Lock()
+	defer nft.Unlock()
 	for _, table := range tables {
 		if table == name {
-			return true
+			// The host reports the table until queued deletion is flushed
+			return !nft.deleted[familyType][name]
 		}
 	}
+	delete(nft.deleted[familyType], name)
 
 	return false
 }
 
 // Get returns all tables defined for a specific TableFamily
 func (nft *nfTables) Get(familyType nftables.TableFamily) ([]string, error) {
-	nft.Lock()
-	defer nft.Unlock()
-
 	return nft.get(familyType)
 }
 
 func (nft *nfTables) get(familyType nftables.TableFamily) ([]string, error) {
-	nftables, err := nft.conn.ListTables()
+	return nft.getByPrefix(familyType, "")
+}
+
+// GetByPrefix returns tables of a specific TableFamily which names start with the prefix,
+// tables of other families are filtered by the kernel.
+func (nft *nfTables) GetByPrefix(familyType nftables.TableFamily, prefix string) ([]string, error) {
+	return nft.getByPrefix(familyType, prefix)
+}
+
+func (nft *nfTables) getByPrefix(familyType nftables.TableFamily, prefix string) ([]string, error) {
+	nftables, _, err := listTables(nft.conn, listFilter{family: familyType, prefix: prefix})
 	if err != nil {
 		return nil, err
 	}
 
 	var tables []string
 	for _, t := range nftables {
-		if t.Family == familyType {
-			tables = append(tables, t.Name)
-		}
+		tables = append(tables, t.Name)
 	}
 
 	return tables, nil
 }
 
+// DefaultSyncConcurrency defines a number of tables synchronized in parallel by Sync
+const DefaultSyncConcurrency = 8
+
+// SyncCounters defines numbers of objects per kind
+type SyncCounters struct {
+	Tables int
+	Chains int
+	Sets   int
+	Rules  int
+}
+
+// SyncReport describes changes of the store made by Sync, Errors carries errors of
+// the tables which failed to be synchronized, keyed by the table name. Skipped counts
+// foreign tables and chains which were listed from the host but not loaded, objects
+// filtered out by the kernel are not counted.
+type SyncReport struct {
+	Added   SyncCounters
+	Removed SyncCounters
+	Skipped SyncCounters
+	Errors  map[string]error
+	// family is the family of synchronized tables, errors name tables along with it
+	family nftables.TableFamily
+}
+
+func (r *SyncReport) merge(o *SyncReport) {
+	r.Added.Tables += o.Added.Tables
+	r.Added.Chains += o.Added.Chains
+	r.Added.Sets += o.Added.Sets
+	r.Added.Rules += o.Added.Rules
+	r.Removed.Tables += o.Removed.Tables
+	r.Removed.Chains += o.Removed.Chains
+	r.Removed.Sets += o.Removed.Sets
+	r.Removed.Rules += o.Removed.Rules
+	r.Skipped.Tables += o.Skipped.Tables
+	r.Skipped.Chains += o.Skipped.Chains
+	r.Skipped.Sets += o.Skipped.Sets
+	r.Skipped.Rules += o.Skipped.Rules
+}
+
+func (r *SyncReport) err() error {
+	if len(r.Errors) == 0 {
+		return nil
+	}
+	names := make([]string, 0, len(r.Errors))
+	for name := range r.Errors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	msgs := make([]string, 0, len(names))
+	for _, name := range names {
+		msgs = append(msgs, fmt.Sprintf("%s %s: %+v", familyName(r.family), name, r.Errors[name]))
+	}
+	return fmt.Errorf("failed to sync tables: %s", strings.Join(msgs, "; "))
+}
+
 // Sync synchronizes tables defined on the host with tables store, newly discovered
-// tables will be added, stale will be removed fomr the store.
-func (nft *nfTables) Sync(familyType nftables.TableFamily) error {
-	nft.Lock()
-	nftables, err := nft.conn.ListTables()
-	if err != nil {
+// tables, chains and sets will be added, stale will be removed from the store. Tables are
+// synchronized in parallel by up to DefaultSyncConcurrency workers. Sync expects all queued
+// changes to be flushed, otherwise not yet programmed objects are considered stale.
+func (nft *nfTables) Sync(familyType nftables.TableFamily) (*SyncReport, error) {
+	// Tables of different families can share the name, they are stored per family
+	if familyType == unix.NFPROTO_UNSPEC {
+		return nil, fmt.Errorf("table family must be specified")
+	}
+	unlock := nft.families.lock(familyType)
+	defer unlock()
+	var tables []*nftables.Table
+	var skippedTables int
+	if err := nft.reads.do(func() (err error) {
+		tables, skippedTables, err = listTables(nft.conn, listFilter{family: familyType})
 		return err
+	}); err != nil {
+		return nil, err
+	}
+	var chains []*nftables.Chain
+	var skippedChains int
+	if err := nft.reads.do(func() (err error) {
+		chains, skippedChains, err = listChains(nft.conn, listFilter{family: familyType})
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	report := &SyncReport{Errors: make(map[string]error), family: familyType}
+	report.Skipped.Tables, report.Skipped.Chains = skippedTables, skippedChains
+	// Chains are grouped by table, so every table goes only through its own chains
+	tableChains := make(map[string][]*nftables.Chain)
+	for _, c := range chains {
+		tableChains[tableName(c.Table)] = append(tableChains[tableName(c.Table)], c)
+	}
+	onHost := make(map[string]bool)
+	pending := make([]*nfTable, 0)
+	nft.Lock()
+	// Sync expects queued changes to be flushed, the host is the source of truth
+	delete(nft.deleted, familyType)
+	for _, t := range tables {
+		onHost[t.Name] = true
+		nt, ok := nft.tables[familyType][t.Name]
+		if !ok {
+			nt = nft.create(t.Name, t.Family)
+			report.Added.Tables++
+		}
+		nt.pending = false
+		pending = append(pending, nt)
+	}
+	for name := range nft.tables[familyType] {
+		if !onHost[name] {
+			delete(nft.tables[familyType], name)
+			report.Removed.Tables++
+		}
+	}
+	if len(nft.tables[familyType]) == 0 {
+		delete(nft.tables, familyType)
 	}
 	nft.Unlock()
 
-	// Getting  list of tables defined on the host
-	for _, t := range nftables {
-		if t.Family == familyType {
-			if _, ok := nft.tables[familyType][t.Name]; !ok {
-				nt := nft.create(t.Name, t.Family)
-				// Sync synchronizes all chains discovered in the table
-				if err := nt.Chains().Sync(); err != nil {
-					return err
-				}
-				// Sync synchronizes all sets discovered in the table
-				if err := nt.Sets().Sync(); err != nil {
-					return err
-				}
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	sem := make(chan struct{}, DefaultSyncConcurrency)
+	for _, nt := range pending {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(nt *nfTable) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			r, err := nt.sync(tableChains[tableName(nt.table)])
+			mu.Lock()
+			defer mu.Unlock()
+			report.merge(r)
+			if err != nil {
+				report.Errors[nt.table.Name] = err
 			}
+		}(nt)
+	}
+	wg.Wait()
+
+	return report, report.err()
+}
+
+// SyncTable synchronizes a single table with the store, if the table is not found on the host,
+// it is removed from the store.
+func (nft *nfTables) SyncTable(name string, familyType nftables.TableFamily) (*SyncReport, error) {
+	if familyType == unix.NFPROTO_UNSPEC {
+		return nil, fmt.Errorf("table family must be specified")
+	}
+	unlock := nft.families.lock(familyType)
+	defer unlock()
+	var tables []*nftables.Table
+	var skipped int
+	if err := nft.reads.do(func() (err error) {
+		tables, skipped, err = listTables(nft.conn, listFilter{family: familyType})
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	report := &SyncReport{Errors: make(map[string]error), family: familyType}
+	found := false
+	for _, t := range tables {
+		if t.Name == name {
+			found = true
+			continue
 		}
+		skipped++
+	}
+	report.Skipped.Tables = skipped
+	nft.Lock()
+	delete(nft.deleted[familyType], name)
+	nt, ok := nft.tables[familyType][name]
+	switch {
+	case !found && ok:
+		delete(nft.tables[familyType], name)
+		if len(nft.tables[familyType]) == 0 {
+			delete(nft.tables, familyType)
+		}
+		report.Removed.Tables++
+	case found && !ok:
+		nt = nft.create(name, familyType)
+		report.Added.Tables++
+	}
+	if found {
+		nt.pending = false
+	}
+	nft.Unlock()
+	if !found {
+		return report, nil
+	}
+	var chains []*nftables.Chain
+	if err := nft.reads.do(func() (err error) {
+		chains, skipped, err = listChains(nft.conn, listFilter{family: familyType, table: name})
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	report.Skipped.Chains = skipped
+	r, err := nt.sync(chains)
+	report.merge(r)
+	if err != nil {
+		report.Errors[name] = err
 	}
 
-	return nil
+	return report, report.err()
+}
+
+// sync synchronizes chains, rules and sets of the table, stale chains and sets are removed
+func (nt *nfTable) sync(chains []*nftables.Chain) (*SyncReport, error) {
+	report := &SyncReport{}
+	if err := nt.ChainsInterface.(*nfChains).sync(chains, report, true); err != nil {
+		return report, err
+	}
+	if err := nt.SetsInterface.(*nfSets).sync(report, true); err != nil {
+		return report, err
+	}
+
+	return report, nil
 }
 
 // Dump outputs json representation of all defined tables/chains/rules
 func (nft *nfTables) Dump() ([]byte, error) {
-	nft.Lock()
-	defer nft.Unlock()
 	var data []byte
-
+	// Use of tables is reported by the host, the store does not track it
+	var host []*nftables.Table
+	if err := nft.reads.do(func() (err error) {
+		host, _, err = listTables(nft.conn, listFilter{})
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	uses := make(map[nftables.TableFamily]map[string]uint32)
+	for _, t := range host {
+		if uses[t.Family] == nil {
+			uses[t.Family] = make(map[string]uint32)
+		}
+		uses[t.Family][t.Name] = t.Use
+	}
+	nft.Lock()
+	tables := make([]*nfTable, 0)
 	for _, f := range nft.tables {
 		for _, t := range f {
-			if b, err := json.Marshal(&t.table); err != nil {
-				return nil, err
-			} else {
-				data = append(data, b...)
-			}
-			if b, err := t.Chains().Dump(); err != nil {
-				return nil, err
-			} else {
-				data = append(data, b...)
-			}
+			tables = append(tables, t)
+		}
+	}
+	nft.Unlock()
+
+	for _, t := range tables {
+		table := *t.table
+		table.Use = uses[table.Family][table.Name]
+		if b, err := json.Marshal(&table); err != nil {
+			return nil, err
+		} else {
+			data = append(data, b...)
+		}
+		if b, err := t.Chains().Dump(); err != nil {
+			return nil, err
+		} else {
+			data = append(data, b...)
 		}
 	}
 
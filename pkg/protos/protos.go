@@ -0,0 +1,207 @@
+// Package protos provides matches of headers of protocols carried by the payload of ip packets, offsets
+// and masks of the headers are built in, so rules do not need to load raw data at hand coded offsets.
+// Matches are loaded relative to the transport header, the kernel locates it honoring IPv4 options and
+// IPv6 extension headers.
+package protos
+
+import (
+	"fmt"
+
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"github.com/sbezverk/nftableslib"
+	"golang.org/x/sys/unix"
+)
+
+// udpHeaderLen is the length of udp header preceding headers of protocols carried by udp
+const udpHeaderLen = 8
+
+// Matcher defines a match of the header of the protocol
+type Matcher interface {
+	// L4Proto returns the ip protocol carrying the header
+	L4Proto() uint8
+	// Exprs returns expressions matching the header, they start with the match of the ip protocol
+	Exprs() ([]expr.Any, error)
+}
+
+// Apply appends expressions of the match to RawExprs of the rule, L4 of the rule must either be nil
+// or match the ip protocol carrying the header.
+func Apply(rule *nftableslib.Rule, m Matcher) error {
+	if rule == nil {
+		return fmt.Errorf("rule cannot be nil")
+	}
+	if err := validateContext(rule, m.L4Proto()); err != nil {
+		return err
+	}
+	re, err := m.Exprs()
+	if err != nil {
+		return err
+	}
+	rule.RawExprs = append(rule.RawExprs, re...)
+
+	return nil
+}
+
+// validateContext checks that the rule does not match other ip protocol than the one carrying the header
+func validateContext(rule *nftableslib.Rule, l4proto uint8) error {
+	if rule.L4 != nil {
+		if rule.L4.L4Proto != l4proto {
+			return fmt.Errorf("match requires l4 protocol %d, but rule matches l4 protocol %d", l4proto, rule.L4.L4Proto)
+		}
+		if rule.L4.Inner != nil {
+			return fmt.Errorf("match of l4 protocol %d cannot be combined with inner header", l4proto)
+		}
+	}
+	if rule.L3 != nil && rule.L3.Protocol != nil && rule.L3.ProtocolRelOp == nftableslib.EQ && *rule.L3.Protocol != uint32(l4proto) {
+		return fmt.Errorf("match requires l4 protocol %d, but rule matches protocol %d", l4proto, *rule.L3.Protocol)
+	}
+
+	return nil
+}
+
+// header returns expressions matching the ip protocol followed by the masked match of the header
+func header(l4proto uint8, offset uint32, mask, value []byte) ([]expr.Any, error) {
+	// [ meta load l4proto => reg 1 ]
+	// [ cmp eq reg 1 l4proto ]
+	re := []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{l4proto}},
+	}
+	m, err := nftableslib.MatchMasked(expr.PayloadBaseTransportHeader, offset, uint32(len(mask)), mask, value, nftableslib.EQ)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(re, m...), nil
+}
+
+// DNS matches flags of DNS header of messages carried by udp, fields which are nil are not matched
+type DNS struct {
+	// QR is true for responses and false for queries
+	QR     *bool
+	Opcode *uint8
+	AA     *bool
+	TC     *bool
+	RD     *bool
+	RA     *bool
+	RCode  *uint8
+}
+
+// dnsFlagsOffset is the offset of flags of DNS header following 2 bytes of the message id
+const dnsFlagsOffset = udpHeaderLen + 2
+
+// L4Proto returns udp, DNS over tcp is not supported as messages are prefixed by their length
+// and tcp header length varies.
+func (d *DNS) L4Proto() uint8 {
+	return unix.IPPROTO_UDP
+}
+
+// Exprs returns expressions matching 2 bytes of flags: QR(0x8000) Opcode(0x7800) AA(0x0400) TC(0x0200)
+// RD(0x0100) RA(0x0080) Z(0x0070) RCODE(0x000f)
+func (d *DNS) Exprs() ([]expr.Any, error) {
+	mask, value := make([]byte, 2), make([]byte, 2)
+	set := false
+	flag := func(b *bool, i int, bit byte) {
+		if b == nil {
+			return
+		}
+		set = true
+		mask[i] |= bit
+		if *b {
+			value[i] |= bit
+		}
+	}
+	flag(d.QR, 0, 0x80)
+	flag(d.AA, 0, 0x04)
+	flag(d.TC, 0, 0x02)
+	flag(d.RD, 0, 0x01)
+	flag(d.RA, 1, 0x80)
+	if d.Opcode != nil {
+		if *d.Opcode > 15 {
+			return nil, fmt.Errorf("invalid dns opcode %d, it must be in range 0-15", *d.Opcode)
+		}
+		set = true
+		mask[0] |= 0x78
+		value[0] |= *d.Opcode << 3
+	}
+	if d.RCode != nil {
+		if *d.RCode > 15 {
+			return nil, fmt.Errorf("invalid dns rcode %d, it must be in range 0-15", *d.RCode)
+		}
+		set = true
+		mask[1] |= 0x0f
+		value[1] |= *d.RCode
+	}
+	if !set {
+		return nil, fmt.Errorf("dns match does not specify any flag")
+	}
+
+	return header(d.L4Proto(), dnsFlagsOffset, mask, value)
+}
+
+// DHCP matches the message type of DHCP messages carried by udp. Options cannot be scanned by
+// expressions, so the message type option must be the first option following the magic cookie,
+// which is where clients and servers commonly put it, messages carrying other options first are not matched.
+type DHCP struct {
+	// MessageType is the value of option 53, 1 discover, 2 offer, 3 request, 5 ack and so on
+	MessageType uint8
+}
+
+// dhcpCookieOffset is the offset of the magic cookie following udp header and 236 bytes of fixed
+// fields of DHCP message, the first option follows the cookie.
+const dhcpCookieOffset = udpHeaderLen + 236
+
+// L4Proto returns udp
+func (d *DHCP) L4Proto() uint8 {
+	return unix.IPPROTO_UDP
+}
+
+// Exprs returns expressions matching the magic cookie 0x63825363 followed by option 53 of length 1
+// carrying the message type.
+func (d *DHCP) Exprs() ([]expr.Any, error) {
+	if d.MessageType == 0 {
+		return nil, fmt.Errorf("dhcp message type cannot be 0")
+	}
+	value := []byte{0x63, 0x82, 0x53, 0x63, 53, 1, d.MessageType}
+	mask := []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+
+	return header(d.L4Proto(), dhcpCookieOffset, mask, value)
+}
+
+// GRE matches the protocol type of GRE header, the ether type of the encapsulated packet
+type GRE struct {
+	Protocol uint16
+}
+
+// L4Proto returns gre
+func (g *GRE) L4Proto() uint8 {
+	return unix.IPPROTO_GRE
+}
+
+// Exprs returns expressions matching 2 bytes of the protocol type following 2 bytes of flags and version
+func (g *GRE) Exprs() ([]expr.Any, error) {
+	if g.Protocol == 0 {
+		return nil, fmt.Errorf("gre protocol cannot be 0")
+	}
+
+	return header(g.L4Proto(), 2, []byte{0xff, 0xff}, binaryutil.BigEndian.PutUint16(g.Protocol))
+}
+
+// ESP matches the security parameters index of ESP header
+type ESP struct {
+	SPI uint32
+}
+
+// L4Proto returns esp, ESP encapsulated in udp is not supported
+func (e *ESP) L4Proto() uint8 {
+	return unix.IPPROTO_ESP
+}
+
+// Exprs returns expressions matching 4 bytes of the security parameters index at the start of the header
+func (e *ESP) Exprs() ([]expr.Any, error) {
+	if e.SPI < 256 {
+		return nil, fmt.Errorf("esp spi %d is reserved, it must be 256 or greater", e.SPI)
+	}
+
+	return header(e.L4Proto(), 0, []byte{0xff, 0xff, 0xff, 0xff}, binaryutil.BigEndian.PutUint32(e.SPI))
+}
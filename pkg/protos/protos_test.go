@@ -0,0 +1,149 @@
+package protos
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/google/nftables/expr"
+	"github.com/sbezverk/nftableslib"
+	"golang.org/x/sys/unix"
+)
+
+func TestMatchers(t *testing.T) {
+	yes, no := true, false
+	query, notImpl := uint8(0), uint8(4)
+	// match returns expressions expected for the ip protocol and the masked match at the offset
+	// of the transport header
+	match := func(l4proto uint8, offset uint32, mask, value []byte) []expr.Any {
+		re := []expr.Any{
+			&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{l4proto}},
+			&expr.Payload{DestRegister: unix.NFT_REG_3, Base: expr.PayloadBaseTransportHeader, Offset: offset, Len: uint32(len(mask))},
+		}
+		full := true
+		for _, b := range mask {
+			full = full && b == 0xff
+		}
+		if !full {
+			re = append(re, &expr.Bitwise{SourceRegister: unix.NFT_REG_3, DestRegister: unix.NFT_REG_3, Len: uint32(len(mask)), Mask: mask, Xor: make([]byte, len(mask))})
+		}
+		return append(re, &expr.Cmp{Op: expr.CmpOpEq, Register: unix.NFT_REG_3, Data: value})
+	}
+	tests := []struct {
+		name    string
+		m       Matcher
+		exprs   []expr.Any
+		success bool
+	}{
+		{
+			name:    "dns standard query",
+			m:       &DNS{QR: &no, Opcode: &query},
+			exprs:   match(unix.IPPROTO_UDP, 10, []byte{0xf8, 0x00}, []byte{0x00, 0x00}),
+			success: true,
+		},
+		{
+			name:    "dns truncated response not implemented",
+			m:       &DNS{QR: &yes, TC: &yes, RA: &no, RCode: &notImpl},
+			exprs:   match(unix.IPPROTO_UDP, 10, []byte{0x82, 0x8f}, []byte{0x82, 0x04}),
+			success: true,
+		},
+		{
+			name:    "dns recursion desired",
+			m:       &DNS{RD: &yes, AA: &no},
+			exprs:   match(unix.IPPROTO_UDP, 10, []byte{0x05, 0x00}, []byte{0x01, 0x00}),
+			success: true,
+		},
+		{
+			name:    "dhcp discover",
+			m:       &DHCP{MessageType: 1},
+			exprs:   match(unix.IPPROTO_UDP, 244, []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, []byte{0x63, 0x82, 0x53, 0x63, 0x35, 0x01, 0x01}),
+			success: true,
+		},
+		{
+			name:    "gre transparent ethernet bridging",
+			m:       &GRE{Protocol: 0x6558},
+			exprs:   match(unix.IPPROTO_GRE, 2, []byte{0xff, 0xff}, []byte{0x65, 0x58}),
+			success: true,
+		},
+		{
+			name:    "esp spi",
+			m:       &ESP{SPI: 0x1000},
+			exprs:   match(unix.IPPROTO_ESP, 0, []byte{0xff, 0xff, 0xff, 0xff}, []byte{0x00, 0x00, 0x10, 0x00}),
+			success: true,
+		},
+		{name: "dns without flags", m: &DNS{}},
+		{name: "dns opcode out of range", m: &DNS{Opcode: func() *uint8 { v := uint8(16); return &v }()}},
+		{name: "dhcp message type 0", m: &DHCP{}},
+		{name: "gre protocol 0", m: &GRE{}},
+		{name: "esp reserved spi", m: &ESP{SPI: 255}},
+	}
+	for _, tt := range tests {
+		exprs, err := tt.m.Exprs()
+		if err != nil && tt.success {
+			t.Fatalf("Test \"%s\" failed with error: %+v but supposed to succeed", tt.name, err)
+		}
+		if err == nil && !tt.success {
+			t.Fatalf("Test \"%s\" succeeded but supposed to fail", tt.name)
+		}
+		if tt.success && !reflect.DeepEqual(exprs, tt.exprs) {
+			t.Fatalf("Test \"%s\" failed, expected expressions %+v, got %+v", tt.name, tt.exprs, exprs)
+		}
+	}
+}
+
+func TestApply(t *testing.T) {
+	udp := uint32(unix.IPPROTO_UDP)
+	tests := []struct {
+		name    string
+		rule    *nftableslib.Rule
+		m       Matcher
+		success bool
+	}{
+		{
+			name:    "dhcp in rule matching udp port",
+			rule:    &nftableslib.Rule{L4: &nftableslib.L4Rule{L4Proto: unix.IPPROTO_UDP, Dst: &nftableslib.Port{List: []uint16{67}}}},
+			m:       &DHCP{MessageType: 1},
+			success: true,
+		},
+		{
+			name:    "esp in rule without l4",
+			rule:    &nftableslib.Rule{},
+			m:       &ESP{SPI: 0x1000},
+			success: true,
+		},
+		{
+			name: "dhcp in rule matching tcp",
+			rule: &nftableslib.Rule{L4: &nftableslib.L4Rule{L4Proto: unix.IPPROTO_TCP, Dst: &nftableslib.Port{List: []uint16{53}}}},
+			m:    &DHCP{MessageType: 1},
+		},
+		{
+			name: "gre in rule matching udp protocol",
+			rule: &nftableslib.Rule{L3: &nftableslib.L3Rule{Protocol: &udp}},
+			m:    &GRE{Protocol: 0x0800},
+		},
+		{
+			name: "dns in rule matching inner header",
+			rule: &nftableslib.Rule{L4: &nftableslib.L4Rule{L4Proto: unix.IPPROTO_UDP, Inner: &nftableslib.InnerHeader{}}},
+			m:    &DNS{RCode: new(uint8)},
+		},
+	}
+	for _, tt := range tests {
+		err := Apply(tt.rule, tt.m)
+		if err != nil && tt.success {
+			t.Fatalf("Test \"%s\" failed with error: %+v but supposed to succeed", tt.name, err)
+		}
+		if err == nil && !tt.success {
+			t.Fatalf("Test \"%s\" succeeded but supposed to fail", tt.name)
+		}
+		if !tt.success {
+			continue
+		}
+		want, _ := tt.m.Exprs()
+		if !reflect.DeepEqual(tt.rule.RawExprs, want) {
+			t.Fatalf("Test \"%s\" failed, expected raw expressions %+v, got %+v", tt.name, want, tt.rule.RawExprs)
+		}
+		if err := tt.rule.Validate(); err != nil {
+			t.Fatalf("Test \"%s\" failed, rule is invalid with error: %+v", tt.name, err)
+		}
+	}
+}